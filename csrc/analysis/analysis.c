@@ -176,6 +176,16 @@ void omni_analysis_free(AnalysisContext* ctx) {
     free_thread_locality(ctx->thread_locality);
     free_thread_spawns(ctx->thread_spawns);
     free_channel_ops(ctx->channel_ops);
+    for (size_t i = 0; i < ctx->warning_count; i++) {
+        free(ctx->warnings[i]);
+    }
+    free(ctx->warnings);
+    free(ctx->warning_at);
+    for (size_t i = 0; i < ctx->error_count; i++) {
+        free(ctx->errors[i]);
+    }
+    free(ctx->errors);
+    free(ctx->error_at);
     free(ctx);
 }
 
@@ -265,6 +275,41 @@ static OwnerInfo* find_or_create_owner_info(AnalysisContext* ctx, const char* na
     return o;
 }
 
+/* Values that reference no other object: string literals and the
+ * string primitives that build a new string */
+static bool is_leaf_value(OmniValue* v) {
+    if (omni_is_string(v)) return true;
+    if (!omni_is_cell(v) || !omni_is_sym(omni_car(v))) return false;
+    const char* op = omni_car(v)->str_val;
+    return strcmp(op, "string-append") == 0 || strcmp(op, "substring") == 0;
+}
+
+/* Freshly built vectors: (vector ...), (make-vector n x) and [...] */
+static bool is_vector_value(OmniValue* v) {
+    if (omni_is_array(v)) return true;
+    if (!omni_is_cell(v) || !omni_is_sym(omni_car(v))) return false;
+    const char* op = omni_car(v)->str_val;
+    return strcmp(op, "vector") == 0 || strcmp(op, "make-vector") == 0;
+}
+
+/* A fresh hash table: (hash) with no arguments */
+static bool is_hash_value(OmniValue* v) {
+    return omni_is_cell(v) && omni_is_sym(omni_car(v)) &&
+           strcmp(omni_car(v)->str_val, "hash") == 0 && omni_is_nil(omni_cdr(v));
+}
+
+/* A variable bound to a leaf is scalar-shaped: freeing it never recurses.
+ * Vector slots are strong fields that may share one object (make-vector
+ * fills every slot with the same one), so a vector is DAG-shaped and its
+ * slots are released through their counts when it is freed. Hash table
+ * entries are shared the same way with hash-keys and hash-get results. */
+static void note_binding(AnalysisContext* ctx, const char* name, OmniValue* val) {
+    if (is_leaf_value(val)) find_or_create_owner_info(ctx, name)->shape = SHAPE_SCALAR;
+    else if (is_vector_value(val) || is_hash_value(val)) {
+        find_or_create_owner_info(ctx, name)->shape = SHAPE_DAG;
+    }
+}
+
 /* ============== Expression Analysis ============== */
 
 static void analyze_expr(AnalysisContext* ctx, OmniValue* expr);
@@ -305,6 +350,7 @@ static void analyze_define(AnalysisContext* ctx, OmniValue* expr) {
         ctx->position++;
 
         if (!omni_is_nil(body)) {
+            note_binding(ctx, name_or_sig->str_val, omni_car(body));
             analyze_expr(ctx, omni_car(body));
         }
     } else if (omni_is_cell(name_or_sig)) {
@@ -362,6 +408,7 @@ static void analyze_let(AnalysisContext* ctx, OmniValue* expr) {
             OmniValue* val = bindings->array.data[i + 1];
             if (omni_is_sym(name)) {
                 mark_var_write(ctx, name->str_val);
+                note_binding(ctx, name->str_val, val);
                 ctx->position++;
             }
             analyze_expr(ctx, val);
@@ -376,6 +423,7 @@ static void analyze_let(AnalysisContext* ctx, OmniValue* expr) {
                 OmniValue* val = omni_car(omni_cdr(binding));
                 if (omni_is_sym(name)) {
                     mark_var_write(ctx, name->str_val);
+                    note_binding(ctx, name->str_val, val);
                     ctx->position++;
                 }
                 if (val) analyze_expr(ctx, val);
@@ -475,13 +523,14 @@ static void analyze_application(AnalysisContext* ctx, OmniValue* expr) {
 
     analyze_expr(ctx, func);
 
-    /* Arguments escape to the function */
+    /* Arguments escape to the function, unless it only reads them */
+    bool reads = omni_is_sym(func) && omni_primitive_reads_args(func->str_val);
     while (!omni_is_nil(args) && omni_is_cell(args)) {
         OmniValue* arg = omni_car(args);
         analyze_expr(ctx, arg);
 
         /* Mark as escaping via argument */
-        if (omni_is_sym(arg)) {
+        if (omni_is_sym(arg) && !reads) {
             set_escape_class(ctx, arg->str_val, ESCAPE_ARG);
         }
 
@@ -518,8 +567,9 @@ static void analyze_list(AnalysisContext* ctx, OmniValue* expr) {
             analyze_if(ctx, expr);
             return;
         }
-        if (strcmp(name, "quote") == 0) {
-            /* Quoted data - no analysis needed */
+        if (strcmp(name, "quote") == 0 || strcmp(name, "deftype") == 0 ||
+            strcmp(name, "defstruct") == 0) {
+            /* Quoted data and type definitions - no analysis needed */
             ctx->position++;
             return;
         }
@@ -551,6 +601,7 @@ static void analyze_expr(AnalysisContext* ctx, OmniValue* expr) {
     case OMNI_INT:
     case OMNI_FLOAT:
     case OMNI_CHAR:
+    case OMNI_STRING:
     case OMNI_KEYWORD:
         ctx->position++;
         break;
@@ -564,8 +615,12 @@ static void analyze_expr(AnalysisContext* ctx, OmniValue* expr) {
         break;
 
     case OMNI_ARRAY:
+        /* [a b ...] builds a vector: its slots share the items, as
+         * arguments to (vector a b ...) would */
         for (size_t i = 0; i < expr->array.len; i++) {
-            analyze_expr(ctx, expr->array.data[i]);
+            OmniValue* item = expr->array.data[i];
+            analyze_expr(ctx, item);
+            if (omni_is_sym(item)) set_escape_class(ctx, item->str_val, ESCAPE_ARG);
         }
         break;
 
@@ -588,10 +643,28 @@ void omni_analyze(AnalysisContext* ctx, OmniValue* expr) {
     analyze_expr(ctx, expr);
 }
 
+static void infer_ownership(AnalysisContext* ctx);
+
 void omni_analyze_program(AnalysisContext* ctx, OmniValue** exprs, size_t count) {
+    /* Summaries for top-level functions first, so a user definition
+     * shadows a primitive of the same name */
+    for (size_t i = 0; i < count; i++) {
+        OmniValue* e = exprs[i];
+        if (omni_is_cell(e) && omni_is_sym(omni_car(e)) &&
+            strcmp(omni_car(e)->str_val, "define") == 0 && omni_is_cell(omni_car(omni_cdr(e)))) {
+            omni_analyze_function_summary(ctx, e);
+        }
+        omni_analyze_shape(ctx, e);
+    }
+    omni_register_primitive_summaries(ctx);
     for (size_t i = 0; i < count; i++) {
         analyze_expr(ctx, exprs[i]);
     }
+    infer_ownership(ctx);
+    /* Which variables threads share, so codegen counts them atomically */
+    for (size_t i = 0; i < count; i++) {
+        omni_analyze_concurrency(ctx, exprs[i]);
+    }
 }
 
 void omni_analyze_liveness(AnalysisContext* ctx, OmniValue* expr) {
@@ -609,6 +682,10 @@ void omni_analyze_ownership(AnalysisContext* ctx, OmniValue* expr) {
     analyze_expr(ctx, expr);
 
     /* Second pass: determine ownership based on escape */
+    infer_ownership(ctx);
+}
+
+static void infer_ownership(AnalysisContext* ctx) {
     for (VarUsage* u = ctx->var_usages; u; u = u->next) {
         OwnerInfo* o = find_or_create_owner_info(ctx, u->name);
 
@@ -636,8 +713,11 @@ void omni_analyze_ownership(AnalysisContext* ctx, OmniValue* expr) {
             o->is_unique = false;  /* Escape analysis found aliasing */
         }
 
-        /* Determine shape from escape info and type hints */
-        if (e) {
+        /* Determine shape from escape info and type hints; leaves,
+         * vectors and hash tables keep the shape their binding gave them */
+        if (o->shape == SHAPE_SCALAR || o->shape == SHAPE_DAG) {
+            /* Strings: no children to free; vectors, tables: shared slots */
+        } else if (e) {
             /* Simple heuristic: params tend to be tree-shaped in Lisp */
             o->shape = SHAPE_TREE;
         } else {
@@ -745,35 +825,20 @@ static void add_back_edge_field(ShapeInfo* s, const char* field_name) {
     s->back_edge_fields[s->back_edge_count++] = strdup(field_name);
 }
 
-void omni_analyze_shape(AnalysisContext* ctx, OmniValue* type_def) {
-    /* Analyze a type definition for cyclic references
-     *
-     * Expected form: (defstruct type-name (field1 type1) (field2 type2) ...)
-     * or: (deftype type-name ...)
-     */
-    if (!omni_is_cell(type_def)) return;
-
-    OmniValue* head = omni_car(type_def);
-    if (!omni_is_sym(head)) return;
-
-    const char* form = head->str_val;
-    if (strcmp(form, "defstruct") != 0 && strcmp(form, "deftype") != 0) {
-        return;  /* Not a type definition */
-    }
-
-    OmniValue* rest = omni_cdr(type_def);
-    if (!omni_is_cell(rest)) return;
-
-    /* Get type name */
-    OmniValue* name_val = omni_car(rest);
-    if (!omni_is_sym(name_val)) return;
-    const char* type_name = name_val->str_val;
+/* Whether a field definition ends with :weak */
+static bool weak_marked(OmniValue* field_def) {
+    OmniValue* last = NULL;
+    for (OmniValue* p = omni_cdr(field_def); omni_is_cell(p); p = omni_cdr(p)) last = omni_car(p);
+    return omni_is_keyword(last) && strcmp(last->str_val, "weak") == 0;
+}
 
+/* The shape of type_name from its field specs; a field of the type
+ * itself, or of the sum type it is a variant of, is a self-reference */
+static ShapeClass analyze_fields(AnalysisContext* ctx, const char* type_name, const char* sum,
+                                 OmniValue* fields) {
     ShapeInfo* shape = find_or_create_shape_info(ctx, type_name);
     shape->shape = SHAPE_TREE;  /* Start optimistic */
 
-    /* Analyze fields */
-    OmniValue* fields = omni_cdr(rest);
     bool has_self_ref = false;
     bool has_back_edge = false;
 
@@ -787,8 +852,9 @@ void omni_analyze_shape(AnalysisContext* ctx, OmniValue* type_def) {
             if (omni_is_sym(field_name_val)) {
                 const char* field_name = field_name_val->str_val;
 
-                /* Check if this is a back-edge by name pattern */
-                if (is_back_edge_name(field_name)) {
+                /* Check if this is a back-edge by name pattern, or
+                 * marked as one: (prev Node :weak) */
+                if (is_back_edge_name(field_name) || weak_marked(field_def)) {
                     add_back_edge_field(shape, field_name);
                     has_back_edge = true;
                 }
@@ -798,7 +864,7 @@ void omni_analyze_shape(AnalysisContext* ctx, OmniValue* type_def) {
                     OmniValue* ft = omni_car(field_type_val);
                     if (omni_is_sym(ft)) {
                         const char* field_type = ft->str_val;
-                        if (strcmp(field_type, type_name) == 0) {
+                        if (strcmp(field_type, type_name) == 0 || (sum && strcmp(field_type, sum) == 0)) {
                             has_self_ref = true;
                             /* Self-reference with back-edge name → weak */
                             if (is_back_edge_name(field_name)) {
@@ -824,6 +890,49 @@ void omni_analyze_shape(AnalysisContext* ctx, OmniValue* type_def) {
         /* No self-references → pure tree */
         shape->shape = SHAPE_TREE;
     }
+    return shape->shape;
+}
+
+void omni_analyze_shape(AnalysisContext* ctx, OmniValue* type_def) {
+    /* Analyze a type definition for cyclic references
+     *
+     * Expected form: (defstruct type-name (field1 type1) (field2 type2) ...)
+     * or: (deftype type-name ...)
+     * or a sum type: (deftype type-name (Variant (field1 type1) ...) ...)
+     */
+    if (!omni_is_cell(type_def)) return;
+
+    OmniValue* head = omni_car(type_def);
+    if (!omni_is_sym(head)) return;
+
+    const char* form = head->str_val;
+    if (strcmp(form, "defstruct") != 0 && strcmp(form, "deftype") != 0) {
+        return;  /* Not a type definition */
+    }
+
+    OmniValue* rest = omni_cdr(type_def);
+    if (!omni_is_cell(rest)) return;
+
+    /* Get type name */
+    OmniValue* name_val = omni_car(rest);
+    if (!omni_is_sym(name_val)) return;
+    const char* type_name = name_val->str_val;
+
+    OmniValue* fields = omni_cdr(rest);
+    if (!omni_is_variant_spec(omni_car(fields))) {
+        analyze_fields(ctx, type_name, NULL, fields);
+        return;
+    }
+
+    /* Each variant is a type; the sum takes the least safe shape of them */
+    ShapeClass worst = SHAPE_TREE;
+    for (; omni_is_cell(fields); fields = omni_cdr(fields)) {
+        OmniValue* variant = omni_car(fields);
+        if (!omni_is_variant_spec(variant)) continue;
+        ShapeClass s = analyze_fields(ctx, omni_car(variant)->str_val, type_name, omni_cdr(variant));
+        if (s > worst) worst = s;
+    }
+    find_or_create_shape_info(ctx, type_name)->shape = worst;
 }
 
 /* Helper: (cadr x) = (car (cdr x)) */
@@ -867,7 +976,7 @@ void omni_analyze_reuse(AnalysisContext* ctx, OmniValue* expr) {
 
     /* For primitives, no reuse analysis needed */
     if (omni_is_int(expr) || omni_is_float(expr) ||
-        omni_is_char(expr) || omni_is_nil(expr)) {
+        omni_is_char(expr) || omni_is_string(expr) || omni_is_nil(expr)) {
         return;
     }
 
@@ -1008,6 +1117,26 @@ const char* omni_free_strategy_name(FreeStrategy strategy) {
     }
 }
 
+const char* omni_ownership_name(OwnershipKind kind) {
+    switch (kind) {
+        case OWNER_LOCAL:       return "local";
+        case OWNER_BORROWED:    return "borrowed";
+        case OWNER_TRANSFERRED: return "transferred";
+        case OWNER_SHARED:      return "shared";
+        default:                return "unknown";
+    }
+}
+
+const char* omni_shape_name(ShapeClass shape) {
+    switch (shape) {
+        case SHAPE_SCALAR: return "scalar";
+        case SHAPE_TREE:   return "tree";
+        case SHAPE_DAG:    return "dag";
+        case SHAPE_CYCLIC: return "cyclic";
+        default:           return "unknown";
+    }
+}
+
 FreeStrategy omni_get_free_strategy(AnalysisContext* ctx, const char* name) {
     OwnerInfo* o = omni_get_owner_info(ctx, name);
     if (!o) return FREE_STRATEGY_NONE;
@@ -1044,7 +1173,8 @@ FreeStrategy omni_get_free_strategy(AnalysisContext* ctx, const char* name) {
     /* Local ownership, non-unique */
     switch (o->shape) {
         case SHAPE_SCALAR:
-            return FREE_STRATEGY_UNIQUE;  /* Scalars are always "unique" */
+            /* A shared leaf may still be referenced elsewhere; free_tree
+             * checks the count and never recurses into a leaf */
         case SHAPE_TREE:
             return FREE_STRATEGY_TREE;
         case SHAPE_DAG:
@@ -1095,6 +1225,21 @@ bool omni_can_stack_alloc(AnalysisContext* ctx, const char* name) {
     return true;
 }
 
+/* Arithmetic, comparisons, predicates, accessors and printers: each
+ * result is new or a part of an argument, never an argument itself */
+static const char* g_reading_primitives[] = {
+    "+", "-", "*", "/", "%", "<", ">", "<=", ">=", "=", "min", "max", "expt", "gcd", "lcm", "sqrt",
+    "car", "cdr", "null?", "proper-list?", "error?", "eq?", "hash", "procedure?", "string?", "keyword?",
+    "length", "display", "print", "write",
+};
+
+bool omni_primitive_reads_args(const char* name) {
+    for (size_t i = 0; i < sizeof(g_reading_primitives) / sizeof(g_reading_primitives[0]); i++) {
+        if (strcmp(g_reading_primitives[i], name) == 0) return true;
+    }
+    return false;
+}
+
 bool omni_should_free_at(AnalysisContext* ctx, const char* name, int position) {
     OwnerInfo* o = omni_get_owner_info(ctx, name);
     if (!o) return false;
@@ -2225,7 +2370,8 @@ void omni_analyze_borrows(AnalysisContext* ctx, OmniValue* expr) {
 
     /* Skip primitives */
     if (omni_is_int(expr) || omni_is_float(expr) ||
-        omni_is_char(expr) || omni_is_nil(expr) || omni_is_sym(expr)) {
+        omni_is_char(expr) || omni_is_string(expr) || omni_is_nil(expr) ||
+        omni_is_sym(expr)) {
         return;
     }
 
@@ -2332,6 +2478,8 @@ static FunctionSummary* find_or_create_function_summary(AnalysisContext* ctx, co
     f->return_param_index = -1;
     f->allocates = false;
     f->has_side_effects = false;
+    f->effects = EFFECT_NONE;
+    f->effect_param = -1;
     f->next = ctx->function_summaries;
     ctx->function_summaries = f;
     return f;
@@ -2377,6 +2525,27 @@ static int get_param_index(FunctionSummary* func, const char* param_name) {
 /* Analyze body to determine parameter usage */
 static void analyze_body_for_summary(AnalysisContext* ctx, FunctionSummary* func, OmniValue* body, bool in_return_pos);
 
+/* Could calling fn, passed as an argument inside func, have side effects?
+ * Unknown functions (parameters, computed values) are assumed to. */
+static bool function_value_has_effects(AnalysisContext* ctx, FunctionSummary* func, OmniValue* fn) {
+    if (omni_is_sym(fn)) {
+        if (get_param_by_name(func, fn->str_val)) return true;
+        /* Without a summary (e.g. display) assume the worst */
+        FunctionSummary* s = omni_get_function_summary(ctx, fn->str_val);
+        return !s || s->has_side_effects || s->effect_param >= 0;
+    }
+    if (omni_is_cell(fn) && omni_is_sym(omni_car(fn)) &&
+        (strcmp(omni_car(fn)->str_val, "lambda") == 0 ||
+         strcmp(omni_car(fn)->str_val, "fn") == 0)) {
+        FunctionSummary body_summary = { .name = "<lambda>", .effect_param = -1 };
+        for (OmniValue* b = omni_cdr(omni_cdr(fn)); omni_is_cell(b); b = omni_cdr(b)) {
+            analyze_body_for_summary(ctx, &body_summary, omni_car(b), false);
+        }
+        return body_summary.has_side_effects;
+    }
+    return true;
+}
+
 static void analyze_body_for_summary(AnalysisContext* ctx, FunctionSummary* func, OmniValue* body, bool in_return_pos) {
     if (!body || omni_is_nil(body)) return;
 
@@ -2410,7 +2579,10 @@ static void analyze_body_for_summary(AnalysisContext* ctx, FunctionSummary* func
 
     /* Check for allocation forms */
     if (strcmp(form, "cons") == 0 || strcmp(form, "list") == 0 ||
-        strcmp(form, "vector") == 0 || strcmp(form, "make") == 0 ||
+        strcmp(form, "vector") == 0 || strcmp(form, "make-vector") == 0 ||
+        strcmp(form, "hash") == 0 || strcmp(form, "make") == 0 ||
+        strcmp(form, "nursery") == 0 || strcmp(form, "make-cancel") == 0 ||
+        strcmp(form, "future") == 0 ||
         strcmp(form, "mk-int") == 0 || strcmp(form, "mk-float") == 0 ||
         strcmp(form, "new") == 0) {
         func->allocates = true;
@@ -2420,11 +2592,43 @@ static void analyze_body_for_summary(AnalysisContext* ctx, FunctionSummary* func
     }
 
     /* Check for side effects */
-    if (strcmp(form, "set!") == 0 || strcmp(form, "display") == 0 ||
+    if (strcmp(form, "set!") == 0 || strcmp(form, "vector-set!") == 0 ||
+        strcmp(form, "hash-set!") == 0 || strcmp(form, "hash-remove!") == 0 ||
+        strcmp(form, "assoc!") == 0 || strcmp(form, "dissoc!") == 0 ||
+        strcmp(form, "conj!") == 0 || strcmp(form, "persistent!") == 0 ||
+        strcmp(form, "display") == 0 ||
         strcmp(form, "print") == 0 || strcmp(form, "write") == 0 ||
-        strcmp(form, "send!") == 0 || strcmp(form, "put!") == 0) {
+        strcmp(form, "read-line") == 0 || strcmp(form, "read-char") == 0 ||
+        strcmp(form, "close-port") == 0 || strcmp(form, "flush-port") == 0 ||
+        strcmp(form, "set-port-buffer!") == 0 ||
+        strcmp(form, "send!") == 0 || strcmp(form, "put!") == 0 ||
+        strcmp(form, "spawn") == 0 || strcmp(form, "future") == 0 ||
+        strcmp(form, "go") == 0 || strcmp(form, "cancel!") == 0 ||
+        strcmp(form, "make-pool") == 0 || strcmp(form, "pool-submit") == 0) {
         func->has_side_effects = true;
     }
+    if (strcmp(form, "display") == 0 || strcmp(form, "print") == 0 ||
+        strcmp(form, "write") == 0 || strcmp(form, "read-line") == 0 ||
+        strcmp(form, "read-char") == 0 || strcmp(form, "close-port") == 0 ||
+        strcmp(form, "flush-port") == 0) {
+        func->effects |= EFFECT_IO;
+    }
+    if (strcmp(form, "send!") == 0 || strcmp(form, "put!") == 0 ||
+        strcmp(form, "spawn") == 0 || strcmp(form, "future") == 0 ||
+        strcmp(form, "go") == 0 || strcmp(form, "cancel!") == 0 ||
+        strcmp(form, "make-pool") == 0 || strcmp(form, "pool-submit") == 0) {
+        func->effects |= EFFECT_CONCURRENT;
+    }
+    if (strcmp(form, "set!") == 0 || strcmp(form, "vector-set!") == 0 ||
+        strcmp(form, "hash-set!") == 0 || strcmp(form, "hash-remove!") == 0 ||
+        strcmp(form, "assoc!") == 0 || strcmp(form, "dissoc!") == 0 ||
+        strcmp(form, "conj!") == 0 || strcmp(form, "persistent!") == 0 ||
+        strcmp(form, "user%set") == 0) {
+        func->effects |= EFFECT_MUTATE;
+    }
+    if (strcmp(form, "error") == 0 || strcmp(form, "assert") == 0) {
+        func->effects |= EFFECT_THROW;
+    }
 
     /* Check for consuming operations - these consume their arguments */
     if (strcmp(form, "free") == 0 || strcmp(form, "free!") == 0) {
@@ -2447,6 +2651,31 @@ static void analyze_body_for_summary(AnalysisContext* ctx, FunctionSummary* func
         return;
     }
 
+    /* Handle cond and case - the last form of each clause is returned,
+     * and so is a cond test with no forms after it */
+    if (strcmp(form, "cond") == 0 || strcmp(form, "case") == 0) {
+        bool is_case = strcmp(form, "case") == 0;
+        OmniValue* clauses = omni_cdr(body);
+        if (is_case && omni_is_cell(clauses)) {
+            analyze_body_for_summary(ctx, func, omni_car(clauses), false);  /* key */
+            clauses = omni_cdr(clauses);
+        }
+        for (; omni_is_cell(clauses); clauses = omni_cdr(clauses)) {
+            OmniValue* clause = omni_car(clauses);
+            if (!omni_is_cell(clause)) continue;
+            OmniValue* forms = omni_cdr(clause);
+            if (!is_case) {
+                analyze_body_for_summary(ctx, func, omni_car(clause),
+                                         in_return_pos && !omni_is_cell(forms));
+            }
+            for (; omni_is_cell(forms); forms = omni_cdr(forms)) {
+                bool is_last = !omni_is_cell(omni_cdr(forms));
+                analyze_body_for_summary(ctx, func, omni_car(forms), in_return_pos && is_last);
+            }
+        }
+        return;
+    }
+
     /* Handle let - check for captures */
     if (strcmp(form, "let") == 0 || strcmp(form, "let*") == 0) {
         OmniValue* bindings = cadr(body);
@@ -2507,6 +2736,23 @@ static void analyze_body_for_summary(AnalysisContext* ctx, FunctionSummary* func
         return;
     }
 
+    /* Calls like (for-each f xs) have the effects of the f they are given,
+     * and calls like (sleep-ms 10) the primitive's own */
+    FunctionSummary* callee = omni_get_function_summary(ctx, form);
+    if (callee && callee->effects != EFFECT_NONE) {
+        func->has_side_effects = true;
+        func->effects |= callee->effects;
+    }
+    if (callee && callee->effect_param >= 0) {
+        OmniValue* arg = omni_cdr(body);
+        for (int i = 0; i < callee->effect_param && omni_is_cell(arg); i++) {
+            arg = omni_cdr(arg);
+        }
+        if (omni_is_cell(arg) && function_value_has_effects(ctx, func, omni_car(arg))) {
+            func->has_side_effects = true;
+        }
+    }
+
     /* Default: recurse on all subexpressions */
     for (OmniValue* rest = omni_cdr(body); omni_is_cell(rest); rest = omni_cdr(rest)) {
         analyze_body_for_summary(ctx, func, omni_car(rest), false);
@@ -2541,7 +2787,7 @@ void omni_analyze_function_summary(AnalysisContext* ctx, OmniValue* func_def) {
             if (!omni_is_sym(fname)) return;
             func_name = fname->str_val;
             params = omni_cdr(name_or_sig);
-            body = caddr(func_def);
+            body = omni_cdr(omni_cdr(func_def));
         } else if (omni_is_sym(name_or_sig)) {
             /* (define name (lambda (params...) body...)) */
             func_name = name_or_sig->str_val;
@@ -2552,7 +2798,7 @@ void omni_analyze_function_summary(AnalysisContext* ctx, OmniValue* func_def) {
                     (strcmp(val_head->str_val, "lambda") == 0 ||
                      strcmp(val_head->str_val, "fn") == 0)) {
                     params = cadr(val);
-                    body = caddr(val);
+                    body = omni_cdr(omni_cdr(val));
                 }
             }
         }
@@ -2562,12 +2808,12 @@ void omni_analyze_function_summary(AnalysisContext* ctx, OmniValue* func_def) {
         if (!omni_is_sym(name_val)) return;
         func_name = name_val->str_val;
         params = caddr(func_def);
-        body = caddr(omni_cdr(func_def));  /* cadddr */
+        body = cdddr(func_def);
     } else if (strcmp(form, "lambda") == 0 || strcmp(form, "fn") == 0) {
         /* Anonymous lambda - use position-based name */
         func_name = "<lambda>";
         params = cadr(func_def);
-        body = caddr(func_def);
+        body = omni_cdr(omni_cdr(func_def));
     } else {
         return;  /* Not a function definition */
     }
@@ -2594,9 +2840,10 @@ void omni_analyze_function_summary(AnalysisContext* ctx, OmniValue* func_def) {
         }
     }
 
-    /* Analyze body for ownership patterns */
-    if (body) {
-        analyze_body_for_summary(ctx, summary, body, true);
+    /* Analyze body for ownership patterns; every form has its effects,
+     * and the last is the one returned */
+    for (OmniValue* b = body; omni_is_cell(b); b = omni_cdr(b)) {
+        analyze_body_for_summary(ctx, summary, omni_car(b), omni_is_nil(omni_cdr(b)));
     }
 
     /* If body is nil/empty, return RETURN_NONE */
@@ -2605,6 +2852,56 @@ void omni_analyze_function_summary(AnalysisContext* ctx, OmniValue* func_def) {
     }
 }
 
+/* Primitive summaries: borrowed arguments. The numeric library has no
+ * effects; the higher-order list operations call their function argument
+ * (parameter 0) and so have whatever effects it has; the timers read the
+ * clock or give up the processor, and runtime-config reads what the
+ * environment set when the program started. */
+static const struct {
+    const char* name;
+    int arity;
+    int effect_param;
+    ReturnOwnership ret;
+    unsigned effects;
+} g_primitive_summaries[] = {
+    { "min", 2, -1, RETURN_FRESH, EFFECT_NONE },
+    { "max", 2, -1, RETURN_FRESH, EFFECT_NONE },
+    { "expt", 2, -1, RETURN_FRESH, EFFECT_NONE },
+    { "gcd", 2, -1, RETURN_FRESH, EFFECT_NONE },
+    { "lcm", 2, -1, RETURN_FRESH, EFFECT_NONE },
+    { "sqrt", 1, -1, RETURN_FRESH, EFFECT_NONE },
+    { "map", 2, 0, RETURN_FRESH, EFFECT_NONE },
+    { "filter", 2, 0, RETURN_FRESH, EFFECT_NONE },
+    { "fold", 3, 0, RETURN_FRESH, EFFECT_NONE },
+    { "for-each", 2, 0, RETURN_NONE, EFFECT_NONE },
+    { "sleep-ms", 1, -1, RETURN_NONE, EFFECT_IO | EFFECT_CONCURRENT },
+    { "yield", 0, -1, RETURN_NONE, EFFECT_CONCURRENT },
+    { "monotonic-millis", 0, -1, RETURN_FRESH, EFFECT_IO },
+    { "runtime-config", 1, -1, RETURN_FRESH, EFFECT_IO },
+};
+
+void omni_register_primitive_summaries(AnalysisContext* ctx) {
+    static const char* param_names[] = { "a", "b", "c" };
+    size_t n = sizeof(g_primitive_summaries) / sizeof(g_primitive_summaries[0]);
+    for (size_t i = 0; i < n; i++) {
+        if (omni_get_function_summary(ctx, g_primitive_summaries[i].name)) continue;
+        FunctionSummary* f = find_or_create_function_summary(ctx, g_primitive_summaries[i].name);
+        for (int j = 0; j < g_primitive_summaries[i].arity; j++) {
+            add_param_summary(f, param_names[j]);
+        }
+        f->return_ownership = g_primitive_summaries[i].ret;
+        f->allocates = f->return_ownership == RETURN_FRESH;
+        f->effects = g_primitive_summaries[i].effects;
+        f->has_side_effects = f->effects != EFFECT_NONE;
+        f->effect_param = g_primitive_summaries[i].effect_param;
+    }
+}
+
+bool omni_function_is_pure(AnalysisContext* ctx, const char* func_name) {
+    FunctionSummary* f = omni_get_function_summary(ctx, func_name);
+    return f && !f->has_side_effects && f->effect_param < 0;
+}
+
 FunctionSummary* omni_get_function_summary(AnalysisContext* ctx, const char* func_name) {
     for (FunctionSummary* f = ctx->function_summaries; f; f = f->next) {
         if (strcmp(f->name, func_name) == 0) return f;
@@ -2663,6 +2960,762 @@ bool omni_caller_should_free_arg(AnalysisContext* ctx, const char* func_name,
     }
 }
 
+/* ============== Dead Code ============== */
+
+/* Warning msg about node, in the 1-based top-level form; node may be
+ * NULL or one macro expansion made, with no position */
+static void add_warning(AnalysisContext* ctx, size_t form, OmniValue* node, const char* msg) {
+    if (ctx->warning_count >= ctx->warning_capacity) {
+        ctx->warning_capacity = ctx->warning_capacity ? ctx->warning_capacity * 2 : 8;
+        ctx->warnings = realloc(ctx->warnings, ctx->warning_capacity * sizeof(char*));
+        ctx->warning_at = realloc(ctx->warning_at, ctx->warning_capacity * sizeof(OmniLocation));
+    }
+    OmniLocation at = { form, node ? node->line : 0, node ? node->column : 0 };
+    ctx->warning_at[ctx->warning_count] = at;
+    ctx->warnings[ctx->warning_count++] = strdup(msg);
+}
+
+static void dead_code_expr(AnalysisContext* ctx, OmniValue* expr, bool value_used, size_t form);
+
+/* A sequence: only the last value can be used */
+static void dead_code_body(AnalysisContext* ctx, OmniValue* body, bool value_used, size_t form) {
+    for (; omni_is_cell(body); body = omni_cdr(body)) {
+        bool is_last = !omni_is_cell(omni_cdr(body));
+        dead_code_expr(ctx, omni_car(body), is_last && value_used, form);
+    }
+}
+
+static void dead_code_expr(AnalysisContext* ctx, OmniValue* expr, bool value_used, size_t form) {
+    if (!omni_is_cell(expr)) return;
+
+    OmniValue* head = omni_car(expr);
+    if (omni_is_sym(head)) {
+        const char* name = head->str_val;
+        if (strcmp(name, "quote") == 0) return;
+
+        if (!value_used && strcmp(name, "map") == 0) {
+            add_warning(ctx, form, expr,
+                        "result of map is discarded; use for-each to iterate for effects only");
+        }
+
+        if (strcmp(name, "do") == 0 || strcmp(name, "begin") == 0 ||
+            strcmp(name, "progn") == 0) {
+            dead_code_body(ctx, omni_cdr(expr), value_used, form);
+            return;
+        }
+        if (strcmp(name, "lambda") == 0 || strcmp(name, "fn") == 0) {
+            dead_code_body(ctx, omni_cdr(omni_cdr(expr)), true, form);
+            return;
+        }
+        if (strcmp(name, "define") == 0) {
+            /* A function body returns its last value; a variable keeps it */
+            dead_code_body(ctx, omni_cdr(omni_cdr(expr)), true, form);
+            return;
+        }
+        if (strcmp(name, "let") == 0 || strcmp(name, "let*") == 0 ||
+            strcmp(name, "letrec") == 0) {
+            dead_code_expr(ctx, cadr(expr), true, form);
+            dead_code_body(ctx, omni_cdr(omni_cdr(expr)), value_used, form);
+            return;
+        }
+        if (strcmp(name, "if") == 0) {
+            OmniValue* rest = omni_cdr(expr);
+            if (!omni_is_cell(rest)) return;
+            dead_code_expr(ctx, omni_car(rest), true, form);
+            for (rest = omni_cdr(rest); omni_is_cell(rest); rest = omni_cdr(rest)) {
+                dead_code_expr(ctx, omni_car(rest), value_used, form);
+            }
+            return;
+        }
+        if (strcmp(name, "cond") == 0 || strcmp(name, "case") == 0) {
+            bool is_case = strcmp(name, "case") == 0;
+            OmniValue* rest = omni_cdr(expr);
+            if (is_case && omni_is_cell(rest)) {
+                dead_code_expr(ctx, omni_car(rest), true, form);
+                rest = omni_cdr(rest);
+            }
+            for (; omni_is_cell(rest); rest = omni_cdr(rest)) {
+                OmniValue* clause = omni_car(rest);
+                if (!omni_is_cell(clause)) continue;
+                if (!is_case) dead_code_expr(ctx, omni_car(clause), true, form);
+                dead_code_body(ctx, omni_cdr(clause), value_used, form);
+            }
+            return;
+        }
+    }
+
+    /* A call uses its operator and every operand */
+    for (OmniValue* rest = expr; omni_is_cell(rest); rest = omni_cdr(rest)) {
+        dead_code_expr(ctx, omni_car(rest), true, form);
+    }
+}
+
+void omni_analyze_dead_code(AnalysisContext* ctx, OmniValue** exprs, size_t count,
+                            bool results_used) {
+    for (size_t i = 0; i < count; i++) {
+        dead_code_expr(ctx, exprs[i], results_used, i + 1);
+    }
+}
+
+size_t omni_analysis_warning_count(AnalysisContext* ctx) {
+    return ctx ? ctx->warning_count : 0;
+}
+
+const char* omni_analysis_get_warning(AnalysisContext* ctx, size_t index) {
+    if (!ctx || index >= ctx->warning_count) return NULL;
+    return ctx->warnings[index];
+}
+
+OmniLocation omni_analysis_get_warning_location(AnalysisContext* ctx, size_t index) {
+    OmniLocation none = { 0, 0, 0 };
+    if (!ctx || index >= ctx->warning_count) return none;
+    return ctx->warning_at[index];
+}
+
+/* ============== Initialization and Dead Stores ============== */
+
+/*
+ * A forward pass over each top-level form that tracks, per path, whether a
+ * variable has been given a value and which stores to it could still be
+ * read. Branches (if, and, or) copy the state and join it afterwards.
+ * Closure bodies run later, so reads inside them are never "before"
+ * anything; they only mark the captured variable's stores as read.
+ */
+
+typedef enum { DF_UNINIT, DF_INIT, DF_MAYBE } DfInit;
+
+typedef enum {
+    DF_GLOBAL,      /* Top-level define */
+    DF_LOCAL,       /* let, let*, parameter */
+    DF_LETREC       /* letrec: unbound until its init has run */
+} DfKind;
+
+typedef struct DfBinding {
+    const char* name;
+    DfKind kind;
+    int depth;                  /* Lambda nesting it is bound at */
+    bool captured;              /* Used by a closure: every store may be read */
+    bool assigned;              /* Target of some set! */
+    struct DfBinding* next;     /* All bindings, for freeing */
+} DfBinding;
+
+typedef struct DfStore {
+    DfBinding* binding;
+    bool is_init;               /* The value bound by let, not a set! */
+    bool read;                  /* Read on some path */
+    size_t form;
+    const char* fn;
+    OmniValue* at;              /* The binding or set! that stores, for its position */
+    struct DfStore* next;       /* All stores, in program order */
+} DfStore;
+
+typedef struct {
+    DfBinding* binding;
+    DfInit init;
+    DfStore** pending;          /* Stores not yet overwritten on this path */
+    size_t pending_count;
+} DfSlot;
+
+typedef struct {
+    DfSlot* slots;
+    size_t count;
+    size_t capacity;
+} DfState;
+
+typedef struct {
+    AnalysisContext* ctx;
+    int depth;                  /* Current lambda nesting */
+    size_t form;                /* 1-based top-level form being walked */
+    const char* fn;             /* Enclosing top-level definition, if any */
+    OmniValue* located;         /* Innermost parsed node being walked */
+    DfBinding* bindings;
+    DfStore* stores;
+    DfStore** stores_tail;
+} Dataflow;
+
+static void add_error(Dataflow* df, const char* msg) {
+    AnalysisContext* ctx = df->ctx;
+    for (size_t i = 0; i < ctx->error_count; i++) {
+        if (strcmp(ctx->errors[i], msg) == 0) return;
+    }
+    if (ctx->error_count >= ctx->error_capacity) {
+        ctx->error_capacity = ctx->error_capacity ? ctx->error_capacity * 2 : 8;
+        ctx->errors = realloc(ctx->errors, ctx->error_capacity * sizeof(char*));
+        ctx->error_at = realloc(ctx->error_at, ctx->error_capacity * sizeof(OmniLocation));
+    }
+    OmniLocation at = { df->form, 0, 0 };
+    if (df->located) {
+        at.line = df->located->line;
+        at.column = df->located->column;
+    }
+    ctx->error_at[ctx->error_count] = at;
+    ctx->errors[ctx->error_count++] = strdup(msg);
+}
+
+/* "in f: " inside a definition, else nothing: the error is located at
+ * the use, so the form is not named */
+static void df_where(char* buf, size_t size, const char* fn) {
+    if (fn) snprintf(buf, size, "in %s: ", fn);
+    else buf[0] = '\0';
+}
+
+static void df_state_free(DfState* st) {
+    for (size_t i = 0; i < st->count; i++) free(st->slots[i].pending);
+    free(st->slots);
+    st->slots = NULL;
+    st->count = st->capacity = 0;
+}
+
+static void df_state_copy(DfState* dst, const DfState* src) {
+    dst->count = dst->capacity = src->count;
+    dst->slots = src->count ? malloc(src->count * sizeof(DfSlot)) : NULL;
+    for (size_t i = 0; i < src->count; i++) {
+        const DfSlot* s = &src->slots[i];
+        dst->slots[i] = *s;
+        dst->slots[i].pending = NULL;
+        if (s->pending_count) {
+            dst->slots[i].pending = malloc(s->pending_count * sizeof(DfStore*));
+            memcpy(dst->slots[i].pending, s->pending, s->pending_count * sizeof(DfStore*));
+        }
+    }
+}
+
+static void df_add_pending(DfSlot* slot, DfStore* store) {
+    for (size_t i = 0; i < slot->pending_count; i++) {
+        if (slot->pending[i] == store) return;
+    }
+    slot->pending = realloc(slot->pending, (slot->pending_count + 1) * sizeof(DfStore*));
+    slot->pending[slot->pending_count++] = store;
+}
+
+/* Merge the state after another branch into st; both have the same slots */
+static void df_join(DfState* st, const DfState* other) {
+    for (size_t i = 0; i < st->count && i < other->count; i++) {
+        DfSlot* a = &st->slots[i];
+        const DfSlot* b = &other->slots[i];
+        if (a->init != b->init) a->init = DF_MAYBE;
+        for (size_t j = 0; j < b->pending_count; j++) df_add_pending(a, b->pending[j]);
+    }
+}
+
+static void df_push(Dataflow* df, DfState* st, const char* name, DfKind kind, DfInit init) {
+    DfBinding* b = calloc(1, sizeof(DfBinding));
+    b->name = name;
+    b->kind = kind;
+    b->depth = df->depth;
+    b->next = df->bindings;
+    df->bindings = b;
+
+    if (st->count >= st->capacity) {
+        st->capacity = st->capacity ? st->capacity * 2 : 16;
+        st->slots = realloc(st->slots, st->capacity * sizeof(DfSlot));
+    }
+    st->slots[st->count++] = (DfSlot){ b, init, NULL, 0 };
+}
+
+static void df_pop(DfState* st, size_t count) {
+    while (st->count > count) free(st->slots[--st->count].pending);
+}
+
+static DfSlot* df_find(DfState* st, const char* name) {
+    for (size_t i = st->count; i > 0; i--) {
+        if (strcmp(st->slots[i - 1].binding->name, name) == 0) return &st->slots[i - 1];
+    }
+    return NULL;
+}
+
+/* The slot now holds a new value, stored by node at; earlier stores on
+ * this path are dead */
+static void df_store(Dataflow* df, DfSlot* slot, bool is_init, OmniValue* at) {
+    DfBinding* b = slot->binding;
+    slot->init = DF_INIT;
+    slot->pending_count = 0;
+    if (b->kind == DF_GLOBAL) return;   /* Any later form may read a global */
+
+    DfStore* store = calloc(1, sizeof(DfStore));
+    store->binding = b;
+    store->is_init = is_init;
+    store->read = b->captured || df->depth > b->depth;
+    store->form = df->form;
+    store->fn = df->fn;
+    store->at = at && at->line ? at : df->located;
+    *df->stores_tail = store;
+    df->stores_tail = &store->next;
+    df_add_pending(slot, store);
+}
+
+static void df_read(Dataflow* df, DfState* st, const char* name) {
+    DfSlot* slot = df_find(st, name);
+    if (!slot) return;
+    for (size_t i = 0; i < slot->pending_count; i++) slot->pending[i]->read = true;
+
+    DfBinding* b = slot->binding;
+    if (df->depth > b->depth) {
+        /* A closure reads it whenever it is called */
+        b->captured = true;
+        return;
+    }
+    if (slot->init != DF_UNINIT) return;
+
+    char where[128], msg[512];
+    df_where(where, sizeof(where), df->fn);
+    if (b->kind == DF_LETREC) {
+        snprintf(msg, sizeof(msg),
+                 "E0008 %s%s is read before letrec initializes it "
+                 "(bind it earlier, or delay the use inside a lambda)",
+                 where, name);
+    } else {
+        snprintf(msg, sizeof(msg),
+                 "E0008 %s%s is read before its definition "
+                 "(move the definition above this use)",
+                 where, name);
+    }
+    add_error(df, msg);
+}
+
+static void df_expr(Dataflow* df, DfState* st, OmniValue* expr);
+
+static void df_body(Dataflow* df, DfState* st, OmniValue* body) {
+    for (; omni_is_cell(body); body = omni_cdr(body)) df_expr(df, st, omni_car(body));
+}
+
+static void df_lambda(Dataflow* df, DfState* st, OmniValue* params, OmniValue* body) {
+    DfState inner;
+    df_state_copy(&inner, st);
+    df->depth++;
+    for (; omni_is_cell(params); params = omni_cdr(params)) {
+        OmniValue* p = omni_car(params);
+        if (omni_is_sym(p)) df_push(df, &inner, p->str_val, DF_LOCAL, DF_INIT);
+    }
+    if (omni_is_sym(params)) df_push(df, &inner, params->str_val, DF_LOCAL, DF_INIT);
+    df_body(df, &inner, body);
+    df->depth--;
+    df_state_free(&inner);
+}
+
+/* Only unquoted parts of a template are evaluated */
+static void df_template(Dataflow* df, DfState* st, OmniValue* tmpl) {
+    if (!omni_is_cell(tmpl)) return;
+    OmniValue* head = omni_car(tmpl);
+    if (omni_is_sym(head) && (strcmp(head->str_val, "unquote") == 0 ||
+                              strcmp(head->str_val, "unquote-splicing") == 0)) {
+        df_expr(df, st, cadr(tmpl));
+        return;
+    }
+    for (; omni_is_cell(tmpl); tmpl = omni_cdr(tmpl)) df_template(df, st, omni_car(tmpl));
+}
+
+static void df_let(Dataflow* df, DfState* st, const char* form, OmniValue* expr) {
+    size_t mark = st->count;
+    OmniValue* bindings = cadr(expr);
+    bool sequential = strcmp(form, "let*") == 0;
+    bool recursive = strcmp(form, "letrec") == 0 || strcmp(form, "letrec*") == 0;
+
+    if (recursive) {
+        for (OmniValue* b = bindings; omni_is_cell(b); b = omni_cdr(b)) {
+            OmniValue* name = omni_is_cell(omni_car(b)) ? omni_car(omni_car(b)) : NULL;
+            if (omni_is_sym(name)) df_push(df, st, name->str_val, DF_LETREC, DF_UNINIT);
+        }
+        size_t i = mark;
+        for (OmniValue* b = bindings; omni_is_cell(b); b = omni_cdr(b)) {
+            OmniValue* name = omni_is_cell(omni_car(b)) ? omni_car(omni_car(b)) : NULL;
+            if (!omni_is_sym(name)) continue;
+            df_expr(df, st, cadr(omni_car(b)));
+            df_store(df, &st->slots[i++], true, omni_car(b));
+        }
+    } else if (sequential) {
+        for (OmniValue* b = bindings; omni_is_cell(b); b = omni_cdr(b)) {
+            OmniValue* name = omni_is_cell(omni_car(b)) ? omni_car(omni_car(b)) : NULL;
+            if (!omni_is_sym(name)) continue;
+            df_expr(df, st, cadr(omni_car(b)));
+            df_push(df, st, name->str_val, DF_LOCAL, DF_UNINIT);
+            df_store(df, &st->slots[st->count - 1], true, omni_car(b));
+        }
+    } else {
+        /* Every init runs before any name is bound */
+        for (OmniValue* b = bindings; omni_is_cell(b); b = omni_cdr(b)) {
+            if (omni_is_cell(omni_car(b))) df_expr(df, st, cadr(omni_car(b)));
+        }
+        for (OmniValue* b = bindings; omni_is_cell(b); b = omni_cdr(b)) {
+            OmniValue* name = omni_is_cell(omni_car(b)) ? omni_car(omni_car(b)) : NULL;
+            if (!omni_is_sym(name)) continue;
+            df_push(df, st, name->str_val, DF_LOCAL, DF_UNINIT);
+            df_store(df, &st->slots[st->count - 1], true, omni_car(b));
+        }
+    }
+    df_body(df, st, omni_cdr(omni_cdr(expr)));
+    df_pop(st, mark);
+}
+
+static void df_set(Dataflow* df, DfState* st, OmniValue* expr) {
+    OmniValue* target = cadr(expr);
+    df_expr(df, st, caddr(expr));
+    if (!omni_is_sym(target)) return;
+    DfSlot* slot = df_find(st, target->str_val);
+    if (!slot) return;
+
+    DfBinding* b = slot->binding;
+    b->assigned = true;
+    if (df->depth > b->depth) {
+        /* A closure's store lands whenever it is called */
+        b->captured = true;
+        for (size_t i = 0; i < slot->pending_count; i++) slot->pending[i]->read = true;
+        return;
+    }
+    if (b->kind == DF_GLOBAL && slot->init == DF_UNINIT) {
+        char where[128], msg[512];
+        df_where(where, sizeof(where), df->fn);
+        snprintf(msg, sizeof(msg),
+                 "E0008 %s%s is set before its definition "
+                 "(define it first, then set! it)",
+                 where, target->str_val);
+        add_error(df, msg);
+    }
+    df_store(df, slot, false, expr);
+}
+
+static void df_define(Dataflow* df, DfState* st, OmniValue* expr) {
+    OmniValue* target = cadr(expr);
+    OmniValue* name = omni_is_cell(target) ? omni_car(target) : target;
+    OmniValue* value = caddr(expr);
+    bool is_function = omni_is_cell(target) ||
+                       (omni_is_cell(value) && omni_is_sym(omni_car(value)) &&
+                        (strcmp(omni_car(value)->str_val, "lambda") == 0 ||
+                         strcmp(omni_car(value)->str_val, "fn") == 0));
+    const char* saved = df->fn;
+    if (df->depth == 0 && is_function && omni_is_sym(name)) df->fn = name->str_val;
+
+    if (omni_is_cell(target)) {
+        df_lambda(df, st, omni_cdr(target), omni_cdr(omni_cdr(expr)));
+    } else {
+        df_body(df, st, omni_cdr(omni_cdr(expr)));
+    }
+    df->fn = saved;
+
+    if (!omni_is_sym(name)) return;
+    DfSlot* slot = df_find(st, name->str_val);
+    if (slot) df_store(df, slot, true, expr);
+}
+
+/* The clauses of cond or case: at most one body runs, and none if no
+ * clause matches and there is no else. A cond test runs only when the
+ * tests before it failed. */
+static void df_clauses(Dataflow* df, DfState* st, OmniValue* clauses, bool tests) {
+    DfState taken = { 0 };
+    bool any = false, exhaustive = false;
+    for (; omni_is_cell(clauses); clauses = omni_cdr(clauses)) {
+        OmniValue* clause = omni_car(clauses);
+        if (!omni_is_cell(clause)) continue;
+        bool is_else = omni_is_sym(omni_car(clause)) && strcmp(omni_car(clause)->str_val, "else") == 0;
+        if (tests && !is_else) df_expr(df, st, omni_car(clause));
+        DfState branch;
+        df_state_copy(&branch, st);
+        df_body(df, &branch, omni_cdr(clause));
+        if (any) {
+            df_join(&taken, &branch);
+            df_state_free(&branch);
+        } else {
+            taken = branch;
+            any = true;
+        }
+        if (is_else) {
+            exhaustive = true;
+            break;
+        }
+    }
+    if (!any) return;
+    if (!exhaustive) df_join(&taken, st);
+    df_state_free(st);
+    *st = taken;
+}
+
+static void df_node(Dataflow* df, DfState* st, OmniValue* expr);
+
+/* Walk expr; errors found meanwhile point at it if it was parsed */
+static void df_expr(Dataflow* df, DfState* st, OmniValue* expr) {
+    OmniValue* outer = df->located;
+    if (expr && expr->line) df->located = expr;
+    df_node(df, st, expr);
+    df->located = outer;
+}
+
+static void df_node(Dataflow* df, DfState* st, OmniValue* expr) {
+    if (omni_is_sym(expr)) {
+        df_read(df, st, expr->str_val);
+        return;
+    }
+    if (!omni_is_cell(expr)) return;
+
+    OmniValue* head = omni_car(expr);
+    if (omni_is_sym(head) && !df_find(st, head->str_val)) {
+        const char* form = head->str_val;
+        if (strcmp(form, "quote") == 0) return;
+        if (strcmp(form, "quasiquote") == 0) {
+            df_template(df, st, cadr(expr));
+            return;
+        }
+        if (strcmp(form, "if") == 0) {
+            df_expr(df, st, cadr(expr));
+            DfState other;
+            df_state_copy(&other, st);
+            df_expr(df, st, caddr(expr));
+            OmniValue* alt = cdddr(expr);
+            if (omni_is_cell(alt)) df_expr(df, &other, omni_car(alt));
+            df_join(st, &other);
+            df_state_free(&other);
+            return;
+        }
+        if (strcmp(form, "and") == 0 || strcmp(form, "or") == 0) {
+            /* Each operand after the first may be skipped */
+            OmniValue* rest = omni_cdr(expr);
+            if (!omni_is_cell(rest)) return;
+            df_expr(df, st, omni_car(rest));
+            DfState skipped;
+            df_state_copy(&skipped, st);
+            for (rest = omni_cdr(rest); omni_is_cell(rest); rest = omni_cdr(rest)) {
+                df_expr(df, st, omni_car(rest));
+                df_join(&skipped, st);
+            }
+            df_state_free(st);
+            *st = skipped;
+            return;
+        }
+        if (strcmp(form, "do") == 0 || strcmp(form, "begin") == 0 ||
+            strcmp(form, "progn") == 0) {
+            df_body(df, st, omni_cdr(expr));
+            return;
+        }
+        if (strcmp(form, "cond") == 0) {
+            df_clauses(df, st, omni_cdr(expr), true);
+            return;
+        }
+        if (strcmp(form, "case") == 0) {
+            OmniValue* rest = omni_cdr(expr);
+            if (!omni_is_cell(rest)) return;
+            df_expr(df, st, omni_car(rest));
+            df_clauses(df, st, omni_cdr(rest), false);
+            return;
+        }
+        if (strcmp(form, "let") == 0 || strcmp(form, "let*") == 0 ||
+            strcmp(form, "letrec") == 0 || strcmp(form, "letrec*") == 0) {
+            df_let(df, st, form, expr);
+            return;
+        }
+        if (strcmp(form, "lambda") == 0 || strcmp(form, "fn") == 0) {
+            df_lambda(df, st, cadr(expr), omni_cdr(omni_cdr(expr)));
+            return;
+        }
+        if (strcmp(form, "define") == 0) {
+            df_define(df, st, expr);
+            return;
+        }
+        if (strcmp(form, "set!") == 0) {
+            df_set(df, st, expr);
+            return;
+        }
+    }
+
+    for (OmniValue* rest = expr; omni_is_cell(rest); rest = omni_cdr(rest)) {
+        df_expr(df, st, omni_car(rest));
+    }
+}
+
+void omni_analyze_dataflow(AnalysisContext* ctx, OmniValue** exprs, size_t count) {
+    Dataflow df = { .ctx = ctx };
+    df.stores_tail = &df.stores;
+    DfState st = { 0 };
+
+    /* Functions can be called from any form; variables exist once defined */
+    for (size_t i = 0; i < count; i++) {
+        OmniValue* e = exprs[i];
+        if (!omni_is_cell(e) || !omni_is_sym(omni_car(e)) ||
+            strcmp(omni_car(e)->str_val, "define") != 0) continue;
+        OmniValue* target = cadr(e);
+        OmniValue* name = omni_is_cell(target) ? omni_car(target) : target;
+        if (!omni_is_sym(name) || df_find(&st, name->str_val)) continue;
+        df_push(&df, &st, name->str_val, DF_GLOBAL, omni_is_cell(target) ? DF_INIT : DF_UNINIT);
+    }
+
+    for (size_t i = 0; i < count; i++) {
+        df.form = i + 1;
+        df_expr(&df, &st, exprs[i]);
+    }
+
+    /* A never-used binding is not a dead store; one overwritten unread is */
+    for (DfStore* s = df.stores; s; s = s->next) {
+        if (s->read || (s->is_init && !s->binding->assigned)) continue;
+        /* The warning is located at the store, so only the function is named */
+        char where[128] = "", msg[512];
+        const char* name = s->binding->name;
+        if (s->fn) snprintf(where, sizeof(where), "in %s: ", s->fn);
+        if (s->is_init) {
+            snprintf(msg, sizeof(msg),
+                     "%sthe value %s is bound to is never read before a set! replaces it "
+                     "(bind %s to the value it is set to)", where, name, name);
+        } else {
+            snprintf(msg, sizeof(msg),
+                     "%sthe value stored by (set! %s ...) is never read "
+                     "(remove the set! or use the value)", where, name);
+        }
+        add_warning(ctx, s->form, s->at, msg);
+    }
+
+    df_state_free(&st);
+    while (df.stores) {
+        DfStore* next = df.stores->next;
+        free(df.stores);
+        df.stores = next;
+    }
+    while (df.bindings) {
+        DfBinding* next = df.bindings->next;
+        free(df.bindings);
+        df.bindings = next;
+    }
+}
+
+size_t omni_analysis_error_count(AnalysisContext* ctx) {
+    return ctx ? ctx->error_count : 0;
+}
+
+const char* omni_analysis_get_error(AnalysisContext* ctx, size_t index) {
+    if (!ctx || index >= ctx->error_count) return NULL;
+    return ctx->errors[index];
+}
+
+OmniLocation omni_analysis_get_error_location(AnalysisContext* ctx, size_t index) {
+    OmniLocation none = { 0, 0, 0 };
+    if (!ctx || index >= ctx->error_count) return none;
+    return ctx->error_at[index];
+}
+
+/* ============== Improper List Arguments ============== */
+
+/* Primitives that walk a list argument, and which argument it is */
+static const struct { const char* name; int arg; } g_list_consumers[] = {
+    { "length", 0 }, { "reverse", 0 }, { "append", 0 },
+    { "map", 1 }, { "for-each", 1 }, { "filter", 1 }, { "fold", 2 },
+};
+
+/* Names in scope and, for each, the improper literal it is bound to */
+typedef struct {
+    const char** names;
+    OmniValue** literals;
+    size_t count;
+    size_t capacity;
+} ImproperEnv;
+
+static void improper_bind(ImproperEnv* env, const char* name, OmniValue* literal) {
+    if (env->count >= env->capacity) {
+        env->capacity = env->capacity ? env->capacity * 2 : 16;
+        env->names = realloc(env->names, env->capacity * sizeof(const char*));
+        env->literals = realloc(env->literals, env->capacity * sizeof(OmniValue*));
+    }
+    env->names[env->count] = name;
+    env->literals[env->count++] = literal;
+}
+
+/* The dotted list expr evaluates to, if it is a quoted literal or a name
+ * bound to one; NULL otherwise */
+static OmniValue* improper_literal(ImproperEnv* env, OmniValue* expr) {
+    if (omni_is_sym(expr)) {
+        for (size_t i = env->count; i > 0; i--) {
+            if (strcmp(env->names[i - 1], expr->str_val) == 0) return env->literals[i - 1];
+        }
+        return NULL;
+    }
+    if (!omni_is_cell(expr) || !omni_is_sym(omni_car(expr)) ||
+        strcmp(omni_car(expr)->str_val, "quote") != 0) return NULL;
+    OmniValue* datum = cadr(expr);
+    if (!omni_is_cell(datum)) return NULL;
+    while (omni_is_cell(datum)) datum = omni_cdr(datum);
+    return omni_is_nil(datum) ? NULL : cadr(expr);
+}
+
+static void improper_expr(AnalysisContext* ctx, ImproperEnv* env, OmniValue* expr, size_t form);
+
+static void improper_body(AnalysisContext* ctx, ImproperEnv* env, OmniValue* body, size_t form) {
+    for (; omni_is_cell(body); body = omni_cdr(body)) improper_expr(ctx, env, omni_car(body), form);
+}
+
+/* Parameters hide outer names for the body */
+static void improper_lambda(AnalysisContext* ctx, ImproperEnv* env, OmniValue* params,
+                            OmniValue* body, size_t form) {
+    size_t mark = env->count;
+    for (; omni_is_cell(params); params = omni_cdr(params)) {
+        if (omni_is_sym(omni_car(params))) improper_bind(env, omni_car(params)->str_val, NULL);
+    }
+    if (omni_is_sym(params)) improper_bind(env, params->str_val, NULL);
+    improper_body(ctx, env, body, form);
+    env->count = mark;
+}
+
+static void improper_expr(AnalysisContext* ctx, ImproperEnv* env, OmniValue* expr, size_t form) {
+    if (!omni_is_cell(expr)) return;
+    OmniValue* head = omni_car(expr);
+    if (omni_is_sym(head)) {
+        const char* name = head->str_val;
+        if (strcmp(name, "quote") == 0 || strcmp(name, "quasiquote") == 0) return;
+        if (strcmp(name, "lambda") == 0 || strcmp(name, "fn") == 0) {
+            improper_lambda(ctx, env, cadr(expr), omni_cdr(omni_cdr(expr)), form);
+            return;
+        }
+        if (strcmp(name, "define") == 0) {
+            OmniValue* target = cadr(expr);
+            if (omni_is_cell(target)) {
+                improper_lambda(ctx, env, omni_cdr(target), omni_cdr(omni_cdr(expr)), form);
+            } else {
+                improper_body(ctx, env, omni_cdr(omni_cdr(expr)), form);
+                if (omni_is_sym(target)) {
+                    improper_bind(env, target->str_val, improper_literal(env, caddr(expr)));
+                }
+            }
+            return;
+        }
+        if (strcmp(name, "let") == 0 || strcmp(name, "let*") == 0) {
+            size_t mark = env->count;
+            for (OmniValue* b = cadr(expr); omni_is_cell(b); b = omni_cdr(b)) {
+                OmniValue* binding = omni_car(b);
+                if (!omni_is_cell(binding) || !omni_is_sym(omni_car(binding))) continue;
+                improper_expr(ctx, env, cadr(binding), form);
+                improper_bind(env, omni_car(binding)->str_val, improper_literal(env, cadr(binding)));
+            }
+            improper_body(ctx, env, omni_cdr(omni_cdr(expr)), form);
+            env->count = mark;
+            return;
+        }
+
+        for (size_t i = 0; i < sizeof(g_list_consumers) / sizeof(g_list_consumers[0]); i++) {
+            if (strcmp(name, g_list_consumers[i].name) != 0) continue;
+            OmniValue* arg = omni_cdr(expr);
+            for (int k = 0; k < g_list_consumers[i].arg && omni_is_cell(arg); k++) arg = omni_cdr(arg);
+            OmniValue* literal = omni_is_cell(arg) ? improper_literal(env, omni_car(arg)) : NULL;
+            if (!literal) break;
+            char* text = omni_value_to_string(literal);
+            char msg[512];
+            snprintf(msg, sizeof(msg),
+                     "%s gets the improper list %s and stops at its dotted tail "
+                     "(pass a proper list, or compile with -checked to make this an error)",
+                     name, text);
+            free(text);
+            add_warning(ctx, form, expr, msg);
+            break;
+        }
+    }
+
+    for (OmniValue* rest = expr; omni_is_cell(rest); rest = omni_cdr(rest)) {
+        improper_expr(ctx, env, omni_car(rest), form);
+    }
+}
+
+void omni_analyze_list_args(AnalysisContext* ctx, OmniValue** exprs, size_t count) {
+    ImproperEnv env = { 0 };
+    for (size_t i = 0; i < count; i++) {
+        improper_expr(ctx, &env, exprs[i], i + 1);
+    }
+    free(env.names);
+    free(env.literals);
+}
+
 /* ============== Concurrency Ownership Inference ============== */
 
 const char* omni_thread_locality_name(ThreadLocality locality) {
@@ -2853,6 +3906,28 @@ ThreadSpawnInfo** omni_get_threads_capturing(AnalysisContext* ctx, const char* v
     return result;
 }
 
+/* Add each variable defined before the spawn that expr uses, once */
+static void collect_thread_captures(AnalysisContext* ctx, OmniValue* expr,
+                                    char*** captured, size_t* count, size_t* cap) {
+    if (omni_is_sym(expr)) {
+        VarUsage* u = omni_get_var_usage(ctx, expr->str_val);
+        if (!u || u->def_pos >= ctx->position) return;
+        for (size_t i = 0; i < *count; i++) {
+            if (strcmp((*captured)[i], expr->str_val) == 0) return;
+        }
+        if (*count >= *cap) {
+            *cap = *cap ? *cap * 2 : 8;
+            *captured = realloc(*captured, *cap * sizeof(char*));
+        }
+        (*captured)[(*count)++] = expr->str_val;
+        return;
+    }
+    if (!omni_is_cell(expr) || omni_sym_eq_str(omni_car(expr), "quote")) return;
+    for (; omni_is_cell(expr); expr = omni_cdr(expr)) {
+        collect_thread_captures(ctx, omni_car(expr), captured, count, cap);
+    }
+}
+
 void omni_analyze_concurrency(AnalysisContext* ctx, OmniValue* expr) {
     /*
      * Analyze concurrency patterns:
@@ -2867,7 +3942,8 @@ void omni_analyze_concurrency(AnalysisContext* ctx, OmniValue* expr) {
 
     /* Skip primitives */
     if (omni_is_int(expr) || omni_is_float(expr) ||
-        omni_is_char(expr) || omni_is_nil(expr) || omni_is_sym(expr)) {
+        omni_is_char(expr) || omni_is_string(expr) || omni_is_nil(expr) ||
+        omni_is_sym(expr)) {
         return;
     }
 
@@ -2886,42 +3962,27 @@ void omni_analyze_concurrency(AnalysisContext* ctx, OmniValue* expr) {
 
     /* Detect thread spawn forms */
     if (strcmp(form, "spawn") == 0 || strcmp(form, "thread") == 0 ||
-        strcmp(form, "go") == 0 || strcmp(form, "async") == 0) {
+        strcmp(form, "go") == 0 || strcmp(form, "async") == 0 ||
+        strcmp(form, "future") == 0) {
 
         /* Generate thread ID */
         char thread_id[32];
-        static int thread_counter = 0;
-        snprintf(thread_id, sizeof(thread_id), "thread_%d", thread_counter++);
+        int thread = ctx->thread_count++;
+        snprintf(thread_id, sizeof(thread_id), "thread_%d", thread);
 
-        /* Collect captured variables from the body */
-        /* For now, just scan for symbols in the body */
+        /* Collect captured variables from the body, at any depth */
         OmniValue* body = omni_cdr(expr);
         char** captured = NULL;
         size_t captured_count = 0;
         size_t captured_cap = 0;
-
-        for (OmniValue* b = body; omni_is_cell(b); b = omni_cdr(b)) {
-            OmniValue* e = omni_car(b);
-            if (omni_is_sym(e)) {
-                /* Check if it's a variable from outer scope */
-                VarUsage* u = omni_get_var_usage(ctx, e->str_val);
-                if (u && u->def_pos < ctx->position) {
-                    /* Variable defined before spawn - captured */
-                    if (captured_count >= captured_cap) {
-                        captured_cap = captured_cap ? captured_cap * 2 : 8;
-                        captured = realloc(captured, captured_cap * sizeof(char*));
-                    }
-                    captured[captured_count++] = e->str_val;
-                }
-            }
-        }
+        collect_thread_captures(ctx, body, &captured, &captured_count, &captured_cap);
 
         omni_record_thread_spawn(ctx, thread_id, captured, captured_count);
         free(captured);
 
         /* Analyze body in new thread context */
         int old_thread = ctx->current_thread_id;
-        ctx->current_thread_id = thread_counter - 1;
+        ctx->current_thread_id = thread;
         for (OmniValue* b = body; omni_is_cell(b); b = omni_cdr(b)) {
             omni_analyze_concurrency(ctx, omni_car(b));
         }
@@ -2980,9 +4041,13 @@ void omni_analyze_concurrency(AnalysisContext* ctx, OmniValue* expr) {
                 }
             }
         }
-        /* Continue analyzing body */
-        OmniValue* body = caddr(expr);
-        omni_analyze_concurrency(ctx, body);
+        /* Continue analyzing the inits and body */
+        for (OmniValue* b = bindings; omni_is_cell(b); b = omni_cdr(b)) {
+            if (omni_is_cell(omni_car(b))) omni_analyze_concurrency(ctx, cadr(omni_car(b)));
+        }
+        for (OmniValue* body = omni_cdr(omni_cdr(expr)); omni_is_cell(body); body = omni_cdr(body)) {
+            omni_analyze_concurrency(ctx, omni_car(body));
+        }
         return;
     }
 
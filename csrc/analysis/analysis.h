@@ -211,6 +211,15 @@ typedef struct ParamSummary {
     struct ParamSummary* next;
 } ParamSummary;
 
+/* Effects a function has of its own (bit flags) */
+typedef enum {
+    EFFECT_NONE = 0,
+    EFFECT_IO = 1 << 0,          /* Output, clocks: observable outside the program */
+    EFFECT_CONCURRENT = 1 << 1,  /* Channels, sleeping, yielding to other threads */
+    EFFECT_MUTATE = 1 << 2,      /* set!, and stores into vectors, tables and objects */
+    EFFECT_THROW = 1 << 3,       /* Raises errors: error, assert */
+} EffectKind;
+
 typedef struct FunctionSummary {
     char* name;              /* Function name */
     ParamSummary* params;    /* Parameter summaries */
@@ -219,6 +228,8 @@ typedef struct FunctionSummary {
     int return_param_index;  /* If RETURN_PASSTHROUGH, which param is returned */
     bool allocates;          /* Does this function allocate? */
     bool has_side_effects;   /* Does this function have side effects? */
+    unsigned effects;        /* EffectKind bits known to cause them */
+    int effect_param;        /* Calls this parameter, taking on its effects (-1: none) */
     struct FunctionSummary* next;
 } FunctionSummary;
 
@@ -262,11 +273,24 @@ typedef struct AnalysisContext {
     /* Function summaries */
     FunctionSummary* function_summaries;
 
+    /* Diagnostics that do not stop compilation */
+    char** warnings;
+    OmniLocation* warning_at;
+    size_t warning_count;
+    size_t warning_capacity;
+
+    /* Diagnostics that do */
+    char** errors;
+    OmniLocation* error_at;
+    size_t error_count;
+    size_t error_capacity;
+
     /* Concurrency tracking */
     ThreadLocalityInfo* thread_locality;
     ThreadSpawnInfo* thread_spawns;
     ChannelOpInfo* channel_ops;
     int current_thread_id;   /* -1 = main thread, >= 0 = spawned */
+    int thread_count;        /* Spawns seen, numbering the next */
 
     /* Current position counter */
     int position;
@@ -350,6 +374,10 @@ FreeStrategy omni_get_free_strategy(AnalysisContext* ctx, const char* name);
 /* Get free strategy name string for codegen comments */
 const char* omni_free_strategy_name(FreeStrategy strategy);
 
+/* Names used by the ownership-of and shape-of reflection forms */
+const char* omni_ownership_name(OwnershipKind kind);
+const char* omni_shape_name(ShapeClass shape);
+
 /* Get allocation strategy for a variable (based on escape analysis) */
 AllocStrategy omni_get_alloc_strategy(AnalysisContext* ctx, const char* name);
 
@@ -359,6 +387,11 @@ const char* omni_alloc_strategy_name(AllocStrategy strategy);
 /* Check if a variable can be stack allocated */
 bool omni_can_stack_alloc(AnalysisContext* ctx, const char* name);
 
+/* Whether the primitive name only reads its arguments: it keeps no
+ * reference to them and returns none of them, so passing a value to it
+ * does not make the value escape */
+bool omni_primitive_reads_args(const char* name);
+
 /* ============== Reuse Analysis Query Functions ============== */
 
 /* Add a reuse candidate (allocation paired with prior free) */
@@ -470,6 +503,59 @@ void omni_analyze_function_summary(AnalysisContext* ctx, OmniValue* func_def);
 /* Get the summary for a function by name */
 FunctionSummary* omni_get_function_summary(AnalysisContext* ctx, const char* func_name);
 
+/* Register summaries for primitives: the pure numeric library (min, max,
+ * expt, gcd, lcm, sqrt), the higher-order list operations, which take
+ * on the effects of their function argument, and the timers (sleep-ms,
+ * yield, monotonic-millis). Called by omni_analyze_program. */
+void omni_register_primitive_summaries(AnalysisContext* ctx);
+
+/* True if the function has a summary, no side effects of its own, and
+ * does not call a function argument */
+bool omni_function_is_pure(AnalysisContext* ctx, const char* func_name);
+
+/* ============== Dead Code ============== */
+
+/*
+ * Warn about values that are computed and thrown away where a cheaper form
+ * exists: a discarded (map f xs) allocates a list nobody reads, and
+ * (for-each f xs) does the same work without it. results_used says whether
+ * top-level results are consumed (false in script mode).
+ */
+void omni_analyze_dead_code(AnalysisContext* ctx, OmniValue** exprs, size_t count,
+                            bool results_used);
+
+/* Warnings collected by the analyses */
+size_t omni_analysis_warning_count(AnalysisContext* ctx);
+const char* omni_analysis_get_warning(AnalysisContext* ctx, size_t index);
+/* Where warning index points: its form and the parsed node it is about */
+OmniLocation omni_analysis_get_warning_location(AnalysisContext* ctx, size_t index);
+
+/* ============== Initialization and Dead Stores ============== */
+
+/*
+ * Report reads and set!s of a top-level variable before its define, and
+ * reads of a letrec binding before its init has run, as E0008 errors;
+ * only reads that are uninitialized on every path count. A store that no
+ * path reads before it is overwritten or goes out of scope is a warning.
+ * Messages name the top-level form (1-based) and enclosing definition.
+ */
+void omni_analyze_dataflow(AnalysisContext* ctx, OmniValue** exprs, size_t count);
+
+/* Errors collected by the analyses */
+size_t omni_analysis_error_count(AnalysisContext* ctx);
+const char* omni_analysis_get_error(AnalysisContext* ctx, size_t index);
+/* Where error index points: its form and the parsed node it is about */
+OmniLocation omni_analysis_get_error_location(AnalysisContext* ctx, size_t index);
+
+/* ============== Improper List Arguments ============== */
+
+/*
+ * Warn when a quoted dotted list, directly or through a let or define
+ * binding, is passed as the list argument of length, reverse, append,
+ * map, for-each, filter or fold, which stop at the dotted tail.
+ */
+void omni_analyze_list_args(AnalysisContext* ctx, OmniValue** exprs, size_t count);
+
 /* Get parameter ownership for a function */
 ParamOwnership omni_get_param_ownership(AnalysisContext* ctx, const char* func_name,
                                         const char* param_name);
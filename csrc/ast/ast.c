@@ -77,31 +77,28 @@ char* omni_arena_strdup(OmniArena* arena, const char* s) {
     return copy;
 }
 
-/* Global AST arena */
-static OmniArena* g_ast_arena = NULL;
-
-void omni_ast_arena_init(void) {
-    if (!g_ast_arena) {
-        g_ast_arena = omni_arena_new(1024 * 1024);  /* 1MB initial */
-    }
-}
-
-void omni_ast_arena_cleanup(void) {
-    if (g_ast_arena) {
-        omni_arena_free(g_ast_arena);
-        g_ast_arena = NULL;
+/* ============== Sessions ============== */
+
+OmniSession* omni_session_new(void) {
+    OmniSession* session = calloc(1, sizeof(OmniSession));
+    if (!session) return NULL;
+    session->arena = omni_arena_new(64 * 1024);
+    if (!session->arena) {
+        free(session);
+        return NULL;
     }
+    return session;
 }
 
-OmniArena* omni_ast_arena_get(void) {
-    if (!g_ast_arena) omni_ast_arena_init();
-    return g_ast_arena;
+void omni_session_free(OmniSession* session) {
+    if (!session) return;
+    omni_arena_free(session->arena);
+    free(session);
 }
 
 /* ============== Internal Allocation ============== */
 
-static OmniValue* omni_alloc_value(void) {
-    OmniArena* arena = omni_ast_arena_get();
+static OmniValue* omni_alloc_value(OmniArena* arena) {
     OmniValue* v = omni_arena_alloc(arena, sizeof(OmniValue));
     if (v) memset(v, 0, sizeof(OmniValue));
     return v;
@@ -109,40 +106,48 @@ static OmniValue* omni_alloc_value(void) {
 
 /* ============== Constructors ============== */
 
-OmniValue* omni_new_int(int64_t i) {
-    OmniValue* v = omni_alloc_value();
+OmniValue* omni_new_int(OmniArena* arena, int64_t i) {
+    OmniValue* v = omni_alloc_value(arena);
     if (!v) return NULL;
     v->tag = OMNI_INT;
     v->int_val = i;
     return v;
 }
 
-OmniValue* omni_new_float(double f) {
-    OmniValue* v = omni_alloc_value();
+OmniValue* omni_new_float(OmniArena* arena, double f) {
+    OmniValue* v = omni_alloc_value(arena);
     if (!v) return NULL;
     v->tag = OMNI_FLOAT;
     v->float_val = f;
     return v;
 }
 
-OmniValue* omni_new_sym(const char* s) {
-    OmniValue* v = omni_alloc_value();
+OmniValue* omni_new_sym(OmniArena* arena, const char* s) {
+    OmniValue* v = omni_alloc_value(arena);
     if (!v) return NULL;
     v->tag = OMNI_SYM;
-    v->str_val = omni_arena_strdup(omni_ast_arena_get(), s);
+    v->str_val = omni_arena_strdup(arena, s);
     return v;
 }
 
-OmniValue* omni_new_char(int32_t c) {
-    OmniValue* v = omni_alloc_value();
+OmniValue* omni_new_char(OmniArena* arena, int32_t c) {
+    OmniValue* v = omni_alloc_value(arena);
     if (!v) return NULL;
     v->tag = OMNI_CHAR;
     v->int_val = c;
     return v;
 }
 
-OmniValue* omni_new_cell(OmniValue* car, OmniValue* cdr) {
-    OmniValue* v = omni_alloc_value();
+OmniValue* omni_new_string(OmniArena* arena, const char* s) {
+    OmniValue* v = omni_alloc_value(arena);
+    if (!v) return NULL;
+    v->tag = OMNI_STRING;
+    v->str_val = omni_arena_strdup(arena, s);
+    return v;
+}
+
+OmniValue* omni_new_cell(OmniArena* arena, OmniValue* car, OmniValue* cdr) {
+    OmniValue* v = omni_alloc_value(arena);
     if (!v) return NULL;
     v->tag = OMNI_CELL;
     v->cell.car = car;
@@ -150,24 +155,24 @@ OmniValue* omni_new_cell(OmniValue* car, OmniValue* cdr) {
     return v;
 }
 
-OmniValue* omni_new_prim(OmniPrimFn fn) {
-    OmniValue* v = omni_alloc_value();
+OmniValue* omni_new_prim(OmniArena* arena, OmniPrimFn fn) {
+    OmniValue* v = omni_alloc_value(arena);
     if (!v) return NULL;
     v->tag = OMNI_PRIM;
     v->prim_fn = fn;
     return v;
 }
 
-OmniValue* omni_new_code(const char* s) {
-    OmniValue* v = omni_alloc_value();
+OmniValue* omni_new_code(OmniArena* arena, const char* s) {
+    OmniValue* v = omni_alloc_value(arena);
     if (!v) return NULL;
     v->tag = OMNI_CODE;
-    v->str_val = omni_arena_strdup(omni_ast_arena_get(), s);
+    v->str_val = omni_arena_strdup(arena, s);
     return v;
 }
 
-OmniValue* omni_new_lambda(OmniValue* params, OmniValue* body, OmniValue* env) {
-    OmniValue* v = omni_alloc_value();
+OmniValue* omni_new_lambda(OmniArena* arena, OmniValue* params, OmniValue* body, OmniValue* env) {
+    OmniValue* v = omni_alloc_value(arena);
     if (!v) return NULL;
     v->tag = OMNI_LAMBDA;
     v->lambda.params = params;
@@ -177,8 +182,8 @@ OmniValue* omni_new_lambda(OmniValue* params, OmniValue* body, OmniValue* env) {
     return v;
 }
 
-OmniValue* omni_new_rec_lambda(OmniValue* self_name, OmniValue* params, OmniValue* body, OmniValue* env) {
-    OmniValue* v = omni_alloc_value();
+OmniValue* omni_new_rec_lambda(OmniArena* arena, OmniValue* self_name, OmniValue* params, OmniValue* body, OmniValue* env) {
+    OmniValue* v = omni_alloc_value(arena);
     if (!v) return NULL;
     v->tag = OMNI_REC_LAMBDA;
     v->lambda.params = params;
@@ -188,24 +193,24 @@ OmniValue* omni_new_rec_lambda(OmniValue* self_name, OmniValue* params, OmniValu
     return v;
 }
 
-OmniValue* omni_new_error(const char* msg) {
-    OmniValue* v = omni_alloc_value();
+OmniValue* omni_new_error(OmniArena* arena, const char* msg) {
+    OmniValue* v = omni_alloc_value(arena);
     if (!v) return NULL;
     v->tag = OMNI_ERROR;
-    v->str_val = omni_arena_strdup(omni_ast_arena_get(), msg);
+    v->str_val = omni_arena_strdup(arena, msg);
     return v;
 }
 
-OmniValue* omni_new_box(OmniValue* initial) {
-    OmniValue* v = omni_alloc_value();
+OmniValue* omni_new_box(OmniArena* arena, OmniValue* initial) {
+    OmniValue* v = omni_alloc_value(arena);
     if (!v) return NULL;
     v->tag = OMNI_BOX;
     v->box_value = initial;
     return v;
 }
 
-OmniValue* omni_new_cont(OmniContFn fn, OmniValue* menv, int tag) {
-    OmniValue* v = omni_alloc_value();
+OmniValue* omni_new_cont(OmniArena* arena, OmniContFn fn, OmniValue* menv, int tag) {
+    OmniValue* v = omni_alloc_value(arena);
     if (!v) return NULL;
     v->tag = OMNI_CONT;
     v->cont.fn = fn;
@@ -214,56 +219,56 @@ OmniValue* omni_new_cont(OmniContFn fn, OmniValue* menv, int tag) {
     return v;
 }
 
-OmniValue* omni_new_chan(int capacity) {
-    OmniValue* v = omni_alloc_value();
+OmniValue* omni_new_chan(OmniArena* arena, int capacity) {
+    OmniValue* v = omni_alloc_value(arena);
     if (!v) return NULL;
     v->tag = OMNI_CHAN;
-    OmniChannel* ch = omni_arena_alloc(omni_ast_arena_get(), sizeof(OmniChannel));
+    OmniChannel* ch = omni_arena_alloc(arena, sizeof(OmniChannel));
     if (!ch) return NULL;
     memset(ch, 0, sizeof(OmniChannel));
     ch->capacity = capacity;
     if (capacity > 0) {
-        ch->buffer = omni_arena_alloc(omni_ast_arena_get(), capacity * sizeof(OmniValue*));
+        ch->buffer = omni_arena_alloc(arena, capacity * sizeof(OmniValue*));
     }
     v->chan = ch;
     return v;
 }
 
-OmniValue* omni_new_green_chan(int capacity) {
-    OmniValue* v = omni_alloc_value();
+OmniValue* omni_new_green_chan(OmniArena* arena, int capacity) {
+    OmniValue* v = omni_alloc_value(arena);
     if (!v) return NULL;
     v->tag = OMNI_GREEN_CHAN;
-    OmniGreenChannel* ch = omni_arena_alloc(omni_ast_arena_get(), sizeof(OmniGreenChannel));
+    OmniGreenChannel* ch = omni_arena_alloc(arena, sizeof(OmniGreenChannel));
     if (!ch) return NULL;
     memset(ch, 0, sizeof(OmniGreenChannel));
     ch->capacity = capacity;
     if (capacity > 0) {
-        ch->buffer = omni_arena_alloc(omni_ast_arena_get(), capacity * sizeof(OmniValue*));
+        ch->buffer = omni_arena_alloc(arena, capacity * sizeof(OmniValue*));
     }
     v->green_chan = ch;
     return v;
 }
 
-OmniValue* omni_new_atom(OmniValue* initial) {
-    OmniValue* v = omni_alloc_value();
+OmniValue* omni_new_atom(OmniArena* arena, OmniValue* initial) {
+    OmniValue* v = omni_alloc_value(arena);
     if (!v) return NULL;
     v->tag = OMNI_ATOM;
     v->atom_value = initial;
     return v;
 }
 
-OmniValue* omni_new_thread(void) {
-    OmniValue* v = omni_alloc_value();
+OmniValue* omni_new_thread(OmniArena* arena) {
+    OmniValue* v = omni_alloc_value(arena);
     if (!v) return NULL;
     v->tag = OMNI_THREAD;
-    v->thread = omni_arena_alloc(omni_ast_arena_get(), sizeof(OmniThreadHandle));
+    v->thread = omni_arena_alloc(arena, sizeof(OmniThreadHandle));
     if (!v->thread) return NULL;
     memset(v->thread, 0, sizeof(OmniThreadHandle));
     return v;
 }
 
-OmniValue* omni_new_process(OmniValue* thunk) {
-    OmniValue* v = omni_alloc_value();
+OmniValue* omni_new_process(OmniArena* arena, OmniValue* thunk) {
+    OmniValue* v = omni_alloc_value(arena);
     if (!v) return NULL;
     v->tag = OMNI_PROCESS;
     v->proc.thunk = thunk;
@@ -271,8 +276,8 @@ OmniValue* omni_new_process(OmniValue* thunk) {
     return v;
 }
 
-OmniValue* omni_new_menv(OmniValue* env, OmniValue* parent, int level) {
-    OmniValue* v = omni_alloc_value();
+OmniValue* omni_new_menv(OmniArena* arena, OmniValue* env, OmniValue* parent, int level) {
+    OmniValue* v = omni_alloc_value(arena);
     if (!v) return NULL;
     v->tag = OMNI_MENV;
     v->menv.env = env;
@@ -282,28 +287,28 @@ OmniValue* omni_new_menv(OmniValue* env, OmniValue* parent, int level) {
     return v;
 }
 
-OmniValue* omni_new_keyword(const char* name) {
-    OmniValue* v = omni_alloc_value();
+OmniValue* omni_new_keyword(OmniArena* arena, const char* name) {
+    OmniValue* v = omni_alloc_value(arena);
     if (!v) return NULL;
     v->tag = OMNI_KEYWORD;
-    v->str_val = omni_arena_strdup(omni_ast_arena_get(), name);
+    v->str_val = omni_arena_strdup(arena, name);
     return v;
 }
 
 /* OmniLisp collection constructors */
 
-OmniValue* omni_new_array(size_t initial_cap) {
-    OmniValue* v = omni_alloc_value();
+OmniValue* omni_new_array(OmniArena* arena, size_t initial_cap) {
+    OmniValue* v = omni_alloc_value(arena);
     if (!v) return NULL;
     v->tag = OMNI_ARRAY;
     v->array.len = 0;
     v->array.cap = initial_cap > 0 ? initial_cap : 8;
-    v->array.data = omni_arena_alloc(omni_ast_arena_get(), v->array.cap * sizeof(OmniValue*));
+    v->array.data = omni_arena_alloc(arena, v->array.cap * sizeof(OmniValue*));
     return v;
 }
 
-OmniValue* omni_new_array_from(OmniValue** elements, size_t len) {
-    OmniValue* v = omni_new_array(len);
+OmniValue* omni_new_array_from(OmniArena* arena, OmniValue** elements, size_t len) {
+    OmniValue* v = omni_new_array(arena, len);
     if (!v) return NULL;
     for (size_t i = 0; i < len; i++) {
         v->array.data[i] = elements[i];
@@ -312,23 +317,23 @@ OmniValue* omni_new_array_from(OmniValue** elements, size_t len) {
     return v;
 }
 
-OmniValue* omni_new_dict(void) {
-    OmniValue* v = omni_alloc_value();
+OmniValue* omni_new_dict(OmniArena* arena) {
+    OmniValue* v = omni_alloc_value(arena);
     if (!v) return NULL;
     v->tag = OMNI_DICT;
     v->dict.len = 0;
     v->dict.cap = 8;
-    v->dict.keys = omni_arena_alloc(omni_ast_arena_get(), 8 * sizeof(OmniValue*));
-    v->dict.values = omni_arena_alloc(omni_ast_arena_get(), 8 * sizeof(OmniValue*));
+    v->dict.keys = omni_arena_alloc(arena, 8 * sizeof(OmniValue*));
+    v->dict.values = omni_arena_alloc(arena, 8 * sizeof(OmniValue*));
     return v;
 }
 
-OmniValue* omni_new_tuple(OmniValue** elements, size_t len) {
-    OmniValue* v = omni_alloc_value();
+OmniValue* omni_new_tuple(OmniArena* arena, OmniValue** elements, size_t len) {
+    OmniValue* v = omni_alloc_value(arena);
     if (!v) return NULL;
     v->tag = OMNI_TUPLE;
     v->tuple.len = len;
-    v->tuple.data = omni_arena_alloc(omni_ast_arena_get(), len * sizeof(OmniValue*));
+    v->tuple.data = omni_arena_alloc(arena, len * sizeof(OmniValue*));
     if (v->tuple.data) {
         for (size_t i = 0; i < len; i++) {
             v->tuple.data[i] = elements[i];
@@ -337,14 +342,14 @@ OmniValue* omni_new_tuple(OmniValue** elements, size_t len) {
     return v;
 }
 
-OmniValue* omni_new_type_lit(const char* name, OmniValue** params, size_t param_count) {
-    OmniValue* v = omni_alloc_value();
+OmniValue* omni_new_type_lit(OmniArena* arena, const char* name, OmniValue** params, size_t param_count) {
+    OmniValue* v = omni_alloc_value(arena);
     if (!v) return NULL;
     v->tag = OMNI_TYPE_LIT;
-    v->type_lit.type_name = omni_arena_strdup(omni_ast_arena_get(), name);
+    v->type_lit.type_name = omni_arena_strdup(arena, name);
     v->type_lit.param_count = param_count;
     if (param_count > 0) {
-        v->type_lit.params = omni_arena_alloc(omni_ast_arena_get(), param_count * sizeof(OmniValue*));
+        v->type_lit.params = omni_arena_alloc(arena, param_count * sizeof(OmniValue*));
         for (size_t i = 0; i < param_count; i++) {
             v->type_lit.params[i] = params[i];
         }
@@ -352,15 +357,15 @@ OmniValue* omni_new_type_lit(const char* name, OmniValue** params, size_t param_
     return v;
 }
 
-OmniValue* omni_new_user_type(const char* type_name, OmniField* fields, size_t field_count) {
-    OmniValue* v = omni_alloc_value();
+OmniValue* omni_new_user_type(OmniArena* arena, const char* type_name, OmniField* fields, size_t field_count) {
+    OmniValue* v = omni_alloc_value(arena);
     if (!v) return NULL;
     v->tag = OMNI_USER_TYPE;
-    v->user_type.type_name = omni_arena_strdup(omni_ast_arena_get(), type_name);
+    v->user_type.type_name = omni_arena_strdup(arena, type_name);
     v->user_type.field_count = field_count;
-    v->user_type.fields = omni_arena_alloc(omni_ast_arena_get(), field_count * sizeof(OmniField));
+    v->user_type.fields = omni_arena_alloc(arena, field_count * sizeof(OmniField));
     for (size_t i = 0; i < field_count; i++) {
-        v->user_type.fields[i].name = omni_arena_strdup(omni_ast_arena_get(), fields[i].name);
+        v->user_type.fields[i].name = omni_arena_strdup(arena, fields[i].name);
         v->user_type.fields[i].value = fields[i].value;
     }
     return v;
@@ -395,6 +400,7 @@ bool omni_values_equal(OmniValue* a, OmniValue* b) {
         return a->float_val == b->float_val;
     case OMNI_SYM:
     case OMNI_KEYWORD:
+    case OMNI_STRING:
     case OMNI_CODE:
     case OMNI_ERROR:
         return strcmp(a->str_val, b->str_val) == 0;
@@ -408,16 +414,16 @@ bool omni_values_equal(OmniValue* a, OmniValue* b) {
 
 /* ============== List Helpers ============== */
 
-OmniValue* omni_list1(OmniValue* a) {
-    return omni_new_cell(a, omni_nil);
+OmniValue* omni_list1(OmniArena* arena, OmniValue* a) {
+    return omni_new_cell(arena, a, omni_nil);
 }
 
-OmniValue* omni_list2(OmniValue* a, OmniValue* b) {
-    return omni_new_cell(a, omni_new_cell(b, omni_nil));
+OmniValue* omni_list2(OmniArena* arena, OmniValue* a, OmniValue* b) {
+    return omni_new_cell(arena, a, omni_new_cell(arena, b, omni_nil));
 }
 
-OmniValue* omni_list3(OmniValue* a, OmniValue* b, OmniValue* c) {
-    return omni_new_cell(a, omni_new_cell(b, omni_new_cell(c, omni_nil)));
+OmniValue* omni_list3(OmniArena* arena, OmniValue* a, OmniValue* b, OmniValue* c) {
+    return omni_new_cell(arena, a, omni_new_cell(arena, b, omni_new_cell(arena, c, omni_nil)));
 }
 
 size_t omni_list_len(OmniValue* v) {
@@ -429,12 +435,12 @@ size_t omni_list_len(OmniValue* v) {
     return n;
 }
 
-OmniValue** omni_list_to_array(OmniValue* v, size_t* out_len) {
+OmniValue** omni_list_to_array(OmniArena* arena, OmniValue* v, size_t* out_len) {
     size_t len = omni_list_len(v);
     if (out_len) *out_len = len;
     if (len == 0) return NULL;
 
-    OmniValue** arr = omni_arena_alloc(omni_ast_arena_get(), len * sizeof(OmniValue*));
+    OmniValue** arr = omni_arena_alloc(arena, len * sizeof(OmniValue*));
     size_t i = 0;
     while (!omni_is_nil(v) && omni_is_cell(v)) {
         arr[i++] = v->cell.car;
@@ -443,14 +449,29 @@ OmniValue** omni_list_to_array(OmniValue* v, size_t* out_len) {
     return arr;
 }
 
-OmniValue* omni_array_to_list(OmniValue** items, size_t len) {
+OmniValue* omni_array_to_list(OmniArena* arena, OmniValue** items, size_t len) {
     OmniValue* result = omni_nil;
     for (size_t i = len; i > 0; i--) {
-        result = omni_new_cell(items[i - 1], result);
+        result = omni_new_cell(arena, items[i - 1], result);
     }
     return result;
 }
 
+OmniValue* omni_list_of(OmniArena* arena, size_t count, ...) {
+    OmniValue* head = omni_nil;
+    OmniValue* tail = NULL;
+    va_list ap;
+    va_start(ap, count);
+    for (size_t i = 0; i < count; i++) {
+        OmniValue* cell = omni_new_cell(arena, va_arg(ap, OmniValue*), omni_nil);
+        if (tail) tail->cell.cdr = cell;
+        else head = cell;
+        tail = cell;
+    }
+    va_end(ap);
+    return head;
+}
+
 /* ============== Box Operations ============== */
 
 OmniValue* omni_box_get(OmniValue* box) {
@@ -482,11 +503,11 @@ void omni_array_set(OmniValue* arr, size_t idx, OmniValue* val) {
     }
 }
 
-void omni_array_push(OmniValue* arr, OmniValue* val) {
+void omni_array_push(OmniArena* arena, OmniValue* arr, OmniValue* val) {
     if (!arr || arr->tag != OMNI_ARRAY) return;
     if (arr->array.len >= arr->array.cap) {
         size_t new_cap = arr->array.cap * 2;
-        OmniValue** new_data = omni_arena_alloc(omni_ast_arena_get(), new_cap * sizeof(OmniValue*));
+        OmniValue** new_data = omni_arena_alloc(arena, new_cap * sizeof(OmniValue*));
         memcpy(new_data, arr->array.data, arr->array.len * sizeof(OmniValue*));
         arr->array.data = new_data;
         arr->array.cap = new_cap;
@@ -516,7 +537,7 @@ OmniValue* omni_dict_get(OmniValue* dict, OmniValue* key) {
     return omni_nil;
 }
 
-void omni_dict_set(OmniValue* dict, OmniValue* key, OmniValue* val) {
+void omni_dict_set(OmniArena* arena, OmniValue* dict, OmniValue* key, OmniValue* val) {
     if (!dict || dict->tag != OMNI_DICT) return;
 
     /* Check if key exists */
@@ -530,8 +551,8 @@ void omni_dict_set(OmniValue* dict, OmniValue* key, OmniValue* val) {
     /* Grow if needed */
     if (dict->dict.len >= dict->dict.cap) {
         size_t new_cap = dict->dict.cap * 2;
-        OmniValue** new_keys = omni_arena_alloc(omni_ast_arena_get(), new_cap * sizeof(OmniValue*));
-        OmniValue** new_vals = omni_arena_alloc(omni_ast_arena_get(), new_cap * sizeof(OmniValue*));
+        OmniValue** new_keys = omni_arena_alloc(arena, new_cap * sizeof(OmniValue*));
+        OmniValue** new_vals = omni_arena_alloc(arena, new_cap * sizeof(OmniValue*));
         memcpy(new_keys, dict->dict.keys, dict->dict.len * sizeof(OmniValue*));
         memcpy(new_vals, dict->dict.values, dict->dict.len * sizeof(OmniValue*));
         dict->dict.keys = new_keys;
@@ -593,6 +614,142 @@ bool omni_user_type_is(OmniValue* v, const char* type_name) {
     return strcmp(v->user_type.type_name, type_name) == 0;
 }
 
+bool omni_is_variant_spec(OmniValue* spec) {
+    if (!omni_is_cell(spec) || !omni_is_sym(omni_car(spec))) return false;
+    char c = omni_car(spec)->str_val[0];
+    return c >= 'A' && c <= 'Z';
+}
+
+/* ============== Traversal ============== */
+
+static bool walk_slots(OmniValue** slots, size_t n, OmniVisitFn visit, void* user_data) {
+    for (size_t i = 0; i < n; i++) {
+        if (!omni_ast_walk(&slots[i], visit, user_data)) return false;
+    }
+    return true;
+}
+
+bool omni_ast_walk(OmniValue** root, OmniVisitFn visit, void* user_data) {
+    if (!root) return true;
+    OmniWalkAction action = visit(root, user_data);
+    if (action == OMNI_WALK_STOP) return false;
+    OmniValue* v = *root;
+    if (action == OMNI_WALK_SKIP || !v) return true;
+
+    switch (v->tag) {
+    case OMNI_CELL: {
+        /* Iterate the spine so long lists do not deepen the C stack */
+        OmniValue* p = v;
+        for (;;) {
+            if (!omni_ast_walk(&p->cell.car, visit, user_data)) return false;
+            OmniValue** next = &p->cell.cdr;
+            if (omni_is_cell(*next)) {
+                p = *next;
+                continue;
+            }
+            if (omni_is_nil(*next)) return true;
+            return omni_ast_walk(next, visit, user_data);
+        }
+    }
+    case OMNI_ARRAY:
+        return walk_slots(v->array.data, v->array.len, visit, user_data);
+    case OMNI_TUPLE:
+        return walk_slots(v->tuple.data, v->tuple.len, visit, user_data);
+    case OMNI_DICT:
+        for (size_t i = 0; i < v->dict.len; i++) {
+            if (!omni_ast_walk(&v->dict.keys[i], visit, user_data)) return false;
+            if (!omni_ast_walk(&v->dict.values[i], visit, user_data)) return false;
+        }
+        return true;
+    case OMNI_TYPE_LIT:
+        return walk_slots(v->type_lit.params, v->type_lit.param_count, visit, user_data);
+    default:
+        return true;
+    }
+}
+
+/* ============== Validation ============== */
+
+static const char* check_node(OmniValue* v, int depth, OmniValue** bad);
+
+static const char* check_slots(OmniValue** slots, size_t n, int depth, OmniValue* owner,
+                               OmniValue** bad) {
+    if (n > 0 && !slots) {
+        *bad = owner;
+        return "collection with elements but no storage";
+    }
+    for (size_t i = 0; i < n; i++) {
+        const char* err = check_node(slots[i], depth, bad);
+        if (err) return err;
+    }
+    return NULL;
+}
+
+static const char* check_list(OmniValue* v, int depth, OmniValue** bad) {
+    /* slow trails the walk at half speed; meeting it means the spine loops */
+    OmniValue* slow = v;
+    bool advance = false;
+    for (OmniValue* p = v;;) {
+        const char* err = check_node(p->cell.car, depth, bad);
+        if (err) return err;
+        p = p->cell.cdr;
+        if (!omni_is_cell(p)) return check_node(p, depth, bad);
+        if (advance) slow = slow->cell.cdr;
+        advance = !advance;
+        if (p == slow) {
+            *bad = v;
+            return "circular list";
+        }
+    }
+}
+
+static const char* check_node(OmniValue* v, int depth, OmniValue** bad) {
+    if (!v) return NULL;
+    *bad = v;
+    if (depth > OMNI_AST_MAX_DEPTH) return "tree nested too deeply (or cyclic)";
+
+    switch (v->tag) {
+    case OMNI_INT:
+    case OMNI_FLOAT:
+    case OMNI_CHAR:
+    case OMNI_NIL:
+    case OMNI_NOTHING:
+        return NULL;
+    case OMNI_SYM:
+        if (!v->str_val) return "symbol without a name";
+        if (!v->str_val[0]) return "symbol with an empty name";
+        return NULL;
+    case OMNI_KEYWORD:
+        return v->str_val ? NULL : "keyword without a name";
+    case OMNI_STRING:
+        return v->str_val ? NULL : "string without text";
+    case OMNI_ERROR:
+        return v->str_val ? NULL : "error without a message";
+    case OMNI_CELL:
+        return check_list(v, depth + 1, bad);
+    case OMNI_ARRAY:
+        return check_slots(v->array.data, v->array.len, depth + 1, v, bad);
+    case OMNI_TUPLE:
+        return check_slots(v->tuple.data, v->tuple.len, depth + 1, v, bad);
+    case OMNI_DICT: {
+        const char* err = check_slots(v->dict.keys, v->dict.len, depth + 1, v, bad);
+        return err ? err : check_slots(v->dict.values, v->dict.len, depth + 1, v, bad);
+    }
+    case OMNI_TYPE_LIT:
+        if (!v->type_lit.type_name) return "type literal without a name";
+        return check_slots(v->type_lit.params, v->type_lit.param_count, depth + 1, v, bad);
+    default:
+        return "runtime-only value in source tree";
+    }
+}
+
+const char* omni_ast_check(OmniValue* v, OmniValue** bad) {
+    OmniValue* where = NULL;
+    const char* err = check_node(v, 0, &where);
+    if (bad) *bad = err ? where : NULL;
+    return err;
+}
+
 /* ============== String Representation ============== */
 
 static void string_builder_init(char** buf, size_t* cap, size_t* len) {
@@ -619,6 +776,42 @@ static void string_builder_append_char(char** buf, size_t* cap, size_t* len, cha
 
 static char* list_to_string_impl(OmniValue* v);
 
+/* Shortest text that reads back as the same float, as the runtimes print
+ * it: plain (1500.0) unless the magnitude is 1e21 or more or below 1e-7 */
+static void float_to_string(char* buf, size_t cap, double f) {
+    for (int prec = 1; prec <= 17; prec++) {
+        snprintf(buf, cap, "%.*g", prec, f);
+        if (strtod(buf, NULL) == f) break;
+    }
+    char* e = strchr(buf, 'e');
+    double mag = f < 0 ? -f : f;
+    if (e && mag >= 1e-7 && mag < 1e21) {
+        /* Spell out the exponent %g chose: d.ddd times 10^x */
+        int x = atoi(e + 1);
+        char digits[24];
+        int n = 0;
+        for (const char* p = buf; p < e; p++) {
+            if (*p >= '0' && *p <= '9') digits[n++] = *p;
+        }
+        char plain[48];
+        int k = 0;
+        if (f < 0) plain[k++] = '-';
+        if (x < 0) {
+            plain[k++] = '0';
+            plain[k++] = '.';
+            for (int i = -1; i > x; i--) plain[k++] = '0';
+            for (int i = 0; i < n; i++) plain[k++] = digits[i];
+        } else {
+            for (int i = 0; i <= x; i++) plain[k++] = i < n ? digits[i] : '0';
+            if (n > x + 1) plain[k++] = '.';
+            for (int i = x + 1; i < n; i++) plain[k++] = digits[i];
+        }
+        plain[k] = '\0';
+        snprintf(buf, cap, "%s", plain);
+    }
+    if (!strpbrk(buf, ".en") && strlen(buf) + 2 < cap) strcat(buf, ".0");
+}
+
 static char* value_to_string_impl(OmniValue* v) {
     if (!v) return strdup("nil");
 
@@ -632,7 +825,7 @@ static char* value_to_string_impl(OmniValue* v) {
         return strdup(tmp);
 
     case OMNI_FLOAT:
-        snprintf(tmp, sizeof(tmp), "%g", v->float_val);
+        float_to_string(tmp, sizeof(tmp), v->float_val);
         return strdup(tmp);
 
     case OMNI_SYM:
@@ -643,7 +836,11 @@ static char* value_to_string_impl(OmniValue* v) {
         if (v->int_val == '\t') return strdup("#\\tab");
         if (v->int_val == '\r') return strdup("#\\return");
         if (v->int_val == ' ') return strdup("#\\space");
-        snprintf(tmp, sizeof(tmp), "#\\%c", (char)v->int_val);
+        if (v->int_val < 32 || v->int_val > 126) {
+            snprintf(tmp, sizeof(tmp), "#\\x%02lx", (long)v->int_val);
+        } else {
+            snprintf(tmp, sizeof(tmp), "#\\%c", (char)v->int_val);
+        }
         return strdup(tmp);
 
     case OMNI_CODE:
@@ -794,6 +991,27 @@ static char* value_to_string_impl(OmniValue* v) {
         string_builder_append(&buf, &cap, &len, v->str_val);
         return buf;
 
+    case OMNI_STRING:
+        /* Read back by the parser: quotes, backslashes and controls escaped */
+        string_builder_init(&buf, &cap, &len);
+        string_builder_append_char(&buf, &cap, &len, '"');
+        for (const char* c = v->str_val; *c; c++) {
+            if (*c == '"' || *c == '\\') {
+                string_builder_append_char(&buf, &cap, &len, '\\');
+                string_builder_append_char(&buf, &cap, &len, *c);
+            } else if (*c == '\n') {
+                string_builder_append(&buf, &cap, &len, "\\n");
+            } else if (*c == '\t') {
+                string_builder_append(&buf, &cap, &len, "\\t");
+            } else if (*c == '\r') {
+                string_builder_append(&buf, &cap, &len, "\\r");
+            } else {
+                string_builder_append_char(&buf, &cap, &len, *c);
+            }
+        }
+        string_builder_append_char(&buf, &cap, &len, '"');
+        return buf;
+
     default:
         return strdup("?");
     }
@@ -824,6 +1042,7 @@ static char* list_to_string_impl(OmniValue* v) {
     return buf;
 }
 
+
 char* omni_value_to_string(OmniValue* v) {
     return value_to_string_impl(v);
 }
@@ -856,6 +1075,7 @@ const char* omni_tag_name(OmniTag tag) {
     case OMNI_NOTHING: return "NOTHING";
     case OMNI_TYPE_LIT: return "TYPE_LIT";
     case OMNI_KEYWORD: return "KEYWORD";
+    case OMNI_STRING: return "STRING";
     default: return "UNKNOWN";
     }
 }
@@ -49,6 +49,7 @@ typedef enum {
     OMNI_NOTHING,      /* Unit value */
     OMNI_TYPE_LIT,     /* Type literal {Int} */
     OMNI_KEYWORD,      /* Keyword :symbol */
+    OMNI_STRING,       /* String literal "text" */
 } OmniTag;
 
 /* Primitive function signature */
@@ -122,10 +123,26 @@ typedef struct OmniField {
 
 /*
  * Core Value structure - tagged union for all values
+ *
+ * Only the union member named for a node's tag is meaningful; reading
+ * any other member is undefined. Trees handed to the compiler (see
+ * omni_ast_check) must also satisfy:
+ *   - NULL is accepted wherever nil is and reads as the empty list
+ *   - str_val of SYM, KEYWORD, STRING and ERROR is non-NULL; symbols are
+ *     non-empty
+ *   - cell.car and cell.cdr are nodes or NULL; list spines end in nil or
+ *     a non-cell tail and never loop back on themselves
+ *   - array/tuple data hold len nodes, dict keys/values hold len nodes
+ *   - runtime-only tags (PRIM, MENV, CODE, LAMBDA, BOX, CONT, channels,
+ *     threads, USER_TYPE, ...) never appear in source trees
  */
 struct OmniValue {
     OmniTag tag;
 
+    /* Where the parser read this node, 1-based; 0 for nodes built in code */
+    int line;
+    int column;
+
     union {
         /* OMNI_INT, OMNI_CHAR */
         int64_t int_val;
@@ -133,7 +150,7 @@ struct OmniValue {
         /* OMNI_FLOAT */
         double float_val;
 
-        /* OMNI_SYM, OMNI_CODE, OMNI_ERROR, OMNI_KEYWORD */
+        /* OMNI_SYM, OMNI_CODE, OMNI_ERROR, OMNI_KEYWORD, OMNI_STRING */
         char* str_val;
 
         /* OMNI_CELL */
@@ -229,6 +246,14 @@ struct OmniValue {
     };
 };
 
+/* Where a diagnostic points: the 1-based top-level form (0 when outside
+ * any) and the position of the innermost parsed node (line 0 if none) */
+typedef struct OmniLocation {
+    size_t form;
+    int line;
+    int column;
+} OmniLocation;
+
 /* ============== Singleton Values ============== */
 
 extern OmniValue* omni_nil;
@@ -241,40 +266,62 @@ void omni_arena_free(OmniArena* arena);
 void* omni_arena_alloc(OmniArena* arena, size_t size);
 char* omni_arena_strdup(OmniArena* arena, const char* s);
 
-/* Global arena for AST allocations */
-void omni_ast_arena_init(void);
-void omni_ast_arena_cleanup(void);
-OmniArena* omni_ast_arena_get(void);
+/* ============== Sessions ============== */
+
+struct OmniMacros;
+struct AnalysisContext;
+struct CodeGenContext;
+
+/* What one compilation works with, passed explicitly to the parser, the
+ * macro expander, the analyses and the code generator so that separate
+ * sessions can run at the same time on different threads. The registries
+ * are filled in by the compiler as it creates them; the session does not
+ * own them. */
+typedef struct OmniSession {
+    OmniArena* arena;                   /* Nodes read or built in the session */
+    struct OmniMacros* types;           /* Macros and the types deftype recorded */
+    struct AnalysisContext* summaries;  /* Function summaries of the program */
+    struct CodeGenContext* codegen;     /* Code generator */
+} OmniSession;
+
+/* A session with a fresh arena and no registries yet */
+OmniSession* omni_session_new(void);
+
+/* Free the session and every node allocated in its arena */
+void omni_session_free(OmniSession* session);
 
 /* ============== Constructors ============== */
 
-OmniValue* omni_new_int(int64_t i);
-OmniValue* omni_new_float(double f);
-OmniValue* omni_new_sym(const char* s);
-OmniValue* omni_new_char(int32_t c);
-OmniValue* omni_new_cell(OmniValue* car, OmniValue* cdr);
-OmniValue* omni_new_prim(OmniPrimFn fn);
-OmniValue* omni_new_code(const char* s);
-OmniValue* omni_new_lambda(OmniValue* params, OmniValue* body, OmniValue* env);
-OmniValue* omni_new_rec_lambda(OmniValue* self_name, OmniValue* params, OmniValue* body, OmniValue* env);
-OmniValue* omni_new_error(const char* msg);
-OmniValue* omni_new_box(OmniValue* initial);
-OmniValue* omni_new_cont(OmniContFn fn, OmniValue* menv, int tag);
-OmniValue* omni_new_chan(int capacity);
-OmniValue* omni_new_green_chan(int capacity);
-OmniValue* omni_new_atom(OmniValue* initial);
-OmniValue* omni_new_thread(void);
-OmniValue* omni_new_process(OmniValue* thunk);
-OmniValue* omni_new_menv(OmniValue* env, OmniValue* parent, int level);
-OmniValue* omni_new_keyword(const char* name);
+/* Nodes, and the arrays and strings in them, are allocated in arena */
+
+OmniValue* omni_new_int(OmniArena* arena, int64_t i);
+OmniValue* omni_new_float(OmniArena* arena, double f);
+OmniValue* omni_new_sym(OmniArena* arena, const char* s);
+OmniValue* omni_new_char(OmniArena* arena, int32_t c);
+OmniValue* omni_new_string(OmniArena* arena, const char* s);
+OmniValue* omni_new_cell(OmniArena* arena, OmniValue* car, OmniValue* cdr);
+OmniValue* omni_new_prim(OmniArena* arena, OmniPrimFn fn);
+OmniValue* omni_new_code(OmniArena* arena, const char* s);
+OmniValue* omni_new_lambda(OmniArena* arena, OmniValue* params, OmniValue* body, OmniValue* env);
+OmniValue* omni_new_rec_lambda(OmniArena* arena, OmniValue* self_name, OmniValue* params, OmniValue* body, OmniValue* env);
+OmniValue* omni_new_error(OmniArena* arena, const char* msg);
+OmniValue* omni_new_box(OmniArena* arena, OmniValue* initial);
+OmniValue* omni_new_cont(OmniArena* arena, OmniContFn fn, OmniValue* menv, int tag);
+OmniValue* omni_new_chan(OmniArena* arena, int capacity);
+OmniValue* omni_new_green_chan(OmniArena* arena, int capacity);
+OmniValue* omni_new_atom(OmniArena* arena, OmniValue* initial);
+OmniValue* omni_new_thread(OmniArena* arena);
+OmniValue* omni_new_process(OmniArena* arena, OmniValue* thunk);
+OmniValue* omni_new_menv(OmniArena* arena, OmniValue* env, OmniValue* parent, int level);
+OmniValue* omni_new_keyword(OmniArena* arena, const char* name);
 
 /* OmniLisp collection constructors */
-OmniValue* omni_new_array(size_t initial_cap);
-OmniValue* omni_new_array_from(OmniValue** elements, size_t len);
-OmniValue* omni_new_dict(void);
-OmniValue* omni_new_tuple(OmniValue** elements, size_t len);
-OmniValue* omni_new_type_lit(const char* name, OmniValue** params, size_t param_count);
-OmniValue* omni_new_user_type(const char* type_name, OmniField* fields, size_t field_count);
+OmniValue* omni_new_array(OmniArena* arena, size_t initial_cap);
+OmniValue* omni_new_array_from(OmniArena* arena, OmniValue** elements, size_t len);
+OmniValue* omni_new_dict(OmniArena* arena);
+OmniValue* omni_new_tuple(OmniArena* arena, OmniValue** elements, size_t len);
+OmniValue* omni_new_type_lit(OmniArena* arena, const char* name, OmniValue** params, size_t param_count);
+OmniValue* omni_new_user_type(OmniArena* arena, const char* type_name, OmniField* fields, size_t field_count);
 
 /* ============== Type Predicates ============== */
 
@@ -303,6 +350,7 @@ static inline bool omni_is_tuple(OmniValue* v) { return v != NULL && v->tag == O
 static inline bool omni_is_nothing(OmniValue* v) { return v == omni_nothing || (v != NULL && v->tag == OMNI_NOTHING); }
 static inline bool omni_is_type_lit(OmniValue* v) { return v != NULL && v->tag == OMNI_TYPE_LIT; }
 static inline bool omni_is_keyword(OmniValue* v) { return v != NULL && v->tag == OMNI_KEYWORD; }
+static inline bool omni_is_string(OmniValue* v) { return v != NULL && v->tag == OMNI_STRING; }
 static inline bool omni_is_user_type(OmniValue* v) { return v != NULL && v->tag == OMNI_USER_TYPE; }
 
 /* ============== Accessors ============== */
@@ -324,12 +372,15 @@ bool omni_values_equal(OmniValue* a, OmniValue* b);
 
 /* ============== List Helpers ============== */
 
-OmniValue* omni_list1(OmniValue* a);
-OmniValue* omni_list2(OmniValue* a, OmniValue* b);
-OmniValue* omni_list3(OmniValue* a, OmniValue* b, OmniValue* c);
+OmniValue* omni_list1(OmniArena* arena, OmniValue* a);
+OmniValue* omni_list2(OmniArena* arena, OmniValue* a, OmniValue* b);
+OmniValue* omni_list3(OmniArena* arena, OmniValue* a, OmniValue* b, OmniValue* c);
 size_t omni_list_len(OmniValue* v);
-OmniValue** omni_list_to_array(OmniValue* v, size_t* out_len);
-OmniValue* omni_array_to_list(OmniValue** items, size_t len);
+OmniValue** omni_list_to_array(OmniArena* arena, OmniValue* v, size_t* out_len);
+OmniValue* omni_array_to_list(OmniArena* arena, OmniValue** items, size_t len);
+
+/* Build a proper list from count node arguments: omni_list_of(arena, 2, a, b) */
+OmniValue* omni_list_of(OmniArena* arena, size_t count, ...);
 
 /* ============== Box Operations ============== */
 
@@ -341,14 +392,16 @@ void omni_box_set(OmniValue* box, OmniValue* val);
 size_t omni_array_len(OmniValue* arr);
 OmniValue* omni_array_get(OmniValue* arr, size_t idx);
 void omni_array_set(OmniValue* arr, size_t idx, OmniValue* val);
-void omni_array_push(OmniValue* arr, OmniValue* val);
+/* Growing arr takes new space from arena, the one it was made in */
+void omni_array_push(OmniArena* arena, OmniValue* arr, OmniValue* val);
 OmniValue* omni_array_pop(OmniValue* arr);
 
 /* ============== Dict Operations ============== */
 
 size_t omni_dict_len(OmniValue* dict);
 OmniValue* omni_dict_get(OmniValue* dict, OmniValue* key);
-void omni_dict_set(OmniValue* dict, OmniValue* key, OmniValue* val);
+/* Likewise for dict */
+void omni_dict_set(OmniArena* arena, OmniValue* dict, OmniValue* key, OmniValue* val);
 bool omni_dict_has(OmniValue* dict, OmniValue* key);
 
 /* ============== Tuple Operations ============== */
@@ -362,6 +415,43 @@ OmniValue* omni_user_type_get_field(OmniValue* v, const char* field_name);
 void omni_user_type_set_field(OmniValue* v, const char* field_name, OmniValue* val);
 bool omni_user_type_is(OmniValue* v, const char* type_name);
 
+/* Whether spec, one of the specs of (deftype Name spec...), is a variant
+ * (Variant field...) of a sum type rather than a field: a list headed by
+ * a capitalised name */
+bool omni_is_variant_spec(OmniValue* spec);
+
+/* ============== Traversal ============== */
+
+typedef enum {
+    OMNI_WALK_CONTINUE = 0,   /* Visit the node's children */
+    OMNI_WALK_SKIP,           /* Do not descend into this node */
+    OMNI_WALK_STOP            /* Abandon the walk */
+} OmniWalkAction;
+
+/* Called with the slot holding a node; storing into *node replaces it */
+typedef OmniWalkAction (*OmniVisitFn)(OmniValue** node, void* user_data);
+
+/*
+ * Walk the tree rooted at *root in pre-order. A list is visited once as a
+ * whole and then each element in order (spine cells are not visited on
+ * their own; a dotted tail is). Children of a replacement node are walked
+ * unless visit returns OMNI_WALK_SKIP. Replacements are written into the
+ * parent in place. Returns false if the walk was stopped.
+ */
+bool omni_ast_walk(OmniValue** root, OmniVisitFn visit, void* user_data);
+
+/* ============== Validation ============== */
+
+/* Deepest nesting omni_ast_check accepts (also catches car cycles) */
+#define OMNI_AST_MAX_DEPTH 10000
+
+/*
+ * Check the invariants documented on OmniValue. Returns NULL for a well
+ * formed tree, otherwise a static description of the first problem and,
+ * if bad is non-NULL, the offending node.
+ */
+const char* omni_ast_check(OmniValue* v, OmniValue** bad);
+
 /* ============== String Representation ============== */
 
 char* omni_value_to_string(OmniValue* v);
@@ -0,0 +1,205 @@
+/*
+ * OmniLisp Hot Reload - swap function definitions in a running program
+ *
+ * See hot.h for how programs and patches are built and loaded.
+ */
+
+#include "hot.h"
+#include "../parser/parser.h"
+
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <unistd.h>
+#include <dlfcn.h>
+#include <pthread.h>
+
+/* Longest definition line accepted from stdin */
+#define HOT_LINE_MAX 65536
+
+typedef struct {
+    Compiler* compiler;       /* Options and error reporting */
+    OmniSession* ast;         /* Holds the forms, old and new */
+    OmniValue** forms;        /* Program as last loaded */
+    size_t count;
+    void* program;            /* Loaded program, which exports the runtime */
+} HotSession;
+
+static void report_errors(Compiler* c) {
+    for (size_t i = 0; i < omni_compiler_error_count(c); i++) {
+        fprintf(stderr, "Error: %s\n", omni_compiler_get_error(c, i));
+    }
+}
+
+/* Name defined by (define (name params...) body...), else NULL */
+static const char* defined_function(OmniValue* form, size_t* params) {
+    if (!omni_is_cell(form) || !omni_sym_eq_str(omni_car(form), "define")) return NULL;
+    OmniValue* sig = omni_car(omni_cdr(form));
+    if (!omni_is_cell(sig) || !omni_is_sym(omni_car(sig))) return NULL;
+    if (params) *params = omni_list_len(omni_cdr(sig));
+    return omni_car(sig)->str_val;
+}
+
+/* Check the module in handle against the runtime it will run on; purple.h
+ * is not included here, so the ABI record stays opaque */
+static bool abi_compatible(void* runtime, void* handle, const char* path) {
+    int (*check)(const void*, char*, size_t) =
+        (int (*)(const void*, char*, size_t))dlsym(runtime, "purple_abi_check");
+    if (!check) {
+        fprintf(stderr, "Error: cannot load %s: the runtime has no purple_abi_check; rebuild libpurple\n", path);
+        return false;
+    }
+    char why[256];
+    if (!check(dlsym(handle, "omni_module_abi"), why, sizeof(why))) {
+        fprintf(stderr, "Error: cannot load %s: %s\n", path, why);
+        return false;
+    }
+    return true;
+}
+
+/* Compile forms into a shared object and load it; patch names the only
+ * function to emit, NULL builds the whole program */
+static void* build_and_load(HotSession* s, OmniValue** forms, size_t count,
+                            const char* patch) {
+    char* path = omni_compiler_temp_path(s->compiler, ".so");
+    if (!path) {
+        perror("Error: cannot create temporary file");
+        return NULL;
+    }
+
+    CompilerOptions opts = s->compiler->options;
+    opts.hot_reload = patch == NULL;
+    opts.hot_patch = patch;
+    Compiler* c = omni_compiler_new_with_options(&opts);
+    bool ok = omni_compiler_compile_ast_to_binary(c, forms, count, path);
+    if (!ok) report_errors(c);
+    omni_compiler_free(c);
+
+    /* The program shares its runtime and functions with later patches */
+    void* handle = NULL;
+    if (ok) {
+        handle = dlopen(path, RTLD_NOW | (patch ? RTLD_LOCAL : RTLD_GLOBAL));
+        if (!handle) {
+            fprintf(stderr, "Error: cannot load %s: %s\n", path, dlerror());
+        } else if (!abi_compatible(patch ? s->program : handle, handle, path)) {
+            dlclose(handle);
+            handle = NULL;
+        }
+    }
+    omni_compiler_remove_temp(s->compiler, path);
+    free(path);
+    return handle;
+}
+
+/* ============== Program Thread ============== */
+
+static void* run_program(void* entry) {
+    int (*program_main)(void) = (int (*)(void))entry;
+    int rc = program_main();
+    fflush(stdout);
+    exit(rc);
+    return NULL;
+}
+
+/* ============== Patches ============== */
+
+/* Replace one function of the running program with the definition in line */
+static void apply_definition(HotSession* s, const char* line) {
+    OmniParser* parser = omni_parser_new(s->ast, line);
+    size_t n = 0;
+    OmniValue** parsed = omni_parser_parse_all(parser, &n);
+    bool bad_parse = omni_parser_get_errors(parser) != NULL;
+    omni_parser_free(parser);
+
+    size_t params = 0;
+    const char* name = !bad_parse && n == 1 ? defined_function(parsed[0], &params) : NULL;
+    if (!name) {
+        fprintf(stderr, "Error: expected one function definition, (define (f ...) ...)\n");
+        free(parsed);
+        return;
+    }
+
+    size_t at = s->count;
+    size_t old_params = 0;
+    for (size_t i = 0; i < s->count && at == s->count; i++) {
+        const char* old = defined_function(s->forms[i], &old_params);
+        if (old && strcmp(old, name) == 0) at = i;
+    }
+    if (at == s->count) {
+        fprintf(stderr, "Error: %s: only functions the program defines can be reloaded\n", name);
+    } else if (params != old_params) {
+        fprintf(stderr, "Error: %s: takes %zu arguments in the running program; restart to change that\n",
+                name, old_params);
+    } else {
+        OmniValue* old = s->forms[at];
+        s->forms[at] = parsed[0];
+
+        void* handle = build_and_load(s, s->forms, s->count, name);
+        void (*install)(void) = handle ? (void (*)(void))dlsym(handle, "omni_hot_install") : NULL;
+        if (install) {
+            install();
+            fprintf(stderr, "reloaded %s\n", name);
+        } else {
+            /* The running program keeps the old definition */
+            s->forms[at] = old;
+        }
+    }
+    free(parsed);
+}
+
+/* ============== Session ============== */
+
+int omni_hot_run(Compiler* compiler, const OmniSource* units, size_t count) {
+    if (!compiler->options.runtime_path) {
+        fprintf(stderr, "Error: hot reload needs the libpurple runtime (see --runtime)\n");
+        return 1;
+    }
+
+    HotSession s = { .compiler = compiler, .ast = omni_session_new() };
+    size_t capacity = 0;
+    for (size_t u = 0; u < count; u++) {
+        OmniParser* parser = omni_parser_new(s.ast, units[u].text);
+        size_t n = 0;
+        OmniValue** forms = omni_parser_parse_all(parser, &n);
+        for (OmniParseError* err = omni_parser_get_errors(parser); err; err = err->next) {
+            fprintf(stderr, "%s:%d:%d: E0005 parse error: %s\n", units[u].name ? units[u].name : "<input>",
+                    err->line, err->column, err->message);
+            count = 0;
+        }
+        omni_parser_free(parser);
+        if (s.count + n > capacity) {
+            capacity = (s.count + n) * 2;
+            s.forms = realloc(s.forms, capacity * sizeof(OmniValue*));
+        }
+        for (size_t i = 0; i < n; i++) s.forms[s.count++] = forms[i];
+        free(forms);
+    }
+    if (count == 0) {
+        free(s.forms);
+        omni_session_free(s.ast);
+        return 1;
+    }
+
+    s.program = build_and_load(&s, s.forms, s.count, NULL);
+    void* entry = s.program ? dlsym(s.program, "main") : NULL;
+    pthread_t thread;
+    if (!entry || pthread_create(&thread, NULL, run_program, entry) != 0) {
+        free(s.forms);
+        omni_session_free(s.ast);
+        return 1;
+    }
+
+    /* Definitions until EOF; the program thread exits the process when
+     * it finishes first */
+    char* line = malloc(HOT_LINE_MAX);
+    while (fgets(line, HOT_LINE_MAX, stdin)) {
+        size_t len = strlen(line);
+        while (len > 0 && (line[len - 1] == '\n' || line[len - 1] == '\r')) line[--len] = '\0';
+        if (len == 0) continue;
+        apply_definition(&s, line);
+    }
+    free(line);
+
+    pthread_join(thread, NULL);
+    return 0;
+}
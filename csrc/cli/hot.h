@@ -0,0 +1,38 @@
+/*
+ * OmniLisp Hot Reload - swap function definitions in a running program
+ *
+ * The program is built as a shared object in which every top-level
+ * function is called through an exported pointer, loaded into this
+ * process and started on its own thread. Each line read from stdin is
+ * then a function definition: it is compiled against the program into a
+ * small patch object, loaded, and its omni_hot_install swaps the pointer
+ * atomically. Calls already running finish in the old code; every later
+ * call, including recursive ones, runs the new one.
+ *
+ * Only functions the program defines can be replaced, keeping their
+ * parameter count. Needs the libpurple runtime, which the program exports
+ * to its patches.
+ *
+ * Every object loaded, program or patch, is first checked against the
+ * runtime's module ABI (purple_abi_check); one built for a different ABI
+ * version, object layout or tag numbering is refused with the reason.
+ */
+
+#ifndef OMNILISP_HOT_H
+#define OMNILISP_HOT_H
+
+#include "../compiler/compiler.h"
+
+#ifdef __cplusplus
+extern "C" {
+#endif
+
+/* Run the program and apply definitions from stdin until the program
+ * exits (its status is returned) or stdin ends (then wait for it) */
+int omni_hot_run(Compiler* compiler, const OmniSource* units, size_t count);
+
+#ifdef __cplusplus
+}
+#endif
+
+#endif /* OMNILISP_HOT_H */
@@ -13,37 +13,156 @@
 #include <getopt.h>
 
 #include "../compiler/compiler.h"
+#include "server.h"
+#include "hot.h"
+#include "repl.h"
 #include "../parser/parser.h"
 #include "../ast/ast.h"
+#include "../macro/macro.h"
+#include "../diff/diff.h"
+#include "../lint/lint.h"
+#include "../fix/fix.h"
+#include "../diagnostics/diagnostics.h"
 
 /* ============== Options ============== */
 
 typedef struct {
     bool compile_mode;        /* -c: emit C code only */
+    bool standalone;          /* --standalone: -c output that builds without libpurple */
+    bool expand_mode;         /* -E: print the program after macro expansion */
     bool verbose;             /* -v: verbose output */
+    bool debug;               /* -g: debug symbols and a crash report */
+    bool stats;               /* -stats: report what the optimisations did */
+    bool check_mode;          /* -check: diagnostics only, no C compiler */
+    bool graph_mode;          /* --graph: print the call graph, build nothing */
+    OmniGraphFormat graph_format;
     const char* output_file;  /* -o: output file */
     const char* eval_expr;    /* -e: evaluate expression */
+    bool script;              /* -script: no echo; exit with the last value */
     const char* runtime_path; /* --runtime: runtime path */
-    const char* input_file;   /* Input file */
+    bool embedded;            /* --embedded: never link libpurple */
+    bool diff_mode;           /* --diff: structural diff of two files */
+    bool lint_mode;           /* --lint: static checks of the input files */
+    bool fix_mode;            /* --fix: apply the safe lint fixes in place */
+    bool dry_run;             /* --dry-run: print what --fix would change */
+    bool accept_renames;      /* --accept-renames: --fix also renames unbound symbols */
+    bool verify_mode;         /* --verify: check a binary's build record against sources */
+    bool server_mode;         /* --server: machine-oriented REPL protocol */
+    int server_port;          /* --port: serve over TCP instead of stdio */
+    long record_steps;        /* --record: calls kept for debug-history */
+    bool hot_mode;            /* --hot: run, then swap in definitions from stdin */
+    bool repl_mode;           /* --repl: the REPL even when stdin is not a terminal */
+    OmniShadowPolicy shadowing; /* -Wstrict, -Wno-shadow */
+    OmniDeprecatedPolicy deprecations; /* -Werror=deprecated, -Wno-deprecated */
+    bool keep_temps;          /* --keep-temps: leave generated files in place */
+    bool checked;             /* --checked: list operations reject improper lists */
+    bool constraint_check;    /* --constraint-check: report frees of borrowed objects */
+    bool coop_cancel;         /* -coop-cancel: check for cancellation in every call */
+    unsigned strategies;      /* --strategy: OmniStrategy mask, 0 = default */
+    OmniMemoryMode memory;    /* -O: memory strategies of the code and embedded runtime */
+    bool size_profile;        /* --profile size: build for the smallest binary */
+    bool minimal_io;          /* --minimal-io: embedded runtime prints without printf */
+    bool freestanding;        /* -freestanding: an object for a target without libc */
+    char* link_with;          /* --link: objects and libraries added to the link */
+    const char* cc;           /* -cc: C compiler, else $CC, else one found on PATH */
+    const char* cflags;       /* -cflags: added C compiler flags, else $CFLAGS */
+    const char* ldflags;      /* -ldflags: added link flags, else $LDFLAGS */
+    const char* target;       /* -target: triple to cross-compile for */
+    int lang;                 /* -lang: level of files without #lang */
+    size_t heap_limit;        /* --heap-limit: bytes the embedded runtime may hold */
+    OmniOomPolicy oom_policy; /* --oom: abort or unwind to catch-oom */
+    bool oom_set;
+    const char** input_files; /* Input files, compiled in order */
+    int input_count;
 } CliOptions;
 
 static void print_usage(const char* prog) {
     fprintf(stderr, "OmniLisp - Native Compiler with ASAP Memory Management\n\n");
-    fprintf(stderr, "Usage: %s [options] [file.omni]\n\n", prog);
+    fprintf(stderr, "Usage: %s [options] [file.omni...]\n\n", prog);
     fprintf(stderr, "Options:\n");
     fprintf(stderr, "  -c             Compile to C code instead of binary\n");
+    fprintf(stderr, "  --standalone   With -c, inline libpurple's sources so the C builds alone\n");
+    fprintf(stderr, "  -E             Print the program with its macros expanded\n");
     fprintf(stderr, "  -o <file>      Output file (default: stdout for -c, a.out for binary)\n");
     fprintf(stderr, "  -e <expr>      Evaluate expression from command line\n");
-    fprintf(stderr, "  -v             Verbose output\n");
+    fprintf(stderr, "  -script        Print only what the program displays, and exit with the\n");
+    fprintf(stderr, "                 value of its last expression (an int; 1 for an error)\n");
+    fprintf(stderr, "  -v             Verbose output (includes per-phase timing)\n");
+    fprintf(stderr, "  -g             Build with debug symbols and a crash handler that prints\n");
+    fprintf(stderr, "                 the function stack, recent reference counts and heap use\n");
+    fprintf(stderr, "  -stats         Report how many conses reuse the memory of a dead pair\n");
+    fprintf(stderr, "  -check         Report errors and warnings without building anything\n");
+    fprintf(stderr, "  --graph <format>  Print the program's call graph, with each function's\n");
+    fprintf(stderr, "                    effects and what calls pass, as dot or json\n");
+    fprintf(stderr, "  -Wstrict       Treat bindings that shadow built-in names as errors\n");
+    fprintf(stderr, "  -Wno-shadow    Allow such bindings without a warning\n");
+    fprintf(stderr, "  -Werror=deprecated  Treat uses of deprecated behaviour as errors\n");
+    fprintf(stderr, "  -Wno-deprecated     Allow them without a warning\n");
+    fprintf(stderr, "  -lang <level>  Language level of files without a #lang line, such as\n");
+    fprintf(stderr, "                 purple/1 (default: the latest, purple/%d)\n", OMNI_LANG_LATEST);
     fprintf(stderr, "  --runtime <path>  Path to runtime library\n");
+    fprintf(stderr, "  --embedded     Use the embedded runtime even if libpurple is found\n");
+    fprintf(stderr, "  --diff <a> <b> Show structural differences between two programs\n");
+    fprintf(stderr, "  --lint <file...>  Report likely mistakes the compiler accepts, with fixes\n");
+    fprintf(stderr, "  --fix <file...>   Apply the lint fixes that keep what the program does\n");
+    fprintf(stderr, "  --dry-run      With --fix, print the changes as a diff instead of writing\n");
+    fprintf(stderr, "  --accept-renames  With --fix, rename each unbound symbol to the first\n");
+    fprintf(stderr, "                    name the compiler suggests for it\n");
+    fprintf(stderr, "  --verify <binary> <file...>  Check that a binary was built from these\n");
+    fprintf(stderr, "                    sources (the binary's --purple-info record)\n");
+    fprintf(stderr, "  --server       Serve the length-prefixed JSON protocol on stdin/stdout\n");
+    fprintf(stderr, "  --port <n>     Serve the protocol on 127.0.0.1:<n> (implies --server)\n");
+    fprintf(stderr, "  --record <n>   Keep the last <n> function calls for (debug-history)\n");
+    fprintf(stderr, "  --hot          Run, replacing functions with definitions read from stdin\n");
+    fprintf(stderr, "  --repl         Start the REPL even when stdin is not a terminal\n");
+    fprintf(stderr, "  --explain <code>  Explain an error, lint or deprecation code such as\n");
+    fprintf(stderr, "                    E0001, L0001 or D0001\n");
+    fprintf(stderr, "  --keep-temps   Keep generated C, objects and binaries and print where\n");
+    fprintf(stderr, "  -checked       Make list operations return an error for improper lists\n");
+    fprintf(stderr, "  -constraint-check  Report objects freed while a borrow is still open\n");
+    fprintf(stderr, "  -coop-cancel   Let with-cancel and nurseries stop code that never allocates\n");
+    fprintf(stderr, "  -O <mode>      Memory strategies to compile in: asap, rc, arena or all\n");
+    fprintf(stderr, "                 (embedded runtime; default: what the program uses, as rc)\n");
+    fprintf(stderr, "  --strategy <list>   Release values with memory strategies added to asap\n");
+    fprintf(stderr, "                      (perceus, arena, deferred, symmetric, scc; libpurple only)\n");
+    fprintf(stderr, "  --profile size Optimise for size, drop unused code and runtime sections,\n");
+    fprintf(stderr, "                 and report the size of each section of a binary built with -o\n");
+    fprintf(stderr, "  --minimal-io   Print without the printf family (embedded runtime)\n");
+    fprintf(stderr, "  -freestanding  Build for a target without libc or threads: -o writes an\n");
+    fprintf(stderr, "                 object using purple_malloc, purple_free and purple_putchar\n");
+    fprintf(stderr, "  --link <file>  Link an object or library into the binary, such as one\n");
+    fprintf(stderr, "                 defining purple_malloc and purple_free (repeatable)\n");
+    fprintf(stderr, "  -cc <compiler> C compiler to build with (default: $CC, else gcc, clang\n");
+    fprintf(stderr, "                 or cc, whichever is found first)\n");
+    fprintf(stderr, "  -cflags <flags>   Flags added when compiling the C (default: $CFLAGS)\n");
+    fprintf(stderr, "  -ldflags <flags>  Flags added to the link (default: $LDFLAGS)\n");
+    fprintf(stderr, "  -target <triple>  Build for another machine with -o or -c, such as\n");
+    fprintf(stderr, "                    aarch64-linux-gnu (<triple>-gcc, or clang --target)\n");
+    fprintf(stderr, "  --heap-limit <n>  Fail allocations that would hold more than <n> bytes\n");
+    fprintf(stderr, "                    (k, m or g suffix; embedded runtime)\n");
+    fprintf(stderr, "  --oom <policy>    On out of memory, abort (default) or raise an error\n");
+    fprintf(stderr, "                    that catch-oom catches (error; embedded runtime)\n");
     fprintf(stderr, "  -h, --help     Show this help\n");
     fprintf(stderr, "  --version      Show version\n");
+    fprintf(stderr, "\nEnvironment:\n");
+    fprintf(stderr, "  PURPLE_TMPDIR  Directory for temporary files (default: /tmp)\n");
+    fprintf(stderr, "  CC, CFLAGS, LDFLAGS  Compiler and flags when -cc, -cflags and\n");
+    fprintf(stderr, "                 -ldflags are not given\n");
     fprintf(stderr, "\nExamples:\n");
     fprintf(stderr, "  %s -e '(+ 1 2)'              # Compile and run expression\n", prog);
     fprintf(stderr, "  %s -c -e '(+ 1 2)'           # Emit C code to stdout\n", prog);
-    fprintf(stderr, "  %s program.omni              # Compile and run file\n", prog);
+    fprintf(stderr, "  %s program.omni              # Run file as a script\n", prog);
+    fprintf(stderr, "  %s -script -e '(- 3 1)'      # Run without echo; exit status 2\n", prog);
     fprintf(stderr, "  %s -c program.omni -o out.c  # Compile file to C\n", prog);
     fprintf(stderr, "  %s -o prog program.omni      # Compile to binary 'prog'\n", prog);
+    fprintf(stderr, "  %s -o prog lib.omni main.omni  # Compile several files into one binary\n", prog);
+    fprintf(stderr, "  %s --diff old.omni new.omni  # Diff ignoring layout and comments\n", prog);
+    fprintf(stderr, "  %s -check lib.omni main.omni # Validate files without building\n", prog);
+    fprintf(stderr, "  %s --lint program.omni       # Check for likely mistakes\n", prog);
+    fprintf(stderr, "  %s --graph dot prog.omni | dot -Tsvg > calls.svg  # Draw the call graph\n", prog);
+    fprintf(stderr, "  %s --fix --dry-run prog.omni # Show the fixes --fix would make\n", prog);
+    fprintf(stderr, "  %s --verify prog prog.omni   # Check prog was built from prog.omni\n", prog);
+    fprintf(stderr, "  %s --hot server.omni         # Live-edit a long-running program\n", prog);
 }
 
 static void print_version(void) {
@@ -52,16 +171,193 @@ static void print_version(void) {
     printf("Target: C99 + POSIX\n");
 }
 
+/* ============== Diff ============== */
+
+/* Parse a file's top-level forms into session, reporting errors against
+ * its path */
+static OmniValue** parse_file(OmniSession* session, const char* path, size_t* count) {
+    char* text = omni_fs_read(omni_fs_os(), path);
+    if (!text) {
+        fprintf(stderr, "Error: cannot open file: %s\n", path);
+        return NULL;
+    }
+    OmniParser* parser = omni_parser_new(session, text);
+    OmniValue** forms = omni_parser_parse_all(parser, count);
+    OmniParseError* errs = omni_parser_get_errors(parser);
+    for (OmniParseError* err = errs; err; err = err->next) {
+        fprintf(stderr, "%s:%d:%d: E0005 parse error: %s\n", path, err->line, err->column, err->message);
+    }
+    if (errs) {
+        free(forms);
+        forms = NULL;
+    }
+    omni_parser_free(parser);
+    free(text);
+    return forms;
+}
+
+/* Print the catalog entry for an error, lint or deprecation code */
+static int explain_error(const char* id) {
+    const OmniErrorInfo* info = omni_error_lookup(id);
+    const OmniLintInfo* lint = info ? NULL : omni_lint_lookup(id);
+    const OmniDeprecationInfo* dep = info || lint ? NULL : omni_deprecation_lookup(id);
+    if (info) {
+        printf("%s: %s\n\n%s", info->id, info->title, info->explanation);
+    } else if (lint) {
+        printf("%s: %s\n\n%s", lint->id, lint->title, lint->explanation);
+    } else if (dep) {
+        printf("%s: %s\n\n%s", dep->id, dep->title, dep->explanation);
+    } else {
+        fprintf(stderr, "Error: unknown error code: %s\n", id);
+        return 1;
+    }
+    return 0;
+}
+
+/* Exit status follows diff(1): 0 same, 1 different, 2 trouble */
+static int run_diff(const char* old_path, const char* new_path) {
+    OmniSession* session = omni_session_new();
+    size_t a_count = 0, b_count = 0;
+    OmniValue** a = parse_file(session, old_path, &a_count);
+    OmniValue** b = a ? parse_file(session, new_path, &b_count) : NULL;
+    if (!a || !b) {
+        free(a);
+        omni_session_free(session);
+        return 2;
+    }
+
+    OmniDiff* diff = omni_diff_forms(a, a_count, b, b_count);
+    if (diff->count > 0) {
+        printf("--- %s\n+++ %s\n", old_path, new_path);
+        omni_diff_print(stdout, diff);
+    }
+    int rc = diff->count > 0 ? 1 : 0;
+
+    omni_diff_free(diff);
+    free(a);
+    free(b);
+    omni_session_free(session);
+    return rc;
+}
+
+/* ============== Lint ============== */
+
+/* Exit status as for --diff: 0 clean, 1 findings, 2 trouble */
+static int run_lint(const char** paths, int count) {
+    int rc = 0;
+    for (int i = 0; i < count; i++) {
+        OmniSession* session = omni_session_new();
+        size_t n = 0;
+        OmniValue** forms = parse_file(session, paths[i], &n);
+        if (!forms) {
+            omni_session_free(session);
+            rc = 2;
+            continue;
+        }
+        OmniLints* lints = omni_lint_forms(session->arena, forms, n);
+        omni_lint_print(stdout, paths[i], lints);
+        if (lints->count > 0 && rc == 0) rc = 1;
+        omni_lint_free(lints);
+        free(forms);
+        omni_session_free(session);
+    }
+    return rc;
+}
+
+/* ============== Fix ============== */
+
+/* The renames the compiler suggests for text's unbound symbols: the
+ * first name of each "E0001 unbound symbol: x (did you mean y, ...?)" */
+static size_t suggested_renames(const char* path, const char* text, OmniRename** out) {
+    CompilerOptions comp_opts = {
+        .emit_c_only = true,
+        .script_mode = true,
+        .use_embedded_runtime = true,
+        .opt_level = 2,
+        .cc = "gcc",
+    };
+    Compiler* compiler = omni_compiler_new_with_options(&comp_opts);
+    OmniSource unit = { path, text };
+    free(omni_compiler_compile_units_to_c(compiler, &unit, 1));
+
+    size_t count = 0;
+    *out = calloc(omni_compiler_error_count(compiler) + 1, sizeof(OmniRename));
+    for (size_t i = 0; i < omni_compiler_error_count(compiler); i++) {
+        const char* e = strstr(omni_compiler_get_error(compiler, i), "E0001 unbound symbol: ");
+        const char* hint = e ? strstr(e, " (did you mean ") : NULL;
+        if (!hint) continue;
+        e += strlen("E0001 unbound symbol: ");
+        hint += strlen(" (did you mean ");
+        (*out)[count].from = strndup(e, strcspn(e, " "));
+        (*out)[count].to = strndup(hint, strcspn(hint, ",? "));
+        count++;
+    }
+    omni_compiler_free(compiler);
+    return count;
+}
+
+/* Exit status as for --lint: with --dry-run 1 means there are changes */
+static int run_fix(const char** paths, int count, bool dry_run, bool accept_renames) {
+    int rc = 0;
+    for (int i = 0; i < count; i++) {
+        char* text = omni_fs_read(omni_fs_os(), paths[i]);
+        if (!text) {
+            fprintf(stderr, "Error: cannot open file: %s\n", paths[i]);
+            rc = 2;
+            continue;
+        }
+        OmniRename* renames = NULL;
+        OmniFixOptions fix_opts = { 0 };
+        if (accept_renames) {
+            fix_opts.rename_count = suggested_renames(paths[i], text, &renames);
+            fix_opts.renames = renames;
+        }
+
+        size_t applied = 0;
+        char* fixed = omni_fix_source(text, &fix_opts, &applied);
+        if (!fixed) {
+            /* Report the parse errors as --lint does */
+            OmniSession* session = omni_session_new();
+            size_t n = 0;
+            free(parse_file(session, paths[i], &n));
+            omni_session_free(session);
+            rc = 2;
+        } else if (dry_run) {
+            omni_fix_print_diff(stdout, paths[i], text, fixed);
+            if (strcmp(text, fixed) != 0 && rc == 0) rc = 1;
+        } else if (strcmp(text, fixed) != 0) {
+            FILE* f = fopen(paths[i], "w");
+            if (f && fputs(fixed, f) >= 0 && fclose(f) == 0) {
+                printf("%s: %zu fix%s applied\n", paths[i], applied, applied == 1 ? "" : "es");
+            } else {
+                if (f) fclose(f);
+                fprintf(stderr, "Error: cannot write to %s\n", paths[i]);
+                rc = 2;
+            }
+        }
+
+        for (size_t r = 0; r < fix_opts.rename_count; r++) {
+            free((char*)renames[r].from);
+            free((char*)renames[r].to);
+        }
+        free(renames);
+        free(fixed);
+        free(text);
+    }
+    return rc;
+}
+
 /* ============== REPL ============== */
 
+/* Calls kept when the record command turns step recording on */
+#define REPL_RECORD_STEPS 1000
+
 static void run_repl(Compiler* compiler) {
     printf("OmniLisp Native REPL - ASAP Memory Management\n");
     printf("Type 'help' for commands, 'quit' to exit\n\n");
 
     char line[4096];
-    char** definitions = NULL;
-    size_t def_count = 0;
-    size_t def_capacity = 0;
+    OmniRepl* repl = omni_repl_new(compiler);
     bool show_code = false;
 
     while (1) {
@@ -94,12 +390,15 @@ static void run_repl(Compiler* compiler) {
             printf("Commands:\n");
             printf("  quit     - exit the REPL\n");
             printf("  code     - toggle C code display\n");
+            printf("  record   - toggle step recording for (debug-history n)\n");
+            printf("  :step-back [n] - go back n steps (default 1) in the last recorded line\n");
             printf("  defs     - show current definitions\n");
             printf("  clear    - clear all definitions\n");
             printf("  help     - show this help\n");
             printf("\nLanguage:\n");
             printf("  (define name value)     - define a variable\n");
             printf("  (define (f x) body)     - define a function\n");
+            printf("  (defmacro m (x) body)   - define a macro\n");
             printf("  (lambda (x) body)       - anonymous function\n");
             printf("  (let [x val] body)      - local binding\n");
             printf("  (if cond then else)     - conditional\n");
@@ -115,21 +414,41 @@ static void run_repl(Compiler* compiler) {
             printf("C code display %s\n", show_code ? "ON" : "OFF");
             continue;
         }
-        if (strcmp(line, "clear") == 0) {
-            for (size_t i = 0; i < def_count; i++) {
-                free(definitions[i]);
+        if (strcmp(line, "record") == 0) {
+            bool on = compiler->options.record_steps == 0;
+            compiler->options.record_steps = on ? REPL_RECORD_STEPS : 0;
+            printf("Step recording %s\n", on ? "ON" : "OFF");
+            continue;
+        }
+        if (strncmp(line, ":step-back", 10) == 0 && (line[10] == '\0' || line[10] == ' ')) {
+            char* end;
+            long n = line[10] ? strtol(line + 10, &end, 10) : 1;
+            if (line[10] && (end == line + 10 || *end != '\0' || n <= 0)) {
+                printf("Usage: :step-back [n], with n a positive count\n");
+                continue;
             }
-            def_count = 0;
+            const char* step = omni_repl_step_back(repl, (size_t)n);
+            if (step) {
+                printf("%s\n", step);
+            } else if (compiler->options.record_steps == 0) {
+                printf("No steps recorded; turn recording on with 'record'\n");
+            } else {
+                printf("No earlier step\n");
+            }
+            continue;
+        }
+        if (strcmp(line, "clear") == 0) {
+            omni_repl_clear(repl);
             printf("Definitions cleared\n");
             continue;
         }
         if (strcmp(line, "defs") == 0) {
-            if (def_count == 0) {
+            if (omni_repl_definition_count(repl) == 0) {
                 printf("No definitions\n");
             } else {
                 printf("Current definitions:\n");
-                for (size_t i = 0; i < def_count; i++) {
-                    printf("  %s\n", definitions[i]);
+                for (size_t i = 0; i < omni_repl_definition_count(repl); i++) {
+                    printf("  %s\n", omni_repl_definition(repl, i));
                 }
             }
             continue;
@@ -142,68 +461,30 @@ static void run_repl(Compiler* compiler) {
         }
 
         /* Parse to check if it's a definition */
-        OmniValue* expr = omni_parse_string(line);
+        OmniSession* session = omni_session_new();
+        OmniValue* expr = omni_parse_string(session, line);
         if (!expr) {
+            omni_session_free(session);
             printf("Parse error\n");
             continue;
         }
 
-        bool is_define = omni_is_cell(expr) && omni_is_sym(omni_car(expr)) &&
-                         strcmp(omni_car(expr)->str_val, "define") == 0;
+        bool is_define = (omni_is_cell(expr) && omni_is_sym(omni_car(expr)) &&
+                          strcmp(omni_car(expr)->str_val, "define") == 0) ||
+                         omni_is_defmacro(expr) || omni_is_deftype(expr);
+        omni_session_free(session);
 
         if (is_define) {
-            /* Store definition */
-            if (def_count >= def_capacity) {
-                def_capacity = def_capacity ? def_capacity * 2 : 8;
-                definitions = realloc(definitions, def_capacity * sizeof(char*));
-            }
-            definitions[def_count++] = strdup(line);
+            /* Built with the next line that is evaluated */
+            omni_repl_define(repl, line);
             printf("Defined\n");
             continue;
         }
 
-        /* Build full program with definitions */
-        size_t total_len = 0;
-        for (size_t i = 0; i < def_count; i++) {
-            total_len += strlen(definitions[i]) + 1;
-        }
-        total_len += len + 1;
-
-        char* full_input = malloc(total_len);
-        char* p = full_input;
-        for (size_t i = 0; i < def_count; i++) {
-            size_t dlen = strlen(definitions[i]);
-            memcpy(p, definitions[i], dlen);
-            p += dlen;
-            *p++ = '\n';
-        }
-        memcpy(p, line, len + 1);
-
-        /* Compile and run */
-        if (show_code) {
-            char* code = omni_compiler_compile_to_c(compiler, full_input);
-            if (code) {
-                printf("--- C code ---\n%s--- end ---\n", code);
-                free(code);
-            }
-        }
-
-        int result = omni_compiler_run(compiler, full_input);
-        if (omni_compiler_has_errors(compiler)) {
-            for (size_t i = 0; i < omni_compiler_error_count(compiler); i++) {
-                fprintf(stderr, "Error: %s\n", omni_compiler_get_error(compiler, i));
-            }
-        }
-
-        free(full_input);
-        (void)result;
+        omni_repl_eval(repl, line, show_code);
     }
 
-    /* Cleanup */
-    for (size_t i = 0; i < def_count; i++) {
-        free(definitions[i]);
-    }
-    free(definitions);
+    omni_repl_free(repl);
 }
 
 /* ============== Main ============== */
@@ -215,15 +496,55 @@ int main(int argc, char** argv) {
         {"help", no_argument, 0, 'h'},
         {"version", no_argument, 0, 'V'},
         {"runtime", required_argument, 0, 'r'},
+        {"embedded", no_argument, 0, 'N'},
+        {"diff", no_argument, 0, 'D'},
+        {"lint", no_argument, 0, 'T'},
+        {"fix", no_argument, 0, 'A'},
+        {"dry-run", no_argument, 0, 'J'},
+        {"accept-renames", no_argument, 0, 'U'},
+        {"verify", no_argument, 0, 'k'},
+        {"server", no_argument, 0, 'S'},
+        {"port", required_argument, 0, 'P'},
+        {"record", required_argument, 0, 'R'},
+        {"hot", no_argument, 0, 'H'},
+        {"repl", no_argument, 0, 'L'},
+        {"explain", required_argument, 0, 'X'},
+        {"keep-temps", no_argument, 0, 'K'},
+        {"checked", no_argument, 0, 'C'},
+        {"constraint-check", no_argument, 0, 'B'},
+        {"coop-cancel", no_argument, 0, 'Y'},
+        {"strategy", required_argument, 0, 'G'},
+        {"profile", required_argument, 0, 'Z'},
+        {"minimal-io", no_argument, 0, 'M'},
+        {"freestanding", no_argument, 0, 'F'},
+        {"stats", no_argument, 0, 's'},
+        {"check", no_argument, 0, 'j'},
+        {"graph", required_argument, 0, 'w'},
+        {"link", required_argument, 0, 'I'},
+        {"heap-limit", required_argument, 0, 'Q'},
+        {"oom", required_argument, 0, 'q'},
+        {"cc", required_argument, 0, 'a'},
+        {"cflags", required_argument, 0, 'f'},
+        {"ldflags", required_argument, 0, 'l'},
+        {"target", required_argument, 0, 't'},
+        {"lang", required_argument, 0, 'i'},
+        {"standalone", no_argument, 0, 'n'},
+        {"script", no_argument, 0, 'x'},
         {0, 0, 0, 0}
     };
 
+    /* Long options may be spelled with one dash too, like -Wstrict
+     * (-check, -checked, -cflags ...); a single letter is still the short
+     * option, and option values are never read as options */
     int opt;
-    while ((opt = getopt_long(argc, argv, "cho:e:vr:", long_options, NULL)) != -1) {
+    while ((opt = getopt_long_only(argc, argv, "cEgho:e:vr:W:O:", long_options, NULL)) != -1) {
         switch (opt) {
         case 'c':
             opts.compile_mode = true;
             break;
+        case 'E':
+            opts.expand_mode = true;
+            break;
         case 'o':
             opts.output_file = optarg;
             break;
@@ -233,9 +554,185 @@ int main(int argc, char** argv) {
         case 'v':
             opts.verbose = true;
             break;
+        case 'g':
+            opts.debug = true;
+            break;
+        case 'W':
+            if (strcmp(optarg, "strict") == 0) {
+                opts.shadowing = OMNI_SHADOW_ERROR;
+            } else if (strcmp(optarg, "no-shadow") == 0) {
+                opts.shadowing = OMNI_SHADOW_ALLOW;
+            } else if (strcmp(optarg, "shadow") == 0) {
+                opts.shadowing = OMNI_SHADOW_WARN;
+            } else if (strcmp(optarg, "error=deprecated") == 0) {
+                opts.deprecations = OMNI_DEPRECATED_ERROR;
+            } else if (strcmp(optarg, "no-deprecated") == 0) {
+                opts.deprecations = OMNI_DEPRECATED_ALLOW;
+            } else if (strcmp(optarg, "deprecated") == 0) {
+                opts.deprecations = OMNI_DEPRECATED_WARN;
+            } else {
+                fprintf(stderr, "Error: unknown warning option: -W%s\n", optarg);
+                return 1;
+            }
+            break;
         case 'r':
             opts.runtime_path = optarg;
             break;
+        case 'N':
+            opts.embedded = true;
+            break;
+        case 'D':
+            opts.diff_mode = true;
+            break;
+        case 'T':
+            opts.lint_mode = true;
+            break;
+        case 'A':
+            opts.fix_mode = true;
+            break;
+        case 'J':
+            opts.dry_run = true;
+            break;
+        case 'U':
+            opts.accept_renames = true;
+            break;
+        case 'k':
+            opts.verify_mode = true;
+            break;
+        case 'S':
+            opts.server_mode = true;
+            break;
+        case 'P':
+            opts.server_port = atoi(optarg);
+            if (opts.server_port <= 0 || opts.server_port > 65535) {
+                fprintf(stderr, "Error: invalid port: %s\n", optarg);
+                return 1;
+            }
+            opts.server_mode = true;
+            break;
+        case 'R':
+            opts.record_steps = atol(optarg);
+            if (opts.record_steps <= 0) {
+                fprintf(stderr, "Error: invalid step count: %s\n", optarg);
+                return 1;
+            }
+            break;
+        case 'H':
+            opts.hot_mode = true;
+            break;
+        case 'L':
+            opts.repl_mode = true;
+            break;
+        case 'X':
+            return explain_error(optarg);
+        case 'K':
+            opts.keep_temps = true;
+            break;
+        case 'C':
+            opts.checked = true;
+            break;
+        case 'B':
+            opts.constraint_check = true;
+            break;
+        case 'Y':
+            opts.coop_cancel = true;
+            break;
+        case 'G':
+            opts.strategies = omni_strategy_parse(optarg);
+            if (!opts.strategies) {
+                fprintf(stderr, "Error: --strategy takes a comma-separated list of asap, perceus, "
+                                "arena, deferred, symmetric and scc\n");
+                return 1;
+            }
+            break;
+        case 'Z':
+            if (strcmp(optarg, "size") == 0) {
+                opts.size_profile = true;
+            } else if (strcmp(optarg, "default") != 0) {
+                fprintf(stderr, "Error: unknown profile: %s (size or default)\n", optarg);
+                return 1;
+            }
+            break;
+        case 'M':
+            opts.minimal_io = true;
+            break;
+        case 'F':
+            opts.freestanding = true;
+            break;
+        case 's':
+            opts.stats = true;
+            break;
+        case 'j':
+            opts.check_mode = true;
+            break;
+        case 'w':
+            if (!omni_graph_format_parse(optarg, &opts.graph_format)) {
+                fprintf(stderr, "Error: unknown graph format: %s (dot or json)\n", optarg);
+                return 1;
+            }
+            opts.graph_mode = true;
+            break;
+        case 'I': {
+            size_t len = opts.link_with ? strlen(opts.link_with) : 0;
+            opts.link_with = realloc(opts.link_with, len + strlen(optarg) + 2);
+            sprintf(opts.link_with + len, "%s%s", len ? " " : "", optarg);
+            break;
+        }
+        case 'Q': {
+            char* end;
+            unsigned long long n = strtoull(optarg, &end, 10);
+            int shift = *end == 'k' || *end == 'K' ? 10 : *end == 'm' || *end == 'M' ? 20
+                      : *end == 'g' || *end == 'G' ? 30 : 0;
+            if (shift) end++;
+            if (end == optarg || *end || n == 0) {
+                fprintf(stderr, "Error: invalid heap limit: %s\n", optarg);
+                return 1;
+            }
+            opts.heap_limit = (size_t)(n << shift);
+            break;
+        }
+        case 'O':
+            if (!omni_memory_mode_parse(optarg, &opts.memory)) {
+                fprintf(stderr, "Error: unknown memory mode: %s (asap, rc, arena or all)\n", optarg);
+                return 1;
+            }
+            break;
+        case 'q':
+            if (strcmp(optarg, "abort") == 0) {
+                opts.oom_policy = OMNI_OOM_ABORT;
+            } else if (strcmp(optarg, "error") == 0) {
+                opts.oom_policy = OMNI_OOM_ERROR;
+            } else {
+                fprintf(stderr, "Error: unknown out-of-memory policy: %s (abort or error)\n", optarg);
+                return 1;
+            }
+            opts.oom_set = true;
+            break;
+        case 'a':
+            opts.cc = optarg;
+            break;
+        case 'f':
+            opts.cflags = optarg;
+            break;
+        case 'l':
+            opts.ldflags = optarg;
+            break;
+        case 't':
+            opts.target = optarg;
+            break;
+        case 'n':
+            opts.standalone = true;
+            break;
+        case 'x':
+            opts.script = true;
+            break;
+        case 'i':
+            if (!(opts.lang = omni_lang_parse(optarg))) {
+                fprintf(stderr, "Error: unknown language: %s (purple/%d to purple/%d)\n",
+                        optarg, OMNI_LANG_FIRST, OMNI_LANG_LATEST);
+                return 1;
+            }
+            break;
         case 'h':
             print_usage(argv[0]);
             return 0;
@@ -249,11 +746,124 @@ int main(int argc, char** argv) {
     }
 
     if (optind < argc) {
-        opts.input_file = argv[optind];
+        opts.input_files = (const char**)&argv[optind];
+        opts.input_count = argc - optind;
+    }
+
+    if (opts.diff_mode) {
+        if (opts.input_count != 2) {
+            fprintf(stderr, "Error: --diff takes exactly two files\n");
+            return 2;
+        }
+        return run_diff(opts.input_files[0], opts.input_files[1]);
+    }
+
+    if (opts.lint_mode) {
+        if (opts.input_count == 0) {
+            fprintf(stderr, "Error: --lint takes one or more files\n");
+            return 2;
+        }
+        return run_lint(opts.input_files, opts.input_count);
+    }
+
+    if (opts.verify_mode) {
+        if (opts.input_count < 2) {
+            fprintf(stderr, "Error: --verify takes a binary and the sources it was built from\n");
+            return 2;
+        }
+        return omni_verify_binary(opts.input_files[0], opts.input_files + 1,
+                                  (size_t)opts.input_count - 1, stdout);
+    }
+
+    if ((opts.dry_run || opts.accept_renames) && !opts.fix_mode) {
+        fprintf(stderr, "Error: --dry-run and --accept-renames go with --fix\n");
+        return 2;
+    }
+
+    if (opts.fix_mode) {
+        if (opts.input_count == 0) {
+            fprintf(stderr, "Error: --fix takes one or more files\n");
+            return 2;
+        }
+        return run_fix(opts.input_files, opts.input_count, opts.dry_run, opts.accept_renames);
+    }
+
+    if (opts.check_mode && ((opts.input_count == 0 && !opts.eval_expr) || opts.compile_mode ||
+                            opts.expand_mode || opts.output_file || opts.hot_mode ||
+                            opts.server_mode || opts.repl_mode)) {
+        fprintf(stderr, "Error: -check takes files or -e, and builds and runs nothing\n");
+        return 2;
+    }
+
+    if (opts.graph_mode && ((opts.input_count == 0 && !opts.eval_expr) || opts.check_mode ||
+                            opts.compile_mode || opts.expand_mode || opts.output_file ||
+                            opts.hot_mode || opts.server_mode || opts.repl_mode)) {
+        fprintf(stderr, "Error: --graph takes files or -e, and builds and runs nothing\n");
+        return 2;
+    }
+
+    if (opts.hot_mode && ((opts.input_count == 0 && !opts.eval_expr) || opts.compile_mode ||
+                          opts.output_file || opts.server_mode || opts.record_steps)) {
+        fprintf(stderr, "Error: --hot runs a program from files or -e; stdin carries the new definitions\n");
+        return 1;
+    }
+
+    /* Freestanding code runs on its target, so it can only be built here */
+    if (opts.freestanding && (opts.server_mode || opts.hot_mode || opts.runtime_path ||
+                              opts.coop_cancel || opts.strategies || opts.record_steps ||
+                              opts.constraint_check || opts.link_with ||
+                              (!opts.compile_mode && !opts.expand_mode && !opts.output_file))) {
+        fprintf(stderr, "Error: -freestanding builds C with -c or an object with -o, on the "
+                        "embedded runtime, without -coop-cancel, --strategy, --record, "
+                        "--constraint-check or --link\n");
+        return 1;
+    }
+
+    if (opts.standalone && !opts.compile_mode) {
+        fprintf(stderr, "Error: --standalone applies to the C that -c writes\n");
+        return 1;
+    }
+
+    if (opts.embedded && opts.runtime_path) {
+        fprintf(stderr, "Error: --embedded and --runtime are mutually exclusive\n");
+        return 1;
+    }
+
+    /* The heap limit and the policy are the embedded runtime's */
+    if (opts.heap_limit || opts.oom_set) {
+        if (opts.runtime_path) {
+            fprintf(stderr, "Error: --heap-limit and --oom need the embedded runtime, not --runtime\n");
+            return 1;
+        }
+        opts.embedded = true;
+    }
+
+    /* A program built for another machine cannot be run on this one */
+    if (opts.target && (opts.server_mode || opts.hot_mode || opts.repl_mode ||
+                        (!opts.compile_mode && !opts.expand_mode && !opts.check_mode &&
+                         !opts.graph_mode && !opts.output_file))) {
+        fprintf(stderr, "Error: -target builds with -o or -c; a program for %s cannot run here\n",
+                opts.target);
+        return 1;
+    }
+
+    /* The environment's compiler and flags, as make takes them */
+    const char* env;
+    if (!opts.cc && (env = getenv("CC")) && *env) opts.cc = env;
+    if (!opts.cflags && (env = getenv("CFLAGS")) && *env) opts.cflags = env;
+    if (!opts.ldflags && (env = getenv("LDFLAGS")) && *env) opts.ldflags = env;
+
+    /* Memory modes choose what the embedded runtime keeps */
+    if (opts.memory) {
+        if (opts.runtime_path) {
+            fprintf(stderr, "Error: -O needs the embedded runtime, not --runtime\n");
+            return 1;
+        }
+        opts.embedded = true;
     }
 
-    /* Auto-detect runtime path */
-    if (!opts.runtime_path) {
+    /* Auto-detect runtime path; the one found was built for this machine */
+    if (!opts.runtime_path && !opts.embedded && !opts.freestanding && !opts.target) {
         /* Check relative to executable */
         char* exe_dir = realpath(argv[0], NULL);
         if (exe_dir) {
@@ -280,36 +890,72 @@ int main(int argc, char** argv) {
         .output_file = opts.output_file,
         .emit_c_only = opts.compile_mode,
         .verbose = opts.verbose,
+        .emit_debug_info = opts.debug,
+        .script_mode = opts.script || (opts.input_count > 0 && !opts.eval_expr),
+        .script_exit = opts.script,
         .runtime_path = opts.runtime_path,
         .use_embedded_runtime = (opts.runtime_path == NULL),
+        .standalone = opts.standalone,
         .opt_level = 2,
-        .cc = "gcc",
+        .record_steps = (size_t)opts.record_steps,
+        .shadowing = opts.shadowing,
+        .deprecations = opts.deprecations,
+        .lang = opts.lang,
+        .cc = opts.cc,
+        .cflags = opts.cflags,
+        .ldflags = opts.ldflags,
+        .target = opts.target,
+        .keep_temps = opts.keep_temps,
+        .checked = opts.checked,
+        .constraint_check = opts.constraint_check,
+        .coop_cancel = opts.coop_cancel,
+        .strategies = opts.strategies,
+        .memory = opts.memory,
+        .size_profile = opts.size_profile,
+        .minimal_io = opts.minimal_io,
+        .freestanding = opts.freestanding,
+        .link_with = opts.link_with,
+        .heap_limit = opts.heap_limit,
+        .oom_policy = opts.oom_policy,
     };
 
     Compiler* compiler = omni_compiler_new_with_options(&comp_opts);
 
+    if (opts.server_mode) {
+        int rc = opts.server_port ? omni_server_run_tcp(compiler, opts.server_port)
+                                  : omni_server_run_stdio(compiler);
+        omni_compiler_free(compiler);
+        omni_compiler_cleanup();
+        return rc;
+    }
+
     /* Get input */
-    char* input = NULL;
+    OmniSource* units = NULL;
+    size_t unit_count = 0;
 
     if (opts.eval_expr) {
-        input = strdup(opts.eval_expr);
-    } else if (opts.input_file) {
-        FILE* f = fopen(opts.input_file, "r");
-        if (!f) {
-            fprintf(stderr, "Error: cannot open file: %s\n", opts.input_file);
-            omni_compiler_free(compiler);
-            return 1;
+        units = malloc(sizeof(OmniSource));
+        units[0].name = NULL;
+        units[0].text = strdup(opts.eval_expr);
+        unit_count = 1;
+    } else if (opts.input_count > 0) {
+        units = calloc(opts.input_count, sizeof(OmniSource));
+        for (int i = 0; i < opts.input_count; i++) {
+            char* text = omni_fs_read(omni_fs_os(), opts.input_files[i]);
+            if (!text) {
+                fprintf(stderr, "Error: cannot open file: %s\n", opts.input_files[i]);
+                for (size_t j = 0; j < unit_count; j++) free((char*)units[j].text);
+                free(units);
+                omni_compiler_free(compiler);
+                return 1;
+            }
+            units[unit_count].name = opts.input_files[i];
+            units[unit_count].text = text;
+            unit_count++;
         }
-        fseek(f, 0, SEEK_END);
-        long size = ftell(f);
-        fseek(f, 0, SEEK_SET);
-        input = malloc(size + 1);
-        size_t read = fread(input, 1, size, f);
-        input[read] = '\0';
-        fclose(f);
     } else {
         /* Check if stdin is a terminal */
-        if (isatty(STDIN_FILENO)) {
+        if (isatty(STDIN_FILENO) || opts.repl_mode) {
             /* Interactive REPL mode */
             run_repl(compiler);
             omni_compiler_free(compiler);
@@ -319,7 +965,7 @@ int main(int argc, char** argv) {
         /* Read from stdin */
         size_t capacity = 4096;
         size_t len = 0;
-        input = malloc(capacity);
+        char* input = malloc(capacity);
         int c;
         while ((c = getchar()) != EOF) {
             if (len + 1 >= capacity) {
@@ -329,20 +975,28 @@ int main(int argc, char** argv) {
             input[len++] = c;
         }
         input[len] = '\0';
+
+        units = malloc(sizeof(OmniSource));
+        units[0].name = NULL;
+        units[0].text = input;
+        unit_count = 1;
     }
 
     /* Skip empty input */
     bool empty = true;
-    for (const char* p = input; *p; p++) {
-        if (*p != ' ' && *p != '\t' && *p != '\n' && *p != '\r') {
-            empty = false;
-            break;
+    for (size_t i = 0; i < unit_count && empty; i++) {
+        for (const char* p = units[i].text; *p; p++) {
+            if (*p != ' ' && *p != '\t' && *p != '\n' && *p != '\r') {
+                empty = false;
+                break;
+            }
         }
     }
 
-    if (empty) {
+    if (empty && !opts.check_mode && !opts.graph_mode) {
         /* Empty input - go to REPL */
-        free(input);
+        for (size_t i = 0; i < unit_count; i++) free((char*)units[i].text);
+        free(units);
         run_repl(compiler);
         omni_compiler_free(compiler);
         return 0;
@@ -350,9 +1004,38 @@ int main(int argc, char** argv) {
 
     int exit_code = 0;
 
-    if (opts.compile_mode) {
+    if (opts.hot_mode) {
+        exit_code = omni_hot_run(compiler, units, unit_count);
+    } else if (opts.check_mode) {
+        if (!omni_compiler_check_units(compiler, units, unit_count)) {
+            for (size_t i = 0; i < omni_compiler_error_count(compiler); i++) {
+                fprintf(stderr, "Error: %s\n", omni_compiler_get_error(compiler, i));
+            }
+            exit_code = 1;
+        }
+    } else if (opts.graph_mode) {
+        if (omni_compiler_check_units(compiler, units, unit_count)) {
+            omni_query_print_call_graph(omni_compiler_query(compiler), stdout, opts.graph_format);
+        } else {
+            for (size_t i = 0; i < omni_compiler_error_count(compiler); i++) {
+                fprintf(stderr, "Error: %s\n", omni_compiler_get_error(compiler, i));
+            }
+            exit_code = 1;
+        }
+    } else if (opts.expand_mode) {
+        char* expanded = omni_compiler_expand_units(compiler, units, unit_count);
+        if (expanded) {
+            printf("%s", expanded);
+            free(expanded);
+        } else {
+            for (size_t i = 0; i < omni_compiler_error_count(compiler); i++) {
+                fprintf(stderr, "Error: %s\n", omni_compiler_get_error(compiler, i));
+            }
+            exit_code = 1;
+        }
+    } else if (opts.compile_mode) {
         /* Emit C code */
-        char* code = omni_compiler_compile_to_c(compiler, input);
+        char* code = omni_compiler_compile_units_to_c(compiler, units, unit_count);
         if (code) {
             if (opts.output_file) {
                 FILE* f = fopen(opts.output_file, "w");
@@ -378,17 +1061,18 @@ int main(int argc, char** argv) {
         }
     } else if (opts.output_file) {
         /* Compile to binary */
-        if (!omni_compiler_compile_to_binary(compiler, input, opts.output_file)) {
+        if (!omni_compiler_compile_units_to_binary(compiler, units, unit_count, opts.output_file)) {
             for (size_t i = 0; i < omni_compiler_error_count(compiler); i++) {
                 fprintf(stderr, "Error: %s\n", omni_compiler_get_error(compiler, i));
             }
             exit_code = 1;
-        } else if (opts.verbose) {
-            fprintf(stderr, "Binary written to %s\n", opts.output_file);
+        } else {
+            if (opts.verbose) fprintf(stderr, "Binary written to %s\n", opts.output_file);
+            if (opts.size_profile) omni_print_size_report(opts.output_file, stdout);
         }
     } else {
         /* Compile and run */
-        exit_code = omni_compiler_run(compiler, input);
+        exit_code = omni_compiler_run_units(compiler, units, unit_count);
         if (omni_compiler_has_errors(compiler)) {
             for (size_t i = 0; i < omni_compiler_error_count(compiler); i++) {
                 fprintf(stderr, "Error: %s\n", omni_compiler_get_error(compiler, i));
@@ -397,7 +1081,21 @@ int main(int argc, char** argv) {
         }
     }
 
-    free(input);
+    for (size_t i = 0; i < omni_compiler_warning_count(compiler); i++) {
+        fprintf(stderr, "Warning: %s\n", omni_compiler_get_warning(compiler, i));
+    }
+
+    if (opts.verbose) {
+        omni_compiler_print_timings(compiler, stderr);
+    }
+    if (opts.stats) {
+        omni_compiler_print_stats(compiler, stderr);
+    }
+
+    fflush(stdout);
+
+    for (size_t i = 0; i < unit_count; i++) free((char*)units[i].text);
+    free(units);
     omni_compiler_free(compiler);
     omni_compiler_cleanup();
 
@@ -0,0 +1,482 @@
+/*
+ * OmniLisp REPL Sessions - evaluate lines without rebuilding what came before
+ *
+ * See repl.h for how definitions and lines are built and run.
+ */
+
+#include "repl.h"
+#include "snapshot.h"
+#include "../codegen/codegen.h"
+
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <unistd.h>
+#include <dlfcn.h>
+#include <signal.h>
+#include <sys/wait.h>
+
+struct OmniRepl {
+    Compiler* compiler;       /* Options and error reporting */
+    char** definitions;       /* Every definition line, in order */
+    size_t count;
+    size_t capacity;
+    size_t loaded;            /* Leading definitions already built and loaded */
+    size_t captured;          /* Leading definitions whose values were captured */
+    pid_t session;            /* The process objects are loaded into; 0 for none */
+    FILE* to_session;         /* Objects to load, one request a line */
+    int from_session;         /* One byte back per request */
+    char** steps;             /* Steps the last recorded line kept, oldest first */
+    size_t step_count;
+    size_t step_at;           /* Where :step-back stands; step_count for after the last */
+};
+
+static void report_errors(Compiler* c) {
+    for (size_t i = 0; i < omni_compiler_error_count(c); i++) {
+        fprintf(stderr, "Error: %s\n", omni_compiler_get_error(c, i));
+    }
+}
+
+OmniRepl* omni_repl_new(Compiler* compiler) {
+    OmniRepl* repl = calloc(1, sizeof(OmniRepl));
+    repl->compiler = compiler;
+    return repl;
+}
+
+static int end_session(OmniRepl* repl);
+static void forget_steps(OmniRepl* repl);
+
+void omni_repl_free(OmniRepl* repl) {
+    if (!repl) return;
+    omni_repl_clear(repl);
+    forget_steps(repl);
+    free(repl->definitions);
+    free(repl);
+}
+
+void omni_repl_define(OmniRepl* repl, const char* text) {
+    if (repl->count >= repl->capacity) {
+        repl->capacity = repl->capacity ? repl->capacity * 2 : 8;
+        repl->definitions = realloc(repl->definitions, repl->capacity * sizeof(char*));
+    }
+    repl->definitions[repl->count++] = strdup(text);
+}
+
+void omni_repl_clear(OmniRepl* repl) {
+    for (size_t i = 0; i < repl->count; i++) free(repl->definitions[i]);
+    repl->count = 0;
+    repl->captured = 0;
+    /* Their globals and functions go with the process they live in */
+    end_session(repl);
+}
+
+size_t omni_repl_definition_count(OmniRepl* repl) {
+    return repl->count;
+}
+
+const char* omni_repl_definition(OmniRepl* repl, size_t index) {
+    return index < repl->count ? repl->definitions[index] : NULL;
+}
+
+/* Every definition as a unit, then text when it is non-NULL */
+static OmniSource* session_units(OmniRepl* repl, const char* text, size_t* count) {
+    OmniSource* units = calloc(repl->count + 1, sizeof(OmniSource));
+    for (size_t i = 0; i < repl->count; i++) units[i].text = repl->definitions[i];
+    *count = repl->count;
+    if (text) units[(*count)++].text = text;
+    return units;
+}
+
+/* ============== Recorded Steps ============== */
+
+static void forget_steps(OmniRepl* repl) {
+    for (size_t i = 0; i < repl->step_count; i++) free(repl->steps[i]);
+    free(repl->steps);
+    repl->steps = NULL;
+    repl->step_count = 0;
+    repl->step_at = 0;
+}
+
+/* Read the steps a program wrote to path, one a line as debug-history
+ * prints them. A line that does not start a step continues the one
+ * before: a written value can hold a newline. */
+static void read_steps(OmniRepl* repl, const char* path) {
+    forget_steps(repl);
+    FILE* f = fopen(path, "r");
+    if (!f) return;
+    size_t capacity = 0;
+    char* line = NULL;
+    size_t size = 0;
+    ssize_t len;
+    while ((len = getline(&line, &size, f)) > 0) {
+        if (line[len - 1] == '\n') line[--len] = '\0';
+        if (repl->step_count > 0 && strncmp(line, "step ", 5) != 0) {
+            char** last = &repl->steps[repl->step_count - 1];
+            size_t at = strlen(*last);
+            *last = realloc(*last, at + len + 2);
+            (*last)[at] = '\n';
+            memcpy(*last + at + 1, line, len + 1);
+            continue;
+        }
+        if (repl->step_count >= capacity) {
+            capacity = capacity ? capacity * 2 : 64;
+            repl->steps = realloc(repl->steps, capacity * sizeof(char*));
+        }
+        repl->steps[repl->step_count++] = strdup(line);
+    }
+    free(line);
+    fclose(f);
+    repl->step_at = repl->step_count;
+}
+
+const char* omni_repl_step_back(OmniRepl* repl, size_t n) {
+    if (repl->step_at == 0) return NULL;
+    repl->step_at = n < repl->step_at ? repl->step_at - n : 0;
+    return repl->steps[repl->step_at];
+}
+
+/* ============== Whole Programs ============== */
+
+/* Run program, showing its output as it arrives, and collect its framed
+ * results into *values. Returns the exit status, or -1 if it did not run. */
+static int run_framed(const char* program, char*** values, size_t* value_count) {
+    FILE* p = popen(program, "r");
+    if (!p) return -1;
+    char* value = NULL;
+    size_t value_len = 0;
+    FILE* vf = NULL;
+    int ch;
+    while ((ch = fgetc(p)) != EOF) {
+        if (ch == OMNI_RESULT_BEGIN) {
+            vf = open_memstream(&value, &value_len);
+        } else if (ch == OMNI_RESULT_END && vf) {
+            fclose(vf);
+            vf = NULL;
+            *values = realloc(*values, (*value_count + 1) * sizeof(char*));
+            (*values)[(*value_count)++] = value;
+            value = NULL;
+        } else {
+            fputc(ch, vf ? vf : stdout);
+        }
+    }
+    if (vf) {
+        fclose(vf);
+        free(value);
+    }
+    int status = pclose(p);
+    fflush(stdout);
+    return WIFEXITED(status) ? WEXITSTATUS(status) : 128 + WTERMSIG(status);
+}
+
+/*
+ * Run the definitions made since the last line once, echoing the values
+ * they define, and keep each value that reads back as a datum in place of
+ * its initializer (see snapshot.h), so later lines do not run it again.
+ * If they do not build or run cleanly, they are dropped.
+ */
+static bool capture_definitions(OmniRepl* repl) {
+    size_t pending = repl->count - repl->captured;
+    size_t* name_counts = calloc(pending, sizeof(size_t));
+    char* names = NULL;
+    size_t names_len = 0;
+    FILE* nf = open_memstream(&names, &names_len);
+    size_t total = 0;
+    for (size_t i = 0; i < pending; i++) {
+        char* line_names = omni_snapshot_names(repl->definitions[repl->captured + i], &name_counts[i]);
+        if (line_names) fprintf(nf, "%s\n", line_names);
+        free(line_names);
+        total += name_counts[i];
+    }
+    fclose(nf);
+
+    bool ok = true;
+    char** values = NULL;
+    size_t value_count = 0;
+    if (total > 0) {
+        size_t count;
+        OmniSource* units = session_units(repl, names, &count);
+        units[count - 1].name = "<snapshot>";
+        CompilerOptions opts = repl->compiler->options;
+        opts.mark_results = true;
+        Compiler* c = omni_compiler_new_with_options(&opts);
+        char* path = omni_compiler_temp_path(repl->compiler, "");
+        if (!path) {
+            perror("Error: cannot create temporary file");
+            ok = false;
+        } else if (!omni_compiler_compile_units_to_binary(c, units, count, path)) {
+            report_errors(c);
+            ok = false;
+        } else {
+            fflush(stdout);
+            ok = run_framed(path, &values, &value_count) == 0;
+        }
+        if (path) {
+            omni_compiler_remove_temp(repl->compiler, path);
+            free(path);
+        }
+        omni_compiler_free(c);
+        free(units);
+    }
+
+    if (!ok) {
+        for (size_t i = repl->captured; i < repl->count; i++) free(repl->definitions[i]);
+        repl->count = repl->captured;
+        fprintf(stderr, "Dropped the definitions made since the last evaluation\n");
+    } else if (value_count == total) {
+        char** line_values = values;
+        for (size_t i = 0; i < pending; i++) {
+            char** def = &repl->definitions[repl->captured + i];
+            char* source = omni_snapshot_source(*def, line_values, name_counts[i]);
+            if (source) {
+                free(*def);
+                *def = source;
+            }
+            line_values += name_counts[i];
+        }
+    }
+    if (ok) repl->captured = repl->count;
+
+    for (size_t i = 0; i < value_count; i++) free(values[i]);
+    free(values);
+    free(names);
+    free(name_counts);
+    return ok;
+}
+
+/* Compile and run text after every definition, as one program. While
+ * steps are recorded, the program writes the ones it kept to a temporary
+ * file named by PURPLE_STEP_LOG, for :step-back. */
+static void eval_program(OmniRepl* repl, const char* text, bool show_code) {
+    if (repl->captured < repl->count && !capture_definitions(repl)) return;
+    size_t count;
+    OmniSource* units = session_units(repl, text, &count);
+    Compiler* compiler = repl->compiler;
+    if (show_code) {
+        char* code = omni_compiler_compile_units_to_c(compiler, units, count);
+        if (code) {
+            printf("--- C code ---\n%s--- end ---\n", code);
+            free(code);
+        }
+    }
+    char* log = compiler->options.record_steps > 0 ? omni_compiler_temp_path(compiler, ".steps") : NULL;
+    if (log) setenv("PURPLE_STEP_LOG", log, 1);
+    omni_compiler_run_units(compiler, units, count);
+    report_errors(compiler);
+    if (log) {
+        unsetenv("PURPLE_STEP_LOG");
+        read_steps(repl, log);
+        omni_compiler_remove_temp(compiler, log);
+        free(log);
+    }
+    free(units);
+}
+
+/* ============== Incremental Objects ============== */
+
+/* Build the units after the first prior ones into a shared object at a
+ * new temporary path, which is returned; NULL if it did not build */
+static char* build_object(OmniRepl* repl, const OmniSource* units, size_t count, size_t prior,
+                          bool show_code) {
+    CompilerOptions opts = repl->compiler->options;
+    opts.incremental = true;
+    opts.prior_units = prior;
+    Compiler* c = omni_compiler_new_with_options(&opts);
+
+    if (show_code) {
+        char* code = omni_compiler_compile_units_to_c(c, units, count);
+        if (code) {
+            printf("--- C code ---\n%s--- end ---\n", code);
+            free(code);
+        }
+    }
+
+    char* path = omni_compiler_temp_path(repl->compiler, ".so");
+    if (!path) {
+        perror("Error: cannot create temporary file");
+    } else if (!omni_compiler_compile_units_to_binary(c, units, count, path)) {
+        report_errors(c);
+        omni_compiler_remove_temp(repl->compiler, path);
+        free(path);
+        path = NULL;
+    }
+    omni_compiler_free(c);
+    return path;
+}
+
+/* ============== The Session Process ============== */
+
+/* Run the main() of the object at path, loaded with mode; returns its
+ * handle, or NULL if it could not be loaded. Loaded objects stay: values
+ * made by their code may still be in use. */
+static void* load_and_run(const char* path, int mode) {
+    void* handle = dlopen(path, RTLD_NOW | mode);
+    int (*entry)(void) = handle ? (int (*)(void))dlsym(handle, "main") : NULL;
+    if (!entry) {
+        fprintf(stderr, "Error: cannot load %s: %s\n", path, dlerror());
+        if (handle) dlclose(handle);
+        return NULL;
+    }
+    entry();
+    fflush(stdout);
+    return handle;
+}
+
+/* The session process: load each object it is sent and answer 1 if it
+ * did, 0 if not. 'R' is the runtime, loaded for every later object to
+ * resolve against; 'D' definitions, whose globals and functions later
+ * objects use; 'L' a line. Ends when the REPL closes its end. */
+static void serve_session(FILE* requests, int replies) {
+    char request[4096];
+    while (fgets(request, sizeof(request), requests)) {
+        size_t len = strlen(request);
+        if (len < 3 || request[len - 1] != '\n') break;
+        request[len - 1] = '\0';
+        const char* path = request + 2;
+        bool ok;
+        if (request[0] == 'R') {
+            ok = dlopen(path, RTLD_NOW | RTLD_GLOBAL) != NULL;
+            if (!ok) fprintf(stderr, "Error: cannot load %s: %s\n", path, dlerror());
+        } else {
+            ok = load_and_run(path, request[0] == 'D' ? RTLD_GLOBAL : RTLD_LOCAL) != NULL;
+        }
+        fflush(stderr);
+        char reply = ok ? '1' : '0';
+        if (write(replies, &reply, 1) != 1) break;
+    }
+    _exit(0);
+}
+
+/* Send the session process an object to load and wait until it has run.
+ * Returns 1 if it loaded, 0 if not and -1 if the process ended. */
+static int session_load(OmniRepl* repl, char kind, const char* path) {
+    fflush(stdout);
+    fflush(stderr);
+    fprintf(repl->to_session, "%c %s\n", kind, path);
+    fflush(repl->to_session);
+    char reply;
+    if (read(repl->from_session, &reply, 1) == 1) return reply == '1';
+
+    int status = end_session(repl);
+    if (WIFSIGNALED(status)) {
+        fprintf(stderr, "Error: the session ended on signal %d; "
+                "its definitions are built again with the next line\n", WTERMSIG(status));
+    } else {
+        fprintf(stderr, "Error: the session ended with status %d; "
+                "its definitions are built again with the next line\n", WEXITSTATUS(status));
+    }
+    return -1;
+}
+
+/* Start the session process and load the runtime into it */
+static bool start_session(OmniRepl* repl) {
+    if (repl->session) return true;
+    char* path = omni_compiler_temp_path(repl->compiler, ".so");
+    if (!path) {
+        perror("Error: cannot create temporary file");
+        return false;
+    }
+    if (!omni_compiler_build_runtime(repl->compiler, path)) {
+        report_errors(repl->compiler);
+        omni_compiler_clear_errors(repl->compiler);
+        free(path);
+        return false;
+    }
+
+    int requests[2], replies[2];
+    if (pipe(requests) != 0) {
+        perror("Error: cannot start the session");
+    } else if (pipe(replies) != 0) {
+        perror("Error: cannot start the session");
+        close(requests[0]);
+        close(requests[1]);
+    } else {
+        fflush(stdout);
+        fflush(stderr);
+        pid_t pid = fork();
+        if (pid == 0) {
+            close(requests[1]);
+            close(replies[0]);
+            serve_session(fdopen(requests[0], "r"), replies[1]);
+        }
+        close(requests[0]);
+        close(replies[1]);
+        if (pid < 0) {
+            perror("Error: cannot start the session");
+            close(requests[1]);
+            close(replies[0]);
+        } else {
+            /* A session that ended is noticed by its reply, not a signal */
+            signal(SIGPIPE, SIG_IGN);
+            repl->session = pid;
+            repl->to_session = fdopen(requests[1], "w");
+            repl->from_session = replies[0];
+            if (session_load(repl, 'R', path) == 0) end_session(repl);
+        }
+    }
+    omni_compiler_remove_temp(repl->compiler, path);
+    free(path);
+    return repl->session != 0;
+}
+
+/* Let the session process end, with everything loaded into it, and
+ * return its wait status. Every definition is then built again, into the
+ * next one. */
+static int end_session(OmniRepl* repl) {
+    int status = 0;
+    if (repl->session) {
+        fclose(repl->to_session);
+        close(repl->from_session);
+        waitpid(repl->session, &status, 0);
+    }
+    repl->to_session = NULL;
+    repl->session = 0;
+    repl->loaded = 0;
+    return status;
+}
+
+/* Build the definitions made since the last line into the session. If
+ * they do not build, they are dropped. */
+static bool load_definitions(OmniRepl* repl) {
+    size_t count;
+    OmniSource* units = session_units(repl, NULL, &count);
+    char* path = build_object(repl, units, count, repl->loaded, false);
+    free(units);
+    int loaded = path ? session_load(repl, 'D', path) : 0;
+    if (path) {
+        omni_compiler_remove_temp(repl->compiler, path);
+        free(path);
+    }
+
+    if (loaded < 0) return false;
+    if (!loaded) {
+        for (size_t i = repl->loaded; i < repl->count; i++) free(repl->definitions[i]);
+        repl->count = repl->loaded;
+        fprintf(stderr, "Dropped the definitions made since the last evaluation\n");
+        return false;
+    }
+    repl->loaded = repl->count;
+    return true;
+}
+
+/* Build text on top of the loaded definitions and run it in the session */
+static void eval_incremental(OmniRepl* repl, const char* text, bool show_code) {
+    size_t count;
+    OmniSource* units = session_units(repl, text, &count);
+    char* path = build_object(repl, units, count, repl->count, show_code);
+    free(units);
+    if (!path) return;
+    session_load(repl, 'L', path);
+    omni_compiler_remove_temp(repl->compiler, path);
+    free(path);
+}
+
+void omni_repl_eval(OmniRepl* repl, const char* text, bool show_code) {
+    /* Recorded steps live in each object, so a session's would be split */
+    if (!repl->compiler->options.runtime_path || repl->compiler->options.record_steps > 0) {
+        eval_program(repl, text, show_code);
+        return;
+    }
+    if (!start_session(repl)) return;
+    if (repl->loaded < repl->count && !load_definitions(repl)) return;
+    eval_incremental(repl, text, show_code);
+}
@@ -0,0 +1,62 @@
+/*
+ * OmniLisp REPL Sessions - evaluate lines without rebuilding what came before
+ *
+ * Definitions are kept until the next line to evaluate, so they may refer
+ * to each other in any order. Then the pending definitions are compiled
+ * into one shared object, loaded into the session process for good and
+ * run, which sets their globals and installs their functions (a redefined
+ * function replaces the old one for every later call). The line itself
+ * is compiled into an object of its own and run in the same process, so
+ * what it changes is there for the next line. Each build compiles only
+ * the new input; earlier definitions are declared, not compiled again.
+ *
+ * The session process is a child started with the first line, so a
+ * crash or exit there leaves the REPL running: the next line starts a
+ * new one and builds every definition into it again.
+ *
+ * Needs the libpurple runtime, which the session loads once and every
+ * object resolves against. Without it, or while steps are recorded, each
+ * line is compiled and run together with every definition, as a program.
+ * Pending definitions are then run once first, and each value that reads
+ * back as a datum is kept in place of its initializer (see snapshot.h).
+ * A recorded line leaves the steps it kept for omni_repl_step_back.
+ */
+
+#ifndef OMNILISP_REPL_H
+#define OMNILISP_REPL_H
+
+#include "../compiler/compiler.h"
+
+#ifdef __cplusplus
+extern "C" {
+#endif
+
+typedef struct OmniRepl OmniRepl;
+
+OmniRepl* omni_repl_new(Compiler* compiler);
+void omni_repl_free(OmniRepl* repl);
+
+/* Add a line of definitions; it is built with the next omni_repl_eval */
+void omni_repl_define(OmniRepl* repl, const char* text);
+
+/* Build any pending definitions, then compile and run text. With
+ * show_code the C compiled for text is printed first. Errors are
+ * reported on stderr. */
+void omni_repl_eval(OmniRepl* repl, const char* text, bool show_code);
+
+/* Forget every definition, ending the session process */
+void omni_repl_clear(OmniRepl* repl);
+
+/* Move n steps back through those the last recorded line kept, from
+ * after the last, and return that step as debug-history prints it; NULL
+ * when there is no earlier step. Each recorded line starts over. */
+const char* omni_repl_step_back(OmniRepl* repl, size_t n);
+
+size_t omni_repl_definition_count(OmniRepl* repl);
+const char* omni_repl_definition(OmniRepl* repl, size_t index);
+
+#ifdef __cplusplus
+}
+#endif
+
+#endif /* OMNILISP_REPL_H */
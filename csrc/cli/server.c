@@ -0,0 +1,791 @@
+/*
+ * OmniLisp Server - machine-oriented REPL protocol
+ *
+ * Drives compile-and-run sessions for editor plugins and notebooks.
+ * See server.h for the wire format.
+ */
+
+#include "server.h"
+#include "snapshot.h"
+#include "../parser/parser.h"
+#include "../codegen/codegen.h"
+#include "../macro/macro.h"
+
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <stdarg.h>
+#include <stdbool.h>
+#include <errno.h>
+#include <fcntl.h>
+#include <poll.h>
+#include <signal.h>
+#include <unistd.h>
+#include <sys/types.h>
+#include <sys/wait.h>
+#include <sys/socket.h>
+#include <netinet/in.h>
+#include <arpa/inet.h>
+
+#define MAX_FRAME_SIZE (16 * 1024 * 1024)
+
+/* ============== Byte Buffers ============== */
+
+typedef struct {
+    char* data;
+    size_t len;
+    size_t cap;
+} Buf;
+
+static void buf_put(Buf* b, const char* s, size_t n) {
+    if (b->len + n + 1 > b->cap) {
+        while (b->len + n + 1 > b->cap) {
+            b->cap = b->cap ? b->cap * 2 : 256;
+        }
+        b->data = realloc(b->data, b->cap);
+    }
+    memcpy(b->data + b->len, s, n);
+    b->len += n;
+    b->data[b->len] = '\0';
+}
+
+static void buf_puts(Buf* b, const char* s) {
+    buf_put(b, s, strlen(s));
+}
+
+static void buf_printf(Buf* b, const char* fmt, ...) {
+    char tmp[256];
+    va_list args;
+    va_start(args, fmt);
+    int n = vsnprintf(tmp, sizeof(tmp), fmt, args);
+    va_end(args);
+    if (n < 0) return;
+    if ((size_t)n < sizeof(tmp)) {
+        buf_put(b, tmp, n);
+        return;
+    }
+    char* big = malloc(n + 1);
+    va_start(args, fmt);
+    vsnprintf(big, n + 1, fmt, args);
+    va_end(args);
+    buf_put(b, big, n);
+    free(big);
+}
+
+/* Drop the first n bytes */
+static void buf_consume(Buf* b, size_t n) {
+    memmove(b->data, b->data + n, b->len - n);
+    b->len -= n;
+    b->data[b->len] = '\0';
+}
+
+static void buf_free(Buf* b) {
+    free(b->data);
+    b->data = NULL;
+    b->len = b->cap = 0;
+}
+
+/* Append s as a quoted JSON string */
+static void buf_json_string(Buf* b, const char* s, size_t n) {
+    buf_put(b, "\"", 1);
+    for (size_t i = 0; i < n; i++) {
+        unsigned char c = (unsigned char)s[i];
+        switch (c) {
+        case '"':  buf_puts(b, "\\\""); break;
+        case '\\': buf_puts(b, "\\\\"); break;
+        case '\n': buf_puts(b, "\\n"); break;
+        case '\r': buf_puts(b, "\\r"); break;
+        case '\t': buf_puts(b, "\\t"); break;
+        default:
+            if (c < 0x20) {
+                buf_printf(b, "\\u%04x", c);
+            } else {
+                buf_put(b, (const char*)&s[i], 1);
+            }
+        }
+    }
+    buf_put(b, "\"", 1);
+}
+
+/* ============== Request Parsing ============== */
+
+/*
+ * Requests are flat JSON objects; only top-level fields are inspected.
+ * Nested values are skipped, not interpreted.
+ */
+
+static const char* json_skip_ws(const char* p) {
+    while (*p == ' ' || *p == '\t' || *p == '\n' || *p == '\r') p++;
+    return p;
+}
+
+static void put_utf8(Buf* b, unsigned cp) {
+    char out[4];
+    if (cp < 0x80) {
+        out[0] = (char)cp;
+        buf_put(b, out, 1);
+    } else if (cp < 0x800) {
+        out[0] = (char)(0xC0 | (cp >> 6));
+        out[1] = (char)(0x80 | (cp & 0x3F));
+        buf_put(b, out, 2);
+    } else if (cp < 0x10000) {
+        out[0] = (char)(0xE0 | (cp >> 12));
+        out[1] = (char)(0x80 | ((cp >> 6) & 0x3F));
+        out[2] = (char)(0x80 | (cp & 0x3F));
+        buf_put(b, out, 3);
+    } else {
+        out[0] = (char)(0xF0 | (cp >> 18));
+        out[1] = (char)(0x80 | ((cp >> 12) & 0x3F));
+        out[2] = (char)(0x80 | ((cp >> 6) & 0x3F));
+        out[3] = (char)(0x80 | (cp & 0x3F));
+        buf_put(b, out, 4);
+    }
+}
+
+static bool parse_hex4(const char* p, unsigned* out) {
+    unsigned v = 0;
+    for (int i = 0; i < 4; i++) {
+        char c = p[i];
+        v <<= 4;
+        if (c >= '0' && c <= '9') v |= (unsigned)(c - '0');
+        else if (c >= 'a' && c <= 'f') v |= (unsigned)(c - 'a' + 10);
+        else if (c >= 'A' && c <= 'F') v |= (unsigned)(c - 'A' + 10);
+        else return false;
+    }
+    *out = v;
+    return true;
+}
+
+/* Parse a string literal at p. Returns the position after the closing
+ * quote, or NULL if malformed. The decoded text goes to out if non-NULL. */
+static const char* json_parse_string(const char* p, Buf* out) {
+    if (*p != '"') return NULL;
+    p++;
+    while (*p && *p != '"') {
+        if (*p != '\\') {
+            if (out) buf_put(out, p, 1);
+            p++;
+            continue;
+        }
+        p++;
+        char c = *p++;
+        switch (c) {
+        case '"':  if (out) buf_puts(out, "\""); break;
+        case '\\': if (out) buf_puts(out, "\\"); break;
+        case '/':  if (out) buf_puts(out, "/"); break;
+        case 'b':  if (out) buf_puts(out, "\b"); break;
+        case 'f':  if (out) buf_puts(out, "\f"); break;
+        case 'n':  if (out) buf_puts(out, "\n"); break;
+        case 'r':  if (out) buf_puts(out, "\r"); break;
+        case 't':  if (out) buf_puts(out, "\t"); break;
+        case 'u': {
+            unsigned cp;
+            if (!parse_hex4(p, &cp)) return NULL;
+            p += 4;
+            if (cp >= 0xD800 && cp < 0xDC00 && p[0] == '\\' && p[1] == 'u') {
+                unsigned lo;
+                if (parse_hex4(p + 2, &lo) && lo >= 0xDC00 && lo < 0xE000) {
+                    cp = 0x10000 + ((cp - 0xD800) << 10) + (lo - 0xDC00);
+                    p += 6;
+                }
+            }
+            if (out) put_utf8(out, cp);
+            break;
+        }
+        default:
+            return NULL;
+        }
+    }
+    return *p == '"' ? p + 1 : NULL;
+}
+
+/* Skip any JSON value. Returns the position after it, or NULL. */
+static const char* json_skip_value(const char* p) {
+    p = json_skip_ws(p);
+    if (*p == '"') return json_parse_string(p, NULL);
+    if (*p == '{' || *p == '[') {
+        char close = (*p == '{') ? '}' : ']';
+        p = json_skip_ws(p + 1);
+        if (*p == close) return p + 1;
+        while (*p) {
+            if (close == '}') {
+                p = json_parse_string(json_skip_ws(p), NULL);
+                if (!p) return NULL;
+                p = json_skip_ws(p);
+                if (*p++ != ':') return NULL;
+            }
+            p = json_skip_value(p);
+            if (!p) return NULL;
+            p = json_skip_ws(p);
+            if (*p == ',') { p = json_skip_ws(p + 1); continue; }
+            if (*p == close) return p + 1;
+            return NULL;
+        }
+        return NULL;
+    }
+    const char* start = p;
+    while (*p && *p != ',' && *p != '}' && *p != ']' &&
+           *p != ' ' && *p != '\t' && *p != '\n' && *p != '\r') {
+        p++;
+    }
+    return p > start ? p : NULL;
+}
+
+/* Find a top-level field; returns the start of its value or NULL */
+static const char* json_find(const char* json, const char* key) {
+    const char* p = json_skip_ws(json);
+    if (*p != '{') return NULL;
+    p = json_skip_ws(p + 1);
+    while (*p == '"') {
+        Buf name = {0};
+        p = json_parse_string(p, &name);
+        if (!p) { buf_free(&name); return NULL; }
+        p = json_skip_ws(p);
+        if (*p++ != ':') { buf_free(&name); return NULL; }
+        p = json_skip_ws(p);
+        bool hit = name.data && strcmp(name.data, key) == 0;
+        buf_free(&name);
+        if (hit) return p;
+        p = json_skip_value(p);
+        if (!p) return NULL;
+        p = json_skip_ws(p);
+        if (*p != ',') return NULL;
+        p = json_skip_ws(p + 1);
+    }
+    return NULL;
+}
+
+/* Decoded string field, or NULL if absent or not a string */
+static char* json_get_string(const char* json, const char* key) {
+    const char* v = json_find(json, key);
+    if (!v || *v != '"') return NULL;
+    Buf out = {0};
+    if (!json_parse_string(v, &out)) {
+        buf_free(&out);
+        return NULL;
+    }
+    if (!out.data) return strdup("");
+    return out.data;
+}
+
+/* Raw JSON text of a field (used to echo ids back verbatim) */
+static char* json_get_raw(const char* json, const char* key) {
+    const char* v = json_find(json, key);
+    if (!v) return NULL;
+    const char* end = json_skip_value(v);
+    if (!end) return NULL;
+    return strndup(v, end - v);
+}
+
+/* ============== Connections ============== */
+
+typedef struct {
+    int in_fd;
+    int out_fd;
+    Buf in;             /* Unframed input */
+    bool eof;
+
+    /* Requests that arrived while an eval was running */
+    char** pending;
+    size_t pending_count;
+    size_t pending_capacity;
+} Conn;
+
+static void conn_init(Conn* c, int in_fd, int out_fd) {
+    memset(c, 0, sizeof(Conn));
+    c->in_fd = in_fd;
+    c->out_fd = out_fd;
+}
+
+static void conn_free(Conn* c) {
+    buf_free(&c->in);
+    for (size_t i = 0; i < c->pending_count; i++) free(c->pending[i]);
+    free(c->pending);
+}
+
+/* Read whatever is available; blocks if nothing is */
+static void conn_fill(Conn* c) {
+    char tmp[4096];
+    ssize_t n;
+    do {
+        n = read(c->in_fd, tmp, sizeof(tmp));
+    } while (n < 0 && errno == EINTR);
+    if (n <= 0) {
+        c->eof = true;
+        return;
+    }
+    buf_put(&c->in, tmp, n);
+}
+
+/* Extract one complete frame from the input buffer. Returns NULL if none
+ * is complete yet; sets *bad on a malformed header. */
+static char* conn_take_frame(Conn* c, bool* bad) {
+    *bad = false;
+    size_t i = 0;
+    while (i < c->in.len && (c->in.data[i] == '\n' || c->in.data[i] == '\r')) i++;
+    if (i > 0) buf_consume(&c->in, i);
+
+    char* nl = c->in.len ? memchr(c->in.data, '\n', c->in.len) : NULL;
+    if (!nl) {
+        if (c->in.len > 32) *bad = true;
+        return NULL;
+    }
+
+    size_t size = 0;
+    const char* p = c->in.data;
+    if (p == nl) { *bad = true; return NULL; }
+    for (; p < nl; p++) {
+        if (*p == '\r' && p + 1 == nl) break;
+        if (*p < '0' || *p > '9' || size > MAX_FRAME_SIZE) {
+            *bad = true;
+            return NULL;
+        }
+        size = size * 10 + (size_t)(*p - '0');
+    }
+    if (size > MAX_FRAME_SIZE) {
+        *bad = true;
+        return NULL;
+    }
+
+    size_t header = (size_t)(nl - c->in.data) + 1;
+    if (c->in.len < header + size) return NULL;
+
+    char* frame = strndup(c->in.data + header, size);
+    buf_consume(&c->in, header + size);
+    return frame;
+}
+
+static void conn_send(Conn* c, const Buf* json) {
+    char header[32];
+    int n = snprintf(header, sizeof(header), "%zu\n", json->len);
+    const char* parts[2] = { header, json->data };
+    size_t lens[2] = { (size_t)n, json->len };
+    for (int k = 0; k < 2; k++) {
+        size_t off = 0;
+        while (off < lens[k]) {
+            ssize_t w = write(c->out_fd, parts[k] + off, lens[k] - off);
+            if (w < 0) {
+                if (errno == EINTR) continue;
+                return;
+            }
+            off += (size_t)w;
+        }
+    }
+}
+
+/* ============== Responses ============== */
+
+static void response_begin(Buf* r, const char* id, const char* status) {
+    buf_puts(r, "{\"id\":");
+    buf_puts(r, id ? id : "null");
+    buf_puts(r, ",\"status\":");
+    buf_json_string(r, status, strlen(status));
+}
+
+static void send_simple(Conn* c, const char* id, const char* status, const char* message) {
+    Buf r = {0};
+    response_begin(&r, id, status);
+    if (message) {
+        buf_puts(&r, ",\"message\":");
+        buf_json_string(&r, message, strlen(message));
+    }
+    buf_puts(&r, "}");
+    conn_send(c, &r);
+    buf_free(&r);
+}
+
+/* ============== Sessions ============== */
+
+typedef struct {
+    Compiler* compiler;
+    char** defs;        /* Accumulated definition sources */
+    size_t def_count;
+    size_t def_capacity;
+} Session;
+
+static void session_free(Session* s) {
+    for (size_t i = 0; i < s->def_count; i++) free(s->defs[i]);
+    free(s->defs);
+}
+
+/* True if code parses cleanly and every top-level form is a define,
+ * defmacro or deftype */
+static bool only_defines(const char* code) {
+    OmniSession* ast = omni_session_new();
+    OmniParser* parser = omni_parser_new(ast, code);
+    size_t count = 0;
+    OmniValue** exprs = omni_parser_parse_all(parser, &count);
+    bool ok = !omni_parser_get_errors(parser) && count > 0;
+    for (size_t i = 0; ok && i < count; i++) {
+        OmniValue* e = exprs[i];
+        ok = (omni_is_cell(e) && omni_is_sym(omni_car(e)) &&
+              strcmp(omni_car(e)->str_val, "define") == 0) || omni_is_defmacro(e) ||
+             omni_is_deftype(e);
+    }
+    free(exprs);
+    omni_parser_free(parser);
+    omni_session_free(ast);
+    return ok;
+}
+
+/* Handle requests that arrive mid-eval: interrupts act immediately,
+ * everything else waits its turn. Returns true if the eval should stop.
+ * A client closing its end does not interrupt; the eval still completes. */
+static bool drain_during_eval(Conn* c, const char* eval_id) {
+    bool stop = false;
+    for (;;) {
+        bool bad;
+        char* frame = conn_take_frame(c, &bad);
+        if (bad) {
+            /* Stop reading; the main loop reports the bad frame */
+            c->eof = true;
+            break;
+        }
+        if (!frame) break;
+
+        char* op = json_get_string(frame, "op");
+        if (op && strcmp(op, "interrupt") == 0) {
+            char* id = json_get_raw(frame, "id");
+            bool match = !id || !eval_id || strcmp(id, eval_id) == 0;
+            Buf r = {0};
+            response_begin(&r, id, "ok");
+            buf_puts(&r, match ? ",\"interrupted\":true}" : ",\"interrupted\":false}");
+            conn_send(c, &r);
+            buf_free(&r);
+            free(id);
+            stop = stop || match;
+            free(frame);
+        } else {
+            if (c->pending_count >= c->pending_capacity) {
+                c->pending_capacity = c->pending_capacity ? c->pending_capacity * 2 : 4;
+                c->pending = realloc(c->pending, c->pending_capacity * sizeof(char*));
+            }
+            c->pending[c->pending_count++] = frame;
+        }
+        free(op);
+    }
+    return stop;
+}
+
+/* Split program output into plain output and the framed results, in order
+ * (*values is a malloc'd array of *value_count malloc'd strings) */
+static void split_output(const Buf* raw, Buf* out, char*** values, size_t* value_count) {
+    Buf value = {0};
+    bool in_value = false;
+    size_t cap = 0;
+    for (size_t i = 0; i < raw->len; i++) {
+        char ch = raw->data[i];
+        if (ch == OMNI_RESULT_BEGIN) {
+            in_value = true;
+            value.len = 0;
+            if (value.data) value.data[0] = '\0';
+        } else if (ch == OMNI_RESULT_END) {
+            in_value = false;
+            while (value.len > 0 && value.data[value.len - 1] == '\n') {
+                value.data[--value.len] = '\0';
+            }
+            if (*value_count == cap) {
+                cap = cap ? cap * 2 : 4;
+                *values = realloc(*values, cap * sizeof(char*));
+            }
+            (*values)[(*value_count)++] = strdup(value.data ? value.data : "");
+        } else {
+            buf_put(in_value ? &value : out, &ch, 1);
+        }
+    }
+    buf_free(&value);
+}
+
+static void handle_eval(Session* s, Conn* c, const char* id, const char* code) {
+    Compiler* compiler = s->compiler;
+
+    /* Program = session definitions followed by this request's code. A
+     * defines-only eval also echoes the values it defines, so the session
+     * can keep them instead of their initializers. */
+    bool defining = only_defines(code);
+    size_t snapshot_count = 0;
+    char* names = defining ? omni_snapshot_names(code, &snapshot_count) : NULL;
+
+    size_t unit_count = s->def_count + 1 + (snapshot_count > 0);
+    OmniSource* units = malloc(unit_count * sizeof(OmniSource));
+    for (size_t i = 0; i < s->def_count; i++) {
+        units[i].name = "<session>";
+        units[i].text = s->defs[i];
+    }
+    units[s->def_count].name = "<eval>";
+    units[s->def_count].text = code;
+    if (snapshot_count > 0) {
+        units[s->def_count + 1].name = "<snapshot>";
+        units[s->def_count + 1].text = names;
+    }
+
+    char* bin_file = omni_compiler_temp_path(compiler, "");
+    if (!bin_file) {
+        free(units);
+        free(names);
+        send_simple(c, id, "error", "cannot create temporary file");
+        return;
+    }
+
+    bool built = omni_compiler_compile_units_to_binary(compiler, units, unit_count, bin_file);
+    free(units);
+    free(names);
+
+    if (!built) {
+        omni_compiler_remove_temp(compiler, bin_file);
+        free(bin_file);
+        Buf r = {0};
+        response_begin(&r, id, "error");
+        buf_puts(&r, ",\"value\":null,\"out\":\"\",\"diagnostics\":[");
+        for (size_t i = 0; i < omni_compiler_error_count(compiler); i++) {
+            const char* msg = omni_compiler_get_error(compiler, i);
+            if (i > 0) buf_puts(&r, ",");
+            buf_json_string(&r, msg, strlen(msg));
+        }
+        buf_puts(&r, "]}");
+        conn_send(c, &r);
+        buf_free(&r);
+        return;
+    }
+
+    int pipefd[2];
+    if (pipe(pipefd) < 0) {
+        omni_compiler_remove_temp(compiler, bin_file);
+        free(bin_file);
+        send_simple(c, id, "error", strerror(errno));
+        return;
+    }
+
+    pid_t pid = fork();
+    if (pid == 0) {
+        /* Child: the program must not read protocol frames from stdin */
+        int devnull = open("/dev/null", O_RDONLY);
+        if (devnull >= 0) dup2(devnull, STDIN_FILENO);
+        dup2(pipefd[1], STDOUT_FILENO);
+        dup2(pipefd[1], STDERR_FILENO);
+        close(pipefd[0]);
+        close(pipefd[1]);
+        execl(bin_file, bin_file, (char*)NULL);
+        _exit(127);
+    }
+    close(pipefd[1]);
+    if (pid < 0) {
+        close(pipefd[0]);
+        omni_compiler_remove_temp(compiler, bin_file);
+        free(bin_file);
+        send_simple(c, id, "error", strerror(errno));
+        return;
+    }
+
+    /* Collect output while watching for interrupts, starting with any
+     * that were read along with the eval's own frame */
+    Buf raw = {0};
+    bool interrupted = drain_during_eval(c, id);
+    if (interrupted) kill(pid, SIGKILL);
+    bool child_open = true;
+    while (child_open) {
+        struct pollfd fds[2] = {
+            { pipefd[0], POLLIN, 0 },
+            { c->in_fd, POLLIN, 0 },
+        };
+        int nfds = c->eof ? 1 : 2;
+        if (poll(fds, nfds, -1) < 0) {
+            if (errno == EINTR) continue;
+            break;
+        }
+        if (fds[0].revents & (POLLIN | POLLHUP | POLLERR)) {
+            char tmp[4096];
+            ssize_t n = read(pipefd[0], tmp, sizeof(tmp));
+            if (n > 0) {
+                buf_put(&raw, tmp, n);
+            } else if (n == 0 || errno != EINTR) {
+                child_open = false;
+            }
+        }
+        if (nfds > 1 && (fds[1].revents & (POLLIN | POLLHUP | POLLERR))) {
+            conn_fill(c);
+            if (drain_during_eval(c, id) && !interrupted) {
+                kill(pid, SIGKILL);
+                interrupted = true;
+            }
+        }
+    }
+    close(pipefd[0]);
+
+    int status = 0;
+    while (waitpid(pid, &status, 0) < 0 && errno == EINTR) {}
+    omni_compiler_remove_temp(compiler, bin_file);
+    free(bin_file);
+
+    int exit_code = WIFEXITED(status) ? WEXITSTATUS(status) : 128 + WTERMSIG(status);
+    const char* result = interrupted ? "interrupted" : (exit_code == 0 ? "ok" : "error");
+
+    Buf out = {0};
+    char** values = NULL;
+    size_t value_count = 0;
+    split_output(&raw, &out, &values, &value_count);
+
+    /* A clean run that only defined things extends the session; its
+     * framed results are the snapshot, not a value to report */
+    if (!interrupted && exit_code == 0 && defining) {
+        if (s->def_count >= s->def_capacity) {
+            s->def_capacity = s->def_capacity ? s->def_capacity * 2 : 8;
+            s->defs = realloc(s->defs, s->def_capacity * sizeof(char*));
+        }
+        char* source = value_count == snapshot_count ? omni_snapshot_source(code, values, value_count) : NULL;
+        s->defs[s->def_count++] = source ? source : strdup(code);
+    }
+    const char* value = !defining && value_count > 0 ? values[value_count - 1] : NULL;
+
+    Buf r = {0};
+    response_begin(&r, id, result);
+    buf_puts(&r, ",\"value\":");
+    if (value) {
+        buf_json_string(&r, value, strlen(value));
+    } else {
+        buf_puts(&r, "null");
+    }
+    buf_puts(&r, ",\"out\":");
+    buf_json_string(&r, out.data ? out.data : "", out.len);
+    buf_printf(&r, ",\"exit\":%d,\"diagnostics\":[]}", exit_code);
+    conn_send(c, &r);
+
+    buf_free(&r);
+    buf_free(&out);
+    for (size_t i = 0; i < value_count; i++) free(values[i]);
+    free(values);
+    buf_free(&raw);
+}
+
+/* Returns false when the client asked to close the session */
+static bool handle_request(Session* s, Conn* c, const char* frame) {
+    char* id = json_get_raw(frame, "id");
+    char* op = json_get_string(frame, "op");
+    bool keep_going = true;
+
+    if (!op) {
+        send_simple(c, id, "error", "missing op");
+    } else if (strcmp(op, "eval") == 0) {
+        char* code = json_get_string(frame, "code");
+        if (code) {
+            handle_eval(s, c, id, code);
+        } else {
+            send_simple(c, id, "error", "eval requires a code string");
+        }
+        free(code);
+    } else if (strcmp(op, "interrupt") == 0) {
+        /* Nothing is running between requests */
+        Buf r = {0};
+        response_begin(&r, id, "ok");
+        buf_puts(&r, ",\"interrupted\":false}");
+        conn_send(c, &r);
+        buf_free(&r);
+    } else if (strcmp(op, "describe") == 0) {
+        Buf r = {0};
+        response_begin(&r, id, "ok");
+        buf_puts(&r, ",\"version\":");
+        buf_json_string(&r, omni_compiler_version(), strlen(omni_compiler_version()));
+        buf_puts(&r, ",\"ops\":[\"eval\",\"interrupt\",\"describe\",\"close\"]}");
+        conn_send(c, &r);
+        buf_free(&r);
+    } else if (strcmp(op, "close") == 0) {
+        send_simple(c, id, "ok", NULL);
+        keep_going = false;
+    } else {
+        char msg[128];
+        snprintf(msg, sizeof(msg), "unknown op: %s", op);
+        send_simple(c, id, "error", msg);
+    }
+
+    free(id);
+    free(op);
+    return keep_going;
+}
+
+/* Serve one connection until EOF or close */
+static void serve(Compiler* compiler, int in_fd, int out_fd) {
+    Conn c;
+    conn_init(&c, in_fd, out_fd);
+    Session s = { compiler, NULL, 0, 0 };
+
+    /* Results are framed so they can be told apart from program output */
+    bool saved_script = compiler->options.script_mode;
+    bool saved_mark = compiler->options.mark_results;
+    compiler->options.script_mode = false;
+    compiler->options.mark_results = true;
+
+    for (;;) {
+        char* frame = NULL;
+        if (c.pending_count > 0) {
+            frame = c.pending[0];
+            memmove(c.pending, c.pending + 1, (c.pending_count - 1) * sizeof(char*));
+            c.pending_count--;
+        } else {
+            bool bad = false;
+            while (!(frame = conn_take_frame(&c, &bad)) && !bad && !c.eof) {
+                conn_fill(&c);
+            }
+            if (bad) {
+                send_simple(&c, NULL, "error", "malformed frame header");
+                break;
+            }
+            if (!frame) break;
+        }
+
+        bool keep_going = handle_request(&s, &c, frame);
+        free(frame);
+        if (!keep_going) break;
+    }
+
+    compiler->options.script_mode = saved_script;
+    compiler->options.mark_results = saved_mark;
+    session_free(&s);
+    conn_free(&c);
+}
+
+/* ============== Entry Points ============== */
+
+int omni_server_run_stdio(Compiler* compiler) {
+    signal(SIGPIPE, SIG_IGN);
+    serve(compiler, STDIN_FILENO, STDOUT_FILENO);
+    return 0;
+}
+
+int omni_server_run_tcp(Compiler* compiler, int port) {
+    signal(SIGPIPE, SIG_IGN);
+
+    int sock = socket(AF_INET, SOCK_STREAM, 0);
+    if (sock < 0) {
+        fprintf(stderr, "Error: socket: %s\n", strerror(errno));
+        return 1;
+    }
+    int one = 1;
+    setsockopt(sock, SOL_SOCKET, SO_REUSEADDR, &one, sizeof(one));
+
+    struct sockaddr_in addr;
+    memset(&addr, 0, sizeof(addr));
+    addr.sin_family = AF_INET;
+    addr.sin_addr.s_addr = htonl(INADDR_LOOPBACK);
+    addr.sin_port = htons((unsigned short)port);
+
+    if (bind(sock, (struct sockaddr*)&addr, sizeof(addr)) < 0 || listen(sock, 1) < 0) {
+        fprintf(stderr, "Error: cannot listen on port %d: %s\n", port, strerror(errno));
+        close(sock);
+        return 1;
+    }
+    fprintf(stderr, "OmniLisp server listening on 127.0.0.1:%d\n", port);
+
+    for (;;) {
+        int client = accept(sock, NULL, NULL);
+        if (client < 0) {
+            if (errno == EINTR) continue;
+            fprintf(stderr, "Error: accept: %s\n", strerror(errno));
+            break;
+        }
+        serve(compiler, client, client);
+        close(client);
+    }
+
+    close(sock);
+    return 1;
+}
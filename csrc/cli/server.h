@@ -0,0 +1,41 @@
+/*
+ * OmniLisp Server - machine-oriented REPL protocol
+ *
+ * Frames are "<length>\n<json>" where <length> is the decimal byte count
+ * of the JSON payload. Requests are objects with an "op" field:
+ *
+ *   {"op":"eval","id":1,"code":"(+ 1 2)"}
+ *   {"op":"interrupt","id":1}
+ *   {"op":"describe","id":2}
+ *   {"op":"close"}
+ *
+ * Every request gets exactly one response carrying the same id. Eval
+ * responses report "status" ("ok", "error" or "interrupted"), the
+ * "value" of the last expression as written by write, captured program
+ * output in "out", the program "exit" status and compiler "diagnostics".
+ *
+ * An eval made only of definitions extends the session. Values that can
+ * be written and read back (numbers, characters, symbols, lists) are kept
+ * as constants, so later evals do not run their initializers again.
+ */
+
+#ifndef OMNILISP_SERVER_H
+#define OMNILISP_SERVER_H
+
+#include "../compiler/compiler.h"
+
+#ifdef __cplusplus
+extern "C" {
+#endif
+
+/* Serve the protocol over stdin/stdout until EOF or a close request */
+int omni_server_run_stdio(Compiler* compiler);
+
+/* Serve the protocol on 127.0.0.1:port, one client at a time */
+int omni_server_run_tcp(Compiler* compiler, int port);
+
+#ifdef __cplusplus
+}
+#endif
+
+#endif /* OMNILISP_SERVER_H */
@@ -0,0 +1,121 @@
+/*
+ * OmniLisp Value Snapshots
+ *
+ * Shared by the REPL and the server. See snapshot.h.
+ */
+
+#include "snapshot.h"
+#include "../parser/parser.h"
+#include "../ast/ast.h"
+
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <stdbool.h>
+
+/* Name bound by a (define name init) form, else NULL */
+static const char* value_define_name(OmniValue* form) {
+    if (!omni_is_cell(form) || !omni_sym_eq_str(omni_car(form), "define")) return NULL;
+    OmniValue* target = omni_car(omni_cdr(form));
+    return omni_is_sym(target) ? target->str_val : NULL;
+}
+
+char* omni_snapshot_names(const char* code, size_t* count) {
+    OmniSession* ast = omni_session_new();
+    OmniParser* parser = omni_parser_new(ast, code);
+    size_t form_count = 0;
+    OmniValue** exprs = omni_parser_parse_all(parser, &form_count);
+    char* names = NULL;
+    size_t size = 0;
+    FILE* f = open_memstream(&names, &size);
+    size_t n = 0;
+    for (size_t i = 0; i < form_count; i++) {
+        const char* name = value_define_name(exprs[i]);
+        if (!name) continue;
+        fprintf(f, n++ > 0 ? " %s" : "%s", name);
+    }
+    fclose(f);
+    free(exprs);
+    omni_parser_free(parser);
+    omni_session_free(ast);
+
+    *count = n;
+    if (n == 0) {
+        free(names);
+        return NULL;
+    }
+    return names;
+}
+
+/* True if v was written in reader syntax and reads back as the same value:
+ * numbers, characters, symbols and lists of them. Closures, errors and
+ * non-finite floats print as something else. */
+static bool readable_datum(OmniValue* v) {
+    while (omni_is_cell(v)) {
+        if (!readable_datum(v->cell.car)) return false;
+        v = v->cell.cdr;
+    }
+    if (omni_is_nil(v)) return true;
+    switch (v->tag) {
+    case OMNI_INT:
+    case OMNI_FLOAT:
+    case OMNI_CHAR:
+        return true;
+    case OMNI_SYM:
+        return v->str_val[0] != '#' && strcmp(v->str_val, "+nan.0") != 0 &&
+               strcmp(v->str_val, "+inf.0") != 0 && strcmp(v->str_val, "-inf.0") != 0;
+    default:
+        return false;
+    }
+}
+
+/*
+ * Storing the value rather than init means later programs reference it
+ * instead of running init again, and a later redefinition of something
+ * init used cannot change it.
+ */
+char* omni_snapshot_source(const char* code, char* const* values, size_t value_count) {
+    OmniSession* ast = omni_session_new();
+    OmniParser* code_parser = omni_parser_new(ast, code);
+    size_t count = 0;
+    OmniValue** exprs = omni_parser_parse_all(code_parser, &count);
+    char* src = NULL;
+    size_t size = 0;
+    FILE* f = open_memstream(&src, &size);
+    size_t k = 0;
+    bool captured = false;
+    for (size_t i = 0; i < count; i++) {
+        const char* name = value_define_name(exprs[i]);
+        OmniValue* datum = NULL;
+        if (name && k < value_count) {
+            OmniParser* parser = omni_parser_new(ast, values[k++]);
+            size_t n = 0;
+            OmniValue** parsed = omni_parser_parse_all(parser, &n);
+            if (!omni_parser_get_errors(parser) && n == 1 && readable_datum(parsed[0])) {
+                datum = parsed[0];
+            }
+            free(parsed);
+            omni_parser_free(parser);
+        }
+
+        char* form = datum ? omni_value_to_string(datum) : omni_value_to_string(exprs[i]);
+        if (datum) {
+            fprintf(f, "(define %s (quote %s))\n", name, form);
+            captured = true;
+        } else {
+            fprintf(f, "%s\n", form);
+        }
+        free(form);
+    }
+    fclose(f);
+    if (size > 0 && src[size - 1] == '\n') src[size - 1] = '\0';
+    free(exprs);
+    omni_parser_free(code_parser);
+    omni_session_free(ast);
+
+    if (!captured) {
+        free(src);
+        return NULL;
+    }
+    return src;
+}
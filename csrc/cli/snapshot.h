@@ -0,0 +1,37 @@
+/*
+ * OmniLisp Value Snapshots - keep defined values instead of initializers
+ *
+ * The REPL and the server grow a session by replaying its definitions in
+ * front of every new program. When a value definition runs, the driver
+ * appends a snapshot unit that echoes each defined name with result
+ * framing on (see OMNI_RESULT_BEGIN in codegen.h), then stores
+ * (define name (quote datum)) for every value that reads back as a
+ * datum, so later programs do not run its initializer again.
+ */
+
+#ifndef OMNILISP_SNAPSHOT_H
+#define OMNILISP_SNAPSHOT_H
+
+#include <stddef.h>
+
+#ifdef __cplusplus
+extern "C" {
+#endif
+
+/* Snapshot unit for code: the names of its (define name init) forms,
+ * space separated. Sets *count; returns NULL when code defines no values. */
+char* omni_snapshot_names(const char* code, size_t* count);
+
+/*
+ * Session source for code whose value definitions produced values[0..n),
+ * in order. Definitions whose value is a readable datum become
+ * (define name (quote datum)); the rest keep their source. Returns NULL
+ * when nothing was captured and code should be kept as written.
+ */
+char* omni_snapshot_source(const char* code, char* const* values, size_t value_count);
+
+#ifdef __cplusplus
+}
+#endif
+
+#endif /* OMNILISP_SNAPSHOT_H */
@@ -5,25 +5,30 @@
  */
 
 #include "codegen.h"
+#include "../diagnostics/diagnostics.h"
 #include <stdlib.h>
 #include <string.h>
 #include <stdarg.h>
 #include <ctype.h>
+#include <limits.h>
+#include <math.h>
 
 /* ============== Context Management ============== */
 
-CodeGenContext* omni_codegen_new(FILE* output) {
+CodeGenContext* omni_codegen_new(OmniSession* session, FILE* output) {
     CodeGenContext* ctx = malloc(sizeof(CodeGenContext));
     if (!ctx) return NULL;
     memset(ctx, 0, sizeof(CodeGenContext));
+    ctx->session = session;
     ctx->output = output;
     return ctx;
 }
 
-CodeGenContext* omni_codegen_new_buffer(void) {
+CodeGenContext* omni_codegen_new_buffer(OmniSession* session) {
     CodeGenContext* ctx = malloc(sizeof(CodeGenContext));
     if (!ctx) return NULL;
     memset(ctx, 0, sizeof(CodeGenContext));
+    ctx->session = session;
     ctx->output_capacity = 4096;
     ctx->output_buffer = malloc(ctx->output_capacity);
     ctx->output_buffer[0] = '\0';
@@ -39,6 +44,25 @@ void omni_codegen_free(CodeGenContext* ctx) {
     }
     free(ctx->symbols.names);
     free(ctx->symbols.c_names);
+    free(ctx->symbols.global);
+    free(ctx->symbols.function);
+    free(ctx->symbols.params);
+    free(ctx->symbols.module);
+    free(ctx->symbols.boxed);
+    free(ctx->symbols.letrec);
+
+    for (size_t i = 0; i < ctx->locals.count; i++) {
+        free(ctx->locals.names[i]);
+    }
+    free(ctx->locals.names);
+
+    for (size_t i = 0; i < ctx->pairs.count; i++) {
+        free(ctx->pairs.names[i]);
+        free(ctx->pairs.c_names[i]);
+    }
+    free(ctx->pairs.names);
+    free(ctx->pairs.c_names);
+    free(ctx->pairs.scopes);
 
     for (size_t i = 0; i < ctx->forward_decls.count; i++) {
         free(ctx->forward_decls.decls[i]);
@@ -50,6 +74,17 @@ void omni_codegen_free(CodeGenContext* ctx) {
     }
     free(ctx->lambda_defs.defs);
 
+    for (size_t i = 0; i < ctx->errors.count; i++) {
+        free(ctx->errors.msgs[i]);
+    }
+    free(ctx->errors.msgs);
+    free(ctx->errors.at);
+
+    for (size_t i = 0; i < ctx->warnings.count; i++) {
+        free(ctx->warnings.msgs[i]);
+    }
+    free(ctx->warnings.msgs);
+
     if (ctx->analysis) {
         omni_analysis_free(ctx->analysis);
     }
@@ -82,18 +117,33 @@ static void buffer_append(CodeGenContext* ctx, const char* s) {
     ctx->output_size += len;
 }
 
-void omni_codegen_emit_raw(CodeGenContext* ctx, const char* fmt, ...) {
+/* Text longer than the stack buffer, such as a whole function body
+ * passed through "%s", is formatted again into a heap buffer */
+static void emit_v(CodeGenContext* ctx, const char* fmt, va_list args) {
     char buf[4096];
-    va_list args;
-    va_start(args, fmt);
-    vsnprintf(buf, sizeof(buf), fmt, args);
-    va_end(args);
+    va_list again;
+    va_copy(again, args);
+    int len = vsnprintf(buf, sizeof(buf), fmt, args);
+    char* text = buf;
+    if (len >= (int)sizeof(buf)) {
+        text = malloc((size_t)len + 1);
+        vsnprintf(text, (size_t)len + 1, fmt, again);
+    }
+    va_end(again);
 
     if (ctx->output) {
-        fputs(buf, ctx->output);
+        fputs(text, ctx->output);
     } else if (ctx->output_buffer) {
-        buffer_append(ctx, buf);
+        buffer_append(ctx, text);
     }
+    if (text != buf) free(text);
+}
+
+void omni_codegen_emit_raw(CodeGenContext* ctx, const char* fmt, ...) {
+    va_list args;
+    va_start(args, fmt);
+    emit_v(ctx, fmt, args);
+    va_end(args);
 }
 
 void omni_codegen_emit(CodeGenContext* ctx, const char* fmt, ...) {
@@ -102,17 +152,10 @@ void omni_codegen_emit(CodeGenContext* ctx, const char* fmt, ...) {
         omni_codegen_emit_raw(ctx, "    ");
     }
 
-    char buf[4096];
     va_list args;
     va_start(args, fmt);
-    vsnprintf(buf, sizeof(buf), fmt, args);
+    emit_v(ctx, fmt, args);
     va_end(args);
-
-    if (ctx->output) {
-        fputs(buf, ctx->output);
-    } else if (ctx->output_buffer) {
-        buffer_append(ctx, buf);
-    }
 }
 
 void omni_codegen_indent(CodeGenContext* ctx) {
@@ -182,6 +225,10 @@ void omni_codegen_add_forward_decl(CodeGenContext* ctx, const char* decl) {
 }
 
 void omni_codegen_add_lambda_def(CodeGenContext* ctx, const char* def) {
+    /* Function-value adapters are shared, so the same one may arrive twice */
+    for (size_t i = 0; i < ctx->lambda_defs.count; i++) {
+        if (strcmp(ctx->lambda_defs.defs[i], def) == 0) return;
+    }
     if (ctx->lambda_defs.count >= ctx->lambda_defs.capacity) {
         ctx->lambda_defs.capacity = ctx->lambda_defs.capacity ? ctx->lambda_defs.capacity * 2 : 16;
         ctx->lambda_defs.defs = realloc(ctx->lambda_defs.defs,
@@ -190,15 +237,137 @@ void omni_codegen_add_lambda_def(CodeGenContext* ctx, const char* def) {
     ctx->lambda_defs.defs[ctx->lambda_defs.count++] = strdup(def);
 }
 
+static void add_error_at(CodeGenContext* ctx, OmniLocation at, const char* msg) {
+    if (ctx->errors.count >= ctx->errors.capacity) {
+        ctx->errors.capacity = ctx->errors.capacity ? ctx->errors.capacity * 2 : 4;
+        ctx->errors.msgs = realloc(ctx->errors.msgs, ctx->errors.capacity * sizeof(char*));
+        ctx->errors.at = realloc(ctx->errors.at, ctx->errors.capacity * sizeof(OmniLocation));
+    }
+    ctx->errors.at[ctx->errors.count] = at;
+    ctx->errors.msgs[ctx->errors.count++] = strdup(msg);
+}
+
+void omni_codegen_error(CodeGenContext* ctx, const char* fmt, ...) {
+    char msg[512];
+    va_list args;
+    va_start(args, fmt);
+    vsnprintf(msg, sizeof(msg), fmt, args);
+    va_end(args);
+
+    OmniLocation at = { ctx->form, 0, 0 };
+    if (ctx->located) {
+        at.line = ctx->located->line;
+        at.column = ctx->located->column;
+    }
+    add_error_at(ctx, at, msg);
+}
+
+size_t omni_codegen_error_count(CodeGenContext* ctx) {
+    return ctx ? ctx->errors.count : 0;
+}
+
+const char* omni_codegen_get_error(CodeGenContext* ctx, size_t index) {
+    return (ctx && index < ctx->errors.count) ? ctx->errors.msgs[index] : NULL;
+}
+
+OmniLocation omni_codegen_get_error_location(CodeGenContext* ctx, size_t index) {
+    OmniLocation none = { 0, 0, 0 };
+    return (ctx && index < ctx->errors.count) ? ctx->errors.at[index] : none;
+}
+
+void omni_codegen_warning(CodeGenContext* ctx, const char* fmt, ...) {
+    char msg[512];
+    va_list args;
+    va_start(args, fmt);
+    vsnprintf(msg, sizeof(msg), fmt, args);
+    va_end(args);
+
+    for (size_t i = 0; i < ctx->warnings.count; i++) {
+        if (strcmp(ctx->warnings.msgs[i], msg) == 0) return;
+    }
+    if (ctx->warnings.count >= ctx->warnings.capacity) {
+        ctx->warnings.capacity = ctx->warnings.capacity ? ctx->warnings.capacity * 2 : 4;
+        ctx->warnings.msgs = realloc(ctx->warnings.msgs, ctx->warnings.capacity * sizeof(char*));
+    }
+    ctx->warnings.msgs[ctx->warnings.count++] = strdup(msg);
+}
+
+size_t omni_codegen_warning_count(CodeGenContext* ctx) {
+    return ctx ? ctx->warnings.count : 0;
+}
+
+const char* omni_codegen_get_warning(CodeGenContext* ctx, size_t index) {
+    return (ctx && index < ctx->warnings.count) ? ctx->warnings.msgs[index] : NULL;
+}
+
+/* Carry lambdas, errors and warnings from a scratch context back into ctx */
+static void absorb_scratch(CodeGenContext* ctx, CodeGenContext* tmp) {
+    for (size_t i = 0; i < tmp->lambda_defs.count; i++) {
+        omni_codegen_add_lambda_def(ctx, tmp->lambda_defs.defs[i]);
+    }
+    for (size_t i = 0; i < tmp->errors.count; i++) {
+        add_error_at(ctx, tmp->errors.at[i], tmp->errors.msgs[i]);
+    }
+    for (size_t i = 0; i < tmp->warnings.count; i++) {
+        omni_codegen_warning(ctx, "%s", tmp->warnings.msgs[i]);
+    }
+    ctx->reuses += tmp->reuses;
+    ctx->frees += tmp->frees;
+}
+
 /* ============== Symbol Table ============== */
 
-static const char* lookup_symbol(CodeGenContext* ctx, const char* name) {
-    for (size_t i = 0; i < ctx->symbols.count; i++) {
-        if (strcmp(ctx->symbols.names[i], name) == 0) {
-            return ctx->symbols.c_names[i];
-        }
+/* Whether a name module defines is private to it */
+static bool module_private(CodeGenContext* ctx, int module, const char* name) {
+    if (!module || !ctx->provides || !ctx->provides[module]) return false;
+    for (OmniValue* p = ctx->provides[module]; omni_is_cell(p); p = omni_cdr(p)) {
+        if (omni_sym_eq_str(omni_car(p), name)) return false;
     }
-    return NULL;
+    return true;
+}
+
+/* Whether the module whose form is being generated imports module itself */
+static bool imports_module(CodeGenContext* ctx, int module) {
+    if (!ctx->imports) return false;
+    for (OmniValue* m = ctx->imports[ctx->module]; omni_is_cell(m); m = omni_cdr(m)) {
+        if (omni_car(m)->int_val == module) return true;
+    }
+    return false;
+}
+
+/* Whether symbol i is a top-level definition the form being generated
+ * cannot see: one of another module that its module does not import, or
+ * that the module it comes from does not provide */
+static bool symbol_hidden(CodeGenContext* ctx, size_t i) {
+    int module = ctx->symbols.module[i];
+    if (module < 0 || module == ctx->module) return false;
+    return !imports_module(ctx, module) || module_private(ctx, module, ctx->symbols.names[i]);
+}
+
+/* C name of module's top-level definition of name: an imported module's
+ * are prefixed with its number, so modules can use the same names */
+static char* top_level_c_name(int module, const char* name) {
+    char* c_name = omni_codegen_mangle(name);
+    if (!module) return c_name;
+    size_t size = strlen(c_name) + 16;
+    char* prefixed = malloc(size);
+    snprintf(prefixed, size, "m%d_%s", module, c_name);
+    free(c_name);
+    return prefixed;
+}
+
+/* Innermost binding of name: index into the symbol table, or -1 */
+static long find_symbol(CodeGenContext* ctx, const char* name) {
+    for (size_t i = ctx->symbols.count; i > 0; i--) {
+        if (symbol_hidden(ctx, i - 1)) continue;
+        if (strcmp(ctx->symbols.names[i - 1], name) == 0) return (long)(i - 1);
+    }
+    return -1;
+}
+
+static const char* lookup_symbol(CodeGenContext* ctx, const char* name) {
+    long i = find_symbol(ctx, name);
+    return i >= 0 ? ctx->symbols.c_names[i] : NULL;
 }
 
 static void register_symbol(CodeGenContext* ctx, const char* name, const char* c_name) {
@@ -206,952 +375,8110 @@ static void register_symbol(CodeGenContext* ctx, const char* name, const char* c
         ctx->symbols.capacity = ctx->symbols.capacity ? ctx->symbols.capacity * 2 : 16;
         ctx->symbols.names = realloc(ctx->symbols.names, ctx->symbols.capacity * sizeof(char*));
         ctx->symbols.c_names = realloc(ctx->symbols.c_names, ctx->symbols.capacity * sizeof(char*));
+        ctx->symbols.global = realloc(ctx->symbols.global, ctx->symbols.capacity * sizeof(bool));
+        ctx->symbols.function = realloc(ctx->symbols.function, ctx->symbols.capacity * sizeof(bool));
+        ctx->symbols.params = realloc(ctx->symbols.params, ctx->symbols.capacity * sizeof(int));
+        ctx->symbols.module = realloc(ctx->symbols.module, ctx->symbols.capacity * sizeof(int));
+        ctx->symbols.boxed = realloc(ctx->symbols.boxed, ctx->symbols.capacity * sizeof(bool));
+        ctx->symbols.letrec = realloc(ctx->symbols.letrec, ctx->symbols.capacity * sizeof(OmniLetrecFn));
     }
     ctx->symbols.names[ctx->symbols.count] = strdup(name);
     ctx->symbols.c_names[ctx->symbols.count] = strdup(c_name);
+    ctx->symbols.global[ctx->symbols.count] = false;
+    ctx->symbols.function[ctx->symbols.count] = false;
+    ctx->symbols.params[ctx->symbols.count] = -1;
+    ctx->symbols.module[ctx->symbols.count] = -1;
+    ctx->symbols.boxed[ctx->symbols.count] = false;
+    ctx->symbols.letrec[ctx->symbols.count] = (OmniLetrecFn){ 0, 0, 0 };
     ctx->symbols.count++;
 }
 
-/* ============== Runtime Header ============== */
-
-void omni_codegen_runtime_header(CodeGenContext* ctx) {
-    omni_codegen_emit_raw(ctx, "/* Generated by OmniLisp Compiler */\n");
-    omni_codegen_emit_raw(ctx, "/* ASAP Memory Management - Compile-Time Free Injection */\n\n");
-
-    if (ctx->use_runtime && ctx->runtime_path) {
-        omni_codegen_emit_raw(ctx, "#include \"%s/include/purple.h\"\n\n", ctx->runtime_path);
-        /* Compatibility macros for runtime */
-        omni_codegen_emit_raw(ctx, "#define NIL mk_pair(NULL, NULL)\n");
-        omni_codegen_emit_raw(ctx, "#define omni_print(o) prim_print(o)\n");
-        omni_codegen_emit_raw(ctx, "#define car(o) obj_car(o)\n");
-        omni_codegen_emit_raw(ctx, "#define cdr(o) obj_cdr(o)\n");
-        omni_codegen_emit_raw(ctx, "#define mk_cell(a, b) mk_pair(a, b)\n");
-        omni_codegen_emit_raw(ctx, "#define prim_cons(a, b) mk_pair(a, b)\n\n");
-    } else {
-        /* Embedded minimal runtime */
-        omni_codegen_emit_raw(ctx, "#include <stdio.h>\n");
-        omni_codegen_emit_raw(ctx, "#include <stdlib.h>\n");
-        omni_codegen_emit_raw(ctx, "#include <string.h>\n");
-        omni_codegen_emit_raw(ctx, "#include <stdint.h>\n");
-        omni_codegen_emit_raw(ctx, "#include <stdbool.h>\n");
-        omni_codegen_emit_raw(ctx, "#include <pthread.h>\n\n");
-
-        /* Value type */
-        omni_codegen_emit_raw(ctx, "typedef enum {\n");
-        omni_codegen_emit_raw(ctx, "    T_INT, T_SYM, T_CELL, T_NIL, T_PRIM, T_LAMBDA, T_CODE, T_ERROR\n");
-        omni_codegen_emit_raw(ctx, "} Tag;\n\n");
-
-        omni_codegen_emit_raw(ctx, "struct Obj;\n");
-        omni_codegen_emit_raw(ctx, "typedef struct Obj* (*PrimFn)(struct Obj*, struct Obj*);\n\n");
-
-        omni_codegen_emit_raw(ctx, "typedef struct Obj {\n");
-        omni_codegen_emit_raw(ctx, "    Tag tag;\n");
-        omni_codegen_emit_raw(ctx, "    int rc;  /* Reference count */\n");
-        omni_codegen_emit_raw(ctx, "    union {\n");
-        omni_codegen_emit_raw(ctx, "        int64_t i;\n");
-        omni_codegen_emit_raw(ctx, "        char* s;\n");
-        omni_codegen_emit_raw(ctx, "        struct { struct Obj* car; struct Obj* cdr; } cell;\n");
-        omni_codegen_emit_raw(ctx, "        PrimFn prim;\n");
-        omni_codegen_emit_raw(ctx, "        struct { struct Obj* params; struct Obj* body; struct Obj* env; } lam;\n");
-        omni_codegen_emit_raw(ctx, "    };\n");
-        omni_codegen_emit_raw(ctx, "} Obj;\n\n");
-
-        /* Nil singleton */
-        omni_codegen_emit_raw(ctx, "static Obj _nil = { .tag = T_NIL, .rc = 1 };\n");
-        omni_codegen_emit_raw(ctx, "#define NIL (&_nil)\n\n");
-
-        /* Heap Constructors */
-        omni_codegen_emit_raw(ctx, "static Obj* mk_int(int64_t i) {\n");
-        omni_codegen_emit_raw(ctx, "    Obj* o = malloc(sizeof(Obj));\n");
-        omni_codegen_emit_raw(ctx, "    o->tag = T_INT; o->rc = 1; o->i = i;\n");
-        omni_codegen_emit_raw(ctx, "    return o;\n");
-        omni_codegen_emit_raw(ctx, "}\n\n");
-
-        omni_codegen_emit_raw(ctx, "static Obj* mk_sym(const char* s) {\n");
-        omni_codegen_emit_raw(ctx, "    Obj* o = malloc(sizeof(Obj));\n");
-        omni_codegen_emit_raw(ctx, "    o->tag = T_SYM; o->rc = 1; o->s = strdup(s);\n");
-        omni_codegen_emit_raw(ctx, "    return o;\n");
-        omni_codegen_emit_raw(ctx, "}\n\n");
-
-        omni_codegen_emit_raw(ctx, "static Obj* mk_cell(Obj* car, Obj* cdr) {\n");
-        omni_codegen_emit_raw(ctx, "    Obj* o = malloc(sizeof(Obj));\n");
-        omni_codegen_emit_raw(ctx, "    o->tag = T_CELL; o->rc = 1;\n");
-        omni_codegen_emit_raw(ctx, "    o->cell.car = car; o->cell.cdr = cdr;\n");
-        omni_codegen_emit_raw(ctx, "    return o;\n");
-        omni_codegen_emit_raw(ctx, "}\n\n");
-
-        /* Stack allocation macros (escape-aware allocation) */
-        omni_codegen_emit_raw(ctx, "/* Stack-allocated objects - no free needed, auto-cleanup at scope exit */\n");
-        omni_codegen_emit_raw(ctx, "#define STACK_INT(name, val) \\\n");
-        omni_codegen_emit_raw(ctx, "    Obj _stack_##name = { .tag = T_INT, .rc = 1, .i = (val) }; \\\n");
-        omni_codegen_emit_raw(ctx, "    Obj* name = &_stack_##name\n\n");
-
-        omni_codegen_emit_raw(ctx, "#define STACK_CELL(name, car_val, cdr_val) \\\n");
-        omni_codegen_emit_raw(ctx, "    Obj _stack_##name = { .tag = T_CELL, .rc = 1, .cell = { (car_val), (cdr_val) } }; \\\n");
-        omni_codegen_emit_raw(ctx, "    Obj* name = &_stack_##name\n\n");
-
-        /* Helper to check if an object is stack-allocated (for debug/safety) */
-        omni_codegen_emit_raw(ctx, "#define IS_STACK_OBJ(o) ((o) && (o)->rc == -1)\n");
-        omni_codegen_emit_raw(ctx, "#define MARK_STACK(o) ((o)->rc = -1)\n\n");
-
-        /* Stack-friendly constructors that initialize existing memory */
-        omni_codegen_emit_raw(ctx, "static void init_int(Obj* o, int64_t i) {\n");
-        omni_codegen_emit_raw(ctx, "    o->tag = T_INT; o->rc = -1; o->i = i;\n");
-        omni_codegen_emit_raw(ctx, "}\n\n");
-
-        omni_codegen_emit_raw(ctx, "static void init_cell(Obj* o, Obj* car, Obj* cdr) {\n");
-        omni_codegen_emit_raw(ctx, "    o->tag = T_CELL; o->rc = -1;\n");
-        omni_codegen_emit_raw(ctx, "    o->cell.car = car; o->cell.cdr = cdr;\n");
-        omni_codegen_emit_raw(ctx, "}\n\n");
-
-        /* Accessors */
-        omni_codegen_emit_raw(ctx, "#define car(o) ((o)->cell.car)\n");
-        omni_codegen_emit_raw(ctx, "#define cdr(o) ((o)->cell.cdr)\n");
-        omni_codegen_emit_raw(ctx, "#define is_nil(o) ((o) == NIL || (o)->tag == T_NIL)\n\n");
-
-        /* Reference counting and ownership-aware free strategies */
-        omni_codegen_emit_raw(ctx, "static void inc_ref(Obj* o) { if (o && o != NIL) o->rc++; }\n");
-        omni_codegen_emit_raw(ctx, "static void dec_ref(Obj* o);\n");
-        omni_codegen_emit_raw(ctx, "static void free_tree(Obj* o);\n\n");
-
-        /* free_unique: Known single reference, no RC check needed */
-        omni_codegen_emit_raw(ctx, "static void free_unique(Obj* o) {\n");
-        omni_codegen_emit_raw(ctx, "    if (!o || o == NIL) return;\n");
-        omni_codegen_emit_raw(ctx, "    switch (o->tag) {\n");
-        omni_codegen_emit_raw(ctx, "    case T_SYM: free(o->s); break;\n");
-        omni_codegen_emit_raw(ctx, "    case T_CELL: free_unique(o->cell.car); free_unique(o->cell.cdr); break;\n");
-        omni_codegen_emit_raw(ctx, "    case T_LAMBDA: free_unique(o->lam.params); free_unique(o->lam.body); free_unique(o->lam.env); break;\n");
-        omni_codegen_emit_raw(ctx, "    default: break;\n");
-        omni_codegen_emit_raw(ctx, "    }\n");
-        omni_codegen_emit_raw(ctx, "    free(o);\n");
-        omni_codegen_emit_raw(ctx, "}\n\n");
-
-        /* free_tree: Tree-shaped, recursive free (still checks RC for shared children) */
-        omni_codegen_emit_raw(ctx, "static void free_tree(Obj* o) {\n");
-        omni_codegen_emit_raw(ctx, "    if (!o || o == NIL) return;\n");
-        omni_codegen_emit_raw(ctx, "    if (o->rc > 1) { o->rc--; return; } /* Shared child - dec only */\n");
-        omni_codegen_emit_raw(ctx, "    switch (o->tag) {\n");
-        omni_codegen_emit_raw(ctx, "    case T_SYM: free(o->s); break;\n");
-        omni_codegen_emit_raw(ctx, "    case T_CELL: free_tree(o->cell.car); free_tree(o->cell.cdr); break;\n");
-        omni_codegen_emit_raw(ctx, "    case T_LAMBDA: free_tree(o->lam.params); free_tree(o->lam.body); free_tree(o->lam.env); break;\n");
-        omni_codegen_emit_raw(ctx, "    default: break;\n");
-        omni_codegen_emit_raw(ctx, "    }\n");
-        omni_codegen_emit_raw(ctx, "    free(o);\n");
-        omni_codegen_emit_raw(ctx, "}\n\n");
-
-        /* free_obj: Standard RC-based free (dec_ref alias) */
-        omni_codegen_emit_raw(ctx, "static void free_obj(Obj* o) {\n");
-        omni_codegen_emit_raw(ctx, "    if (!o || o == NIL) return;\n");
-        omni_codegen_emit_raw(ctx, "    if (--o->rc > 0) return;\n");
-        omni_codegen_emit_raw(ctx, "    switch (o->tag) {\n");
-        omni_codegen_emit_raw(ctx, "    case T_SYM: free(o->s); break;\n");
-        omni_codegen_emit_raw(ctx, "    case T_CELL: free_obj(o->cell.car); free_obj(o->cell.cdr); break;\n");
-        omni_codegen_emit_raw(ctx, "    case T_LAMBDA: free_obj(o->lam.params); free_obj(o->lam.body); free_obj(o->lam.env); break;\n");
-        omni_codegen_emit_raw(ctx, "    default: break;\n");
-        omni_codegen_emit_raw(ctx, "    }\n");
-        omni_codegen_emit_raw(ctx, "    free(o);\n");
-        omni_codegen_emit_raw(ctx, "}\n");
-        omni_codegen_emit_raw(ctx, "static void dec_ref(Obj* o) { free_obj(o); }\n\n");
-
-        /* Weak references for back-edges (break cycles) */
-        omni_codegen_emit_raw(ctx, "/* Weak reference: does NOT prevent deallocation.\n");
-        omni_codegen_emit_raw(ctx, " * Used for back-edges (parent, prev, etc.) to break cycles.\n");
-        omni_codegen_emit_raw(ctx, " * Weak refs are NOT followed during free (no recursive free).\n");
-        omni_codegen_emit_raw(ctx, " * Weak refs are auto-nullified when target is freed.\n");
-        omni_codegen_emit_raw(ctx, " */\n");
-        omni_codegen_emit_raw(ctx, "typedef struct WeakRef {\n");
-        omni_codegen_emit_raw(ctx, "    Obj** slot;           /* Pointer to the weak field in the owner */\n");
-        omni_codegen_emit_raw(ctx, "    struct WeakRef* next; /* Next weak ref pointing to same target */\n");
-        omni_codegen_emit_raw(ctx, "} WeakRef;\n\n");
-
-        omni_codegen_emit_raw(ctx, "/* Weak ref list head stored in target object (or separate table) */\n");
-        omni_codegen_emit_raw(ctx, "static WeakRef* _weak_refs = NULL; /* Global list for simplicity */\n\n");
-
-        omni_codegen_emit_raw(ctx, "static void weak_ref_register(Obj** slot, Obj* target) {\n");
-        omni_codegen_emit_raw(ctx, "    (void)target; /* For table-based lookup, would use target */\n");
-        omni_codegen_emit_raw(ctx, "    WeakRef* wr = malloc(sizeof(WeakRef));\n");
-        omni_codegen_emit_raw(ctx, "    wr->slot = slot;\n");
-        omni_codegen_emit_raw(ctx, "    wr->next = _weak_refs;\n");
-        omni_codegen_emit_raw(ctx, "    _weak_refs = wr;\n");
-        omni_codegen_emit_raw(ctx, "}\n\n");
-
-        omni_codegen_emit_raw(ctx, "static void weak_refs_nullify(Obj* target) {\n");
-        omni_codegen_emit_raw(ctx, "    /* Called when target is about to be freed - nullify all weak refs */\n");
-        omni_codegen_emit_raw(ctx, "    WeakRef** prev = &_weak_refs;\n");
-        omni_codegen_emit_raw(ctx, "    WeakRef* wr = _weak_refs;\n");
-        omni_codegen_emit_raw(ctx, "    while (wr) {\n");
-        omni_codegen_emit_raw(ctx, "        if (*(wr->slot) == target) {\n");
-        omni_codegen_emit_raw(ctx, "            *(wr->slot) = NULL; /* Nullify the weak reference */\n");
-        omni_codegen_emit_raw(ctx, "            *prev = wr->next;\n");
-        omni_codegen_emit_raw(ctx, "            WeakRef* to_free = wr;\n");
-        omni_codegen_emit_raw(ctx, "            wr = wr->next;\n");
-        omni_codegen_emit_raw(ctx, "            free(to_free);\n");
-        omni_codegen_emit_raw(ctx, "        } else {\n");
-        omni_codegen_emit_raw(ctx, "            prev = &wr->next;\n");
-        omni_codegen_emit_raw(ctx, "            wr = wr->next;\n");
-        omni_codegen_emit_raw(ctx, "        }\n");
-        omni_codegen_emit_raw(ctx, "    }\n");
-        omni_codegen_emit_raw(ctx, "}\n\n");
-
-        omni_codegen_emit_raw(ctx, "/* Set a back-edge field (weak reference) */\n");
-        omni_codegen_emit_raw(ctx, "#define SET_WEAK(owner, field, target) do { \\\n");
-        omni_codegen_emit_raw(ctx, "    (owner)->field = (target); \\\n");
-        omni_codegen_emit_raw(ctx, "    if (target) weak_ref_register(&(owner)->field, target); \\\n");
-        omni_codegen_emit_raw(ctx, "} while(0)\n\n");
-
-        omni_codegen_emit_raw(ctx, "/* Get a back-edge field (may be NULL if target was freed) */\n");
-        omni_codegen_emit_raw(ctx, "#define GET_WEAK(owner, field) ((owner)->field)\n\n");
-
-        /* Perceus reuse functions - reuse freed memory for new allocations */
-        omni_codegen_emit_raw(ctx, "/* Perceus Reuse: In-place mutation for functional-style updates.\n");
-        omni_codegen_emit_raw(ctx, " * When we know an object will be freed immediately before a new allocation\n");
-        omni_codegen_emit_raw(ctx, " * of the same size, we can reuse its memory instead of free+malloc.\n");
-        omni_codegen_emit_raw(ctx, " */\n\n");
-
-        omni_codegen_emit_raw(ctx, "/* Reuse an object's memory for an integer */\n");
-        omni_codegen_emit_raw(ctx, "static Obj* reuse_as_int(Obj* old, int64_t val) {\n");
-        omni_codegen_emit_raw(ctx, "    if (!old || old == NIL) return mk_int(val);\n");
-        omni_codegen_emit_raw(ctx, "    /* Clear old content if needed */\n");
-        omni_codegen_emit_raw(ctx, "    if (old->tag == T_SYM && old->s) free(old->s);\n");
-        omni_codegen_emit_raw(ctx, "    else if (old->tag == T_CELL) {\n");
-        omni_codegen_emit_raw(ctx, "        free_obj(old->cell.car);\n");
-        omni_codegen_emit_raw(ctx, "        free_obj(old->cell.cdr);\n");
-        omni_codegen_emit_raw(ctx, "    }\n");
-        omni_codegen_emit_raw(ctx, "    old->tag = T_INT;\n");
-        omni_codegen_emit_raw(ctx, "    old->i = val;\n");
-        omni_codegen_emit_raw(ctx, "    old->rc = 1;\n");
-        omni_codegen_emit_raw(ctx, "    return old;\n");
-        omni_codegen_emit_raw(ctx, "}\n\n");
-
-        omni_codegen_emit_raw(ctx, "/* Reuse an object's memory for a cell/cons */\n");
-        omni_codegen_emit_raw(ctx, "static Obj* reuse_as_cell(Obj* old, Obj* car, Obj* cdr) {\n");
-        omni_codegen_emit_raw(ctx, "    if (!old || old == NIL) return mk_cell(car, cdr);\n");
-        omni_codegen_emit_raw(ctx, "    /* Clear old content if needed */\n");
-        omni_codegen_emit_raw(ctx, "    if (old->tag == T_SYM && old->s) free(old->s);\n");
-        omni_codegen_emit_raw(ctx, "    else if (old->tag == T_CELL) {\n");
-        omni_codegen_emit_raw(ctx, "        free_obj(old->cell.car);\n");
-        omni_codegen_emit_raw(ctx, "        free_obj(old->cell.cdr);\n");
-        omni_codegen_emit_raw(ctx, "    }\n");
-        omni_codegen_emit_raw(ctx, "    old->tag = T_CELL;\n");
-        omni_codegen_emit_raw(ctx, "    old->cell.car = car; inc_ref(car);\n");
-        omni_codegen_emit_raw(ctx, "    old->cell.cdr = cdr; inc_ref(cdr);\n");
-        omni_codegen_emit_raw(ctx, "    old->rc = 1;\n");
-        omni_codegen_emit_raw(ctx, "    return old;\n");
-        omni_codegen_emit_raw(ctx, "}\n\n");
-
-        omni_codegen_emit_raw(ctx, "/* Reuse an object's memory for a float */\n");
-        omni_codegen_emit_raw(ctx, "static Obj* reuse_as_float(Obj* old, double val) {\n");
-        omni_codegen_emit_raw(ctx, "    if (!old || old == NIL) return mk_float(val);\n");
-        omni_codegen_emit_raw(ctx, "    /* Clear old content if needed */\n");
-        omni_codegen_emit_raw(ctx, "    if (old->tag == T_SYM && old->s) free(old->s);\n");
-        omni_codegen_emit_raw(ctx, "    else if (old->tag == T_CELL) {\n");
-        omni_codegen_emit_raw(ctx, "        free_obj(old->cell.car);\n");
-        omni_codegen_emit_raw(ctx, "        free_obj(old->cell.cdr);\n");
-        omni_codegen_emit_raw(ctx, "    }\n");
-        omni_codegen_emit_raw(ctx, "    old->tag = T_FLOAT;\n");
-        omni_codegen_emit_raw(ctx, "    old->f = val;\n");
-        omni_codegen_emit_raw(ctx, "    old->rc = 1;\n");
-        omni_codegen_emit_raw(ctx, "    return old;\n");
-        omni_codegen_emit_raw(ctx, "}\n\n");
-
-        omni_codegen_emit_raw(ctx, "/* Check if object can be reused (unique, about to be freed) */\n");
-        omni_codegen_emit_raw(ctx, "#define CAN_REUSE(o) ((o) && (o) != NIL && (o)->rc == 1)\n\n");
-
-        omni_codegen_emit_raw(ctx, "/* Conditional reuse macro - falls back to fresh alloc if can't reuse */\n");
-        omni_codegen_emit_raw(ctx, "#define REUSE_OR_NEW_INT(old, val) \\\n");
-        omni_codegen_emit_raw(ctx, "    (CAN_REUSE(old) ? reuse_as_int(old, val) : mk_int(val))\n\n");
-
-        omni_codegen_emit_raw(ctx, "#define REUSE_OR_NEW_CELL(old, car, cdr) \\\n");
-        omni_codegen_emit_raw(ctx, "    (CAN_REUSE(old) ? reuse_as_cell(old, car, cdr) : mk_cell(car, cdr))\n\n");
-
-        omni_codegen_emit_raw(ctx, "#define REUSE_OR_NEW_FLOAT(old, val) \\\n");
-        omni_codegen_emit_raw(ctx, "    (CAN_REUSE(old) ? reuse_as_float(old, val) : mk_float(val))\n\n");
-
-        /* RC Elision: Skip reference counting for objects with known lifetimes */
-        omni_codegen_emit_raw(ctx, "/* RC Elision: Conditional inc/dec based on analysis.\n");
-        omni_codegen_emit_raw(ctx, " * When analysis proves RC operations are unnecessary, we skip them:\n");
-        omni_codegen_emit_raw(ctx, " * - Unique references: no other refs exist\n");
-        omni_codegen_emit_raw(ctx, " * - Stack-allocated: lifetime is scope-bound\n");
-        omni_codegen_emit_raw(ctx, " * - Arena/pool: bulk free, no individual tracking\n");
-        omni_codegen_emit_raw(ctx, " * - Same region: all refs die together\n");
-        omni_codegen_emit_raw(ctx, " */\n\n");
-
-        omni_codegen_emit_raw(ctx, "/* Conditional inc_ref - may be elided */\n");
-        omni_codegen_emit_raw(ctx, "#define INC_REF_IF_NEEDED(o, can_elide) \\\n");
-        omni_codegen_emit_raw(ctx, "    do { if (!(can_elide)) inc_ref(o); } while(0)\n\n");
-
-        omni_codegen_emit_raw(ctx, "/* Conditional dec_ref - may be elided */\n");
-        omni_codegen_emit_raw(ctx, "#define DEC_REF_IF_NEEDED(o, can_elide) \\\n");
-        omni_codegen_emit_raw(ctx, "    do { if (!(can_elide)) dec_ref(o); } while(0)\n\n");
-
-        omni_codegen_emit_raw(ctx, "/* No-op for elided RC operations (for clarity in generated code) */\n");
-        omni_codegen_emit_raw(ctx, "#define RC_ELIDED() ((void)0)\n\n");
-
-        omni_codegen_emit_raw(ctx, "/* Region-local reference: no RC needed within same region */\n");
-        omni_codegen_emit_raw(ctx, "#define REGION_LOCAL_REF(o) (o)  /* No inc_ref needed */\n\n");
-
-        /* Per-Region External Refcount */
-        omni_codegen_emit_raw(ctx, "/* Per-Region External Refcount: Track references into a region.\n");
-        omni_codegen_emit_raw(ctx, " * Instead of per-object RC, track external refs to the region.\n");
-        omni_codegen_emit_raw(ctx, " * When external_refcount == 0 and scope ends, bulk free entire region.\n");
-        omni_codegen_emit_raw(ctx, " */\n\n");
-
-        omni_codegen_emit_raw(ctx, "typedef struct Region {\n");
-        omni_codegen_emit_raw(ctx, "    int id;\n");
-        omni_codegen_emit_raw(ctx, "    int external_refcount;  /* Refs from outside this region */\n");
-        omni_codegen_emit_raw(ctx, "    void* arena;            /* Arena allocator for this region */\n");
-        omni_codegen_emit_raw(ctx, "    struct Region* parent;  /* Enclosing region */\n");
-        omni_codegen_emit_raw(ctx, "} Region;\n\n");
-
-        omni_codegen_emit_raw(ctx, "static Region* _current_region = NULL;\n\n");
-
-        omni_codegen_emit_raw(ctx, "static Region* region_new(int id) {\n");
-        omni_codegen_emit_raw(ctx, "    Region* r = malloc(sizeof(Region));\n");
-        omni_codegen_emit_raw(ctx, "    r->id = id;\n");
-        omni_codegen_emit_raw(ctx, "    r->external_refcount = 0;\n");
-        omni_codegen_emit_raw(ctx, "    r->arena = NULL;  /* Could use arena allocator */\n");
-        omni_codegen_emit_raw(ctx, "    r->parent = _current_region;\n");
-        omni_codegen_emit_raw(ctx, "    _current_region = r;\n");
-        omni_codegen_emit_raw(ctx, "    return r;\n");
-        omni_codegen_emit_raw(ctx, "}\n\n");
-
-        omni_codegen_emit_raw(ctx, "static void region_end(Region* r) {\n");
-        omni_codegen_emit_raw(ctx, "    if (!r) return;\n");
-        omni_codegen_emit_raw(ctx, "    _current_region = r->parent;\n");
-        omni_codegen_emit_raw(ctx, "    /* If no external refs, could bulk-free arena here */\n");
-        omni_codegen_emit_raw(ctx, "    if (r->external_refcount == 0) {\n");
-        omni_codegen_emit_raw(ctx, "        /* Safe to bulk free all objects in region */\n");
-        omni_codegen_emit_raw(ctx, "    }\n");
-        omni_codegen_emit_raw(ctx, "    free(r);\n");
-        omni_codegen_emit_raw(ctx, "}\n\n");
-
-        omni_codegen_emit_raw(ctx, "#define REGION_INC_EXTERNAL(r) do { if (r) (r)->external_refcount++; } while(0)\n");
-        omni_codegen_emit_raw(ctx, "#define REGION_DEC_EXTERNAL(r) do { if (r) (r)->external_refcount--; } while(0)\n");
-        omni_codegen_emit_raw(ctx, "#define REGION_CAN_BULK_FREE(r) ((r) && (r)->external_refcount == 0)\n\n");
-
-        /* Borrow/Tether: Keep objects alive during loop iteration */
-        omni_codegen_emit_raw(ctx, "/* Borrow/Tether: Keep borrowed objects alive.\n");
-        omni_codegen_emit_raw(ctx, " * When iterating over a collection, the collection must stay alive.\n");
-        omni_codegen_emit_raw(ctx, " * Tethering increments RC at loop entry, decrements at loop exit.\n");
-        omni_codegen_emit_raw(ctx, " */\n\n");
-
-        omni_codegen_emit_raw(ctx, "/* Tether an object to keep it alive during a borrow */\n");
-        omni_codegen_emit_raw(ctx, "#define TETHER(o) do { if (o) inc_ref(o); } while(0)\n\n");
-
-        omni_codegen_emit_raw(ctx, "/* Release a tether when borrow ends */\n");
-        omni_codegen_emit_raw(ctx, "#define UNTETHER(o) do { if (o) dec_ref(o); } while(0)\n\n");
-
-        omni_codegen_emit_raw(ctx, "/* Borrow a collection for loop iteration */\n");
-        omni_codegen_emit_raw(ctx, "#define BORROW_FOR_LOOP(coll) TETHER(coll)\n\n");
-
-        omni_codegen_emit_raw(ctx, "/* End loop borrow */\n");
-        omni_codegen_emit_raw(ctx, "#define END_LOOP_BORROW(coll) UNTETHER(coll)\n\n");
-
-        omni_codegen_emit_raw(ctx, "/* Scoped tether - automatically releases at scope end */\n");
-        omni_codegen_emit_raw(ctx, "#define SCOPED_TETHER_DECL(name, o) \\\n");
-        omni_codegen_emit_raw(ctx, "    Obj* name##_tethered = (o); \\\n");
-        omni_codegen_emit_raw(ctx, "    TETHER(name##_tethered)\n\n");
-
-        omni_codegen_emit_raw(ctx, "#define SCOPED_TETHER_END(name) \\\n");
-        omni_codegen_emit_raw(ctx, "    UNTETHER(name##_tethered)\n\n");
-
-        /* Interprocedural Ownership Annotations */
-        omni_codegen_emit_raw(ctx, "/* Interprocedural Summaries: Ownership annotations for function boundaries.\n");
-        omni_codegen_emit_raw(ctx, " * These annotations guide the compiler/reader about ownership transfer.\n");
-        omni_codegen_emit_raw(ctx, " * PARAM_BORROWED: Caller keeps ownership, callee borrows.\n");
-        omni_codegen_emit_raw(ctx, " * PARAM_CONSUMED: Callee takes ownership, will free.\n");
-        omni_codegen_emit_raw(ctx, " * PARAM_PASSTHROUGH: Param passes through to return value.\n");
-        omni_codegen_emit_raw(ctx, " * PARAM_CAPTURED: Param is captured in closure/data structure.\n");
-        omni_codegen_emit_raw(ctx, " */\n\n");
-
-        omni_codegen_emit_raw(ctx, "/* Parameter ownership annotations (for documentation) */\n");
-        omni_codegen_emit_raw(ctx, "#define PARAM_BORROWED(p) (p)      /* Borrowed: caller keeps ownership */\n");
-        omni_codegen_emit_raw(ctx, "#define PARAM_CONSUMED(p) (p)      /* Consumed: callee takes ownership */\n");
-        omni_codegen_emit_raw(ctx, "#define PARAM_PASSTHROUGH(p) (p)   /* Passthrough: returned to caller */\n");
-        omni_codegen_emit_raw(ctx, "#define PARAM_CAPTURED(p) (p)      /* Captured: stored in closure/struct */\n\n");
-
-        omni_codegen_emit_raw(ctx, "/* Return ownership annotations */\n");
-        omni_codegen_emit_raw(ctx, "#define RETURN_FRESH(v) (v)        /* Fresh allocation, caller must free */\n");
-        omni_codegen_emit_raw(ctx, "#define RETURN_PASSTHROUGH(v) (v)  /* Returns a parameter, no new alloc */\n");
-        omni_codegen_emit_raw(ctx, "#define RETURN_BORROWED(v) (v)     /* Borrowed ref, don't free */\n");
-        omni_codegen_emit_raw(ctx, "#define RETURN_NONE() NIL          /* Returns nil/void */\n\n");
-
-        omni_codegen_emit_raw(ctx, "/* Caller-side ownership handling */\n");
-        omni_codegen_emit_raw(ctx, "#define CALL_CONSUMED(arg, call_expr) \\\n");
-        omni_codegen_emit_raw(ctx, "    ({ Obj* _result = (call_expr); /* arg ownership transferred */ _result; })\n\n");
-
-        omni_codegen_emit_raw(ctx, "#define CALL_BORROWED(arg, call_expr) \\\n");
-        omni_codegen_emit_raw(ctx, "    ({ Obj* _result = (call_expr); /* caller still owns arg */ _result; })\n\n");
-
-        omni_codegen_emit_raw(ctx, "/* Function summary declaration macro */\n");
-        omni_codegen_emit_raw(ctx, "#define FUNC_SUMMARY(name, ret_own, allocs, side_effects) \\\n");
-        omni_codegen_emit_raw(ctx, "    /* Summary: name returns ret_own, allocates: allocs, side_effects: side_effects */\n\n");
-
-        omni_codegen_emit_raw(ctx, "/* Ownership transfer assertion (debug builds) */\n");
-        omni_codegen_emit_raw(ctx, "#ifndef NDEBUG\n");
-        omni_codegen_emit_raw(ctx, "#define ASSERT_OWNED(o) do { \\\n");
-        omni_codegen_emit_raw(ctx, "    if ((o) && (o) != NIL && (o)->rc < 1) { \\\n");
-        omni_codegen_emit_raw(ctx, "        fprintf(stderr, \"Ownership error: %%p has rc=%%d\\n\", (void*)(o), (o)->rc); \\\n");
-        omni_codegen_emit_raw(ctx, "    } \\\n");
-        omni_codegen_emit_raw(ctx, "} while(0)\n");
-        omni_codegen_emit_raw(ctx, "#else\n");
-        omni_codegen_emit_raw(ctx, "#define ASSERT_OWNED(o) ((void)0)\n");
-        omni_codegen_emit_raw(ctx, "#endif\n\n");
-
-        /* Concurrency Ownership Inference */
-        omni_codegen_emit_raw(ctx, "/* Concurrency Ownership: Thread-safe reference counting.\n");
-        omni_codegen_emit_raw(ctx, " * THREAD_LOCAL: Data stays in one thread, no sync needed.\n");
-        omni_codegen_emit_raw(ctx, " * THREAD_SHARED: Data accessed by multiple threads, needs atomic RC.\n");
-        omni_codegen_emit_raw(ctx, " * THREAD_TRANSFER: Data transferred via channel, ownership moves.\n");
-        omni_codegen_emit_raw(ctx, " */\n\n");
-
-        omni_codegen_emit_raw(ctx, "/* Atomic reference counting for shared data */\n");
-        omni_codegen_emit_raw(ctx, "#ifdef __STDC_NO_ATOMICS__\n");
-        omni_codegen_emit_raw(ctx, "/* Fallback for systems without C11 atomics - use mutex */\n");
-        omni_codegen_emit_raw(ctx, "static pthread_mutex_t _rc_mutex = PTHREAD_MUTEX_INITIALIZER;\n");
-        omni_codegen_emit_raw(ctx, "#define ATOMIC_INC_REF(o) do { \\\n");
-        omni_codegen_emit_raw(ctx, "    pthread_mutex_lock(&_rc_mutex); \\\n");
-        omni_codegen_emit_raw(ctx, "    if ((o) && (o) != NIL) (o)->rc++; \\\n");
-        omni_codegen_emit_raw(ctx, "    pthread_mutex_unlock(&_rc_mutex); \\\n");
-        omni_codegen_emit_raw(ctx, "} while(0)\n\n");
-        omni_codegen_emit_raw(ctx, "#define ATOMIC_DEC_REF(o) do { \\\n");
-        omni_codegen_emit_raw(ctx, "    pthread_mutex_lock(&_rc_mutex); \\\n");
-        omni_codegen_emit_raw(ctx, "    if ((o) && (o) != NIL) { \\\n");
-        omni_codegen_emit_raw(ctx, "        if (--(o)->rc <= 0) { \\\n");
-        omni_codegen_emit_raw(ctx, "            pthread_mutex_unlock(&_rc_mutex); \\\n");
-        omni_codegen_emit_raw(ctx, "            free_obj(o); \\\n");
-        omni_codegen_emit_raw(ctx, "        } else { \\\n");
-        omni_codegen_emit_raw(ctx, "            pthread_mutex_unlock(&_rc_mutex); \\\n");
-        omni_codegen_emit_raw(ctx, "        } \\\n");
-        omni_codegen_emit_raw(ctx, "    } else { pthread_mutex_unlock(&_rc_mutex); } \\\n");
-        omni_codegen_emit_raw(ctx, "} while(0)\n");
-        omni_codegen_emit_raw(ctx, "#else\n");
-        omni_codegen_emit_raw(ctx, "/* Using __atomic builtins for GCC/Clang compatibility */\n");
-        omni_codegen_emit_raw(ctx, "#define ATOMIC_INC_REF(o) do { \\\n");
-        omni_codegen_emit_raw(ctx, "    if ((o) && (o) != NIL) __atomic_add_fetch(&(o)->rc, 1, __ATOMIC_SEQ_CST); \\\n");
-        omni_codegen_emit_raw(ctx, "} while(0)\n\n");
-        omni_codegen_emit_raw(ctx, "#define ATOMIC_DEC_REF(o) do { \\\n");
-        omni_codegen_emit_raw(ctx, "    if ((o) && (o) != NIL) { \\\n");
-        omni_codegen_emit_raw(ctx, "        if (__atomic_sub_fetch(&(o)->rc, 1, __ATOMIC_SEQ_CST) <= 0) { \\\n");
-        omni_codegen_emit_raw(ctx, "            free_obj(o); \\\n");
-        omni_codegen_emit_raw(ctx, "        } \\\n");
-        omni_codegen_emit_raw(ctx, "    } \\\n");
-        omni_codegen_emit_raw(ctx, "} while(0)\n");
-        omni_codegen_emit_raw(ctx, "#endif\n\n");
-
-        omni_codegen_emit_raw(ctx, "/* Thread locality annotations */\n");
-        omni_codegen_emit_raw(ctx, "#define THREAD_LOCAL_VAR(v) (v)      /* No sync needed */\n");
-        omni_codegen_emit_raw(ctx, "#define THREAD_SHARED_VAR(v) (v)     /* Uses atomic RC */\n");
-        omni_codegen_emit_raw(ctx, "#define THREAD_TRANSFER_VAR(v) (v)   /* Ownership moves */\n\n");
-
-        omni_codegen_emit_raw(ctx, "/* Channel operations - ownership transfer semantics */\n");
-        omni_codegen_emit_raw(ctx, "typedef struct Channel {\n");
-        omni_codegen_emit_raw(ctx, "    Obj** buffer;\n");
-        omni_codegen_emit_raw(ctx, "    size_t capacity;\n");
-        omni_codegen_emit_raw(ctx, "    size_t head, tail, count;\n");
-        omni_codegen_emit_raw(ctx, "    pthread_mutex_t mutex;\n");
-        omni_codegen_emit_raw(ctx, "    pthread_cond_t not_empty;\n");
-        omni_codegen_emit_raw(ctx, "    pthread_cond_t not_full;\n");
-        omni_codegen_emit_raw(ctx, "    int closed;\n");
-        omni_codegen_emit_raw(ctx, "} Channel;\n\n");
-
-        omni_codegen_emit_raw(ctx, "static Channel* channel_new(size_t capacity) {\n");
-        omni_codegen_emit_raw(ctx, "    Channel* c = malloc(sizeof(Channel));\n");
-        omni_codegen_emit_raw(ctx, "    c->buffer = malloc(capacity * sizeof(Obj*));\n");
-        omni_codegen_emit_raw(ctx, "    c->capacity = capacity;\n");
-        omni_codegen_emit_raw(ctx, "    c->head = c->tail = c->count = 0;\n");
-        omni_codegen_emit_raw(ctx, "    pthread_mutex_init(&c->mutex, NULL);\n");
-        omni_codegen_emit_raw(ctx, "    pthread_cond_init(&c->not_empty, NULL);\n");
-        omni_codegen_emit_raw(ctx, "    pthread_cond_init(&c->not_full, NULL);\n");
-        omni_codegen_emit_raw(ctx, "    c->closed = 0;\n");
-        omni_codegen_emit_raw(ctx, "    return c;\n");
-        omni_codegen_emit_raw(ctx, "}\n\n");
-
-        omni_codegen_emit_raw(ctx, "/* Send transfers ownership - sender must NOT free after */\n");
-        omni_codegen_emit_raw(ctx, "static void channel_send(Channel* c, Obj* value) {\n");
-        omni_codegen_emit_raw(ctx, "    pthread_mutex_lock(&c->mutex);\n");
-        omni_codegen_emit_raw(ctx, "    while (c->count == c->capacity && !c->closed) {\n");
-        omni_codegen_emit_raw(ctx, "        pthread_cond_wait(&c->not_full, &c->mutex);\n");
-        omni_codegen_emit_raw(ctx, "    }\n");
-        omni_codegen_emit_raw(ctx, "    if (!c->closed) {\n");
-        omni_codegen_emit_raw(ctx, "        c->buffer[c->tail] = value;  /* Ownership transfers */\n");
-        omni_codegen_emit_raw(ctx, "        c->tail = (c->tail + 1) %% c->capacity;\n");
-        omni_codegen_emit_raw(ctx, "        c->count++;\n");
-        omni_codegen_emit_raw(ctx, "        pthread_cond_signal(&c->not_empty);\n");
-        omni_codegen_emit_raw(ctx, "    }\n");
-        omni_codegen_emit_raw(ctx, "    pthread_mutex_unlock(&c->mutex);\n");
-        omni_codegen_emit_raw(ctx, "}\n\n");
-
-        omni_codegen_emit_raw(ctx, "/* Recv receives ownership - receiver must free when done */\n");
-        omni_codegen_emit_raw(ctx, "static Obj* channel_recv(Channel* c) {\n");
-        omni_codegen_emit_raw(ctx, "    pthread_mutex_lock(&c->mutex);\n");
-        omni_codegen_emit_raw(ctx, "    while (c->count == 0 && !c->closed) {\n");
-        omni_codegen_emit_raw(ctx, "        pthread_cond_wait(&c->not_empty, &c->mutex);\n");
-        omni_codegen_emit_raw(ctx, "    }\n");
-        omni_codegen_emit_raw(ctx, "    Obj* value = NIL;\n");
-        omni_codegen_emit_raw(ctx, "    if (c->count > 0) {\n");
-        omni_codegen_emit_raw(ctx, "        value = c->buffer[c->head];  /* Ownership transfers */\n");
-        omni_codegen_emit_raw(ctx, "        c->head = (c->head + 1) %% c->capacity;\n");
-        omni_codegen_emit_raw(ctx, "        c->count--;\n");
-        omni_codegen_emit_raw(ctx, "        pthread_cond_signal(&c->not_full);\n");
-        omni_codegen_emit_raw(ctx, "    }\n");
-        omni_codegen_emit_raw(ctx, "    pthread_mutex_unlock(&c->mutex);\n");
-        omni_codegen_emit_raw(ctx, "    return value;\n");
-        omni_codegen_emit_raw(ctx, "}\n\n");
-
-        omni_codegen_emit_raw(ctx, "static void channel_close(Channel* c) {\n");
-        omni_codegen_emit_raw(ctx, "    pthread_mutex_lock(&c->mutex);\n");
-        omni_codegen_emit_raw(ctx, "    c->closed = 1;\n");
-        omni_codegen_emit_raw(ctx, "    pthread_cond_broadcast(&c->not_empty);\n");
-        omni_codegen_emit_raw(ctx, "    pthread_cond_broadcast(&c->not_full);\n");
-        omni_codegen_emit_raw(ctx, "    pthread_mutex_unlock(&c->mutex);\n");
-        omni_codegen_emit_raw(ctx, "}\n\n");
-
-        omni_codegen_emit_raw(ctx, "static void channel_free(Channel* c) {\n");
-        omni_codegen_emit_raw(ctx, "    if (!c) return;\n");
-        omni_codegen_emit_raw(ctx, "    /* Free any remaining items in buffer */\n");
-        omni_codegen_emit_raw(ctx, "    while (c->count > 0) {\n");
-        omni_codegen_emit_raw(ctx, "        free_obj(c->buffer[c->head]);\n");
-        omni_codegen_emit_raw(ctx, "        c->head = (c->head + 1) %% c->capacity;\n");
-        omni_codegen_emit_raw(ctx, "        c->count--;\n");
-        omni_codegen_emit_raw(ctx, "    }\n");
-        omni_codegen_emit_raw(ctx, "    free(c->buffer);\n");
-        omni_codegen_emit_raw(ctx, "    pthread_mutex_destroy(&c->mutex);\n");
-        omni_codegen_emit_raw(ctx, "    pthread_cond_destroy(&c->not_empty);\n");
-        omni_codegen_emit_raw(ctx, "    pthread_cond_destroy(&c->not_full);\n");
-        omni_codegen_emit_raw(ctx, "    free(c);\n");
-        omni_codegen_emit_raw(ctx, "}\n\n");
-
-        omni_codegen_emit_raw(ctx, "/* Ownership transfer macros */\n");
-        omni_codegen_emit_raw(ctx, "#define SEND_OWNERSHIP(ch, val) do { channel_send(ch, val); /* val no longer owned */ } while(0)\n");
-        omni_codegen_emit_raw(ctx, "#define RECV_OWNERSHIP(ch, var) do { var = channel_recv(ch); /* var now owned */ } while(0)\n\n");
-
-        omni_codegen_emit_raw(ctx, "/* Thread spawn with captured variable handling */\n");
-        omni_codegen_emit_raw(ctx, "#define SPAWN_THREAD(fn, arg) do { \\\n");
-        omni_codegen_emit_raw(ctx, "    pthread_t _thread; \\\n");
-        omni_codegen_emit_raw(ctx, "    pthread_create(&_thread, NULL, fn, arg); \\\n");
-        omni_codegen_emit_raw(ctx, "    pthread_detach(_thread); \\\n");
-        omni_codegen_emit_raw(ctx, "} while(0)\n\n");
-
-        omni_codegen_emit_raw(ctx, "/* Mark variable as shared (needs atomic RC) */\n");
-        omni_codegen_emit_raw(ctx, "#define MARK_SHARED(v) ((void)0)  /* Analysis marker, no runtime cost */\n\n");
-
-        omni_codegen_emit_raw(ctx, "/* Conditional RC based on thread locality analysis */\n");
-        omni_codegen_emit_raw(ctx, "#define INC_REF_FOR_THREAD(o, needs_atomic) \\\n");
-        omni_codegen_emit_raw(ctx, "    do { if (needs_atomic) ATOMIC_INC_REF(o); else inc_ref(o); } while(0)\n\n");
-
-        omni_codegen_emit_raw(ctx, "#define DEC_REF_FOR_THREAD(o, needs_atomic) \\\n");
-        omni_codegen_emit_raw(ctx, "    do { if (needs_atomic) ATOMIC_DEC_REF(o); else dec_ref(o); } while(0)\n\n");
-
-        /* Print */
-        omni_codegen_emit_raw(ctx, "static void print_obj(Obj* o) {\n");
-        omni_codegen_emit_raw(ctx, "    if (!o || is_nil(o)) { printf(\"()\"); return; }\n");
-        omni_codegen_emit_raw(ctx, "    switch (o->tag) {\n");
-        omni_codegen_emit_raw(ctx, "    case T_INT: printf(\"%%ld\", (long)o->i); break;\n");
-        omni_codegen_emit_raw(ctx, "    case T_SYM: printf(\"%%s\", o->s); break;\n");
-        omni_codegen_emit_raw(ctx, "    case T_CELL:\n");
-        omni_codegen_emit_raw(ctx, "        printf(\"(\");\n");
-        omni_codegen_emit_raw(ctx, "        while (!is_nil(o)) {\n");
-        omni_codegen_emit_raw(ctx, "            print_obj(car(o));\n");
-        omni_codegen_emit_raw(ctx, "            o = cdr(o);\n");
-        omni_codegen_emit_raw(ctx, "            if (!is_nil(o)) printf(\" \");\n");
-        omni_codegen_emit_raw(ctx, "        }\n");
-        omni_codegen_emit_raw(ctx, "        printf(\")\");\n");
-        omni_codegen_emit_raw(ctx, "        break;\n");
-        omni_codegen_emit_raw(ctx, "    default: printf(\"#<unknown>\"); break;\n");
-        omni_codegen_emit_raw(ctx, "    }\n");
-        omni_codegen_emit_raw(ctx, "}\n");
-        omni_codegen_emit_raw(ctx, "#define omni_print(o) print_obj(o)\n\n");
-
-        /* Primitives */
-        omni_codegen_emit_raw(ctx, "static Obj* prim_add(Obj* a, Obj* b) { return mk_int(a->i + b->i); }\n");
-        omni_codegen_emit_raw(ctx, "static Obj* prim_sub(Obj* a, Obj* b) { return mk_int(a->i - b->i); }\n");
-        omni_codegen_emit_raw(ctx, "static Obj* prim_mul(Obj* a, Obj* b) { return mk_int(a->i * b->i); }\n");
-        omni_codegen_emit_raw(ctx, "static Obj* prim_div(Obj* a, Obj* b) { return mk_int(a->i / b->i); }\n");
-        omni_codegen_emit_raw(ctx, "static Obj* prim_mod(Obj* a, Obj* b) { return mk_int(a->i %% b->i); }\n");
-        omni_codegen_emit_raw(ctx, "static Obj* prim_lt(Obj* a, Obj* b) { return mk_int(a->i < b->i ? 1 : 0); }\n");
-        omni_codegen_emit_raw(ctx, "static Obj* prim_gt(Obj* a, Obj* b) { return mk_int(a->i > b->i ? 1 : 0); }\n");
-        omni_codegen_emit_raw(ctx, "static Obj* prim_le(Obj* a, Obj* b) { return mk_int(a->i <= b->i ? 1 : 0); }\n");
-        omni_codegen_emit_raw(ctx, "static Obj* prim_ge(Obj* a, Obj* b) { return mk_int(a->i >= b->i ? 1 : 0); }\n");
-        omni_codegen_emit_raw(ctx, "static Obj* prim_eq(Obj* a, Obj* b) { return mk_int(a->i == b->i ? 1 : 0); }\n");
-        omni_codegen_emit_raw(ctx, "static Obj* prim_cons(Obj* a, Obj* b) { inc_ref(a); inc_ref(b); return mk_cell(a, b); }\n");
-        omni_codegen_emit_raw(ctx, "static Obj* prim_car(Obj* lst) { return is_nil(lst) ? NIL : car(lst); }\n");
-        omni_codegen_emit_raw(ctx, "static Obj* prim_cdr(Obj* lst) { return is_nil(lst) ? NIL : cdr(lst); }\n");
-        omni_codegen_emit_raw(ctx, "static Obj* prim_null(Obj* o) { return mk_int(is_nil(o) ? 1 : 0); }\n");
-        omni_codegen_emit_raw(ctx, "static int is_truthy(Obj* o) { return o && o != NIL && (o->tag != T_INT || o->i != 0); }\n\n");
-    }
+/* A top-level variable; its version stamp is _ver_<c_name> */
+static void register_global(CodeGenContext* ctx, const char* name, const char* c_name) {
+    register_symbol(ctx, name, c_name);
+    ctx->symbols.global[ctx->symbols.count - 1] = true;
 }
 
-/* ============== Expression Compilation ============== */
-
-static void codegen_expr(CodeGenContext* ctx, OmniValue* expr);
+/* A top-level function, compiled to a C function of the same name
+ * taking params arguments */
+static void register_function(CodeGenContext* ctx, const char* name, const char* c_name, int params) {
+    register_symbol(ctx, name, c_name);
+    ctx->symbols.function[ctx->symbols.count - 1] = true;
+    ctx->symbols.params[ctx->symbols.count - 1] = params;
+}
 
-static void codegen_int(CodeGenContext* ctx, OmniValue* expr) {
-    omni_codegen_emit_raw(ctx, "mk_int(%ld)", (long)expr->int_val);
+static void copy_symbols(CodeGenContext* dst, CodeGenContext* src) {
+    for (size_t i = 0; i < src->symbols.count; i++) {
+        register_symbol(dst, src->symbols.names[i], src->symbols.c_names[i]);
+        dst->symbols.global[dst->symbols.count - 1] = src->symbols.global[i];
+        dst->symbols.function[dst->symbols.count - 1] = src->symbols.function[i];
+        dst->symbols.params[dst->symbols.count - 1] = src->symbols.params[i];
+        dst->symbols.module[dst->symbols.count - 1] = src->symbols.module[i];
+        dst->symbols.boxed[dst->symbols.count - 1] = src->symbols.boxed[i];
+        dst->symbols.letrec[dst->symbols.count - 1] = src->symbols.letrec[i];
+    }
 }
 
-static void codegen_float(CodeGenContext* ctx, OmniValue* expr) {
-    /* For now, treat floats as ints (TODO: proper float support) */
-    omni_codegen_emit_raw(ctx, "mk_int(%ld)", (long)expr->float_val);
+/* Bindings made from here on are dropped by pop_scope(ctx, mark) at the
+ * end of the form that makes them */
+static size_t scope_mark(CodeGenContext* ctx) {
+    return ctx->symbols.count;
 }
 
-static void codegen_sym(CodeGenContext* ctx, OmniValue* expr) {
-    const char* c_name = lookup_symbol(ctx, expr->str_val);
-    if (c_name) {
-        omni_codegen_emit_raw(ctx, "%s", c_name);
-    } else {
-        /* Check for primitives */
-        const char* name = expr->str_val;
-        if (strcmp(name, "+") == 0) omni_codegen_emit_raw(ctx, "prim_add");
-        else if (strcmp(name, "-") == 0) omni_codegen_emit_raw(ctx, "prim_sub");
-        else if (strcmp(name, "*") == 0) omni_codegen_emit_raw(ctx, "prim_mul");
-        else if (strcmp(name, "/") == 0) omni_codegen_emit_raw(ctx, "prim_div");
-        else if (strcmp(name, "%%") == 0) omni_codegen_emit_raw(ctx, "prim_mod");
-        else if (strcmp(name, "<") == 0) omni_codegen_emit_raw(ctx, "prim_lt");
-        else if (strcmp(name, ">") == 0) omni_codegen_emit_raw(ctx, "prim_gt");
-        else if (strcmp(name, "<=") == 0) omni_codegen_emit_raw(ctx, "prim_le");
-        else if (strcmp(name, ">=") == 0) omni_codegen_emit_raw(ctx, "prim_ge");
-        else if (strcmp(name, "=") == 0) omni_codegen_emit_raw(ctx, "prim_eq");
-        else if (strcmp(name, "cons") == 0) omni_codegen_emit_raw(ctx, "prim_cons");
-        else if (strcmp(name, "car") == 0) omni_codegen_emit_raw(ctx, "prim_car");
-        else if (strcmp(name, "cdr") == 0) omni_codegen_emit_raw(ctx, "prim_cdr");
-        else if (strcmp(name, "null?") == 0) omni_codegen_emit_raw(ctx, "prim_null");
-        else {
-            char* mangled = omni_codegen_mangle(name);
-            omni_codegen_emit_raw(ctx, "%s", mangled);
-            free(mangled);
-        }
+static void pop_scope(CodeGenContext* ctx, size_t mark) {
+    while (ctx->symbols.count > mark) {
+        ctx->symbols.count--;
+        free(ctx->symbols.names[ctx->symbols.count]);
+        free(ctx->symbols.c_names[ctx->symbols.count]);
     }
 }
 
-static void codegen_quote(CodeGenContext* ctx, OmniValue* expr) {
-    /* (quote x) */
-    OmniValue* args = omni_cdr(expr);
-    if (omni_is_nil(args)) {
-        omni_codegen_emit_raw(ctx, "NIL");
-        return;
-    }
+/* C name of the top-level variable name refers to, or NULL when a local
+ * binding shadows it */
+static const char* global_variable(CodeGenContext* ctx, const char* name) {
+    long i = find_symbol(ctx, name);
+    return i >= 0 && ctx->symbols.global[i] ? ctx->symbols.c_names[i] : NULL;
+}
 
-    OmniValue* val = omni_car(args);
+/* Whether name refers to a function compiled as a C function rather than
+ * to a variable, which may hold a closure */
+static bool function_symbol(CodeGenContext* ctx, const char* name) {
+    long i = find_symbol(ctx, name);
+    return i >= 0 && ctx->symbols.function[i];
+}
 
-    if (omni_is_nil(val)) {
-        omni_codegen_emit_raw(ctx, "NIL");
-    } else if (omni_is_int(val)) {
-        omni_codegen_emit_raw(ctx, "mk_int(%ld)", (long)val->int_val);
-    } else if (omni_is_sym(val)) {
-        omni_codegen_emit_raw(ctx, "mk_sym(\"%s\")", val->str_val);
-    } else if (omni_is_cell(val)) {
-        /* Build list at runtime */
-        omni_codegen_emit_raw(ctx, "mk_cell(");
-        codegen_quote(ctx, omni_list2(omni_new_sym("quote"), omni_car(val)));
-        omni_codegen_emit_raw(ctx, ", ");
-        codegen_quote(ctx, omni_list2(omni_new_sym("quote"), omni_cdr(val)));
-        omni_codegen_emit_raw(ctx, ")");
-    } else {
-        omni_codegen_emit_raw(ctx, "NIL");
-    }
+/* Whether name refers to a local kept in a box (see box_binding) */
+static bool boxed_symbol(CodeGenContext* ctx, const char* name) {
+    long i = find_symbol(ctx, name);
+    return i >= 0 && ctx->symbols.boxed[i];
 }
 
-static void codegen_if(CodeGenContext* ctx, OmniValue* expr) {
-    /* (if cond then else) */
-    OmniValue* args = omni_cdr(expr);
-    OmniValue* cond = omni_car(args);
-    args = omni_cdr(args);
-    OmniValue* then_expr = omni_is_nil(args) ? NULL : omni_car(args);
-    args = omni_cdr(args);
-    OmniValue* else_expr = omni_is_nil(args) ? NULL : omni_car(args);
+/* The letrec function name refers to; its group is 0 for anything else */
+static OmniLetrecFn letrec_function(CodeGenContext* ctx, const char* name) {
+    long i = find_symbol(ctx, name);
+    return i >= 0 ? ctx->symbols.letrec[i] : (OmniLetrecFn){ 0, 0, 0 };
+}
 
-    omni_codegen_emit_raw(ctx, "(is_truthy(");
-    codegen_expr(ctx, cond);
-    omni_codegen_emit_raw(ctx, ") ? (");
-    if (then_expr) codegen_expr(ctx, then_expr);
-    else omni_codegen_emit_raw(ctx, "NIL");
-    omni_codegen_emit_raw(ctx, ") : (");
-    if (else_expr) codegen_expr(ctx, else_expr);
-    else omni_codegen_emit_raw(ctx, "NIL");
-    omni_codegen_emit_raw(ctx, "))");
+/* Symbols for the captures of fn's group, slot by slot. Their names have
+ * a space, so no program binds them; each is bound wherever the group's
+ * functions can be called, to the value that slot holds there. Returns
+ * the number of slots. */
+static int group_slots(OmniArena* arena, OmniLetrecFn fn, OmniValue** slots) {
+    for (int i = 0; i < fn.captures; i++) {
+        char name[32];
+        snprintf(name, sizeof(name), " letrec%d %d", fn.group, i);
+        slots[i] = omni_new_sym(arena, name);
+    }
+    return fn.captures;
 }
 
-static void codegen_let(CodeGenContext* ctx, OmniValue* expr) {
-    /* (let ((x val) ...) body) */
-    OmniValue* args = omni_cdr(expr);
-    OmniValue* bindings = omni_car(args);
-    OmniValue* body = omni_cdr(args);
+/* ============== Boxed Variables ============== */
 
-    omni_codegen_emit_raw(ctx, "({\n");
-    omni_codegen_indent(ctx);
+/*
+ * A lambda gets a copy of the locals it uses. When some set! assigns one
+ * of them, the lambda and the code around it must still see the same
+ * variable, so such a local is kept in a box and the lambda copies the
+ * box. Which locals is decided by name over the whole program: a local
+ * is boxed when some lambda uses its name and some set! assigns it.
+ */
 
-    /* Emit bindings */
-    if (omni_is_array(bindings)) {
-        /* Array-style: [x 1 y 2] */
-        for (size_t i = 0; i + 1 < bindings->array.len; i += 2) {
-            OmniValue* name = bindings->array.data[i];
-            OmniValue* val = bindings->array.data[i + 1];
-            if (omni_is_sym(name)) {
-                char* c_name = omni_codegen_mangle(name->str_val);
-                omni_codegen_emit(ctx, "Obj* %s = ", c_name);
-                codegen_expr(ctx, val);
-                omni_codegen_emit_raw(ctx, ";\n");
-                register_symbol(ctx, name->str_val, c_name);
-                free(c_name);
-            }
-        }
-    } else if (omni_is_cell(bindings)) {
-        /* List-style: ((x 1) (y 2)) */
-        while (!omni_is_nil(bindings) && omni_is_cell(bindings)) {
-            OmniValue* binding = omni_car(bindings);
-            if (omni_is_cell(binding)) {
-                OmniValue* name = omni_car(binding);
-                OmniValue* val = omni_car(omni_cdr(binding));
-                if (omni_is_sym(name)) {
-                    char* c_name = omni_codegen_mangle(name->str_val);
-                    omni_codegen_emit(ctx, "Obj* %s = ", c_name);
-                    codegen_expr(ctx, val);
-                    omni_codegen_emit_raw(ctx, ";\n");
-                    register_symbol(ctx, name->str_val, c_name);
-                    free(c_name);
-                }
-            }
-            bindings = omni_cdr(bindings);
+/* Add to *targets the name each (set! name ...) in expr assigns */
+static void collect_set_targets(OmniArena* arena, OmniValue* expr, OmniValue** targets) {
+    if (omni_is_array(expr)) {
+        for (size_t i = 0; i < expr->array.len; i++) collect_set_targets(arena, expr->array.data[i], targets);
+        return;
+    }
+    if (!omni_is_cell(expr) || omni_sym_eq_str(omni_car(expr), "quote")) return;
+    OmniValue* target = omni_car(omni_cdr(expr));
+    if (omni_sym_eq_str(omni_car(expr), "set!") && omni_is_sym(target)) {
+        bool seen = false;
+        for (OmniValue* p = *targets; omni_is_cell(p) && !seen; p = omni_cdr(p)) {
+            seen = omni_sym_eq_str(omni_car(p), target->str_val);
         }
+        if (!seen) *targets = omni_new_cell(arena, target, *targets);
     }
+    for (; omni_is_cell(expr); expr = omni_cdr(expr)) collect_set_targets(arena, omni_car(expr), targets);
+}
 
-    /* Emit body */
-    OmniValue* result = NULL;
-    while (!omni_is_nil(body) && omni_is_cell(body)) {
-        result = omni_car(body);
-        body = omni_cdr(body);
-        if (!omni_is_nil(body)) {
-            omni_codegen_emit(ctx, "");
-            codegen_expr(ctx, result);
-            omni_codegen_emit_raw(ctx, ";\n");
+/* Whether name occurs in a lambda in expr, or anywhere in it when
+ * inside is set */
+static bool used_in_lambda(OmniValue* expr, const char* name, bool inside) {
+    if (omni_is_sym(expr)) return inside && strcmp(expr->str_val, name) == 0;
+    if (omni_is_array(expr)) {
+        for (size_t i = 0; i < expr->array.len; i++) {
+            if (used_in_lambda(expr->array.data[i], name, inside)) return true;
         }
+        return false;
+    }
+    if (!omni_is_cell(expr) || omni_sym_eq_str(omni_car(expr), "quote")) return false;
+    inside = inside || omni_sym_eq_str(omni_car(expr), "lambda") || omni_sym_eq_str(omni_car(expr), "fn");
+    for (; omni_is_cell(expr); expr = omni_cdr(expr)) {
+        if (used_in_lambda(omni_car(expr), name, inside)) return true;
     }
+    return false;
+}
 
-    /* Last expression is the result */
-    if (result) {
-        omni_codegen_emit(ctx, "");
-        codegen_expr(ctx, result);
-        omni_codegen_emit_raw(ctx, ";\n");
+/* Names of the locals to box in exprs, as a list of symbols */
+static OmniValue* boxed_names(OmniArena* arena, OmniValue** exprs, size_t count) {
+    OmniValue* targets = omni_nil;
+    for (size_t i = 0; i < count; i++) collect_set_targets(arena, exprs[i], &targets);
+    OmniValue* boxed = omni_nil;
+    for (OmniValue* p = targets; omni_is_cell(p); p = omni_cdr(p)) {
+        for (size_t i = 0; i < count; i++) {
+            if (used_in_lambda(exprs[i], omni_car(p)->str_val, false)) {
+                boxed = omni_new_cell(arena, omni_car(p), boxed);
+                break;
+            }
+        }
     }
+    return boxed;
+}
 
-    omni_codegen_dedent(ctx);
-    omni_codegen_emit(ctx, "})");
+/* Box the innermost binding of name, a local just declared, if its name
+ * is one of ctx->boxed_names: its C variable then holds the box */
+static void box_binding(CodeGenContext* ctx, const char* name) {
+    long i = find_symbol(ctx, name);
+    if (i < 0) return;
+    for (OmniValue* p = ctx->boxed_names; omni_is_cell(p); p = omni_cdr(p)) {
+        if (omni_sym_eq_str(omni_car(p), name)) {
+            const char* c_name = ctx->symbols.c_names[i];
+            omni_codegen_emit(ctx, "%s = mk_box(%s);\n", c_name, c_name);
+            ctx->symbols.boxed[i] = true;
+            return;
+        }
+    }
 }
 
-static void codegen_lambda(CodeGenContext* ctx, OmniValue* expr) {
-    /* Generate lambda as a static function */
-    int lambda_id = ctx->lambda_counter++;
+/* ============== Runtime Header ============== */
 
-    OmniValue* args = omni_cdr(expr);
-    OmniValue* params = omni_car(args);
-    OmniValue* body = omni_cdr(args);
+/* ============== Embedded Runtime ============== */
 
-    /* Generate lambda function name */
-    char fn_name[64];
-    snprintf(fn_name, sizeof(fn_name), "_lambda_%d", lambda_id);
+/*
+ * The embedded runtime is emitted as a prelude followed by sections.
+ * The prelude carries every include, the core types and prototypes for
+ * the core functions, so sections may reference each other in any order.
+ * Sections are emitted in dependency order; requesting a section pulls in
+ * the sections it depends on.
+ */
 
-    /* Build function definition into a buffer */
-    char def[8192];
-    char* p = def;
-    p += sprintf(p, "static Obj* %s(", fn_name);
-
-    /* Parameters - register them before generating body */
-    bool first = true;
-    OmniValue* param_list = params;
-    if (omni_is_cell(param_list)) {
-        while (!omni_is_nil(param_list) && omni_is_cell(param_list)) {
-            if (!first) p += sprintf(p, ", ");
-            first = false;
-            OmniValue* param = omni_car(param_list);
-            if (omni_is_sym(param)) {
-                char* c_name = omni_codegen_mangle(param->str_val);
-                p += sprintf(p, "Obj* %s", c_name);
-                register_symbol(ctx, param->str_val, c_name);
-                free(c_name);
+static const char* g_runtime_section_names[OMNI_RT_COUNT] = {
+    [OMNI_RT_CORE] = "core",
+    [OMNI_RT_STACK] = "stack",
+    [OMNI_RT_WEAK] = "weak",
+    [OMNI_RT_REUSE] = "reuse",
+    [OMNI_RT_RC_ELISION] = "rc-elision",
+    [OMNI_RT_REGION] = "region",
+    [OMNI_RT_TETHER] = "tether",
+    [OMNI_RT_OWNERSHIP] = "ownership",
+    [OMNI_RT_CONCURRENCY] = "concurrency",
+    [OMNI_RT_PRINT] = "print",
+    [OMNI_RT_PRIMITIVES] = "primitives",
+    [OMNI_RT_ERROR] = "error",
+    [OMNI_RT_LISTS] = "lists",
+    [OMNI_RT_STRINGS] = "strings",
+    [OMNI_RT_VECTORS] = "vectors",
+    [OMNI_RT_HASHES] = "hashes",
+    [OMNI_RT_PERSISTENT] = "persistent",
+    [OMNI_RT_USER_TYPES] = "types",
+    [OMNI_RT_PORTS] = "ports",
+};
+
+/* Sections each section needs besides the prelude */
+static const unsigned g_runtime_section_deps[OMNI_RT_COUNT] = {
+    [OMNI_RT_CORE] = 0,
+    [OMNI_RT_STACK] = OMNI_RT_BIT(OMNI_RT_CORE),
+    [OMNI_RT_WEAK] = OMNI_RT_BIT(OMNI_RT_CORE),
+    [OMNI_RT_REUSE] = OMNI_RT_BIT(OMNI_RT_PRIMITIVES),  /* REUSE_OR_NEW_CELL falls back on prim_cons */
+    [OMNI_RT_RC_ELISION] = OMNI_RT_BIT(OMNI_RT_CORE),
+    [OMNI_RT_REGION] = OMNI_RT_BIT(OMNI_RT_CORE),
+    [OMNI_RT_TETHER] = OMNI_RT_BIT(OMNI_RT_CORE),
+    [OMNI_RT_OWNERSHIP] = OMNI_RT_BIT(OMNI_RT_CORE),
+    [OMNI_RT_CONCURRENCY] = OMNI_RT_BIT(OMNI_RT_CORE),
+    [OMNI_RT_PRINT] = OMNI_RT_BIT(OMNI_RT_CORE),
+    [OMNI_RT_PRIMITIVES] = OMNI_RT_BIT(OMNI_RT_CORE),
+    [OMNI_RT_ERROR] = OMNI_RT_BIT(OMNI_RT_CORE),
+    [OMNI_RT_LISTS] = OMNI_RT_BIT(OMNI_RT_PRIMITIVES),
+    [OMNI_RT_STRINGS] = OMNI_RT_BIT(OMNI_RT_CORE),
+    [OMNI_RT_VECTORS] = OMNI_RT_BIT(OMNI_RT_CORE),
+    [OMNI_RT_HASHES] = OMNI_RT_BIT(OMNI_RT_PRIMITIVES),
+    [OMNI_RT_PERSISTENT] = OMNI_RT_BIT(OMNI_RT_PRIMITIVES) | OMNI_RT_BIT(OMNI_RT_PRINT),
+    [OMNI_RT_USER_TYPES] = OMNI_RT_BIT(OMNI_RT_PRINT),  /* Printers hook into print_obj_to */
+    [OMNI_RT_PORTS] = OMNI_RT_BIT(OMNI_RT_PRINT),
+};
+
+static const char* g_strategy_names[] = {
+    "asap", "perceus", "arena", "deferred", "symmetric", "scc"
+};
+
+const char* omni_strategy_name(OmniStrategy strategy) {
+    for (int i = 0; i < 6; i++) {
+        if ((unsigned)strategy == 1u << i) return g_strategy_names[i];
+    }
+    return "unknown";
+}
+
+unsigned omni_strategy_parse(const char* list) {
+    unsigned mask = OMNI_STRATEGY_ASAP;
+    const char* p = list;
+    while (p && *p) {
+        size_t len = strcspn(p, ",");
+        int found = -1;
+        for (int i = 0; i < 6; i++) {
+            if (strlen(g_strategy_names[i]) == len && strncmp(p, g_strategy_names[i], len) == 0) {
+                found = i;
             }
-            param_list = omni_cdr(param_list);
         }
+        if (found < 0) return 0;
+        mask |= 1u << found;
+        p += len;
+        if (*p == ',') p++;
     }
-    if (first) {
-        p += sprintf(p, "void");
-    }
-    p += sprintf(p, ") {\n");
+    return mask;
+}
 
-    /* Generate body - find last expression for return */
-    OmniValue* result = NULL;
-    OmniValue* body_iter = body;
-    while (!omni_is_nil(body_iter) && omni_is_cell(body_iter)) {
-        result = omni_car(body_iter);
-        body_iter = omni_cdr(body_iter);
+void omni_strategy_format(unsigned mask, char* buf, size_t size) {
+    size_t n = 0;
+    buf[0] = '\0';
+    for (int i = 0; i < 6 && n < size; i++) {
+        if (!(mask & (1u << i))) continue;
+        n += snprintf(buf + n, size - n, "%s%s", n ? "+" : "", g_strategy_names[i]);
     }
+}
 
-    /* Generate body using a temp context to capture output */
-    if (result) {
-        CodeGenContext* tmp = omni_codegen_new_buffer();
-        tmp->indent_level = 1;
-        tmp->lambda_counter = ctx->lambda_counter;
-        /* Copy symbol table */
-        for (size_t i = 0; i < ctx->symbols.count; i++) {
-            register_symbol(tmp, ctx->symbols.names[i], ctx->symbols.c_names[i]);
+static const char* g_memory_mode_names[] = { "default", "asap", "rc", "arena", "all" };
+
+const char* omni_memory_mode_name(OmniMemoryMode mode) {
+    if (mode < OMNI_MEMORY_DEFAULT || mode > OMNI_MEMORY_ALL) return "unknown";
+    return g_memory_mode_names[mode];
+}
+
+bool omni_memory_mode_parse(const char* name, OmniMemoryMode* mode) {
+    for (int i = OMNI_MEMORY_ASAP; i <= OMNI_MEMORY_ALL; i++) {
+        if (strcmp(name, g_memory_mode_names[i]) == 0) {
+            *mode = (OmniMemoryMode)i;
+            return true;
         }
+    }
+    return false;
+}
 
-        omni_codegen_emit(tmp, "return ");
-        codegen_expr(tmp, result);
-        omni_codegen_emit_raw(tmp, ";\n");
+unsigned omni_memory_mode_sections(OmniMemoryMode mode) {
+    switch (mode) {
+    case OMNI_MEMORY_ASAP:
+        return OMNI_RT_BIT(OMNI_RT_STACK);
+    case OMNI_MEMORY_RC:
+        return OMNI_RT_BIT(OMNI_RT_STACK) | OMNI_RT_BIT(OMNI_RT_REUSE) |
+               OMNI_RT_BIT(OMNI_RT_RC_ELISION) | OMNI_RT_BIT(OMNI_RT_WEAK);
+    case OMNI_MEMORY_ARENA:
+        return OMNI_RT_BIT(OMNI_RT_STACK) | OMNI_RT_BIT(OMNI_RT_REGION) | OMNI_RT_BIT(OMNI_RT_TETHER);
+    case OMNI_MEMORY_ALL:
+        return OMNI_RT_ALL;
+    default:
+        return 0;
+    }
+}
 
-        /* Update lambda counter from nested lambdas */
-        ctx->lambda_counter = tmp->lambda_counter;
+const char* omni_runtime_section_name(OmniRuntimeSection section) {
+    if (section < 0 || section >= OMNI_RT_COUNT) return "unknown";
+    return g_runtime_section_names[section];
+}
 
-        /* Copy any nested lambda definitions */
-        for (size_t i = 0; i < tmp->lambda_defs.count; i++) {
-            omni_codegen_add_lambda_def(ctx, tmp->lambda_defs.defs[i]);
+unsigned omni_runtime_section_closure(unsigned mask) {
+    mask |= OMNI_RT_BIT(OMNI_RT_CORE);
+    unsigned prev;
+    do {
+        prev = mask;
+        for (int i = 0; i < OMNI_RT_COUNT; i++) {
+            if (mask & OMNI_RT_BIT(i)) mask |= g_runtime_section_deps[i];
         }
+    } while (mask != prev);
+    return mask;
+}
 
-        char* body_code = omni_codegen_get_output(tmp);
-        if (body_code) {
-            p += sprintf(p, "%s", body_code);
-            free(body_code);
-        }
-        omni_codegen_free(tmp);
+/*
+ * Allocators: every allocation of the embedded runtime goes through the
+ * current PurpleAllocator, "default" until purple_set_allocator picks
+ * another. Blocks start with their size and the allocator that made them,
+ * so each is released by that allocator and counted against it however
+ * often the current one changes. "default" calls purple_malloc and
+ * purple_free: hosted builds define them weakly over libc, so a program
+ * linked with its own (jemalloc, mimalloc, an arena) overrides them, and
+ * freestanding targets supply them. An allocation that the allocator
+ * refuses, or that would take the bytes live in all of them over the heap
+ * limit, goes to omni_out_of_memory (see rt_core) and does not return.
+ */
+static void rt_allocator(CodeGenContext* ctx) {
+    if (ctx->freestanding) {
+        /* One thread */
+        omni_codegen_emit_raw(ctx, "#define OMNI_COUNT(x, n) ((x) += (n))\n");
+        omni_codegen_emit_raw(ctx, "#define OMNI_LOAD(x) (x)\n");
+        omni_codegen_emit_raw(ctx, "#define OMNI_STORE(x, v) ((x) = (v))\n");
+        omni_codegen_emit_raw(ctx, "#define OMNI_ATOMIC_ADD(x, n) ((x) += (n))\n");
     } else {
-        p += sprintf(p, "    return NIL;\n");
+        omni_codegen_emit_raw(ctx, "__attribute__((weak)) void* purple_malloc(size_t size) { return malloc(size); }\n");
+        omni_codegen_emit_raw(ctx, "__attribute__((weak)) void purple_free(void* p) { free(p); }\n");
+        /* For memory libc allocates itself, such as open_memstream buffers */
+        omni_codegen_emit_raw(ctx, "static void omni_libc_free(void* p) { free(p); }\n");
+        omni_codegen_emit_raw(ctx, "#define OMNI_COUNT(x, n) __atomic_add_fetch(&(x), (n), __ATOMIC_RELAXED)\n");
+        omni_codegen_emit_raw(ctx, "#define OMNI_LOAD(x) __atomic_load_n(&(x), __ATOMIC_ACQUIRE)\n");
+        omni_codegen_emit_raw(ctx, "#define OMNI_STORE(x, v) __atomic_store_n(&(x), (v), __ATOMIC_RELEASE)\n");
+        omni_codegen_emit_raw(ctx, "#define OMNI_ATOMIC_ADD(x, n) __atomic_add_fetch(&(x), (n), __ATOMIC_ACQ_REL)\n");
     }
+    omni_codegen_emit_raw(ctx, "typedef struct PurpleAllocator {\n");
+    omni_codegen_emit_raw(ctx, "    const char* name;\n");
+    omni_codegen_emit_raw(ctx, "    void* (*alloc)(size_t size);\n");
+    omni_codegen_emit_raw(ctx, "    void (*release)(void* p);\n");
+    omni_codegen_emit_raw(ctx, "    size_t allocs, frees;  /* Blocks made and released */\n");
+    omni_codegen_emit_raw(ctx, "    size_t live, peak;     /* Bytes in use, now and at most */\n");
+    omni_codegen_emit_raw(ctx, "} PurpleAllocator;\n");
+    omni_codegen_emit_raw(ctx, "int purple_set_allocator(const char* name, void* (*alloc)(size_t size), void (*release)(void* p));\n");
+    omni_codegen_emit_raw(ctx, "const PurpleAllocator* purple_allocators(size_t* count);\n");
+    omni_codegen_emit_raw(ctx, "#define OMNI_ALLOCATORS 8\n");
+    omni_codegen_emit_raw(ctx, "static PurpleAllocator omni_allocators[OMNI_ALLOCATORS] = { { \"default\", purple_malloc, purple_free, 0, 0, 0, 0 } };\n");
+    omni_codegen_emit_raw(ctx, "static size_t omni_allocator_count = 1;\n");
+    omni_codegen_emit_raw(ctx, "static PurpleAllocator* omni_allocator = &omni_allocators[0];\n");
+    omni_codegen_emit(ctx, "static size_t omni_heap_limit = %zu;  /* 0 = none */\n", ctx->heap_limit);
+    omni_codegen_emit_raw(ctx, "static size_t omni_heap_live = 0;\n");
+    omni_codegen_emit_raw(ctx, "void purple_set_heap_limit(size_t bytes) { OMNI_STORE(omni_heap_limit, bytes); }\n\n");
+
+    omni_codegen_emit_raw(ctx, "typedef union { struct { size_t size; PurpleAllocator* owner; } h; long double align; void* p; } OmniBlock;\n");
+    omni_codegen_emit_raw(ctx, "static void omni_raise_peak(PurpleAllocator* a, size_t live) {\n");
+    if (ctx->freestanding) {
+        omni_codegen_emit_raw(ctx, "    if (live > a->peak) a->peak = live;\n");
+    } else {
+        omni_codegen_emit_raw(ctx, "    size_t peak = __atomic_load_n(&a->peak, __ATOMIC_RELAXED);\n");
+        omni_codegen_emit_raw(ctx, "    while (live > peak && !__atomic_compare_exchange_n(&a->peak, &peak, live, true,\n");
+        omni_codegen_emit_raw(ctx, "                                                       __ATOMIC_RELAXED, __ATOMIC_RELAXED)) {}\n");
+    }
+    omni_codegen_emit_raw(ctx, "}\n");
+    /* NULL when the allocator refuses or the limit would be passed */
+    omni_codegen_emit_raw(ctx, "static void* omni_try_malloc(size_t n) {\n");
+    omni_codegen_emit_raw(ctx, "    PurpleAllocator* a = OMNI_LOAD(omni_allocator);\n");
+    omni_codegen_emit_raw(ctx, "    size_t limit = OMNI_LOAD(omni_heap_limit);\n");
+    omni_codegen_emit_raw(ctx, "    if (limit && OMNI_LOAD(omni_heap_live) + n > limit) return NULL;\n");
+    omni_codegen_emit_raw(ctx, "    OmniBlock* b = a->alloc(sizeof(OmniBlock) + n);\n");
+    omni_codegen_emit_raw(ctx, "    if (!b) return NULL;\n");
+    omni_codegen_emit_raw(ctx, "    b->h.size = n; b->h.owner = a;\n");
+    omni_codegen_emit_raw(ctx, "    OMNI_COUNT(a->allocs, 1);\n");
+    omni_codegen_emit_raw(ctx, "    omni_raise_peak(a, OMNI_COUNT(a->live, n));\n");
+    omni_codegen_emit_raw(ctx, "    OMNI_COUNT(omni_heap_live, n);\n");
+    omni_codegen_emit_raw(ctx, "    return b + 1;\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static void omni_out_of_memory(size_t n);\n");
+    omni_codegen_emit_raw(ctx, "static void* omni_malloc(size_t n) {\n");
+    omni_codegen_emit_raw(ctx, "    void* p = omni_try_malloc(n);\n");
+    omni_codegen_emit_raw(ctx, "    if (!p) omni_out_of_memory(n);\n");
+    omni_codegen_emit_raw(ctx, "    return p;\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static void omni_free(void* p) {\n");
+    omni_codegen_emit_raw(ctx, "    if (!p) return;\n");
+    omni_codegen_emit_raw(ctx, "    OmniBlock* b = (OmniBlock*)p - 1;\n");
+    omni_codegen_emit_raw(ctx, "    PurpleAllocator* a = b->h.owner;\n");
+    omni_codegen_emit_raw(ctx, "    OMNI_COUNT(a->frees, 1);\n");
+    omni_codegen_emit_raw(ctx, "    OMNI_COUNT(a->live, -b->h.size);\n");
+    omni_codegen_emit_raw(ctx, "    OMNI_COUNT(omni_heap_live, -b->h.size);\n");
+    omni_codegen_emit_raw(ctx, "    a->release(b);\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static void* omni_calloc(size_t count, size_t n) {\n");
+    omni_codegen_emit_raw(ctx, "    void* p = omni_malloc(count * n);\n");
+    omni_codegen_emit_raw(ctx, "    return p ? memset(p, 0, count * n) : NULL;\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static void* omni_realloc(void* p, size_t n) {\n");
+    omni_codegen_emit_raw(ctx, "    void* q = omni_malloc(n);\n");
+    omni_codegen_emit_raw(ctx, "    if (q && p) {\n");
+    omni_codegen_emit_raw(ctx, "        size_t old = ((OmniBlock*)p - 1)->h.size;\n");
+    omni_codegen_emit_raw(ctx, "        memcpy(q, p, old < n ? old : n);\n");
+    omni_codegen_emit_raw(ctx, "        omni_free(p);\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    return q;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    /* Registers name, or updates it when it exists, and makes it current;
+     * with alloc NULL it only switches to an allocator registered already.
+     * -1 when the table is full or there is nothing named name. */
+    omni_codegen_emit_raw(ctx, "static int omni_same_name(const char* a, const char* b) {\n");
+    omni_codegen_emit_raw(ctx, "    while (*a && *a == *b) a++, b++;\n");
+    omni_codegen_emit_raw(ctx, "    return *a == *b;\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "int purple_set_allocator(const char* name, void* (*alloc)(size_t size), void (*release)(void* p)) {\n");
+    omni_codegen_emit_raw(ctx, "    size_t i = 0;\n");
+    omni_codegen_emit_raw(ctx, "    while (i < omni_allocator_count && !omni_same_name(omni_allocators[i].name, name)) i++;\n");
+    omni_codegen_emit_raw(ctx, "    if (alloc) {\n");
+    omni_codegen_emit_raw(ctx, "        if (i == OMNI_ALLOCATORS) return -1;\n");
+    omni_codegen_emit_raw(ctx, "        if (i == omni_allocator_count) { omni_allocators[i].name = name; omni_allocator_count++; }\n");
+    omni_codegen_emit_raw(ctx, "        omni_allocators[i].alloc = alloc;\n");
+    omni_codegen_emit_raw(ctx, "        omni_allocators[i].release = release;\n");
+    omni_codegen_emit_raw(ctx, "    } else if (i == omni_allocator_count) {\n");
+    omni_codegen_emit_raw(ctx, "        return -1;\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    OMNI_STORE(omni_allocator, &omni_allocators[i]);\n");
+    omni_codegen_emit_raw(ctx, "    return 0;\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "const PurpleAllocator* purple_allocators(size_t* count) {\n");
+    omni_codegen_emit_raw(ctx, "    *count = omni_allocator_count;\n");
+    omni_codegen_emit_raw(ctx, "    return omni_allocators;\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "#define malloc omni_malloc\n");
+    omni_codegen_emit_raw(ctx, "#define calloc omni_calloc\n");
+    omni_codegen_emit_raw(ctx, "#define realloc omni_realloc\n");
+    omni_codegen_emit_raw(ctx, "#define free omni_free\n");
+    if (!ctx->freestanding) {
+        /* Freestanding builds define theirs with the other strings */
+        omni_codegen_emit_raw(ctx, "static char* omni_strdup(const char* s) {\n");
+        omni_codegen_emit_raw(ctx, "    size_t n = strlen(s) + 1;\n");
+        omni_codegen_emit_raw(ctx, "    char* d = omni_malloc(n);\n");
+        omni_codegen_emit_raw(ctx, "    return d ? memcpy(d, s, n) : NULL;\n");
+        omni_codegen_emit_raw(ctx, "}\n");
+        omni_codegen_emit_raw(ctx, "#define strdup omni_strdup\n");
+    }
+    omni_codegen_emit_raw(ctx, "\n");
+}
 
-    p += sprintf(p, "}");
-
-    /* Add to lambda definitions */
-    omni_codegen_add_lambda_def(ctx, def);
+/*
+ * Freestanding: what the runtime takes from libc, for targets without
+ * one. Memory comes from purple_malloc and purple_free and every character
+ * printed goes to purple_putchar, all supplied by the program the code is
+ * linked into, as are memcpy, memmove, memset and memcmp, which any gcc
+ * output may call. Floats use the approximations here, and clock() never
+ * advances, so (ms n) budgets do not expire.
+ */
+static void rt_freestanding(CodeGenContext* ctx) {
+    omni_codegen_emit_raw(ctx, "extern void* purple_malloc(size_t size);\n");
+    omni_codegen_emit_raw(ctx, "extern void purple_free(void* p);\n");
+    omni_codegen_emit_raw(ctx, "extern void purple_putchar(int c);\n");
+    omni_codegen_emit_raw(ctx, "void* memcpy(void* dst, const void* src, size_t n);\n");
+    omni_codegen_emit_raw(ctx, "void* memmove(void* dst, const void* src, size_t n);\n");
+    omni_codegen_emit_raw(ctx, "void* memset(void* dst, int c, size_t n);\n");
+    omni_codegen_emit_raw(ctx, "int memcmp(const void* a, const void* b, size_t n);\n\n");
+
+    rt_allocator(ctx);
+
+    /* Strings */
+    omni_codegen_emit_raw(ctx, "static size_t omni_strlen(const char* s) { size_t n = 0; while (s[n]) n++; return n; }\n");
+    omni_codegen_emit_raw(ctx, "static int omni_strncmp(const char* a, const char* b, size_t n) {\n");
+    omni_codegen_emit_raw(ctx, "    for (; n && *a && *a == *b; n--) a++, b++;\n");
+    omni_codegen_emit_raw(ctx, "    return n ? (unsigned char)*a - (unsigned char)*b : 0;\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static int omni_strcmp(const char* a, const char* b) { return omni_strncmp(a, b, (size_t)-1); }\n");
+    omni_codegen_emit_raw(ctx, "static char* omni_strdup(const char* s) {\n");
+    omni_codegen_emit_raw(ctx, "    size_t n = omni_strlen(s) + 1;\n");
+    omni_codegen_emit_raw(ctx, "    char* d = omni_malloc(n);\n");
+    omni_codegen_emit_raw(ctx, "    return d ? memcpy(d, s, n) : NULL;\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static char* omni_strchr(const char* s, int c) {\n");
+    omni_codegen_emit_raw(ctx, "    for (;; s++) { if (*s == (char)c) return (char*)s; if (!*s) return NULL; }\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static char* omni_strpbrk(const char* s, const char* set) {\n");
+    omni_codegen_emit_raw(ctx, "    for (; *s; s++) if (omni_strchr(set, *s)) return (char*)s;\n");
+    omni_codegen_emit_raw(ctx, "    return NULL;\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "#define strlen omni_strlen\n");
+    omni_codegen_emit_raw(ctx, "#define strncmp omni_strncmp\n");
+    omni_codegen_emit_raw(ctx, "#define strcmp omni_strcmp\n");
+    omni_codegen_emit_raw(ctx, "#define strdup omni_strdup\n");
+    omni_codegen_emit_raw(ctx, "#define strchr omni_strchr\n");
+    omni_codegen_emit_raw(ctx, "#define strpbrk omni_strpbrk\n\n");
+
+    /* Output: stdout and stderr both go to purple_putchar. The only other
+     * streams are open_memstream's, for string ports, which grow a buffer
+     * from omni_malloc. */
+    omni_codegen_emit_raw(ctx, "typedef struct { char** text; size_t* len; size_t cap; } FILE;\n");
+    omni_codegen_emit_raw(ctx, "static FILE omni_out;\n");
+    omni_codegen_emit_raw(ctx, "#define stdout (&omni_out)\n");
+    omni_codegen_emit_raw(ctx, "#define stderr (&omni_out)\n");
+    omni_codegen_emit_raw(ctx, "static int omni_fputc(int c, FILE* f) {\n");
+    omni_codegen_emit_raw(ctx, "    if (!f->text) { purple_putchar((unsigned char)c); return c; }\n");
+    omni_codegen_emit_raw(ctx, "    if (*f->len + 1 >= f->cap) { f->cap = f->cap ? f->cap * 2 : 64; *f->text = omni_realloc(*f->text, f->cap); }\n");
+    omni_codegen_emit_raw(ctx, "    (*f->text)[(*f->len)++] = (char)c;\n");
+    omni_codegen_emit_raw(ctx, "    (*f->text)[*f->len] = '\\0';\n");
+    omni_codegen_emit_raw(ctx, "    return c;\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static size_t omni_fwrite(const void* p, size_t size, size_t n, FILE* f) {\n");
+    omni_codegen_emit_raw(ctx, "    for (size_t i = 0; i < size * n; i++) omni_fputc(((const unsigned char*)p)[i], f);\n");
+    omni_codegen_emit_raw(ctx, "    return n;\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static int omni_fputs(const char* s, FILE* f) { while (*s) omni_fputc(*s++, f); return 0; }\n");
+    omni_codegen_emit_raw(ctx, "static int omni_fflush(FILE* f) { (void)f; return 0; }\n");
+    /* Nothing is buffered, so there is no buffer to change */
+    omni_codegen_emit_raw(ctx, "enum { _IOFBF, _IOLBF, _IONBF };\n");
+    omni_codegen_emit_raw(ctx, "#define BUFSIZ 1024\n");
+    omni_codegen_emit_raw(ctx, "static int omni_setvbuf(FILE* f, char* buf, int mode, size_t n) { (void)f; (void)buf; (void)mode; (void)n; return 0; }\n");
+    omni_codegen_emit_raw(ctx, "static FILE* open_memstream(char** text, size_t* len) {\n");
+    omni_codegen_emit_raw(ctx, "    FILE* f = omni_malloc(sizeof(FILE));\n");
+    omni_codegen_emit_raw(ctx, "    f->text = text; f->len = len; f->cap = 0;\n");
+    omni_codegen_emit_raw(ctx, "    *text = NULL; *len = 0;\n");
+    omni_codegen_emit_raw(ctx, "    return f;\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static int omni_fclose(FILE* f) { omni_free(f); return 0; }\n");
+    omni_codegen_emit_raw(ctx, "static void omni_libc_free(void* p) { omni_free(p); }\n");
+    omni_codegen_emit_raw(ctx, "#define fwrite omni_fwrite\n");
+    omni_codegen_emit_raw(ctx, "#define fputc omni_fputc\n");
+    omni_codegen_emit_raw(ctx, "#define fputs omni_fputs\n");
+    omni_codegen_emit_raw(ctx, "#define fflush omni_fflush\n");
+    omni_codegen_emit_raw(ctx, "#define setvbuf omni_setvbuf\n");
+    omni_codegen_emit_raw(ctx, "#define fclose omni_fclose\n\n");
+
+    /* setjmp that needs no library; longjmp always makes it return 1 */
+    omni_codegen_emit_raw(ctx, "typedef void* jmp_buf[5];\n");
+    omni_codegen_emit_raw(ctx, "#define setjmp(b) __builtin_setjmp(b)\n");
+    omni_codegen_emit_raw(ctx, "#define longjmp(b, v) __builtin_longjmp((b), 1)\n\n");
+
+    /* No clock and one thread */
+    omni_codegen_emit_raw(ctx, "typedef long clock_t;\n");
+    omni_codegen_emit_raw(ctx, "#define CLOCKS_PER_SEC 1000\n");
+    omni_codegen_emit_raw(ctx, "#define clock() ((clock_t)0)\n");
+    omni_codegen_emit_raw(ctx, "#define __thread\n\n");
+
+    /* Floats: floor and fmod are exact; the others are within a few ulps */
+    omni_codegen_emit_raw(ctx, "static double omni_floor(double x) {\n");
+    omni_codegen_emit_raw(ctx, "    if (!(x > -4503599627370496.0 && x < 4503599627370496.0)) return x;  /* whole, inf or nan */\n");
+    omni_codegen_emit_raw(ctx, "    double t = (double)(long long)x;\n");
+    omni_codegen_emit_raw(ctx, "    return t > x ? t - 1 : t;\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static double omni_fmod(double a, double b) {\n");
+    omni_codegen_emit_raw(ctx, "    if (b == 0 || a - a != 0 || b != b) return (a * b) / 0.0 * 0.0;  /* nan */\n");
+    omni_codegen_emit_raw(ctx, "    double m = b < 0 ? -b : b, r = a < 0 ? -a : a;\n");
+    omni_codegen_emit_raw(ctx, "    while (r >= m) {\n");
+    omni_codegen_emit_raw(ctx, "        double d = m;\n");
+    omni_codegen_emit_raw(ctx, "        while (d * 2 <= r) d *= 2;\n");
+    omni_codegen_emit_raw(ctx, "        r -= d;\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    return a < 0 ? -r : r;\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static double omni_scale2(double x, int k) {\n");
+    omni_codegen_emit_raw(ctx, "    for (; k > 0; k--) x *= 2;\n");
+    omni_codegen_emit_raw(ctx, "    for (; k < 0; k++) x /= 2;\n");
+    omni_codegen_emit_raw(ctx, "    return x;\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static double omni_log(double x) {\n");
+    omni_codegen_emit_raw(ctx, "    if (x != x || x < 0) return (x - x) / 0.0 * 0.0;  /* nan */\n");
+    omni_codegen_emit_raw(ctx, "    if (x == 0) return -1.0 / 0.0;\n");
+    omni_codegen_emit_raw(ctx, "    if (x - x != 0) return x;\n");
+    omni_codegen_emit_raw(ctx, "    int k = 0;\n");
+    omni_codegen_emit_raw(ctx, "    while (x > 1.4142135623730951) { x /= 2; k++; }\n");
+    omni_codegen_emit_raw(ctx, "    while (x < 0.7071067811865476) { x *= 2; k--; }\n");
+    /* ln x = 2 atanh((x - 1) / (x + 1)) */
+    omni_codegen_emit_raw(ctx, "    double s = (x - 1) / (x + 1), s2 = s * s, term = s, sum = 0;\n");
+    omni_codegen_emit_raw(ctx, "    for (int i = 1; i < 60 && term != 0; i += 2) { sum += term / i; term *= s2; }\n");
+    omni_codegen_emit_raw(ctx, "    return 2 * sum + k * 0.6931471805599453;\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static double omni_exp(double x) {\n");
+    omni_codegen_emit_raw(ctx, "    if (x != x) return x;\n");
+    omni_codegen_emit_raw(ctx, "    if (x > 709.8) return 1.0 / 0.0;\n");
+    omni_codegen_emit_raw(ctx, "    if (x < -745.2) return 0;\n");
+    omni_codegen_emit_raw(ctx, "    int k = (int)(x / 0.6931471805599453 + (x < 0 ? -0.5 : 0.5));\n");
+    omni_codegen_emit_raw(ctx, "    double r = x - k * 0.6931471805599453, term = 1, sum = 1;\n");
+    omni_codegen_emit_raw(ctx, "    for (int i = 1; i < 30 && term != 0; i++) { term *= r / i; sum += term; }\n");
+    omni_codegen_emit_raw(ctx, "    return omni_scale2(sum, k);\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static double omni_pow(double x, double y) {\n");
+    omni_codegen_emit_raw(ctx, "    if (y == omni_floor(y) && y >= -1e9 && y <= 1e9) {\n");
+    omni_codegen_emit_raw(ctx, "        double r = 1, b = x;\n");
+    omni_codegen_emit_raw(ctx, "        for (long long n = (long long)(y < 0 ? -y : y); n; n >>= 1, b *= b) if (n & 1) r *= b;\n");
+    omni_codegen_emit_raw(ctx, "        return y < 0 ? 1 / r : r;\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    return x == 0 ? (y > 0 ? 0 : 1.0 / 0.0) : omni_exp(y * omni_log(x));\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static double omni_sqrt(double x) {\n");
+    omni_codegen_emit_raw(ctx, "    if (x < 0) return (x - x) / 0.0 * 0.0;  /* nan */\n");
+    omni_codegen_emit_raw(ctx, "    if (x == 0 || x != x || x - x != 0) return x;\n");
+    omni_codegen_emit_raw(ctx, "    double r = omni_exp(omni_log(x) / 2);\n");
+    omni_codegen_emit_raw(ctx, "    for (int i = 0; i < 4; i++) r = (r + x / r) / 2;\n");
+    omni_codegen_emit_raw(ctx, "    return r;\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static double omni_strtod(const char* s, char** end) {\n");
+    omni_codegen_emit_raw(ctx, "    const char* p = s;\n");
+    omni_codegen_emit_raw(ctx, "    double sign = *p == '-' ? -1 : 1, v = 0;\n");
+    omni_codegen_emit_raw(ctx, "    int e = 0;\n");
+    omni_codegen_emit_raw(ctx, "    if (*p == '-' || *p == '+') p++;\n");
+    omni_codegen_emit_raw(ctx, "    for (; *p >= '0' && *p <= '9'; p++) v = v * 10 + (*p - '0');\n");
+    omni_codegen_emit_raw(ctx, "    if (*p == '.') for (p++; *p >= '0' && *p <= '9'; p++, e--) v = v * 10 + (*p - '0');\n");
+    omni_codegen_emit_raw(ctx, "    if (*p == 'e' || *p == 'E') {\n");
+    omni_codegen_emit_raw(ctx, "        int neg = p[1] == '-', x = 0;\n");
+    omni_codegen_emit_raw(ctx, "        p += p[1] == '-' || p[1] == '+' ? 2 : 1;\n");
+    omni_codegen_emit_raw(ctx, "        for (; *p >= '0' && *p <= '9'; p++) x = x < 10000 ? x * 10 + (*p - '0') : x;\n");
+    omni_codegen_emit_raw(ctx, "        e += neg ? -x : x;\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    if (end) *end = (char*)p;\n");
+    omni_codegen_emit_raw(ctx, "    return sign * (e < 0 ? v / omni_pow(10, -e) : v * omni_pow(10, e));\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "#define NAN (0.0 / 0.0)\n");
+    omni_codegen_emit_raw(ctx, "#define floor omni_floor\n");
+    omni_codegen_emit_raw(ctx, "#define fmod omni_fmod\n");
+    omni_codegen_emit_raw(ctx, "#define log10(x) (omni_log(x) / 2.302585092994046)\n");
+    omni_codegen_emit_raw(ctx, "#define pow omni_pow\n");
+    omni_codegen_emit_raw(ctx, "#define sqrt omni_sqrt\n");
+    omni_codegen_emit_raw(ctx, "#define strtod omni_strtod\n\n");
+}
 
-    /* Emit function name at call site */
-    omni_codegen_emit_raw(ctx, "%s", fn_name);
+/*
+ * Minimal I/O: the printf family is replaced by a small formatter that
+ * writes through fwrite, for targets where printf is much of the binary.
+ * Floats may differ from printf in their last digit.
+ */
+static void rt_minimal_io(CodeGenContext* ctx) {
+    omni_codegen_emit_raw(ctx, "#include <stdarg.h>\n\n");
+    omni_codegen_emit_raw(ctx, "typedef struct { FILE* out; char* buf; size_t cap; size_t len; } OmniSink;\n\n");
+    omni_codegen_emit_raw(ctx, "static void omni_putstr(OmniSink* s, const char* text, size_t n) {\n");
+    omni_codegen_emit_raw(ctx, "    if (s->out) { fwrite(text, 1, n, s->out); s->len += n; return; }\n");
+    omni_codegen_emit_raw(ctx, "    for (size_t i = 0; i < n; i++, s->len++) {\n");
+    omni_codegen_emit_raw(ctx, "        if (s->len + 1 < s->cap) s->buf[s->len] = text[i];\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+    omni_codegen_emit_raw(ctx, "static size_t omni_format_uint(char* buf, unsigned long long v, unsigned base) {\n");
+    omni_codegen_emit_raw(ctx, "    char digits[24];\n");
+    omni_codegen_emit_raw(ctx, "    size_t n = 0;\n");
+    omni_codegen_emit_raw(ctx, "    do { digits[n++] = \"0123456789abcdef\"[v %% base]; v /= base; } while (v);\n");
+    omni_codegen_emit_raw(ctx, "    for (size_t i = 0; i < n; i++) buf[i] = digits[n - 1 - i];\n");
+    omni_codegen_emit_raw(ctx, "    return n;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+    /* %.*g: prec significant digits, trailing zeros dropped */
+    omni_codegen_emit_raw(ctx, "static size_t omni_format_g(char* buf, double v, int prec) {\n");
+    omni_codegen_emit_raw(ctx, "    size_t n = 0;\n");
+    omni_codegen_emit_raw(ctx, "    if (prec < 1) prec = 1;\n");
+    omni_codegen_emit_raw(ctx, "    if (prec > 17) prec = 17;\n");
+    omni_codegen_emit_raw(ctx, "    if (v < 0 || (v == 0 && 1 / v < 0)) { buf[n++] = '-'; v = -v; }\n");
+    omni_codegen_emit_raw(ctx, "    if (v == 0) { buf[n++] = '0'; return n; }\n");
+    omni_codegen_emit_raw(ctx, "    int e = (int)floor(log10(v));\n");
+    omni_codegen_emit_raw(ctx, "    int shift = prec - 1 - e;\n");
+    omni_codegen_emit_raw(ctx, "    double scaled = v * pow(10, shift / 2) * pow(10, shift - shift / 2);\n");
+    omni_codegen_emit_raw(ctx, "    unsigned long long m = (unsigned long long)(scaled + 0.5);\n");
+    omni_codegen_emit_raw(ctx, "    unsigned long long top = 1;\n");
+    omni_codegen_emit_raw(ctx, "    for (int i = 0; i < prec; i++) top *= 10;\n");
+    omni_codegen_emit_raw(ctx, "    if (m >= top) { m /= 10; e++; }\n");
+    omni_codegen_emit_raw(ctx, "    if (m < top / 10) { m *= 10; e--; }\n");
+    omni_codegen_emit_raw(ctx, "    char d[24];\n");
+    omni_codegen_emit_raw(ctx, "    omni_format_uint(d, m, 10);\n");
+    omni_codegen_emit_raw(ctx, "    int last = prec - 1;\n");
+    omni_codegen_emit_raw(ctx, "    while (last > 0 && d[last] == '0') last--;\n");
+    omni_codegen_emit_raw(ctx, "    if (e < -4 || e >= prec) {\n");
+    omni_codegen_emit_raw(ctx, "        buf[n++] = d[0];\n");
+    omni_codegen_emit_raw(ctx, "        if (last > 0) { buf[n++] = '.'; for (int i = 1; i <= last; i++) buf[n++] = d[i]; }\n");
+    omni_codegen_emit_raw(ctx, "        buf[n++] = 'e';\n");
+    omni_codegen_emit_raw(ctx, "        buf[n++] = e < 0 ? '-' : '+';\n");
+    omni_codegen_emit_raw(ctx, "        if (e < 0) e = -e;\n");
+    omni_codegen_emit_raw(ctx, "        if (e < 10) buf[n++] = '0';\n");
+    omni_codegen_emit_raw(ctx, "        n += omni_format_uint(buf + n, (unsigned long long)e, 10);\n");
+    omni_codegen_emit_raw(ctx, "    } else if (e >= 0) {\n");
+    omni_codegen_emit_raw(ctx, "        for (int i = 0; i <= e; i++) buf[n++] = d[i];\n");
+    omni_codegen_emit_raw(ctx, "        if (last > e) { buf[n++] = '.'; for (int i = e + 1; i <= last; i++) buf[n++] = d[i]; }\n");
+    omni_codegen_emit_raw(ctx, "    } else {\n");
+    omni_codegen_emit_raw(ctx, "        buf[n++] = '0'; buf[n++] = '.';\n");
+    omni_codegen_emit_raw(ctx, "        for (int i = -1; i > e; i--) buf[n++] = '0';\n");
+    omni_codegen_emit_raw(ctx, "        for (int i = 0; i <= last; i++) buf[n++] = d[i];\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    return n;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+    /* Conversions d i u x c s p g %, with 0, a width, a precision and l ll z */
+    omni_codegen_emit_raw(ctx, "static int omni_vformat(OmniSink* s, const char* fmt, va_list ap) {\n");
+    omni_codegen_emit_raw(ctx, "    while (*fmt) {\n");
+    omni_codegen_emit_raw(ctx, "        const char* run = fmt;\n");
+    omni_codegen_emit_raw(ctx, "        while (*fmt && *fmt != '%%') fmt++;\n");
+    omni_codegen_emit_raw(ctx, "        omni_putstr(s, run, (size_t)(fmt - run));\n");
+    omni_codegen_emit_raw(ctx, "        if (!*fmt++) break;\n");
+    omni_codegen_emit_raw(ctx, "        char pad = ' ';\n");
+    omni_codegen_emit_raw(ctx, "        int width = 0, prec = -1, size = 0;\n");
+    omni_codegen_emit_raw(ctx, "        if (*fmt == '0') { pad = '0'; fmt++; }\n");
+    omni_codegen_emit_raw(ctx, "        while (*fmt >= '0' && *fmt <= '9') width = width * 10 + *fmt++ - '0';\n");
+    omni_codegen_emit_raw(ctx, "        if (*fmt == '.') {\n");
+    omni_codegen_emit_raw(ctx, "            fmt++;\n");
+    omni_codegen_emit_raw(ctx, "            prec = 0;\n");
+    omni_codegen_emit_raw(ctx, "            if (*fmt == '*') { prec = va_arg(ap, int); fmt++; }\n");
+    omni_codegen_emit_raw(ctx, "            while (*fmt >= '0' && *fmt <= '9') prec = prec * 10 + *fmt++ - '0';\n");
+    omni_codegen_emit_raw(ctx, "        }\n");
+    omni_codegen_emit_raw(ctx, "        for (; *fmt == 'l' || *fmt == 'z'; fmt++) size = *fmt == 'z' ? 3 : size + 1;\n");
+    omni_codegen_emit_raw(ctx, "        char tmp[64];\n");
+    omni_codegen_emit_raw(ctx, "        const char* text = tmp;\n");
+    omni_codegen_emit_raw(ctx, "        size_t n = 0;\n");
+    omni_codegen_emit_raw(ctx, "        switch (*fmt) {\n");
+    omni_codegen_emit_raw(ctx, "        case 'd': case 'i': {\n");
+    omni_codegen_emit_raw(ctx, "            long long v = size == 2 ? va_arg(ap, long long) : size == 3 ? (long long)va_arg(ap, size_t)\n");
+    omni_codegen_emit_raw(ctx, "                        : size == 1 ? va_arg(ap, long) : va_arg(ap, int);\n");
+    omni_codegen_emit_raw(ctx, "            if (v < 0) tmp[n++] = '-';\n");
+    omni_codegen_emit_raw(ctx, "            n += omni_format_uint(tmp + n, v < 0 ? 0ULL - (unsigned long long)v : (unsigned long long)v, 10);\n");
+    omni_codegen_emit_raw(ctx, "            break;\n");
+    omni_codegen_emit_raw(ctx, "        }\n");
+    omni_codegen_emit_raw(ctx, "        case 'u': case 'x': {\n");
+    omni_codegen_emit_raw(ctx, "            unsigned long long v = size == 2 ? va_arg(ap, unsigned long long) : size == 3 ? va_arg(ap, size_t)\n");
+    omni_codegen_emit_raw(ctx, "                                 : size == 1 ? va_arg(ap, unsigned long) : va_arg(ap, unsigned);\n");
+    omni_codegen_emit_raw(ctx, "            n = omni_format_uint(tmp, v, *fmt == 'x' ? 16 : 10);\n");
+    omni_codegen_emit_raw(ctx, "            break;\n");
+    omni_codegen_emit_raw(ctx, "        }\n");
+    omni_codegen_emit_raw(ctx, "        case 'p':\n");
+    omni_codegen_emit_raw(ctx, "            tmp[0] = '0'; tmp[1] = 'x';\n");
+    omni_codegen_emit_raw(ctx, "            n = 2 + omni_format_uint(tmp + 2, (unsigned long long)(uintptr_t)va_arg(ap, void*), 16);\n");
+    omni_codegen_emit_raw(ctx, "            break;\n");
+    omni_codegen_emit_raw(ctx, "        case 'c': tmp[n++] = (char)va_arg(ap, int); break;\n");
+    omni_codegen_emit_raw(ctx, "        case 's':\n");
+    omni_codegen_emit_raw(ctx, "            text = va_arg(ap, const char*);\n");
+    omni_codegen_emit_raw(ctx, "            if (!text) text = \"(null)\";\n");
+    omni_codegen_emit_raw(ctx, "            n = strlen(text);\n");
+    omni_codegen_emit_raw(ctx, "            if (prec >= 0 && n > (size_t)prec) n = (size_t)prec;\n");
+    omni_codegen_emit_raw(ctx, "            break;\n");
+    omni_codegen_emit_raw(ctx, "        case 'g': n = omni_format_g(tmp, va_arg(ap, double), prec < 0 ? 6 : prec); break;\n");
+    omni_codegen_emit_raw(ctx, "        default: tmp[n++] = *fmt ? *fmt : '%%'; break;\n");
+    omni_codegen_emit_raw(ctx, "        }\n");
+    omni_codegen_emit_raw(ctx, "        if (*fmt) fmt++;\n");
+    omni_codegen_emit_raw(ctx, "        for (; width > (int)n; width--) omni_putstr(s, &pad, 1);\n");
+    omni_codegen_emit_raw(ctx, "        omni_putstr(s, text, n);\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    return (int)s->len;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+    omni_codegen_emit_raw(ctx, "static int omni_fprintf(FILE* out, const char* fmt, ...) {\n");
+    omni_codegen_emit_raw(ctx, "    OmniSink s = { out, NULL, 0, 0 };\n");
+    omni_codegen_emit_raw(ctx, "    va_list ap;\n");
+    omni_codegen_emit_raw(ctx, "    va_start(ap, fmt);\n");
+    omni_codegen_emit_raw(ctx, "    int n = omni_vformat(&s, fmt, ap);\n");
+    omni_codegen_emit_raw(ctx, "    va_end(ap);\n");
+    omni_codegen_emit_raw(ctx, "    return n;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+    omni_codegen_emit_raw(ctx, "static int omni_snprintf(char* buf, size_t cap, const char* fmt, ...) {\n");
+    omni_codegen_emit_raw(ctx, "    OmniSink s = { NULL, buf, cap, 0 };\n");
+    omni_codegen_emit_raw(ctx, "    va_list ap;\n");
+    omni_codegen_emit_raw(ctx, "    va_start(ap, fmt);\n");
+    omni_codegen_emit_raw(ctx, "    int n = omni_vformat(&s, fmt, ap);\n");
+    omni_codegen_emit_raw(ctx, "    va_end(ap);\n");
+    omni_codegen_emit_raw(ctx, "    if (cap > 0) buf[s.len < cap ? s.len : cap - 1] = '\\0';\n");
+    omni_codegen_emit_raw(ctx, "    return n;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+    omni_codegen_emit_raw(ctx, "#define printf(...) omni_fprintf(stdout, __VA_ARGS__)\n");
+    omni_codegen_emit_raw(ctx, "#define fprintf omni_fprintf\n");
+    omni_codegen_emit_raw(ctx, "#define snprintf omni_snprintf\n\n");
 }
 
-static void codegen_define(CodeGenContext* ctx, OmniValue* expr) {
-    OmniValue* args = omni_cdr(expr);
-    OmniValue* name_or_sig = omni_car(args);
+static void rt_prelude(CodeGenContext* ctx) {
+    /* Includes: every section's needs, in one place */
+    if (ctx->freestanding) {
+        /* Only the headers a freestanding compiler has */
+        omni_codegen_emit_raw(ctx, "#include <stddef.h>\n");
+        omni_codegen_emit_raw(ctx, "#include <stdint.h>\n");
+        omni_codegen_emit_raw(ctx, "#include <stdbool.h>\n\n");
+        rt_freestanding(ctx);
+    } else {
+        omni_codegen_emit_raw(ctx, "#define _POSIX_C_SOURCE 200809L\n");
+        omni_codegen_emit_raw(ctx, "#include <stdio.h>\n");
+        omni_codegen_emit_raw(ctx, "#include <stdlib.h>\n");
+        omni_codegen_emit_raw(ctx, "#include <string.h>\n");
+        omni_codegen_emit_raw(ctx, "#include <stdint.h>\n");
+        omni_codegen_emit_raw(ctx, "#include <stdbool.h>\n");
+        omni_codegen_emit_raw(ctx, "#include <limits.h>\n");
+        omni_codegen_emit_raw(ctx, "#include <math.h>\n");
+        omni_codegen_emit_raw(ctx, "#include <setjmp.h>\n");
+        omni_codegen_emit_raw(ctx, "#include <time.h>\n");
+        omni_codegen_emit_raw(ctx, "#include <sched.h>\n");
+        omni_codegen_emit_raw(ctx, "#include <pthread.h>\n");
+        omni_codegen_emit_raw(ctx, "#include <unistd.h>\n");
+        omni_codegen_emit_raw(ctx, "#include <sys/socket.h>\n");
+        omni_codegen_emit_raw(ctx, "#include <netdb.h>\n");
+        if (ctx->crash_handler) omni_codegen_emit_raw(ctx, "#include <signal.h>\n");
+        omni_codegen_emit_raw(ctx, "\n");
+        rt_allocator(ctx);
+    }
+    if (ctx->minimal_io || ctx->freestanding) rt_minimal_io(ctx);
+
+    /* Value type */
+    omni_codegen_emit_raw(ctx, "typedef enum {\n");
+    omni_codegen_emit_raw(ctx, "    T_INT, T_FLOAT, T_SYM, T_CELL, T_NIL, T_PRIM, T_LAMBDA, T_CODE, T_ERROR, T_CHAR, T_STRING, T_VECTOR, T_HASH, T_CANCEL, T_PROMISE, T_BOX, T_USER, T_PORT, T_PMAP, T_PVEC, T_POOL, T_KEYWORD\n");
+    omni_codegen_emit_raw(ctx, "} Tag;\n\n");
+
+    omni_codegen_emit_raw(ctx, "struct Obj;\n");
+    omni_codegen_emit_raw(ctx, "struct HashTable;\n");
+    omni_codegen_emit_raw(ctx, "struct Promise;\n");
+    omni_codegen_emit_raw(ctx, "struct WorkerPool;\n");
+    omni_codegen_emit_raw(ctx, "struct PColl;\n");
+    omni_codegen_emit_raw(ctx, "struct OmniPort;\n");
+    /* A deftype, described by a static UserType the program defines */
+    omni_codegen_emit_raw(ctx, "typedef struct UserType {\n");
+    omni_codegen_emit_raw(ctx, "    const char* name;\n");
+    omni_codegen_emit_raw(ctx, "    int field_count;\n");
+    omni_codegen_emit_raw(ctx, "    const char* const* fields;\n");
+    omni_codegen_emit_raw(ctx, "    uint64_t weak;  /* Bit i: field i is weak, neither counted nor released */\n");
+    omni_codegen_emit_raw(ctx, "    const char* sum;  /* The sum type a variant belongs to, or NULL */\n");
+    omni_codegen_emit_raw(ctx, "    int tag;          /* The variant's place among the sum's */\n");
+    omni_codegen_emit_raw(ctx, "} UserType;\n");
+    omni_codegen_emit_raw(ctx, "typedef struct Obj* (*PrimFn)(struct Obj*, struct Obj*);\n");
+    omni_codegen_emit_raw(ctx, "typedef struct Obj* (*ClosureFn)(struct Obj** captures, struct Obj** args, int argc);\n\n");
+
+    omni_codegen_emit_raw(ctx, "typedef struct Obj {\n");
+    omni_codegen_emit_raw(ctx, "    Tag tag;\n");
+    omni_codegen_emit_raw(ctx, "    int rc;  /* Reference count */\n");
+    omni_codegen_emit_raw(ctx, "    union {\n");
+    omni_codegen_emit_raw(ctx, "        int64_t i;\n");
+    omni_codegen_emit_raw(ctx, "        double f;\n");
+    omni_codegen_emit_raw(ctx, "        char* s;\n");
+    omni_codegen_emit_raw(ctx, "        struct { struct Obj* car; struct Obj* cdr; } cell;\n");
+    omni_codegen_emit_raw(ctx, "        PrimFn prim;\n");
+    omni_codegen_emit_raw(ctx, "        struct { struct Obj* params; struct Obj* body; struct Obj* env; } lam;\n");
+    omni_codegen_emit_raw(ctx, "        struct { char* msg; struct Obj* data; struct Obj* tag; struct Obj* trace; } err;\n");
+    omni_codegen_emit_raw(ctx, "        struct { ClosureFn fn; int arity; const char* name; struct Obj** captures; int count; } code;\n");
+    omni_codegen_emit_raw(ctx, "        struct { struct Obj** items; int64_t len; } vec;\n");
+    omni_codegen_emit_raw(ctx, "        struct HashTable* hash;\n");
+    omni_codegen_emit_raw(ctx, "        struct Promise* promise;\n");
+    omni_codegen_emit_raw(ctx, "        struct WorkerPool* pool;  /* See rt_concurrency */\n");
+    omni_codegen_emit_raw(ctx, "        struct Obj* box;\n");
+    omni_codegen_emit_raw(ctx, "        struct { const UserType* type; struct Obj** fields; } user;\n");
+    omni_codegen_emit_raw(ctx, "        struct OmniPort* port;  /* See rt_print */\n");
+    omni_codegen_emit_raw(ctx, "        struct PColl* pcoll;  /* A persistent map or vector */\n");
+    omni_codegen_emit_raw(ctx, "    };\n");
+    omni_codegen_emit_raw(ctx, "} Obj;\n\n");
+
+    /* Hash tables: chained buckets plus a list in insertion order */
+    omni_codegen_emit_raw(ctx, "typedef struct HashNode {\n");
+    omni_codegen_emit_raw(ctx, "    Obj* key; Obj* value; uint64_t code;\n");
+    omni_codegen_emit_raw(ctx, "    struct HashNode* chain;  /* Next in the bucket */\n");
+    omni_codegen_emit_raw(ctx, "    struct HashNode* prev; struct HashNode* next;  /* Insertion order */\n");
+    omni_codegen_emit_raw(ctx, "} HashNode;\n");
+    omni_codegen_emit_raw(ctx, "typedef struct HashTable {\n");
+    omni_codegen_emit_raw(ctx, "    HashNode** buckets; size_t bucket_count; size_t count;\n");
+    omni_codegen_emit_raw(ctx, "    HashNode* first; HashNode* last;\n");
+    omni_codegen_emit_raw(ctx, "} HashTable;\n\n");
+
+    /* Nil singleton */
+    omni_codegen_emit_raw(ctx, "static Obj _nil = { .tag = T_NIL, .rc = 1 };\n");
+    omni_codegen_emit_raw(ctx, "#define NIL (&_nil)\n\n");
+
+    /* Accessors */
+    omni_codegen_emit_raw(ctx, "#define car(o) ((o)->cell.car)\n");
+    omni_codegen_emit_raw(ctx, "#define cdr(o) ((o)->cell.cdr)\n");
+    omni_codegen_emit_raw(ctx, "#define is_nil(o) ((o) == NIL || (o)->tag == T_NIL)\n\n");
+
+    /* Core prototypes (defined in the core section) */
+    omni_codegen_emit_raw(ctx, "static Obj* mk_int(int64_t i);\n");
+    omni_codegen_emit_raw(ctx, "static Obj* mk_float(double f);\n");
+    omni_codegen_emit_raw(ctx, "static Obj* mk_char(int64_t c);\n");
+    omni_codegen_emit_raw(ctx, "static Obj* mk_sym(const char* s);\n");
+    omni_codegen_emit_raw(ctx, "static Obj* mk_string(const char* s);\n");
+    omni_codegen_emit_raw(ctx, "static Obj* mk_cell(Obj* car, Obj* cdr);\n");
+    omni_codegen_emit_raw(ctx, "static Obj* mk_error(const char* msg);\n");
+    omni_codegen_emit_raw(ctx, "static Obj* mk_error_obj(const char* msg, Obj* data);\n");
+    omni_codegen_emit_raw(ctx, "static Obj* omni_error_trace(void);\n");
+    omni_codegen_emit_raw(ctx, "static Obj* mk_code(ClosureFn fn, int arity, const char* name);\n");
+    omni_codegen_emit_raw(ctx, "static Obj* mk_closure_code(ClosureFn fn, int arity, Obj** captures, int count);\n");
+    omni_codegen_emit_raw(ctx, "static Obj* mk_box(Obj* v);\n");
+    omni_codegen_emit_raw(ctx, "static Obj* box_get(Obj* b);\n");
+    omni_codegen_emit_raw(ctx, "static void box_set(Obj* b, Obj* v);\n");
+    omni_codegen_emit_raw(ctx, "static void inc_ref(Obj* o);\n");
+    omni_codegen_emit_raw(ctx, "static void dec_ref(Obj* o);\n");
+    omni_codegen_emit_raw(ctx, "static void free_obj(Obj* o);\n");
+    omni_codegen_emit_raw(ctx, "static void free_tree(Obj* o);\n");
+    omni_codegen_emit_raw(ctx, "static void free_unique(Obj* o);\n\n");
+}
+
+/*
+ * Crash reports for -g builds: each compiled function pushes its name on
+ * a per-thread shadow stack, and the last OMNI_RC_RING reference count
+ * changes are kept with the object's tag and count before the change. On
+ * a fatal signal both go to stderr with each allocator's totals, and the
+ * signal is raised again with its default action. Builds without -g log
+ * nothing.
+ */
+static void rt_crash_report(CodeGenContext* ctx) {
+    omni_codegen_emit_raw(ctx, "/* Crash reports */\n");
+    omni_codegen_emit_raw(ctx, "#define OMNI_SHADOW_DEPTH 256\n");
+    omni_codegen_emit_raw(ctx, "static __thread const char* omni_shadow[OMNI_SHADOW_DEPTH];\n");
+    omni_codegen_emit_raw(ctx, "static __thread int omni_shadow_depth = 0;\n");
+    omni_codegen_emit_raw(ctx, "static void purple_enter(const char* fn) {\n");
+    omni_codegen_emit_raw(ctx, "    if (omni_shadow_depth < OMNI_SHADOW_DEPTH) omni_shadow[omni_shadow_depth] = fn;\n");
+    omni_codegen_emit_raw(ctx, "    omni_shadow_depth++;\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static Obj* purple_leave(Obj* result) { if (omni_shadow_depth > 0) omni_shadow_depth--; return result; }\n");
+    omni_codegen_emit_raw(ctx, "static int purple_shadow_depth(void) { return omni_shadow_depth; }\n");
+    omni_codegen_emit_raw(ctx, "static void purple_shadow_restore(int depth) { omni_shadow_depth = depth; }\n");
+    /* An error's trace: the stack as a list of names, innermost first */
+    omni_codegen_emit_raw(ctx, "static Obj* omni_error_trace(void) {\n");
+    omni_codegen_emit_raw(ctx, "    Obj* trace = NIL;\n");
+    omni_codegen_emit_raw(ctx, "    int depth = omni_shadow_depth < OMNI_SHADOW_DEPTH ? omni_shadow_depth : OMNI_SHADOW_DEPTH;\n");
+    omni_codegen_emit_raw(ctx, "    for (int i = 0; i < depth; i++) trace = mk_cell(mk_sym(omni_shadow[i]), trace);\n");
+    omni_codegen_emit_raw(ctx, "    return trace;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    omni_codegen_emit_raw(ctx, "#define OMNI_RC_RING 32\n");
+    omni_codegen_emit_raw(ctx, "typedef struct { const char* op; Obj* obj; int tag; int rc; } OmniRcOp;\n");
+    omni_codegen_emit_raw(ctx, "static OmniRcOp omni_rc_ring[OMNI_RC_RING];\n");
+    omni_codegen_emit_raw(ctx, "static unsigned long omni_rc_ops = 0;\n");
+    omni_codegen_emit_raw(ctx, "static void omni_rc_log(const char* op, Obj* o) {\n");
+    omni_codegen_emit_raw(ctx, "    OmniRcOp* r = &omni_rc_ring[(OMNI_COUNT(omni_rc_ops, 1) - 1) %% OMNI_RC_RING];\n");
+    omni_codegen_emit_raw(ctx, "    r->op = op; r->obj = o; r->tag = o->tag; r->rc = o->rc;\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "#define OMNI_RC_LOG(op, o) omni_rc_log(op, o)\n\n");
+
+    omni_codegen_emit_raw(ctx, "static const char* omni_tag_names[] = {\n");
+    omni_codegen_emit_raw(ctx, "    \"int\", \"float\", \"symbol\", \"pair\", \"nil\", \"primitive\", \"lambda\", \"closure\", \"error\", \"char\",\n");
+    omni_codegen_emit_raw(ctx, "    \"string\", \"vector\", \"hash\", \"cancel\", \"promise\", \"box\", \"user\", \"port\", \"pmap\", \"pvec\", \"pool\", \"keyword\"\n");
+    omni_codegen_emit_raw(ctx, "};\n");
+    omni_codegen_emit_raw(ctx, "#define OMNI_SAY(...) do { \\\n");
+    omni_codegen_emit_raw(ctx, "    char line_[160]; \\\n");
+    omni_codegen_emit_raw(ctx, "    int n_ = snprintf(line_, sizeof(line_), __VA_ARGS__); \\\n");
+    omni_codegen_emit_raw(ctx, "    if (n_ > 0 && write(2, line_, n_ < (int)sizeof(line_) ? (size_t)n_ : sizeof(line_) - 1) < 0) {} \\\n");
+    omni_codegen_emit_raw(ctx, "} while (0)\n");
+    omni_codegen_emit_raw(ctx, "static void omni_crash(int sig) {\n");
+    omni_codegen_emit_raw(ctx, "    const char* what = sig == SIGSEGV ? \"segmentation fault\" : sig == SIGBUS ? \"bus error\" :\n");
+    omni_codegen_emit_raw(ctx, "                       sig == SIGFPE ? \"arithmetic exception\" : sig == SIGILL ? \"illegal instruction\" : \"abort\";\n");
+    omni_codegen_emit_raw(ctx, "    OMNI_SAY(\"purple: crashed with %%s\\n\", what);\n");
+    omni_codegen_emit_raw(ctx, "    OMNI_SAY(\"function stack, innermost first:\\n\");\n");
+    omni_codegen_emit_raw(ctx, "    if (omni_shadow_depth == 0) OMNI_SAY(\"  (no compiled function running)\\n\");\n");
+    omni_codegen_emit_raw(ctx, "    if (omni_shadow_depth > OMNI_SHADOW_DEPTH) OMNI_SAY(\"  ... %%d frames too deep to keep\\n\", omni_shadow_depth - OMNI_SHADOW_DEPTH);\n");
+    omni_codegen_emit_raw(ctx, "    for (int i = omni_shadow_depth < OMNI_SHADOW_DEPTH ? omni_shadow_depth : OMNI_SHADOW_DEPTH; i-- > 0;) OMNI_SAY(\"  %%s\\n\", omni_shadow[i]);\n");
+    omni_codegen_emit_raw(ctx, "    unsigned long ops = omni_rc_ops;\n");
+    omni_codegen_emit_raw(ctx, "    OMNI_SAY(\"last reference count changes, oldest first:\\n\");\n");
+    omni_codegen_emit_raw(ctx, "    if (ops == 0) OMNI_SAY(\"  (none)\\n\");\n");
+    omni_codegen_emit_raw(ctx, "    for (unsigned long i = ops > OMNI_RC_RING ? ops - OMNI_RC_RING : 0; i < ops; i++) {\n");
+    omni_codegen_emit_raw(ctx, "        OmniRcOp* r = &omni_rc_ring[i %% OMNI_RC_RING];\n");
+    omni_codegen_emit_raw(ctx, "        unsigned tag = (unsigned)r->tag;\n");
+    omni_codegen_emit_raw(ctx, "        OMNI_SAY(\"  %%s %%p (%%s, count %%d)\\n\", r->op, (void*)r->obj,\n");
+    omni_codegen_emit_raw(ctx, "                 tag < sizeof(omni_tag_names) / sizeof(omni_tag_names[0]) ? omni_tag_names[tag] : \"freed\", r->rc);\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    OMNI_SAY(\"heap:\\n\");\n");
+    omni_codegen_emit_raw(ctx, "    for (size_t i = 0; i < omni_allocator_count; i++) {\n");
+    omni_codegen_emit_raw(ctx, "        PurpleAllocator* a = &omni_allocators[i];\n");
+    omni_codegen_emit_raw(ctx, "        OMNI_SAY(\"  %%s: %%zu allocs, %%zu frees, %%zu bytes live, %%zu at peak\\n\", a->name, a->allocs, a->frees, a->live, a->peak);\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    signal(sig, SIG_DFL);\n");
+    omni_codegen_emit_raw(ctx, "    raise(sig);\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static void purple_install_crash_handler(void) {\n");
+    omni_codegen_emit_raw(ctx, "    static const int signals[] = { SIGSEGV, SIGBUS, SIGFPE, SIGILL, SIGABRT };\n");
+    omni_codegen_emit_raw(ctx, "    struct sigaction sa;\n");
+    omni_codegen_emit_raw(ctx, "    memset(&sa, 0, sizeof(sa));\n");
+    omni_codegen_emit_raw(ctx, "    sa.sa_handler = omni_crash;\n");
+    omni_codegen_emit_raw(ctx, "    sigemptyset(&sa.sa_mask);\n");
+    omni_codegen_emit_raw(ctx, "    for (size_t i = 0; i < sizeof(signals) / sizeof(signals[0]); i++) sigaction(signals[i], &sa, NULL);\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+}
+
+static void rt_core(CodeGenContext* ctx) {
+    /* Allocation budgets for with-budget: a per-thread stack of frames,
+     * charged by every heap constructor. Exceeding a frame unwinds to
+     * its setjmp; the outermost exceeded frame wins. catch-oom frames
+     * are unlimited budgets that running out of memory unwinds to. */
+    omni_codegen_emit_raw(ctx, "typedef struct OmniBudget {\n");
+    omni_codegen_emit_raw(ctx, "    jmp_buf jump; long allocs_left; clock_t deadline;\n");
+    omni_codegen_emit_raw(ctx, "    const char* exceeded; struct OmniBudget* outer;\n");
+    omni_codegen_emit_raw(ctx, "    bool catches_oom; size_t wanted;\n");
+    omni_codegen_emit_raw(ctx, "    struct Obj* output;  /* The current output port when it began */\n");
+    omni_codegen_emit_raw(ctx, "} OmniBudget;\n");
+    /* with-output-to-port's port on this thread; NULL for standard output.
+     * Frames that unwinding lands in put back the one they began with. */
+    omni_codegen_emit_raw(ctx, "static __thread struct Obj* g_output = NULL;\n");
+    omni_codegen_emit_raw(ctx, "static __thread OmniBudget* g_budget = NULL;\n");
+    omni_codegen_emit_raw(ctx, "static __thread unsigned g_budget_ticks = 0;\n");
+    /* Installed by the concurrency section on threads that use nurseries */
+    omni_codegen_emit_raw(ctx, "static __thread void (*g_safe_point)(void) = NULL;\n");
+    omni_codegen_emit_raw(ctx, "static __thread void (*g_budget_jump)(OmniBudget* hit) = NULL;\n\n");
+
+    omni_codegen_emit_raw(ctx, "static void omni_budget_enter(OmniBudget* b, long allocs, long ms) {\n");
+    omni_codegen_emit_raw(ctx, "    b->allocs_left = allocs; b->deadline = 0; b->exceeded = NULL;\n");
+    omni_codegen_emit_raw(ctx, "    b->catches_oom = false; b->wanted = 0; b->output = g_output;\n");
+    omni_codegen_emit_raw(ctx, "    if (ms >= 0) {\n");
+    omni_codegen_emit_raw(ctx, "        b->deadline = clock() + (clock_t)((double)ms * CLOCKS_PER_SEC / 1000.0);\n");
+    omni_codegen_emit_raw(ctx, "        if (b->deadline == 0) b->deadline = 1;\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    b->outer = g_budget; g_budget = b;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    omni_codegen_emit_raw(ctx, "static void omni_budget_leave(OmniBudget* b) { g_budget = b->outer; }\n\n");
+
+    omni_codegen_emit_raw(ctx, "static Obj* omni_budget_error(OmniBudget* b) {\n");
+    omni_codegen_emit_raw(ctx, "    g_output = b->output;\n");
+    omni_codegen_emit_raw(ctx, "    return mk_error_obj(\"budget-exceeded\", mk_sym(b->exceeded ? b->exceeded : \"allocs\"));\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    omni_codegen_emit_raw(ctx, "static void budget_charge(void) {\n");
+    omni_codegen_emit_raw(ctx, "    if (g_safe_point) g_safe_point();\n");
+    omni_codegen_emit_raw(ctx, "    if (!g_budget) return;\n");
+    omni_codegen_emit_raw(ctx, "    bool timed = ++g_budget_ticks % 64 == 0;\n");
+    omni_codegen_emit_raw(ctx, "    clock_t now = timed ? clock() : 0;\n");
+    omni_codegen_emit_raw(ctx, "    OmniBudget* hit = NULL;\n");
+    omni_codegen_emit_raw(ctx, "    for (OmniBudget* b = g_budget; b; b = b->outer) {\n");
+    omni_codegen_emit_raw(ctx, "        if (b->allocs_left >= 0 && --b->allocs_left < 0) { b->exceeded = \"allocs\"; hit = b; }\n");
+    omni_codegen_emit_raw(ctx, "        else if (timed && b->deadline && now >= b->deadline) { b->exceeded = \"ms\"; hit = b; }\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    if (hit) {\n");
+    omni_codegen_emit_raw(ctx, "        if (g_budget_jump) g_budget_jump(hit);\n");
+    omni_codegen_emit_raw(ctx, "        g_budget = hit->outer; longjmp(hit->jump, 1);\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    /* Out of memory. Each thread inside a catch-oom holds an emergency
+     * reserve; it is freed before unwinding, so the error and whatever
+     * the program does next have room, and taken again by the next
+     * catch-oom. Without a catch-oom, or with the abort policy, the
+     * program stops with a diagnostic. */
+    omni_codegen_emit_raw(ctx, "#define OMNI_OOM_RESERVE 16384\n");
+    omni_codegen_emit_raw(ctx, "static __thread void* g_oom_reserve = NULL;\n");
+    omni_codegen_emit_raw(ctx, "static void omni_oom_enter(OmniBudget* b) {\n");
+    omni_codegen_emit_raw(ctx, "    omni_budget_enter(b, -1, -1);\n");
+    omni_codegen_emit_raw(ctx, "    b->catches_oom = true;\n");
+    omni_codegen_emit_raw(ctx, "    if (!g_oom_reserve) g_oom_reserve = omni_try_malloc(OMNI_OOM_RESERVE);\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static Obj* omni_oom_error(OmniBudget* b) {\n");
+    omni_codegen_emit_raw(ctx, "    g_output = b->output;\n");
+    omni_codegen_emit_raw(ctx, "    return mk_error_obj(\"out-of-memory\", mk_int((int64_t)b->wanted));\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    /* Installed by the ports section once the program opens a file or a
+     * connection, so that what is buffered for it is written before the
+     * program stops */
+    omni_codegen_emit_raw(ctx, "static void (*g_flush_ports)(void) = NULL;\n");
+    omni_codegen_emit_raw(ctx, "static void omni_out_of_memory(size_t n) {\n");
+    omni_codegen_emit_raw(ctx, "    OmniBudget* hit = NULL;\n");
+    if (ctx->oom_policy == OMNI_OOM_ERROR) {
+        omni_codegen_emit_raw(ctx, "    for (OmniBudget* b = g_budget; b && !hit; b = b->outer) if (b->catches_oom) hit = b;\n");
+    }
+    omni_codegen_emit_raw(ctx, "    omni_free(g_oom_reserve); g_oom_reserve = NULL;\n");
+    omni_codegen_emit_raw(ctx, "    if (!hit) {\n");
+    omni_codegen_emit_raw(ctx, "        size_t limit = OMNI_LOAD(omni_heap_limit);\n");
+    omni_codegen_emit_raw(ctx, "        fprintf(stderr, \"out of memory: %%zu bytes requested with %%zu in use\", n, OMNI_LOAD(omni_heap_live));\n");
+    omni_codegen_emit_raw(ctx, "        if (limit) fprintf(stderr, \" (heap limit %%zu)\", limit);\n");
+    omni_codegen_emit_raw(ctx, "        fputs(\"\\n\", stderr);\n");
+    omni_codegen_emit_raw(ctx, "        if (g_flush_ports) g_flush_ports();\n");
+    omni_codegen_emit_raw(ctx, ctx->freestanding ? "        __builtin_trap();\n" : "        abort();\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    hit->exceeded = \"out-of-memory\"; hit->wanted = n;\n");
+    omni_codegen_emit_raw(ctx, "    if (g_budget_jump) g_budget_jump(hit);\n");
+    omni_codegen_emit_raw(ctx, "    g_budget = hit->outer; longjmp(hit->jump, 1);\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    /* Heap Constructors */
+    omni_codegen_emit_raw(ctx, "static Obj* mk_int(int64_t i) {\n");
+    omni_codegen_emit_raw(ctx, "    budget_charge();\n");
+    omni_codegen_emit_raw(ctx, "    Obj* o = malloc(sizeof(Obj));\n");
+    omni_codegen_emit_raw(ctx, "    o->tag = T_INT; o->rc = 1; o->i = i;\n");
+    omni_codegen_emit_raw(ctx, "    return o;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    omni_codegen_emit_raw(ctx, "static Obj* mk_float(double f) {\n");
+    omni_codegen_emit_raw(ctx, "    budget_charge();\n");
+    omni_codegen_emit_raw(ctx, "    Obj* o = malloc(sizeof(Obj));\n");
+    omni_codegen_emit_raw(ctx, "    o->tag = T_FLOAT; o->rc = 1; o->f = f;\n");
+    omni_codegen_emit_raw(ctx, "    return o;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    omni_codegen_emit_raw(ctx, "static Obj* mk_char(int64_t c) {\n");
+    omni_codegen_emit_raw(ctx, "    budget_charge();\n");
+    omni_codegen_emit_raw(ctx, "    Obj* o = malloc(sizeof(Obj));\n");
+    omni_codegen_emit_raw(ctx, "    o->tag = T_CHAR; o->rc = 1; o->i = c;\n");
+    omni_codegen_emit_raw(ctx, "    return o;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    omni_codegen_emit_raw(ctx, "static Obj* mk_sym(const char* s) {\n");
+    omni_codegen_emit_raw(ctx, "    budget_charge();\n");
+    omni_codegen_emit_raw(ctx, "    Obj* o = malloc(sizeof(Obj));\n");
+    omni_codegen_emit_raw(ctx, "    o->tag = T_SYM; o->rc = 1; o->s = strdup(s);\n");
+    omni_codegen_emit_raw(ctx, "    return o;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    /* Keywords are interned: mk_keyword returns the one object with that
+     * name, made on first use and never freed, so eq? is identity */
+    omni_codegen_emit_raw(ctx, "static Obj** omni_keywords = NULL;\n");
+    omni_codegen_emit_raw(ctx, "static size_t omni_keyword_count = 0, omni_keyword_cap = 0;\n");
+    omni_codegen_emit_raw(ctx, "static char omni_keyword_lock = 0;\n");
+    omni_codegen_emit_raw(ctx, "static Obj* mk_keyword(const char* s) {\n");
+    omni_codegen_emit_raw(ctx, "    while (__atomic_test_and_set(&omni_keyword_lock, __ATOMIC_ACQUIRE)) {}\n");
+    omni_codegen_emit_raw(ctx, "    Obj* o = NULL;\n");
+    omni_codegen_emit_raw(ctx, "    for (size_t i = 0; i < omni_keyword_count && !o; i++) {\n");
+    omni_codegen_emit_raw(ctx, "        if (strcmp(omni_keywords[i]->s, s) == 0) o = omni_keywords[i];\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    if (!o) {\n");
+    omni_codegen_emit_raw(ctx, "        if (omni_keyword_count == omni_keyword_cap) {\n");
+    omni_codegen_emit_raw(ctx, "            omni_keyword_cap = omni_keyword_cap ? omni_keyword_cap * 2 : 16;\n");
+    omni_codegen_emit_raw(ctx, "            omni_keywords = realloc(omni_keywords, omni_keyword_cap * sizeof(Obj*));\n");
+    omni_codegen_emit_raw(ctx, "        }\n");
+    omni_codegen_emit_raw(ctx, "        o = malloc(sizeof(Obj));\n");
+    omni_codegen_emit_raw(ctx, "        o->tag = T_KEYWORD; o->rc = 1; o->s = strdup(s);\n");
+    omni_codegen_emit_raw(ctx, "        omni_keywords[omni_keyword_count++] = o;\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    __atomic_clear(&omni_keyword_lock, __ATOMIC_RELEASE);\n");
+    omni_codegen_emit_raw(ctx, "    return o;\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static int is_keyword(Obj* o) { return o && o != NIL && o->tag == T_KEYWORD; }\n");
+    omni_codegen_emit_raw(ctx, "#define test_is_keyword(o) is_keyword(o)\n");
+    omni_codegen_emit_raw(ctx, "static Obj* prim_is_keyword(Obj* o) { return mk_int(is_keyword(o)); }\n\n");
+
+    /* Strings own a NUL-terminated copy of their text and hold no
+     * references, so every free strategy treats them as leaves */
+    omni_codegen_emit_raw(ctx, "static Obj* mk_string(const char* s) {\n");
+    omni_codegen_emit_raw(ctx, "    budget_charge();\n");
+    omni_codegen_emit_raw(ctx, "    Obj* o = malloc(sizeof(Obj));\n");
+    omni_codegen_emit_raw(ctx, "    o->tag = T_STRING; o->rc = 1; o->s = strdup(s);\n");
+    omni_codegen_emit_raw(ctx, "    return o;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    omni_codegen_emit_raw(ctx, "static Obj* mk_cell(Obj* car, Obj* cdr) {\n");
+    omni_codegen_emit_raw(ctx, "    budget_charge();\n");
+    omni_codegen_emit_raw(ctx, "    Obj* o = malloc(sizeof(Obj));\n");
+    omni_codegen_emit_raw(ctx, "    o->tag = T_CELL; o->rc = 1;\n");
+    omni_codegen_emit_raw(ctx, "    o->cell.car = car; o->cell.cdr = cdr;\n");
+    omni_codegen_emit_raw(ctx, "    return o;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    /* Error objects: owned message copy plus an optional referenced
+     * payload, the symbol naming the error's kind (NIL for error) and the
+     * function stack when it was made, which -g builds keep */
+    omni_codegen_emit_raw(ctx, "static Obj* mk_error_obj(const char* msg, Obj* data) {\n");
+    omni_codegen_emit_raw(ctx, "    budget_charge();\n");
+    omni_codegen_emit_raw(ctx, "    Obj* o = malloc(sizeof(Obj));\n");
+    omni_codegen_emit_raw(ctx, "    o->tag = T_ERROR; o->rc = 1;\n");
+    omni_codegen_emit_raw(ctx, "    o->err.msg = msg ? strdup(msg) : NULL;\n");
+    omni_codegen_emit_raw(ctx, "    o->err.data = data;\n");
+    omni_codegen_emit_raw(ctx, "    inc_ref(data);\n");
+    omni_codegen_emit_raw(ctx, "    o->err.tag = NIL;\n");
+    omni_codegen_emit_raw(ctx, "    o->err.trace = omni_error_trace();\n");
+    omni_codegen_emit_raw(ctx, "    return o;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    omni_codegen_emit_raw(ctx, "static Obj* mk_error(const char* msg) { return mk_error_obj(msg, NIL); }\n\n");
+
+    /* Compiled functions used as values; the adapter unpacks the arguments.
+     * name is a static string (NULL for lambdas) used when printing. */
+    omni_codegen_emit_raw(ctx, "static Obj* mk_code(ClosureFn fn, int arity, const char* name) {\n");
+    omni_codegen_emit_raw(ctx, "    budget_charge();\n");
+    omni_codegen_emit_raw(ctx, "    Obj* o = malloc(sizeof(Obj));\n");
+    omni_codegen_emit_raw(ctx, "    o->tag = T_CODE; o->rc = 1;\n");
+    omni_codegen_emit_raw(ctx, "    o->code.fn = fn; o->code.arity = arity; o->code.name = name;\n");
+    omni_codegen_emit_raw(ctx, "    o->code.captures = NULL; o->code.count = 0;\n");
+    omni_codegen_emit_raw(ctx, "    return o;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    /* Lambdas that use enclosing locals: the adapter is passed a copy of
+     * their values, each referenced, in capture order */
+    omni_codegen_emit_raw(ctx, "static Obj* mk_closure_code(ClosureFn fn, int arity, Obj** captures, int count) {\n");
+    omni_codegen_emit_raw(ctx, "    Obj* o = mk_code(fn, arity, NULL);\n");
+    omni_codegen_emit_raw(ctx, "    o->code.captures = malloc(count * sizeof(Obj*));\n");
+    omni_codegen_emit_raw(ctx, "    o->code.count = count;\n");
+    omni_codegen_emit_raw(ctx, "    for (int i = 0; i < count; i++) { o->code.captures[i] = captures[i]; inc_ref(captures[i]); }\n");
+    omni_codegen_emit_raw(ctx, "    return o;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    /* A local that closures capture and set! assigns lives in a box, so
+     * they all see one variable. The box references its value. */
+    omni_codegen_emit_raw(ctx, "static Obj* mk_box(Obj* v) {\n");
+    omni_codegen_emit_raw(ctx, "    budget_charge();\n");
+    omni_codegen_emit_raw(ctx, "    Obj* o = malloc(sizeof(Obj));\n");
+    omni_codegen_emit_raw(ctx, "    o->tag = T_BOX; o->rc = 1; o->box = v;\n");
+    omni_codegen_emit_raw(ctx, "    inc_ref(v);\n");
+    omni_codegen_emit_raw(ctx, "    return o;\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static Obj* box_get(Obj* b) { return b->box; }\n");
+    omni_codegen_emit_raw(ctx, "static void box_set(Obj* b, Obj* v) { inc_ref(v); dec_ref(b->box); b->box = v; }\n\n");
+
+    /* (memory-stats): (name allocs frees live peak) for each allocator,
+     * counted before the list itself is made */
+    omni_codegen_emit_raw(ctx, "static Obj* omni_memory_stats(void) {\n");
+    omni_codegen_emit_raw(ctx, "    size_t n = omni_allocator_count;\n");
+    omni_codegen_emit_raw(ctx, "    PurpleAllocator seen[OMNI_ALLOCATORS];\n");
+    omni_codegen_emit_raw(ctx, "    for (size_t i = 0; i < n; i++) seen[i] = omni_allocators[i];\n");
+    omni_codegen_emit_raw(ctx, "    Obj* out = NIL;\n");
+    omni_codegen_emit_raw(ctx, "    for (size_t i = n; i-- > 0;) {\n");
+    omni_codegen_emit_raw(ctx, "        Obj* row = mk_cell(mk_int((int64_t)seen[i].peak), NIL);\n");
+    omni_codegen_emit_raw(ctx, "        row = mk_cell(mk_int((int64_t)seen[i].live), row);\n");
+    omni_codegen_emit_raw(ctx, "        row = mk_cell(mk_int((int64_t)seen[i].frees), row);\n");
+    omni_codegen_emit_raw(ctx, "        row = mk_cell(mk_int((int64_t)seen[i].allocs), row);\n");
+    omni_codegen_emit_raw(ctx, "        out = mk_cell(mk_cell(mk_sym(seen[i].name), row), out);\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    return out;\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    /* (set-allocator! 'name) switches to an allocator the program registered */
+    omni_codegen_emit_raw(ctx, "static Obj* omni_use_allocator(Obj* name) {\n");
+    omni_codegen_emit_raw(ctx, "    if (name->tag != T_SYM && name->tag != T_STRING)\n");
+    omni_codegen_emit_raw(ctx, "        return mk_error_obj(\"set-allocator!: expected a name\", name);\n");
+    omni_codegen_emit_raw(ctx, "    if (purple_set_allocator(name->s, NULL, NULL) != 0)\n");
+    omni_codegen_emit_raw(ctx, "        return mk_error_obj(\"set-allocator!: no such allocator\", name);\n");
+    omni_codegen_emit_raw(ctx, "    return NIL;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    /* Runtime configuration: the PURPLE_* knobs main reads before the
+     * first form (see purple.h). This runtime frees at once, so the
+     * deferred batch and free-list budget are only reported; the heap
+     * limit replaces --heap-limit's. Freestanding code has no environment
+     * and keeps the defaults. */
+    omni_codegen_emit_raw(ctx, "enum { LOG_ERROR, LOG_WARN, LOG_INFO, LOG_DEBUG };\n");
+    omni_codegen_emit_raw(ctx, "enum { SCHED_THREADS, SCHED_INLINE };\n");
+    omni_codegen_emit_raw(ctx, "static const char* omni_log_level_names[] = { \"error\", \"warn\", \"info\", \"debug\" };\n");
+    omni_codegen_emit_raw(ctx, "static const char* omni_scheduler_names[] = { \"threads\", \"inline\" };\n");
+    omni_codegen_emit_raw(ctx, "static int omni_log_level = LOG_WARN;\n");
+    omni_codegen_emit_raw(ctx, "static int omni_scheduler = SCHED_THREADS;\n");
+    omni_codegen_emit_raw(ctx, "static long omni_deferred_batch = 32;\n");
+    omni_codegen_emit_raw(ctx, "static long omni_freelist_budget = 0;\n");
+    if (!ctx->freestanding) {
+        omni_codegen_emit_raw(ctx, "static void config_ignore(const char* var, const char* value) {\n");
+        omni_codegen_emit_raw(ctx, "    if (omni_log_level >= LOG_WARN) fprintf(stderr, \"purple: ignoring %%s=%%s\\n\", var, value);\n");
+        omni_codegen_emit_raw(ctx, "}\n");
+        omni_codegen_emit_raw(ctx, "static int config_size(const char* v, unsigned long long* out) {\n");
+        omni_codegen_emit_raw(ctx, "    if (*v < '0' || *v > '9') return 0;\n");
+        omni_codegen_emit_raw(ctx, "    char* end;\n");
+        omni_codegen_emit_raw(ctx, "    unsigned long long n = strtoull(v, &end, 10);\n");
+        omni_codegen_emit_raw(ctx, "    int shift = *end == 'k' || *end == 'K' ? 10 : *end == 'm' || *end == 'M' ? 20\n");
+        omni_codegen_emit_raw(ctx, "              : *end == 'g' || *end == 'G' ? 30 : 0;\n");
+        omni_codegen_emit_raw(ctx, "    if (shift) end++;\n");
+        omni_codegen_emit_raw(ctx, "    if (*end || n > (ULLONG_MAX >> shift)) return 0;\n");
+        omni_codegen_emit_raw(ctx, "    *out = n << shift;\n");
+        omni_codegen_emit_raw(ctx, "    return 1;\n");
+        omni_codegen_emit_raw(ctx, "}\n");
+        omni_codegen_emit_raw(ctx, "static int config_choice(const char* v, const char** names, int count) {\n");
+        omni_codegen_emit_raw(ctx, "    for (int i = 0; i < count; i++) if (strcmp(v, names[i]) == 0) return i;\n");
+        omni_codegen_emit_raw(ctx, "    return -1;\n");
+        omni_codegen_emit_raw(ctx, "}\n");
+        omni_codegen_emit_raw(ctx, "static void purple_load_config(void) {\n");
+        omni_codegen_emit_raw(ctx, "    const char* v; unsigned long long n; int i;\n");
+        omni_codegen_emit_raw(ctx, "    if ((v = getenv(\"PURPLE_LOG_LEVEL\"))) {\n");
+        omni_codegen_emit_raw(ctx, "        if ((i = config_choice(v, omni_log_level_names, 4)) >= 0) omni_log_level = i;\n");
+        omni_codegen_emit_raw(ctx, "        else config_ignore(\"PURPLE_LOG_LEVEL\", v);\n");
+        omni_codegen_emit_raw(ctx, "    }\n");
+        omni_codegen_emit_raw(ctx, "    if ((v = getenv(\"PURPLE_DEFERRED_BATCH\"))) {\n");
+        omni_codegen_emit_raw(ctx, "        if (config_size(v, &n) && n > 0 && n <= INT_MAX) omni_deferred_batch = (long)n;\n");
+        omni_codegen_emit_raw(ctx, "        else config_ignore(\"PURPLE_DEFERRED_BATCH\", v);\n");
+        omni_codegen_emit_raw(ctx, "    }\n");
+        omni_codegen_emit_raw(ctx, "    if ((v = getenv(\"PURPLE_FREELIST_BUDGET\"))) {\n");
+        omni_codegen_emit_raw(ctx, "        if (config_size(v, &n) && n <= LONG_MAX) omni_freelist_budget = (long)n;\n");
+        omni_codegen_emit_raw(ctx, "        else config_ignore(\"PURPLE_FREELIST_BUDGET\", v);\n");
+        omni_codegen_emit_raw(ctx, "    }\n");
+        omni_codegen_emit_raw(ctx, "    if ((v = getenv(\"PURPLE_HEAP_LIMIT\"))) {\n");
+        omni_codegen_emit_raw(ctx, "        if (config_size(v, &n) && n <= SIZE_MAX) purple_set_heap_limit((size_t)n);\n");
+        omni_codegen_emit_raw(ctx, "        else config_ignore(\"PURPLE_HEAP_LIMIT\", v);\n");
+        omni_codegen_emit_raw(ctx, "    }\n");
+        omni_codegen_emit_raw(ctx, "    if ((v = getenv(\"PURPLE_SCHEDULER\"))) {\n");
+        omni_codegen_emit_raw(ctx, "        if ((i = config_choice(v, omni_scheduler_names, 2)) >= 0) omni_scheduler = i;\n");
+        omni_codegen_emit_raw(ctx, "        else config_ignore(\"PURPLE_SCHEDULER\", v);\n");
+        omni_codegen_emit_raw(ctx, "    }\n");
+        omni_codegen_emit_raw(ctx, "    if (omni_log_level >= LOG_INFO) {\n");
+        omni_codegen_emit_raw(ctx, "        fprintf(stderr, \"purple: deferred-batch=%%ld freelist-budget=%%ld heap-limit=%%zu \"\n");
+        omni_codegen_emit_raw(ctx, "                        \"log-level=%%s scheduler=%%s\\n\",\n");
+        omni_codegen_emit_raw(ctx, "                omni_deferred_batch, omni_freelist_budget, OMNI_LOAD(omni_heap_limit),\n");
+        omni_codegen_emit_raw(ctx, "                omni_log_level_names[omni_log_level], omni_scheduler_names[omni_scheduler]);\n");
+        omni_codegen_emit_raw(ctx, "    }\n");
+        omni_codegen_emit_raw(ctx, "}\n");
+    }
+    omni_codegen_emit_raw(ctx, "static Obj* prim_runtime_config(Obj* key) {\n");
+    omni_codegen_emit_raw(ctx, "    const char* k = key && key != NIL && key->tag == T_SYM ? key->s : \"\";\n");
+    omni_codegen_emit_raw(ctx, "    if (strcmp(k, \"deferred-batch\") == 0) return mk_int(omni_deferred_batch);\n");
+    omni_codegen_emit_raw(ctx, "    if (strcmp(k, \"freelist-budget\") == 0) return mk_int(omni_freelist_budget);\n");
+    omni_codegen_emit_raw(ctx, "    if (strcmp(k, \"heap-limit\") == 0) return mk_int((int64_t)OMNI_LOAD(omni_heap_limit));\n");
+    omni_codegen_emit_raw(ctx, "    if (strcmp(k, \"log-level\") == 0) return mk_sym(omni_log_level_names[omni_log_level]);\n");
+    omni_codegen_emit_raw(ctx, "    if (strcmp(k, \"scheduler\") == 0) return mk_sym(omni_scheduler_names[omni_scheduler]);\n");
+    omni_codegen_emit_raw(ctx, "    return mk_error_obj(\"runtime-config: unknown key\", key);\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    /* Reference counting and ownership-aware free strategies. Counts
+     * change atomically once a second thread has started, since any
+     * object may have reached it; atomic_inc_ref and atomic_dec_ref,
+     * which the compiler uses for variables shared between threads,
+     * always do. */
+    if (ctx->crash_handler) {
+        rt_crash_report(ctx);
+    } else {
+        omni_codegen_emit_raw(ctx, "#define OMNI_RC_LOG(op, o) ((void)0)\n");
+        omni_codegen_emit_raw(ctx, "static Obj* omni_error_trace(void) { return NIL; }\n");
+    }
+    omni_codegen_emit_raw(ctx, "static int omni_threaded = 0;\n");
+    omni_codegen_emit_raw(ctx, "#define RC_ADD(o, n) (OMNI_LOAD(omni_threaded) ? OMNI_ATOMIC_ADD((o)->rc, (n)) : ((o)->rc += (n)))\n");
+    omni_codegen_emit_raw(ctx, "static void release_obj(Obj* o);\n");
+    omni_codegen_emit_raw(ctx, "static void inc_ref(Obj* o) { if (o && o != NIL) { OMNI_RC_LOG(\"inc_ref\", o); RC_ADD(o, 1); } }\n");
+    omni_codegen_emit_raw(ctx, "static void atomic_inc_ref(Obj* o) { if (o && o != NIL) { OMNI_RC_LOG(\"atomic_inc_ref\", o); OMNI_ATOMIC_ADD(o->rc, 1); } }\n");
+    omni_codegen_emit_raw(ctx, "static void atomic_dec_ref(Obj* o) {\n");
+    omni_codegen_emit_raw(ctx, "    if (!o || o == NIL || o->tag == T_KEYWORD) return;\n");
+    omni_codegen_emit_raw(ctx, "    OMNI_RC_LOG(\"atomic_dec_ref\", o);\n");
+    omni_codegen_emit_raw(ctx, "    if (OMNI_ATOMIC_ADD(o->rc, -1) <= 0) release_obj(o);\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    /* Called with each object just before its memory is released
+     * (--constraint-check installs one) */
+    omni_codegen_emit_raw(ctx, "static void (*g_free_hook)(Obj*) = NULL;\n");
+    omni_codegen_emit_raw(ctx, "static void set_free_hook(void (*hook)(Obj*)) { g_free_hook = hook; }\n");
+    /* Installed by the concurrency section once it makes a promise */
+    omni_codegen_emit_raw(ctx, "static void (*g_free_promise)(struct Promise*) = NULL;\n");
+    omni_codegen_emit_raw(ctx, "static void (*g_free_pool)(struct WorkerPool*) = NULL;\n");
+    /* Installed by the persistent section once it makes a collection;
+     * share_obj freezes one about to reach another thread */
+    omni_codegen_emit_raw(ctx, "static void (*g_free_pcoll)(struct PColl*) = NULL;\n");
+    omni_codegen_emit_raw(ctx, "static void (*g_share_pcoll)(Obj*) = NULL;\n");
+    omni_codegen_emit_raw(ctx, "static void share_obj(Obj* o) { if (g_share_pcoll) g_share_pcoll(o); }\n");
+    /* Installed by the print section once it makes a port */
+    omni_codegen_emit_raw(ctx, "static void (*g_free_port)(struct OmniPort*) = NULL;\n\n");
+
+    /* Free a table's entries, handing each key and value to release */
+    omni_codegen_emit_raw(ctx, "static void free_hash_table(HashTable* t, void (*release)(Obj*)) {\n");
+    omni_codegen_emit_raw(ctx, "    for (HashNode* n = t->first, *next; n; n = next) {\n");
+    omni_codegen_emit_raw(ctx, "        next = n->next;\n");
+    omni_codegen_emit_raw(ctx, "        release(n->key); release(n->value);\n");
+    omni_codegen_emit_raw(ctx, "        free(n);\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    free(t->buckets);\n");
+    omni_codegen_emit_raw(ctx, "    free(t);\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    /* The strong fields of a user object go to release; weak ones are
+     * not its to release */
+    omni_codegen_emit_raw(ctx, "static void release_user_fields(Obj* o, void (*release)(Obj*)) {\n");
+    omni_codegen_emit_raw(ctx, "    for (int i = 0; i < o->user.type->field_count; i++) {\n");
+    omni_codegen_emit_raw(ctx, "        if (!(o->user.type->weak >> i & 1)) release(o->user.fields[i]);\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    free(o->user.fields);\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    /* free_unique: Known single reference, no RC check needed */
+    omni_codegen_emit_raw(ctx, "static void free_unique(Obj* o) {\n");
+    omni_codegen_emit_raw(ctx, "    if (!o || o == NIL || o->tag == T_KEYWORD) return;  /* keywords live forever */\n");
+    omni_codegen_emit_raw(ctx, "    OMNI_RC_LOG(\"free_unique\", o);\n");
+    omni_codegen_emit_raw(ctx, "    if (g_free_hook) g_free_hook(o);\n");
+    omni_codegen_emit_raw(ctx, "    switch (o->tag) {\n");
+    omni_codegen_emit_raw(ctx, "    case T_SYM: case T_STRING: free(o->s); break;\n");
+    omni_codegen_emit_raw(ctx, "    case T_CELL: free_unique(o->cell.car); free_unique(o->cell.cdr); break;\n");
+    omni_codegen_emit_raw(ctx, "    case T_VECTOR: for (int64_t i = 0; i < o->vec.len; i++) free_obj(o->vec.items[i]); free(o->vec.items); break; /* slots may be shared */\n");
+    omni_codegen_emit_raw(ctx, "    case T_HASH: free_hash_table(o->hash, free_obj); break;\n");
+    omni_codegen_emit_raw(ctx, "    case T_PROMISE: g_free_promise(o->promise); break;\n");
+    omni_codegen_emit_raw(ctx, "    case T_POOL: g_free_pool(o->pool); break;\n");
+    omni_codegen_emit_raw(ctx, "    case T_PMAP: case T_PVEC: g_free_pcoll(o->pcoll); break;\n");
+    omni_codegen_emit_raw(ctx, "    case T_PORT: g_free_port(o->port); break;\n");
+    omni_codegen_emit_raw(ctx, "    case T_LAMBDA: free_unique(o->lam.params); free_unique(o->lam.body); free_unique(o->lam.env); break;\n");
+    omni_codegen_emit_raw(ctx, "    case T_ERROR: free(o->err.msg); dec_ref(o->err.data); dec_ref(o->err.tag); dec_ref(o->err.trace); break; /* payload is shared */\n");
+    omni_codegen_emit_raw(ctx, "    case T_CODE: for (int i = 0; i < o->code.count; i++) dec_ref(o->code.captures[i]); free(o->code.captures); break; /* captures are shared */\n");
+    omni_codegen_emit_raw(ctx, "    case T_BOX: dec_ref(o->box); break;\n");
+    omni_codegen_emit_raw(ctx, "    case T_USER: release_user_fields(o, free_obj); break; /* fields may be shared */\n");
+    omni_codegen_emit_raw(ctx, "    default: break;\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    free(o);\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    /* free_tree: Tree-shaped, recursive free (still checks RC for shared children) */
+    omni_codegen_emit_raw(ctx, "static void free_tree(Obj* o) {\n");
+    omni_codegen_emit_raw(ctx, "    if (!o || o == NIL || o->tag == T_KEYWORD) return;\n");
+    omni_codegen_emit_raw(ctx, "    OMNI_RC_LOG(\"free_tree\", o);\n");
+    omni_codegen_emit_raw(ctx, "    if (o->rc > 1 && RC_ADD(o, -1) > 0) return; /* Shared child - dec only */\n");
+    omni_codegen_emit_raw(ctx, "    if (g_free_hook) g_free_hook(o);\n");
+    omni_codegen_emit_raw(ctx, "    switch (o->tag) {\n");
+    omni_codegen_emit_raw(ctx, "    case T_SYM: case T_STRING: free(o->s); break;\n");
+    omni_codegen_emit_raw(ctx, "    case T_CELL: free_tree(o->cell.car); free_tree(o->cell.cdr); break;\n");
+    omni_codegen_emit_raw(ctx, "    case T_VECTOR: for (int64_t i = 0; i < o->vec.len; i++) free_tree(o->vec.items[i]); free(o->vec.items); break;\n");
+    omni_codegen_emit_raw(ctx, "    case T_HASH: free_hash_table(o->hash, free_tree); break;\n");
+    omni_codegen_emit_raw(ctx, "    case T_PROMISE: g_free_promise(o->promise); break;\n");
+    omni_codegen_emit_raw(ctx, "    case T_POOL: g_free_pool(o->pool); break;\n");
+    omni_codegen_emit_raw(ctx, "    case T_PMAP: case T_PVEC: g_free_pcoll(o->pcoll); break;\n");
+    omni_codegen_emit_raw(ctx, "    case T_PORT: g_free_port(o->port); break;\n");
+    omni_codegen_emit_raw(ctx, "    case T_LAMBDA: free_tree(o->lam.params); free_tree(o->lam.body); free_tree(o->lam.env); break;\n");
+    omni_codegen_emit_raw(ctx, "    case T_ERROR: free(o->err.msg); free_tree(o->err.data); free_tree(o->err.tag); free_tree(o->err.trace); break;\n");
+    omni_codegen_emit_raw(ctx, "    case T_CODE: for (int i = 0; i < o->code.count; i++) dec_ref(o->code.captures[i]); free(o->code.captures); break; /* captures are shared */\n");
+    omni_codegen_emit_raw(ctx, "    case T_BOX: dec_ref(o->box); break;\n");
+    omni_codegen_emit_raw(ctx, "    case T_USER: release_user_fields(o, free_tree); break;\n");
+    omni_codegen_emit_raw(ctx, "    default: break;\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    free(o);\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    /* free_obj: Standard RC-based free (dec_ref alias) */
+    omni_codegen_emit_raw(ctx, "static void free_obj(Obj* o) {\n");
+    omni_codegen_emit_raw(ctx, "    if (!o || o == NIL || o->tag == T_KEYWORD) return;\n");
+    omni_codegen_emit_raw(ctx, "    OMNI_RC_LOG(\"dec_ref\", o);\n");
+    omni_codegen_emit_raw(ctx, "    if (RC_ADD(o, -1) <= 0) release_obj(o);\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static void release_obj(Obj* o) {\n");
+    omni_codegen_emit_raw(ctx, "    if (g_free_hook) g_free_hook(o);\n");
+    omni_codegen_emit_raw(ctx, "    switch (o->tag) {\n");
+    omni_codegen_emit_raw(ctx, "    case T_SYM: case T_STRING: free(o->s); break;\n");
+    omni_codegen_emit_raw(ctx, "    case T_CELL: free_obj(o->cell.car); free_obj(o->cell.cdr); break;\n");
+    omni_codegen_emit_raw(ctx, "    case T_VECTOR: for (int64_t i = 0; i < o->vec.len; i++) free_obj(o->vec.items[i]); free(o->vec.items); break;\n");
+    omni_codegen_emit_raw(ctx, "    case T_HASH: free_hash_table(o->hash, free_obj); break;\n");
+    omni_codegen_emit_raw(ctx, "    case T_PROMISE: g_free_promise(o->promise); break;\n");
+    omni_codegen_emit_raw(ctx, "    case T_POOL: g_free_pool(o->pool); break;\n");
+    omni_codegen_emit_raw(ctx, "    case T_PMAP: case T_PVEC: g_free_pcoll(o->pcoll); break;\n");
+    omni_codegen_emit_raw(ctx, "    case T_PORT: g_free_port(o->port); break;\n");
+    omni_codegen_emit_raw(ctx, "    case T_LAMBDA: free_obj(o->lam.params); free_obj(o->lam.body); free_obj(o->lam.env); break;\n");
+    omni_codegen_emit_raw(ctx, "    case T_ERROR: free(o->err.msg); free_obj(o->err.data); free_obj(o->err.tag); free_obj(o->err.trace); break;\n");
+    omni_codegen_emit_raw(ctx, "    case T_CODE: for (int i = 0; i < o->code.count; i++) free_obj(o->code.captures[i]); free(o->code.captures); break;\n");
+    omni_codegen_emit_raw(ctx, "    case T_BOX: free_obj(o->box); break;\n");
+    omni_codegen_emit_raw(ctx, "    case T_USER: release_user_fields(o, free_obj); break;\n");
+    omni_codegen_emit_raw(ctx, "    default: break;\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    free(o);\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static void dec_ref(Obj* o) { free_obj(o); }\n\n");
+}
+
+static void rt_stack(CodeGenContext* ctx) {
+    /* Stack allocation macros (escape-aware allocation) */
+    omni_codegen_emit_raw(ctx, "/* Stack-allocated objects - no free needed, auto-cleanup at scope exit */\n");
+    omni_codegen_emit_raw(ctx, "#define STACK_INT(name, val) \\\n");
+    omni_codegen_emit_raw(ctx, "    Obj _stack_##name = { .tag = T_INT, .rc = 1, .i = (val) }; \\\n");
+    omni_codegen_emit_raw(ctx, "    Obj* name = &_stack_##name\n\n");
+
+    omni_codegen_emit_raw(ctx, "#define STACK_CELL(name, car_val, cdr_val) \\\n");
+    omni_codegen_emit_raw(ctx, "    Obj _stack_##name = { .tag = T_CELL, .rc = 1, .cell = { (car_val), (cdr_val) } }; \\\n");
+    omni_codegen_emit_raw(ctx, "    Obj* name = &_stack_##name\n\n");
+
+    /* Helper to check if an object is stack-allocated (for debug/safety) */
+    omni_codegen_emit_raw(ctx, "#define IS_STACK_OBJ(o) ((o) && (o)->rc == -1)\n");
+    omni_codegen_emit_raw(ctx, "#define MARK_STACK(o) ((o)->rc = -1)\n\n");
+
+    /* Stack-friendly constructors that initialize existing memory */
+    omni_codegen_emit_raw(ctx, "static void init_int(Obj* o, int64_t i) {\n");
+    omni_codegen_emit_raw(ctx, "    o->tag = T_INT; o->rc = -1; o->i = i;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    omni_codegen_emit_raw(ctx, "static void init_cell(Obj* o, Obj* car, Obj* cdr) {\n");
+    omni_codegen_emit_raw(ctx, "    o->tag = T_CELL; o->rc = -1;\n");
+    omni_codegen_emit_raw(ctx, "    o->cell.car = car; o->cell.cdr = cdr;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+}
+
+static void rt_weak(CodeGenContext* ctx) {
+    /* Weak references for back-edges (break cycles) */
+    omni_codegen_emit_raw(ctx, "/* Weak reference: does NOT prevent deallocation.\n");
+    omni_codegen_emit_raw(ctx, " * Used for back-edges (parent, prev, etc.) to break cycles.\n");
+    omni_codegen_emit_raw(ctx, " * Weak refs are NOT followed during free (no recursive free).\n");
+    omni_codegen_emit_raw(ctx, " * Weak refs are auto-nullified when target is freed.\n");
+    omni_codegen_emit_raw(ctx, " */\n");
+    omni_codegen_emit_raw(ctx, "typedef struct WeakRef {\n");
+    omni_codegen_emit_raw(ctx, "    Obj** slot;           /* Pointer to the weak field in the owner */\n");
+    omni_codegen_emit_raw(ctx, "    struct WeakRef* next; /* Next weak ref pointing to same target */\n");
+    omni_codegen_emit_raw(ctx, "} WeakRef;\n\n");
+
+    omni_codegen_emit_raw(ctx, "/* Weak ref list head stored in target object (or separate table) */\n");
+    omni_codegen_emit_raw(ctx, "static WeakRef* _weak_refs = NULL; /* Global list for simplicity */\n\n");
+
+    omni_codegen_emit_raw(ctx, "static void weak_ref_register(Obj** slot, Obj* target) {\n");
+    omni_codegen_emit_raw(ctx, "    (void)target; /* For table-based lookup, would use target */\n");
+    omni_codegen_emit_raw(ctx, "    WeakRef* wr = malloc(sizeof(WeakRef));\n");
+    omni_codegen_emit_raw(ctx, "    wr->slot = slot;\n");
+    omni_codegen_emit_raw(ctx, "    wr->next = _weak_refs;\n");
+    omni_codegen_emit_raw(ctx, "    _weak_refs = wr;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    omni_codegen_emit_raw(ctx, "static void weak_refs_nullify(Obj* target) {\n");
+    omni_codegen_emit_raw(ctx, "    /* Called when target is about to be freed - nullify all weak refs */\n");
+    omni_codegen_emit_raw(ctx, "    WeakRef** prev = &_weak_refs;\n");
+    omni_codegen_emit_raw(ctx, "    WeakRef* wr = _weak_refs;\n");
+    omni_codegen_emit_raw(ctx, "    while (wr) {\n");
+    omni_codegen_emit_raw(ctx, "        if (*(wr->slot) == target) {\n");
+    omni_codegen_emit_raw(ctx, "            *(wr->slot) = NULL; /* Nullify the weak reference */\n");
+    omni_codegen_emit_raw(ctx, "            *prev = wr->next;\n");
+    omni_codegen_emit_raw(ctx, "            WeakRef* to_free = wr;\n");
+    omni_codegen_emit_raw(ctx, "            wr = wr->next;\n");
+    omni_codegen_emit_raw(ctx, "            free(to_free);\n");
+    omni_codegen_emit_raw(ctx, "        } else {\n");
+    omni_codegen_emit_raw(ctx, "            prev = &wr->next;\n");
+    omni_codegen_emit_raw(ctx, "            wr = wr->next;\n");
+    omni_codegen_emit_raw(ctx, "        }\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    omni_codegen_emit_raw(ctx, "/* Set a back-edge field (weak reference) */\n");
+    omni_codegen_emit_raw(ctx, "#define SET_WEAK(owner, field, target) do { \\\n");
+    omni_codegen_emit_raw(ctx, "    (owner)->field = (target); \\\n");
+    omni_codegen_emit_raw(ctx, "    if (target) weak_ref_register(&(owner)->field, target); \\\n");
+    omni_codegen_emit_raw(ctx, "} while(0)\n\n");
+
+    omni_codegen_emit_raw(ctx, "/* Get a back-edge field (may be NULL if target was freed) */\n");
+    omni_codegen_emit_raw(ctx, "#define GET_WEAK(owner, field) ((owner)->field)\n\n");
+}
+
+static void rt_reuse(CodeGenContext* ctx) {
+    /* Perceus reuse functions - reuse freed memory for new allocations */
+    omni_codegen_emit_raw(ctx, "/* Perceus Reuse: In-place mutation for functional-style updates.\n");
+    omni_codegen_emit_raw(ctx, " * When we know an object will be freed immediately before a new allocation\n");
+    omni_codegen_emit_raw(ctx, " * of the same size, we can reuse its memory instead of free+malloc.\n");
+    omni_codegen_emit_raw(ctx, " */\n\n");
+
+    omni_codegen_emit_raw(ctx, "/* Reuse an object's memory for an integer */\n");
+    omni_codegen_emit_raw(ctx, "static Obj* reuse_as_int(Obj* old, int64_t val) {\n");
+    omni_codegen_emit_raw(ctx, "    if (!old || old == NIL) return mk_int(val);\n");
+    omni_codegen_emit_raw(ctx, "    /* Clear old content if needed */\n");
+    omni_codegen_emit_raw(ctx, "    if ((old->tag == T_SYM || old->tag == T_STRING) && old->s) free(old->s);\n");
+    omni_codegen_emit_raw(ctx, "    else if (old->tag == T_CELL) {\n");
+    omni_codegen_emit_raw(ctx, "        free_obj(old->cell.car);\n");
+    omni_codegen_emit_raw(ctx, "        free_obj(old->cell.cdr);\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    else if (old->tag == T_VECTOR) {\n");
+    omni_codegen_emit_raw(ctx, "        for (int64_t i = 0; i < old->vec.len; i++) free_obj(old->vec.items[i]);\n");
+    omni_codegen_emit_raw(ctx, "        free(old->vec.items);\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    else if (old->tag == T_HASH) free_hash_table(old->hash, free_obj);\n");
+    omni_codegen_emit_raw(ctx, "    else if (old->tag == T_PROMISE) g_free_promise(old->promise);\n");
+    omni_codegen_emit_raw(ctx, "    else if (old->tag == T_POOL) g_free_pool(old->pool);\n");
+    omni_codegen_emit_raw(ctx, "    else if (old->tag == T_PMAP || old->tag == T_PVEC) g_free_pcoll(old->pcoll);\n");
+    omni_codegen_emit_raw(ctx, "    else if (old->tag == T_PORT) g_free_port(old->port);\n");
+    omni_codegen_emit_raw(ctx, "    else if (old->tag == T_USER) release_user_fields(old, free_obj);\n");
+    omni_codegen_emit_raw(ctx, "    old->tag = T_INT;\n");
+    omni_codegen_emit_raw(ctx, "    old->i = val;\n");
+    omni_codegen_emit_raw(ctx, "    old->rc = 1;\n");
+    omni_codegen_emit_raw(ctx, "    return old;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    omni_codegen_emit_raw(ctx, "/* Reuse an object's memory for a cell/cons */\n");
+    omni_codegen_emit_raw(ctx, "static Obj* reuse_as_cell(Obj* old, Obj* car, Obj* cdr) {\n");
+    omni_codegen_emit_raw(ctx, "    /* Take the new parts first: they may be parts of old */\n");
+    omni_codegen_emit_raw(ctx, "    inc_ref(car); inc_ref(cdr);\n");
+    omni_codegen_emit_raw(ctx, "    if (!old || old == NIL) return mk_cell(car, cdr);\n");
+    omni_codegen_emit_raw(ctx, "    /* Clear old content if needed */\n");
+    omni_codegen_emit_raw(ctx, "    if ((old->tag == T_SYM || old->tag == T_STRING) && old->s) free(old->s);\n");
+    omni_codegen_emit_raw(ctx, "    else if (old->tag == T_CELL) {\n");
+    omni_codegen_emit_raw(ctx, "        free_obj(old->cell.car);\n");
+    omni_codegen_emit_raw(ctx, "        free_obj(old->cell.cdr);\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    else if (old->tag == T_VECTOR) {\n");
+    omni_codegen_emit_raw(ctx, "        for (int64_t i = 0; i < old->vec.len; i++) free_obj(old->vec.items[i]);\n");
+    omni_codegen_emit_raw(ctx, "        free(old->vec.items);\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    else if (old->tag == T_HASH) free_hash_table(old->hash, free_obj);\n");
+    omni_codegen_emit_raw(ctx, "    else if (old->tag == T_PROMISE) g_free_promise(old->promise);\n");
+    omni_codegen_emit_raw(ctx, "    else if (old->tag == T_POOL) g_free_pool(old->pool);\n");
+    omni_codegen_emit_raw(ctx, "    else if (old->tag == T_PMAP || old->tag == T_PVEC) g_free_pcoll(old->pcoll);\n");
+    omni_codegen_emit_raw(ctx, "    else if (old->tag == T_PORT) g_free_port(old->port);\n");
+    omni_codegen_emit_raw(ctx, "    else if (old->tag == T_USER) release_user_fields(old, free_obj);\n");
+    omni_codegen_emit_raw(ctx, "    old->tag = T_CELL;\n");
+    omni_codegen_emit_raw(ctx, "    old->cell.car = car;\n");
+    omni_codegen_emit_raw(ctx, "    old->cell.cdr = cdr;\n");
+    omni_codegen_emit_raw(ctx, "    old->rc = 1;\n");
+    omni_codegen_emit_raw(ctx, "    return old;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    omni_codegen_emit_raw(ctx, "/* Reuse an object's memory for a float */\n");
+    omni_codegen_emit_raw(ctx, "static Obj* reuse_as_float(Obj* old, double val) {\n");
+    omni_codegen_emit_raw(ctx, "    if (!old || old == NIL) return mk_float(val);\n");
+    omni_codegen_emit_raw(ctx, "    /* Clear old content if needed */\n");
+    omni_codegen_emit_raw(ctx, "    if ((old->tag == T_SYM || old->tag == T_STRING) && old->s) free(old->s);\n");
+    omni_codegen_emit_raw(ctx, "    else if (old->tag == T_CELL) {\n");
+    omni_codegen_emit_raw(ctx, "        free_obj(old->cell.car);\n");
+    omni_codegen_emit_raw(ctx, "        free_obj(old->cell.cdr);\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    else if (old->tag == T_VECTOR) {\n");
+    omni_codegen_emit_raw(ctx, "        for (int64_t i = 0; i < old->vec.len; i++) free_obj(old->vec.items[i]);\n");
+    omni_codegen_emit_raw(ctx, "        free(old->vec.items);\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    else if (old->tag == T_HASH) free_hash_table(old->hash, free_obj);\n");
+    omni_codegen_emit_raw(ctx, "    else if (old->tag == T_PROMISE) g_free_promise(old->promise);\n");
+    omni_codegen_emit_raw(ctx, "    else if (old->tag == T_POOL) g_free_pool(old->pool);\n");
+    omni_codegen_emit_raw(ctx, "    else if (old->tag == T_PMAP || old->tag == T_PVEC) g_free_pcoll(old->pcoll);\n");
+    omni_codegen_emit_raw(ctx, "    else if (old->tag == T_PORT) g_free_port(old->port);\n");
+    omni_codegen_emit_raw(ctx, "    else if (old->tag == T_USER) release_user_fields(old, free_obj);\n");
+    omni_codegen_emit_raw(ctx, "    old->tag = T_FLOAT;\n");
+    omni_codegen_emit_raw(ctx, "    old->f = val;\n");
+    omni_codegen_emit_raw(ctx, "    old->rc = 1;\n");
+    omni_codegen_emit_raw(ctx, "    return old;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    omni_codegen_emit_raw(ctx, "/* Check if object can be reused (unique, about to be freed) */\n");
+    omni_codegen_emit_raw(ctx, "#define CAN_REUSE(o) ((o) && (o) != NIL && (o)->rc == 1 && (o)->tag != T_KEYWORD)\n\n");
+
+    omni_codegen_emit_raw(ctx, "/* Conditional reuse macro - falls back to fresh alloc if can't reuse */\n");
+    omni_codegen_emit_raw(ctx, "#define REUSE_OR_NEW_INT(old, val) \\\n");
+    omni_codegen_emit_raw(ctx, "    (CAN_REUSE(old) ? reuse_as_int(old, val) : mk_int(val))\n\n");
+
+    omni_codegen_emit_raw(ctx, "#define REUSE_OR_NEW_CELL(old, car, cdr) \\\n");
+    omni_codegen_emit_raw(ctx, "    (CAN_REUSE(old) ? reuse_as_cell(old, car, cdr) : prim_cons(car, cdr))\n\n");
+
+    omni_codegen_emit_raw(ctx, "#define REUSE_OR_NEW_FLOAT(old, val) \\\n");
+    omni_codegen_emit_raw(ctx, "    (CAN_REUSE(old) ? reuse_as_float(old, val) : mk_float(val))\n\n");
+}
+
+static void rt_rc_elision(CodeGenContext* ctx) {
+    /* RC Elision: Skip reference counting for objects with known lifetimes */
+    omni_codegen_emit_raw(ctx, "/* RC Elision: Conditional inc/dec based on analysis.\n");
+    omni_codegen_emit_raw(ctx, " * When analysis proves RC operations are unnecessary, we skip them:\n");
+    omni_codegen_emit_raw(ctx, " * - Unique references: no other refs exist\n");
+    omni_codegen_emit_raw(ctx, " * - Stack-allocated: lifetime is scope-bound\n");
+    omni_codegen_emit_raw(ctx, " * - Arena/pool: bulk free, no individual tracking\n");
+    omni_codegen_emit_raw(ctx, " * - Same region: all refs die together\n");
+    omni_codegen_emit_raw(ctx, " */\n\n");
+
+    omni_codegen_emit_raw(ctx, "/* Conditional inc_ref - may be elided */\n");
+    omni_codegen_emit_raw(ctx, "#define INC_REF_IF_NEEDED(o, can_elide) \\\n");
+    omni_codegen_emit_raw(ctx, "    do { if (!(can_elide)) inc_ref(o); } while(0)\n\n");
+
+    omni_codegen_emit_raw(ctx, "/* Conditional dec_ref - may be elided */\n");
+    omni_codegen_emit_raw(ctx, "#define DEC_REF_IF_NEEDED(o, can_elide) \\\n");
+    omni_codegen_emit_raw(ctx, "    do { if (!(can_elide)) dec_ref(o); } while(0)\n\n");
+
+    omni_codegen_emit_raw(ctx, "/* No-op for elided RC operations (for clarity in generated code) */\n");
+    omni_codegen_emit_raw(ctx, "#define RC_ELIDED() ((void)0)\n\n");
+
+    omni_codegen_emit_raw(ctx, "/* Region-local reference: no RC needed within same region */\n");
+    omni_codegen_emit_raw(ctx, "#define REGION_LOCAL_REF(o) (o)  /* No inc_ref needed */\n\n");
+}
+
+static void rt_region(CodeGenContext* ctx) {
+    /* Per-Region External Refcount */
+    omni_codegen_emit_raw(ctx, "/* Per-Region External Refcount: Track references into a region.\n");
+    omni_codegen_emit_raw(ctx, " * Instead of per-object RC, track external refs to the region.\n");
+    omni_codegen_emit_raw(ctx, " * When external_refcount == 0 and scope ends, bulk free entire region.\n");
+    omni_codegen_emit_raw(ctx, " */\n\n");
+
+    omni_codegen_emit_raw(ctx, "typedef struct Region {\n");
+    omni_codegen_emit_raw(ctx, "    int id;\n");
+    omni_codegen_emit_raw(ctx, "    int external_refcount;  /* Refs from outside this region */\n");
+    omni_codegen_emit_raw(ctx, "    void* arena;            /* Arena allocator for this region */\n");
+    omni_codegen_emit_raw(ctx, "    struct Region* parent;  /* Enclosing region */\n");
+    omni_codegen_emit_raw(ctx, "} Region;\n\n");
+
+    omni_codegen_emit_raw(ctx, "static Region* _current_region = NULL;\n\n");
+
+    omni_codegen_emit_raw(ctx, "static Region* region_new(int id) {\n");
+    omni_codegen_emit_raw(ctx, "    Region* r = malloc(sizeof(Region));\n");
+    omni_codegen_emit_raw(ctx, "    r->id = id;\n");
+    omni_codegen_emit_raw(ctx, "    r->external_refcount = 0;\n");
+    omni_codegen_emit_raw(ctx, "    r->arena = NULL;  /* Could use arena allocator */\n");
+    omni_codegen_emit_raw(ctx, "    r->parent = _current_region;\n");
+    omni_codegen_emit_raw(ctx, "    _current_region = r;\n");
+    omni_codegen_emit_raw(ctx, "    return r;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    omni_codegen_emit_raw(ctx, "static void region_end(Region* r) {\n");
+    omni_codegen_emit_raw(ctx, "    if (!r) return;\n");
+    omni_codegen_emit_raw(ctx, "    _current_region = r->parent;\n");
+    omni_codegen_emit_raw(ctx, "    /* If no external refs, could bulk-free arena here */\n");
+    omni_codegen_emit_raw(ctx, "    if (r->external_refcount == 0) {\n");
+    omni_codegen_emit_raw(ctx, "        /* Safe to bulk free all objects in region */\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    free(r);\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    omni_codegen_emit_raw(ctx, "#define REGION_INC_EXTERNAL(r) do { if (r) (r)->external_refcount++; } while(0)\n");
+    omni_codegen_emit_raw(ctx, "#define REGION_DEC_EXTERNAL(r) do { if (r) (r)->external_refcount--; } while(0)\n");
+    omni_codegen_emit_raw(ctx, "#define REGION_CAN_BULK_FREE(r) ((r) && (r)->external_refcount == 0)\n\n");
+}
+
+static void rt_tether(CodeGenContext* ctx) {
+    /* Borrow/Tether: Keep objects alive during loop iteration */
+    omni_codegen_emit_raw(ctx, "/* Borrow/Tether: Keep borrowed objects alive.\n");
+    omni_codegen_emit_raw(ctx, " * When iterating over a collection, the collection must stay alive.\n");
+    omni_codegen_emit_raw(ctx, " * Tethering increments RC at loop entry, decrements at loop exit.\n");
+    omni_codegen_emit_raw(ctx, " */\n\n");
+
+    omni_codegen_emit_raw(ctx, "/* Tether an object to keep it alive during a borrow */\n");
+    omni_codegen_emit_raw(ctx, "#define TETHER(o) do { if (o) inc_ref(o); } while(0)\n\n");
+
+    omni_codegen_emit_raw(ctx, "/* Release a tether when borrow ends */\n");
+    omni_codegen_emit_raw(ctx, "#define UNTETHER(o) do { if (o) dec_ref(o); } while(0)\n\n");
+
+    omni_codegen_emit_raw(ctx, "/* Borrow a collection for loop iteration */\n");
+    omni_codegen_emit_raw(ctx, "#define BORROW_FOR_LOOP(coll) TETHER(coll)\n\n");
+
+    omni_codegen_emit_raw(ctx, "/* End loop borrow */\n");
+    omni_codegen_emit_raw(ctx, "#define END_LOOP_BORROW(coll) UNTETHER(coll)\n\n");
+
+    omni_codegen_emit_raw(ctx, "/* Scoped tether - automatically releases at scope end */\n");
+    omni_codegen_emit_raw(ctx, "#define SCOPED_TETHER_DECL(name, o) \\\n");
+    omni_codegen_emit_raw(ctx, "    Obj* name##_tethered = (o); \\\n");
+    omni_codegen_emit_raw(ctx, "    TETHER(name##_tethered)\n\n");
+
+    omni_codegen_emit_raw(ctx, "#define SCOPED_TETHER_END(name) \\\n");
+    omni_codegen_emit_raw(ctx, "    UNTETHER(name##_tethered)\n\n");
+}
+
+static void rt_ownership(CodeGenContext* ctx) {
+    /* Interprocedural Ownership Annotations */
+    omni_codegen_emit_raw(ctx, "/* Interprocedural Summaries: Ownership annotations for function boundaries.\n");
+    omni_codegen_emit_raw(ctx, " * These annotations guide the compiler/reader about ownership transfer.\n");
+    omni_codegen_emit_raw(ctx, " * PARAM_BORROWED: Caller keeps ownership, callee borrows.\n");
+    omni_codegen_emit_raw(ctx, " * PARAM_CONSUMED: Callee takes ownership, will free.\n");
+    omni_codegen_emit_raw(ctx, " * PARAM_PASSTHROUGH: Param passes through to return value.\n");
+    omni_codegen_emit_raw(ctx, " * PARAM_CAPTURED: Param is captured in closure/data structure.\n");
+    omni_codegen_emit_raw(ctx, " */\n\n");
+
+    omni_codegen_emit_raw(ctx, "/* Parameter ownership annotations (for documentation) */\n");
+    omni_codegen_emit_raw(ctx, "#define PARAM_BORROWED(p) (p)      /* Borrowed: caller keeps ownership */\n");
+    omni_codegen_emit_raw(ctx, "#define PARAM_CONSUMED(p) (p)      /* Consumed: callee takes ownership */\n");
+    omni_codegen_emit_raw(ctx, "#define PARAM_PASSTHROUGH(p) (p)   /* Passthrough: returned to caller */\n");
+    omni_codegen_emit_raw(ctx, "#define PARAM_CAPTURED(p) (p)      /* Captured: stored in closure/struct */\n\n");
+
+    omni_codegen_emit_raw(ctx, "/* Return ownership annotations */\n");
+    omni_codegen_emit_raw(ctx, "#define RETURN_FRESH(v) (v)        /* Fresh allocation, caller must free */\n");
+    omni_codegen_emit_raw(ctx, "#define RETURN_PASSTHROUGH(v) (v)  /* Returns a parameter, no new alloc */\n");
+    omni_codegen_emit_raw(ctx, "#define RETURN_BORROWED(v) (v)     /* Borrowed ref, don't free */\n");
+    omni_codegen_emit_raw(ctx, "#define RETURN_NONE() NIL          /* Returns nil/void */\n\n");
+
+    omni_codegen_emit_raw(ctx, "/* Caller-side ownership handling */\n");
+    omni_codegen_emit_raw(ctx, "#define CALL_CONSUMED(arg, call_expr) \\\n");
+    omni_codegen_emit_raw(ctx, "    ({ Obj* _result = (call_expr); /* arg ownership transferred */ _result; })\n\n");
+
+    omni_codegen_emit_raw(ctx, "#define CALL_BORROWED(arg, call_expr) \\\n");
+    omni_codegen_emit_raw(ctx, "    ({ Obj* _result = (call_expr); /* caller still owns arg */ _result; })\n\n");
+
+    omni_codegen_emit_raw(ctx, "/* Function summary declaration macro */\n");
+    omni_codegen_emit_raw(ctx, "#define FUNC_SUMMARY(name, ret_own, allocs, side_effects) \\\n");
+    omni_codegen_emit_raw(ctx, "    /* Summary: name returns ret_own, allocates: allocs, side_effects: side_effects */\n\n");
+
+    omni_codegen_emit_raw(ctx, "/* Ownership transfer assertion (debug builds) */\n");
+    omni_codegen_emit_raw(ctx, "#ifndef NDEBUG\n");
+    omni_codegen_emit_raw(ctx, "#define ASSERT_OWNED(o) do { \\\n");
+    omni_codegen_emit_raw(ctx, "    if ((o) && (o) != NIL && (o)->rc < 1) { \\\n");
+    omni_codegen_emit_raw(ctx, "        fprintf(stderr, \"Ownership error: %%p has rc=%%d\\n\", (void*)(o), (o)->rc); \\\n");
+    omni_codegen_emit_raw(ctx, "    } \\\n");
+    omni_codegen_emit_raw(ctx, "} while(0)\n");
+    omni_codegen_emit_raw(ctx, "#else\n");
+    omni_codegen_emit_raw(ctx, "#define ASSERT_OWNED(o) ((void)0)\n");
+    omni_codegen_emit_raw(ctx, "#endif\n\n");
+}
+
+static void rt_concurrency(CodeGenContext* ctx) {
+    /* Concurrency Ownership Inference */
+    omni_codegen_emit_raw(ctx, "/* Concurrency Ownership: Thread-safe reference counting.\n");
+    omni_codegen_emit_raw(ctx, " * THREAD_LOCAL: Data stays in one thread, no sync needed.\n");
+    omni_codegen_emit_raw(ctx, " * THREAD_SHARED: Data accessed by multiple threads, needs atomic RC.\n");
+    omni_codegen_emit_raw(ctx, " * THREAD_TRANSFER: Data transferred via channel, ownership moves.\n");
+    omni_codegen_emit_raw(ctx, " */\n\n");
+
+    omni_codegen_emit_raw(ctx, "/* Atomic reference counting for shared data (see rt_core) */\n");
+    omni_codegen_emit_raw(ctx, "#define ATOMIC_INC_REF(o) atomic_inc_ref(o)\n");
+    omni_codegen_emit_raw(ctx, "#define ATOMIC_DEC_REF(o) atomic_dec_ref(o)\n\n");
+
+    omni_codegen_emit_raw(ctx, "/* Thread locality annotations */\n");
+    omni_codegen_emit_raw(ctx, "#define THREAD_LOCAL_VAR(v) (v)      /* No sync needed */\n");
+    omni_codegen_emit_raw(ctx, "#define THREAD_SHARED_VAR(v) (v)     /* Uses atomic RC */\n");
+    omni_codegen_emit_raw(ctx, "#define THREAD_TRANSFER_VAR(v) (v)   /* Ownership moves */\n\n");
+
+    /* Structured concurrency. A nursery frame is opened by (nursery
+     * body...), which joins the tasks (spawn e) starts, or by (with-cancel
+     * tok body...), which starts none but stops when tok is cancelled.
+     * Cancellation is noticed at safe points and in blocking waits, and
+     * unwinds to the innermost frame the thread owns: its nursery body
+     * while g_nursery_bodies > 0, otherwise its task's entry. */
+    omni_codegen_emit_raw(ctx, "typedef struct OmniTask OmniTask;\n");
+    omni_codegen_emit_raw(ctx, "typedef struct OmniNursery {\n");
+    omni_codegen_emit_raw(ctx, "    jmp_buf jump; pthread_mutex_t lock;\n");
+    omni_codegen_emit_raw(ctx, "    OmniTask* first; OmniTask* last;\n");
+    omni_codegen_emit_raw(ctx, "    int cancelled; int unwound; Obj* failure;\n");
+    omni_codegen_emit_raw(ctx, "    OmniBudget* budget; OmniBudget* unwinding;\n");
+    omni_codegen_emit_raw(ctx, "    Obj* token; int collects;\n");
+    omni_codegen_emit_raw(ctx, "    Obj* output;  /* The current output port when the body began */\n");
+    omni_codegen_emit_raw(ctx, "    struct OmniNursery* parent;\n");
+    omni_codegen_emit_raw(ctx, "} OmniNursery;\n");
+    omni_codegen_emit_raw(ctx, "struct OmniTask {\n");
+    omni_codegen_emit_raw(ctx, "    ClosureFn fn; Obj** captures; int count; Obj* result;\n");
+    omni_codegen_emit_raw(ctx, "    pthread_t thread; int started; jmp_buf jump;\n");
+    omni_codegen_emit_raw(ctx, "    OmniNursery* nursery; struct OmniTask* next;\n");
+    omni_codegen_emit_raw(ctx, "};\n");
+    omni_codegen_emit_raw(ctx, "static __thread OmniNursery* g_nursery = NULL;\n");
+    omni_codegen_emit_raw(ctx, "static __thread OmniTask* g_task = NULL;\n");
+    omni_codegen_emit_raw(ctx, "static __thread int g_nursery_bodies = 0;\n");
+    omni_codegen_emit_raw(ctx, "static __thread struct OmniWaitGroup* g_wait_group = NULL;\n\n");
+
+    /* Tasks, goroutines and futures get threads of their own, or under
+     * PURPLE_SCHEDULER=inline run to their end where they are started,
+     * with the thread-local state a new thread begins with */
+    omni_codegen_emit_raw(ctx, "static int start_thread(pthread_t* thread, void* (*entry)(void*), void* arg, const char* form) {\n");
+    omni_codegen_emit_raw(ctx, "    OMNI_STORE(omni_threaded, 1);\n");
+    omni_codegen_emit_raw(ctx, "    if (pthread_create(thread, NULL, entry, arg) != 0) return 0;\n");
+    omni_codegen_emit_raw(ctx, "    if (omni_log_level >= LOG_DEBUG) fprintf(stderr, \"purple: %%s started a thread\\n\", form);\n");
+    omni_codegen_emit_raw(ctx, "    return 1;\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static void run_inline(void* (*entry)(void*), void* arg, const char* form) {\n");
+    omni_codegen_emit_raw(ctx, "    if (omni_log_level >= LOG_DEBUG) fprintf(stderr, \"purple: %%s runs inline\\n\", form);\n");
+    omni_codegen_emit_raw(ctx, "    OmniNursery* nursery = g_nursery; OmniTask* task = g_task; int bodies = g_nursery_bodies;\n");
+    omni_codegen_emit_raw(ctx, "    OmniBudget* budget = g_budget; Obj* output = g_output; struct OmniWaitGroup* group = g_wait_group;\n");
+    omni_codegen_emit_raw(ctx, "    void (*safe_point)(void) = g_safe_point; void (*budget_jump)(OmniBudget*) = g_budget_jump;\n");
+    omni_codegen_emit_raw(ctx, "    g_nursery = NULL; g_task = NULL; g_nursery_bodies = 0;\n");
+    omni_codegen_emit_raw(ctx, "    g_budget = NULL; g_output = NULL; g_wait_group = NULL;\n");
+    omni_codegen_emit_raw(ctx, "    g_safe_point = NULL; g_budget_jump = NULL;\n");
+    omni_codegen_emit_raw(ctx, "    entry(arg);\n");
+    omni_codegen_emit_raw(ctx, "    g_nursery = nursery; g_task = task; g_nursery_bodies = bodies;\n");
+    omni_codegen_emit_raw(ctx, "    g_budget = budget; g_output = output; g_wait_group = group;\n");
+    omni_codegen_emit_raw(ctx, "    g_safe_point = safe_point; g_budget_jump = budget_jump;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+    omni_codegen_emit_raw(ctx, "static int is_cancel_token(Obj* o) { return o && o != NIL && o->tag == T_CANCEL; }\n");
+    omni_codegen_emit_raw(ctx, "static Obj* prim_make_cancel(void) {\n");
+    omni_codegen_emit_raw(ctx, "    budget_charge();\n");
+    omni_codegen_emit_raw(ctx, "    Obj* o = malloc(sizeof(Obj));\n");
+    omni_codegen_emit_raw(ctx, "    o->tag = T_CANCEL; o->rc = 1; o->i = 0;\n");
+    omni_codegen_emit_raw(ctx, "    return o;\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static Obj* prim_cancel(Obj* tok) {\n");
+    omni_codegen_emit_raw(ctx, "    if (!is_cancel_token(tok)) return mk_error(\"cancel!: not a cancel token\");\n");
+    omni_codegen_emit_raw(ctx, "    __atomic_store_n(&tok->i, 1, __ATOMIC_SEQ_CST);\n");
+    omni_codegen_emit_raw(ctx, "    return NIL;\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static Obj* prim_is_cancelled(Obj* tok) {\n");
+    omni_codegen_emit_raw(ctx, "    if (!is_cancel_token(tok)) return mk_error(\"cancelled?: not a cancel token\");\n");
+    omni_codegen_emit_raw(ctx, "    return mk_int(__atomic_load_n(&tok->i, __ATOMIC_SEQ_CST) != 0);\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+    omni_codegen_emit_raw(ctx, "static int nursery_fail(OmniNursery* n, Obj* err) {\n");
+    omni_codegen_emit_raw(ctx, "    pthread_mutex_lock(&n->lock);\n");
+    omni_codegen_emit_raw(ctx, "    int first = n->failure == NULL;\n");
+    omni_codegen_emit_raw(ctx, "    if (first) n->failure = err;\n");
+    omni_codegen_emit_raw(ctx, "    pthread_mutex_unlock(&n->lock);\n");
+    omni_codegen_emit_raw(ctx, "    __atomic_store_n(&n->cancelled, 1, __ATOMIC_SEQ_CST);\n");
+    omni_codegen_emit_raw(ctx, "    return first;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+    omni_codegen_emit_raw(ctx, "static int cancel_requested(void) {\n");
+    omni_codegen_emit_raw(ctx, "    for (OmniNursery* n = g_nursery; n; n = n->parent) {\n");
+    omni_codegen_emit_raw(ctx, "        if (__atomic_load_n(&n->cancelled, __ATOMIC_SEQ_CST)) return 1;\n");
+    omni_codegen_emit_raw(ctx, "        if (n->token && __atomic_load_n(&n->token->i, __ATOMIC_SEQ_CST)) return 1;\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    return 0;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+    omni_codegen_emit_raw(ctx, "static void nursery_safe_point(void) {\n");
+    omni_codegen_emit_raw(ctx, "    if (!g_nursery || !cancel_requested()) return;\n");
+    omni_codegen_emit_raw(ctx, "    if (g_nursery_bodies > 0) {\n");
+    omni_codegen_emit_raw(ctx, "        g_budget = g_nursery->budget; g_nursery->unwound = 1;\n");
+    omni_codegen_emit_raw(ctx, "        longjmp(g_nursery->jump, 1);\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    if (!g_task) return;\n");
+    omni_codegen_emit_raw(ctx, "    g_budget = NULL;\n");
+    omni_codegen_emit_raw(ctx, "    longjmp(g_task->jump, 1);\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static void omni_cancel_point(void) { nursery_safe_point(); }\n\n");
+    omni_codegen_emit_raw(ctx, "#define CANCEL_POLL_MS 10\n");
+    omni_codegen_emit_raw(ctx, "static int wait_or_cancel(pthread_cond_t* cond, pthread_mutex_t* lock) {\n");
+    omni_codegen_emit_raw(ctx, "    if (!g_nursery) { pthread_cond_wait(cond, lock); return 1; }\n");
+    omni_codegen_emit_raw(ctx, "    if (cancel_requested()) return 0;\n");
+    omni_codegen_emit_raw(ctx, "    struct timespec ts;\n");
+    omni_codegen_emit_raw(ctx, "    clock_gettime(CLOCK_REALTIME, &ts);\n");
+    omni_codegen_emit_raw(ctx, "    ts.tv_nsec += CANCEL_POLL_MS * 1000000L;\n");
+    omni_codegen_emit_raw(ctx, "    if (ts.tv_nsec >= 1000000000L) { ts.tv_sec++; ts.tv_nsec -= 1000000000L; }\n");
+    omni_codegen_emit_raw(ctx, "    pthread_cond_timedwait(cond, lock, &ts);\n");
+    omni_codegen_emit_raw(ctx, "    return !cancel_requested();\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+    omni_codegen_emit_raw(ctx, "static void nursery_budget_jump(OmniBudget* hit) {\n");
+    omni_codegen_emit_raw(ctx, "    if (g_nursery_bodies == 0) return;\n");
+    omni_codegen_emit_raw(ctx, "    for (OmniBudget* b = g_nursery->budget; b; b = b->outer) {\n");
+    omni_codegen_emit_raw(ctx, "        if (b != hit) continue;\n");
+    omni_codegen_emit_raw(ctx, "        g_nursery->unwinding = hit;\n");
+    omni_codegen_emit_raw(ctx, "        __atomic_store_n(&g_nursery->cancelled, 1, __ATOMIC_SEQ_CST);\n");
+    omni_codegen_emit_raw(ctx, "        g_budget = g_nursery->budget;\n");
+    omni_codegen_emit_raw(ctx, "        longjmp(g_nursery->jump, 1);\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+    omni_codegen_emit_raw(ctx, "static void* task_entry(void* arg) {\n");
+    omni_codegen_emit_raw(ctx, "    OmniTask* t = (OmniTask*)arg;\n");
+    omni_codegen_emit_raw(ctx, "    Obj* result;\n");
+    omni_codegen_emit_raw(ctx, "    g_task = t; g_nursery = t->nursery;\n");
+    omni_codegen_emit_raw(ctx, "    g_safe_point = nursery_safe_point; g_budget_jump = nursery_budget_jump;\n");
+    /* The inline scheduler runs tasks on the spawning thread */
+    if (ctx->crash_handler) omni_codegen_emit_raw(ctx, "    int depth = purple_shadow_depth();\n");
+    omni_codegen_emit_raw(ctx, "    if (setjmp(t->jump)) {\n");
+    if (ctx->crash_handler) omni_codegen_emit_raw(ctx, "        purple_shadow_restore(depth);\n");
+    omni_codegen_emit_raw(ctx, "        g_nursery = NULL;\n");
+    omni_codegen_emit_raw(ctx, "        result = mk_error(\"cancelled\");\n");
+    omni_codegen_emit_raw(ctx, "    } else {\n");
+    omni_codegen_emit_raw(ctx, "        result = t->fn(t->captures, NULL, 0);\n");
+    omni_codegen_emit_raw(ctx, "        g_nursery = NULL;\n");
+    omni_codegen_emit_raw(ctx, "        if (result && result != NIL && result->tag == T_ERROR) nursery_fail(t->nursery, result);\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    g_task = NULL;\n");
+    omni_codegen_emit_raw(ctx, "    t->result = result;\n");
+    omni_codegen_emit_raw(ctx, "    return NULL;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+    omni_codegen_emit_raw(ctx, "static void nursery_open(OmniNursery* n, Obj* token, int collects) {\n");
+    omni_codegen_emit_raw(ctx, "    pthread_mutex_init(&n->lock, NULL);\n");
+    omni_codegen_emit_raw(ctx, "    n->first = n->last = NULL;\n");
+    omni_codegen_emit_raw(ctx, "    n->cancelled = 0; n->unwound = 0; n->failure = NULL;\n");
+    omni_codegen_emit_raw(ctx, "    n->budget = g_budget; n->unwinding = NULL;\n");
+    omni_codegen_emit_raw(ctx, "    n->token = token; n->collects = collects; n->output = g_output;\n");
+    omni_codegen_emit_raw(ctx, "    n->parent = g_nursery; g_nursery = n; g_nursery_bodies++;\n");
+    omni_codegen_emit_raw(ctx, "    g_safe_point = nursery_safe_point; g_budget_jump = nursery_budget_jump;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+    omni_codegen_emit_raw(ctx, "static void nursery_close(OmniNursery* n) {\n");
+    omni_codegen_emit_raw(ctx, "    g_nursery = n->parent; g_nursery_bodies--; g_output = n->output;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+    omni_codegen_emit_raw(ctx, "static void nursery_resume_unwind(OmniBudget* hit) {\n");
+    omni_codegen_emit_raw(ctx, "    nursery_budget_jump(hit);\n");
+    omni_codegen_emit_raw(ctx, "    g_budget = hit->outer; longjmp(hit->jump, 1);\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+    omni_codegen_emit_raw(ctx, "static void omni_nursery_enter(OmniNursery* n) { nursery_open(n, NULL, 1); }\n\n");
+    omni_codegen_emit_raw(ctx, "static int omni_cancel_enter(OmniNursery* n, Obj* token) {\n");
+    omni_codegen_emit_raw(ctx, "    if (!is_cancel_token(token)) return 0;\n");
+    omni_codegen_emit_raw(ctx, "    nursery_open(n, token, 0);\n");
+    omni_codegen_emit_raw(ctx, "    return 1;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+    omni_codegen_emit_raw(ctx, "static Obj* omni_cancel_leave(OmniNursery* n, Obj* value) {\n");
+    omni_codegen_emit_raw(ctx, "    nursery_close(n);\n");
+    omni_codegen_emit_raw(ctx, "    pthread_mutex_destroy(&n->lock);\n");
+    omni_codegen_emit_raw(ctx, "    if (n->unwinding) nursery_resume_unwind(n->unwinding);\n");
+    omni_codegen_emit_raw(ctx, "    if (!n->unwound) return value;\n");
+    omni_codegen_emit_raw(ctx, "    dec_ref(value);\n");
+    omni_codegen_emit_raw(ctx, "    return mk_error(\"cancelled\");\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+    omni_codegen_emit_raw(ctx, "static Obj* omni_spawn(ClosureFn fn, Obj** captures, int count) {\n");
+    omni_codegen_emit_raw(ctx, "    OmniNursery* n = g_nursery;\n");
+    omni_codegen_emit_raw(ctx, "    while (n && !n->collects) n = n->parent;\n");
+    omni_codegen_emit_raw(ctx, "    if (!n) return mk_error(\"spawn: not inside a nursery\");\n");
+    omni_codegen_emit_raw(ctx, "    OmniTask* t = calloc(1, sizeof(OmniTask));\n");
+    omni_codegen_emit_raw(ctx, "    t->fn = fn; t->count = count; t->nursery = n;\n");
+    omni_codegen_emit_raw(ctx, "    if (count > 0) t->captures = malloc(count * sizeof(Obj*));\n");
+    omni_codegen_emit_raw(ctx, "    for (int i = 0; i < count; i++) {\n");
+    omni_codegen_emit_raw(ctx, "        share_obj(captures[i]);\n");
+    omni_codegen_emit_raw(ctx, "        t->captures[i] = captures[i]; inc_ref(captures[i]);\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    int runs_inline = omni_scheduler == SCHED_INLINE;\n");
+    omni_codegen_emit_raw(ctx, "    pthread_mutex_lock(&n->lock);\n");
+    omni_codegen_emit_raw(ctx, "    if (n->last) n->last->next = t; else n->first = t;\n");
+    omni_codegen_emit_raw(ctx, "    n->last = t;\n");
+    omni_codegen_emit_raw(ctx, "    if (!runs_inline) t->started = start_thread(&t->thread, task_entry, t, \"spawn\");\n");
+    omni_codegen_emit_raw(ctx, "    pthread_mutex_unlock(&n->lock);\n");
+    omni_codegen_emit_raw(ctx, "    if (runs_inline) {\n");
+    omni_codegen_emit_raw(ctx, "        run_inline(task_entry, t, \"spawn\");\n");
+    omni_codegen_emit_raw(ctx, "    } else if (!t->started) {\n");
+    omni_codegen_emit_raw(ctx, "        t->result = mk_error(\"spawn: cannot start a thread\");\n");
+    omni_codegen_emit_raw(ctx, "        nursery_fail(n, t->result);\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    return NIL;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+    omni_codegen_emit_raw(ctx, "static Obj* omni_nursery_leave(OmniNursery* n, Obj* value) {\n");
+    omni_codegen_emit_raw(ctx, "    nursery_close(n);\n");
+    omni_codegen_emit_raw(ctx, "    if (value && value != NIL && value->tag == T_ERROR) { if (!nursery_fail(n, value)) dec_ref(value); }\n");
+    omni_codegen_emit_raw(ctx, "    else dec_ref(value);\n");
+    omni_codegen_emit_raw(ctx, "    int count = 0;\n");
+    omni_codegen_emit_raw(ctx, "    pthread_mutex_lock(&n->lock);\n");
+    omni_codegen_emit_raw(ctx, "    OmniTask* t = n->first;\n");
+    omni_codegen_emit_raw(ctx, "    pthread_mutex_unlock(&n->lock);\n");
+    omni_codegen_emit_raw(ctx, "    while (t) {\n");
+    omni_codegen_emit_raw(ctx, "        if (t->started) pthread_join(t->thread, NULL);\n");
+    omni_codegen_emit_raw(ctx, "        count++;\n");
+    omni_codegen_emit_raw(ctx, "        pthread_mutex_lock(&n->lock);\n");
+    omni_codegen_emit_raw(ctx, "        t = t->next;\n");
+    omni_codegen_emit_raw(ctx, "        pthread_mutex_unlock(&n->lock);\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    int keep = !n->failure && !n->unwound && !n->unwinding;\n");
+    omni_codegen_emit_raw(ctx, "    Obj** results = malloc((count > 0 ? count : 1) * sizeof(Obj*));\n");
+    omni_codegen_emit_raw(ctx, "    int i = 0;\n");
+    omni_codegen_emit_raw(ctx, "    for (t = n->first; t; ) {\n");
+    omni_codegen_emit_raw(ctx, "        OmniTask* next = t->next;\n");
+    omni_codegen_emit_raw(ctx, "        results[i++] = t->result;\n");
+    omni_codegen_emit_raw(ctx, "        if (!keep && t->result != n->failure) dec_ref(t->result);\n");
+    omni_codegen_emit_raw(ctx, "        for (int j = 0; j < t->count; j++) dec_ref(t->captures[j]);\n");
+    omni_codegen_emit_raw(ctx, "        free(t->captures); free(t);\n");
+    omni_codegen_emit_raw(ctx, "        t = next;\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    pthread_mutex_destroy(&n->lock);\n");
+    omni_codegen_emit_raw(ctx, "    if (n->unwinding) {\n");
+    omni_codegen_emit_raw(ctx, "        free(results);\n");
+    omni_codegen_emit_raw(ctx, "        if (n->failure) dec_ref(n->failure);\n");
+    omni_codegen_emit_raw(ctx, "        nursery_resume_unwind(n->unwinding);\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    Obj* out = NIL;\n");
+    omni_codegen_emit_raw(ctx, "    if (n->failure) out = n->failure;\n");
+    omni_codegen_emit_raw(ctx, "    else if (n->unwound) out = mk_error(\"cancelled\");\n");
+    omni_codegen_emit_raw(ctx, "    else for (i = count; i > 0; i--) out = mk_cell(results[i - 1], out);\n");
+    omni_codegen_emit_raw(ctx, "    free(results);\n");
+    omni_codegen_emit_raw(ctx, "    return out;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    /* Goroutines. (go body...) runs body on a detached thread; an
+     * enclosing (wait-group body...) counts it, and the goroutines it
+     * starts, and waits for them all before returning. Captures marked
+     * in shared are counted atomically, since the goroutine releases
+     * them on its own thread while the starter may still use them. */
+    omni_codegen_emit_raw(ctx, "typedef struct OmniWaitGroup {\n");
+    omni_codegen_emit_raw(ctx, "    pthread_mutex_t lock; pthread_cond_t done;\n");
+    omni_codegen_emit_raw(ctx, "    int pending;\n");
+    omni_codegen_emit_raw(ctx, "    struct OmniWaitGroup* parent;\n");
+    omni_codegen_emit_raw(ctx, "} OmniWaitGroup;\n");
+    omni_codegen_emit_raw(ctx, "typedef struct OmniGoroutine {\n");
+    omni_codegen_emit_raw(ctx, "    ClosureFn fn; Obj** captures; int count; uint64_t shared;\n");
+    omni_codegen_emit_raw(ctx, "    OmniWaitGroup* group;\n");
+    omni_codegen_emit_raw(ctx, "} OmniGoroutine;\n");
+    omni_codegen_emit_raw(ctx, "\n");
+    omni_codegen_emit_raw(ctx, "static void wait_group_done(OmniWaitGroup* w) {\n");
+    omni_codegen_emit_raw(ctx, "    if (!w) return;\n");
+    omni_codegen_emit_raw(ctx, "    pthread_mutex_lock(&w->lock);\n");
+    omni_codegen_emit_raw(ctx, "    if (--w->pending == 0) pthread_cond_broadcast(&w->done);\n");
+    omni_codegen_emit_raw(ctx, "    pthread_mutex_unlock(&w->lock);\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static void goroutine_free(OmniGoroutine* g) {\n");
+    omni_codegen_emit_raw(ctx, "    for (int i = 0; i < g->count; i++) {\n");
+    omni_codegen_emit_raw(ctx, "        if (g->shared >> i & 1) ATOMIC_DEC_REF(g->captures[i]);\n");
+    omni_codegen_emit_raw(ctx, "        else dec_ref(g->captures[i]);\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    free(g->captures); free(g);\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static void* goroutine_entry(void* arg) {\n");
+    omni_codegen_emit_raw(ctx, "    OmniGoroutine* g = (OmniGoroutine*)arg;\n");
+    omni_codegen_emit_raw(ctx, "    OmniWaitGroup* w = g->group;\n");
+    omni_codegen_emit_raw(ctx, "    g_wait_group = w;\n");
+    omni_codegen_emit_raw(ctx, "    dec_ref(g->fn(g->captures, NULL, 0));\n");
+    omni_codegen_emit_raw(ctx, "    goroutine_free(g);\n");
+    omni_codegen_emit_raw(ctx, "    wait_group_done(w);\n");
+    omni_codegen_emit_raw(ctx, "    return NULL;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+    omni_codegen_emit_raw(ctx, "static Obj* omni_go(ClosureFn fn, Obj** captures, int count, uint64_t shared) {\n");
+    omni_codegen_emit_raw(ctx, "    OmniGoroutine* g = calloc(1, sizeof(OmniGoroutine));\n");
+    omni_codegen_emit_raw(ctx, "    if (!g) return mk_error(\"go: out of memory\");\n");
+    omni_codegen_emit_raw(ctx, "    g->fn = fn; g->count = count; g->shared = shared; g->group = g_wait_group;\n");
+    omni_codegen_emit_raw(ctx, "    if (count > 0) g->captures = malloc(count * sizeof(Obj*));\n");
+    omni_codegen_emit_raw(ctx, "    for (int i = 0; i < count; i++) {\n");
+    omni_codegen_emit_raw(ctx, "        share_obj(captures[i]);\n");
+    omni_codegen_emit_raw(ctx, "        g->captures[i] = captures[i];\n");
+    omni_codegen_emit_raw(ctx, "        if (shared >> i & 1) ATOMIC_INC_REF(captures[i]); else inc_ref(captures[i]);\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    if (g->group) {\n");
+    omni_codegen_emit_raw(ctx, "        pthread_mutex_lock(&g->group->lock);\n");
+    omni_codegen_emit_raw(ctx, "        g->group->pending++;\n");
+    omni_codegen_emit_raw(ctx, "        pthread_mutex_unlock(&g->group->lock);\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    if (omni_scheduler == SCHED_INLINE) {\n");
+    omni_codegen_emit_raw(ctx, "        run_inline(goroutine_entry, g, \"go\");\n");
+    omni_codegen_emit_raw(ctx, "        return NIL;\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    pthread_t thread;\n");
+    omni_codegen_emit_raw(ctx, "    if (!start_thread(&thread, goroutine_entry, g, \"go\")) {\n");
+    omni_codegen_emit_raw(ctx, "        OmniWaitGroup* w = g->group;\n");
+    omni_codegen_emit_raw(ctx, "        goroutine_free(g);\n");
+    omni_codegen_emit_raw(ctx, "        wait_group_done(w);\n");
+    omni_codegen_emit_raw(ctx, "        return mk_error(\"go: cannot start a thread\");\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    pthread_detach(thread);\n");
+    omni_codegen_emit_raw(ctx, "    return NIL;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+    omni_codegen_emit_raw(ctx, "static void omni_wait_group_enter(OmniWaitGroup* w) {\n");
+    omni_codegen_emit_raw(ctx, "    pthread_mutex_init(&w->lock, NULL);\n");
+    omni_codegen_emit_raw(ctx, "    pthread_cond_init(&w->done, NULL);\n");
+    omni_codegen_emit_raw(ctx, "    w->pending = 0; w->parent = g_wait_group; g_wait_group = w;\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static Obj* omni_wait_group_leave(OmniWaitGroup* w, Obj* value) {\n");
+    omni_codegen_emit_raw(ctx, "    g_wait_group = w->parent;\n");
+    omni_codegen_emit_raw(ctx, "    pthread_mutex_lock(&w->lock);\n");
+    omni_codegen_emit_raw(ctx, "    while (w->pending > 0) pthread_cond_wait(&w->done, &w->lock);\n");
+    omni_codegen_emit_raw(ctx, "    pthread_mutex_unlock(&w->lock);\n");
+    omni_codegen_emit_raw(ctx, "    pthread_mutex_destroy(&w->lock);\n");
+    omni_codegen_emit_raw(ctx, "    pthread_cond_destroy(&w->done);\n");
+    omni_codegen_emit_raw(ctx, "    return value;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    omni_codegen_emit_raw(ctx, "/* Channel operations - ownership transfer semantics.\n");
+    omni_codegen_emit_raw(ctx, " * Capacity 0 is unbuffered: a send completes only once a receiver has\n");
+    omni_codegen_emit_raw(ctx, " * taken the value, so sender and receiver rendezvous. */\n");
+    omni_codegen_emit_raw(ctx, "typedef struct Channel {\n");
+    omni_codegen_emit_raw(ctx, "    Obj** buffer;\n");
+    omni_codegen_emit_raw(ctx, "    size_t capacity;\n");
+    omni_codegen_emit_raw(ctx, "    size_t head, tail, count;\n");
+    omni_codegen_emit_raw(ctx, "    Obj* slot;                  /* Unbuffered handoff */\n");
+    omni_codegen_emit_raw(ctx, "    int has_slot;\n");
+    omni_codegen_emit_raw(ctx, "    size_t waiting_receivers;\n");
+    omni_codegen_emit_raw(ctx, "    unsigned long handoffs;     /* Values taken from the slot */\n");
+    omni_codegen_emit_raw(ctx, "    pthread_mutex_t mutex;\n");
+    omni_codegen_emit_raw(ctx, "    pthread_cond_t not_empty;\n");
+    omni_codegen_emit_raw(ctx, "    pthread_cond_t not_full;\n");
+    omni_codegen_emit_raw(ctx, "    int closed;\n");
+    omni_codegen_emit_raw(ctx, "} Channel;\n\n");
+
+    omni_codegen_emit_raw(ctx, "static Channel* channel_new(size_t capacity) {\n");
+    omni_codegen_emit_raw(ctx, "    Channel* c = malloc(sizeof(Channel));\n");
+    omni_codegen_emit_raw(ctx, "    c->buffer = capacity > 0 ? malloc(capacity * sizeof(Obj*)) : NULL;\n");
+    omni_codegen_emit_raw(ctx, "    c->capacity = capacity;\n");
+    omni_codegen_emit_raw(ctx, "    c->head = c->tail = c->count = 0;\n");
+    omni_codegen_emit_raw(ctx, "    c->slot = NULL;\n");
+    omni_codegen_emit_raw(ctx, "    c->has_slot = 0;\n");
+    omni_codegen_emit_raw(ctx, "    c->waiting_receivers = 0;\n");
+    omni_codegen_emit_raw(ctx, "    c->handoffs = 0;\n");
+    omni_codegen_emit_raw(ctx, "    pthread_mutex_init(&c->mutex, NULL);\n");
+    omni_codegen_emit_raw(ctx, "    pthread_cond_init(&c->not_empty, NULL);\n");
+    omni_codegen_emit_raw(ctx, "    pthread_cond_init(&c->not_full, NULL);\n");
+    omni_codegen_emit_raw(ctx, "    c->closed = 0;\n");
+    omni_codegen_emit_raw(ctx, "    return c;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    omni_codegen_emit_raw(ctx, "/* Unbuffered send: wait for a receiver and a free slot, hand the value\n");
+    omni_codegen_emit_raw(ctx, " * over, then wait until it is taken. If the channel closes first the\n");
+    omni_codegen_emit_raw(ctx, " * value is withdrawn and stays with the sender. */\n");
+    omni_codegen_emit_raw(ctx, "static int channel_send_unbuffered(Channel* c, Obj* value) {\n");
+    omni_codegen_emit_raw(ctx, "    while ((c->has_slot || c->waiting_receivers == 0) && !c->closed) {\n");
+    omni_codegen_emit_raw(ctx, "        pthread_cond_wait(&c->not_full, &c->mutex);\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    if (c->closed) return 0;\n");
+    omni_codegen_emit_raw(ctx, "    unsigned long ticket = c->handoffs;\n");
+    omni_codegen_emit_raw(ctx, "    c->slot = value;  /* Ownership transfers */\n");
+    omni_codegen_emit_raw(ctx, "    c->has_slot = 1;\n");
+    omni_codegen_emit_raw(ctx, "    pthread_cond_broadcast(&c->not_empty);\n");
+    omni_codegen_emit_raw(ctx, "    while (c->handoffs == ticket && !c->closed) {\n");
+    omni_codegen_emit_raw(ctx, "        pthread_cond_wait(&c->not_full, &c->mutex);\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    if (c->handoffs != ticket) return 1;\n");
+    omni_codegen_emit_raw(ctx, "    c->slot = NULL;\n");
+    omni_codegen_emit_raw(ctx, "    c->has_slot = 0;\n");
+    omni_codegen_emit_raw(ctx, "    return 0;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    omni_codegen_emit_raw(ctx, "/* Send transfers ownership - sender must NOT free after.\n");
+    omni_codegen_emit_raw(ctx, " * Returns 0 if the channel is closed; the sender then keeps the value. */\n");
+    omni_codegen_emit_raw(ctx, "static int channel_send(Channel* c, Obj* value) {\n");
+    omni_codegen_emit_raw(ctx, "    int sent = 0;\n");
+    omni_codegen_emit_raw(ctx, "    share_obj(value);\n");
+    omni_codegen_emit_raw(ctx, "    pthread_mutex_lock(&c->mutex);\n");
+    omni_codegen_emit_raw(ctx, "    if (c->capacity == 0) {\n");
+    omni_codegen_emit_raw(ctx, "        sent = channel_send_unbuffered(c, value);\n");
+    omni_codegen_emit_raw(ctx, "        pthread_mutex_unlock(&c->mutex);\n");
+    omni_codegen_emit_raw(ctx, "        return sent;\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    while (c->count == c->capacity && !c->closed) {\n");
+    omni_codegen_emit_raw(ctx, "        pthread_cond_wait(&c->not_full, &c->mutex);\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    if (!c->closed) {\n");
+    omni_codegen_emit_raw(ctx, "        c->buffer[c->tail] = value;  /* Ownership transfers */\n");
+    omni_codegen_emit_raw(ctx, "        c->tail = (c->tail + 1) %% c->capacity;\n");
+    omni_codegen_emit_raw(ctx, "        c->count++;\n");
+    omni_codegen_emit_raw(ctx, "        sent = 1;\n");
+    omni_codegen_emit_raw(ctx, "        pthread_cond_signal(&c->not_empty);\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    pthread_mutex_unlock(&c->mutex);\n");
+    omni_codegen_emit_raw(ctx, "    return sent;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    omni_codegen_emit_raw(ctx, "/* Recv receives ownership - receiver must free when done. Inside a\n");
+    omni_codegen_emit_raw(ctx, " * nursery or with-cancel, a cancelled wait returns (error 'cancelled). */\n");
+    omni_codegen_emit_raw(ctx, "static Obj* channel_recv(Channel* c) {\n");
+    omni_codegen_emit_raw(ctx, "    pthread_mutex_lock(&c->mutex);\n");
+    omni_codegen_emit_raw(ctx, "    Obj* value = NIL;\n");
+    omni_codegen_emit_raw(ctx, "    if (c->capacity == 0) {\n");
+    omni_codegen_emit_raw(ctx, "        c->waiting_receivers++;\n");
+    omni_codegen_emit_raw(ctx, "        pthread_cond_broadcast(&c->not_full);\n");
+    omni_codegen_emit_raw(ctx, "        while (!c->has_slot && !c->closed) {\n");
+    omni_codegen_emit_raw(ctx, "            if (!wait_or_cancel(&c->not_empty, &c->mutex) && !c->has_slot) {\n");
+    omni_codegen_emit_raw(ctx, "                c->waiting_receivers--;\n");
+    omni_codegen_emit_raw(ctx, "                pthread_mutex_unlock(&c->mutex);\n");
+    omni_codegen_emit_raw(ctx, "                return mk_error(\"cancelled\");\n");
+    omni_codegen_emit_raw(ctx, "            }\n");
+    omni_codegen_emit_raw(ctx, "        }\n");
+    omni_codegen_emit_raw(ctx, "        c->waiting_receivers--;\n");
+    omni_codegen_emit_raw(ctx, "        if (c->has_slot) {\n");
+    omni_codegen_emit_raw(ctx, "            value = c->slot;  /* Ownership transfers */\n");
+    omni_codegen_emit_raw(ctx, "            c->slot = NULL;\n");
+    omni_codegen_emit_raw(ctx, "            c->has_slot = 0;\n");
+    omni_codegen_emit_raw(ctx, "            c->handoffs++;\n");
+    omni_codegen_emit_raw(ctx, "            pthread_cond_broadcast(&c->not_full);\n");
+    omni_codegen_emit_raw(ctx, "        }\n");
+    omni_codegen_emit_raw(ctx, "        pthread_mutex_unlock(&c->mutex);\n");
+    omni_codegen_emit_raw(ctx, "        return value;\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    while (c->count == 0 && !c->closed) {\n");
+    omni_codegen_emit_raw(ctx, "        if (!wait_or_cancel(&c->not_empty, &c->mutex)) {\n");
+    omni_codegen_emit_raw(ctx, "            pthread_mutex_unlock(&c->mutex);\n");
+    omni_codegen_emit_raw(ctx, "            return mk_error(\"cancelled\");\n");
+    omni_codegen_emit_raw(ctx, "        }\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    if (c->count > 0) {\n");
+    omni_codegen_emit_raw(ctx, "        value = c->buffer[c->head];  /* Ownership transfers */\n");
+    omni_codegen_emit_raw(ctx, "        c->head = (c->head + 1) %% c->capacity;\n");
+    omni_codegen_emit_raw(ctx, "        c->count--;\n");
+    omni_codegen_emit_raw(ctx, "        pthread_cond_signal(&c->not_full);\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    pthread_mutex_unlock(&c->mutex);\n");
+    omni_codegen_emit_raw(ctx, "    return value;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    omni_codegen_emit_raw(ctx, "static void channel_close(Channel* c) {\n");
+    omni_codegen_emit_raw(ctx, "    pthread_mutex_lock(&c->mutex);\n");
+    omni_codegen_emit_raw(ctx, "    c->closed = 1;\n");
+    omni_codegen_emit_raw(ctx, "    pthread_cond_broadcast(&c->not_empty);\n");
+    omni_codegen_emit_raw(ctx, "    pthread_cond_broadcast(&c->not_full);\n");
+    omni_codegen_emit_raw(ctx, "    pthread_mutex_unlock(&c->mutex);\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    omni_codegen_emit_raw(ctx, "static void channel_free(Channel* c) {\n");
+    omni_codegen_emit_raw(ctx, "    if (!c) return;\n");
+    omni_codegen_emit_raw(ctx, "    /* Free any remaining items in buffer */\n");
+    omni_codegen_emit_raw(ctx, "    while (c->count > 0) {\n");
+    omni_codegen_emit_raw(ctx, "        free_obj(c->buffer[c->head]);\n");
+    omni_codegen_emit_raw(ctx, "        c->head = (c->head + 1) %% c->capacity;\n");
+    omni_codegen_emit_raw(ctx, "        c->count--;\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    if (c->has_slot) free_obj(c->slot);\n");
+    omni_codegen_emit_raw(ctx, "    free(c->buffer);\n");
+    omni_codegen_emit_raw(ctx, "    pthread_mutex_destroy(&c->mutex);\n");
+    omni_codegen_emit_raw(ctx, "    pthread_cond_destroy(&c->not_empty);\n");
+    omni_codegen_emit_raw(ctx, "    pthread_cond_destroy(&c->not_full);\n");
+    omni_codegen_emit_raw(ctx, "    free(c);\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    /* Futures: (future expr) runs the lifted expr on its own thread. The
+     * result is kept in the promise and each await returns a new
+     * reference; the first await joins the thread, and the captures live
+     * until the promise is freed. */
+    omni_codegen_emit_raw(ctx, "typedef struct Promise {\n");
+    omni_codegen_emit_raw(ctx, "    pthread_t thread;\n");
+    omni_codegen_emit_raw(ctx, "    pthread_mutex_t lock;\n");
+    omni_codegen_emit_raw(ctx, "    pthread_cond_t cond;\n");
+    omni_codegen_emit_raw(ctx, "    int done;\n");
+    omni_codegen_emit_raw(ctx, "    Obj* result;\n");
+    omni_codegen_emit_raw(ctx, "    ClosureFn fn;\n");
+    omni_codegen_emit_raw(ctx, "    Obj** captures;\n");
+    omni_codegen_emit_raw(ctx, "    int count;\n");
+    omni_codegen_emit_raw(ctx, "    int ran_inline;  /* No thread to join */\n");
+    omni_codegen_emit_raw(ctx, "    int joined;  /* By the first await after done */\n");
+    omni_codegen_emit_raw(ctx, "} Promise;\n\n");
+    omni_codegen_emit_raw(ctx, "static void* future_entry(void* arg) {\n");
+    omni_codegen_emit_raw(ctx, "    Promise* p = (Promise*)arg;\n");
+    omni_codegen_emit_raw(ctx, "    Obj* result = p->fn(p->captures, NULL, 0);\n");
+    omni_codegen_emit_raw(ctx, "    pthread_mutex_lock(&p->lock);\n");
+    omni_codegen_emit_raw(ctx, "    p->result = result; p->done = 1;\n");
+    omni_codegen_emit_raw(ctx, "    pthread_cond_broadcast(&p->cond);\n");
+    omni_codegen_emit_raw(ctx, "    pthread_mutex_unlock(&p->lock);\n");
+    omni_codegen_emit_raw(ctx, "    return NULL;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+    omni_codegen_emit_raw(ctx, "static void promise_release(Promise* p) {\n");
+    omni_codegen_emit_raw(ctx, "    for (int i = 0; i < p->count; i++) dec_ref(p->captures[i]);\n");
+    omni_codegen_emit_raw(ctx, "    free(p->captures);\n");
+    omni_codegen_emit_raw(ctx, "    pthread_mutex_destroy(&p->lock);\n");
+    omni_codegen_emit_raw(ctx, "    pthread_cond_destroy(&p->cond);\n");
+    omni_codegen_emit_raw(ctx, "    free(p);\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+    omni_codegen_emit_raw(ctx, "static void free_promise(Promise* p) {\n");
+    omni_codegen_emit_raw(ctx, "    if (!p->ran_inline && !p->joined) pthread_join(p->thread, NULL);\n");
+    omni_codegen_emit_raw(ctx, "    dec_ref(p->result);\n");
+    omni_codegen_emit_raw(ctx, "    promise_release(p);\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+    omni_codegen_emit_raw(ctx, "static Obj* omni_future(ClosureFn fn, Obj** captures, int count) {\n");
+    omni_codegen_emit_raw(ctx, "    Promise* p = calloc(1, sizeof(Promise));\n");
+    omni_codegen_emit_raw(ctx, "    if (!p) return mk_error(\"future: out of memory\");\n");
+    omni_codegen_emit_raw(ctx, "    pthread_mutex_init(&p->lock, NULL);\n");
+    omni_codegen_emit_raw(ctx, "    pthread_cond_init(&p->cond, NULL);\n");
+    omni_codegen_emit_raw(ctx, "    p->fn = fn; p->count = count;\n");
+    omni_codegen_emit_raw(ctx, "    if (count > 0) p->captures = malloc(count * sizeof(Obj*));\n");
+    omni_codegen_emit_raw(ctx, "    for (int i = 0; i < count; i++) {\n");
+    omni_codegen_emit_raw(ctx, "        share_obj(captures[i]);\n");
+    omni_codegen_emit_raw(ctx, "        p->captures[i] = captures[i]; inc_ref(captures[i]);\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    Obj* o = malloc(sizeof(Obj));\n");
+    omni_codegen_emit_raw(ctx, "    if (o && omni_scheduler == SCHED_INLINE) {\n");
+    omni_codegen_emit_raw(ctx, "        p->ran_inline = 1;\n");
+    omni_codegen_emit_raw(ctx, "        run_inline(future_entry, p, \"future\");\n");
+    omni_codegen_emit_raw(ctx, "    } else if (!o || !start_thread(&p->thread, future_entry, p, \"future\")) {\n");
+    omni_codegen_emit_raw(ctx, "        free(o); promise_release(p);\n");
+    omni_codegen_emit_raw(ctx, "        return mk_error(\"future: cannot start a thread\");\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    o->tag = T_PROMISE; o->rc = 1; o->promise = p;\n");
+    omni_codegen_emit_raw(ctx, "    g_free_promise = free_promise;\n");
+    omni_codegen_emit_raw(ctx, "    return o;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+    omni_codegen_emit_raw(ctx, "static int is_promise(Obj* o) { return o && o != NIL && o->tag == T_PROMISE; }\n");
+    omni_codegen_emit_raw(ctx, "static Obj* promise_await(Promise* p) {\n");
+    omni_codegen_emit_raw(ctx, "    pthread_mutex_lock(&p->lock);\n");
+    omni_codegen_emit_raw(ctx, "    while (!p->done) {\n");
+    omni_codegen_emit_raw(ctx, "        if (!wait_or_cancel(&p->cond, &p->lock)) {\n");
+    omni_codegen_emit_raw(ctx, "            pthread_mutex_unlock(&p->lock);\n");
+    omni_codegen_emit_raw(ctx, "            return mk_error(\"cancelled\");\n");
+    omni_codegen_emit_raw(ctx, "        }\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    if (!p->ran_inline && !p->joined) { pthread_join(p->thread, NULL); p->joined = 1; }\n");
+    omni_codegen_emit_raw(ctx, "    Obj* result = p->result;\n");
+    omni_codegen_emit_raw(ctx, "    inc_ref(result);\n");
+    omni_codegen_emit_raw(ctx, "    pthread_mutex_unlock(&p->lock);\n");
+    omni_codegen_emit_raw(ctx, "    return result;\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static Obj* prim_await(Obj* p) {\n");
+    omni_codegen_emit_raw(ctx, "    if (!is_promise(p)) return mk_error(\"await: not a promise\");\n");
+    omni_codegen_emit_raw(ctx, "    return promise_await(p->promise);\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static Obj* prim_promise_done(Obj* p) {\n");
+    omni_codegen_emit_raw(ctx, "    if (!is_promise(p)) return mk_error(\"promise-done?: not a promise\");\n");
+    omni_codegen_emit_raw(ctx, "    pthread_mutex_lock(&p->promise->lock);\n");
+    omni_codegen_emit_raw(ctx, "    int done = p->promise->done;\n");
+    omni_codegen_emit_raw(ctx, "    pthread_mutex_unlock(&p->promise->lock);\n");
+    omni_codegen_emit_raw(ctx, "    return mk_int(done);\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static Obj* prim_all_of(Obj* ps) {\n");
+    omni_codegen_emit_raw(ctx, "    for (Obj* l = ps; !is_nil(l); l = cdr(l)) {\n");
+    omni_codegen_emit_raw(ctx, "        if (l->tag != T_CELL || !is_promise(car(l))) return mk_error(\"all-of: not a list of promises\");\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    Obj* results = NIL; Obj* last = NULL;\n");
+    omni_codegen_emit_raw(ctx, "    for (Obj* l = ps; !is_nil(l); l = cdr(l)) {\n");
+    omni_codegen_emit_raw(ctx, "        Obj* cell = mk_cell(promise_await(car(l)->promise), NIL);\n");
+    omni_codegen_emit_raw(ctx, "        if (last) cdr(last) = cell; else results = cell;\n");
+    omni_codegen_emit_raw(ctx, "        last = cell;\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    return results;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+    /* Worker pools: (make-pool n) starts n threads that run submitted
+     * thunks in queue order, and (pool-submit pool thunk) returns a
+     * promise of the thunk's value, so many small tasks share a few
+     * threads. A job holds a reference to its promise until it finishes;
+     * freeing the pool lets the workers drain the queue, then joins them.
+     * If a worker drops the last reference, the workers are detached and
+     * the last one out frees the pool. */
+    omni_codegen_emit_raw(ctx, "typedef struct PoolJob { Obj* thunk; Obj* promise; struct PoolJob* next; } PoolJob;\n");
+    omni_codegen_emit_raw(ctx, "typedef struct WorkerPool {\n");
+    omni_codegen_emit_raw(ctx, "    pthread_t* threads;\n");
+    omni_codegen_emit_raw(ctx, "    int count;  /* 0 under the inline scheduler */\n");
+    omni_codegen_emit_raw(ctx, "    int running;\n");
+    omni_codegen_emit_raw(ctx, "    int closing;\n");
+    omni_codegen_emit_raw(ctx, "    int orphaned;  /* Freed by the last worker out */\n");
+    omni_codegen_emit_raw(ctx, "    pthread_mutex_t lock;\n");
+    omni_codegen_emit_raw(ctx, "    pthread_cond_t ready;\n");
+    omni_codegen_emit_raw(ctx, "    PoolJob* first; PoolJob* last;\n");
+    omni_codegen_emit_raw(ctx, "} WorkerPool;\n\n");
+    omni_codegen_emit_raw(ctx, "static __thread WorkerPool* g_worker_pool = NULL;\n");
+    omni_codegen_emit_raw(ctx, "static void pool_destroy(WorkerPool* w) {\n");
+    omni_codegen_emit_raw(ctx, "    free(w->threads);\n");
+    omni_codegen_emit_raw(ctx, "    pthread_mutex_destroy(&w->lock);\n");
+    omni_codegen_emit_raw(ctx, "    pthread_cond_destroy(&w->ready);\n");
+    omni_codegen_emit_raw(ctx, "    free(w);\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static void* pool_job_entry(void* arg) {\n");
+    omni_codegen_emit_raw(ctx, "    PoolJob* job = (PoolJob*)arg;\n");
+    omni_codegen_emit_raw(ctx, "    Promise* p = job->promise->promise;\n");
+    omni_codegen_emit_raw(ctx, "    Obj* result = job->thunk->code.fn(job->thunk->code.captures, NULL, 0);\n");
+    omni_codegen_emit_raw(ctx, "    dec_ref(job->thunk);\n");
+    omni_codegen_emit_raw(ctx, "    pthread_mutex_lock(&p->lock);\n");
+    omni_codegen_emit_raw(ctx, "    p->result = result; p->done = 1;\n");
+    omni_codegen_emit_raw(ctx, "    pthread_cond_broadcast(&p->cond);\n");
+    omni_codegen_emit_raw(ctx, "    pthread_mutex_unlock(&p->lock);\n");
+    omni_codegen_emit_raw(ctx, "    dec_ref(job->promise);\n");
+    omni_codegen_emit_raw(ctx, "    free(job);\n");
+    omni_codegen_emit_raw(ctx, "    return NULL;\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static void* pool_worker(void* arg) {\n");
+    omni_codegen_emit_raw(ctx, "    WorkerPool* w = (WorkerPool*)arg;\n");
+    omni_codegen_emit_raw(ctx, "    g_worker_pool = w;\n");
+    omni_codegen_emit_raw(ctx, "    for (;;) {\n");
+    omni_codegen_emit_raw(ctx, "        pthread_mutex_lock(&w->lock);\n");
+    omni_codegen_emit_raw(ctx, "        while (!w->first && !w->closing) pthread_cond_wait(&w->ready, &w->lock);\n");
+    omni_codegen_emit_raw(ctx, "        PoolJob* job = w->first;\n");
+    omni_codegen_emit_raw(ctx, "        if (job) { w->first = job->next; if (!w->first) w->last = NULL; }\n");
+    omni_codegen_emit_raw(ctx, "        if (!job) {\n");
+    omni_codegen_emit_raw(ctx, "            int last_out = --w->running == 0 && w->orphaned;\n");
+    omni_codegen_emit_raw(ctx, "            pthread_mutex_unlock(&w->lock);\n");
+    omni_codegen_emit_raw(ctx, "            if (last_out) pool_destroy(w);\n");
+    omni_codegen_emit_raw(ctx, "            return NULL;\n");
+    omni_codegen_emit_raw(ctx, "        }\n");
+    omni_codegen_emit_raw(ctx, "        pthread_mutex_unlock(&w->lock);\n");
+    omni_codegen_emit_raw(ctx, "        pool_job_entry(job);\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static void free_pool(WorkerPool* w) {\n");
+    omni_codegen_emit_raw(ctx, "    int on_worker = g_worker_pool == w;\n");
+    omni_codegen_emit_raw(ctx, "    pthread_mutex_lock(&w->lock);\n");
+    omni_codegen_emit_raw(ctx, "    w->closing = 1; w->orphaned = on_worker;\n");
+    omni_codegen_emit_raw(ctx, "    pthread_cond_broadcast(&w->ready);\n");
+    omni_codegen_emit_raw(ctx, "    pthread_mutex_unlock(&w->lock);\n");
+    omni_codegen_emit_raw(ctx, "    for (int i = 0; i < w->count; i++) {\n");
+    omni_codegen_emit_raw(ctx, "        if (on_worker) pthread_detach(w->threads[i]);\n");
+    omni_codegen_emit_raw(ctx, "        else pthread_join(w->threads[i], NULL);\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    if (!on_worker) pool_destroy(w);\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static Obj* prim_make_pool(Obj* n) {\n");
+    omni_codegen_emit_raw(ctx, "    if (!n || n == NIL || n->tag != T_INT) return mk_error(\"make-pool: not an integer\");\n");
+    omni_codegen_emit_raw(ctx, "    if (n->i < 1 || n->i > 1024) return mk_error(\"make-pool: size must be between 1 and 1024\");\n");
+    omni_codegen_emit_raw(ctx, "    WorkerPool* w = calloc(1, sizeof(WorkerPool));\n");
+    omni_codegen_emit_raw(ctx, "    Obj* o = malloc(sizeof(Obj));\n");
+    omni_codegen_emit_raw(ctx, "    if (!w || !o) { free(w); free(o); return mk_error(\"make-pool: out of memory\"); }\n");
+    omni_codegen_emit_raw(ctx, "    pthread_mutex_init(&w->lock, NULL);\n");
+    omni_codegen_emit_raw(ctx, "    pthread_cond_init(&w->ready, NULL);\n");
+    omni_codegen_emit_raw(ctx, "    if (omni_scheduler != SCHED_INLINE) {\n");
+    omni_codegen_emit_raw(ctx, "        w->threads = malloc((size_t)n->i * sizeof(pthread_t));\n");
+    omni_codegen_emit_raw(ctx, "        while (w->threads && w->count < n->i && start_thread(&w->threads[w->count], pool_worker, w, \"make-pool\")) {\n");
+    omni_codegen_emit_raw(ctx, "            pthread_mutex_lock(&w->lock);\n");
+    omni_codegen_emit_raw(ctx, "            w->count++; w->running++;\n");
+    omni_codegen_emit_raw(ctx, "            pthread_mutex_unlock(&w->lock);\n");
+    omni_codegen_emit_raw(ctx, "        }\n");
+    omni_codegen_emit_raw(ctx, "        if (w->count < n->i) {\n");
+    omni_codegen_emit_raw(ctx, "            free(o); free_pool(w);\n");
+    omni_codegen_emit_raw(ctx, "            return mk_error(\"make-pool: cannot start a thread\");\n");
+    omni_codegen_emit_raw(ctx, "        }\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    o->tag = T_POOL; o->rc = 1; o->pool = w;\n");
+    omni_codegen_emit_raw(ctx, "    g_free_pool = free_pool;\n");
+    omni_codegen_emit_raw(ctx, "    return o;\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static Obj* prim_pool_submit(Obj* pool, Obj* thunk) {\n");
+    omni_codegen_emit_raw(ctx, "    if (!pool || pool == NIL || pool->tag != T_POOL) return mk_error(\"pool-submit: not a pool\");\n");
+    omni_codegen_emit_raw(ctx, "    if (!thunk || thunk == NIL || thunk->tag != T_CODE || thunk->code.arity != 0) {\n");
+    omni_codegen_emit_raw(ctx, "        return mk_error(\"pool-submit: not a procedure of no arguments\");\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    Promise* p = calloc(1, sizeof(Promise));\n");
+    omni_codegen_emit_raw(ctx, "    PoolJob* job = malloc(sizeof(PoolJob));\n");
+    omni_codegen_emit_raw(ctx, "    Obj* o = malloc(sizeof(Obj));\n");
+    omni_codegen_emit_raw(ctx, "    if (!p || !job || !o) { free(p); free(job); free(o); return mk_error(\"pool-submit: out of memory\"); }\n");
+    omni_codegen_emit_raw(ctx, "    pthread_mutex_init(&p->lock, NULL);\n");
+    omni_codegen_emit_raw(ctx, "    pthread_cond_init(&p->cond, NULL);\n");
+    omni_codegen_emit_raw(ctx, "    p->ran_inline = 1;  /* The pool's threads outlive it */\n");
+    omni_codegen_emit_raw(ctx, "    o->tag = T_PROMISE; o->rc = 2; o->promise = p;  /* One for the job */\n");
+    omni_codegen_emit_raw(ctx, "    g_free_promise = free_promise;\n");
+    omni_codegen_emit_raw(ctx, "    for (int i = 0; i < thunk->code.count; i++) share_obj(thunk->code.captures[i]);\n");
+    omni_codegen_emit_raw(ctx, "    inc_ref(thunk);\n");
+    omni_codegen_emit_raw(ctx, "    job->thunk = thunk; job->promise = o; job->next = NULL;\n");
+    omni_codegen_emit_raw(ctx, "    WorkerPool* w = pool->pool;\n");
+    omni_codegen_emit_raw(ctx, "    if (w->count == 0) {\n");
+    omni_codegen_emit_raw(ctx, "        run_inline(pool_job_entry, job, \"pool-submit\");\n");
+    omni_codegen_emit_raw(ctx, "        return o;\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    pthread_mutex_lock(&w->lock);\n");
+    omni_codegen_emit_raw(ctx, "    if (w->last) w->last->next = job; else w->first = job;\n");
+    omni_codegen_emit_raw(ctx, "    w->last = job;\n");
+    omni_codegen_emit_raw(ctx, "    pthread_cond_signal(&w->ready);\n");
+    omni_codegen_emit_raw(ctx, "    pthread_mutex_unlock(&w->lock);\n");
+    omni_codegen_emit_raw(ctx, "    return o;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+
+    omni_codegen_emit_raw(ctx, "/* Ownership transfer macros */\n");
+    omni_codegen_emit_raw(ctx, "#define SEND_OWNERSHIP(ch, val) do { channel_send(ch, val); /* val no longer owned */ } while(0)\n");
+    omni_codegen_emit_raw(ctx, "#define RECV_OWNERSHIP(ch, var) do { var = channel_recv(ch); /* var now owned */ } while(0)\n\n");
+
+    omni_codegen_emit_raw(ctx, "/* Thread spawn with captured variable handling */\n");
+    omni_codegen_emit_raw(ctx, "#define SPAWN_THREAD(fn, arg) do { \\\n");
+    omni_codegen_emit_raw(ctx, "    pthread_t _thread; \\\n");
+    omni_codegen_emit_raw(ctx, "    OMNI_STORE(omni_threaded, 1); \\\n");
+    omni_codegen_emit_raw(ctx, "    pthread_create(&_thread, NULL, fn, arg); \\\n");
+    omni_codegen_emit_raw(ctx, "    pthread_detach(_thread); \\\n");
+    omni_codegen_emit_raw(ctx, "} while(0)\n\n");
+
+    omni_codegen_emit_raw(ctx, "/* Mark variable as shared (needs atomic RC) */\n");
+    omni_codegen_emit_raw(ctx, "#define MARK_SHARED(v) ((void)0)  /* Analysis marker, no runtime cost */\n\n");
+
+    omni_codegen_emit_raw(ctx, "/* Conditional RC based on thread locality analysis */\n");
+    omni_codegen_emit_raw(ctx, "#define INC_REF_FOR_THREAD(o, needs_atomic) \\\n");
+    omni_codegen_emit_raw(ctx, "    do { if (needs_atomic) ATOMIC_INC_REF(o); else inc_ref(o); } while(0)\n\n");
+
+    omni_codegen_emit_raw(ctx, "#define DEC_REF_FOR_THREAD(o, needs_atomic) \\\n");
+    omni_codegen_emit_raw(ctx, "    do { if (needs_atomic) ATOMIC_DEC_REF(o); else dec_ref(o); } while(0)\n\n");
+
+    /* sleep-ms, yield and monotonic-millis. With PURPLE_VIRTUAL_TIME set,
+     * sleeping advances a clock that starts at 0 instead of blocking, so
+     * tests of timed code run instantly and see exact times. */
+    omni_codegen_emit_raw(ctx, "static int64_t g_virtual_ms = 0;\n");
+    omni_codegen_emit_raw(ctx, "static int virtual_time(void) {\n");
+    omni_codegen_emit_raw(ctx, "    static int on = -1;\n");
+    omni_codegen_emit_raw(ctx, "    int cached = __atomic_load_n(&on, __ATOMIC_ACQUIRE);\n");
+    omni_codegen_emit_raw(ctx, "    if (cached < 0) {\n");
+    omni_codegen_emit_raw(ctx, "        const char* v = getenv(\"PURPLE_VIRTUAL_TIME\");\n");
+    omni_codegen_emit_raw(ctx, "        cached = v && *v && strcmp(v, \"0\") != 0;\n");
+    omni_codegen_emit_raw(ctx, "        __atomic_store_n(&on, cached, __ATOMIC_RELEASE);\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    return cached;\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static Obj* prim_sleep_ms(Obj* ms) {\n");
+    omni_codegen_emit_raw(ctx, "    double n;\n");
+    omni_codegen_emit_raw(ctx, "    if (ms && ms != NIL && ms->tag == T_INT) n = (double)ms->i;\n");
+    omni_codegen_emit_raw(ctx, "    else if (ms && ms != NIL && ms->tag == T_FLOAT) n = ms->f;\n");
+    omni_codegen_emit_raw(ctx, "    else return mk_error(\"sleep-ms: not a number\");\n");
+    omni_codegen_emit_raw(ctx, "    nursery_safe_point();\n");
+    omni_codegen_emit_raw(ctx, "    if (!(n > 0)) return NIL;\n");
+    omni_codegen_emit_raw(ctx, "    if (virtual_time()) {\n");
+    omni_codegen_emit_raw(ctx, "        __atomic_add_fetch(&g_virtual_ms, (int64_t)n, __ATOMIC_SEQ_CST);\n");
+    omni_codegen_emit_raw(ctx, "        return NIL;\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    double slice = g_nursery ? CANCEL_POLL_MS : n;  /* so a cancel! wakes it */\n");
+    omni_codegen_emit_raw(ctx, "    while (n > 0) {\n");
+    omni_codegen_emit_raw(ctx, "        double step = n < slice ? n : slice;\n");
+    omni_codegen_emit_raw(ctx, "        struct timespec ts = { (time_t)(step / 1000), (long)(fmod(step, 1000) * 1000000) };\n");
+    omni_codegen_emit_raw(ctx, "        while (nanosleep(&ts, &ts) != 0) {}\n");
+    omni_codegen_emit_raw(ctx, "        n -= step;\n");
+    omni_codegen_emit_raw(ctx, "        nursery_safe_point();\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    return NIL;\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static Obj* prim_yield(void) { sched_yield(); nursery_safe_point(); return NIL; }\n");
+    omni_codegen_emit_raw(ctx, "static Obj* prim_monotonic_millis(void) {\n");
+    omni_codegen_emit_raw(ctx, "    if (virtual_time()) return mk_int(__atomic_load_n(&g_virtual_ms, __ATOMIC_SEQ_CST));\n");
+    omni_codegen_emit_raw(ctx, "    struct timespec ts;\n");
+    omni_codegen_emit_raw(ctx, "    clock_gettime(CLOCK_MONOTONIC, &ts);\n");
+    omni_codegen_emit_raw(ctx, "    return mk_int((int64_t)ts.tv_sec * 1000 + ts.tv_nsec / 1000000);\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+}
+
+static void rt_print(CodeGenContext* ctx) {
+    /* Shortest float text that reads back as the same double, plain
+     * unless its magnitude is 1e21 or more or below 1e-7 */
+    omni_codegen_emit_raw(ctx, "static int format_float(char* buf, size_t cap, double f) {\n");
+    omni_codegen_emit_raw(ctx, "    if (f != f) return snprintf(buf, cap, \"+nan.0\");\n");
+    omni_codegen_emit_raw(ctx, "    if (f - f != 0) return snprintf(buf, cap, f > 0 ? \"+inf.0\" : \"-inf.0\");\n");
+    omni_codegen_emit_raw(ctx, "    int len = 0;\n");
+    omni_codegen_emit_raw(ctx, "    for (int prec = 1; prec <= 17; prec++) {\n");
+    omni_codegen_emit_raw(ctx, "        len = snprintf(buf, cap, \"%%.*g\", prec, f);\n");
+    omni_codegen_emit_raw(ctx, "        if (strtod(buf, NULL) == f) break;\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    char* e = strchr(buf, 'e');\n");
+    omni_codegen_emit_raw(ctx, "    double mag = f < 0 ? -f : f;\n");
+    omni_codegen_emit_raw(ctx, "    if (e && mag >= 1e-7 && mag < 1e21) {\n");
+    omni_codegen_emit_raw(ctx, "        int x = 0;\n");
+    omni_codegen_emit_raw(ctx, "        for (const char* p = e + 2; *p; p++) x = x * 10 + (*p - '0');\n");
+    omni_codegen_emit_raw(ctx, "        if (e[1] == '-') x = -x;\n");
+    omni_codegen_emit_raw(ctx, "        char digits[24];\n");
+    omni_codegen_emit_raw(ctx, "        int n = 0;\n");
+    omni_codegen_emit_raw(ctx, "        for (const char* p = buf; p < e; p++) if (*p >= '0' && *p <= '9') digits[n++] = *p;\n");
+    omni_codegen_emit_raw(ctx, "        char plain[48];\n");
+    omni_codegen_emit_raw(ctx, "        int k = 0;\n");
+    omni_codegen_emit_raw(ctx, "        if (f < 0) plain[k++] = '-';\n");
+    omni_codegen_emit_raw(ctx, "        if (x < 0) {\n");
+    omni_codegen_emit_raw(ctx, "            plain[k++] = '0'; plain[k++] = '.';\n");
+    omni_codegen_emit_raw(ctx, "            for (int i = -1; i > x; i--) plain[k++] = '0';\n");
+    omni_codegen_emit_raw(ctx, "            for (int i = 0; i < n; i++) plain[k++] = digits[i];\n");
+    omni_codegen_emit_raw(ctx, "        } else {\n");
+    omni_codegen_emit_raw(ctx, "            for (int i = 0; i <= x; i++) plain[k++] = i < n ? digits[i] : '0';\n");
+    omni_codegen_emit_raw(ctx, "            if (n > x + 1) plain[k++] = '.';\n");
+    omni_codegen_emit_raw(ctx, "            for (int i = x + 1; i < n; i++) plain[k++] = digits[i];\n");
+    omni_codegen_emit_raw(ctx, "        }\n");
+    omni_codegen_emit_raw(ctx, "        plain[k] = '\\0';\n");
+    omni_codegen_emit_raw(ctx, "        len = snprintf(buf, cap, \"%%s\", plain);\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    if (!strpbrk(buf, \".e\") && (size_t)len + 2 < cap) {\n");
+    omni_codegen_emit_raw(ctx, "        buf[len++] = '.'; buf[len++] = '0'; buf[len] = '\\0';\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    return len;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    /* A deftype object prints through the printer define-printer gave its
+     * type, if any, else as #<T f1=v1 f2=v2> with each field as field
+     * prints it; a weak field holding an object is #<weak>, so a back edge
+     * is not followed, and one that is cleared prints its nil */
+    omni_codegen_emit_raw(ctx, "static int (*print_user_hook)(FILE* out, Obj* o) = NULL;\n");
+    omni_codegen_emit_raw(ctx, "static void print_user_default(FILE* out, Obj* o, void (*field)(FILE*, Obj*)) {\n");
+    omni_codegen_emit_raw(ctx, "    fprintf(out, \"#<%%s\", o->user.type->name);\n");
+    omni_codegen_emit_raw(ctx, "    for (int i = 0; i < o->user.type->field_count; i++) {\n");
+    omni_codegen_emit_raw(ctx, "        fprintf(out, \" %%s=\", o->user.type->fields[i]);\n");
+    omni_codegen_emit_raw(ctx, "        Obj* v = o->user.fields[i];\n");
+    omni_codegen_emit_raw(ctx, "        if ((o->user.type->weak >> i & 1) && v && !is_nil(v)) fprintf(out, \"#<weak>\");\n");
+    omni_codegen_emit_raw(ctx, "        else field(out, v);\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    fputc('>', out);\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    /* Persistent maps and vectors print through the persistent section,
+     * each entry or element as item prints it */
+    omni_codegen_emit_raw(ctx, "static void (*print_pcoll_hook)(FILE* out, Obj* o, void (*item)(FILE*, Obj*)) = NULL;\n\n");
+
+    /* Print */
+    omni_codegen_emit_raw(ctx, "static void print_obj_to(FILE* out, Obj* o) {\n");
+    omni_codegen_emit_raw(ctx, "    if (!o || is_nil(o)) { fprintf(out, \"()\"); return; }\n");
+    omni_codegen_emit_raw(ctx, "    switch (o->tag) {\n");
+    omni_codegen_emit_raw(ctx, "    case T_INT: fprintf(out, \"%%ld\", (long)o->i); break;\n");
+    omni_codegen_emit_raw(ctx, "    case T_SYM: case T_STRING: fprintf(out, \"%%s\", o->s); break;\n");
+    omni_codegen_emit_raw(ctx, "    case T_KEYWORD: fprintf(out, \":%%s\", o->s); break;\n");
+    omni_codegen_emit_raw(ctx, "    case T_CELL:\n");
+    omni_codegen_emit_raw(ctx, "        fprintf(out, \"(\");\n");
+    omni_codegen_emit_raw(ctx, "        while (!is_nil(o)) {\n");
+    omni_codegen_emit_raw(ctx, "            print_obj_to(out, car(o));\n");
+    omni_codegen_emit_raw(ctx, "            o = cdr(o);\n");
+    omni_codegen_emit_raw(ctx, "            if (o && !is_nil(o) && o->tag != T_CELL) { fprintf(out, \" . \"); print_obj_to(out, o); break; }\n");
+    omni_codegen_emit_raw(ctx, "            if (!is_nil(o)) fprintf(out, \" \");\n");
+    omni_codegen_emit_raw(ctx, "        }\n");
+    omni_codegen_emit_raw(ctx, "        fprintf(out, \")\");\n");
+    omni_codegen_emit_raw(ctx, "        break;\n");
+    omni_codegen_emit_raw(ctx, "    case T_VECTOR:\n");
+    omni_codegen_emit_raw(ctx, "        fprintf(out, \"[\");\n");
+    omni_codegen_emit_raw(ctx, "        for (int64_t i = 0; i < o->vec.len; i++) {\n");
+    omni_codegen_emit_raw(ctx, "            if (i > 0) fprintf(out, \" \");\n");
+    omni_codegen_emit_raw(ctx, "            print_obj_to(out, o->vec.items[i]);\n");
+    omni_codegen_emit_raw(ctx, "        }\n");
+    omni_codegen_emit_raw(ctx, "        fprintf(out, \"]\");\n");
+    omni_codegen_emit_raw(ctx, "        break;\n");
+    omni_codegen_emit_raw(ctx, "    case T_HASH:\n");
+    omni_codegen_emit_raw(ctx, "        fprintf(out, \"#{\");\n");
+    omni_codegen_emit_raw(ctx, "        for (HashNode* n = o->hash->first; n; n = n->next) {\n");
+    omni_codegen_emit_raw(ctx, "            if (n != o->hash->first) fprintf(out, \" \");\n");
+    omni_codegen_emit_raw(ctx, "            print_obj_to(out, n->key);\n");
+    omni_codegen_emit_raw(ctx, "            fprintf(out, \" \");\n");
+    omni_codegen_emit_raw(ctx, "            print_obj_to(out, n->value);\n");
+    omni_codegen_emit_raw(ctx, "        }\n");
+    omni_codegen_emit_raw(ctx, "        fprintf(out, \"}\");\n");
+    omni_codegen_emit_raw(ctx, "        break;\n");
+    omni_codegen_emit_raw(ctx, "    case T_FLOAT: { char buf[32]; format_float(buf, sizeof(buf), o->f); fputs(buf, out); break; }\n");
+    omni_codegen_emit_raw(ctx, "    case T_CHAR: fputc((int)o->i, out); break;\n");
+    omni_codegen_emit_raw(ctx, "    case T_ERROR: fprintf(out, \"#<error %%s>\", o->err.msg ? o->err.msg : \"\"); break;\n");
+    omni_codegen_emit_raw(ctx, "    case T_CANCEL: fprintf(out, \"#<cancel>\"); break;\n");
+    omni_codegen_emit_raw(ctx, "    case T_PROMISE: fprintf(out, \"#<promise>\"); break;\n");
+    omni_codegen_emit_raw(ctx, "    case T_POOL: fprintf(out, \"#<pool>\"); break;\n");
+    omni_codegen_emit_raw(ctx, "    case T_CODE:\n");
+    omni_codegen_emit_raw(ctx, "        if (o->code.name) fprintf(out, \"#<closure %%s arity %%d>\", o->code.name, o->code.arity);\n");
+    omni_codegen_emit_raw(ctx, "        else fprintf(out, \"#<closure arity %%d>\", o->code.arity);\n");
+    omni_codegen_emit_raw(ctx, "        break;\n");
+    omni_codegen_emit_raw(ctx, "    case T_USER:\n");
+    omni_codegen_emit_raw(ctx, "        if (!print_user_hook || !print_user_hook(out, o)) print_user_default(out, o, print_obj_to);\n");
+    omni_codegen_emit_raw(ctx, "        break;\n");
+    omni_codegen_emit_raw(ctx, "    case T_PORT: fprintf(out, \"#<port>\"); break;\n");
+    omni_codegen_emit_raw(ctx, "    case T_PMAP: case T_PVEC: print_pcoll_hook(out, o, print_obj_to); break;\n");
+    omni_codegen_emit_raw(ctx, "    default: fprintf(out, \"#<unknown>\"); break;\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+
+    /* Ports: a stream to read, a stream to write, or both for a socket;
+     * each is NULL where the port has none, and both once it is closed.
+     * Ports the program opens own their streams. Those for the console,
+     * and the one a printer from define-printer is given, borrow them. */
+    omni_codegen_emit_raw(ctx, "typedef struct OmniPort {\n");
+    omni_codegen_emit_raw(ctx, "    FILE* in; FILE* out;\n");
+    omni_codegen_emit_raw(ctx, "    bool owned; bool string;\n");
+    omni_codegen_emit_raw(ctx, "    char* text; size_t len;  /* A string port's open_memstream buffer */\n");
+    omni_codegen_emit_raw(ctx, "    char* buf;               /* From set-port-buffer!, for an owned stream */\n");
+    omni_codegen_emit_raw(ctx, "    struct OmniPort* prev; struct OmniPort* next;  /* In g_open_ports */\n");
+    omni_codegen_emit_raw(ctx, "    bool tracked;\n");
+    omni_codegen_emit_raw(ctx, "} OmniPort;\n");
+    /* Installed by the ports section once it tracks a port */
+    omni_codegen_emit_raw(ctx, "static void (*g_untrack_port)(OmniPort*) = NULL;\n");
+    omni_codegen_emit_raw(ctx, "static void port_close(OmniPort* p) {\n");
+    omni_codegen_emit_raw(ctx, "    if (p->tracked) g_untrack_port(p);\n");
+    omni_codegen_emit_raw(ctx, "    if (p->owned && p->in) fclose(p->in);\n");
+    omni_codegen_emit_raw(ctx, "    if (p->owned && p->out) fclose(p->out);\n");
+    omni_codegen_emit_raw(ctx, "    else if (p->out) fflush(p->out);\n");
+    omni_codegen_emit_raw(ctx, "    p->in = p->out = NULL;\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static void port_free(OmniPort* p) {\n");
+    omni_codegen_emit_raw(ctx, "    port_close(p);\n");
+    omni_codegen_emit_raw(ctx, "    omni_libc_free(p->text);\n");
+    omni_codegen_emit_raw(ctx, "    free(p->buf);\n");
+    omni_codegen_emit_raw(ctx, "    free(p);\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static Obj* mk_port(FILE* in, FILE* out, bool owned) {\n");
+    omni_codegen_emit_raw(ctx, "    budget_charge();\n");
+    omni_codegen_emit_raw(ctx, "    Obj* o = malloc(sizeof(Obj));\n");
+    omni_codegen_emit_raw(ctx, "    o->tag = T_PORT; o->rc = 1;\n");
+    omni_codegen_emit_raw(ctx, "    o->port = calloc(1, sizeof(OmniPort));\n");
+    omni_codegen_emit_raw(ctx, "    o->port->in = in; o->port->out = out; o->port->owned = owned;\n");
+    omni_codegen_emit_raw(ctx, "    g_free_port = port_free;\n");
+    omni_codegen_emit_raw(ctx, "    return o;\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static int is_port(Obj* o) { return o && o != NIL && o->tag == T_PORT; }\n");
+    /* Where (display x p) writes: anything but a port means the current
+     * output port. NULL when the port is closed or only reads. */
+    omni_codegen_emit_raw(ctx, "static FILE* port_out(Obj* p) {\n");
+    omni_codegen_emit_raw(ctx, "    if (!is_port(p)) p = g_output;\n");
+    omni_codegen_emit_raw(ctx, "    return p ? p->port->out : stdout;\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static Obj* port_not_open(const char* who) {\n");
+    omni_codegen_emit_raw(ctx, "    char msg[96];\n");
+    omni_codegen_emit_raw(ctx, "    snprintf(msg, sizeof(msg), \"%%s: not an open output port\", who);\n");
+    omni_codegen_emit_raw(ctx, "    return mk_error(msg);\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static Obj* omni_print_to(Obj* p, Obj* o) {\n");
+    omni_codegen_emit_raw(ctx, "    FILE* out = port_out(p);\n");
+    omni_codegen_emit_raw(ctx, "    if (!out) return port_not_open(\"display\");\n");
+    omni_codegen_emit_raw(ctx, "    print_obj_to(out, o);\n");
+    omni_codegen_emit_raw(ctx, "    return NIL;\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "#define omni_print(o) omni_print_to(NIL, o)\n");
+    omni_codegen_emit_raw(ctx, "static Obj* omni_newline_to(Obj* p) {\n");
+    omni_codegen_emit_raw(ctx, "    FILE* out = port_out(p);\n");
+    omni_codegen_emit_raw(ctx, "    if (!out) return port_not_open(\"newline\");\n");
+    omni_codegen_emit_raw(ctx, "    fputc('\\n', out);\n");
+    omni_codegen_emit_raw(ctx, "    return NIL;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    /* write: like print_obj_to, but chars and strings print as reader syntax */
+    omni_codegen_emit_raw(ctx, "static void write_obj_to(FILE* out, Obj* o) {\n");
+    omni_codegen_emit_raw(ctx, "    if (!o || is_nil(o) || (o->tag != T_CHAR && o->tag != T_CELL && o->tag != T_STRING && o->tag != T_VECTOR && o->tag != T_HASH && o->tag != T_USER && o->tag != T_PMAP && o->tag != T_PVEC)) { print_obj_to(out, o); return; }\n");
+    omni_codegen_emit_raw(ctx, "    if (o->tag == T_PMAP || o->tag == T_PVEC) { print_pcoll_hook(out, o, write_obj_to); return; }\n");
+    omni_codegen_emit_raw(ctx, "    if (o->tag == T_USER) {\n");
+    omni_codegen_emit_raw(ctx, "        if (!print_user_hook || !print_user_hook(out, o)) print_user_default(out, o, write_obj_to);\n");
+    omni_codegen_emit_raw(ctx, "        return;\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    if (o->tag == T_HASH) {\n");
+    omni_codegen_emit_raw(ctx, "        fprintf(out, \"#{\");\n");
+    omni_codegen_emit_raw(ctx, "        for (HashNode* n = o->hash->first; n; n = n->next) {\n");
+    omni_codegen_emit_raw(ctx, "            if (n != o->hash->first) fprintf(out, \" \");\n");
+    omni_codegen_emit_raw(ctx, "            write_obj_to(out, n->key);\n");
+    omni_codegen_emit_raw(ctx, "            fprintf(out, \" \");\n");
+    omni_codegen_emit_raw(ctx, "            write_obj_to(out, n->value);\n");
+    omni_codegen_emit_raw(ctx, "        }\n");
+    omni_codegen_emit_raw(ctx, "        fprintf(out, \"}\");\n");
+    omni_codegen_emit_raw(ctx, "        return;\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    if (o->tag == T_VECTOR) {\n");
+    omni_codegen_emit_raw(ctx, "        fprintf(out, \"[\");\n");
+    omni_codegen_emit_raw(ctx, "        for (int64_t i = 0; i < o->vec.len; i++) {\n");
+    omni_codegen_emit_raw(ctx, "            if (i > 0) fprintf(out, \" \");\n");
+    omni_codegen_emit_raw(ctx, "            write_obj_to(out, o->vec.items[i]);\n");
+    omni_codegen_emit_raw(ctx, "        }\n");
+    omni_codegen_emit_raw(ctx, "        fprintf(out, \"]\");\n");
+    omni_codegen_emit_raw(ctx, "        return;\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    if (o->tag == T_STRING) {\n");
+    omni_codegen_emit_raw(ctx, "        fputc('\"', out);\n");
+    omni_codegen_emit_raw(ctx, "        for (const char* p = o->s; *p; p++) {\n");
+    omni_codegen_emit_raw(ctx, "            switch (*p) {\n");
+    omni_codegen_emit_raw(ctx, "            case '\"': fputs(\"\\\\\\\"\", out); break;\n");
+    omni_codegen_emit_raw(ctx, "            case '\\\\': fputs(\"\\\\\\\\\", out); break;\n");
+    omni_codegen_emit_raw(ctx, "            case '\\n': fputs(\"\\\\n\", out); break;\n");
+    omni_codegen_emit_raw(ctx, "            case '\\t': fputs(\"\\\\t\", out); break;\n");
+    omni_codegen_emit_raw(ctx, "            case '\\r': fputs(\"\\\\r\", out); break;\n");
+    omni_codegen_emit_raw(ctx, "            default: fputc(*p, out); break;\n");
+    omni_codegen_emit_raw(ctx, "            }\n");
+    omni_codegen_emit_raw(ctx, "        }\n");
+    omni_codegen_emit_raw(ctx, "        fputc('\"', out);\n");
+    omni_codegen_emit_raw(ctx, "        return;\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    if (o->tag == T_CELL) {\n");
+    omni_codegen_emit_raw(ctx, "        fprintf(out, \"(\");\n");
+    omni_codegen_emit_raw(ctx, "        while (!is_nil(o)) {\n");
+    omni_codegen_emit_raw(ctx, "            write_obj_to(out, car(o));\n");
+    omni_codegen_emit_raw(ctx, "            o = cdr(o);\n");
+    omni_codegen_emit_raw(ctx, "            if (o && !is_nil(o) && o->tag != T_CELL) { fprintf(out, \" . \"); write_obj_to(out, o); break; }\n");
+    omni_codegen_emit_raw(ctx, "            if (!is_nil(o)) fprintf(out, \" \");\n");
+    omni_codegen_emit_raw(ctx, "        }\n");
+    omni_codegen_emit_raw(ctx, "        fprintf(out, \")\");\n");
+    omni_codegen_emit_raw(ctx, "        return;\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    switch (o->i) {\n");
+    omni_codegen_emit_raw(ctx, "    case ' ': fprintf(out, \"#\\\\space\"); break;\n");
+    omni_codegen_emit_raw(ctx, "    case '\\n': fprintf(out, \"#\\\\newline\"); break;\n");
+    omni_codegen_emit_raw(ctx, "    case '\\t': fprintf(out, \"#\\\\tab\"); break;\n");
+    omni_codegen_emit_raw(ctx, "    case '\\r': fprintf(out, \"#\\\\return\"); break;\n");
+    omni_codegen_emit_raw(ctx, "    case 0: fprintf(out, \"#\\\\nul\"); break;\n");
+    omni_codegen_emit_raw(ctx, "    case 27: fprintf(out, \"#\\\\escape\"); break;\n");
+    omni_codegen_emit_raw(ctx, "    case 127: fprintf(out, \"#\\\\delete\"); break;\n");
+    omni_codegen_emit_raw(ctx, "    default:\n");
+    omni_codegen_emit_raw(ctx, "        if (o->i < 32) fprintf(out, \"#\\\\x%%02lx\", (long)o->i);\n");
+    omni_codegen_emit_raw(ctx, "        else fprintf(out, \"#\\\\%%c\", (int)o->i);\n");
+    omni_codegen_emit_raw(ctx, "        break;\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static Obj* omni_write_to(Obj* p, Obj* o) {\n");
+    omni_codegen_emit_raw(ctx, "    FILE* out = port_out(p);\n");
+    omni_codegen_emit_raw(ctx, "    if (!out) return port_not_open(\"write\");\n");
+    omni_codegen_emit_raw(ctx, "    write_obj_to(out, o);\n");
+    omni_codegen_emit_raw(ctx, "    return NIL;\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "#define omni_write(o) omni_write_to(NIL, o)\n\n");
+}
+
+static void rt_primitives(CodeGenContext* ctx) {
+    /* Primitives */
+    /* Numeric tower: int op int stays int, anything with a float is a float */
+    omni_codegen_emit_raw(ctx, "static int is_float(Obj* o) { return o && o != NIL && o->tag == T_FLOAT; }\n");
+    omni_codegen_emit_raw(ctx, "static double to_double(Obj* o) { return is_float(o) ? o->f : (double)o->i; }\n");
+    omni_codegen_emit_raw(ctx, "#define NUM_BINOP(name, op) \\\n");
+    omni_codegen_emit_raw(ctx, "    static Obj* name(Obj* a, Obj* b) { \\\n");
+    omni_codegen_emit_raw(ctx, "        if (is_float(a) || is_float(b)) return mk_float(to_double(a) op to_double(b)); \\\n");
+    omni_codegen_emit_raw(ctx, "        return mk_int(a->i op b->i); \\\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "NUM_BINOP(prim_add, +)\n");
+    omni_codegen_emit_raw(ctx, "NUM_BINOP(prim_sub, -)\n");
+    omni_codegen_emit_raw(ctx, "NUM_BINOP(prim_mul, *)\n");
+    omni_codegen_emit_raw(ctx, "NUM_BINOP(prim_div, /)\n");
+    omni_codegen_emit_raw(ctx, "static Obj* prim_mod(Obj* a, Obj* b) { return mk_int(a->i %% b->i); }\n\n");
+
+    /* Exact int/float ordering; 2 means unordered (NaN) */
+    omni_codegen_emit_raw(ctx, "static int cmp_int_float(int64_t i, double f) {\n");
+    omni_codegen_emit_raw(ctx, "    if (f != f) return 2;\n");
+    omni_codegen_emit_raw(ctx, "    if (f >= 9223372036854775808.0) return -1;\n");
+    omni_codegen_emit_raw(ctx, "    if (f < -9223372036854775808.0) return 1;\n");
+    omni_codegen_emit_raw(ctx, "    int64_t t = (int64_t)f;\n");
+    omni_codegen_emit_raw(ctx, "    if (i != t) return i < t ? -1 : 1;\n");
+    omni_codegen_emit_raw(ctx, "    return f > (double)t ? -1 : (f < (double)t ? 1 : 0);\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static int num_compare(Obj* a, Obj* b) {\n");
+    omni_codegen_emit_raw(ctx, "    if (is_float(a) && is_float(b)) {\n");
+    omni_codegen_emit_raw(ctx, "        if (a->f != a->f || b->f != b->f) return 2;\n");
+    omni_codegen_emit_raw(ctx, "        return a->f < b->f ? -1 : (a->f > b->f ? 1 : 0);\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    if (is_float(a)) { int c = cmp_int_float(b->i, a->f); return c == 2 ? c : -c; }\n");
+    omni_codegen_emit_raw(ctx, "    if (is_float(b)) return cmp_int_float(a->i, b->f);\n");
+    omni_codegen_emit_raw(ctx, "    return a->i < b->i ? -1 : (a->i > b->i ? 1 : 0);\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    /* The test_ functions are what an if tests without boxing */
+    omni_codegen_emit_raw(ctx, "static int test_lt(Obj* a, Obj* b) { return num_compare(a, b) == -1; }\n");
+    omni_codegen_emit_raw(ctx, "static int test_gt(Obj* a, Obj* b) { return num_compare(a, b) == 1; }\n");
+    omni_codegen_emit_raw(ctx, "static int test_le(Obj* a, Obj* b) { int c = num_compare(a, b); return c == -1 || c == 0; }\n");
+    omni_codegen_emit_raw(ctx, "static int test_ge(Obj* a, Obj* b) { int c = num_compare(a, b); return c == 1 || c == 0; }\n");
+    omni_codegen_emit_raw(ctx, "static int test_eq(Obj* a, Obj* b) { return num_compare(a, b) == 0; }\n");
+    omni_codegen_emit_raw(ctx, "static Obj* prim_lt(Obj* a, Obj* b) { return mk_int(test_lt(a, b)); }\n");
+    omni_codegen_emit_raw(ctx, "static Obj* prim_gt(Obj* a, Obj* b) { return mk_int(test_gt(a, b)); }\n");
+    omni_codegen_emit_raw(ctx, "static Obj* prim_le(Obj* a, Obj* b) { return mk_int(test_le(a, b)); }\n");
+    omni_codegen_emit_raw(ctx, "static Obj* prim_ge(Obj* a, Obj* b) { return mk_int(test_ge(a, b)); }\n");
+    omni_codegen_emit_raw(ctx, "static Obj* prim_eq(Obj* a, Obj* b) { return mk_int(test_eq(a, b)); }\n");
+
+    /* Numeric library: exact where possible, inexact as soon as a float is involved */
+    omni_codegen_emit_raw(ctx, "static Obj* num_pick(Obj* a, Obj* b, int take_b) {\n");
+    omni_codegen_emit_raw(ctx, "    Obj* r = take_b ? b : a;\n");
+    omni_codegen_emit_raw(ctx, "    if (is_float(a) || is_float(b)) return mk_float(to_double(r));\n");
+    omni_codegen_emit_raw(ctx, "    return mk_int(r->i);\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static Obj* prim_min(Obj* a, Obj* b) { int c = num_compare(a, b); return c == 2 ? mk_float(NAN) : num_pick(a, b, c == 1); }\n");
+    omni_codegen_emit_raw(ctx, "static Obj* prim_max(Obj* a, Obj* b) { int c = num_compare(a, b); return c == 2 ? mk_float(NAN) : num_pick(a, b, c == -1); }\n");
+    omni_codegen_emit_raw(ctx, "static Obj* prim_expt(Obj* a, Obj* b) {\n");
+    omni_codegen_emit_raw(ctx, "    if (is_float(a) || is_float(b) || b->i < 0) return mk_float(pow(to_double(a), to_double(b)));\n");
+    omni_codegen_emit_raw(ctx, "    int64_t base = a->i, r = 1;\n");
+    omni_codegen_emit_raw(ctx, "    uint64_t e = (uint64_t)b->i;\n");
+    omni_codegen_emit_raw(ctx, "    for (;;) {\n");
+    omni_codegen_emit_raw(ctx, "        if ((e & 1) && __builtin_mul_overflow(r, base, &r)) break;\n");
+    omni_codegen_emit_raw(ctx, "        e >>= 1;\n");
+    omni_codegen_emit_raw(ctx, "        if (!e) return mk_int(r);\n");
+    omni_codegen_emit_raw(ctx, "        if (__builtin_mul_overflow(base, base, &base)) break;\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    return mk_float(pow(to_double(a), to_double(b)));\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static int int_magnitude(Obj* o, uint64_t* out) {\n");
+    omni_codegen_emit_raw(ctx, "    if (is_float(o)) {\n");
+    omni_codegen_emit_raw(ctx, "        double f = o->f < 0 ? -o->f : o->f;\n");
+    omni_codegen_emit_raw(ctx, "        if (f != floor(f) || f >= 18446744073709551616.0) return 0;\n");
+    omni_codegen_emit_raw(ctx, "        *out = (uint64_t)f;\n");
+    omni_codegen_emit_raw(ctx, "        return 1;\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    *out = o->i < 0 ? 0 - (uint64_t)o->i : (uint64_t)o->i;\n");
+    omni_codegen_emit_raw(ctx, "    return 1;\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static uint64_t gcd_u64(uint64_t a, uint64_t b) { while (b) { uint64_t t = a %% b; a = b; b = t; } return a; }\n");
+    omni_codegen_emit_raw(ctx, "static Obj* magnitude_result(Obj* a, Obj* b, uint64_t v) {\n");
+    omni_codegen_emit_raw(ctx, "    return is_float(a) || is_float(b) || v > INT64_MAX ? mk_float((double)v) : mk_int((int64_t)v);\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static Obj* prim_gcd(Obj* a, Obj* b) {\n");
+    omni_codegen_emit_raw(ctx, "    uint64_t x, y;\n");
+    omni_codegen_emit_raw(ctx, "    if (!int_magnitude(a, &x) || !int_magnitude(b, &y)) return mk_error(\"gcd: not an integer\");\n");
+    omni_codegen_emit_raw(ctx, "    return magnitude_result(a, b, gcd_u64(x, y));\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static Obj* prim_lcm(Obj* a, Obj* b) {\n");
+    omni_codegen_emit_raw(ctx, "    uint64_t x, y, l;\n");
+    omni_codegen_emit_raw(ctx, "    if (!int_magnitude(a, &x) || !int_magnitude(b, &y)) return mk_error(\"lcm: not an integer\");\n");
+    omni_codegen_emit_raw(ctx, "    if (x == 0 || y == 0) return magnitude_result(a, b, 0);\n");
+    omni_codegen_emit_raw(ctx, "    x /= gcd_u64(x, y);\n");
+    omni_codegen_emit_raw(ctx, "    if (__builtin_mul_overflow(x, y, &l)) return mk_float((double)x * (double)y);\n");
+    omni_codegen_emit_raw(ctx, "    return magnitude_result(a, b, l);\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static Obj* prim_sqrt(Obj* a) {\n");
+    omni_codegen_emit_raw(ctx, "    if (is_float(a)) return mk_float(sqrt(a->f));\n");
+    omni_codegen_emit_raw(ctx, "    if (a->i >= 0) {\n");
+    omni_codegen_emit_raw(ctx, "        uint64_t n = (uint64_t)a->i, r = (uint64_t)sqrt((double)n);\n");
+    omni_codegen_emit_raw(ctx, "        while (r * r > n) r--;\n");
+    omni_codegen_emit_raw(ctx, "        while ((r + 1) * (r + 1) <= n) r++;\n");
+    omni_codegen_emit_raw(ctx, "        if (r * r == n) return mk_int((int64_t)r);\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    return mk_float(sqrt((double)a->i));\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static Obj* prim_cons(Obj* a, Obj* b) { inc_ref(a); inc_ref(b); return mk_cell(a, b); }\n");
+    omni_codegen_emit_raw(ctx, "static Obj* prim_car(Obj* lst) { return is_nil(lst) ? NIL : car(lst); }\n");
+    omni_codegen_emit_raw(ctx, "static Obj* prim_cdr(Obj* lst) { return is_nil(lst) ? NIL : cdr(lst); }\n");
+    omni_codegen_emit_raw(ctx, "static int test_null(Obj* o) { return is_nil(o); }\n");
+    omni_codegen_emit_raw(ctx, "static Obj* prim_null(Obj* o) { return mk_int(test_null(o)); }\n");
+    omni_codegen_emit_raw(ctx, "static Obj* prim_proper_list(Obj* o) {\n");
+    omni_codegen_emit_raw(ctx, "    while (o && !is_nil(o) && o->tag == T_CELL) o = cdr(o);\n");
+    omni_codegen_emit_raw(ctx, "    return mk_int(!o || is_nil(o) ? 1 : 0);\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+
+    /* eq?: identity, except that numbers, chars, symbols and strings compare by value
+     * (each is boxed afresh) and procedures without captures by code. hash agrees with eq?. */
+    omni_codegen_emit_raw(ctx, "static int is_eq(Obj* a, Obj* b) {\n");
+    omni_codegen_emit_raw(ctx, "    if (a == b) return 1;\n");
+    omni_codegen_emit_raw(ctx, "    if (!a || !b) return 0;\n");
+    omni_codegen_emit_raw(ctx, "    if (is_nil(a) || is_nil(b)) return is_nil(a) && is_nil(b);\n");
+    omni_codegen_emit_raw(ctx, "    if (a->tag != b->tag) return 0;\n");
+    omni_codegen_emit_raw(ctx, "    switch (a->tag) {\n");
+    omni_codegen_emit_raw(ctx, "    case T_INT: case T_CHAR: return a->i == b->i;\n");
+    omni_codegen_emit_raw(ctx, "    case T_SYM: case T_STRING: return strcmp(a->s, b->s) == 0;\n");
+    omni_codegen_emit_raw(ctx, "    case T_CODE: return a->code.fn == b->code.fn && a->code.count == 0 && b->code.count == 0;\n");
+    omni_codegen_emit_raw(ctx, "    default: return 0;\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static uint64_t obj_hash(Obj* o) {\n");
+    omni_codegen_emit_raw(ctx, "    uint64_t h;\n");
+    omni_codegen_emit_raw(ctx, "    if (!o || is_nil(o)) return 0;\n");
+    omni_codegen_emit_raw(ctx, "    switch (o->tag) {\n");
+    omni_codegen_emit_raw(ctx, "    case T_INT: case T_CHAR: h = (uint64_t)o->i; break;\n");
+    omni_codegen_emit_raw(ctx, "    case T_SYM: case T_STRING:\n");
+    omni_codegen_emit_raw(ctx, "        h = 1469598103934665603ull;\n");
+    omni_codegen_emit_raw(ctx, "        for (const char* p = o->s; *p; p++) h = (h ^ (unsigned char)*p) * 1099511628211ull;\n");
+    omni_codegen_emit_raw(ctx, "        break;\n");
+    omni_codegen_emit_raw(ctx, "    case T_CODE: h = (uint64_t)(uintptr_t)o->code.fn; break;\n");
+    omni_codegen_emit_raw(ctx, "    default: h = (uint64_t)(uintptr_t)o; break;\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    return h * 0x9E3779B97F4A7C15ull;\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "#define test_is_eq(a, b) is_eq(a, b)\n");
+    omni_codegen_emit_raw(ctx, "static Obj* prim_is_eq(Obj* a, Obj* b) { return mk_int(is_eq(a, b)); }\n");
+    omni_codegen_emit_raw(ctx, "static Obj* prim_hash(Obj* o) { return mk_int((int64_t)(obj_hash(o) >> 1)); }\n");
+    omni_codegen_emit_raw(ctx, "static int is_truthy(Obj* o) { return o && o != NIL && (o->tag != T_INT || o->i != 0) && (o->tag != T_FLOAT || o->f != 0.0); }\n\n");
+}
+
+static void rt_error(CodeGenContext* ctx) {
+    /* Error accessors: borrowed results, NULL if not an error */
+    omni_codegen_emit_raw(ctx, "static int is_error(Obj* o) { return o && o != NIL && o->tag == T_ERROR; }\n");
+    /* A program's exit status: an int's value, 1 for an error, else 0 */
+    omni_codegen_emit_raw(ctx, "#define omni_exit_status(o) (is_error(o) ? 1 : (o) && (o) != NIL && (o)->tag == T_INT ? (int)(o)->i : 0)\n");
+    omni_codegen_emit_raw(ctx, "static const char* error_message(Obj* e) { return is_error(e) ? e->err.msg : NULL; }\n");
+    omni_codegen_emit_raw(ctx, "static Obj* error_data(Obj* e) { return is_error(e) ? e->err.data : NULL; }\n\n");
+
+    /* (error msg [data]) - message comes from a symbol, a string, an int or another error */
+    omni_codegen_emit_raw(ctx, "static Obj* prim_error(Obj* msg, Obj* data) {\n");
+    omni_codegen_emit_raw(ctx, "    char buf[32];\n");
+    omni_codegen_emit_raw(ctx, "    const char* text = \"error\";\n");
+    omni_codegen_emit_raw(ctx, "    if (msg && msg != NIL && (msg->tag == T_SYM || msg->tag == T_STRING)) text = msg->s;\n");
+    omni_codegen_emit_raw(ctx, "    else if (is_error(msg) && msg->err.msg) text = msg->err.msg;\n");
+    omni_codegen_emit_raw(ctx, "    else if (msg && msg != NIL && msg->tag == T_INT) {\n");
+    omni_codegen_emit_raw(ctx, "        snprintf(buf, sizeof(buf), \"%%ld\", (long)msg->i);\n");
+    omni_codegen_emit_raw(ctx, "        text = buf;\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    Obj* e = mk_error_obj(text, data);\n");
+    /* A symbol names the error's kind; an error passes its kind on */
+    omni_codegen_emit_raw(ctx, "    e->err.tag = msg && msg != NIL && msg->tag == T_SYM ? msg : is_error(msg) ? msg->err.tag : NIL;\n");
+    omni_codegen_emit_raw(ctx, "    inc_ref(e->err.tag);\n");
+    omni_codegen_emit_raw(ctx, "    return e;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    omni_codegen_emit_raw(ctx, "static Obj* prim_error_message(Obj* e) {\n");
+    omni_codegen_emit_raw(ctx, "    const char* msg = error_message(e);\n");
+    omni_codegen_emit_raw(ctx, "    return msg ? mk_sym(msg) : NIL;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    omni_codegen_emit_raw(ctx, "static Obj* prim_error_data(Obj* e) {\n");
+    omni_codegen_emit_raw(ctx, "    Obj* data = error_data(e);\n");
+    omni_codegen_emit_raw(ctx, "    if (!data) return NIL;\n");
+    omni_codegen_emit_raw(ctx, "    inc_ref(data);\n");
+    omni_codegen_emit_raw(ctx, "    return data;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    omni_codegen_emit_raw(ctx, "static Obj* prim_error_tag(Obj* e) {\n");
+    omni_codegen_emit_raw(ctx, "    if (!is_error(e)) return NIL;\n");
+    omni_codegen_emit_raw(ctx, "    if (e->err.tag == NIL) return mk_sym(\"error\");\n");
+    omni_codegen_emit_raw(ctx, "    inc_ref(e->err.tag);\n");
+    omni_codegen_emit_raw(ctx, "    return e->err.tag;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    omni_codegen_emit_raw(ctx, "static Obj* prim_error_trace(Obj* e) {\n");
+    omni_codegen_emit_raw(ctx, "    if (!is_error(e)) return NIL;\n");
+    omni_codegen_emit_raw(ctx, "    inc_ref(e->err.trace);\n");
+    omni_codegen_emit_raw(ctx, "    return e->err.trace;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    omni_codegen_emit_raw(ctx, "#define test_is_error(o) is_error(o)\n");
+    omni_codegen_emit_raw(ctx, "static Obj* prim_is_error(Obj* o) { return mk_int(is_error(o) ? 1 : 0); }\n\n");
+}
+
+/* Emitters, indexed by section; array order is dependency order */
+static void rt_lists(CodeGenContext* ctx) {
+    /* Calling function values. A compiled function may hand back one of its
+     * arguments unchanged; take a reference so the caller always owns the
+     * result. */
+    omni_codegen_emit_raw(ctx, "static Obj* call_closure(Obj* fn, Obj** args, int argc) {\n");
+    omni_codegen_emit_raw(ctx, "    if (!fn || fn == NIL || fn->tag != T_CODE) return mk_error(\"not a procedure\");\n");
+    omni_codegen_emit_raw(ctx, "    if (fn->code.arity != argc) return mk_error(\"arity mismatch\");\n");
+    omni_codegen_emit_raw(ctx, "    Obj* r = fn->code.fn(fn->code.captures, args, argc);\n");
+    omni_codegen_emit_raw(ctx, "    for (int i = 0; i < argc; i++) {\n");
+    omni_codegen_emit_raw(ctx, "        if (r == args[i]) { inc_ref(r); break; }\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    return r;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    /* Inline caches: a call site through a global keeps, per thread, the
+     * entry point it resolved, valid while the global's version stamp is
+     * unchanged */
+    omni_codegen_emit_raw(ctx, "typedef struct { unsigned version; ClosureFn fn; Obj** captures; } OmniCallCache;\n\n");
+    omni_codegen_emit_raw(ctx, "static Obj* omni_call_cached(OmniCallCache* ic, Obj* fn, unsigned version, Obj** args, int argc) {\n");
+    omni_codegen_emit_raw(ctx, "    if (!ic->fn || ic->version != version) {\n");
+    omni_codegen_emit_raw(ctx, "        if (!fn || fn == NIL || fn->tag != T_CODE || fn->code.arity != argc) return call_closure(fn, args, argc);\n");
+    omni_codegen_emit_raw(ctx, "        ic->fn = fn->code.fn; ic->captures = fn->code.captures; ic->version = version;\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    Obj* r = ic->fn(ic->captures, args, argc);\n");
+    omni_codegen_emit_raw(ctx, "    for (int i = 0; i < argc; i++) {\n");
+    omni_codegen_emit_raw(ctx, "        if (r == args[i]) { inc_ref(r); break; }\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    return r;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    omni_codegen_emit_raw(ctx, "static int is_procedure(Obj* o) { return o && o != NIL && o->tag == T_CODE; }\n");
+    omni_codegen_emit_raw(ctx, "#define test_is_procedure(o) is_procedure(o)\n");
+    omni_codegen_emit_raw(ctx, "static Obj* prim_is_procedure(Obj* o) { return mk_int(is_procedure(o)); }\n");
+    omni_codegen_emit_raw(ctx, "static Obj* prim_arity(Obj* o) {\n");
+    omni_codegen_emit_raw(ctx, "    return is_procedure(o) ? mk_int(o->code.arity) : mk_error(\"not a procedure\");\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    /* List operations: iterative, arguments borrowed, results owned.
+     * New cells take a reference to every element they share. */
+    omni_codegen_emit_raw(ctx, "#define LIST_PUSH(head, tail, x) do { \\\n");
+    omni_codegen_emit_raw(ctx, "        Obj* _cell = mk_cell((x), NIL); \\\n");
+    omni_codegen_emit_raw(ctx, "        if ((tail) == NIL) (head) = _cell; else cdr(tail) = _cell; \\\n");
+    omni_codegen_emit_raw(ctx, "        (tail) = _cell; \\\n");
+    omni_codegen_emit_raw(ctx, "    } while (0)\n\n");
+
+    /* Checked mode (--checked): a dotted tail, or a non-list argument, is
+     * an error naming the operation instead of the end of the list */
+    omni_codegen_emit_raw(ctx, "static int g_checked_lists = 0;\n");
+    omni_codegen_emit_raw(ctx, "static void set_checked_lists(int on) { g_checked_lists = on; }\n\n");
+    omni_codegen_emit_raw(ctx, "static Obj* improper_list_error(const char* op, Obj* tail, int64_t n) {\n");
+    omni_codegen_emit_raw(ctx, "    char msg[128];\n");
+    omni_codegen_emit_raw(ctx, "    snprintf(msg, sizeof(msg), \"%%s: improper list, non-list tail after %%lld element%%s\",\n");
+    omni_codegen_emit_raw(ctx, "             op, (long long)n, n == 1 ? \"\" : \"s\");\n");
+    omni_codegen_emit_raw(ctx, "    return mk_error_obj(msg, tail);\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+    omni_codegen_emit_raw(ctx, "#define LIST_IMPROPER(xs) (g_checked_lists && (xs) && !is_nil(xs))\n\n");
+
+    omni_codegen_emit_raw(ctx, "static Obj* list_length(Obj* xs) {\n");
+    omni_codegen_emit_raw(ctx, "    int64_t n = 0;\n");
+    omni_codegen_emit_raw(ctx, "    for (; xs && !is_nil(xs) && xs->tag == T_CELL; xs = cdr(xs)) n++;\n");
+    omni_codegen_emit_raw(ctx, "    if (LIST_IMPROPER(xs)) return improper_list_error(\"length\", xs, n);\n");
+    omni_codegen_emit_raw(ctx, "    return mk_int(n);\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    /* append copies the spine of a and shares b as the tail */
+    omni_codegen_emit_raw(ctx, "static Obj* list_append(Obj* a, Obj* b) {\n");
+    omni_codegen_emit_raw(ctx, "    Obj* head = NIL;\n");
+    omni_codegen_emit_raw(ctx, "    Obj* tail = NIL;\n");
+    omni_codegen_emit_raw(ctx, "    int64_t n = 0;\n");
+    omni_codegen_emit_raw(ctx, "    for (; a && !is_nil(a) && a->tag == T_CELL; a = cdr(a), n++) {\n");
+    omni_codegen_emit_raw(ctx, "        inc_ref(car(a));\n");
+    omni_codegen_emit_raw(ctx, "        LIST_PUSH(head, tail, car(a));\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    if (LIST_IMPROPER(a)) { free_obj(head); return improper_list_error(\"append\", a, n); }\n");
+    omni_codegen_emit_raw(ctx, "    inc_ref(b);\n");
+    omni_codegen_emit_raw(ctx, "    if (tail == NIL) return b;\n");
+    omni_codegen_emit_raw(ctx, "    cdr(tail) = b;\n");
+    omni_codegen_emit_raw(ctx, "    return head;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    omni_codegen_emit_raw(ctx, "static Obj* list_reverse(Obj* xs) {\n");
+    omni_codegen_emit_raw(ctx, "    Obj* r = NIL;\n");
+    omni_codegen_emit_raw(ctx, "    int64_t n = 0;\n");
+    omni_codegen_emit_raw(ctx, "    for (; xs && !is_nil(xs) && xs->tag == T_CELL; xs = cdr(xs), n++) {\n");
+    omni_codegen_emit_raw(ctx, "        inc_ref(car(xs));\n");
+    omni_codegen_emit_raw(ctx, "        r = mk_cell(car(xs), r);\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    if (LIST_IMPROPER(xs)) { free_obj(r); return improper_list_error(\"reverse\", xs, n); }\n");
+    omni_codegen_emit_raw(ctx, "    return r;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    omni_codegen_emit_raw(ctx, "static Obj* list_map(Obj* fn, Obj* xs) {\n");
+    omni_codegen_emit_raw(ctx, "    Obj* head = NIL;\n");
+    omni_codegen_emit_raw(ctx, "    Obj* tail = NIL;\n");
+    omni_codegen_emit_raw(ctx, "    int64_t n = 0;\n");
+    omni_codegen_emit_raw(ctx, "    for (; xs && !is_nil(xs) && xs->tag == T_CELL; xs = cdr(xs), n++) {\n");
+    omni_codegen_emit_raw(ctx, "        Obj* args[1] = { car(xs) };\n");
+    omni_codegen_emit_raw(ctx, "        LIST_PUSH(head, tail, call_closure(fn, args, 1));\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    if (LIST_IMPROPER(xs)) { free_obj(head); return improper_list_error(\"map\", xs, n); }\n");
+    omni_codegen_emit_raw(ctx, "    return head;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    omni_codegen_emit_raw(ctx, "static Obj* list_filter(Obj* fn, Obj* xs) {\n");
+    omni_codegen_emit_raw(ctx, "    Obj* head = NIL;\n");
+    omni_codegen_emit_raw(ctx, "    Obj* tail = NIL;\n");
+    omni_codegen_emit_raw(ctx, "    int64_t n = 0;\n");
+    omni_codegen_emit_raw(ctx, "    for (; xs && !is_nil(xs) && xs->tag == T_CELL; xs = cdr(xs), n++) {\n");
+    omni_codegen_emit_raw(ctx, "        Obj* args[1] = { car(xs) };\n");
+    omni_codegen_emit_raw(ctx, "        Obj* keep = call_closure(fn, args, 1);\n");
+    omni_codegen_emit_raw(ctx, "        int truthy = is_truthy(keep);\n");
+    omni_codegen_emit_raw(ctx, "        free_obj(keep);\n");
+    omni_codegen_emit_raw(ctx, "        if (!truthy) continue;\n");
+    omni_codegen_emit_raw(ctx, "        inc_ref(car(xs));\n");
+    omni_codegen_emit_raw(ctx, "        LIST_PUSH(head, tail, car(xs));\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    if (LIST_IMPROPER(xs)) { free_obj(head); return improper_list_error(\"filter\", xs, n); }\n");
+    omni_codegen_emit_raw(ctx, "    return head;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    /* (for-each f xs) calls f for its effects and builds nothing */
+    omni_codegen_emit_raw(ctx, "static Obj* list_for_each(Obj* fn, Obj* xs) {\n");
+    omni_codegen_emit_raw(ctx, "    int64_t n = 0;\n");
+    omni_codegen_emit_raw(ctx, "    for (; xs && !is_nil(xs) && xs->tag == T_CELL; xs = cdr(xs), n++) {\n");
+    omni_codegen_emit_raw(ctx, "        Obj* args[1] = { car(xs) };\n");
+    omni_codegen_emit_raw(ctx, "        free_obj(call_closure(fn, args, 1));\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    if (LIST_IMPROPER(xs)) return improper_list_error(\"for-each\", xs, n);\n");
+    omni_codegen_emit_raw(ctx, "    return NIL;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    /* (fold f init xs) calls (f acc x) left to right */
+    omni_codegen_emit_raw(ctx, "static Obj* list_fold(Obj* fn, Obj* init, Obj* xs) {\n");
+    omni_codegen_emit_raw(ctx, "    Obj* acc = init;\n");
+    omni_codegen_emit_raw(ctx, "    inc_ref(acc);\n");
+    omni_codegen_emit_raw(ctx, "    int64_t n = 0;\n");
+    omni_codegen_emit_raw(ctx, "    for (; xs && !is_nil(xs) && xs->tag == T_CELL; xs = cdr(xs), n++) {\n");
+    omni_codegen_emit_raw(ctx, "        Obj* args[2] = { acc, car(xs) };\n");
+    omni_codegen_emit_raw(ctx, "        Obj* next = call_closure(fn, args, 2);\n");
+    omni_codegen_emit_raw(ctx, "        free_obj(acc);\n");
+    omni_codegen_emit_raw(ctx, "        acc = next;\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    if (LIST_IMPROPER(xs)) { free_obj(acc); return improper_list_error(\"fold\", xs, n); }\n");
+    omni_codegen_emit_raw(ctx, "    return acc;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+}
+
+static void rt_strings(CodeGenContext* ctx) {
+    /* String primitives: arguments borrowed, results owned. A wrong type
+     * or an index outside the string is an error naming the operation. */
+    omni_codegen_emit_raw(ctx, "static int is_string(Obj* o) { return o && o != NIL && o->tag == T_STRING; }\n");
+    omni_codegen_emit_raw(ctx, "static int is_index(Obj* o) { return o && o != NIL && o->tag == T_INT; }\n");
+    omni_codegen_emit_raw(ctx, "#define test_is_string(o) is_string(o)\n");
+    omni_codegen_emit_raw(ctx, "static Obj* prim_is_string(Obj* o) { return mk_int(is_string(o)); }\n\n");
+
+    omni_codegen_emit_raw(ctx, "static Obj* prim_string_length(Obj* s) {\n");
+    omni_codegen_emit_raw(ctx, "    if (!is_string(s)) return mk_error(\"string-length: not a string\");\n");
+    omni_codegen_emit_raw(ctx, "    return mk_int((int64_t)strlen(s->s));\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    omni_codegen_emit_raw(ctx, "static Obj* prim_string_append(Obj* a, Obj* b) {\n");
+    omni_codegen_emit_raw(ctx, "    if (!is_string(a) || !is_string(b)) return mk_error(\"string-append: not a string\");\n");
+    omni_codegen_emit_raw(ctx, "    size_t la = strlen(a->s), lb = strlen(b->s);\n");
+    omni_codegen_emit_raw(ctx, "    char* buf = malloc(la + lb + 1);\n");
+    omni_codegen_emit_raw(ctx, "    memcpy(buf, a->s, la);\n");
+    omni_codegen_emit_raw(ctx, "    memcpy(buf + la, b->s, lb + 1);\n");
+    omni_codegen_emit_raw(ctx, "    Obj* r = mk_string(buf);\n");
+    omni_codegen_emit_raw(ctx, "    free(buf);\n");
+    omni_codegen_emit_raw(ctx, "    return r;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    omni_codegen_emit_raw(ctx, "static Obj* prim_string_ref(Obj* s, Obj* i) {\n");
+    omni_codegen_emit_raw(ctx, "    if (!is_string(s)) return mk_error(\"string-ref: not a string\");\n");
+    omni_codegen_emit_raw(ctx, "    if (!is_index(i) || i->i < 0 || (size_t)i->i >= strlen(s->s)) return mk_error(\"string-ref: index out of range\");\n");
+    omni_codegen_emit_raw(ctx, "    return mk_char((unsigned char)s->s[i->i]);\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    omni_codegen_emit_raw(ctx, "static Obj* prim_substring(Obj* s, Obj* start, Obj* end) {\n");
+    omni_codegen_emit_raw(ctx, "    if (!is_string(s)) return mk_error(\"substring: not a string\");\n");
+    omni_codegen_emit_raw(ctx, "    int64_t len = (int64_t)strlen(s->s);\n");
+    omni_codegen_emit_raw(ctx, "    if (!is_index(start) || !is_index(end) || start->i < 0 || end->i < start->i || end->i > len) {\n");
+    omni_codegen_emit_raw(ctx, "        return mk_error(\"substring: index out of range\");\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    char* buf = malloc((size_t)(end->i - start->i) + 1);\n");
+    omni_codegen_emit_raw(ctx, "    memcpy(buf, s->s + start->i, (size_t)(end->i - start->i));\n");
+    omni_codegen_emit_raw(ctx, "    buf[end->i - start->i] = '\\0';\n");
+    omni_codegen_emit_raw(ctx, "    Obj* r = mk_string(buf);\n");
+    omni_codegen_emit_raw(ctx, "    free(buf);\n");
+    omni_codegen_emit_raw(ctx, "    return r;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+}
+
+static void rt_vectors(CodeGenContext* ctx) {
+    /* Vector primitives: arguments borrowed, results owned. Each slot
+     * holds its own reference, released when the slot is overwritten or
+     * the vector freed. */
+    omni_codegen_emit_raw(ctx, "static int is_vector(Obj* o) { return o && o != NIL && o->tag == T_VECTOR; }\n");
+    omni_codegen_emit_raw(ctx, "static int is_slot_index(Obj* v, Obj* i) {\n");
+    omni_codegen_emit_raw(ctx, "    return i && i != NIL && i->tag == T_INT && i->i >= 0 && i->i < v->vec.len;\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "#define test_is_vector(o) is_vector(o)\n");
+    omni_codegen_emit_raw(ctx, "static Obj* prim_is_vector(Obj* o) { return mk_int(is_vector(o)); }\n\n");
+
+    omni_codegen_emit_raw(ctx, "static Obj* mk_vector(int64_t n, Obj* init) {\n");
+    omni_codegen_emit_raw(ctx, "    budget_charge();\n");
+    omni_codegen_emit_raw(ctx, "    Obj* o = malloc(sizeof(Obj));\n");
+    omni_codegen_emit_raw(ctx, "    o->tag = T_VECTOR; o->rc = 1;\n");
+    omni_codegen_emit_raw(ctx, "    o->vec.len = n;\n");
+    omni_codegen_emit_raw(ctx, "    o->vec.items = malloc((size_t)(n ? n : 1) * sizeof(Obj*));\n");
+    omni_codegen_emit_raw(ctx, "    for (int64_t i = 0; i < n; i++) { inc_ref(init); o->vec.items[i] = init; }\n");
+    omni_codegen_emit_raw(ctx, "    return o;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    /* (vector a b ...) and [a b ...] */
+    omni_codegen_emit_raw(ctx, "static Obj* prim_vector_of(Obj** items, int n) {\n");
+    omni_codegen_emit_raw(ctx, "    Obj* o = mk_vector(n, NIL);\n");
+    omni_codegen_emit_raw(ctx, "    for (int i = 0; i < n; i++) { inc_ref(items[i]); o->vec.items[i] = items[i]; }\n");
+    omni_codegen_emit_raw(ctx, "    return o;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    omni_codegen_emit_raw(ctx, "static Obj* prim_make_vector(Obj* n, Obj* init) {\n");
+    omni_codegen_emit_raw(ctx, "    if (!n || n == NIL || n->tag != T_INT || n->i < 0) return mk_error(\"make-vector: length must be a non-negative integer\");\n");
+    omni_codegen_emit_raw(ctx, "    return mk_vector(n->i, init);\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    omni_codegen_emit_raw(ctx, "static Obj* prim_vector_length(Obj* v) {\n");
+    omni_codegen_emit_raw(ctx, "    if (!is_vector(v)) return mk_error(\"vector-length: not a vector\");\n");
+    omni_codegen_emit_raw(ctx, "    return mk_int(v->vec.len);\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    omni_codegen_emit_raw(ctx, "static Obj* prim_vector_ref(Obj* v, Obj* i) {\n");
+    omni_codegen_emit_raw(ctx, "    if (!is_vector(v)) return mk_error(\"vector-ref: not a vector\");\n");
+    omni_codegen_emit_raw(ctx, "    if (!is_slot_index(v, i)) return mk_error(\"vector-ref: index out of range\");\n");
+    omni_codegen_emit_raw(ctx, "    inc_ref(v->vec.items[i->i]);\n");
+    omni_codegen_emit_raw(ctx, "    return v->vec.items[i->i];\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    omni_codegen_emit_raw(ctx, "static Obj* prim_vector_set(Obj* v, Obj* i, Obj* x) {\n");
+    omni_codegen_emit_raw(ctx, "    if (!is_vector(v)) return mk_error(\"vector-set!: not a vector\");\n");
+    omni_codegen_emit_raw(ctx, "    if (!is_slot_index(v, i)) return mk_error(\"vector-set!: index out of range\");\n");
+    omni_codegen_emit_raw(ctx, "    Obj* old = v->vec.items[i->i];\n");
+    omni_codegen_emit_raw(ctx, "    inc_ref(x);\n");
+    omni_codegen_emit_raw(ctx, "    v->vec.items[i->i] = x;\n");
+    omni_codegen_emit_raw(ctx, "    free_obj(old);\n");
+    omni_codegen_emit_raw(ctx, "    return NIL;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+}
+
+static void rt_hashes(CodeGenContext* ctx) {
+    /* Hash table primitives: arguments borrowed, results owned. Keys
+     * compare with is_eq and hash with obj_hash. The table holds its own
+     * reference to each key and value, released when the entry is removed
+     * or the table freed. */
+    omni_codegen_emit_raw(ctx, "static int is_hash(Obj* o) { return o && o != NIL && o->tag == T_HASH; }\n");
+    omni_codegen_emit_raw(ctx, "#define test_is_hash(o) is_hash(o)\n");
+    omni_codegen_emit_raw(ctx, "static Obj* prim_is_hash(Obj* o) { return mk_int(is_hash(o)); }\n\n");
+
+    omni_codegen_emit_raw(ctx, "static HashNode** hash_bucket(HashTable* t, uint64_t code) {\n");
+    omni_codegen_emit_raw(ctx, "    return &t->buckets[(code ^ (code >> 32)) & (t->bucket_count - 1)];\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    /* The link pointing at key's node, or at the NULL ending its bucket */
+    omni_codegen_emit_raw(ctx, "static HashNode** hash_link(HashTable* t, Obj* key, uint64_t code) {\n");
+    omni_codegen_emit_raw(ctx, "    HashNode** link = hash_bucket(t, code);\n");
+    omni_codegen_emit_raw(ctx, "    while (*link && !((*link)->code == code && is_eq((*link)->key, key))) link = &(*link)->chain;\n");
+    omni_codegen_emit_raw(ctx, "    return link;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    /* Double the buckets, rechaining in insertion order */
+    omni_codegen_emit_raw(ctx, "static void hash_grow(HashTable* t) {\n");
+    omni_codegen_emit_raw(ctx, "    free(t->buckets);\n");
+    omni_codegen_emit_raw(ctx, "    t->bucket_count *= 2;\n");
+    omni_codegen_emit_raw(ctx, "    t->buckets = calloc(t->bucket_count, sizeof(HashNode*));\n");
+    omni_codegen_emit_raw(ctx, "    for (HashNode* n = t->first; n; n = n->next) {\n");
+    omni_codegen_emit_raw(ctx, "        HashNode** b = hash_bucket(t, n->code);\n");
+    omni_codegen_emit_raw(ctx, "        n->chain = *b; *b = n;\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    omni_codegen_emit_raw(ctx, "static Obj* prim_make_hash(void) {\n");
+    omni_codegen_emit_raw(ctx, "    budget_charge();\n");
+    omni_codegen_emit_raw(ctx, "    Obj* o = malloc(sizeof(Obj));\n");
+    omni_codegen_emit_raw(ctx, "    o->tag = T_HASH; o->rc = 1;\n");
+    omni_codegen_emit_raw(ctx, "    o->hash = calloc(1, sizeof(HashTable));\n");
+    omni_codegen_emit_raw(ctx, "    o->hash->bucket_count = 8;\n");
+    omni_codegen_emit_raw(ctx, "    o->hash->buckets = calloc(8, sizeof(HashNode*));\n");
+    omni_codegen_emit_raw(ctx, "    return o;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    omni_codegen_emit_raw(ctx, "static Obj* prim_hash_count(Obj* h) {\n");
+    omni_codegen_emit_raw(ctx, "    if (!is_hash(h)) return mk_error(\"hash-count: not a hash table\");\n");
+    omni_codegen_emit_raw(ctx, "    return mk_int((int64_t)h->hash->count);\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    /* The value stored under key, or nil */
+    omni_codegen_emit_raw(ctx, "static Obj* prim_hash_get(Obj* h, Obj* key) {\n");
+    omni_codegen_emit_raw(ctx, "    if (!is_hash(h)) return mk_error(\"hash-get: not a hash table\");\n");
+    omni_codegen_emit_raw(ctx, "    HashNode* n = *hash_link(h->hash, key, obj_hash(key));\n");
+    omni_codegen_emit_raw(ctx, "    if (!n) return NIL;\n");
+    omni_codegen_emit_raw(ctx, "    inc_ref(n->value);\n");
+    omni_codegen_emit_raw(ctx, "    return n->value;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    omni_codegen_emit_raw(ctx, "static Obj* prim_hash_set(Obj* h, Obj* key, Obj* value) {\n");
+    omni_codegen_emit_raw(ctx, "    if (!is_hash(h)) return mk_error(\"hash-set!: not a hash table\");\n");
+    omni_codegen_emit_raw(ctx, "    HashTable* t = h->hash;\n");
+    omni_codegen_emit_raw(ctx, "    uint64_t code = obj_hash(key);\n");
+    omni_codegen_emit_raw(ctx, "    HashNode** link = hash_link(t, key, code);\n");
+    omni_codegen_emit_raw(ctx, "    inc_ref(value);\n");
+    omni_codegen_emit_raw(ctx, "    if (*link) {\n");
+    omni_codegen_emit_raw(ctx, "        /* Keep the key already stored; replace the value */\n");
+    omni_codegen_emit_raw(ctx, "        Obj* old = (*link)->value;\n");
+    omni_codegen_emit_raw(ctx, "        (*link)->value = value;\n");
+    omni_codegen_emit_raw(ctx, "        free_obj(old);\n");
+    omni_codegen_emit_raw(ctx, "        return NIL;\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    HashNode* n = malloc(sizeof(HashNode));\n");
+    omni_codegen_emit_raw(ctx, "    inc_ref(key);\n");
+    omni_codegen_emit_raw(ctx, "    n->key = key; n->value = value; n->code = code; n->chain = NULL;\n");
+    omni_codegen_emit_raw(ctx, "    *link = n;\n");
+    omni_codegen_emit_raw(ctx, "    n->prev = t->last; n->next = NULL;\n");
+    omni_codegen_emit_raw(ctx, "    if (t->last) t->last->next = n; else t->first = n;\n");
+    omni_codegen_emit_raw(ctx, "    t->last = n;\n");
+    omni_codegen_emit_raw(ctx, "    if (++t->count > t->bucket_count) hash_grow(t);\n");
+    omni_codegen_emit_raw(ctx, "    return NIL;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    omni_codegen_emit_raw(ctx, "static Obj* prim_hash_remove(Obj* h, Obj* key) {\n");
+    omni_codegen_emit_raw(ctx, "    if (!is_hash(h)) return mk_error(\"hash-remove!: not a hash table\");\n");
+    omni_codegen_emit_raw(ctx, "    HashTable* t = h->hash;\n");
+    omni_codegen_emit_raw(ctx, "    HashNode** link = hash_link(t, key, obj_hash(key));\n");
+    omni_codegen_emit_raw(ctx, "    HashNode* n = *link;\n");
+    omni_codegen_emit_raw(ctx, "    if (!n) return NIL;\n");
+    omni_codegen_emit_raw(ctx, "    *link = n->chain;\n");
+    omni_codegen_emit_raw(ctx, "    if (n->prev) n->prev->next = n->next; else t->first = n->next;\n");
+    omni_codegen_emit_raw(ctx, "    if (n->next) n->next->prev = n->prev; else t->last = n->prev;\n");
+    omni_codegen_emit_raw(ctx, "    t->count--;\n");
+    omni_codegen_emit_raw(ctx, "    free_obj(n->key); free_obj(n->value);\n");
+    omni_codegen_emit_raw(ctx, "    free(n);\n");
+    omni_codegen_emit_raw(ctx, "    return NIL;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    /* Fresh list of the keys in insertion order */
+    omni_codegen_emit_raw(ctx, "static Obj* prim_hash_keys(Obj* h) {\n");
+    omni_codegen_emit_raw(ctx, "    if (!is_hash(h)) return mk_error(\"hash-keys: not a hash table\");\n");
+    omni_codegen_emit_raw(ctx, "    Obj* keys = NIL;\n");
+    omni_codegen_emit_raw(ctx, "    for (HashNode* n = h->hash->last; n; n = n->prev) {\n");
+    omni_codegen_emit_raw(ctx, "        inc_ref(n->key);\n");
+    omni_codegen_emit_raw(ctx, "        keys = mk_cell(n->key, keys);\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    return keys;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+}
+
+static void rt_persistent(CodeGenContext* ctx) {
+    /* Persistent maps and vectors: assoc, dissoc and conj return a new
+     * version sharing all but the changed path with the old one. A map is
+     * a hash array mapped trie over obj_hash, ending in collision nodes; a
+     * vector is a radix-balanced trie with its elements in the leaves.
+     * Nodes are counted while one thread reaches them. Freezing a version
+     * moves its nodes into a frozen group that, like a frozen SCC, is
+     * counted once as a whole, atomically, so versions in other threads
+     * share the nodes without touching their counts; spawn, future and
+     * channel sends freeze what they hand over. */
+    omni_codegen_emit_raw(ctx, "#define PTRIE_BITS 5\n");
+    omni_codegen_emit_raw(ctx, "#define PTRIE_WIDTH (1 << PTRIE_BITS)\n");
+    omni_codegen_emit_raw(ctx, "#define PTRIE_MASK (PTRIE_WIDTH - 1)\n");
+    omni_codegen_emit_raw(ctx, "typedef struct PSlot { Obj* key; Obj* value; struct PNode* node; } PSlot;\n");
+    omni_codegen_emit_raw(ctx, "typedef struct PNode {\n");
+    omni_codegen_emit_raw(ctx, "    int rc; int frozen;\n");
+    omni_codegen_emit_raw(ctx, "    uint32_t bitmap;  /* Map: slots present; 0 in a collision node */\n");
+    omni_codegen_emit_raw(ctx, "    int count;\n");
+    omni_codegen_emit_raw(ctx, "    int capacity;  /* Slots allocated; more than count in a transient's */\n");
+    omni_codegen_emit_raw(ctx, "    PSlot slots[];\n");
+    omni_codegen_emit_raw(ctx, "} PNode;\n");
+    omni_codegen_emit_raw(ctx, "typedef struct PGroup {\n");
+    omni_codegen_emit_raw(ctx, "    int rc;  /* Versions reaching it, and the next group */\n");
+    omni_codegen_emit_raw(ctx, "    PNode** nodes; int64_t count; int64_t capacity;\n");
+    omni_codegen_emit_raw(ctx, "    struct PGroup* older;\n");
+    omni_codegen_emit_raw(ctx, "} PGroup;\n");
+    omni_codegen_emit_raw(ctx, "typedef struct PColl {\n");
+    omni_codegen_emit_raw(ctx, "    int64_t count;\n");
+    omni_codegen_emit_raw(ctx, "    int shift;  /* Vector: bits above the leaf level */\n");
+    omni_codegen_emit_raw(ctx, "    int transient;  /* 1 for a transient, -1 once persistent! ends it */\n");
+    omni_codegen_emit_raw(ctx, "    PNode* root;\n");
+    omni_codegen_emit_raw(ctx, "    PGroup* group;  /* Frozen nodes this version reaches */\n");
+    omni_codegen_emit_raw(ctx, "} PColl;\n\n");
+    omni_codegen_emit_raw(ctx, "/* A node of count slots; for a transient (edit), with room to grow */\n");
+    omni_codegen_emit_raw(ctx, "static PNode* pnode_new(int count, int edit) {\n");
+    omni_codegen_emit_raw(ctx, "    int capacity = count;\n");
+    omni_codegen_emit_raw(ctx, "    if (edit) for (capacity = 4; capacity < count; capacity *= 2) {}\n");
+    omni_codegen_emit_raw(ctx, "    PNode* n = calloc(1, sizeof(PNode) + (size_t)capacity * sizeof(PSlot));\n");
+    omni_codegen_emit_raw(ctx, "    n->rc = 1; n->count = count; n->capacity = capacity;\n");
+    omni_codegen_emit_raw(ctx, "    return n;\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static void pnode_retain(PNode* n) { if (n && !n->frozen) n->rc++; }\n");
+    omni_codegen_emit_raw(ctx, "static void pnode_release(PNode* n) {\n");
+    omni_codegen_emit_raw(ctx, "    if (!n || n->frozen || --n->rc > 0) return;\n");
+    omni_codegen_emit_raw(ctx, "    for (int i = 0; i < n->count; i++) {\n");
+    omni_codegen_emit_raw(ctx, "        free_obj(n->slots[i].key); free_obj(n->slots[i].value);\n");
+    omni_codegen_emit_raw(ctx, "        pnode_release(n->slots[i].node);\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    free(n);\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "/* Whether a transient, owning the path down to n, may change it in place */\n");
+    omni_codegen_emit_raw(ctx, "static int pnode_owned(const PNode* n, int edit) { return edit && n && !n->frozen && n->rc == 1; }\n");
+    omni_codegen_emit_raw(ctx, "static void pslot_copy(PSlot* dst, const PSlot* src, int count) {\n");
+    omni_codegen_emit_raw(ctx, "    for (int i = 0; i < count; i++) {\n");
+    omni_codegen_emit_raw(ctx, "        dst[i] = src[i];\n");
+    omni_codegen_emit_raw(ctx, "        inc_ref(dst[i].key); inc_ref(dst[i].value); pnode_retain(dst[i].node);\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "/* n with count slots, to change: n itself when a transient owns it and it has room, else a fresh copy.\n");
+    omni_codegen_emit_raw(ctx, " * n is borrowed; the result is a new reference. */\n");
+    omni_codegen_emit_raw(ctx, "static PNode* pnode_edit(PNode* n, int count, int edit) {\n");
+    omni_codegen_emit_raw(ctx, "    if (pnode_owned(n, edit) && count <= n->capacity) {\n");
+    omni_codegen_emit_raw(ctx, "        for (int i = n->count; i < count; i++) n->slots[i] = (PSlot){ NULL, NULL, NULL };\n");
+    omni_codegen_emit_raw(ctx, "        n->count = count; n->rc++;\n");
+    omni_codegen_emit_raw(ctx, "        return n;\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    PNode* c = pnode_new(count, edit);\n");
+    omni_codegen_emit_raw(ctx, "    c->bitmap = n->bitmap;\n");
+    omni_codegen_emit_raw(ctx, "    pslot_copy(c->slots, n->slots, n->count < count ? n->count : count);\n");
+    omni_codegen_emit_raw(ctx, "    return c;\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "/* Set slot i of a node being changed: key and value are borrowed, node is taken */\n");
+    omni_codegen_emit_raw(ctx, "static void pslot_put(PNode* n, int i, Obj* key, Obj* value, PNode* node) {\n");
+    omni_codegen_emit_raw(ctx, "    PSlot old = n->slots[i];\n");
+    omni_codegen_emit_raw(ctx, "    inc_ref(key); inc_ref(value);\n");
+    omni_codegen_emit_raw(ctx, "    n->slots[i] = (PSlot){ key, value, node };\n");
+    omni_codegen_emit_raw(ctx, "    free_obj(old.key); free_obj(old.value); pnode_release(old.node);\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "/* n with an empty slot i before the ones from i on, as for pnode_edit */\n");
+    omni_codegen_emit_raw(ctx, "static PNode* pnode_insert(PNode* n, int i, int edit) {\n");
+    omni_codegen_emit_raw(ctx, "    if (pnode_owned(n, edit) && n->count < n->capacity) {\n");
+    omni_codegen_emit_raw(ctx, "        memmove(n->slots + i + 1, n->slots + i, (size_t)(n->count - i) * sizeof(PSlot));\n");
+    omni_codegen_emit_raw(ctx, "        n->slots[i] = (PSlot){ NULL, NULL, NULL };\n");
+    omni_codegen_emit_raw(ctx, "        n->count++; n->rc++;\n");
+    omni_codegen_emit_raw(ctx, "        return n;\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    PNode* c = pnode_new(n->count + 1, edit);\n");
+    omni_codegen_emit_raw(ctx, "    c->bitmap = n->bitmap;\n");
+    omni_codegen_emit_raw(ctx, "    pslot_copy(c->slots, n->slots, i);\n");
+    omni_codegen_emit_raw(ctx, "    pslot_copy(c->slots + i + 1, n->slots + i, n->count - i);\n");
+    omni_codegen_emit_raw(ctx, "    return c;\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "/* n without slot i, and without bit in its bitmap, as for pnode_edit */\n");
+    omni_codegen_emit_raw(ctx, "static PNode* pnode_without(PNode* n, int i, uint32_t bit, int edit) {\n");
+    omni_codegen_emit_raw(ctx, "    if (pnode_owned(n, edit)) {\n");
+    omni_codegen_emit_raw(ctx, "        pslot_put(n, i, NULL, NULL, NULL);\n");
+    omni_codegen_emit_raw(ctx, "        memmove(n->slots + i, n->slots + i + 1, (size_t)(n->count - i - 1) * sizeof(PSlot));\n");
+    omni_codegen_emit_raw(ctx, "        n->count--; n->bitmap &= ~bit; n->rc++;\n");
+    omni_codegen_emit_raw(ctx, "        return n;\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    PNode* c = pnode_new(n->count - 1, edit);\n");
+    omni_codegen_emit_raw(ctx, "    c->bitmap = n->bitmap & ~bit;\n");
+    omni_codegen_emit_raw(ctx, "    pslot_copy(c->slots, n->slots, i);\n");
+    omni_codegen_emit_raw(ctx, "    pslot_copy(c->slots + i, n->slots + i + 1, n->count - i - 1);\n");
+    omni_codegen_emit_raw(ctx, "    return c;\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    /* Bits below bit, counted without libgcc, which -freestanding lacks */
+    omni_codegen_emit_raw(ctx, "static int pslot_index(uint32_t bitmap, uint32_t bit) {\n");
+    omni_codegen_emit_raw(ctx, "    uint32_t x = bitmap & (bit - 1);\n");
+    omni_codegen_emit_raw(ctx, "    x = x - (x >> 1 & 0x55555555u);\n");
+    omni_codegen_emit_raw(ctx, "    x = (x & 0x33333333u) + (x >> 2 & 0x33333333u);\n");
+    omni_codegen_emit_raw(ctx, "    return (int)(((x + (x >> 4)) & 0x0F0F0F0Fu) * 0x01010101u >> 24);\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+    omni_codegen_emit_raw(ctx, "static void pgroup_retain(PGroup* g) { if (g) __atomic_add_fetch(&g->rc, 1, __ATOMIC_ACQ_REL); }\n");
+    omni_codegen_emit_raw(ctx, "static void pgroup_release(PGroup* g) {\n");
+    omni_codegen_emit_raw(ctx, "    while (g && __atomic_sub_fetch(&g->rc, 1, __ATOMIC_ACQ_REL) == 0) {\n");
+    omni_codegen_emit_raw(ctx, "        for (int64_t i = 0; i < g->count; i++) {\n");
+    omni_codegen_emit_raw(ctx, "            PNode* n = g->nodes[i];\n");
+    omni_codegen_emit_raw(ctx, "            for (int j = 0; j < n->count; j++) { free_obj(n->slots[j].key); free_obj(n->slots[j].value); }\n");
+    omni_codegen_emit_raw(ctx, "            free(n);\n");
+    omni_codegen_emit_raw(ctx, "        }\n");
+    omni_codegen_emit_raw(ctx, "        free(g->nodes);\n");
+    omni_codegen_emit_raw(ctx, "        PGroup* older = g->older;\n");
+    omni_codegen_emit_raw(ctx, "        free(g);\n");
+    omni_codegen_emit_raw(ctx, "        g = older;\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "/* n frozen into g: n itself when only this version reaches it, else a frozen copy */\n");
+    omni_codegen_emit_raw(ctx, "static PNode* pnode_freeze(PNode* n, PGroup* g) {\n");
+    omni_codegen_emit_raw(ctx, "    if (!n || n->frozen) return n;\n");
+    omni_codegen_emit_raw(ctx, "    if (n->rc > 1) { PNode* c = pnode_edit(n, n->count, 0); n->rc--; n = c; }\n");
+    omni_codegen_emit_raw(ctx, "    n->frozen = 1;\n");
+    omni_codegen_emit_raw(ctx, "    if (g->count == g->capacity) {\n");
+    omni_codegen_emit_raw(ctx, "        g->capacity = g->capacity ? g->capacity * 2 : 16;\n");
+    omni_codegen_emit_raw(ctx, "        g->nodes = realloc(g->nodes, (size_t)g->capacity * sizeof(PNode*));\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    g->nodes[g->count++] = n;\n");
+    omni_codegen_emit_raw(ctx, "    for (int i = 0; i < n->count; i++) n->slots[i].node = pnode_freeze(n->slots[i].node, g);\n");
+    omni_codegen_emit_raw(ctx, "    return n;\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static void pcoll_freeze(PColl* c) {\n");
+    omni_codegen_emit_raw(ctx, "    if (!c->root || c->root->frozen) return;\n");
+    omni_codegen_emit_raw(ctx, "    PGroup* g = calloc(1, sizeof(PGroup));\n");
+    omni_codegen_emit_raw(ctx, "    g->rc = 1;\n");
+    omni_codegen_emit_raw(ctx, "    g->older = c->group;  /* Takes the version's count */\n");
+    omni_codegen_emit_raw(ctx, "    c->root = pnode_freeze(c->root, g);\n");
+    omni_codegen_emit_raw(ctx, "    c->group = g;\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static void pcoll_free(PColl* c) {\n");
+    omni_codegen_emit_raw(ctx, "    pnode_release(c->root); pgroup_release(c->group);\n");
+    omni_codegen_emit_raw(ctx, "    free(c);\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static int is_pmap(Obj* o) { return o && o != NIL && o->tag == T_PMAP; }\n");
+    omni_codegen_emit_raw(ctx, "static int is_pvec(Obj* o) { return o && o != NIL && o->tag == T_PVEC; }\n");
+    omni_codegen_emit_raw(ctx, "static void share_pcoll(Obj* o) { if (is_pmap(o) || is_pvec(o)) pcoll_freeze(o->pcoll); }\n\n");
+    omni_codegen_emit_raw(ctx, "static void pnode_each(PNode* n, void (*f)(Obj* key, Obj* value, void* arg), void* arg) {\n");
+    omni_codegen_emit_raw(ctx, "    for (int i = 0; n && i < n->count; i++) {\n");
+    omni_codegen_emit_raw(ctx, "        if (n->slots[i].node) pnode_each(n->slots[i].node, f, arg);\n");
+    omni_codegen_emit_raw(ctx, "        else f(n->slots[i].key, n->slots[i].value, arg);\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "typedef struct PPrint { FILE* out; void (*item)(FILE*, Obj*); int map; int first; } PPrint;\n");
+    omni_codegen_emit_raw(ctx, "static void pprint_entry(Obj* key, Obj* value, void* arg) {\n");
+    omni_codegen_emit_raw(ctx, "    PPrint* p = arg;\n");
+    omni_codegen_emit_raw(ctx, "    if (!p->first) fputc(' ', p->out);\n");
+    omni_codegen_emit_raw(ctx, "    p->first = 0;\n");
+    omni_codegen_emit_raw(ctx, "    if (p->map) { p->item(p->out, key); fputc(' ', p->out); }\n");
+    omni_codegen_emit_raw(ctx, "    p->item(p->out, value);\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "/* #pmap{k v ...} in trie order, or #pvec[x ...]; a transient is opaque */\n");
+    omni_codegen_emit_raw(ctx, "static void print_pcoll(FILE* out, Obj* o, void (*item)(FILE*, Obj*)) {\n");
+    omni_codegen_emit_raw(ctx, "    PPrint p = { out, item, o->tag == T_PMAP, 1 };\n");
+    omni_codegen_emit_raw(ctx, "    if (o->pcoll->transient) { fputs(p.map ? \"#<transient pmap>\" : \"#<transient pvec>\", out); return; }\n");
+    omni_codegen_emit_raw(ctx, "    fputs(p.map ? \"#pmap{\" : \"#pvec[\", out);\n");
+    omni_codegen_emit_raw(ctx, "    pnode_each(o->pcoll->root, pprint_entry, &p);\n");
+    omni_codegen_emit_raw(ctx, "    fputc(p.map ? '}' : ']', out);\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+    omni_codegen_emit_raw(ctx, "/* Takes root, and a count of group */\n");
+    omni_codegen_emit_raw(ctx, "static Obj* mk_pcoll(Tag tag, int64_t count, int shift, PNode* root, PGroup* group) {\n");
+    omni_codegen_emit_raw(ctx, "    budget_charge();\n");
+    omni_codegen_emit_raw(ctx, "    Obj* o = malloc(sizeof(Obj));\n");
+    omni_codegen_emit_raw(ctx, "    o->tag = tag; o->rc = 1;\n");
+    omni_codegen_emit_raw(ctx, "    o->pcoll = malloc(sizeof(PColl));\n");
+    omni_codegen_emit_raw(ctx, "    o->pcoll->count = count; o->pcoll->shift = shift; o->pcoll->transient = 0;\n");
+    omni_codegen_emit_raw(ctx, "    o->pcoll->root = root; o->pcoll->group = group;\n");
+    omni_codegen_emit_raw(ctx, "    if (!g_free_pcoll) { g_free_pcoll = pcoll_free; g_share_pcoll = share_pcoll; print_pcoll_hook = print_pcoll; }\n");
+    omni_codegen_emit_raw(ctx, "    return o;\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static Obj* pcoll_derive(Obj* o, int64_t count, int shift, PNode* root) {\n");
+    omni_codegen_emit_raw(ctx, "    pgroup_retain(o->pcoll->group);\n");
+    omni_codegen_emit_raw(ctx, "    return mk_pcoll(o->tag, count, shift, root, o->pcoll->group);\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+    omni_codegen_emit_raw(ctx, "static PNode* pmap_assoc_node(PNode* n, int shift, uint64_t h, Obj* key, Obj* value, int* added, int edit);\n");
+    omni_codegen_emit_raw(ctx, "/* A trie holding two entries whose hashes agree below shift */\n");
+    omni_codegen_emit_raw(ctx, "static PNode* pmap_pair(int shift, Obj* k1, Obj* v1, uint64_t h2, Obj* k2, Obj* v2, int edit) {\n");
+    omni_codegen_emit_raw(ctx, "    if (shift >= 64) {\n");
+    omni_codegen_emit_raw(ctx, "        PNode* r = pnode_new(2, edit);\n");
+    omni_codegen_emit_raw(ctx, "        pslot_put(r, 0, k1, v1, NULL); pslot_put(r, 1, k2, v2, NULL);\n");
+    omni_codegen_emit_raw(ctx, "        return r;\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    int added;\n");
+    omni_codegen_emit_raw(ctx, "    PNode* one = pmap_assoc_node(NULL, shift, obj_hash(k1), k1, v1, &added, edit);\n");
+    omni_codegen_emit_raw(ctx, "    PNode* r = pmap_assoc_node(one, shift, h2, k2, v2, &added, edit);\n");
+    omni_codegen_emit_raw(ctx, "    pnode_release(one);\n");
+    omni_codegen_emit_raw(ctx, "    return r;\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "/* n with key bound to value, as for pnode_edit. n is changed before the child under it,\n");
+    omni_codegen_emit_raw(ctx, " * so a transient changes a child in place only when it owns n. */\n");
+    omni_codegen_emit_raw(ctx, "static PNode* pmap_assoc_node(PNode* n, int shift, uint64_t h, Obj* key, Obj* value, int* added, int edit) {\n");
+    omni_codegen_emit_raw(ctx, "    if (!n) {\n");
+    omni_codegen_emit_raw(ctx, "        PNode* r = pnode_new(1, edit);\n");
+    omni_codegen_emit_raw(ctx, "        r->bitmap = 1u << (h >> shift & PTRIE_MASK);\n");
+    omni_codegen_emit_raw(ctx, "        pslot_put(r, 0, key, value, NULL);\n");
+    omni_codegen_emit_raw(ctx, "        *added = 1;\n");
+    omni_codegen_emit_raw(ctx, "        return r;\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    if (!n->bitmap) {\n");
+    omni_codegen_emit_raw(ctx, "        int count = n->count;\n");
+    omni_codegen_emit_raw(ctx, "        for (int i = 0; i < count; i++) {\n");
+    omni_codegen_emit_raw(ctx, "            if (is_eq(n->slots[i].key, key)) {\n");
+    omni_codegen_emit_raw(ctx, "                PNode* r = pnode_edit(n, count, edit);\n");
+    omni_codegen_emit_raw(ctx, "                pslot_put(r, i, r->slots[i].key, value, NULL);\n");
+    omni_codegen_emit_raw(ctx, "                return r;\n");
+    omni_codegen_emit_raw(ctx, "            }\n");
+    omni_codegen_emit_raw(ctx, "        }\n");
+    omni_codegen_emit_raw(ctx, "        PNode* r = pnode_edit(n, count + 1, edit);\n");
+    omni_codegen_emit_raw(ctx, "        pslot_put(r, count, key, value, NULL);\n");
+    omni_codegen_emit_raw(ctx, "        *added = 1;\n");
+    omni_codegen_emit_raw(ctx, "        return r;\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    uint32_t bit = 1u << (h >> shift & PTRIE_MASK);\n");
+    omni_codegen_emit_raw(ctx, "    int i = pslot_index(n->bitmap, bit);\n");
+    omni_codegen_emit_raw(ctx, "    if (!(n->bitmap & bit)) {\n");
+    omni_codegen_emit_raw(ctx, "        PNode* r = pnode_insert(n, i, edit);\n");
+    omni_codegen_emit_raw(ctx, "        r->bitmap |= bit;\n");
+    omni_codegen_emit_raw(ctx, "        pslot_put(r, i, key, value, NULL);\n");
+    omni_codegen_emit_raw(ctx, "        *added = 1;\n");
+    omni_codegen_emit_raw(ctx, "        return r;\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    PNode* r = pnode_edit(n, n->count, edit);\n");
+    omni_codegen_emit_raw(ctx, "    const PSlot* s = &r->slots[i];\n");
+    omni_codegen_emit_raw(ctx, "    if (s->node) pslot_put(r, i, NULL, NULL, pmap_assoc_node(s->node, shift + PTRIE_BITS, h, key, value, added, edit));\n");
+    omni_codegen_emit_raw(ctx, "    else if (is_eq(s->key, key)) pslot_put(r, i, s->key, value, NULL);\n");
+    omni_codegen_emit_raw(ctx, "    else {\n");
+    omni_codegen_emit_raw(ctx, "        pslot_put(r, i, NULL, NULL, pmap_pair(shift + PTRIE_BITS, s->key, s->value, h, key, value, edit));\n");
+    omni_codegen_emit_raw(ctx, "        *added = 1;\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    return r;\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "/* n without key: n again, retained, when key is not there, else n changed as for pnode_edit or NULL for none */\n");
+    omni_codegen_emit_raw(ctx, "static PNode* pmap_dissoc_node(PNode* n, int shift, uint64_t h, Obj* key, int* removed, int edit) {\n");
+    omni_codegen_emit_raw(ctx, "    if (!n->bitmap) {\n");
+    omni_codegen_emit_raw(ctx, "        for (int i = 0; i < n->count; i++) {\n");
+    omni_codegen_emit_raw(ctx, "            if (is_eq(n->slots[i].key, key)) { *removed = 1; return n->count == 1 ? NULL : pnode_without(n, i, 0, edit); }\n");
+    omni_codegen_emit_raw(ctx, "        }\n");
+    omni_codegen_emit_raw(ctx, "        pnode_retain(n);\n");
+    omni_codegen_emit_raw(ctx, "        return n;\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    uint32_t bit = 1u << (h >> shift & PTRIE_MASK);\n");
+    omni_codegen_emit_raw(ctx, "    int i = pslot_index(n->bitmap, bit);\n");
+    omni_codegen_emit_raw(ctx, "    const PSlot* s = &n->slots[i];\n");
+    omni_codegen_emit_raw(ctx, "    if (!(n->bitmap & bit) || (!s->node && !is_eq(s->key, key))) { pnode_retain(n); return n; }\n");
+    omni_codegen_emit_raw(ctx, "    if (s->node) {\n");
+    omni_codegen_emit_raw(ctx, "        /* Whether anything goes is only known below, so the child changes in place only if n is owned too */\n");
+    omni_codegen_emit_raw(ctx, "        PNode* child = pmap_dissoc_node(s->node, shift + PTRIE_BITS, h, key, removed, pnode_owned(n, edit));\n");
+    omni_codegen_emit_raw(ctx, "        if (!*removed) { pnode_release(child); pnode_retain(n); return n; }\n");
+    omni_codegen_emit_raw(ctx, "        if (child) {\n");
+    omni_codegen_emit_raw(ctx, "            PNode* r = pnode_edit(n, n->count, edit);\n");
+    omni_codegen_emit_raw(ctx, "            pslot_put(r, i, NULL, NULL, child);\n");
+    omni_codegen_emit_raw(ctx, "            return r;\n");
+    omni_codegen_emit_raw(ctx, "        }\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    *removed = 1;\n");
+    omni_codegen_emit_raw(ctx, "    return n->count == 1 ? NULL : pnode_without(n, i, bit, edit);\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static const PSlot* pmap_find(PNode* n, uint64_t h, Obj* key) {\n");
+    omni_codegen_emit_raw(ctx, "    for (int shift = 0; n; shift += PTRIE_BITS) {\n");
+    omni_codegen_emit_raw(ctx, "        if (!n->bitmap) {\n");
+    omni_codegen_emit_raw(ctx, "            for (int i = 0; i < n->count; i++) if (is_eq(n->slots[i].key, key)) return &n->slots[i];\n");
+    omni_codegen_emit_raw(ctx, "            return NULL;\n");
+    omni_codegen_emit_raw(ctx, "        }\n");
+    omni_codegen_emit_raw(ctx, "        uint32_t bit = 1u << (h >> shift & PTRIE_MASK);\n");
+    omni_codegen_emit_raw(ctx, "        if (!(n->bitmap & bit)) return NULL;\n");
+    omni_codegen_emit_raw(ctx, "        const PSlot* s = &n->slots[pslot_index(n->bitmap, bit)];\n");
+    omni_codegen_emit_raw(ctx, "        if (!s->node) return is_eq(s->key, key) ? s : NULL;\n");
+    omni_codegen_emit_raw(ctx, "        n = s->node;\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    return NULL;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+    omni_codegen_emit_raw(ctx, "/* n with element i set to x, as for pnode_edit; n may be NULL or end before i */\n");
+    omni_codegen_emit_raw(ctx, "static PNode* pvec_set_node(PNode* n, int shift, int64_t i, Obj* x, int edit) {\n");
+    omni_codegen_emit_raw(ctx, "    int j = (int)(i >> shift & PTRIE_MASK);\n");
+    omni_codegen_emit_raw(ctx, "    int have = n ? n->count : 0;\n");
+    omni_codegen_emit_raw(ctx, "    PNode* r = n ? pnode_edit(n, j < have ? have : j + 1, edit) : pnode_new(j + 1, edit);\n");
+    omni_codegen_emit_raw(ctx, "    if (shift == 0) pslot_put(r, j, NULL, x, NULL);\n");
+    omni_codegen_emit_raw(ctx, "    else pslot_put(r, j, NULL, NULL, pvec_set_node(r->slots[j].node, shift - PTRIE_BITS, i, x, edit));\n");
+    omni_codegen_emit_raw(ctx, "    return r;\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static Obj* pvec_nth(PColl* c, int64_t i) {\n");
+    omni_codegen_emit_raw(ctx, "    PNode* n = c->root;\n");
+    omni_codegen_emit_raw(ctx, "    for (int shift = c->shift; shift > 0; shift -= PTRIE_BITS) n = n->slots[i >> shift & PTRIE_MASK].node;\n");
+    omni_codegen_emit_raw(ctx, "    return n->slots[i & PTRIE_MASK].value;\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static int64_t pvec_index(Obj* i) { return i && i != NIL && i->tag == T_INT ? i->i : -1; }\n\n");
+    omni_codegen_emit_raw(ctx, "/* o with count elements under root, a new reference: o itself, changed, for a transient, else another\n");
+    omni_codegen_emit_raw(ctx, " * version. Takes root. */\n");
+    omni_codegen_emit_raw(ctx, "static Obj* pcoll_update(Obj* o, int64_t count, int shift, PNode* root) {\n");
+    omni_codegen_emit_raw(ctx, "    PColl* c = o->pcoll;\n");
+    omni_codegen_emit_raw(ctx, "    if (!c->transient) return pcoll_derive(o, count, shift, root);\n");
+    omni_codegen_emit_raw(ctx, "    pnode_release(c->root);\n");
+    omni_codegen_emit_raw(ctx, "    c->root = root; c->count = count; c->shift = shift;\n");
+    omni_codegen_emit_raw(ctx, "    inc_ref(o);\n");
+    omni_codegen_emit_raw(ctx, "    return o;\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static Obj* pcoll_conj(Obj* v, Obj* x) {\n");
+    omni_codegen_emit_raw(ctx, "    PColl* c = v->pcoll;\n");
+    omni_codegen_emit_raw(ctx, "    int edit = c->transient;\n");
+    omni_codegen_emit_raw(ctx, "    if (c->root && c->count == (int64_t)PTRIE_WIDTH << c->shift) {\n");
+    omni_codegen_emit_raw(ctx, "        /* Full: the old root becomes the first child of a new one */\n");
+    omni_codegen_emit_raw(ctx, "        PNode* up = pnode_new(1, edit);\n");
+    omni_codegen_emit_raw(ctx, "        up->slots[0].node = c->root;\n");
+    omni_codegen_emit_raw(ctx, "        pnode_retain(c->root);\n");
+    omni_codegen_emit_raw(ctx, "        PNode* r = pvec_set_node(up, c->shift + PTRIE_BITS, c->count, x, edit);\n");
+    omni_codegen_emit_raw(ctx, "        pnode_release(up);\n");
+    omni_codegen_emit_raw(ctx, "        return pcoll_update(v, c->count + 1, c->shift + PTRIE_BITS, r);\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    return pcoll_update(v, c->count + 1, c->shift, pvec_set_node(c->root, c->shift, c->count, x, edit));\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static Obj* pcoll_assoc(Obj* coll, Obj* key, Obj* value, const char* range_error) {\n");
+    omni_codegen_emit_raw(ctx, "    PColl* c = coll->pcoll;\n");
+    omni_codegen_emit_raw(ctx, "    if (coll->tag == T_PMAP) {\n");
+    omni_codegen_emit_raw(ctx, "        int added = 0;\n");
+    omni_codegen_emit_raw(ctx, "        PNode* r = pmap_assoc_node(c->root, 0, obj_hash(key), key, value, &added, c->transient);\n");
+    omni_codegen_emit_raw(ctx, "        return pcoll_update(coll, c->count + added, 0, r);\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    int64_t i = pvec_index(key);\n");
+    omni_codegen_emit_raw(ctx, "    if (i < 0 || i > c->count) return mk_error(range_error);\n");
+    omni_codegen_emit_raw(ctx, "    if (i == c->count) return pcoll_conj(coll, value);\n");
+    omni_codegen_emit_raw(ctx, "    return pcoll_update(coll, c->count, c->shift, pvec_set_node(c->root, c->shift, i, value, c->transient));\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static Obj* pcoll_dissoc(Obj* m, Obj* key) {\n");
+    omni_codegen_emit_raw(ctx, "    int removed = 0;\n");
+    omni_codegen_emit_raw(ctx, "    PNode* r = m->pcoll->root ? pmap_dissoc_node(m->pcoll->root, 0, obj_hash(key), key, &removed, m->pcoll->transient) : NULL;\n");
+    omni_codegen_emit_raw(ctx, "    if (!removed) { pnode_release(r); inc_ref(m); return m; }\n");
+    omni_codegen_emit_raw(ctx, "    return pcoll_update(m, m->pcoll->count - 1, 0, r);\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static int is_transient(Obj* o) { return (is_pmap(o) || is_pvec(o)) && o->pcoll->transient; }\n");
+    omni_codegen_emit_raw(ctx, "/* A transient persistent! has, or has not, ended */\n");
+    omni_codegen_emit_raw(ctx, "static int is_ended_transient(Obj* o) { return is_transient(o) && o->pcoll->transient < 0; }\n");
+    omni_codegen_emit_raw(ctx, "static int is_live_transient(Obj* o) { return is_transient(o) && o->pcoll->transient > 0; }\n\n");
+    omni_codegen_emit_raw(ctx, "static Obj* prim_make_pmap(void) { return mk_pcoll(T_PMAP, 0, 0, NULL, NULL); }\n");
+    omni_codegen_emit_raw(ctx, "static Obj* prim_make_pvec(void) { return mk_pcoll(T_PVEC, 0, 0, NULL, NULL); }\n");
+    omni_codegen_emit_raw(ctx, "static Obj* prim_is_pmap(Obj* o) { return mk_int(is_pmap(o) && !is_transient(o)); }\n");
+    omni_codegen_emit_raw(ctx, "static Obj* prim_is_pvec(Obj* o) { return mk_int(is_pvec(o) && !is_transient(o)); }\n\n");
+    omni_codegen_emit_raw(ctx, "static Obj* prim_conj(Obj* v, Obj* x) {\n");
+    omni_codegen_emit_raw(ctx, "    if (is_transient(v)) return mk_error(\"conj: a transient (use conj!)\");\n");
+    omni_codegen_emit_raw(ctx, "    if (!is_pvec(v)) return mk_error(\"conj: not a persistent vector\");\n");
+    omni_codegen_emit_raw(ctx, "    return pcoll_conj(v, x);\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static Obj* prim_assoc(Obj* coll, Obj* key, Obj* value) {\n");
+    omni_codegen_emit_raw(ctx, "    if (is_transient(coll)) return mk_error(\"assoc: a transient (use assoc!)\");\n");
+    omni_codegen_emit_raw(ctx, "    if (!is_pmap(coll) && !is_pvec(coll)) return mk_error(\"assoc: not a persistent map or vector\");\n");
+    omni_codegen_emit_raw(ctx, "    return pcoll_assoc(coll, key, value, \"assoc: index out of range\");\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static Obj* prim_dissoc(Obj* m, Obj* key) {\n");
+    omni_codegen_emit_raw(ctx, "    if (is_transient(m)) return mk_error(\"dissoc: a transient (use dissoc!)\");\n");
+    omni_codegen_emit_raw(ctx, "    if (!is_pmap(m)) return mk_error(\"dissoc: not a persistent map\");\n");
+    omni_codegen_emit_raw(ctx, "    return pcoll_dissoc(m, key);\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+    omni_codegen_emit_raw(ctx, "/* The value under key, or element key of a vector; nil if there is none */\n");
+    omni_codegen_emit_raw(ctx, "static Obj* prim_get(Obj* coll, Obj* key) {\n");
+    omni_codegen_emit_raw(ctx, "    Obj* v = NIL;\n");
+    omni_codegen_emit_raw(ctx, "    if (is_ended_transient(coll)) return mk_error(\"get: transient used after persistent!\");\n");
+    omni_codegen_emit_raw(ctx, "    if (is_pmap(coll)) {\n");
+    omni_codegen_emit_raw(ctx, "        const PSlot* s = pmap_find(coll->pcoll->root, obj_hash(key), key);\n");
+    omni_codegen_emit_raw(ctx, "        if (s) v = s->value;\n");
+    omni_codegen_emit_raw(ctx, "    } else if (is_pvec(coll)) {\n");
+    omni_codegen_emit_raw(ctx, "        int64_t i = pvec_index(key);\n");
+    omni_codegen_emit_raw(ctx, "        if (i >= 0 && i < coll->pcoll->count) v = pvec_nth(coll->pcoll, i);\n");
+    omni_codegen_emit_raw(ctx, "    } else return mk_error(\"get: not a persistent map or vector\");\n");
+    omni_codegen_emit_raw(ctx, "    inc_ref(v);\n");
+    omni_codegen_emit_raw(ctx, "    return v;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+    omni_codegen_emit_raw(ctx, "static Obj* prim_count(Obj* coll) {\n");
+    omni_codegen_emit_raw(ctx, "    if (is_ended_transient(coll)) return mk_error(\"count: transient used after persistent!\");\n");
+    omni_codegen_emit_raw(ctx, "    if (!is_pmap(coll) && !is_pvec(coll)) return mk_error(\"count: not a persistent map or vector\");\n");
+    omni_codegen_emit_raw(ctx, "    return mk_int(coll->pcoll->count);\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+    omni_codegen_emit_raw(ctx, "static void collect_key(Obj* key, Obj* value, void* arg) {\n");
+    omni_codegen_emit_raw(ctx, "    (void)value;\n");
+    omni_codegen_emit_raw(ctx, "    Obj** keys = arg;\n");
+    omni_codegen_emit_raw(ctx, "    inc_ref(key);\n");
+    omni_codegen_emit_raw(ctx, "    *keys = mk_cell(key, *keys);\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "/* Fresh list of the keys, in the map's order */\n");
+    omni_codegen_emit_raw(ctx, "static Obj* prim_keys(Obj* m) {\n");
+    omni_codegen_emit_raw(ctx, "    if (is_ended_transient(m)) return mk_error(\"keys: transient used after persistent!\");\n");
+    omni_codegen_emit_raw(ctx, "    if (!is_pmap(m)) return mk_error(\"keys: not a persistent map\");\n");
+    omni_codegen_emit_raw(ctx, "    Obj* reversed = NIL;\n");
+    omni_codegen_emit_raw(ctx, "    pnode_each(m->pcoll->root, collect_key, &reversed);\n");
+    omni_codegen_emit_raw(ctx, "    Obj* keys = NIL;\n");
+    omni_codegen_emit_raw(ctx, "    for (Obj* p = reversed; !is_nil(p); p = cdr(p)) { inc_ref(car(p)); keys = mk_cell(car(p), keys); }\n");
+    omni_codegen_emit_raw(ctx, "    free_obj(reversed);\n");
+    omni_codegen_emit_raw(ctx, "    return keys;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+    omni_codegen_emit_raw(ctx, "static Obj* prim_freeze(Obj* coll) {\n");
+    omni_codegen_emit_raw(ctx, "    if (is_transient(coll)) return mk_error(\"freeze: a transient\");\n");
+    omni_codegen_emit_raw(ctx, "    if (!is_pmap(coll) && !is_pvec(coll)) return mk_error(\"freeze: not a persistent map or vector\");\n");
+    omni_codegen_emit_raw(ctx, "    pcoll_freeze(coll->pcoll);\n");
+    omni_codegen_emit_raw(ctx, "    inc_ref(coll);\n");
+    omni_codegen_emit_raw(ctx, "    return coll;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+    omni_codegen_emit_raw(ctx, "static Obj* prim_transient(Obj* coll) {\n");
+    omni_codegen_emit_raw(ctx, "    if (is_transient(coll) || (!is_pmap(coll) && !is_pvec(coll))) return mk_error(\"transient: not a persistent map or vector\");\n");
+    omni_codegen_emit_raw(ctx, "    pnode_retain(coll->pcoll->root);\n");
+    omni_codegen_emit_raw(ctx, "    Obj* t = pcoll_derive(coll, coll->pcoll->count, coll->pcoll->shift, coll->pcoll->root);\n");
+    omni_codegen_emit_raw(ctx, "    t->pcoll->transient = 1;\n");
+    omni_codegen_emit_raw(ctx, "    return t;\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "/* A new version with the transient's nodes, which it can no longer use */\n");
+    omni_codegen_emit_raw(ctx, "static Obj* prim_persistent(Obj* t) {\n");
+    omni_codegen_emit_raw(ctx, "    if (is_ended_transient(t)) return mk_error(\"persistent!: transient used after persistent!\");\n");
+    omni_codegen_emit_raw(ctx, "    if (!is_live_transient(t)) return mk_error(\"persistent!: not a transient\");\n");
+    omni_codegen_emit_raw(ctx, "    PColl* c = t->pcoll;\n");
+    omni_codegen_emit_raw(ctx, "    Obj* o = mk_pcoll(t->tag, c->count, c->shift, c->root, c->group);\n");
+    omni_codegen_emit_raw(ctx, "    c->root = NULL; c->group = NULL; c->count = 0; c->transient = -1;\n");
+    omni_codegen_emit_raw(ctx, "    return o;\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static Obj* prim_is_transient(Obj* o) { return mk_int(is_live_transient(o)); }\n");
+    omni_codegen_emit_raw(ctx, "static Obj* prim_transient_assoc(Obj* t, Obj* key, Obj* value) {\n");
+    omni_codegen_emit_raw(ctx, "    if (is_ended_transient(t)) return mk_error(\"assoc!: transient used after persistent!\");\n");
+    omni_codegen_emit_raw(ctx, "    if (!is_live_transient(t)) return mk_error(\"assoc!: not a transient\");\n");
+    omni_codegen_emit_raw(ctx, "    return pcoll_assoc(t, key, value, \"assoc!: index out of range\");\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static Obj* prim_transient_dissoc(Obj* t, Obj* key) {\n");
+    omni_codegen_emit_raw(ctx, "    if (is_ended_transient(t)) return mk_error(\"dissoc!: transient used after persistent!\");\n");
+    omni_codegen_emit_raw(ctx, "    if (!is_live_transient(t) || t->tag != T_PMAP) return mk_error(\"dissoc!: not a transient map\");\n");
+    omni_codegen_emit_raw(ctx, "    return pcoll_dissoc(t, key);\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static Obj* prim_transient_conj(Obj* t, Obj* x) {\n");
+    omni_codegen_emit_raw(ctx, "    if (is_ended_transient(t)) return mk_error(\"conj!: transient used after persistent!\");\n");
+    omni_codegen_emit_raw(ctx, "    if (!is_live_transient(t) || t->tag != T_PVEC) return mk_error(\"conj!: not a transient vector\");\n");
+    omni_codegen_emit_raw(ctx, "    return pcoll_conj(t, x);\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+}
+
+static void rt_user_types(CodeGenContext* ctx) {
+    /* deftype objects: the generated constructor, predicate, accessors and
+     * setters call these with the type's descriptor. Types match by
+     * descriptor or by name, so objects keep their type across units. */
+    omni_codegen_emit_raw(ctx, "static int user_type_is(const UserType* t, Obj* o) {\n");
+    omni_codegen_emit_raw(ctx, "    return o && o != NIL && o->tag == T_USER &&\n");
+    omni_codegen_emit_raw(ctx, "           (o->user.type == t || strcmp(o->user.type->name, t->name) == 0);\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    /* Fields are borrowed; the object holds a reference to each strong one */
+    omni_codegen_emit_raw(ctx, "static Obj* mk_user(const UserType* t, Obj** fields) {\n");
+    omni_codegen_emit_raw(ctx, "    budget_charge();\n");
+    omni_codegen_emit_raw(ctx, "    Obj* o = malloc(sizeof(Obj));\n");
+    omni_codegen_emit_raw(ctx, "    o->tag = T_USER; o->rc = 1;\n");
+    omni_codegen_emit_raw(ctx, "    o->user.type = t;\n");
+    omni_codegen_emit_raw(ctx, "    o->user.fields = malloc((size_t)(t->field_count ? t->field_count : 1) * sizeof(Obj*));\n");
+    omni_codegen_emit_raw(ctx, "    for (int i = 0; i < t->field_count; i++) {\n");
+    omni_codegen_emit_raw(ctx, "        if (!(t->weak >> i & 1)) inc_ref(fields[i]);\n");
+    omni_codegen_emit_raw(ctx, "        o->user.fields[i] = fields[i];\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    return o;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    omni_codegen_emit_raw(ctx, "static Obj* user_is(const UserType* t, Obj* o) { return mk_int(user_type_is(t, o)); }\n\n");
+
+    /* A sum type's objects are those of its variants, each of which names
+     * the sum in its descriptor; the tag is the variant's name */
+    omni_codegen_emit_raw(ctx, "static int user_sum_is(const UserType* sum, Obj* o) {\n");
+    omni_codegen_emit_raw(ctx, "    return o && o != NIL && o->tag == T_USER && o->user.type->sum &&\n");
+    omni_codegen_emit_raw(ctx, "           strcmp(o->user.type->sum, sum->name) == 0;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    omni_codegen_emit_raw(ctx, "static Obj* user_in(const UserType* sum, Obj* o) { return mk_int(user_sum_is(sum, o)); }\n\n");
+
+    omni_codegen_emit_raw(ctx, "static Obj* user_tag(const UserType* sum, Obj* o) {\n");
+    omni_codegen_emit_raw(ctx, "    if (!user_sum_is(sum, o)) {\n");
+    omni_codegen_emit_raw(ctx, "        char msg[256];\n");
+    omni_codegen_emit_raw(ctx, "        snprintf(msg, sizeof(msg), \"%%s-tag: not a %%s\", sum->name, sum->name);\n");
+    omni_codegen_emit_raw(ctx, "        return mk_error(msg);\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    return mk_sym(o->user.type->name);\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    omni_codegen_emit_raw(ctx, "static Obj* user_ref(const UserType* t, int i, Obj* o) {\n");
+    omni_codegen_emit_raw(ctx, "    if (!user_type_is(t, o)) {\n");
+    omni_codegen_emit_raw(ctx, "        char msg[256];\n");
+    omni_codegen_emit_raw(ctx, "        snprintf(msg, sizeof(msg), \"%%s-%%s: not a %%s\", t->name, t->fields[i], t->name);\n");
+    omni_codegen_emit_raw(ctx, "        return mk_error(msg);\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    inc_ref(o->user.fields[i]);\n");
+    omni_codegen_emit_raw(ctx, "    return o->user.fields[i];\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    omni_codegen_emit_raw(ctx, "static Obj* user_set(const UserType* t, int i, Obj* o, Obj* v) {\n");
+    omni_codegen_emit_raw(ctx, "    if (!user_type_is(t, o)) {\n");
+    omni_codegen_emit_raw(ctx, "        char msg[256];\n");
+    omni_codegen_emit_raw(ctx, "        snprintf(msg, sizeof(msg), \"set-%%s-%%s!: not a %%s\", t->name, t->fields[i], t->name);\n");
+    omni_codegen_emit_raw(ctx, "        return mk_error(msg);\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    Obj* old = o->user.fields[i];\n");
+    omni_codegen_emit_raw(ctx, "    o->user.fields[i] = v;\n");
+    omni_codegen_emit_raw(ctx, "    if (!(t->weak >> i & 1)) { inc_ref(v); free_obj(old); }\n");
+    omni_codegen_emit_raw(ctx, "    return NIL;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    /* Printers from define-printer, by type name. A printer is called with
+     * the object and a port for the stream it is printed to. */
+    omni_codegen_emit_raw(ctx, "typedef struct UserPrinter { const char* name; Obj* fn; struct UserPrinter* next; } UserPrinter;\n");
+    omni_codegen_emit_raw(ctx, "static UserPrinter* user_printers = NULL;\n\n");
+
+    omni_codegen_emit_raw(ctx, "static int print_user_custom(FILE* out, Obj* o) {\n");
+    omni_codegen_emit_raw(ctx, "    UserPrinter* p = user_printers;\n");
+    omni_codegen_emit_raw(ctx, "    while (p && strcmp(p->name, o->user.type->name) != 0) p = p->next;\n");
+    omni_codegen_emit_raw(ctx, "    if (!p) return 0;\n");
+    omni_codegen_emit_raw(ctx, "    Obj* port = mk_port(NULL, out, false);\n");
+    omni_codegen_emit_raw(ctx, "    Obj* args[2] = { o, port };\n");
+    omni_codegen_emit_raw(ctx, "    Obj* r = p->fn->code.fn(p->fn->code.captures, args, 2);\n");
+    omni_codegen_emit_raw(ctx, "    if (r != o && r != port) free_obj(r);\n");
+    omni_codegen_emit_raw(ctx, "    free_obj(port);\n");
+    omni_codegen_emit_raw(ctx, "    return 1;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    /* fn is borrowed; the registry holds a reference to it */
+    omni_codegen_emit_raw(ctx, "static Obj* user_printer(const UserType* t, Obj* fn) {\n");
+    omni_codegen_emit_raw(ctx, "    if (!fn || fn == NIL || fn->tag != T_CODE || fn->code.arity != 2) {\n");
+    omni_codegen_emit_raw(ctx, "        char msg[256];\n");
+    omni_codegen_emit_raw(ctx, "        snprintf(msg, sizeof(msg), \"define-printer %%s: expected a procedure of 2 arguments\", t->name);\n");
+    omni_codegen_emit_raw(ctx, "        return mk_error(msg);\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    UserPrinter* p = user_printers;\n");
+    omni_codegen_emit_raw(ctx, "    while (p && strcmp(p->name, t->name) != 0) p = p->next;\n");
+    omni_codegen_emit_raw(ctx, "    if (p) {\n");
+    omni_codegen_emit_raw(ctx, "        free_obj(p->fn);\n");
+    omni_codegen_emit_raw(ctx, "    } else {\n");
+    omni_codegen_emit_raw(ctx, "        p = malloc(sizeof(UserPrinter));\n");
+    omni_codegen_emit_raw(ctx, "        p->name = t->name; p->next = user_printers;\n");
+    omni_codegen_emit_raw(ctx, "        user_printers = p;\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    inc_ref(fn);\n");
+    omni_codegen_emit_raw(ctx, "    p->fn = fn;\n");
+    omni_codegen_emit_raw(ctx, "    print_user_hook = print_user_custom;\n");
+    omni_codegen_emit_raw(ctx, "    return NIL;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+}
+
+static void rt_ports(CodeGenContext* ctx) {
+    /* Ports beyond printing (see rt_print): the console, strings, files
+     * and sockets, read and written through the same primitives. Reading
+     * a port that also writes sends what it has written first, so a
+     * request goes out before its reply is awaited. The end of input
+     * reads as nil. */
+    omni_codegen_emit_raw(ctx, "#define test_is_port(o) is_port(o)\n");
+    omni_codegen_emit_raw(ctx, "static Obj* prim_is_port(Obj* o) { return mk_int(is_port(o)); }\n\n");
+
+    omni_codegen_emit_raw(ctx, "static Obj* prim_current_output_port(void) {\n");
+    omni_codegen_emit_raw(ctx, "    if (!g_output) return mk_port(NULL, stdout, false);\n");
+    omni_codegen_emit_raw(ctx, "    inc_ref(g_output);\n");
+    omni_codegen_emit_raw(ctx, "    return g_output;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    /* with-output-to-port: port is borrowed for the body */
+    omni_codegen_emit_raw(ctx, "static int omni_output_enter(Obj* port, Obj** outer) {\n");
+    omni_codegen_emit_raw(ctx, "    if (!is_port(port) || !port->port->out) return 0;\n");
+    omni_codegen_emit_raw(ctx, "    *outer = g_output; g_output = port;\n");
+    omni_codegen_emit_raw(ctx, "    return 1;\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static void omni_output_leave(Obj* outer) { g_output = outer; }\n\n");
+
+    omni_codegen_emit_raw(ctx, "static Obj* prim_open_output_string(void) {\n");
+    omni_codegen_emit_raw(ctx, "    Obj* o = mk_port(NULL, NULL, true);\n");
+    omni_codegen_emit_raw(ctx, "    o->port->string = true;\n");
+    omni_codegen_emit_raw(ctx, "    o->port->out = open_memstream(&o->port->text, &o->port->len);\n");
+    omni_codegen_emit_raw(ctx, "    return o;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    /* Everything written so far, closed or not */
+    omni_codegen_emit_raw(ctx, "static Obj* prim_get_output_string(Obj* p) {\n");
+    omni_codegen_emit_raw(ctx, "    if (!is_port(p) || !p->port->string) return mk_error(\"get-output-string: not a string port\");\n");
+    omni_codegen_emit_raw(ctx, "    if (p->port->out) fflush(p->port->out);\n");
+    omni_codegen_emit_raw(ctx, "    return mk_string(p->port->text ? p->port->text : \"\");\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    omni_codegen_emit_raw(ctx, "static Obj* prim_close_port(Obj* p) {\n");
+    omni_codegen_emit_raw(ctx, "    if (!is_port(p)) return mk_error(\"close-port: not a port\");\n");
+    omni_codegen_emit_raw(ctx, "    port_close(p->port);\n");
+    omni_codegen_emit_raw(ctx, "    return NIL;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    omni_codegen_emit_raw(ctx, "static Obj* prim_flush_port(Obj* p) {\n");
+    omni_codegen_emit_raw(ctx, "    FILE* out = is_port(p) ? p->port->out : NULL;\n");
+    omni_codegen_emit_raw(ctx, "    if (!out) return port_not_open(\"flush-port\");\n");
+    omni_codegen_emit_raw(ctx, "    fflush(out);\n");
+    omni_codegen_emit_raw(ctx, "    return NIL;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    /* (set-port-buffer! p n): buffer n bytes of the stream p writes, or
+     * else reads; 0 for none and 'line to write each line as it ends.
+     * What was buffered before is written first. A borrowed stream may
+     * outlive the port, so the buffer for one is never freed. */
+    omni_codegen_emit_raw(ctx, "static Obj* prim_set_port_buffer(Obj* p, Obj* size) {\n");
+    omni_codegen_emit_raw(ctx, "    FILE* f = !is_port(p) ? NULL : p->port->out ? p->port->out : p->port->in;\n");
+    omni_codegen_emit_raw(ctx, "    if (!f) return mk_error(\"set-port-buffer!: not an open port\");\n");
+    omni_codegen_emit_raw(ctx, "    int mode; size_t n = BUFSIZ;\n");
+    omni_codegen_emit_raw(ctx, "    if (size && size != NIL && size->tag == T_SYM && strcmp(size->s, \"line\") == 0) mode = _IOLBF;\n");
+    omni_codegen_emit_raw(ctx, "    else if (size && size != NIL && size->tag == T_INT && size->i >= 0) { n = (size_t)size->i; mode = n ? _IOFBF : _IONBF; }\n");
+    omni_codegen_emit_raw(ctx, "    else return mk_error(\"set-port-buffer!: expected a size in bytes or 'line\");\n");
+    omni_codegen_emit_raw(ctx, "    char* buf = mode == _IONBF ? NULL : malloc(n);\n");
+    omni_codegen_emit_raw(ctx, "    fflush(f);\n");
+    omni_codegen_emit_raw(ctx, "    if (setvbuf(f, buf, mode, n) != 0) {\n");
+    omni_codegen_emit_raw(ctx, "        free(buf);\n");
+    omni_codegen_emit_raw(ctx, "        return mk_error(\"set-port-buffer!: cannot change the buffer\");\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    if (p->port->owned) { free(p->port->buf); p->port->buf = buf; }\n");
+    omni_codegen_emit_raw(ctx, "    return NIL;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    if (ctx->freestanding) return;  /* No console input, files or sockets */
+
+    omni_codegen_emit_raw(ctx, "static Obj* prim_current_input_port(void) { return mk_port(stdin, NULL, false); }\n\n");
+
+    /* Ports with a file or connection open, oldest first: at exit, or
+     * before stopping for want of memory, each one's buffered output is
+     * written in that order */
+    omni_codegen_emit_raw(ctx, "static OmniPort* g_open_ports = NULL;\n");
+    omni_codegen_emit_raw(ctx, "static OmniPort* g_open_ports_last = NULL;\n");
+    omni_codegen_emit_raw(ctx, "static pthread_mutex_t g_open_ports_lock = PTHREAD_MUTEX_INITIALIZER;\n");
+    omni_codegen_emit_raw(ctx, "static void omni_flush_ports(void) {\n");
+    omni_codegen_emit_raw(ctx, "    pthread_mutex_lock(&g_open_ports_lock);\n");
+    omni_codegen_emit_raw(ctx, "    for (OmniPort* p = g_open_ports; p; p = p->next) if (p->out) fflush(p->out);\n");
+    omni_codegen_emit_raw(ctx, "    pthread_mutex_unlock(&g_open_ports_lock);\n");
+    omni_codegen_emit_raw(ctx, "    fflush(stdout);\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static void untrack_port(OmniPort* p) {\n");
+    omni_codegen_emit_raw(ctx, "    pthread_mutex_lock(&g_open_ports_lock);\n");
+    omni_codegen_emit_raw(ctx, "    if (p->prev) p->prev->next = p->next; else g_open_ports = p->next;\n");
+    omni_codegen_emit_raw(ctx, "    if (p->next) p->next->prev = p->prev; else g_open_ports_last = p->prev;\n");
+    omni_codegen_emit_raw(ctx, "    p->tracked = false;\n");
+    omni_codegen_emit_raw(ctx, "    pthread_mutex_unlock(&g_open_ports_lock);\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static Obj* track_port(Obj* o) {\n");
+    omni_codegen_emit_raw(ctx, "    static bool registered = false;\n");
+    omni_codegen_emit_raw(ctx, "    OmniPort* p = o->port;\n");
+    omni_codegen_emit_raw(ctx, "    pthread_mutex_lock(&g_open_ports_lock);\n");
+    omni_codegen_emit_raw(ctx, "    if (!registered) { atexit(omni_flush_ports); registered = true; }\n");
+    omni_codegen_emit_raw(ctx, "    g_untrack_port = untrack_port; g_flush_ports = omni_flush_ports;\n");
+    omni_codegen_emit_raw(ctx, "    p->prev = g_open_ports_last; p->next = NULL;\n");
+    omni_codegen_emit_raw(ctx, "    if (g_open_ports_last) g_open_ports_last->next = p; else g_open_ports = p;\n");
+    omni_codegen_emit_raw(ctx, "    g_open_ports_last = p;\n");
+    omni_codegen_emit_raw(ctx, "    p->tracked = true;\n");
+    omni_codegen_emit_raw(ctx, "    pthread_mutex_unlock(&g_open_ports_lock);\n");
+    omni_codegen_emit_raw(ctx, "    return o;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    omni_codegen_emit_raw(ctx, "static Obj* open_file_port(Obj* path, const char* mode, const char* who) {\n");
+    omni_codegen_emit_raw(ctx, "    char msg[96];\n");
+    omni_codegen_emit_raw(ctx, "    if (!path || path == NIL || path->tag != T_STRING) {\n");
+    omni_codegen_emit_raw(ctx, "        snprintf(msg, sizeof(msg), \"%%s: not a string\", who);\n");
+    omni_codegen_emit_raw(ctx, "        return mk_error(msg);\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    FILE* f = fopen(path->s, mode);\n");
+    omni_codegen_emit_raw(ctx, "    if (f && *mode == 'r') return mk_port(f, NULL, true);\n");
+    /* Files are fully buffered, but a terminal shows each line as it ends */
+    omni_codegen_emit_raw(ctx, "    if (f && isatty(fileno(f))) setvbuf(f, NULL, _IOLBF, BUFSIZ);\n");
+    omni_codegen_emit_raw(ctx, "    if (f) return track_port(mk_port(NULL, f, true));\n");
+    omni_codegen_emit_raw(ctx, "    snprintf(msg, sizeof(msg), \"%%s: cannot open the file\", who);\n");
+    omni_codegen_emit_raw(ctx, "    return mk_error_obj(msg, path);\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static Obj* prim_open_input_file(Obj* path) { return open_file_port(path, \"r\", \"open-input-file\"); }\n");
+    omni_codegen_emit_raw(ctx, "static Obj* prim_open_output_file(Obj* path) { return open_file_port(path, \"w\", \"open-output-file\"); }\n\n");
+
+    /* One port reading and writing the connection, through a stream for
+     * each direction */
+    omni_codegen_emit_raw(ctx, "static Obj* prim_tcp_connect(Obj* host, Obj* port) {\n");
+    omni_codegen_emit_raw(ctx, "    if (!host || host == NIL || host->tag != T_STRING || !port || port == NIL || port->tag != T_INT) {\n");
+    omni_codegen_emit_raw(ctx, "        return mk_error(\"tcp-connect: expected a host name and a port number\");\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    char service[24];\n");
+    omni_codegen_emit_raw(ctx, "    snprintf(service, sizeof(service), \"%%ld\", (long)port->i);\n");
+    omni_codegen_emit_raw(ctx, "    struct addrinfo hints, *found = NULL;\n");
+    omni_codegen_emit_raw(ctx, "    memset(&hints, 0, sizeof(hints));\n");
+    omni_codegen_emit_raw(ctx, "    hints.ai_family = AF_UNSPEC; hints.ai_socktype = SOCK_STREAM;\n");
+    omni_codegen_emit_raw(ctx, "    int fd = -1;\n");
+    omni_codegen_emit_raw(ctx, "    if (getaddrinfo(host->s, service, &hints, &found) == 0) {\n");
+    omni_codegen_emit_raw(ctx, "        for (struct addrinfo* a = found; a && fd < 0; a = a->ai_next) {\n");
+    omni_codegen_emit_raw(ctx, "            fd = socket(a->ai_family, a->ai_socktype, a->ai_protocol);\n");
+    omni_codegen_emit_raw(ctx, "            if (fd >= 0 && connect(fd, a->ai_addr, a->ai_addrlen) != 0) { close(fd); fd = -1; }\n");
+    omni_codegen_emit_raw(ctx, "        }\n");
+    omni_codegen_emit_raw(ctx, "        freeaddrinfo(found);\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    int fd2 = fd < 0 ? -1 : dup(fd);\n");
+    omni_codegen_emit_raw(ctx, "    FILE* in = fd2 < 0 ? NULL : fdopen(fd, \"r\");\n");
+    omni_codegen_emit_raw(ctx, "    FILE* out = in ? fdopen(fd2, \"w\") : NULL;\n");
+    omni_codegen_emit_raw(ctx, "    if (out) return track_port(mk_port(in, out, true));\n");
+    omni_codegen_emit_raw(ctx, "    if (in) fclose(in); else if (fd >= 0) close(fd);\n");
+    omni_codegen_emit_raw(ctx, "    if (fd2 >= 0) close(fd2);\n");
+    omni_codegen_emit_raw(ctx, "    return mk_error_obj(\"tcp-connect: cannot connect\", host);\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    omni_codegen_emit_raw(ctx, "static FILE* port_in(Obj* p) {\n");
+    omni_codegen_emit_raw(ctx, "    if (!is_port(p) || !p->port->in) return NULL;\n");
+    omni_codegen_emit_raw(ctx, "    if (p->port->out) fflush(p->port->out);\n");
+    omni_codegen_emit_raw(ctx, "    return p->port->in;\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    /* The next line without its newline */
+    omni_codegen_emit_raw(ctx, "static Obj* prim_read_line(Obj* p) {\n");
+    omni_codegen_emit_raw(ctx, "    FILE* in = port_in(p);\n");
+    omni_codegen_emit_raw(ctx, "    if (!in) return mk_error(\"read-line: not an open input port\");\n");
+    omni_codegen_emit_raw(ctx, "    size_t cap = 64, len = 0;\n");
+    omni_codegen_emit_raw(ctx, "    char* buf = malloc(cap);\n");
+    omni_codegen_emit_raw(ctx, "    int c;\n");
+    omni_codegen_emit_raw(ctx, "    while ((c = fgetc(in)) != EOF && c != '\\n') {\n");
+    omni_codegen_emit_raw(ctx, "        if (len + 1 == cap) buf = realloc(buf, cap *= 2);\n");
+    omni_codegen_emit_raw(ctx, "        buf[len++] = (char)c;\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    buf[len] = '\\0';\n");
+    omni_codegen_emit_raw(ctx, "    Obj* line = c == EOF && len == 0 ? NIL : mk_string(buf);\n");
+    omni_codegen_emit_raw(ctx, "    free(buf);\n");
+    omni_codegen_emit_raw(ctx, "    return line;\n");
+    omni_codegen_emit_raw(ctx, "}\n");
+    omni_codegen_emit_raw(ctx, "static Obj* prim_read_char(Obj* p) {\n");
+    omni_codegen_emit_raw(ctx, "    FILE* in = port_in(p);\n");
+    omni_codegen_emit_raw(ctx, "    if (!in) return mk_error(\"read-char: not an open input port\");\n");
+    omni_codegen_emit_raw(ctx, "    int c = fgetc(in);\n");
+    omni_codegen_emit_raw(ctx, "    return c == EOF ? NIL : mk_char(c);\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+}
+
+static void (*const g_runtime_section_emitters[OMNI_RT_COUNT])(CodeGenContext*) = {
+    [OMNI_RT_CORE] = rt_core,
+    [OMNI_RT_STACK] = rt_stack,
+    [OMNI_RT_WEAK] = rt_weak,
+    [OMNI_RT_REUSE] = rt_reuse,
+    [OMNI_RT_RC_ELISION] = rt_rc_elision,
+    [OMNI_RT_REGION] = rt_region,
+    [OMNI_RT_TETHER] = rt_tether,
+    [OMNI_RT_OWNERSHIP] = rt_ownership,
+    [OMNI_RT_CONCURRENCY] = rt_concurrency,
+    [OMNI_RT_PRINT] = rt_print,
+    [OMNI_RT_PRIMITIVES] = rt_primitives,
+    [OMNI_RT_ERROR] = rt_error,
+    [OMNI_RT_LISTS] = rt_lists,
+    [OMNI_RT_STRINGS] = rt_strings,
+    [OMNI_RT_VECTORS] = rt_vectors,
+    [OMNI_RT_HASHES] = rt_hashes,
+    [OMNI_RT_PERSISTENT] = rt_persistent,
+    [OMNI_RT_USER_TYPES] = rt_user_types,
+    [OMNI_RT_PORTS] = rt_ports,
+};
+
+void omni_codegen_runtime_sections(CodeGenContext* ctx, unsigned mask) {
+    mask = omni_runtime_section_closure(mask);
+    if (ctx->freestanding) mask &= ~OMNI_RT_BIT(OMNI_RT_CONCURRENCY);  /* No threads */
+    rt_prelude(ctx);
+    for (int i = 0; i < OMNI_RT_COUNT; i++) {
+        if (mask & OMNI_RT_BIT(i)) g_runtime_section_emitters[i](ctx);
+    }
+}
+
+static bool ident_char(char c) {
+    return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '_';
+}
+
+/* Whether name occurs in code as a whole identifier */
+static bool uses_name(const char* code, const char* name, size_t len) {
+    for (const char* p = strstr(code, name); p; p = strstr(p + 1, name)) {
+        if ((p == code || !ident_char(p[-1])) && !ident_char(p[len])) return true;
+    }
+    return false;
+}
+
+/* The name a top-level line of runtime text defines, if any: a macro,
+ * a function pointer type, or the last identifier before the first of
+ * ( = ; [ in a function or variable. Copied into name. */
+static bool defined_on_line(const char* line, const char* end, char* name, size_t cap) {
+    const char* start = NULL;
+    const char* stop = NULL;
+    if (strncmp(line, "#define ", 8) == 0) {
+        start = line + 8;
+    } else if (*line == '#' || *line == '/' || *line == ' ' || *line == '\t' || *line == '{') {
+        return false;
+    } else {
+        const char* fnptr = strstr(line, "(*");
+        if (fnptr && fnptr < end) {
+            start = fnptr + 2;
+        } else {
+            stop = line;
+            while (stop < end && !strchr("(=;[", *stop)) stop++;
+            if (stop == end) return false;
+            while (stop > line && !ident_char(stop[-1])) stop--;
+            start = stop;
+            while (start > line && ident_char(start[-1])) start--;
+        }
+    }
+    if (!stop) {
+        stop = start;
+        while (stop < end && ident_char(*stop)) stop++;
+    }
+    size_t len = (size_t)(stop - start);
+    if (len == 0 || len >= cap || !(ident_char(*start) && !(*start >= '0' && *start <= '9'))) {
+        return false;
+    }
+    memcpy(name, start, len);
+    name[len] = '\0';
+    return true;
+}
+
+unsigned omni_runtime_sections_used(const char* code) {
+    unsigned mask = 0;
+    for (int i = 0; i < OMNI_RT_COUNT; i++) {
+        CodeGenContext* tmp = omni_codegen_new_buffer(NULL);
+        g_runtime_section_emitters[i](tmp);
+        for (const char* line = tmp->output_buffer; *line && !(mask & OMNI_RT_BIT(i));) {
+            const char* end = strchr(line, '\n');
+            if (!end) end = line + strlen(line);
+            char name[128];
+            if (defined_on_line(line, end, name, sizeof(name)) &&
+                uses_name(code, name, strlen(name))) {
+                mask |= OMNI_RT_BIT(i);
+            }
+            line = *end ? end + 1 : end;
+        }
+        omni_codegen_free(tmp);
+    }
+    return omni_runtime_section_closure(mask);
+}
+
+/*
+ * Step recording: each call to a top-level function is kept, as the text
+ * of the call and of its result, in a ring of the last record_steps calls.
+ * A set! of any variable, local or top-level, is kept as the step's
+ * environment delta, old and new value, on the call running it; at top
+ * level it is a step of its own. Text is captured when the step happens, so later frees and
+ * mutation do not change what debug-history shows. With PURPLE_STEP_LOG
+ * set, the kept steps are written to that file at exit, for the REPL.
+ */
+static void rt_step_recorder(CodeGenContext* ctx) {
+    omni_codegen_emit_raw(ctx, "/* Step recording for debug-history */\n");
+    /* POSIX 2008, which -std=c99 headers leave undeclared */
+    omni_codegen_emit_raw(ctx, "FILE* open_memstream(char** buf, size_t* len);\n");
+    omni_codegen_emit_raw(ctx, "#define OMNI_STEPS %zu\n", ctx->record_steps);
+    omni_codegen_emit_raw(ctx, "typedef struct { char* call; char* result; char* delta; } OmniStep;\n");
+    omni_codegen_emit_raw(ctx, "static OmniStep omni_steps[OMNI_STEPS];\n");
+    omni_codegen_emit_raw(ctx, "static long omni_step_total = 0;\n");
+    omni_codegen_emit_raw(ctx, "static long omni_step_current = -1;  /* The call running now; -1 at top level */\n");
+    omni_codegen_emit_raw(ctx, "static const char* omni_step_log = NULL;\n\n");
+
+    omni_codegen_emit_raw(ctx, "static long omni_step_new(char* call) {\n");
+    omni_codegen_emit_raw(ctx, "    OmniStep* s = &omni_steps[omni_step_total %% OMNI_STEPS];\n");
+    omni_codegen_emit_raw(ctx, "    omni_libc_free(s->call); omni_libc_free(s->result); omni_libc_free(s->delta);\n");
+    omni_codegen_emit_raw(ctx, "    s->call = call; s->result = NULL; s->delta = NULL;\n");
+    omni_codegen_emit_raw(ctx, "    return omni_step_total++;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    omni_codegen_emit_raw(ctx, "static long omni_step_begin(const char* name, int argc, Obj** args) {\n");
+    omni_codegen_emit_raw(ctx, "    char* text = NULL; size_t len = 0;\n");
+    omni_codegen_emit_raw(ctx, "    FILE* f = open_memstream(&text, &len);\n");
+    omni_codegen_emit_raw(ctx, "    fprintf(f, \"(%%s\", name);\n");
+    omni_codegen_emit_raw(ctx, "    for (int i = 0; i < argc; i++) { fputc(' ', f); write_obj_to(f, args[i]); }\n");
+    omni_codegen_emit_raw(ctx, "    fputc(')', f);\n");
+    omni_codegen_emit_raw(ctx, "    fclose(f);\n");
+    omni_codegen_emit_raw(ctx, "    return omni_step_current = omni_step_new(text);\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    /* A step whose slot was reused by later calls keeps no result; up is
+     * the call that was running when it began */
+    omni_codegen_emit_raw(ctx, "static Obj* omni_step_end(long step, long up, Obj* result) {\n");
+    omni_codegen_emit_raw(ctx, "    omni_step_current = up;\n");
+    omni_codegen_emit_raw(ctx, "    if (omni_step_total - step > OMNI_STEPS) return result;\n");
+    omni_codegen_emit_raw(ctx, "    char* text = NULL; size_t len = 0;\n");
+    omni_codegen_emit_raw(ctx, "    FILE* f = open_memstream(&text, &len);\n");
+    omni_codegen_emit_raw(ctx, "    write_obj_to(f, result);\n");
+    omni_codegen_emit_raw(ctx, "    fclose(f);\n");
+    omni_codegen_emit_raw(ctx, "    omni_steps[step %% OMNI_STEPS].result = text;\n");
+    omni_codegen_emit_raw(ctx, "    return result;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    omni_codegen_emit_raw(ctx, "static char* omni_step_text(Obj* x) {\n");
+    omni_codegen_emit_raw(ctx, "    char* text = NULL; size_t len = 0;\n");
+    omni_codegen_emit_raw(ctx, "    FILE* f = open_memstream(&text, &len);\n");
+    omni_codegen_emit_raw(ctx, "    write_obj_to(f, x);\n");
+    omni_codegen_emit_raw(ctx, "    fclose(f);\n");
+    omni_codegen_emit_raw(ctx, "    return text;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    /* old is the variable's value as text, taken before the new value was
+     * computed, which may free it */
+    omni_codegen_emit_raw(ctx, "static void omni_step_set(const char* name, char* old, Obj* value) {\n");
+    omni_codegen_emit_raw(ctx, "    long step = omni_step_current;\n");
+    omni_codegen_emit_raw(ctx, "    char* text = NULL; size_t len = 0;\n");
+    omni_codegen_emit_raw(ctx, "    FILE* f;\n");
+    omni_codegen_emit_raw(ctx, "    if (step < 0 || omni_step_total - step > OMNI_STEPS) {\n");
+    omni_codegen_emit_raw(ctx, "        f = open_memstream(&text, &len);\n");
+    omni_codegen_emit_raw(ctx, "        fprintf(f, \"(set! %%s \", name);\n");
+    omni_codegen_emit_raw(ctx, "        write_obj_to(f, value);\n");
+    omni_codegen_emit_raw(ctx, "        fputc(')', f);\n");
+    omni_codegen_emit_raw(ctx, "        fclose(f);\n");
+    omni_codegen_emit_raw(ctx, "        step = omni_step_new(text);\n");
+    omni_codegen_emit_raw(ctx, "        omni_step_end(step, omni_step_current, NIL);\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    OmniStep* s = &omni_steps[step %% OMNI_STEPS];\n");
+    omni_codegen_emit_raw(ctx, "    f = open_memstream(&text, &len);\n");
+    omni_codegen_emit_raw(ctx, "    if (s->delta) fprintf(f, \"%%s, \", s->delta);\n");
+    omni_codegen_emit_raw(ctx, "    fprintf(f, \"%%s: %%s -> \", name, old);\n");
+    omni_codegen_emit_raw(ctx, "    write_obj_to(f, value);\n");
+    omni_codegen_emit_raw(ctx, "    fclose(f);\n");
+    omni_codegen_emit_raw(ctx, "    omni_libc_free(old);\n");
+    omni_codegen_emit_raw(ctx, "    omni_libc_free(s->delta);\n");
+    omni_codegen_emit_raw(ctx, "    s->delta = text;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    /* Steps still running show ... for their result */
+    omni_codegen_emit_raw(ctx, "static void omni_step_print(FILE* out, long i) {\n");
+    omni_codegen_emit_raw(ctx, "    OmniStep* s = &omni_steps[i %% OMNI_STEPS];\n");
+    omni_codegen_emit_raw(ctx, "    fprintf(out, \"step %%ld: %%s => %%s\", i + 1, s->call, s->result ? s->result : \"...\");\n");
+    omni_codegen_emit_raw(ctx, "    if (s->delta) fprintf(out, \" ; %%s\", s->delta);\n");
+    omni_codegen_emit_raw(ctx, "    fputc('\\n', out);\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    /* Oldest first */
+    omni_codegen_emit_raw(ctx, "static Obj* omni_debug_history(long n) {\n");
+    omni_codegen_emit_raw(ctx, "    long first = omni_step_total - n;\n");
+    omni_codegen_emit_raw(ctx, "    if (first < omni_step_total - OMNI_STEPS) first = omni_step_total - OMNI_STEPS;\n");
+    omni_codegen_emit_raw(ctx, "    if (first < 0) first = 0;\n");
+    omni_codegen_emit_raw(ctx, "    for (long i = first; i < omni_step_total; i++) omni_step_print(stdout, i);\n");
+    omni_codegen_emit_raw(ctx, "    return NIL;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    omni_codegen_emit_raw(ctx, "static void omni_step_save(void) {\n");
+    omni_codegen_emit_raw(ctx, "    FILE* f = fopen(omni_step_log, \"w\");\n");
+    omni_codegen_emit_raw(ctx, "    if (!f) return;\n");
+    omni_codegen_emit_raw(ctx, "    long first = omni_step_total > OMNI_STEPS ? omni_step_total - OMNI_STEPS : 0;\n");
+    omni_codegen_emit_raw(ctx, "    for (long i = first; i < omni_step_total; i++) omni_step_print(f, i);\n");
+    omni_codegen_emit_raw(ctx, "    fclose(f);\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    omni_codegen_emit_raw(ctx, "static void omni_step_enable(void) {\n");
+    omni_codegen_emit_raw(ctx, "    omni_step_log = getenv(\"PURPLE_STEP_LOG\");\n");
+    omni_codegen_emit_raw(ctx, "    if (omni_step_log && *omni_step_log) atexit(omni_step_save);\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+}
+
+/*
+ * Constraint checking (--constraint-check): a side table of the objects the
+ * compiler saw bound or borrowed, keyed by address. The runtime's free hook
+ * reports any object freed while a borrow the analysis inferred is still
+ * open, with the site that bound it and the site that borrowed it.
+ * With PURPLE_CONSTRAINT_TRACE set, every event is also written to that
+ * file for runtime/tools/constraint_verify.c to replay.
+ */
+static void rt_constraint_check(CodeGenContext* ctx) {
+    omni_codegen_emit_raw(ctx, "/* Constraint checking */\n");
+    omni_codegen_emit_raw(ctx, "#define OMNI_CC_BUCKETS 1024\n");
+    omni_codegen_emit_raw(ctx, "typedef struct OmniConstraint {\n");
+    omni_codegen_emit_raw(ctx, "    Obj* obj;\n");
+    omni_codegen_emit_raw(ctx, "    const char* alloc_site;\n");
+    omni_codegen_emit_raw(ctx, "    const char* borrow_site;   /* Innermost open borrow */\n");
+    omni_codegen_emit_raw(ctx, "    int borrows;\n");
+    omni_codegen_emit_raw(ctx, "    struct OmniConstraint* next;\n");
+    omni_codegen_emit_raw(ctx, "} OmniConstraint;\n");
+    omni_codegen_emit_raw(ctx, "static OmniConstraint* omni_cc_buckets[OMNI_CC_BUCKETS];\n");
+    omni_codegen_emit_raw(ctx, "static long omni_cc_violations = 0;\n");
+    omni_codegen_emit_raw(ctx, "static FILE* omni_cc_trace = NULL;   /* PURPLE_CONSTRAINT_TRACE */\n\n");
+
+    /* One line per event: kind, object address, site */
+    omni_codegen_emit_raw(ctx, "static void omni_cc_event(const char* kind, Obj* o, const char* site) {\n");
+    omni_codegen_emit_raw(ctx, "    if (!omni_cc_trace) return;\n");
+    omni_codegen_emit_raw(ctx, "    fprintf(omni_cc_trace, \"%%s %%p\", kind, (void*)o);\n");
+    omni_codegen_emit_raw(ctx, "    if (site) {\n");
+    omni_codegen_emit_raw(ctx, "        fputc(' ', omni_cc_trace);\n");
+    omni_codegen_emit_raw(ctx, "        for (const char* p = site; *p; p++) fputc(*p == '\\n' ? ' ' : *p, omni_cc_trace);\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    fputc('\\n', omni_cc_trace);\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    omni_codegen_emit_raw(ctx, "static OmniConstraint** omni_cc_slot(Obj* o) {\n");
+    omni_codegen_emit_raw(ctx, "    OmniConstraint** p = &omni_cc_buckets[((uintptr_t)o >> 4) %% OMNI_CC_BUCKETS];\n");
+    omni_codegen_emit_raw(ctx, "    while (*p && (*p)->obj != o) p = &(*p)->next;\n");
+    omni_codegen_emit_raw(ctx, "    return p;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    omni_codegen_emit_raw(ctx, "static OmniConstraint* omni_cc_entry(Obj* o) {\n");
+    omni_codegen_emit_raw(ctx, "    OmniConstraint** p = omni_cc_slot(o);\n");
+    omni_codegen_emit_raw(ctx, "    if (!*p) { *p = calloc(1, sizeof(OmniConstraint)); (*p)->obj = o; }\n");
+    omni_codegen_emit_raw(ctx, "    return *p;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    omni_codegen_emit_raw(ctx, "static void omni_cc_alloc(Obj* o, const char* site) {\n");
+    omni_codegen_emit_raw(ctx, "    if (!o || o == NIL) return;\n");
+    omni_codegen_emit_raw(ctx, "    omni_cc_entry(o)->alloc_site = site;\n");
+    omni_codegen_emit_raw(ctx, "    omni_cc_event(\"alloc\", o, site);\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    omni_codegen_emit_raw(ctx, "static void omni_cc_borrow(Obj* o, const char* site) {\n");
+    omni_codegen_emit_raw(ctx, "    if (!o || o == NIL) return;\n");
+    omni_codegen_emit_raw(ctx, "    OmniConstraint* c = omni_cc_entry(o);\n");
+    omni_codegen_emit_raw(ctx, "    c->borrows++;\n");
+    omni_codegen_emit_raw(ctx, "    c->borrow_site = site;\n");
+    omni_codegen_emit_raw(ctx, "    omni_cc_event(\"borrow\", o, site);\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    /* Only the address is used, so releasing a freed object is harmless */
+    omni_codegen_emit_raw(ctx, "static void omni_cc_release(Obj* o) {\n");
+    omni_codegen_emit_raw(ctx, "    OmniConstraint* c = *omni_cc_slot(o);\n");
+    omni_codegen_emit_raw(ctx, "    if (!c || c->borrows == 0) return;\n");
+    omni_codegen_emit_raw(ctx, "    c->borrows--;\n");
+    omni_codegen_emit_raw(ctx, "    omni_cc_event(\"release\", o, NULL);\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    omni_codegen_emit_raw(ctx, "static void omni_cc_on_free(Obj* o) {\n");
+    omni_codegen_emit_raw(ctx, "    OmniConstraint** p = omni_cc_slot(o);\n");
+    omni_codegen_emit_raw(ctx, "    OmniConstraint* c = *p;\n");
+    omni_codegen_emit_raw(ctx, "    if (!c) return;\n");
+    omni_codegen_emit_raw(ctx, "    omni_cc_event(\"free\", o, NULL);\n");
+    omni_codegen_emit_raw(ctx, "    if (c->borrows > 0) {\n");
+    omni_codegen_emit_raw(ctx, "        omni_cc_violations++;\n");
+    omni_codegen_emit_raw(ctx, "        fprintf(stderr, \"constraint violation: object allocated at %%s freed while borrowed at %%s\\n\",\n");
+    omni_codegen_emit_raw(ctx, "                c->alloc_site ? c->alloc_site : \"an unrecorded site\", c->borrow_site);\n");
+    omni_codegen_emit_raw(ctx, "    }\n");
+    omni_codegen_emit_raw(ctx, "    *p = c->next;\n");
+    omni_codegen_emit_raw(ctx, "    free(c);\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    omni_codegen_emit_raw(ctx, "static void omni_cc_report(void) {\n");
+    omni_codegen_emit_raw(ctx, "    if (omni_cc_trace) { fclose(omni_cc_trace); omni_cc_trace = NULL; }\n");
+    omni_codegen_emit_raw(ctx, "    if (omni_cc_violations == 0) return;\n");
+    omni_codegen_emit_raw(ctx, "    fprintf(stderr, \"constraint check: %%ld violation%%s\\n\", omni_cc_violations,\n");
+    omni_codegen_emit_raw(ctx, "            omni_cc_violations == 1 ? \"\" : \"s\");\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+
+    omni_codegen_emit_raw(ctx, "static void omni_cc_enable(void) {\n");
+    omni_codegen_emit_raw(ctx, "    const char* trace = getenv(\"PURPLE_CONSTRAINT_TRACE\");\n");
+    omni_codegen_emit_raw(ctx, "    if (trace && *trace) omni_cc_trace = fopen(trace, \"w\");\n");
+    omni_codegen_emit_raw(ctx, "    set_free_hook(omni_cc_on_free);\n");
+    omni_codegen_emit_raw(ctx, "    atexit(omni_cc_report);\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+}
+
+void omni_codegen_runtime_header(CodeGenContext* ctx) {
+    omni_codegen_emit_raw(ctx, "/* Generated by OmniLisp Compiler */\n");
+    omni_codegen_emit_raw(ctx, "/* ASAP Memory Management - Compile-Time Free Injection */\n\n");
+
+    if (ctx->use_runtime && ctx->runtime_path) {
+        omni_codegen_emit_raw(ctx, "#include \"%s/include/purple.h\"\n\n", ctx->runtime_path);
+        /* Compatibility macros for runtime */
+        omni_codegen_emit_raw(ctx, "#define NIL NULL\n");
+        omni_codegen_emit_raw(ctx, "#define omni_print(o) prim_print(o)\n");
+        omni_codegen_emit_raw(ctx, "#define omni_write(o) prim_write(o)\n");
+        omni_codegen_emit_raw(ctx, "#define omni_print_to(p, o) prim_display_to(o, p)\n");
+        omni_codegen_emit_raw(ctx, "#define omni_write_to(p, o) prim_write_to(o, p)\n");
+        omni_codegen_emit_raw(ctx, "#define omni_newline_to(p) prim_newline_to(p)\n");
+        omni_codegen_emit_raw(ctx, "#define car(o) obj_car(o)\n");
+        omni_codegen_emit_raw(ctx, "#define cdr(o) obj_cdr(o)\n");
+        omni_codegen_emit_raw(ctx, "#define mk_cell(a, b) mk_pair(a, b)\n");
+        omni_codegen_emit_raw(ctx, "#define omni_libc_free(p) free(p)\n");
+        omni_codegen_emit_raw(ctx, "#define omni_exit_status(o) (is_error(o) ? 1 : is_int(o) ? (int)obj_to_int(o) : 0)\n");
+        omni_codegen_emit_raw(ctx, "#define mk_code(fn, arity, name) closure_named(mk_closure(fn, NULL, NULL, 0, arity), name)\n");
+        omni_codegen_emit_raw(ctx, "#define mk_closure_code(fn, arity, captures, count) mk_closure(fn, captures, NULL, count, arity)\n\n");
+        /* Checked by loaders (--hot) against the runtime's purple_abi() */
+        omni_codegen_emit_raw(ctx, "static const PurpleTypeDescriptor omni_module_types[] = PURPLE_ABI_TYPES;\n");
+        omni_codegen_emit_raw(ctx, "const PurpleAbi omni_module_abi = {\n");
+        omni_codegen_emit_raw(ctx, "    PURPLE_ABI_VERSION, sizeof(Obj), sizeof(OmniCallCache),\n");
+        omni_codegen_emit_raw(ctx, "    omni_module_types, sizeof(omni_module_types) / sizeof(omni_module_types[0])\n");
+        omni_codegen_emit_raw(ctx, "};\n\n");
+    } else if (ctx->trim_runtime && ctx->output_buffer) {
+        /* Inserted by omni_codegen_program, which knows what is used */
+        ctx->runtime_at = ctx->output_size;
+    } else {
+        /* Embedded minimal runtime */
+        omni_codegen_runtime_sections(ctx, OMNI_RT_ALL);
+    }
+    /* A case datum against the key, as eq? compares; takes the datum */
+    omni_codegen_emit_raw(ctx, "static inline int omni_case_eq(Obj* key, Obj* datum) {\n");
+    omni_codegen_emit_raw(ctx, "    Obj* eq = prim_is_eq(key, datum);\n");
+    omni_codegen_emit_raw(ctx, "    int match = is_truthy(eq);\n");
+    omni_codegen_emit_raw(ctx, "    free_obj(eq);\n");
+    omni_codegen_emit_raw(ctx, "    free_obj(datum);\n");
+    omni_codegen_emit_raw(ctx, "    return match;\n");
+    omni_codegen_emit_raw(ctx, "}\n\n");
+    if (ctx->record_steps > 0) rt_step_recorder(ctx);
+    if (ctx->constraint_check) rt_constraint_check(ctx);
+}
+
+/* ============== Expression Compilation ============== */
+
+static void codegen_expr(CodeGenContext* ctx, OmniValue* expr);
+
+static void codegen_int(CodeGenContext* ctx, OmniValue* expr) {
+    /* INT64_MIN has no literal form in C: -9223372036854775808 overflows */
+    if (expr->int_val == INT64_MIN) {
+        omni_codegen_emit_raw(ctx, "mk_int(INT64_MIN)");
+    } else {
+        omni_codegen_emit_raw(ctx, "mk_int(%lld)", (long long)expr->int_val);
+    }
+}
+
+static void codegen_char(CodeGenContext* ctx, OmniValue* expr) {
+    omni_codegen_emit_raw(ctx, "mk_char(%ld)", (long)expr->int_val);
+}
+
+/* ctor("text"), for a constructor taking the text of expr */
+static void codegen_text(CodeGenContext* ctx, const char* ctor, OmniValue* expr) {
+    /* Octal escapes keep any byte a valid C string character */
+    omni_codegen_emit_raw(ctx, "%s(\"", ctor);
+    for (const unsigned char* p = (const unsigned char*)expr->str_val; *p; p++) {
+        if (*p == '"' || *p == '\\') {
+            omni_codegen_emit_raw(ctx, "\\%c", *p);
+        } else if (*p < 0x20 || *p >= 0x7f || *p == '?') {
+            omni_codegen_emit_raw(ctx, "\\%03o", *p);
+        } else {
+            omni_codegen_emit_raw(ctx, "%c", *p);
+        }
+    }
+    omni_codegen_emit_raw(ctx, "\")");
+}
+
+static void codegen_string(CodeGenContext* ctx, OmniValue* expr) {
+    codegen_text(ctx, "mk_string", expr);
+}
+
+/* Keywords evaluate to themselves: the one object of that name */
+static void codegen_keyword(CodeGenContext* ctx, OmniValue* expr) {
+    codegen_text(ctx, "mk_keyword", expr);
+}
+
+static void codegen_float(CodeGenContext* ctx, OmniValue* expr) {
+    /* %.17g round-trips every double; keep it a C double literal */
+    double f = expr->float_val;
+    if (f != f) {
+        omni_codegen_emit_raw(ctx, "mk_float(0.0 / 0.0)");
+    } else if (f - f != 0) {
+        omni_codegen_emit_raw(ctx, "mk_float(%s1.0 / 0.0)", f < 0 ? "-" : "");
+    } else {
+        char buf[32];
+        snprintf(buf, sizeof(buf), "%.17g", f);
+        omni_codegen_emit_raw(ctx, "mk_float(%s%s)", buf, strpbrk(buf, ".e") ? "" : ".0");
+    }
+}
+
+/* Error values from the front end become runtime error objects */
+static void codegen_error(CodeGenContext* ctx, OmniValue* expr) {
+    omni_codegen_emit_raw(ctx, "mk_error(\"");
+    for (const char* p = expr->str_val ? expr->str_val : ""; *p; p++) {
+        if (*p == '"' || *p == '\\') omni_codegen_emit_raw(ctx, "\\%c", *p);
+        else if (*p == '\n') omni_codegen_emit_raw(ctx, "\\n");
+        else if (*p == '%') omni_codegen_emit_raw(ctx, "%%");
+        else omni_codegen_emit_raw(ctx, "%c", *p);
+    }
+    omni_codegen_emit_raw(ctx, "\")");
+}
+
+/* Primitives callable by name: the runtime function each maps to (both
+ * runtimes define the same names) and its arity */
+typedef struct {
+    const char* name;
+    const char* c_name;
+    int arity;
+} PrimitiveName;
+
+static const PrimitiveName g_primitive_names[] = {
+    { "+", "prim_add", 2 },
+    { "-", "prim_sub", 2 },
+    { "*", "prim_mul", 2 },
+    { "/", "prim_div", 2 },
+    { "%", "prim_mod", 2 },
+    { "<", "prim_lt", 2 },
+    { ">", "prim_gt", 2 },
+    { "<=", "prim_le", 2 },
+    { ">=", "prim_ge", 2 },
+    { "=", "prim_eq", 2 },
+    { "min", "prim_min", 2 },
+    { "max", "prim_max", 2 },
+    { "expt", "prim_expt", 2 },
+    { "gcd", "prim_gcd", 2 },
+    { "lcm", "prim_lcm", 2 },
+    { "sqrt", "prim_sqrt", 1 },
+    { "cons", "prim_cons", 2 },
+    { "car", "prim_car", 1 },
+    { "cdr", "prim_cdr", 1 },
+    { "null?", "prim_null", 1 },
+    { "proper-list?", "prim_proper_list", 1 },
+    { "error-message", "prim_error_message", 1 },
+    { "error-data", "prim_error_data", 1 },
+    { "error-payload", "prim_error_data", 1 },
+    { "error-tag", "prim_error_tag", 1 },
+    { "error-trace", "prim_error_trace", 1 },
+    { "error?", "prim_is_error", 1 },
+    { "eq?", "prim_is_eq", 2 },
+    { "hash", "prim_hash", 1 },
+    { "procedure?", "prim_is_procedure", 1 },
+    { "arity", "prim_arity", 1 },
+    { "length", "list_length", 1 },
+    { "append", "list_append", 2 },
+    { "reverse", "list_reverse", 1 },
+    { "map", "list_map", 2 },
+    { "for-each", "list_for_each", 2 },
+    { "filter", "list_filter", 2 },
+    { "fold", "list_fold", 3 },
+    { "sleep-ms", "prim_sleep_ms", 1 },
+    { "yield", "prim_yield", 0 },
+    { "monotonic-millis", "prim_monotonic_millis", 0 },
+    { "string?", "prim_is_string", 1 },
+    { "keyword?", "prim_is_keyword", 1 },
+    { "string-length", "prim_string_length", 1 },
+    { "string-append", "prim_string_append", 2 },
+    { "string-ref", "prim_string_ref", 2 },
+    { "substring", "prim_substring", 3 },
+    { "vector?", "prim_is_vector", 1 },
+    { "make-vector", "prim_make_vector", 2 },
+    { "vector-length", "prim_vector_length", 1 },
+    { "vector-ref", "prim_vector_ref", 2 },
+    { "vector-set!", "prim_vector_set", 3 },
+    { "hash?", "prim_is_hash", 1 },
+    { "hash-count", "prim_hash_count", 1 },
+    { "hash-get", "prim_hash_get", 2 },
+    { "hash-set!", "prim_hash_set", 3 },
+    { "hash-remove!", "prim_hash_remove", 2 },
+    { "hash-keys", "prim_hash_keys", 1 },
+    { "pmap", "prim_make_pmap", 0 },
+    { "pvec", "prim_make_pvec", 0 },
+    { "pmap?", "prim_is_pmap", 1 },
+    { "pvec?", "prim_is_pvec", 1 },
+    { "assoc", "prim_assoc", 3 },
+    { "dissoc", "prim_dissoc", 2 },
+    { "conj", "prim_conj", 2 },
+    { "get", "prim_get", 2 },
+    { "count", "prim_count", 1 },
+    { "keys", "prim_keys", 1 },
+    { "freeze", "prim_freeze", 1 },
+    { "transient", "prim_transient", 1 },
+    { "persistent!", "prim_persistent", 1 },
+    { "transient?", "prim_is_transient", 1 },
+    { "assoc!", "prim_transient_assoc", 3 },
+    { "dissoc!", "prim_transient_dissoc", 2 },
+    { "conj!", "prim_transient_conj", 2 },
+    { "port?", "prim_is_port", 1 },
+    { "current-output-port", "prim_current_output_port", 0 },
+    { "current-input-port", "prim_current_input_port", 0 },
+    { "open-output-string", "prim_open_output_string", 0 },
+    { "get-output-string", "prim_get_output_string", 1 },
+    { "open-input-file", "prim_open_input_file", 1 },
+    { "open-output-file", "prim_open_output_file", 1 },
+    { "tcp-connect", "prim_tcp_connect", 2 },
+    { "read-line", "prim_read_line", 1 },
+    { "read-char", "prim_read_char", 1 },
+    { "close-port", "prim_close_port", 1 },
+    { "flush-port", "prim_flush_port", 1 },
+    { "runtime-config", "prim_runtime_config", 1 },
+    { "set-port-buffer!", "prim_set_port_buffer", 2 },
+    { "make-cancel", "prim_make_cancel", 0 },
+    { "cancel!", "prim_cancel", 1 },
+    { "cancelled?", "prim_is_cancelled", 1 },
+    { "await", "prim_await", 1 },
+    { "promise-done?", "prim_promise_done", 1 },
+    { "all-of", "prim_all_of", 1 },
+    { "make-pool", "prim_make_pool", 1 },
+    { "pool-submit", "prim_pool_submit", 2 },
+};
+
+static const PrimitiveName* find_primitive(const char* name) {
+    size_t n = sizeof(g_primitive_names) / sizeof(g_primitive_names[0]);
+    for (size_t i = 0; i < n; i++) {
+        if (strcmp(g_primitive_names[i].name, name) == 0) return &g_primitive_names[i];
+    }
+    return NULL;
+}
+
+/* Names the compiler handles itself rather than through the symbol table */
+static const char* g_builtin_forms[] = {
+    "quote", "quasiquote", "unquote", "unquote-splicing",
+    "if", "cond", "case", "let", "let*", "letrec", "letrec*", "and", "or", "lambda", "fn", "define", "set!",
+    "do", "begin", "run", "debug-history", "memory-stats", "set-allocator!", "with-budget", "catch-oom", "nursery", "spawn", "with-cancel",
+    "future", "go", "wait-group", "error", "import", "provide", "with-output-to-port",
+    "display", "print", "write", "newline", "vector", "ownership-of", "shape-of",
+    "lift", "code-app", "code-let", "code-if", "staged-power", "staged-unroll",
+};
+
+/* Report a name nothing binds, suggesting the nearest names that are in
+ * scope, primitive or built in */
+static void unbound_symbol(CodeGenContext* ctx, const char* name) {
+    size_t n_prims = sizeof(g_primitive_names) / sizeof(g_primitive_names[0]);
+    size_t n_forms = sizeof(g_builtin_forms) / sizeof(g_builtin_forms[0]);
+    size_t count = 0;
+    const char** names = malloc((ctx->symbols.count + n_prims + n_forms) * sizeof(char*));
+    const char* owner = NULL;
+    bool provided = false;
+    for (size_t i = 0; i < ctx->symbols.count; i++) {
+        if (!symbol_hidden(ctx, i)) {
+            names[count++] = ctx->symbols.names[i];
+        } else if (strcmp(ctx->symbols.names[i], name) == 0 &&
+                   ctx->module_names[ctx->symbols.module[i]]) {
+            owner = ctx->module_names[ctx->symbols.module[i]];
+            provided = !module_private(ctx, ctx->symbols.module[i], name);
+        }
+    }
+    for (size_t i = 0; i < n_prims; i++) names[count++] = g_primitive_names[i].name;
+    for (size_t i = 0; i < n_forms; i++) names[count++] = g_builtin_forms[i];
+
+    const char* near[3];
+    size_t found = omni_suggest(name, names, count, near, 3);
+    char msg[256];
+    snprintf(msg, sizeof(msg), "E0001 unbound symbol: %s", name);
+    if (owner) {
+        /* Defined, but by a module that keeps it to itself or that this
+         * one does not import */
+        size_t len = strlen(msg);
+        snprintf(msg + len, sizeof(msg) - len, provided ? " (defined in %s, which is not imported here)"
+                                                        : " (%s does not provide it)", owner);
+    } else {
+        omni_format_suggestions(msg, sizeof(msg), near, found);
+    }
+    free(names);
+
+    /* Once per name, however often it is used */
+    for (size_t i = 0; i < ctx->errors.count; i++) {
+        if (strcmp(ctx->errors.msgs[i], msg) == 0) return;
+    }
+    omni_codegen_error(ctx, "%s", msg);
+}
+
+static bool builtin_form(const char* name) {
+    for (size_t i = 0; i < sizeof(g_builtin_forms) / sizeof(g_builtin_forms[0]); i++) {
+        if (strcmp(g_builtin_forms[i], name) == 0) return true;
+    }
+    return false;
+}
+
+/* A binding that hides a primitive or built-in form is reported as the
+ * shadowing policy says; within its scope the binding wins either way */
+static void check_shadowing(CodeGenContext* ctx, const char* name, const char* binder) {
+    const char* what = find_primitive(name) ? "primitive" : builtin_form(name) ? "built-in form" : NULL;
+    if (!what || ctx->shadowing == OMNI_SHADOW_ALLOW) return;
+    if (ctx->shadowing == OMNI_SHADOW_ERROR) {
+        omni_codegen_error(ctx, "E0007 %s %s shadows the %s %s", binder, name, what, name);
+    } else {
+        omni_codegen_warning(ctx, "%s %s shadows the %s %s (-Wno-shadow if intended)",
+                             binder, name, what, name);
+    }
+}
+
+static void codegen_function_value(CodeGenContext* ctx, OmniValue* f);
+
+static void codegen_sym(CodeGenContext* ctx, OmniValue* expr) {
+    const char* c_name = lookup_symbol(ctx, expr->str_val);
+    if (c_name && letrec_function(ctx, expr->str_val).group) {
+        codegen_function_value(ctx, expr);
+        return;
+    }
+    if (c_name) {
+        omni_codegen_emit_raw(ctx, boxed_symbol(ctx, expr->str_val) ? "box_get(%s)" : "%s", c_name);
+        return;
+    }
+    const PrimitiveName* prim = find_primitive(expr->str_val);
+    if (prim) {
+        omni_codegen_emit_raw(ctx, "%s", prim->c_name);
+    } else {
+        unbound_symbol(ctx, expr->str_val);
+        omni_codegen_emit_raw(ctx, "NIL");
+    }
+}
+
+/* Quoted data with more parts than this is built by a function of its own */
+#define LITERAL_MAX_INLINE 64
+
+/* Parts of datum val: atoms, pairs and vectors, counting at most to limit */
+static size_t literal_size(OmniValue* val, size_t limit) {
+    size_t size = 0;
+    while (size < limit) {
+        size++;
+        if (omni_is_array(val)) {
+            for (size_t i = 0; i < val->array.len && size < limit; i++) {
+                size += literal_size(val->array.data[i], limit - size);
+            }
+            return size;
+        }
+        if (!omni_is_cell(val)) return size;
+        size += literal_size(omni_car(val), limit - size);
+        val = omni_cdr(val);
+    }
+    return size;
+}
+
+static void codegen_quote(CodeGenContext* ctx, OmniValue* expr);
+
+/* Emit datum val, quoted */
+static void codegen_datum(CodeGenContext* ctx, OmniValue* val) {
+    OmniArena* arena = ctx->session->arena;
+    codegen_quote(ctx, omni_list2(arena, omni_new_sym(arena, "quote"), val));
+}
+
+/* Emit a call to a new function that builds the list or vector val, an
+ * item per statement, so a large literal is neither one deeply nested
+ * expression nor part of the function using it. Each call builds it
+ * afresh, as the inline form would. */
+static void codegen_literal_builder(CodeGenContext* ctx, OmniValue* val) {
+    char fn_name[64];
+    snprintf(fn_name, sizeof(fn_name), "_literal_%d", ctx->lambda_counter++);
+
+    CodeGenContext* tmp = omni_codegen_new_buffer(ctx->session);
+    tmp->indent_level = 1;
+    tmp->lambda_counter = ctx->lambda_counter;
+    if (omni_is_array(val)) {
+        omni_codegen_emit(tmp, "Obj* items[%zu];\n", val->array.len);
+        for (size_t i = 0; i < val->array.len; i++) {
+            omni_codegen_emit(tmp, "items[%zu] = ", i);
+            codegen_datum(tmp, val->array.data[i]);
+            omni_codegen_emit_raw(tmp, ";\n");
+        }
+        omni_codegen_emit(tmp, "return prim_vector_of(items, %zu);\n", val->array.len);
+    } else {
+        /* Cons the items onto the tail, last first */
+        size_t n = 0;
+        OmniValue* tail = val;
+        for (; omni_is_cell(tail); tail = omni_cdr(tail)) n++;
+        OmniValue** items = malloc(n * sizeof(OmniValue*));
+        n = 0;
+        for (OmniValue* p = val; omni_is_cell(p); p = omni_cdr(p)) items[n++] = omni_car(p);
+        omni_codegen_emit(tmp, "Obj* list = ");
+        codegen_datum(tmp, tail);
+        omni_codegen_emit_raw(tmp, ";\n");
+        while (n > 0) {
+            omni_codegen_emit(tmp, "list = mk_cell(");
+            codegen_datum(tmp, items[--n]);
+            omni_codegen_emit_raw(tmp, ", list);\n");
+        }
+        free(items);
+        omni_codegen_emit(tmp, "return list;\n");
+    }
+    ctx->lambda_counter = tmp->lambda_counter;
+    absorb_scratch(ctx, tmp);
+
+    char* body_code = omni_codegen_get_output(tmp);
+    size_t size = strlen(fn_name) + (body_code ? strlen(body_code) : 0) + 64;
+    char* def = malloc(size);
+    snprintf(def, size, "static Obj* %s(void) {\n%s}", fn_name, body_code ? body_code : "");
+    omni_codegen_add_lambda_def(ctx, def);
+    free(def);
+    free(body_code);
+    omni_codegen_free(tmp);
+
+    omni_codegen_emit_raw(ctx, "%s()", fn_name);
+}
+
+static void codegen_quote(CodeGenContext* ctx, OmniValue* expr) {
+    OmniArena* arena = ctx->session->arena;
+    /* (quote x) */
+    OmniValue* args = omni_cdr(expr);
+    if (omni_is_nil(args)) {
+        omni_codegen_emit_raw(ctx, "NIL");
+        return;
+    }
+
+    OmniValue* val = omni_car(args);
+
+    if (omni_is_nil(val)) {
+        omni_codegen_emit_raw(ctx, "NIL");
+    } else if (omni_is_int(val)) {
+        codegen_int(ctx, val);
+    } else if (omni_is_char(val)) {
+        codegen_char(ctx, val);
+    } else if (omni_is_string(val)) {
+        codegen_string(ctx, val);
+    } else if (omni_is_keyword(val)) {
+        codegen_keyword(ctx, val);
+    } else if (omni_is_float(val)) {
+        codegen_float(ctx, val);
+    } else if (omni_is_sym(val)) {
+        omni_codegen_emit_raw(ctx, "mk_sym(\"%s\")", val->str_val);
+    } else if ((omni_is_cell(val) || omni_is_array(val)) &&
+               literal_size(val, LITERAL_MAX_INLINE + 1) > LITERAL_MAX_INLINE) {
+        codegen_literal_builder(ctx, val);
+    } else if (omni_is_cell(val)) {
+        /* Build list at runtime */
+        omni_codegen_emit_raw(ctx, "mk_cell(");
+        codegen_quote(ctx, omni_list2(arena, omni_new_sym(arena, "quote"), omni_car(val)));
+        omni_codegen_emit_raw(ctx, ", ");
+        codegen_quote(ctx, omni_list2(arena, omni_new_sym(arena, "quote"), omni_cdr(val)));
+        omni_codegen_emit_raw(ctx, ")");
+    } else if (omni_is_array(val)) {
+        /* '[a b] is a vector of the quoted items */
+        if (val->array.len == 0) {
+            omni_codegen_emit_raw(ctx, "prim_vector_of(NULL, 0)");
+            return;
+        }
+        omni_codegen_emit_raw(ctx, "prim_vector_of((Obj*[]){");
+        for (size_t i = 0; i < val->array.len; i++) {
+            if (i > 0) omni_codegen_emit_raw(ctx, ", ");
+            codegen_quote(ctx, omni_list2(arena, omni_new_sym(arena, "quote"), val->array.data[i]));
+        }
+        omni_codegen_emit_raw(ctx, "}, %zu)", val->array.len);
+    } else {
+        omni_codegen_emit_raw(ctx, "NIL");
+    }
+}
+
+/* ============== Quasiquote ============== */
+
+static bool is_atomic(OmniValue* expr);
+static void codegen_owned(CodeGenContext* ctx, OmniValue* expr);
+
+/* (head x), as unquote, unquote-splicing and quasiquote appear in templates */
+static bool is_template_form(OmniValue* t, const char* head) {
+    return omni_is_cell(t) && omni_sym_eq_str(omni_car(t), head) &&
+           omni_is_cell(omni_cdr(t)) && omni_is_nil(omni_cdr(omni_cdr(t)));
+}
+
+/* Whether anything in template t is evaluated; depth counts the
+ * quasiquotes t is nested in, and only unquotes at depth 1 evaluate */
+static bool template_has_unquote(OmniValue* t, int depth) {
+    if (!omni_is_cell(t)) return false;
+    if (is_template_form(t, "unquote") || is_template_form(t, "unquote-splicing")) {
+        return depth == 1 || template_has_unquote(omni_car(omni_cdr(t)), depth - 1);
+    }
+    if (is_template_form(t, "quasiquote")) {
+        return template_has_unquote(omni_car(omni_cdr(t)), depth + 1);
+    }
+    return template_has_unquote(omni_car(t), depth) || template_has_unquote(omni_cdr(t), depth);
+}
+
+typedef struct {
+    char** temps;             /* One per evaluated unquote; NULL if atomic */
+    size_t count;
+    size_t capacity;
+    size_t next;              /* Next one to use while building */
+} QuasiValues;
+
+/* Evaluate the unquoted expressions of t left to right into temporaries,
+ * so building the structure afterwards cannot reorder their effects.
+ * Inserted values are owned; spliced lists are only read. */
+static void quasi_evaluate(CodeGenContext* ctx, OmniValue* t, int depth, QuasiValues* v) {
+    if (!template_has_unquote(t, depth)) return;
+    bool splice = is_template_form(t, "unquote-splicing");
+    if (is_template_form(t, "unquote") || splice) {
+        OmniValue* arg = omni_car(omni_cdr(t));
+        if (depth > 1) {
+            quasi_evaluate(ctx, arg, depth - 1, v);
+            return;
+        }
+        char* temp = NULL;
+        if (!is_atomic(arg)) {
+            temp = omni_codegen_temp(ctx);
+            omni_codegen_emit(ctx, "Obj* %s = ", temp);
+            if (splice) codegen_expr(ctx, arg);
+            else codegen_owned(ctx, arg);
+            omni_codegen_emit_raw(ctx, ";\n");
+        }
+        if (v->count >= v->capacity) {
+            v->capacity = v->capacity ? v->capacity * 2 : 8;
+            v->temps = realloc(v->temps, v->capacity * sizeof(char*));
+        }
+        v->temps[v->count++] = temp;
+        return;
+    }
+    if (is_template_form(t, "quasiquote")) {
+        quasi_evaluate(ctx, omni_car(omni_cdr(t)), depth + 1, v);
+        return;
+    }
+    quasi_evaluate(ctx, omni_car(t), depth, v);
+    quasi_evaluate(ctx, omni_cdr(t), depth, v);
+}
+
+/* Emit the value unquoted at this point of the template */
+static void quasi_value(CodeGenContext* ctx, OmniValue* arg, bool splice, QuasiValues* v) {
+    const char* temp = v->temps[v->next++];
+    if (temp) omni_codegen_emit_raw(ctx, "%s", temp);
+    else if (splice) codegen_expr(ctx, arg);
+    else codegen_owned(ctx, arg);
+}
+
+static void quasi_build(CodeGenContext* ctx, OmniValue* t, int depth, QuasiValues* v);
+
+/* A nested template form rebuilt as data: (head <template>) */
+static void quasi_build_form(CodeGenContext* ctx, const char* head, OmniValue* arg, int depth,
+                             QuasiValues* v) {
+    omni_codegen_emit_raw(ctx, "mk_cell(mk_sym(\"%s\"), mk_cell(", head);
+    quasi_build(ctx, arg, depth, v);
+    omni_codegen_emit_raw(ctx, ", NIL))");
+}
+
+/* Build the structure of t from quoted parts and the evaluated values */
+static void quasi_build(CodeGenContext* ctx, OmniValue* t, int depth, QuasiValues* v) {
+    OmniArena* arena = ctx->session->arena;
+    if (!template_has_unquote(t, depth)) {
+        codegen_quote(ctx, omni_list2(arena, omni_new_sym(arena, "quote"), t));
+        return;
+    }
+    if (is_template_form(t, "unquote")) {
+        OmniValue* arg = omni_car(omni_cdr(t));
+        if (depth == 1) quasi_value(ctx, arg, false, v);
+        else quasi_build_form(ctx, "unquote", arg, depth - 1, v);
+        return;
+    }
+    if (is_template_form(t, "unquote-splicing")) {
+        OmniValue* arg = omni_car(omni_cdr(t));
+        if (depth > 1) {
+            quasi_build_form(ctx, "unquote-splicing", arg, depth - 1, v);
+            return;
+        }
+        /* Only an element of a list has somewhere to splice into */
+        char* text = omni_value_to_string(t);
+        omni_codegen_error(ctx, "E0002 %s: unquote-splicing must be an element of a list", text);
+        free(text);
+        v->next++;
+        omni_codegen_emit_raw(ctx, "NIL");
+        return;
+    }
+    if (is_template_form(t, "quasiquote")) {
+        quasi_build_form(ctx, "quasiquote", omni_car(omni_cdr(t)), depth + 1, v);
+        return;
+    }
+
+    OmniValue* elem = omni_car(t);
+    if (depth == 1 && is_template_form(elem, "unquote-splicing")) {
+        omni_codegen_emit_raw(ctx, "list_append(");
+        quasi_value(ctx, omni_car(omni_cdr(elem)), true, v);
+    } else {
+        omni_codegen_emit_raw(ctx, "mk_cell(");
+        quasi_build(ctx, elem, depth, v);
+    }
+    omni_codegen_emit_raw(ctx, ", ");
+    quasi_build(ctx, omni_cdr(t), depth, v);
+    omni_codegen_emit_raw(ctx, ")");
+}
+
+/* (quasiquote template): quoted structure with (unquote x) replaced by
+ * the value of x and (unquote-splicing xs) by the elements of xs */
+static void codegen_quasiquote(CodeGenContext* ctx, OmniValue* expr) {
+    OmniArena* arena = ctx->session->arena;
+    OmniValue* args = omni_cdr(expr);
+    if (!omni_is_cell(args) || !omni_is_nil(omni_cdr(args))) {
+        char* text = omni_value_to_string(expr);
+        omni_codegen_error(ctx, "E0002 %s: expected (quasiquote template)", text);
+        free(text);
+        omni_codegen_emit_raw(ctx, "NIL");
+        return;
+    }
+    OmniValue* t = omni_car(args);
+    if (!template_has_unquote(t, 1)) {
+        codegen_quote(ctx, omni_list2(arena, omni_new_sym(arena, "quote"), t));
+        return;
+    }
+
+    QuasiValues values = {0};
+    omni_codegen_emit_raw(ctx, "({\n");
+    omni_codegen_indent(ctx);
+    quasi_evaluate(ctx, t, 1, &values);
+    omni_codegen_emit(ctx, "");
+    quasi_build(ctx, t, 1, &values);
+    omni_codegen_emit_raw(ctx, ";\n");
+    omni_codegen_dedent(ctx);
+    omni_codegen_emit(ctx, "})");
+
+    for (size_t i = 0; i < values.count; i++) free(values.temps[i]);
+    free(values.temps);
+}
+
+static bool flattens(CodeGenContext* ctx, OmniValue* expr);
+static void codegen_flat(CodeGenContext* ctx, OmniValue* expr);
+static bool fold_constant(CodeGenContext* ctx, OmniValue* expr, OmniValue* out);
+static void codegen_call(CodeGenContext* ctx, const char* callee, OmniValue* func,
+                         OmniValue** argv, size_t argc, unsigned fn_mask, bool packed);
+
+/* Boolean primitives whose result a test uses without boxing it: both
+ * runtimes define test_<c_name without prim_>, the int the primitive
+ * would box */
+static const char* g_test_primitives[] = {
+    "<", ">", "<=", ">=", "=", "null?", "eq?", "error?", "procedure?", "string?", "keyword?", "vector?", "hash?", "port?",
+};
+
+/* An operand of an unboxed test. A small int literal needs no heap
+ * object: it is an immediate in libpurple, and a static object the
+ * embedded runtime never frees (a stack one would keep C compilers from
+ * making tail calls of the arms into jumps). */
+static void codegen_test_operand(CodeGenContext* ctx, OmniValue* arg) {
+    long long n = omni_is_int(arg) ? (long long)arg->int_val : 0;
+    if (!omni_is_int(arg) || n < INT32_MIN || n > INT32_MAX) {
+        codegen_expr(ctx, arg);
+    } else if (ctx->use_runtime) {
+        omni_codegen_emit_raw(ctx, "mk_int_unboxed(%lld)", n);
+    } else {
+        omni_codegen_emit_raw(ctx, "({ static Obj _k = { .tag = T_INT, .rc = 1, .i = %lld }; &_k; })", n);
+    }
+}
+
+/* Emit cond as a C truth value. A test that folds is 1 or 0, and a call
+ * to one of g_test_primitives is its test_ function, so (if (< a b) ...)
+ * allocates nothing; anything else is boxed and checked by is_truthy. */
+static void codegen_test(CodeGenContext* ctx, OmniValue* cond) {
+    OmniValue folded;
+    if (omni_is_cell(cond) && fold_constant(ctx, cond, &folded)) {
+        bool truth = folded.tag == OMNI_INT ? folded.int_val != 0 : folded.float_val != 0.0;
+        omni_codegen_emit_raw(ctx, truth ? "1" : "0");
+        return;
+    }
+    OmniValue* head = omni_is_cell(cond) ? omni_car(cond) : NULL;
+    const PrimitiveName* prim = NULL;
+    if (head && omni_is_sym(head) && !lookup_symbol(ctx, head->str_val)) {
+        for (size_t i = 0; i < sizeof(g_test_primitives) / sizeof(g_test_primitives[0]); i++) {
+            if (strcmp(head->str_val, g_test_primitives[i]) == 0) prim = find_primitive(head->str_val);
+        }
+    }
+    OmniValue* argv[2];
+    size_t argc = 0;
+    bool atomic = true;
+    for (OmniValue* a = head ? omni_cdr(cond) : omni_nil; omni_is_cell(a) && argc < 2; a = omni_cdr(a)) {
+        atomic = atomic && is_atomic(omni_car(a));
+        argv[argc++] = omni_car(a);
+    }
+    if (!prim || argc != (size_t)prim->arity || omni_list_len(omni_cdr(cond)) != argc) {
+        omni_codegen_emit_raw(ctx, "is_truthy(");
+        codegen_expr(ctx, cond);
+        omni_codegen_emit_raw(ctx, ")");
+        return;
+    }
+    char test[64];
+    snprintf(test, sizeof(test), "test_%s", prim->c_name + strlen("prim_"));
+    if (!atomic) {
+        /* codegen_call keeps the operands in order */
+        codegen_call(ctx, test, NULL, argv, argc, 0, false);
+        return;
+    }
+    omni_codegen_emit_raw(ctx, "%s(", test);
+    for (size_t i = 0; i < argc; i++) {
+        if (i > 0) omni_codegen_emit_raw(ctx, ", ");
+        codegen_test_operand(ctx, argv[i]);
+    }
+    omni_codegen_emit_raw(ctx, ")");
+}
+
+/* ============== Shared Test Calls ============== */
+
+/*
+ * (if (null? (cdr x)) (car x) (f (cdr x))) computes (cdr x) twice, each
+ * time a call of its own with its own temporaries. A pure call that the
+ * test always evaluates and the if repeats is computed once, ahead of
+ * it: the if becomes (let ((" shared N" (cdr x))) (if (null? " shared N")
+ * (car x) (f " shared N"))). The call's operands are literals, locals no
+ * closure can assign and such calls in turn, and nothing in the if
+ * assigns them, so every use sees the value the test saw.
+ */
+
+/* Primitives whose result depends only on their operands, none of which
+ * they change (pairs and strings are immutable) */
+static const char* g_shareable_primitives[] = {
+    "+", "-", "*", "/", "%", "<", ">", "<=", ">=", "=", "min", "max", "expt", "gcd", "lcm", "sqrt",
+    "car", "cdr", "null?", "eq?", "error?", "procedure?", "string?", "keyword?", "vector?", "hash?", "port?",
+    "string-length",
+};
+
+/* Forms that only sequence or choose among their operands, which uses of
+ * a shared call can be replaced in */
+static const char* g_shareable_forms[] = {
+    "if", "cond", "do", "begin", "and", "or", "display", "print", "write",
+};
+
+static bool in_names(const char* name, const char** names, size_t count) {
+    for (size_t i = 0; i < count; i++) {
+        if (strcmp(names[i], name) == 0) return true;
+    }
+    return false;
+}
+
+/* Whether expr is a call that may be computed once for an if in which
+ * set! assigns the names in assigned */
+static bool shareable_call(CodeGenContext* ctx, OmniValue* expr, OmniValue* assigned) {
+    if (!omni_is_cell(expr) || !omni_is_sym(omni_car(expr))) return false;
+    const char* name = omni_car(expr)->str_val;
+    const PrimitiveName* prim = find_primitive(name);
+    size_t n = sizeof(g_shareable_primitives) / sizeof(g_shareable_primitives[0]);
+    if (!prim || lookup_symbol(ctx, name) || !in_names(name, g_shareable_primitives, n) ||
+        omni_list_len(omni_cdr(expr)) != (size_t)prim->arity) {
+        return false;
+    }
+    for (OmniValue* a = omni_cdr(expr); omni_is_cell(a); a = omni_cdr(a)) {
+        OmniValue* arg = omni_car(a);
+        if (omni_is_int(arg) || omni_is_float(arg)) continue;
+        if (!omni_is_sym(arg)) {
+            if (!shareable_call(ctx, arg, assigned)) return false;
+            continue;
+        }
+        long i = find_symbol(ctx, arg->str_val);
+        if (i < 0 || ctx->symbols.global[i] || ctx->symbols.boxed[i]) return false;
+        for (OmniValue* p = assigned; omni_is_cell(p); p = omni_cdr(p)) {
+            if (omni_sym_eq_str(omni_car(p), arg->str_val)) return false;
+        }
+    }
+    return true;
+}
+
+/* Whether a and b are the same expression, element by element */
+static bool same_expr(OmniValue* a, OmniValue* b) {
+    while (omni_is_cell(a) && omni_is_cell(b)) {
+        if (!same_expr(omni_car(a), omni_car(b))) return false;
+        a = omni_cdr(a);
+        b = omni_cdr(b);
+    }
+    if (omni_is_nil(a) || omni_is_nil(b)) return omni_is_nil(a) && omni_is_nil(b);
+    return omni_values_equal(a, b);
+}
+
+static OmniValue* replace_shared(CodeGenContext* ctx, OmniValue* expr, OmniValue* sub,
+                                 OmniValue* var, int* uses);
+
+/* list with replace_shared applied to each item, or to each form of each
+ * item when the items are cond clauses */
+static OmniValue* replace_shared_items(CodeGenContext* ctx, OmniValue* list, OmniValue* sub,
+                                       OmniValue* var, int* uses, bool clauses) {
+    if (!omni_is_cell(list)) return list;
+    OmniValue* item = omni_car(list);
+    OmniValue* first = clauses ? replace_shared_items(ctx, item, sub, var, uses, false)
+                               : replace_shared(ctx, item, sub, var, uses);
+    OmniValue* rest = replace_shared_items(ctx, omni_cdr(list), sub, var, uses, clauses);
+    if (first == item && rest == omni_cdr(list)) return list;
+    OmniValue* cell = omni_new_cell(ctx->session->arena, first, rest);
+    cell->line = list->line;
+    cell->column = list->column;
+    return cell;
+}
+
+/* expr with the uses of sub replaced by var, counting them in *uses; with
+ * var NULL, only counted. Uses are looked for in the operands of calls
+ * and g_shareable_forms, not in forms that bind names or delay their
+ * evaluation. */
+static OmniValue* replace_shared(CodeGenContext* ctx, OmniValue* expr, OmniValue* sub,
+                                 OmniValue* var, int* uses) {
+    if (same_expr(expr, sub)) {
+        (*uses)++;
+        return var ? var : expr;
+    }
+    if (!omni_is_cell(expr) || !omni_is_sym(omni_car(expr))) return expr;
+    const char* head = omni_car(expr)->str_val;
+    size_t n = sizeof(g_shareable_forms) / sizeof(g_shareable_forms[0]);
+    bool call = lookup_symbol(ctx, head) || find_primitive(head);
+    if (!call && !in_names(head, g_shareable_forms, n)) return expr;
+    OmniValue* args = replace_shared_items(ctx, omni_cdr(expr), sub, var, uses,
+                                           !call && strcmp(head, "cond") == 0);
+    if (args == omni_cdr(expr)) return expr;
+    OmniValue* cell = omni_new_cell(ctx->session->arena, omni_car(expr), args);
+    cell->line = expr->line;
+    cell->column = expr->column;
+    return cell;
+}
+
+/* The outermost shareable call that evaluating test always evaluates and
+ * that args, the operands of its if, use more than once; or NULL */
+static OmniValue* shared_test_call(CodeGenContext* ctx, OmniValue* test, OmniValue* args,
+                                   OmniValue* assigned) {
+    if (!omni_is_cell(test) || !omni_is_sym(omni_car(test))) return NULL;
+    OmniValue folded;
+    if (shareable_call(ctx, test, assigned) && !fold_constant(ctx, test, &folded)) {
+        int uses = 0;
+        replace_shared_items(ctx, args, test, NULL, &uses, false);
+        if (uses > 1) return test;
+    }
+    const char* head = omni_car(test)->str_val;
+    if (!lookup_symbol(ctx, head) && !find_primitive(head)) return NULL;
+    for (OmniValue* a = omni_cdr(test); omni_is_cell(a); a = omni_cdr(a)) {
+        OmniValue* sub = shared_test_call(ctx, omni_car(a), args, assigned);
+        if (sub) return sub;
+    }
+    return NULL;
+}
+
+/* expr, an if, as a let computing a call its test and arms share ahead of
+ * it; expr itself when they share none */
+static OmniValue* share_test_calls(CodeGenContext* ctx, OmniValue* expr) {
+    OmniArena* arena = ctx->session->arena;
+    OmniValue* args = omni_cdr(expr);
+    if (!omni_is_cell(args)) return expr;
+    OmniValue* assigned = omni_nil;
+    collect_set_targets(arena, expr, &assigned);
+    OmniValue* sub = shared_test_call(ctx, omni_car(args), args, assigned);
+    if (!sub) return expr;
+
+    char name[32];
+    snprintf(name, sizeof(name), " shared %d", ctx->temp_counter++);
+    OmniValue* var = omni_new_sym(arena, name);
+    int uses = 0;
+    OmniValue* body = omni_new_cell(arena, omni_car(expr), replace_shared_items(ctx, args, sub, var, &uses, false));
+    body->line = expr->line;
+    body->column = expr->column;
+    return omni_list3(arena, omni_new_sym(arena, "let"), omni_list1(arena, omni_list2(arena, var, sub)), body);
+}
+
+/* Report an if that is not (if test then [else]) */
+static bool check_if(CodeGenContext* ctx, OmniValue* expr) {
+    size_t n = omni_list_len(omni_cdr(expr));
+    if (n == 2 || n == 3) return true;
+    char* text = omni_value_to_string(expr);
+    omni_codegen_error(ctx, "E0002 %s: expected (if test then [else])", text);
+    free(text);
+    return false;
+}
+
+static void codegen_if(CodeGenContext* ctx, OmniValue* expr) {
+    /* (if cond then else) - a ternary, unless an arm has blocks of its own.
+     * Without an else, the if is nil when cond is false. */
+    if (!check_if(ctx, expr)) {
+        omni_codegen_emit_raw(ctx, "NIL");
+        return;
+    }
+    if (flattens(ctx, expr)) {
+        codegen_flat(ctx, expr);
+        return;
+    }
+    OmniValue* shared = share_test_calls(ctx, expr);
+    if (shared != expr) {
+        codegen_expr(ctx, shared);
+        return;
+    }
+    OmniValue* args = omni_cdr(expr);
+    OmniValue* cond = omni_car(args);
+    args = omni_cdr(args);
+    OmniValue* then_expr = omni_is_nil(args) ? NULL : omni_car(args);
+    args = omni_cdr(args);
+    OmniValue* else_expr = omni_is_nil(args) ? NULL : omni_car(args);
+
+    omni_codegen_emit_raw(ctx, "(");
+    codegen_test(ctx, cond);
+    omni_codegen_emit_raw(ctx, " ? (");
+    if (then_expr) codegen_expr(ctx, then_expr);
+    else omni_codegen_emit_raw(ctx, "NIL");
+    omni_codegen_emit_raw(ctx, ") : (");
+    if (else_expr) codegen_expr(ctx, else_expr);
+    else omni_codegen_emit_raw(ctx, "NIL");
+    omni_codegen_emit_raw(ctx, "))");
+}
+
+/* Whether clause is (else form...) */
+static bool else_clause(OmniValue* clause) {
+    return omni_is_cell(clause) && omni_sym_eq_str(omni_car(clause), "else");
+}
+
+/* The forms of a cond or case clause, as one expression */
+static void codegen_clause_body(CodeGenContext* ctx, OmniValue* forms) {
+    OmniArena* arena = ctx->session->arena;
+    if (omni_is_nil(omni_cdr(forms))) codegen_expr(ctx, omni_car(forms));
+    else codegen_expr(ctx, omni_new_cell(arena, omni_new_sym(arena, "do"), forms));
+}
+
+/* Report clauses that are not (head form...) with head a list for case,
+ * or an else that is not last; a cond clause may be just (test) */
+static bool check_clauses(CodeGenContext* ctx, OmniValue* expr, OmniValue* clauses, bool is_case) {
+    for (; omni_is_cell(clauses); clauses = omni_cdr(clauses)) {
+        OmniValue* clause = omni_car(clauses);
+        bool ok = omni_is_cell(clause);
+        if (ok && (is_case || else_clause(clause))) ok = omni_is_cell(omni_cdr(clause));
+        if (ok && is_case && !else_clause(clause)) ok = omni_is_cell(omni_car(clause));
+        if (ok && else_clause(clause) && !omni_is_nil(omni_cdr(clauses))) ok = false;
+        if (!ok) {
+            char* text = omni_value_to_string(expr);
+            omni_codegen_error(ctx, is_case
+                ? "E0002 %s: expected (case key ((datum...) expr...)... [(else expr...)])"
+                : "E0002 %s: expected (cond (test expr...)... [(else expr...)])", text);
+            free(text);
+            return false;
+        }
+    }
+    return true;
+}
+
+static void codegen_cond_clauses(CodeGenContext* ctx, OmniValue* clauses) {
+    if (!omni_is_cell(clauses)) {
+        omni_codegen_emit_raw(ctx, "NIL");
+        return;
+    }
+    OmniValue* clause = omni_car(clauses);
+    if (else_clause(clause)) {
+        codegen_clause_body(ctx, omni_cdr(clause));
+        return;
+    }
+    if (omni_is_nil(omni_cdr(clause))) {
+        /* (test) yields the test's own value when it is true */
+        char* t = omni_codegen_temp(ctx);
+        omni_codegen_emit_raw(ctx, "({ Obj* %s = ", t);
+        codegen_owned(ctx, omni_car(clause));
+        omni_codegen_emit_raw(ctx, "; is_truthy(%s) ? %s : (free_obj(%s), ", t, t, t);
+        codegen_cond_clauses(ctx, omni_cdr(clauses));
+        omni_codegen_emit_raw(ctx, "); })");
+        free(t);
+        return;
+    }
+    omni_codegen_emit_raw(ctx, "(");
+    codegen_test(ctx, omni_car(clause));
+    omni_codegen_emit_raw(ctx, " ? (");
+    codegen_clause_body(ctx, omni_cdr(clause));
+    omni_codegen_emit_raw(ctx, ") : (");
+    codegen_cond_clauses(ctx, omni_cdr(clauses));
+    omni_codegen_emit_raw(ctx, "))");
+}
+
+static void codegen_cond(CodeGenContext* ctx, OmniValue* expr) {
+    /* (cond (test expr...)... (else expr...)) - a single clause is a
+     * ternary; more are tested one after another in one flat block */
+    if (!check_clauses(ctx, expr, omni_cdr(expr), false)) {
+        omni_codegen_emit_raw(ctx, "NIL");
+        return;
+    }
+    if (flattens(ctx, expr)) {
+        codegen_flat(ctx, expr);
+        return;
+    }
+    codegen_cond_clauses(ctx, omni_cdr(expr));
+}
+
+static void codegen_case(CodeGenContext* ctx, OmniValue* expr) {
+    OmniArena* arena = ctx->session->arena;
+    /* (case key ((d...) expr...)... (else expr...)) - key is evaluated
+     * once and compared with each quoted datum by eq?:
+     *   k = key;
+     *   if (eq(k, 'd1) || eq(k, 'd2)) r = ...; else if ... else r = ...;
+     *   free_obj(k); */
+    OmniValue* args = omni_cdr(expr);
+    if (!omni_is_cell(args)) {
+        char* text = omni_value_to_string(expr);
+        omni_codegen_error(ctx, "E0002 %s: expected (case key ((datum...) expr...)... [(else expr...)])", text);
+        free(text);
+        omni_codegen_emit_raw(ctx, "NIL");
+        return;
+    }
+    if (!check_clauses(ctx, expr, omni_cdr(args), true)) {
+        omni_codegen_emit_raw(ctx, "NIL");
+        return;
+    }
+
+    char* k = omni_codegen_temp(ctx);
+    char* r = omni_codegen_temp(ctx);
+    omni_codegen_emit_raw(ctx, "({\n");
+    omni_codegen_indent(ctx);
+    omni_codegen_emit(ctx, "Obj* %s = ", k);
+    codegen_owned(ctx, omni_car(args));
+    omni_codegen_emit_raw(ctx, ";\n");
+    omni_codegen_emit(ctx, "Obj* %s;\n", r);
+
+    bool has_else = false;
+    omni_codegen_emit(ctx, "");
+    for (OmniValue* c = omni_cdr(args); omni_is_cell(c); c = omni_cdr(c)) {
+        OmniValue* clause = omni_car(c);
+        if (else_clause(clause)) {
+            omni_codegen_emit_raw(ctx, "%s = ", r);
+            codegen_clause_body(ctx, omni_cdr(clause));
+            omni_codegen_emit_raw(ctx, ";\n");
+            has_else = true;
+            break;
+        }
+        omni_codegen_emit_raw(ctx, "if (");
+        bool first = true;
+        for (OmniValue* d = omni_car(clause); omni_is_cell(d); d = omni_cdr(d)) {
+            omni_codegen_emit_raw(ctx, first ? "omni_case_eq(%s, " : " || omni_case_eq(%s, ", k);
+            codegen_quote(ctx, omni_list2(arena, omni_new_sym(arena, "quote"), omni_car(d)));
+            omni_codegen_emit_raw(ctx, ")");
+            first = false;
+        }
+        if (first) omni_codegen_emit_raw(ctx, "0");
+        omni_codegen_emit_raw(ctx, ") %s = ", r);
+        codegen_clause_body(ctx, omni_cdr(clause));
+        omni_codegen_emit_raw(ctx, ";\n");
+        omni_codegen_emit(ctx, "else ");
+    }
+    if (!has_else) omni_codegen_emit_raw(ctx, "%s = NIL;\n", r);
+    omni_codegen_emit(ctx, "free_obj(%s);\n", k);
+    omni_codegen_emit(ctx, "%s;\n", r);
+    omni_codegen_dedent(ctx);
+    omni_codegen_emit(ctx, "})");
+    free(k);
+    free(r);
+}
+
+/* Whether the concurrency analysis finds name shared between threads,
+ * so that its references are counted atomically */
+static bool shared_rc(CodeGenContext* ctx, const char* name) {
+    return ctx->analysis && omni_needs_atomic_rc(ctx->analysis, name);
+}
+
+static const char* inc_ref_for(CodeGenContext* ctx, const char* name) {
+    return shared_rc(ctx, name) ? "atomic_inc_ref" : "inc_ref";
+}
+
+/* Emit expr as an owned reference. Bound variables are borrowed, so they
+ * get an extra reference; everything else already yields a fresh value. */
+static void codegen_owned(CodeGenContext* ctx, OmniValue* expr) {
+    const char* c_name = omni_is_sym(expr) ? lookup_symbol(ctx, expr->str_val) : NULL;
+    if (c_name && boxed_symbol(ctx, expr->str_val)) {
+        omni_codegen_emit_raw(ctx, "(%s(box_get(%s)), box_get(%s))", inc_ref_for(ctx, expr->str_val),
+                              c_name, c_name);
+    } else if (c_name) {
+        omni_codegen_emit_raw(ctx, "(%s(%s), %s)", inc_ref_for(ctx, expr->str_val), c_name, c_name);
+    } else {
+        codegen_expr(ctx, expr);
+    }
+}
+
+static void codegen_and_or(CodeGenContext* ctx, OmniValue* expr, bool is_and) {
+    /* (and a b ...) / (or a b ...) - folded into one flat block:
+     *   r = a;
+     *   if (is_truthy(r)) { free_obj(r); r = b; }   (and)
+     *   if (!is_truthy(r)) { free_obj(r); r = b; }  (or)
+     * Once an operand short-circuits, every later test fails the same way,
+     * so no nesting is needed. The result is always owned. */
+    OmniValue* args = omni_cdr(expr);
+    if (omni_is_nil(args)) {
+        omni_codegen_emit_raw(ctx, is_and ? "mk_int(1)" : "NIL");
+        return;
+    }
+    if (omni_is_nil(omni_cdr(args))) {
+        codegen_owned(ctx, omni_car(args));
+        return;
+    }
+
+    char* r = omni_codegen_temp(ctx);
+    omni_codegen_emit_raw(ctx, "({\n");
+    omni_codegen_indent(ctx);
+    omni_codegen_emit(ctx, "Obj* %s = ", r);
+    codegen_owned(ctx, omni_car(args));
+    omni_codegen_emit_raw(ctx, ";\n");
+
+    for (args = omni_cdr(args); !omni_is_nil(args) && omni_is_cell(args); args = omni_cdr(args)) {
+        omni_codegen_emit(ctx, "if (%sis_truthy(%s)) { free_obj(%s); %s = ",
+                          is_and ? "" : "!", r, r, r);
+        codegen_owned(ctx, omni_car(args));
+        omni_codegen_emit_raw(ctx, "; }\n");
+    }
+
+    omni_codegen_emit(ctx, "%s;\n", r);
+    omni_codegen_dedent(ctx);
+    omni_codegen_emit(ctx, "})");
+    free(r);
+}
+
+/* Emit text as the body of a C string literal */
+static void emit_c_text(CodeGenContext* ctx, const char* text) {
+    for (const char* p = text; *p; p++) {
+        if (*p == '"' || *p == '\\') omni_codegen_emit_raw(ctx, "\\%c", *p);
+        else if (*p == '\n') omni_codegen_emit_raw(ctx, "\\n");
+        else omni_codegen_emit_raw(ctx, "%c", *p);
+    }
+}
+
+/* Under --constraint-check, record where a bound value came from */
+static void emit_constraint_alloc(CodeGenContext* ctx, const char* form, const char* name,
+                                  const char* c_name) {
+    if (!ctx->constraint_check) return;
+    omni_codegen_emit(ctx, "omni_cc_alloc(%s, \"form %zu: %s ", c_name, ctx->form, form);
+    emit_c_text(ctx, name);
+    omni_codegen_emit_raw(ctx, "\");\n");
+}
+
+static void codegen_define(CodeGenContext* ctx, OmniValue* expr);
+
+/* A (define name init) among the forms of a let, lambda, function or do
+ * body binds name for the rest of that body, like let*. block is the
+ * scope mark where the body's C block starts. Returns false when form is
+ * not a define, for the caller to emit as an expression. */
+static bool codegen_internal_define(CodeGenContext* ctx, OmniValue* form, size_t block, bool last) {
+    if (!omni_is_cell(form) || !omni_sym_eq_str(omni_car(form), "define") ||
+        lookup_symbol(ctx, "define")) {
+        return false;
+    }
+
+    OmniValue* target = omni_car(omni_cdr(form));
+    char* text = omni_value_to_string(form);
+    const char* name = omni_is_sym(target) ? target->str_val : NULL;
+    bool bound = false;
+    for (size_t i = block; name && i < ctx->symbols.count; i++) {
+        if (strcmp(ctx->symbols.names[i], name) == 0) bound = true;
+    }
+
+    if (omni_is_cell(target)) {
+        omni_codegen_error(ctx, "E0002 %s: functions can only be defined at top level; "
+                           "bind a lambda with (define name (lambda ...)) instead", text);
+        /* Bound anyway so its uses don't add unbound-symbol errors */
+        OmniValue* fname = omni_car(target);
+        if (omni_is_sym(fname)) {
+            char* fn_c_name = omni_codegen_mangle(fname->str_val);
+            register_symbol(ctx, fname->str_val, fn_c_name);
+            free(fn_c_name);
+        }
+    } else if (!name) {
+        omni_codegen_error(ctx, "E0002 %s: expected (define name value)", text);
+    } else if (last) {
+        omni_codegen_error(ctx, "E0002 %s: a body cannot end with a define; "
+                           "add the expression whose value it returns", text);
+    } else if (bound) {
+        omni_codegen_error(ctx, "E0002 %s: %s is already bound in this body", text, name);
+    } else {
+        codegen_define(ctx, form);
+    }
+    free(text);
+    return true;
+}
+
+/* ============== Flat Statements ============== */
+
+/*
+ * Nested lets, dos, ifs and conds are emitted as one run of statements in
+ * the enclosing C block instead of a statement expression each: bindings
+ * become locals of that block and branches jump to labels. gcc has limits
+ * on how deeply statement expressions nest, so a deeply nested program
+ * must not nest them in proportion.
+ */
+
+static void codegen_stmt(CodeGenContext* ctx, OmniValue* expr, const char* dest);
+
+/* A letrec function that only calls itself in tail position, generated
+ * as a loop in the enclosing function: its tail calls assign params and
+ * jump to label */
+typedef struct OmniLoop {
+    const char* name;
+    char* label;
+    char** params;            /* C names */
+    size_t arity;
+} OmniLoop;
+
+/* Whether expr is a tail call of the loop being generated */
+static bool loop_jump(CodeGenContext* ctx, OmniValue* expr) {
+    return ctx->loop && omni_is_cell(expr) && omni_sym_eq_str(omni_car(expr), ctx->loop->name);
+}
+
+/* The built-in form expr is, unless the program binds its head itself */
+static const char* flat_form(CodeGenContext* ctx, OmniValue* expr) {
+    if (!omni_is_cell(expr) || !omni_is_sym(omni_car(expr))) return NULL;
+    const char* name = omni_car(expr)->str_val;
+    return lookup_symbol(ctx, name) ? NULL : name;
+}
+
+/* Whether expr is emitted as statements: a let, let*, letrec, do or begin, a
+ * loop's tail call, a cond of more than one clause, or an if or cond with
+ * such an arm */
+static bool flattens(CodeGenContext* ctx, OmniValue* expr) {
+    if (loop_jump(ctx, expr)) return true;
+    const char* form = flat_form(ctx, expr);
+    if (!form) return false;
+    if (strcmp(form, "let") == 0 || strcmp(form, "let*") == 0 ||
+        strcmp(form, "letrec") == 0 || strcmp(form, "letrec*") == 0 ||
+        strcmp(form, "do") == 0 || strcmp(form, "begin") == 0) {
+        return true;
+    }
+    if (strcmp(form, "cond") == 0) {
+        OmniValue* clause = omni_car(omni_cdr(expr));
+        if (!omni_is_cell(omni_cdr(expr)) || !omni_is_cell(clause)) return false;
+        if (omni_is_cell(omni_cdr(omni_cdr(expr)))) return true;
+        OmniValue* forms = omni_cdr(clause);
+        return omni_is_cell(forms) && (omni_is_cell(omni_cdr(forms)) || flattens(ctx, omni_car(forms)));
+    }
+    if (strcmp(form, "if") == 0) {
+        OmniValue* arms = omni_cdr(omni_cdr(expr));
+        return (omni_is_cell(arms) && flattens(ctx, omni_car(arms))) ||
+               (omni_is_cell(arms) && omni_is_cell(omni_cdr(arms)) &&
+                flattens(ctx, omni_car(omni_cdr(arms))));
+    }
+    return false;
+}
+
+/* Forget the locals of the previous function; names are reused per function */
+static void reset_locals(CodeGenContext* ctx) {
+    for (size_t i = 0; i < ctx->locals.count; i++) free(ctx->locals.names[i]);
+    ctx->locals.count = 0;
+    for (size_t i = 0; i < ctx->pairs.count; i++) {
+        free(ctx->pairs.names[i]);
+        free(ctx->pairs.c_names[i]);
+    }
+    ctx->pairs.count = 0;
+}
+
+static bool local_taken(CodeGenContext* ctx, const char* c_name) {
+    for (size_t i = 0; i < ctx->locals.count; i++) {
+        if (strcmp(ctx->locals.names[i], c_name) == 0) return true;
+    }
+    for (size_t i = 0; i < ctx->symbols.count; i++) {
+        if (strcmp(ctx->symbols.c_names[i], c_name) == 0) return true;
+    }
+    return false;
+}
+
+/* C name for a new local called name: its mangled name, or that with a
+ * suffix when the function already declares it or a visible binding has
+ * it (so (let ((x (+ x 1))) ...) still reads the outer x) */
+static char* fresh_local(CodeGenContext* ctx, const char* name) {
+    char* c_name = omni_codegen_mangle(name);
+    if (local_taken(ctx, c_name)) {
+        size_t size = strlen(c_name) + 16;
+        char* renamed = malloc(size);
+        do {
+            snprintf(renamed, size, "%s_%d", c_name, ctx->temp_counter++);
+        } while (local_taken(ctx, renamed));
+        free(c_name);
+        c_name = renamed;
+    }
+    if (ctx->locals.count >= ctx->locals.capacity) {
+        ctx->locals.capacity = ctx->locals.capacity ? ctx->locals.capacity * 2 : 16;
+        ctx->locals.names = realloc(ctx->locals.names, ctx->locals.capacity * sizeof(char*));
+    }
+    ctx->locals.names[ctx->locals.count++] = strdup(c_name);
+    return c_name;
+}
+
+/* Declare a local for name, set to val, and bind name to it. form names
+ * the binding for --constraint-check, or is NULL to record nothing. */
+static void bind_local(CodeGenContext* ctx, OmniValue* name, OmniValue* val,
+                       const char* form, const char* binder) {
+    char* c_name = fresh_local(ctx, name->str_val);
+    if (val && flattens(ctx, val)) {
+        omni_codegen_emit(ctx, "Obj* %s;\n", c_name);
+        codegen_stmt(ctx, val, c_name);
+    } else {
+        omni_codegen_emit(ctx, "Obj* %s = ", c_name);
+        if (val) codegen_expr(ctx, val);
+        else omni_codegen_emit_raw(ctx, "NIL");
+        omni_codegen_emit_raw(ctx, ";\n");
+    }
+    if (form) emit_constraint_alloc(ctx, form, name->str_val, c_name);
+    check_shadowing(ctx, name->str_val, binder);
+    register_symbol(ctx, name->str_val, c_name);
+    box_binding(ctx, name->str_val);
+    free(c_name);
+}
+
+/* The forms of a body in order, the last one's value going to dest */
+static void codegen_body_stmts(CodeGenContext* ctx, OmniValue* body, size_t mark, const char* dest) {
+    if (!omni_is_cell(body)) {
+        codegen_stmt(ctx, omni_nil, dest);
+        return;
+    }
+    while (omni_is_cell(body)) {
+        OmniValue* form = omni_car(body);
+        body = omni_cdr(body);
+        bool last = !omni_is_cell(body);
+        if (codegen_internal_define(ctx, form, mark, last)) continue;
+        codegen_stmt(ctx, form, last ? dest : NULL);
+    }
+}
+
+/* Whether a form in forms, or in one of the binding forms of forms,
+ * binds name: as a let variable, a parameter or a definition */
+static bool rebinds(OmniValue* forms, const char* name) {
+    if (!omni_is_cell(forms) || omni_sym_eq_str(omni_car(forms), "quote")) return false;
+    OmniValue* head = omni_car(forms);
+    OmniValue* rest = omni_cdr(forms);
+    if (omni_sym_eq_str(head, "let") || omni_sym_eq_str(head, "let*") ||
+        omni_sym_eq_str(head, "letrec") || omni_sym_eq_str(head, "letrec*")) {
+        /* The names bound, not their values; a named let's come second */
+        OmniValue* bindings = omni_car(rest);
+        if (omni_sym_eq_str(bindings, name)) return true;
+        if (omni_is_sym(bindings)) bindings = omni_car(omni_cdr(rest));
+        if (omni_is_array(bindings)) {
+            for (size_t i = 0; i < bindings->array.len; i += 2) {
+                if (omni_sym_eq_str(bindings->array.data[i], name)) return true;
+            }
+        }
+        for (; omni_is_cell(bindings); bindings = omni_cdr(bindings)) {
+            OmniValue* binding = omni_car(bindings);
+            if (omni_sym_eq_str(omni_is_cell(binding) ? omni_car(binding) : binding, name)) return true;
+        }
+    } else if (omni_sym_eq_str(head, "lambda") || omni_sym_eq_str(head, "fn") ||
+               omni_sym_eq_str(head, "define")) {
+        /* The params or signature */
+        if (used_in_lambda(omni_car(rest), name, true)) return true;
+    }
+    for (; omni_is_cell(forms); forms = omni_cdr(forms)) {
+        if (rebinds(omni_car(forms), name)) return true;
+    }
+    return false;
+}
+
+/* Whether every use of name in expr only reads it: as an operand of a
+ * primitive that keeps none of its operands, or as the test of an if.
+ * scope is the code name is visible in; a primitive it rebinds does not
+ * count. */
+static bool only_read(CodeGenContext* ctx, OmniValue* expr, const char* name, OmniValue* scope) {
+    if (omni_is_sym(expr)) return strcmp(expr->str_val, name) != 0;
+    if (omni_is_array(expr)) return !used_in_lambda(expr, name, true);
+    if (!omni_is_cell(expr) || omni_sym_eq_str(omni_car(expr), "quote")) return true;
+
+    OmniValue* head = omni_car(expr);
+    OmniValue* args = omni_cdr(expr);
+    if (omni_sym_eq_str(head, "lambda") || omni_sym_eq_str(head, "fn")) {
+        return !used_in_lambda(args, name, true);
+    }
+    bool reads = omni_is_sym(head) && omni_primitive_reads_args(head->str_val) &&
+                 !lookup_symbol(ctx, head->str_val) && !rebinds(scope, head->str_val);
+    if (omni_sym_eq_str(head, "if") && omni_sym_eq_str(omni_car(args), name)) {
+        args = omni_cdr(args);
+    } else if (!reads && !only_read(ctx, head, name, scope)) {
+        return false;
+    }
+    for (; omni_is_cell(args); args = omni_cdr(args)) {
+        OmniValue* arg = omni_car(args);
+        if (reads && omni_sym_eq_str(arg, name)) continue;
+        if (!only_read(ctx, arg, name, scope)) return false;
+    }
+    return true;
+}
+
+static char** loop_args(CodeGenContext* ctx, OmniValue* args, size_t arity);
+
+/* Whether a closure captures the local name and set! assigns it */
+static bool boxed_name(CodeGenContext* ctx, const char* name) {
+    for (OmniValue* p = ctx->boxed_names; omni_is_cell(p); p = omni_cdr(p)) {
+        if (omni_sym_eq_str(omni_car(p), name)) return true;
+    }
+    return false;
+}
+
+/* Whether val is (cons a b) with the built-in cons */
+static bool is_cons_call(CodeGenContext* ctx, OmniValue* val) {
+    return omni_is_cell(val) && omni_sym_eq_str(omni_car(val), "cons") &&
+           omni_list_len(omni_cdr(val)) == 2 && !lookup_symbol(ctx, "cons");
+}
+
+/* The forms of a let after a binding: the values of the bindings from
+ * the one at i (list-style bindings start at it), then body. NULL when
+ * one of those bindings hides cons or a reading primitive. */
+static OmniValue* let_rest(OmniArena* arena, OmniValue* bindings, size_t i, OmniValue* body) {
+    OmniValue* names[64];
+    OmniValue* vals[64];
+    size_t n = 0;
+    if (omni_is_array(bindings)) {
+        for (; i + 1 < bindings->array.len && n < 64; i += 2, n++) {
+            names[n] = bindings->array.data[i];
+            vals[n] = bindings->array.data[i + 1];
+        }
+        if (i + 1 < bindings->array.len) return NULL;
+    } else {
+        for (; omni_is_cell(bindings) && n < 64; bindings = omni_cdr(bindings), n++) {
+            OmniValue* binding = omni_car(bindings);
+            names[n] = omni_is_cell(binding) ? omni_car(binding) : binding;
+            vals[n] = omni_is_cell(binding) ? omni_car(omni_cdr(binding)) : omni_nil;
+        }
+        if (omni_is_cell(bindings)) return NULL;
+    }
+    OmniValue* forms = body;
+    while (n > 0) {
+        n--;
+        if (omni_is_sym(names[n]) && (omni_primitive_reads_args(names[n]->str_val) ||
+                                      strcmp(names[n]->str_val, "cons") == 0)) {
+            return NULL;
+        }
+        forms = omni_new_cell(arena, vals[n], forms);
+    }
+    return forms;
+}
+
+/*
+ * Bind name to val on the C stack when val makes an integer or a pair
+ * that cannot outlive the let: escape analysis finds nothing holding on
+ * to it, and the rest of the let (later bindings and body, in scope)
+ * only reads it. The object is a C automatic, so it goes when the
+ * function's frame does, with no free. false, emitting nothing, when
+ * the binding has to be on the heap.
+ */
+static bool bind_stack_local(CodeGenContext* ctx, OmniValue* name, OmniValue* val, OmniValue* scope) {
+    if (ctx->use_runtime || ctx->constraint_check || !ctx->analysis || !val || !scope) return false;
+    if (!omni_can_stack_alloc(ctx->analysis, name->str_val)) return false;
+    if (boxed_name(ctx, name->str_val)) return false;
+
+    OmniValue folded;
+    bool is_int = fold_constant(ctx, val, &folded) && omni_is_int(&folded);
+    bool is_cons = is_cons_call(ctx, val) && !rebinds(scope, "cons");
+    if (!is_int && !is_cons) return false;
+    for (OmniValue* f = scope; omni_is_cell(f); f = omni_cdr(f)) {
+        if (!only_read(ctx, omni_car(f), name->str_val, scope)) return false;
+    }
+
+    char* c_name = fresh_local(ctx, name->str_val);
+    if (is_int && folded.int_val == INT64_MIN) {
+        omni_codegen_emit(ctx, "STACK_INT(%s, INT64_MIN);\n", c_name);
+    } else if (is_int) {
+        omni_codegen_emit(ctx, "STACK_INT(%s, %lld);\n", c_name, (long long)folded.int_val);
+    } else {
+        /* As prim_cons: the pair holds a reference to each part */
+        char** parts = loop_args(ctx, omni_cdr(val), 2);
+        omni_codegen_emit(ctx, "inc_ref(%s); inc_ref(%s);\n", parts[0], parts[1]);
+        omni_codegen_emit(ctx, "STACK_CELL(%s, %s, %s);\n", c_name, parts[0], parts[1]);
+        free(parts[0]);
+        free(parts[1]);
+        free(parts);
+    }
+    check_shadowing(ctx, name->str_val, "let binding");
+    register_symbol(ctx, name->str_val, c_name);
+    free(c_name);
+    return true;
+}
+
+/* Whether the pair bound to name dies in cons, a (cons a b) in expr,
+ * where scope is the code the binding is visible in: cons is reached
+ * through lets, ifs, conds and sequences only, so it runs at most once
+ * each time the binding does, and the name appears nowhere else in expr,
+ * and in the operands of cons only as read. *found is set on reaching
+ * cons. */
+static bool dies_in(CodeGenContext* ctx, OmniValue* expr, OmniValue* cons, const char* name,
+                    OmniValue* scope, bool* found) {
+    if (expr == cons) {
+        *found = true;
+        for (OmniValue* a = omni_cdr(cons); omni_is_cell(a); a = omni_cdr(a)) {
+            if (!only_read(ctx, omni_car(a), name, scope)) return false;
+        }
+        return true;
+    }
+    const char* form = flat_form(ctx, expr);
+    if (!form || rebinds(scope, form)) return !used_in_lambda(expr, name, true);
+    OmniValue* args = omni_cdr(expr);
+    if (strcmp(form, "let") == 0 || strcmp(form, "let*") == 0) {
+        OmniValue* bindings = omni_car(args);
+        if (omni_is_array(bindings)) {
+            for (size_t i = 0; i < bindings->array.len; i++) {
+                if (!dies_in(ctx, bindings->array.data[i], cons, name, scope, found)) return false;
+            }
+        } else {
+            for (; omni_is_cell(bindings); bindings = omni_cdr(bindings)) {
+                OmniValue* binding = omni_car(bindings);
+                if (!omni_is_cell(binding)) return !used_in_lambda(expr, name, true);
+                for (; omni_is_cell(binding); binding = omni_cdr(binding)) {
+                    if (!dies_in(ctx, omni_car(binding), cons, name, scope, found)) return false;
+                }
+            }
+        }
+        args = omni_cdr(args);
+    } else if (strcmp(form, "cond") == 0) {
+        for (; omni_is_cell(args); args = omni_cdr(args)) {
+            for (OmniValue* f = omni_car(args); omni_is_cell(f); f = omni_cdr(f)) {
+                if (!dies_in(ctx, omni_car(f), cons, name, scope, found)) return false;
+            }
+        }
+        return true;
+    } else if (strcmp(form, "if") != 0 && strcmp(form, "do") != 0 && strcmp(form, "begin") != 0) {
+        return !used_in_lambda(expr, name, true);
+    }
+    for (; omni_is_cell(args); args = omni_cdr(args)) {
+        if (!dies_in(ctx, omni_car(args), cons, name, scope, found)) return false;
+    }
+    return true;
+}
+
+/* Remember that the let binding name, visible in scope, made a new
+ * heap pair, if a later cons could take over its memory */
+static void note_pair(CodeGenContext* ctx, OmniValue* name, OmniValue* val, OmniValue* scope) {
+    if (ctx->use_runtime || ctx->constraint_check || !scope || !is_cons_call(ctx, val)) return;
+    if (boxed_name(ctx, name->str_val)) return;
+    if (ctx->pairs.count >= ctx->pairs.capacity) {
+        ctx->pairs.capacity = ctx->pairs.capacity ? ctx->pairs.capacity * 2 : 8;
+        ctx->pairs.names = realloc(ctx->pairs.names, ctx->pairs.capacity * sizeof(char*));
+        ctx->pairs.c_names = realloc(ctx->pairs.c_names, ctx->pairs.capacity * sizeof(char*));
+        ctx->pairs.scopes = realloc(ctx->pairs.scopes, ctx->pairs.capacity * sizeof(OmniValue*));
+    }
+    ctx->pairs.names[ctx->pairs.count] = strdup(name->str_val);
+    ctx->pairs.c_names[ctx->pairs.count] = strdup(lookup_symbol(ctx, name->str_val));
+    ctx->pairs.scopes[ctx->pairs.count] = scope;
+    ctx->pairs.count++;
+}
+
+/* Forget the pair candidate at i, returning its C name */
+static char* drop_pair(CodeGenContext* ctx, size_t i) {
+    char* c_name = ctx->pairs.c_names[i];
+    free(ctx->pairs.names[i]);
+    ctx->pairs.count--;
+    memmove(ctx->pairs.names + i, ctx->pairs.names + i + 1, (ctx->pairs.count - i) * sizeof(char*));
+    memmove(ctx->pairs.c_names + i, ctx->pairs.c_names + i + 1, (ctx->pairs.count - i) * sizeof(char*));
+    memmove(ctx->pairs.scopes + i, ctx->pairs.scopes + i + 1, (ctx->pairs.count - i) * sizeof(OmniValue*));
+    return c_name;
+}
+
+/*
+ * Perceus reuse: bind name to val, a (cons a b), in the memory of a pair
+ * an earlier let of this function made and that is dead once a and b
+ * are evaluated. At run time the old pair is only taken over when
+ * nothing else holds it (REUSE_OR_NEW_CELL); otherwise a new one is
+ * made. false, emitting nothing, when no pair dies here.
+ */
+static bool bind_reused_pair(CodeGenContext* ctx, OmniValue* name, OmniValue* val) {
+    if (ctx->use_runtime || ctx->constraint_check || !is_cons_call(ctx, val)) return false;
+    if (ctx->memory == OMNI_MEMORY_ASAP || ctx->memory == OMNI_MEMORY_ARENA) return false;
+    if (boxed_name(ctx, name->str_val)) return false;
+
+    size_t i = ctx->pairs.count;
+    for (; i > 0; i--) {
+        const char* c_name = lookup_symbol(ctx, ctx->pairs.names[i - 1]);
+        if (!c_name || strcmp(c_name, ctx->pairs.c_names[i - 1]) != 0) continue;
+        OmniValue* scope = ctx->pairs.scopes[i - 1];
+        bool found = false;
+        bool dies = true;
+        for (OmniValue* f = scope; dies && omni_is_cell(f); f = omni_cdr(f)) {
+            dies = dies_in(ctx, omni_car(f), val, ctx->pairs.names[i - 1], scope, &found);
+        }
+        if (dies && found) break;
+    }
+    if (i == 0) return false;
+
+    /* The old pair is used up; no later cons may take it too */
+    char* old = drop_pair(ctx, i - 1);
+    char** parts = loop_args(ctx, omni_cdr(val), 2);
+    char* c_name = fresh_local(ctx, name->str_val);
+    omni_codegen_emit(ctx, "Obj* %s = REUSE_OR_NEW_CELL(%s, %s, %s);\n", c_name, old, parts[0], parts[1]);
+    check_shadowing(ctx, name->str_val, "let binding");
+    register_symbol(ctx, name->str_val, c_name);
+    ctx->reuses++;
+    free(parts[0]);
+    free(parts[1]);
+    free(parts);
+    free(c_name);
+    free(old);
+    return true;
+}
+
+/* One binding of a let: on the stack, in a dead pair or on the heap */
+static void bind_let(CodeGenContext* ctx, OmniValue* name, OmniValue* val, OmniValue* scope) {
+    if (bind_stack_local(ctx, name, val, scope)) return;
+    if (!bind_reused_pair(ctx, name, val)) bind_local(ctx, name, val, "let", "let binding");
+    note_pair(ctx, name, val, scope);
+}
+
+/* Whether expr takes a part of name out of it: (car name), (cdr name),
+ * or a min or max of it, which would outlive a free of name */
+static bool takes_part(OmniValue* expr, const char* name) {
+    if (!omni_is_cell(expr) || omni_sym_eq_str(omni_car(expr), "quote")) return false;
+    OmniValue* head = omni_car(expr);
+    if (omni_sym_eq_str(head, "car") || omni_sym_eq_str(head, "cdr") ||
+        omni_sym_eq_str(head, "min") || omni_sym_eq_str(head, "max")) {
+        for (OmniValue* a = omni_cdr(expr); omni_is_cell(a); a = omni_cdr(a)) {
+            if (omni_sym_eq_str(omni_car(a), name)) return true;
+        }
+    }
+    for (; omni_is_cell(expr); expr = omni_cdr(expr)) {
+        if (takes_part(omni_car(expr), name)) return true;
+    }
+    return false;
+}
+
+/* Whether the new pair bound to name can be freed once the rest of the
+ * let, scope, is done with it: scope only reads it and keeps no part */
+static bool releasable(CodeGenContext* ctx, OmniValue* name, OmniValue* scope) {
+    if (!scope || rebinds(scope, "car") || rebinds(scope, "cdr")) return false;
+    for (size_t i = ctx->pairs.count; i > 0; i--) {
+        if (strcmp(ctx->pairs.names[i - 1], name->str_val) != 0) continue;
+        if (strcmp(ctx->pairs.c_names[i - 1], lookup_symbol(ctx, name->str_val)) != 0) return false;
+        for (OmniValue* f = scope; omni_is_cell(f); f = omni_cdr(f)) {
+            if (!only_read(ctx, omni_car(f), name->str_val, scope)) return false;
+            if (takes_part(omni_car(f), name->str_val)) return false;
+        }
+        return true;
+    }
+    return false;
+}
+
+/*
+ * ASAP free at the last use: free each pair in dead that no form of rest
+ * mentions, unless a cons has taken its memory over already. The shape
+ * analysis routes the free (free_tree for a tree, dec_ref otherwise);
+ * never free_unique, since the parts are shared with whatever the pair
+ * was made from. Whether to free is decided here, not by the analysis's
+ * free strategy: that sees every use in a lambda as a capture. A freed
+ * pair is no longer a reuse candidate. One that threads share is counted
+ * down atomically instead.
+ */
+static void release_pairs(CodeGenContext* ctx, OmniValue** dead, size_t* count, OmniValue* rest) {
+    size_t kept = 0;
+    for (size_t d = 0; d < *count; d++) {
+        const char* name = dead[d]->str_val;
+        bool used = false;
+        for (OmniValue* f = rest; !used && omni_is_cell(f); f = omni_cdr(f)) {
+            used = used_in_lambda(omni_car(f), name, true);
+        }
+        if (used) {
+            dead[kept++] = dead[d];
+            continue;
+        }
+        const char* c_name = lookup_symbol(ctx, name);
+        for (size_t i = ctx->pairs.count; c_name && i > 0; i--) {
+            if (strcmp(ctx->pairs.c_names[i - 1], c_name) != 0) continue;
+            OwnerInfo* owner = ctx->analysis ? omni_get_owner_info(ctx->analysis, name) : NULL;
+            bool tree = owner && owner->shape == SHAPE_TREE;
+            const char* release = shared_rc(ctx, name) ? "atomic_dec_ref" : tree ? "free_tree" : "dec_ref";
+            char* pair = drop_pair(ctx, i - 1);
+            omni_codegen_emit(ctx, "%s(%s); /* last use of %s */\n", release, pair, name);
+            ctx->frees++;
+            free(pair);
+            break;
+        }
+    }
+    *count = kept;
+}
+
+static void codegen_let_stmts(CodeGenContext* ctx, OmniValue* expr, const char* dest) {
+    OmniArena* arena = ctx->session->arena;
+    /* (let ((x val) ...) body) */
+    OmniValue* args = omni_cdr(expr);
+    OmniValue* bindings = omni_car(args);
+    size_t mark = scope_mark(ctx);
+    OmniValue* dead[64];
+    size_t dead_count = 0;
+
+    if (omni_is_array(bindings)) {
+        /* Array-style: [x 1 y 2] */
+        for (size_t i = 0; i + 1 < bindings->array.len; i += 2) {
+            OmniValue* name = bindings->array.data[i];
+            if (omni_is_sym(name)) {
+                OmniValue* scope = let_rest(arena, bindings, i + 2, omni_cdr(args));
+                bind_let(ctx, name, bindings->array.data[i + 1], scope);
+                if (dead_count < 64 && releasable(ctx, name, scope)) dead[dead_count++] = name;
+            }
+        }
+    } else if (omni_is_cell(bindings)) {
+        /* List-style: ((x 1) (y 2)) */
+        for (; omni_is_cell(bindings); bindings = omni_cdr(bindings)) {
+            OmniValue* binding = omni_car(bindings);
+            if (omni_is_cell(binding) && omni_is_sym(omni_car(binding))) {
+                OmniValue* scope = let_rest(arena, omni_cdr(bindings), 0, omni_cdr(args));
+                bind_let(ctx, omni_car(binding), omni_car(omni_cdr(binding)), scope);
+                if (dead_count < 64 && releasable(ctx, omni_car(binding), scope)) {
+                    dead[dead_count++] = omni_car(binding);
+                }
+            }
+        }
+    }
+
+    OmniValue* body = omni_cdr(args);
+    if (dead_count == 0 || !omni_is_cell(body)) {
+        codegen_body_stmts(ctx, body, mark, dest);
+        pop_scope(ctx, mark);
+        return;
+    }
+    /* As codegen_body_stmts, freeing each pair before the first form
+     * from which on nothing uses it; one the last form uses stays */
+    while (omni_is_cell(body)) {
+        release_pairs(ctx, dead, &dead_count, body);
+        OmniValue* form = omni_car(body);
+        body = omni_cdr(body);
+        bool last = !omni_is_cell(body);
+        if (codegen_internal_define(ctx, form, mark, last)) continue;
+        codegen_stmt(ctx, form, last ? dest : NULL);
+    }
+    pop_scope(ctx, mark);
+}
+
+static bool is_lambda_form(OmniValue* expr);
+static void collect_captures(CodeGenContext* ctx, OmniValue* expr, OmniValue** names, int* count, int cap);
+static int codegen_lambda_fn(CodeGenContext* ctx, OmniValue* expr, const char* fn_name,
+                             OmniValue** names, int count, OmniLetrecFn group);
+
+/* Whether every use of name in expr, a function body form in tail
+ * position when tail is set, is a tail call with arity arguments */
+static bool only_tail_calls(OmniValue* expr, const char* name, size_t arity, bool tail) {
+    if (omni_is_sym(expr)) return strcmp(expr->str_val, name) != 0;
+    if (omni_is_array(expr)) return !used_in_lambda(expr, name, true);
+    if (!omni_is_cell(expr) || omni_sym_eq_str(omni_car(expr), "quote")) return true;
+
+    OmniValue* head = omni_car(expr);
+    OmniValue* args = omni_cdr(expr);
+    if (omni_sym_eq_str(head, name)) {
+        if (!tail || omni_list_len(args) != arity) return false;
+        return !used_in_lambda(args, name, true);
+    }
+    if (omni_sym_eq_str(head, "if")) {
+        if (used_in_lambda(omni_car(args), name, true)) return false;
+        for (OmniValue* a = omni_cdr(args); omni_is_cell(a); a = omni_cdr(a)) {
+            if (!only_tail_calls(omni_car(a), name, arity, tail)) return false;
+        }
+        return true;
+    }
+    if (omni_sym_eq_str(head, "cond")) {
+        for (; omni_is_cell(args); args = omni_cdr(args)) {
+            OmniValue* clause = omni_car(args);
+            if (!omni_is_cell(clause) || used_in_lambda(omni_car(clause), name, true)) return false;
+            for (OmniValue* f = omni_cdr(clause); omni_is_cell(f); f = omni_cdr(f)) {
+                if (!only_tail_calls(omni_car(f), name, arity, tail && !omni_is_cell(omni_cdr(f)))) return false;
+            }
+        }
+        return true;
+    }
+    OmniValue* body = NULL;
+    if (omni_sym_eq_str(head, "let") || omni_sym_eq_str(head, "let*")) {
+        /* A let that binds name hides the loop */
+        OmniValue* bindings = omni_car(args);
+        if (used_in_lambda(bindings, name, true)) return false;
+        body = omni_cdr(args);
+    } else if (omni_sym_eq_str(head, "do") || omni_sym_eq_str(head, "begin")) {
+        body = args;
+    }
+    if (!body) return !used_in_lambda(expr, name, true);
+    for (; omni_is_cell(body); body = omni_cdr(body)) {
+        if (!only_tail_calls(omni_car(body), name, arity, tail && !omni_is_cell(omni_cdr(body)))) return false;
+    }
+    return true;
+}
+
+/* Args evaluated into new temps, in order */
+static char** loop_args(CodeGenContext* ctx, OmniValue* args, size_t arity) {
+    char** temps = malloc((arity + 1) * sizeof(char*));
+    for (size_t i = 0; i < arity; i++, args = omni_cdr(args)) {
+        temps[i] = omni_codegen_temp(ctx);
+        if (flattens(ctx, omni_car(args))) {
+            omni_codegen_emit(ctx, "Obj* %s;\n", temps[i]);
+            codegen_stmt(ctx, omni_car(args), temps[i]);
+        } else {
+            omni_codegen_emit(ctx, "Obj* %s = ", temps[i]);
+            codegen_expr(ctx, omni_car(args));
+            omni_codegen_emit_raw(ctx, ";\n");
+        }
+    }
+    return temps;
+}
+
+/* A tail call of the loop: the params take the args, and the body runs again */
+static void codegen_loop_jump(CodeGenContext* ctx, OmniValue* expr) {
+    OmniLoop* loop = ctx->loop;
+    char** temps = loop_args(ctx, omni_cdr(expr), loop->arity);
+    for (size_t i = 0; i < loop->arity; i++) {
+        omni_codegen_emit(ctx, "%s = %s;\n", loop->params[i], temps[i]);
+        free(temps[i]);
+    }
+    free(temps);
+    omni_codegen_emit(ctx, "goto %s;\n", loop->label);
+}
+
+/*
+ * (letrec ((name (lambda (params...) body...))) (name args...)), as a
+ * named let expands to, when body only calls name in tail position: the
+ * params become locals, set to the args, and body runs in the enclosing
+ * function, with its tail calls of name assigning the params and jumping
+ * back to the top. No closure is made and the stack does not grow. False,
+ * having emitted nothing, for any other letrec.
+ */
+static bool codegen_letrec_loop(CodeGenContext* ctx, OmniValue* expr, const char* dest) {
+    OmniValue* bindings = omni_car(omni_cdr(expr));
+    OmniValue* body = omni_cdr(omni_cdr(expr));
+    if (!omni_is_cell(bindings) || !omni_is_nil(omni_cdr(bindings))) return false;
+    OmniValue* binding = omni_car(bindings);
+    if (!omni_is_cell(binding) || !omni_is_sym(omni_car(binding))) return false;
+    const char* name = omni_car(binding)->str_val;
+    OmniValue* init = omni_car(omni_cdr(binding));
+    if (!is_lambda_form(init)) return false;
+    OmniValue* params = omni_car(omni_cdr(init));
+    size_t arity = 0;
+    OmniValue* p = params;
+    for (; omni_is_cell(p); p = omni_cdr(p), arity++) {
+        if (!omni_is_sym(omni_car(p))) return false;
+    }
+    if (!omni_is_nil(p)) return false;
+    if (!omni_is_cell(body) || !omni_is_nil(omni_cdr(body))) return false;
+    OmniValue* call = omni_car(body);
+    if (!omni_is_cell(call) || !omni_sym_eq_str(omni_car(call), name) ||
+        omni_list_len(omni_cdr(call)) != arity || used_in_lambda(omni_cdr(call), name, true)) {
+        return false;
+    }
+    for (OmniValue* f = omni_cdr(omni_cdr(init)); omni_is_cell(f); f = omni_cdr(f)) {
+        if (!only_tail_calls(omni_car(f), name, arity, !omni_is_cell(omni_cdr(f)))) return false;
+    }
+
+    char** temps = loop_args(ctx, omni_cdr(call), arity);
+    size_t mark = scope_mark(ctx);
+    OmniLoop loop = { name, omni_codegen_label(ctx), malloc((arity + 1) * sizeof(char*)), arity };
+    p = params;
+    for (size_t i = 0; i < arity; i++, p = omni_cdr(p)) {
+        loop.params[i] = fresh_local(ctx, omni_car(p)->str_val);
+        omni_codegen_emit(ctx, "Obj* %s = %s;\n", loop.params[i], temps[i]);
+        check_shadowing(ctx, omni_car(p)->str_val, "parameter");
+        register_symbol(ctx, omni_car(p)->str_val, loop.params[i]);
+        free(temps[i]);
+    }
+    free(temps);
+
+    /* The statement expression's value is its last statement, so a loop
+     * leaves it in a temporary declared ahead of the jumps */
+    char* result = dest && !*dest ? omni_codegen_temp(ctx) : NULL;
+    if (result) omni_codegen_emit(ctx, "Obj* %s;\n", result);
+    omni_codegen_emit(ctx, "%s:;\n", loop.label);
+    if (ctx->coop_cancel) omni_codegen_emit(ctx, "omni_cancel_point();\n");
+    for (p = params; omni_is_cell(p); p = omni_cdr(p)) box_binding(ctx, omni_car(p)->str_val);
+
+    OmniLoop* outer = ctx->loop;
+    ctx->loop = &loop;
+    codegen_body_stmts(ctx, omni_cdr(omni_cdr(init)), mark, result ? result : dest);
+    ctx->loop = outer;
+    if (result) {
+        omni_codegen_emit(ctx, "%s;\n", result);
+        free(result);
+    }
+    pop_scope(ctx, mark);
+
+    for (size_t i = 0; i < arity; i++) free(loop.params[i]);
+    free(loop.params);
+    free(loop.label);
+    return true;
+}
+
+/*
+ * (letrec ((name init) ...) body...) binds every name before any init
+ * runs, so the inits can refer to each other; letrec* is the same form.
+ * A name whose init is a lambda becomes a function of the letrec's group.
+ * The group's functions share one captures array of the enclosing locals
+ * any of them uses and call each other directly with it, so mutual
+ * recursion makes no reference cycle; used as a value, such a name makes
+ * a closure over that array. The other names are bound in order once the
+ * functions exist, and those the functions use are boxes, filled in when
+ * their init has run.
+ */
+static void codegen_letrec_stmts(CodeGenContext* ctx, OmniValue* expr, const char* dest) {
+    if (codegen_letrec_loop(ctx, expr, dest)) return;
+    OmniValue* args = omni_cdr(expr);
+    OmniValue* bindings = omni_car(args);
+    size_t mark = scope_mark(ctx);
+
+    size_t n = 0;
+    OmniValue** names = NULL;
+    OmniValue** inits = NULL;
+    if (omni_is_array(bindings)) {
+        /* Array-style: [f (lambda ...) x 1] */
+        names = malloc((bindings->array.len / 2 + 1) * sizeof(OmniValue*));
+        inits = malloc((bindings->array.len / 2 + 1) * sizeof(OmniValue*));
+        for (size_t i = 0; i + 1 < bindings->array.len; i += 2) {
+            if (!omni_is_sym(bindings->array.data[i])) continue;
+            names[n] = bindings->array.data[i];
+            inits[n++] = bindings->array.data[i + 1];
+        }
+    } else {
+        /* List-style: ((f (lambda ...)) (x 1)) */
+        size_t len = omni_list_len(bindings);
+        names = malloc((len + 1) * sizeof(OmniValue*));
+        inits = malloc((len + 1) * sizeof(OmniValue*));
+        for (; omni_is_cell(bindings); bindings = omni_cdr(bindings)) {
+            OmniValue* binding = omni_car(bindings);
+            if (!omni_is_cell(binding) || !omni_is_sym(omni_car(binding))) continue;
+            names[n] = omni_car(binding);
+            inits[n++] = omni_car(omni_cdr(binding));
+        }
+    }
+
+    /* Values the functions use: boxes, empty until their init runs */
+    bool* boxed = calloc(n + 1, sizeof(bool));
+    for (size_t i = 0; i < n; i++) {
+        if (is_lambda_form(inits[i])) continue;
+        for (size_t j = 0; j < n && !boxed[i]; j++) {
+            boxed[i] = is_lambda_form(inits[j]) && used_in_lambda(inits[j], names[i]->str_val, false);
+        }
+        if (!boxed[i]) continue;
+        char* c_name = fresh_local(ctx, names[i]->str_val);
+        omni_codegen_emit(ctx, "Obj* %s = mk_box(NIL);\n", c_name);
+        check_shadowing(ctx, names[i]->str_val, "letrec binding");
+        register_symbol(ctx, names[i]->str_val, c_name);
+        ctx->symbols.boxed[ctx->symbols.count - 1] = true;
+        free(c_name);
+    }
+
+    /* The functions, named before any body is compiled; ids follow the
+     * lambda counter, so the first function's is the group's */
+    OmniLetrecFn group = { ctx->lambda_counter + 1, 0, 0 };
+    size_t first = ctx->symbols.count;
+    for (size_t i = 0; i < n; i++) {
+        if (!is_lambda_form(inits[i])) continue;
+        char fn_name[64];
+        snprintf(fn_name, sizeof(fn_name), "_lambda_%d", ctx->lambda_counter++);
+        check_shadowing(ctx, names[i]->str_val, "letrec binding");
+        int arity = (int)omni_list_len(omni_car(omni_cdr(inits[i])));
+        register_function(ctx, names[i]->str_val, fn_name, arity);
+        ctx->symbols.letrec[ctx->symbols.count - 1] = group;
+        ctx->symbols.letrec[ctx->symbols.count - 1].arity = arity;
+    }
+    size_t last = ctx->symbols.count;
+
+    /* Their captures: what any of them uses, as slots of the group */
+    OmniValue* captures[65];
+    int count = 0;
+    for (size_t i = 0; i < n; i++) {
+        if (is_lambda_form(inits[i])) collect_captures(ctx, omni_cdr(omni_cdr(inits[i])), captures, &count, 65);
+    }
+    if (count > 64) {
+        char* text = omni_value_to_string(expr);
+        omni_codegen_error(ctx, "E0002 %s: a letrec's functions can use at most 64 local variables", text);
+        free(text);
+        count = 64;
+    }
+    group.captures = count;
+    for (size_t i = first; i < last; i++) ctx->symbols.letrec[i].captures = count;
+    OmniValue* slots[64];
+    group_slots(ctx->session->arena, group, slots);
+    for (int i = 0; i < count; i++) {
+        register_symbol(ctx, slots[i]->str_val, lookup_symbol(ctx, captures[i]->str_val));
+    }
+
+    /* Declared ahead of the definitions, which call each other */
+    for (size_t i = first; i < last; i++) {
+        char decl[1280];
+        int len = snprintf(decl, sizeof(decl), "static Obj* %s(Obj** captures", ctx->symbols.c_names[i]);
+        for (int j = 0; j < ctx->symbols.letrec[i].arity && len < (int)sizeof(decl) - 8; j++) {
+            len += snprintf(decl + len, sizeof(decl) - len, ", Obj*");
+        }
+        snprintf(decl + len, sizeof(decl) - len, ");");
+        omni_codegen_add_lambda_def(ctx, decl);
+    }
+    for (size_t i = first; i < last; i++) {
+        OmniValue* init = NULL;
+        for (size_t j = 0; j < n && !init; j++) {
+            if (is_lambda_form(inits[j]) && strcmp(names[j]->str_val, ctx->symbols.names[i]) == 0) init = inits[j];
+        }
+        char* fn_name = strdup(ctx->symbols.c_names[i]);
+        codegen_lambda_fn(ctx, init, fn_name, captures, count, ctx->symbols.letrec[i]);
+        free(fn_name);
+    }
+
+    /* The other bindings, in order */
+    for (size_t i = 0; i < n; i++) {
+        if (is_lambda_form(inits[i])) continue;
+        if (!boxed[i]) {
+            bind_local(ctx, names[i], inits[i], "letrec", "letrec binding");
+            continue;
+        }
+        char* t = omni_codegen_temp(ctx);
+        if (flattens(ctx, inits[i])) {
+            omni_codegen_emit(ctx, "Obj* %s;\n", t);
+            codegen_stmt(ctx, inits[i], t);
+        } else {
+            omni_codegen_emit(ctx, "Obj* %s = ", t);
+            codegen_owned(ctx, inits[i]);
+            omni_codegen_emit_raw(ctx, ";\n");
+        }
+        omni_codegen_emit(ctx, "box_set(%s, %s);\n", lookup_symbol(ctx, names[i]->str_val), t);
+        omni_codegen_emit(ctx, "dec_ref(%s);\n", t);
+        free(t);
+    }
+    free(names);
+    free(inits);
+    free(boxed);
+
+    codegen_body_stmts(ctx, omni_cdr(args), mark, dest);
+    pop_scope(ctx, mark);
+}
+
+static void codegen_if_stmts(CodeGenContext* ctx, OmniValue* expr, const char* dest) {
+    /* if (!cond) goto else; then; goto end; else: else; end: */
+    if (!check_if(ctx, expr)) {
+        codegen_stmt(ctx, omni_nil, dest);
+        return;
+    }
+    OmniValue* shared = share_test_calls(ctx, expr);
+    if (shared != expr) {
+        codegen_stmt(ctx, shared, dest);
+        return;
+    }
+    OmniValue* args = omni_cdr(expr);
+    OmniValue* arms = omni_cdr(args);
+    char* other = omni_codegen_label(ctx);
+    char* end = omni_codegen_label(ctx);
+
+    omni_codegen_emit(ctx, "if (!");
+    codegen_test(ctx, omni_car(args));
+    omni_codegen_emit_raw(ctx, ") goto %s;\n", other);
+    codegen_stmt(ctx, omni_is_cell(arms) ? omni_car(arms) : omni_nil, dest);
+    omni_codegen_emit(ctx, "goto %s;\n", end);
+    omni_codegen_emit(ctx, "%s:;\n", other);
+    arms = omni_is_cell(arms) ? omni_cdr(arms) : omni_nil;
+    codegen_stmt(ctx, omni_is_cell(arms) ? omni_car(arms) : omni_nil, dest);
+    omni_codegen_emit(ctx, "%s:;\n", end);
+    free(other);
+    free(end);
+}
+
+static void codegen_cond_stmts(CodeGenContext* ctx, OmniValue* expr, const char* dest) {
+    OmniArena* arena = ctx->session->arena;
+    /* Each clause tests and, when it fails, jumps to the next; the first
+     * that holds leaves its value in dest and jumps to the end */
+    if (!check_clauses(ctx, expr, omni_cdr(expr), false)) {
+        codegen_stmt(ctx, omni_nil, dest);
+        return;
+    }
+    char* end = omni_codegen_label(ctx);
+    bool has_else = false;
+    for (OmniValue* c = omni_cdr(expr); omni_is_cell(c); c = omni_cdr(c)) {
+        OmniValue* clause = omni_car(c);
+        OmniValue* forms = omni_cdr(clause);
+        OmniValue* body = omni_is_cell(omni_cdr(forms)) ? omni_new_cell(arena, omni_new_sym(arena, "do"), forms)
+                                                        : omni_car(forms);
+        if (else_clause(clause)) {
+            codegen_stmt(ctx, body, dest);
+            has_else = true;
+            break;
+        }
+        if (omni_is_nil(forms)) {
+            /* (test) yields the test's own value when it is true */
+            char* t = omni_codegen_temp(ctx);
+            omni_codegen_emit(ctx, "Obj* %s = ", t);
+            codegen_owned(ctx, omni_car(clause));
+            omni_codegen_emit_raw(ctx, ";\n");
+            if (dest) omni_codegen_emit(ctx, "if (is_truthy(%s)) { %s = %s; goto %s; }\n", t, dest, t, end);
+            else omni_codegen_emit(ctx, "if (is_truthy(%s)) goto %s;\n", t, end);
+            omni_codegen_emit(ctx, "free_obj(%s);\n", t);
+            free(t);
+            continue;
+        }
+        char* next = omni_codegen_label(ctx);
+        omni_codegen_emit(ctx, "if (!");
+        codegen_test(ctx, omni_car(clause));
+        omni_codegen_emit_raw(ctx, ") goto %s;\n", next);
+        codegen_stmt(ctx, body, dest);
+        omni_codegen_emit(ctx, "goto %s;\n", end);
+        omni_codegen_emit(ctx, "%s:;\n", next);
+        free(next);
+    }
+    if (!has_else) codegen_stmt(ctx, omni_nil, dest);
+    omni_codegen_emit(ctx, "%s:;\n", end);
+    free(end);
+}
+
+/*
+ * Emit expr as statements. Its value is assigned to dest; with dest NULL
+ * it is dropped, and with dest "" it is left as the value of the
+ * enclosing statement expression (the last statement of its block).
+ */
+static void codegen_stmt(CodeGenContext* ctx, OmniValue* expr, const char* dest) {
+    OmniValue* outer = ctx->located;
+    if (expr && expr->line) ctx->located = expr;
+
+    const char* form = flattens(ctx, expr) ? flat_form(ctx, expr) : NULL;
+    if (loop_jump(ctx, expr)) {
+        codegen_loop_jump(ctx, expr);
+    } else if (!form) {
+        if (omni_is_nil(expr) && !dest) {
+            /* Nothing to drop */
+        } else if (dest && *dest) {
+            omni_codegen_emit(ctx, "%s = ", dest);
+            codegen_expr(ctx, expr);
+            omni_codegen_emit_raw(ctx, ";\n");
+        } else {
+            omni_codegen_emit(ctx, "");
+            codegen_expr(ctx, expr);
+            omni_codegen_emit_raw(ctx, ";\n");
+        }
+    } else if (strcmp(form, "let") == 0 || strcmp(form, "let*") == 0) {
+        codegen_let_stmts(ctx, expr, dest);
+    } else if (strcmp(form, "letrec") == 0 || strcmp(form, "letrec*") == 0) {
+        codegen_letrec_stmts(ctx, expr, dest);
+    } else if (strcmp(form, "do") == 0 || strcmp(form, "begin") == 0) {
+        size_t mark = scope_mark(ctx);
+        codegen_body_stmts(ctx, omni_cdr(expr), mark, dest);
+        pop_scope(ctx, mark);
+    } else if (dest && !*dest) {
+        /* A branch's value reaches the block's end through a temporary */
+        char* t = omni_codegen_temp(ctx);
+        omni_codegen_emit(ctx, "Obj* %s;\n", t);
+        codegen_stmt(ctx, expr, t);
+        omni_codegen_emit(ctx, "%s;\n", t);
+        free(t);
+    } else if (strcmp(form, "if") == 0) {
+        codegen_if_stmts(ctx, expr, dest);
+    } else {
+        codegen_cond_stmts(ctx, expr, dest);
+    }
+
+    ctx->located = outer;
+}
+
+/* expr, which flattens, as one statement expression */
+static void codegen_flat(CodeGenContext* ctx, OmniValue* expr) {
+    omni_codegen_emit_raw(ctx, "({\n");
+    omni_codegen_indent(ctx);
+    codegen_stmt(ctx, expr, "");
+    omni_codegen_dedent(ctx);
+    omni_codegen_emit(ctx, "})");
+}
+
+/* Locals expr refers to, each once, in order of first use */
+static void collect_captures(CodeGenContext* ctx, OmniValue* expr, OmniValue** names, int* count, int cap) {
+    if (omni_is_sym(expr)) {
+        long i = find_symbol(ctx, expr->str_val);
+        if (i >= 0 && ctx->symbols.letrec[i].group) {
+            /* Calling it takes its group's captures */
+            OmniValue* slots[64];
+            int n = group_slots(ctx->session->arena, ctx->symbols.letrec[i], slots);
+            for (int j = 0; j < n; j++) collect_captures(ctx, slots[j], names, count, cap);
+            return;
+        }
+        if (i < 0 || ctx->symbols.global[i] || ctx->symbols.function[i]) return;
+        for (int j = 0; j < *count; j++) {
+            if (strcmp(names[j]->str_val, expr->str_val) == 0) return;
+        }
+        if (*count < cap) names[(*count)++] = expr;
+        return;
+    }
+    if (omni_is_array(expr)) {
+        for (size_t i = 0; i < expr->array.len; i++) {
+            collect_captures(ctx, expr->array.data[i], names, count, cap);
+        }
+        return;
+    }
+    if (!omni_is_cell(expr)) return;
+    if (omni_is_sym(omni_car(expr)) && strcmp(omni_car(expr)->str_val, "quote") == 0) return;
+    for (; omni_is_cell(expr); expr = omni_cdr(expr)) {
+        collect_captures(ctx, omni_car(expr), names, count, cap);
+    }
+}
+
+/* Bind each of names in tmp, the scratch context of a lifted function,
+ * to its slot of the function's captures array */
+static void bind_captures(CodeGenContext* tmp, CodeGenContext* ctx, OmniValue** names, int count) {
+    for (int i = 0; i < count; i++) {
+        char c_name[32];
+        snprintf(c_name, sizeof(c_name), "captures[%d]", i);
+        register_symbol(tmp, names[i]->str_val, c_name);
+        tmp->symbols.boxed[tmp->symbols.count - 1] = boxed_symbol(ctx, names[i]->str_val);
+    }
+}
+
+/* Emit the captures array for names: the locals' values, or their boxes
+ * for boxed locals, so that assignments stay shared */
+static void emit_captures(CodeGenContext* ctx, OmniValue** names, int count) {
+    if (count == 0) {
+        omni_codegen_emit_raw(ctx, "NULL");
+        return;
+    }
+    omni_codegen_emit_raw(ctx, "(Obj*[]){ ");
+    for (int i = 0; i < count; i++) {
+        omni_codegen_emit_raw(ctx, "%s%s", i ? ", " : "", lookup_symbol(ctx, names[i]->str_val));
+    }
+    omni_codegen_emit_raw(ctx, " }");
+}
+
+/* Compile the lambda expr into the static function fn_name. Its first
+ * parameter is the captures array, holding the enclosing locals names;
+ * a letrec function also binds the slots of its group (see group_slots)
+ * to it, and group is 0 for any other lambda. Returns the parameter
+ * count. */
+static int codegen_lambda_fn(CodeGenContext* ctx, OmniValue* expr, const char* fn_name,
+                             OmniValue** names, int count, OmniLetrecFn group) {
+    OmniValue* args = omni_cdr(expr);
+    OmniValue* params = omni_car(args);
+    OmniValue* body = omni_cdr(args);
+
+    /* Generate body using a temp context to capture output */
+    CodeGenContext* tmp = omni_codegen_new_buffer(ctx->session);
+    tmp->indent_level = 1;
+    tmp->lambda_counter = ctx->lambda_counter;
+    tmp->analysis = ctx->analysis;
+    tmp->record_steps = ctx->record_steps;
+    tmp->shadowing = ctx->shadowing;
+    tmp->constraint_check = ctx->constraint_check;
+    tmp->memory = ctx->memory;
+    tmp->coop_cancel = ctx->coop_cancel;
+    tmp->freestanding = ctx->freestanding;
+    tmp->oom_policy = ctx->oom_policy;
+    tmp->use_runtime = ctx->use_runtime;
+    tmp->runtime_path = ctx->runtime_path;
+    tmp->form = ctx->form;
+    tmp->located = ctx->located;
+    tmp->module_names = ctx->module_names;
+    tmp->provides = ctx->provides;
+    tmp->imports = ctx->imports;
+    tmp->module = ctx->module;
+    tmp->boxed_names = ctx->boxed_names;
+    copy_symbols(tmp, ctx);
+    bind_captures(tmp, ctx, names, count);
+    OmniValue* slots[64];
+    int slot_count = group_slots(ctx->session->arena, group, slots);
+    for (int i = 0; i < slot_count; i++) {
+        char c_name[32];
+        snprintf(c_name, sizeof(c_name), "captures[%d]", i);
+        register_symbol(tmp, slots[i]->str_val, c_name);
+    }
+
+    /* Signature - parameters are registered before generating body */
+    char header[1280];
+    int len = snprintf(header, sizeof(header), "static Obj* %s(Obj** captures", fn_name);
+    size_t block = scope_mark(tmp);
+    int param_count = 0;
+    for (OmniValue* param_list = params; omni_is_cell(param_list); param_list = omni_cdr(param_list)) {
+        param_count++;
+        OmniValue* param = omni_car(param_list);
+        if (omni_is_sym(param)) {
+            char* c_name = omni_codegen_mangle(param->str_val);
+            if (len < (int)sizeof(header)) {
+                len += snprintf(header + len, sizeof(header) - len, ", Obj* %s", c_name);
+            }
+            check_shadowing(tmp, param->str_val, "parameter");
+            register_symbol(tmp, param->str_val, c_name);
+            free(c_name);
+        }
+    }
+    if (count == 0) omni_codegen_emit(tmp, "(void)captures;\n");
+    if (ctx->coop_cancel) omni_codegen_emit(tmp, "omni_cancel_point();\n");
+    for (OmniValue* param_list = params; omni_is_cell(param_list); param_list = omni_cdr(param_list)) {
+        if (omni_is_sym(omni_car(param_list))) box_binding(tmp, omni_car(param_list)->str_val);
+    }
+
+    /* Body: earlier expressions run for their effects */
+    OmniValue* body_iter = body;
+    if (!omni_is_cell(body_iter)) omni_codegen_emit(tmp, "return NIL;\n");
+    for (; omni_is_cell(body_iter); body_iter = omni_cdr(body_iter)) {
+        OmniValue* form = omni_car(body_iter);
+        bool last = !omni_is_cell(omni_cdr(body_iter));
+        if (codegen_internal_define(tmp, form, block, last)) continue;
+        omni_codegen_emit(tmp, last ? "return " : "");
+        codegen_expr(tmp, form);
+        omni_codegen_emit_raw(tmp, ";\n");
+    }
+
+    /* Update lambda counter from nested lambdas */
+    ctx->lambda_counter = tmp->lambda_counter;
+
+    /* Copy any nested lambda definitions */
+    absorb_scratch(ctx, tmp);
+
+    char* body_code = omni_codegen_get_output(tmp);
+    size_t size = strlen(header) + (body_code ? strlen(body_code) : 0) + 16;
+    char* def = malloc(size);
+    snprintf(def, size, "%s) {\n%s}", header, body_code ? body_code : "");
+    omni_codegen_add_lambda_def(ctx, def);
+    free(def);
+    free(body_code);
+    tmp->analysis = NULL;
+    omni_codegen_free(tmp);
+    return param_count;
+}
+
+/* Compile a lambda into a static function and return its name. The
+ * function's first parameter is the captures array for the enclosing
+ * locals its body uses, which go to names (room for 65) and *count (at
+ * most 64); the parameter count goes to *arity when it is non-NULL. */
+static char* codegen_lambda_def(CodeGenContext* ctx, OmniValue* expr, int* arity,
+                                OmniValue** names, int* count) {
+    int lambda_id = ctx->lambda_counter++;
+
+    /* Generate lambda function name */
+    char fn_name[64];
+    snprintf(fn_name, sizeof(fn_name), "_lambda_%d", lambda_id);
+
+    /* Enclosing locals the body uses; a parameter of the same name
+     * shadows its capture */
+    *count = 0;
+    collect_captures(ctx, omni_cdr(omni_cdr(expr)), names, count, 65);
+    if (*count > 64) {
+        char* text = omni_value_to_string(expr);
+        omni_codegen_error(ctx, "E0002 %s: a lambda can use at most 64 local variables", text);
+        free(text);
+        *count = 64;
+    }
+
+    int params = codegen_lambda_fn(ctx, expr, fn_name, names, *count, (OmniLetrecFn){ 0, 0, 0 });
+    if (arity) *arity = params;
+    return strdup(fn_name);
+}
+
+static bool is_lambda_form(OmniValue* expr) {
+    return omni_is_cell(expr) && omni_is_sym(omni_car(expr)) &&
+           (strcmp(omni_car(expr)->str_val, "lambda") == 0 ||
+            strcmp(omni_car(expr)->str_val, "fn") == 0);
+}
+
+static void codegen_lambda(CodeGenContext* ctx, OmniValue* expr) {
+    /* A lambda used as a value is a closure object */
+    codegen_function_value(ctx, expr);
+}
+
+/* Emit a function passed as a value, e.g. the f in (map f xs). Lambdas,
+ * top-level functions and primitives compile to plain C functions, so they
+ * are wrapped in a closure object (mk_code) whose adapter unpacks the
+ * argument array for call_closure; a lambda using enclosing locals gets
+ * them as the closure's captures (mk_closure_code). Anything else is
+ * already an object. */
+static void codegen_function_value(CodeGenContext* ctx, OmniValue* f) {
+    char* target = NULL;
+    int arity = 0;
+    bool lambda = is_lambda_form(f);
+    OmniValue* captures[65];
+    int count = 0;
+    OmniLetrecFn group = omni_is_sym(f) ? letrec_function(ctx, f->str_val) : (OmniLetrecFn){ 0, 0, 0 };
+
+    if (lambda) {
+        target = codegen_lambda_def(ctx, f, &arity, captures, &count);
+    } else if (group.group) {
+        /* A closure over the captures its group shares */
+        target = strdup(lookup_symbol(ctx, f->str_val));
+        arity = group.arity;
+        count = group_slots(ctx->session->arena, group, captures);
+        lambda = true;
+    } else if (omni_is_sym(f)) {
+        const char* c_name = lookup_symbol(ctx, f->str_val);
+        FunctionSummary* summary = ctx->analysis && function_symbol(ctx, f->str_val) ?
+            omni_get_function_summary(ctx->analysis, f->str_val) : NULL;
+        const PrimitiveName* prim = find_primitive(f->str_val);
+        if (c_name && summary) {
+            target = strdup(c_name);
+            arity = (int)summary->param_count;
+        } else if (!c_name && prim) {
+            target = strdup(prim->c_name);
+            arity = prim->arity;
+        }
+    }
+    /* Printing forms are open-coded in calls, so wrap them here */
+    const char* printer = NULL;
+    if (!target && omni_is_sym(f) && !lookup_symbol(ctx, f->str_val)) {
+        if (strcmp(f->str_val, "display") == 0 || strcmp(f->str_val, "print") == 0) {
+            printer = "omni_print";
+        } else if (strcmp(f->str_val, "write") == 0) {
+            printer = "omni_write";
+        }
+    }
+    if (!target && !printer) {
+        if (omni_is_sym(f)) codegen_sym(ctx, f);
+        else codegen_expr(ctx, f);
+        return;
+    }
+
+    /* One adapter per target, so a function is eq? to itself wherever it
+     * is taken as a value */
+    const char* name = omni_is_sym(f) ? f->str_val : NULL;
+    char* adapter_for = printer ? omni_codegen_mangle(name) : strdup(target);
+    char adapter[128];
+    snprintf(adapter, sizeof(adapter), "_fnval_%s", adapter_for);
+    free(adapter_for);
+    char def[512];
+    char* p = def;
+    p += sprintf(p, "static Obj* %s(Obj** captures, Obj** args, int argc) {\n", adapter);
+    p += sprintf(p, "    (void)captures; (void)argc;\n");
+    if (printer) {
+        arity = 1;
+        p += sprintf(p, "    return %s(args[0]);\n}", printer);
+    } else {
+        p += sprintf(p, "    return %s(%s", target, lambda ? "captures" : "");
+        for (int i = 0; i < arity; i++) {
+            p += sprintf(p, "%sargs[%d]", i || lambda ? ", " : "", i);
+        }
+        p += sprintf(p, ");\n}");
+    }
+    omni_codegen_add_lambda_def(ctx, def);
+    free(target);
+
+    if (count > 0) {
+        omni_codegen_emit_raw(ctx, "mk_closure_code(%s, %d, ", adapter, arity);
+        emit_captures(ctx, captures, count);
+        omni_codegen_emit_raw(ctx, ", %d)", count);
+    } else if (name && !strpbrk(name, "\"\\")) {
+        omni_codegen_emit_raw(ctx, "mk_code(%s, %d, \"%s\")", adapter, arity, name);
+    } else {
+        omni_codegen_emit_raw(ctx, "mk_code(%s, %d, NULL)", adapter, arity);
+    }
+}
+
+/* (ownership-of 'x) and (shape-of 'x) are resolved at compile time to a
+ * symbol naming the analysis verdict for x, or unknown */
+static void codegen_reflection(CodeGenContext* ctx, const char* form, OmniValue* args) {
+    OmniValue* quoted = omni_is_cell(args) ? omni_car(args) : NULL;
+    const char* var = NULL;
+    if (quoted && omni_is_cell(quoted) && omni_is_sym(omni_car(quoted)) &&
+        strcmp(omni_car(quoted)->str_val, "quote") == 0 &&
+        omni_is_cell(omni_cdr(quoted)) && omni_is_sym(omni_car(omni_cdr(quoted)))) {
+        var = omni_car(omni_cdr(quoted))->str_val;
+    }
+
+    const char* verdict = "unknown";
+    OwnerInfo* owner = var && ctx->analysis ? omni_get_owner_info(ctx->analysis, var) : NULL;
+    if (strcmp(form, "ownership-of") == 0) {
+        if (owner) verdict = omni_ownership_name(owner->ownership);
+    } else if (owner) {
+        verdict = omni_shape_name(owner->shape);
+    } else if (var && ctx->analysis) {
+        /* Not a variable: maybe a type name */
+        verdict = omni_shape_name(omni_get_type_shape(ctx->analysis, var));
+    }
+    omni_codegen_emit_raw(ctx, "mk_sym(\"%s\")", verdict);
+}
+
+static void codegen_define(CodeGenContext* ctx, OmniValue* expr) {
+    OmniValue* args = omni_cdr(expr);
+    OmniValue* name_or_sig = omni_car(args);
+    OmniValue* body = omni_cdr(args);
+
+    if (omni_is_sym(name_or_sig)) {
+        /* Variable define */
+        bind_local(ctx, name_or_sig, omni_is_nil(body) ? NULL : omni_car(body),
+                   NULL, "definition of");
+    } else if (omni_is_cell(name_or_sig)) {
+        /* Function define */
+        OmniValue* fname = omni_car(name_or_sig);
+        OmniValue* params = omni_cdr(name_or_sig);
+
+        if (!omni_is_sym(fname)) return;
+
+        char* c_name = top_level_c_name(ctx->module, fname->str_val);
+        check_shadowing(ctx, fname->str_val, "definition of");
+        register_function(ctx, fname->str_val, c_name, (int)omni_list_len(params));
+        ctx->symbols.module[ctx->symbols.count - 1] = ctx->module;
+        size_t mark = scope_mark(ctx);
+
+        /* Parameter list, shared by the definition and its prototype */
+        char param_list[1024];
+        int len = 0;
+        bool first = true;
+        while (!omni_is_nil(params) && omni_is_cell(params)) {
+            if (!first && len < (int)sizeof(param_list)) {
+                len += snprintf(param_list + len, sizeof(param_list) - len, ", ");
+            }
+            first = false;
+            OmniValue* param = omni_car(params);
+            if (omni_is_sym(param)) {
+                char* param_name = omni_codegen_mangle(param->str_val);
+                if (len < (int)sizeof(param_list)) {
+                    len += snprintf(param_list + len, sizeof(param_list) - len, "Obj* %s", param_name);
+                }
+                check_shadowing(ctx, param->str_val, "parameter");
+                register_symbol(ctx, param->str_val, param_name);
+                free(param_name);
+            }
+            params = omni_cdr(params);
+        }
+        if (first) len = snprintf(param_list, sizeof(param_list), "void");
+
+        /* With hot reload the body is _hot_<name> and <name> is an exported
+         * pointer to it, so every call goes through what a patch installs */
+        char impl[256];
+        snprintf(impl, sizeof(impl), ctx->hot_reload ? "_hot_%s" : "%s", c_name);
+
+        /* The prototype goes to the forward declarations so lambdas and
+         * earlier functions can call it */
+        if (len < (int)sizeof(param_list)) {
+            char proto[1280];
+            snprintf(proto, sizeof(proto), ctx->hot_reload ? "extern Obj* (*%s)(%s);" : "static Obj* %s(%s);",
+                     c_name, param_list);
+            omni_codegen_add_forward_decl(ctx, proto);
+        }
+
+        /* A patch only declares the functions it does not replace, and an
+         * incremental object those loaded before it */
+        if ((ctx->hot_patch && strcmp(ctx->hot_patch, fname->str_val) != 0) || ctx->declare_only) {
+            pop_scope(ctx, mark);
+            free(c_name);
+            return;
+        }
+
+        omni_codegen_emit(ctx, "static Obj* %s(%s) {\n", impl, param_list);
+        omni_codegen_indent(ctx);
+        reset_locals(ctx);
+
+        if (ctx->record_steps > 0) {
+            /* Arguments are captured on entry, before the body frees them */
+            size_t argc = 0;
+            for (OmniValue* p = omni_cdr(name_or_sig); omni_is_cell(p); p = omni_cdr(p)) {
+                if (omni_is_sym(omni_car(p))) argc++;
+            }
+            omni_codegen_emit(ctx, "long _step_up = omni_step_current, _step = omni_step_begin(\"%s\", %zu, ",
+                              fname->str_val, argc);
+            if (argc == 0) omni_codegen_emit_raw(ctx, "NULL");
+            else omni_codegen_emit_raw(ctx, "(Obj*[]){");
+            size_t i = 0;
+            for (OmniValue* p = omni_cdr(name_or_sig); omni_is_cell(p); p = omni_cdr(p)) {
+                if (!omni_is_sym(omni_car(p))) continue;
+                omni_codegen_emit_raw(ctx, i++ ? ", %s" : "%s", lookup_symbol(ctx, omni_car(p)->str_val));
+            }
+            omni_codegen_emit_raw(ctx, argc ? "});\n" : ");\n");
+        }
+        if (ctx->crash_handler) omni_codegen_emit(ctx, "purple_enter(\"%s\");\n", fname->str_val);
+        /* Recursion is how programs loop, so entry is a safe point */
+        if (ctx->coop_cancel) omni_codegen_emit(ctx, "omni_cancel_point();\n");
+        for (OmniValue* p = omni_cdr(name_or_sig); omni_is_cell(p); p = omni_cdr(p)) {
+            if (omni_is_sym(omni_car(p))) box_binding(ctx, omni_car(p)->str_val);
+        }
+
+        /* Body: earlier expressions run for their effects */
+        OmniValue* result = NULL;
+        while (!omni_is_nil(body) && omni_is_cell(body)) {
+            if (result && !codegen_internal_define(ctx, result, mark, false)) {
+                omni_codegen_emit(ctx, "");
+                codegen_expr(ctx, result);
+                omni_codegen_emit_raw(ctx, ";\n");
+            }
+            result = omni_car(body);
+            body = omni_cdr(body);
+        }
+
+        if (result && codegen_internal_define(ctx, result, mark, true)) result = NULL;
+        omni_codegen_emit(ctx, "return ");
+        if (ctx->crash_handler) omni_codegen_emit_raw(ctx, "purple_leave(");
+        if (ctx->record_steps > 0) omni_codegen_emit_raw(ctx, "omni_step_end(_step, _step_up, ");
+        if (result) codegen_expr(ctx, result);
+        else omni_codegen_emit_raw(ctx, "NIL");
+        if (ctx->record_steps > 0) omni_codegen_emit_raw(ctx, ")");
+        omni_codegen_emit_raw(ctx, ctx->crash_handler ? ");\n" : ";\n");
+
+        omni_codegen_dedent(ctx);
+        omni_codegen_emit(ctx, "}\n\n");
+
+        if (ctx->hot_patch) {
+            omni_codegen_emit(ctx, "void omni_hot_install(void) {\n");
+            omni_codegen_emit(ctx, "    __atomic_store_n(&%s, %s, __ATOMIC_SEQ_CST);\n", c_name, impl);
+            omni_codegen_emit(ctx, "}\n\n");
+        } else if (ctx->hot_reload) {
+            omni_codegen_emit(ctx, "Obj* (*%s)(%s) = %s;\n\n", c_name, param_list, impl);
+        }
+
+        pop_scope(ctx, mark);
+        free(c_name);
+    }
+}
+
+/* (set! name value) assigns a variable and yields (). A boxed local is
+ * assigned through its box and a top-level variable bumps its version
+ * stamp, like a define. */
+static void codegen_set(CodeGenContext* ctx, OmniValue* expr) {
+    OmniValue* args = omni_cdr(expr);
+    OmniValue* target = omni_car(args);
+    long i = omni_is_sym(target) ? find_symbol(ctx, target->str_val) : -1;
+    if (!omni_is_sym(target) || !omni_is_cell(omni_cdr(args)) || !omni_is_nil(omni_cdr(omni_cdr(args)))) {
+        char* text = omni_value_to_string(expr);
+        omni_codegen_error(ctx, "E0002 %s: expected (set! name value)", text);
+        free(text);
+        omni_codegen_emit_raw(ctx, "NIL");
+        return;
+    }
+    if (i < 0) {
+        unbound_symbol(ctx, target->str_val);
+        omni_codegen_emit_raw(ctx, "NIL");
+        return;
+    }
+    if (ctx->symbols.function[i]) {
+        char* text = omni_value_to_string(expr);
+        omni_codegen_error(ctx, "E0002 %s: %s is a function; only variables can be assigned",
+                           text, target->str_val);
+        free(text);
+        omni_codegen_emit_raw(ctx, "NIL");
+        return;
+    }
+
+    const char* c_name = ctx->symbols.c_names[i];
+    OmniValue* value = omni_car(omni_cdr(args));
+    if (ctx->record_steps > 0) {
+        /* Recorded with the value it replaces, local or top-level */
+        bool boxed = ctx->symbols.boxed[i];
+        omni_codegen_emit_raw(ctx, "({ char* _old = omni_step_text(%s%s%s); Obj* _set = ",
+                              boxed ? "box_get(" : "", c_name, boxed ? ")" : "");
+        codegen_expr(ctx, value);
+        omni_codegen_emit_raw(ctx, "; omni_step_set(\"%s\", _old, _set); ", target->str_val);
+        if (boxed) {
+            omni_codegen_emit_raw(ctx, "box_set(%s, _set); NIL; })", c_name);
+        } else {
+            omni_codegen_emit_raw(ctx, "%s = _set; ", c_name);
+            if (ctx->symbols.global[i]) omni_codegen_emit_raw(ctx, "_ver_%s++; ", c_name);
+            omni_codegen_emit_raw(ctx, "NIL; })");
+        }
+    } else if (ctx->symbols.boxed[i]) {
+        omni_codegen_emit_raw(ctx, "({ box_set(%s, ", c_name);
+        codegen_expr(ctx, value);
+        omni_codegen_emit_raw(ctx, "); NIL; })");
+    } else {
+        omni_codegen_emit_raw(ctx, "({ %s = ", c_name);
+        codegen_expr(ctx, value);
+        if (ctx->symbols.global[i]) omni_codegen_emit_raw(ctx, "; _ver_%s++", c_name);
+        omni_codegen_emit_raw(ctx, "; NIL; })");
+    }
+}
+
+/* (debug-history) prints every kept step, (debug-history n) the last n */
+static void codegen_debug_history(CodeGenContext* ctx, OmniValue* expr) {
+    OmniValue* args = omni_cdr(expr);
+    OmniValue* n = omni_car(args);
+    if (ctx->record_steps == 0) {
+        char* text = omni_value_to_string(expr);
+        omni_codegen_error(ctx, "E0004 %s: no steps are recorded; compile with --record N", text);
+        free(text);
+    } else if (!omni_is_nil(args) && (!omni_is_int(n) || n->int_val < 0 || !omni_is_nil(omni_cdr(args)))) {
+        char* text = omni_value_to_string(expr);
+        omni_codegen_error(ctx, "E0002 %s: expected (debug-history) or (debug-history n) with n a literal count", text);
+        free(text);
+    }
+    omni_codegen_emit_raw(ctx, "omni_debug_history(%ld)",
+                          omni_is_int(n) ? (long)n->int_val : (long)ctx->record_steps);
+}
+
+/* (memory-stats) and (set-allocator! name) read and switch the embedded
+ * runtime's allocators; libpurple does its own allocation */
+static void codegen_allocator_form(CodeGenContext* ctx, OmniValue* expr, const char* name) {
+    OmniValue* args = omni_cdr(expr);
+    bool stats = strcmp(name, "memory-stats") == 0;
+    if (ctx->use_runtime && ctx->runtime_path) {
+        char* text = omni_value_to_string(expr);
+        omni_codegen_error(ctx, "E0004 %s: allocators belong to the embedded runtime; compile with --embedded", text);
+        free(text);
+    } else if (stats ? !omni_is_nil(args) : !omni_is_cell(args) || !omni_is_nil(omni_cdr(args))) {
+        char* text = omni_value_to_string(expr);
+        omni_codegen_error(ctx, stats ? "E0002 %s: expected (memory-stats)"
+                                      : "E0002 %s: expected (set-allocator! name)", text);
+        free(text);
+    }
+    if (stats) {
+        omni_codegen_emit_raw(ctx, "omni_memory_stats()");
+    } else {
+        omni_codegen_emit_raw(ctx, "omni_use_allocator(");
+        if (omni_is_cell(args)) codegen_expr(ctx, omni_car(args));
+        else omni_codegen_emit_raw(ctx, "NIL");
+        omni_codegen_emit_raw(ctx, ")");
+    }
+}
+
+/*
+ * (with-budget (allocs N) [(ms N)] body...) runs body with at most N heap
+ * allocations (and N ms of CPU time); running out unwinds to the form,
+ * which then yields #<error budget-exceeded> with allocs or ms as data.
+ */
+static void codegen_budget_frame(CodeGenContext* ctx, OmniValue* body, const char* enter,
+                                 const char* extra, const char* on_unwind);
+
+static void codegen_with_budget(CodeGenContext* ctx, OmniValue* expr) {
+    long allocs = -1, ms = -1;
+    OmniValue* body = omni_cdr(expr);
+    while (omni_is_cell(body) && omni_is_cell(omni_car(body)) && omni_is_sym(omni_car(omni_car(body)))) {
+        OmniValue* limit = omni_car(body);
+        const char* kind = omni_car(limit)->str_val;
+        long* slot = strcmp(kind, "allocs") == 0 ? &allocs : strcmp(kind, "ms") == 0 ? &ms : NULL;
+        if (!slot) break;
+        OmniValue* n = omni_car(omni_cdr(limit));
+        if (*slot >= 0 || !omni_is_int(n) || n->int_val < 0 || !omni_is_nil(omni_cdr(omni_cdr(limit)))) {
+            char* text = omni_value_to_string(expr);
+            omni_codegen_error(ctx, "E0002 %s: each of (allocs n) and (ms n) takes one literal count", text);
+            free(text);
+        }
+        *slot = omni_is_int(n) ? (long)n->int_val : 0;
+        body = omni_cdr(body);
+    }
+    if ((allocs < 0 && ms < 0) || !omni_is_cell(body)) {
+        char* text = omni_value_to_string(expr);
+        omni_codegen_error(ctx, "E0002 %s: expected (with-budget (allocs n) [(ms n)] body...)", text);
+        free(text);
+    }
+
+    char limits[64];
+    snprintf(limits, sizeof(limits), ", %ldL, %ldL", allocs, ms);
+    codegen_budget_frame(ctx, body, "omni_budget_enter", limits, "omni_budget_error");
+}
+
+/* A budget frame around body: enter(&frame extra), then body's value, or
+ * on_unwind(&frame) if something unwinds to the frame */
+static void codegen_budget_frame(CodeGenContext* ctx, OmniValue* body, const char* enter,
+                                 const char* extra, const char* on_unwind) {
+    OmniArena* arena = ctx->session->arena;
+    int id = ctx->temp_counter++;
+    omni_codegen_emit_raw(ctx, "({ OmniBudget _b%d; Obj* _b%d_v;\n", id, id);
+    omni_codegen_indent(ctx);
+    omni_codegen_emit(ctx, "%s(&_b%d%s);\n", enter, id, extra);
+    if (ctx->crash_handler) {
+        omni_codegen_emit(ctx, "int _b%d_s = purple_shadow_depth();\n", id);
+        omni_codegen_emit(ctx, "if (setjmp(_b%d.jump)) { purple_shadow_restore(_b%d_s); _b%d_v = %s(&_b%d); }\n", id, id, id, on_unwind, id);
+    } else {
+        omni_codegen_emit(ctx, "if (setjmp(_b%d.jump)) _b%d_v = %s(&_b%d);\n", id, id, on_unwind, id);
+    }
+    omni_codegen_emit(ctx, "else { _b%d_v = ", id);
+    if (omni_is_cell(body) && !omni_is_nil(omni_cdr(body))) {
+        codegen_expr(ctx, omni_new_cell(arena, omni_new_sym(arena, "do"), body));
+    } else if (omni_is_cell(body)) {
+        codegen_expr(ctx, omni_car(body));
+    } else {
+        omni_codegen_emit_raw(ctx, "NIL");
+    }
+    omni_codegen_emit_raw(ctx, "; omni_budget_leave(&_b%d); }\n", id);
+    omni_codegen_emit(ctx, "_b%d_v; })", id);
+    omni_codegen_dedent(ctx);
+}
+
+/*
+ * (catch-oom body...) is body's value, or #<error out-of-memory> with the
+ * bytes asked for as data if an allocation in body fails or would pass
+ * the heap limit. Only compiled with the error policy (--oom error), and
+ * only in the embedded runtime, which does the allocating.
+ */
+static void codegen_catch_oom(CodeGenContext* ctx, OmniValue* expr) {
+    OmniValue* body = omni_cdr(expr);
+    if (ctx->use_runtime && ctx->runtime_path) {
+        char* text = omni_value_to_string(expr);
+        omni_codegen_error(ctx, "E0004 %s: out-of-memory handling belongs to the embedded runtime; compile with --embedded", text);
+        free(text);
+    } else if (ctx->oom_policy != OMNI_OOM_ERROR) {
+        char* text = omni_value_to_string(expr);
+        omni_codegen_error(ctx, "E0004 %s: catch-oom needs --oom error", text);
+        free(text);
+    } else if (!omni_is_cell(body)) {
+        char* text = omni_value_to_string(expr);
+        omni_codegen_error(ctx, "E0002 %s: expected (catch-oom body...)", text);
+        free(text);
+    }
+    codegen_budget_frame(ctx, body, "omni_oom_enter", "", "omni_oom_error");
+}
+
+/*
+ * (nursery body...) joins every task spawned while body runs; its value
+ * is their results in spawn order, or the first error. See rt_concurrency.
+ */
+static void codegen_nursery(CodeGenContext* ctx, OmniValue* expr) {
+    OmniArena* arena = ctx->session->arena;
+    OmniValue* body = omni_cdr(expr);
+    int id = ctx->temp_counter++;
+    omni_codegen_emit_raw(ctx, "({ OmniNursery _n%d; Obj* _n%d_v;\n", id, id);
+    omni_codegen_indent(ctx);
+    omni_codegen_emit(ctx, "omni_nursery_enter(&_n%d);\n", id);
+    if (ctx->crash_handler) {
+        omni_codegen_emit(ctx, "int _n%d_s = purple_shadow_depth();\n", id);
+        omni_codegen_emit(ctx, "if (setjmp(_n%d.jump)) { purple_shadow_restore(_n%d_s); _n%d_v = NIL; }\n", id, id, id);
+    } else {
+        omni_codegen_emit(ctx, "if (setjmp(_n%d.jump)) _n%d_v = NIL;\n", id, id);
+    }
+    omni_codegen_emit(ctx, "else _n%d_v = ", id);
+    if (omni_is_cell(body) && !omni_is_nil(omni_cdr(body))) {
+        codegen_expr(ctx, omni_new_cell(arena, omni_new_sym(arena, "do"), body));
+    } else if (omni_is_cell(body)) {
+        codegen_expr(ctx, omni_car(body));
+    } else {
+        omni_codegen_emit_raw(ctx, "NIL");
+    }
+    omni_codegen_emit_raw(ctx, ";\n");
+    omni_codegen_emit(ctx, "omni_nursery_leave(&_n%d, _n%d_v); })", id, id);
+    omni_codegen_dedent(ctx);
+}
+
+/*
+ * (with-cancel tok body...) runs body until (cancel! tok); the body then
+ * stops at its next safe point and the form yields #<error cancelled>.
+ * It opens a nursery frame that collects no tasks. See rt_concurrency.
+ */
+static void codegen_with_cancel(CodeGenContext* ctx, OmniValue* expr) {
+    OmniArena* arena = ctx->session->arena;
+    OmniValue* args = omni_cdr(expr);
+    if (!omni_is_cell(args) || !omni_is_cell(omni_cdr(args))) {
+        char* text = omni_value_to_string(expr);
+        omni_codegen_error(ctx, "E0002 %s: expected (with-cancel token body...)", text);
+        free(text);
+        omni_codegen_emit_raw(ctx, "NIL");
+        return;
+    }
     OmniValue* body = omni_cdr(args);
+    int id = ctx->temp_counter++;
+    omni_codegen_emit_raw(ctx, "({ OmniNursery _c%d; Obj* _c%d_v; Obj* _c%d_t = ", id, id, id);
+    codegen_expr(ctx, omni_car(args));
+    omni_codegen_emit_raw(ctx, ";\n");
+    omni_codegen_indent(ctx);
+    omni_codegen_emit(ctx, "if (!omni_cancel_enter(&_c%d, _c%d_t)) _c%d_v = mk_error(\"with-cancel: not a cancel token\");\n",
+                      id, id, id);
+    omni_codegen_emit(ctx, "else {\n");
+    omni_codegen_indent(ctx);
+    if (ctx->crash_handler) {
+        omni_codegen_emit(ctx, "int _c%d_s = purple_shadow_depth();\n", id);
+        omni_codegen_emit(ctx, "if (setjmp(_c%d.jump)) { purple_shadow_restore(_c%d_s); _c%d_v = NIL; }\n", id, id, id);
+    } else {
+        omni_codegen_emit(ctx, "if (setjmp(_c%d.jump)) _c%d_v = NIL;\n", id, id);
+    }
+    omni_codegen_emit(ctx, "else _c%d_v = ", id);
+    if (!omni_is_nil(omni_cdr(body))) {
+        codegen_expr(ctx, omni_new_cell(arena, omni_new_sym(arena, "do"), body));
+    } else {
+        codegen_expr(ctx, omni_car(body));
+    }
+    omni_codegen_emit_raw(ctx, ";\n");
+    omni_codegen_emit(ctx, "_c%d_v = omni_cancel_leave(&_c%d, _c%d_v);\n", id, id, id);
+    omni_codegen_dedent(ctx);
+    omni_codegen_emit(ctx, "}\n");
+    omni_codegen_emit(ctx, "_c%d_v; })", id);
+    omni_codegen_dedent(ctx);
+}
 
-    if (omni_is_sym(name_or_sig)) {
-        /* Variable define */
-        char* c_name = omni_codegen_mangle(name_or_sig->str_val);
-        omni_codegen_emit(ctx, "Obj* %s = ", c_name);
-        if (!omni_is_nil(body)) {
-            codegen_expr(ctx, omni_car(body));
-        } else {
-            omni_codegen_emit_raw(ctx, "NIL");
+/*
+ * (with-output-to-port port body...) sends what body prints without a
+ * port to port, then puts the current output port back. See rt_ports.
+ */
+static void codegen_with_output(CodeGenContext* ctx, OmniValue* expr) {
+    OmniArena* arena = ctx->session->arena;
+    OmniValue* args = omni_cdr(expr);
+    if (!omni_is_cell(args) || !omni_is_cell(omni_cdr(args))) {
+        char* text = omni_value_to_string(expr);
+        omni_codegen_error(ctx, "E0002 %s: expected (with-output-to-port port body...)", text);
+        free(text);
+        omni_codegen_emit_raw(ctx, "NIL");
+        return;
+    }
+    OmniValue* body = omni_cdr(args);
+    int id = ctx->temp_counter++;
+    omni_codegen_emit_raw(ctx, "({ Obj* _w%d_outer; Obj* _w%d_v; Obj* _w%d_p = ", id, id, id);
+    codegen_expr(ctx, omni_car(args));
+    omni_codegen_emit_raw(ctx, ";\n");
+    omni_codegen_indent(ctx);
+    omni_codegen_emit(ctx, "if (!omni_output_enter(_w%d_p, &_w%d_outer)) _w%d_v = mk_error(\"with-output-to-port: not an open output port\");\n",
+                      id, id, id);
+    omni_codegen_emit(ctx, "else {\n");
+    omni_codegen_indent(ctx);
+    omni_codegen_emit(ctx, "_w%d_v = ", id);
+    if (!omni_is_nil(omni_cdr(body))) {
+        codegen_expr(ctx, omni_new_cell(arena, omni_new_sym(arena, "do"), body));
+    } else {
+        codegen_expr(ctx, omni_car(body));
+    }
+    omni_codegen_emit_raw(ctx, ";\n");
+    omni_codegen_emit(ctx, "omni_output_leave(_w%d_outer);\n", id);
+    omni_codegen_dedent(ctx);
+    omni_codegen_emit(ctx, "}\n");
+    omni_codegen_emit(ctx, "_w%d_v; })", id);
+    omni_codegen_dedent(ctx);
+}
+
+/* What a lifted body is called: a task, goroutine or future */
+static const char* lifted_name(const char* form) {
+    if (strcmp(form, "spawn") == 0) return "task";
+    if (strcmp(form, "go") == 0) return "goroutine";
+    return form;
+}
+
+/*
+ * Lift body into a ClosureFn whose captures are the locals it uses, at
+ * most 64 of them, into names and count. Returns the function's name, or
+ * NULL after reporting a body that is missing.
+ */
+static char* lift_body(CodeGenContext* ctx, OmniValue* expr, OmniValue** names, int* count) {
+    OmniArena* arena = ctx->session->arena;
+    const char* form = omni_car(expr)->str_val;
+    OmniValue* body = omni_cdr(expr);
+    if (!omni_is_cell(body)) {
+        char* text = omni_value_to_string(expr);
+        omni_codegen_error(ctx, "E0002 %s: expected (%s body...)", text, form);
+        free(text);
+        return NULL;
+    }
+    *count = 0;
+    collect_captures(ctx, body, names, count, 65);
+    if (*count > 64) {
+        char* text = omni_value_to_string(expr);
+        omni_codegen_error(ctx, "E0002 %s: a %s can use at most 64 local variables", text,
+                           lifted_name(form));
+        free(text);
+        *count = 64;
+    }
+
+    char fn_name[64];
+    snprintf(fn_name, sizeof(fn_name), "_%s_%d", strcmp(form, "spawn") == 0 ? "task" : form,
+             ctx->lambda_counter++);
+
+    CodeGenContext* tmp = omni_codegen_new_buffer(ctx->session);
+    tmp->indent_level = 1;
+    tmp->lambda_counter = ctx->lambda_counter;
+    tmp->analysis = ctx->analysis;
+    tmp->record_steps = ctx->record_steps;
+    tmp->shadowing = ctx->shadowing;
+    tmp->constraint_check = ctx->constraint_check;
+    tmp->memory = ctx->memory;
+    tmp->coop_cancel = ctx->coop_cancel;
+    tmp->freestanding = ctx->freestanding;
+    tmp->oom_policy = ctx->oom_policy;
+    tmp->use_runtime = ctx->use_runtime;
+    tmp->runtime_path = ctx->runtime_path;
+    tmp->form = ctx->form;
+    tmp->located = ctx->located;
+    tmp->module_names = ctx->module_names;
+    tmp->provides = ctx->provides;
+    tmp->imports = ctx->imports;
+    tmp->module = ctx->module;
+    tmp->boxed_names = ctx->boxed_names;
+    copy_symbols(tmp, ctx);
+    bind_captures(tmp, ctx, names, *count);
+    omni_codegen_emit(tmp, "return ");
+    codegen_expr(tmp, omni_is_nil(omni_cdr(body)) ? omni_car(body)
+                                                   : omni_new_cell(arena, omni_new_sym(arena, "do"), body));
+    omni_codegen_emit_raw(tmp, ";\n");
+    ctx->lambda_counter = tmp->lambda_counter;
+    absorb_scratch(ctx, tmp);
+
+    char* body_code = omni_codegen_get_output(tmp);
+    size_t size = strlen(fn_name) + (body_code ? strlen(body_code) : 0) + 160;
+    char* def = malloc(size);
+    snprintf(def, size, "static Obj* %s(Obj** captures, Obj** args, int argc) {\n"
+                        "    (void)captures; (void)args; (void)argc;\n%s}",
+             fn_name, body_code ? body_code : "");
+    omni_codegen_add_lambda_def(ctx, def);
+    free(def);
+    free(body_code);
+    tmp->analysis = NULL;
+    omni_codegen_free(tmp);
+    return strdup(fn_name);
+}
+
+/*
+ * Lift body and emit start(fn, captures, count): omni_spawn for (spawn
+ * body...), omni_future for (future body...).
+ */
+static void codegen_lifted_body(CodeGenContext* ctx, OmniValue* expr, const char* start) {
+    OmniValue* names[65];
+    int count;
+    char* fn_name = lift_body(ctx, expr, names, &count);
+    if (!fn_name) {
+        omni_codegen_emit_raw(ctx, "NIL");
+        return;
+    }
+    omni_codegen_emit_raw(ctx, "%s(%s, ", start, fn_name);
+    emit_captures(ctx, names, count);
+    omni_codegen_emit_raw(ctx, ", %d)", count);
+    free(fn_name);
+}
+
+/*
+ * (spawn body...) runs body as a task of the innermost nursery; the
+ * nursery keeps the locals it uses alive until the task is joined.
+ */
+static void codegen_spawn(CodeGenContext* ctx, OmniValue* expr) {
+    codegen_lifted_body(ctx, expr, "omni_spawn");
+}
+
+/*
+ * (future body...) runs body on its own thread and is a promise for its
+ * value; the promise keeps the locals it uses alive until it is freed.
+ */
+static void codegen_future(CodeGenContext* ctx, OmniValue* expr) {
+    codegen_lifted_body(ctx, expr, "omni_future");
+}
+
+/*
+ * (go body...) runs body on a thread of its own and is (); only an
+ * enclosing (wait-group body...) waits for it. The goroutine releases
+ * the locals it uses when it ends, so those the concurrency analysis
+ * finds shared with it are counted atomically.
+ */
+static void codegen_go(CodeGenContext* ctx, OmniValue* expr) {
+    OmniValue* names[65];
+    int count;
+    char* fn_name = lift_body(ctx, expr, names, &count);
+    if (!fn_name) {
+        omni_codegen_emit_raw(ctx, "NIL");
+        return;
+    }
+    uint64_t shared = 0;
+    for (int i = 0; i < count; i++) {
+        if (!ctx->analysis || shared_rc(ctx, names[i]->str_val)) shared |= 1ull << i;
+    }
+    omni_codegen_emit_raw(ctx, "omni_go(%s, ", fn_name);
+    emit_captures(ctx, names, count);
+    omni_codegen_emit_raw(ctx, ", %d, 0x%llxULL)", count, (unsigned long long)shared);
+    free(fn_name);
+}
+
+/* (wait-group body...) is body's value once every goroutine started
+ * while it ran, or by those goroutines, has ended */
+static void codegen_wait_group(CodeGenContext* ctx, OmniValue* expr) {
+    OmniArena* arena = ctx->session->arena;
+    OmniValue* body = omni_cdr(expr);
+    int id = ctx->temp_counter++;
+    omni_codegen_emit_raw(ctx, "({ OmniWaitGroup _g%d; Obj* _g%d_v;\n", id, id);
+    omni_codegen_indent(ctx);
+    omni_codegen_emit(ctx, "omni_wait_group_enter(&_g%d);\n", id);
+    omni_codegen_emit(ctx, "_g%d_v = ", id);
+    if (omni_is_cell(body) && !omni_is_nil(omni_cdr(body))) {
+        codegen_expr(ctx, omni_new_cell(arena, omni_new_sym(arena, "do"), body));
+    } else if (omni_is_cell(body)) {
+        codegen_expr(ctx, omni_car(body));
+    } else {
+        omni_codegen_emit_raw(ctx, "NIL");
+    }
+    omni_codegen_emit_raw(ctx, ";\n");
+    omni_codegen_emit(ctx, "omni_wait_group_leave(&_g%d, _g%d_v); })", id, id);
+    omni_codegen_dedent(ctx);
+}
+
+/* Expressions whose evaluation has no side effects */
+static bool is_atomic(OmniValue* expr) {
+    if (!expr || omni_is_nil(expr)) return true;
+    switch (expr->tag) {
+    case OMNI_INT:
+    case OMNI_FLOAT:
+    case OMNI_CHAR:
+    case OMNI_STRING:
+    case OMNI_KEYWORD:
+    case OMNI_SYM:
+    case OMNI_ERROR:
+        return true;
+    case OMNI_CELL:
+        return omni_is_sym(omni_car(expr)) &&
+               strcmp(omni_car(expr)->str_val, "quote") == 0;
+    default:
+        return false;
+    }
+}
+
+/* Emit one call argument; bit i of fn_mask marks argument i as a function
+ * value (see codegen_function_value) */
+/* A bound variable that is not a compiled function, e.g. a parameter
+ * holding a closure */
+static bool is_closure_variable(CodeGenContext* ctx, OmniValue* func) {
+    return omni_is_sym(func) && lookup_symbol(ctx, func->str_val) &&
+           !function_symbol(ctx, func->str_val);
+}
+
+static const char* thread_name(CodeGenContext* ctx, OmniValue* expr);
+
+static void codegen_arg(CodeGenContext* ctx, OmniValue* arg, size_t i, unsigned fn_mask) {
+    /* Freestanding code reports thread primitives through codegen_expr */
+    bool fn = fn_mask & (1u << i) && !(ctx->freestanding && thread_name(ctx, arg));
+    if (!arg) omni_codegen_emit_raw(ctx, "NIL");
+    else if (fn) codegen_function_value(ctx, arg);
+    else codegen_expr(ctx, arg);
+}
+
+/* Emit a call to callee (or to the expression func when callee is NULL).
+ * The operator is evaluated first, then the arguments left to right: C
+ * leaves argument order unspecified, so once two or more of them have
+ * side effects they are materialized into temporaries first. A NULL
+ * argument stands for NIL.
+ * A packed callee takes the arguments as one array and a count, the way
+ * call_closure does. */
+static void codegen_call(CodeGenContext* ctx, const char* callee, OmniValue* func,
+                         OmniValue** argv, size_t argc, unsigned fn_mask, bool packed) {
+    size_t effectful = 0;
+    for (size_t i = 0; i < argc; i++) {
+        if (!is_atomic(argv[i])) effectful++;
+    }
+
+    /* An operator computed by an expression counts as one of them */
+    bool computed = !callee && !omni_is_sym(func) && !is_lambda_form(func);
+    char** temps = NULL;
+    char* fn_temp = NULL;
+    if (effectful > 1 || (computed && effectful > 0)) {
+        temps = calloc(argc, sizeof(char*));
+        omni_codegen_emit_raw(ctx, "({\n");
+        omni_codegen_indent(ctx);
+        if (computed) {
+            fn_temp = omni_codegen_temp(ctx);
+            omni_codegen_emit(ctx, "Obj* %s = ", fn_temp);
+            codegen_expr(ctx, func);
+            omni_codegen_emit_raw(ctx, ";\n");
+        }
+        for (size_t i = 0; i < argc; i++) {
+            if (is_atomic(argv[i])) continue;
+            temps[i] = omni_codegen_temp(ctx);
+            omni_codegen_emit(ctx, "Obj* %s = ", temps[i]);
+            codegen_arg(ctx, argv[i], i, fn_mask);
+            omni_codegen_emit_raw(ctx, ";\n");
         }
+        omni_codegen_emit(ctx, "");
+    }
+
+    /* A variable holding a closure, or an expression computing one, is
+     * called through call_closure; a global through a per-site cache */
+    bool via_closure = !callee && (omni_is_sym(func) ? is_closure_variable(ctx, func)
+                                                     : !is_lambda_form(func));
+    const char* global = via_closure && omni_is_sym(func) ? global_variable(ctx, func->str_val) : NULL;
+    if (callee && packed) {
+        omni_codegen_emit_raw(ctx, argc ? "%s((Obj*[]){" : "%s(NULL, 0", callee);
+    } else if (callee) {
+        omni_codegen_emit_raw(ctx, "%s(", callee);
+    } else if (global) {
+        /* Thread-local, so callers on other threads never see a half-written entry */
+        omni_codegen_emit_raw(ctx, "({ static __thread OmniCallCache _ic; omni_call_cached(&_ic, %s, _ver_%s", global, global);
+        omni_codegen_emit_raw(ctx, argc ? ", (Obj*[]){" : ", NULL, 0");
+    } else if (via_closure) {
+        omni_codegen_emit_raw(ctx, "call_closure(");
+        if (fn_temp) omni_codegen_emit_raw(ctx, "%s", fn_temp);
+        else codegen_expr(ctx, func);
+        omni_codegen_emit_raw(ctx, argc ? ", (Obj*[]){" : ", NULL, 0");
+    } else if (omni_is_sym(func) && letrec_function(ctx, func->str_val).group) {
+        OmniValue* slots[64];
+        int count = group_slots(ctx->session->arena, letrec_function(ctx, func->str_val), slots);
+        omni_codegen_emit_raw(ctx, "%s(", lookup_symbol(ctx, func->str_val));
+        emit_captures(ctx, slots, count);
+    } else if (omni_is_sym(func)) {
+        codegen_sym(ctx, func);
+        omni_codegen_emit_raw(ctx, "(");
+    } else {
+        OmniValue* captures[65];
+        int count = 0;
+        char* fn_name = codegen_lambda_def(ctx, func, NULL, captures, &count);
+        omni_codegen_emit_raw(ctx, "%s(", fn_name);
+        emit_captures(ctx, captures, count);
+        free(fn_name);
+    }
+    bool lambda = !callee && !via_closure &&
+                  (!omni_is_sym(func) || letrec_function(ctx, func->str_val).group);
+    for (size_t i = 0; i < argc; i++) {
+        if (i > 0 || lambda) omni_codegen_emit_raw(ctx, ", ");
+        if (temps && temps[i]) omni_codegen_emit_raw(ctx, "%s", temps[i]);
+        else codegen_arg(ctx, argv[i], i, fn_mask);
+    }
+    if ((via_closure || packed) && argc) omni_codegen_emit_raw(ctx, "}, %zu", argc);
+    omni_codegen_emit_raw(ctx, global ? "); })" : ")");
+
+    if (temps) {
         omni_codegen_emit_raw(ctx, ";\n");
-        register_symbol(ctx, name_or_sig->str_val, c_name);
-        free(c_name);
-    } else if (omni_is_cell(name_or_sig)) {
-        /* Function define */
-        OmniValue* fname = omni_car(name_or_sig);
-        OmniValue* params = omni_cdr(name_or_sig);
+        omni_codegen_dedent(ctx);
+        omni_codegen_emit(ctx, "})");
+        for (size_t i = 0; i < argc; i++) free(temps[i]);
+        free(temps);
+        free(fn_temp);
+    }
+}
 
-        if (!omni_is_sym(fname)) return;
+/* ============== Constant Folding ============== */
 
-        char* c_name = omni_codegen_mangle(fname->str_val);
-        register_symbol(ctx, fname->str_val, c_name);
+static double fold_to_double(OmniValue* v) {
+    return v->tag == OMNI_FLOAT ? v->float_val : (double)v->int_val;
+}
+
+
+static uint64_t fold_gcd(uint64_t a, uint64_t b) {
+    while (b) {
+        uint64_t t = a % b;
+        a = b;
+        b = t;
+    }
+    return a;
+}
+
+/* Exact ordering as in the runtimes' num_compare: -1, 0, 1, or 2 (NaN) */
+static int fold_compare(OmniValue* a, OmniValue* b) {
+    if (a->tag == OMNI_INT && b->tag == OMNI_INT) {
+        return a->int_val < b->int_val ? -1 : (a->int_val > b->int_val ? 1 : 0);
+    }
+    if (a->tag == OMNI_FLOAT && b->tag == OMNI_FLOAT) {
+        double x = a->float_val, y = b->float_val;
+        if (x != x || y != y) return 2;
+        return x < y ? -1 : (x > y ? 1 : 0);
+    }
+    bool swap = a->tag == OMNI_FLOAT;
+    int64_t i = swap ? b->int_val : a->int_val;
+    double f = swap ? a->float_val : b->float_val;
+    int c;
+    if (f != f) return 2;
+    if (f >= 9223372036854775808.0) c = -1;
+    else if (f < -9223372036854775808.0) c = 1;
+    else {
+        int64_t t = (int64_t)f;
+        if (i != t) c = i < t ? -1 : 1;
+        else c = f > (double)t ? -1 : (f < (double)t ? 1 : 0);
+    }
+    return swap ? -c : c;
+}
+
+static void fold_set_int(OmniValue* out, int64_t i) {
+    memset(out, 0, sizeof(*out));
+    out->tag = OMNI_INT;
+    out->int_val = i;
+}
+
+static void fold_set_float(OmniValue* out, double f) {
+    memset(out, 0, sizeof(*out));
+    out->tag = OMNI_FLOAT;
+    out->float_val = f;
+}
+
+/* Integer operands only: floats are left to the runtime */
+static uint64_t fold_abs_u64(OmniValue* v) {
+    return v->int_val < 0 ? 0 - (uint64_t)v->int_val : (uint64_t)v->int_val;
+}
+
+/* As the runtimes' magnitude_result: a float when no int holds v */
+static void fold_set_magnitude(OmniValue* out, uint64_t v) {
+    if (v > INT64_MAX) fold_set_float(out, (double)v);
+    else fold_set_int(out, (int64_t)v);
+}
+
+/* Evaluate a call to a pure numeric primitive whose operands are all
+ * literals (or foldable calls). The arithmetic mirrors the runtimes, so a
+ * folded call prints exactly what the call would have printed. */
+static bool fold_constant(CodeGenContext* ctx, OmniValue* expr, OmniValue* out) {
+    if (omni_is_int(expr) || omni_is_float(expr)) {
+        *out = *expr;
+        return true;
+    }
+    if (!omni_is_cell(expr) || !omni_is_sym(omni_car(expr)) || !ctx->analysis) return false;
+
+    const char* name = omni_car(expr)->str_val;
+    if (lookup_symbol(ctx, name) || !omni_function_is_pure(ctx->analysis, name)) return false;
+    FunctionSummary* summary = omni_get_function_summary(ctx->analysis, name);
+
+    /* min and max take any number of operands, up to the few folded here */
+    bool variadic = strcmp(name, "min") == 0 || strcmp(name, "max") == 0;
+    OmniValue v[8];
+    memset(v, 0, sizeof(v));
+    size_t argc = 0;
+    for (OmniValue* a = omni_cdr(expr); !omni_is_nil(a) && omni_is_cell(a); a = omni_cdr(a)) {
+        if (argc == (variadic ? 8 : 2) || !fold_constant(ctx, omni_car(a), &v[argc])) return false;
+        argc++;
+    }
+    if (variadic ? argc == 0 : argc != summary->param_count) return false;
+
+    bool inexact = false;
+    for (size_t i = 0; i < argc; i++) inexact |= v[i].tag == OMNI_FLOAT;
+
+    if (variadic) {
+        OmniValue* r = &v[0];
+        for (size_t i = 1; i < argc; i++) {
+            int c = fold_compare(r, &v[i]);
+            if (c == 2) {
+                fold_set_float(out, NAN);
+                return true;
+            }
+            if (name[1] == 'i' ? c == 1 : c == -1) r = &v[i];
+        }
+        if (inexact) fold_set_float(out, fold_to_double(r));
+        else fold_set_int(out, r->int_val);
+        return true;
+    }
+    if (strcmp(name, "expt") == 0) {
+        if (inexact || v[1].int_val < 0) {
+            fold_set_float(out, pow(fold_to_double(&v[0]), fold_to_double(&v[1])));
+            return true;
+        }
+        /* As prim_expt: a power no int holds is a float */
+        int64_t base = v[0].int_val, r = 1;
+        uint64_t e = (uint64_t)v[1].int_val;
+        for (;;) {
+            if ((e & 1) && __builtin_mul_overflow(r, base, &r)) break;
+            e >>= 1;
+            if (!e) {
+                fold_set_int(out, r);
+                return true;
+            }
+            if (__builtin_mul_overflow(base, base, &base)) break;
+        }
+        fold_set_float(out, pow(fold_to_double(&v[0]), fold_to_double(&v[1])));
+        return true;
+    }
+    /* Left to the runtime, which makes the result of a float a float */
+    if ((strcmp(name, "gcd") == 0 || strcmp(name, "lcm") == 0) && inexact) return false;
+    if (strcmp(name, "gcd") == 0) {
+        fold_set_magnitude(out, fold_gcd(fold_abs_u64(&v[0]), fold_abs_u64(&v[1])));
+        return true;
+    }
+    if (strcmp(name, "lcm") == 0) {
+        uint64_t x = fold_abs_u64(&v[0]), y = fold_abs_u64(&v[1]), l;
+        if (x == 0 || y == 0) {
+            fold_set_int(out, 0);
+            return true;
+        }
+        x /= fold_gcd(x, y);
+        if (__builtin_mul_overflow(x, y, &l)) fold_set_float(out, (double)x * (double)y);
+        else fold_set_magnitude(out, l);
+        return true;
+    }
+    if (strcmp(name, "sqrt") == 0) {
+        if (inexact) {
+            fold_set_float(out, sqrt(v[0].float_val));
+            return true;
+        }
+        if (v[0].int_val >= 0) {
+            uint64_t n = (uint64_t)v[0].int_val, r = (uint64_t)sqrt((double)n);
+            while (r * r > n) r--;
+            while ((r + 1) * (r + 1) <= n) r++;
+            if (r * r == n) {
+                fold_set_int(out, (int64_t)r);
+                return true;
+            }
+        }
+        fold_set_float(out, sqrt((double)v[0].int_val));
+        return true;
+    }
+    return false;
+}
+
+/* Arguments func can be called with, from min to max; false when that
+ * is only known at run time, as for a variable holding a closure */
+static bool call_arity(CodeGenContext* ctx, OmniValue* func, int* min, int* max) {
+    *min = *max = -1;
+    if (omni_is_sym(func)) {
+        const char* name = func->str_val;
+        long i = find_symbol(ctx, name);
+        if (i >= 0) {
+            *min = *max = ctx->symbols.params[i];
+        } else if (strcmp(name, "-") == 0) {
+            *min = 1;
+            *max = 2;
+        } else if (strcmp(name, "display") == 0 || strcmp(name, "print") == 0 ||
+                   strcmp(name, "write") == 0) {
+            *min = 0;
+            *max = 2;  /* The value and a port */
+        } else if (strcmp(name, "hash") == 0) {
+            *min = 0;
+            *max = 1;
+        } else if (strcmp(name, "error") == 0) {
+            *min = 1;
+            *max = 2;
+        } else if (strcmp(name, "newline") == 0) {
+            *min = 0;
+            *max = 1;
+        } else if (strcmp(name, "min") == 0 || strcmp(name, "max") == 0) {
+            *min = 1;
+            *max = INT_MAX;
+        } else if (find_primitive(name)) {
+            *min = *max = find_primitive(name)->arity;
+        }
+    } else if (is_lambda_form(func)) {
+        OmniValue* params = omni_car(omni_cdr(func));
+        if (omni_is_nil(params) || omni_is_cell(params)) *min = *max = (int)omni_list_len(params);
+    }
+    return *min >= 0;
+}
+
+/* Report a call with a number of arguments its callee cannot take */
+static void check_arity(CodeGenContext* ctx, OmniValue* expr) {
+    int min, max;
+    if (!call_arity(ctx, omni_car(expr), &min, &max)) return;
+    int given = (int)omni_list_len(omni_cdr(expr));
+    if (given >= min && given <= max) return;
+
+    char* callee = omni_value_to_string(omni_car(expr));
+    char takes[32];
+    if (min == max) snprintf(takes, sizeof(takes), "%d", min);
+    else if (max == INT_MAX) snprintf(takes, sizeof(takes), "%d or more", min);
+    else snprintf(takes, sizeof(takes), "%d or %d", min, max);
+    omni_codegen_error(ctx, "E0011 wrong number of arguments: %s takes %s, given %d",
+                       omni_is_sym(omni_car(expr)) ? callee : "lambda", takes, given);
+    free(callee);
+}
+
+/*
+ * (user%op T arg...) is the runtime's user_op(&_type_T, arg...) over the
+ * descriptor _type_T the program emits for T, and (user%new T f...) is
+ * mk_user. The functions a deftype defines are made of these, with the
+ * field index of (user%ref T i x) and (user%set T i x v) a literal; a sum
+ * type S adds (user%in S x) and (user%tag S x). define-printer expands to
+ * (user%printer T fn).
+ */
+static bool codegen_user_form(CodeGenContext* ctx, OmniValue* expr) {
+    OmniValue* func = omni_car(expr);
+    if (!omni_is_sym(func) || strncmp(func->str_val, "user%", 5) != 0) return false;
+    const char* op = func->str_val + 5;
+    OmniValue* args = omni_cdr(expr);
+    char* type = omni_codegen_mangle(omni_car(args)->str_val);
+    args = omni_cdr(args);
+    if (strcmp(op, "new") == 0) {
+        omni_codegen_emit_raw(ctx, "mk_user(&_type_%s, ", type);
+        if (omni_is_nil(args)) omni_codegen_emit_raw(ctx, "NULL");
+        else omni_codegen_emit_raw(ctx, "(Obj*[]){");
+        for (OmniValue* a = args; omni_is_cell(a); a = omni_cdr(a)) {
+            if (a != args) omni_codegen_emit_raw(ctx, ", ");
+            codegen_expr(ctx, omni_car(a));
+        }
+        omni_codegen_emit_raw(ctx, omni_is_nil(args) ? ")" : "})");
+    } else {
+        omni_codegen_emit_raw(ctx, "user_%s(&_type_%s", op, type);
+        for (OmniValue* a = args; omni_is_cell(a); a = omni_cdr(a)) {
+            omni_codegen_emit_raw(ctx, ", ");
+            /* The field index of ref and set */
+            bool index = a == args && (strcmp(op, "ref") == 0 || strcmp(op, "set") == 0);
+            if (index && omni_is_int(omni_car(a))) omni_codegen_emit_raw(ctx, "%ld", (long)omni_car(a)->int_val);
+            else codegen_expr(ctx, omni_car(a));
+        }
+        omni_codegen_emit_raw(ctx, ")");
+    }
+    free(type);
+    return true;
+}
+
+static void codegen_apply(CodeGenContext* ctx, OmniValue* expr) {
+    OmniValue* func = omni_car(expr);
+    OmniValue* args = omni_cdr(expr);
+
+    if (codegen_user_form(ctx, expr)) return;
+
+    /* Reported, then compiled anyway so errors in the arguments show too */
+    check_arity(ctx, expr);
+
+    /* Calls to pure numeric primitives over literals become literals */
+    OmniValue folded;
+    if (fold_constant(ctx, expr, &folded)) {
+        if (folded.tag == OMNI_INT) codegen_int(ctx, &folded);
+        else codegen_float(ctx, &folded);
+        return;
+    }
+
+    /* Operators and printers, unless a binding of the same name is in scope */
+    if (omni_is_sym(func) && !lookup_symbol(ctx, func->str_val)) {
+        const char* name = func->str_val;
+        bool is_binop = (strcmp(name, "+") == 0 || strcmp(name, "-") == 0 ||
+                         strcmp(name, "*") == 0 || strcmp(name, "/") == 0 ||
+                         strcmp(name, "%") == 0 || strcmp(name, "<") == 0 ||
+                         strcmp(name, ">") == 0 || strcmp(name, "<=") == 0 ||
+                         strcmp(name, ">=") == 0 || strcmp(name, "=") == 0);
+
+        if (is_binop && !omni_is_nil(args) && !omni_is_nil(omni_cdr(args))) {
+            OmniValue* operands[2] = { omni_car(args), omni_car(omni_cdr(args)) };
+            codegen_call(ctx, NULL, func, operands, 2, 0, false);
+            return;
+        }
+
+        /* (min a b c ...) compares left to right, two at a time */
+        if ((strcmp(name, "min") == 0 || strcmp(name, "max") == 0) && omni_is_cell(args) &&
+            omni_list_len(args) != 2) {
+            const char* prim = name[1] == 'i' ? "prim_min" : "prim_max";
+            char* acc = omni_codegen_temp(ctx);
+            omni_codegen_emit_raw(ctx, "({ Obj* %s = ", acc);
+            codegen_expr(ctx, omni_car(args));
+            omni_codegen_emit_raw(ctx, "; ");
+            if (omni_is_nil(omni_cdr(args))) {
+                omni_codegen_emit_raw(ctx, "%s(%s, %s); })", prim, acc, acc);
+            } else {
+                for (OmniValue* a = omni_cdr(args); omni_is_cell(a); a = omni_cdr(a)) {
+                    omni_codegen_emit_raw(ctx, "%s = %s(%s, ", acc, prim, acc);
+                    codegen_expr(ctx, omni_car(a));
+                    omni_codegen_emit_raw(ctx, "); ");
+                }
+                omni_codegen_emit_raw(ctx, "%s; })", acc);
+            }
+            free(acc);
+            return;
+        }
+
+        /* Unary minus: (- x) negates; (- 1) is not the literal -1 */
+        if (strcmp(name, "-") == 0 && !omni_is_nil(args) && omni_is_nil(omni_cdr(args))) {
+            if (omni_is_int(omni_car(args)) && omni_car(args)->int_val != INT64_MIN) {
+                OmniValue neg = *omni_car(args);
+                neg.int_val = -neg.int_val;
+                codegen_int(ctx, &neg);
+                return;
+            }
+            omni_codegen_emit_raw(ctx, "prim_sub(mk_int(0), ");
+            codegen_expr(ctx, omni_car(args));
+            omni_codegen_emit_raw(ctx, ")");
+            return;
+        }
+
+        /* Check for display/print, and write, with an optional port */
+        bool is_write = strcmp(name, "write") == 0;
+        if (is_write || strcmp(name, "display") == 0 || strcmp(name, "print") == 0) {
+            bool to_port = omni_is_cell(args) && omni_is_cell(omni_cdr(args));
+            omni_codegen_emit_raw(ctx, "omni_%s%s(", is_write ? "write" : "print", to_port ? "_to" : "");
+            if (to_port) {
+                codegen_expr(ctx, omni_car(omni_cdr(args)));
+                omni_codegen_emit_raw(ctx, ", ");
+            }
+            if (!omni_is_nil(args)) codegen_expr(ctx, omni_car(args));
+            else omni_codegen_emit_raw(ctx, "NIL");
+            omni_codegen_emit_raw(ctx, ")");
+            return;
+        }
+
+        /* Printing with no port goes to the current output port */
+        if (strcmp(name, "newline") == 0) {
+            omni_codegen_emit_raw(ctx, "omni_newline_to(");
+            if (omni_is_nil(args)) omni_codegen_emit_raw(ctx, "NIL");
+            else codegen_expr(ctx, omni_car(args));
+            omni_codegen_emit_raw(ctx, ")");
+            return;
+        }
+
+        if (strcmp(name, "ownership-of") == 0 || strcmp(name, "shape-of") == 0) {
+            codegen_reflection(ctx, name, args);
+            return;
+        }
+
+        /* (error msg [data]) - the payload is optional */
+        if (strcmp(name, "error") == 0) {
+            OmniValue* operands[2] = { NULL, NULL };
+            if (!omni_is_nil(args)) {
+                operands[0] = omni_car(args);
+                if (!omni_is_nil(omni_cdr(args))) operands[1] = omni_car(omni_cdr(args));
+            }
+            codegen_call(ctx, "prim_error", NULL, operands, 2, 0, false);
+            return;
+        }
+    }
+
+    /* (vector a b ...) takes any number of slots */
+    if (omni_is_sym(func) && !lookup_symbol(ctx, func->str_val) &&
+        strcmp(func->str_val, "vector") == 0) {
+        size_t argc = omni_list_len(args);
+        OmniValue** argv = argc ? malloc(argc * sizeof(OmniValue*)) : NULL;
+        size_t i = 0;
+        for (OmniValue* a = args; omni_is_cell(a); a = omni_cdr(a)) argv[i++] = omni_car(a);
+        codegen_call(ctx, "prim_vector_of", NULL, argv, argc, 0, true);
+        free(argv);
+        return;
+    }
+
+    /* (hash) makes a table; (hash x) is the primitive hashing x */
+    if (omni_is_sym(func) && !lookup_symbol(ctx, func->str_val) &&
+        strcmp(func->str_val, "hash") == 0 && omni_is_nil(args)) {
+        omni_codegen_emit_raw(ctx, "prim_make_hash()");
+        return;
+    }
+
+    /* Regular function call; higher-order list primitives take their
+     * function argument as a closure object */
+    size_t argc = 0;
+    for (OmniValue* a = args; !omni_is_nil(a) && omni_is_cell(a); a = omni_cdr(a)) argc++;
+    OmniValue** argv = argc ? malloc(argc * sizeof(OmniValue*)) : NULL;
+    size_t i = 0;
+    for (OmniValue* a = args; !omni_is_nil(a) && omni_is_cell(a); a = omni_cdr(a)) {
+        argv[i++] = omni_car(a);
+    }
+    unsigned fn_mask = 0;
+    if (omni_is_sym(func) && !lookup_symbol(ctx, func->str_val) &&
+        (strcmp(func->str_val, "map") == 0 || strcmp(func->str_val, "filter") == 0 ||
+         strcmp(func->str_val, "fold") == 0 || strcmp(func->str_val, "for-each") == 0)) {
+        fn_mask = 1u;
+    }
+
+    /* Under --constraint-check, hold a constraint on a collection the
+     * borrow analysis says the call borrows */
+    const char* borrowed = NULL;
+    if (fn_mask && ctx->constraint_check && ctx->analysis && argc > 0 &&
+        omni_is_sym(argv[argc - 1]) &&
+        omni_get_borrow_info(ctx->analysis, argv[argc - 1]->str_val)) {
+        borrowed = lookup_symbol(ctx, argv[argc - 1]->str_val);
+    }
+    if (borrowed) {
+        char* text = omni_value_to_string(expr);
+        omni_codegen_emit_raw(ctx, "({ omni_cc_borrow(%s, \"form %zu: ", borrowed, ctx->form);
+        emit_c_text(ctx, text);
+        omni_codegen_emit_raw(ctx, "\"); Obj* _cc_result = ");
+        free(text);
+    }
+    codegen_call(ctx, NULL, func, argv, argc, fn_mask, false);
+    if (borrowed) omni_codegen_emit_raw(ctx, "; omni_cc_release(%s); _cc_result; })", borrowed);
+    free(argv);
+}
 
-        /* Emit function */
-        omni_codegen_emit(ctx, "static Obj* %s(", c_name);
+/* ============== Staging ============== */
+
+/* A symbol naming a top-level function, a primitive or a printer */
+static bool names_function(CodeGenContext* ctx, OmniValue* sym) {
+    if (lookup_symbol(ctx, sym->str_val)) {
+        return function_symbol(ctx, sym->str_val);
+    }
+    return find_primitive(sym->str_val) || strcmp(sym->str_val, "display") == 0 ||
+           strcmp(sym->str_val, "print") == 0 || strcmp(sym->str_val, "write") == 0;
+}
+
+/* Why v cannot cross from compile time into the generated program, or
+ * NULL if it can */
+static const char* unliftable(CodeGenContext* ctx, OmniValue* v) {
+    switch (v ? v->tag : OMNI_NIL) {
+    case OMNI_INT:
+    case OMNI_FLOAT:
+    case OMNI_CHAR:
+    case OMNI_STRING:
+    case OMNI_KEYWORD:
+    case OMNI_NIL:
+        return NULL;
+    case OMNI_SYM:
+        if (names_function(ctx, v)) return NULL;
+        return lookup_symbol(ctx, v->str_val) ? "variables are only known at run time"
+                                              : "unbound symbol";
+    case OMNI_CELL: {
+        OmniValue* head = omni_car(v);
+        if (omni_sym_eq_str(head, "quote") || is_lambda_form(v)) return NULL;
+        if (omni_sym_eq_str(head, "lift")) return "code values do not persist into later stages";
+        if (omni_sym_eq_str(head, "box")) return "boxes have no compiled representation";
+        if (omni_sym_eq_str(head, "error")) return "error values do not persist across stages";
+        return "the value is computed at run time";
+    }
+    case OMNI_ERROR:
+        return "error values do not persist across stages";
+    default:
+        return "the value has no compiled representation";
+    }
+}
 
-        /* Parameters */
-        bool first = true;
-        while (!omni_is_nil(params) && omni_is_cell(params)) {
-            if (!first) omni_codegen_emit_raw(ctx, ", ");
-            first = false;
-            OmniValue* param = omni_car(params);
-            if (omni_is_sym(param)) {
-                char* param_name = omni_codegen_mangle(param->str_val);
-                omni_codegen_emit_raw(ctx, "Obj* %s", param_name);
-                register_symbol(ctx, param->str_val, param_name);
-                free(param_name);
-            }
-            params = omni_cdr(params);
-        }
+/* ============== Code Values ============== */
 
-        if (first) {
-            omni_codegen_emit_raw(ctx, "void");
-        }
-        omni_codegen_emit_raw(ctx, ") {\n");
-        omni_codegen_indent(ctx);
+/* Names bound by enclosing code-let forms while staging */
+typedef struct StageScope {
+    const char* name;
+    const struct StageScope* outer;
+} StageScope;
 
-        /* Body */
-        OmniValue* result = NULL;
-        while (!omni_is_nil(body) && omni_is_cell(body)) {
-            result = omni_car(body);
-            body = omni_cdr(body);
-        }
+/* Largest count staged-power and staged-unroll will expand */
+#define STAGE_MAX_UNROLL 1024
 
-        if (result) {
-            omni_codegen_emit(ctx, "return ");
-            codegen_expr(ctx, result);
-            omni_codegen_emit_raw(ctx, ";\n");
-        } else {
-            omni_codegen_emit(ctx, "return NIL;\n");
-        }
+static const char* g_code_forms[] = {
+    "lift", "code-app", "code-let", "code-if", "staged-power", "staged-unroll", NULL
+};
 
-        omni_codegen_dedent(ctx);
-        omni_codegen_emit(ctx, "}\n\n");
+/* Head of a code-building form, unless the program defines its own */
+static const char* code_form_name(CodeGenContext* ctx, OmniValue* v) {
+    OmniValue* head = omni_car(v);
+    if (!omni_is_cell(v) || !omni_is_sym(head) || lookup_symbol(ctx, head->str_val)) return NULL;
+    for (int i = 0; g_code_forms[i]; i++) {
+        if (strcmp(head->str_val, g_code_forms[i]) == 0) return g_code_forms[i];
+    }
+    return NULL;
+}
 
-        free(c_name);
+static bool in_stage_scope(const StageScope* scope, OmniValue* sym) {
+    for (; scope; scope = scope->outer) {
+        if (strcmp(scope->name, sym->str_val) == 0) return true;
     }
+    return false;
 }
 
-static void codegen_apply(CodeGenContext* ctx, OmniValue* expr) {
-    OmniValue* func = omni_car(expr);
-    OmniValue* args = omni_cdr(expr);
+static OmniValue* stage_error(CodeGenContext* ctx, OmniValue* form, const char* what,
+                              const char* why) {
+    char* text = omni_value_to_string(form);
+    omni_codegen_error(ctx, "E0003 cannot %s %s: %s", what, text, why);
+    free(text);
+    return NULL;
+}
 
-    /* Check for binary operators */
-    if (omni_is_sym(func)) {
-        const char* name = func->str_val;
-        bool is_binop = (strcmp(name, "+") == 0 || strcmp(name, "-") == 0 ||
-                         strcmp(name, "*") == 0 || strcmp(name, "/") == 0 ||
-                         strcmp(name, "%") == 0 || strcmp(name, "<") == 0 ||
-                         strcmp(name, ">") == 0 || strcmp(name, "<=") == 0 ||
-                         strcmp(name, ">=") == 0 || strcmp(name, "=") == 0);
+/* Small non-negative integer literal used as an unroll count, or -1 */
+static int64_t stage_count(OmniValue* v) {
+    return (omni_is_int(v) && v->int_val >= 0 && v->int_val <= STAGE_MAX_UNROLL) ? v->int_val : -1;
+}
 
-        if (is_binop && !omni_is_nil(args) && !omni_is_nil(omni_cdr(args))) {
-            OmniValue* a = omni_car(args);
-            OmniValue* b = omni_car(omni_cdr(args));
+/*
+ * Build the expression a code value stands for. Code is made by lift or
+ * by naming a bound variable, and combined with code-app, code-let and
+ * code-if (or the staged-* library forms); the result is an ordinary expression, so it is compiled, and
+ * its temporaries owned and freed, like hand-written code. Returns NULL
+ * after reporting an error.
+ */
+static OmniValue* stage_code(CodeGenContext* ctx, OmniValue* v, const StageScope* scope) {
+    OmniArena* arena = ctx->session->arena;
+    /* A bound name is code that reads it where the code ends up */
+    if (omni_is_sym(v) && (in_stage_scope(scope, v) || lookup_symbol(ctx, v->str_val))) return v;
+
+    const char* form = code_form_name(ctx, v);
+    if (!form) {
+        return stage_error(ctx, v, "stage", "not code; build code with lift or code-* forms");
+    }
+    OmniValue* args = omni_cdr(v);
+    size_t argc = omni_list_len(args);
 
-            codegen_sym(ctx, func);
-            omni_codegen_emit_raw(ctx, "(");
-            codegen_expr(ctx, a);
-            omni_codegen_emit_raw(ctx, ", ");
-            codegen_expr(ctx, b);
-            omni_codegen_emit_raw(ctx, ")");
-            return;
+    if (strcmp(form, "lift") == 0) {
+        OmniValue* x = omni_car(args);
+        const char* why = argc == 1 ? unliftable(ctx, x) : "lift takes exactly one value";
+        return why ? stage_error(ctx, v, "lift", why) : x;
+    }
+
+    if (strcmp(form, "code-app") == 0) {
+        if (argc < 1) return stage_error(ctx, v, "stage", "code-app needs a function");
+        OmniValue** items = malloc(argc * sizeof(OmniValue*));
+        size_t i = 0;
+        for (OmniValue* p = args; omni_is_cell(p); p = omni_cdr(p), i++) {
+            items[i] = stage_code(ctx, omni_car(p), scope);
+            if (!items[i]) {
+                free(items);
+                return NULL;
+            }
         }
+        OmniValue* app = omni_array_to_list(arena, items, argc);
+        free(items);
+        return app;
+    }
 
-        /* Check for display/print */
-        if (strcmp(name, "display") == 0 || strcmp(name, "print") == 0) {
-            omni_codegen_emit_raw(ctx, "(omni_print(");
-            if (!omni_is_nil(args)) codegen_expr(ctx, omni_car(args));
-            else omni_codegen_emit_raw(ctx, "NIL");
-            omni_codegen_emit_raw(ctx, "), NIL)");
-            return;
+    if (strcmp(form, "code-let") == 0) {
+        OmniValue* name = omni_car(args);
+        if (argc != 3 || !omni_is_sym(name)) {
+            return stage_error(ctx, v, "stage", "expected (code-let name val body)");
         }
+        OmniValue* val = stage_code(ctx, omni_car(omni_cdr(args)), scope);
+        StageScope inner = { name->str_val, scope };
+        OmniValue* body = val ? stage_code(ctx, omni_car(omni_cdr(omni_cdr(args))), &inner) : NULL;
+        if (!body) return NULL;
+        return omni_list3(arena, omni_new_sym(arena, "let"), omni_list1(arena, omni_list2(arena, name, val)), body);
+    }
 
-        if (strcmp(name, "newline") == 0) {
-            omni_codegen_emit_raw(ctx, "(printf(\"\\n\"), NIL)");
-            return;
+    if (strcmp(form, "code-if") == 0) {
+        if (argc != 3) return stage_error(ctx, v, "stage", "expected (code-if c then else)");
+        OmniValue* c = stage_code(ctx, omni_car(args), scope);
+        OmniValue* t = c ? stage_code(ctx, omni_car(omni_cdr(args)), scope) : NULL;
+        OmniValue* e = t ? stage_code(ctx, omni_car(omni_cdr(omni_cdr(args))), scope) : NULL;
+        return e ? omni_list_of(arena, 4, omni_new_sym(arena, "if"), c, t, e) : NULL;
+    }
+
+    /* Staged library: counts are compile-time literals, operands are code */
+    int64_t n = stage_count(omni_car(args));
+    if (argc != 2 || n < 0) {
+        char why[96];
+        snprintf(why, sizeof(why), "expected (%s n code) with n a literal from 0 to %d",
+                 form, STAGE_MAX_UNROLL);
+        return stage_error(ctx, v, "stage", why);
+    }
+    OmniValue* operand = stage_code(ctx, omni_car(omni_cdr(args)), scope);
+    if (!operand) return NULL;
+
+    if (strcmp(form, "staged-power") == 0) {
+        /* x^n as n multiplications of one evaluation of x */
+        if (n == 0) return omni_new_int(arena, 1);
+        char tmp[32];
+        snprintf(tmp, sizeof(tmp), "stage-%d", ctx->temp_counter++);
+        OmniValue* x = omni_new_sym(arena, tmp);
+        OmniValue* product = x;
+        for (int64_t i = 1; i < n; i++) {
+            product = omni_list3(arena, omni_new_sym(arena, "*"), x, product);
         }
+        return omni_list3(arena, omni_new_sym(arena, "let"), omni_list1(arena, omni_list2(arena, x, operand)), product);
     }
 
-    /* Regular function call */
-    codegen_expr(ctx, func);
-    omni_codegen_emit_raw(ctx, "(");
-    bool first = true;
-    while (!omni_is_nil(args) && omni_is_cell(args)) {
-        if (!first) omni_codegen_emit_raw(ctx, ", ");
-        first = false;
-        codegen_expr(ctx, omni_car(args));
-        args = omni_cdr(args);
+    /* staged-unroll: (f 0) ... (f n-1) in sequence */
+    if (n == 0) return omni_list2(arena, omni_new_sym(arena, "quote"), omni_nil);
+    OmniValue* calls = omni_nil;
+    for (int64_t i = n; i-- > 0;) {
+        calls = omni_new_cell(arena, omni_list2(arena, operand, omni_new_int(arena, i)), calls);
     }
-    omni_codegen_emit_raw(ctx, ")");
+    return omni_new_cell(arena, omni_new_sym(arena, "do"), calls);
+}
+
+/* A code-building form in value position evaluates to the value of the
+ * code it builds */
+static void codegen_code(CodeGenContext* ctx, OmniValue* expr) {
+    OmniValue* code = stage_code(ctx, expr, NULL);
+    if (code) {
+        codegen_expr(ctx, code);
+    } else {
+        omni_codegen_emit_raw(ctx, "NIL");
+    }
+}
+
+/* (run code) runs code built at compile time, i.e. yields its value */
+static void codegen_run(CodeGenContext* ctx, OmniValue* expr) {
+    OmniValue* code = omni_car(omni_cdr(expr));
+    if (omni_list_len(omni_cdr(expr)) == 1 && code_form_name(ctx, code)) {
+        codegen_code(ctx, code);
+        return;
+    }
+    stage_error(ctx, expr, "run", "run expects code built with lift or code-* forms");
+    omni_codegen_emit_raw(ctx, "NIL");
 }
 
 static void codegen_list(CodeGenContext* ctx, OmniValue* expr) {
@@ -1162,20 +8489,44 @@ static void codegen_list(CodeGenContext* ctx, OmniValue* expr) {
 
     OmniValue* head = omni_car(expr);
 
-    /* Check for special forms */
-    if (omni_is_sym(head)) {
+    /* Check for special forms; a local binding of the same name wins */
+    if (omni_is_sym(head) && !lookup_symbol(ctx, head->str_val)) {
         const char* name = head->str_val;
 
         if (strcmp(name, "quote") == 0) {
             codegen_quote(ctx, expr);
             return;
         }
+        if (strcmp(name, "quasiquote") == 0) {
+            codegen_quasiquote(ctx, expr);
+            return;
+        }
+        if (strcmp(name, "unquote") == 0 || strcmp(name, "unquote-splicing") == 0) {
+            char* text = omni_value_to_string(expr);
+            omni_codegen_error(ctx, "E0002 %s: %s is only valid inside quasiquote", text, name);
+            free(text);
+            omni_codegen_emit_raw(ctx, "NIL");
+            return;
+        }
         if (strcmp(name, "if") == 0) {
             codegen_if(ctx, expr);
             return;
         }
-        if (strcmp(name, "let") == 0 || strcmp(name, "let*") == 0) {
-            codegen_let(ctx, expr);
+        if (strcmp(name, "cond") == 0) {
+            codegen_cond(ctx, expr);
+            return;
+        }
+        if (strcmp(name, "case") == 0) {
+            codegen_case(ctx, expr);
+            return;
+        }
+        if (strcmp(name, "let") == 0 || strcmp(name, "let*") == 0 ||
+            strcmp(name, "letrec") == 0 || strcmp(name, "letrec*") == 0) {
+            codegen_flat(ctx, expr);
+            return;
+        }
+        if (strcmp(name, "and") == 0 || strcmp(name, "or") == 0) {
+            codegen_and_or(ctx, expr, name[0] == 'a');
             return;
         }
         if (strcmp(name, "lambda") == 0 || strcmp(name, "fn") == 0) {
@@ -1183,23 +8534,82 @@ static void codegen_list(CodeGenContext* ctx, OmniValue* expr) {
             return;
         }
         if (strcmp(name, "define") == 0) {
-            codegen_define(ctx, expr);
+            /* Bodies and the top level handle their own defines */
+            char* text = omni_value_to_string(expr);
+            omni_codegen_error(ctx, "E0002 %s: define is only allowed at top level or among "
+                               "the forms of a let, lambda, function or do body", text);
+            free(text);
+            omni_codegen_emit_raw(ctx, "NIL");
+            return;
+        }
+        if (strcmp(name, "set!") == 0) {
+            codegen_set(ctx, expr);
+            return;
+        }
+        if (strcmp(name, "debug-history") == 0) {
+            codegen_debug_history(ctx, expr);
+            return;
+        }
+        if (strcmp(name, "memory-stats") == 0 || strcmp(name, "set-allocator!") == 0) {
+            codegen_allocator_form(ctx, expr, name);
+            return;
+        }
+        if (strcmp(name, "with-budget") == 0) {
+            codegen_with_budget(ctx, expr);
+            return;
+        }
+        if (strcmp(name, "catch-oom") == 0) {
+            codegen_catch_oom(ctx, expr);
+            return;
+        }
+        if (strcmp(name, "nursery") == 0) {
+            codegen_nursery(ctx, expr);
+            return;
+        }
+        if (strcmp(name, "spawn") == 0) {
+            codegen_spawn(ctx, expr);
+            return;
+        }
+        if (strcmp(name, "with-cancel") == 0) {
+            codegen_with_cancel(ctx, expr);
+            return;
+        }
+        if (strcmp(name, "with-output-to-port") == 0) {
+            codegen_with_output(ctx, expr);
+            return;
+        }
+        if (strcmp(name, "future") == 0) {
+            codegen_future(ctx, expr);
+            return;
+        }
+        if (strcmp(name, "go") == 0) {
+            codegen_go(ctx, expr);
+            return;
+        }
+        if (strcmp(name, "wait-group") == 0) {
+            codegen_wait_group(ctx, expr);
+            return;
+        }
+        if (strcmp(name, "import") == 0 || strcmp(name, "provide") == 0) {
+            /* The compiler takes them out of the top level of each file */
+            char* text = omni_value_to_string(expr);
+            omni_codegen_error(ctx, "E0009 %s: %s is only allowed at the top level of a file",
+                               text, name);
+            free(text);
+            omni_codegen_emit_raw(ctx, "NIL");
+            return;
+        }
+        /* Staging forms, unless the program defines its own */
+        if (code_form_name(ctx, expr)) {
+            codegen_code(ctx, expr);
+            return;
+        }
+        if (strcmp(name, "run") == 0) {
+            codegen_run(ctx, expr);
             return;
         }
         if (strcmp(name, "do") == 0 || strcmp(name, "begin") == 0) {
-            OmniValue* body = omni_cdr(expr);
-            omni_codegen_emit_raw(ctx, "({\n");
-            omni_codegen_indent(ctx);
-            OmniValue* result = NULL;
-            while (!omni_is_nil(body) && omni_is_cell(body)) {
-                result = omni_car(body);
-                body = omni_cdr(body);
-                omni_codegen_emit(ctx, "");
-                codegen_expr(ctx, result);
-                omni_codegen_emit_raw(ctx, ";\n");
-            }
-            omni_codegen_dedent(ctx);
-            omni_codegen_emit(ctx, "})");
+            codegen_flat(ctx, expr);
             return;
         }
     }
@@ -1208,7 +8618,54 @@ static void codegen_list(CodeGenContext* ctx, OmniValue* expr) {
     codegen_apply(ctx, expr);
 }
 
+static void codegen_node(CodeGenContext* ctx, OmniValue* expr);
+
+/* Forms and primitives that run on threads or wait for time to pass */
+static const char* g_thread_names[] = {
+    "nursery", "spawn", "with-cancel", "future", "go", "wait-group", "await", "promise-done?", "all-of",
+    "make-pool", "pool-submit", "make-cancel", "cancel!", "cancelled?", "sleep-ms", "yield", "monotonic-millis",
+};
+
+/* Primitives that read the console or open files and sockets */
+static const char* g_os_names[] = {
+    "current-input-port", "open-input-file", "open-output-file", "tcp-connect", "read-line", "read-char",
+};
+
+/* A call or use of one of names the program does not rebind */
+static const char* named_in(CodeGenContext* ctx, OmniValue* expr, const char* const* names, size_t count) {
+    OmniValue* name = omni_is_cell(expr) ? omni_car(expr) : expr;
+    if (!omni_is_sym(name) || lookup_symbol(ctx, name->str_val)) return NULL;
+    for (size_t i = 0; i < count; i++) {
+        if (strcmp(name->str_val, names[i]) == 0) return names[i];
+    }
+    return NULL;
+}
+
+/* One of g_thread_names, which freestanding code cannot run */
+static const char* thread_name(CodeGenContext* ctx, OmniValue* expr) {
+    return named_in(ctx, expr, g_thread_names, sizeof(g_thread_names) / sizeof(g_thread_names[0]));
+}
+
+/* Generate expr; errors raised meanwhile point at it if it was parsed */
 static void codegen_expr(CodeGenContext* ctx, OmniValue* expr) {
+    OmniValue* outer = ctx->located;
+    if (expr && expr->line) ctx->located = expr;
+    const char* threads = ctx->freestanding ? thread_name(ctx, expr) : NULL;
+    const char* os = ctx->freestanding && !threads ?
+        named_in(ctx, expr, g_os_names, sizeof(g_os_names) / sizeof(g_os_names[0])) : NULL;
+    if (threads || os) {
+        char* text = omni_value_to_string(expr);
+        omni_codegen_error(ctx, "E0004 %s: %s needs %s, which -freestanding code does not have",
+                           text, threads ? threads : os, threads ? "threads" : "files and sockets");
+        free(text);
+        omni_codegen_emit_raw(ctx, "NIL");
+    } else {
+        codegen_node(ctx, expr);
+    }
+    ctx->located = outer;
+}
+
+static void codegen_node(CodeGenContext* ctx, OmniValue* expr) {
     if (!expr || omni_is_nil(expr)) {
         omni_codegen_emit_raw(ctx, "NIL");
         return;
@@ -1221,15 +8678,28 @@ static void codegen_expr(CodeGenContext* ctx, OmniValue* expr) {
     case OMNI_FLOAT:
         codegen_float(ctx, expr);
         break;
+    case OMNI_CHAR:
+        codegen_char(ctx, expr);
+        break;
+    case OMNI_STRING:
+        codegen_string(ctx, expr);
+        break;
+    case OMNI_KEYWORD:
+        codegen_keyword(ctx, expr);
+        break;
     case OMNI_SYM:
-        codegen_sym(ctx, expr);
+        /* Functions used as values become closure objects */
+        codegen_function_value(ctx, expr);
+        break;
+    case OMNI_ERROR:
+        codegen_error(ctx, expr);
         break;
     case OMNI_CELL:
         codegen_list(ctx, expr);
         break;
     case OMNI_ARRAY:
-        /* TODO: Array literals */
-        omni_codegen_emit_raw(ctx, "NIL");
+        /* [a b ...] is (vector a b ...) */
+        codegen_call(ctx, "prim_vector_of", NULL, expr->array.data, expr->array.len, 0, true);
         break;
     default:
         omni_codegen_emit_raw(ctx, "NIL");
@@ -1243,47 +8713,408 @@ void omni_codegen_expr(CodeGenContext* ctx, OmniValue* expr) {
     codegen_expr(ctx, expr);
 }
 
-void omni_codegen_main(CodeGenContext* ctx, OmniValue** exprs, size_t count) {
-    omni_codegen_emit(ctx, "int main(void) {\n");
+/* Name defined by a top-level (define name init), else NULL */
+static const char* top_level_variable(OmniValue* expr) {
+    if (!omni_is_cell(expr) || !omni_sym_eq_str(omni_car(expr), "define")) return NULL;
+    OmniValue* target = omni_car(omni_cdr(expr));
+    return omni_is_sym(target) ? target->str_val : NULL;
+}
+
+/* Name defined by a top-level (define (name params...) body...), else NULL */
+static const char* top_level_function(OmniValue* expr) {
+    if (!omni_is_cell(expr) || !omni_sym_eq_str(omni_car(expr), "define")) return NULL;
+    OmniValue* sig = omni_car(omni_cdr(expr));
+    return omni_is_cell(sig) && omni_is_sym(omni_car(sig)) ? omni_car(sig)->str_val : NULL;
+}
+
+/* Module top-level form i came from, 0 for the program's own */
+static int form_module(CodeGenContext* ctx, size_t i) {
+    return ctx->form_modules ? ctx->form_modules[i] : 0;
+}
+
+/* Whether expr is a (deftype T field...) form */
+static bool is_deftype(OmniValue* expr) {
+    return omni_is_cell(expr) && omni_is_sym(omni_car(expr)) &&
+           strcmp(omni_car(expr)->str_val, "deftype") == 0 &&
+           omni_is_cell(omni_cdr(expr)) && omni_is_sym(omni_car(omni_cdr(expr)));
+}
+
+/* Emit top-level form i; echo prints the value of an expression */
+static void codegen_top_level(CodeGenContext* ctx, OmniValue** exprs, size_t i,
+                              bool has_globals, bool echo) {
+    OmniValue* expr = exprs[i];
+    ctx->form = i + 1;
+    ctx->located = expr->line ? expr : NULL;
+    ctx->module = form_module(ctx, i);
+    reset_locals(ctx);
+
+    /* A deftype is its descriptor and the defines that follow it */
+    if (is_deftype(expr)) return;
+
+    /* Top-level variable: set its global */
+    const char* var = top_level_variable(expr);
+    if (var) {
+        OmniValue* init = omni_cdr(omni_cdr(expr));
+        const char* c_name = lookup_symbol(ctx, var);
+        omni_codegen_emit(ctx, "%s = ", c_name);
+        if (omni_is_nil(init)) omni_codegen_emit_raw(ctx, "NIL");
+        else codegen_expr(ctx, omni_car(init));
+        omni_codegen_emit_raw(ctx, ";\n");
+        emit_constraint_alloc(ctx, "define", var, c_name);
+        omni_codegen_emit(ctx, "_ver_%s++;\n", c_name);
+        return;
+    }
+
+    /* Check if it's a define - emit at top level */
+    if (omni_is_cell(expr) && omni_is_sym(omni_car(expr)) &&
+        strcmp(omni_car(expr)->str_val, "define") == 0) {
+        /* Already emitted as top-level function */
+        return;
+    }
+
+    /* Regular expression - emit in main */
+    omni_codegen_emit(ctx, "{\n");
     omni_codegen_indent(ctx);
+    omni_codegen_emit(ctx, "Obj* _result = ");
+    codegen_expr(ctx, expr);
+    omni_codegen_emit_raw(ctx, ";\n");
+    if (!echo) {
+        /* Run for its effects */
+    } else if (ctx->mark_results) {
+        omni_codegen_emit(ctx, "putchar(%d);\n", OMNI_RESULT_BEGIN);
+        omni_codegen_emit(ctx, "omni_write(_result);\n");
+        omni_codegen_emit(ctx, "putchar(%d);\n", OMNI_RESULT_END);
+    } else if (!ctx->script_mode) {
+        omni_codegen_emit(ctx, "omni_print(_result);\n");
+        omni_codegen_emit(ctx, "printf(\"\\n\");\n");
+    }
+    if (ctx->form == ctx->status_form) {
+        omni_codegen_emit(ctx, "omni_status = omni_exit_status(_result);\n");
+    }
+    if (!has_globals) {
+        omni_codegen_emit(ctx, ctx->strategies ? "strategy_release(_result);\n"
+                                               : "free_obj(_result);\n");
+    }
+    omni_codegen_dedent(ctx);
+    omni_codegen_emit(ctx, "}\n");
+}
 
-    for (size_t i = 0; i < count; i++) {
-        OmniValue* expr = exprs[i];
+/* Top-level forms main runs itself; a longer program runs them from
+ * functions of this many forms each, as gcc is slow to optimise one huge
+ * function */
+#define MAIN_MAX_FORMS 64
+
+/* Emit the forms from up to to, in main or one of its chunks */
+static void codegen_run_forms(CodeGenContext* ctx, OmniValue** exprs, size_t from, size_t to,
+                              bool has_globals) {
+    for (size_t i = from; i < to; i++) {
+        int module = form_module(ctx, i);
+        if (!module) {
+            codegen_top_level(ctx, exprs, i, has_globals, true);
+        } else if (i == ctx->prior_forms || form_module(ctx, i - 1) != module) {
+            /* Once, where the module's forms start */
+            omni_codegen_emit(ctx, "_module_%d();\n", module);
+        }
+    }
+}
 
-        /* Check if it's a define - emit at top level */
-        if (omni_is_cell(expr) && omni_is_sym(omni_car(expr)) &&
-            strcmp(omni_car(expr)->str_val, "define") == 0) {
-            /* Already emitted as top-level function */
+/* Index of the program's own (define (main ...) ...), or count if none */
+static size_t entry_form(CodeGenContext* ctx, OmniValue** exprs, size_t count) {
+    for (size_t i = ctx->prior_forms; i < count; i++) {
+        const char* name = top_level_function(exprs[i]);
+        if (!form_module(ctx, i) && name && strcmp(name, "main") == 0) return i;
+    }
+    return count;
+}
+
+void omni_codegen_main(CodeGenContext* ctx, OmniValue** exprs, size_t count) {
+    /* Any result may share structure with a global, which lives until exit */
+    bool has_globals = false;
+    for (size_t i = 0; i < count && !has_globals; i++) {
+        has_globals = top_level_variable(exprs[i]) != NULL;
+    }
+
+    /* A program defining main runs it after its top-level forms, which
+     * are not echoed, and exits with its value; with -script, the last
+     * top-level expression's value is the exit status. Not for framed
+     * results, which the REPL reads. */
+    size_t entry = ctx->mark_results ? count : entry_form(ctx, exprs, count);
+    bool entry_args = false;
+    if (entry < count) {
+        OmniValue* params = omni_cdr(omni_car(omni_cdr(exprs[entry])));
+        entry_args = omni_is_cell(params);
+        if (entry_args && (!omni_is_sym(omni_car(params)) || !omni_is_nil(omni_cdr(params)))) {
+            ctx->form = entry + 1;
+            ctx->located = exprs[entry]->line ? exprs[entry] : NULL;
+            omni_codegen_error(ctx, "E0002 main takes no parameters, or one for the list of "
+                                    "command-line arguments");
+        }
+        ctx->script_mode = true;
+    } else if (ctx->script_exit && !ctx->mark_results) {
+        for (size_t i = ctx->prior_forms; i < count; i++) {
+            OmniValue* expr = exprs[i];
+            if (form_module(ctx, i) || is_deftype(expr) ||
+                (omni_is_cell(expr) && omni_sym_eq_str(omni_car(expr), "define"))) {
+                continue;
+            }
+            ctx->status_form = i + 1;
+        }
+    }
+    bool has_status = entry < count || ctx->script_exit;
+
+    /* Each imported module's forms run, without echoing, in a function of
+     * its own, called where they come in the program */
+    for (size_t i = ctx->prior_forms; i < count;) {
+        int module = form_module(ctx, i);
+        if (!module) {
+            i++;
             continue;
         }
+        omni_codegen_emit(ctx, "/* %s */\n", ctx->module_names[module]);
+        omni_codegen_emit(ctx, "static void _module_%d(void) {\n", module);
+        omni_codegen_indent(ctx);
+        for (; i < count && form_module(ctx, i) == module; i++) {
+            codegen_top_level(ctx, exprs, i, has_globals, false);
+        }
+        omni_codegen_dedent(ctx);
+        omni_codegen_emit(ctx, "}\n\n");
+    }
+
+    if (has_status) omni_codegen_emit(ctx, "static int omni_status = 0;\n\n");
+
+    size_t chunks = 0;
+    if (count - ctx->prior_forms > MAIN_MAX_FORMS) {
+        for (size_t i = ctx->prior_forms; i < count; i += MAIN_MAX_FORMS) {
+            size_t end = count - i > MAIN_MAX_FORMS ? i + MAIN_MAX_FORMS : count;
+            omni_codegen_emit(ctx, "static void _chunk_%zu(void) {\n", chunks++);
+            omni_codegen_indent(ctx);
+            codegen_run_forms(ctx, exprs, i, end, has_globals);
+            omni_codegen_dedent(ctx);
+            omni_codegen_emit(ctx, "}\n\n");
+        }
+    }
+
+    /* Freestanding code is started by the program it is linked into */
+    if (ctx->freestanding) {
+        omni_codegen_emit(ctx, "int purple_main(void) {\n");
+        omni_codegen_indent(ctx);
+    } else if (ctx->provenance) {
+        /* The record stays in the binary as one string, for omni_binary_provenance */
+        omni_codegen_emit(ctx, "static const char omni_provenance[] = \"");
+        for (const char* c = ctx->provenance; *c; c++) {
+            if (*c == '\n') omni_codegen_emit_raw(ctx, "\\n");
+            else if (*c == '"' || *c == '\\') omni_codegen_emit_raw(ctx, "\\%c", *c);
+            else if ((unsigned char)*c < 0x20 || (unsigned char)*c >= 0x7f) omni_codegen_emit_raw(ctx, "\\%03o", (unsigned char)*c);
+            else omni_codegen_emit_raw(ctx, "%c", *c);
+        }
+        omni_codegen_emit_raw(ctx, "\";\n\n");
+        omni_codegen_emit(ctx, "int main(int argc, char** argv) {\n");
+        omni_codegen_indent(ctx);
+        omni_codegen_emit(ctx, "if (argc == 2 && strcmp(argv[1], \"--purple-info\") == 0) {\n");
+        omni_codegen_emit(ctx, "    fputs(omni_provenance, stdout);\n");
+        omni_codegen_emit(ctx, "    return 0;\n");
+        omni_codegen_emit(ctx, "}\n");
+    } else if (entry_args) {
+        omni_codegen_emit(ctx, "int main(int argc, char** argv) {\n");
+        omni_codegen_indent(ctx);
+    } else {
+        omni_codegen_emit(ctx, "int main(void) {\n");
+        omni_codegen_indent(ctx);
+    }
+    if (!ctx->freestanding) omni_codegen_emit(ctx, "purple_load_config();\n");
+    if (ctx->crash_handler) omni_codegen_emit(ctx, "purple_install_crash_handler();\n");
+    if (ctx->checked) omni_codegen_emit(ctx, "set_checked_lists(1);\n");
+    if (ctx->constraint_check) omni_codegen_emit(ctx, "omni_cc_enable();\n");
+    if (ctx->record_steps > 0) omni_codegen_emit(ctx, "omni_step_enable();\n");
+    if (ctx->strategies) omni_codegen_emit(ctx, "set_memory_strategies(0x%02x);\n", ctx->strategies);
+
+    /* An incremental object points the shared function pointers at its
+     * own functions, which may replace ones loaded before */
+    for (size_t i = ctx->prior_forms; ctx->incremental && i < count; i++) {
+        const char* name = top_level_function(exprs[i]);
+        if (!name) continue;
+        char* c_name = top_level_c_name(form_module(ctx, i), name);
+        omni_codegen_emit(ctx, "%s = _hot_%s;\n", c_name, c_name);
+        free(c_name);
+    }
 
-        /* Regular expression - emit in main */
+    if (chunks == 0) codegen_run_forms(ctx, exprs, ctx->prior_forms, count, has_globals);
+    for (size_t i = 0; i < chunks; i++) omni_codegen_emit(ctx, "_chunk_%zu();\n", i);
+
+    /* main's argument is the arguments after the program's name, as
+     * strings; a freestanding program has none */
+    if (entry < count) {
         omni_codegen_emit(ctx, "{\n");
         omni_codegen_indent(ctx);
-        omni_codegen_emit(ctx, "Obj* _result = ");
-        codegen_expr(ctx, expr);
-        omni_codegen_emit_raw(ctx, ";\n");
-        omni_codegen_emit(ctx, "omni_print(_result);\n");
-        omni_codegen_emit(ctx, "printf(\"\\n\");\n");
-        omni_codegen_emit(ctx, "free_obj(_result);\n");
+        if (entry_args) {
+            omni_codegen_emit(ctx, "Obj* _args = NIL;\n");
+            if (!ctx->freestanding) {
+                omni_codegen_emit(ctx, "for (int i = argc - 1; i > 0; i--) _args = mk_cell(mk_string(argv[i]), _args);\n");
+            }
+        }
+        ctx->module = 0;
+        omni_codegen_emit(ctx, "Obj* _result = %s(%s);\n", lookup_symbol(ctx, "main"),
+                          entry_args ? "_args" : "");
+        omni_codegen_emit(ctx, "omni_status = omni_exit_status(_result);\n");
         omni_codegen_dedent(ctx);
         omni_codegen_emit(ctx, "}\n");
     }
 
-    omni_codegen_emit(ctx, "return 0;\n");
+    omni_codegen_emit(ctx, "fflush(stdout);\n");
+    omni_codegen_emit(ctx, "return %s;\n", has_status ? "omni_status" : "0");
     omni_codegen_dedent(ctx);
     omni_codegen_emit(ctx, "}\n");
 }
 
+/* Whether a form of module loaded before this incremental object
+ * defines the top-level variable name */
+static bool defined_before(CodeGenContext* ctx, OmniValue** exprs, int module, const char* name) {
+    for (size_t i = 0; i < ctx->prior_forms; i++) {
+        const char* var = top_level_variable(exprs[i]);
+        if (var && form_module(ctx, i) == module && strcmp(var, name) == 0) return true;
+    }
+    return false;
+}
+
+/* Whether the module whose forms are being generated has a top-level
+ * definition of name already; one it imports may be redefined */
+static bool defined_here(CodeGenContext* ctx, const char* name) {
+    long i = find_symbol(ctx, name);
+    return i >= 0 && ctx->symbols.module[i] == ctx->module;
+}
+
+/* The descriptor _type_T of a type with the field specs fields; a
+ * variant also names its sum type and its place among the variants */
+static void codegen_type_descriptor(CodeGenContext* ctx, const char* name, OmniValue* fields,
+                                    const char* sum, int tag) {
+    char* c_name = omni_codegen_mangle(name);
+    CodeGenContext* tmp = omni_codegen_new_buffer(ctx->session);
+    omni_codegen_emit_raw(tmp, "static const char* const _fields_%s[] = {", c_name);
+    int n = 0;
+    uint64_t weak = 0;
+    for (OmniValue* f = fields; omni_is_cell(f); f = omni_cdr(f), n++) {
+        OmniValue* field = omni_is_cell(omni_car(f)) ? omni_car(omni_car(f)) : omni_car(f);
+        omni_codegen_emit_raw(tmp, n ? ", \"%s\"" : "\"%s\"", field->str_val);
+        if (omni_is_back_edge_field(ctx->analysis, name, field->str_val)) weak |= 1ull << n;
+    }
+    omni_codegen_emit_raw(tmp, n ? "};\n" : "NULL};\n");
+    omni_codegen_emit_raw(tmp, "static const UserType _type_%s = { \"%s\", %d, _fields_%s, 0x%llxULL",
+                          c_name, name, n, c_name, (unsigned long long)weak);
+    if (sum) omni_codegen_emit_raw(tmp, ", \"%s\", %d };", sum, tag);
+    else omni_codegen_emit_raw(tmp, ", NULL, 0 };");
+    char* decl = omni_codegen_get_output(tmp);
+    omni_codegen_add_forward_decl(ctx, decl);
+    free(decl);
+    omni_codegen_free(tmp);
+    free(c_name);
+}
+
+/* Whether an earlier deftype than exprs[i] defines a type named name */
+static bool type_defined_before(OmniValue** exprs, size_t i, const char* name) {
+    for (size_t j = 0; j < i; j++) {
+        if (!is_deftype(exprs[j])) continue;
+        if (strcmp(omni_car(omni_cdr(exprs[j]))->str_val, name) == 0) return true;
+        for (OmniValue* s = omni_cdr(omni_cdr(exprs[j])); omni_is_cell(s); s = omni_cdr(s)) {
+            if (omni_is_variant_spec(omni_car(s)) && strcmp(omni_car(omni_car(s))->str_val, name) == 0) {
+                return true;
+            }
+        }
+    }
+    return false;
+}
+
+/* A UserType descriptor _type_T for each deftype: its name, its field
+ * names, and a bit for each field the shape analysis holds weak. A sum
+ * type has one for each variant, and one of its own with no fields. */
+static void codegen_type_descriptors(CodeGenContext* ctx, OmniValue** exprs, size_t count) {
+    for (size_t i = 0; i < count; i++) {
+        if (!is_deftype(exprs[i])) continue;
+        const char* name = omni_car(omni_cdr(exprs[i]))->str_val;
+        OmniValue* specs = omni_cdr(omni_cdr(exprs[i]));
+        bool sum = omni_is_cell(specs) && omni_is_variant_spec(omni_car(specs));
+        if (!type_defined_before(exprs, i, name)) {
+            codegen_type_descriptor(ctx, name, sum ? omni_nil : specs, NULL, 0);
+        }
+        if (!sum) continue;
+        int tag = 0;
+        for (; omni_is_cell(specs); specs = omni_cdr(specs), tag++) {
+            const char* variant = omni_car(omni_car(specs))->str_val;
+            if (type_defined_before(exprs, i, variant)) continue;
+            codegen_type_descriptor(ctx, variant, omni_cdr(omni_car(specs)), name, tag);
+        }
+    }
+}
+
 void omni_codegen_program(CodeGenContext* ctx, OmniValue** exprs, size_t count) {
-    /* Initialize analysis */
-    ctx->analysis = omni_analysis_new();
-    omni_analyze_program(ctx->analysis, exprs, count);
+    /* Initialize analysis unless the caller already ran it */
+    if (!ctx->analysis) {
+        ctx->analysis = omni_analysis_new();
+        omni_analyze_program(ctx->analysis, exprs, count);
+    }
 
     /* Emit runtime header */
-    omni_codegen_runtime_header(ctx);
+    if (!ctx->check_only) omni_codegen_runtime_header(ctx);
+
+    codegen_type_descriptors(ctx, exprs, count);
+
+    /* First pass: collect defines and compile them as top-level functions.
+     * They are buffered so that prototypes and the lambdas their bodies
+     * use can be emitted ahead of them. */
+    CodeGenContext* defs_ctx = omni_codegen_new_buffer(ctx->session);
+    defs_ctx->analysis = ctx->analysis;
+    defs_ctx->lambda_counter = ctx->lambda_counter;
+    defs_ctx->record_steps = ctx->record_steps;
+    defs_ctx->crash_handler = ctx->crash_handler;
+    defs_ctx->hot_reload = ctx->hot_reload;
+    defs_ctx->hot_patch = ctx->hot_patch;
+    defs_ctx->incremental = ctx->incremental;
+    defs_ctx->shadowing = ctx->shadowing;
+    defs_ctx->constraint_check = ctx->constraint_check;
+    defs_ctx->memory = ctx->memory;
+    defs_ctx->coop_cancel = ctx->coop_cancel;
+    defs_ctx->freestanding = ctx->freestanding;
+    defs_ctx->oom_policy = ctx->oom_policy;
+    defs_ctx->use_runtime = ctx->use_runtime;
+    defs_ctx->runtime_path = ctx->runtime_path;
+    defs_ctx->boxed_names = ctx->boxed_names = boxed_names(ctx->session->arena, exprs, count);
+
+    /* Top-level variables are globals, set in order by main(); declaring
+     * them first lets function bodies refer to them. Each has a version
+     * stamp, bumped whenever a define sets it, for inline call caches. */
+    defs_ctx->module_names = ctx->module_names;
+    defs_ctx->provides = ctx->provides;
+    defs_ctx->imports = ctx->imports;
+    for (size_t i = 0; i < count; i++) {
+        const char* name = top_level_variable(exprs[i]);
+        defs_ctx->module = form_module(ctx, i);
+        if (!name || defined_here(defs_ctx, name)) continue;
+        check_shadowing(defs_ctx, name, "definition of");
+        char* c_name = top_level_c_name(defs_ctx->module, name);
+        char decl[256];
+        /* Shared with patches under hot reload */
+        const char* linkage = ctx->hot_patch || defined_before(ctx, exprs, defs_ctx->module, name) ? "extern "
+                            : ctx->hot_reload ? "" : "static ";
+        snprintf(decl, sizeof(decl), "%sObj* %s;", linkage, c_name);
+        omni_codegen_add_forward_decl(defs_ctx, decl);
+        snprintf(decl, sizeof(decl), "%sunsigned _ver_%s;", linkage, c_name);
+        omni_codegen_add_forward_decl(defs_ctx, decl);
+        register_global(defs_ctx, name, c_name);
+        defs_ctx->symbols.module[defs_ctx->symbols.count - 1] = defs_ctx->module;
+        free(c_name);
+    }
+
+    /* Functions too, so bodies can call ones defined further down */
+    for (size_t i = 0; i < count; i++) {
+        const char* name = top_level_function(exprs[i]);
+        defs_ctx->module = form_module(ctx, i);
+        if (!name || defined_here(defs_ctx, name)) continue;
+        char* c_name = top_level_c_name(defs_ctx->module, name);
+        OmniValue* sig = omni_car(omni_cdr(exprs[i]));
+        register_function(defs_ctx, name, c_name, (int)omni_list_len(omni_cdr(sig)));
+        defs_ctx->symbols.module[defs_ctx->symbols.count - 1] = defs_ctx->module;
+        free(c_name);
+    }
 
-    /* First pass: collect defines and emit as top-level functions */
     for (size_t i = 0; i < count; i++) {
         OmniValue* expr = exprs[i];
         if (omni_is_cell(expr) && omni_is_sym(omni_car(expr)) &&
@@ -1293,30 +9124,67 @@ void omni_codegen_program(CodeGenContext* ctx, OmniValue** exprs, size_t count)
 
             /* Only emit function defines at top level */
             if (omni_is_cell(name_or_sig)) {
-                codegen_define(ctx, expr);
+                defs_ctx->form = i + 1;
+                defs_ctx->located = expr->line ? expr : NULL;
+                defs_ctx->module = form_module(ctx, i);
+                defs_ctx->declare_only = i < ctx->prior_forms;
+                codegen_define(defs_ctx, expr);
             }
         }
     }
-
-    /* Generate main() to a buffer first to collect lambdas */
-    CodeGenContext* main_ctx = omni_codegen_new_buffer();
-    main_ctx->analysis = ctx->analysis;
-    main_ctx->lambda_counter = ctx->lambda_counter;
-    /* Copy symbol table */
-    for (size_t i = 0; i < ctx->symbols.count; i++) {
-        register_symbol(main_ctx, ctx->symbols.names[i], ctx->symbols.c_names[i]);
+    char* defs_code = omni_codegen_get_output(defs_ctx);
+    ctx->lambda_counter = defs_ctx->lambda_counter;
+    copy_symbols(ctx, defs_ctx);
+    for (size_t i = 0; i < defs_ctx->forward_decls.count; i++) {
+        omni_codegen_add_forward_decl(ctx, defs_ctx->forward_decls.decls[i]);
     }
-    omni_codegen_main(main_ctx, exprs, count);
-    char* main_code = omni_codegen_get_output(main_ctx);
+    absorb_scratch(ctx, defs_ctx);
+    defs_ctx->analysis = NULL;
+    omni_codegen_free(defs_ctx);
+
+    /* Generate main() to a buffer first to collect lambdas. A patch is
+     * only the replaced function and its installer. */
+    char* main_code = NULL;
+    if (!ctx->hot_patch) {
+        CodeGenContext* main_ctx = omni_codegen_new_buffer(ctx->session);
+        main_ctx->analysis = ctx->analysis;
+        main_ctx->lambda_counter = ctx->lambda_counter;
+        main_ctx->script_mode = ctx->script_mode;
+        main_ctx->script_exit = ctx->script_exit;
+        main_ctx->mark_results = ctx->mark_results;
+        main_ctx->record_steps = ctx->record_steps;
+        main_ctx->crash_handler = ctx->crash_handler;
+        main_ctx->checked = ctx->checked;
+        main_ctx->strategies = ctx->strategies;
+        main_ctx->hot_reload = ctx->hot_reload;
+        main_ctx->incremental = ctx->incremental;
+        main_ctx->prior_forms = ctx->prior_forms;
+        main_ctx->shadowing = ctx->shadowing;
+        main_ctx->constraint_check = ctx->constraint_check;
+        main_ctx->memory = ctx->memory;
+        main_ctx->coop_cancel = ctx->coop_cancel;
+        main_ctx->freestanding = ctx->freestanding;
+        main_ctx->oom_policy = ctx->oom_policy;
+        main_ctx->provenance = ctx->provenance;
+        main_ctx->use_runtime = ctx->use_runtime;
+        main_ctx->runtime_path = ctx->runtime_path;
+        main_ctx->boxed_names = ctx->boxed_names;
+        main_ctx->form_modules = ctx->form_modules;
+        main_ctx->provides = ctx->provides;
+        main_ctx->imports = ctx->imports;
+        main_ctx->module_names = ctx->module_names;
+        /* Copy symbol table */
+        copy_symbols(main_ctx, ctx);
+        omni_codegen_main(main_ctx, exprs, count);
+        main_code = omni_codegen_get_output(main_ctx);
 
-    /* Collect lambdas generated during main */
-    for (size_t i = 0; i < main_ctx->lambda_defs.count; i++) {
-        omni_codegen_add_lambda_def(ctx, main_ctx->lambda_defs.defs[i]);
-    }
+        /* Collect lambdas generated during main */
+        absorb_scratch(ctx, main_ctx);
 
-    /* Don't free analysis from temp context */
-    main_ctx->analysis = NULL;
-    omni_codegen_free(main_ctx);
+        /* Don't free analysis from temp context */
+        main_ctx->analysis = NULL;
+        omni_codegen_free(main_ctx);
+    }
 
     /* Emit forward declarations */
     for (size_t i = 0; i < ctx->forward_decls.count; i++) {
@@ -1331,11 +9199,29 @@ void omni_codegen_program(CodeGenContext* ctx, OmniValue** exprs, size_t count)
         omni_codegen_emit_raw(ctx, "%s\n\n", ctx->lambda_defs.defs[i]);
     }
 
+    /* Emit top-level functions */
+    if (defs_code) {
+        omni_codegen_emit_raw(ctx, "%s", defs_code);
+        free(defs_code);
+    }
+
     /* Emit main function */
     if (main_code) {
         omni_codegen_emit_raw(ctx, "%s", main_code);
         free(main_code);
     }
+
+    /* A trimmed runtime has the sections the code after it uses and the
+     * memory mode keeps */
+    if (ctx->trim_runtime && ctx->output_buffer && !(ctx->use_runtime && ctx->runtime_path)) {
+        char* code = strdup(ctx->output_buffer + ctx->runtime_at);
+        ctx->output_size = ctx->runtime_at;
+        ctx->output_buffer[ctx->output_size] = '\0';
+        omni_codegen_runtime_sections(ctx, omni_runtime_sections_used(code) |
+                                               omni_memory_mode_sections(ctx->memory));
+        buffer_append(ctx, code);
+        free(code);
+    }
 }
 
 /* ============== ASAP Memory Management ============== */
@@ -1350,6 +9236,11 @@ static void emit_ownership_free(CodeGenContext* ctx, const char* var_name, const
 
     FreeStrategy strategy = omni_get_free_strategy(ctx->analysis, var_name);
     const char* strategy_name = omni_free_strategy_name(strategy);
+    if (strategy != FREE_STRATEGY_NONE && shared_rc(ctx, var_name)) {
+        /* Another thread may hold it: neither unique nor ours to walk */
+        omni_codegen_emit(ctx, "atomic_dec_ref(%s); /* shared */\n", c_name);
+        return;
+    }
 
     switch (strategy) {
         case FREE_STRATEGY_NONE:
@@ -1414,6 +9305,11 @@ void omni_codegen_emit_cfg_frees(CodeGenContext* ctx, CFG* cfg, CFGNode* node) {
         if (c_name) {
             FreeStrategy strategy = omni_get_free_strategy(ctx->analysis, to_free[i]);
             const char* strategy_name = omni_free_strategy_name(strategy);
+            if (strategy != FREE_STRATEGY_NONE && shared_rc(ctx, to_free[i])) {
+                omni_codegen_emit(ctx, "atomic_dec_ref(%s); /* CFG node %d: shared */\n",
+                                  c_name, node->id);
+                continue;
+            }
 
             switch (strategy) {
                 case FREE_STRATEGY_NONE:
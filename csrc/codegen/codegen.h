@@ -21,7 +21,49 @@ extern "C" {
 
 /* ============== Code Generator State ============== */
 
+/* Markers framing each echoed top-level result when mark_results is set,
+ * so a driver can tell results apart from program output on stdout.
+ * Framed results are written in reader syntax (as by write). */
+#define OMNI_RESULT_BEGIN '\x1e'
+#define OMNI_RESULT_END   '\x1f'
+
+/* What to do when a binding shadows a primitive or a built-in form */
+typedef enum {
+    OMNI_SHADOW_WARN = 0,     /* Warn; the binding wins in its scope */
+    OMNI_SHADOW_ERROR,        /* Reject the program (-Wstrict) */
+    OMNI_SHADOW_ALLOW         /* Intended; say nothing (-Wno-shadow) */
+} OmniShadowPolicy;
+
+/* What the embedded runtime does when an allocation fails or would go
+ * over the heap limit */
+typedef enum {
+    OMNI_OOM_ABORT = 0,       /* Print a diagnostic and abort */
+    OMNI_OOM_ERROR            /* Unwind to the innermost catch-oom, if any */
+} OmniOomPolicy;
+
+/* Memory strategies compiled code uses (-O). The embedded runtime keeps
+ * the sections the code refers to and those of the mode; the compiler's
+ * own frees and stack allocation are always on. */
+typedef enum {
+    OMNI_MEMORY_DEFAULT = 0,  /* As rc, with only the sections the code refers to */
+    OMNI_MEMORY_ASAP,         /* Frees the compiler places; no reuse of dead pairs */
+    OMNI_MEMORY_RC,           /* Also reuse of dead pairs nothing else counts */
+    OMNI_MEMORY_ARENA,        /* As asap, with the region and tether sections */
+    OMNI_MEMORY_ALL           /* Everything, and every runtime section */
+} OmniMemoryMode;
+
+/* How a letrec's function is called: with the captures array of its
+ * group, whose slots are named by group_slot */
+typedef struct OmniLetrecFn {
+    int group;                /* The letrec's id, or 0 for other symbols */
+    int captures;             /* Slots of the group's captures array */
+    int arity;
+} OmniLetrecFn;
+
 typedef struct CodeGenContext {
+    /* Session being compiled; nodes the generator makes go in its arena */
+    OmniSession* session;
+
     /* Output stream */
     FILE* output;
     char* output_buffer;      /* For in-memory generation */
@@ -41,10 +83,37 @@ typedef struct CodeGenContext {
     struct {
         char** names;
         char** c_names;
+        bool* global;         /* Top-level variable (see register_global) */
+        bool* function;       /* Compiled function (see register_function) */
+        int* params;          /* Its parameter count, -1 for anything else */
+        int* module;          /* Module whose top-level definition it is, -1 for a local */
+        bool* boxed;          /* Local kept in a box (see box_binding) */
+        OmniLetrecFn* letrec; /* Function of a letrec (see codegen_letrec_stmts) */
         size_t count;
         size_t capacity;
     } symbols;
 
+    /* C names declared so far in the function being generated. Flattened
+     * lets share one C block, so each binding needs a name of its own. */
+    struct {
+        char** names;
+        size_t count;
+        size_t capacity;
+    } locals;
+
+    /* Lets of that function binding a new heap pair, each with the code
+     * the binding is visible in; a later cons may take over the pair's
+     * memory once it is dead (see reuse_pair) */
+    struct {
+        char** names;
+        char** c_names;
+        OmniValue** scopes;
+        size_t count;
+        size_t capacity;
+    } pairs;
+    size_t reuses;            /* Conses generated to reuse a dead pair */
+    size_t frees;             /* Frees generated at a pair's last use */
+
     /* Forward declarations needed */
     struct {
         char** decls;
@@ -59,20 +128,75 @@ typedef struct CodeGenContext {
         size_t capacity;
     } lambda_defs;
 
+    /* Errors; the generated code is unusable if there are any */
+    struct {
+        char** msgs;
+        OmniLocation* at;
+        size_t count;
+        size_t capacity;
+    } errors;
+
+    /* Warnings; the generated code is still usable */
+    struct {
+        char** msgs;
+        size_t count;
+        size_t capacity;
+    } warnings;
+
     /* Flags */
     bool in_tail_position;
     bool generating_header;
     bool use_runtime;         /* Use external runtime library */
+    bool script_mode;         /* Don't echo top-level results */
+    bool script_exit;         /* Exit with the last top-level expression's value */
+    size_t status_form;       /* 1-based form whose value is the exit status, 0 = none */
+    bool mark_results;        /* Frame echoed results with OMNI_RESULT_* */
+    size_t record_steps;      /* Calls kept for debug-history (0 = off) */
+    bool crash_handler;       /* -g: shadow stack, RC ring and a report on fatal signals */
+    bool checked;             /* main() turns on set_checked_lists */
+    bool constraint_check;    /* Emit the constraint layer and record bind/borrow sites */
+    bool coop_cancel;         /* Every function and lambda entry is a cancellation point */
+    unsigned strategies;      /* OmniStrategy mask for main(), 0 = release with free_obj */
+    OmniMemoryMode memory;    /* -O: memory strategies the code uses */
+    bool trim_runtime;        /* Embedded runtime: only the sections the program uses */
+    size_t runtime_at;        /* Where they go in the output, once it is all generated */
+    bool minimal_io;          /* Embedded runtime: print without the printf family */
+    bool freestanding;        /* Embedded runtime without libc or threads (implies minimal_io) */
+    size_t heap_limit;        /* Embedded runtime: bytes live at once, 0 = no limit */
+    OmniOomPolicy oom_policy; /* Embedded runtime: what a failed allocation does */
+    const char* provenance;   /* Build record main() prints for --purple-info, or NULL */
+    bool check_only;          /* For the diagnostics alone: the runtime is left out */
+    size_t form;              /* 1-based top-level form being generated, for sites */
+    OmniValue* located;       /* Innermost parsed node being generated, for errors */
+    OmniValue* boxed_names;   /* Names closures capture and set! assigns (see boxed_names) */
+    struct OmniLoop* loop;    /* Loop whose body is being generated (see codegen_letrec_loop) */
+
+    /* Imported modules (see modules/modules.h). Module k's forms run in
+     * _module_k() and its definitions are C names prefixed m<k>_. A
+     * module sees its own names and those the modules it imports provide. */
+    const int* form_modules;  /* Module of each top-level form, 0 = the program's own */
+    OmniValue** provides;     /* Per module, the names it provides; NULL for all */
+    OmniValue** imports;      /* Per module, the modules it imports, as ints */
+    const char** module_names;
+    int module;               /* Module of the form being generated */
+
+    bool hot_reload;          /* Call top-level functions through swappable pointers */
+    const char* hot_patch;    /* Emit only this function plus omni_hot_install */
+    bool incremental;         /* main() installs the functions this object defines */
+    size_t prior_forms;       /* Leading forms built and loaded already; declared extern */
+    bool declare_only;        /* Only declare the function being defined */
+    OmniShadowPolicy shadowing;
     const char* runtime_path;
 } CodeGenContext;
 
 /* ============== Code Generator API ============== */
 
-/* Create a new code generator writing to a file */
-CodeGenContext* omni_codegen_new(FILE* output);
+/* Create a new code generator for session writing to a file. The session
+ * may be NULL for a generator that only emits the runtime. */
+CodeGenContext* omni_codegen_new(OmniSession* session, FILE* output);
 
-/* Create a new code generator writing to memory */
-CodeGenContext* omni_codegen_new_buffer(void);
+/* Create a new code generator for session writing to memory */
+CodeGenContext* omni_codegen_new_buffer(OmniSession* session);
 
 /* Free code generator resources */
 void omni_codegen_free(CodeGenContext* ctx);
@@ -94,6 +218,85 @@ void omni_codegen_expr(CodeGenContext* ctx, OmniValue* expr);
 /* Generate the runtime header (types, macros, etc.) */
 void omni_codegen_runtime_header(CodeGenContext* ctx);
 
+/* ============== Memory Strategies ============== */
+
+/* How a libpurple program releases top-level values (--strategy). The
+ * values match PURPLE_STRATEGY_* in purple.h; asap is always included. */
+typedef enum {
+    OMNI_STRATEGY_ASAP      = 0x01,
+    OMNI_STRATEGY_PERCEUS   = 0x02,
+    OMNI_STRATEGY_ARENA     = 0x04,
+    OMNI_STRATEGY_DEFERRED  = 0x08,
+    OMNI_STRATEGY_SYMMETRIC = 0x10,
+    OMNI_STRATEGY_SCC       = 0x20
+} OmniStrategy;
+
+#define OMNI_STRATEGY_ALL 0x3f
+
+/* Name of a single strategy bit ("perceus"), or "unknown" */
+const char* omni_strategy_name(OmniStrategy strategy);
+
+/* Parse a comma-separated list such as "perceus,scc" into a mask with
+ * asap set. Returns 0 if a name is not a strategy. */
+unsigned omni_strategy_parse(const char* list);
+
+/* Write the mask as "asap+perceus+scc" into buf */
+void omni_strategy_format(unsigned mask, char* buf, size_t size);
+
+/* ============== Memory Modes ============== */
+
+/* "asap", "rc", "arena", "all", or "default" */
+const char* omni_memory_mode_name(OmniMemoryMode mode);
+
+/* The mode called name; false if there is none */
+bool omni_memory_mode_parse(const char* name, OmniMemoryMode* mode);
+
+/* Runtime sections (see below) the mode keeps whether used or not */
+unsigned omni_memory_mode_sections(OmniMemoryMode mode);
+
+/* ============== Embedded Runtime Sections ============== */
+
+/* Sections of the embedded runtime, in dependency order */
+typedef enum {
+    OMNI_RT_CORE = 0,         /* Constructors, inc/dec_ref, free strategies */
+    OMNI_RT_STACK,            /* Stack allocation macros */
+    OMNI_RT_WEAK,             /* Weak references for back-edges */
+    OMNI_RT_REUSE,            /* Perceus-style in-place reuse */
+    OMNI_RT_RC_ELISION,       /* Conditional RC macros */
+    OMNI_RT_REGION,           /* Per-region external refcounts */
+    OMNI_RT_TETHER,           /* Borrow/tether macros */
+    OMNI_RT_OWNERSHIP,        /* Interprocedural ownership annotations */
+    OMNI_RT_CONCURRENCY,      /* Atomic RC, channels, threads, timers */
+    OMNI_RT_PRINT,            /* print_obj */
+    OMNI_RT_PRIMITIVES,       /* Arithmetic, comparison, list primitives */
+    OMNI_RT_ERROR,            /* Error accessors and primitives */
+    OMNI_RT_LISTS,            /* call_closure and list_* operations */
+    OMNI_RT_STRINGS,          /* String primitives */
+    OMNI_RT_VECTORS,          /* Vector primitives */
+    OMNI_RT_HASHES,           /* Hash table primitives */
+    OMNI_RT_PERSISTENT,       /* Persistent maps and vectors */
+    OMNI_RT_USER_TYPES,       /* deftype objects */
+    OMNI_RT_PORTS,            /* String, file and socket ports */
+    OMNI_RT_COUNT
+} OmniRuntimeSection;
+
+#define OMNI_RT_BIT(s) (1u << (s))
+#define OMNI_RT_ALL ((1u << OMNI_RT_COUNT) - 1)
+
+/* Name of a section (for diagnostics and tests) */
+const char* omni_runtime_section_name(OmniRuntimeSection section);
+
+/* Expand a section mask with everything its sections depend on */
+unsigned omni_runtime_section_closure(unsigned mask);
+
+/* Emit the runtime prelude followed by the sections in mask (and their
+ * dependencies). Any mask yields a self-contained translation unit. */
+void omni_codegen_runtime_sections(CodeGenContext* ctx, unsigned mask);
+
+/* Sections the generated code (without a runtime) calls into, with their
+ * dependencies */
+unsigned omni_runtime_sections_used(const char* code);
+
 /* Generate the main function wrapper */
 void omni_codegen_main(CodeGenContext* ctx, OmniValue** exprs, size_t count);
 
@@ -144,6 +347,23 @@ void omni_codegen_add_forward_decl(CodeGenContext* ctx, const char* decl);
 /* Register a lambda definition */
 void omni_codegen_add_lambda_def(CodeGenContext* ctx, const char* def);
 
+/* Report an error in the program being generated */
+void omni_codegen_error(CodeGenContext* ctx, const char* fmt, ...);
+
+/* Get error count / message at index */
+size_t omni_codegen_error_count(CodeGenContext* ctx);
+const char* omni_codegen_get_error(CodeGenContext* ctx, size_t index);
+/* Where error index points: its form and the innermost parsed node
+ * being generated when it was raised */
+OmniLocation omni_codegen_get_error_location(CodeGenContext* ctx, size_t index);
+
+/* Report something suspicious that still compiles; repeats are dropped */
+void omni_codegen_warning(CodeGenContext* ctx, const char* fmt, ...);
+
+/* Get warning count / message at index */
+size_t omni_codegen_warning_count(CodeGenContext* ctx);
+const char* omni_codegen_get_warning(CodeGenContext* ctx, size_t index);
+
 /* ============== ASAP Memory Management ============== */
 
 /* Emit free_obj calls for variables at given position */
@@ -3,32 +3,45 @@
  */
 
 #include "compiler.h"
+#include "../diagnostics/diagnostics.h"
+#include "../modules/modules.h"
+#include "../macro/macro.h"
 #include <stdlib.h>
 #include <string.h>
 #include <stdio.h>
 #include <stdarg.h>
 #include <errno.h>
+#include <time.h>
+#include <pthread.h>
+#include <stdint.h>
+#ifndef OMNI_NO_EXEC
 #include <sys/wait.h>
 #include <unistd.h>
+#include <dirent.h>
+#include <signal.h>
+#include <sys/stat.h>
+#include <fcntl.h>
+#include <elf.h>
+#endif
 
 #define OMNILISP_VERSION "0.1.0"
 
 /* ============== Initialization ============== */
 
-static bool g_initialized = false;
+#ifndef OMNI_NO_EXEC
+static void temp_session_close(void);
+#endif
 
+/* The grammar is shared by every compiler and built once; everything
+ * else a compile uses belongs to its own OmniSession */
 void omni_compiler_init(void) {
-    if (g_initialized) return;
-    omni_ast_arena_init();
     omni_grammar_init();
-    g_initialized = true;
 }
 
 void omni_compiler_cleanup(void) {
-    if (!g_initialized) return;
-    omni_grammar_cleanup();
-    omni_ast_arena_cleanup();
-    g_initialized = false;
+#ifndef OMNI_NO_EXEC
+    temp_session_close();
+#endif
 }
 
 const char* omni_compiler_version(void) {
@@ -50,7 +63,7 @@ static CompilerOptions default_options(void) {
         .emit_debug_info = false,
         .enable_asan = false,
         .enable_tsan = false,
-        .cc = "gcc",
+        .cc = NULL,
         .cflags = NULL,
     };
     return opts;
@@ -80,17 +93,16 @@ Compiler* omni_compiler_new_with_options(const CompilerOptions* options) {
 void omni_compiler_free(Compiler* compiler) {
     if (!compiler) return;
 
-    if (compiler->analysis) {
-        omni_analysis_free(compiler->analysis);
-    }
-    if (compiler->codegen) {
-        omni_codegen_free(compiler->codegen);
-    }
+    omni_query_free(compiler->query);
 
     for (size_t i = 0; i < compiler->error_count; i++) {
         free(compiler->errors[i]);
     }
     free(compiler->errors);
+    for (size_t i = 0; i < compiler->warning_count; i++) {
+        free(compiler->warnings[i]);
+    }
+    free(compiler->warnings);
 
     free(compiler);
 }
@@ -119,6 +131,32 @@ static void add_error(Compiler* c, const char* fmt, ...) {
     c->errors[c->error_count++] = strdup(buf);
 }
 
+/* The named unit form (1-based) was read from, if any */
+static const OmniSource* unit_of_form(Compiler* c, size_t form) {
+    for (size_t i = 0; i < c->unit_count && form > 0; i++) {
+        if (form <= c->unit_ends[i]) return c->units[i].name ? &c->units[i] : NULL;
+    }
+    return NULL;
+}
+
+/* "file:line:col: msg" plus the source line, when unit is named and
+ * line known */
+static void add_unit_error(Compiler* c, const OmniSource* unit, int line, int column,
+                           const char* msg) {
+    if (!unit || !unit->name || line <= 0) {
+        add_error(c, "%s", msg);
+        return;
+    }
+    char buf[1024];
+    snprintf(buf, sizeof(buf), "%s:%d:%d: %s", unit->name, line, column, msg);
+    omni_format_snippet(buf, sizeof(buf), unit->text, line, column);
+    add_error(c, "%s", buf);
+}
+
+static void add_located_error(Compiler* c, OmniLocation at, const char* msg) {
+    add_unit_error(c, unit_of_form(c, at.form), at.line, at.column, msg);
+}
+
 bool omni_compiler_has_errors(Compiler* compiler) {
     return compiler && compiler->error_count > 0;
 }
@@ -138,84 +176,1422 @@ void omni_compiler_clear_errors(Compiler* compiler) {
         free(compiler->errors[i]);
     }
     compiler->error_count = 0;
+    for (size_t i = 0; i < compiler->warning_count; i++) {
+        free(compiler->warnings[i]);
+    }
+    compiler->warning_count = 0;
 }
 
-/* ============== Compilation ============== */
+static void add_warning(Compiler* c, const char* msg) {
+    if (c->warning_count >= c->warning_capacity) {
+        c->warning_capacity = c->warning_capacity ? c->warning_capacity * 2 : 8;
+        c->warnings = realloc(c->warnings, c->warning_capacity * sizeof(char*));
+    }
+    c->warnings[c->warning_count++] = strdup(msg);
+}
 
-char* omni_compiler_compile_to_c(Compiler* compiler, const char* source) {
-    if (!compiler || !source) return NULL;
+static void add_unit_warning(Compiler* c, const OmniSource* unit, int line, int column,
+                             const char* msg) {
+    if (!unit || !unit->name || line <= 0) {
+        add_warning(c, msg);
+        return;
+    }
+    char buf[1024];
+    snprintf(buf, sizeof(buf), "%s:%d:%d: %s", unit->name, line, column, msg);
+    omni_format_snippet(buf, sizeof(buf), unit->text, line, column);
+    add_warning(c, buf);
+}
 
-    omni_compiler_clear_errors(compiler);
+static void add_located_warning(Compiler* c, OmniLocation at, const char* msg) {
+    add_unit_warning(c, unit_of_form(c, at.form), at.line, at.column, msg);
+}
+
+size_t omni_compiler_warning_count(Compiler* compiler) {
+    return compiler ? compiler->warning_count : 0;
+}
+
+const char* omni_compiler_get_warning(Compiler* compiler, size_t index) {
+    if (!compiler || index >= compiler->warning_count) return NULL;
+    return compiler->warnings[index];
+}
+
+/* ============== Phase Timing ============== */
+
+static double now_ms(void) {
+    struct timespec ts;
+    clock_gettime(CLOCK_MONOTONIC, &ts);
+    return (double)ts.tv_sec * 1000.0 + (double)ts.tv_nsec / 1e6;
+}
 
-    /* Parse */
-    OmniParser* parser = omni_parser_new(source);
-    size_t expr_count;
-    OmniValue** exprs = omni_parser_parse_all(parser, &expr_count);
+static void phase_add(Compiler* c, CompilerPhase phase, double start) {
+    c->phase_ms[phase] += now_ms() - start;
+}
+
+double omni_compiler_phase_time(Compiler* compiler, CompilerPhase phase) {
+    if (!compiler || phase < 0 || phase >= OMNI_PHASE_COUNT) return 0.0;
+    return compiler->phase_ms[phase];
+}
+
+const char* omni_compiler_phase_name(CompilerPhase phase) {
+    switch (phase) {
+    case OMNI_PHASE_PARSE:    return "parse";
+    case OMNI_PHASE_EXPAND:   return "expansion";
+    case OMNI_PHASE_ANALYSIS: return "analysis";
+    case OMNI_PHASE_CODEGEN:  return "C emission";
+    case OMNI_PHASE_CC:       return "cc";
+    case OMNI_PHASE_LINK:     return "link";
+    default:                  return "unknown";
+    }
+}
+
+void omni_compiler_reset_timings(Compiler* compiler) {
+    if (!compiler) return;
+    memset(compiler->phase_ms, 0, sizeof(compiler->phase_ms));
+}
+
+void omni_compiler_print_timings(Compiler* compiler, FILE* out) {
+    if (!compiler || !out) return;
+
+    double total = 0.0;
+    for (int i = 0; i < OMNI_PHASE_COUNT; i++) {
+        total += compiler->phase_ms[i];
+    }
+
+    fprintf(out, "%-12s %10s %7s\n", "phase", "ms", "%");
+    for (int i = 0; i < OMNI_PHASE_COUNT; i++) {
+        double ms = compiler->phase_ms[i];
+        fprintf(out, "%-12s %10.3f %6.1f%%\n", omni_compiler_phase_name((CompilerPhase)i),
+                ms, total > 0.0 ? ms * 100.0 / total : 0.0);
+    }
+    fprintf(out, "%-12s %10.3f\n", "total", total);
+}
+
+void omni_compiler_print_stats(Compiler* compiler, FILE* out) {
+    if (!compiler || !out) return;
+    fprintf(out, "%-12s %10zu\n", "reuses", compiler->reuses);
+    fprintf(out, "%-12s %10zu\n", "frees", compiler->frees);
+}
+
+/* ============== Language Levels ============== */
+
+int omni_lang_parse(const char* name) {
+    const char* prefix = "purple/";
+    if (!name || strncmp(name, prefix, strlen(prefix)) != 0) return 0;
+    const char* digits = name + strlen(prefix);
+    if (*digits < '0' || *digits > '9') return 0;
+    char* end;
+    long level = strtol(digits, &end, 10);
+    if (*end != '\0' || level < OMNI_LANG_FIRST || level > OMNI_LANG_LATEST) return 0;
+    return (int)level;
+}
+
+/* Top-level forms that a level of the language added */
+static const struct {
+    const char* name;
+    int level;
+} g_lang_forms[] = {
+    { "import",   2 },
+    { "provide",  2 },
+    { "defmacro", 2 },
+};
+
+/* The level form's head first appeared at, 0 if in every level */
+static int lang_form_level(OmniValue* form) {
+    if (!omni_is_cell(form) || !omni_is_sym(omni_car(form))) return 0;
+    const char* head = omni_car(form)->str_val;
+    for (size_t i = 0; i < sizeof(g_lang_forms) / sizeof(g_lang_forms[0]); i++) {
+        if (strcmp(head, g_lang_forms[i].name) == 0) return g_lang_forms[i].level;
+    }
+    return 0;
+}
+
+/* ============== Compilation ============== */
+
+/* Parse one source unit into *forms (malloc'd), and the level of the
+ * language it is written in into *lang.
+ * Errors are attributed to the unit's name when it has one. */
+static bool parse_unit(Compiler* compiler, const OmniSource* unit,
+                       OmniValue*** forms, size_t* count, int* lang) {
+    double start = now_ms();
+    OmniParser* parser = omni_parser_new(compiler->session, unit->text);
+    OmniValue** unit_exprs = omni_parser_parse_all(parser, count);
+    phase_add(compiler, OMNI_PHASE_PARSE, start);
 
     if (omni_parser_get_errors(parser)) {
-        OmniParseError* err = omni_parser_get_errors(parser);
-        while (err) {
-            add_error(compiler, "Parse error at line %d, col %d: %s",
-                      err->line, err->column, err->message);
-            err = err->next;
+        for (OmniParseError* err = omni_parser_get_errors(parser); err; err = err->next) {
+            if (unit->name) {
+                char buf[1024];
+                snprintf(buf, sizeof(buf), "%s:%d:%d: E0005 parse error: %s",
+                         unit->name, err->line, err->column, err->message);
+                omni_format_snippet(buf, sizeof(buf), unit->text, err->line, err->column);
+                add_error(compiler, "%s", buf);
+            } else {
+                add_error(compiler, "E0005 Parse error at line %d, col %d: %s",
+                          err->line, err->column, err->message);
+            }
         }
         omni_parser_free(parser);
-        return NULL;
+        free(unit_exprs);
+        return false;
+    }
+    *lang = compiler->options.lang ? compiler->options.lang : OMNI_LANG_LATEST;
+    if (parser->lang && !(*lang = omni_lang_parse(parser->lang))) {
+        char msg[512];
+        snprintf(msg, sizeof(msg), "E0012 unknown language %s: this compiler knows purple/%d to purple/%d",
+                 parser->lang, OMNI_LANG_FIRST, OMNI_LANG_LATEST);
+        add_unit_error(compiler, unit, parser->lang_line, parser->lang_column, msg);
+        omni_parser_free(parser);
+        free(unit_exprs);
+        return false;
     }
     omni_parser_free(parser);
+    *forms = unit_exprs;
+    return true;
+}
 
-    if (expr_count == 0) {
-        add_error(compiler, "No expressions to compile");
+/* Analyze and generate C for a program's top-level expressions */
+/* Set codegen up for compiler's options */
+static void configure_codegen(Compiler* compiler, CodeGenContext* codegen) {
+    if (compiler->options.runtime_path && !compiler->options.freestanding) {
+        omni_codegen_set_runtime(codegen, compiler->options.runtime_path);
+    }
+    codegen->script_mode = compiler->options.script_mode;
+    codegen->script_exit = compiler->options.script_exit;
+    codegen->mark_results = compiler->options.mark_results;
+    codegen->record_steps = compiler->options.record_steps;
+    codegen->crash_handler = compiler->options.emit_debug_info && !compiler->options.freestanding;
+    codegen->checked = compiler->options.checked;
+    codegen->constraint_check = compiler->options.constraint_check;
+    codegen->coop_cancel = compiler->options.coop_cancel && !compiler->options.freestanding;
+    codegen->strategies = compiler->options.strategies;
+    codegen->memory = compiler->options.memory;
+    codegen->trim_runtime = (compiler->options.size_profile || compiler->options.memory != OMNI_MEMORY_ALL) &&
+                            !compiler->check_only;
+    codegen->check_only = compiler->check_only;
+    codegen->minimal_io = compiler->options.minimal_io;
+    codegen->freestanding = compiler->options.freestanding;
+    codegen->heap_limit = compiler->options.heap_limit;
+    codegen->oom_policy = compiler->options.oom_policy;
+    codegen->hot_reload = compiler->options.hot_reload || compiler->options.hot_patch ||
+                          compiler->options.incremental;
+    codegen->hot_patch = compiler->options.hot_patch;
+    codegen->incremental = compiler->options.incremental;
+    codegen->shadowing = compiler->options.shadowing;
+}
+
+static char* compile_exprs(Compiler* compiler, OmniValue** exprs, size_t expr_count) {
+    if (compiler->options.strategies && !compiler->options.runtime_path) {
+        add_error(compiler, "E0004 --strategy needs the libpurple runtime (pass --runtime)");
         return NULL;
     }
 
-    /* Generate code */
-    CodeGenContext* codegen = omni_codegen_new_buffer();
-    if (compiler->options.runtime_path) {
-        omni_codegen_set_runtime(codegen, compiler->options.runtime_path);
+    /* Reject malformed trees before any pass trips over them */
+    for (size_t i = 0; i < expr_count; i++) {
+        OmniValue* bad = NULL;
+        const char* err = omni_ast_check(exprs[i], &bad);
+        if (err) {
+            add_error(compiler, "E0006 Malformed AST in expression %zu: %s (%s node)",
+                      i + 1, err, bad ? omni_tag_name(bad->tag) : "NULL");
+            return NULL;
+        }
     }
 
+    omni_query_free(compiler->query);
+    compiler->query = NULL;
+
+    /* Analyze */
+    double start = now_ms();
+    AnalysisContext* analysis = compiler->session->summaries = omni_analysis_new();
+    omni_analyze_program(analysis, exprs, expr_count);
+    /* Echoed top-level results count as used; script results do not */
+    omni_analyze_dead_code(analysis, exprs, expr_count, !compiler->options.script_mode);
+    omni_analyze_dataflow(analysis, exprs, expr_count);
+    omni_analyze_list_args(analysis, exprs, expr_count);
+    if (compiler->options.constraint_check) {
+        /* The borrows codegen registers constraints on */
+        for (size_t i = 0; i < expr_count; i++) omni_analyze_borrows(analysis, exprs[i]);
+    }
+    for (size_t i = 0; i < omni_analysis_warning_count(analysis); i++) {
+        add_located_warning(compiler, omni_analysis_get_warning_location(analysis, i),
+                            omni_analysis_get_warning(analysis, i));
+    }
+    /* Kept for tools, errors or not */
+    const char** units = malloc((expr_count ? expr_count : 1) * sizeof(char*));
+    for (size_t i = 0; i < expr_count; i++) {
+        const OmniSource* unit = unit_of_form(compiler, i + 1);
+        units[i] = unit ? unit->name : NULL;
+    }
+    compiler->query = omni_query_build(analysis, exprs, units, expr_count);
+    free(units);
+    phase_add(compiler, OMNI_PHASE_ANALYSIS, start);
+    if (omni_analysis_error_count(analysis) > 0) {
+        for (size_t i = 0; i < omni_analysis_error_count(analysis); i++) {
+            add_located_error(compiler, omni_analysis_get_error_location(analysis, i),
+                              omni_analysis_get_error(analysis, i));
+        }
+        omni_analysis_free(analysis);
+        compiler->session->summaries = NULL;
+        return NULL;
+    }
+
+    /* Generate code (the code generator takes ownership of the analysis) */
+    start = now_ms();
+    CodeGenContext* codegen = compiler->session->codegen = omni_codegen_new_buffer(compiler->session);
+    configure_codegen(compiler, codegen);
+    codegen->prior_forms = compiler->prior_forms;
+    codegen->provenance = compiler->provenance;
+    codegen->form_modules = compiler->form_modules;
+    codegen->provides = compiler->provides;
+    codegen->imports = compiler->imports;
+    codegen->module_names = compiler->module_names;
+    codegen->analysis = analysis;
+
     omni_codegen_program(codegen, exprs, expr_count);
+    for (size_t i = 0; i < omni_codegen_warning_count(codegen); i++) {
+        add_warning(compiler, omni_codegen_get_warning(codegen, i));
+    }
 
-    char* output = omni_codegen_get_output(codegen);
+    char* output = NULL;
+    if (omni_codegen_error_count(codegen) > 0) {
+        for (size_t i = 0; i < omni_codegen_error_count(codegen); i++) {
+            add_located_error(compiler, omni_codegen_get_error_location(codegen, i),
+                              omni_codegen_get_error(codegen, i));
+        }
+    } else {
+        output = omni_codegen_get_output(codegen);
+    }
+    compiler->reuses = codegen->reuses;
+    compiler->frees = codegen->frees;
     omni_codegen_free(codegen);
-
-    free(exprs);
+    compiler->session->codegen = NULL;
+    compiler->session->summaries = NULL;
+    phase_add(compiler, OMNI_PHASE_CODEGEN, start);
 
     return output;
 }
 
-static char* create_temp_file(const char* suffix) {
-    char* path = malloc(256);
-    snprintf(path, 256, "/tmp/omnilisp_XXXXXX%s", suffix);
-    int fd = mkstemps(path, strlen(suffix));
-    if (fd < 0) {
+/* ============== Provenance ============== */
+
+/* SHA-256 (FIPS 180-4) */
+static const uint32_t g_sha256_k[64] = {
+    0x428a2f98, 0x71374491, 0xb5c0fbcf, 0xe9b5dba5, 0x3956c25b, 0x59f111f1, 0x923f82a4, 0xab1c5ed5,
+    0xd807aa98, 0x12835b01, 0x243185be, 0x550c7dc3, 0x72be5d74, 0x80deb1fe, 0x9bdc06a7, 0xc19bf174,
+    0xe49b69c1, 0xefbe4786, 0x0fc19dc6, 0x240ca1cc, 0x2de92c6f, 0x4a7484aa, 0x5cb0a9dc, 0x76f988da,
+    0x983e5152, 0xa831c66d, 0xb00327c8, 0xbf597fc7, 0xc6e00bf3, 0xd5a79147, 0x06ca6351, 0x14292967,
+    0x27b70a85, 0x2e1b2138, 0x4d2c6dfc, 0x53380d13, 0x650a7354, 0x766a0abb, 0x81c2c92e, 0x92722c85,
+    0xa2bfe8a1, 0xa81a664b, 0xc24b8b70, 0xc76c51a3, 0xd192e819, 0xd6990624, 0xf40e3585, 0x106aa070,
+    0x19a4c116, 0x1e376c08, 0x2748774c, 0x34b0bcb5, 0x391c0cb3, 0x4ed8aa4a, 0x5b9cca4f, 0x682e6ff3,
+    0x748f82ee, 0x78a5636f, 0x84c87814, 0x8cc70208, 0x90befffa, 0xa4506ceb, 0xbef9a3f7, 0xc67178f2,
+};
+
+#define ROTR32(x, n) (((x) >> (n)) | ((x) << (32 - (n))))
+
+static void sha256_block(uint32_t h[8], const unsigned char* p) {
+    uint32_t w[64];
+    for (int i = 0; i < 16; i++) {
+        w[i] = (uint32_t)p[4 * i] << 24 | (uint32_t)p[4 * i + 1] << 16 |
+               (uint32_t)p[4 * i + 2] << 8 | (uint32_t)p[4 * i + 3];
+    }
+    for (int i = 16; i < 64; i++) {
+        uint32_t s0 = ROTR32(w[i - 15], 7) ^ ROTR32(w[i - 15], 18) ^ (w[i - 15] >> 3);
+        uint32_t s1 = ROTR32(w[i - 2], 17) ^ ROTR32(w[i - 2], 19) ^ (w[i - 2] >> 10);
+        w[i] = w[i - 16] + s0 + w[i - 7] + s1;
+    }
+    uint32_t a = h[0], b = h[1], c = h[2], d = h[3], e = h[4], f = h[5], g = h[6], k = h[7];
+    for (int i = 0; i < 64; i++) {
+        uint32_t t1 = k + (ROTR32(e, 6) ^ ROTR32(e, 11) ^ ROTR32(e, 25)) + ((e & f) ^ (~e & g)) +
+                      g_sha256_k[i] + w[i];
+        uint32_t t2 = (ROTR32(a, 2) ^ ROTR32(a, 13) ^ ROTR32(a, 22)) + ((a & b) ^ (a & c) ^ (b & c));
+        k = g; g = f; f = e; e = d + t1;
+        d = c; c = b; b = a; a = t1 + t2;
+    }
+    h[0] += a; h[1] += b; h[2] += c; h[3] += d;
+    h[4] += e; h[5] += f; h[6] += g; h[7] += k;
+}
+
+void omni_sha256_hex(const void* data, size_t size, char hex[65]) {
+    uint32_t h[8] = { 0x6a09e667, 0xbb67ae85, 0x3c6ef372, 0xa54ff53a,
+                      0x510e527f, 0x9b05688c, 0x1f83d9ab, 0x5be0cd19 };
+    const unsigned char* p = data;
+    size_t left = size;
+    for (; left >= 64; p += 64, left -= 64) sha256_block(h, p);
+
+    /* The tail, a 1 bit, zeros and the length in bits fill one or two blocks */
+    unsigned char tail[128] = { 0 };
+    memcpy(tail, p, left);
+    tail[left] = 0x80;
+    size_t blocks = left < 56 ? 1 : 2;
+    uint64_t bits = (uint64_t)size * 8;
+    for (int i = 0; i < 8; i++) tail[blocks * 64 - 1 - i] = (unsigned char)(bits >> (8 * i));
+    for (size_t i = 0; i < blocks; i++) sha256_block(h, tail + 64 * i);
+
+    for (int i = 0; i < 8; i++) snprintf(hex + 8 * i, 9, "%08x", (unsigned)h[i]);
+}
+
+/* Read the whole file at path; NULL if it cannot be */
+static unsigned char* read_binary(const char* path, size_t* size) {
+    FILE* f = fopen(path, "rb");
+    if (!f) return NULL;
+    fseek(f, 0, SEEK_END);
+    long len = ftell(f);
+    fseek(f, 0, SEEK_SET);
+    unsigned char* data = len > 0 ? malloc((size_t)len) : NULL;
+    if (data && fread(data, 1, (size_t)len, f) != (size_t)len) {
+        free(data);
+        data = NULL;
+    }
+    fclose(f);
+    *size = (size_t)len;
+    return data;
+}
+
+/* "sha256:<hex>" of the runtime the binary gets: libpurple's archive, or
+ * the whole embedded runtime as these options generate it */
+static void runtime_hash(Compiler* c, FILE* out) {
+    char hex[65];
+    if (c->options.runtime_path) {
+        char path[1024];
+        snprintf(path, sizeof(path), "%s/libpurple.a", c->options.runtime_path);
+        size_t size = 0;
+        unsigned char* data = read_binary(path, &size);
+        if (!data) {
+            fprintf(out, "runtime: libpurple unknown\n");
+            return;
+        }
+        omni_sha256_hex(data, size, hex);
+        free(data);
+        fprintf(out, "runtime: libpurple sha256:%s\n", hex);
+        return;
+    }
+    CodeGenContext* rt = omni_codegen_new_buffer(NULL);
+    configure_codegen(c, rt);
+    rt->trim_runtime = false;
+    omni_codegen_runtime_header(rt);
+    omni_sha256_hex(rt->output_buffer, rt->output_size, hex);
+    omni_codegen_free(rt);
+    fprintf(out, "runtime: embedded sha256:%s\n", hex);
+}
+
+/* The record of what builds a program from units (see compiler.h) */
+static char* provenance_record(Compiler* c, const OmniSource* units, size_t count) {
+    char* record = NULL;
+    size_t len = 0;
+    FILE* out = open_memstream(&record, &len);
+    fputs(OMNI_PROVENANCE_MAGIC, out);
+    fprintf(out, "compiler: omnilisp %s\n", OMNILISP_VERSION);
+    runtime_hash(c, out);
+
+    /* Options that change the code or how it runs, in a fixed order */
+    const CompilerOptions* o = &c->options;
+    fprintf(out, "flags:");
+    if (o->size_profile) fprintf(out, " -Os");
+    else fprintf(out, " -O%d", o->opt_level);
+    if (o->emit_debug_info) fprintf(out, " -g");
+    if (o->enable_asan) fprintf(out, " asan");
+    if (o->enable_tsan) fprintf(out, " tsan");
+    if (o->script_mode) fprintf(out, " script");
+    if (o->script_exit) fprintf(out, " script-exit");
+    if (o->lang) fprintf(out, " lang=purple/%d", o->lang);
+    if (o->checked) fprintf(out, " checked");
+    if (o->constraint_check) fprintf(out, " constraint-check");
+    if (o->coop_cancel) fprintf(out, " coop-cancel");
+    if (o->strategies) {
+        const char* sep = " strategy=";
+        for (unsigned bit = 1; bit <= OMNI_STRATEGY_ALL; bit <<= 1) {
+            if (!(o->strategies & bit)) continue;
+            fprintf(out, "%s%s", sep, omni_strategy_name((OmniStrategy)bit));
+            sep = ",";
+        }
+    }
+    if (o->memory) fprintf(out, " memory=%s", omni_memory_mode_name(o->memory));
+    if (o->minimal_io) fprintf(out, " minimal-io");
+    if (o->record_steps) fprintf(out, " record=%zu", o->record_steps);
+    if (o->heap_limit) fprintf(out, " heap-limit=%zu", o->heap_limit);
+    if (o->oom_policy == OMNI_OOM_ERROR) fprintf(out, " oom=error");
+    if (o->cc) fprintf(out, " cc=%s", o->cc);
+    if (o->target) fprintf(out, " target=%s", o->target);
+    if (o->cflags) fprintf(out, " cflags=%s", o->cflags);
+    if (o->ldflags) fprintf(out, " ldflags=%s", o->ldflags);
+    if (o->link_with) fprintf(out, " link=%s", o->link_with);
+    fputc('\n', out);
+
+    for (size_t i = 0; i < count; i++) {
+        if (!units[i].text) continue;
+        char hex[65];
+        omni_sha256_hex(units[i].text, strlen(units[i].text), hex);
+        fprintf(out, "source: %s sha256:%s\n", units[i].name ? units[i].name : "-e", hex);
+    }
+    fclose(out);
+    return record;
+}
+
+/* ============== Standalone C ============== */
+
+/* libpurple.a's sources, relative to the runtime, in runtime/Makefile's
+ * order: runtime.c defines the types the others share */
+static const char* const g_runtime_sources[] = {
+    "src/runtime.c",
+    "src/memory/slot_pool.c",
+    "src/memory/handle.c",
+};
+
+/* Files already written into a standalone program */
+typedef struct {
+    FILE* out;
+    char** seen;
+    size_t seen_count;
+} Amalgam;
+
+/* Append the file at path to a, each #include "name" in it replaced by
+ * that file the first time and dropped after; false if one cannot be read */
+static bool amalgamate(Compiler* c, Amalgam* a, const char* path) {
+    for (size_t i = 0; i < a->seen_count; i++) {
+        if (strcmp(a->seen[i], path) == 0) return true;
+    }
+    a->seen = realloc(a->seen, (a->seen_count + 1) * sizeof(char*));
+    a->seen[a->seen_count++] = strdup(path);
+
+    char* text = omni_fs_read(omni_fs_os(), path);
+    if (!text) {
+        add_error(c, "Cannot read %s for --standalone: %s", path, strerror(errno));
+        return false;
+    }
+    const char* slash = strrchr(path, '/');
+    int dir_len = slash ? (int)(slash - path + 1) : 0;
+
+    size_t root = strlen(c->options.runtime_path);
+    bool under = strncmp(path, c->options.runtime_path, root) == 0 && path[root] == '/';
+    fprintf(a->out, "/* ========== libpurple: %s ========== */\n", under ? path + root + 1 : path);
+    bool ok = true;
+    for (const char* line = text; *line && ok; ) {
+        const char* end = strchr(line, '\n');
+        size_t len = end ? (size_t)(end - line + 1) : strlen(line);
+        const char* p = line + strspn(line, " \t");
+        bool directive = *p == '#';
+        if (directive) p += 1 + strspn(p + 1, " \t");
+        if (directive && strstr(p, "include \"") == p) {
+            const char* name = p + strlen("include \"");
+            const char* close = strchr(name, '"');
+            char included[1024];
+            snprintf(included, sizeof(included), "%.*s%.*s", dir_len, path,
+                     close ? (int)(close - name) : 0, name);
+            ok = amalgamate(c, a, included);
+        } else {
+            fwrite(line, 1, len, a->out);
+        }
+        line += len;
+    }
+    if (*text && text[strlen(text) - 1] != '\n') fputc('\n', a->out);
+    free(text);
+    return ok;
+}
+
+/* code with its #include of libpurple's header replaced by the runtime's
+ * sources, so that it builds with the C compiler alone; NULL if they
+ * cannot be read */
+static char* inline_runtime(Compiler* c, char* code) {
+    char include[1024];
+    snprintf(include, sizeof(include), "#include \"%s/include/purple.h\"\n", c->options.runtime_path);
+    char* at = strstr(code, include);
+    if (!at) return code;
+
+    char* result = NULL;
+    size_t len = 0;
+    Amalgam a = { open_memstream(&result, &len), NULL, 0 };
+    fwrite(code, 1, (size_t)(at - code), a.out);
+    /* As runtime/Makefile builds it */
+    fputs("#ifndef _GNU_SOURCE\n#define _GNU_SOURCE\n#endif\n\n", a.out);
+    bool ok = true;
+    for (size_t i = 0; i < sizeof(g_runtime_sources) / sizeof(g_runtime_sources[0]) && ok; i++) {
+        char path[1024];
+        snprintf(path, sizeof(path), "%s/%s", c->options.runtime_path, g_runtime_sources[i]);
+        ok = amalgamate(c, &a, path);
+    }
+    fputs("/* ========== program ========== */\n", a.out);
+    fputs(at + strlen(include), a.out);
+    fclose(a.out);
+    for (size_t i = 0; i < a.seen_count; i++) free(a.seen[i]);
+    free(a.seen);
+    free(code);
+    if (!ok) {
+        free(result);
+        return NULL;
+    }
+    return result;
+}
+
+/* ============== Modules ============== */
+
+/* A program assembled from source units and the modules they import */
+typedef struct Program {
+    OmniValue** exprs;
+    int* modules;             /* Module of each form, 0 for the units passed in */
+    size_t count;
+    size_t capacity;
+
+    /* Units in the order of their forms, and the forms read by the end of each */
+    OmniSource* units;
+    size_t* ends;
+    size_t unit_count;
+    size_t unit_capacity;
+
+    /* Per module number (loader index + 1) */
+    OmniValue** provides;
+    OmniValue** imports;      /* Modules it imports itself, as ints */
+    const char** names;
+    size_t module_count;
+
+    OmniModuleLoader* loader;
+    OmniMacros* macros;       /* Defined so far, by every unit */
+} Program;
+
+static void program_add_form(Program* p, OmniValue* form, int module) {
+    if (p->count >= p->capacity) {
+        p->capacity = p->capacity ? p->capacity * 2 : 16;
+        p->exprs = realloc(p->exprs, p->capacity * sizeof(OmniValue*));
+        p->modules = realloc(p->modules, p->capacity * sizeof(int));
+    }
+    p->exprs[p->count] = form;
+    p->modules[p->count++] = module;
+}
+
+static void program_add_unit(Program* p, const OmniSource* unit) {
+    if (p->unit_count >= p->unit_capacity) {
+        p->unit_capacity = p->unit_capacity ? p->unit_capacity * 2 : 8;
+        p->units = realloc(p->units, p->unit_capacity * sizeof(OmniSource));
+        p->ends = realloc(p->ends, p->unit_capacity * sizeof(size_t));
+    }
+    p->units[p->unit_count] = *unit;
+    p->ends[p->unit_count++] = p->count;
+}
+
+/* Start module's entries: provides everything until a provide says otherwise */
+static void program_add_module(Program* p, int module, const char* name) {
+    if ((size_t)module >= p->module_count) {
+        p->provides = realloc(p->provides, (size_t)(module + 1) * sizeof(OmniValue*));
+        p->imports = realloc(p->imports, (size_t)(module + 1) * sizeof(OmniValue*));
+        p->names = realloc(p->names, (size_t)(module + 1) * sizeof(char*));
+        for (size_t i = p->module_count; i <= (size_t)module; i++) {
+            p->provides[i] = NULL;
+            p->imports[i] = omni_nil;
+            p->names[i] = NULL;
+        }
+        p->module_count = (size_t)module + 1;
+    }
+    p->provides[module] = NULL;
+    p->names[module] = name;
+}
+
+static bool add_unit(Compiler* c, Program* p, const OmniSource* unit, int module);
+
+/* Error at node of unit */
+static void unit_error(Compiler* c, const OmniSource* unit, OmniValue* node, const char* fmt, ...) {
+    char msg[768];
+    va_list args;
+    va_start(args, fmt);
+    vsnprintf(msg, sizeof(msg), fmt, args);
+    va_end(args);
+    add_unit_error(c, unit, node->line, node->column, msg);
+}
+
+/* Load the files (import "path" ...) in unit names, each before unit,
+ * and record that module imports them */
+static bool add_imports(Compiler* c, Program* p, const OmniSource* unit, int module, OmniValue* form) {
+    bool ok = true;
+    for (OmniValue* args = omni_cdr(form); omni_is_cell(args); args = omni_cdr(args)) {
+        OmniValue* arg = omni_car(args);
+        if (!omni_is_string(arg)) {
+            char* text = omni_value_to_string(form);
+            unit_error(c, unit, form, "E0002 %s: expected (import \"path\"...)", text);
+            free(text);
+            ok = false;
+            continue;
+        }
+
+        char* path = omni_module_resolve(unit->name, arg->str_val);
+        size_t index;
+        char chain[512];
+        switch (omni_modules_load(p->loader, path, NULL, &index)) {
+        case OMNI_MODULE_NEW: {
+            OmniModule* m = &p->loader->modules[index];
+            OmniSource source = { m->path, m->text };
+            ok = add_unit(c, p, &source, (int)index + 1) && ok;
+            omni_modules_done(p->loader, index);
+            p->imports[module] = omni_new_cell(c->session->arena,
+                                               omni_new_int(c->session->arena, (int64_t)index + 1),
+                                               p->imports[module]);
+            break;
+        }
+        case OMNI_MODULE_LOADED:
+            p->imports[module] = omni_new_cell(c->session->arena,
+                                               omni_new_int(c->session->arena, (int64_t)index + 1),
+                                               p->imports[module]);
+            break;
+        case OMNI_MODULE_CYCLE:
+            omni_modules_format_cycle(p->loader, index, chain, sizeof(chain));
+            unit_error(c, unit, arg, "E0009 import cycle: %s", chain);
+            ok = false;
+            break;
+        case OMNI_MODULE_MISSING:
+            unit_error(c, unit, arg, "E0009 cannot import %s: %s", path, strerror(errno));
+            ok = false;
+            break;
+        }
         free(path);
+    }
+    return ok;
+}
+
+/* Record the names (provide name ...) in unit lists; each must be one of
+ * the unit's definitions */
+static bool add_provides(Compiler* c, Program* p, const OmniSource* unit, int module,
+                         OmniValue** forms, size_t count, OmniValue* form) {
+    bool ok = true;
+    if (!p->provides[module]) p->provides[module] = omni_nil;
+    for (OmniValue* args = omni_cdr(form); omni_is_cell(args); args = omni_cdr(args)) {
+        OmniValue* name = omni_car(args);
+        if (!omni_is_sym(name)) {
+            char* text = omni_value_to_string(form);
+            unit_error(c, unit, form, "E0002 %s: expected (provide name...)", text);
+            free(text);
+            ok = false;
+            continue;
+        }
+        bool defined = false;
+        for (size_t i = 0; i < count && !defined; i++) {
+            const char* def = omni_defined_name(forms[i]);
+            defined = def && strcmp(def, name->str_val) == 0;
+            /* A type's name provides everything its deftype defines */
+            if (omni_is_deftype(forms[i]) &&
+                omni_sym_eq_str(omni_car(omni_cdr(forms[i])), name->str_val)) {
+                OmniValue* names = omni_deftype_names(c->session->arena, forms[i]);
+                for (OmniValue* n = names; omni_is_cell(n); n = omni_cdr(n)) {
+                    p->provides[module] = omni_new_cell(c->session->arena, omni_car(n), p->provides[module]);
+                }
+                defined = true;
+            }
+        }
+        if (!defined) {
+            unit_error(c, unit, name, "E0009 %s provides %s, which it does not define",
+                       unit->name ? unit->name : "the program", name->str_val);
+            ok = false;
+            continue;
+        }
+        p->provides[module] = omni_new_cell(c->session->arena, name, p->provides[module]);
+    }
+    return ok;
+}
+
+/* Add unit's forms to p, after those of the modules it imports */
+static bool add_unit(Compiler* c, Program* p, const OmniSource* unit, int module) {
+    OmniValue** forms = NULL;
+    size_t count = 0;
+    int lang;
+    if (!parse_unit(c, unit, &forms, &count, &lang)) return false;
+
+    bool ok = true;
+    for (size_t i = 0; i < count; i++) {
+        int needs = lang_form_level(forms[i]);
+        if (needs > lang) {
+            unit_error(c, unit, forms[i], "E0012 %s needs #lang purple/%d; %s is purple/%d",
+                       omni_car(forms[i])->str_val, needs,
+                       unit->name ? unit->name : "the program", lang);
+            ok = false;
+        }
+    }
+    if (!ok) {
+        free(forms);
+        return false;
+    }
+
+    /* Behaviour a later level changes, unless the file accepts it */
+    if (c->options.deprecations != OMNI_DEPRECATED_ALLOW) {
+        OmniDeprecatedUses* uses = omni_deprecations_find(forms, count, omni_deprecations_allowed(unit->text));
+        for (size_t i = 0; i < uses->count; i++) {
+            OmniDeprecatedUse* u = &uses->items[i];
+            char msg[400];
+            if (c->options.deprecations == OMNI_DEPRECATED_ERROR) {
+                unit_error(c, unit, u->at, "%s (-Werror=deprecated)", u->message);
+                ok = false;
+                continue;
+            }
+            snprintf(msg, sizeof(msg), "%s (deprecated; see --explain %s)", u->message,
+                     omni_deprecation_info(u->code)->id);
+            add_unit_warning(c, unit, u->at->line, u->at->column, msg);
+        }
+        omni_deprecations_free(uses);
+    }
+    program_add_module(p, module, unit->name);
+    for (size_t i = 0; i < count; i++) {
+        if (omni_is_import(forms[i])) ok = add_imports(c, p, unit, module, forms[i]) && ok;
+    }
+    /* Macros apply to the forms after their definition, imported ones
+     * included; a definition leaves no form behind. A type's definitions
+     * follow its deftype, which stays for the analysis and back ends. */
+    double start = now_ms();
+    OmniValue** types = calloc(count ? count : 1, sizeof(OmniValue*));
+    size_t made = 0;
+    for (size_t i = 0; i < count; i++) {
+        if (omni_is_import(forms[i]) || omni_is_provide(forms[i])) continue;
+        OmniMacroError err;
+        if (omni_is_defmacro(forms[i])) {
+            if (!omni_macros_define(p->macros, forms[i], &err)) {
+                unit_error(c, unit, err.at, "%s", err.message);
+                ok = false;
+            }
+            forms[i] = NULL;
+        } else if (omni_is_deftype(forms[i])) {
+            if (!(types[i] = omni_macros_deftype(p->macros, forms[i], &err))) {
+                unit_error(c, unit, err.at, "%s", err.message);
+                ok = false;
+            }
+            made += omni_list_len(types[i]);
+        } else if (!(forms[i] = omni_macros_expand(p->macros, forms[i], &err))) {
+            unit_error(c, unit, err.at, "%s", err.message);
+            ok = false;
+        }
+    }
+    if (made) {
+        OmniValue** all = malloc((count + made) * sizeof(OmniValue*));
+        size_t n = 0;
+        for (size_t i = 0; i < count; i++) {
+            all[n++] = forms[i];
+            for (OmniValue* d = types[i]; d && omni_is_cell(d); d = omni_cdr(d)) all[n++] = omni_car(d);
+        }
+        free(forms);
+        forms = all;
+        count = n;
+    }
+    free(types);
+    phase_add(c, OMNI_PHASE_EXPAND, start);
+    /* A module's private names matter only to its importers; the
+     * program's own provide is just checked */
+    for (size_t i = 0; i < count; i++) {
+        if (omni_is_provide(forms[i])) ok = add_provides(c, p, unit, module, forms, count, forms[i]) && ok;
+    }
+    for (size_t i = 0; i < count; i++) {
+        if (forms[i] && !omni_is_import(forms[i]) && !omni_is_provide(forms[i])) {
+            program_add_form(p, forms[i], module);
+        }
+    }
+    program_add_unit(p, unit);
+    free(forms);
+    return ok;
+}
+
+/* Parse every unit in order into one program, each after the modules it
+ * imports; false if any of them had errors */
+static bool assemble_program(Compiler* compiler, Program* p, const OmniSource* units, size_t unit_count) {
+    *p = (Program){ .loader = omni_modules_new(), .macros = omni_macros_new(compiler->session) };
+    if (compiler->options.fs) p->loader->fs = compiler->options.fs;
+    program_add_module(p, 0, NULL);
+    bool ok = true;
+    for (size_t i = 0; i < unit_count; i++) {
+        /* Forms from here on are new to an incremental build */
+        if (i == compiler->options.prior_units) compiler->prior_forms = p->count;
+        if (!units[i].text) {
+            program_add_unit(p, &units[i]);
+            continue;
+        }
+        size_t index;
+        if (units[i].name &&
+            omni_modules_load(p->loader, units[i].name, units[i].text, &index) == OMNI_MODULE_LOADED) {
+            /* Already imported by an earlier unit */
+            continue;
+        }
+        ok = add_unit(compiler, p, &units[i], 0) && ok;
+        if (units[i].name) omni_modules_done(p->loader, index);
+    }
+    if (compiler->options.prior_units >= unit_count) compiler->prior_forms = p->count;
+    return ok;
+}
+
+static void program_free(Program* p) {
+    free(p->exprs);
+    free(p->modules);
+    free(p->units);
+    free(p->ends);
+    free(p->provides);
+    free(p->imports);
+    free(p->names);
+    omni_modules_free(p->loader);
+    omni_macros_free(p->macros);
+}
+
+static char* compile_units(Compiler* compiler, const OmniSource* units, size_t unit_count) {
+    omni_query_free(compiler->query);
+    compiler->query = NULL;
+
+    Program p;
+    bool ok = assemble_program(compiler, &p, units, unit_count);
+
+    compiler->units = p.units;
+    compiler->unit_ends = p.ends;
+    compiler->unit_count = p.unit_count;
+    compiler->form_modules = p.modules;
+    compiler->provides = p.provides;
+    compiler->imports = p.imports;
+    compiler->module_names = p.names;
+    /* A program may be nothing but macro definitions, as a REPL or
+     * server definition is */
+    if (ok && p.count == 0 && omni_macros_count(p.macros) == 0) {
+        add_error(compiler, "No expressions to compile");
+        ok = false;
+    }
+    if (ok && compiler->embed_provenance) {
+        compiler->provenance = provenance_record(compiler, p.units, p.unit_count);
+    }
+    char* output = ok ? compile_exprs(compiler, p.exprs, p.count) : NULL;
+    if (output && compiler->options.standalone && compiler->options.runtime_path &&
+        !compiler->check_only) {
+        output = inline_runtime(compiler, output);
+    }
+    free(compiler->provenance);
+    compiler->provenance = NULL;
+    compiler->units = NULL;
+    compiler->unit_ends = NULL;
+    compiler->unit_count = 0;
+    compiler->form_modules = NULL;
+    compiler->provides = NULL;
+    compiler->imports = NULL;
+    compiler->module_names = NULL;
+    compiler->prior_forms = 0;
+
+    program_free(&p);
+    return output;
+}
+
+static void session_begin(Compiler* compiler) {
+    compiler->session = omni_session_new();
+}
+
+static void session_end(Compiler* compiler) {
+    omni_session_free(compiler->session);
+    compiler->session = NULL;
+}
+
+char* omni_compiler_compile_units_to_c(Compiler* compiler, const OmniSource* units, size_t unit_count) {
+    if (!compiler || !units) return NULL;
+    omni_compiler_clear_errors(compiler);
+
+    /* Each compile has its own session, so compilers never share (or
+     * accumulate) AST memory and can run on different threads */
+    session_begin(compiler);
+    char* output = compile_units(compiler, units, unit_count);
+    session_end(compiler);
+
+    return output;
+}
+
+const OmniQuery* omni_compiler_query(Compiler* compiler) {
+    return compiler ? compiler->query : NULL;
+}
+
+bool omni_compiler_check_units(Compiler* compiler, const OmniSource* units, size_t unit_count) {
+    if (!compiler || !units) return false;
+    compiler->check_only = true;
+    free(omni_compiler_compile_units_to_c(compiler, units, unit_count));
+    compiler->check_only = false;
+    return !omni_compiler_has_errors(compiler);
+}
+
+char* omni_compiler_expand_units(Compiler* compiler, const OmniSource* units, size_t unit_count) {
+    if (!compiler || !units) return NULL;
+    omni_compiler_clear_errors(compiler);
+
+    session_begin(compiler);
+    Program p;
+    char* output = NULL;
+    if (assemble_program(compiler, &p, units, unit_count)) {
+        size_t len = 0, cap = 256;
+        output = malloc(cap);
+        output[0] = '\0';
+        for (size_t i = 0; i < p.count; i++) {
+            char* text = omni_value_to_string(p.exprs[i]);
+            size_t n = strlen(text);
+            if (len + n + 2 > cap) {
+                while (len + n + 2 > cap) cap *= 2;
+                output = realloc(output, cap);
+            }
+            memcpy(output + len, text, n);
+            len += n;
+            output[len++] = '\n';
+            output[len] = '\0';
+            free(text);
+        }
+    }
+    compiler->prior_forms = 0;
+    program_free(&p);
+    session_end(compiler);
+
+    return output;
+}
+
+char* omni_compiler_compile_ast_to_c(Compiler* compiler, OmniValue** exprs, size_t count) {
+    if (!compiler || (!exprs && count > 0)) return NULL;
+    omni_compiler_clear_errors(compiler);
+
+    /* The trees belong to the caller; only compiler temporaries go in
+     * the session's arena */
+    session_begin(compiler);
+    char* output = NULL;
+    if (count == 0) {
+        add_error(compiler, "No expressions to compile");
+    } else {
+        output = compile_exprs(compiler, exprs, count);
+    }
+    session_end(compiler);
+
+    return output;
+}
+
+char* omni_compiler_compile_to_c(Compiler* compiler, const char* source) {
+    OmniSource unit = { NULL, source };
+    return source ? omni_compiler_compile_units_to_c(compiler, &unit, 1) : NULL;
+}
+
+char* omni_compiler_compile_file_to_c(Compiler* compiler, const char* filename) {
+    if (!compiler || !filename) return NULL;
+
+    char* source = omni_fs_read(compiler->options.fs, filename);
+    if (!source) {
+        add_error(compiler, "Cannot open file: %s", filename);
+        return NULL;
+    }
+
+    OmniSource unit = { filename, source };
+    char* result = omni_compiler_compile_units_to_c(compiler, &unit, 1);
+    free(source);
+    return result;
+}
+
+#ifndef OMNI_NO_EXEC
+
+/*
+ * Everything below builds, runs or inspects native binaries, and needs a
+ * C compiler and processes. Defining OMNI_NO_EXEC leaves it out, so the
+ * front end builds where there are neither (the wasm playground).
+ */
+
+/* ============== Binary Size ============== */
+
+/* The parts of an ELF section header used here, from either class */
+typedef struct {
+    size_t name, offset, size;
+    bool loaded;
+} SectionHeader;
+
+/* The section header at offset at; wide for ELFCLASS64. Headers are read
+ * in the byte order of this machine, which built the binary. */
+static SectionHeader section_header(const unsigned char* data, bool wide, size_t at) {
+    SectionHeader h;
+    if (wide) {
+        Elf64_Shdr sh;
+        memcpy(&sh, data + at, sizeof(sh));
+        h = (SectionHeader){ sh.sh_name, sh.sh_offset, sh.sh_size, (sh.sh_flags & SHF_ALLOC) != 0 };
+    } else {
+        Elf32_Shdr sh;
+        memcpy(&sh, data + at, sizeof(sh));
+        h = (SectionHeader){ sh.sh_name, sh.sh_offset, sh.sh_size, (sh.sh_flags & SHF_ALLOC) != 0 };
+    }
+    return h;
+}
+
+int omni_binary_sections(const char* path, OmniSectionSize* sections, size_t cap) {
+    size_t size = 0;
+    unsigned char* data = read_binary(path, &size);
+    if (!data || size < sizeof(Elf64_Ehdr) || memcmp(data, ELFMAG, SELFMAG) != 0 ||
+        (data[EI_CLASS] != ELFCLASS64 && data[EI_CLASS] != ELFCLASS32)) {
+        free(data);
+        return -1;
+    }
+
+    bool wide = data[EI_CLASS] == ELFCLASS64;
+    size_t shoff, shnum, shstrndx, entry;
+    if (wide) {
+        Elf64_Ehdr eh;
+        memcpy(&eh, data, sizeof(eh));
+        shoff = eh.e_shoff, shnum = eh.e_shnum, shstrndx = eh.e_shstrndx;
+        entry = sizeof(Elf64_Shdr);
+    } else {
+        Elf32_Ehdr eh;
+        memcpy(&eh, data, sizeof(eh));
+        shoff = eh.e_shoff, shnum = eh.e_shnum, shstrndx = eh.e_shstrndx;
+        entry = sizeof(Elf32_Shdr);
+    }
+    if (shoff > size || shnum > (size - shoff) / entry || shstrndx >= shnum) {
+        free(data);
+        return -1;
+    }
+
+    SectionHeader names = section_header(data, wide, shoff + shstrndx * entry);
+    int found = 0;
+    for (size_t i = 0; i < shnum; i++) {
+        SectionHeader sh = section_header(data, wide, shoff + i * entry);
+        if (!sh.loaded || sh.size == 0) continue;
+        if ((size_t)found < cap) {
+            size_t at = names.offset + sh.name;
+            const char* name = at < size ? (const char*)data + at : "";
+            int len = (int)strnlen(name, at < size ? size - at : 0);
+            snprintf(sections[found].name, sizeof(sections[found].name), "%.*s", len, name);
+            sections[found].size = (unsigned long)sh.size;
+        }
+        found++;
+    }
+    free(data);
+    return found;
+}
+
+bool omni_print_size_report(const char* path, FILE* out) {
+    int count = omni_binary_sections(path, NULL, 0);
+    if (count < 0) return false;
+    OmniSectionSize* sections = calloc((size_t)count + 1, sizeof(OmniSectionSize));
+    omni_binary_sections(path, sections, (size_t)count);
+
+    unsigned long total = 0;
+    fprintf(out, "Size of %s:\n", path);
+    for (int i = 0; i < count; i++) {
+        fprintf(out, "  %-20s %8lu\n", sections[i].name, sections[i].size);
+        total += sections[i].size;
+    }
+    fprintf(out, "  %-20s %8lu\n", "total", total);
+    free(sections);
+    return true;
+}
+
+char* omni_binary_provenance(const char* path) {
+    size_t size = 0;
+    unsigned char* data = read_binary(path, &size);
+    if (!data) return NULL;
+    /* The first copy of the magic string with a record after it; the
+     * compiler's own binary has the string alone */
+    const char* magic = OMNI_PROVENANCE_MAGIC;
+    size_t magic_len = strlen(magic);
+    char* record = NULL;
+    for (unsigned char* at = data; !record;) {
+        size_t left = size - (size_t)(at - data);
+        at = memmem(at, left, magic, magic_len);
+        if (!at) break;
+        unsigned char* end = memchr(at, '\0', size - (size_t)(at - data));
+        if (!end) break;
+        if ((size_t)(end - at) > magic_len) record = strndup((const char*)at, (size_t)(end - at));
+        at = end;
+    }
+    free(data);
+    return record;
+}
+
+int omni_verify_binary(const char* path, const char** sources, size_t count, FILE* out) {
+    char* record = omni_binary_provenance(path);
+    if (!record) {
+        fprintf(out, "%s: no build record (not built by omnilisp, or built before records)\n", path);
+        return 2;
+    }
+    char (*hashes)[65] = calloc(count + 1, sizeof(*hashes));
+    bool* used = calloc(count + 1, sizeof(bool));
+    int rc = 0;
+    for (size_t i = 0; i < count; i++) {
+        size_t size = 0;
+        unsigned char* data = read_binary(sources[i], &size);
+        if (!data && access(sources[i], R_OK) != 0) {
+            fprintf(out, "%s: cannot read\n", sources[i]);
+            rc = 2;
+            continue;
+        }
+        omni_sha256_hex(data ? (const void*)data : "", data ? size : 0, hashes[i]);
+        free(data);
+    }
+
+    /* The record's lines, each source matched with a file of the same hash */
+    for (char* line = record + strlen(OMNI_PROVENANCE_MAGIC); rc != 2 && *line;) {
+        char* next = strchr(line, '\n');
+        if (next) *next++ = '\0';
+        else next = line + strlen(line);
+        char* hash = strncmp(line, "source: ", 8) == 0 ? strstr(line, " sha256:") : NULL;
+        if (!hash) {
+            fprintf(out, "%s\n", line);
+            line = next;
+            continue;
+        }
+        const char* name = line + 8;
+        *hash = '\0';
+        hash += strlen(" sha256:");
+        size_t i = 0;
+        while (i < count && (used[i] || strcmp(hashes[i], hash) != 0)) i++;
+        if (i < count) {
+            used[i] = true;
+            if (strcmp(name, sources[i]) == 0) fprintf(out, "match: %s\n", name);
+            else fprintf(out, "match: %s (as %s)\n", name, sources[i]);
+        } else {
+            /* The file by that name, changed, or none */
+            i = 0;
+            while (i < count && (used[i] || strcmp(sources[i], name) != 0)) i++;
+            if (i < count) {
+                used[i] = true;
+                fprintf(out, "differs: %s (sha256:%s, built from sha256:%s)\n", name, hashes[i], hash);
+            } else {
+                fprintf(out, "missing: %s (no file given has sha256:%s)\n", name, hash);
+            }
+            rc = 1;
+        }
+        line = next;
+    }
+    for (size_t i = 0; rc != 2 && i < count; i++) {
+        if (used[i]) continue;
+        fprintf(out, "not a source: %s\n", sources[i]);
+        rc = 1;
+    }
+    if (rc != 2) {
+        fprintf(out, "%s: %s these sources\n", path, rc == 0 ? "built from" : "not built from");
+    }
+
+    free(used);
+    free(hashes);
+    free(record);
+    return rc;
+}
+
+/* ============== Temporary Files ============== */
+
+/* One directory per process, shared by every compiler in it */
+static char* g_temp_dir = NULL;
+static unsigned g_temp_seq = 0;
+static bool g_temp_kept = false;
+static bool g_temp_atexit = false;
+static pthread_mutex_t g_temp_lock = PTHREAD_MUTEX_INITIALIZER;
+
+/* Marks a directory that --keep-temps asked to leave alone */
+#define TEMP_KEEP_MARKER ".keep"
+
+static const char* temp_root(void) {
+    const char* root = getenv("PURPLE_TMPDIR");
+    return root && *root ? root : "/tmp";
+}
+
+/* Remove the session directories of processes that no longer exist,
+ * e.g. ones that crashed before cleaning up */
+static void prune_stale_sessions(const char* root) {
+    DIR* d = opendir(root);
+    if (!d) return;
+    struct dirent* e;
+    while ((e = readdir(d))) {
+        long pid;
+        char rest[16];
+        if (sscanf(e->d_name, "omnilisp-%ld-%15s", &pid, rest) != 2 || pid <= 0) continue;
+        if (pid == (long)getpid() || kill((pid_t)pid, 0) == 0 || errno != ESRCH) continue;
+
+        char path[4096];
+        snprintf(path, sizeof(path), "%s/%s/" TEMP_KEEP_MARKER, root, e->d_name);
+        if (access(path, F_OK) == 0) continue;
+        snprintf(path, sizeof(path), "%s/%s", root, e->d_name);
+        DIR* session = opendir(path);
+        if (!session) continue;
+        struct dirent* f;
+        while ((f = readdir(session))) {
+            if (strcmp(f->d_name, ".") != 0 && strcmp(f->d_name, "..") != 0) {
+                unlinkat(dirfd(session), f->d_name, 0);
+            }
+        }
+        closedir(session);
+        rmdir(path);
+    }
+    closedir(d);
+}
+
+/* Forget the directory, removing it if nothing was kept in it */
+static void temp_session_close(void) {
+    pthread_mutex_lock(&g_temp_lock);
+    if (g_temp_dir) {
+        rmdir(g_temp_dir);
+        free(g_temp_dir);
+        g_temp_dir = NULL;
+    }
+    g_temp_seq = 0;
+    g_temp_kept = false;
+    pthread_mutex_unlock(&g_temp_lock);
+}
+
+/* Create the directory on first use; called with g_temp_lock held */
+static bool temp_session_open(void) {
+    if (g_temp_dir) return true;
+    const char* root = temp_root();
+    if (mkdir(root, 0700) != 0 && errno != EEXIST) return false;
+    prune_stale_sessions(root);
+
+    size_t len = strlen(root) + 48;
+    char* dir = malloc(len);
+    snprintf(dir, len, "%s/omnilisp-%ld-XXXXXX", root, (long)getpid());
+    if (!mkdtemp(dir)) {
+        int err = errno;
+        free(dir);
+        errno = err;
+        return false;
+    }
+    g_temp_dir = dir;
+    if (!g_temp_atexit) {
+        atexit(temp_session_close);
+        g_temp_atexit = true;
+    }
+    return true;
+}
+
+char* omni_compiler_temp_path(Compiler* compiler, const char* suffix) {
+    pthread_mutex_lock(&g_temp_lock);
+    if (!temp_session_open()) {
+        int err = errno;
+        pthread_mutex_unlock(&g_temp_lock);
+        errno = err;
         return NULL;
     }
-    close(fd);
+    if (compiler && compiler->options.keep_temps && !g_temp_kept) {
+        char marker[4096];
+        snprintf(marker, sizeof(marker), "%s/" TEMP_KEEP_MARKER, g_temp_dir);
+        FILE* f = fopen(marker, "w");
+        if (f) fclose(f);
+        fprintf(stderr, "Keeping temporary files in %s\n", g_temp_dir);
+        g_temp_kept = true;
+    }
+    size_t len = strlen(g_temp_dir) + strlen(suffix) + 16;
+    char* path = malloc(len);
+    snprintf(path, len, "%s/%u%s", g_temp_dir, ++g_temp_seq, suffix);
+    pthread_mutex_unlock(&g_temp_lock);
     return path;
 }
 
-bool omni_compiler_compile_to_binary(Compiler* compiler, const char* source, const char* output) {
-    if (!compiler || !source || !output) return false;
+void omni_compiler_remove_temp(Compiler* compiler, const char* path) {
+    if (path && !(compiler && compiler->options.keep_temps)) unlink(path);
+}
 
-    /* Generate C code */
-    char* c_code = omni_compiler_compile_to_c(compiler, source);
-    if (!c_code) return false;
+const char* omni_compiler_temp_dir(void) {
+    pthread_mutex_lock(&g_temp_lock);
+    const char* dir = g_temp_dir;
+    pthread_mutex_unlock(&g_temp_lock);
+    return dir;
+}
 
-    /* Write to temp file */
-    char* c_file = create_temp_file(".c");
-    if (!c_file) {
+/* Stem for a build's source and object: the output itself without its
+ * extension when it is a temporary, else a fresh number */
+static char* temp_stem(Compiler* compiler, const char* output) {
+    const char* slash = strrchr(output, '/');
+    pthread_mutex_lock(&g_temp_lock);
+    bool temporary = g_temp_dir && slash && (size_t)(slash - output) == strlen(g_temp_dir) &&
+                     strncmp(output, g_temp_dir, slash - output) == 0;
+    pthread_mutex_unlock(&g_temp_lock);
+    if (!temporary) return omni_compiler_temp_path(compiler, "");
+
+    const char* dot = strchr(slash, '.');
+    size_t len = dot ? (size_t)(dot - output) : strlen(output);
+    char* stem = malloc(len + 1);
+    memcpy(stem, output, len);
+    stem[len] = '\0';
+    return stem;
+}
+
+static char* with_suffix(const char* stem, const char* suffix) {
+    size_t len = strlen(stem) + strlen(suffix) + 1;
+    char* path = malloc(len);
+    snprintf(path, len, "%s%s", stem, suffix);
+    return path;
+}
+
+/* ============== C Compiler ============== */
+
+/* Whether name is an executable in a directory of PATH */
+static bool on_path(const char* name) {
+    const char* path = getenv("PATH");
+    if (!path || !*path) path = "/usr/bin:/bin";
+    char file[4096];
+    for (const char* dir = path; dir;) {
+        const char* end = strchr(dir, ':');
+        size_t len = end ? (size_t)(end - dir) : strlen(dir);
+        snprintf(file, sizeof(file), "%.*s/%s", (int)len, len ? dir : ".", name);
+        if (access(file, X_OK) == 0) return true;
+        dir = end ? end + 1 : NULL;
+    }
+    return false;
+}
+
+char* omni_find_cc(const char* target) {
+    char names[3][256];
+    if (target) {
+        snprintf(names[0], sizeof(names[0]), "%s-gcc", target);
+        snprintf(names[1], sizeof(names[1]), "%s-cc", target);
+        snprintf(names[2], sizeof(names[2]), "clang");
+    } else {
+        snprintf(names[0], sizeof(names[0]), "gcc");
+        snprintf(names[1], sizeof(names[1]), "clang");
+        snprintf(names[2], sizeof(names[2]), "cc");
+    }
+    for (size_t i = 0; i < 3; i++) {
+        if (on_path(names[i])) return strdup(names[i]);
+    }
+    return NULL;
+}
+
+/* The compiler a build runs, as a new string: the option, else the one
+ * omni_find_cc finds. NULL, with an error, when there is none. */
+static char* build_cc(Compiler* compiler) {
+    if (compiler->options.cc) {
+        /* The command's first word, as "ccache gcc" runs ccache */
+        char name[1024];
+        snprintf(name, sizeof(name), "%.*s", (int)strcspn(compiler->options.cc, " "),
+                 compiler->options.cc);
+        if (strchr(name, '/') ? access(name, X_OK) != 0 : !on_path(name)) {
+            add_error(compiler, "C compiler not found: %s", name);
+            return NULL;
+        }
+        return strdup(compiler->options.cc);
+    }
+    char* cc = omni_find_cc(compiler->options.target);
+    if (!cc && compiler->options.target) {
+        add_error(compiler, "No C compiler for %s (tried %s-gcc, %s-cc and clang); pass -cc",
+                  compiler->options.target, compiler->options.target, compiler->options.target);
+    } else if (!cc) {
+        add_error(compiler, "No C compiler found (tried gcc, clang and cc); pass -cc or set CC");
+    }
+    return cc;
+}
+
+/* "--target=<triple> " when cc is clang, which builds for any target
+ * given this way; other compilers build only for their own */
+static void target_flag(Compiler* compiler, const char* cc, char* out, size_t cap) {
+    out[0] = '\0';
+    if (!compiler->options.target) return;
+    size_t len = strcspn(cc, " ");
+    const char* base = cc;
+    for (const char* p = cc; p < cc + len; p++) {
+        if (*p == '/') base = p + 1;
+    }
+    if (strncmp(base, "clang", 5) == 0) {
+        snprintf(out, cap, "--target=%s ", compiler->options.target);
+    }
+}
+
+bool omni_compiler_compile_to_binary(Compiler* compiler, const char* source, const char* output) {
+    OmniSource unit = { NULL, source };
+    return source ? omni_compiler_compile_units_to_binary(compiler, &unit, 1, output) : false;
+}
+
+/* Compile generated C (freed here) with cc and link it into output.
+ * Hot-reload builds are shared objects; a patch leaves the runtime to the
+ * program it is loaded into, and freestanding code is not linked at all. */
+static bool build_c_with(Compiler* compiler, const char* cc, char* c_code, const char* output) {
+    char* stem = temp_stem(compiler, output);
+    if (!stem) {
         add_error(compiler, "Failed to create temp file: %s", strerror(errno));
         free(c_code);
         return false;
     }
+    char* c_file = with_suffix(stem, ".c");
+    char* o_file = with_suffix(stem, ".o");
+    free(stem);
 
+    /* Write to temp file */
     FILE* f = fopen(c_file, "w");
     if (!f) {
         add_error(compiler, "Failed to write temp file: %s", strerror(errno));
         free(c_file);
+        free(o_file);
         free(c_code);
         return false;
     }
@@ -223,110 +1599,196 @@ bool omni_compiler_compile_to_binary(Compiler* compiler, const char* source, con
     fclose(f);
     free(c_code);
 
-    /* Build gcc command */
+    /* Compile to an object file */
     char cmd[2048];
-    const char* cc = compiler->options.cc ? compiler->options.cc : "gcc";
-
-    if (compiler->options.runtime_path) {
-        snprintf(cmd, sizeof(cmd),
-                 "%s -std=c99 -pthread -O%d %s%s%s -I%s/include -o %s %s -L%s -lpurple",
-                 cc,
-                 compiler->options.opt_level,
-                 compiler->options.emit_debug_info ? "-g " : "",
-                 compiler->options.enable_asan ? "-fsanitize=address " : "",
-                 compiler->options.enable_tsan ? "-fsanitize=thread " : "",
-                 compiler->options.runtime_path,
-                 output,
-                 c_file,
-                 compiler->options.runtime_path);
+    char flags[512];
+    bool shared = compiler->options.hot_reload || compiler->options.hot_patch ||
+                  compiler->options.incremental;
+    char opt[64];
+    if (compiler->options.size_profile) {
+        /* A section per function and object, for --gc-sections to drop */
+        snprintf(opt, sizeof(opt), "-Os -ffunction-sections -fdata-sections");
+    } else {
+        snprintf(opt, sizeof(opt), "-O%d", compiler->options.opt_level);
+    }
+    char target[288];
+    target_flag(compiler, cc, target, sizeof(target));
+    snprintf(flags, sizeof(flags), "%s%s %s%s%s%s%s%s", target, opt,
+             compiler->options.emit_debug_info ? "-g " : "",
+             compiler->options.enable_asan ? "-fsanitize=address " : "",
+             compiler->options.enable_tsan ? "-fsanitize=thread " : "",
+             shared ? "-fPIC -shared " : "",
+             compiler->options.cflags ? compiler->options.cflags : "",
+             compiler->options.cflags ? " " : "");
+
+    if (compiler->options.freestanding) {
+        /* Left for the target's own link */
+        snprintf(cmd, sizeof(cmd), "%s -std=c99 -ffreestanding %s-c -o %s %s",
+                 cc, flags, output, c_file);
+    } else if (compiler->options.runtime_path) {
+        snprintf(cmd, sizeof(cmd), "%s -std=c99 -pthread %s-I%s/include -c -o %s %s",
+                 cc, flags, compiler->options.runtime_path, o_file, c_file);
     } else {
-        snprintf(cmd, sizeof(cmd),
-                 "%s -std=c99 -pthread -O%d %s%s%s -o %s %s",
-                 cc,
-                 compiler->options.opt_level,
-                 compiler->options.emit_debug_info ? "-g " : "",
-                 compiler->options.enable_asan ? "-fsanitize=address " : "",
-                 compiler->options.enable_tsan ? "-fsanitize=thread " : "",
-                 output,
-                 c_file);
+        snprintf(cmd, sizeof(cmd), "%s -std=c99 -pthread %s-c -o %s %s",
+                 cc, flags, o_file, c_file);
     }
 
     if (compiler->options.verbose) {
         fprintf(stderr, "Compiling: %s\n", cmd);
     }
 
+    double start = now_ms();
     int status = system(cmd);
-    unlink(c_file);
+    phase_add(compiler, OMNI_PHASE_CC, start);
+    omni_compiler_remove_temp(compiler, c_file);
     free(c_file);
 
     if (status != 0) {
         add_error(compiler, "C compilation failed with status %d", status);
+        omni_compiler_remove_temp(compiler, o_file);
+        free(o_file);
+        return false;
+    }
+    if (compiler->options.freestanding) {
+        free(o_file);
+        return true;
+    }
+
+    /* Link against the runtime; patches and incremental objects use the
+     * one already loaded */
+    if (compiler->options.size_profile) {
+        size_t len = strlen(flags);
+        snprintf(flags + len, sizeof(flags) - len, "-Wl,--gc-sections ");
+    }
+    const char* link_with = compiler->options.link_with ? compiler->options.link_with : "";
+    const char* link_sep = compiler->options.link_with ? " " : "";
+    if (compiler->options.hot_patch || compiler->options.incremental) {
+        snprintf(cmd, sizeof(cmd), "%s %s-o %s %s", cc, flags, output, o_file);
+    } else if (compiler->options.runtime_path) {
+        snprintf(cmd, sizeof(cmd), "%s -pthread %s-o %s %s%s%s -L%s -lpurple -lm",
+                 cc, flags, output, o_file, link_sep, link_with, compiler->options.runtime_path);
+    } else {
+        snprintf(cmd, sizeof(cmd), "%s -pthread %s-o %s %s%s%s -lm",
+                 cc, flags, output, o_file, link_sep, link_with);
+    }
+    if (compiler->options.ldflags) {
+        /* Last, so libraries in them resolve what the objects need */
+        size_t len = strlen(cmd);
+        snprintf(cmd + len, sizeof(cmd) - len, " %s", compiler->options.ldflags);
+    }
+
+    if (compiler->options.verbose) {
+        fprintf(stderr, "Linking: %s\n", cmd);
+    }
+
+    start = now_ms();
+    status = system(cmd);
+    phase_add(compiler, OMNI_PHASE_LINK, start);
+    omni_compiler_remove_temp(compiler, o_file);
+    free(o_file);
+
+    if (status != 0) {
+        add_error(compiler, "Linking failed with status %d", status);
         return false;
     }
 
     return true;
 }
 
-char* omni_compiler_compile_file_to_c(Compiler* compiler, const char* filename) {
-    if (!compiler || !filename) return NULL;
-
-    FILE* f = fopen(filename, "r");
-    if (!f) {
-        add_error(compiler, "Cannot open file: %s", filename);
-        return NULL;
+static bool build_c(Compiler* compiler, char* c_code, const char* output) {
+    char* cc = build_cc(compiler);
+    if (!cc) {
+        free(c_code);
+        return false;
     }
+    bool ok = build_c_with(compiler, cc, c_code, output);
+    free(cc);
+    return ok;
+}
 
-    /* Read file contents */
-    fseek(f, 0, SEEK_END);
-    long size = ftell(f);
-    fseek(f, 0, SEEK_SET);
+bool omni_compiler_compile_units_to_binary(Compiler* compiler, const OmniSource* units,
+                                           size_t unit_count, const char* output) {
+    if (!compiler || !units || !output) return false;
+    /* Programs carry their record; shared and freestanding objects have no main() */
+    compiler->embed_provenance = !compiler->options.freestanding && !compiler->options.hot_reload &&
+                                 !compiler->options.hot_patch && !compiler->options.incremental;
+    char* c_code = omni_compiler_compile_units_to_c(compiler, units, unit_count);
+    compiler->embed_provenance = false;
+    return c_code && build_c(compiler, c_code, output);
+}
 
-    char* source = malloc(size + 1);
-    size_t read = fread(source, 1, size, f);
-    source[read] = '\0';
-    fclose(f);
+bool omni_compiler_compile_ast_to_binary(Compiler* compiler, OmniValue** exprs, size_t count,
+                                         const char* output) {
+    if (!compiler || !output) return false;
+    char* c_code = omni_compiler_compile_ast_to_c(compiler, exprs, count);
+    return c_code && build_c(compiler, c_code, output);
+}
 
-    char* result = omni_compiler_compile_to_c(compiler, source);
-    free(source);
-    return result;
+bool omni_compiler_build_runtime(Compiler* compiler, const char* output) {
+    if (!compiler || !output) return false;
+    if (!compiler->options.runtime_path) {
+        add_error(compiler, "Incremental builds need the libpurple runtime");
+        return false;
+    }
+
+    /* Every member, not just those a program happens to use, since later
+     * objects may call any of them */
+    char* cc = build_cc(compiler);
+    if (!cc) return false;
+    char target[288];
+    target_flag(compiler, cc, target, sizeof(target));
+    char cmd[2048];
+    snprintf(cmd, sizeof(cmd), "%s %s-pthread -shared -o %s -Wl,--whole-archive %s/libpurple.a "
+             "-Wl,--no-whole-archive -lm%s%s", cc, target, output, compiler->options.runtime_path,
+             compiler->options.ldflags ? " " : "",
+             compiler->options.ldflags ? compiler->options.ldflags : "");
+    free(cc);
+    if (compiler->options.verbose) {
+        fprintf(stderr, "Linking: %s\n", cmd);
+    }
+
+    double start = now_ms();
+    int status = system(cmd);
+    phase_add(compiler, OMNI_PHASE_LINK, start);
+    if (status != 0) {
+        add_error(compiler, "Linking failed with status %d", status);
+        return false;
+    }
+    return true;
 }
 
 bool omni_compiler_compile_file_to_binary(Compiler* compiler, const char* filename, const char* output) {
     if (!compiler || !filename || !output) return false;
 
-    FILE* f = fopen(filename, "r");
-    if (!f) {
+    char* source = omni_fs_read(compiler->options.fs, filename);
+    if (!source) {
         add_error(compiler, "Cannot open file: %s", filename);
         return false;
     }
 
-    /* Read file contents */
-    fseek(f, 0, SEEK_END);
-    long size = ftell(f);
-    fseek(f, 0, SEEK_SET);
-
-    char* source = malloc(size + 1);
-    size_t read = fread(source, 1, size, f);
-    source[read] = '\0';
-    fclose(f);
-
-    bool result = omni_compiler_compile_to_binary(compiler, source, output);
+    OmniSource unit = { filename, source };
+    bool result = omni_compiler_compile_units_to_binary(compiler, &unit, 1, output);
     free(source);
     return result;
 }
 
 int omni_compiler_run(Compiler* compiler, const char* source) {
-    if (!compiler || !source) return -1;
+    OmniSource unit = { NULL, source };
+    return source ? omni_compiler_run_units(compiler, &unit, 1) : -1;
+}
+
+int omni_compiler_run_units(Compiler* compiler, const OmniSource* units, size_t unit_count) {
+    if (!compiler || !units) return -1;
 
     /* Compile to temp binary */
-    char* bin_file = create_temp_file("");
+    char* bin_file = omni_compiler_temp_path(compiler, "");
     if (!bin_file) {
-        add_error(compiler, "Failed to create temp file");
+        add_error(compiler, "Failed to create temp file: %s", strerror(errno));
         return -1;
     }
 
-    if (!omni_compiler_compile_to_binary(compiler, source, bin_file)) {
-        unlink(bin_file);
+    if (!omni_compiler_compile_units_to_binary(compiler, units, unit_count, bin_file)) {
+        omni_compiler_remove_temp(compiler, bin_file);
         free(bin_file);
         return -1;
     }
@@ -339,7 +1801,7 @@ int omni_compiler_run(Compiler* compiler, const char* source) {
         _exit(127);  /* exec failed */
     } else if (pid < 0) {
         add_error(compiler, "Failed to fork: %s", strerror(errno));
-        unlink(bin_file);
+        omni_compiler_remove_temp(compiler, bin_file);
         free(bin_file);
         return -1;
     }
@@ -348,7 +1810,7 @@ int omni_compiler_run(Compiler* compiler, const char* source) {
     int status;
     waitpid(pid, &status, 0);
 
-    unlink(bin_file);
+    omni_compiler_remove_temp(compiler, bin_file);
     free(bin_file);
 
     if (WIFEXITED(status)) {
@@ -356,3 +1818,5 @@ int omni_compiler_run(Compiler* compiler, const char* source) {
     }
     return -1;
 }
+
+#endif /* OMNI_NO_EXEC */
@@ -12,12 +12,29 @@
 #include "../parser/parser.h"
 #include "../analysis/analysis.h"
 #include "../codegen/codegen.h"
+#include "../fs/fs.h"
+#include "../query/query.h"
+#include "../deprecate/deprecate.h"
 #include <stdbool.h>
+#include <stdio.h>
 
 #ifdef __cplusplus
 extern "C" {
 #endif
 
+/* ============== Language Levels ============== */
+
+/* A file asks for a level of the language with "#lang purple/N" as its
+ * first line (after any #! line); files without one get
+ * CompilerOptions.lang. Level 1 is the language before modules and
+ * macros, where import, provide and defmacro are errors; level 2 is the
+ * language as it is now. */
+#define OMNI_LANG_FIRST 1
+#define OMNI_LANG_LATEST 2
+
+/* The level "purple/N" names, or 0 if this compiler does not know it */
+int omni_lang_parse(const char* name);
+
 /* ============== Compiler Options ============== */
 
 typedef struct CompilerOptions {
@@ -25,10 +42,16 @@ typedef struct CompilerOptions {
     const char* output_file;      /* Output file path (NULL = stdout) */
     bool emit_c_only;             /* Just emit C code, don't compile */
     bool verbose;                 /* Verbose output */
+    bool script_mode;             /* Don't echo top-level results */
+    bool script_exit;             /* Exit with the last top-level expression's
+                                   * value (-script) */
+    bool mark_results;            /* Frame echoed results (see OMNI_RESULT_BEGIN) */
 
     /* Runtime options */
     const char* runtime_path;     /* Path to runtime library */
     bool use_embedded_runtime;    /* Use embedded runtime */
+    bool standalone;              /* Inline libpurple's sources into the C, which
+                                   * then builds without it (-c --standalone) */
 
     /* Optimization options */
     int opt_level;                /* 0=debug, 1=default, 2=aggressive */
@@ -36,29 +59,136 @@ typedef struct CompilerOptions {
     bool enable_dps;              /* Enable destination-passing style */
 
     /* Debug options */
-    bool emit_debug_info;         /* Emit debug symbols */
+    bool emit_debug_info;         /* -g: debug symbols and the crash handler */
     bool enable_asan;             /* Enable AddressSanitizer */
     bool enable_tsan;             /* Enable ThreadSanitizer */
+    size_t record_steps;          /* Keep the last N calls for debug-history (0 = off) */
+    bool checked;                 /* List operations return an error for improper lists */
+    bool constraint_check;        /* Report objects freed while an inferred borrow is open */
+    bool coop_cancel;             /* Check for cancellation on every function entry */
+    unsigned strategies;          /* OmniStrategy mask (libpurple only), 0 = default release */
+    OmniMemoryMode memory;        /* -O: memory strategies the code and embedded runtime use */
+
+    /* Language */
+    int lang;                     /* -lang: level of files without #lang (0 = OMNI_LANG_LATEST) */
+
+    /* Diagnostics */
+    OmniShadowPolicy shadowing;   /* Bindings that hide primitives or built-in forms */
+    OmniDeprecatedPolicy deprecations; /* Uses of behaviour a later level changes */
+
+    /* Hot reload (libpurple runtime only) */
+    bool hot_reload;              /* Build a shared object whose functions can be swapped */
+    const char* hot_patch;        /* Build a patch replacing only this function */
+
+    /* Incremental builds (libpurple runtime only; see cli/repl.h) */
+    bool incremental;             /* Build a shared object that installs its functions when loaded */
+    size_t prior_units;           /* Leading units built into objects already loaded */
+
+    /* Size profile, for small targets */
+    bool size_profile;            /* -Os, unused code dropped at link, trimmed embedded runtime */
+    bool minimal_io;              /* Embedded runtime prints without the printf family */
+
+    /* Freestanding code, for kernels and firmware: no libc, no threads.
+     * The embedded runtime allocates with purple_malloc/purple_free and
+     * prints with purple_putchar, which the target supplies, and the
+     * program runs when the target calls purple_main(). Binaries are
+     * relocatable objects for the target's own link. */
+    bool freestanding;
+
+    /* Out of memory (embedded runtime): allocations that would take the
+     * heap over heap_limit bytes fail like ones the allocator refuses */
+    size_t heap_limit;            /* 0 = no limit */
+    OmniOomPolicy oom_policy;     /* Abort, or unwind to catch-oom */
 
     /* C compiler options */
-    const char* cc;               /* C compiler (default: gcc) */
+    const char* cc;               /* C compiler (NULL = omni_find_cc's for target) */
     const char* cflags;           /* Additional CFLAGS */
+    const char* ldflags;          /* Additional flags for the link */
+    const char* link_with;        /* Objects and libraries added to the link, such as
+                                   * one defining purple_malloc and purple_free */
+    const char* target;           /* Target triple to build for (NULL = this machine):
+                                   * clang gets --target, other compilers are the
+                                   * target's own, such as aarch64-linux-gnu-gcc */
+
+    /* Temporary files (see omni_compiler_temp_path) */
+    bool keep_temps;              /* Leave generated sources and binaries for inspection */
+
+    /* Sources: where input files and the modules they import are read
+     * from, such as an editor's buffers (NULL = the OS's files) */
+    const OmniFS* fs;
 } CompilerOptions;
 
+/* ============== Pipeline Phases ============== */
+
+typedef enum {
+    OMNI_PHASE_PARSE = 0,         /* Source text -> AST */
+    OMNI_PHASE_EXPAND,            /* Macros and deftypes -> plain forms */
+    OMNI_PHASE_ANALYSIS,          /* Liveness, escape, ownership, ... */
+    OMNI_PHASE_CODEGEN,           /* AST -> C source */
+    OMNI_PHASE_CC,                /* C source -> object file */
+    OMNI_PHASE_LINK,              /* Object file + runtime -> binary */
+    OMNI_PHASE_COUNT
+} CompilerPhase;
+
+/* ============== Source Units ============== */
+
+/* A named piece of source text. The name (usually a file path) is used to
+ * attribute diagnostics; it may be NULL for inline expressions. */
+typedef struct OmniSource {
+    const char* name;
+    const char* text;
+} OmniSource;
+
 /* ============== Compiler State ============== */
 
 typedef struct Compiler {
     CompilerOptions options;
 
     /* Internal state */
-    OmniArena* arena;
-    AnalysisContext* analysis;
-    CodeGenContext* codegen;
+    OmniSession* session;     /* The compile in progress: its nodes, type and
+                               * summary registries and code generator */
+
+    /* The units being compiled and the number of forms read by the end
+     * of each, so errors can name the file and line they point at */
+    const OmniSource* units;
+    size_t* unit_ends;
+    size_t unit_count;
+
+    /* Imported modules, as handed to the code generator */
+    const int* form_modules;
+    OmniValue** provides;
+    OmniValue** imports;
+    const char** module_names;
+    size_t prior_forms;       /* Forms read from options.prior_units */
+
+    /* The record a binary being built carries (see omni_binary_provenance) */
+    bool embed_provenance;
+    char* provenance;
+
+    /* Compiling only for the diagnostics (see omni_compiler_check_units) */
+    bool check_only;
 
     /* Error handling */
     char** errors;
     size_t error_count;
     size_t error_capacity;
+
+    /* Warnings (do not stop compilation) */
+    char** warnings;
+    size_t warning_count;
+    size_t warning_capacity;
+
+    /* Accumulated wall-clock time per phase, in milliseconds */
+    double phase_ms[OMNI_PHASE_COUNT];
+
+    /* Conses of the last compilation that reuse a dead pair's memory */
+    size_t reuses;
+
+    /* Frees of the last compilation placed at a pair's last use */
+    size_t frees;
+
+    /* What the last compilation's analysis found (see omni_compiler_query) */
+    OmniQuery* query;
 } Compiler;
 
 /* ============== Compiler API ============== */
@@ -77,21 +207,158 @@ void omni_compiler_set_runtime(Compiler* compiler, const char* path);
 
 /* ============== Compilation ============== */
 
+/*
+ * The functions that build, run or inspect native binaries (those taking
+ * an output path, run, Binary Size, omni_binary_provenance,
+ * omni_verify_binary and Temporary Files) need a C compiler and processes.
+ * Building with OMNI_NO_EXEC defined leaves them out; the rest only needs
+ * memory and an OmniFS.
+ */
+
 /* Compile source string to C code */
 char* omni_compiler_compile_to_c(Compiler* compiler, const char* source);
 
-/* Compile source string to binary */
-bool omni_compiler_compile_to_binary(Compiler* compiler, const char* source, const char* output);
-
 /* Compile source file to C code */
 char* omni_compiler_compile_file_to_c(Compiler* compiler, const char* filename);
 
+/* Multi-unit variant: units are parsed in order into a single program */
+char* omni_compiler_compile_units_to_c(Compiler* compiler, const OmniSource* units, size_t count);
+
+#ifndef OMNI_NO_EXEC
+/* Compile source string to binary */
+bool omni_compiler_compile_to_binary(Compiler* compiler, const char* source, const char* output);
+
 /* Compile source file to binary */
 bool omni_compiler_compile_file_to_binary(Compiler* compiler, const char* filename, const char* output);
 
 /* Compile and run in memory (JIT-style) */
 int omni_compiler_run(Compiler* compiler, const char* source);
 
+bool omni_compiler_compile_units_to_binary(Compiler* compiler, const OmniSource* units,
+                                           size_t count, const char* output);
+int omni_compiler_run_units(Compiler* compiler, const OmniSource* units, size_t count);
+#endif
+
+/* The program's forms after macro expansion, one per line, as source
+ * text; NULL if the units do not parse or expand */
+char* omni_compiler_expand_units(Compiler* compiler, const OmniSource* units, size_t count);
+
+/* Parse, expand, analyze and generate code for the units only for the
+ * errors and warnings that finds, without the runtime or a C compiler.
+ * true when there are no errors. */
+bool omni_compiler_check_units(Compiler* compiler, const OmniSource* units, size_t count);
+
+/* What the analysis of the last compilation or check found: its types,
+ * function summaries, and the ownership and shape of the variables at
+ * each place in its units (see query.h). NULL if that compilation did
+ * not get as far as analysis. It stays valid until the next compilation
+ * or omni_compiler_free. */
+const OmniQuery* omni_compiler_query(Compiler* compiler);
+
+/* Compile trees built with the AST API (see ast.h) to C code. The trees
+ * are checked with omni_ast_check first; malformed ones are reported as
+ * errors and nothing is generated. The caller keeps ownership. */
+char* omni_compiler_compile_ast_to_c(Compiler* compiler, OmniValue** exprs, size_t count);
+
+#ifndef OMNI_NO_EXEC
+/* Same, compiled and linked into output (a shared object when hot_reload,
+ * hot_patch or incremental is set, an unlinked object when freestanding) */
+bool omni_compiler_compile_ast_to_binary(Compiler* compiler, OmniValue** exprs, size_t count,
+                                         const char* output);
+
+/* Link the libpurple runtime into a shared object that exports all of it,
+ * for incremental objects to be loaded against */
+bool omni_compiler_build_runtime(Compiler* compiler, const char* output);
+
+/* The first C compiler on PATH that builds for target (NULL = this
+ * machine): gcc, clang or cc, or for a target <target>-gcc, <target>-cc
+ * or clang. A new string, or NULL if there is none. */
+char* omni_find_cc(const char* target);
+
+/* ============== Binary Size ============== */
+
+/* A section of a built binary that is loaded when it runs */
+typedef struct {
+    char name[32];
+    unsigned long size;
+} OmniSectionSize;
+
+/* The loaded sections of the ELF file at path, in file order. Returns how
+ * many there are (only the first cap are stored), or -1 if the file cannot
+ * be read as ELF. */
+int omni_binary_sections(const char* path, OmniSectionSize* sections, size_t cap);
+
+/* Print the size of each loaded section of the binary at path, and their
+ * total; false if it cannot be read as ELF */
+bool omni_print_size_report(const char* path, FILE* out);
+#endif
+
+/* ============== Provenance ============== */
+
+/*
+ * Every program binary records what built it: the compiler version, a
+ * hash of the runtime (libpurple's archive, or the embedded runtime as
+ * the options generate it), the options that change the code, and a
+ * hash of each source, the modules it imports included. Nothing in it
+ * depends on the time or on temporary paths, so building the same
+ * sources the same way gives the same record. The program prints it
+ * when run with --purple-info as its only argument:
+ *
+ *     purple-info 1
+ *     compiler: omnilisp 0.1.0
+ *     runtime: embedded sha256:3b0c...
+ *     flags: -O2 script checked
+ *     source: lib/util.omni sha256:9e1f...
+ *     source: prog.omni sha256:51be...
+ *
+ * Shared objects (hot reload, incremental) and freestanding objects
+ * have no main() and no record.
+ */
+
+#define OMNI_PROVENANCE_MAGIC "purple-info 1\n"
+
+/* SHA-256 of size bytes at data, as 64 lowercase hex digits and a NUL */
+void omni_sha256_hex(const void* data, size_t size, char hex[65]);
+
+#ifndef OMNI_NO_EXEC
+/* The record in the binary at path, as a new string; NULL if it cannot
+ * be read or has none */
+char* omni_binary_provenance(const char* path);
+
+/*
+ * Check that the binary at path was built from the files sources: each
+ * source its record lists has the hash of one of them, and each of them
+ * is listed. Prints the record's compiler, runtime and flags and, for
+ * each source, whether a file matched, a file of the same name differs
+ * or none was given, to out. Returns 0 when everything matched, 1 when something
+ * did not, and 2 when the binary has no record or a file cannot be read,
+ * as --diff does.
+ */
+int omni_verify_binary(const char* path, const char** sources, size_t count, FILE* out);
+#endif
+
+/* ============== Temporary Files ============== */
+
+#ifndef OMNI_NO_EXEC
+
+/* Generated sources, objects and binaries go in one directory per process,
+ * created on first use under $PURPLE_TMPDIR (default /tmp) and named
+ * omnilisp-<pid>-XXXXXX. Files in it are numbered in creation order, and
+ * a build names its source and object after a numbered output (3.c and
+ * 3.o for binary 3). Directories left by processes that died are pruned
+ * when a new one is created, unless they were kept. */
+
+/* Allocate the next numbered path with the given suffix, or NULL with
+ * errno set if the directory cannot be created. The caller frees it. */
+char* omni_compiler_temp_path(Compiler* compiler, const char* suffix);
+
+/* Delete a file from omni_compiler_temp_path unless keep_temps is set */
+void omni_compiler_remove_temp(Compiler* compiler, const char* path);
+
+/* The directory in use, or NULL before the first temporary file */
+const char* omni_compiler_temp_dir(void);
+#endif /* OMNI_NO_EXEC */
+
 /* ============== Error Handling ============== */
 
 /* Check if there are errors */
@@ -106,12 +373,35 @@ const char* omni_compiler_get_error(Compiler* compiler, size_t index);
 /* Clear errors */
 void omni_compiler_clear_errors(Compiler* compiler);
 
+/* Get warning count */
+size_t omni_compiler_warning_count(Compiler* compiler);
+
+/* Get warning message at index */
+const char* omni_compiler_get_warning(Compiler* compiler, size_t index);
+
+/* ============== Phase Timing ============== */
+
+/* Get the accumulated time spent in a phase (milliseconds) */
+double omni_compiler_phase_time(Compiler* compiler, CompilerPhase phase);
+
+/* Get the display name of a phase */
+const char* omni_compiler_phase_name(CompilerPhase phase);
+
+/* Reset all phase timers */
+void omni_compiler_reset_timings(Compiler* compiler);
+
+/* Print a per-phase timing table */
+void omni_compiler_print_timings(Compiler* compiler, FILE* out);
+
+/* Print what the optimisations of the last compilation did */
+void omni_compiler_print_stats(Compiler* compiler, FILE* out);
+
 /* ============== Utilities ============== */
 
 /* Initialize compiler subsystems */
 void omni_compiler_init(void);
 
-/* Cleanup compiler subsystems */
+/* Cleanup compiler subsystems, removing the temp directory if empty */
 void omni_compiler_cleanup(void);
 
 /* Get compiler version string */
@@ -0,0 +1,199 @@
+/*
+ * OmniLisp Deprecations Implementation
+ */
+
+#include "deprecate.h"
+#include <ctype.h>
+#include <stdarg.h>
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <strings.h>
+
+/* Longest form quoted in a message */
+#define DEPRECATE_SNIPPET_MAX 60
+
+/* ============== Catalog ============== */
+
+static const OmniDeprecationInfo g_deprecations[] = {
+    { OMNI_DEPRECATED_ZERO_IS_FALSE, "D0001", "0 as a false test",
+      "if, cond, when, unless, and and or treat 0 and 0.0 as false, although\n"
+      "the language makes nil its only false value. A later level will\n"
+      "follow the language, and 0 will be true. A test that is the literal 0\n"
+      "relies on the old behaviour. Write '() for a test that is always\n"
+      "false, and compare numbers explicitly, (= n 0), where a value may be\n"
+      "0.\n" },
+    { OMNI_DEPRECATED_DIVIDE_BY_ZERO, "D0002", "division by a literal 0",
+      "(/ x 0) and (% x 0) give 0 with libpurple and stop a program built\n"
+      "with the embedded runtime. Division by zero will return an error\n"
+      "value on both, as other failing primitives do. Test the divisor\n"
+      "before dividing, or use the error once it is returned. Dividing by\n"
+      "0.0 is not affected: it gives an infinity or NaN, as IEEE floats do.\n" },
+};
+
+const OmniDeprecationInfo* omni_deprecation_info(OmniDeprecation code) {
+    for (size_t i = 0; i < sizeof(g_deprecations) / sizeof(g_deprecations[0]); i++) {
+        if (g_deprecations[i].code == code) return &g_deprecations[i];
+    }
+    return NULL;
+}
+
+const OmniDeprecationInfo* omni_deprecation_lookup(const char* id) {
+    if (!id) return NULL;
+    for (size_t i = 0; i < sizeof(g_deprecations) / sizeof(g_deprecations[0]); i++) {
+        if (strcasecmp(g_deprecations[i].id, id) == 0) return &g_deprecations[i];
+    }
+    return NULL;
+}
+
+/* ============== Pragmas ============== */
+
+#define PRAGMA "allow-deprecated"
+
+unsigned omni_deprecations_allowed(const char* source) {
+    unsigned allowed = 0;
+    for (const char* line = source; line && *line;) {
+        const char* p = line;
+        while (*p == ' ' || *p == '\t') p++;
+        if (*p == ';') {
+            while (*p == ';' || *p == ' ' || *p == '\t') p++;
+            if (strncmp(p, PRAGMA, strlen(PRAGMA)) == 0) {
+                p += strlen(PRAGMA);
+                /* Codes, separated by blanks or commas, to the end of the line */
+                while (*p && *p != '\n') {
+                    while (*p != '\n' && (isspace((unsigned char)*p) || *p == ',')) p++;
+                    char id[16];
+                    size_t n = 0;
+                    while (*p && !isspace((unsigned char)*p) && *p != ',') {
+                        if (n < sizeof(id) - 1) id[n++] = *p;
+                        p++;
+                    }
+                    id[n] = '\0';
+                    const OmniDeprecationInfo* info = omni_deprecation_lookup(id);
+                    if (info) allowed |= 1u << info->code;
+                }
+            }
+        }
+        line = strchr(p, '\n');
+        if (line) line++;
+    }
+    return allowed;
+}
+
+/* ============== Finding Uses ============== */
+
+typedef struct {
+    OmniDeprecatedUses* uses;
+    OmniValue** forms;        /* The program, for the names it defines */
+    size_t count;
+    unsigned allowed;
+} DeprecateWalk;
+
+static bool is_form(OmniValue* x, const char* name) {
+    return omni_is_cell(x) && omni_sym_eq_str(omni_car(x), name);
+}
+
+/* Whether the program defines name at top level, replacing a primitive */
+static bool redefined(DeprecateWalk* w, const char* name) {
+    for (size_t i = 0; i < w->count; i++) {
+        if (!is_form(w->forms[i], "define")) continue;
+        OmniValue* target = omni_car(omni_cdr(w->forms[i]));
+        if (omni_is_cell(target)) target = omni_car(target);
+        if (omni_sym_eq_str(target, name)) return true;
+    }
+    return false;
+}
+
+/* Text of v for a message, cut short when long */
+static void snippet(OmniValue* v, char* buf, size_t cap) {
+    char* text = omni_value_to_string(v);
+    if (!text) {
+        snprintf(buf, cap, "?");
+        return;
+    }
+    if (strlen(text) > DEPRECATE_SNIPPET_MAX) {
+        snprintf(buf, cap, "%.*s...", DEPRECATE_SNIPPET_MAX - 3, text);
+    } else {
+        snprintf(buf, cap, "%s", text);
+    }
+    free(text);
+}
+
+static void add_use(DeprecateWalk* w, OmniDeprecation code, OmniValue* at, const char* fmt, ...) {
+    if (w->allowed & (1u << code)) return;
+    OmniDeprecatedUses* u = w->uses;
+    if (u->count == u->capacity) {
+        u->capacity = u->capacity ? u->capacity * 2 : 8;
+        u->items = realloc(u->items, u->capacity * sizeof(OmniDeprecatedUse));
+    }
+    OmniDeprecatedUse* use = &u->items[u->count++];
+    use->code = code;
+    use->at = at;
+    int n = snprintf(use->message, sizeof(use->message), "%s ", omni_deprecation_info(code)->id);
+    va_list args;
+    va_start(args, fmt);
+    vsnprintf(use->message + n, sizeof(use->message) - (size_t)n, fmt, args);
+    va_end(args);
+}
+
+static bool is_zero(OmniValue* x) {
+    return (omni_is_int(x) && x->int_val == 0) || (omni_is_float(x) && x->float_val == 0.0);
+}
+
+/* D0001: test, the test of form, is a literal 0 */
+static void check_test(DeprecateWalk* w, OmniValue* form, OmniValue* test) {
+    if (!is_zero(test)) return;
+    char text[DEPRECATE_SNIPPET_MAX + 8];
+    snippet(form, text, sizeof(text));
+    add_use(w, OMNI_DEPRECATED_ZERO_IS_FALSE, test,
+            "%s tests 0, which is false now and will be true; use '() for false", text);
+}
+
+static void walk(DeprecateWalk* w, OmniValue* x) {
+    if (omni_is_array(x)) {
+        for (size_t i = 0; i < x->array.len; i++) walk(w, x->array.data[i]);
+        return;
+    }
+    if (!omni_is_cell(x)) return;
+    /* Data, and macro bodies, which the expander runs on its own terms */
+    if (is_form(x, "quote") || is_form(x, "quasiquote") || is_form(x, "defmacro")) return;
+
+    OmniValue* args = omni_cdr(x);
+    if (is_form(x, "if") || is_form(x, "when") || is_form(x, "unless")) {
+        check_test(w, x, omni_car(args));
+    } else if (is_form(x, "cond")) {
+        for (OmniValue* c = args; omni_is_cell(c); c = omni_cdr(c)) {
+            if (omni_is_cell(omni_car(c))) check_test(w, x, omni_car(omni_car(c)));
+        }
+    } else if (is_form(x, "and") || is_form(x, "or")) {
+        /* The last operand is the value, not a test */
+        for (OmniValue* a = args; omni_is_cell(a) && omni_is_cell(omni_cdr(a)); a = omni_cdr(a)) {
+            check_test(w, x, omni_car(a));
+        }
+    } else if ((is_form(x, "/") || is_form(x, "%")) && !redefined(w, omni_car(x)->str_val)) {
+        for (OmniValue* a = omni_cdr(args); omni_is_cell(a); a = omni_cdr(a)) {
+            /* / by 0.0 is a float division, an infinity or NaN on both runtimes */
+            if (!is_zero(omni_car(a)) || (is_form(x, "/") && omni_is_float(omni_car(a)))) continue;
+            char text[DEPRECATE_SNIPPET_MAX + 8];
+            snippet(x, text, sizeof(text));
+            add_use(w, OMNI_DEPRECATED_DIVIDE_BY_ZERO, x,
+                    "%s divides by 0, which gives 0 or stops the program now and will give an error value",
+                    text);
+            break;
+        }
+    }
+
+    for (; omni_is_cell(x); x = omni_cdr(x)) walk(w, omni_car(x));
+}
+
+OmniDeprecatedUses* omni_deprecations_find(OmniValue** forms, size_t count, unsigned allowed) {
+    DeprecateWalk w = { calloc(1, sizeof(OmniDeprecatedUses)), forms, count, allowed };
+    for (size_t i = 0; i < count; i++) walk(&w, forms[i]);
+    return w.uses;
+}
+
+void omni_deprecations_free(OmniDeprecatedUses* uses) {
+    if (!uses) return;
+    free(uses->items);
+    free(uses);
+}
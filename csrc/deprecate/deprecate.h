@@ -0,0 +1,81 @@
+/*
+ * OmniLisp Deprecations
+ *
+ * Behaviour a later version of the language changes is deprecated first:
+ * programs that rely on it still compile, with a warning that has a
+ * stable code (D0001, ...) and says what will change, so the change can
+ * land without silently breaking them. -Werror=deprecated turns the
+ * warnings into errors and -Wno-deprecated silences them; a file can
+ * accept some of them with a comment line of its own,
+ *
+ *     ; allow-deprecated D0001 D0002
+ *
+ * Programs are checked as parsed, before macro expansion, so positions
+ * are the source's and code a macro writes is not reported.
+ */
+
+#ifndef OMNILISP_DEPRECATE_H
+#define OMNILISP_DEPRECATE_H
+
+#include "../ast/ast.h"
+#include <stdbool.h>
+#include <stddef.h>
+
+#ifdef __cplusplus
+extern "C" {
+#endif
+
+typedef enum {
+    OMNI_DEPRECATED_ZERO_IS_FALSE = 1,   /* D0001 */
+    OMNI_DEPRECATED_DIVIDE_BY_ZERO,      /* D0002 */
+    OMNI_DEPRECATED_COUNT
+} OmniDeprecation;
+
+typedef struct {
+    OmniDeprecation code;
+    const char* id;               /* "D0001" */
+    const char* title;            /* One line */
+    const char* explanation;      /* What changes and how to update, several lines */
+} OmniDeprecationInfo;
+
+/* Catalog entry for a code, or by its id ("D0001", case-insensitive);
+ * NULL when unknown */
+const OmniDeprecationInfo* omni_deprecation_info(OmniDeprecation code);
+const OmniDeprecationInfo* omni_deprecation_lookup(const char* id);
+
+/* What to do when a program relies on deprecated behaviour */
+typedef enum {
+    OMNI_DEPRECATED_WARN = 0,     /* Warn; it still works */
+    OMNI_DEPRECATED_ERROR,        /* Reject the program (-Werror=deprecated) */
+    OMNI_DEPRECATED_ALLOW         /* Say nothing (-Wno-deprecated) */
+} OmniDeprecatedPolicy;
+
+/* One place that relies on deprecated behaviour */
+typedef struct OmniDeprecatedUse {
+    OmniDeprecation code;
+    OmniValue* at;                /* Node the use is about */
+    char message[256];            /* Starts with the code */
+} OmniDeprecatedUse;
+
+typedef struct OmniDeprecatedUses {
+    OmniDeprecatedUse* items;
+    size_t count;
+    size_t capacity;
+} OmniDeprecatedUses;
+
+/* The codes the allow-deprecated comment lines of a file's source
+ * accept, as a mask of 1 << code; codes it does not know are ignored */
+unsigned omni_deprecations_allowed(const char* source);
+
+/* The uses in a program given as top-level forms, in source order,
+ * except those of codes in the mask allowed */
+OmniDeprecatedUses* omni_deprecations_find(OmniValue** forms, size_t count, unsigned allowed);
+
+/* Free the uses (the trees they point into are not touched) */
+void omni_deprecations_free(OmniDeprecatedUses* uses);
+
+#ifdef __cplusplus
+}
+#endif
+
+#endif /* OMNILISP_DEPRECATE_H */
@@ -0,0 +1,193 @@
+/*
+ * OmniLisp Diagnostics Implementation
+ */
+
+#include "diagnostics.h"
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <strings.h>
+
+/* ============== Catalog ============== */
+
+static const OmniErrorInfo g_errors[] = {
+    { OMNI_E_UNBOUND_SYMBOL, "E0001", "unbound symbol",
+      "A name is used that no enclosing let, lambda or parameter binds, the\n"
+      "program does not define, and is not a primitive. It is usually a\n"
+      "misspelling; the message lists the nearest names in scope. Define the\n"
+      "name before using it at top level or bind it locally.\n" },
+    { OMNI_E_MALFORMED_FORM, "E0002", "malformed special form",
+      "A special form has the wrong shape, such as a missing clause or a\n"
+      "limit that is not a literal count. The message shows the expected\n"
+      "shape.\n" },
+    { OMNI_E_STAGING, "E0003", "staging error",
+      "A code-building form (lift, code-app, code-let, code-if,\n"
+      "staged-power, staged-unroll) cannot be expanded at compile time,\n"
+      "usually because an argument that must be known while compiling is a\n"
+      "runtime value.\n" },
+    { OMNI_E_NEEDS_OPTION, "E0004", "form needs a compiler option",
+      "The form only works when the program is compiled with a particular\n"
+      "option; the message names it (for example --record N for\n"
+      "debug-history). Also reported for forms an option rules out, such as\n"
+      "spawn, nursery and the other thread forms under -freestanding.\n" },
+    { OMNI_E_PARSE, "E0005", "parse error",
+      "The source could not be read: an unbalanced parenthesis or bracket,\n"
+      "an unterminated string, or an invalid token. The position points at\n"
+      "where reading stopped.\n" },
+    { OMNI_E_MALFORMED_AST, "E0006", "malformed expression",
+      "An expression handed to the compiler is not a valid tree, for example\n"
+      "an improper list used as a call. This comes from tools building\n"
+      "programs directly rather than from source text.\n" },
+    { OMNI_E_SHADOWING, "E0007", "binding shadows a built-in name",
+      "A let binding, parameter or definition reuses the name of a primitive\n"
+      "or built-in form, so inside its scope the name means the binding:\n"
+      "after (let ((car 3)) ...), (car xs) calls 3. This is a warning by\n"
+      "default and an error under -Wstrict. Rename the binding, or pass\n"
+      "-Wno-shadow when the shadowing is intended.\n" },
+    { OMNI_E_UNINITIALIZED, "E0008", "variable used before it has a value",
+      "A variable is read or set! before anything has given it a value: a\n"
+      "top-level variable used in a form above its define, or a letrec\n"
+      "binding read by an init that runs before its own. Only uses that are\n"
+      "early on every path are reported. Move the definition up, or wrap\n"
+      "the use in a lambda so it runs later.\n" },
+    { OMNI_E_IMPORT, "E0009", "import error",
+      "An (import \"path\") cannot be carried out: the file cannot be read,\n"
+      "or it imports, directly or not, the file being loaded. Paths are\n"
+      "relative to the importing file. Also reported when a module's\n"
+      "provide names something the module does not define.\n" },
+    { OMNI_E_MACRO, "E0010", "macro expansion error",
+      "A macro call could not be expanded: its body failed while running\n"
+      "(a wrong number of arguments, car of a non-list, an (error ...),\n"
+      "too many steps), or expansions kept producing calls more than 256\n"
+      "deep. Also reported for a defmacro that is not at top level. Use\n"
+      "-E to print what the program expands to.\n" },
+    { OMNI_E_ARITY, "E0011", "wrong number of arguments",
+      "A call passes more or fewer arguments than its callee takes: a\n"
+      "primitive, a function the program defines, a letrec function or a\n"
+      "lambda written in the call. The message gives both counts. Calls\n"
+      "through a variable holding a closure are checked when they run.\n" },
+    { OMNI_E_LANG, "E0012", "language level",
+      "A file's #lang line names a level this compiler does not know, or\n"
+      "the file uses a form its level does not have, such as import in a\n"
+      "#lang purple/1 file. Raise the file's level, or build it with a\n"
+      "compiler that knows the newer one. Files without #lang are at the\n"
+      "-lang level, the latest by default.\n" },
+};
+
+const OmniErrorInfo* omni_error_info(OmniErrorCode code) {
+    for (size_t i = 0; i < sizeof(g_errors) / sizeof(g_errors[0]); i++) {
+        if (g_errors[i].code == code) return &g_errors[i];
+    }
+    return NULL;
+}
+
+const OmniErrorInfo* omni_error_lookup(const char* id) {
+    if (!id) return NULL;
+    for (size_t i = 0; i < sizeof(g_errors) / sizeof(g_errors[0]); i++) {
+        if (strcasecmp(g_errors[i].id, id) == 0) return &g_errors[i];
+    }
+    return NULL;
+}
+
+/* ============== Suggestions ============== */
+
+/* Optimal string alignment distance over three rolling rows */
+size_t omni_edit_distance(const char* a, const char* b) {
+    size_t n = strlen(a), m = strlen(b);
+    size_t* rows = malloc(3 * (m + 1) * sizeof(size_t));
+    size_t* prev2 = rows;
+    size_t* prev = rows + (m + 1);
+    size_t* cur = rows + 2 * (m + 1);
+    for (size_t j = 0; j <= m; j++) prev[j] = j;
+
+    for (size_t i = 1; i <= n; i++) {
+        cur[0] = i;
+        for (size_t j = 1; j <= m; j++) {
+            size_t cost = a[i - 1] == b[j - 1] ? 0 : 1;
+            size_t best = prev[j - 1] + cost;
+            if (prev[j] + 1 < best) best = prev[j] + 1;
+            if (cur[j - 1] + 1 < best) best = cur[j - 1] + 1;
+            if (i > 1 && j > 1 && a[i - 1] == b[j - 2] && a[i - 2] == b[j - 1] &&
+                prev2[j - 2] + 1 < best) {
+                best = prev2[j - 2] + 1;
+            }
+            cur[j] = best;
+        }
+        size_t* t = prev2;
+        prev2 = prev;
+        prev = cur;
+        cur = t;
+    }
+    size_t d = prev[m];
+    free(rows);
+    return d;
+}
+
+size_t omni_suggest(const char* name, const char* const* candidates, size_t count,
+                    const char** out, size_t max) {
+    /* One edit for short names, about one per three characters beyond;
+     * a one-character name is never a misspelling of another */
+    size_t len = strlen(name);
+    size_t limit = len <= 1 ? 0 : len <= 3 ? 1 : len / 3;
+    size_t dist[8];
+    if (max > sizeof(dist) / sizeof(dist[0])) max = sizeof(dist) / sizeof(dist[0]);
+
+    size_t found = 0;
+    for (size_t i = 0; i < count; i++) {
+        const char* c = candidates[i];
+        if (!c || strcmp(c, name) == 0) continue;
+        bool seen = false;
+        for (size_t k = 0; k < found && !seen; k++) seen = strcmp(out[k], c) == 0;
+        if (seen) continue;
+        size_t d = omni_edit_distance(name, c);
+        if (d > limit) continue;
+
+        /* Insert in order, keeping earlier candidates first on ties */
+        size_t at = found;
+        while (at > 0 && dist[at - 1] > d) at--;
+        if (at >= max) continue;
+        size_t last = found < max ? found : max - 1;
+        for (size_t k = last; k > at; k--) {
+            out[k] = out[k - 1];
+            dist[k] = dist[k - 1];
+        }
+        out[at] = c;
+        dist[at] = d;
+        if (found < max) found++;
+    }
+    return found;
+}
+
+void omni_format_suggestions(char* buf, size_t cap, const char* const* suggestions, size_t count) {
+    if (count == 0) return;
+    size_t len = strlen(buf);
+    len += snprintf(buf + len, len < cap ? cap - len : 0, " (did you mean ");
+    for (size_t i = 0; i < count && len < cap; i++) {
+        const char* sep = i == 0 ? "" : i + 1 == count ? " or " : ", ";
+        len += snprintf(buf + len, cap - len, "%s%s", sep, suggestions[i]);
+    }
+    if (len < cap) snprintf(buf + len, cap - len, "?)");
+}
+
+void omni_format_snippet(char* buf, size_t cap, const char* text, int line, int column) {
+    if (!text || line < 1) return;
+    const char* start = text;
+    for (int l = 1; l < line; l++) {
+        start = strchr(start, '\n');
+        if (!start) return;
+        start++;
+    }
+    const char* end = strchr(start, '\n');
+    int width = end ? (int)(end - start) : (int)strlen(start);
+    if (width > 0 && start[width - 1] == '\r') width--;
+
+    size_t len = strlen(buf);
+    int gutter = snprintf(NULL, 0, "%d", line);
+    len += snprintf(buf + len, len < cap ? cap - len : 0, "\n %d | %.*s\n %*s | ",
+                    line, width, start, gutter, "");
+    /* Copy tabs so the caret lines up however they are shown */
+    for (int i = 0; i + 1 < column && i < width && len + 1 < cap; i++) {
+        buf[len++] = start[i] == '\t' ? '\t' : ' ';
+    }
+    if (len < cap) snprintf(buf + len, cap - len, "^");
+}
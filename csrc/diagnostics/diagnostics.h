@@ -0,0 +1,78 @@
+/*
+ * OmniLisp Diagnostics
+ *
+ * Every compiler error starts with a stable code (E0001, E0002, ...) that
+ * names its kind; the catalog below explains each one and is what
+ * `omnilisp --explain CODE` prints. Misspelled names are answered with
+ * the closest known names, ranked by edit distance.
+ */
+
+#ifndef OMNILISP_DIAGNOSTICS_H
+#define OMNILISP_DIAGNOSTICS_H
+
+#include <stdbool.h>
+#include <stddef.h>
+
+#ifdef __cplusplus
+extern "C" {
+#endif
+
+typedef enum {
+    OMNI_E_UNBOUND_SYMBOL = 1,    /* E0001 */
+    OMNI_E_MALFORMED_FORM,        /* E0002 */
+    OMNI_E_STAGING,               /* E0003 */
+    OMNI_E_NEEDS_OPTION,          /* E0004 */
+    OMNI_E_PARSE,                 /* E0005 */
+    OMNI_E_MALFORMED_AST,         /* E0006 */
+    OMNI_E_SHADOWING,             /* E0007 */
+    OMNI_E_UNINITIALIZED,         /* E0008 */
+    OMNI_E_IMPORT,                /* E0009 */
+    OMNI_E_MACRO,                 /* E0010 */
+    OMNI_E_ARITY,                 /* E0011 */
+    OMNI_E_LANG,                  /* E0012 */
+    OMNI_E_COUNT
+} OmniErrorCode;
+
+typedef struct {
+    OmniErrorCode code;
+    const char* id;               /* "E0001" */
+    const char* title;            /* One line, as in messages */
+    const char* explanation;      /* Cause and fix, several lines */
+} OmniErrorInfo;
+
+/* Catalog entry for a code, or by its id ("E0001", case-insensitive);
+ * NULL when unknown */
+const OmniErrorInfo* omni_error_info(OmniErrorCode code);
+const OmniErrorInfo* omni_error_lookup(const char* id);
+
+/* Edits (insert, delete, substitute, swap two neighbours) turning a into b */
+size_t omni_edit_distance(const char* a, const char* b);
+
+/*
+ * Up to max candidates close enough to name to be a likely misspelling,
+ * nearest first, without duplicates or name itself. Returns how many
+ * were stored in out.
+ */
+size_t omni_suggest(const char* name, const char* const* candidates, size_t count,
+                    const char** out, size_t max);
+
+/* Append " (did you mean a, b or c?)" for the suggestions to buf, which
+ * holds a string of at most cap bytes; nothing when there are none */
+void omni_format_suggestions(char* buf, size_t cap, const char* const* suggestions, size_t count);
+
+/*
+ * Append the source line at line (1-based) of text to buf, under a
+ * numbered gutter, and a caret under column:
+ *
+ *     3 | (display (f y))
+ *       |             ^
+ *
+ * Each part starts on a new line. Nothing when the line does not exist.
+ */
+void omni_format_snippet(char* buf, size_t cap, const char* text, int line, int column);
+
+#ifdef __cplusplus
+}
+#endif
+
+#endif /* OMNILISP_DIAGNOSTICS_H */
@@ -0,0 +1,289 @@
+/*
+ * OmniLisp Structural Diff Implementation
+ */
+
+#include "diff.h"
+#include <stdlib.h>
+#include <string.h>
+
+/* Beyond this many cell pairs the LCS table is skipped and sequences are
+ * compared position by position */
+#define DIFF_LCS_LIMIT (4u * 1024 * 1024)
+
+/* Longest form summary printed in hunk headers */
+#define DIFF_SUMMARY_MAX 60
+
+/* ============== Equality ============== */
+
+bool omni_diff_equal(OmniValue* a, OmniValue* b) {
+    while (omni_is_cell(a) && omni_is_cell(b)) {
+        if (!omni_diff_equal(a->cell.car, b->cell.car)) return false;
+        a = a->cell.cdr;
+        b = b->cell.cdr;
+    }
+    if (omni_is_nil(a) || omni_is_nil(b)) return omni_is_nil(a) && omni_is_nil(b);
+    if (omni_is_array(a) && omni_is_array(b)) {
+        if (a->array.len != b->array.len) return false;
+        for (size_t i = 0; i < a->array.len; i++) {
+            if (!omni_diff_equal(a->array.data[i], b->array.data[i])) return false;
+        }
+        return true;
+    }
+    return omni_values_equal(a, b);
+}
+
+/* ============== Diff State ============== */
+
+typedef struct {
+    OmniDiff* diff;
+    size_t form_a;
+    size_t form_b;
+    OmniValue* form;
+    size_t* path;
+    size_t depth;
+    size_t path_cap;
+} DiffWalk;
+
+static void path_push(DiffWalk* w, size_t pos) {
+    if (w->depth == w->path_cap) {
+        w->path_cap = w->path_cap ? w->path_cap * 2 : 8;
+        w->path = realloc(w->path, w->path_cap * sizeof(size_t));
+    }
+    w->path[w->depth++] = pos;
+}
+
+static void add_entry(DiffWalk* w, OmniDiffKind kind, OmniValue* old_val, OmniValue* new_val) {
+    OmniDiff* d = w->diff;
+    if (d->count == d->capacity) {
+        d->capacity = d->capacity ? d->capacity * 2 : 16;
+        d->entries = realloc(d->entries, d->capacity * sizeof(OmniDiffEntry));
+    }
+    OmniDiffEntry* e = &d->entries[d->count++];
+    e->kind = kind;
+    e->form_a = w->form_a;
+    e->form_b = w->form_b;
+    e->form = w->form;
+    e->path_len = w->depth;
+    e->path = NULL;
+    if (w->depth > 0) {
+        e->path = malloc(w->depth * sizeof(size_t));
+        memcpy(e->path, w->path, w->depth * sizeof(size_t));
+    }
+    e->old_val = old_val;
+    e->new_val = new_val;
+}
+
+/* ============== Alignment ============== */
+
+/* Elements of a proper list or array (malloc'd), or NULL if v is neither */
+static OmniValue** seq_items(OmniValue* v, size_t* len) {
+    if (omni_is_array(v)) {
+        *len = v->array.len;
+        OmniValue** items = malloc((*len + 1) * sizeof(OmniValue*));
+        for (size_t i = 0; i < *len; i++) items[i] = v->array.data[i];
+        return items;
+    }
+    if (!omni_is_cell(v)) return NULL;
+    size_t n = 0;
+    OmniValue* p = v;
+    for (; omni_is_cell(p); p = p->cell.cdr) n++;
+    if (!omni_is_nil(p)) return NULL;
+
+    OmniValue** items = malloc(n * sizeof(OmniValue*));
+    n = 0;
+    for (p = v; omni_is_cell(p); p = p->cell.cdr) items[n++] = p->cell.car;
+    *len = n;
+    return items;
+}
+
+/* Name bound by (define name ...) or (define (name ...) ...), else NULL */
+static OmniValue* defined_name(OmniValue* v) {
+    if (!omni_sym_eq_str(omni_car(v), "define")) return NULL;
+    OmniValue* target = omni_car(omni_cdr(v));
+    return omni_is_cell(target) ? omni_car(target) : target;
+}
+
+/* Lists worth comparing element-wise: same head (or both arrays), and
+ * definitions only when they define the same name */
+static bool similar(OmniValue* a, OmniValue* b) {
+    if (omni_is_array(a) && omni_is_array(b)) return true;
+    if (!omni_is_cell(a) || !omni_is_cell(b)) return false;
+    if (!omni_diff_equal(a->cell.car, b->cell.car)) return false;
+    return omni_diff_equal(defined_name(a), defined_name(b));
+}
+
+/* Two atoms, or two similar lists, can be reported as one change */
+static bool pairable(OmniValue* a, OmniValue* b) {
+    bool a_seq = omni_is_cell(a) || omni_is_array(a);
+    bool b_seq = omni_is_cell(b) || omni_is_array(b);
+    return (!a_seq && !b_seq) || similar(a, b);
+}
+
+static void diff_node(DiffWalk* w, OmniValue* a, OmniValue* b);
+
+/* Report one unmatched element; top-level forms set the form context */
+static void report(DiffWalk* w, bool top, OmniDiffKind kind, size_t pos, OmniValue* v) {
+    if (top) {
+        w->form_a = kind == OMNI_DIFF_REMOVED ? pos : 0;
+        w->form_b = kind == OMNI_DIFF_ADDED ? pos : 0;
+        w->form = v;
+        add_entry(w, kind, kind == OMNI_DIFF_REMOVED ? v : NULL, kind == OMNI_DIFF_ADDED ? v : NULL);
+        return;
+    }
+    path_push(w, pos);
+    add_entry(w, kind, kind == OMNI_DIFF_REMOVED ? v : NULL, kind == OMNI_DIFF_ADDED ? v : NULL);
+    w->depth--;
+}
+
+/* Compare a pair of elements standing in the same place */
+static void pair(DiffWalk* w, bool top, size_t pos_a, OmniValue* a, size_t pos_b, OmniValue* b) {
+    if (top) {
+        w->form_a = pos_a;
+        w->form_b = pos_b;
+        w->form = b;
+        diff_node(w, a, b);
+        return;
+    }
+    path_push(w, pos_b);
+    diff_node(w, a, b);
+    w->depth--;
+}
+
+/* Resolve a run of elements that LCS left unmatched on both sides */
+static void diff_run(DiffWalk* w, bool top, OmniValue** xs, size_t i, size_t i_end,
+                     OmniValue** ys, size_t j, size_t j_end) {
+    while (i < i_end && j < j_end) {
+        /* Pair xs[i] with the first counterpart left in the run; anything
+         * skipped over on the new side was added */
+        size_t k = j;
+        while (k < j_end && !pairable(xs[i], ys[k])) k++;
+        if (k == j_end) {
+            report(w, top, OMNI_DIFF_REMOVED, i + 1, xs[i]);
+            i++;
+            continue;
+        }
+        for (; j < k; j++) report(w, top, OMNI_DIFF_ADDED, j + 1, ys[j]);
+        pair(w, top, i + 1, xs[i], j + 1, ys[j]);
+        i++;
+        j++;
+    }
+    for (; i < i_end; i++) report(w, top, OMNI_DIFF_REMOVED, i + 1, xs[i]);
+    for (; j < j_end; j++) report(w, top, OMNI_DIFF_ADDED, j + 1, ys[j]);
+}
+
+static void diff_seq(DiffWalk* w, bool top, OmniValue** xs, size_t n, OmniValue** ys, size_t m) {
+    if (n == 0 || m == 0 || (n + 1) * (m + 1) > DIFF_LCS_LIMIT) {
+        diff_run(w, top, xs, 0, n, ys, 0, m);
+        return;
+    }
+
+    /* lcs[i][j] = length of the LCS of xs[i..] and ys[j..] */
+    size_t cols = m + 1;
+    size_t* lcs = calloc((n + 1) * cols, sizeof(size_t));
+    for (size_t i = n; i-- > 0;) {
+        for (size_t j = m; j-- > 0;) {
+            if (omni_diff_equal(xs[i], ys[j])) {
+                lcs[i * cols + j] = lcs[(i + 1) * cols + j + 1] + 1;
+            } else {
+                size_t down = lcs[(i + 1) * cols + j];
+                size_t right = lcs[i * cols + j + 1];
+                lcs[i * cols + j] = down > right ? down : right;
+            }
+        }
+    }
+
+    size_t i = 0, j = 0, run_i = 0, run_j = 0;
+    while (i < n && j < m) {
+        if (omni_diff_equal(xs[i], ys[j]) && lcs[i * cols + j] == lcs[(i + 1) * cols + j + 1] + 1) {
+            diff_run(w, top, xs, run_i, i, ys, run_j, j);
+            run_i = ++i;
+            run_j = ++j;
+        } else if (lcs[(i + 1) * cols + j] >= lcs[i * cols + j + 1]) {
+            i++;
+        } else {
+            j++;
+        }
+    }
+    diff_run(w, top, xs, run_i, n, ys, run_j, m);
+    free(lcs);
+}
+
+static void diff_node(DiffWalk* w, OmniValue* a, OmniValue* b) {
+    if (omni_diff_equal(a, b)) return;
+
+    size_t n = 0, m = 0;
+    OmniValue** xs = similar(a, b) ? seq_items(a, &n) : NULL;
+    OmniValue** ys = xs ? seq_items(b, &m) : NULL;
+    if (xs && ys) {
+        diff_seq(w, false, xs, n, ys, m);
+    } else {
+        add_entry(w, OMNI_DIFF_CHANGED, a, b);
+    }
+    free(xs);
+    free(ys);
+}
+
+/* ============== Public API ============== */
+
+OmniDiff* omni_diff_forms(OmniValue** a, size_t a_count, OmniValue** b, size_t b_count) {
+    OmniDiff* diff = calloc(1, sizeof(OmniDiff));
+    if (!diff) return NULL;
+    DiffWalk w = { .diff = diff };
+    diff_seq(&w, true, a, a_count, b, b_count);
+    free(w.path);
+    return diff;
+}
+
+void omni_diff_free(OmniDiff* diff) {
+    if (!diff) return;
+    for (size_t i = 0; i < diff->count; i++) {
+        free(diff->entries[i].path);
+    }
+    free(diff->entries);
+    free(diff);
+}
+
+static void print_value(FILE* out, char sign, OmniValue* v) {
+    char* s = omni_value_to_string(v);
+    fprintf(out, "%c %s\n", sign, s ? s : "?");
+    free(s);
+}
+
+static void print_summary(FILE* out, OmniValue* form) {
+    char* s = omni_value_to_string(form);
+    if (!s) return;
+    if (strlen(s) > DIFF_SUMMARY_MAX) {
+        fprintf(out, "%.*s...", DIFF_SUMMARY_MAX - 3, s);
+    } else {
+        fputs(s, out);
+    }
+    free(s);
+}
+
+void omni_diff_print(FILE* out, const OmniDiff* diff) {
+    if (!diff) return;
+    for (size_t k = 0; k < diff->count; k++) {
+        const OmniDiffEntry* e = &diff->entries[k];
+
+        if (e->path_len == 0 && e->kind == OMNI_DIFF_REMOVED) {
+            fprintf(out, "form %zu removed:\n", e->form_a);
+        } else if (e->path_len == 0 && e->kind == OMNI_DIFF_ADDED) {
+            fprintf(out, "form %zu added:\n", e->form_b);
+        } else {
+            fprintf(out, "form %zu", e->form_b);
+            if (e->form_a != e->form_b) fprintf(out, " (was %zu)", e->form_a);
+            if (e->path_len > 0) {
+                fputs(", element ", out);
+                for (size_t i = 0; i < e->path_len; i++) {
+                    fprintf(out, i ? ".%zu" : "%zu", e->path[i]);
+                }
+                fputs(", in ", out);
+                print_summary(out, e->form);
+            }
+            fputs(":\n", out);
+        }
+
+        if (e->old_val) print_value(out, '-', e->old_val);
+        if (e->new_val) print_value(out, '+', e->new_val);
+    }
+}
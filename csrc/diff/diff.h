@@ -0,0 +1,67 @@
+/*
+ * OmniLisp Structural Diff
+ *
+ * Compares two programs as parsed trees rather than text, so whitespace,
+ * comments and line breaks never show up as changes. Top-level forms and
+ * list elements are aligned on whole-subtree equality (longest common
+ * subsequence); unmatched lists with the same head are compared element
+ * by element so a change is reported at the smallest differing subtree.
+ */
+
+#ifndef OMNILISP_DIFF_H
+#define OMNILISP_DIFF_H
+
+#include "../ast/ast.h"
+#include <stdio.h>
+#include <stdbool.h>
+#include <stddef.h>
+
+#ifdef __cplusplus
+extern "C" {
+#endif
+
+typedef enum {
+    OMNI_DIFF_CHANGED = 0,    /* Subtree replaced by another */
+    OMNI_DIFF_REMOVED,        /* Only in the old program */
+    OMNI_DIFF_ADDED           /* Only in the new program */
+} OmniDiffKind;
+
+/*
+ * One difference. Form numbers and element positions are 1-based.
+ * Positions follow the new tree, except for removals which follow the
+ * old one. A top-level form added or removed as a whole has no path.
+ */
+typedef struct OmniDiffEntry {
+    OmniDiffKind kind;
+    size_t form_a;            /* Top-level form in the old program (0 = none) */
+    size_t form_b;            /* Top-level form in the new program (0 = none) */
+    OmniValue* form;          /* That form (new one when both exist) */
+    size_t* path;             /* Element positions inside form */
+    size_t path_len;
+    OmniValue* old_val;       /* NULL for OMNI_DIFF_ADDED */
+    OmniValue* new_val;       /* NULL for OMNI_DIFF_REMOVED */
+} OmniDiffEntry;
+
+typedef struct OmniDiff {
+    OmniDiffEntry* entries;
+    size_t count;
+    size_t capacity;
+} OmniDiff;
+
+/* Diff two programs given as top-level forms */
+OmniDiff* omni_diff_forms(OmniValue** a, size_t a_count, OmniValue** b, size_t b_count);
+
+/* Free a diff (the trees it points into are not touched) */
+void omni_diff_free(OmniDiff* diff);
+
+/* Structural equality of two trees (lists and arrays element-wise) */
+bool omni_diff_equal(OmniValue* a, OmniValue* b);
+
+/* Print a diff as readable -/+ hunks */
+void omni_diff_print(FILE* out, const OmniDiff* diff);
+
+#ifdef __cplusplus
+}
+#endif
+
+#endif /* OMNILISP_DIFF_H */
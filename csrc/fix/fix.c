@@ -0,0 +1,358 @@
+/*
+ * OmniLisp Fix Implementation
+ */
+
+#include "fix.h"
+#include "../ast/ast.h"
+#include "../parser/parser.h"
+#include "../lint/lint.h"
+#include <stdlib.h>
+#include <string.h>
+
+/* Rounds of linting and fixing before giving up on reaching a fixed point */
+#define FIX_MAX_PASSES 16
+
+/* Beyond this many line pairs the diff is one hunk for the whole text */
+#define FIX_LCS_LIMIT (4u * 1024 * 1024)
+
+/* ============== Source Text ============== */
+
+/* Offset of a 1-based line and column in text, or -1 past its end */
+static long offset_of(const char* text, int line, int column) {
+    const char* p = text;
+    for (int l = 1; l < line; l++) {
+        p = strchr(p, '\n');
+        if (!p) return -1;
+        p++;
+    }
+    for (int c = 1; c < column; c++, p++) {
+        if (!*p || *p == '\n') return -1;
+    }
+    return p - text;
+}
+
+static bool delimiter(char c) {
+    return c == '\0' || c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '(' || c == ')' ||
+           c == '[' || c == ']' || c == '{' || c == '}' || c == '"' || c == ';';
+}
+
+/* End of the string literal starting at i */
+static size_t string_end(const char* s, size_t i) {
+    for (i++; s[i] && s[i] != '"'; i++) {
+        if (s[i] == '\\' && s[i + 1]) i++;
+    }
+    return s[i] ? i + 1 : i;
+}
+
+/* End of the datum whose text starts at i */
+static size_t datum_end(const char* s, size_t i) {
+    while (s[i] == '\'' || s[i] == '`' || s[i] == ',') i += s[i] == ',' && s[i + 1] == '@' ? 2 : 1;
+    if (s[i] == '"') return string_end(s, i);
+    if (s[i] == '#' && (s[i + 1] == '(' || s[i + 1] == '[' || s[i + 1] == '{')) i++;
+    if (s[i] != '(' && s[i] != '[' && s[i] != '{') {
+        if (s[i] == '#' && s[i + 1] == '\\' && s[i + 2]) i += 3;
+        while (!delimiter(s[i])) i++;
+        return i;
+    }
+    int depth = 0;
+    for (; s[i]; i++) {
+        if (s[i] == '"') {
+            i = string_end(s, i) - 1;
+        } else if (s[i] == ';') {
+            while (s[i + 1] && s[i + 1] != '\n') i++;
+        } else if (s[i] == '#' && s[i + 1] == '\\') {
+            i += s[i + 2] ? 2 : 1;
+        } else if (s[i] == '(' || s[i] == '[' || s[i] == '{') {
+            depth++;
+        } else if ((s[i] == ')' || s[i] == ']' || s[i] == '}') && --depth == 0) {
+            return i + 1;
+        }
+    }
+    return i;
+}
+
+/* ============== Edits ============== */
+
+typedef struct {
+    size_t start;
+    size_t end;
+    char* text;               /* Replaces [start, end) */
+} Edit;
+
+typedef struct {
+    Edit* items;
+    size_t count;
+    size_t capacity;
+} Edits;
+
+static void add_edit(Edits* e, size_t start, size_t end, char* text) {
+    if (e->count == e->capacity) {
+        e->capacity = e->capacity ? e->capacity * 2 : 16;
+        e->items = realloc(e->items, e->capacity * sizeof(Edit));
+    }
+    e->items[e->count++] = (Edit){ start, end, text };
+}
+
+/* Growable string */
+typedef struct {
+    char* data;
+    size_t len;
+    size_t cap;
+} Text;
+
+static void text_add(Text* t, const char* s, size_t n) {
+    if (t->len + n + 1 > t->cap) {
+        t->cap = (t->len + n + 1) * 2;
+        t->data = realloc(t->data, t->cap);
+    }
+    memcpy(t->data + t->len, s, n);
+    t->len += n;
+    t->data[t->len] = '\0';
+}
+
+/* v as source: nodes with a position are copied from src as written,
+ * new ones are printed */
+static void render(Text* t, const char* src, OmniValue* v) {
+    long at = v && v->line > 0 ? offset_of(src, v->line, v->column) : -1;
+    if (at >= 0) {
+        text_add(t, src + at, datum_end(src, (size_t)at) - (size_t)at);
+        return;
+    }
+    if (omni_is_cell(v)) {
+        text_add(t, "(", 1);
+        for (OmniValue* p = v; omni_is_cell(p); p = omni_cdr(p)) {
+            if (p != v) text_add(t, " ", 1);
+            render(t, src, omni_car(p));
+        }
+        text_add(t, ")", 1);
+        return;
+    }
+    char* s = omni_value_to_string(v);
+    text_add(t, s, strlen(s));
+    free(s);
+}
+
+/* Deleting [start, end) also takes the space around it: the whole line
+ * when nothing else is on it, the space before a closing bracket, all
+ * the space after an opening one, or else the space after on its line */
+static void deletion(const char* src, size_t* start, size_t* end) {
+    size_t e = *end;
+    while (src[e] == ' ' || src[e] == '\t') e++;
+    size_t s = *start;
+    while (s > 0 && (src[s - 1] == ' ' || src[s - 1] == '\t')) s--;
+    if ((s == 0 || src[s - 1] == '\n') && (src[e] == '\n' || src[e] == '\0')) {
+        *start = s;
+        *end = src[e] == '\n' ? e + 1 : e;
+    } else if (src[e] == ')' || src[e] == ']' || src[e] == '}') {
+        while (*start > 0 && strchr(" \t\r\n", src[*start - 1])) (*start)--;
+        *end = e;
+    } else if (s > 0 && (src[s - 1] == '(' || src[s - 1] == '[' || src[s - 1] == '{')) {
+        while (src[e] && strchr(" \t\r\n", src[e])) e++;
+        *end = e;
+    } else {
+        *end = e;
+    }
+}
+
+/* Renames of the symbols in x that are not quoted */
+static void rename_edits(Edits* edits, const char* src, OmniValue* x, const OmniFixOptions* opts) {
+    if (omni_is_sym(x)) {
+        long at = x->line > 0 ? offset_of(src, x->line, x->column) : -1;
+        for (size_t i = 0; i < opts->rename_count && at >= 0; i++) {
+            if (strcmp(x->str_val, opts->renames[i].from) != 0) continue;
+            add_edit(edits, (size_t)at, datum_end(src, (size_t)at), strdup(opts->renames[i].to));
+            break;
+        }
+        return;
+    }
+    if (omni_is_array(x)) {
+        for (size_t i = 0; i < x->array.len; i++) rename_edits(edits, src, x->array.data[i], opts);
+        return;
+    }
+    if (!omni_is_cell(x) || omni_sym_eq_str(omni_car(x), "quote")) return;
+    for (; omni_is_cell(x); x = omni_cdr(x)) rename_edits(edits, src, omni_car(x), opts);
+}
+
+static void lint_edits(Edits* edits, const char* src, OmniArena* arena, OmniValue** forms, size_t count) {
+    OmniLints* lints = omni_lint_forms(arena, forms, count);
+    for (size_t i = 0; i < lints->count; i++) {
+        OmniLint* lint = &lints->items[i];
+        long at = lint->fixable && lint->at->line > 0 ? offset_of(src, lint->at->line, lint->at->column) : -1;
+        if (at < 0) continue;
+        size_t start = (size_t)at;
+        size_t end = datum_end(src, start);
+        if (!lint->fix) {
+            deletion(src, &start, &end);
+            add_edit(edits, start, end, strdup(""));
+            continue;
+        }
+        Text t = { 0 };
+        render(&t, src, lint->fix);
+        add_edit(edits, start, end, t.data ? t.data : strdup(""));
+    }
+    omni_lint_free(lints);
+}
+
+static int by_position(const void* a, const void* b) {
+    const Edit* x = a;
+    const Edit* y = b;
+    if (x->start != y->start) return x->start < y->start ? -1 : 1;
+    return x->end > y->end ? -1 : x->end < y->end;
+}
+
+/* src with the edits that do not overlap an earlier one applied; the
+ * rest are left for the next pass */
+static char* apply_edits(const char* src, Edits* edits, size_t* applied) {
+    qsort(edits->items, edits->count, sizeof(Edit), by_position);
+    Text t = { 0 };
+    size_t done = 0;
+    for (size_t i = 0; i < edits->count; i++) {
+        Edit* e = &edits->items[i];
+        if (e->start < done) continue;
+        text_add(&t, src + done, e->start - done);
+        text_add(&t, e->text, strlen(e->text));
+        done = e->end;
+        (*applied)++;
+    }
+    text_add(&t, src + done, strlen(src + done));
+    for (size_t i = 0; i < edits->count; i++) free(edits->items[i].text);
+    free(edits->items);
+    return t.data;
+}
+
+/* ============== Public API ============== */
+
+char* omni_fix_source(const char* source, const OmniFixOptions* opts, size_t* applied) {
+    *applied = 0;
+    char* text = strdup(source);
+    for (int pass = 0; pass < FIX_MAX_PASSES; pass++) {
+        /* Each pass reads a new text, so its trees go in a session of
+         * their own; the edits made from them are plain text */
+        OmniSession* session = omni_session_new();
+        OmniParser* parser = omni_parser_new(session, text);
+        size_t count = 0;
+        OmniValue** forms = omni_parser_parse_all(parser, &count);
+        if (omni_parser_get_errors(parser)) {
+            /* A fix that broke the text is undone by stopping before it */
+            free(forms);
+            omni_parser_free(parser);
+            omni_session_free(session);
+            if (pass == 0) {
+                free(text);
+                return NULL;
+            }
+            return text;
+        }
+
+        Edits edits = { 0 };
+        if (pass == 0 && opts) {
+            for (size_t i = 0; i < count; i++) rename_edits(&edits, text, forms[i], opts);
+        }
+        /* Renames first, on their own, so no lint fix overlaps them */
+        if (edits.count == 0) lint_edits(&edits, text, session->arena, forms, count);
+        free(forms);
+        omni_parser_free(parser);
+        omni_session_free(session);
+        if (edits.count == 0) {
+            free(edits.items);
+            break;
+        }
+        char* next = apply_edits(text, &edits, applied);
+        free(text);
+        text = next;
+    }
+    return text;
+}
+
+/* The lines of text: starts and lengths without the newline */
+static size_t split_lines(const char* text, const char*** starts, size_t** lens) {
+    size_t n = 0;
+    for (const char* p = text; *p; p++) n += *p == '\n';
+    if (*text && text[strlen(text) - 1] != '\n') n++;
+    *starts = malloc((n + 1) * sizeof(char*));
+    *lens = malloc((n + 1) * sizeof(size_t));
+    const char* p = text;
+    for (size_t i = 0; i < n; i++) {
+        const char* nl = strchr(p, '\n');
+        (*starts)[i] = p;
+        (*lens)[i] = nl ? (size_t)(nl - p) : strlen(p);
+        p = nl ? nl + 1 : p + strlen(p);
+    }
+    return n;
+}
+
+static bool same_line(const char* a, size_t a_len, const char* b, size_t b_len) {
+    return a_len == b_len && memcmp(a, b, a_len) == 0;
+}
+
+/* "start,count" of a hunk side, as diff -U0 writes it */
+static void print_range(FILE* out, size_t first, size_t count) {
+    if (count == 1) {
+        fprintf(out, "%zu", first + 1);
+    } else {
+        fprintf(out, "%zu,%zu", count ? first + 1 : first, count);
+    }
+}
+
+void omni_fix_print_diff(FILE* out, const char* path, const char* old_text, const char* new_text) {
+    if (strcmp(old_text, new_text) == 0) return;
+    const char** a;
+    const char** b;
+    size_t* a_len;
+    size_t* b_len;
+    size_t n = split_lines(old_text, &a, &a_len);
+    size_t m = split_lines(new_text, &b, &b_len);
+
+    /* lcs[i][j] = length of the LCS of a[i..] and b[j..]; too big a
+     * table leaves every line unmatched */
+    size_t cols = m + 1;
+    size_t* lcs = (n + 1) * cols <= FIX_LCS_LIMIT ? calloc((n + 1) * cols, sizeof(size_t)) : NULL;
+    for (size_t i = n; lcs && i-- > 0;) {
+        for (size_t j = m; j-- > 0;) {
+            if (same_line(a[i], a_len[i], b[j], b_len[j])) {
+                lcs[i * cols + j] = lcs[(i + 1) * cols + j + 1] + 1;
+            } else {
+                size_t down = lcs[(i + 1) * cols + j];
+                size_t right = lcs[i * cols + j + 1];
+                lcs[i * cols + j] = down > right ? down : right;
+            }
+        }
+    }
+
+    fprintf(out, "--- %s\n+++ %s\n", path, path);
+    size_t i = 0, j = 0;
+    while (i < n || j < m) {
+        if (lcs && i < n && j < m && same_line(a[i], a_len[i], b[j], b_len[j]) &&
+            lcs[i * cols + j] == lcs[(i + 1) * cols + j + 1] + 1) {
+            i++;
+            j++;
+            continue;
+        }
+        /* A hunk: lines until the next match */
+        size_t i0 = i, j0 = j;
+        while (i < n || j < m) {
+            if (lcs && i < n && j < m && same_line(a[i], a_len[i], b[j], b_len[j]) &&
+                lcs[i * cols + j] == lcs[(i + 1) * cols + j + 1] + 1) {
+                break;
+            }
+            if (j >= m || (i < n && lcs && lcs[(i + 1) * cols + j] >= lcs[i * cols + j + 1])) {
+                i++;
+            } else if (j < m) {
+                j++;
+            }
+            if (!lcs && i >= n) j = m;
+        }
+        fputs("@@ -", out);
+        print_range(out, i0, i - i0);
+        fputs(" +", out);
+        print_range(out, j0, j - j0);
+        fputs(" @@\n", out);
+        for (size_t k = i0; k < i; k++) fprintf(out, "-%.*s\n", (int)a_len[k], a[k]);
+        for (size_t k = j0; k < j; k++) fprintf(out, "+%.*s\n", (int)b_len[k], b[k]);
+    }
+    free(lcs);
+    free(a);
+    free(a_len);
+    free(b);
+    free(b_len);
+}
@@ -0,0 +1,54 @@
+/*
+ * OmniLisp Fix
+ *
+ * Applies the safe fixes lint finds (see lint.h), and renames asked for,
+ * to a program's source. A fix rewrites one node of the parsed program
+ * and prints it back in place of that node's text; parts of it that come
+ * from the program are copied as they were written. Comments and the
+ * layout of everything a fix does not touch stay as they are. Fixing
+ * repeats until nothing more applies, since one fix can expose another.
+ */
+
+#ifndef OMNILISP_FIX_H
+#define OMNILISP_FIX_H
+
+#include <stdio.h>
+#include <stdbool.h>
+#include <stddef.h>
+
+#ifdef __cplusplus
+extern "C" {
+#endif
+
+typedef struct OmniRename {
+    const char* from;
+    const char* to;
+} OmniRename;
+
+typedef struct OmniFixOptions {
+    const OmniRename* renames;    /* Symbols renamed wherever they are not quoted */
+    size_t rename_count;
+} OmniFixOptions;
+
+/* source with the fixes applied, as a new string, and in *applied how
+ * many were; NULL if source does not parse. opts may be NULL. */
+char* omni_fix_source(const char* source, const OmniFixOptions* opts, size_t* applied);
+
+/*
+ * Print the lines that differ between old_text and new_text as a unified
+ * diff without context, under --- and +++ headers naming path; nothing
+ * when the texts are the same:
+ *
+ *     --- prog.omni
+ *     +++ prog.omni
+ *     @@ -2 +2 @@
+ *     -  (if (g) x x))
+ *     +  (do (g) x))
+ */
+void omni_fix_print_diff(FILE* out, const char* path, const char* old_text, const char* new_text);
+
+#ifdef __cplusplus
+}
+#endif
+
+#endif /* OMNILISP_FIX_H */
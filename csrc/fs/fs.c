@@ -0,0 +1,192 @@
+/*
+ * OmniLisp Source Files Implementation
+ */
+
+#include "fs.h"
+#include <errno.h>
+#include <limits.h>
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+
+/* ============== Operating System ============== */
+
+static char* os_read(const OmniFS* fs, const char* path) {
+    (void)fs;
+    FILE* f = fopen(path, "r");
+    if (!f) return NULL;
+    fseek(f, 0, SEEK_END);
+    long size = ftell(f);
+    fseek(f, 0, SEEK_SET);
+    if (size < 0) {
+        int err = errno;
+        fclose(f);
+        errno = err;
+        return NULL;
+    }
+    char* text = malloc((size_t)size + 1);
+    size_t n = fread(text, 1, (size_t)size, f);
+    text[n] = '\0';
+    fclose(f);
+    return text;
+}
+
+static bool os_canonical(const OmniFS* fs, const char* path, char* out, size_t cap) {
+    (void)fs;
+    char resolved[PATH_MAX];
+    if (!realpath(path, resolved)) return false;
+    if (strlen(resolved) >= cap) {
+        errno = ENAMETOOLONG;
+        return false;
+    }
+    strcpy(out, resolved);
+    return true;
+}
+
+static const OmniFS g_os_fs = { os_read, os_canonical, NULL };
+
+const OmniFS* omni_fs_os(void) {
+    return &g_os_fs;
+}
+
+char* omni_fs_read(const OmniFS* fs, const char* path) {
+    return (fs ? fs : &g_os_fs)->read(fs ? fs : &g_os_fs, path);
+}
+
+bool omni_fs_canonical(const OmniFS* fs, const char* path, char* out, size_t cap) {
+    return (fs ? fs : &g_os_fs)->canonical(fs ? fs : &g_os_fs, path, out, cap);
+}
+
+/* ============== Memory ============== */
+
+typedef struct {
+    const OmniFS* fallback;
+    char** paths;             /* Folded */
+    char** texts;
+    size_t count;
+    size_t capacity;
+} MemoryFiles;
+
+/* path with "." and "dir/.." parts and repeated slashes folded away,
+ * malloc'd: "a/./b//../c" is "a/c" */
+static char* fold_path(const char* path) {
+    size_t len = strlen(path);
+    char* out = malloc(len + 2);
+    size_t n = 0;
+    size_t floor = 0;         /* Leading "/" and ".." parts cannot be folded */
+    if (path[0] == '/') out[n++] = '/', floor = 1;
+
+    for (const char* p = path; *p;) {
+        while (*p == '/') p++;
+        const char* end = strchr(p, '/');
+        size_t part = end ? (size_t)(end - p) : strlen(p);
+        if (part == 0 || (part == 1 && p[0] == '.')) {
+            /* Nothing */
+        } else if (part == 2 && p[0] == '.' && p[1] == '.' && n > floor) {
+            /* Back over the last part */
+            while (n > floor && out[n - 1] != '/') n--;
+            if (n > floor) n--;
+        } else if (part == 2 && p[0] == '.' && p[1] == '.' && path[0] == '/') {
+            /* Above the root is the root */
+        } else {
+            if (n > 0 && out[n - 1] != '/') out[n++] = '/';
+            memcpy(out + n, p, part);
+            n += part;
+            if (part == 2 && p[0] == '.' && p[1] == '.') floor = n;
+        }
+        p += part;
+    }
+    if (n == 0) out[n++] = '.';
+    out[n] = '\0';
+    return out;
+}
+
+/* Index of the file at folded path, or count if it is not held */
+static size_t memory_find(const MemoryFiles* m, const char* folded) {
+    size_t i = 0;
+    while (i < m->count && strcmp(m->paths[i], folded) != 0) i++;
+    return i;
+}
+
+static char* memory_read(const OmniFS* fs, const char* path) {
+    const MemoryFiles* m = fs->data;
+    char* folded = fold_path(path);
+    size_t i = memory_find(m, folded);
+    free(folded);
+    if (i < m->count) return strdup(m->texts[i]);
+    if (m->fallback) return omni_fs_read(m->fallback, path);
+    errno = ENOENT;
+    return NULL;
+}
+
+static bool memory_canonical(const OmniFS* fs, const char* path, char* out, size_t cap) {
+    const MemoryFiles* m = fs->data;
+    char* folded = fold_path(path);
+    bool found = memory_find(m, folded) < m->count;
+    if (found && strlen(folded) >= cap) {
+        free(folded);
+        errno = ENAMETOOLONG;
+        return false;
+    }
+    if (found) strcpy(out, folded);
+    free(folded);
+    if (found) return true;
+    if (m->fallback) return omni_fs_canonical(m->fallback, path, out, cap);
+    errno = ENOENT;
+    return false;
+}
+
+OmniFS* omni_fs_memory_new(const OmniFS* fallback) {
+    OmniFS* fs = malloc(sizeof(OmniFS));
+    MemoryFiles* m = calloc(1, sizeof(MemoryFiles));
+    m->fallback = fallback;
+    *fs = (OmniFS){ memory_read, memory_canonical, m };
+    return fs;
+}
+
+void omni_fs_memory_free(OmniFS* fs) {
+    if (!fs) return;
+    MemoryFiles* m = fs->data;
+    for (size_t i = 0; i < m->count; i++) {
+        free(m->paths[i]);
+        free(m->texts[i]);
+    }
+    free(m->paths);
+    free(m->texts);
+    free(m);
+    free(fs);
+}
+
+void omni_fs_memory_put(OmniFS* fs, const char* path, const char* text) {
+    MemoryFiles* m = fs->data;
+    char* folded = fold_path(path);
+    size_t i = memory_find(m, folded);
+    if (i < m->count) {
+        free(folded);
+        free(m->texts[i]);
+        m->texts[i] = strdup(text);
+        return;
+    }
+    if (m->count >= m->capacity) {
+        m->capacity = m->capacity ? m->capacity * 2 : 8;
+        m->paths = realloc(m->paths, m->capacity * sizeof(char*));
+        m->texts = realloc(m->texts, m->capacity * sizeof(char*));
+    }
+    m->paths[m->count] = folded;
+    m->texts[m->count] = strdup(text);
+    m->count++;
+}
+
+bool omni_fs_memory_remove(OmniFS* fs, const char* path) {
+    MemoryFiles* m = fs->data;
+    char* folded = fold_path(path);
+    size_t i = memory_find(m, folded);
+    free(folded);
+    if (i == m->count) return false;
+    free(m->paths[i]);
+    free(m->texts[i]);
+    m->count--;
+    memmove(m->paths + i, m->paths + i + 1, (m->count - i) * sizeof(char*));
+    memmove(m->texts + i, m->texts + i + 1, (m->count - i) * sizeof(char*));
+    return true;
+}
@@ -0,0 +1,61 @@
+/*
+ * OmniLisp Source Files
+ *
+ * Where the front end reads source text from. The CLI, the compiler's
+ * file entry points and the module loader go through an OmniFS instead
+ * of the operating system, so a program can be compiled from an editor's
+ * unsaved buffers, or from memory where there are no files at all (tests,
+ * a wasm build of the compiler).
+ */
+
+#ifndef OMNILISP_FS_H
+#define OMNILISP_FS_H
+
+#include <stdbool.h>
+#include <stddef.h>
+
+#ifdef __cplusplus
+extern "C" {
+#endif
+
+typedef struct OmniFS OmniFS;
+
+struct OmniFS {
+    /* Whole text of the file at path, malloc'd; NULL with errno set when
+     * it cannot be read */
+    char* (*read)(const OmniFS* fs, const char* path);
+
+    /* The name of the file at path that every path to it shares, into out
+     * (cap bytes); false with errno set when there is no such file */
+    bool (*canonical)(const OmniFS* fs, const char* path, char* out, size_t cap);
+
+    void* data;
+};
+
+/* The operating system's files */
+const OmniFS* omni_fs_os(void);
+
+char* omni_fs_read(const OmniFS* fs, const char* path);
+bool omni_fs_canonical(const OmniFS* fs, const char* path, char* out, size_t cap);
+
+/*
+ * Files held in memory, over fallback (NULL for none): a file put here
+ * hides the fallback's file of the same name, as an unsaved buffer hides
+ * the file on disk. Paths are told apart as written once "." and "dir/.."
+ * parts and repeated slashes are folded, so put absolute paths to hide
+ * files of the operating system.
+ */
+OmniFS* omni_fs_memory_new(const OmniFS* fallback);
+void omni_fs_memory_free(OmniFS* fs);
+
+/* Add the file at path with text, or replace its text */
+void omni_fs_memory_put(OmniFS* fs, const char* path, const char* text);
+
+/* Drop the file at path, uncovering the fallback's; false if there is none */
+bool omni_fs_memory_remove(OmniFS* fs, const char* path);
+
+#ifdef __cplusplus
+}
+#endif
+
+#endif /* OMNILISP_FS_H */
@@ -0,0 +1,492 @@
+/*
+ * OmniLisp Lint Implementation
+ */
+
+#include "lint.h"
+#include "../diff/diff.h"
+#include <stdarg.h>
+#include <stdlib.h>
+#include <string.h>
+#include <strings.h>
+
+/* Longest value quoted in a message */
+#define LINT_SNIPPET_MAX 60
+
+/* ============== Catalog ============== */
+
+static const OmniLintInfo g_rules[] = {
+    { OMNI_LINT_IGNORED_VALUE, "L0001", "result of a pure expression ignored",
+      "A form of a body other than the last computes a value without doing\n"
+      "anything else - a constant, a variable, a quoted datum, a lambda or a\n"
+      "primitive such as + or car applied to such values - and the value is\n"
+      "dropped. It is usually a leftover or a misplaced parenthesis. The fix\n"
+      "deletes the form.\n" },
+    { OMNI_LINT_SAME_BRANCHES, "L0002", "if with identical branches",
+      "Both branches of an if are the same expression, so the test decides\n"
+      "nothing. The fix replaces (if c x x) with x, or with (do c x) when\n"
+      "the test may have effects.\n" },
+    { OMNI_LINT_CAR_OF_CONS, "L0003", "car or cdr of a cons just made",
+      "(car (cons a b)) is a and (cdr (cons a b)) is b; the pair is built\n"
+      "only to be taken apart. The fix keeps the part that is used when the\n"
+      "other one has no effects.\n" },
+    { OMNI_LINT_SELF_COMPARISON, "L0004", "value compared with itself",
+      "Both sides of a comparison are the same expression, so the result\n"
+      "does not depend on the value: (= x x) and (eq? x x) are true,\n"
+      "(< x x) is false. One side is usually meant to be something else.\n" },
+    { OMNI_LINT_NO_BASE_CASE, "L0005", "recursion without a base case",
+      "A function calls itself, and its body has no if, cond, case, and or\n"
+      "or, so every call makes another and it never returns. Add the test\n"
+      "that ends the recursion.\n" },
+    { OMNI_LINT_FLOAT_EQUALITY, "L0006", "= on floats",
+      "= compares floats exactly, and a float computed by arithmetic is\n"
+      "rarely exactly the literal it is compared with: (= (+ 0.1 0.2) 0.3)\n"
+      "is false. Compare the difference with a tolerance instead, as in\n"
+      "(< (abs (- a b)) 1e-9).\n" },
+    { OMNI_LINT_UNUSED_BINDING, "L0007", "unused let binding",
+      "A let or let* binds a name that its body, and for let* the bindings\n"
+      "after it, never mention. The fix deletes a (name init) binding whose\n"
+      "init has no effects; one whose init does something is only reported,\n"
+      "since (do init ...) would keep the effect without the name.\n" },
+    { OMNI_LINT_APPEND_CHAIN, "L0008", "append chain nested to the left",
+      "append copies every list but its last, so (append (append a b) c)\n"
+      "copies a twice, and a longer chain built this way copies its first\n"
+      "lists again at each step. The fix nests the chain to the right,\n"
+      "(append a (append b c)), which evaluates the same lists in the same\n"
+      "order and copies each once.\n" },
+};
+
+const OmniLintInfo* omni_lint_info(OmniLintRule rule) {
+    for (size_t i = 0; i < sizeof(g_rules) / sizeof(g_rules[0]); i++) {
+        if (g_rules[i].rule == rule) return &g_rules[i];
+    }
+    return NULL;
+}
+
+const OmniLintInfo* omni_lint_lookup(const char* id) {
+    if (!id) return NULL;
+    for (size_t i = 0; i < sizeof(g_rules) / sizeof(g_rules[0]); i++) {
+        if (strcasecmp(g_rules[i].id, id) == 0) return &g_rules[i];
+    }
+    return NULL;
+}
+
+/* ============== Lint State ============== */
+
+typedef struct {
+    OmniArena* arena;         /* Where fixes are built */
+    OmniLints* lints;
+    OmniValue** forms;        /* The program, for the names it defines */
+    size_t count;
+} LintWalk;
+
+static bool is_form(OmniValue* x, const char* name) {
+    return omni_is_cell(x) && omni_sym_eq_str(omni_car(x), name);
+}
+
+/* Whether the program defines name at top level, replacing a primitive */
+static bool redefined(LintWalk* w, const char* name) {
+    for (size_t i = 0; i < w->count; i++) {
+        if (!is_form(w->forms[i], "define")) continue;
+        OmniValue* target = omni_car(omni_cdr(w->forms[i]));
+        if (omni_is_cell(target)) target = omni_car(target);
+        if (omni_sym_eq_str(target, name)) return true;
+    }
+    return false;
+}
+
+/* A call of the primitive name, which the program has not redefined */
+static bool prim_call(LintWalk* w, OmniValue* x, const char* name) {
+    return is_form(x, name) && !redefined(w, name);
+}
+
+/* Text of v for a message, cut short when long */
+static void snippet(OmniValue* v, char* buf, size_t cap) {
+    char* text = omni_value_to_string(v);
+    if (!text) {
+        snprintf(buf, cap, "?");
+        return;
+    }
+    if (strlen(text) > LINT_SNIPPET_MAX) {
+        snprintf(buf, cap, "%.*s...", LINT_SNIPPET_MAX - 3, text);
+    } else {
+        snprintf(buf, cap, "%s", text);
+    }
+    free(text);
+}
+
+static OmniLint* add_lint(LintWalk* w, OmniLintRule rule, OmniValue* at, const char* fmt, ...) {
+    OmniLints* l = w->lints;
+    if (l->count == l->capacity) {
+        l->capacity = l->capacity ? l->capacity * 2 : 16;
+        l->items = realloc(l->items, l->capacity * sizeof(OmniLint));
+    }
+    OmniLint* lint = &l->items[l->count++];
+    memset(lint, 0, sizeof(*lint));
+    lint->rule = rule;
+    lint->at = at;
+    va_list args;
+    va_start(args, fmt);
+    vsnprintf(lint->message, sizeof(lint->message), fmt, args);
+    va_end(args);
+    return lint;
+}
+
+/* ============== Purity ============== */
+
+/* Primitives whose only effect is their value */
+static const char* g_pure_prims[] = {
+    "+", "-", "*", "/", "%", "<", ">", "<=", ">=", "=", "min", "max", "expt", "gcd", "lcm", "sqrt",
+    "cons", "car", "cdr", "null?", "proper-list?", "eq?", "procedure?", "arity", "length",
+    "append", "reverse", "string?", "keyword?", "string-length", "error?", "error-message", "error-data",
+    "error-payload", "error-tag", "error-trace",
+};
+
+static bool pure_prim(LintWalk* w, OmniValue* head) {
+    if (!omni_is_sym(head)) return false;
+    for (size_t i = 0; i < sizeof(g_pure_prims) / sizeof(g_pure_prims[0]); i++) {
+        if (strcmp(g_pure_prims[i], head->str_val) == 0) return !redefined(w, head->str_val);
+    }
+    return false;
+}
+
+/* Whether evaluating x does nothing but make its value: a literal, a
+ * variable, a quoted datum, a lambda, or a pure primitive applied to
+ * such expressions */
+static bool pure(LintWalk* w, OmniValue* x) {
+    if (omni_is_array(x)) {
+        for (size_t i = 0; i < x->array.len; i++) {
+            if (!pure(w, x->array.data[i])) return false;
+        }
+        return true;
+    }
+    if (!omni_is_cell(x)) return true;
+    if (is_form(x, "quote") || is_form(x, "lambda") || is_form(x, "fn")) return true;
+    if (!pure_prim(w, omni_car(x))) return false;
+    for (OmniValue* a = omni_cdr(x); omni_is_cell(a); a = omni_cdr(a)) {
+        if (!pure(w, omni_car(a))) return false;
+    }
+    return true;
+}
+
+/* ============== Rules ============== */
+
+static void lint_node(LintWalk* w, OmniValue* x);
+
+/* The forms of a body; each but the last is there for its effects */
+static void lint_body(LintWalk* w, OmniValue* body) {
+    for (; omni_is_cell(body); body = omni_cdr(body)) {
+        OmniValue* form = omni_car(body);
+        if (omni_is_cell(omni_cdr(body)) && !is_form(form, "define") && pure(w, form)) {
+            char text[LINT_SNIPPET_MAX + 8];
+            snippet(form, text, sizeof(text));
+            add_lint(w, OMNI_LINT_IGNORED_VALUE, form, "the value of %s is never used", text)->fixable = true;
+        }
+        lint_node(w, form);
+    }
+}
+
+/* (if c x x) */
+static void lint_if(LintWalk* w, OmniValue* x) {
+    OmniValue* args = omni_cdr(x);
+    if (omni_list_len(args) != 3) return;
+    OmniValue* test = omni_car(args);
+    OmniValue* then = omni_car(omni_cdr(args));
+    if (!omni_diff_equal(then, omni_car(omni_cdr(omni_cdr(args))))) return;
+    char text[LINT_SNIPPET_MAX + 8];
+    snippet(then, text, sizeof(text));
+    OmniLint* lint = add_lint(w, OMNI_LINT_SAME_BRANCHES, x, "both branches of this if are %s", text);
+    lint->fixable = true;
+    lint->fix = pure(w, test) ? then
+              : omni_new_cell(w->arena, omni_new_sym(w->arena, "do"),
+                              omni_new_cell(w->arena, test, omni_new_cell(w->arena, then, omni_nil)));
+}
+
+/* (car (cons a b)) and (cdr (cons a b)) */
+static void lint_car_of_cons(LintWalk* w, OmniValue* x, bool car) {
+    OmniValue* pair = omni_car(omni_cdr(x));
+    if (!omni_is_nil(omni_cdr(omni_cdr(x))) || !prim_call(w, pair, "cons") ||
+        omni_list_len(omni_cdr(pair)) != 2) {
+        return;
+    }
+    OmniValue* kept = car ? omni_car(omni_cdr(pair)) : omni_car(omni_cdr(omni_cdr(pair)));
+    OmniValue* dropped = car ? omni_car(omni_cdr(omni_cdr(pair))) : omni_car(omni_cdr(pair));
+    char text[LINT_SNIPPET_MAX + 8];
+    snippet(kept, text, sizeof(text));
+    OmniLint* lint = add_lint(w, OMNI_LINT_CAR_OF_CONS, x, "%s of a cons just made is %s",
+                              car ? "car" : "cdr", text);
+    if (pure(w, dropped)) {
+        lint->fixable = true;
+        lint->fix = kept;
+    }
+}
+
+/* Comparisons and = of floats */
+static void lint_comparison(LintWalk* w, OmniValue* x) {
+    static const struct {
+        const char* name;
+        bool holds;           /* Of a value and itself */
+    } ops[] = {
+        { "=", true }, { "<=", true }, { ">=", true }, { "eq?", true }, { "<", false }, { ">", false },
+    };
+    const char* name = omni_car(x)->str_val;
+    OmniValue* args = omni_cdr(x);
+    for (size_t i = 0; i < sizeof(ops) / sizeof(ops[0]); i++) {
+        if (strcmp(ops[i].name, name) != 0 || !prim_call(w, x, name)) continue;
+        if (omni_list_len(args) == 2 && omni_diff_equal(omni_car(args), omni_car(omni_cdr(args))) &&
+            pure(w, omni_car(args))) {
+            char text[LINT_SNIPPET_MAX + 8];
+            snippet(omni_car(args), text, sizeof(text));
+            add_lint(w, OMNI_LINT_SELF_COMPARISON, x, "%s compares %s with itself, so it is always %s",
+                     name, text, ops[i].holds ? "true" : "false");
+            return;
+        }
+    }
+    if (strcmp(name, "=") != 0 || !prim_call(w, x, "=")) return;
+    for (OmniValue* a = args; omni_is_cell(a); a = omni_cdr(a)) {
+        if (omni_is_float(omni_car(a))) {
+            add_lint(w, OMNI_LINT_FLOAT_EQUALITY, x,
+                     "= compares floats exactly; compare the difference with a tolerance");
+            return;
+        }
+    }
+}
+
+/* Whether x calls name outside any lambda or quote */
+static bool calls(OmniValue* x, const char* name) {
+    if (omni_is_array(x)) {
+        for (size_t i = 0; i < x->array.len; i++) {
+            if (calls(x->array.data[i], name)) return true;
+        }
+        return false;
+    }
+    if (!omni_is_cell(x) || is_form(x, "quote") || is_form(x, "lambda") || is_form(x, "fn")) return false;
+    if (omni_sym_eq_str(omni_car(x), name)) return true;
+    for (; omni_is_cell(x); x = omni_cdr(x)) {
+        if (calls(omni_car(x), name)) return true;
+    }
+    return false;
+}
+
+/* Whether x has a form that can choose not to evaluate part of it,
+ * outside any lambda or quote */
+static bool branches(OmniValue* x) {
+    static const char* forms[] = { "if", "cond", "case", "and", "or", "match", "when", "unless" };
+    if (omni_is_array(x)) {
+        for (size_t i = 0; i < x->array.len; i++) {
+            if (branches(x->array.data[i])) return true;
+        }
+        return false;
+    }
+    if (!omni_is_cell(x) || is_form(x, "quote") || is_form(x, "lambda") || is_form(x, "fn")) return false;
+    for (size_t i = 0; i < sizeof(forms) / sizeof(forms[0]); i++) {
+        if (is_form(x, forms[i])) return true;
+    }
+    for (; omni_is_cell(x); x = omni_cdr(x)) {
+        if (branches(omni_car(x))) return true;
+    }
+    return false;
+}
+
+/* (define (name params...) body...) that calls itself with no way out */
+static void lint_recursion(LintWalk* w, OmniValue* x) {
+    OmniValue* target = omni_car(omni_cdr(x));
+    OmniValue* name = omni_car(target);
+    OmniValue* body = omni_cdr(omni_cdr(x));
+    if (!omni_is_sym(name)) return;
+    for (OmniValue* p = omni_cdr(target); omni_is_cell(p); p = omni_cdr(p)) {
+        if (omni_sym_eq_str(omni_car(p), name->str_val)) return;
+    }
+    if (calls(body, name->str_val) && !branches(body)) {
+        add_lint(w, OMNI_LINT_NO_BASE_CASE, x, "%s calls itself on every path, so it never returns",
+                 name->str_val);
+    }
+}
+
+/* Whether x mentions the symbol name anywhere, quoted or not */
+static bool mentions(OmniValue* x, const char* name) {
+    if (omni_is_sym(x)) return strcmp(x->str_val, name) == 0;
+    if (omni_is_array(x)) {
+        for (size_t i = 0; i < x->array.len; i++) {
+            if (mentions(x->array.data[i], name)) return true;
+        }
+        return false;
+    }
+    for (; omni_is_cell(x); x = omni_cdr(x)) {
+        if (mentions(omni_car(x), name)) return true;
+    }
+    return false;
+}
+
+/* Bindings of a let or let* that nothing after them mentions */
+static void lint_unused(LintWalk* w, OmniValue* x, OmniValue* bindings, OmniValue* body) {
+    bool sequential = is_form(x, "let*");
+    if (omni_is_array(bindings)) {
+        for (size_t i = 0; i + 1 < bindings->array.len; i += 2) {
+            OmniValue* name = bindings->array.data[i];
+            if (!omni_is_sym(name) || mentions(body, name->str_val)) continue;
+            bool later = false;
+            for (size_t j = i + 3; sequential && j < bindings->array.len && !later; j += 2) {
+                later = mentions(bindings->array.data[j], name->str_val);
+            }
+            if (!later) add_lint(w, OMNI_LINT_UNUSED_BINDING, name, "%s is bound but never used", name->str_val);
+        }
+        return;
+    }
+    for (OmniValue* b = bindings; omni_is_cell(b); b = omni_cdr(b)) {
+        OmniValue* binding = omni_car(b);
+        OmniValue* name = omni_car(binding);
+        if (!omni_is_cell(binding) || !omni_is_sym(name) || mentions(body, name->str_val) ||
+            (sequential && mentions(omni_cdr(b), name->str_val))) {
+            continue;
+        }
+        OmniLint* lint = add_lint(w, OMNI_LINT_UNUSED_BINDING, binding, "%s is bound but never used",
+                                  name->str_val);
+        lint->fixable = pure(w, omni_car(omni_cdr(binding)));
+    }
+}
+
+/* (append (append a b) c), as a chain of any length; the lists in it are
+ * checked in turn. False for any other append. */
+static bool lint_append_chain(LintWalk* w, OmniValue* x) {
+    OmniValue* first = omni_car(omni_cdr(x));
+    if (omni_list_len(omni_cdr(x)) != 2 || !prim_call(w, first, "append") ||
+        omni_list_len(omni_cdr(first)) != 2) {
+        return false;
+    }
+    /* The lists in order: walk down the left spine, then add each right
+     * operand on the way back */
+    OmniValue* lists = omni_nil;
+    OmniValue* spine = x;
+    for (; prim_call(w, spine, "append") && omni_list_len(omni_cdr(spine)) == 2;
+         spine = omni_car(omni_cdr(spine))) {
+        lists = omni_new_cell(w->arena, omni_car(omni_cdr(omni_cdr(spine))), lists);
+    }
+    lists = omni_new_cell(w->arena, spine, lists);
+    size_t n = omni_list_len(lists);
+    OmniValue** items = malloc(n * sizeof(OmniValue*));
+    for (size_t i = 0; i < n; i++, lists = omni_cdr(lists)) items[i] = omni_car(lists);
+    OmniValue* fix = items[n - 1];
+    for (size_t i = n - 1; i-- > 0;) {
+        fix = omni_new_cell(w->arena, omni_new_sym(w->arena, "append"),
+                            omni_new_cell(w->arena, items[i], omni_new_cell(w->arena, fix, omni_nil)));
+    }
+
+    char text[LINT_SNIPPET_MAX + 8];
+    snippet(first, text, sizeof(text));
+    OmniLint* lint = add_lint(w, OMNI_LINT_APPEND_CHAIN, x, "append copies the lists of %s again", text);
+    lint->fixable = true;
+    lint->fix = fix;
+    for (size_t i = 0; i < n; i++) lint_node(w, items[i]);
+    free(items);
+    return true;
+}
+
+/* ============== Walk ============== */
+
+/* (name init) bindings, or [name init ...] */
+static void lint_bindings(LintWalk* w, OmniValue* bindings) {
+    if (omni_is_array(bindings)) {
+        for (size_t i = 1; i < bindings->array.len; i += 2) lint_node(w, bindings->array.data[i]);
+        return;
+    }
+    for (; omni_is_cell(bindings); bindings = omni_cdr(bindings)) {
+        OmniValue* binding = omni_car(bindings);
+        if (omni_is_cell(binding)) lint_node(w, omni_car(omni_cdr(binding)));
+    }
+}
+
+static void lint_node(LintWalk* w, OmniValue* x) {
+    if (omni_is_array(x)) {
+        for (size_t i = 0; i < x->array.len; i++) lint_node(w, x->array.data[i]);
+        return;
+    }
+    if (!omni_is_cell(x)) return;
+    /* Quoted data and templates, and macro bodies that build them */
+    if (is_form(x, "quote") || is_form(x, "quasiquote") || is_form(x, "defmacro")) return;
+
+    OmniValue* args = omni_cdr(x);
+    if (is_form(x, "define")) {
+        if (omni_is_cell(omni_car(args))) {
+            lint_recursion(w, x);
+            lint_body(w, omni_cdr(args));
+        } else {
+            lint_node(w, omni_car(omni_cdr(args)));
+        }
+        return;
+    }
+    if (is_form(x, "lambda") || is_form(x, "fn")) {
+        lint_body(w, omni_cdr(args));
+        return;
+    }
+    if (is_form(x, "let") || is_form(x, "let*") || is_form(x, "letrec") || is_form(x, "letrec*")) {
+        /* A named let has its name first */
+        if (omni_is_sym(omni_car(args))) {
+            args = omni_cdr(args);
+        } else if (is_form(x, "let") || is_form(x, "let*")) {
+            lint_unused(w, x, omni_car(args), omni_cdr(args));
+        }
+        lint_bindings(w, omni_car(args));
+        lint_body(w, omni_cdr(args));
+        return;
+    }
+    if (is_form(x, "do") || is_form(x, "begin")) {
+        lint_body(w, args);
+        return;
+    }
+    if (is_form(x, "cond")) {
+        for (; omni_is_cell(args); args = omni_cdr(args)) {
+            OmniValue* clause = omni_car(args);
+            if (!omni_is_cell(clause)) continue;
+            lint_node(w, omni_car(clause));
+            lint_body(w, omni_cdr(clause));
+        }
+        return;
+    }
+
+    if (is_form(x, "if")) {
+        lint_if(w, x);
+    } else if (prim_call(w, x, "car") || prim_call(w, x, "cdr")) {
+        lint_car_of_cons(w, x, omni_sym_eq_str(omni_car(x), "car"));
+    } else if (prim_call(w, x, "append") && lint_append_chain(w, x)) {
+        return;
+    } else if (omni_is_sym(omni_car(x))) {
+        lint_comparison(w, x);
+    }
+    for (; omni_is_cell(x); x = omni_cdr(x)) lint_node(w, omni_car(x));
+}
+
+/* ============== Public API ============== */
+
+OmniLints* omni_lint_forms(OmniArena* arena, OmniValue** forms, size_t count) {
+    OmniLints* lints = calloc(1, sizeof(OmniLints));
+    if (!lints) return NULL;
+    LintWalk w = { arena, lints, forms, count };
+    /* Top-level values are printed, so only bodies drop theirs */
+    for (size_t i = 0; i < count; i++) lint_node(&w, forms[i]);
+    return lints;
+}
+
+void omni_lint_free(OmniLints* lints) {
+    if (!lints) return;
+    free(lints->items);
+    free(lints);
+}
+
+void omni_lint_print(FILE* out, const char* path, const OmniLints* lints) {
+    if (!lints) return;
+    for (size_t i = 0; i < lints->count; i++) {
+        const OmniLint* lint = &lints->items[i];
+        fprintf(out, "%s:%d:%d: %s %s\n", path, lint->at->line, lint->at->column,
+                omni_lint_info(lint->rule)->id, lint->message);
+        if (!lint->fixable) continue;
+        char* at = omni_value_to_string(lint->at);
+        if (lint->fix) {
+            char* fix = omni_value_to_string(lint->fix);
+            fprintf(out, "  fix: replace %s with %s\n", at, fix);
+            free(fix);
+        } else {
+            fprintf(out, "  fix: delete %s\n", at);
+        }
+        free(at);
+    }
+}
@@ -0,0 +1,90 @@
+/*
+ * OmniLisp Lint
+ *
+ * Static checks for code the compiler accepts but that is probably not
+ * what was meant: a pure value computed and dropped, an if whose
+ * branches are the same, (car (cons a b)), a value compared with itself,
+ * a function that calls itself on every path, = on floats, let bindings
+ * nothing uses and append chains that copy their prefix again. Programs
+ * are checked as parsed, before macro expansion, so positions are the
+ * source's. Each finding has a stable code (L0001, ...) and, where the
+ * rewrite cannot change what the program does, a fix.
+ */
+
+#ifndef OMNILISP_LINT_H
+#define OMNILISP_LINT_H
+
+#include "../ast/ast.h"
+#include <stdio.h>
+#include <stdbool.h>
+#include <stddef.h>
+
+#ifdef __cplusplus
+extern "C" {
+#endif
+
+typedef enum {
+    OMNI_LINT_IGNORED_VALUE = 1,  /* L0001 */
+    OMNI_LINT_SAME_BRANCHES,      /* L0002 */
+    OMNI_LINT_CAR_OF_CONS,        /* L0003 */
+    OMNI_LINT_SELF_COMPARISON,    /* L0004 */
+    OMNI_LINT_NO_BASE_CASE,       /* L0005 */
+    OMNI_LINT_FLOAT_EQUALITY,     /* L0006 */
+    OMNI_LINT_UNUSED_BINDING,     /* L0007 */
+    OMNI_LINT_APPEND_CHAIN,       /* L0008 */
+    OMNI_LINT_COUNT
+} OmniLintRule;
+
+typedef struct {
+    OmniLintRule rule;
+    const char* id;               /* "L0001" */
+    const char* title;            /* One line */
+    const char* explanation;      /* Cause and fix, several lines */
+} OmniLintInfo;
+
+/* Catalog entry for a rule, or by its id ("L0001", case-insensitive);
+ * NULL when unknown */
+const OmniLintInfo* omni_lint_info(OmniLintRule rule);
+const OmniLintInfo* omni_lint_lookup(const char* id);
+
+/*
+ * One finding. With fixable set, replacing at by fix leaves what the
+ * program does unchanged; a NULL fix means deleting at, a form of a
+ * body that is not its last or a let binding. Nodes of fix taken from
+ * the program keep their positions; new ones have none.
+ */
+typedef struct OmniLint {
+    OmniLintRule rule;
+    OmniValue* at;            /* Node the finding is about */
+    char message[256];
+    bool fixable;
+    OmniValue* fix;
+} OmniLint;
+
+typedef struct OmniLints {
+    OmniLint* items;
+    size_t count;
+    size_t capacity;
+} OmniLints;
+
+/* Check a program given as top-level forms, findings in source order;
+ * the replacements fixes suggest are built in arena */
+OmniLints* omni_lint_forms(OmniArena* arena, OmniValue** forms, size_t count);
+
+/* Free the findings (the trees they point into are not touched) */
+void omni_lint_free(OmniLints* lints);
+
+/*
+ * Print the findings as path:line:col: code message, each fix on the
+ * line after it:
+ *
+ *     prog.omni:3:3: L0002 both branches of this if are (g x)
+ *       fix: replace (if (f) (g x) (g x)) with (do (f) (g x))
+ */
+void omni_lint_print(FILE* out, const char* path, const OmniLints* lints);
+
+#ifdef __cplusplus
+}
+#endif
+
+#endif /* OMNILISP_LINT_H */
@@ -0,0 +1,1943 @@
+/*
+ * OmniLisp Macros Implementation
+ */
+
+#include "macro.h"
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <stdarg.h>
+#include <stdint.h>
+#include <inttypes.h>
+
+/* Evaluation steps one expansion may take, and how deep procedure calls
+ * and expansions of expansions may nest */
+#define MACRO_MAX_STEPS 1000000
+#define MACRO_MAX_CALLS 1000
+#define MACRO_MAX_EXPANSIONS 256
+
+typedef struct Macro {
+    const char* name;
+    OmniValue* params;
+    OmniValue* body;
+} Macro;
+
+/* A (deftype ...) seen so far */
+typedef struct TypeDef {
+    const char* name;
+    OmniValue* fields;        /* Field names, in order */
+    const char* sum;          /* The sum type it is a variant of, or NULL;
+                               * the variants of one deftype share it */
+} TypeDef;
+
+struct OmniMacros {
+    Macro* macros;
+    size_t count;
+    size_t capacity;
+
+    TypeDef* types;
+    size_t type_count;
+    size_t type_capacity;
+
+    OmniArena* arena;         /* The session's, for nodes expansions make */
+    OmniValue* globals;       /* (name . primitive) cells */
+    unsigned gensyms;         /* Names made so far */
+    unsigned long steps;      /* Taken by the current expansion */
+    int calls;                /* Procedure calls in progress */
+    int expansions;           /* Expansions in progress */
+    char error[400];          /* Why evaluation stopped */
+};
+
+/* ============== Helpers ============== */
+
+static bool is_form(OmniValue* x, const char* name) {
+    return omni_is_cell(x) && omni_sym_eq_str(omni_car(x), name);
+}
+
+/* Text of v for a message, cut short when long */
+static void short_text(OmniValue* v, char* buf, size_t cap) {
+    char* text = omni_value_to_string(v);
+    snprintf(buf, cap, "%s", text);
+    if (strlen(text) >= cap && cap > 4) strcpy(buf + cap - 4, "...");
+    free(text);
+}
+
+static bool fail(OmniMacros* m, const char* fmt, ...) {
+    va_list args;
+    va_start(args, fmt);
+    vsnprintf(m->error, sizeof(m->error), fmt, args);
+    va_end(args);
+    return false;
+}
+
+static bool fail_on(OmniMacros* m, const char* what, OmniValue* v) {
+    char text[80];
+    short_text(v, text, sizeof(text));
+    return fail(m, "%s: %s", what, text);
+}
+
+static bool truthy(OmniValue* v) {
+    if (omni_is_nil(v)) return false;
+    if (omni_is_int(v)) return v->int_val != 0;
+    if (omni_is_float(v)) return v->float_val != 0.0;
+    return true;
+}
+
+static OmniValue* boolean(OmniArena* arena, bool b) {
+    return omni_new_int(arena, b ? 1 : 0);
+}
+
+/* Builds a list front to back */
+typedef struct ListBuilder {
+    OmniArena* arena;
+    OmniValue* head;
+    OmniValue** link;
+} ListBuilder;
+
+static void list_start(ListBuilder* b, OmniArena* arena) {
+    b->arena = arena;
+    b->head = omni_nil;
+    b->link = &b->head;
+}
+
+static void list_add(ListBuilder* b, OmniValue* v) {
+    *b->link = omni_new_cell(b->arena, v, omni_nil);
+    b->link = &(*b->link)->cell.cdr;
+}
+
+/* Copy of x at where's position */
+static OmniValue* copy_node(OmniArena* arena, OmniValue* x, OmniValue* where) {
+    OmniValue* y = omni_arena_alloc(arena, sizeof(OmniValue));
+    *y = *x;
+    y->line = where->line;
+    y->column = where->column;
+    return y;
+}
+
+/* Whether x mentions the symbol name outside a quote */
+static bool mentions(OmniValue* x, const char* name) {
+    if (omni_is_sym(x)) return strcmp(x->str_val, name) == 0;
+    if (omni_is_array(x)) {
+        for (size_t i = 0; i < x->array.len; i++) {
+            if (mentions(x->array.data[i], name)) return true;
+        }
+        return false;
+    }
+    if (!omni_is_cell(x) || is_form(x, "quote")) return false;
+    return mentions(omni_car(x), name) || mentions(omni_cdr(x), name);
+}
+
+/* The variables and inits of let bindings, ((var init) ...) or
+ * [var init ...], as two lists; false if they are malformed */
+static bool binding_parts(OmniArena* arena, OmniValue* bindings, OmniValue** vars, OmniValue** inits) {
+    ListBuilder v, i;
+    list_start(&v, arena);
+    list_start(&i, arena);
+    if (omni_is_array(bindings)) {
+        if (bindings->array.len % 2 != 0) return false;
+        for (size_t k = 0; k < bindings->array.len; k += 2) {
+            if (!omni_is_sym(bindings->array.data[k])) return false;
+            list_add(&v, bindings->array.data[k]);
+            list_add(&i, bindings->array.data[k + 1]);
+        }
+    } else {
+        for (; omni_is_cell(bindings); bindings = omni_cdr(bindings)) {
+            OmniValue* pair = omni_car(bindings);
+            if (omni_list_len(pair) != 2 || !omni_is_nil(omni_cdr(omni_cdr(pair))) ||
+                !omni_is_sym(omni_car(pair))) {
+                return false;
+            }
+            list_add(&v, omni_car(pair));
+            list_add(&i, omni_car(omni_cdr(pair)));
+        }
+        if (!omni_is_nil(bindings)) return false;
+    }
+    *vars = v.head;
+    *inits = i.head;
+    return true;
+}
+
+/* A fresh name made from prefix, up to any % a generated name has */
+static const char* fresh_name(OmniMacros* m, const char* prefix) {
+    size_t len = strcspn(prefix, "%");
+    char name[96];
+    snprintf(name, sizeof(name), "%.*s%%%u", (int)(len < 64 ? len : 64), prefix, ++m->gensyms);
+    return omni_arena_strdup(m->arena, name);
+}
+
+/* ============== Environments ============== */
+
+/* Environments are lists of (name . value) cells, innermost first */
+static OmniValue* lookup(OmniValue* env, const char* name) {
+    for (; omni_is_cell(env); env = omni_cdr(env)) {
+        OmniValue* binding = omni_car(env);
+        if (strcmp(omni_car(binding)->str_val, name) == 0) return binding;
+    }
+    return NULL;
+}
+
+static OmniValue* bind(OmniArena* arena, OmniValue* env, OmniValue* name, OmniValue* value) {
+    return omni_new_cell(arena, omni_new_cell(arena, name, value), env);
+}
+
+/* Report that params do not take argc arguments */
+static bool arity_error(OmniMacros* m, OmniValue* params, size_t argc) {
+    size_t want = 0;
+    OmniValue* p = params;
+    if (omni_is_array(p)) {
+        want = p->array.len;
+    } else {
+        for (; omni_is_cell(p); p = omni_cdr(p)) want++;
+    }
+    return fail(m, "expects %zu%s argument%s, got %zu", want, omni_is_sym(p) ? " or more" : "",
+                want == 1 ? "" : "s", argc);
+}
+
+/* env with params, a list (maybe dotted), a symbol or an array, bound
+ * to the argc args */
+static bool bind_params(OmniMacros* m, OmniValue* params, OmniValue** args, size_t argc,
+                        OmniValue* env, OmniValue** out) {
+    OmniArena* arena = m->arena;
+    size_t i = 0;
+    if (omni_is_array(params)) {
+        if (params->array.len != argc) return arity_error(m, params, argc);
+        for (; i < argc; i++) env = bind(arena, env, params->array.data[i], args[i]);
+        *out = env;
+        return true;
+    }
+    OmniValue* p = params;
+    for (; omni_is_cell(p); p = omni_cdr(p)) {
+        if (i >= argc) return arity_error(m, params, argc);
+        env = bind(arena, env, omni_car(p), args[i++]);
+    }
+    if (omni_is_sym(p)) {
+        ListBuilder rest;
+        list_start(&rest, arena);
+        while (i < argc) list_add(&rest, args[i++]);
+        env = bind(arena, env, p, rest.head);
+    } else if (i < argc) {
+        return arity_error(m, params, argc);
+    }
+    *out = env;
+    return true;
+}
+
+/* True if params are symbols in one of the shapes bind_params takes */
+static bool valid_params(OmniValue* params) {
+    if (omni_is_array(params)) {
+        for (size_t i = 0; i < params->array.len; i++) {
+            if (!omni_is_sym(params->array.data[i])) return false;
+        }
+        return true;
+    }
+    OmniValue* p = params;
+    for (; omni_is_cell(p); p = omni_cdr(p)) {
+        if (!omni_is_sym(omni_car(p))) return false;
+    }
+    return omni_is_nil(p) || omni_is_sym(p);
+}
+
+/* ============== Evaluation ============== */
+
+static bool eval(OmniMacros* m, OmniValue* x, OmniValue* env, OmniValue** out);
+static bool apply(OmniMacros* m, OmniValue* f, OmniValue** args, size_t argc, OmniValue** out);
+
+/* Evaluate the forms of body in order; (define ...) among them binds a
+ * name for the forms after it, itself included */
+static bool eval_body(OmniMacros* m, OmniValue* body, OmniValue* env, OmniValue** out) {
+    OmniArena* arena = m->arena;
+    *out = omni_nil;
+    for (; omni_is_cell(body); body = omni_cdr(body)) {
+        OmniValue* form = omni_car(body);
+        if (!is_form(form, "define")) {
+            if (!eval(m, form, env, out)) return false;
+            continue;
+        }
+        OmniValue* target = omni_car(omni_cdr(form));
+        OmniValue* name = omni_is_cell(target) ? omni_car(target) : target;
+        if (!omni_is_sym(name) || (omni_is_cell(target) && !valid_params(omni_cdr(target)))) {
+            return fail_on(m, "malformed define", form);
+        }
+        OmniValue* binding = omni_new_cell(arena, name, omni_nil);
+        env = omni_new_cell(arena, binding, env);
+        OmniValue* value;
+        if (omni_is_cell(target)) {
+            value = omni_new_lambda(arena, omni_cdr(target), omni_cdr(omni_cdr(form)), env);
+        } else if (!eval(m, omni_car(omni_cdr(omni_cdr(form))), env, &value)) {
+            return false;
+        }
+        binding->cell.cdr = value;
+        *out = omni_nil;
+    }
+    return true;
+}
+
+/* Bind name to init for a let; sequential lets see earlier bindings */
+static bool let_bind(OmniMacros* m, OmniValue* name, OmniValue* init, OmniValue* env,
+                     bool sequential, OmniValue** inner) {
+    if (!omni_is_sym(name)) return fail_on(m, "let binds a non-symbol", name);
+    OmniValue* value;
+    if (!eval(m, init, sequential ? *inner : env, &value)) return false;
+    *inner = bind(m->arena, *inner, name, value);
+    return true;
+}
+
+/* (let name ((var init) ...) body...): name is bound, in the body, to a
+ * procedure of the vars, and called with the inits */
+static bool eval_named_let(OmniMacros* m, OmniValue* x, OmniValue* env, OmniValue** out) {
+    OmniArena* arena = m->arena;
+    OmniValue* name = omni_car(omni_cdr(x));
+    OmniValue* vars;
+    OmniValue* inits;
+    if (!binding_parts(arena, omni_car(omni_cdr(omni_cdr(x))), &vars, &inits)) {
+        return fail_on(m, "malformed named let", x);
+    }
+    OmniValue* binding = omni_new_cell(arena, name, omni_nil);
+    binding->cell.cdr = omni_new_lambda(arena, vars, omni_cdr(omni_cdr(omni_cdr(x))),
+                                        omni_new_cell(arena, binding, env));
+    size_t argc = omni_list_len(inits);
+    OmniValue** vals = argc ? omni_arena_alloc(arena, argc * sizeof(OmniValue*)) : NULL;
+    for (size_t i = 0; i < argc; i++, inits = omni_cdr(inits)) {
+        if (!eval(m, omni_car(inits), env, &vals[i])) return false;
+    }
+    return apply(m, omni_cdr(binding), vals, argc, out);
+}
+
+/* (let ((name init) ...) body...) or (let [name init ...] body...) */
+static bool eval_let(OmniMacros* m, OmniValue* x, OmniValue* env, bool sequential, OmniValue** out) {
+    OmniValue* bindings = omni_car(omni_cdr(x));
+    if (!sequential && omni_is_sym(bindings)) return eval_named_let(m, x, env, out);
+    OmniValue* inner = env;
+    if (omni_is_array(bindings)) {
+        if (bindings->array.len % 2 != 0) return fail_on(m, "let needs a value for each name", bindings);
+        for (size_t i = 0; i < bindings->array.len; i += 2) {
+            if (!let_bind(m, bindings->array.data[i], bindings->array.data[i + 1], env, sequential, &inner)) {
+                return false;
+            }
+        }
+    } else {
+        for (OmniValue* b = bindings; omni_is_cell(b); b = omni_cdr(b)) {
+            OmniValue* pair = omni_car(b);
+            if (!let_bind(m, omni_car(pair), omni_car(omni_cdr(pair)), env, sequential, &inner)) return false;
+        }
+    }
+    return eval_body(m, omni_cdr(omni_cdr(x)), inner, out);
+}
+
+static bool quasi(OmniMacros* m, OmniValue* t, int depth, OmniValue* env, OmniValue** out);
+
+/* (name t') for a (name t) template, with t' built at depth */
+static bool quasi_wrap(OmniMacros* m, OmniValue* t, int depth, OmniValue* env, OmniValue** out) {
+    OmniValue* inner;
+    if (!quasi(m, omni_car(omni_cdr(t)), depth, env, &inner)) return false;
+    *out = omni_list2(m->arena, omni_car(t), inner);
+    return true;
+}
+
+/* Add template element e to b, splicing the list an unquote-splicing makes */
+static bool quasi_element(OmniMacros* m, OmniValue* e, int depth, OmniValue* env, ListBuilder* b) {
+    OmniValue* v;
+    if (depth == 1 && is_form(e, "unquote-splicing")) {
+        if (!eval(m, omni_car(omni_cdr(e)), env, &v)) return false;
+        if (omni_is_array(v)) {
+            for (size_t i = 0; i < v->array.len; i++) list_add(b, v->array.data[i]);
+            return true;
+        }
+        for (; omni_is_cell(v); v = omni_cdr(v)) list_add(b, omni_car(v));
+        if (!omni_is_nil(v)) return fail_on(m, "unquote-splicing of a non-list", v);
+        return true;
+    }
+    if (!quasi(m, e, depth, env, &v)) return false;
+    list_add(b, v);
+    return true;
+}
+
+/* Structure of template t with its unquotes evaluated; depth counts the
+ * quasiquotes t is in, and only unquotes at depth 1 evaluate */
+static bool quasi(OmniMacros* m, OmniValue* t, int depth, OmniValue* env, OmniValue** out) {
+    OmniArena* arena = m->arena;
+    if (is_form(t, "unquote")) {
+        if (depth == 1) return eval(m, omni_car(omni_cdr(t)), env, out);
+        return quasi_wrap(m, t, depth - 1, env, out);
+    }
+    if (is_form(t, "unquote-splicing")) {
+        if (depth == 1) return fail_on(m, "unquote-splicing outside a list", t);
+        return quasi_wrap(m, t, depth - 1, env, out);
+    }
+    if (is_form(t, "quasiquote")) return quasi_wrap(m, t, depth + 1, env, out);
+
+    ListBuilder b;
+    list_start(&b, arena);
+    if (omni_is_array(t)) {
+        for (size_t i = 0; i < t->array.len; i++) {
+            if (!quasi_element(m, t->array.data[i], depth, env, &b)) return false;
+        }
+        size_t len;
+        OmniValue** items = omni_list_to_array(arena, b.head, &len);
+        *out = omni_new_array_from(arena, items, len);
+        return true;
+    }
+    if (!omni_is_cell(t)) {
+        *out = t;
+        return true;
+    }
+    OmniValue* p = t;
+    for (; omni_is_cell(p); p = omni_cdr(p)) {
+        /* (a . ,b) reads as (a unquote b) */
+        if (p != t && (is_form(p, "unquote") || is_form(p, "unquote-splicing"))) break;
+        if (!quasi_element(m, omni_car(p), depth, env, &b)) return false;
+    }
+    if (!omni_is_nil(p) && !quasi(m, p, depth, env, b.link)) return false;
+    *out = b.head;
+    return true;
+}
+
+/* (error part...): stop with the parts as the message */
+static bool eval_error(OmniMacros* m, OmniValue* args, OmniValue* env) {
+    char msg[sizeof(m->error)] = "";
+    size_t len = 0;
+    for (; omni_is_cell(args); args = omni_cdr(args)) {
+        OmniValue* v;
+        if (!eval(m, omni_car(args), env, &v)) return false;
+        char* text = omni_is_string(v) ? NULL : omni_value_to_string(v);
+        len += (size_t)snprintf(msg + len, len < sizeof(msg) ? sizeof(msg) - len : 0, "%s%s",
+                                len ? " " : "", text ? text : v->str_val);
+        if (len >= sizeof(msg)) len = sizeof(msg) - 1;
+        free(text);
+    }
+    return fail(m, "%s", msg);
+}
+
+static bool eval(OmniMacros* m, OmniValue* x, OmniValue* env, OmniValue** out) {
+    OmniArena* arena = m->arena;
+    if (++m->steps > MACRO_MAX_STEPS) {
+        return fail(m, "macro body runs too long (more than %d steps)", MACRO_MAX_STEPS);
+    }
+    if (omni_is_sym(x)) {
+        OmniValue* binding = lookup(env, x->str_val);
+        if (!binding) binding = lookup(m->globals, x->str_val);
+        if (binding) {
+            *out = omni_cdr(binding);
+            return true;
+        }
+        if (strcmp(x->str_val, "nil") == 0) {
+            *out = omni_nil;
+            return true;
+        }
+        return fail(m, "unbound symbol in macro body: %s", x->str_val);
+    }
+    if (!omni_is_cell(x)) {
+        *out = x;
+        return true;
+    }
+
+    OmniValue* head = omni_car(x);
+    OmniValue* args = omni_cdr(x);
+    if (omni_is_sym(head)) {
+        const char* name = head->str_val;
+        if (strcmp(name, "quote") == 0) {
+            *out = omni_car(args);
+            return true;
+        }
+        if (strcmp(name, "quasiquote") == 0) return quasi(m, omni_car(args), 1, env, out);
+        if (strcmp(name, "if") == 0) {
+            OmniValue* test;
+            if (!eval(m, omni_car(args), env, &test)) return false;
+            OmniValue* branch = truthy(test) ? omni_cdr(args) : omni_cdr(omni_cdr(args));
+            if (!omni_is_cell(branch)) {
+                *out = omni_nil;
+                return true;
+            }
+            return eval(m, omni_car(branch), env, out);
+        }
+        if (strcmp(name, "when") == 0 || strcmp(name, "unless") == 0) {
+            OmniValue* test;
+            if (!eval(m, omni_car(args), env, &test)) return false;
+            if (truthy(test) == (name[0] == 'w')) return eval_body(m, omni_cdr(args), env, out);
+            *out = omni_nil;
+            return true;
+        }
+        if (strcmp(name, "cond") == 0) {
+            for (; omni_is_cell(args); args = omni_cdr(args)) {
+                OmniValue* clause = omni_car(args);
+                OmniValue* test = omni_car(clause);
+                if (omni_sym_eq_str(test, "else")) return eval_body(m, omni_cdr(clause), env, out);
+                if (!eval(m, test, env, out)) return false;
+                if (truthy(*out)) {
+                    return omni_is_cell(omni_cdr(clause)) ? eval_body(m, omni_cdr(clause), env, out) : true;
+                }
+            }
+            *out = omni_nil;
+            return true;
+        }
+        if (strcmp(name, "let") == 0 || strcmp(name, "let*") == 0) {
+            return eval_let(m, x, env, name[3] == '*', out);
+        }
+        if (strcmp(name, "lambda") == 0 || strcmp(name, "fn") == 0) {
+            if (!valid_params(omni_car(args))) return fail_on(m, "malformed parameter list", omni_car(args));
+            *out = omni_new_lambda(arena, omni_car(args), omni_cdr(args), env);
+            return true;
+        }
+        if (strcmp(name, "and") == 0 || strcmp(name, "or") == 0) {
+            bool is_and = name[0] == 'a';
+            *out = boolean(arena, is_and);
+            for (; omni_is_cell(args); args = omni_cdr(args)) {
+                if (!eval(m, omni_car(args), env, out)) return false;
+                if (truthy(*out) != is_and) return true;
+            }
+            return true;
+        }
+        if (strcmp(name, "do") == 0 || strcmp(name, "begin") == 0) return eval_body(m, args, env, out);
+        if (strcmp(name, "error") == 0) return eval_error(m, args, env);
+        if (strcmp(name, "define") == 0) return fail_on(m, "define outside a body", x);
+    }
+
+    OmniValue* f;
+    if (!eval(m, head, env, &f)) return false;
+    size_t argc = omni_list_len(args);
+    OmniValue** vals = argc ? omni_arena_alloc(arena, argc * sizeof(OmniValue*)) : NULL;
+    for (size_t i = 0; i < argc; i++, args = omni_cdr(args)) {
+        if (!eval(m, omni_car(args), env, &vals[i])) return false;
+    }
+    return apply(m, f, vals, argc, out);
+}
+
+/* ============== Primitives ============== */
+
+typedef bool (*MacroPrim)(OmniMacros* m, OmniValue** args, size_t argc, OmniValue** out);
+
+static bool prim_cons(OmniMacros* m, OmniValue** args, size_t argc, OmniValue** out) {
+    (void)m; (void)argc;
+    *out = omni_new_cell(m->arena, args[0], args[1]);
+    return true;
+}
+
+/* The cell n cdrs into list */
+static bool nth_cell(OmniMacros* m, OmniValue* list, size_t n, OmniValue** out) {
+    for (; n > 0 && omni_is_cell(list); n--) list = omni_cdr(list);
+    if (!omni_is_cell(list)) return fail_on(m, "list too short", list);
+    *out = list;
+    return true;
+}
+
+static bool prim_car(OmniMacros* m, OmniValue** args, size_t argc, OmniValue** out) {
+    (void)argc;
+    if (!nth_cell(m, args[0], 0, out)) return false;
+    *out = omni_car(*out);
+    return true;
+}
+
+static bool prim_cdr(OmniMacros* m, OmniValue** args, size_t argc, OmniValue** out) {
+    (void)argc;
+    if (!nth_cell(m, args[0], 0, out)) return false;
+    *out = omni_cdr(*out);
+    return true;
+}
+
+static bool prim_cadr(OmniMacros* m, OmniValue** args, size_t argc, OmniValue** out) {
+    (void)argc;
+    if (!nth_cell(m, args[0], 1, out)) return false;
+    *out = omni_car(*out);
+    return true;
+}
+
+static bool prim_cddr(OmniMacros* m, OmniValue** args, size_t argc, OmniValue** out) {
+    (void)argc;
+    if (!nth_cell(m, args[0], 1, out)) return false;
+    *out = omni_cdr(*out);
+    return true;
+}
+
+static bool prim_caddr(OmniMacros* m, OmniValue** args, size_t argc, OmniValue** out) {
+    (void)argc;
+    if (!nth_cell(m, args[0], 2, out)) return false;
+    *out = omni_car(*out);
+    return true;
+}
+
+static bool prim_nth(OmniMacros* m, OmniValue** args, size_t argc, OmniValue** out) {
+    (void)argc;
+    if (!omni_is_int(args[1]) || args[1]->int_val < 0) return fail_on(m, "nth: bad index", args[1]);
+    if (!nth_cell(m, args[0], (size_t)args[1]->int_val, out)) return false;
+    *out = omni_car(*out);
+    return true;
+}
+
+static bool prim_list(OmniMacros* m, OmniValue** args, size_t argc, OmniValue** out) {
+    (void)m;
+    *out = omni_array_to_list(m->arena, args, argc);
+    return true;
+}
+
+static bool prim_append(OmniMacros* m, OmniValue** args, size_t argc, OmniValue** out) {
+    ListBuilder b;
+    list_start(&b, m->arena);
+    for (size_t i = 0; i + 1 < argc; i++) {
+        OmniValue* p = args[i];
+        for (; omni_is_cell(p); p = omni_cdr(p)) list_add(&b, omni_car(p));
+        if (!omni_is_nil(p)) return fail_on(m, "append of a non-list", args[i]);
+    }
+    /* The last list is shared, not copied */
+    if (argc > 0) *b.link = args[argc - 1];
+    *out = b.head;
+    return true;
+}
+
+static bool prim_reverse(OmniMacros* m, OmniValue** args, size_t argc, OmniValue** out) {
+    (void)argc;
+    OmniValue* p = args[0];
+    *out = omni_nil;
+    for (; omni_is_cell(p); p = omni_cdr(p)) *out = omni_new_cell(m->arena, omni_car(p), *out);
+    if (!omni_is_nil(p)) return fail_on(m, "reverse of a non-list", args[0]);
+    return true;
+}
+
+static bool prim_length(OmniMacros* m, OmniValue** args, size_t argc, OmniValue** out) {
+    OmniArena* arena = m->arena;
+    (void)argc;
+    OmniValue* v = args[0];
+    if (omni_is_array(v)) {
+        *out = omni_new_int(arena, (int64_t)v->array.len);
+    } else if (omni_is_string(v)) {
+        *out = omni_new_int(arena, (int64_t)strlen(v->str_val));
+    } else {
+        int64_t n = 0;
+        for (; omni_is_cell(v); v = omni_cdr(v)) n++;
+        if (!omni_is_nil(v)) return fail_on(m, "length of a non-list", args[0]);
+        *out = omni_new_int(arena, n);
+    }
+    return true;
+}
+
+static bool prim_null_p(OmniMacros* m, OmniValue** args, size_t argc, OmniValue** out) {
+    (void)m; (void)argc;
+    *out = boolean(m->arena, omni_is_nil(args[0]));
+    return true;
+}
+
+static bool prim_pair_p(OmniMacros* m, OmniValue** args, size_t argc, OmniValue** out) {
+    (void)m; (void)argc;
+    *out = boolean(m->arena, omni_is_cell(args[0]));
+    return true;
+}
+
+static bool prim_list_p(OmniMacros* m, OmniValue** args, size_t argc, OmniValue** out) {
+    (void)m; (void)argc;
+    OmniValue* v = args[0];
+    while (omni_is_cell(v)) v = omni_cdr(v);
+    *out = boolean(m->arena, omni_is_nil(v));
+    return true;
+}
+
+static bool prim_symbol_p(OmniMacros* m, OmniValue** args, size_t argc, OmniValue** out) {
+    (void)m; (void)argc;
+    *out = boolean(m->arena, omni_is_sym(args[0]));
+    return true;
+}
+
+static bool prim_string_p(OmniMacros* m, OmniValue** args, size_t argc, OmniValue** out) {
+    (void)m; (void)argc;
+    *out = boolean(m->arena, omni_is_string(args[0]));
+    return true;
+}
+
+static bool prim_keyword_p(OmniMacros* m, OmniValue** args, size_t argc, OmniValue** out) {
+    (void)m; (void)argc;
+    *out = boolean(m->arena, omni_is_keyword(args[0]));
+    return true;
+}
+
+static bool prim_number_p(OmniMacros* m, OmniValue** args, size_t argc, OmniValue** out) {
+    (void)m; (void)argc;
+    *out = boolean(m->arena, omni_is_int(args[0]) || omni_is_float(args[0]));
+    return true;
+}
+
+static bool prim_not(OmniMacros* m, OmniValue** args, size_t argc, OmniValue** out) {
+    (void)m; (void)argc;
+    *out = boolean(m->arena, !truthy(args[0]));
+    return true;
+}
+
+static bool values_eq(OmniValue* a, OmniValue* b) {
+    if (omni_is_nil(a) || omni_is_nil(b)) return omni_is_nil(a) && omni_is_nil(b);
+    if (a == b) return true;
+    switch (a->tag) {
+    case OMNI_SYM: case OMNI_KEYWORD: case OMNI_INT: case OMNI_CHAR: case OMNI_FLOAT:
+        return omni_values_equal(a, b);
+    default:
+        return false;
+    }
+}
+
+static bool values_equal(OmniValue* a, OmniValue* b) {
+    while (omni_is_cell(a) && omni_is_cell(b)) {
+        if (!values_equal(omni_car(a), omni_car(b))) return false;
+        a = omni_cdr(a);
+        b = omni_cdr(b);
+    }
+    if (omni_is_array(a) && omni_is_array(b)) {
+        if (a->array.len != b->array.len) return false;
+        for (size_t i = 0; i < a->array.len; i++) {
+            if (!values_equal(a->array.data[i], b->array.data[i])) return false;
+        }
+        return true;
+    }
+    if (omni_is_nil(a) || omni_is_nil(b)) return omni_is_nil(a) && omni_is_nil(b);
+    return omni_values_equal(a, b);
+}
+
+static bool prim_eq_p(OmniMacros* m, OmniValue** args, size_t argc, OmniValue** out) {
+    (void)m; (void)argc;
+    *out = boolean(m->arena, values_eq(args[0], args[1]));
+    return true;
+}
+
+static bool prim_equal_p(OmniMacros* m, OmniValue** args, size_t argc, OmniValue** out) {
+    (void)m; (void)argc;
+    *out = boolean(m->arena, values_equal(args[0], args[1]));
+    return true;
+}
+
+static bool check_numbers(OmniMacros* m, OmniValue** args, size_t argc, bool* any_float) {
+    *any_float = false;
+    for (size_t i = 0; i < argc; i++) {
+        if (omni_is_float(args[i])) {
+            *any_float = true;
+        } else if (!omni_is_int(args[i])) {
+            return fail_on(m, "arithmetic on a non-number", args[i]);
+        }
+    }
+    return true;
+}
+
+static double to_double(OmniValue* v) {
+    return omni_is_float(v) ? v->float_val : (double)v->int_val;
+}
+
+/* Fold op over args; - and / of one argument negate and invert */
+static bool arith(OmniMacros* m, char op, OmniValue** args, size_t argc, OmniValue** out) {
+    OmniArena* arena = m->arena;
+    bool floats;
+    if (!check_numbers(m, args, argc, &floats)) return false;
+    if (argc == 0) {
+        *out = omni_new_int(arena, op == '*' ? 1 : 0);
+        return true;
+    }
+    if (floats) {
+        double acc = to_double(args[0]);
+        if (argc == 1 && op == '-') acc = -acc;
+        if (argc == 1 && op == '/') acc = 1.0 / acc;
+        for (size_t i = 1; i < argc; i++) {
+            double v = to_double(args[i]);
+            acc = op == '+' ? acc + v : op == '-' ? acc - v : op == '*' ? acc * v : acc / v;
+        }
+        *out = omni_new_float(arena, acc);
+        return true;
+    }
+    int64_t acc = args[0]->int_val;
+    if (argc == 1 && op == '-') acc = -acc;
+    if (argc == 1 && op == '/') {
+        if (acc == 0) return fail(m, "division by zero");
+        acc = 1 / acc;
+    }
+    for (size_t i = 1; i < argc; i++) {
+        int64_t v = args[i]->int_val;
+        if (op == '/' && v == 0) return fail(m, "division by zero");
+        acc = op == '+' ? acc + v : op == '-' ? acc - v : op == '*' ? acc * v : acc / v;
+    }
+    *out = omni_new_int(arena, acc);
+    return true;
+}
+
+static bool prim_add(OmniMacros* m, OmniValue** args, size_t argc, OmniValue** out) {
+    return arith(m, '+', args, argc, out);
+}
+
+static bool prim_sub(OmniMacros* m, OmniValue** args, size_t argc, OmniValue** out) {
+    return arith(m, '-', args, argc, out);
+}
+
+static bool prim_mul(OmniMacros* m, OmniValue** args, size_t argc, OmniValue** out) {
+    return arith(m, '*', args, argc, out);
+}
+
+static bool prim_div(OmniMacros* m, OmniValue** args, size_t argc, OmniValue** out) {
+    return arith(m, '/', args, argc, out);
+}
+
+/* True if each argument stands in relation op to the next */
+static bool compare(OmniMacros* m, const char* op, OmniValue** args, size_t argc, OmniValue** out) {
+    bool floats;
+    if (!check_numbers(m, args, argc, &floats)) return false;
+    bool holds = true;
+    for (size_t i = 0; i + 1 < argc && holds; i++) {
+        double a = to_double(args[i]), b = to_double(args[i + 1]);
+        int c = a < b ? -1 : a > b ? 1 : 0;
+        holds = strcmp(op, "<") == 0 ? c < 0 : strcmp(op, ">") == 0 ? c > 0 :
+                strcmp(op, "<=") == 0 ? c <= 0 : strcmp(op, ">=") == 0 ? c >= 0 : c == 0;
+    }
+    *out = boolean(m->arena, holds);
+    return true;
+}
+
+static bool prim_lt(OmniMacros* m, OmniValue** args, size_t argc, OmniValue** out) {
+    return compare(m, "<", args, argc, out);
+}
+
+static bool prim_gt(OmniMacros* m, OmniValue** args, size_t argc, OmniValue** out) {
+    return compare(m, ">", args, argc, out);
+}
+
+static bool prim_le(OmniMacros* m, OmniValue** args, size_t argc, OmniValue** out) {
+    return compare(m, "<=", args, argc, out);
+}
+
+static bool prim_ge(OmniMacros* m, OmniValue** args, size_t argc, OmniValue** out) {
+    return compare(m, ">=", args, argc, out);
+}
+
+static bool prim_num_eq(OmniMacros* m, OmniValue** args, size_t argc, OmniValue** out) {
+    return compare(m, "=", args, argc, out);
+}
+
+static bool prim_gensym(OmniMacros* m, OmniValue** args, size_t argc, OmniValue** out) {
+    const char* prefix = "g";
+    if (argc > 0) {
+        if (!omni_is_sym(args[0]) && !omni_is_string(args[0])) {
+            return fail_on(m, "gensym: prefix is not a symbol or string", args[0]);
+        }
+        prefix = args[0]->str_val;
+    }
+    *out = omni_new_sym(m->arena, fresh_name(m, prefix));
+    return true;
+}
+
+static bool prim_symbol_to_string(OmniMacros* m, OmniValue** args, size_t argc, OmniValue** out) {
+    (void)argc;
+    if (!omni_is_sym(args[0])) return fail_on(m, "symbol->string of a non-symbol", args[0]);
+    *out = omni_new_string(m->arena, args[0]->str_val);
+    return true;
+}
+
+static bool prim_string_to_symbol(OmniMacros* m, OmniValue** args, size_t argc, OmniValue** out) {
+    (void)argc;
+    if (!omni_is_string(args[0]) || !args[0]->str_val[0]) {
+        return fail_on(m, "string->symbol of a non-string or empty string", args[0]);
+    }
+    *out = omni_new_sym(m->arena, args[0]->str_val);
+    return true;
+}
+
+static bool prim_string_append(OmniMacros* m, OmniValue** args, size_t argc, OmniValue** out) {
+    size_t len = 0;
+    for (size_t i = 0; i < argc; i++) {
+        if (!omni_is_string(args[i])) return fail_on(m, "string-append of a non-string", args[i]);
+        len += strlen(args[i]->str_val);
+    }
+    char* text = malloc(len + 1);
+    text[0] = '\0';
+    for (size_t i = 0; i < argc; i++) strcat(text, args[i]->str_val);
+    *out = omni_new_string(m->arena, text);
+    free(text);
+    return true;
+}
+
+static bool prim_number_to_string(OmniMacros* m, OmniValue** args, size_t argc, OmniValue** out) {
+    (void)argc;
+    char text[64];
+    if (omni_is_int(args[0])) {
+        snprintf(text, sizeof(text), "%" PRId64, args[0]->int_val);
+    } else if (omni_is_float(args[0])) {
+        snprintf(text, sizeof(text), "%g", args[0]->float_val);
+    } else {
+        return fail_on(m, "number->string of a non-number", args[0]);
+    }
+    *out = omni_new_string(m->arena, text);
+    return true;
+}
+
+/* (map f list...): f of the lists' elements in turn, until one runs out */
+static bool prim_map(OmniMacros* m, OmniValue** args, size_t argc, OmniValue** out) {
+    OmniArena* arena = m->arena;
+    size_t n = argc - 1;
+    OmniValue** lists = omni_arena_alloc(arena, n * sizeof(OmniValue*));
+    OmniValue** items = omni_arena_alloc(arena, n * sizeof(OmniValue*));
+    memcpy(lists, args + 1, n * sizeof(OmniValue*));
+    ListBuilder b;
+    list_start(&b, arena);
+    for (;;) {
+        for (size_t i = 0; i < n; i++) {
+            if (!omni_is_cell(lists[i])) {
+                *out = b.head;
+                return true;
+            }
+            items[i] = omni_car(lists[i]);
+            lists[i] = omni_cdr(lists[i]);
+        }
+        OmniValue* v;
+        if (!apply(m, args[0], items, n, &v)) return false;
+        list_add(&b, v);
+    }
+}
+
+/* (apply f arg... list) */
+static bool prim_apply(OmniMacros* m, OmniValue** args, size_t argc, OmniValue** out) {
+    OmniValue* last = args[argc - 1];
+    size_t n = argc - 2 + omni_list_len(last);
+    OmniValue** all = omni_arena_alloc(m->arena, (n ? n : 1) * sizeof(OmniValue*));
+    memcpy(all, args + 1, (argc - 2) * sizeof(OmniValue*));
+    size_t i = argc - 2;
+    for (; omni_is_cell(last); last = omni_cdr(last)) all[i++] = omni_car(last);
+    if (!omni_is_nil(last)) return fail_on(m, "apply of a non-list", args[argc - 1]);
+    return apply(m, args[0], all, n, out);
+}
+
+#define MANY ((size_t)-1)
+
+static const struct {
+    const char* name;
+    MacroPrim fn;
+    size_t min, max;          /* Arguments taken */
+} g_prims[] = {
+    { "cons", prim_cons, 2, 2 },
+    { "car", prim_car, 1, 1 }, { "first", prim_car, 1, 1 },
+    { "cdr", prim_cdr, 1, 1 }, { "rest", prim_cdr, 1, 1 },
+    { "cadr", prim_cadr, 1, 1 }, { "second", prim_cadr, 1, 1 },
+    { "cddr", prim_cddr, 1, 1 },
+    { "caddr", prim_caddr, 1, 1 }, { "third", prim_caddr, 1, 1 },
+    { "nth", prim_nth, 2, 2 },
+    { "list", prim_list, 0, MANY },
+    { "append", prim_append, 0, MANY },
+    { "reverse", prim_reverse, 1, 1 },
+    { "length", prim_length, 1, 1 },
+    { "null?", prim_null_p, 1, 1 },
+    { "pair?", prim_pair_p, 1, 1 },
+    { "list?", prim_list_p, 1, 1 },
+    { "symbol?", prim_symbol_p, 1, 1 },
+    { "string?", prim_string_p, 1, 1 },
+    { "keyword?", prim_keyword_p, 1, 1 },
+    { "number?", prim_number_p, 1, 1 },
+    { "not", prim_not, 1, 1 },
+    { "eq?", prim_eq_p, 2, 2 },
+    { "equal?", prim_equal_p, 2, 2 },
+    { "+", prim_add, 0, MANY }, { "-", prim_sub, 1, MANY },
+    { "*", prim_mul, 0, MANY }, { "/", prim_div, 1, MANY },
+    { "<", prim_lt, 1, MANY }, { ">", prim_gt, 1, MANY },
+    { "<=", prim_le, 1, MANY }, { ">=", prim_ge, 1, MANY },
+    { "=", prim_num_eq, 1, MANY },
+    { "gensym", prim_gensym, 0, 1 },
+    { "symbol->string", prim_symbol_to_string, 1, 1 },
+    { "string->symbol", prim_string_to_symbol, 1, 1 },
+    { "string-append", prim_string_append, 0, MANY },
+    { "number->string", prim_number_to_string, 1, 1 },
+    { "map", prim_map, 2, MANY },
+    { "apply", prim_apply, 2, MANY },
+};
+
+/* Primitives are kept as OMNI_PRIM nodes holding their table entry's fn */
+static OmniValue* prim_value(OmniArena* arena, MacroPrim fn) {
+    return omni_new_prim(arena, (OmniPrimFn)(void (*)(void))fn);
+}
+
+static bool apply(OmniMacros* m, OmniValue* f, OmniValue** args, size_t argc, OmniValue** out) {
+    if (omni_is_prim(f)) {
+        MacroPrim fn = (MacroPrim)(void (*)(void))f->prim_fn;
+        for (size_t i = 0; i < sizeof(g_prims) / sizeof(g_prims[0]); i++) {
+            if (g_prims[i].fn != fn) continue;
+            if (argc < g_prims[i].min || argc > g_prims[i].max) {
+                return fail(m, "%s: wrong number of arguments (%zu)", g_prims[i].name, argc);
+            }
+            break;
+        }
+        return fn(m, args, argc, out);
+    }
+    if (!omni_is_lambda(f)) return fail_on(m, "call of a non-procedure", f);
+    if (m->calls >= MACRO_MAX_CALLS) return fail(m, "macro body recurses too deeply");
+
+    OmniValue* env;
+    if (!bind_params(m, f->lambda.params, args, argc, f->lambda.env, &env)) return false;
+    m->calls++;
+    bool ok = eval_body(m, f->lambda.body, env, out);
+    m->calls--;
+    return ok;
+}
+
+/* ============== Hygiene ============== */
+
+/* Set of nodes, by address */
+typedef struct NodeSet {
+    OmniValue** slots;
+    size_t capacity;          /* A power of two */
+    size_t count;
+} NodeSet;
+
+static size_t node_slot(NodeSet* s, OmniValue* v) {
+    size_t i = (size_t)(((uintptr_t)v >> 4) * 2654435761u) & (s->capacity - 1);
+    while (s->slots[i] && s->slots[i] != v) i = (i + 1) & (s->capacity - 1);
+    return i;
+}
+
+static bool set_has(NodeSet* s, OmniValue* v) {
+    return s->count > 0 && s->slots[node_slot(s, v)] == v;
+}
+
+static void set_add(NodeSet* s, OmniValue* v) {
+    if ((s->count + 1) * 2 > s->capacity) {
+        NodeSet grown = { calloc(s->capacity ? s->capacity * 2 : 64, sizeof(OmniValue*)),
+                          s->capacity ? s->capacity * 2 : 64, 0 };
+        for (size_t i = 0; i < s->capacity; i++) {
+            if (s->slots[i]) grown.slots[node_slot(&grown, s->slots[i])] = s->slots[i];
+        }
+        grown.count = s->count;
+        free(s->slots);
+        *s = grown;
+    }
+    size_t i = node_slot(s, v);
+    if (!s->slots[i]) {
+        s->slots[i] = v;
+        s->count++;
+    }
+}
+
+/* Add every node of the tree at v */
+static void add_tree(NodeSet* s, OmniValue* v) {
+    while (!omni_is_nil(v) && !set_has(s, v)) {
+        set_add(s, v);
+        if (omni_is_array(v)) {
+            for (size_t i = 0; i < v->array.len; i++) add_tree(s, v->array.data[i]);
+        }
+        if (!omni_is_cell(v)) return;
+        add_tree(s, omni_car(v));
+        v = omni_cdr(v);
+    }
+}
+
+typedef struct Hygiene {
+    OmniMacros* macros;
+    NodeSet args;             /* Nodes of the call's arguments */
+    OmniValue* call;
+    const char** from;        /* Names the macro binds, and their new names */
+    const char** to;
+    size_t count;
+} Hygiene;
+
+static const char* renamed(Hygiene* h, const char* name) {
+    for (size_t i = 0; i < h->count; i++) {
+        if (strcmp(h->from[i], name) == 0) return h->to[i];
+    }
+    return NULL;
+}
+
+/* Rename binder unless it came from the call's arguments */
+static void rename_binder(Hygiene* h, OmniValue* binder) {
+    if (!omni_is_sym(binder) || set_has(&h->args, binder) || renamed(h, binder->str_val)) return;
+    h->from = realloc(h->from, (h->count + 1) * sizeof(char*));
+    h->to = realloc(h->to, (h->count + 1) * sizeof(char*));
+    h->from[h->count] = binder->str_val;
+    h->to[h->count++] = fresh_name(h->macros, binder->str_val);
+}
+
+/* Find the let, let*, named let, lambda and fn binders the macro wrote in x */
+static void collect_binders(Hygiene* h, OmniValue* x) {
+    if (omni_is_nil(x) || set_has(&h->args, x)) return;
+    if (omni_is_array(x)) {
+        for (size_t i = 0; i < x->array.len; i++) collect_binders(h, x->array.data[i]);
+        return;
+    }
+    if (!omni_is_cell(x) || is_form(x, "quote")) return;
+
+    OmniValue* binders = omni_car(omni_cdr(x));
+    if (is_form(x, "let") || is_form(x, "let*")) {
+        if (omni_is_sym(binders)) {
+            /* Named let: the name, then the bindings */
+            rename_binder(h, binders);
+            binders = omni_car(omni_cdr(omni_cdr(x)));
+        }
+        if (omni_is_array(binders)) {
+            for (size_t i = 0; i < binders->array.len; i += 2) rename_binder(h, binders->array.data[i]);
+        } else {
+            for (OmniValue* b = binders; omni_is_cell(b); b = omni_cdr(b)) rename_binder(h, omni_car(omni_car(b)));
+        }
+    } else if (is_form(x, "lambda") || is_form(x, "fn")) {
+        if (omni_is_array(binders)) {
+            for (size_t i = 0; i < binders->array.len; i++) rename_binder(h, binders->array.data[i]);
+        } else {
+            OmniValue* p = binders;
+            for (; omni_is_cell(p); p = omni_cdr(p)) rename_binder(h, omni_car(p));
+            rename_binder(h, p);
+        }
+    }
+
+    OmniValue* p = x;
+    for (; omni_is_cell(p) && (p == x || !set_has(&h->args, p)); p = omni_cdr(p)) collect_binders(h, omni_car(p));
+    collect_binders(h, p);
+}
+
+/* Copy of the macro's part of x, at the call's position and with its
+ * binders renamed; argument nodes are kept as they are */
+static OmniValue* rebuild(Hygiene* h, OmniValue* x, bool quoted) {
+    OmniArena* arena = h->macros->arena;
+    if (omni_is_nil(x) || omni_is_nothing(x) || set_has(&h->args, x)) return x;
+    switch (x->tag) {
+    case OMNI_SYM: {
+        OmniValue* y = copy_node(arena, x, h->call);
+        const char* name = quoted ? NULL : renamed(h, x->str_val);
+        if (name) y->str_val = (char*)name;
+        return y;
+    }
+    case OMNI_CELL: {
+        OmniValue* y = copy_node(arena, x, h->call);
+        bool quote = quoted || is_form(x, "quote");
+        y->cell.car = rebuild(h, omni_car(x), quote);
+        y->cell.cdr = rebuild(h, omni_cdr(x), quote);
+        return y;
+    }
+    case OMNI_ARRAY: {
+        OmniValue* y = omni_new_array_from(arena, x->array.data, x->array.len);
+        for (size_t i = 0; i < y->array.len; i++) y->array.data[i] = rebuild(h, y->array.data[i], quoted);
+        y->line = h->call->line;
+        y->column = h->call->column;
+        return y;
+    }
+    case OMNI_INT: case OMNI_FLOAT: case OMNI_CHAR: case OMNI_STRING: case OMNI_KEYWORD:
+        return copy_node(arena, x, h->call);
+    default:
+        return x;
+    }
+}
+
+/* The expansion of call, made hygienic */
+static OmniValue* hygienic(OmniMacros* m, OmniValue* expansion, OmniValue* call) {
+    Hygiene h = { .macros = m, .call = call };
+    for (OmniValue* a = omni_cdr(call); omni_is_cell(a); a = omni_cdr(a)) add_tree(&h.args, omni_car(a));
+    collect_binders(&h, expansion);
+    OmniValue* result = rebuild(&h, expansion, false);
+    free(h.args.slots);
+    free(h.from);
+    free(h.to);
+    return result;
+}
+
+/* ============== Expansion ============== */
+
+static Macro* find_macro(OmniMacros* m, OmniValue* head) {
+    if (!omni_is_sym(head)) return NULL;
+    /* A later definition replaces an earlier one */
+    for (size_t i = m->count; i-- > 0;) {
+        if (strcmp(m->macros[i].name, head->str_val) == 0) return &m->macros[i];
+    }
+    return NULL;
+}
+
+static void expansion_error(OmniMacroError* err, OmniValue* call, const char* why) {
+    char text[80];
+    short_text(call, text, sizeof(text));
+    snprintf(err->message, sizeof(err->message), "E0010 expanding %s: %s", text, why);
+    err->at = call;
+}
+
+/* What a call of mac expands to, before the expansion is expanded */
+static bool invoke(OmniMacros* m, Macro* mac, OmniValue* call, OmniMacroError* err, OmniValue** out) {
+    size_t argc;
+    OmniValue** args = omni_list_to_array(m->arena, omni_cdr(call), &argc);
+    OmniValue* env;
+    OmniValue* expansion;
+    m->steps = 0;
+    m->calls = 0;
+    if (!bind_params(m, mac->params, args, argc, omni_nil, &env) ||
+        !eval_body(m, mac->body, env, &expansion)) {
+        expansion_error(err, call, m->error);
+        return false;
+    }
+    *out = hygienic(m, expansion, call);
+    return true;
+}
+
+static bool expand(OmniMacros* m, OmniValue* x, OmniMacroError* err, OmniValue** out);
+static bool expand_template(OmniMacros* m, OmniValue* t, int depth, OmniMacroError* err, OmniValue** out);
+
+typedef enum {
+    WALK_FORMS,               /* Expressions */
+    WALK_BINDINGS,            /* (name init) let bindings */
+    WALK_TEMPLATE             /* Parts of a quasiquote template */
+} WalkMode;
+
+static OmniValue* with_parts(OmniArena* arena, OmniValue* cell, OmniValue* car, OmniValue* cdr) {
+    if (car == omni_car(cell) && cdr == omni_cdr(cell)) return cell;
+    OmniValue* y = copy_node(arena, cell, cell);
+    y->cell.car = car;
+    y->cell.cdr = cdr;
+    return y;
+}
+
+/* list with its elements from index from on walked in mode, sharing the
+ * parts that do not change */
+static bool walk_list(OmniMacros* m, OmniValue* list, size_t from, WalkMode mode, int depth,
+                      OmniMacroError* err, OmniValue** out) {
+    *out = list;
+    if (!omni_is_cell(list)) {
+        if (from > 0 || omni_is_nil(list)) return true;
+        return mode == WALK_TEMPLATE ? expand_template(m, list, depth, err, out) : expand(m, list, err, out);
+    }
+
+    OmniValue* car = omni_car(list);
+    if (from == 0) {
+        bool ok = mode == WALK_FORMS ? expand(m, car, err, &car)
+                : mode == WALK_TEMPLATE ? expand_template(m, car, depth, err, &car)
+                : walk_list(m, car, 1, WALK_FORMS, 0, err, &car);
+        if (!ok) return false;
+    }
+    OmniValue* rest = omni_cdr(list);
+    OmniValue* cdr;
+    bool ok = mode == WALK_TEMPLATE && (is_form(rest, "unquote") || is_form(rest, "unquote-splicing"))
+            ? expand_template(m, rest, depth, err, &cdr)
+            : walk_list(m, rest, from ? from - 1 : 0, mode, depth, err, &cdr);
+    if (!ok) return false;
+    *out = with_parts(m->arena, list, car, cdr);
+    return true;
+}
+
+/* arr with every step-th element from first expanded */
+static bool walk_array(OmniMacros* m, OmniValue* arr, size_t first, size_t step, int depth,
+                       OmniMacroError* err, OmniValue** out) {
+    *out = arr;
+    for (size_t i = first; i < arr->array.len; i += step) {
+        OmniValue* v = arr->array.data[i];
+        if (!(depth ? expand_template(m, v, depth, err, &v) : expand(m, v, err, &v))) return false;
+        if (v == arr->array.data[i]) continue;
+        if (*out == arr) {
+            *out = omni_new_array_from(m->arena, arr->array.data, arr->array.len);
+            (*out)->line = arr->line;
+            (*out)->column = arr->column;
+        }
+        (*out)->array.data[i] = v;
+    }
+    return true;
+}
+
+static OmniValue* cell_at(OmniArena* arena, OmniValue* car, OmniValue* cdr, OmniValue* where) {
+    OmniValue* y = omni_new_cell(arena, car, cdr);
+    y->line = where->line;
+    y->column = where->column;
+    return y;
+}
+
+/* The symbol fmt makes, at where's position */
+static OmniValue* named(OmniArena* arena, OmniValue* where, const char* fmt, ...) {
+    char name[256];
+    va_list args;
+    va_start(args, fmt);
+    vsnprintf(name, sizeof(name), fmt, args);
+    va_end(args);
+    return copy_node(arena, omni_new_sym(arena, name), where);
+}
+
+/* The list of n items, at where's position */
+static OmniValue* form_at(OmniArena* arena, OmniValue* where, size_t n, ...) {
+    OmniValue* items[8];
+    va_list args;
+    va_start(args, n);
+    for (size_t i = 0; i < n; i++) items[i] = va_arg(args, OmniValue*);
+    va_end(args);
+    OmniValue* list = omni_nil;
+    while (n-- > 0) list = cell_at(arena, items[n], list, where);
+    return list;
+}
+
+/*
+ * (let name ((var init) ...) body...) as the core forms
+ * (letrec ((name (lambda (var ...) body...))) (name init ...)). Inits that
+ * mention name mean an outer binding of it, so then they are bound first,
+ * to fresh names, by a let around the letrec.
+ */
+static bool named_let(OmniMacros* m, OmniValue* x, OmniMacroError* err, OmniValue** out) {
+    OmniArena* arena = m->arena;
+    OmniValue* name = omni_car(omni_cdr(x));
+    OmniValue* rest = omni_cdr(omni_cdr(x));
+    OmniValue* vars;
+    OmniValue* inits;
+    if (!omni_is_cell(rest) || !binding_parts(arena, omni_car(rest), &vars, &inits)) {
+        char text[80];
+        short_text(x, text, sizeof(text));
+        snprintf(err->message, sizeof(err->message),
+                 "E0002 %s: expected (let name ((var init) ...) body...)", text);
+        err->at = x;
+        return false;
+    }
+    OmniValue* outer = omni_nil;
+    if (mentions(inits, name->str_val)) {
+        ListBuilder temps, args;
+        list_start(&temps, arena);
+        list_start(&args, arena);
+        for (OmniValue* i = inits; omni_is_cell(i); i = omni_cdr(i)) {
+            OmniValue* t = copy_node(arena, omni_new_sym(arena, fresh_name(m, "init")), x);
+            list_add(&temps, cell_at(arena, t, cell_at(arena, omni_car(i), omni_nil, x), x));
+            list_add(&args, t);
+        }
+        outer = temps.head;
+        inits = args.head;
+    }
+    OmniValue* fn = cell_at(arena, omni_new_sym(arena, "lambda"), cell_at(arena, vars, omni_cdr(rest), x), x);
+    OmniValue* binding = cell_at(arena, name, cell_at(arena, fn, omni_nil, x), x);
+    OmniValue* call = cell_at(arena, name, inits, x);
+    *out = cell_at(arena, omni_new_sym(arena, "letrec"),
+                   cell_at(arena, cell_at(arena, binding, omni_nil, x), cell_at(arena, call, omni_nil, x), x), x);
+    if (!omni_is_nil(outer)) {
+        *out = cell_at(arena, omni_new_sym(arena, "let"),
+                       cell_at(arena, outer, cell_at(arena, *out, omni_nil, x), x), x);
+    }
+    return true;
+}
+
+/* ============== User Types ============== */
+
+static TypeDef* find_type(OmniMacros* m, OmniValue* name) {
+    if (!omni_is_sym(name)) return NULL;
+    for (size_t i = m->type_count; i-- > 0;) {
+        if (strcmp(m->types[i].name, name->str_val) == 0) return &m->types[i];
+    }
+    return NULL;
+}
+
+/* The setter for accessor, when it is a field accessor T-f of a type */
+static const char* setter_of(OmniMacros* m, OmniValue* accessor, char* buf, size_t size) {
+    if (!omni_is_sym(accessor)) return NULL;
+    for (size_t i = m->type_count; i-- > 0;) {
+        for (OmniValue* f = m->types[i].fields; omni_is_cell(f); f = omni_cdr(f)) {
+            snprintf(buf, size, "%s-%s", m->types[i].name, omni_car(f)->str_val);
+            if (strcmp(buf, accessor->str_val) == 0) {
+                snprintf(buf, size, "set-%s-%s!", m->types[i].name, omni_car(f)->str_val);
+                return buf;
+            }
+        }
+    }
+    return NULL;
+}
+
+/* A mark such as :weak or :when */
+static bool is_mark(OmniValue* x, const char* name) {
+    return omni_is_keyword(x) && strcmp(x->str_val, name) == 0;
+}
+
+/* The field names of a deftype's field specs, each name or
+ * (name [type] [:weak]); false if one is malformed or repeated */
+static bool deftype_fields(OmniArena* arena, OmniValue* specs, OmniValue** out, OmniValue** bad) {
+    ListBuilder fields;
+    list_start(&fields, arena);
+    for (; omni_is_cell(specs); specs = omni_cdr(specs)) {
+        OmniValue* spec = omni_car(specs);
+        OmniValue* name = omni_is_cell(spec) ? omni_car(spec) : spec;
+        *bad = spec;
+        if (!omni_is_sym(name)) return false;
+        if (omni_is_cell(spec)) {
+            OmniValue* rest = omni_cdr(spec);
+            if (omni_is_cell(rest) && !omni_is_keyword(omni_car(rest))) rest = omni_cdr(rest);
+            if (omni_is_cell(rest) && is_mark(omni_car(rest), "weak")) rest = omni_cdr(rest);
+            if (!omni_is_nil(rest)) return false;
+        }
+        for (OmniValue* f = fields.head; omni_is_cell(f); f = omni_cdr(f)) {
+            if (strcmp(omni_car(f)->str_val, name->str_val) == 0) return false;
+        }
+        list_add(&fields, name);
+    }
+    *out = fields.head;
+    return omni_is_nil(specs);
+}
+
+/* Tests of the value of at that pat matches, and the bindings it makes,
+ * added to tests and binds */
+static bool pattern_parts(OmniMacros* m, OmniValue* pat, OmniValue* at, OmniValue* where,
+                          ListBuilder* tests, ListBuilder* binds, OmniMacroError* err) {
+    OmniArena* arena = m->arena;
+    if (omni_sym_eq_str(pat, "_")) return true;
+    if (omni_is_sym(pat)) {
+        list_add(binds, form_at(arena, where, 2, pat, at));
+        return true;
+    }
+    if (omni_is_int(pat) || omni_is_float(pat) || omni_is_char(pat) || omni_is_string(pat) ||
+        omni_is_keyword(pat) || is_form(pat, "quote")) {
+        bool empty = is_form(pat, "quote") && omni_is_nil(omni_car(omni_cdr(pat)));
+        list_add(tests, empty ? form_at(arena, where, 2, named(arena, where, "null?"), at)
+                              : form_at(arena, where, 3, named(arena, where, "eq?"), at, pat));
+        return true;
+    }
+
+    char text[80];
+    short_text(pat, text, sizeof(text));
+    TypeDef* t = omni_is_cell(pat) ? find_type(m, omni_car(pat)) : NULL;
+    if (!t) {
+        snprintf(err->message, sizeof(err->message),
+                 "E0002 %s: expected _, a variable, a literal or (Type pattern...)", text);
+        err->at = pat;
+        return false;
+    }
+    size_t given = omni_list_len(omni_cdr(pat)), fields = omni_list_len(t->fields);
+    if (given != fields) {
+        snprintf(err->message, sizeof(err->message), "E0002 %s: %s has %zu field%s, the pattern gives %zu",
+                 text, t->name, fields, fields == 1 ? "" : "s", given);
+        err->at = pat;
+        return false;
+    }
+    list_add(tests, form_at(arena, where, 2, named(arena, where, "%s?", t->name), at));
+    OmniValue* p = omni_cdr(pat);
+    for (OmniValue* f = t->fields; omni_is_cell(f); f = omni_cdr(f), p = omni_cdr(p)) {
+        OmniValue* field = form_at(arena, where, 2,
+                                   named(arena, where, "%s-%s", t->name, omni_car(f)->str_val), at);
+        if (!pattern_parts(m, omni_car(p), field, where, tests, binds, err)) return false;
+    }
+    return true;
+}
+
+/* Whether every pattern in pats matches anything */
+static bool irrefutable(OmniValue* pats) {
+    for (; omni_is_cell(pats); pats = omni_cdr(pats)) {
+        if (!omni_is_sym(omni_car(pats))) return false;
+    }
+    return true;
+}
+
+/* With no clause that matches everything, each variant of the sum type
+ * the clauses take apart needs a clause of its own: (Variant var...)
+ * without a guard */
+static bool exhaustive(OmniMacros* m, OmniValue* x, const char* sum, OmniValue* covered,
+                       OmniMacroError* err) {
+    /* The variants of the sum's latest definition */
+    const char* latest = NULL;
+    for (size_t i = 0; i < m->type_count; i++) {
+        if (m->types[i].sum && strcmp(m->types[i].sum, sum) == 0) latest = m->types[i].sum;
+    }
+    for (size_t i = 0; i < m->type_count; i++) {
+        if (m->types[i].sum != latest) continue;
+        bool found = false;
+        for (OmniValue* c = covered; omni_is_cell(c) && !found; c = omni_cdr(c)) {
+            found = strcmp(omni_car(c)->str_val, m->types[i].name) == 0;
+        }
+        if (found) continue;
+        char text[80];
+        short_text(x, text, sizeof(text));
+        snprintf(err->message, sizeof(err->message),
+                 "E0002 %s: no clause matches %s, a variant of %s; add one, or a _ clause",
+                 text, m->types[i].name, sum);
+        err->at = x;
+        return false;
+    }
+    return true;
+}
+
+/* forms in the scope of binds: (let* binds forms...), or forms alone */
+static OmniValue* with_binds(OmniArena* arena, OmniValue* binds, OmniValue* forms, OmniValue* where) {
+    if (omni_is_nil(binds)) return forms;
+    return cell_at(arena, cell_at(arena, named(arena, where, "let*"), cell_at(arena, binds, forms, where), where),
+                   omni_nil, where);
+}
+
+/*
+ * (match value (pattern [:when guard] body...) ...) as the core forms
+ * (let ((v value)) (cond (tests (let* (bindings) body...)) ...)), where a
+ * clause's tests check the shape of v and its bindings take it apart.
+ * A value no clause matches gives an error. Clauses over the variants of
+ * a sum type must cover them all.
+ */
+static bool match_form(OmniMacros* m, OmniValue* x, OmniMacroError* err, OmniValue** out) {
+    OmniArena* arena = m->arena;
+    OmniValue* args = omni_cdr(x);
+    OmniValue* v = copy_node(arena, omni_new_sym(arena, fresh_name(m, "match")), x);
+    ListBuilder clauses;
+    list_start(&clauses, arena);
+    bool total = false;
+    const char* sum = NULL;
+    ListBuilder covered;
+    list_start(&covered, arena);
+    OmniValue* c = omni_is_cell(args) ? omni_cdr(args) : args;
+    for (; omni_is_cell(c) && !total; c = omni_cdr(c)) {
+        OmniValue* clause = omni_car(c);
+        OmniValue* pat = omni_is_cell(clause) ? omni_car(clause) : NULL;
+        OmniValue* body = omni_is_cell(clause) ? omni_cdr(clause) : omni_nil;
+        OmniValue* guard = NULL;
+        if (omni_is_cell(body) && is_mark(omni_car(body), "when") && omni_is_cell(omni_cdr(body))) {
+            guard = omni_car(omni_cdr(body));
+            body = omni_cdr(omni_cdr(body));
+        } else if (omni_list_len(pat) == 3 && is_mark(omni_car(omni_cdr(pat)), "when")) {
+            /* The guard may sit in the pattern too: ((n :when guard) body...) */
+            guard = omni_car(omni_cdr(omni_cdr(pat)));
+            pat = omni_car(pat);
+        }
+        if (!omni_is_cell(body)) break;
+
+        TypeDef* t = omni_is_cell(pat) ? find_type(m, omni_car(pat)) : NULL;
+        if (t && t->sum) {
+            if (!sum) sum = t->sum;
+            if (!guard && irrefutable(omni_cdr(pat))) list_add(&covered, omni_car(pat));
+        }
+
+        ListBuilder tests, binds;
+        list_start(&tests, arena);
+        list_start(&binds, arena);
+        if (!pattern_parts(m, pat, v, x, &tests, &binds, err)) return false;
+        if (guard) list_add(&tests, omni_car(with_binds(arena, binds.head, cell_at(arena, guard, omni_nil, x), x)));
+
+        OmniValue* test;
+        if (omni_is_nil(tests.head)) {
+            test = named(arena, x, "else");
+            total = true;
+        } else if (omni_is_nil(omni_cdr(tests.head))) {
+            test = omni_car(tests.head);
+        } else {
+            test = cell_at(arena, named(arena, x, "and"), tests.head, x);
+        }
+        list_add(&clauses, cell_at(arena, test, with_binds(arena, binds.head, body, x), x));
+    }
+    if (!omni_is_cell(args) || (!omni_is_nil(c) && !total)) {
+        char text[80];
+        short_text(omni_is_cell(c) ? omni_car(c) : x, text, sizeof(text));
+        snprintf(err->message, sizeof(err->message),
+                 "E0002 %s: expected (match value (pattern body...) ...)", text);
+        err->at = omni_is_cell(c) ? omni_car(c) : x;
+        return false;
+    }
+    if (!total && sum && !exhaustive(m, x, sum, covered.head, err)) return false;
+    if (!total) {
+        OmniValue* message = copy_node(arena, omni_new_string(arena, "match: no clause matches"), x);
+        list_add(&clauses, form_at(arena, x, 2, named(arena, x, "else"),
+                                   form_at(arena, x, 2, named(arena, x, "error"), message)));
+    }
+    OmniValue* binding = form_at(arena, x, 1, form_at(arena, x, 2, v, omni_car(args)));
+    *out = form_at(arena, x, 3, named(arena, x, "let"), binding,
+                   cell_at(arena, named(arena, x, "cond"), clauses.head, x));
+    return true;
+}
+
+/* ============== Core Form Shapes ============== */
+
+/*
+ * The core forms are checked here, once, before anything takes them
+ * apart, so a form with parts missing or misplaced is an E0002 at its own
+ * position instead of code built from whatever the parts turned out to be.
+ */
+static bool malformed(OmniMacroError* err, OmniValue* x, const char* usage) {
+    char text[80];
+    short_text(x, text, sizeof(text));
+    snprintf(err->message, sizeof(err->message), "E0002 %s: expected %s", text, usage);
+    err->at = x;
+    return false;
+}
+
+/* Whether x is a list, ending in (), of n or more elements */
+static bool proper_list(OmniValue* x, size_t n) {
+    for (; omni_is_cell(x); x = omni_cdr(x)) {
+        if (n > 0) n--;
+    }
+    return omni_is_nil(x) && n == 0;
+}
+
+static bool symbol_list(OmniValue* x) {
+    for (; omni_is_cell(x); x = omni_cdr(x)) {
+        if (!omni_is_sym(omni_car(x))) return false;
+    }
+    return omni_is_nil(x);
+}
+
+/* Whether x, a quote, let, lambda or define, has the parts its form
+ * takes; if not, err says what the form looks like */
+static bool core_shape(OmniArena* arena, OmniValue* x, OmniMacroError* err) {
+    const char* name = omni_car(x)->str_val;
+    OmniValue* args = omni_cdr(x);
+    char usage[96];
+    if (strcmp(name, "quote") == 0) {
+        return proper_list(args, 1) && omni_is_nil(omni_cdr(args)) ? true : malformed(err, x, "(quote datum)");
+    }
+    if (strcmp(name, "lambda") == 0 || strcmp(name, "fn") == 0) {
+        snprintf(usage, sizeof(usage), "(%s (param...) body...)", name);
+        return proper_list(args, 1) && symbol_list(omni_car(args)) ? true : malformed(err, x, usage);
+    }
+    if (strcmp(name, "define") == 0) {
+        OmniValue* target = omni_car(args);
+        bool ok = omni_is_sym(target) ? proper_list(args, 2) && omni_is_nil(omni_cdr(omni_cdr(args)))
+                : omni_is_cell(target) && omni_is_sym(omni_car(target)) &&
+                  symbol_list(omni_cdr(target)) && proper_list(args, 1);
+        return ok ? true : malformed(err, x, "(define name value) or (define (name param...) body...)");
+    }
+    /* let, let*, letrec, letrec*; a named let is checked as it expands */
+    OmniValue* vars;
+    OmniValue* inits;
+    snprintf(usage, sizeof(usage), "(%s ((var init) ...) body...)", name);
+    return proper_list(args, 1) && binding_parts(arena, omni_car(args), &vars, &inits) ? true : malformed(err, x, usage);
+}
+
+/*
+ * (lambda self (param...) body...) as the core forms
+ * (letrec ((self (lambda (param...) body...))) self), so the body can
+ * call the lambda by name.
+ */
+static OmniValue* self_lambda(OmniArena* arena, OmniValue* x) {
+    OmniValue* self = omni_car(omni_cdr(x));
+    OmniValue* fn = cell_at(arena, omni_car(x), omni_cdr(omni_cdr(x)), x);
+    OmniValue* binding = cell_at(arena, self, cell_at(arena, fn, omni_nil, x), x);
+    return form_at(arena, x, 3, named(arena, x, "letrec"), cell_at(arena, binding, omni_nil, x), self);
+}
+
+/* Template t with the expressions its depth-1 unquotes hold expanded */
+static bool expand_template(OmniMacros* m, OmniValue* t, int depth, OmniMacroError* err, OmniValue** out) {
+    *out = t;
+    if (omni_is_array(t)) return walk_array(m, t, 0, 1, depth, err, out);
+    if (is_form(t, "unquote") || is_form(t, "unquote-splicing")) {
+        if (depth == 1) return walk_list(m, t, 1, WALK_FORMS, 0, err, out);
+        return walk_list(m, t, 1, WALK_TEMPLATE, depth - 1, err, out);
+    }
+    if (is_form(t, "quasiquote")) return walk_list(m, t, 1, WALK_TEMPLATE, depth + 1, err, out);
+    if (!omni_is_cell(t)) return true;
+    return walk_list(m, t, 0, WALK_TEMPLATE, depth, err, out);
+}
+
+static bool expand(OmniMacros* m, OmniValue* x, OmniMacroError* err, OmniValue** out) {
+    OmniArena* arena = m->arena;
+    *out = x;
+    if (omni_is_array(x)) return walk_array(m, x, 0, 1, 0, err, out);
+    if (!omni_is_cell(x)) return true;
+
+    OmniValue* head = omni_car(x);
+    if (is_form(x, "quote")) return core_shape(arena, x, err);
+    if (is_form(x, "quasiquote")) return expand_template(m, x, 0, err, out);
+    if (is_form(x, "defmacro")) {
+        snprintf(err->message, sizeof(err->message), "E0010 defmacro is only allowed at top level");
+        err->at = x;
+        return false;
+    }
+
+    Macro* mac = find_macro(m, head);
+    if (mac) {
+        if (m->expansions >= MACRO_MAX_EXPANSIONS) {
+            char why[80];
+            snprintf(why, sizeof(why), "expansions nest more than %d deep", MACRO_MAX_EXPANSIONS);
+            expansion_error(err, x, why);
+            return false;
+        }
+        OmniValue* expansion;
+        if (!invoke(m, mac, x, err, &expansion)) return false;
+        m->expansions++;
+        bool ok = expand(m, expansion, err, out);
+        m->expansions--;
+        return ok;
+    }
+
+    if (is_form(x, "deftype")) {
+        snprintf(err->message, sizeof(err->message), "E0002 deftype is only allowed at top level");
+        err->at = x;
+        return false;
+    }
+    if (is_form(x, "match")) {
+        OmniValue* core;
+        return match_form(m, x, err, &core) && expand(m, core, err, out);
+    }
+
+    /* (when test body...) is (if test (do body...)), and (unless test
+     * body...) is (if test () (do body...)): nil when the body is skipped */
+    if (is_form(x, "when") || is_form(x, "unless")) {
+        if (!omni_is_cell(omni_cdr(x))) {
+            char text[80];
+            short_text(x, text, sizeof(text));
+            snprintf(err->message, sizeof(err->message), "E0002 %s: expected (%s test body...)",
+                     text, omni_car(x)->str_val);
+            err->at = x;
+            return false;
+        }
+        OmniValue* test = omni_car(omni_cdr(x));
+        OmniValue* body = cell_at(arena, named(arena, x, "do"), omni_cdr(omni_cdr(x)), x);
+        OmniValue* core = is_form(x, "when") ? form_at(arena, x, 3, named(arena, x, "if"), test, body)
+                                             : form_at(arena, x, 4, named(arena, x, "if"), test, omni_nil, body);
+        return expand(m, core, err, out);
+    }
+
+    /* (define-printer T fn) is (user%printer T fn) */
+    if (is_form(x, "define-printer")) {
+        if (omni_list_len(x) != 3 || !find_type(m, omni_car(omni_cdr(x)))) {
+            char text[80];
+            short_text(x, text, sizeof(text));
+            snprintf(err->message, sizeof(err->message),
+                     "E0002 %s: expected (define-printer Type fn) after (deftype Type ...)", text);
+            err->at = x;
+            return false;
+        }
+        OmniValue* call = cell_at(arena, named(arena, x, "user%%printer"), omni_cdr(x), x);
+        return expand(m, call, err, out);
+    }
+
+    /* (set! (T-f obj) v) is (set-T-f! obj v) */
+    if (is_form(x, "set!") && omni_is_cell(omni_car(omni_cdr(x))) &&
+        omni_list_len(omni_car(omni_cdr(x))) == 2 && omni_list_len(x) == 3) {
+        OmniValue* place = omni_car(omni_cdr(x));
+        char buf[256];
+        const char* setter = setter_of(m, omni_car(place), buf, sizeof(buf));
+        if (setter) {
+            OmniValue* call = form_at(arena, x, 3, named(arena, x, "%s", setter), omni_car(omni_cdr(place)),
+                                      omni_car(omni_cdr(omni_cdr(x))));
+            return expand(m, call, err, out);
+        }
+    }
+
+    if (is_form(x, "let") && omni_is_sym(omni_car(omni_cdr(x)))) {
+        OmniValue* letrec;
+        return named_let(m, x, err, &letrec) && expand(m, letrec, err, out);
+    }
+    if ((is_form(x, "lambda") || is_form(x, "fn")) && omni_is_sym(omni_car(omni_cdr(x))) &&
+        omni_is_cell(omni_cdr(omni_cdr(x)))) {
+        return expand(m, self_lambda(arena, x), err, out);
+    }
+    if (is_form(x, "let") || is_form(x, "let*") || is_form(x, "letrec") || is_form(x, "letrec*") ||
+        is_form(x, "lambda") || is_form(x, "fn") || is_form(x, "define")) {
+        if (!core_shape(arena, x, err)) return false;
+    }
+
+    /* Binders and parameter lists are not calls */
+    if (is_form(x, "let") || is_form(x, "let*")) {
+        OmniValue* bindings = omni_car(omni_cdr(x));
+        OmniValue* walked;
+        bool ok = omni_is_array(bindings) ? walk_array(m, bindings, 1, 2, 0, err, &walked)
+                                          : walk_list(m, bindings, 0, WALK_BINDINGS, 0, err, &walked);
+        if (!ok || !walk_list(m, x, 2, WALK_FORMS, 0, err, out)) return false;
+        if (walked != bindings) {
+            OmniValue* rest = omni_cdr(*out);
+            *out = with_parts(arena, *out, head, with_parts(arena, rest, walked, omni_cdr(rest)));
+        }
+        return true;
+    }
+    if (is_form(x, "lambda") || is_form(x, "fn") || is_form(x, "define")) {
+        return walk_list(m, x, 2, WALK_FORMS, 0, err, out);
+    }
+    return walk_list(m, x, 0, WALK_FORMS, 0, err, out);
+}
+
+/* ============== Public API ============== */
+
+OmniMacros* omni_macros_new(OmniSession* session) {
+    OmniMacros* m = calloc(1, sizeof(OmniMacros));
+    OmniArena* arena = m->arena = session->arena;
+    m->globals = omni_nil;
+    for (size_t i = 0; i < sizeof(g_prims) / sizeof(g_prims[0]); i++) {
+        m->globals = bind(arena, m->globals, omni_new_sym(arena, g_prims[i].name),
+                          prim_value(arena, g_prims[i].fn));
+    }
+    session->types = m;
+    return m;
+}
+
+void omni_macros_free(OmniMacros* macros) {
+    if (!macros) return;
+    free(macros->macros);
+    free(macros->types);
+    free(macros);
+}
+
+size_t omni_macros_count(const OmniMacros* macros) {
+    return macros->count;
+}
+
+bool omni_is_defmacro(OmniValue* form) {
+    return is_form(form, "defmacro");
+}
+
+bool omni_macros_define(OmniMacros* macros, OmniValue* form, OmniMacroError* err) {
+    OmniValue* name = omni_car(omni_cdr(form));
+    OmniValue* params = omni_car(omni_cdr(omni_cdr(form)));
+    OmniValue* body = omni_cdr(omni_cdr(omni_cdr(form)));
+    if (!omni_is_sym(name) || !valid_params(params) || !omni_is_cell(body)) {
+        char text[80];
+        short_text(form, text, sizeof(text));
+        snprintf(err->message, sizeof(err->message),
+                 "E0002 %s: expected (defmacro name (params...) body...)", text);
+        err->at = form;
+        return false;
+    }
+
+    if (macros->count >= macros->capacity) {
+        macros->capacity = macros->capacity ? macros->capacity * 2 : 8;
+        macros->macros = realloc(macros->macros, macros->capacity * sizeof(Macro));
+    }
+    macros->macros[macros->count++] = (Macro){ name->str_val, params, body };
+    return true;
+}
+
+bool omni_is_deftype(OmniValue* form) {
+    return is_form(form, "deftype");
+}
+
+/* Whether a deftype's specs are the variants of a sum type */
+static bool is_sum(OmniValue* form) {
+    for (OmniValue* s = omni_cdr(omni_cdr(form)); omni_is_cell(s); s = omni_cdr(s)) {
+        if (omni_is_variant_spec(omni_car(s))) return true;
+    }
+    return false;
+}
+
+/* mk-T, T, T?, then T-f and set-T-f! for each field f */
+static void add_type_names(ListBuilder* names, OmniValue* where, const char* type, OmniValue* fields) {
+    list_add(names, named(names->arena, where, "mk-%s", type));
+    list_add(names, named(names->arena, where, "%s", type));
+    list_add(names, named(names->arena, where, "%s?", type));
+    for (OmniValue* f = fields; omni_is_cell(f); f = omni_cdr(f)) {
+        list_add(names, named(names->arena, where, "%s-%s", type, omni_car(f)->str_val));
+        list_add(names, named(names->arena, where, "set-%s-%s!", type, omni_car(f)->str_val));
+    }
+}
+
+OmniValue* omni_deftype_names(OmniArena* arena, OmniValue* form) {
+    const char* type = omni_car(omni_cdr(form))->str_val;
+    OmniValue* fields = omni_nil;
+    OmniValue* bad;
+    ListBuilder names;
+    list_start(&names, arena);
+    if (!is_sum(form)) {
+        deftype_fields(arena, omni_cdr(omni_cdr(form)), &fields, &bad);
+        add_type_names(&names, form, type, fields);
+        return names.head;
+    }
+    list_add(&names, named(arena, form, "%s?", type));
+    list_add(&names, named(arena, form, "%s-tag", type));
+    for (OmniValue* s = omni_cdr(omni_cdr(form)); omni_is_cell(s); s = omni_cdr(s)) {
+        fields = omni_nil;
+        deftype_fields(arena, omni_cdr(omni_car(s)), &fields, &bad);
+        add_type_names(&names, form, omni_car(omni_car(s))->str_val, fields);
+    }
+    return names.head;
+}
+
+/* Check the fields of type and record it for match patterns; false with
+ * err set if there are too many */
+static bool add_typedef(OmniMacros* macros, OmniValue* form, OmniValue* type, OmniValue* fields,
+                        const char* sum, OmniMacroError* err) {
+    if (omni_list_len(fields) > OMNI_MAX_FIELDS) {
+        snprintf(err->message, sizeof(err->message), "E0002 deftype %s: a type has at most %d fields",
+                 type->str_val, OMNI_MAX_FIELDS);
+        err->at = form;
+        return false;
+    }
+    if (macros->type_count >= macros->type_capacity) {
+        macros->type_capacity = macros->type_capacity ? macros->type_capacity * 2 : 8;
+        macros->types = realloc(macros->types, macros->type_capacity * sizeof(TypeDef));
+    }
+    macros->types[macros->type_count++] = (TypeDef){ type->str_val, fields, sum };
+    return true;
+}
+
+/* (define (mk-T f...) (user%new T f...)), (define (T f...) ...) the
+ * same, (define (T? x) (user%is T x)), then for each field i
+ * (define (T-f x) (user%ref T i x)) and
+ * (define (set-T-f! x v) (user%set T i x v)) */
+static void add_type_defines(OmniMacros* macros, ListBuilder* defs, OmniValue* form, OmniValue* name,
+                             OmniValue* fields) {
+    OmniArena* arena = macros->arena;
+    ListBuilder all;
+    list_start(&all, arena);
+    add_type_names(&all, form, name->str_val, fields);
+    OmniValue* names = all.head;
+    OmniValue* define = named(arena, form, "define");
+    OmniValue* type = copy_node(arena, name, form);
+    ListBuilder params;
+    list_start(&params, arena);
+    for (OmniValue* f = fields; omni_is_cell(f); f = omni_cdr(f)) {
+        list_add(&params, copy_node(arena, omni_new_sym(arena, fresh_name(macros, omni_car(f)->str_val)), form));
+    }
+    OmniValue* make = cell_at(arena, named(arena, form, "user%%new"),
+                              cell_at(arena, type, params.head, form), form);
+    list_add(defs, form_at(arena, form, 3, define, cell_at(arena, omni_car(names), params.head, form), make));
+    names = omni_cdr(names);
+    list_add(defs, form_at(arena, form, 3, define, cell_at(arena, omni_car(names), params.head, form), make));
+    names = omni_cdr(names);
+
+    OmniValue* x = copy_node(arena, omni_new_sym(arena, fresh_name(macros, "x")), form);
+    OmniValue* v = copy_node(arena, omni_new_sym(arena, fresh_name(macros, "v")), form);
+    list_add(defs, form_at(arena, form, 3, define, form_at(arena, form, 2, omni_car(names), x),
+                           form_at(arena, form, 3, named(arena, form, "user%%is"), type, x)));
+    names = omni_cdr(names);
+    for (int64_t i = 0; omni_is_cell(names); i++, names = omni_cdr(omni_cdr(names))) {
+        OmniValue* index = copy_node(arena, omni_new_int(arena, i), form);
+        list_add(defs, form_at(arena, form, 3, define, form_at(arena, form, 2, omni_car(names), x),
+                               form_at(arena, form, 4, named(arena, form, "user%%ref"), type, index, x)));
+        list_add(defs, form_at(arena, form, 3, define, form_at(arena, form, 3, omni_car(omni_cdr(names)), x, v),
+                               form_at(arena, form, 5, named(arena, form, "user%%set"), type, index, x, v)));
+    }
+}
+
+/*
+ * A sum type (deftype S (Variant field...) ...): each variant is a type
+ * of its own, as if by (deftype Variant field...), whose descriptor
+ * names S. (define (S? x) (user%in S x)) and (define (S-tag x)
+ * (user%tag S x)) come first.
+ */
+static OmniValue* sum_deftype(OmniMacros* macros, OmniValue* form, OmniMacroError* err) {
+    OmniArena* arena = macros->arena;
+    OmniValue* name = omni_car(omni_cdr(form));
+    OmniValue* specs = omni_cdr(omni_cdr(form));
+    char text[80];
+    for (OmniValue* s = specs; omni_is_cell(s); s = omni_cdr(s)) {
+        OmniValue* spec = omni_car(s);
+        OmniValue* fields;
+        OmniValue* bad = spec;
+        const char* why = NULL;
+        if (!omni_is_variant_spec(spec)) {
+            why = "a sum type's specs are all variants (Variant field...)";
+        } else if (!deftype_fields(arena, omni_cdr(spec), &fields, &bad)) {
+            why = "expected (Variant (field type [:weak]) ...)";
+        } else if (strcmp(omni_car(spec)->str_val, name->str_val) == 0) {
+            why = "a variant cannot have the sum type's name";
+        }
+        for (OmniValue* o = specs; o != s && !why; o = omni_cdr(o)) {
+            if (strcmp(omni_car(omni_car(o))->str_val, omni_car(spec)->str_val) == 0) why = "a variant is repeated";
+        }
+        if (why) {
+            short_text(spec, text, sizeof(text));
+            snprintf(err->message, sizeof(err->message), "E0002 deftype %s: %s: %s", name->str_val, text, why);
+            err->at = bad;
+            return NULL;
+        }
+    }
+
+    ListBuilder defs;
+    list_start(&defs, arena);
+    OmniValue* define = named(arena, form, "define");
+    OmniValue* type = copy_node(arena, name, form);
+    OmniValue* x = copy_node(arena, omni_new_sym(arena, fresh_name(macros, "x")), form);
+    list_add(&defs, form_at(arena, form, 3, define,
+                            form_at(arena, form, 2, named(arena, form, "%s?", name->str_val), x),
+                            form_at(arena, form, 3, named(arena, form, "user%%in"), type, x)));
+    list_add(&defs, form_at(arena, form, 3, define,
+                            form_at(arena, form, 2, named(arena, form, "%s-tag", name->str_val), x),
+                            form_at(arena, form, 3, named(arena, form, "user%%tag"), type, x)));
+    for (OmniValue* s = specs; omni_is_cell(s); s = omni_cdr(s)) {
+        OmniValue* fields;
+        OmniValue* bad;
+        deftype_fields(arena, omni_cdr(omni_car(s)), &fields, &bad);
+        if (!add_typedef(macros, form, omni_car(omni_car(s)), fields, name->str_val, err)) return NULL;
+        add_type_defines(macros, &defs, form, omni_car(omni_car(s)), fields);
+    }
+    return defs.head;
+}
+
+OmniValue* omni_macros_deftype(OmniMacros* macros, OmniValue* form, OmniMacroError* err) {
+    OmniArena* arena = macros->arena;
+    OmniValue* name = omni_car(omni_cdr(form));
+    OmniValue* fields;
+    OmniValue* bad = form;
+    char text[80];
+    if (omni_is_sym(name) && is_sum(form)) return sum_deftype(macros, form, err);
+    if (!omni_is_sym(name) || !deftype_fields(arena, omni_cdr(omni_cdr(form)), &fields, &bad)) {
+        short_text(form, text, sizeof(text));
+        snprintf(err->message, sizeof(err->message),
+                 "E0002 %s: expected (deftype Name (field type [:weak]) ...)", text);
+        err->at = omni_is_sym(name) ? bad : form;
+        return NULL;
+    }
+    if (!add_typedef(macros, form, name, fields, NULL, err)) return NULL;
+
+    ListBuilder defs;
+    list_start(&defs, arena);
+    add_type_defines(macros, &defs, form, name, fields);
+    return defs.head;
+}
+
+OmniValue* omni_macros_expand(OmniMacros* macros, OmniValue* form, OmniMacroError* err) {
+    OmniValue* out;
+    macros->expansions = 0;
+    return expand(macros, form, err, &out) ? out : NULL;
+}
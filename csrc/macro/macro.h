@@ -0,0 +1,104 @@
+/*
+ * OmniLisp Macros - compile-time expansion of defmacro
+ *
+ * (defmacro name (params...) body...) defines a macro for the forms that
+ * follow it, in its own file and in files that import it. A call
+ * (name args...) is replaced before compilation by the value of body,
+ * evaluated with params bound to the unevaluated argument forms; the
+ * expansion is expanded again until no macro calls remain. A dotted
+ * parameter (params... . rest) takes the remaining arguments as a list.
+ *
+ * Bodies run in a small evaluator, not in compiled code: quote,
+ * quasiquote, if, when, unless, cond, let, let*, named let, lambda/fn,
+ * and, or, do/begin, inner defines and error, with list, symbol, string
+ * and arithmetic primitives and (gensym [prefix]). Program definitions
+ * are not visible to them.
+ *
+ * Expansion also rewrites each named let, (let name ((var init) ...)
+ * body...), as the letrec of a function name of the vars called with the
+ * inits, so later passes see only core forms.
+ *
+ * Expansion also rewrites each (match value (pattern body...) ...) as a
+ * cond over the value, so a clause's pattern becomes tests of its shape
+ * and bindings that take it apart. A pattern is _, a variable, a literal
+ * or (Type pattern...) for a type deftype defined earlier, and a clause
+ * may add a guard, (pattern :when test body...). Unless a clause matches
+ * anything, clauses over the variants of a sum type must give each
+ * variant one without a guard whose field patterns are variables.
+ *
+ * Expansion also rewrites (when test body...) as (if test (do body...))
+ * and (unless test body...) as (if test () (do body...)), so either is
+ * nil when its body does not run.
+ *
+ * Expansion also checks each (define-printer Type fn) names a type deftype
+ * defined earlier, and rewrites it as the call that registers fn as the
+ * printer of Type's objects.
+ *
+ * Expansion is hygienic for the names a macro binds itself: a let, let*,
+ * named let, lambda or fn binder that comes from the macro rather than from its
+ * arguments is renamed to a fresh name, so it can neither capture nor
+ * shadow a name in the caller's code. Generated names contain a %, as in
+ * tmp%3, and nodes made by an expansion carry the call's position.
+ */
+
+#ifndef OMNILISP_MACRO_H
+#define OMNILISP_MACRO_H
+
+#include "../ast/ast.h"
+#include <stdbool.h>
+
+#ifdef __cplusplus
+extern "C" {
+#endif
+
+typedef struct OmniMacros OmniMacros;
+
+typedef struct OmniMacroError {
+    char message[512];
+    OmniValue* at;            /* Node the message is about */
+} OmniMacroError;
+
+/* The macros and types of session, which becomes its type registry;
+ * nodes made while defining and expanding macros are allocated in the
+ * session's arena */
+OmniMacros* omni_macros_new(OmniSession* session);
+void omni_macros_free(OmniMacros* macros);
+
+/* Macros defined so far */
+size_t omni_macros_count(const OmniMacros* macros);
+
+/* (defmacro ...) forms */
+bool omni_is_defmacro(OmniValue* form);
+
+/* Define the macro of a (defmacro ...) form; false with err set if the
+ * form is malformed */
+bool omni_macros_define(OmniMacros* macros, OmniValue* form, OmniMacroError* err);
+
+/* Fields a (deftype ...) may have */
+#define OMNI_MAX_FIELDS 64
+
+/* (deftype ...) forms */
+bool omni_is_deftype(OmniValue* form);
+
+/* Record the type of a (deftype Name (field type [:weak]) ...) form for
+ * the match patterns after it, and give the definitions it makes as a
+ * list of define forms: the constructor as mk-Name and as Name, Name?,
+ * and Name-field and set-Name-field! for each field. A sum type
+ * (deftype Name (Variant field...) ...) defines Name? and Name-tag, then
+ * each variant as a type of its own. NULL with err set if it is
+ * malformed. */
+OmniValue* omni_macros_deftype(OmniMacros* macros, OmniValue* form, OmniMacroError* err);
+
+/* The names a well-formed (deftype ...) form defines, in that order,
+ * allocated in arena */
+OmniValue* omni_deftype_names(OmniArena* arena, OmniValue* form);
+
+/* form with every macro call in it expanded: form itself when there are
+ * none, NULL with err set if an expansion fails */
+OmniValue* omni_macros_expand(OmniMacros* macros, OmniValue* form, OmniMacroError* err);
+
+#ifdef __cplusplus
+}
+#endif
+
+#endif /* OMNILISP_MACRO_H */
@@ -0,0 +1,119 @@
+/*
+ * OmniLisp Modules Implementation
+ */
+
+#include "modules.h"
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <limits.h>
+
+/* ============== Loader ============== */
+
+OmniModuleLoader* omni_modules_new(void) {
+    OmniModuleLoader* loader = calloc(1, sizeof(OmniModuleLoader));
+    loader->fs = omni_fs_os();
+    return loader;
+}
+
+void omni_modules_free(OmniModuleLoader* loader) {
+    if (!loader) return;
+    for (size_t i = 0; i < loader->count; i++) {
+        free(loader->modules[i].path);
+        free(loader->modules[i].key);
+        free(loader->modules[i].text);
+    }
+    free(loader->modules);
+    free(loader->stack);
+    free(loader);
+}
+
+char* omni_module_resolve(const char* importer, const char* path) {
+    const char* slash = importer ? strrchr(importer, '/') : NULL;
+    if (path[0] == '/' || !slash) return strdup(path);
+
+    size_t dir = (size_t)(slash - importer) + 1;
+    char* resolved = malloc(dir + strlen(path) + 1);
+    memcpy(resolved, importer, dir);
+    strcpy(resolved + dir, path);
+    return resolved;
+}
+
+OmniModuleStatus omni_modules_load(OmniModuleLoader* loader, const char* path,
+                                   const char* text, size_t* index) {
+    /* Files are told apart by their canonical path. Text that is not in
+     * a file (such as an -e expression) is never the same as other text. */
+    char canonical[PATH_MAX];
+    bool found = omni_fs_canonical(loader->fs, path, canonical, sizeof(canonical));
+    if (!text && !found) return OMNI_MODULE_MISSING;
+    const char* key = found ? canonical : path;
+
+    for (size_t i = 0; i < loader->count && found; i++) {
+        if (strcmp(loader->modules[i].key, key) == 0) {
+            *index = i;
+            return loader->modules[i].loading ? OMNI_MODULE_CYCLE : OMNI_MODULE_LOADED;
+        }
+    }
+
+    char* read = NULL;
+    if (!text) {
+        read = omni_fs_read(loader->fs, path);
+        if (!read) return OMNI_MODULE_MISSING;
+    }
+
+    if (loader->count >= loader->capacity) {
+        loader->capacity = loader->capacity ? loader->capacity * 2 : 8;
+        loader->modules = realloc(loader->modules, loader->capacity * sizeof(OmniModule));
+        loader->stack = realloc(loader->stack, loader->capacity * sizeof(size_t));
+    }
+    OmniModule* m = &loader->modules[loader->count];
+    m->path = strdup(path);
+    m->key = strdup(key);
+    m->text = read;
+    m->loading = true;
+    loader->stack[loader->depth++] = loader->count;
+    *index = loader->count++;
+    return OMNI_MODULE_NEW;
+}
+
+void omni_modules_done(OmniModuleLoader* loader, size_t index) {
+    loader->modules[index].loading = false;
+    for (size_t i = loader->depth; i > 0; i--) {
+        if (loader->stack[i - 1] == index) {
+            memmove(&loader->stack[i - 1], &loader->stack[i],
+                    (loader->depth - i) * sizeof(size_t));
+            loader->depth--;
+            break;
+        }
+    }
+}
+
+void omni_modules_format_cycle(OmniModuleLoader* loader, size_t index, char* buf, size_t cap) {
+    size_t len = 0;
+    buf[0] = '\0';
+    bool in_cycle = false;
+    for (size_t i = 0; i < loader->depth && len < cap; i++) {
+        if (loader->stack[i] == index) in_cycle = true;
+        if (!in_cycle) continue;
+        len += (size_t)snprintf(buf + len, cap - len, "%s -> ",
+                                loader->modules[loader->stack[i]].path);
+    }
+    if (len < cap) snprintf(buf + len, cap - len, "%s", loader->modules[index].path);
+}
+
+/* ============== Forms ============== */
+
+bool omni_is_import(OmniValue* form) {
+    return omni_is_cell(form) && omni_sym_eq_str(omni_car(form), "import");
+}
+
+bool omni_is_provide(OmniValue* form) {
+    return omni_is_cell(form) && omni_sym_eq_str(omni_car(form), "provide");
+}
+
+const char* omni_defined_name(OmniValue* form) {
+    if (!omni_is_cell(form) || !omni_sym_eq_str(omni_car(form), "define")) return NULL;
+    OmniValue* target = omni_car(omni_cdr(form));
+    if (omni_is_cell(target)) target = omni_car(target);
+    return omni_is_sym(target) ? target->str_val : NULL;
+}
@@ -0,0 +1,81 @@
+/*
+ * OmniLisp Modules
+ *
+ * (import "path" ...) makes other files part of a program. A path is
+ * resolved against the directory of the file importing it (the working
+ * directory for input that has no file). Each file is loaded once however
+ * many files import it, and its forms run before those of the file that
+ * first imports it. (provide name ...) lists the definitions a module
+ * lets its importers use; a module without one provides everything.
+ */
+
+#ifndef OMNILISP_MODULES_H
+#define OMNILISP_MODULES_H
+
+#include "../ast/ast.h"
+#include "../fs/fs.h"
+#include <stdbool.h>
+#include <stddef.h>
+
+#ifdef __cplusplus
+extern "C" {
+#endif
+
+typedef struct OmniModule {
+    char* path;               /* As resolved, for diagnostics */
+    char* key;                /* Canonical path, to recognise the same file */
+    char* text;               /* Read by the loader; NULL when the caller has it */
+    bool loading;             /* Its imports are still being loaded */
+} OmniModule;
+
+typedef struct OmniModuleLoader {
+    const OmniFS* fs;         /* Where files are read from (the OS's by default) */
+    OmniModule* modules;
+    size_t count;
+    size_t capacity;
+
+    /* Modules being loaded, outermost first */
+    size_t* stack;
+    size_t depth;
+} OmniModuleLoader;
+
+typedef enum {
+    OMNI_MODULE_NEW = 0,      /* First seen: load its imports, then its forms */
+    OMNI_MODULE_LOADED,       /* Already part of the program */
+    OMNI_MODULE_CYCLE,        /* Imports itself through the modules being loaded */
+    OMNI_MODULE_MISSING       /* Cannot be read */
+} OmniModuleStatus;
+
+OmniModuleLoader* omni_modules_new(void);
+void omni_modules_free(OmniModuleLoader* loader);
+
+/* Path of the file path names when imported by importer (NULL when the
+ * importing input has no file). The result is malloc'd. */
+char* omni_module_resolve(const char* importer, const char* path);
+
+/*
+ * Look up or read the file at path (as resolved). text is its contents
+ * when the caller already has them, else NULL to read it; text that is
+ * not in a file is always NEW. *index is set to the module unless the
+ * file is missing. A NEW module is loading until omni_modules_done.
+ */
+OmniModuleStatus omni_modules_load(OmniModuleLoader* loader, const char* path,
+                                   const char* text, size_t* index);
+void omni_modules_done(OmniModuleLoader* loader, size_t index);
+
+/* Write "a.omni -> b.omni -> a.omni" for the cycle closing at index into buf */
+void omni_modules_format_cycle(OmniModuleLoader* loader, size_t index, char* buf, size_t cap);
+
+/* (import ...) and (provide ...) forms */
+bool omni_is_import(OmniValue* form);
+bool omni_is_provide(OmniValue* form);
+
+/* Name a top-level (define name ...) or (define (name ...) ...) defines,
+ * else NULL */
+const char* omni_defined_name(OmniValue* form);
+
+#ifdef __cplusplus
+}
+#endif
+
+#endif /* OMNILISP_MODULES_H */
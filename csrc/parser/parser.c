@@ -12,6 +12,8 @@
 #include <stdio.h>
 #include <stdarg.h>
 #include <ctype.h>
+#include <errno.h>
+#include <pthread.h>
 
 /* ============== Grammar Rule IDs ============== */
 
@@ -19,23 +21,38 @@ enum {
     R_EPSILON,
     R_CHAR_SPACE, R_CHAR_TAB, R_CHAR_NL, R_CHAR_CR, R_SEMICOLON,
     R_SPACE,
+    R_ANY_CHAR, R_NOT_NL, R_LINE_CHAR, R_LINE_REST,
     R_COMMENT,
-    R_WS,
-
-    R_DIGIT, R_DIGIT1, R_INT, R_SIGN, R_SIGNED_INT,
+    R_WS_ITEM, R_WS,
+    R_SHEBANG_START, R_SHEBANG, R_SHEBANG_OPT,
+    R_LANG_START, R_LANG, R_LANG_OPT,
+
+    /* Integer sub-rules precede R_INT so it matches on the first fixpoint
+     * pass, before ATOM has settled on a symbol of the same length. */
+    R_DIGIT, R_DIGIT1,
+    R_MINUS, R_PLUS, R_INT_SIGN, R_INT_SIGN_OPT, R_UNDERSCORE,
+    R_DEC_CHAR, R_DEC_REST, R_DEC_INT,
+    R_HEX_LOWER, R_HEX_UPPER, R_HEX_CHAR, R_HEX_BODY, R_HEX_PREFIX, R_HEX_INT,
+    R_OCT_DIGIT, R_OCT_CHAR, R_OCT_BODY, R_OCT_PREFIX, R_OCT_INT,
+    R_BIN_DIGIT, R_BIN_CHAR, R_BIN_BODY, R_BIN_PREFIX, R_BIN_INT,
+    R_INT, R_SIGN,
+    R_DOT, R_EXP_LOWER, R_EXP_UPPER, R_EXP_MARK, R_EXP_DIGITS, R_EXPONENT, R_EXPONENT_OPT,
+    R_FRACTION, R_FLOAT_DOT, R_FLOAT_EXP,
     R_FLOAT_FRAC, R_FLOAT,
 
-    R_ALPHA, R_ALPHA_UPPER, R_SYM_SPECIAL, R_SYM_CHAR, R_SYM_FIRST, R_SYM,
+    R_ALPHA, R_ALPHA_UPPER, R_SYM_BANG, R_SYM_SPECIAL, R_SYM_CHAR, R_SYM_FIRST, R_SYM,
     R_KEYWORD,
 
-    R_CHAR_ESCAPE, R_CHAR_LIT, R_STRING_CHAR, R_STRING,
+    R_CHAR_ESCAPE, R_CHAR_NAME_CHAR, R_CHAR_NAME, R_CHAR_LIT,
+    R_DQUOTE, R_BACKSLASH, R_STRING_ESC, R_STRING_STOP, R_STRING_NOT_STOP, R_STRING_PLAIN,
+    R_STRING_CHAR, R_STRING_BODY, R_STRING,
 
     R_LPAREN, R_RPAREN,
     R_LBRACKET, R_RBRACKET,
     R_LBRACE, R_RBRACE,
     R_HASHBRACE, R_HASHPAREN, R_HASHBRACKET,
 
-    R_QUOTE_CHAR, R_QUASIQUOTE_CHAR, R_UNQUOTE_SPLICE_CHARS, R_UNQUOTE_CHAR,
+    R_QUOTE_CHAR, R_QUASIQUOTE_CHAR, R_UNQUOTE_SPLICE_CHARS, R_UNQUOTE_CHAR, R_QUOTE_PREFIX,
 
     R_EXPR,
     R_ATOM,
@@ -54,14 +71,22 @@ enum {
     NUM_RULES
 };
 
+/* The grammar is built once for the process and only read after that,
+ * so any number of parsers can use it at once */
 static PikaRule g_rules[NUM_RULES] = {{0}};
 static int* g_rule_ids[NUM_RULES] = {NULL};
-static bool g_grammar_initialized = false;
+static pthread_once_t g_grammar_once = PTHREAD_ONCE_INIT;
+
+/* The children of every rule, handed out by ids() */
+static int g_child_ids[160];
+static size_t g_child_count = 0;
 
 /* ============== Helper Functions ============== */
 
 static int* ids(int count, ...) {
-    int* arr = malloc(sizeof(int) * count);
+    if (g_child_count + (size_t)count > sizeof(g_child_ids) / sizeof(g_child_ids[0])) abort();
+    int* arr = g_child_ids + g_child_count;
+    g_child_count += (size_t)count;
     va_list args;
     va_start(args, count);
     for (int i = 0; i < count; i++) arr[i] = va_arg(args, int);
@@ -69,23 +94,191 @@ static int* ids(int count, ...) {
     return arr;
 }
 
+/* ============== Source Positions ============== */
+
+/* Offsets where each line of the text being parsed starts, so actions
+ * can stamp nodes with a line and column; the actions' state->user */
+typedef struct LineTable {
+    size_t* starts;
+    size_t count;
+} LineTable;
+
+static void lines_begin(LineTable* t, const char* text, size_t len) {
+    size_t lines = 1;
+    for (size_t i = 0; i < len; i++) {
+        if (text[i] == '\n') lines++;
+    }
+    t->starts = malloc(sizeof(size_t) * lines);
+    t->count = 0;
+    if (!t->starts) return;
+    t->starts[t->count++] = 0;
+    for (size_t i = 0; i < len; i++) {
+        if (text[i] == '\n') t->starts[t->count++] = i + 1;
+    }
+}
+
+static void lines_end(LineTable* t) {
+    free(t->starts);
+    t->starts = NULL;
+    t->count = 0;
+}
+
+/* Record that v was read at byte offset pos; shared singletons stay bare */
+static OmniValue* at(PikaState* state, OmniValue* v, size_t pos) {
+    LineTable* t = state->user;
+    if (!v || v == omni_nil || v == omni_nothing || !t || t->count == 0) return v;
+    size_t lo = 0, hi = t->count;
+    while (hi - lo > 1) {
+        size_t mid = (lo + hi) / 2;
+        if (t->starts[mid] <= pos) lo = mid;
+        else hi = mid;
+    }
+    v->line = (int)lo + 1;
+    v->column = (int)(pos - t->starts[lo]) + 1;
+    return v;
+}
+
 /* ============== Semantic Actions ============== */
 
+/* Base of the integer literal at text: 16, 8 or 2 after #x, #o or #b */
+static int int_base(const char* text) {
+    if (text[0] != '#') return 10;
+    switch (text[1]) {
+        case 'x': return 16;
+        case 'o': return 8;
+        case 'b': return 2;
+    }
+    return 10;
+}
+
+/* Value of the integer literal of len bytes at text: [#x|#o|#b][+-]digits,
+ * with _ separators dropped. *in_range is false if it does not fit. */
+static long long int_value(const char* text, size_t len, bool* in_range) {
+    int base = int_base(text);
+    if (base != 10) {
+        text += 2;
+        len -= 2;
+    }
+
+    char buf[128];
+    size_t n = 0;
+    for (size_t i = 0; i < len && n < sizeof(buf) - 1; i++) {
+        if (text[i] != '_') buf[n++] = text[i];
+    }
+    buf[n] = '\0';
+    errno = 0;
+    long long value = strtoll(buf, NULL, base);
+    *in_range = errno != ERANGE;
+    return value;
+}
+
 static OmniValue* act_int(PikaState* state, size_t pos, PikaMatch match) {
-    char buf[64];
-    size_t len = match.len > 63 ? 63 : match.len;
-    memcpy(buf, state->input + pos, len);
-    buf[len] = '\0';
-    return omni_new_int(atol(buf));
+    bool in_range;
+    long long value = int_value(state->input + pos, match.len, &in_range);
+    return at(state, omni_new_int(state->arena, value), pos);
+}
+
+static OmniValue* act_float(PikaState* state, size_t pos, PikaMatch match) {
+    char buf[128];
+    size_t n = 0;
+    for (size_t i = 0; i < match.len && n < sizeof(buf) - 1; i++) {
+        char c = state->input[pos + i];
+        if (c != '_') buf[n++] = c;
+    }
+    buf[n] = '\0';
+    return at(state, omni_new_float(state->arena, strtod(buf, NULL)), pos);
 }
 
 static OmniValue* act_sym(PikaState* state, size_t pos, PikaMatch match) {
     char* s = malloc(match.len + 1);
     memcpy(s, state->input + pos, match.len);
     s[match.len] = '\0';
-    OmniValue* v = omni_new_sym(s);
+    /* :name is a keyword; a lone : stays a symbol */
+    OmniValue* v = s[0] == ':' && s[1] ? omni_new_keyword(state->arena, s + 1) : omni_new_sym(state->arena, s);
     free(s);
-    return v;
+    return at(state, v, pos);
+}
+
+/* Named characters accepted after #\ */
+static const struct { const char* name; int32_t c; } g_char_names[] = {
+    { "space", ' ' }, { "newline", '\n' }, { "tab", '\t' }, { "return", '\r' },
+    { "nul", 0 }, { "null", 0 }, { "escape", 27 }, { "delete", 127 },
+    { "alarm", 7 }, { "backspace", 8 },
+};
+
+static OmniValue* char_literal(PikaState* state, size_t pos, PikaMatch match) {
+    /* #\a, #\space, #\x41 */
+    const char* text = state->input + pos + 2;
+    size_t len = match.len - 2;
+    if (len == 1) return omni_new_char(state->arena, (unsigned char)text[0]);
+
+    for (size_t i = 0; i < sizeof(g_char_names) / sizeof(g_char_names[0]); i++) {
+        if (strlen(g_char_names[i].name) == len &&
+            strncmp(g_char_names[i].name, text, len) == 0) {
+            return omni_new_char(state->arena, g_char_names[i].c);
+        }
+    }
+    if (text[0] == 'x' && len <= 9) {
+        char buf[16];
+        char* end;
+        memcpy(buf, text + 1, len - 1);
+        buf[len - 1] = '\0';
+        long c = strtol(buf, &end, 16);
+        if (*end == '\0') return omni_new_char(state->arena, (int32_t)c);
+    }
+    return omni_new_error(state->arena, "unknown character name");
+}
+
+static OmniValue* act_char(PikaState* state, size_t pos, PikaMatch match) {
+    return at(state, char_literal(state, pos, match), pos);
+}
+
+static OmniValue* act_string(PikaState* state, size_t pos, PikaMatch match) {
+    /* Between the quotes; \n \t \r are controls, \" and \\ themselves.
+     * Any other escape is reported once the program is read. */
+    const char* text = state->input + pos + 1;
+    size_t len = match.len - 2;
+    char* s = malloc(len + 1);
+    size_t n = 0;
+    for (size_t i = 0; i < len; i++) {
+        char c = text[i];
+        if (c == '\\' && i + 1 < len) {
+            c = text[++i];
+            switch (c) {
+                case 'n': c = '\n'; break;
+                case 't': c = '\t'; break;
+                case 'r': c = '\r'; break;
+            }
+        }
+        s[n++] = c;
+    }
+    s[n] = '\0';
+    OmniValue* v = omni_new_string(state->arena, s);
+    free(s);
+    return at(state, v, pos);
+}
+
+/* (a b . c): a copy of the spine ending in c, or NULL if items has no
+ * dot before its last element. Copied because match values are shared. */
+static OmniValue* dotted_list(PikaState* state, OmniValue* items) {
+    OmniValue* p = items;
+    if (!omni_is_cell(p)) return NULL;
+    for (p = omni_cdr(p); omni_is_cell(p); p = omni_cdr(p)) {
+        OmniValue* rest = omni_cdr(p);
+        if (omni_is_sym(omni_car(p)) && strcmp(omni_car(p)->str_val, ".") == 0 &&
+            omni_is_cell(rest) && omni_is_nil(omni_cdr(rest))) break;
+    }
+    if (!omni_is_cell(p)) return NULL;
+
+    OmniValue* tail = omni_car(omni_cdr(p));
+    OmniValue* head = NULL;
+    OmniValue** link = &head;
+    for (OmniValue* q = items; q != p; q = omni_cdr(q)) {
+        *link = omni_new_cell(state->arena, omni_car(q), omni_nil);
+        link = &(*link)->cell.cdr;
+    }
+    *link = tail;
+    return head;
 }
 
 static OmniValue* act_list(PikaState* state, size_t pos, PikaMatch match) {
@@ -98,7 +291,10 @@ static OmniValue* act_list(PikaState* state, size_t pos, PikaMatch match) {
 
     /* Get inner content */
     PikaMatch* inner_m = pika_get_match(state, current, R_LIST_INNER);
-    if (inner_m && inner_m->matched && inner_m->val) return inner_m->val;
+    if (inner_m && inner_m->matched && inner_m->val) {
+        OmniValue* dotted = dotted_list(state, inner_m->val);
+        return at(state, dotted ? dotted : inner_m->val, pos);
+    }
 
     return omni_nil;
 }
@@ -122,7 +318,7 @@ static OmniValue* act_list_inner(PikaState* state, size_t pos, PikaMatch match)
     PikaMatch* rest_m = pika_get_match(state, current, R_LIST_INNER);
     OmniValue* tail = (rest_m && rest_m->matched && rest_m->val) ? rest_m->val : omni_nil;
 
-    return omni_new_cell(head, tail);
+    return omni_new_cell(state->arena, head, tail);
 }
 
 static OmniValue* act_array(PikaState* state, size_t pos, PikaMatch match) {
@@ -139,13 +335,13 @@ static OmniValue* act_array(PikaState* state, size_t pos, PikaMatch match) {
         size_t len = 0;
         for (OmniValue* p = list; !omni_is_nil(p) && omni_is_cell(p); p = omni_cdr(p)) len++;
 
-        OmniValue* arr = omni_new_array(len);
+        OmniValue* arr = omni_new_array(state->arena, len);
         for (OmniValue* p = list; !omni_is_nil(p) && omni_is_cell(p); p = omni_cdr(p)) {
-            omni_array_push(arr, omni_car(p));
+            omni_array_push(state->arena, arr, omni_car(p));
         }
-        return arr;
+        return at(state, arr, pos);
     }
-    return omni_new_array(0);
+    return at(state, omni_new_array(state->arena, 0), pos);
 }
 
 static OmniValue* act_array_inner(PikaState* state, size_t pos, PikaMatch match) {
@@ -165,8 +361,8 @@ static OmniValue* act_quoted(PikaState* state, size_t pos, PikaMatch match) {
 
         PikaMatch* expr_m = pika_get_match(state, expr_pos, R_EXPR);
         if (expr_m && expr_m->matched && expr_m->val) {
-            return omni_new_cell(omni_new_sym("unquote-splicing"),
-                                 omni_new_cell(expr_m->val, omni_nil));
+            return at(state, omni_new_cell(state->arena, omni_new_sym(state->arena, "unquote-splicing"),
+                                           omni_new_cell(state->arena, expr_m->val, omni_nil)), pos);
         }
     }
 
@@ -182,8 +378,8 @@ static OmniValue* act_quoted(PikaState* state, size_t pos, PikaMatch match) {
             case ',': quote_sym = "unquote"; break;
             default: quote_sym = "quote"; break;
         }
-        return omni_new_cell(omni_new_sym(quote_sym),
-                             omni_new_cell(expr_m->val, omni_nil));
+        return at(state, omni_new_cell(state->arena, omni_new_sym(state->arena, quote_sym),
+                                       omni_new_cell(state->arena, expr_m->val, omni_nil)), pos);
     }
 
     return omni_nil;
@@ -192,9 +388,19 @@ static OmniValue* act_quoted(PikaState* state, size_t pos, PikaMatch match) {
 static OmniValue* act_program(PikaState* state, size_t pos, PikaMatch match) {
     size_t current = pos;
 
+    PikaMatch* shebang_m = pika_get_match(state, current, R_SHEBANG_OPT);
+    if (shebang_m && shebang_m->matched) current += shebang_m->len;
+
     PikaMatch* ws_m = pika_get_match(state, current, R_WS);
     if (ws_m && ws_m->matched) current += ws_m->len;
 
+    PikaMatch* lang_m = pika_get_match(state, current, R_LANG_OPT);
+    if (lang_m && lang_m->matched && lang_m->len > 0) {
+        current += lang_m->len;
+        ws_m = pika_get_match(state, current, R_WS);
+        if (ws_m && ws_m->matched) current += ws_m->len;
+    }
+
     PikaMatch* inner_m = pika_get_match(state, current, R_PROGRAM_INNER);
     if (inner_m && inner_m->matched && inner_m->val) return inner_m->val;
 
@@ -207,9 +413,7 @@ static OmniValue* act_program_inner(PikaState* state, size_t pos, PikaMatch matc
 
 /* ============== Grammar Initialization ============== */
 
-void omni_grammar_init(void) {
-    if (g_grammar_initialized) return;
-
+static void build_grammar(void) {
     /* Epsilon */
     g_rules[R_EPSILON] = (PikaRule){ PIKA_TERMINAL, .data.str = "" };
 
@@ -224,24 +428,116 @@ void omni_grammar_init(void) {
     g_rule_ids[R_SPACE] = ids(4, R_CHAR_SPACE, R_CHAR_TAB, R_CHAR_NL, R_CHAR_CR);
     g_rules[R_SPACE] = (PikaRule){ PIKA_ALT, .data.children = { g_rule_ids[R_SPACE], 4 } };
 
+    /* Rest of line: any characters up to (not including) a newline */
+    g_rules[R_ANY_CHAR] = (PikaRule){ PIKA_ANY, .data.str = NULL };
+    g_rule_ids[R_NOT_NL] = ids(1, R_CHAR_NL);
+    g_rules[R_NOT_NL] = (PikaRule){ PIKA_NOT, .data.children = { g_rule_ids[R_NOT_NL], 1 } };
+    g_rule_ids[R_LINE_CHAR] = ids(2, R_NOT_NL, R_ANY_CHAR);
+    g_rules[R_LINE_CHAR] = (PikaRule){ PIKA_SEQ, .data.children = { g_rule_ids[R_LINE_CHAR], 2 } };
+    g_rule_ids[R_LINE_REST] = ids(1, R_LINE_CHAR);
+    g_rules[R_LINE_REST] = (PikaRule){ PIKA_REP, .data.children = { g_rule_ids[R_LINE_REST], 1 } };
+
     /* Comments: ; to end of line */
-    g_rule_ids[R_COMMENT] = ids(2, R_SEMICOLON, R_CHAR_NL);
+    g_rule_ids[R_COMMENT] = ids(2, R_SEMICOLON, R_LINE_REST);
     g_rules[R_COMMENT] = (PikaRule){ PIKA_SEQ, .data.children = { g_rule_ids[R_COMMENT], 2 } };
 
-    /* Whitespace sequence */
-    g_rule_ids[R_WS] = ids(1, R_SPACE);
+    /* Whitespace sequence (comments count as whitespace) */
+    g_rule_ids[R_WS_ITEM] = ids(2, R_SPACE, R_COMMENT);
+    g_rules[R_WS_ITEM] = (PikaRule){ PIKA_ALT, .data.children = { g_rule_ids[R_WS_ITEM], 2 } };
+    g_rule_ids[R_WS] = ids(1, R_WS_ITEM);
     g_rules[R_WS] = (PikaRule){ PIKA_REP, .data.children = { g_rule_ids[R_WS], 1 } };
 
+    /* Shebang line: #! to end of line, only meaningful at the start of a program */
+    g_rules[R_SHEBANG_START] = (PikaRule){ PIKA_TERMINAL, .data.str = "#!" };
+    g_rule_ids[R_SHEBANG] = ids(2, R_SHEBANG_START, R_LINE_REST);
+    g_rules[R_SHEBANG] = (PikaRule){ PIKA_SEQ, .data.children = { g_rule_ids[R_SHEBANG], 2 } };
+    g_rule_ids[R_SHEBANG_OPT] = ids(1, R_SHEBANG);
+    g_rules[R_SHEBANG_OPT] = (PikaRule){ PIKA_OPT, .data.children = { g_rule_ids[R_SHEBANG_OPT], 1 } };
+
+    /* #lang purple/N, the language level a file asks for */
+    g_rules[R_LANG_START] = (PikaRule){ PIKA_TERMINAL, .data.str = "#lang" };
+    g_rule_ids[R_LANG] = ids(2, R_LANG_START, R_LINE_REST);
+    g_rules[R_LANG] = (PikaRule){ PIKA_SEQ, .data.children = { g_rule_ids[R_LANG], 2 } };
+    g_rule_ids[R_LANG_OPT] = ids(1, R_LANG);
+    g_rules[R_LANG_OPT] = (PikaRule){ PIKA_OPT, .data.children = { g_rule_ids[R_LANG_OPT], 1 } };
+
     /* Digits */
     g_rules[R_DIGIT] = (PikaRule){ PIKA_RANGE, .data.range = { '0', '9' } };
     g_rules[R_DIGIT1] = (PikaRule){ PIKA_RANGE, .data.range = { '1', '9' } };
 
-    /* Integer */
-    g_rule_ids[R_INT] = ids(1, R_DIGIT);
-    g_rules[R_INT] = (PikaRule){ PIKA_POS, .data.children = { g_rule_ids[R_INT], 1 }, .action = act_int };
+    /* Optional sign and digit separator */
+    g_rules[R_MINUS] = (PikaRule){ PIKA_TERMINAL, .data.str = "-" };
+    g_rules[R_PLUS] = (PikaRule){ PIKA_TERMINAL, .data.str = "+" };
+    g_rule_ids[R_INT_SIGN] = ids(2, R_MINUS, R_PLUS);
+    g_rules[R_INT_SIGN] = (PikaRule){ PIKA_ALT, .data.children = { g_rule_ids[R_INT_SIGN], 2 } };
+    g_rule_ids[R_INT_SIGN_OPT] = ids(1, R_INT_SIGN);
+    g_rules[R_INT_SIGN_OPT] = (PikaRule){ PIKA_OPT, .data.children = { g_rule_ids[R_INT_SIGN_OPT], 1 } };
+    g_rules[R_UNDERSCORE] = (PikaRule){ PIKA_TERMINAL, .data.str = "_" };
+
+    /* Decimal: [+-]digit (digit | _)*  so "-" alone stays a symbol */
+    g_rule_ids[R_DEC_CHAR] = ids(2, R_DIGIT, R_UNDERSCORE);
+    g_rules[R_DEC_CHAR] = (PikaRule){ PIKA_ALT, .data.children = { g_rule_ids[R_DEC_CHAR], 2 } };
+    g_rule_ids[R_DEC_REST] = ids(1, R_DEC_CHAR);
+    g_rules[R_DEC_REST] = (PikaRule){ PIKA_REP, .data.children = { g_rule_ids[R_DEC_REST], 1 } };
+    g_rule_ids[R_DEC_INT] = ids(3, R_INT_SIGN_OPT, R_DIGIT, R_DEC_REST);
+    g_rules[R_DEC_INT] = (PikaRule){ PIKA_SEQ, .data.children = { g_rule_ids[R_DEC_INT], 3 } };
+
+    /* Hexadecimal: #x[+-](hex | _)+ */
+    g_rules[R_HEX_LOWER] = (PikaRule){ PIKA_RANGE, .data.range = { 'a', 'f' } };
+    g_rules[R_HEX_UPPER] = (PikaRule){ PIKA_RANGE, .data.range = { 'A', 'F' } };
+    g_rule_ids[R_HEX_CHAR] = ids(4, R_DIGIT, R_HEX_LOWER, R_HEX_UPPER, R_UNDERSCORE);
+    g_rules[R_HEX_CHAR] = (PikaRule){ PIKA_ALT, .data.children = { g_rule_ids[R_HEX_CHAR], 4 } };
+    g_rule_ids[R_HEX_BODY] = ids(1, R_HEX_CHAR);
+    g_rules[R_HEX_BODY] = (PikaRule){ PIKA_POS, .data.children = { g_rule_ids[R_HEX_BODY], 1 } };
+    g_rules[R_HEX_PREFIX] = (PikaRule){ PIKA_TERMINAL, .data.str = "#x" };
+    g_rule_ids[R_HEX_INT] = ids(3, R_HEX_PREFIX, R_INT_SIGN_OPT, R_HEX_BODY);
+    g_rules[R_HEX_INT] = (PikaRule){ PIKA_SEQ, .data.children = { g_rule_ids[R_HEX_INT], 3 } };
+
+    /* Octal: #o[+-](0-7 | _)+ */
+    g_rules[R_OCT_DIGIT] = (PikaRule){ PIKA_RANGE, .data.range = { '0', '7' } };
+    g_rule_ids[R_OCT_CHAR] = ids(2, R_OCT_DIGIT, R_UNDERSCORE);
+    g_rules[R_OCT_CHAR] = (PikaRule){ PIKA_ALT, .data.children = { g_rule_ids[R_OCT_CHAR], 2 } };
+    g_rule_ids[R_OCT_BODY] = ids(1, R_OCT_CHAR);
+    g_rules[R_OCT_BODY] = (PikaRule){ PIKA_POS, .data.children = { g_rule_ids[R_OCT_BODY], 1 } };
+    g_rules[R_OCT_PREFIX] = (PikaRule){ PIKA_TERMINAL, .data.str = "#o" };
+    g_rule_ids[R_OCT_INT] = ids(3, R_OCT_PREFIX, R_INT_SIGN_OPT, R_OCT_BODY);
+    g_rules[R_OCT_INT] = (PikaRule){ PIKA_SEQ, .data.children = { g_rule_ids[R_OCT_INT], 3 } };
+
+    /* Binary: #b[+-](0-1 | _)+ */
+    g_rules[R_BIN_DIGIT] = (PikaRule){ PIKA_RANGE, .data.range = { '0', '1' } };
+    g_rule_ids[R_BIN_CHAR] = ids(2, R_BIN_DIGIT, R_UNDERSCORE);
+    g_rules[R_BIN_CHAR] = (PikaRule){ PIKA_ALT, .data.children = { g_rule_ids[R_BIN_CHAR], 2 } };
+    g_rule_ids[R_BIN_BODY] = ids(1, R_BIN_CHAR);
+    g_rules[R_BIN_BODY] = (PikaRule){ PIKA_POS, .data.children = { g_rule_ids[R_BIN_BODY], 1 } };
+    g_rules[R_BIN_PREFIX] = (PikaRule){ PIKA_TERMINAL, .data.str = "#b" };
+    g_rule_ids[R_BIN_INT] = ids(3, R_BIN_PREFIX, R_INT_SIGN_OPT, R_BIN_BODY);
+    g_rules[R_BIN_INT] = (PikaRule){ PIKA_SEQ, .data.children = { g_rule_ids[R_BIN_INT], 3 } };
 
-    /* Signed integer */
-    g_rules[R_SIGNED_INT] = g_rules[R_INT];
+    /* Integer */
+    g_rule_ids[R_INT] = ids(4, R_HEX_INT, R_OCT_INT, R_BIN_INT, R_DEC_INT);
+    g_rules[R_INT] = (PikaRule){ PIKA_ALT, .data.children = { g_rule_ids[R_INT], 4 }, .action = act_int };
+
+    /* Float: decimal integer with a fraction and/or an exponent
+     * (1.5, -0.25, 1e10, 2.5E-3); a bare "1." stays an int then a symbol */
+    g_rules[R_DOT] = (PikaRule){ PIKA_TERMINAL, .data.str = "." };
+    g_rules[R_EXP_LOWER] = (PikaRule){ PIKA_TERMINAL, .data.str = "e" };
+    g_rules[R_EXP_UPPER] = (PikaRule){ PIKA_TERMINAL, .data.str = "E" };
+    g_rule_ids[R_EXP_MARK] = ids(2, R_EXP_LOWER, R_EXP_UPPER);
+    g_rules[R_EXP_MARK] = (PikaRule){ PIKA_ALT, .data.children = { g_rule_ids[R_EXP_MARK], 2 } };
+    g_rule_ids[R_EXP_DIGITS] = ids(1, R_DIGIT);
+    g_rules[R_EXP_DIGITS] = (PikaRule){ PIKA_POS, .data.children = { g_rule_ids[R_EXP_DIGITS], 1 } };
+    g_rule_ids[R_EXPONENT] = ids(3, R_EXP_MARK, R_INT_SIGN_OPT, R_EXP_DIGITS);
+    g_rules[R_EXPONENT] = (PikaRule){ PIKA_SEQ, .data.children = { g_rule_ids[R_EXPONENT], 3 } };
+    g_rule_ids[R_EXPONENT_OPT] = ids(1, R_EXPONENT);
+    g_rules[R_EXPONENT_OPT] = (PikaRule){ PIKA_OPT, .data.children = { g_rule_ids[R_EXPONENT_OPT], 1 } };
+    g_rule_ids[R_FRACTION] = ids(3, R_DOT, R_DIGIT, R_DEC_REST);
+    g_rules[R_FRACTION] = (PikaRule){ PIKA_SEQ, .data.children = { g_rule_ids[R_FRACTION], 3 } };
+    g_rule_ids[R_FLOAT_DOT] = ids(3, R_DEC_INT, R_FRACTION, R_EXPONENT_OPT);
+    g_rules[R_FLOAT_DOT] = (PikaRule){ PIKA_SEQ, .data.children = { g_rule_ids[R_FLOAT_DOT], 3 } };
+    g_rule_ids[R_FLOAT_EXP] = ids(2, R_DEC_INT, R_EXPONENT);
+    g_rules[R_FLOAT_EXP] = (PikaRule){ PIKA_SEQ, .data.children = { g_rule_ids[R_FLOAT_EXP], 2 } };
+    g_rule_ids[R_FLOAT] = ids(2, R_FLOAT_DOT, R_FLOAT_EXP);
+    g_rules[R_FLOAT] = (PikaRule){ PIKA_ALT, .data.children = { g_rule_ids[R_FLOAT], 2 }, .action = act_float };
 
     /* Alphabetic */
     g_rules[R_ALPHA] = (PikaRule){ PIKA_RANGE, .data.range = { 'a', 'z' } };
@@ -250,7 +546,7 @@ void omni_grammar_init(void) {
     /* Symbol characters: alpha, alpha-upper, digit, and common operators
      * We need to EXCLUDE delimiters: ( ) [ ] { } and whitespace
      * Valid symbol chars (by ASCII range):
-     * - '!' to '\'' (33-39): ! " # $ % & '   (excludes ( ) starting at 40)
+     * - '!' (33) and '#' to '\'' (35-39): ! # $ % & '   (" starts a string)
      * - '*' to '/' (42-47): * + , - . /      (excludes ( ) at 40-41)
      * - ':' to '@' (58-64): : ; < = > ? @    (comparison operators)
      * - '_' (95): underscore
@@ -260,23 +556,52 @@ void omni_grammar_init(void) {
     /* We'll define the ranges we need as temporary rules using R_SIGN, R_FLOAT_FRAC, etc. */
     /* R_SIGN (12) - range ':'  to '@' for < > = etc */
     g_rules[R_SIGN] = (PikaRule){ PIKA_RANGE, .data.range = { ':', '@' } };  /* :;<=>?@ */
-    /* R_FLOAT_FRAC (15) - range '!' to '\'' for other symbols */
-    g_rules[R_FLOAT_FRAC] = (PikaRule){ PIKA_RANGE, .data.range = { '!', '\'' } };  /* !"#$%&' */
+    /* R_FLOAT_FRAC (15) - range '#' to '\'' for other symbols */
+    g_rules[R_FLOAT_FRAC] = (PikaRule){ PIKA_RANGE, .data.range = { '#', '\'' } };  /* #$%&' */
+    g_rules[R_SYM_BANG] = (PikaRule){ PIKA_TERMINAL, .data.str = "!" };
     /* R_SYM_SPECIAL - range '*' to '/' */
     g_rules[R_SYM_SPECIAL] = (PikaRule){ PIKA_RANGE, .data.range = { '*', '/' } };  /* *+,-./ */
 
     /* R_SYM_FIRST: first char of symbol (not a digit) */
-    g_rule_ids[R_SYM_FIRST] = ids(5, R_ALPHA, R_ALPHA_UPPER, R_SYM_SPECIAL, R_SIGN, R_FLOAT_FRAC);
-    g_rules[R_SYM_FIRST] = (PikaRule){ PIKA_ALT, .data.children = { g_rule_ids[R_SYM_FIRST], 5 } };
+    g_rule_ids[R_SYM_FIRST] = ids(6, R_ALPHA, R_ALPHA_UPPER, R_SYM_SPECIAL, R_SIGN, R_FLOAT_FRAC, R_SYM_BANG);
+    g_rules[R_SYM_FIRST] = (PikaRule){ PIKA_ALT, .data.children = { g_rule_ids[R_SYM_FIRST], 6 } };
 
     /* Symbol characters: alpha, alpha-upper, digit, and operators */
-    g_rule_ids[R_SYM_CHAR] = ids(6, R_ALPHA, R_ALPHA_UPPER, R_DIGIT, R_SYM_SPECIAL, R_SIGN, R_FLOAT_FRAC);
-    g_rules[R_SYM_CHAR] = (PikaRule){ PIKA_ALT, .data.children = { g_rule_ids[R_SYM_CHAR], 6 } };
+    g_rule_ids[R_SYM_CHAR] = ids(8, R_ALPHA, R_ALPHA_UPPER, R_DIGIT, R_SYM_SPECIAL, R_SIGN, R_FLOAT_FRAC,
+                                 R_SYM_BANG, R_UNDERSCORE);
+    g_rules[R_SYM_CHAR] = (PikaRule){ PIKA_ALT, .data.children = { g_rule_ids[R_SYM_CHAR], 8 } };
 
     /* Symbol: first char then rest */
     g_rule_ids[R_SYM] = ids(1, R_SYM_CHAR);
     g_rules[R_SYM] = (PikaRule){ PIKA_POS, .data.children = { g_rule_ids[R_SYM], 1 }, .action = act_sym };
 
+    /* Character literal: #\ then one character, or a name like space / x41 */
+    g_rules[R_CHAR_ESCAPE] = (PikaRule){ PIKA_TERMINAL, .data.str = "#\\" };
+    g_rule_ids[R_CHAR_NAME_CHAR] = ids(3, R_ALPHA, R_ALPHA_UPPER, R_DIGIT);
+    g_rules[R_CHAR_NAME_CHAR] = (PikaRule){ PIKA_ALT, .data.children = { g_rule_ids[R_CHAR_NAME_CHAR], 3 } };
+    g_rule_ids[R_CHAR_NAME] = ids(1, R_CHAR_NAME_CHAR);
+    g_rules[R_CHAR_NAME] = (PikaRule){ PIKA_REP, .data.children = { g_rule_ids[R_CHAR_NAME], 1 } };
+    g_rule_ids[R_CHAR_LIT] = ids(3, R_CHAR_ESCAPE, R_ANY_CHAR, R_CHAR_NAME);
+    g_rules[R_CHAR_LIT] = (PikaRule){ PIKA_SEQ, .data.children = { g_rule_ids[R_CHAR_LIT], 3 }, .action = act_char };
+
+    /* String literal: "..." where \ escapes the next character */
+    g_rules[R_DQUOTE] = (PikaRule){ PIKA_TERMINAL, .data.str = "\"" };
+    g_rules[R_BACKSLASH] = (PikaRule){ PIKA_TERMINAL, .data.str = "\\" };
+    g_rule_ids[R_STRING_ESC] = ids(2, R_BACKSLASH, R_ANY_CHAR);
+    g_rules[R_STRING_ESC] = (PikaRule){ PIKA_SEQ, .data.children = { g_rule_ids[R_STRING_ESC], 2 } };
+    g_rule_ids[R_STRING_STOP] = ids(2, R_DQUOTE, R_BACKSLASH);
+    g_rules[R_STRING_STOP] = (PikaRule){ PIKA_ALT, .data.children = { g_rule_ids[R_STRING_STOP], 2 } };
+    g_rule_ids[R_STRING_NOT_STOP] = ids(1, R_STRING_STOP);
+    g_rules[R_STRING_NOT_STOP] = (PikaRule){ PIKA_NOT, .data.children = { g_rule_ids[R_STRING_NOT_STOP], 1 } };
+    g_rule_ids[R_STRING_PLAIN] = ids(2, R_STRING_NOT_STOP, R_ANY_CHAR);
+    g_rules[R_STRING_PLAIN] = (PikaRule){ PIKA_SEQ, .data.children = { g_rule_ids[R_STRING_PLAIN], 2 } };
+    g_rule_ids[R_STRING_CHAR] = ids(2, R_STRING_ESC, R_STRING_PLAIN);
+    g_rules[R_STRING_CHAR] = (PikaRule){ PIKA_ALT, .data.children = { g_rule_ids[R_STRING_CHAR], 2 } };
+    g_rule_ids[R_STRING_BODY] = ids(1, R_STRING_CHAR);
+    g_rules[R_STRING_BODY] = (PikaRule){ PIKA_REP, .data.children = { g_rule_ids[R_STRING_BODY], 1 } };
+    g_rule_ids[R_STRING] = ids(3, R_DQUOTE, R_STRING_BODY, R_DQUOTE);
+    g_rules[R_STRING] = (PikaRule){ PIKA_SEQ, .data.children = { g_rule_ids[R_STRING], 3 }, .action = act_string };
+
     /* Brackets */
     g_rules[R_LPAREN] = (PikaRule){ PIKA_TERMINAL, .data.str = "(" };
     g_rules[R_RPAREN] = (PikaRule){ PIKA_TERMINAL, .data.str = ")" };
@@ -288,11 +613,16 @@ void omni_grammar_init(void) {
     /* Quote characters */
     g_rules[R_QUOTE_CHAR] = (PikaRule){ PIKA_TERMINAL, .data.str = "'" };
     g_rules[R_QUASIQUOTE_CHAR] = (PikaRule){ PIKA_TERMINAL, .data.str = "`" };
+    g_rules[R_UNQUOTE_SPLICE_CHARS] = (PikaRule){ PIKA_TERMINAL, .data.str = ",@" };
     g_rules[R_UNQUOTE_CHAR] = (PikaRule){ PIKA_TERMINAL, .data.str = "," };
 
-    /* ATOM = INT / SYM */
-    g_rule_ids[R_ATOM] = ids(2, R_INT, R_SYM);
-    g_rules[R_ATOM] = (PikaRule){ PIKA_ALT, .data.children = { g_rule_ids[R_ATOM], 2 } };
+    /* QUOTE_PREFIX = ' / ` / ,@ / , */
+    g_rule_ids[R_QUOTE_PREFIX] = ids(4, R_QUOTE_CHAR, R_QUASIQUOTE_CHAR, R_UNQUOTE_SPLICE_CHARS, R_UNQUOTE_CHAR);
+    g_rules[R_QUOTE_PREFIX] = (PikaRule){ PIKA_ALT, .data.children = { g_rule_ids[R_QUOTE_PREFIX], 4 } };
+
+    /* ATOM = FLOAT / INT / CHAR / STRING / SYM */
+    g_rule_ids[R_ATOM] = ids(5, R_FLOAT, R_INT, R_CHAR_LIT, R_STRING, R_SYM);
+    g_rules[R_ATOM] = (PikaRule){ PIKA_ALT, .data.children = { g_rule_ids[R_ATOM], 5 } };
 
     /* LIST_SEQ = EXPR WS LIST_INNER */
     g_rule_ids[R_LIST_SEQ] = ids(3, R_EXPR, R_WS, R_LIST_INNER);
@@ -318,8 +648,8 @@ void omni_grammar_init(void) {
     g_rule_ids[R_ARRAY] = ids(4, R_LBRACKET, R_WS, R_ARRAY_INNER, R_RBRACKET);
     g_rules[R_ARRAY] = (PikaRule){ PIKA_SEQ, .data.children = { g_rule_ids[R_ARRAY], 4 }, .action = act_array };
 
-    /* QUOTED = 'EXPR | `EXPR | ,EXPR */
-    g_rule_ids[R_QUOTED] = ids(2, R_QUOTE_CHAR, R_EXPR);
+    /* QUOTED = QUOTE_PREFIX EXPR */
+    g_rule_ids[R_QUOTED] = ids(2, R_QUOTE_PREFIX, R_EXPR);
     g_rules[R_QUOTED] = (PikaRule){ PIKA_SEQ, .data.children = { g_rule_ids[R_QUOTED], 2 }, .action = act_quoted };
 
     /* EXPR = LIST / ARRAY / QUOTED / ATOM */
@@ -334,65 +664,173 @@ void omni_grammar_init(void) {
     g_rule_ids[R_PROGRAM_INNER] = ids(2, R_PROGRAM_SEQ, R_EPSILON);
     g_rules[R_PROGRAM_INNER] = (PikaRule){ PIKA_ALT, .data.children = { g_rule_ids[R_PROGRAM_INNER], 2 }, .action = act_program_inner };
 
-    /* PROGRAM = WS PROGRAM_INNER */
-    g_rule_ids[R_PROGRAM] = ids(2, R_WS, R_PROGRAM_INNER);
-    g_rules[R_PROGRAM] = (PikaRule){ PIKA_SEQ, .data.children = { g_rule_ids[R_PROGRAM], 2 }, .action = act_program };
-
-    g_grammar_initialized = true;
+    /* PROGRAM = SHEBANG? WS LANG? WS PROGRAM_INNER */
+    g_rule_ids[R_PROGRAM] = ids(5, R_SHEBANG_OPT, R_WS, R_LANG_OPT, R_WS, R_PROGRAM_INNER);
+    g_rules[R_PROGRAM] = (PikaRule){ PIKA_SEQ, .data.children = { g_rule_ids[R_PROGRAM], 5 }, .action = act_program };
 }
 
-void omni_grammar_cleanup(void) {
-    if (!g_grammar_initialized) return;
-
-    /* Free rule ID arrays */
-    for (int i = 0; i < NUM_RULES; i++) {
-        if (g_rule_ids[i]) {
-            free(g_rule_ids[i]);
-            g_rule_ids[i] = NULL;
-        }
-    }
-
-    g_grammar_initialized = false;
+void omni_grammar_init(void) {
+    pthread_once(&g_grammar_once, build_grammar);
 }
 
 /* ============== Parser API ============== */
 
-OmniParser* omni_parser_new(const char* input) {
-    return omni_parser_new_n(input, strlen(input));
+OmniParser* omni_parser_new(OmniSession* session, const char* input) {
+    return omni_parser_new_n(session, input, strlen(input));
 }
 
-OmniParser* omni_parser_new_n(const char* input, size_t len) {
+OmniParser* omni_parser_new_n(OmniSession* session, const char* input, size_t len) {
     OmniParser* p = malloc(sizeof(OmniParser));
     if (!p) return NULL;
+    p->session = session;
     p->input = input;
     p->input_len = len;
     p->pos = 0;
     p->errors = NULL;
     p->error_count = 0;
+    p->lang = NULL;
+    p->lang_line = 0;
+    p->lang_column = 0;
     return p;
 }
 
 void omni_parser_free(OmniParser* parser) {
     if (!parser) return;
+    omni_parse_error_free(parser->errors);
+    free(parser->lang);
+    free(parser);
+}
 
-    /* Free error chain */
-    OmniParseError* err = parser->errors;
+void omni_parse_error_free(OmniParseError* err) {
     while (err) {
         OmniParseError* next = err->next;
+        free(err->message);
         free(err);
         err = next;
     }
+}
 
-    free(parser);
+/* Record a parse error at a byte offset, computing line/column */
+/* The 1-based line and column of offset in the input */
+static void parser_locate(OmniParser* parser, size_t offset, int* line, int* column) {
+    *line = 1;
+    *column = 1;
+    for (size_t i = 0; i < offset && i < parser->input_len; i++) {
+        if (parser->input[i] == '\n') {
+            (*line)++;
+            *column = 1;
+        } else {
+            (*column)++;
+        }
+    }
 }
 
-OmniValue* omni_parse_string(const char* source) {
+static void parser_add_error(OmniParser* parser, size_t offset, const char* fmt, ...) {
+    OmniParseError* err = malloc(sizeof(OmniParseError));
+    if (!err) return;
+
+    int line, column;
+    parser_locate(parser, offset, &line, &column);
+
+    char buf[256];
+    va_list args;
+    va_start(args, fmt);
+    vsnprintf(buf, sizeof(buf), fmt, args);
+    va_end(args);
+
+    err->start = (int)offset;
+    err->end = (int)offset + 1;
+    err->line = line;
+    err->column = column;
+    err->message = strdup(buf);
+    err->next = NULL;
+
+    /* Append to keep errors in source order */
+    OmniParseError** tail = &parser->errors;
+    while (*tail) tail = &(*tail)->next;
+    *tail = err;
+    parser->error_count++;
+}
+
+/* Report the _ separators in the number read at offset that are not
+ * between two digits, and an integer too large for 64 bits */
+static void check_number(OmniParser* parser, size_t offset, bool integer) {
+    const char* text = parser->input + offset;
+    size_t avail = parser->input_len - offset;
+    int base = integer ? int_base(text) : 10;
+    size_t start = base != 10 ? 2 : 0;
+    size_t len = start;
+    if (len < avail && (text[len] == '-' || text[len] == '+')) len++;
+    for (; len < avail; len++) {
+        char c = text[len];
+        bool digit = base == 16 ? isxdigit((unsigned char)c) : c >= '0' && c < '0' + (base < 10 ? base : 10);
+        if (digit || c == '_') continue;
+        /* A float's fraction and exponent */
+        if (!integer && (c == '.' || c == 'e' || c == 'E' ||
+                         ((c == '-' || c == '+') && (text[len - 1] == 'e' || text[len - 1] == 'E')))) {
+            continue;
+        }
+        break;
+    }
+
+    for (size_t i = start; i < len; i++) {
+        if (text[i] != '_') continue;
+        bool after_digit = i > start && text[i - 1] != '_' && isxdigit((unsigned char)text[i - 1]);
+        bool before_digit = i + 1 < len && text[i + 1] != '_' && isxdigit((unsigned char)text[i + 1]);
+        if (!integer) {
+            after_digit = after_digit && isdigit((unsigned char)text[i - 1]);
+            before_digit = before_digit && isdigit((unsigned char)text[i + 1]);
+        }
+        if (!after_digit || !before_digit) {
+            parser_add_error(parser, offset + i, "'_' in a number must be between two digits");
+            return;
+        }
+    }
+    bool in_range = true;
+    if (integer) int_value(text, len, &in_range);
+    if (!in_range) parser_add_error(parser, offset, "integer literal out of range");
+}
+
+/* Report the escapes no string literal in v may use, at their backslash,
+ * and the numbers with misplaced separators or too large to hold.
+ * Checked on the finished tree, as actions also run for text that ends
+ * up inside comments or other tokens. */
+static void check_literals(OmniParser* parser, const LineTable* lines, OmniValue* v) {
+    if (!v || v == omni_nil) return;
+    if (omni_is_cell(v)) {
+        check_literals(parser, lines, omni_car(v));
+        check_literals(parser, lines, omni_cdr(v));
+    } else if (v->tag == OMNI_ARRAY) {
+        for (size_t i = 0; i < v->array.len; i++) check_literals(parser, lines, v->array.data[i]);
+    } else if (v->tag == OMNI_DICT) {
+        for (size_t i = 0; i < v->dict.len; i++) {
+            check_literals(parser, lines, v->dict.keys[i]);
+            check_literals(parser, lines, v->dict.values[i]);
+        }
+    } else if ((v->tag == OMNI_INT || v->tag == OMNI_FLOAT) && v->line > 0 &&
+               (size_t)v->line <= lines->count) {
+        check_number(parser, lines->starts[v->line - 1] + (size_t)v->column - 1, v->tag == OMNI_INT);
+    } else if (v->tag == OMNI_STRING && v->line > 0 && (size_t)v->line <= lines->count) {
+        size_t i = lines->starts[v->line - 1] + (size_t)v->column;
+        for (; i < parser->input_len && parser->input[i] != '"'; i++) {
+            if (parser->input[i] != '\\' || i + 1 >= parser->input_len) continue;
+            char c = parser->input[++i];
+            if (!strchr("ntr\"\\", c)) parser_add_error(parser, i - 1, "unknown escape '\\%c' in string", c);
+        }
+    }
+}
+
+OmniValue* omni_parse_string(OmniSession* session, const char* source) {
     omni_grammar_init();
 
-    PikaState* state = pika_new(source, g_rules, NUM_RULES);
-    if (!state) return omni_new_error("Failed to create parser state");
+    PikaState* state = pika_new(source, g_rules, NUM_RULES, session->arena);
+    if (!state) return omni_new_error(session->arena, "Failed to create parser state");
 
+    LineTable lines;
+    lines_begin(&lines, state->input, state->input_len);
+    state->user = &lines;
     OmniValue* result = pika_run(state, R_EXPR);
+    lines_end(&lines);
 
 #ifdef DEBUG
     fprintf(stderr, "[DEBUG] parse_string input='%s'\n", source);
@@ -426,13 +864,53 @@ OmniValue* omni_parse_string(const char* source) {
 OmniValue** omni_parser_parse_all(OmniParser* parser, size_t* count) {
     omni_grammar_init();
 
-    PikaState* state = pika_new(parser->input, g_rules, NUM_RULES);
+    PikaState* state = pika_new(parser->input, g_rules, NUM_RULES, parser->session->arena);
     if (!state) {
         *count = 0;
         return NULL;
     }
 
+    LineTable lines;
+    lines_begin(&lines, state->input, state->input_len);
+    state->user = &lines;
     OmniValue* program = pika_run(state, R_PROGRAM);
+    if (!omni_is_error(program)) check_literals(parser, &lines, program);
+    lines_end(&lines);
+
+    /* Anything the program rule did not consume is a syntax error */
+    PikaMatch* root = pika_get_match(state, 0, R_PROGRAM);
+    size_t consumed = (root && root->matched) ? root->len : 0;
+    if (consumed < state->input_len) {
+        char c = state->input[consumed];
+        if (c == '(' || c == '[') {
+            parser_add_error(parser, consumed, "unbalanced '%c' (missing closing delimiter?)", c);
+        } else if (c == ')' || c == ']') {
+            parser_add_error(parser, consumed, "unexpected '%c'", c);
+        } else if (c == '"') {
+            parser_add_error(parser, consumed, "unterminated string");
+        } else {
+            parser_add_error(parser, consumed, "unexpected input '%c'", c);
+        }
+    }
+
+    /* The #lang line, if the program starts with one */
+    size_t lang_at = 0;
+    PikaMatch* shebang_m = pika_get_match(state, 0, R_SHEBANG_OPT);
+    if (shebang_m && shebang_m->matched) lang_at += shebang_m->len;
+    PikaMatch* ws_m = pika_get_match(state, lang_at, R_WS);
+    if (ws_m && ws_m->matched) lang_at += ws_m->len;
+    PikaMatch* lang_m = pika_get_match(state, lang_at, R_LANG_OPT);
+    if (lang_m && lang_m->matched && lang_m->len > 0) {
+        const char* text = state->input + lang_at + strlen("#lang");
+        size_t len = lang_m->len - strlen("#lang");
+        while (len > 0 && (*text == ' ' || *text == '\t')) text++, len--;
+        while (len > 0 && (text[len - 1] == ' ' || text[len - 1] == '\t' || text[len - 1] == '\r')) len--;
+        free(parser->lang);
+        parser->lang = malloc(len + 1);
+        memcpy(parser->lang, text, len);
+        parser->lang[len] = '\0';
+        parser_locate(parser, lang_at, &parser->lang_line, &parser->lang_column);
+    }
 
 #ifdef DEBUG
     fprintf(stderr, "[DEBUG] parse_all input='%.50s'\n", parser->input);
@@ -32,6 +32,7 @@ struct OmniParseError {
 
 /* Parser state */
 struct OmniParser {
+    OmniSession* session;     /* Nodes are allocated in its arena */
     const char* input;
     size_t input_len;
     int pos;
@@ -39,13 +40,20 @@ struct OmniParser {
     /* Error tracking */
     OmniParseError* errors;
     int error_count;
+
+    /* What a "#lang purple/2" line at the top (after any #! line) names,
+     * and where; NULL without one */
+    char* lang;
+    int lang_line;
+    int lang_column;
 };
 
 /* ============== Parser API ============== */
 
-/* Create a new parser for the given input */
-OmniParser* omni_parser_new(const char* input);
-OmniParser* omni_parser_new_n(const char* input, size_t len);
+/* Create a new parser for the given input, for a session that outlives
+ * the nodes it reads */
+OmniParser* omni_parser_new(OmniSession* session, const char* input);
+OmniParser* omni_parser_new_n(OmniSession* session, const char* input, size_t len);
 
 /* Free parser resources */
 void omni_parser_free(OmniParser* parser);
@@ -63,19 +71,17 @@ void omni_parse_error_free(OmniParseError* err);
 /* ============== Convenience Functions ============== */
 
 /* Parse a single expression from a string */
-OmniValue* omni_parse_string(const char* input);
+OmniValue* omni_parse_string(OmniSession* session, const char* input);
 
 /* Parse all expressions from a string */
-OmniValue** omni_parse_all_string(const char* input, size_t* out_count);
+OmniValue** omni_parse_all_string(OmniSession* session, const char* input, size_t* out_count);
 
 /* ============== Grammar Initialization ============== */
 
-/* Initialize the OmniLisp grammar (call once at startup) */
+/* Build the OmniLisp grammar if it has not been built; safe to call from
+ * any thread, and the parse functions call it themselves */
 void omni_grammar_init(void);
 
-/* Cleanup grammar resources */
-void omni_grammar_cleanup(void);
-
 #ifdef __cplusplus
 }
 #endif
@@ -68,12 +68,15 @@ typedef struct PikaState {
 
     /* Memoization table: [input_len + 1][num_rules] */
     PikaMatch* table;
+
+    OmniArena* arena;       /* Where nodes are built */
+    void* user;             /* For the semantic actions, NULL until set */
 } PikaState;
 
 /* ============== Public API ============== */
 
-/* Create a new parser state */
-PikaState* pika_new(const char* input, PikaRule* rules, int num_rules);
+/* Create a new parser state building its nodes in arena */
+PikaState* pika_new(const char* input, PikaRule* rules, int num_rules, OmniArena* arena);
 
 /* Free parser state */
 void pika_free(PikaState* state);
@@ -9,7 +9,7 @@
 #include <stdlib.h>
 #include <string.h>
 
-PikaState* pika_new(const char* input, PikaRule* rules, int num_rules) {
+PikaState* pika_new(const char* input, PikaRule* rules, int num_rules, OmniArena* arena) {
     PikaState* state = malloc(sizeof(PikaState));
     if (!state) return NULL;
 
@@ -17,6 +17,8 @@ PikaState* pika_new(const char* input, PikaRule* rules, int num_rules) {
     state->input_len = strlen(input);
     state->num_rules = num_rules;
     state->rules = rules;
+    state->arena = arena;
+    state->user = NULL;
 
     size_t table_size = (state->input_len + 1) * num_rules;
     state->table = calloc(table_size, sizeof(PikaMatch));
@@ -216,10 +218,10 @@ OmniValue* pika_run(PikaState* state, int root_rule_id) {
         char* s = malloc(root->len + 1);
         memcpy(s, state->input, root->len);
         s[root->len] = '\0';
-        OmniValue* v = omni_new_sym(s);
+        OmniValue* v = omni_new_sym(state->arena, s);
         free(s);
         return v;
     }
 
-    return omni_new_error("Parse failed");
+    return omni_new_error(state->arena, "Parse failed");
 }
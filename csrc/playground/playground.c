@@ -0,0 +1,129 @@
+/*
+ * OmniLisp Playground Implementation
+ */
+
+#include "playground.h"
+#include "../compiler/compiler.h"
+#include "../fs/fs.h"
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+
+struct OmniPlayground {
+    OmniFS* fs;               /* Imported files, with nothing under them */
+    char* result;             /* The last call's JSON */
+    size_t len;
+    size_t cap;
+};
+
+/* ============== JSON ============== */
+
+static void put(OmniPlayground* p, const char* s, size_t n) {
+    if (p->len + n + 1 > p->cap) {
+        while (p->len + n + 1 > p->cap) {
+            p->cap = p->cap ? p->cap * 2 : 256;
+        }
+        p->result = realloc(p->result, p->cap);
+    }
+    memcpy(p->result + p->len, s, n);
+    p->len += n;
+    p->result[p->len] = '\0';
+}
+
+static void puts_raw(OmniPlayground* p, const char* s) {
+    put(p, s, strlen(s));
+}
+
+/* Append s as a quoted JSON string */
+static void put_string(OmniPlayground* p, const char* s) {
+    put(p, "\"", 1);
+    for (; *s; s++) {
+        unsigned char c = (unsigned char)*s;
+        switch (c) {
+        case '"':  puts_raw(p, "\\\""); break;
+        case '\\': puts_raw(p, "\\\\"); break;
+        case '\n': puts_raw(p, "\\n"); break;
+        case '\r': puts_raw(p, "\\r"); break;
+        case '\t': puts_raw(p, "\\t"); break;
+        default:
+            if (c < 0x20) {
+                char esc[8];
+                snprintf(esc, sizeof(esc), "\\u%04x", c);
+                puts_raw(p, esc);
+            } else {
+                put(p, s, 1);
+            }
+        }
+    }
+    put(p, "\"", 1);
+}
+
+/* ============== Playground ============== */
+
+OmniPlayground* omni_playground_new(void) {
+    OmniPlayground* p = calloc(1, sizeof(OmniPlayground));
+    if (!p) return NULL;
+    p->fs = omni_fs_memory_new(NULL);
+    return p;
+}
+
+void omni_playground_free(OmniPlayground* p) {
+    if (!p) return;
+    omni_fs_memory_free(p->fs);
+    free(p->result);
+    free(p);
+}
+
+void omni_playground_put_file(OmniPlayground* p, const char* path, const char* text) {
+    if (p && path && text) omni_fs_memory_put(p->fs, path, text);
+}
+
+bool omni_playground_remove_file(OmniPlayground* p, const char* path) {
+    return p && path && omni_fs_memory_remove(p->fs, path);
+}
+
+/* Compile source as main.omni and describe the outcome in p->result */
+static const char* run(OmniPlayground* p, const char* source, bool check_only) {
+    /* Held with the other files, so the loader finds it as it finds them */
+    OmniSource unit = { OMNI_PLAYGROUND_MAIN, source ? source : "" };
+    omni_fs_memory_put(p->fs, unit.name, unit.text);
+    CompilerOptions opts = { .use_embedded_runtime = true, .fs = p->fs };
+    Compiler* compiler = omni_compiler_new_with_options(&opts);
+    char* code = NULL;
+    if (check_only) {
+        omni_compiler_check_units(compiler, &unit, 1);
+    } else {
+        code = omni_compiler_compile_units_to_c(compiler, &unit, 1);
+    }
+
+    p->len = 0;
+    puts_raw(p, omni_compiler_has_errors(compiler) ? "{\"ok\":false" : "{\"ok\":true");
+    if (!check_only) {
+        puts_raw(p, ",\"c\":");
+        if (code) put_string(p, code);
+        else puts_raw(p, "null");
+    }
+    puts_raw(p, ",\"errors\":[");
+    for (size_t i = 0; i < omni_compiler_error_count(compiler); i++) {
+        if (i > 0) puts_raw(p, ",");
+        put_string(p, omni_compiler_get_error(compiler, i));
+    }
+    puts_raw(p, "],\"warnings\":[");
+    for (size_t i = 0; i < omni_compiler_warning_count(compiler); i++) {
+        if (i > 0) puts_raw(p, ",");
+        put_string(p, omni_compiler_get_warning(compiler, i));
+    }
+    puts_raw(p, "]}");
+
+    free(code);
+    omni_compiler_free(compiler);
+    return p->result;
+}
+
+const char* omni_playground_check(OmniPlayground* p, const char* source) {
+    return p ? run(p, source, true) : NULL;
+}
+
+const char* omni_playground_compile(OmniPlayground* p, const char* source) {
+    return p ? run(p, source, false) : NULL;
+}
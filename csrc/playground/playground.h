@@ -0,0 +1,54 @@
+/*
+ * OmniLisp Playground
+ *
+ * The compiler front end as a browser playground uses it: source in,
+ * generated C and diagnostics out, as JSON. Nothing here runs a C
+ * compiler or touches the operating system; the files a program imports
+ * are held in memory. `make wasm` builds this with the front end and
+ * OMNI_NO_EXEC into playground/omnilisp.{js,wasm}, and playground.js
+ * wraps it for JavaScript.
+ */
+
+#ifndef OMNILISP_PLAYGROUND_H
+#define OMNILISP_PLAYGROUND_H
+
+#include <stdbool.h>
+
+#ifdef __cplusplus
+extern "C" {
+#endif
+
+typedef struct OmniPlayground OmniPlayground;
+
+/* The name source is compiled under, in diagnostics and for imports */
+#define OMNI_PLAYGROUND_MAIN "main.omni"
+
+OmniPlayground* omni_playground_new(void);
+void omni_playground_free(OmniPlayground* p);
+
+/* Add or replace the file a program imports as path (relative to
+ * main.omni), or drop it; false if there was none */
+void omni_playground_put_file(OmniPlayground* p, const char* path, const char* text);
+bool omni_playground_remove_file(OmniPlayground* p, const char* path);
+
+/*
+ * Parse, expand and analyze source for its diagnostics only, as -check
+ * does:
+ *
+ *     {"ok":false,"errors":["main.omni:1:4: E0001 unbound symbol: y ..."],"warnings":[]}
+ *
+ * The result belongs to p and lasts until its next call.
+ */
+const char* omni_playground_check(OmniPlayground* p, const char* source);
+
+/* The same with the generated C (embedded runtime), null on errors:
+ *
+ *     {"ok":true,"c":"...","errors":[],"warnings":[]}
+ */
+const char* omni_playground_compile(OmniPlayground* p, const char* source);
+
+#ifdef __cplusplus
+}
+#endif
+
+#endif /* OMNILISP_PLAYGROUND_H */
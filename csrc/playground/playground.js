@@ -0,0 +1,34 @@
+// OmniLisp Playground
+//
+// The compiler front end in the browser. `make wasm` builds
+// omnilisp.js and omnilisp.wasm next to this file; then
+//
+//     import { loadPlayground } from "./playground.js";
+//
+//     const playground = await loadPlayground();
+//     playground.putFile("lib/util.omni", "(define (sq n) (* n n))\n(provide sq)");
+//     const { ok, c, errors, warnings } = playground.compile(source);
+//
+// check(source) gives the diagnostics alone, without generating C, and is
+// cheap enough to run on every edit.
+
+import createOmnilisp from "./omnilisp.js";
+
+export async function loadPlayground(options = {}) {
+    const module = await createOmnilisp(options);
+    const handle = module._omni_playground_new();
+    const call = (name, source) =>
+        JSON.parse(module.ccall(name, "string", ["number", "string"], [handle, source]));
+
+    return {
+        check: (source) => call("omni_playground_check", source),
+        compile: (source) => call("omni_playground_compile", source),
+        putFile: (path, text) =>
+            module.ccall("omni_playground_put_file", null, ["number", "string", "string"],
+                         [handle, path, text]),
+        removeFile: (path) =>
+            module.ccall("omni_playground_remove_file", "boolean", ["number", "string"],
+                         [handle, path]),
+        free: () => module._omni_playground_free(handle),
+    };
+}
@@ -0,0 +1,476 @@
+/*
+ * OmniLisp Query
+ *
+ * Copies what the analysis found into tables of its own: types and
+ * functions are few and looked up by name; sites are kept in the order
+ * the forms were walked and searched by position.
+ */
+
+#include "query.h"
+#include <stdlib.h>
+#include <string.h>
+
+struct OmniQuery {
+    OmniTypeInfo* types;
+    size_t type_count;
+
+    OmniFunctionInfo* functions;
+    size_t function_count;
+
+    OmniCallInfo* calls;
+    size_t call_count;
+
+    /* Indices of the program's functions in functions, in definition order */
+    size_t* defined;
+    size_t defined_count;
+
+    OmniSiteInfo* sites;
+    size_t site_count;
+    size_t site_capacity;
+};
+
+static char* dup_or_null(const char* s) {
+    return s ? strdup(s) : NULL;
+}
+
+static bool same_unit(const char* a, const char* b) {
+    if (!a || !b) return a == b;
+    return strcmp(a, b) == 0;
+}
+
+static bool is_quote(OmniValue* expr) {
+    return omni_is_cell(expr) && omni_is_sym(omni_car(expr)) &&
+           strcmp(omni_car(expr)->str_val, "quote") == 0;
+}
+
+/* ============== Types ============== */
+
+static bool is_deftype(OmniValue* expr) {
+    return omni_is_cell(expr) && omni_is_sym(omni_car(expr)) &&
+           strcmp(omni_car(expr)->str_val, "deftype") == 0 &&
+           omni_is_cell(omni_cdr(expr)) && omni_is_sym(omni_car(omni_cdr(expr)));
+}
+
+/* The type name with the field specs fields, each a name or
+ * (name type [:weak]); sum names the sum type a variant belongs to */
+static OmniTypeInfo* add_type_info(OmniQuery* q, AnalysisContext* analysis, const char* name,
+                                   OmniValue* fields, const char* sum) {
+    /* The first deftype of a name is the one its descriptor describes */
+    if (omni_query_lookup_type(q, name)) return NULL;
+
+    q->types = realloc(q->types, (q->type_count + 1) * sizeof(OmniTypeInfo));
+    OmniTypeInfo* t = &q->types[q->type_count++];
+    t->name = strdup(name);
+    t->shape = omni_get_type_shape(analysis, name);
+    t->fields = NULL;
+    t->field_count = 0;
+    t->sum = dup_or_null(sum);
+    t->variants = NULL;
+    t->variant_count = 0;
+
+    for (OmniValue* f = fields; omni_is_cell(f); f = omni_cdr(f)) {
+        OmniValue* spec = omni_car(f);
+        OmniValue* field = omni_is_cell(spec) ? omni_car(spec) : spec;
+        if (!omni_is_sym(field)) continue;
+
+        OmniValue* type = NULL;
+        if (omni_is_cell(spec) && omni_is_cell(omni_cdr(spec)) &&
+            !omni_is_keyword(omni_car(omni_cdr(spec)))) {
+            type = omni_car(omni_cdr(spec));
+        }
+
+        t->fields = realloc(t->fields, (t->field_count + 1) * sizeof(OmniFieldInfo));
+        OmniFieldInfo* fi = &t->fields[t->field_count++];
+        fi->name = strdup(field->str_val);
+        fi->type = type ? omni_value_to_string(type) : NULL;
+        fi->strength = omni_is_back_edge_field(analysis, name, field->str_val)
+                           ? OMNI_FIELD_WEAK : OMNI_FIELD_STRONG;
+    }
+    return t;
+}
+
+/* A deftype; a sum type is itself, with no fields, then each variant */
+static void add_type(OmniQuery* q, AnalysisContext* analysis, OmniValue* def) {
+    const char* name = omni_car(omni_cdr(def))->str_val;
+    OmniValue* specs = omni_cdr(omni_cdr(def));
+    if (!omni_is_variant_spec(omni_car(specs))) {
+        add_type_info(q, analysis, name, specs, NULL);
+        return;
+    }
+    if (!add_type_info(q, analysis, name, omni_nil, NULL)) return;
+    size_t sum = q->type_count - 1;
+    for (; omni_is_cell(specs); specs = omni_cdr(specs)) {
+        if (!omni_is_variant_spec(omni_car(specs))) continue;
+        const char* variant = omni_car(omni_car(specs))->str_val;
+        add_type_info(q, analysis, variant, omni_cdr(omni_car(specs)), name);
+        /* q->types moves as it grows */
+        OmniTypeInfo* t = &q->types[sum];
+        t->variants = realloc(t->variants, (t->variant_count + 1) * sizeof(char*));
+        t->variants[t->variant_count++] = strdup(variant);
+    }
+}
+
+/* ============== Functions ============== */
+
+static void add_functions(OmniQuery* q, AnalysisContext* analysis) {
+    for (FunctionSummary* s = analysis->function_summaries; s; s = s->next) {
+        q->function_count++;
+    }
+    q->functions = calloc(q->function_count ? q->function_count : 1, sizeof(OmniFunctionInfo));
+
+    /* Kept in the analysis's order, so a name finds the same summary
+     * omni_get_function_summary does */
+    size_t i = 0;
+    for (FunctionSummary* s = analysis->function_summaries; s; s = s->next, i++) {
+        OmniFunctionInfo* f = &q->functions[i];
+        f->name = strdup(s->name);
+        f->effects = s->effects;
+        f->has_side_effects = s->has_side_effects;
+        f->allocates = s->allocates;
+        f->effect_param = s->effect_param;
+        f->returns = s->return_ownership;
+
+        for (ParamSummary* p = s->params; p; p = p->next) f->param_count++;
+        f->params = calloc(f->param_count ? f->param_count : 1, sizeof(char*));
+        f->param_ownership = calloc(f->param_count ? f->param_count : 1, sizeof(ParamOwnership));
+        /* The summary lists them last first */
+        size_t j = f->param_count;
+        for (ParamSummary* p = s->params; p; p = p->next) {
+            j--;
+            f->params[j] = dup_or_null(p->name);
+            f->param_ownership[j] = p->ownership;
+        }
+    }
+}
+
+/* The function (define (f ...) body...) defines, unless a deftype made
+ * it: those bodies are one (user%op T ...) form */
+static const char* program_function(OmniValue* expr) {
+    if (!omni_is_cell(expr) || !omni_sym_eq_str(omni_car(expr), "define") ||
+        !omni_is_cell(omni_cdr(expr)) || !omni_is_cell(omni_car(omni_cdr(expr)))) {
+        return NULL;
+    }
+    OmniValue* name = omni_car(omni_car(omni_cdr(expr)));
+    OmniValue* body = omni_cdr(omni_cdr(expr));
+    if (!omni_is_sym(name)) return NULL;
+    if (omni_is_cell(body) && omni_is_nil(omni_cdr(body)) && omni_is_cell(omni_car(body)) &&
+        omni_is_sym(omni_car(omni_car(body))) &&
+        strncmp(omni_car(omni_car(body))->str_val, "user%", 5) == 0) {
+        return NULL;
+    }
+    return name->str_val;
+}
+
+static OmniFunctionInfo* find_function(const OmniQuery* q, const char* name) {
+    return (OmniFunctionInfo*)omni_query_function_effects(q, name);
+}
+
+static void add_call(OmniQuery* q, const char* caller, const OmniFunctionInfo* callee,
+                     OmniValue* args) {
+    for (size_t i = 0; i < q->call_count; i++) {
+        if (strcmp(q->calls[i].caller, caller) == 0 && strcmp(q->calls[i].callee, callee->name) == 0) {
+            return;
+        }
+    }
+    q->calls = realloc(q->calls, (q->call_count + 1) * sizeof(OmniCallInfo));
+    OmniCallInfo* c = &q->calls[q->call_count++];
+    c->caller = strdup(caller);
+    c->callee = strdup(callee->name);
+    c->arg_count = 0;
+    for (OmniValue* a = args; omni_is_cell(a) && c->arg_count < callee->param_count; a = omni_cdr(a)) {
+        c->arg_count++;
+    }
+    c->args = calloc(c->arg_count ? c->arg_count : 1, sizeof(ParamOwnership));
+    for (size_t i = 0; i < c->arg_count; i++) c->args[i] = callee->param_ownership[i];
+}
+
+/* The calls to the program's functions anywhere in expr, lambdas in it
+ * included, as calls made by caller */
+static void add_calls(OmniQuery* q, const char* caller, OmniValue* expr) {
+    if (!omni_is_cell(expr) || is_quote(expr)) return;
+    OmniValue* head = omni_car(expr);
+    const OmniFunctionInfo* callee = omni_is_sym(head) ? find_function(q, head->str_val) : NULL;
+    if (callee && callee->in_program) add_call(q, caller, callee, omni_cdr(expr));
+    for (OmniValue* p = expr; omni_is_cell(p); p = omni_cdr(p)) add_calls(q, caller, omni_car(p));
+}
+
+/* Mark the functions exprs define, then find the calls between them */
+static void add_program(OmniQuery* q, OmniValue** exprs, size_t count) {
+    q->defined = calloc(count ? count : 1, sizeof(size_t));
+    for (size_t i = 0; i < count; i++) {
+        const char* name = program_function(exprs[i]);
+        OmniFunctionInfo* f = name ? find_function(q, name) : NULL;
+        if (!f || f->in_program) continue;
+        f->in_program = true;
+        q->defined[q->defined_count++] = (size_t)(f - q->functions);
+    }
+    for (size_t i = 0; i < count; i++) {
+        const char* name = program_function(exprs[i]);
+        if (!name) continue;
+        for (OmniValue* b = omni_cdr(omni_cdr(exprs[i])); omni_is_cell(b); b = omni_cdr(b)) {
+            add_calls(q, name, omni_car(b));
+        }
+    }
+}
+
+/* ============== Sites ============== */
+
+/* Only variables the program binds: not primitives, functions, or the
+ * names macros make up (gensyms have a % in them) */
+static void add_site(OmniQuery* q, AnalysisContext* analysis, const char* unit, OmniValue* sym) {
+    if (sym->line <= 0 || strchr(sym->str_val, '%')) return;
+    VarUsage* u = omni_get_var_usage(analysis, sym->str_val);
+    OwnerInfo* owner = omni_get_owner_info(analysis, sym->str_val);
+    if (!u || (!u->is_param && u->def_pos < 0) || !owner ||
+        omni_get_function_summary(analysis, sym->str_val)) {
+        return;
+    }
+
+    if (q->site_count == q->site_capacity) {
+        q->site_capacity = q->site_capacity ? q->site_capacity * 2 : 64;
+        q->sites = realloc(q->sites, q->site_capacity * sizeof(OmniSiteInfo));
+    }
+    OmniSiteInfo* s = &q->sites[q->site_count++];
+    s->unit = dup_or_null(unit);
+    s->line = sym->line;
+    s->column = sym->column;
+    s->end_column = sym->column + (int)strlen(sym->str_val);
+    s->name = strdup(sym->str_val);
+    s->ownership = owner->ownership;
+    s->shape = owner->shape;
+}
+
+static void add_sites(OmniQuery* q, AnalysisContext* analysis, const char* unit, OmniValue* expr) {
+    if (omni_is_sym(expr)) {
+        add_site(q, analysis, unit, expr);
+    } else if (omni_is_cell(expr) && !is_quote(expr)) {
+        for (OmniValue* p = expr; omni_is_cell(p); p = omni_cdr(p)) {
+            add_sites(q, analysis, unit, omni_car(p));
+        }
+    } else if (omni_is_array(expr)) {
+        for (size_t i = 0; i < expr->array.len; i++) {
+            add_sites(q, analysis, unit, expr->array.data[i]);
+        }
+    }
+}
+
+/* ============== Building ============== */
+
+OmniQuery* omni_query_build(AnalysisContext* analysis, OmniValue** exprs,
+                            const char* const* units, size_t count) {
+    OmniQuery* q = calloc(1, sizeof(OmniQuery));
+    if (!q) return NULL;
+
+    for (size_t i = 0; i < count; i++) {
+        if (is_deftype(exprs[i])) add_type(q, analysis, exprs[i]);
+    }
+    add_functions(q, analysis);
+    add_program(q, exprs, count);
+    for (size_t i = 0; i < count; i++) {
+        if (!is_deftype(exprs[i])) add_sites(q, analysis, units ? units[i] : NULL, exprs[i]);
+    }
+    return q;
+}
+
+void omni_query_free(OmniQuery* q) {
+    if (!q) return;
+    for (size_t i = 0; i < q->type_count; i++) {
+        for (size_t j = 0; j < q->types[i].field_count; j++) {
+            free(q->types[i].fields[j].name);
+            free(q->types[i].fields[j].type);
+        }
+        free(q->types[i].fields);
+        for (size_t j = 0; j < q->types[i].variant_count; j++) free(q->types[i].variants[j]);
+        free(q->types[i].variants);
+        free(q->types[i].sum);
+        free(q->types[i].name);
+    }
+    free(q->types);
+    for (size_t i = 0; i < q->function_count; i++) {
+        for (size_t j = 0; j < q->functions[i].param_count; j++) {
+            free(q->functions[i].params[j]);
+        }
+        free(q->functions[i].params);
+        free(q->functions[i].param_ownership);
+        free(q->functions[i].name);
+    }
+    free(q->functions);
+    for (size_t i = 0; i < q->call_count; i++) {
+        free(q->calls[i].caller);
+        free(q->calls[i].callee);
+        free(q->calls[i].args);
+    }
+    free(q->calls);
+    free(q->defined);
+    for (size_t i = 0; i < q->site_count; i++) {
+        free(q->sites[i].unit);
+        free(q->sites[i].name);
+    }
+    free(q->sites);
+    free(q);
+}
+
+/* ============== Lookups ============== */
+
+const OmniTypeInfo* omni_query_lookup_type(const OmniQuery* q, const char* name) {
+    if (!q || !name) return NULL;
+    for (size_t i = 0; i < q->type_count; i++) {
+        if (strcmp(q->types[i].name, name) == 0) return &q->types[i];
+    }
+    return NULL;
+}
+
+OmniFieldStrength omni_query_field_strength(const OmniQuery* q, const char* type,
+                                            const char* field) {
+    const OmniTypeInfo* t = omni_query_lookup_type(q, type);
+    if (!t || !field) return OMNI_FIELD_UNKNOWN;
+    for (size_t i = 0; i < t->field_count; i++) {
+        if (strcmp(t->fields[i].name, field) == 0) return t->fields[i].strength;
+    }
+    return OMNI_FIELD_UNKNOWN;
+}
+
+const OmniFunctionInfo* omni_query_function_effects(const OmniQuery* q, const char* name) {
+    if (!q || !name) return NULL;
+    for (size_t i = 0; i < q->function_count; i++) {
+        if (strcmp(q->functions[i].name, name) == 0) return &q->functions[i];
+    }
+    return NULL;
+}
+
+size_t omni_query_call_count(const OmniQuery* q) {
+    return q ? q->call_count : 0;
+}
+
+const OmniCallInfo* omni_query_call(const OmniQuery* q, size_t index) {
+    return q && index < q->call_count ? &q->calls[index] : NULL;
+}
+
+const OmniSiteInfo* omni_query_site_at(const OmniQuery* q, const char* unit,
+                                       int line, int column) {
+    if (!q) return NULL;
+    for (size_t i = 0; i < q->site_count; i++) {
+        const OmniSiteInfo* s = &q->sites[i];
+        if (s->line == line && column >= s->column && column < s->end_column &&
+            same_unit(s->unit, unit)) {
+            return s;
+        }
+    }
+    return NULL;
+}
+
+bool omni_query_ownership_at(const OmniQuery* q, const char* unit, int line, int column,
+                             OwnershipKind* out) {
+    const OmniSiteInfo* s = omni_query_site_at(q, unit, line, column);
+    if (s && out) *out = s->ownership;
+    return s != NULL;
+}
+
+bool omni_query_shape_at(const OmniQuery* q, const char* unit, int line, int column,
+                         ShapeClass* out) {
+    const OmniSiteInfo* s = omni_query_site_at(q, unit, line, column);
+    if (s && out) *out = s->shape;
+    return s != NULL;
+}
+
+const char* omni_field_strength_name(OmniFieldStrength strength) {
+    switch (strength) {
+        case OMNI_FIELD_STRONG: return "strong";
+        case OMNI_FIELD_WEAK: return "weak";
+        default: return "unknown";
+    }
+}
+
+/* ============== Call Graph ============== */
+
+bool omni_graph_format_parse(const char* name, OmniGraphFormat* out) {
+    if (strcmp(name, "dot") == 0) *out = OMNI_GRAPH_DOT;
+    else if (strcmp(name, "json") == 0) *out = OMNI_GRAPH_JSON;
+    else return false;
+    return true;
+}
+
+/* Print s as the inside of a DOT or JSON string */
+static void print_escaped(FILE* out, const char* s) {
+    for (; *s; s++) {
+        if (*s == '"' || *s == '\\') fputc('\\', out);
+        fputc(*s, out);
+    }
+}
+
+/* The effects of f, each as a name */
+static size_t effect_names(const OmniFunctionInfo* f, const char* names[5]) {
+    size_t n = 0;
+    if (f->allocates) names[n++] = "allocates";
+    if (f->effects & EFFECT_MUTATE) names[n++] = "mutates";
+    if (f->effects & EFFECT_IO) names[n++] = "io";
+    if (f->effects & EFFECT_CONCURRENT) names[n++] = "concurrent";
+    if (f->effects & EFFECT_THROW) names[n++] = "throws";
+    return n;
+}
+
+static void print_dot(const OmniQuery* q, FILE* out) {
+    fprintf(out, "digraph calls {\n");
+    for (size_t i = 0; i < q->defined_count; i++) {
+        const OmniFunctionInfo* f = &q->functions[q->defined[i]];
+        const char* names[5];
+        size_t n = effect_names(f, names);
+        fprintf(out, "  \"");
+        print_escaped(out, f->name);
+        fprintf(out, "\" [label=\"");
+        print_escaped(out, f->name);
+        for (size_t j = 0; j < n; j++) fprintf(out, "%s%s", j ? ", " : "\\n", names[j]);
+        fprintf(out, "\"];\n");
+    }
+    for (size_t i = 0; i < q->call_count; i++) {
+        const OmniCallInfo* c = &q->calls[i];
+        fprintf(out, "  \"");
+        print_escaped(out, c->caller);
+        fprintf(out, "\" -> \"");
+        print_escaped(out, c->callee);
+        fprintf(out, "\"");
+        if (c->arg_count) {
+            fprintf(out, " [label=\"");
+            for (size_t j = 0; j < c->arg_count; j++) {
+                fprintf(out, "%s%s", j ? ", " : "", omni_param_ownership_name(c->args[j]));
+            }
+            fprintf(out, "\"]");
+        }
+        fprintf(out, ";\n");
+    }
+    fprintf(out, "}\n");
+}
+
+static void print_json(const OmniQuery* q, FILE* out) {
+    fprintf(out, "{\"functions\": [");
+    for (size_t i = 0; i < q->defined_count; i++) {
+        const OmniFunctionInfo* f = &q->functions[q->defined[i]];
+        const char* names[5];
+        size_t n = effect_names(f, names);
+        fprintf(out, "%s{\"name\": \"", i ? ", " : "");
+        print_escaped(out, f->name);
+        fprintf(out, "\", \"effects\": [");
+        for (size_t j = 0; j < n; j++) fprintf(out, "%s\"%s\"", j ? ", " : "", names[j]);
+        fprintf(out, "]}");
+    }
+    fprintf(out, "],\n \"calls\": [");
+    for (size_t i = 0; i < q->call_count; i++) {
+        const OmniCallInfo* c = &q->calls[i];
+        fprintf(out, "%s{\"from\": \"", i ? ", " : "");
+        print_escaped(out, c->caller);
+        fprintf(out, "\", \"to\": \"");
+        print_escaped(out, c->callee);
+        fprintf(out, "\", \"args\": [");
+        for (size_t j = 0; j < c->arg_count; j++) {
+            fprintf(out, "%s\"%s\"", j ? ", " : "", omni_param_ownership_name(c->args[j]));
+        }
+        fprintf(out, "]}");
+    }
+    fprintf(out, "]}\n");
+}
+
+void omni_query_print_call_graph(const OmniQuery* q, FILE* out, OmniGraphFormat format) {
+    if (!q) return;
+    if (format == OMNI_GRAPH_JSON) print_json(q, out);
+    else print_dot(q, out);
+}
@@ -0,0 +1,157 @@
+/*
+ * OmniLisp Query
+ *
+ * Read-only answers to what a compilation found out, for tools such as
+ * an editor's hover, a documentation generator or an explain command:
+ * the types the program defines and how each field holds its value, the
+ * effects of each function and which functions call which, and the
+ * ownership and shape the analysis gave the variable at a place in the
+ * source. The compiler records one after its analysis (see
+ * omni_compiler_query); everything in it is copied, so it outlives the
+ * program's AST.
+ */
+
+#ifndef OMNILISP_QUERY_H
+#define OMNILISP_QUERY_H
+
+#include "../ast/ast.h"
+#include "../analysis/analysis.h"
+#include <stdbool.h>
+#include <stddef.h>
+#include <stdio.h>
+
+#ifdef __cplusplus
+extern "C" {
+#endif
+
+/* How a field of a type holds its value */
+typedef enum {
+    OMNI_FIELD_UNKNOWN = 0,      /* No such type or field */
+    OMNI_FIELD_STRONG,           /* Counted: keeps the value alive */
+    OMNI_FIELD_WEAK,             /* A back-edge: does not */
+} OmniFieldStrength;
+
+typedef struct OmniFieldInfo {
+    char* name;
+    char* type;                  /* The declared type as written, or NULL */
+    OmniFieldStrength strength;
+} OmniFieldInfo;
+
+/* A (deftype Name field...); a sum type (deftype Name (Variant field...)
+ * ...) is one with no fields and the names of its variants, and each
+ * variant one that names the sum */
+typedef struct OmniTypeInfo {
+    char* name;
+    ShapeClass shape;
+    OmniFieldInfo* fields;
+    size_t field_count;
+    char* sum;                   /* The sum type it is a variant of, or NULL */
+    char** variants;             /* A sum type's variants, in order */
+    size_t variant_count;
+} OmniTypeInfo;
+
+/* A function's interprocedural summary, user functions and primitives */
+typedef struct OmniFunctionInfo {
+    char* name;
+    unsigned effects;            /* EffectKind bits */
+    bool has_side_effects;
+    bool allocates;
+    int effect_param;            /* Takes on this parameter's effects (-1: none) */
+    ReturnOwnership returns;
+    size_t param_count;
+    char** params;
+    ParamOwnership* param_ownership;
+    bool in_program;             /* Defined by the program, not a primitive
+                                  * or one of the functions a deftype makes */
+} OmniFunctionInfo;
+
+/* One of the program's functions calling another; each pair appears
+ * once, with the arguments of the first call */
+typedef struct OmniCallInfo {
+    char* caller;
+    char* callee;
+    size_t arg_count;            /* Arguments the callee has a parameter for */
+    ParamOwnership* args;        /* What the callee does with each of them */
+} OmniCallInfo;
+
+/* A variable read or bound at a place in the source */
+typedef struct OmniSiteInfo {
+    char* unit;                  /* Name of the unit it is in (NULL if unnamed) */
+    int line;                    /* 1-based, as the parser read it */
+    int column;
+    int end_column;              /* One past the name's last column */
+    char* name;
+    OwnershipKind ownership;
+    ShapeClass shape;
+} OmniSiteInfo;
+
+typedef struct OmniQuery OmniQuery;
+
+/* Record what analysis found about the count forms exprs; units[i] names
+ * the unit form i was read from (units itself may be NULL) */
+OmniQuery* omni_query_build(AnalysisContext* analysis, OmniValue** exprs,
+                            const char* const* units, size_t count);
+
+void omni_query_free(OmniQuery* query);
+
+/* The type name defines, or NULL */
+const OmniTypeInfo* omni_query_lookup_type(const OmniQuery* query, const char* name);
+
+/* How field of type holds its value */
+OmniFieldStrength omni_query_field_strength(const OmniQuery* query, const char* type,
+                                            const char* field);
+
+/* The summary of the function name, or NULL if there is none */
+const OmniFunctionInfo* omni_query_function_effects(const OmniQuery* query, const char* name);
+
+/* The calls between the program's functions, in the order they appear */
+size_t omni_query_call_count(const OmniQuery* query);
+const OmniCallInfo* omni_query_call(const OmniQuery* query, size_t index);
+
+/* The variable whose name covers line:column of unit (NULL for an
+ * unnamed unit), or NULL if no variable is there */
+const OmniSiteInfo* omni_query_site_at(const OmniQuery* query, const char* unit,
+                                       int line, int column);
+
+/* Its ownership and shape; false, leaving *out alone, if none is there */
+bool omni_query_ownership_at(const OmniQuery* query, const char* unit, int line, int column,
+                             OwnershipKind* out);
+bool omni_query_shape_at(const OmniQuery* query, const char* unit, int line, int column,
+                         ShapeClass* out);
+
+/* Names of the field strengths: strong, weak, unknown */
+const char* omni_field_strength_name(OmniFieldStrength strength);
+
+/* ============== Call Graph ============== */
+
+typedef enum {
+    OMNI_GRAPH_DOT = 0,
+    OMNI_GRAPH_JSON,
+} OmniGraphFormat;
+
+/* The format a name such as "dot" or "json" names; false if none */
+bool omni_graph_format_parse(const char* name, OmniGraphFormat* out);
+
+/*
+ * Print the program's functions and the calls between them. Each
+ * function is labelled with the effects its summary records (allocates,
+ * mutates, io, concurrent, throws), and each call with what the callee
+ * does with each argument (borrowed, consumed, passthrough, captured):
+ *
+ *     digraph calls {
+ *       "load" [label="load\nallocates, io"];
+ *       "load" -> "parse" [label="borrowed"];
+ *     }
+ *
+ * or as JSON:
+ *
+ *     {"functions": [{"name": "load", "effects": ["allocates", "io"]}, ...],
+ *      "calls": [{"from": "load", "to": "parse", "args": ["borrowed"]}, ...]}
+ */
+void omni_query_print_call_graph(const OmniQuery* query, FILE* out, OmniGraphFormat format);
+
+#ifdef __cplusplus
+}
+#endif
+
+#endif /* OMNILISP_QUERY_H */
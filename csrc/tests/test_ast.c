@@ -0,0 +1,353 @@
+/*
+ * AST Builder, Walker and Validation Tests
+ *
+ * Tests for building trees with the public AST API, walking them with
+ * omni_ast_walk (including in-place replacement), and the invariants
+ * enforced by omni_ast_check at the compiler front door.
+ */
+
+#define _POSIX_C_SOURCE 200809L
+#define _GNU_SOURCE
+
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <assert.h>
+
+#include "../ast/ast.h"
+#include "../parser/parser.h"
+#include "../compiler/compiler.h"
+
+/* Test counters */
+static int tests_run = 0;
+static int tests_passed = 0;
+
+/* Where the trees the tests build and parse live */
+static OmniSession* session;
+
+#define TEST(name) static void name(void)
+#define RUN_TEST(name) do { \
+    printf("  %s: ", #name); \
+    name(); \
+    tests_run++; \
+    tests_passed++; \
+    printf("\033[32mPASS\033[0m\n"); \
+} while(0)
+
+#define ASSERT(cond) do { \
+    if (!(cond)) { \
+        printf("\033[31mFAIL\033[0m (line %d: %s)\n", __LINE__, #cond); \
+        tests_run++; \
+        return; \
+    } \
+} while(0)
+
+/* ========== Helpers ========== */
+
+/* (define (sq x) (* x x)) */
+static OmniValue* build_square(void) {
+    OmniValue* x = omni_new_sym(session->arena, "x");
+    return omni_list_of(session->arena, 3, omni_new_sym(session->arena, "define"),
+                        omni_list_of(session->arena, 2, omni_new_sym(session->arena, "sq"), x),
+                        omni_list_of(session->arena, 3, omni_new_sym(session->arena, "*"), x, x));
+}
+
+/* Visitor state: count symbols, renaming from -> to */
+typedef struct {
+    const char* from;
+    const char* to;
+    int symbols;
+    int stop_after;
+} RenameState;
+
+static OmniWalkAction rename_visit(OmniValue** node, void* user_data) {
+    RenameState* st = user_data;
+    if (!omni_is_sym(*node)) return OMNI_WALK_CONTINUE;
+    st->symbols++;
+    if (st->from && strcmp((*node)->str_val, st->from) == 0) {
+        *node = omni_new_sym(session->arena, st->to);
+    }
+    if (st->stop_after && st->symbols >= st->stop_after) return OMNI_WALK_STOP;
+    return OMNI_WALK_CONTINUE;
+}
+
+static OmniWalkAction skip_quote(OmniValue** node, void* user_data) {
+    int* symbols = user_data;
+    if (omni_is_cell(*node) && omni_sym_eq_str(omni_car(*node), "quote")) {
+        return OMNI_WALK_SKIP;
+    }
+    if (omni_is_sym(*node)) (*symbols)++;
+    return OMNI_WALK_CONTINUE;
+}
+
+/* ========== Builders ========== */
+
+TEST(test_list_of_builds_proper_list) {
+    OmniValue* l = omni_list_of(session->arena, 3, omni_new_int(session->arena, 1), omni_new_int(session->arena, 2), omni_new_int(session->arena, 3));
+    ASSERT(omni_list_len(l) == 3);
+    ASSERT(omni_car(omni_cdr(omni_cdr(l)))->int_val == 3);
+    ASSERT(omni_is_nil(omni_cdr(omni_cdr(omni_cdr(l)))));
+    ASSERT(omni_is_nil(omni_list_of(session->arena, 0)));
+
+    char* s = omni_value_to_string(build_square());
+    ASSERT(strcmp(s, "(define (sq x) (* x x))") == 0);
+    free(s);
+}
+
+TEST(test_to_string_reads_back) {
+    static const char* texts[] = { "(1.0 0.1 1e+300 -2.5)", "(#\\a #\\space #\\x01)",
+                                   "(\"a\\\"b\" \"x\\ny\" \"\")" };
+    for (size_t i = 0; i < 3; i++) {
+        char* s = omni_value_to_string(omni_parse_string(session, texts[i]));
+        ASSERT(strcmp(s, texts[i]) == 0);
+        free(s);
+    }
+}
+
+TEST(test_unterminated_string_is_an_error) {
+    OmniParser* p = omni_parser_new(session, "(f 1) \"abc");
+    size_t n = 0;
+    OmniValue** exprs = omni_parser_parse_all(p, &n);
+    OmniParseError* err = omni_parser_get_errors(p);
+    ASSERT(err != NULL);
+    ASSERT(strstr(err->message, "unterminated string") != NULL);
+    free(exprs);
+    omni_parser_free(p);
+}
+
+TEST(test_unknown_escape_is_an_error) {
+    OmniParser* p = omni_parser_new(session, "(f \"ok\\n\")\n (g \"a\\xb\") ; \"\\q\"");
+    size_t n = 0;
+    OmniValue** exprs = omni_parser_parse_all(p, &n);
+    OmniParseError* err = omni_parser_get_errors(p);
+    ASSERT(err != NULL && err->next == NULL);
+    ASSERT(strcmp(err->message, "unknown escape '\\x' in string") == 0);
+    ASSERT(err->line == 2 && err->column == 7);
+    free(exprs);
+    omni_parser_free(p);
+}
+
+TEST(test_bad_integer_literals_are_errors) {
+    OmniParser* p = omni_parser_new(session, "(f 9223372036854775808 1_000)\n#xFFFFFFFFFFFFFFFF 1_ 1__0");
+    size_t n = 0;
+    OmniValue** exprs = omni_parser_parse_all(p, &n);
+    OmniParseError* err = omni_parser_get_errors(p);
+    ASSERT(err != NULL && strcmp(err->message, "integer literal out of range") == 0);
+    ASSERT(err->line == 1 && err->column == 4);
+    err = err->next;
+    ASSERT(err != NULL && strcmp(err->message, "integer literal out of range") == 0);
+    ASSERT(err->line == 2 && err->column == 1);
+    err = err->next;
+    ASSERT(err != NULL && strcmp(err->message, "'_' in a number must be between two digits") == 0);
+    ASSERT(err->line == 2 && err->column == 21);
+    err = err->next;
+    ASSERT(err != NULL && strcmp(err->message, "'_' in a number must be between two digits") == 0);
+    ASSERT(err->line == 2 && err->column == 24);
+    ASSERT(err->next == NULL);
+    free(exprs);
+    omni_parser_free(p);
+}
+
+TEST(test_colon_names_are_keywords) {
+    OmniValue* v = omni_parse_string(session, "(:weak : a:b)");
+    ASSERT(omni_is_keyword(omni_car(v)));
+    ASSERT(strcmp(omni_car(v)->str_val, "weak") == 0);
+    ASSERT(omni_is_sym(omni_car(omni_cdr(v))));
+    ASSERT(omni_is_sym(omni_car(omni_cdr(omni_cdr(v)))));
+    char* s = omni_value_to_string(v);
+    ASSERT(strcmp(s, "(:weak : a:b)") == 0);
+    free(s);
+}
+
+/* ========== Walking ========== */
+
+TEST(test_walk_visits_every_symbol) {
+    OmniValue* tree = build_square();
+    RenameState st = { 0 };
+    ASSERT(omni_ast_walk(&tree, rename_visit, &st));
+    ASSERT(st.symbols == 6);
+}
+
+TEST(test_walk_replaces_in_place) {
+    OmniValue* tree = build_square();
+    RenameState st = { .from = "x", .to = "y" };
+    ASSERT(omni_ast_walk(&tree, rename_visit, &st));
+
+    char* s = omni_value_to_string(tree);
+    ASSERT(strcmp(s, "(define (sq y) (* y y))") == 0);
+    free(s);
+}
+
+TEST(test_walk_replaces_root_and_dotted_tail) {
+    OmniValue* root = omni_new_sym(session->arena, "x");
+    RenameState st = { .from = "x", .to = "z" };
+    ASSERT(omni_ast_walk(&root, rename_visit, &st));
+    ASSERT(omni_sym_eq_str(root, "z"));
+
+    OmniValue* pair = omni_new_cell(session->arena, omni_new_sym(session->arena, "a"), omni_new_sym(session->arena, "x"));
+    ASSERT(omni_ast_walk(&pair, rename_visit, &st));
+    ASSERT(omni_sym_eq_str(omni_cdr(pair), "z"));
+}
+
+TEST(test_walk_skip_and_stop) {
+    OmniValue* tree = omni_list_of(session->arena, 3, omni_new_sym(session->arena, "f"),
+                                   omni_list_of(session->arena, 2, omni_new_sym(session->arena, "quote"), omni_new_sym(session->arena, "a")),
+                                   omni_new_sym(session->arena, "b"));
+    int symbols = 0;
+    ASSERT(omni_ast_walk(&tree, skip_quote, &symbols));
+    ASSERT(symbols == 2);
+
+    RenameState st = { .stop_after = 2 };
+    ASSERT(!omni_ast_walk(&tree, rename_visit, &st));
+    ASSERT(st.symbols == 2);
+}
+
+TEST(test_walk_descends_into_arrays) {
+    OmniValue* arr = omni_new_array(session->arena, 2);
+    omni_array_push(session->arena, arr, omni_new_sym(session->arena, "x"));
+    omni_array_push(session->arena, arr, omni_new_int(session->arena, 1));
+    RenameState st = { .from = "x", .to = "y" };
+    ASSERT(omni_ast_walk(&arr, rename_visit, &st));
+    ASSERT(omni_sym_eq_str(omni_array_get(arr, 0), "y"));
+}
+
+/* ========== Validation ========== */
+
+TEST(test_check_accepts_parsed_and_built_trees) {
+    OmniParser* p = omni_parser_new(session, "(define (f x) [x 1.5 #\\a]) (f 'y) :k");
+    size_t n = 0;
+    OmniValue** exprs = omni_parser_parse_all(p, &n);
+    ASSERT(n == 3);
+    for (size_t i = 0; i < n; i++) {
+        ASSERT(omni_ast_check(exprs[i], NULL) == NULL);
+    }
+    free(exprs);
+    omni_parser_free(p);
+
+    ASSERT(omni_ast_check(build_square(), NULL) == NULL);
+    ASSERT(omni_ast_check(NULL, NULL) == NULL);
+}
+
+TEST(test_check_rejects_bad_symbols) {
+    OmniValue* empty = omni_new_sym(session->arena, "");
+    OmniValue* bad = NULL;
+    ASSERT(omni_ast_check(omni_list_of(session->arena, 2, omni_new_sym(session->arena, "f"), empty), &bad) != NULL);
+    ASSERT(bad == empty);
+
+    OmniValue* unnamed = omni_new_sym(session->arena, "x");
+    unnamed->str_val = NULL;
+    ASSERT(omni_ast_check(unnamed, &bad) != NULL);
+    ASSERT(bad == unnamed);
+}
+
+TEST(test_check_rejects_runtime_values) {
+    OmniValue* box = omni_new_box(session->arena, omni_new_int(session->arena, 1));
+    OmniValue* bad = NULL;
+    const char* err = omni_ast_check(omni_list_of(session->arena, 2, omni_new_sym(session->arena, "f"), box), &bad);
+    ASSERT(err != NULL);
+    ASSERT(strstr(err, "runtime-only") != NULL);
+    ASSERT(bad == box);
+}
+
+TEST(test_check_rejects_cycles) {
+    OmniValue* l = omni_list_of(session->arena, 3, omni_new_int(session->arena, 1), omni_new_int(session->arena, 2), omni_new_int(session->arena, 3));
+    omni_cdr(omni_cdr(l))->cell.cdr = l;
+    ASSERT(omni_ast_check(l, NULL) != NULL);
+
+    OmniValue* self = omni_new_cell(session->arena, omni_new_int(session->arena, 1), omni_nil);
+    self->cell.cdr = self;
+    ASSERT(omni_ast_check(self, NULL) != NULL);
+
+    OmniValue* nest = omni_new_cell(session->arena, omni_nil, omni_nil);
+    nest->cell.car = nest;
+    ASSERT(omni_ast_check(nest, NULL) != NULL);
+}
+
+TEST(test_check_rejects_missing_storage) {
+    OmniValue* arr = omni_new_array(session->arena, 0);
+    arr->array.data = NULL;
+    arr->array.len = 2;
+    OmniValue* bad = NULL;
+    ASSERT(omni_ast_check(arr, &bad) != NULL);
+    ASSERT(bad == arr);
+}
+
+/* ========== Compiler Front Door ========== */
+
+TEST(test_compiler_accepts_built_trees) {
+    CompilerOptions opts = { .use_embedded_runtime = true };
+    Compiler* c = omni_compiler_new_with_options(&opts);
+
+    OmniValue* exprs[2] = {
+        build_square(),
+        omni_list_of(session->arena, 2, omni_new_sym(session->arena, "sq"), omni_new_int(session->arena, 7)),
+    };
+    char* code = omni_compiler_compile_ast_to_c(c, exprs, 2);
+    ASSERT(code != NULL);
+    ASSERT(!omni_compiler_has_errors(c));
+    ASSERT(strstr(code, "o_sq(mk_int(7))") != NULL);
+
+    free(code);
+    omni_compiler_free(c);
+}
+
+TEST(test_compiler_rejects_malformed_trees) {
+    CompilerOptions opts = { .use_embedded_runtime = true };
+    Compiler* c = omni_compiler_new_with_options(&opts);
+
+    OmniValue* exprs[2] = {
+        build_square(),
+        omni_list_of(session->arena, 2, omni_new_sym(session->arena, "sq"), omni_new_prim(session->arena, NULL)),
+    };
+    ASSERT(omni_compiler_compile_ast_to_c(c, exprs, 2) == NULL);
+    ASSERT(omni_compiler_error_count(c) == 1);
+    const char* err = omni_compiler_get_error(c, 0);
+    ASSERT(strstr(err, "expression 2") != NULL);
+    ASSERT(strstr(err, "PRIM") != NULL);
+
+    omni_compiler_free(c);
+}
+
+int main(void) {
+    session = omni_session_new();
+    printf("\n\033[33m=== AST API Tests ===\033[0m\n");
+
+    printf("\n\033[33m--- Builders ---\033[0m\n");
+    RUN_TEST(test_list_of_builds_proper_list);
+    RUN_TEST(test_to_string_reads_back);
+    RUN_TEST(test_unterminated_string_is_an_error);
+    RUN_TEST(test_unknown_escape_is_an_error);
+    RUN_TEST(test_bad_integer_literals_are_errors);
+    RUN_TEST(test_colon_names_are_keywords);
+
+    printf("\n\033[33m--- Walking ---\033[0m\n");
+    RUN_TEST(test_walk_visits_every_symbol);
+    RUN_TEST(test_walk_replaces_in_place);
+    RUN_TEST(test_walk_replaces_root_and_dotted_tail);
+    RUN_TEST(test_walk_skip_and_stop);
+    RUN_TEST(test_walk_descends_into_arrays);
+
+    printf("\n\033[33m--- Validation ---\033[0m\n");
+    RUN_TEST(test_check_accepts_parsed_and_built_trees);
+    RUN_TEST(test_check_rejects_bad_symbols);
+    RUN_TEST(test_check_rejects_runtime_values);
+    RUN_TEST(test_check_rejects_cycles);
+    RUN_TEST(test_check_rejects_missing_storage);
+
+    printf("\n\033[33m--- Compiler Front Door ---\033[0m\n");
+    RUN_TEST(test_compiler_accepts_built_trees);
+    RUN_TEST(test_compiler_rejects_malformed_trees);
+
+    printf("\n\033[33m=== Summary ===\033[0m\n");
+    printf("  Total:  %d\n", tests_run);
+    if (tests_passed == tests_run) {
+        printf("  \033[32mPassed: %d\033[0m\n", tests_passed);
+    } else {
+        printf("  \033[32mPassed: %d\033[0m\n", tests_passed);
+        printf("  \033[31mFailed: %d\033[0m\n", tests_run - tests_passed);
+    }
+    printf("  Failed: %d\n", tests_run - tests_passed);
+
+    omni_session_free(session);
+    return (tests_passed == tests_run) ? 0 : 1;
+}
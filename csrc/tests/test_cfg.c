@@ -19,6 +19,9 @@
 static int tests_run = 0;
 static int tests_passed = 0;
 
+/* Where the trees the tests build and parse live */
+static OmniSession* session;
+
 #define TEST(name) static void name(void)
 #define RUN_TEST(name) do { \
     printf("  %s: ", #name); \
@@ -38,17 +41,17 @@ static int tests_passed = 0;
 
 /* Helper to create a simple symbol */
 static OmniValue* mk_sym(const char* name) {
-    return omni_new_sym(name);
+    return omni_new_sym(session->arena, name);
 }
 
 /* Helper to create a simple integer */
 static OmniValue* mk_int(long val) {
-    return omni_new_int(val);
+    return omni_new_int(session->arena, val);
 }
 
 /* Helper to create a cons cell */
 static OmniValue* mk_cons(OmniValue* car, OmniValue* cdr) {
-    return omni_new_cell(car, cdr);
+    return omni_new_cell(session->arena, car, cdr);
 }
 
 /* Helper to create a list from args */
@@ -311,6 +314,7 @@ TEST(test_print_cfg) {
 /* ========== Main ========== */
 
 int main(void) {
+    session = omni_session_new();
     printf("\n\033[33m=== CFG and Liveness Analysis Tests ===\033[0m\n");
 
     printf("\n\033[33m--- Basic CFG Construction ---\033[0m\n");
@@ -339,5 +343,6 @@ int main(void) {
     }
     printf("  Failed: %d\n", tests_run - tests_passed);
 
+    omni_session_free(session);
     return (tests_passed == tests_run) ? 0 : 1;
 }
@@ -0,0 +1,3945 @@
+/*
+ * Compiler Driver Tests
+ *
+ * Tests for multi-unit compilation, diagnostic attribution, script mode
+ * and the behaviour of compiled programs.
+ */
+
+#define _POSIX_C_SOURCE 200809L
+#define _GNU_SOURCE
+
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <unistd.h>
+#include <assert.h>
+#include <pthread.h>
+#include <sys/stat.h>
+#include <sys/wait.h>
+
+#include "../compiler/compiler.h"
+#include "../parser/parser.h"
+
+/* Test counters */
+static int tests_run = 0;
+static int tests_passed = 0;
+
+/* Where the trees the tests build and parse live */
+static OmniSession* session;
+
+#define TEST(name) static void name(void)
+#define RUN_TEST(name) do { \
+    printf("  %s: ", #name); \
+    name(); \
+    tests_run++; \
+    tests_passed++; \
+    printf("\033[32mPASS\033[0m\n"); \
+} while(0)
+
+#define ASSERT(cond) do { \
+    if (!(cond)) { \
+        printf("\033[31mFAIL\033[0m (line %d: %s)\n", __LINE__, #cond); \
+        tests_run++; \
+        return; \
+    } \
+} while(0)
+
+/* ========== Helpers ========== */
+
+/* Compile src against libpurple at runtime_path (or the embedded runtime
+ * when NULL), run it and capture stdout.
+ * Returns the program's exit status, or -1 if it didn't build. */
+static int run_program_with(const CompilerOptions* opts, const char* src, char* out, size_t cap) {
+    Compiler* c = omni_compiler_new_with_options(opts);
+    char path[] = "/tmp/omni_test_prog_XXXXXX";
+    int fd = mkstemp(path);
+    if (fd < 0) {
+        omni_compiler_free(c);
+        return -1;
+    }
+    close(fd);
+
+    bool ok = omni_compiler_compile_to_binary(c, src, path);
+    omni_compiler_free(c);
+    if (!ok) {
+        unlink(path);
+        return -1;
+    }
+
+    FILE* p = popen(path, "r");
+    size_t n = p ? fread(out, 1, cap - 1, p) : 0;
+    out[n] = '\0';
+    while (n > 0 && out[n - 1] == '\n') out[--n] = '\0';
+    int status = p ? pclose(p) : -1;
+    unlink(path);
+    return status;
+}
+
+static int run_program_on(const char* src, const char* runtime_path, char* out, size_t cap) {
+    CompilerOptions opts = {
+        .runtime_path = runtime_path,
+        .use_embedded_runtime = (runtime_path == NULL),
+    };
+    return run_program_with(&opts, src, out, cap);
+}
+
+static int run_program(const char* src, char* out, size_t cap) {
+    return run_program_on(src, NULL, out, cap);
+}
+
+/* ========== Multi-unit Compilation ========== */
+
+TEST(test_units_share_one_program) {
+    Compiler* c = omni_compiler_new();
+    OmniSource units[] = {
+        { "lib.omni", "(define (sq x) (* x x))" },
+        { "main.omni", "(sq 7)" },
+    };
+
+    char* code = omni_compiler_compile_units_to_c(c, units, 2);
+    ASSERT(code != NULL);
+    ASSERT(!omni_compiler_has_errors(c));
+    ASSERT(strstr(code, "sq") != NULL);
+
+    free(code);
+    omni_compiler_free(c);
+}
+
+TEST(test_unit_lines_count_from_each_file) {
+    Compiler* c = omni_compiler_new();
+    OmniSource units[] = {
+        { "lib.omni", "(define (sq x) (* x x))\n(define (cube x) (* x (sq x)))\n" },
+        { "main.omni", "(cube 2)\n(sq\n" },
+    };
+
+    char* code = omni_compiler_compile_units_to_c(c, units, 2);
+    ASSERT(code == NULL);
+    ASSERT(omni_compiler_error_count(c) == 1);
+    ASSERT(strncmp(omni_compiler_get_error(c, 0), "main.omni:2:1:", 14) == 0);
+
+    omni_compiler_free(c);
+}
+
+TEST(test_unit_errors_name_file) {
+    Compiler* c = omni_compiler_new();
+    OmniSource units[] = {
+        { "good.omni", "(+ 1 2)" },
+        { "bad.omni", "(+ 1\n(foo)" },
+    };
+
+    char* code = omni_compiler_compile_units_to_c(c, units, 2);
+    ASSERT(code == NULL);
+    ASSERT(omni_compiler_error_count(c) == 1);
+    ASSERT(strncmp(omni_compiler_get_error(c, 0), "bad.omni:1:1:", 13) == 0);
+
+    omni_compiler_free(c);
+}
+
+TEST(test_errors_point_at_the_source) {
+    Compiler* c = omni_compiler_new();
+    OmniSource units[] = {
+        { "lib.omni", "(define (f x)\n  (+ x 1))" },
+        { "prog.omni", "(display\n  (f y))" },
+    };
+
+    char* code = omni_compiler_compile_units_to_c(c, units, 2);
+    ASSERT(code == NULL);
+    ASSERT(omni_compiler_error_count(c) == 1);
+    ASSERT(strcmp(omni_compiler_get_error(c, 0),
+                  "prog.omni:2:6: E0001 unbound symbol: y\n"
+                  " 2 |   (f y))\n"
+                  "   |      ^") == 0);
+
+    omni_compiler_free(c);
+}
+
+TEST(test_unnamed_unit_error_format) {
+    Compiler* c = omni_compiler_new();
+
+    char* code = omni_compiler_compile_to_c(c, "(+ 1 2))");
+    ASSERT(code == NULL);
+    ASSERT(omni_compiler_has_errors(c));
+    ASSERT(strstr(omni_compiler_get_error(c, 0), "Parse error at line 1") != NULL);
+
+    omni_compiler_free(c);
+}
+
+TEST(test_unbound_symbol_suggests_names) {
+    Compiler* c = omni_compiler_new();
+    ASSERT(omni_compiler_compile_to_c(c, "(lenght '(1 2))") == NULL);
+    ASSERT(strcmp(omni_compiler_get_error(c, 0),
+                  "E0001 unbound symbol: lenght (did you mean length?)") == 0);
+    omni_compiler_free(c);
+
+    /* Misspelled special forms, locals and functions defined later */
+    c = omni_compiler_new();
+    ASSERT(omni_compiler_compile_to_c(c, "(lamda (x) x)") == NULL);
+    ASSERT(strstr(omni_compiler_get_error(c, 0), "lamda (did you mean lambda?)") != NULL);
+    omni_compiler_free(c);
+
+    c = omni_compiler_new();
+    ASSERT(omni_compiler_compile_to_c(c,
+        "(define (f total) (+ totl (g totl))) (define (g n) n) (f 1)") == NULL);
+    ASSERT(omni_compiler_error_count(c) == 1);
+    ASSERT(strstr(omni_compiler_get_error(c, 0), "totl (did you mean total?)") != NULL);
+    omni_compiler_free(c);
+
+    c = omni_compiler_new();
+    char* code = omni_compiler_compile_to_c(c, "(define (f) (g)) (define (g) 7) (f)");
+    ASSERT(code != NULL);
+    free(code);
+    omni_compiler_free(c);
+}
+
+TEST(test_shadowed_builtins_follow_scope) {
+    char out[128];
+    ASSERT(run_program(
+        "(let ((car 3)) car)\n"
+        "(car '(1 2))\n"
+        "(let ((max (lambda (a b) 7))) (max 1 2))\n"
+        "(define (g display) (display 5))\n"
+        "(g (lambda (x) (+ x 1)))\n"
+        "(define (f) 1)\n"
+        "(define (h f) (f))\n"
+        "(h (lambda () 2))\n"
+        "(let ((if (lambda (a b c) c))) (if 1 2 3))",
+        out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "3\n1\n7\n6\n2\n3") == 0);
+}
+
+TEST(test_shadowing_policy) {
+    const char* src = "(let ((car 3)) car) (define (f length) length)";
+    CompilerOptions opts = { .use_embedded_runtime = true };
+    Compiler* c = omni_compiler_new_with_options(&opts);
+    char* code = omni_compiler_compile_to_c(c, src);
+    ASSERT(code != NULL);
+    free(code);
+    ASSERT(omni_compiler_warning_count(c) == 2);
+    /* Functions are generated ahead of main */
+    ASSERT(strstr(omni_compiler_get_warning(c, 0), "parameter length shadows the primitive") != NULL);
+    ASSERT(strstr(omni_compiler_get_warning(c, 1), "let binding car shadows the primitive") != NULL);
+    omni_compiler_free(c);
+
+    opts.shadowing = OMNI_SHADOW_ERROR;
+    c = omni_compiler_new_with_options(&opts);
+    ASSERT(omni_compiler_compile_to_c(c, src) == NULL);
+    ASSERT(strncmp(omni_compiler_get_error(c, 0), "E0007 ", 6) == 0);
+    omni_compiler_free(c);
+
+    opts.shadowing = OMNI_SHADOW_ALLOW;
+    c = omni_compiler_new_with_options(&opts);
+    code = omni_compiler_compile_to_c(c, src);
+    ASSERT(code != NULL);
+    free(code);
+    ASSERT(omni_compiler_warning_count(c) == 0);
+    omni_compiler_free(c);
+}
+
+/* First error (or NULL) from compiling src; *warnings gets the count */
+static char* first_error(const char* src, size_t* warnings, char* warning, size_t cap) {
+    static char err[512];
+    Compiler* c = omni_compiler_new();
+    char* code = omni_compiler_compile_to_c(c, src);
+    free(code);
+    *warnings = omni_compiler_warning_count(c);
+    if (warning && cap) {
+        snprintf(warning, cap, "%s", *warnings ? omni_compiler_get_warning(c, 0) : "");
+    }
+    const char* e = omni_compiler_has_errors(c) ? omni_compiler_get_error(c, 0) : NULL;
+    if (e) snprintf(err, sizeof(err), "%s", e);
+    omni_compiler_free(c);
+    return e ? err : NULL;
+}
+
+TEST(test_uninitialized_reads_are_errors) {
+    size_t n;
+    char* e = first_error("(define y (+ x 1))\n(define x 1)\ny", &n, NULL, 0);
+    ASSERT(e && strcmp(e, "E0008 x is read before its definition "
+                          "(move the definition above this use)") == 0);
+
+    e = first_error("(define (f) 1) (set! x 2) (define x 1)", &n, NULL, 0);
+    ASSERT(e && strncmp(e, "E0008 x is set before its definition", 36) == 0);
+
+    e = first_error("(letrec ((a b) (b 1)) a)", &n, NULL, 0);
+    ASSERT(e && strstr(e, "b is read before letrec initializes it") != NULL);
+
+    /* From a file, the error points at the read */
+    Compiler* c = omni_compiler_new();
+    OmniSource unit = { "lr.omni", "(define (f) 1)\n(letrec ((a b)\n         (b 1)) a)" };
+    ASSERT(!omni_compiler_check_units(c, &unit, 1));
+    ASSERT(strcmp(omni_compiler_get_error(c, 0),
+                  "lr.omni:2:13: E0008 b is read before letrec initializes it "
+                  "(bind it earlier, or delay the use inside a lambda)\n"
+                  " 2 | (letrec ((a b)\n"
+                  "   |             ^") == 0);
+    omni_compiler_free(c);
+
+    /* Deferred by a lambda, or early on only one path: not reported */
+    ASSERT(first_error("(define (f) x) (define x 1) (f)", &n, NULL, 0) == NULL);
+    e = first_error("(letrec ((a (lambda () b)) (b 1)) (a))", &n, NULL, 0);
+    ASSERT(e == NULL || strncmp(e, "E0008", 5) != 0);
+    e = first_error("(define (g) (let ((v 1)) (if v (set! v 2) 0) v))", &n, NULL, 0);
+    ASSERT(e == NULL || strncmp(e, "E0008", 5) != 0);
+}
+
+TEST(test_wrong_argument_counts_are_errors) {
+    size_t n;
+    char* e = first_error("(define (f a b) a)\n(f 1)", &n, NULL, 0);
+    ASSERT(e && strcmp(e, "E0011 wrong number of arguments: f takes 2, given 1") == 0);
+    e = first_error("(car '(1) '(2))", &n, NULL, 0);
+    ASSERT(e && strstr(e, "car takes 1, given 2") != NULL);
+    e = first_error("(- 1 2 3)", &n, NULL, 0);
+    ASSERT(e && strstr(e, "- takes 1 or 2, given 3") != NULL);
+    e = first_error("(letrec ((g (lambda (x) x))) (g))", &n, NULL, 0);
+    ASSERT(e && strstr(e, "g takes 1, given 0") != NULL);
+
+    /* Every bad call is reported, along with other errors */
+    Compiler* c = omni_compiler_new();
+    ASSERT(omni_compiler_compile_to_c(c, "(define (f x) x) (f) (+ 1) (f y)") == NULL);
+    ASSERT(omni_compiler_error_count(c) == 3);
+    ASSERT(strstr(omni_compiler_get_error(c, 2), "E0001 unbound symbol: y") != NULL);
+    omni_compiler_free(c);
+
+    /* A local binding replaces the primitive's count; closures are
+     * checked when called */
+    ASSERT(first_error("(let ((car (lambda (a b) a))) (car 1 2))", &n, NULL, 0) == NULL);
+    ASSERT(first_error("(define g (lambda (x) x)) (g 1 2)", &n, NULL, 0) == NULL);
+}
+
+TEST(test_dead_stores_warn) {
+    size_t n;
+    char w[512];
+    first_error("(let ((x 1)) (set! x 2) (display x))", &n, w, sizeof(w));
+    ASSERT(n == 1);
+    ASSERT(strstr(w, "the value x is bound to is never read") == w);
+
+    first_error("(define (f) (let ((y 0)) (display y) (set! y 5)))", &n, w, sizeof(w));
+    ASSERT(n == 1);
+    ASSERT(strcmp(w, "in f: the value stored by (set! y ...) is never read "
+                     "(remove the set! or use the value)") == 0);
+
+    /* Read on one path, read by a closure, or never used at all */
+    first_error("(define (g c) (let ((z 0)) (if c (set! z 1) 0) z))", &n, w, sizeof(w));
+    ASSERT(n == 0);
+    first_error("(let ((k 0)) (let ((peek (lambda () k))) (set! k 1) (peek)))", &n, w, sizeof(w));
+    ASSERT(n == 0);
+    first_error("(let ((unused 1)) 2)", &n, w, sizeof(w));
+    ASSERT(n == 0);
+
+    /* One cond or case clause runs, and maybe none */
+    first_error("(define (g c) (let ((z 0)) (cond (c (set! z 1))) z))", &n, w, sizeof(w));
+    ASSERT(n == 0);
+    first_error("(define (g c) (let ((z 0)) (case c ((1) (set! z 1)) (else (set! z 2))) z))",
+                &n, w, sizeof(w));
+    ASSERT(n == 1);
+    ASSERT(strstr(w, "the value z is bound to is never read") != NULL);
+
+    /* From a file, the warning points at the store */
+    Compiler* c = omni_compiler_new();
+    OmniSource unit = { "main.omni", "(define (f)\n  (let ((y 0))\n    (display y)\n    (set! y 5)))" };
+    ASSERT(omni_compiler_check_units(c, &unit, 1));
+    ASSERT(omni_compiler_warning_count(c) == 1);
+    const char* at = omni_compiler_get_warning(c, 0);
+    ASSERT(strstr(at, "main.omni:4:5: in f: the value stored by (set! y ...) is never read") == at);
+    omni_compiler_free(c);
+}
+
+TEST(test_cond_and_case) {
+    char out[256];
+    ASSERT(run_program(
+        "(define (sign n) (cond ((< n 0) 'neg) ((= n 0) 'zero) (else 'pos)))\n"
+        "(cons (sign -2) (cons (sign 0) (cons (sign 5) '())))\n"
+        "(define (kind x) (case x ((1 2 3) 'small) ((a b) 'letter) ((#\\z) 'zed) (else (cons 'other x))))\n"
+        "(cons (kind 2) (cons (kind 'b) (cons (kind #\\z) (cons (kind 9) '()))))\n"
+        "(cond ((= 0 1) 1) ((length '(7 8))))\n"
+        "(cond ((= 1 2) 1))\n"
+        "(case (+ 2 3) ((1) 'one))\n"
+        "(let ((xs '(1 2))) (cond ((null? xs) 'empty) (else (display \"side \") (length xs))))",
+        out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "(neg zero pos)\n(small letter zed (other . 9))\n2\n()\n()\nside 2") == 0);
+}
+
+TEST(test_cond_and_case_check_their_clauses) {
+    size_t n;
+    char* e = first_error("(cond (else 1) ((= 1 1) 2))", &n, NULL, 0);
+    ASSERT(e && strstr(e, "expected (cond (test expr...)... [(else expr...)])") != NULL);
+    e = first_error("(cond 1)", &n, NULL, 0);
+    ASSERT(e && strstr(e, "expected (cond") != NULL);
+    e = first_error("(case 1 (1 'one))", &n, NULL, 0);
+    ASSERT(e && strstr(e, "expected (case key ((datum...) expr...)... [(else expr...)])") != NULL);
+    e = first_error("(case)", &n, NULL, 0);
+    ASSERT(e && strstr(e, "expected (case") != NULL);
+}
+
+TEST(test_tests_use_unboxed_booleans) {
+    /* A boolean primitive tested by if or cond boxes nothing; one whose
+     * value is used still does */
+    const char* src = "(define (f a b) (if (< a b) a b))\n"
+                      "(define (g n) (cond ((= n 0) 'zero) ((null? n) 'nil) (else n)))\n"
+                      "(define (h a b) (<= a b))\n"
+                      "(f 1 2) (g 0) (h 1 2)";
+    CompilerOptions opts = { .use_embedded_runtime = true };
+    Compiler* c = omni_compiler_new_with_options(&opts);
+    char* code = omni_compiler_compile_to_c(c, src);
+    ASSERT(code != NULL);
+    ASSERT(strstr(code, "(test_lt(o_a, o_b) ? (o_a) : (o_b))") != NULL);
+    ASSERT(strstr(code, "test_eq(o_n, ({ static Obj _k = { .tag = T_INT, .rc = 1, .i = 0 }; &_k; }))") != NULL);
+    ASSERT(strstr(code, "test_null(o_n)") != NULL);
+    ASSERT(strstr(code, "return prim_le(o_a, o_b);") != NULL);
+    free(code);
+    omni_compiler_free(c);
+
+    CompilerOptions lib = { .runtime_path = "/opt/purple" };
+    c = omni_compiler_new_with_options(&lib);
+    code = omni_compiler_compile_to_c(c, src);
+    ASSERT(code != NULL);
+    ASSERT(strstr(code, "test_eq(o_n, mk_int_unboxed(0))") != NULL);
+    free(code);
+    omni_compiler_free(c);
+}
+
+TEST(test_if_computes_shared_test_calls_once) {
+    /* A pure call in the test that an arm repeats is computed once; not
+     * when the if assigns one of its operands */
+    const char* src = "(define (f x) (if (null? (car (cdr x))) 0 (+ (car (cdr x)) 1)))\n"
+                      "(define (g n) (if (< (* n n) 50) (+ (* n n) 1) (- (* n n) 1)))\n"
+                      "(define (h n) (if (< (+ n 1) 5) (do (set! n 10) (+ n 1)) n))\n"
+                      "(cons (f '(1 2)) (cons (f '(1 ())) (cons (g 3) (cons (g 9) (cons (h 1) '())))))";
+    CompilerOptions opts = { .use_embedded_runtime = true };
+    Compiler* c = omni_compiler_new_with_options(&opts);
+    char* code = omni_compiler_compile_to_c(c, src);
+    ASSERT(code != NULL);
+    ASSERT(strstr(code, "= prim_car(prim_cdr(o_x));") != NULL);
+    ASSERT(strstr(code, "test_null(o__shared_") != NULL);
+    ASSERT(strstr(code, "= prim_mul(o_n, o_n);") != NULL);
+    ASSERT(strstr(code, "prim_add(prim_mul(o_n, o_n)") == NULL);
+    ASSERT(strstr(code, "test_lt(prim_add(o_n, mk_int(1))") != NULL);
+    free(code);
+    omni_compiler_free(c);
+
+    char out[64];
+    ASSERT(run_program(src, out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "(3 0 10 80 11)") == 0);
+}
+
+TEST(test_internal_defines) {
+    size_t n;
+    char out[64];
+    ASSERT(run_program("(let ((x 1)) (define y (+ x 1)) (define z (* y 3)) z)", out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "6") == 0);
+    ASSERT(run_program("(map (lambda (x) (define d (* x 2)) (+ d 1)) '(1 2 3))", out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "(3 5 7)") == 0);
+    /* Scoped to the body: a nested do may shadow, the top level can't see it */
+    ASSERT(run_program("(let ((x 1)) (do (define x 2) x))", out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "2") == 0);
+    char* e = first_error("(let () (define x 1) x) x", &n, NULL, 0);
+    ASSERT(e && strcmp(e, "E0001 unbound symbol: x") == 0);
+
+    e = first_error("(+ 1 (define x 2))", &n, NULL, 0);
+    ASSERT(e && strcmp(e, "E0002 (define x 2): define is only allowed at top level or among "
+                          "the forms of a let, lambda, function or do body") == 0);
+    e = first_error("(if 1 (define x 2) 3)", &n, NULL, 0);
+    ASSERT(e && strncmp(e, "E0002 (define x 2): define is only allowed", 42) == 0);
+
+    /* Lambda, let and do bodies */
+    e = first_error("(lambda () (define (g) 1) (g))", &n, NULL, 0);
+    ASSERT(e && strncmp(e, "E0002 (define (g) 1): functions can only be defined at top level", 64) == 0);
+    e = first_error("(let ((x 1)) (define x 5) x)", &n, NULL, 0);
+    ASSERT(e && strcmp(e, "E0002 (define x 5): x is already bound in this body") == 0);
+    e = first_error("(define (f n) (define n 2) n)", &n, NULL, 0);
+    ASSERT(e && strcmp(e, "E0002 (define n 2): n is already bound in this body") == 0);
+    e = first_error("(do 1 (define y 2))", &n, NULL, 0);
+    ASSERT(e && strncmp(e, "E0002 (define y 2): a body cannot end with a define", 51) == 0);
+}
+
+/* ========== Scripts ========== */
+
+TEST(test_shebang_and_comments_skipped) {
+    Compiler* c = omni_compiler_new();
+    const char* src =
+        "#!/usr/bin/env purple\n"
+        "; leading comment\n"
+        "(+ 1 2) ; trailing comment\n"
+        ";; final comment";
+
+    char* code = omni_compiler_compile_to_c(c, src);
+    ASSERT(code != NULL);
+    ASSERT(!omni_compiler_has_errors(c));
+
+    free(code);
+    omni_compiler_free(c);
+}
+
+TEST(test_script_mode_suppresses_echo) {
+    CompilerOptions opts = { .script_mode = true, .use_embedded_runtime = true };
+    Compiler* c = omni_compiler_new_with_options(&opts);
+
+    char* code = omni_compiler_compile_to_c(c, "(+ 1 2)");
+    ASSERT(code != NULL);
+    char* main_fn = strstr(code, "int main(void)");
+    ASSERT(main_fn != NULL);
+    ASSERT(strstr(main_fn, "omni_print(_result)") == NULL);
+    ASSERT(strstr(main_fn, "fflush(stdout)") != NULL);
+
+    free(code);
+    omni_compiler_free(c);
+}
+
+/* -script: only displayed output, and the last expression's value is
+ * the exit status, on both runtimes */
+TEST(test_script_exits_with_the_last_value) {
+    static const struct { const char* src; const char* out; int status; } cases[] = {
+        { "(display \"hi\") (define x 1) (+ x 6) (define y 2)", "hi", 7 },
+        { "(display 'a) (error \"bad\")", "a", 1 },
+        { "(+ 1 2) '(4 5)", "", 0 },
+        { "(define (f) 1)", "", 0 },
+    };
+    char* runtime = access("../runtime/libpurple.a", F_OK) == 0 ? realpath("../runtime", NULL) : NULL;
+    for (size_t i = 0; i < sizeof(cases) / sizeof(cases[0]); i++) {
+        for (int backend = 0; backend < 2; backend++) {
+            if (backend == 1 && !runtime) continue;
+            CompilerOptions opts = {
+                .script_mode = true,
+                .script_exit = true,
+                .runtime_path = backend ? runtime : NULL,
+                .use_embedded_runtime = !backend,
+            };
+            char out[64];
+            int status = run_program_with(&opts, cases[i].src, out, sizeof(out));
+            ASSERT(status != -1 && WEXITSTATUS(status) == cases[i].status);
+            ASSERT(strcmp(out, cases[i].out) == 0);
+        }
+    }
+    free(runtime);
+}
+
+/* A program defining main runs it last, without echoing, and exits
+ * with its value; its parameter gets the command-line arguments */
+TEST(test_main_is_the_entry_point) {
+    char out[64];
+    int status = run_program("(define (main) (display \"main\") 3) (display \"top \") 5", out, sizeof(out));
+    ASSERT(WEXITSTATUS(status) == 3);
+    ASSERT(strcmp(out, "top main") == 0);
+
+    Compiler* c = omni_compiler_new();
+    char path[] = "/tmp/omni_test_main_XXXXXX";
+    int fd = mkstemp(path);
+    ASSERT(fd >= 0);
+    close(fd);
+    ASSERT(omni_compiler_compile_to_binary(c, "(define (main args) (display args) (length args))", path));
+    omni_compiler_free(c);
+    char cmd[128];
+    snprintf(cmd, sizeof(cmd), "%s one \"two three\"", path);
+    FILE* p = popen(cmd, "r");
+    size_t n = fread(out, 1, sizeof(out) - 1, p);
+    out[n] = '\0';
+    status = pclose(p);
+    unlink(path);
+    ASSERT(WEXITSTATUS(status) == 2);
+    ASSERT(strcmp(out, "(one two three)") == 0);
+
+    c = omni_compiler_new();
+    char* code = omni_compiler_compile_to_c(c, "(define (main a b) a)");
+    ASSERT(code == NULL);
+    ASSERT(strstr(omni_compiler_get_error(c, 0), "main takes no parameters") != NULL);
+    omni_compiler_free(c);
+}
+
+/* ========== Modules ========== */
+
+/* Write text to dir/name, creating dir/lib for names under it */
+static void write_module(const char* dir, const char* name, const char* text) {
+    char path[512];
+    snprintf(path, sizeof(path), "%s/lib", dir);
+    mkdir(path, 0700);
+    snprintf(path, sizeof(path), "%s/%s", dir, name);
+    FILE* f = fopen(path, "w");
+    fputs(text, f);
+    fclose(f);
+}
+
+static void remove_modules(const char* dir, const char* const* names, size_t count) {
+    char path[512];
+    for (size_t i = 0; i < count; i++) {
+        snprintf(path, sizeof(path), "%s/%s", dir, names[i]);
+        unlink(path);
+    }
+    snprintf(path, sizeof(path), "%s/lib", dir);
+    rmdir(path);
+    rmdir(dir);
+}
+
+TEST(test_imports_run_once_before_the_importer) {
+    char dir[] = "/tmp/omni_test_import_XXXXXX";
+    ASSERT(mkdtemp(dir) != NULL);
+    write_module(dir, "lib/util.omni",
+                 "(provide square)\n"
+                 "(import \"helpers.omni\")\n"
+                 "(define (helper x) (* x x))\n"
+                 "(define (square x) (helper x))\n"
+                 "(display \"util \")");
+    write_module(dir, "lib/helpers.omni", "(define (twice x) (+ x x)) (display \"helpers \")");
+    write_module(dir, "main.omni",
+                 "(import \"lib/util.omni\")\n"
+                 "(import \"lib/helpers.omni\" \"lib/util.omni\")\n"
+                 "(display (square (twice 3)))");
+
+    char main_path[512], bin[512];
+    snprintf(main_path, sizeof(main_path), "%s/main.omni", dir);
+    snprintf(bin, sizeof(bin), "%s/main", dir);
+    CompilerOptions opts = { .script_mode = true, .use_embedded_runtime = true };
+    Compiler* c = omni_compiler_new_with_options(&opts);
+
+    /* Each module runs in a function of its own */
+    char* code = omni_compiler_compile_file_to_c(c, main_path);
+    ASSERT(code != NULL);
+    char* main_fn = strstr(code, "int main(void)");
+    ASSERT(main_fn != NULL);
+    ASSERT(strstr(code, "static void _module_") != NULL);
+    ASSERT(strstr(main_fn, "_module_") != NULL);
+    free(code);
+
+    ASSERT(omni_compiler_compile_file_to_binary(c, main_path, bin));
+    FILE* p = popen(bin, "r");
+    char out[64];
+    size_t n = p ? fread(out, 1, sizeof(out) - 1, p) : 0;
+    out[n] = '\0';
+    ASSERT(p && pclose(p) == 0);
+    ASSERT(strcmp(out, "helpers util 36") == 0);
+    omni_compiler_free(c);
+
+    const char* files[] = { "lib/util.omni", "lib/helpers.omni", "main.omni", "main" };
+    remove_modules(dir, files, 4);
+}
+
+TEST(test_private_names_stay_in_their_module) {
+    char dir[] = "/tmp/omni_test_import_XXXXXX";
+    ASSERT(mkdtemp(dir) != NULL);
+    write_module(dir, "lib/util.omni",
+                 "(provide square)\n"
+                 "(define (helper x) (* x x))\n"
+                 "(define (square x) (helper x))");
+    write_module(dir, "main.omni", "(import \"lib/util.omni\")\n(helper 3)");
+
+    char main_path[512], expected[1024];
+    snprintf(main_path, sizeof(main_path), "%s/main.omni", dir);
+    Compiler* c = omni_compiler_new();
+    ASSERT(omni_compiler_compile_file_to_c(c, main_path) == NULL);
+    ASSERT(omni_compiler_error_count(c) == 1);
+    snprintf(expected, sizeof(expected),
+             "%s:2:1: E0001 unbound symbol: helper (%s/lib/util.omni does not provide it)",
+             main_path, dir);
+    ASSERT(strncmp(omni_compiler_get_error(c, 0), expected, strlen(expected)) == 0);
+    omni_compiler_free(c);
+
+    const char* files[] = { "lib/util.omni", "main.omni" };
+    remove_modules(dir, files, 2);
+}
+
+/* A module sees what the modules it imports provide, not what they import */
+TEST(test_provides_reach_only_direct_importers) {
+    char dir[] = "/tmp/omni_test_import_XXXXXX";
+    ASSERT(mkdtemp(dir) != NULL);
+    write_module(dir, "lib/b.omni", "(provide fb)\n(define (fb) 41)");
+    write_module(dir, "lib/a.omni", "(import \"b.omni\")\n(provide fa)\n(define (fa) (fb))");
+    write_module(dir, "main.omni", "(import \"lib/a.omni\")\n(fb)");
+
+    char main_path[512], expected[1024];
+    snprintf(main_path, sizeof(main_path), "%s/main.omni", dir);
+    Compiler* c = omni_compiler_new();
+    ASSERT(omni_compiler_compile_file_to_c(c, main_path) == NULL);
+    ASSERT(omni_compiler_error_count(c) == 1);
+    snprintf(expected, sizeof(expected),
+             "%s:2:1: E0001 unbound symbol: fb (defined in %s/lib/b.omni, which is not imported here)",
+             main_path, dir);
+    ASSERT(strncmp(omni_compiler_get_error(c, 0), expected, strlen(expected)) == 0);
+    omni_compiler_free(c);
+
+    const char* files[] = { "lib/a.omni", "lib/b.omni", "main.omni" };
+    remove_modules(dir, files, 3);
+}
+
+/* Each module's definitions are its own: an importer may redefine a name
+ * it imports, and modules may keep private names that are the same */
+TEST(test_modules_have_their_own_names) {
+    char dir[] = "/tmp/omni_test_import_XXXXXX";
+    ASSERT(mkdtemp(dir) != NULL);
+    write_module(dir, "lib/b.omni",
+                 "(provide fb get-b)\n"
+                 "(define (helper) 4)\n"
+                 "(define (fb) (helper))\n"
+                 "(define (get-b) (fb))");
+    write_module(dir, "lib/c.omni", "(provide get-c)\n(define (helper) 5)\n(define (get-c) (helper))");
+    write_module(dir, "main.omni",
+                 "(import \"lib/b.omni\" \"lib/c.omni\")\n"
+                 "(define (fb) 1)\n"
+                 "(display (fb)) (display (get-b)) (display (get-c))");
+
+    char main_path[512], bin[512];
+    snprintf(main_path, sizeof(main_path), "%s/main.omni", dir);
+    snprintf(bin, sizeof(bin), "%s/main", dir);
+    CompilerOptions opts = { .script_mode = true, .use_embedded_runtime = true };
+    Compiler* c = omni_compiler_new_with_options(&opts);
+    ASSERT(omni_compiler_compile_file_to_binary(c, main_path, bin));
+    FILE* p = popen(bin, "r");
+    char out[64];
+    size_t n = p ? fread(out, 1, sizeof(out) - 1, p) : 0;
+    out[n] = '\0';
+    ASSERT(p && pclose(p) == 0);
+    ASSERT(strcmp(out, "145") == 0);
+    omni_compiler_free(c);
+
+    const char* files[] = { "lib/b.omni", "lib/c.omni", "main.omni", "main" };
+    remove_modules(dir, files, 4);
+}
+
+TEST(test_import_errors) {
+    char dir[] = "/tmp/omni_test_import_XXXXXX";
+    ASSERT(mkdtemp(dir) != NULL);
+    write_module(dir, "lib/a.omni", "(import \"b.omni\")");
+    write_module(dir, "lib/b.omni", "(import \"a.omni\")");
+    write_module(dir, "lib/c.omni", "(provide nope)\n(define (f) 1)");
+    write_module(dir, "main.omni",
+                 "(import \"lib/a.omni\" \"lib/c.omni\" \"missing.omni\")");
+
+    char main_path[512], expected[1024];
+    snprintf(main_path, sizeof(main_path), "%s/main.omni", dir);
+    Compiler* c = omni_compiler_new();
+    ASSERT(omni_compiler_compile_file_to_c(c, main_path) == NULL);
+    ASSERT(omni_compiler_error_count(c) == 3);
+
+    snprintf(expected, sizeof(expected),
+             "%s/lib/b.omni:1:9: E0009 import cycle: %s/lib/a.omni -> %s/lib/b.omni -> %s/lib/a.omni",
+             dir, dir, dir, dir);
+    ASSERT(strncmp(omni_compiler_get_error(c, 0), expected, strlen(expected)) == 0);
+    ASSERT(strstr(omni_compiler_get_error(c, 1), "/lib/c.omni provides nope, which it does not define"));
+    ASSERT(strstr(omni_compiler_get_error(c, 2), "missing.omni: No such file or directory"));
+    omni_compiler_free(c);
+
+    /* import and provide are only read at the top level of a file */
+    c = omni_compiler_new();
+    ASSERT(omni_compiler_compile_to_c(c, "(let ((x 1)) (import \"lib/c.omni\"))") == NULL);
+    ASSERT(strcmp(omni_compiler_get_error(c, 0), "E0009 (import \"lib/c.omni\"): import is only "
+                  "allowed at the top level of a file") == 0);
+    omni_compiler_free(c);
+
+    const char* files[] = { "lib/a.omni", "lib/b.omni", "lib/c.omni", "main.omni" };
+    remove_modules(dir, files, 4);
+}
+
+TEST(test_imports_read_from_memory) {
+    /* Unsaved buffers: the files exist nowhere on disk */
+    OmniFS* fs = omni_fs_memory_new(NULL);
+    omni_fs_memory_put(fs, "/buffers/lib/util.omni", "(provide sq)\n(define (sq x) (* x x))");
+    omni_fs_memory_put(fs, "/buffers/main.omni", "(import \"lib/util.omni\")\n(display (sq 7))");
+    CompilerOptions opts = { .script_mode = true, .use_embedded_runtime = true, .fs = fs };
+    Compiler* c = omni_compiler_new_with_options(&opts);
+
+    char bin[] = "/tmp/omni_test_fs_XXXXXX";
+    int fd = mkstemp(bin);
+    ASSERT(fd >= 0);
+    close(fd);
+    ASSERT(omni_compiler_compile_file_to_binary(c, "/buffers/main.omni", bin));
+    FILE* p = popen(bin, "r");
+    char out[64];
+    size_t n = p ? fread(out, 1, sizeof(out) - 1, p) : 0;
+    out[n] = '\0';
+    ASSERT(p && pclose(p) == 0);
+    ASSERT(strcmp(out, "49") == 0);
+    unlink(bin);
+
+    ASSERT(omni_compiler_compile_file_to_c(c, "/buffers/other.omni") == NULL);
+    ASSERT(strstr(omni_compiler_get_error(c, 0), "Cannot open file: /buffers/other.omni") != NULL);
+    omni_compiler_free(c);
+    omni_fs_memory_free(fs);
+}
+
+/* ========== Macros ========== */
+
+TEST(test_macros_expand_before_compiling) {
+    CompilerOptions opts = { .script_mode = true, .use_embedded_runtime = true };
+    char out[64];
+    ASSERT(run_program_with(&opts,
+                            "(defmacro my-or (a b) `(let ((tmp ,a)) (if tmp tmp ,b)))\n"
+                            "(defmacro unless (c . body) `(if ,c 0 (do ,@body)))\n"
+                            "(define tmp 5)\n"
+                            "(define (pick x) (my-or x tmp))\n"
+                            "(display (pick 0)) (display (pick 3)) (display (unless 0 7))",
+                            out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "537") == 0);
+}
+
+TEST(test_macros_cross_modules) {
+    char dir[] = "/tmp/omni_test_import_XXXXXX";
+    ASSERT(mkdtemp(dir) != NULL);
+    write_module(dir, "lib/m.omni", "(provide sq)\n(defmacro twice (x) `(+ ,x ,x))\n(define (sq x) (* x x))");
+
+    char main_path[512];
+    snprintf(main_path, sizeof(main_path), "%s/main.omni", dir);
+    OmniSource unit = { main_path, "(import \"lib/m.omni\")\n(display (twice (sq 3)))" };
+    Compiler* c = omni_compiler_new();
+    char* expanded = omni_compiler_expand_units(c, &unit, 1);
+    ASSERT(expanded != NULL);
+    ASSERT(strcmp(expanded, "(define (sq x) (* x x))\n(display (+ (sq 3) (sq 3)))\n") == 0);
+    free(expanded);
+    omni_compiler_free(c);
+
+    const char* files[] = { "lib/m.omni" };
+    remove_modules(dir, files, 1);
+}
+
+TEST(test_macro_errors_point_at_the_call) {
+    Compiler* c = omni_compiler_new();
+    OmniSource unit = { "main.omni", "(defmacro two (a b) `(+ ,a ,b))\n(display (two 1))" };
+    ASSERT(omni_compiler_compile_units_to_c(c, &unit, 1) == NULL);
+    ASSERT(omni_compiler_error_count(c) == 1);
+    const char* expected = "main.omni:2:10: E0010 expanding (two 1): expects 2 arguments, got 1";
+    ASSERT(strncmp(omni_compiler_get_error(c, 0), expected, strlen(expected)) == 0);
+
+    /* Errors in the expansion are reported where the macro was called */
+    unit.text = "(defmacro use-y () `(+ y 1))\n\n(display (use-y))";
+    ASSERT(omni_compiler_compile_units_to_c(c, &unit, 1) == NULL);
+    expected = "main.omni:3:10: E0001 unbound symbol: y";
+    ASSERT(strncmp(omni_compiler_get_error(c, 0), expected, strlen(expected)) == 0);
+    omni_compiler_free(c);
+}
+
+TEST(test_deftype_across_modules) {
+    /* Providing the type provides its constructor, predicate and fields */
+    OmniFS* fs = omni_fs_memory_new(NULL);
+    omni_fs_memory_put(fs, "lib/tree.omni",
+                       "(provide Node)\n(deftype Node (val int) (kids Node) (parent Node))");
+    omni_fs_memory_put(fs, "main.omni",
+                       "(import \"lib/tree.omni\")\n"
+                       "(define n (Node 1 '() '()))\n"
+                       "(set-Node-val! n 2)\n"
+                       "(display (cons (Node? n) (Node-val n)))");
+    CompilerOptions opts = { .script_mode = true, .use_embedded_runtime = true, .fs = fs };
+    Compiler* c = omni_compiler_new_with_options(&opts);
+    char* code = omni_compiler_compile_file_to_c(c, "main.omni");
+    ASSERT(code != NULL);
+    /* parent is a back edge, so the object neither counts nor releases it */
+    ASSERT(strstr(code, "static const char* const _fields_o_Node[] = {\"val\", \"kids\", \"parent\"};") != NULL);
+    ASSERT(strstr(code, "static const UserType _type_o_Node = { \"Node\", 3, _fields_o_Node, 0x4ULL, NULL, 0 };") != NULL);
+    free(code);
+
+    /* A malformed deftype is reported where it is */
+    omni_fs_memory_put(fs, "main.omni", "(import \"lib/tree.omni\")\n(deftype Leaf\n  (v int :strong))");
+    ASSERT(omni_compiler_compile_file_to_c(c, "main.omni") == NULL);
+    const char* expected = "main.omni:3:3: E0002 (deftype Leaf (v int :strong)): expected (deftype Name (field type [:weak]) ...)";
+    ASSERT(strncmp(omni_compiler_get_error(c, 0), expected, strlen(expected)) == 0);
+    omni_compiler_clear_errors(c);
+
+    /* Patterns name the fields in order, all of them */
+    omni_fs_memory_put(fs, "main.omni",
+                       "(import \"lib/tree.omni\")\n(match 1\n  ((Node v) v))");
+    ASSERT(omni_compiler_compile_file_to_c(c, "main.omni") == NULL);
+    expected = "main.omni:3:4: E0002 (Node v): Node has 3 fields, the pattern gives 1";
+    ASSERT(strncmp(omni_compiler_get_error(c, 0), expected, strlen(expected)) == 0);
+    omni_compiler_free(c);
+    omni_fs_memory_free(fs);
+}
+
+/* ========== Language Levels ========== */
+
+TEST(test_lang_levels_gate_forms_per_file) {
+    OmniFS* fs = omni_fs_memory_new(NULL);
+    omni_fs_memory_put(fs, "lib/old.omni", "#lang purple/1\n(define (sq x) (* x x))");
+    CompilerOptions opts = { .use_embedded_runtime = true, .fs = fs };
+    Compiler* c = omni_compiler_new_with_options(&opts);
+
+    /* A purple/1 module is imported by a purple/2 program */
+    OmniSource unit = { "main.omni", "#!/usr/bin/env omnilisp\n#lang purple/2\n"
+                                     "(import \"lib/old.omni\")\n(display (sq 3))" };
+    char* code = omni_compiler_compile_units_to_c(c, &unit, 1);
+    ASSERT(code != NULL);
+    free(code);
+
+    /* Without #lang a file is at the options' level */
+    omni_compiler_free(c);
+    opts.lang = 1;
+    c = omni_compiler_new_with_options(&opts);
+    unit.text = "(defmacro twice (x) `(+ ,x ,x))\n(provide twice)";
+    ASSERT(omni_compiler_compile_units_to_c(c, &unit, 1) == NULL);
+    ASSERT(omni_compiler_error_count(c) == 2);
+    const char* e = omni_compiler_get_error(c, 0);
+    ASSERT(strstr(e, "main.omni:1:1: E0012 defmacro needs #lang purple/2; main.omni is purple/1") == e);
+    e = omni_compiler_get_error(c, 1);
+    ASSERT(strstr(e, "main.omni:2:1: E0012 provide needs #lang purple/2") == e);
+
+    unit.text = "#lang purple/2\n(defmacro twice (x) `(+ ,x ,x))\n(display (twice 2))";
+    code = omni_compiler_compile_units_to_c(c, &unit, 1);
+    ASSERT(code != NULL);
+    free(code);
+    omni_compiler_free(c);
+    omni_fs_memory_free(fs);
+}
+
+TEST(test_unknown_lang_levels_are_errors) {
+    ASSERT(omni_lang_parse("purple/1") == 1);
+    ASSERT(omni_lang_parse("purple/2") == OMNI_LANG_LATEST);
+    ASSERT(omni_lang_parse("purple/3") == 0);
+    ASSERT(omni_lang_parse("purple/") == 0);
+    ASSERT(omni_lang_parse("purple/2x") == 0);
+    ASSERT(omni_lang_parse("racket") == 0);
+
+    Compiler* c = omni_compiler_new();
+    OmniSource unit = { "main.omni", "; newer\n#lang purple/9\n(display 1)" };
+    ASSERT(omni_compiler_compile_units_to_c(c, &unit, 1) == NULL);
+    ASSERT(omni_compiler_error_count(c) == 1);
+    const char* e = omni_compiler_get_error(c, 0);
+    ASSERT(strstr(e, "main.omni:2:1: E0012 unknown language purple/9: this compiler knows "
+                     "purple/1 to purple/2") == e);
+    omni_compiler_free(c);
+}
+
+TEST(test_deprecated_behaviour_warns_per_policy) {
+    OmniSource unit = { "main.omni", "(define x 1)\n(display (if 0 x (/ x 0)))" };
+    CompilerOptions opts = { .use_embedded_runtime = true };
+    Compiler* c = omni_compiler_new_with_options(&opts);
+    ASSERT(omni_compiler_check_units(c, &unit, 1));
+    ASSERT(omni_compiler_warning_count(c) == 2);
+    const char* w = omni_compiler_get_warning(c, 0);
+    ASSERT(strstr(w, "main.omni:2:14: D0001 (if 0 x (/ x 0)) tests 0") == w);
+    ASSERT(strstr(w, "(deprecated; see --explain D0001)") != NULL);
+    w = omni_compiler_get_warning(c, 1);
+    ASSERT(strstr(w, "main.omni:2:18: D0002 (/ x 0) divides by 0") == w);
+    omni_compiler_free(c);
+
+    /* -Werror=deprecated, with one code allowed by the file */
+    opts.deprecations = OMNI_DEPRECATED_ERROR;
+    c = omni_compiler_new_with_options(&opts);
+    unit.text = "; allow-deprecated D0002\n(define x 1)\n(display (if 0 x (/ x 0)))";
+    ASSERT(!omni_compiler_check_units(c, &unit, 1));
+    ASSERT(omni_compiler_error_count(c) == 1);
+    const char* e = omni_compiler_get_error(c, 0);
+    ASSERT(strstr(e, "main.omni:3:14: D0001") == e);
+    ASSERT(strstr(e, "(-Werror=deprecated)") != NULL);
+    omni_compiler_free(c);
+
+    /* -Wno-deprecated */
+    opts.deprecations = OMNI_DEPRECATED_ALLOW;
+    c = omni_compiler_new_with_options(&opts);
+    ASSERT(omni_compiler_check_units(c, &unit, 1));
+    ASSERT(omni_compiler_warning_count(c) == 0);
+    omni_compiler_free(c);
+}
+
+/* ========== Temporary Files ========== */
+
+/* Whether dir/name exists */
+static bool temp_exists(const char* dir, const char* name) {
+    char path[512];
+    snprintf(path, sizeof(path), "%s/%s", dir, name);
+    return access(path, F_OK) == 0;
+}
+
+TEST(test_temp_files_share_a_session) {
+    /* Start a fresh session under our own PURPLE_TMPDIR */
+    omni_compiler_cleanup();
+    char root[] = "/tmp/omni_test_tmpdir_XXXXXX";
+    ASSERT(mkdtemp(root) != NULL);
+    setenv("PURPLE_TMPDIR", root, 1);
+
+    CompilerOptions opts = { .use_embedded_runtime = true, .keep_temps = true };
+    Compiler* keep = omni_compiler_new_with_options(&opts);
+    char* first = omni_compiler_temp_path(keep, "");
+    ASSERT(first != NULL);
+    const char* dir = omni_compiler_temp_dir();
+    ASSERT(dir != NULL && strncmp(dir, root, strlen(root)) == 0);
+    ASSERT(strncmp(first, dir, strlen(dir)) == 0 && strcmp(first + strlen(dir), "/1") == 0);
+
+    /* A kept build leaves its source and object named after the output */
+    ASSERT(omni_compiler_compile_to_binary(keep, "(+ 1 2)", first));
+    ASSERT(temp_exists(dir, "1") && temp_exists(dir, "1.c") && temp_exists(dir, "1.o"));
+
+    /* Other compilers reuse the directory and clean up after themselves */
+    Compiler* tidy = omni_compiler_new();
+    char* second = omni_compiler_temp_path(tidy, "");
+    ASSERT(strncmp(second, dir, strlen(dir)) == 0 && strcmp(second + strlen(dir), "/2") == 0);
+    ASSERT(omni_compiler_compile_to_binary(tidy, "(+ 1 2)", second));
+    ASSERT(temp_exists(dir, "2") && !temp_exists(dir, "2.c") && !temp_exists(dir, "2.o"));
+    omni_compiler_remove_temp(tidy, second);
+    ASSERT(!temp_exists(dir, "2"));
+
+    const char* kept[] = { "1", "1.c", "1.o", ".keep" };
+    char* session = strdup(dir);
+    for (size_t i = 0; i < sizeof(kept) / sizeof(kept[0]); i++) {
+        char path[512];
+        snprintf(path, sizeof(path), "%s/%s", session, kept[i]);
+        unlink(path);
+    }
+    free(first);
+    free(second);
+    omni_compiler_free(keep);
+    omni_compiler_free(tidy);
+
+    /* Closing the session removes the emptied directory */
+    omni_compiler_cleanup();
+    ASSERT(access(session, F_OK) != 0);
+    free(session);
+    unsetenv("PURPLE_TMPDIR");
+    ASSERT(rmdir(root) == 0);
+}
+
+/* ========== Errors ========== */
+
+TEST(test_error_forms_map_to_prims) {
+    CompilerOptions opts = { .use_embedded_runtime = true };
+    Compiler* c = omni_compiler_new_with_options(&opts);
+
+    char* code = omni_compiler_compile_to_c(c,
+        "(error-data (error 'oops 42))\n"
+        "(error? (error 'bare))");
+    ASSERT(code != NULL);
+    char* main_fn = strstr(code, "int main(void)");
+    ASSERT(main_fn != NULL);
+    ASSERT(strstr(main_fn, "prim_error_data(prim_error(") != NULL);
+    ASSERT(strstr(main_fn, "prim_is_error(prim_error(") != NULL);
+    ASSERT(strstr(main_fn, ", NIL)") != NULL);
+
+    free(code);
+    omni_compiler_free(c);
+}
+
+TEST(test_errors_carry_a_tag_and_trace) {
+    const char* src =
+        "(define (inner x) (if (= x 0) (error 'not-found x) (inner (- x 1))))\n"
+        "(define (outer x) (inner x))\n"
+        "(define e (outer 2))\n"
+        "(error-tag e)\n"
+        "(error-payload e)\n"
+        "(error-tag (error e))\n"
+        "(error-tag (error \"plain\"))\n"
+        "(error-tag 5)\n"
+        "(error-trace e)";
+    char out[256];
+    ASSERT(run_program(src, out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "not-found\n0\nnot-found\nerror\n()\n()") == 0);
+
+    /* -g builds keep the function stack, innermost first */
+    CompilerOptions opts = { .use_embedded_runtime = true, .emit_debug_info = true };
+    ASSERT(run_program_with(&opts, src, out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "not-found\n0\nnot-found\nerror\n()\n(inner inner inner outer)") == 0);
+}
+
+/* ========== Logical Forms ========== */
+
+TEST(test_and_or_empty_and_single) {
+    char out[256];
+    ASSERT(run_program("(and)", out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "1") == 0);
+    ASSERT(run_program("(or)", out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "()") == 0);
+    ASSERT(run_program("(let ((x 5)) (cons (and x) (cons x '())))", out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "(5 5)") == 0);
+}
+
+TEST(test_and_mixed_ownership) {
+    char out[256];
+    /* A borrowed operand selected as the result must stay alive */
+    ASSERT(run_program("(let ((x 7)) (cons (and 1 x) (cons x '())))", out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "(7 7)") == 0);
+    ASSERT(run_program("(let ((a 1) (b 0)) (cons (and a 2 b 3) (cons a (cons b '()))))",
+                       out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "(0 1 0)") == 0);
+    ASSERT(run_program("(let ((a 1) (b 2)) (cons (and a 3 b 4 a) (cons b '())))",
+                       out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "(1 2)") == 0);
+}
+
+TEST(test_or_mixed_ownership) {
+    char out[256];
+    ASSERT(run_program("(let ((x 0) (y 3)) (cons (or x y) (cons y '())))", out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "(3 3)") == 0);
+    ASSERT(run_program("(let ((x 0)) (cons (or x 0 x) (cons x '())))", out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "(0 0)") == 0);
+    ASSERT(run_program("(let ((y 6)) (or 0 0 0 y 9))", out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "6") == 0);
+}
+
+TEST(test_when_unless_and_one_armed_if) {
+    char out[256];
+    /* The missing arm is nil and owns nothing */
+    ASSERT(run_program("(define (f x) (if (> x 0) (cons x '())))\n"
+                       "(cons (f 1) (cons (f -1) '()))", out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "((1) ())") == 0);
+    ASSERT(run_program("(let ((x (cons 1 '()))) (cons (when (> 2 1) (display 5) x) (cons (unless (> 2 1) x) x)))",
+                       out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "5((1) () 1)") == 0);
+
+    size_t n;
+    char* e = first_error("(if 1 2 3 4)", &n, NULL, 0);
+    ASSERT(e && strcmp(e, "E0002 (if 1 2 3 4): expected (if test then [else])") == 0);
+    e = first_error("(define (f) (if))", &n, NULL, 0);
+    ASSERT(e && strcmp(e, "E0002 (if): expected (if test then [else])") == 0);
+}
+
+TEST(test_and_or_short_circuit) {
+    char out[256];
+    ASSERT(run_program("(and 1 0 (display 5))", out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "0") == 0);
+    ASSERT(run_program("(or 0 2 (display 5))", out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "2") == 0);
+}
+
+/* ========== Evaluation Order ========== */
+
+TEST(test_call_args_left_to_right) {
+    char out[256];
+    ASSERT(run_program("(+ (do (display 1) 1) (do (display 2) 2))", out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "123") == 0);
+    ASSERT(run_program("(define (f a b c) (cons a (cons b (cons c '()))))\n"
+                       "(f (do (display 1) 1) 0 (do (display 2) 2))",
+                       out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "12(1 0 2)") == 0);
+}
+
+TEST(test_operator_before_args) {
+    char out[256];
+    ASSERT(run_program("((do (display 0) (lambda (a b) a)) (do (display 1) 1) (do (display 2) 2))",
+                       out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "0121") == 0);
+    ASSERT(run_program("((do (display 0) car) (do (display 1) '(1)))", out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "011") == 0);
+}
+
+TEST(test_nested_args_left_to_right) {
+    char out[256];
+    ASSERT(run_program("(cons (do (display 1) 1) (cons (do (display 2) 2) (cons (do (display 3) 3) '())))",
+                       out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "123(1 2 3)") == 0);
+    ASSERT(run_program("(- (+ (do (display 1) 1) (do (display 2) 2)) (do (display 3) 3))",
+                       out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "1230") == 0);
+}
+
+TEST(test_let_bindings_left_to_right) {
+    char out[256];
+    ASSERT(run_program("(let ((a (do (display 1) 1)) (b (do (display 2) 2))) (- a b))",
+                       out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "12-1") == 0);
+}
+
+/* ========== Nesting ========== */
+
+/* Deepest nesting of statement expressions in code */
+static int statement_expression_depth(const char* code) {
+    int depth = 0, deepest = 0;
+    for (const char* p = code; p[0] && p[1]; p++) {
+        if (p[0] == '(' && p[1] == '{' && ++depth > deepest) deepest = depth;
+        if (p[0] == '}' && p[1] == ')') depth--;
+    }
+    return deepest;
+}
+
+TEST(test_nested_forms_stay_flat) {
+    /* 300 levels of let, if and cond: as many nested ({ }) would be
+     * more than gcc copes with in one function */
+    size_t levels = 300;
+    size_t cap = levels * 96 + 256;
+    char* src = malloc(cap);
+    size_t len = (size_t)snprintf(src, cap, "(define (deep a)\n");
+    for (size_t i = 0; i < levels; i++) {
+        len += (size_t)snprintf(src + len, cap - len,
+                                "(let ((v%zu (+ a 1))) (if (> v%zu 0) (cond ((= v%zu 0) 0) (else ",
+                                i, i, i);
+    }
+    len += (size_t)snprintf(src + len, cap - len, "a");
+    for (size_t i = 0; i < levels; i++) len += (size_t)snprintf(src + len, cap - len, ")) 0))");
+    snprintf(src + len, cap - len, ")\n(deep 7)");
+
+    Compiler* c = omni_compiler_new();
+    char* code = omni_compiler_compile_to_c(c, src);
+    ASSERT(code != NULL);
+    ASSERT(statement_expression_depth(code) <= 2);
+    free(code);
+    omni_compiler_free(c);
+
+    char out[64];
+    ASSERT(run_program(src, out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "7") == 0);
+    free(src);
+}
+
+TEST(test_flat_bindings_keep_their_scope) {
+    char out[256];
+    /* A binding's init still sees the name it shadows */
+    ASSERT(run_program("(let ((x 1)) (let ((x (+ x 1))) x))", out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "2") == 0);
+    /* Sibling blocks may reuse a name */
+    ASSERT(run_program("(do (let ((a 1)) a) (let ((a 2)) (+ a 40)))", out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "42") == 0);
+    ASSERT(run_program("(define (f n) (let ((x n)) (if (> x 3) (let ((x (* x 2))) x) "
+                       "(cond ((= x 1) 'one) ((let ((y (- x 2))) (if (= y 0) 'two '())))"
+                       " (else (do (define z 5) z))))))\n"
+                       "(cons (f 1) (cons (f 2) (cons (f 3) (cons (f 5) '()))))",
+                       out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "(one two 5 10)") == 0);
+}
+
+TEST(test_local_ints_and_pairs_on_the_stack) {
+    const char* src = "(define (f n) (let ((a 5) (p (cons n (* n 2)))) (display (car p)) (+ a (cdr p))))\n(f 3)";
+    Compiler* c = omni_compiler_new();
+    char* code = omni_compiler_compile_to_c(c, src);
+    ASSERT(code != NULL);
+    ASSERT(strstr(code, "STACK_INT(o_a, 5);") != NULL);
+    ASSERT(strstr(code, "STACK_CELL(o_p, ") != NULL);
+    free(code);
+
+    /* Returned, captured, passed to a function or set: on the heap */
+    code = omni_compiler_compile_to_c(c,
+        "(define (g x) x)\n"
+        "(define (f n) (let ((p (cons n n)) (q (cons n n)) (r (cons n n)) (s 1))"
+        " (g q) (set! s 2) (cons (lambda () (car r)) (cons p s))))\n(f 1)");
+    ASSERT(code != NULL);
+    ASSERT(strstr(code, "STACK_CELL(o_") == NULL);
+    ASSERT(strstr(code, "STACK_INT(o_") == NULL);
+    free(code);
+    omni_compiler_free(c);
+
+    char out[64];
+    ASSERT(run_program(src, out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "311") == 0);
+}
+
+TEST(test_dead_pairs_are_reused) {
+    /* In a closure, where the pairs cannot go on the stack */
+    const char* src =
+        "(define (f xs) (map (lambda (x) (let ((p (cons x xs)))"
+        " (let ((q (cons (+ (car p) 10) (cdr p)))) (let ((r (cons (car q) (length (cdr q))))) r)))) xs))\n"
+        "(f (cons 2 (cons 3 '())))";
+    Compiler* c = omni_compiler_new();
+    char* code = omni_compiler_compile_to_c(c, src);
+    ASSERT(code != NULL);
+    ASSERT(strstr(code, "Obj* o_q = REUSE_OR_NEW_CELL(o_p, ") != NULL);
+    ASSERT(strstr(code, "Obj* o_r = REUSE_OR_NEW_CELL(o_q, ") != NULL);
+    ASSERT(c->reuses == 2);
+    free(code);
+
+    /* Used after the cons, in a closure, or by a cons that runs repeatedly */
+    code = omni_compiler_compile_to_c(c,
+        "(define (f xs) (let ((p (cons 1 xs))) (let ((q (cons 2 (cdr p)))) (cons (car p) q))))\n"
+        "(define (g xs) (let ((p (cons 1 xs))) (lambda () (let ((q (cons (car p) 2))) q))))\n"
+        "(define (h xs) (let ((p (cons 1 xs))) (map (lambda (x) (let ((q (cons x (car p)))) q)) xs)))\n"
+        "(f '(3))");
+    ASSERT(code != NULL);
+    ASSERT(strstr(code, "REUSE_OR_NEW_CELL(o_") == NULL);
+    ASSERT(c->reuses == 0);
+    free(code);
+    omni_compiler_free(c);
+
+    char out[64];
+    ASSERT(run_program(src, out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "((12 . 2) (13 . 2))") == 0);
+}
+
+TEST(test_dead_pairs_are_freed_at_last_use) {
+    /* In closures, where the pairs cannot go on the stack */
+    const char* src =
+        "(define (f xs) (map (lambda (x) (let ((p (cons x xs)) (n (length p))) (display p) (+ n x))) xs))\n"
+        "(define (g k) ((lambda (x) (let ((p (cons x (quote ())))) (let loop ((i 0)) (if (= i 2) (length p)"
+        " (let ((q (cons i p))) (display (length q)) (loop (+ i 1))))))) k))\n"
+        "(g 0)\n(f (cons 2 (cons 3 '())))";
+    Compiler* c = omni_compiler_new();
+    char* code = omni_compiler_compile_to_c(c, src);
+    ASSERT(code != NULL);
+    ASSERT(strstr(code, "omni_print(o_p);\n        free_tree(o_p); /* last use of p */") != NULL);
+    ASSERT(strstr(code, "free_tree(o_q); /* last use of q */") != NULL);
+    ASSERT(c->frees == 2);
+    free(code);
+
+    /* A part taken out, a use in the last form or a cons taking it over */
+    code = omni_compiler_compile_to_c(c,
+        "(define (f xs) (map (lambda (x) (let ((p (cons (cons x x) xs)) (y (car p))) (display p) y)) xs))\n"
+        "(define (g xs) (map (lambda (x) (let ((p (cons x xs))) (display p) (length p))) xs))\n"
+        "(define (h xs) (map (lambda (x) (let ((p (cons x xs))) (let ((q (cons (length p) 1))) q))) xs))\n"
+        "(f '(3))");
+    ASSERT(code != NULL);
+    ASSERT(strstr(code, "last use of") == NULL);
+    ASSERT(c->frees == 0);
+    free(code);
+    omni_compiler_free(c);
+
+    char out[64];
+    ASSERT(run_program(src, out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "221\n(2 2 3)(3 2 3)(5 6)") == 0);
+}
+
+TEST(test_check_reports_without_building) {
+    Compiler* c = omni_compiler_new();
+    OmniSource good[] = { { "lib.omni", "(define (sq n) (* n n))" }, { "main.omni", "(sq 3)" } };
+    ASSERT(omni_compiler_check_units(c, good, 2));
+    ASSERT(omni_compiler_error_count(c) == 0);
+
+    OmniSource bad[] = { { "main.omni", "(define (f x) (+ x y))\n(f 1 2)" } };
+    ASSERT(!omni_compiler_check_units(c, bad, 1));
+    ASSERT(omni_compiler_error_count(c) == 2);
+    ASSERT(strstr(omni_compiler_get_error(c, 0), "main.omni:1:20: E0001 unbound symbol: y") != NULL);
+    ASSERT(strstr(omni_compiler_get_error(c, 1), "E0011") != NULL);
+    ASSERT(omni_compiler_phase_time(c, OMNI_PHASE_CC) == 0.0);
+
+    /* A later build still has its runtime */
+    char* code = omni_compiler_compile_to_c(c, "(+ 1 2)");
+    ASSERT(code != NULL);
+    ASSERT(strstr(code, "static Obj* mk_cell(") != NULL);
+    free(code);
+    omni_compiler_free(c);
+}
+
+/* ========== Timers ========== */
+
+TEST(test_timings_table_lists_every_phase) {
+    Compiler* c = omni_compiler_new();
+    char path[] = "/tmp/omni_test_prog_XXXXXX";
+    int fd = mkstemp(path);
+    ASSERT(fd >= 0);
+    close(fd);
+    ASSERT(omni_compiler_compile_to_binary(c,
+        "(defmacro twice (x) `(+ ,x ,x))\n(twice 21)", path));
+    unlink(path);
+    for (int i = 0; i < OMNI_PHASE_COUNT; i++) {
+        ASSERT(omni_compiler_phase_time(c, (CompilerPhase)i) > 0.0);
+    }
+
+    /* A header, one row per phase in pipeline order, then the total */
+    char out[1024];
+    FILE* f = fmemopen(out, sizeof(out), "w");
+    omni_compiler_print_timings(c, f);
+    fclose(f);
+    const char* rows[] = { "phase ", "parse ", "expansion ", "analysis ", "C emission ",
+                           "cc ", "link ", "total " };
+    const char* line = out;
+    for (size_t i = 0; i < sizeof(rows) / sizeof(rows[0]); i++) {
+        ASSERT(strncmp(line, rows[i], strlen(rows[i])) == 0);
+        line = strchr(line, '\n');
+        ASSERT(line != NULL);
+        line++;
+    }
+    ASSERT(*line == '\0');
+    ASSERT(strstr(out, "%\n") != NULL);
+
+    omni_compiler_reset_timings(c);
+    ASSERT(omni_compiler_phase_time(c, OMNI_PHASE_EXPAND) == 0.0);
+    omni_compiler_free(c);
+}
+
+
+TEST(test_long_programs_run_in_chunks) {
+    /* 200 forms: main calls chunks of them, in order */
+    size_t forms = 200;
+    size_t cap = forms * 32 + 128;
+    char* src = malloc(cap);
+    size_t len = (size_t)snprintf(src, cap, "(define n 0)\n");
+    for (size_t i = 0; i < forms; i++) {
+        len += (size_t)snprintf(src + len, cap - len,
+                                i == 100 ? "(define (inc x) (+ x 1))\n" : "(define n (inc n))\n");
+    }
+    snprintf(src + len, cap - len, "n");
+
+    Compiler* c = omni_compiler_new();
+    char* code = omni_compiler_compile_to_c(c, src);
+    ASSERT(code != NULL);
+    ASSERT(strstr(code, "static void _chunk_3(void)") != NULL);
+    ASSERT(strstr(code, "_chunk_3();") != NULL);
+    free(code);
+    omni_compiler_free(c);
+
+    char out[64];
+    ASSERT(run_program(src, out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "199") == 0);
+    free(src);
+}
+
+TEST(test_large_literals_get_builders) {
+    /* (0 1 ... 99) with a vector of 70 symbols in place of 50 */
+    char src[1024];
+    size_t len = (size_t)snprintf(src, sizeof(src), "(define (data) '(");
+    for (int i = 0; i < 100; i++) {
+        if (i != 50) {
+            len += (size_t)snprintf(src + len, sizeof(src) - len, "%d ", i);
+            continue;
+        }
+        len += (size_t)snprintf(src + len, sizeof(src) - len, "[");
+        for (int j = 0; j < 70; j++) len += (size_t)snprintf(src + len, sizeof(src) - len, "x ");
+        len += (size_t)snprintf(src + len, sizeof(src) - len, "] ");
+    }
+    snprintf(src + len, sizeof(src) - len,
+             "))\n(define d (data))\n"
+             "(cons (car (cdr d)) (cons (car (cdr (cdr (cdr (cdr (cdr d)))))) '()))");
+
+    Compiler* c = omni_compiler_new();
+    char* code = omni_compiler_compile_to_c(c, src);
+    ASSERT(code != NULL);
+    ASSERT(strstr(code, "static Obj* _literal_") != NULL);
+    ASSERT(strstr(code, "return prim_vector_of(items, 70);") != NULL);
+    free(code);
+    omni_compiler_free(c);
+
+    char out[64];
+    ASSERT(run_program(src, out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "(1 5)") == 0);
+}
+
+TEST(test_sleep_uses_virtual_time) {
+    char out[256];
+    const char* src =
+        "(define (tick n) (if (= n 0) 0 (do (sleep-ms 250) (yield) (tick (- n 1)))))"
+        "(let ((t0 (monotonic-millis))) (do (tick 4) (- (monotonic-millis) t0)))";
+
+    /* A second of sleeping passes instantly on the virtual clock */
+    setenv("PURPLE_VIRTUAL_TIME", "1", 1);
+    ASSERT(run_program(src, out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "1000") == 0);
+    ASSERT(run_program("(sleep-ms 'soon)", out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "#<error sleep-ms: not a number>") == 0);
+    unsetenv("PURPLE_VIRTUAL_TIME");
+
+    ASSERT(run_program("(let ((t0 (monotonic-millis))) (do (sleep-ms 20) (>= (- (monotonic-millis) t0) 20)))",
+                       out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "1") == 0);
+}
+
+/* ========== Characters ========== */
+
+TEST(test_char_literals_parse) {
+    OmniValue* v = omni_parse_string(session, "#\\a");
+    ASSERT(omni_is_char(v) && v->int_val == 'a');
+    v = omni_parse_string(session, "#\\newline");
+    ASSERT(omni_is_char(v) && v->int_val == '\n');
+    v = omni_parse_string(session, "#\\x41");
+    ASSERT(omni_is_char(v) && v->int_val == 'A');
+    v = omni_parse_string(session, "#\\(");
+    ASSERT(omni_is_char(v) && v->int_val == '(');
+}
+
+TEST(test_write_vs_display) {
+    char out[256];
+    ASSERT(run_program("(display #\\a)", out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "a()") == 0);
+    ASSERT(run_program("(write #\\a)", out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "#\\a()") == 0);
+}
+
+TEST(test_quoted_chars_written) {
+    char out[256];
+    ASSERT(run_program("(write '(#\\a #\\space x #\\x1))", out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "(#\\a #\\space x #\\x01)()") == 0);
+}
+
+TEST(test_quasiquote_unquote_and_splice) {
+    char out[256];
+    ASSERT(run_program("(let ((x 10)) `(a ,x c))", out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "(a 10 c)") == 0);
+    ASSERT(run_program("(let ((xs '(1 2 3))) `(a ,@xs b))", out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "(a 1 2 3 b)") == 0);
+    ASSERT(run_program("`(a ,@'() b)", out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "(a b)") == 0);
+
+    /* Unquotes run left to right; inner levels stay quoted */
+    ASSERT(run_program("(define (p x) (display x) x) `(,(p 1) ,@(cons (p 2) '(3)) ,(p 4))",
+                       out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "124(1 2 3 4)") == 0);
+    ASSERT(run_program("(let ((x 1)) `(a `(b ,(c ,x))))", out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "(a (quasiquote (b (unquote (c 1)))))") == 0);
+
+    Compiler* c = omni_compiler_new();
+    ASSERT(omni_compiler_compile_to_c(c, ",x") == NULL);
+    ASSERT(strstr(omni_compiler_get_error(c, 0), "only valid inside quasiquote") != NULL);
+    omni_compiler_free(c);
+}
+
+/* ========== Numeric Literals ========== */
+
+TEST(test_negative_literal_vs_minus) {
+    OmniValue* v = omni_parse_string(session, "(-1)");
+    ASSERT(omni_is_cell(v) && omni_is_int(omni_car(v)) && omni_car(v)->int_val == -1);
+    v = omni_parse_string(session, "(- 1)");
+    ASSERT(omni_is_sym(omni_car(v)) && strcmp(omni_car(v)->str_val, "-") == 0);
+    ASSERT(omni_is_int(omni_car(omni_cdr(v))) && omni_car(omni_cdr(v))->int_val == 1);
+    v = omni_parse_string(session, "-x");
+    ASSERT(omni_is_sym(v) && strcmp(v->str_val, "-x") == 0);
+    v = omni_parse_string(session, "+5");
+    ASSERT(omni_is_int(v) && v->int_val == 5);
+}
+
+TEST(test_radix_literals) {
+    OmniValue* v = omni_parse_string(session, "#x1F");
+    ASSERT(omni_is_int(v) && v->int_val == 31);
+    v = omni_parse_string(session, "#b1010");
+    ASSERT(omni_is_int(v) && v->int_val == 10);
+    v = omni_parse_string(session, "#o17");
+    ASSERT(omni_is_int(v) && v->int_val == 15);
+    v = omni_parse_string(session, "#x-ff");
+    ASSERT(omni_is_int(v) && v->int_val == -255);
+}
+
+TEST(test_digit_separators) {
+    OmniValue* v = omni_parse_string(session, "1_000_000");
+    ASSERT(omni_is_int(v) && v->int_val == 1000000);
+    v = omni_parse_string(session, "#xff_ff");
+    ASSERT(omni_is_int(v) && v->int_val == 0xffff);
+}
+
+TEST(test_numeric_literals_compile) {
+    char out[256];
+    ASSERT(run_program("(- 1)", out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "-1") == 0);
+    ASSERT(run_program("(- 5 -3)", out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "8") == 0);
+    ASSERT(run_program("(let ((x 4)) (- x))", out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "-4") == 0);
+    ASSERT(run_program("(+ #x10 #b11)", out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "19") == 0);
+    ASSERT(run_program("-9223372036854775808", out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "-9223372036854775808") == 0);
+}
+
+TEST(test_float_literals) {
+    OmniValue* v = omni_parse_string(session, "1.5");
+    ASSERT(omni_is_float(v) && v->float_val == 1.5);
+    v = omni_parse_string(session, "-2.5e-3");
+    ASSERT(omni_is_float(v) && v->float_val == -2.5e-3);
+    v = omni_parse_string(session, "1e10");
+    ASSERT(omni_is_float(v) && v->float_val == 1e10);
+    v = omni_parse_string(session, "a.b");
+    ASSERT(omni_is_sym(v));
+}
+
+TEST(test_floats_print_round_trip) {
+    char out[256];
+    ASSERT(run_program("'(0.1 3.0 0.30000000000000004 1e100)", out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "(0.1 3.0 0.30000000000000004 1e+100)") == 0);
+
+    /* What gets printed must read back as the same double */
+    double samples[] = { 1.0 / 3.0, 2.0 / 3.0, 123456.789e-30 };
+    for (size_t i = 0; i < sizeof(samples) / sizeof(samples[0]); i++) {
+        char src[64];
+        snprintf(src, sizeof(src), "%.17g", samples[i]);
+        ASSERT(run_program(src, out, sizeof(out)) == 0);
+        OmniValue* back = omni_parse_string(session, out);
+        ASSERT(omni_is_float(back) && back->float_val == samples[i]);
+    }
+}
+
+/* ========== Numeric Comparison ========== */
+
+/* Conformance cases for mixed int/float comparison; one program per run */
+static const struct { const char* expr; const char* expect; } g_compare_cases[] = {
+    { "(= 1 1.0)", "1" },
+    { "(= 1 1.5)", "0" },
+    { "(< 1 2.5)", "1" },
+    { "(> 2.5 2)", "1" },
+    { "(<= 1.0 1)", "1" },
+    { "(>= -0.5 0)", "0" },
+    { "(= (+ 0.5 0.5) 1)", "1" },
+    { "(* 2 1.5)", "3.0" },
+    { "(= 9007199254740993 9007199254740992.0)", "0" },
+    { "(< 9007199254740992.0 9007199254740993)", "1" },
+    { "(> 9223372036854775807 9.3e18)", "0" },
+};
+
+TEST(test_mixed_numeric_comparison) {
+    char src[1024] = "";
+    char expect[256] = "";
+    size_t n = sizeof(g_compare_cases) / sizeof(g_compare_cases[0]);
+    for (size_t i = 0; i < n; i++) {
+        strcat(src, g_compare_cases[i].expr);
+        strcat(src, "\n");
+        strcat(expect, g_compare_cases[i].expect);
+        if (i + 1 < n) strcat(expect, "\n");
+    }
+
+    char out[256];
+    ASSERT(run_program(src, out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, expect) == 0);
+}
+
+/* ========== Numeric Library ========== */
+
+/* Each case runs once folded (literal operands) and once at runtime
+ * (operands bound by let), and both must print the expected value */
+static const struct { const char* op; const char* a; const char* b; const char* expect; } g_numlib_cases[] = {
+    { "expt", "2", "10", "1024" },
+    { "expt", "2", "-1", "0.5" },
+    { "expt", "4", "0.5", "2.0" },
+    { "expt", "2", "64", "18446744073709552000.0" },
+    { "expt", "-2", "63", "-9223372036854775808" },
+    { "min", "1", "2.5", "1.0" },
+    { "max", "-3", "7", "7" },
+    { "gcd", "12", "-18", "6" },
+    { "lcm", "4", "6", "12" },
+    { "lcm", "0", "5", "0" },
+    { "gcd", "2.0", "4", "2.0" },
+    { "lcm", "2.0", "3", "6.0" },
+    { "gcd", "-9223372036854775808", "0", "9223372036854776000.0" },
+    { "lcm", "9223372036854775807", "2", "18446744073709552000.0" },
+    { "lcm", "4294967296", "4294967297", "18446744078004520000.0" },
+    { "sqrt", "16", NULL, "4" },
+    { "sqrt", "2", NULL, "1.4142135623730951" },
+    { "sqrt", "2.25", NULL, "1.5" },
+};
+
+TEST(test_numeric_library_folded_and_runtime) {
+    char src[2048] = "";
+    char expect[512] = "";
+    size_t n = sizeof(g_numlib_cases) / sizeof(g_numlib_cases[0]);
+    for (size_t i = 0; i < n; i++) {
+        char line[160];
+        const char* b = g_numlib_cases[i].b;
+        snprintf(line, sizeof(line), "(%s %s%s%s)\n(let ((x %s)) (%s x%s%s))\n",
+                 g_numlib_cases[i].op, g_numlib_cases[i].a, b ? " " : "", b ? b : "",
+                 g_numlib_cases[i].a, g_numlib_cases[i].op, b ? " " : "", b ? b : "");
+        strcat(src, line);
+        strcat(expect, g_numlib_cases[i].expect);
+        strcat(expect, "\n");
+        strcat(expect, g_numlib_cases[i].expect);
+        if (i + 1 < n) strcat(expect, "\n");
+    }
+
+    char out[512];
+    ASSERT(run_program(src, out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, expect) == 0);
+}
+
+TEST(test_numeric_library_constant_folds) {
+    CompilerOptions opts = { .use_embedded_runtime = true };
+    Compiler* c = omni_compiler_new_with_options(&opts);
+
+    char* code = omni_compiler_compile_to_c(c,
+        "(expt 2 10)\n"
+        "(max (sqrt 81) (gcd 4 6))\n"
+        "(let ((x 3)) (min x 2))\n"
+        "(gcd 2.0 4)");
+    ASSERT(code != NULL);
+    char* main_fn = strstr(code, "int main(void)");
+    ASSERT(main_fn != NULL);
+    ASSERT(strstr(main_fn, "mk_int(1024)") != NULL);
+    ASSERT(strstr(main_fn, "mk_int(9)") != NULL);
+    ASSERT(strstr(main_fn, "prim_expt") == NULL);
+    ASSERT(strstr(main_fn, "prim_sqrt") == NULL);
+    ASSERT(strstr(main_fn, "prim_min(") != NULL);
+    ASSERT(strstr(main_fn, "prim_gcd(") != NULL);
+
+    free(code);
+    omni_compiler_free(c);
+}
+
+TEST(test_min_max_are_variadic) {
+    char out[64];
+    ASSERT(run_program("(min 4 2 3)\n(max 1 5.0 3)\n(min 7)\n(let ((x 3)) (max x 8 -1 x))",
+                       out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "2\n5.0\n7\n8") == 0);
+}
+
+TEST(test_user_definition_blocks_folding) {
+    char out[64];
+    ASSERT(run_program("(define (sqrt x) 42)\n(sqrt 16)", out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "42") == 0);
+}
+
+/* ========== List Primitives ========== */
+
+TEST(test_list_primitives_link) {
+    char out[256];
+    ASSERT(run_program(
+        "(length '(1 2 3))\n"
+        "(append '(1 2) '(3 4))\n"
+        "(append '() '(5))\n"
+        "(reverse '(1 2 3))\n"
+        "(map (lambda (x) (* x x)) '(1 2 3))\n"
+        "(filter (lambda (x) (> x 1)) '(1 2 3))\n"
+        "(fold + 0 '(1 2 3 4))",
+        out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "3\n(1 2 3 4)\n(5)\n(3 2 1)\n(1 4 9)\n(2 3)\n10") == 0);
+}
+
+TEST(test_named_functions_as_arguments) {
+    char out[256];
+    ASSERT(run_program(
+        "(define (square x) (* x x))\n"
+        "(define (keep-odd x) (% x 2))\n"
+        "(map square '(1 2 3))\n"
+        "(filter keep-odd '(1 2 3 4 5))\n"
+        "(map car '((1 2) (3 4)))\n"
+        "(fold (lambda (acc x) acc) 7 '(1 2))",
+        out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "(1 4 9)\n(1 3 5)\n(1 3)\n7") == 0);
+}
+
+TEST(test_lambda_inside_function_body) {
+    char out[64];
+    ASSERT(run_program(
+        "(define (inc-all xs) (map (lambda (x) (+ x 1)) xs))\n"
+        "(inc-all '(1 2))",
+        out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "(2 3)") == 0);
+}
+
+TEST(test_map_wraps_function_argument) {
+    CompilerOptions opts = { .use_embedded_runtime = true };
+    Compiler* c = omni_compiler_new_with_options(&opts);
+
+    char* code = omni_compiler_compile_to_c(c, "(map (lambda (x) x) '(1))");
+    ASSERT(code != NULL);
+    char* main_fn = strstr(code, "int main(void)");
+    ASSERT(main_fn != NULL);
+    ASSERT(strstr(main_fn, "list_map(mk_code(_fnval__lambda_0, 1, NULL)") != NULL);
+    ASSERT(strstr(code, "return _lambda_0(captures, args[0]);") != NULL);
+
+    free(code);
+    omni_compiler_free(c);
+}
+
+TEST(test_closures_print_and_introspect) {
+    char out[128];
+    ASSERT(run_program(
+        "(define (sq x) (* x x))\n"
+        "(define (twice f x) (f (f x)))\n"
+        "sq\n"
+        "(procedure? sq)\n"
+        "(procedure? 3)\n"
+        "(arity car)\n"
+        "(twice sq 3)",
+        out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "#<closure sq arity 1>\n1\n0\n1\n81") == 0);
+}
+
+TEST(test_lambdas_capture_enclosing_locals) {
+    char out[128];
+    ASSERT(run_program(
+        "(define (adder n) (lambda (x) (+ x n)))\n"
+        "((adder 3) 4)\n"
+        "(map (adder 10) '(1 2))\n"
+        "(let ((a 1) (b 2)) ((lambda (c) (cons a (cons b (cons c (quote ()))))) 3))\n"
+        "(define (outer x) (lambda (y) (lambda (z) (+ x (+ y z)))))\n"
+        "(((outer 1) 2) 3)",
+        out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "7\n(11 12)\n(1 2 3)\n6") == 0);
+}
+
+TEST(test_set_shares_captured_variables) {
+    char out[128];
+    /* Each counter has its own n; both lambdas of a pair share theirs */
+    ASSERT(run_program(
+        "(define (make-counter) (let ((n 0)) (lambda () (set! n (+ n 1)) n)))\n"
+        "(define c (make-counter))\n"
+        "(define d (make-counter))\n"
+        "(c) (c) (d)\n"
+        "(define (make-acc total) (lambda (x) (set! total (+ total x)) total))\n"
+        "(define acc (make-acc 100))\n"
+        "(acc 10) (acc 5)\n"
+        "(define (counter-pair) (let ((n 0)) (cons (lambda () (set! n (+ n 1))) (lambda () n))))\n"
+        "(define p (counter-pair))\n"
+        "((car p)) ((car p)) ((cdr p))",
+        out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "1\n2\n1\n110\n115\n()\n()\n2") == 0);
+
+    ASSERT(run_program(
+        "(define g 1)\n"
+        "(define (bump!) (set! g (* g 2)))\n"
+        "(bump!) (bump!) g\n"
+        "(let ((x 1)) (set! x (+ x 1)) x)\n"
+        "(define (f x) (set! x (cons x x)) x)\n"
+        "(f 1)",
+        out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "()\n()\n4\n2\n(1 . 1)") == 0);
+}
+
+TEST(test_malformed_core_forms_are_errors) {
+    static const struct { const char* src; const char* error; } cases[] = {
+        { "(let)", "E0002 (let): expected (let ((var init) ...) body...)" },
+        { "(let* ((x)) x)", "E0002 (let* ((x)) x): expected (let* ((var init) ...) body...)" },
+        { "(letrec ((x 1 2)) x)", "E0002 (letrec ((x 1 2)) x): expected (letrec ((var init) ...) body...)" },
+        { "(lambda)", "E0002 (lambda): expected (lambda (param...) body...)" },
+        { "(fn (1) 1)", "E0002 (fn (1) 1): expected (fn (param...) body...)" },
+        { "(define x)", "E0002 (define x): expected (define name value) or (define (name param...) body...)" },
+        { "(define (f . x) x)",
+          "E0002 (define (f . x) x): expected (define name value) or (define (name param...) body...)" },
+        { "(quote 1 2)", "E0002 (quote 1 2): expected (quote datum)" },
+    };
+    for (size_t i = 0; i < sizeof(cases) / sizeof(cases[0]); i++) {
+        size_t n;
+        char* e = first_error(cases[i].src, &n, NULL, 0);
+        if (!e || strcmp(e, cases[i].error) != 0) printf("(%s: %s) ", cases[i].src, e ? e : "no error");
+        ASSERT(e && strcmp(e, cases[i].error) == 0);
+    }
+}
+
+/* src with the list that opens at open cut off after its element ending
+ * at end */
+static char* truncate_list(const char* src, size_t open, size_t end) {
+    int depth = 0;
+    size_t close = open;
+    for (; src[close]; close++) {
+        if (src[close] == '(') depth++;
+        if (src[close] == ')' && --depth == 0) break;
+    }
+    size_t len = strlen(src);
+    char* out = malloc(len + 2);
+    memcpy(out, src, end);
+    out[end] = ')';
+    memcpy(out + end + 1, src + close + 1, len - close);
+    return out;
+}
+
+TEST(test_truncated_forms_compile_or_fail_cleanly) {
+    /* Every list in the program cut short after each of its elements */
+    const char* src =
+        "(define (fact n) (if (= n 0) 1 (* n (fact (- n 1)))))\n"
+        "(define xs (cons 1 (cons 2 ())))\n"
+        "(let ((a 1) (b (lambda (y) (+ y a)))) (set! a 2) (b a))\n"
+        "(let* ((p (quote (1 2))) (q `(0 ,@p))) (cond ((null? q) 0) (else (car q))))\n"
+        "(letrec ((even? (fn (n) (if (= n 0) 1 (odd? (- n 1))))) (odd? (fn (n) (if (= n 0) 0 (even? (- n 1))))))"
+        " (even? 10))\n"
+        "(let loop ((i 0)) (when (< i 3) (loop (+ i 1))))\n"
+        "(case 2 ((1) 'a) (else 'b))\n"
+        "(do (define z 1) (and z (or z 2)))\n"
+        "(match xs ((cons h t) h) (_ 0))\n";
+    size_t checked = 0;
+    for (size_t open = 0; src[open]; open++) {
+        if (src[open] != '(') continue;
+        int depth = 1;
+        for (size_t i = open + 1; src[i] && depth > 0; i++) {
+            if (src[i] == '(') depth++;
+            if (src[i] == ')') depth--;
+            if (depth != 1 || src[i] == ' ' || (src[i + 1] != ' ' && src[i + 1] != ')')) continue;
+            char* cut = truncate_list(src, open, i + 1);
+            Compiler* c = omni_compiler_new_with_options(&(CompilerOptions){ .use_embedded_runtime = true });
+            char* code = omni_compiler_compile_to_c(c, cut);
+            ASSERT(code || omni_compiler_error_count(c) > 0);
+            free(code);
+            omni_compiler_free(c);
+            free(cut);
+            checked++;
+        }
+    }
+    ASSERT(checked > 100);
+}
+
+TEST(test_set_needs_a_variable) {
+    Compiler* c = omni_compiler_new_with_options(&(CompilerOptions){ .use_embedded_runtime = true });
+    ASSERT(omni_compiler_compile_to_c(c, "(set! nowhere 1)") == NULL);
+    ASSERT(strstr(omni_compiler_get_error(c, 0), "E0001 unbound symbol: nowhere") != NULL);
+    omni_compiler_free(c);
+
+    c = omni_compiler_new_with_options(&(CompilerOptions){ .use_embedded_runtime = true });
+    ASSERT(omni_compiler_compile_to_c(c, "(define (f) 1) (set! f 2)") == NULL);
+    ASSERT(strstr(omni_compiler_get_error(c, 0),
+                  "E0002 (set! f 2): f is a function; only variables can be assigned") != NULL);
+    omni_compiler_free(c);
+
+    c = omni_compiler_new_with_options(&(CompilerOptions){ .use_embedded_runtime = true });
+    ASSERT(omni_compiler_compile_to_c(c, "(let ((x 1)) (set! x))") == NULL);
+    ASSERT(strstr(omni_compiler_get_error(c, 0), "E0002 (set! x): expected (set! name value)") != NULL);
+    omni_compiler_free(c);
+}
+
+TEST(test_letrec_functions_call_each_other) {
+    char out[256];
+    ASSERT(run_program(
+        "(define (parity n)\n"
+        "  (letrec ((ev? (lambda (n) (if (= n 0) 'even (od? (- n 1)))))\n"
+        "           (od? (fn (n) (if (= n 0) 'odd (ev? (- n 1))))))\n"
+        "    (ev? n)))\n"
+        "(parity 7)\n"
+        "(parity 100000)\n"
+        "(define (count-down k step)\n"
+        "  (letrec [go (lambda (n acc) (if (< n 0) acc (go (- n step) (cons n acc))))]\n"
+        "    (go k '())))\n"
+        "(count-down 10 3)\n"
+        "(define (f k) (letrec ((outer (lambda (n) (if (= n 0) k (letrec ((inner (lambda (m) (outer (- m 1))))) (inner n)))))) (outer 3)))\n"
+        "(f 42)",
+        out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "odd\neven\n(1 4 7 10)\n42") == 0);
+}
+
+TEST(test_letrec_functions_as_values) {
+    char out[256];
+    /* Values the functions use are filled in before the body runs */
+    ASSERT(run_program(
+        "(letrec ((f (lambda (x) (* x base))) (base 10) (y (f 4))) (+ y base))\n"
+        "(map (letrec ((sq (lambda (x) (* x x)))) sq) '(1 2))\n"
+        "(define (adder k) (letrec ((add (lambda (x) (+ x k))) (twice (lambda (x) (add (add x))))) twice))\n"
+        "((adder 5) 1)\n"
+        "(letrec ((f (lambda () f))) (procedure? (f)))\n"
+        "(letrec* ((a 1) (b (+ a 1))) (+ a b))\n"
+        "(let ((c 0)) (letrec ((tick (lambda () (set! c (+ c 1)) c))) (tick) (tick)))",
+        out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "50\n(1 4)\n11\n1\n3\n2") == 0);
+
+    Compiler* c = omni_compiler_new_with_options(&(CompilerOptions){ .use_embedded_runtime = true });
+    ASSERT(omni_compiler_compile_to_c(c, "(letrec ((f (lambda () 1))) (set! f 2))") == NULL);
+    ASSERT(strstr(omni_compiler_get_error(c, 0),
+                  "E0002 (set! f 2): f is a function; only variables can be assigned") != NULL);
+    omni_compiler_free(c);
+}
+
+TEST(test_named_let_runs_as_a_loop) {
+    char out[256];
+    ASSERT(run_program(
+        "(define (sum n) (let loop ((i 0) (acc 0)) (if (> i n) acc (loop (+ i 1) (+ acc i)))))\n"
+        "(sum 1000000)\n"
+        "(let loop [i 0 acc 1] (cond ((> i 5) acc) (else (loop (+ i 1) (* acc 2)))))\n"
+        "(let loop ((i 0)) (if (< i 3) (begin (display i) (loop (+ i 1))) 'done))\n"
+        "(define (evens k) (let loop ((i 0) (acc '())) (let ((j (* i 2))) (if (< i k) (loop (+ i 1) (cons j acc)) acc))))\n"
+        "(evens 3)",
+        out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "500000500000\n64\n012done\n(4 2 0)") == 0);
+
+    /* Tail calls jump back to the top instead of making a closure */
+    Compiler* c = omni_compiler_new_with_options(&(CompilerOptions){ .use_embedded_runtime = true });
+    char* code = omni_compiler_compile_to_c(c,
+        "(define (sum n) (let loop ((i 0) (acc 0)) (if (> i n) acc (loop (+ i 1) (+ acc i)))))");
+    ASSERT(code != NULL);
+    ASSERT(strstr(code, "_lambda_") == NULL);
+    ASSERT(strstr(code, "goto _L0;") != NULL);
+    free(code);
+    omni_compiler_free(c);
+}
+
+TEST(test_named_let_falls_back_to_a_function) {
+    char out[256];
+    /* A call that is not in tail position, the loop used as a value, a
+     * closure over the loop variables, an init naming an outer binding of
+     * the loop's name, and a named let in a macro */
+    ASSERT(run_program(
+        "(define (fact n) (let f ((k n)) (if (= k 0) 1 (* k (f (- k 1))))))\n"
+        "(fact 10)\n"
+        "(procedure? (let loop ((i 0)) loop))\n"
+        "(define (thunks) (let loop ((i 0) (acc '())) (if (= i 3) acc (loop (+ i 1) (cons (lambda () i) acc)))))\n"
+        "((car (thunks)))\n"
+        "(define (loop x) (* x 2))\n"
+        "(let loop ((i (loop 3))) (if (> i 10) i (loop (+ i 1))))\n"
+        "(defmacro repeat (n body) `(let loop ((i 0)) (if (< i ,n) (begin ,body (loop (+ i 1))) 'ok)))\n"
+        "(let ((i 7)) (repeat 2 (display i)))\n"
+        "(defmacro zeros (n) (let lp ((k n) (acc '())) (if (= k 0) `(quote ,acc) (lp (- k 1) (cons 0 acc)))))\n"
+        "(zeros 3)",
+        out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "3628800\n1\n2\n11\n77ok\n(0 0 0)") == 0);
+
+    Compiler* c = omni_compiler_new_with_options(&(CompilerOptions){ .use_embedded_runtime = true });
+    ASSERT(omni_compiler_compile_to_c(c, "(let loop (i 0) i)") == NULL);
+    ASSERT(strstr(omni_compiler_get_error(c, 0),
+                  "E0002 (let loop (i 0) i): expected (let name ((var init) ...) body...)") != NULL);
+    omni_compiler_free(c);
+}
+
+TEST(test_closure_identity) {
+    char out[64];
+    ASSERT(run_program(
+        "(define (sq x) (* x x))\n"
+        "(eq? sq sq)\n"
+        "(eq? car cdr)\n"
+        "(eq? (hash sq) (hash sq))\n"
+        "(eq? 'a 'a)",
+        out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "1\n0\n1\n1") == 0);
+}
+
+TEST(test_top_level_variables_are_globals) {
+    char out[64];
+    ASSERT(run_program(
+        "(define (f) n)\n"
+        "(define n (+ 1 2))\n"
+        "(define xs '(1 2))\n"
+        "(f)\n"
+        "(car xs)\n"
+        "xs",
+        out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "3\n1\n(1 2)") == 0);
+}
+
+TEST(test_global_calls_follow_redefinition) {
+    char out[128];
+    ASSERT(run_program(
+        "(define f (lambda (x) (* x 2)))\n"
+        "(define (g y) (f y))\n"
+        "(g 4)\n"
+        "(define f (lambda (x) (+ x 1)))\n"
+        "(g 4)\n"
+        "(define (h f) (f 1))\n"
+        "(h (lambda (z) (- z)))",
+        out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "8\n5\n-1") == 0);
+
+    CompilerOptions opts = { .use_embedded_runtime = true };
+    Compiler* c = omni_compiler_new_with_options(&opts);
+    char* code = omni_compiler_compile_to_c(c, "(define f (lambda (x) x)) (define (g y) (f y))");
+    ASSERT(code != NULL);
+    ASSERT(strstr(code, "static __thread OmniCallCache _ic;") != NULL);
+    ASSERT(strstr(code, "omni_call_cached(&_ic, o_f, _ver_o_f, (Obj*[]){o_y}, 1)") != NULL);
+    ASSERT(strstr(code, "_ver_o_f++;") != NULL);
+    free(code);
+    omni_compiler_free(c);
+}
+
+TEST(test_call_caches_are_per_thread) {
+    /* Threads calling through one site must not race on its cache */
+    CompilerOptions opts = { .use_embedded_runtime = true, .enable_tsan = true };
+    char out[64];
+    setenv("TSAN_OPTIONS", "halt_on_error=1", 1);
+    int status = run_program_with(&opts,
+        "(define f (lambda (x) (+ x 1)))\n"
+        "(define (work n acc) (if (= n 0) acc (work (- n 1) (f acc))))\n"
+        "(wait-group (go (work 2000 0)) (go (work 2000 0)) (go (work 2000 0)) (go (work 2000 0)))\n"
+        "(work 3 0)",
+        out, sizeof(out));
+    unsetenv("TSAN_OPTIONS");
+    ASSERT(status == 0);
+    ASSERT(strcmp(out, "()\n3") == 0);
+}
+
+TEST(test_hot_reload_calls_through_pointers) {
+    const char* src = "(define (sq x) (* x x)) (define (quad x) (sq (sq x))) (define n 2) (quad n)";
+    CompilerOptions opts = { .use_embedded_runtime = true, .hot_reload = true };
+    Compiler* c = omni_compiler_new_with_options(&opts);
+    char* code = omni_compiler_compile_to_c(c, src);
+    ASSERT(code != NULL);
+    ASSERT(strstr(code, "extern Obj* (*o_sq)(Obj* o_x);") != NULL);
+    ASSERT(strstr(code, "static Obj* _hot_o_sq(Obj* o_x) {") != NULL);
+    ASSERT(strstr(code, "Obj* (*o_sq)(Obj* o_x) = _hot_o_sq;") != NULL);
+    ASSERT(strstr(code, "\nObj* o_n;") != NULL);
+    ASSERT(strstr(code, "int main(void)") != NULL);
+    free(code);
+    omni_compiler_free(c);
+
+    /* A patch carries only the replaced function */
+    opts.hot_patch = "sq";
+    c = omni_compiler_new_with_options(&opts);
+    code = omni_compiler_compile_to_c(c, src);
+    ASSERT(code != NULL);
+    ASSERT(strstr(code, "static Obj* _hot_o_sq(Obj* o_x) {") != NULL);
+    ASSERT(strstr(code, "__atomic_store_n(&o_sq, _hot_o_sq, __ATOMIC_SEQ_CST);") != NULL);
+    ASSERT(strstr(code, "extern Obj* o_n;") != NULL);
+    ASSERT(strstr(code, "_hot_o_quad") == NULL);
+    ASSERT(strstr(code, "int main(void)") == NULL);
+    free(code);
+    omni_compiler_free(c);
+}
+
+TEST(test_incremental_objects_build_only_new_units) {
+    /* Units before prior_units are loaded already: declared, not built */
+    CompilerOptions opts = { .runtime_path = "/opt/purple", .incremental = true, .prior_units = 2 };
+    OmniSource units[] = {
+        { NULL, "(define (sq x) (* x x)) (define n (do (display 1) 3))" },
+        { NULL, "(define (quad x) (sq (sq x)))" },
+        { NULL, "(define (sq x) x) (define m 1) (quad n)" },
+    };
+    Compiler* c = omni_compiler_new_with_options(&opts);
+    char* code = omni_compiler_compile_units_to_c(c, units, 3);
+    ASSERT(code != NULL);
+    ASSERT(strstr(code, "extern Obj* o_n;") != NULL);
+    ASSERT(strstr(code, "\nObj* o_m;") != NULL);
+    ASSERT(strstr(code, "extern Obj* (*o_quad)(Obj* o_x);") != NULL);
+    ASSERT(strstr(code, "_hot_o_quad") == NULL);
+    ASSERT(strstr(code, "omni_print(mk_int(1))") == NULL);
+    /* A redefinition replaces the loaded function when main runs */
+    ASSERT(strstr(code, "static Obj* _hot_o_sq(Obj* o_x) {") != NULL);
+    ASSERT(strstr(code, "o_sq = _hot_o_sq;") != NULL);
+    ASSERT(strstr(code, "o_quad(o_n)") != NULL);
+    free(code);
+    omni_compiler_free(c);
+}
+
+TEST(test_modules_record_their_abi) {
+    /* Loaders check this against the runtime before running the module */
+    CompilerOptions opts = { .runtime_path = "/opt/purple", .hot_patch = "sq" };
+    Compiler* c = omni_compiler_new_with_options(&opts);
+    char* code = omni_compiler_compile_to_c(c, "(define (sq x) (* x x))");
+    ASSERT(code != NULL);
+    ASSERT(strstr(code, "static const PurpleTypeDescriptor omni_module_types[] = PURPLE_ABI_TYPES;") != NULL);
+    ASSERT(strstr(code, "const PurpleAbi omni_module_abi = {") != NULL);
+    free(code);
+    omni_compiler_free(c);
+}
+
+TEST(test_debug_history_shows_recorded_calls) {
+    CompilerOptions opts = { .use_embedded_runtime = true, .record_steps = 3 };
+    char out[256];
+    ASSERT(run_program_with(&opts,
+        "(define (fact n) (if (= n 0) 1 (* n (fact (- n 1)))))\n"
+        "(define (off-by x) (- (fact x) 1))\n"
+        "(off-by 3)\n"
+        "(debug-history 2)\n"
+        "(define (peek) (debug-history 1))\n"
+        "(peek)",
+        out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "5\n"
+                       "step 4: (fact 1) => 1\n"
+                       "step 5: (fact 0) => 1\n()\n"
+                       "step 6: (peek) => ...\n()") == 0);
+}
+
+TEST(test_debug_history_shows_environment_deltas) {
+    CompilerOptions opts = { .use_embedded_runtime = true, .record_steps = 8 };
+    char out[256];
+    ASSERT(run_program_with(&opts,
+        "(define n 0)\n"
+        "(define (bump k) (set! n (+ n k)) n)\n"
+        "(define (twice) (bump 1) (bump 2))\n"
+        "(twice)\n"
+        "(set! n 10)\n"
+        "(debug-history)",
+        out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "3\n()\n"
+                       "step 1: (twice) => 3\n"
+                       "step 2: (bump 1) => 1 ; n: 0 -> 1\n"
+                       "step 3: (bump 2) => 3 ; n: 1 -> 3\n"
+                       "step 4: (set! n 10) => () ; n: 3 -> 10\n()") == 0);
+}
+
+TEST(test_debug_history_shows_local_deltas) {
+    CompilerOptions opts = { .use_embedded_runtime = true, .record_steps = 8 };
+    char out[256];
+    ASSERT(run_program_with(&opts,
+        "(define (tally xs) (let ((n 0)) (for-each (lambda (x) (set! n (+ n 1))) xs) n))\n"
+        "(define (last-of xs) (let ((p xs)) (set! p (cdr p)) (set! p (cdr p)) (car p)))\n"
+        "(tally '(a b))\n"
+        "(last-of '(1 2 3))\n"
+        "(debug-history)",
+        out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "2\n3\n"
+                       "step 1: (tally (a b)) => 2 ; n: 0 -> 1, n: 1 -> 2\n"
+                       "step 2: (last-of (1 2 3)) => 3 ; p: (1 2 3) -> (2 3), p: (2 3) -> (3)\n()") == 0);
+}
+
+TEST(test_debug_history_needs_recording) {
+    CompilerOptions opts = { .use_embedded_runtime = true };
+    Compiler* c = omni_compiler_new_with_options(&opts);
+    ASSERT(omni_compiler_compile_to_c(c, "(debug-history 3)") == NULL);
+    ASSERT(strstr(omni_compiler_get_error(c, 0), "compile with --record N") != NULL);
+    omni_compiler_free(c);
+
+    opts.record_steps = 4;
+    c = omni_compiler_new_with_options(&opts);
+    ASSERT(omni_compiler_compile_to_c(c, "(debug-history 'x)") == NULL);
+    ASSERT(strstr(omni_compiler_get_error(c, 0), "n a literal count") != NULL);
+    char* code = omni_compiler_compile_to_c(c, "(define (debug-history n) n) (debug-history 'x)");
+    ASSERT(code != NULL);
+    free(code);
+    omni_compiler_free(c);
+}
+
+TEST(test_with_budget_stops_runaway_allocation) {
+    char out[256];
+    ASSERT(run_program(
+        "(define (build n) (if (= n 0) '() (cons n (build (- n 1)))))\n"
+        "(with-budget (allocs 100) (length (build 10)))\n"
+        "(with-budget (allocs 100) (build 1000))\n"
+        "(with-budget (allocs 1000) (with-budget (allocs 10) (build 50)))\n"
+        "(with-budget (allocs 10) (with-budget (allocs 1000) (build 50)))\n"
+        "(with-budget (allocs 100) (ms 1000) (build 2) (+ 1 2))",
+        out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "10\n#<error budget-exceeded>\n#<error budget-exceeded>\n"
+                       "#<error budget-exceeded>\n3") == 0);
+}
+
+TEST(test_with_budget_needs_literal_limits) {
+    CompilerOptions opts = { .use_embedded_runtime = true };
+    Compiler* c = omni_compiler_new_with_options(&opts);
+    ASSERT(omni_compiler_compile_to_c(c, "(with-budget (allocs n) 1)") == NULL);
+    ASSERT(strstr(omni_compiler_get_error(c, 0), "one literal count") != NULL);
+    omni_compiler_free(c);
+
+    c = omni_compiler_new_with_options(&opts);
+    ASSERT(omni_compiler_compile_to_c(c, "(with-budget 1)") == NULL);
+    ASSERT(strstr(omni_compiler_get_error(c, 0), "expected (with-budget") != NULL);
+    omni_compiler_free(c);
+}
+
+TEST(test_nursery_joins_its_tasks) {
+    char out[256];
+    ASSERT(run_program(
+        "(define (sum n) (if (= n 0) 0 (+ n (sum (- n 1)))))\n"
+        "(nursery (spawn (sum 10)) (spawn (sum 100)) 'ignored)\n"
+        "(let ((x 5) (xs (cons 1 (cons 2 '())))) (nursery (spawn (* x x)) (spawn (cons x xs))))\n"
+        "(nursery (spawn (nursery (spawn 1) (spawn 2))) (spawn 3))\n"
+        "(nursery)\n"
+        "(spawn 1)",
+        out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "(55 5050)\n(25 (5 1 2))\n((1 2) 3)\n()\n"
+                       "#<error spawn: not inside a nursery>") == 0);
+}
+
+TEST(test_nursery_first_error_cancels_the_rest) {
+    char out[256];
+    ASSERT(run_program(
+        "(define (spin n) (do (yield) (spin (+ n 1))))\n"
+        "(nursery (spawn (spin 0)) (spawn (sleep-ms 5) (error 'stop)))\n"
+        "(nursery (spawn (spin 0)) (error 'body))\n"
+        "(nursery (spawn (nursery (spawn (spin 0)))) (spawn (error 'outer)))\n"
+        "(with-budget (allocs 20) (nursery (spawn (spin 0)) (spin 0)))",
+        out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "#<error stop>\n#<error body>\n#<error outer>\n"
+                       "#<error budget-exceeded>") == 0);
+}
+
+TEST(test_spawn_needs_a_body) {
+    CompilerOptions opts = { .use_embedded_runtime = true };
+    Compiler* c = omni_compiler_new_with_options(&opts);
+    ASSERT(omni_compiler_compile_to_c(c, "(nursery (spawn))") == NULL);
+    ASSERT(strstr(omni_compiler_get_error(c, 0), "expected (spawn body...)") != NULL);
+    omni_compiler_free(c);
+}
+
+TEST(test_with_cancel_stops_when_its_token_is_cancelled) {
+    char out[256];
+    ASSERT(run_program(
+        "(define (spin n) (do (yield) (spin (+ n 1))))\n"
+        "(define tok (make-cancel))\n"
+        "(cancelled? tok)\n"
+        "(nursery (spawn (sleep-ms 5) (cancel! tok)) (spawn (error? (with-cancel tok (spin 0)))))\n"
+        "(cancelled? tok)\n"
+        "(with-cancel tok 1)\n"
+        "(with-cancel (make-cancel) 1 2)\n"
+        "(with-cancel 'tok 1)",
+        out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "0\n(() 1)\n1\n#<error cancelled>\n2\n"
+                       "#<error with-cancel: not a cancel token>") == 0);
+}
+
+TEST(test_cancel_wakes_a_sleeper) {
+    char out[128];
+    ASSERT(run_program(
+        "(define tok (make-cancel))\n"
+        "(nursery (spawn (sleep-ms 5) (cancel! tok))"
+        " (let ((t0 (monotonic-millis)))"
+        "  (with-cancel tok (sleep-ms 60000))"
+        "  (< (- (monotonic-millis) t0) 10000)))",
+        out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "(())") == 0);
+}
+
+TEST(test_coop_cancel_checks_on_every_call) {
+    const char* src =
+        "(define (spin) (spin))\n"
+        "(define tok (make-cancel))\n"
+        "(cancel! tok)\n"
+        "(with-cancel tok (spin))";
+    CompilerOptions opts = { .use_embedded_runtime = true, .coop_cancel = true };
+    Compiler* c = omni_compiler_new_with_options(&opts);
+    char* code = omni_compiler_compile_to_c(c, src);
+    ASSERT(code != NULL);
+    ASSERT(strstr(code, "omni_cancel_point();") != NULL);
+    free(code);
+    omni_compiler_free(c);
+
+    /* Off by default */
+    c = omni_compiler_new();
+    code = omni_compiler_compile_to_c(c, src);
+    ASSERT(code != NULL);
+    ASSERT(strstr(code, "omni_cancel_point();") == NULL);
+    free(code);
+    omni_compiler_free(c);
+
+    char out[64];
+    ASSERT(run_program_with(&opts, src, out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "()\n#<error cancelled>") == 0);
+}
+
+TEST(test_with_cancel_needs_a_token_and_body) {
+    CompilerOptions opts = { .use_embedded_runtime = true };
+    Compiler* c = omni_compiler_new_with_options(&opts);
+    ASSERT(omni_compiler_compile_to_c(c, "(with-cancel (make-cancel))") == NULL);
+    ASSERT(strstr(omni_compiler_get_error(c, 0), "expected (with-cancel token body...)") != NULL);
+    omni_compiler_free(c);
+}
+
+TEST(test_await_memoizes_the_result) {
+    char out[128];
+    ASSERT(run_program(
+        "(define (slow n) (do (sleep-ms 100) (* n 2)))\n"
+        "(define p (future (slow 21)))\n"
+        "(promise-done? p)\n"
+        "(await p)\n"
+        "(await p)\n"
+        "(promise-done? p)\n"
+        "(define (add1 x) (await (future (+ x 1))))\n"
+        "(add1 5)\n"
+        "(all-of (cons (future (slow 1)) (cons p ())))",
+        out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "0\n42\n42\n1\n6\n(2 42)") == 0);
+}
+
+TEST(test_pool_runs_many_tasks_on_few_threads) {
+    char out[256];
+    ASSERT(run_program(
+        "(define pool (make-pool 4))\n"
+        "(define (submit-all n acc)\n"
+        "  (if (= n 0) acc (submit-all (- n 1) (cons (pool-submit pool (lambda () (* n n))) acc))))\n"
+        "(fold + 0 (all-of (submit-all 1000 ())))\n"
+        "pool\n"
+        "(pool-submit pool 1)\n"
+        "(make-pool 0)",
+        out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "333833500\n#<pool>\n#<error pool-submit: not a procedure of no arguments>\n"
+                       "#<error make-pool: size must be between 1 and 1024>") == 0);
+
+    /* Under the inline scheduler a pool starts no threads */
+    setenv("PURPLE_SCHEDULER", "inline", 1);
+    int status = run_program("(let ((p (make-pool 2))) (await (pool-submit p (lambda () (display 1) 2))))",
+                             out, sizeof(out));
+    unsetenv("PURPLE_SCHEDULER");
+    ASSERT(status == 0 && strcmp(out, "12") == 0);
+}
+
+TEST(test_future_needs_a_body) {
+    CompilerOptions opts = { .use_embedded_runtime = true };
+    Compiler* c = omni_compiler_new_with_options(&opts);
+    ASSERT(omni_compiler_compile_to_c(c, "(future)") == NULL);
+    ASSERT(strstr(omni_compiler_get_error(c, 0), "expected (future body...)") != NULL);
+    omni_compiler_free(c);
+}
+
+TEST(test_wait_group_joins_goroutines) {
+    char out[128];
+    ASSERT(run_program(
+        "(define (start n)\n"
+        "  (wait-group (go (sleep-ms (* 30 n)) (display n))\n"
+        "              (if (> n 1) (go (start (- n 1))) ())\n"
+        "              n))\n"
+        "(start 3)",
+        out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "1233") == 0);
+}
+
+TEST(test_go_counts_shared_captures_atomically) {
+    CompilerOptions opts = { .use_embedded_runtime = true };
+    Compiler* c = omni_compiler_new_with_options(&opts);
+    char* code = omni_compiler_compile_to_c(c, "(define (f x) (wait-group (go (car x)) (cdr x))) (f (cons 1 2))");
+    ASSERT(code != NULL);
+    ASSERT(strstr(code, "omni_go(_go_0, ") != NULL);
+    ASSERT(strstr(code, ", 1, 0x1ULL)") != NULL);
+    free(code);
+    omni_compiler_free(c);
+}
+
+TEST(test_shared_variables_count_atomically) {
+    CompilerOptions opts = { .use_embedded_runtime = true };
+    Compiler* c = omni_compiler_new_with_options(&opts);
+    char* code = omni_compiler_compile_to_c(c, "(define (f xs) (wait-group (go (length xs)) (or xs 1)))\n"
+                                               "(define (g ys) (or ys 1))\n"
+                                               "(f '(1)) (g '(2))");
+    ASSERT(code != NULL);
+    ASSERT(strstr(code, "(atomic_inc_ref(o_xs), o_xs)") != NULL);
+    ASSERT(strstr(code, "(inc_ref(o_ys), o_ys)") != NULL);
+    free(code);
+    omni_compiler_free(c);
+}
+
+TEST(test_go_needs_a_body) {
+    CompilerOptions opts = { .use_embedded_runtime = true };
+    Compiler* c = omni_compiler_new_with_options(&opts);
+    ASSERT(omni_compiler_compile_to_c(c, "(go)") == NULL);
+    ASSERT(strstr(omni_compiler_get_error(c, 0), "expected (go body...)") != NULL);
+    omni_compiler_free(c);
+}
+
+TEST(test_lift_persists_compile_time_values) {
+    char out[128];
+    ASSERT(run_program(
+        "(define (sq x) (* x x))\n"
+        "(lift 42)\n"
+        "(run (lift '(1 2)))\n"
+        "((lift sq) 5)\n"
+        "(lift (lambda (a b) a))",
+        out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "42\n(1 2)\n25\n#<closure arity 2>") == 0);
+}
+
+TEST(test_lift_rejects_run_time_values) {
+    static const struct { const char* src; const char* why; } cases[] = {
+        { "(let ((x 1)) (lift x))", "cannot lift (lift x): variables are only known at run time" },
+        { "(lift (box 1))", "boxes have no compiled representation" },
+        { "(define (f) (lift (g 1)))", "the value is computed at run time" },
+        { "(run 3)", "cannot run (run 3)" },
+    };
+    CompilerOptions opts = { .use_embedded_runtime = true };
+    Compiler* c = omni_compiler_new_with_options(&opts);
+    for (size_t i = 0; i < sizeof(cases) / sizeof(cases[0]); i++) {
+        ASSERT(omni_compiler_compile_to_c(c, cases[i].src) == NULL);
+        ASSERT(omni_compiler_error_count(c) == 1);
+        ASSERT(strstr(omni_compiler_get_error(c, 0), cases[i].why) != NULL);
+    }
+    omni_compiler_free(c);
+}
+
+TEST(test_code_combinators_build_programs) {
+    char out[128];
+    ASSERT(run_program(
+        "(define (sq x) (* x x))\n"
+        "(define (cube x) (staged-power 3 x))\n"
+        "(code-app (lift sq) (lift 5))\n"
+        "(code-let y (lift 2) (code-app (lift +) y y))\n"
+        "(run (code-if (lift 1) (lift 'yes) (lift 'no)))\n"
+        "(cube 2)\n"
+        "(staged-power 0 (lift 9))\n"
+        "(staged-unroll 3 (lift display))",
+        out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "25\n4\nyes\n8\n1\n012()") == 0);
+}
+
+TEST(test_code_combinators_reject_non_code) {
+    static const struct { const char* src; const char* why; } cases[] = {
+        { "(code-app (lift +) 1 (lift 2))", "cannot stage 1: not code" },
+        { "(define (f n x) (staged-power n x))", "with n a literal from 0 to 1024" },
+        { "(staged-unroll 2000 (lift display))", "with n a literal from 0 to 1024" },
+    };
+    CompilerOptions opts = { .use_embedded_runtime = true };
+    Compiler* c = omni_compiler_new_with_options(&opts);
+    for (size_t i = 0; i < sizeof(cases) / sizeof(cases[0]); i++) {
+        ASSERT(omni_compiler_compile_to_c(c, cases[i].src) == NULL);
+        ASSERT(omni_compiler_error_count(c) == 1);
+        ASSERT(strstr(omni_compiler_get_error(c, 0), cases[i].why) != NULL);
+    }
+    omni_compiler_free(c);
+}
+
+TEST(test_for_each_runs_for_effects) {
+    char out[64];
+    ASSERT(run_program(
+        "(define (show xs) (for-each display xs) (newline) (length xs))\n"
+        "(show '(1 2 3))\n"
+        "(for-each (lambda (x) (display (* x 10))) '(4 5))",
+        out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "123\n3\n4050()") == 0);
+}
+
+TEST(test_discarded_map_warns) {
+    CompilerOptions opts = { .use_embedded_runtime = true };
+    Compiler* c = omni_compiler_new_with_options(&opts);
+
+    char* code = omni_compiler_compile_to_c(c, "(do (map display '(1)) 1)");
+    ASSERT(code != NULL);
+    free(code);
+    ASSERT(omni_compiler_warning_count(c) == 1);
+    ASSERT(strstr(omni_compiler_get_warning(c, 0), "for-each") != NULL);
+
+    code = omni_compiler_compile_to_c(c, "(do (for-each display '(1)) (map car '((1))))");
+    ASSERT(code != NULL);
+    free(code);
+    ASSERT(omni_compiler_warning_count(c) == 0);
+
+    /* From a file, the warning points at the call */
+    OmniSource unit = { "main.omni", "(define xs '(1))\n(do (map display xs)\n    1)" };
+    ASSERT(omni_compiler_check_units(c, &unit, 1));
+    ASSERT(omni_compiler_warning_count(c) == 1);
+    const char* w = omni_compiler_get_warning(c, 0);
+    ASSERT(strstr(w, "main.omni:2:5: result of map is discarded") == w);
+
+    omni_compiler_free(c);
+}
+
+TEST(test_checked_lists_reject_improper) {
+    char out[256];
+    const char* src =
+        "(length '(1 2 . 3))\n"
+        "(map (lambda (x) x) (cons 1 2))\n"
+        "(length '(1 2))\n"
+        "(proper-list? '(1 2))";
+
+    /* Unchecked, the dotted tail ends the list */
+    ASSERT(run_program(src, out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "2\n(1)\n2\n1") == 0);
+
+    CompilerOptions opts = { .use_embedded_runtime = true, .checked = true };
+    ASSERT(run_program_with(&opts, src, out, sizeof(out)) == 0);
+    ASSERT(strcmp(out,
+                  "#<error length: improper list, non-list tail after 2 elements>\n"
+                  "#<error map: improper list, non-list tail after 1 element>\n"
+                  "2\n1") == 0);
+}
+
+TEST(test_improper_literal_warns) {
+    CompilerOptions opts = { .use_embedded_runtime = true };
+    Compiler* c = omni_compiler_new_with_options(&opts);
+
+    char* code = omni_compiler_compile_to_c(c, "(length '(1 2 . 3))");
+    ASSERT(code != NULL);
+    free(code);
+    ASSERT(omni_compiler_warning_count(c) == 1);
+    ASSERT(strstr(omni_compiler_get_warning(c, 0),
+                  "length gets the improper list (1 2 . 3)") == omni_compiler_get_warning(c, 0));
+
+    /* Through a binding, but not once a parameter hides it */
+    code = omni_compiler_compile_to_c(c,
+        "(define xs '(a . b))\n"
+        "(reverse xs)\n"
+        "(define (f xs) (reverse xs))");
+    ASSERT(code != NULL);
+    free(code);
+    ASSERT(omni_compiler_warning_count(c) == 1);
+    ASSERT(strstr(omni_compiler_get_warning(c, 0), "reverse gets") == omni_compiler_get_warning(c, 0));
+
+    /* From a file, the warning points at the call */
+    OmniSource unit = { "main.omni", "(define xs '(a . b))\n(display (reverse xs))" };
+    ASSERT(omni_compiler_check_units(c, &unit, 1));
+    ASSERT(omni_compiler_warning_count(c) == 1);
+    const char* w = omni_compiler_get_warning(c, 0);
+    ASSERT(strstr(w, "main.omni:2:10: reverse gets the improper list (a . b)") == w);
+
+    code = omni_compiler_compile_to_c(c, "(length '(1 2)) (car '(1 . 2))");
+    ASSERT(code != NULL);
+    free(code);
+    ASSERT(omni_compiler_warning_count(c) == 0);
+
+    omni_compiler_free(c);
+}
+
+/* ========== Constraint Checking ========== */
+
+TEST(test_constraint_check_registers_borrows) {
+    const char* src =
+        "(define xs '(1 2 3))\n"
+        "(let ((ys '(4 5))) (map (lambda (x) (* x 2)) ys))\n"
+        "(fold + 0 xs)";
+    CompilerOptions opts = { .use_embedded_runtime = true, .constraint_check = true };
+    Compiler* c = omni_compiler_new_with_options(&opts);
+    char* code = omni_compiler_compile_to_c(c, src);
+    ASSERT(code != NULL);
+    ASSERT(strstr(code, "omni_cc_enable();") != NULL);
+    ASSERT(strstr(code, "omni_cc_alloc(o_xs, \"form 1: define xs\")") != NULL);
+    ASSERT(strstr(code, "omni_cc_alloc(o_ys, \"form 2: let ys\")") != NULL);
+    ASSERT(strstr(code, "omni_cc_borrow(o_ys, \"form 2: (map (lambda (x) (* x 2)) ys)\")") != NULL);
+    ASSERT(strstr(code, "omni_cc_borrow(o_xs, \"form 3: (fold + 0 xs)\")") != NULL);
+    free(code);
+    omni_compiler_free(c);
+
+    /* Off by default */
+    c = omni_compiler_new();
+    code = omni_compiler_compile_to_c(c, src);
+    ASSERT(code != NULL);
+    ASSERT(strstr(code, "omni_cc_") == NULL);
+    free(code);
+    omni_compiler_free(c);
+
+    char out[64];
+    ASSERT(run_program_with(&opts, src, out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "(8 10)\n6") == 0);
+}
+
+TEST(test_constraint_check_reports_free_while_borrowed) {
+    CompilerOptions opts = { .use_embedded_runtime = true, .constraint_check = true };
+    Compiler* c = omni_compiler_new_with_options(&opts);
+    char* code = omni_compiler_compile_to_c(c, "1");
+    omni_compiler_free(c);
+    ASSERT(code != NULL);
+
+    /* Keep the generated layer, but drive it by hand */
+    char* main_fn = strstr(code, "int main(void)");
+    ASSERT(main_fn != NULL);
+
+    char src_path[] = "/tmp/omni_test_cc_XXXXXX.c";
+    int fd = mkstemps(src_path, 2);
+    ASSERT(fd >= 0);
+    FILE* f = fdopen(fd, "w");
+    fwrite(code, 1, (size_t)(main_fn - code), f);
+    fprintf(f, "int program_main(void)%s", main_fn + strlen("int main(void)"));
+    fputs("int main(void) {\n"
+          "    omni_cc_enable();\n"
+          "    Obj* kept = mk_int(1);\n"
+          "    Obj* o = mk_int(2);\n"
+          "    omni_cc_alloc(kept, \"site A\");\n"
+          "    omni_cc_borrow(kept, \"site B\");\n"
+          "    omni_cc_release(kept);\n"
+          "    free_obj(kept);\n"
+          "    omni_cc_alloc(o, \"site C\");\n"
+          "    omni_cc_borrow(o, \"site D\");\n"
+          "    free_obj(o);\n"
+          "    return 0;\n"
+          "}\n", f);
+    fclose(f);
+    free(code);
+
+    char bin_path[sizeof(src_path)];
+    memcpy(bin_path, src_path, sizeof(src_path));
+    bin_path[strlen(bin_path) - 2] = '\0';
+    char cmd[256];
+    snprintf(cmd, sizeof(cmd), "gcc -w -o %s %s -lm -lpthread && %s 2>&1", bin_path, src_path, bin_path);
+    FILE* p = popen(cmd, "r");
+    ASSERT(p != NULL);
+    char out[256];
+    size_t n = fread(out, 1, sizeof(out) - 1, p);
+    out[n] = '\0';
+    int status = pclose(p);
+    unlink(src_path);
+    unlink(bin_path);
+
+    ASSERT(status == 0);
+    ASSERT(strcmp(out,
+                  "constraint violation: object allocated at site C freed while borrowed at site D\n"
+                  "constraint check: 1 violation\n") == 0);
+}
+
+TEST(test_constraint_check_writes_trace) {
+    char path[] = "/tmp/omni_test_trace_XXXXXX";
+    int fd = mkstemp(path);
+    ASSERT(fd >= 0);
+    close(fd);
+
+    CompilerOptions opts = { .use_embedded_runtime = true, .constraint_check = true };
+    char out[64];
+    setenv("PURPLE_CONSTRAINT_TRACE", path, 1);
+    int status = run_program_with(&opts, "(let ((ys '(4 5))) (map (lambda (x) x) ys))",
+                                  out, sizeof(out));
+    unsetenv("PURPLE_CONSTRAINT_TRACE");
+    ASSERT(status == 0);
+
+    char trace[512];
+    FILE* f = fopen(path, "r");
+    ASSERT(f != NULL);
+    size_t n = fread(trace, 1, sizeof(trace) - 1, f);
+    trace[n] = '\0';
+    fclose(f);
+    unlink(path);
+
+    /* alloc, borrow, release of the same object */
+    char addr[32];
+    ASSERT(sscanf(trace, "alloc %31s", addr) == 1);
+    char expect[256];
+    snprintf(expect, sizeof(expect),
+             "alloc %s form 1: let ys\n"
+             "borrow %s form 1: (map (lambda (x) x) ys)\n"
+             "release %s\n", addr, addr, addr);
+    ASSERT(strncmp(trace, expect, strlen(expect)) == 0);
+}
+
+/* ========== Analysis Reflection ========== */
+
+TEST(test_reflection_reports_verdicts) {
+    char out[128];
+    ASSERT(run_program(
+        "(let ((x '(1 2))) (ownership-of 'x))\n"
+        "(define (f y) (ownership-of 'y))\n"
+        "(f 1)\n"
+        "(define (g z) z)\n"
+        "(ownership-of 'z)\n"
+        "(let ((x '(1 2))) (shape-of 'x))\n"
+        "(ownership-of 'nowhere)",
+        out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "local\nborrowed\ntransferred\ntree\nunknown") == 0);
+}
+
+TEST(test_reflection_is_resolved_at_compile_time) {
+    Compiler* c = omni_compiler_new();
+    char* code = omni_compiler_compile_to_c(c, "(let ((x '(1))) (shape-of 'x))");
+    ASSERT(code != NULL);
+    ASSERT(strstr(code, "mk_sym(\"tree\")") != NULL);
+    ASSERT(strstr(code, "shape_of") == NULL);
+    free(code);
+    omni_compiler_free(c);
+}
+
+/* ========== Queries ========== */
+
+TEST(test_query_answers_after_compiling) {
+    Compiler* c = omni_compiler_new();
+    ASSERT(omni_compiler_query(c) == NULL);
+    OmniSource unit = { "prog.omni",
+        "(deftype Node (val int) (next Node) (prev Node :weak))\n"
+        "(define (show x) (display x))\n"
+        "(let ((p '(1 2)))\n"
+        "  (+ (length p) 1))\n" };
+    ASSERT(omni_compiler_check_units(c, &unit, 1));
+    const OmniQuery* q = omni_compiler_query(c);
+    ASSERT(q != NULL);
+
+    const OmniTypeInfo* t = omni_query_lookup_type(q, "Node");
+    ASSERT(t && t->field_count == 3 && t->shape == SHAPE_CYCLIC);
+    ASSERT(strcmp(t->fields[0].type, "int") == 0);
+    ASSERT(omni_query_field_strength(q, "Node", "next") == OMNI_FIELD_STRONG);
+    ASSERT(omni_query_field_strength(q, "Node", "prev") == OMNI_FIELD_WEAK);
+    ASSERT(omni_query_field_strength(q, "Node", "nope") == OMNI_FIELD_UNKNOWN);
+    ASSERT(omni_query_lookup_type(q, "Leaf") == NULL);
+    ASSERT(!t->sum && t->variant_count == 0);
+
+    const OmniFunctionInfo* f = omni_query_function_effects(q, "show");
+    ASSERT(f && (f->effects & EFFECT_IO) && f->param_count == 1);
+    ASSERT(strcmp(f->params[0], "x") == 0 && f->param_ownership[0] == PARAM_BORROWED);
+    f = omni_query_function_effects(q, "map");
+    ASSERT(f && f->effects == 0 && f->effect_param == 0);
+
+    /* Anywhere on a variable's name; not on primitives or between names */
+    OwnershipKind own;
+    ShapeClass shape;
+    ASSERT(omni_query_ownership_at(q, "prog.omni", 2, 27, &own) && own == OWNER_BORROWED);
+    ASSERT(omni_query_ownership_at(q, "prog.omni", 3, 8, &own) && own == OWNER_LOCAL);
+    ASSERT(omni_query_shape_at(q, "prog.omni", 4, 14, &shape) && shape == SHAPE_TREE);
+    ASSERT(!omni_query_ownership_at(q, "prog.omni", 4, 7, &own));
+    ASSERT(!omni_query_ownership_at(q, "prog.omni", 4, 15, &own));
+    ASSERT(!omni_query_shape_at(q, "other.omni", 4, 14, &shape));
+
+    /* Each compilation replaces it; one that does not parse leaves none */
+    ASSERT(omni_compiler_check_units(c, &(OmniSource){ "prog.omni", "(+ 1 2)" }, 1));
+    ASSERT(omni_query_lookup_type(omni_compiler_query(c), "Node") == NULL);
+    ASSERT(!omni_compiler_check_units(c, &(OmniSource){ "prog.omni", "(+ 1" }, 1));
+    ASSERT(omni_compiler_query(c) == NULL);
+    omni_compiler_free(c);
+}
+
+TEST(test_query_describes_sum_types) {
+    Compiler* c = omni_compiler_new();
+    OmniSource unit = { "prog.omni",
+        "(deftype Tree (Leaf (v int)) (Branch (l Tree) (r Tree) (up Tree)))\n" };
+    ASSERT(omni_compiler_check_units(c, &unit, 1));
+    const OmniQuery* q = omni_compiler_query(c);
+
+    const OmniTypeInfo* t = omni_query_lookup_type(q, "Tree");
+    ASSERT(t && t->field_count == 0 && t->variant_count == 2 && t->shape == SHAPE_CYCLIC);
+    ASSERT(strcmp(t->variants[0], "Leaf") == 0 && strcmp(t->variants[1], "Branch") == 0);
+    t = omni_query_lookup_type(q, "Branch");
+    ASSERT(t && t->field_count == 3 && strcmp(t->sum, "Tree") == 0);
+    ASSERT(omni_query_field_strength(q, "Branch", "l") == OMNI_FIELD_STRONG);
+    ASSERT(omni_query_field_strength(q, "Branch", "up") == OMNI_FIELD_WEAK);
+    ASSERT(omni_query_lookup_type(q, "Leaf")->shape == SHAPE_TREE);
+    omni_compiler_free(c);
+}
+
+TEST(test_query_call_graph) {
+    Compiler* c = omni_compiler_new();
+    OmniSource unit = { "prog.omni",
+        "(define (log x) (display x))\n"
+        "(define (bump! v) (vector-set! v 0 1) v)\n"
+        "(define (check n) (if (< n 0) (error 'negative n) n))\n"
+        "(define (run v n)\n"
+        "  (log n)\n"
+        "  (check (bump! v))\n"
+        "  (log '(run)))\n" };
+    ASSERT(omni_compiler_check_units(c, &unit, 1));
+    const OmniQuery* q = omni_compiler_query(c);
+
+    /* Effects of every form of a body, and of the functions it calls */
+    const OmniFunctionInfo* run = omni_query_function_effects(q, "run");
+    ASSERT(run && run->in_program && run->effects == (EFFECT_IO | EFFECT_MUTATE | EFFECT_THROW));
+    ASSERT(strcmp(run->params[0], "v") == 0 && strcmp(run->params[1], "n") == 0);
+    ASSERT(!omni_query_function_effects(q, "map")->in_program);
+
+    /* One edge per caller and callee, with what the callee does with each argument */
+    ASSERT(omni_query_call_count(q) == 3);
+    const OmniCallInfo* call = omni_query_call(q, 1);
+    ASSERT(strcmp(call->caller, "run") == 0 && strcmp(call->callee, "check") == 0);
+    ASSERT(call->arg_count == 1 && call->args[0] == PARAM_PASSTHROUGH);
+
+    char out[1024];
+    FILE* f = fmemopen(out, sizeof(out), "w");
+    omni_query_print_call_graph(q, f, OMNI_GRAPH_DOT);
+    fclose(f);
+    ASSERT(strcmp(out,
+        "digraph calls {\n"
+        "  \"log\" [label=\"log\\nio\"];\n"
+        "  \"bump!\" [label=\"bump!\\nmutates\"];\n"
+        "  \"check\" [label=\"check\\nthrows\"];\n"
+        "  \"run\" [label=\"run\\nmutates, io, throws\"];\n"
+        "  \"run\" -> \"log\" [label=\"borrowed\"];\n"
+        "  \"run\" -> \"check\" [label=\"passthrough\"];\n"
+        "  \"run\" -> \"bump!\" [label=\"passthrough\"];\n"
+        "}\n") == 0);
+
+    f = fmemopen(out, sizeof(out), "w");
+    omni_query_print_call_graph(q, f, OMNI_GRAPH_JSON);
+    fclose(f);
+    ASSERT(strstr(out, "{\"name\": \"run\", \"effects\": [\"mutates\", \"io\", \"throws\"]}") != NULL);
+    ASSERT(strstr(out, "{\"from\": \"run\", \"to\": \"check\", \"args\": [\"passthrough\"]}") != NULL);
+    omni_compiler_free(c);
+}
+
+/* ========== Independent Sessions ========== */
+
+/* Each thread compiles with its own compiler; returns non-NULL on failure */
+static void* compile_in_thread(void* arg) {
+    const char* src = arg;
+    Compiler* c = omni_compiler_new();
+    for (int i = 0; i < 50; i++) {
+        char* code = omni_compiler_compile_to_c(c, src);
+        bool ok = code && strstr(code, "o_sq") && !omni_compiler_has_errors(c);
+        free(code);
+        if (!ok) {
+            omni_compiler_free(c);
+            return (void*)1;
+        }
+    }
+    omni_compiler_free(c);
+    return NULL;
+}
+
+TEST(test_compilers_run_concurrently) {
+    const char* src = "(define (sq x) (* x x)) (map sq '(1 2 3))";
+    pthread_t threads[4];
+    for (int i = 0; i < 4; i++) {
+        ASSERT(pthread_create(&threads[i], NULL, compile_in_thread, (void*)src) == 0);
+    }
+    int failures = 0;
+    for (int i = 0; i < 4; i++) {
+        void* result;
+        pthread_join(threads[i], &result);
+        if (result) failures++;
+    }
+    ASSERT(failures == 0);
+}
+
+TEST(test_compile_frees_its_session) {
+    Compiler* c = omni_compiler_new();
+    char* code = omni_compiler_compile_to_c(c, "(+ 1 2)");
+    ASSERT(code != NULL);
+    free(code);
+    ASSERT(c->session == NULL);
+
+    /* Trees from the caller's session stay the caller's */
+    OmniValue* expr = omni_parse_string(session, "(* 2 3)");
+    code = omni_compiler_compile_ast_to_c(c, &expr, 1);
+    ASSERT(code != NULL);
+    free(code);
+    ASSERT(c->session == NULL);
+    ASSERT(omni_is_cell(expr) && omni_sym_eq_str(omni_car(expr), "*"));
+    omni_compiler_free(c);
+}
+
+/* ========== Back-end Parity ========== */
+
+/* What each back end prints for a program; NULL means it does not build,
+ * which must then hold on both */
+static const struct {
+    const char* src;
+    const char* embedded;
+    const char* libpurple;
+} g_backend_cases[] = {
+    { "(+ 1 2)", "3", "3" },
+    { "(let ((x 1)) (+ x 2))", "3", "3" },
+    { "(define (f x) (* x 2)) (f 4)", "8", "8" },
+    { "(if (< 1 2.5) 1.5 #\\a)", "1.5", "1.5" },
+    { "(/ 1.0 0.0)", "+inf.0", "+inf.0" },
+    { "(/ -1 0.0)", "-inf.0", "-inf.0" },
+    { "(let ((z 0.0)) (/ z z))", "+nan.0", "+nan.0" },
+    { "(fold + 0 '(1 2 3))", "6", "6" },
+    { "(error 'oops 1)", "#<error oops>", "#<error oops>" },
+    { "(define (sq x) (* x x)) sq", "#<closure sq arity 1>", "#<closure sq arity 1>" },
+    { "(arity (lambda (a b) a))", "2", "2" },
+    { "(define (adder n) (lambda (x) (+ x n))) ((adder 2) 3)", "5", "5" },
+    { "(define (make-counter) (let ((n 0)) (lambda () (set! n (+ n 1)) n))) "
+      "(let ((c (make-counter))) (c) (c))", "2", "2" },
+    { "'(1 2 3)", "(1 2 3)", "(1 2 3)" },
+    { "(length '(1 2 3))", "3", "3" },
+    { "(let ((x 2)) `(1 ,x 3))", "(1 2 3)", "(1 2 3)" },
+    { "'(1 (2 . 3) . 4)", "(1 (2 . 3) . 4)", "(1 (2 . 3) . 4)" },
+    { "(proper-list? (cons 1 2))", "0", "0" },
+    { "(let () (define x 1) (+ x 1))", "2", "2" },
+    { "((lambda (a) (define b (* a 2)) (+ a b)) 3)", "9", "9" },
+    { "(define (f) (define a 1) (define b (+ a 1)) (* a b)) (f)", "2", "2" },
+    { "(do (define q 4) (+ q 1))", "5", "5" },
+    { "(let () (define (g) 1) (g))", NULL, NULL },
+    { "(car '(1 2))", "1", "1" },
+    { "(map car '((1 2) (3 4)))", "(1 3)", "(1 3)" },
+    { "(define g cdr) (cons (g '(1 2)) (procedure? car))", "((2) . 1)", "((2) . 1)" },
+    { "\"hi\"", "hi", "hi" },
+    { "(string-append \"a\\\"\" \"b\")", "a\"b", "a\"b" },
+    { "(write (substring \"hello\\n\" 3 6))", "\"lo\\n\"()", "\"lo\\n\"()" },
+    { "(string-ref \"abc\" 2)", "c", "c" },
+    { "(let ((s \"abc\")) (string-length s))", "3", "3" },
+    { "(string-ref \"abc\" 3)", "#<error string-ref: index out of range>",
+                                  "#<error string-ref: index out of range>" },
+    { "(error \"went wrong\")", "#<error went wrong>", "#<error went wrong>" },
+    { "(gcd 1.5 3)", "#<error gcd: not an integer>", "#<error gcd: not an integer>" },
+    { "(let ((x 2)) (lcm x 0.5))", "#<error lcm: not an integer>", "#<error lcm: not an integer>" },
+    { "[1 (+ 1 1) \"3\"]", "[1 2 3]", "[1 2 3]" },
+    { "(write (vector #\\a \"b\" '(c)))", "[#\\a \"b\" (c)]()", "[#\\a \"b\" (c)]()" },
+    { "(let ((v (make-vector 3 0))) (vector-set! v 1 '(x)) v)", "[0 (x) 0]", "[0 (x) 0]" },
+    { "(vector-length '[a b])", "2", "2" },
+    { "(vector-ref (vector 1 2) 2)", "#<error vector-ref: index out of range>",
+                                      "#<error vector-ref: index out of range>" },
+    { "(let ((h (hash))) (hash-set! h 'a 1) (hash-set! h \"b\" '(2)) (hash-set! h 'a 3) h)",
+      "#{a 3 b (2)}", "#{a 3 b (2)}" },
+    { "(let ((h (hash))) (hash-set! h 1 'x) (hash-set! h 2 'y) (hash-remove! h 1) (hash-keys h))",
+      "(2)", "(2)" },
+    { "(let ((h (hash))) (hash-set! h \"k\" 'v) (hash-get h \"k\"))", "v", "v" },
+    { "(hash-get (hash) 'missing)", "()", "()" },
+    { "(hash-count 'h)", "#<error hash-count: not a hash table>",
+                         "#<error hash-count: not a hash table>" },
+    { "(assoc (assoc (pmap) 'a 1) \"b\" '(2))", "#pmap{b (2) a 1}", "#pmap{b (2) a 1}" },
+    { "(let ((m (assoc (pmap) 'a 1))) (cons (get (dissoc m 'a) 'a) (count m)))", "(() . 1)", "(() . 1)" },
+    { "(keys (assoc (assoc (assoc (pmap) 1 'a) 2 'b) 3 'c))", "(2 1 3)", "(2 1 3)" },
+    { "(let ((v (conj (conj (pvec) 1) 2))) (cons (assoc v 1 'b) v))",
+      "(#pvec[1 b] . #pvec[1 2])", "(#pvec[1 b] . #pvec[1 2])" },
+    { "(define (grow v n) (if (= n 0) v (grow (conj v n) (- n 1)))) "
+      "(let ((v (grow (pvec) 40))) (cons (count v) (cons (get v 0) (get (freeze (assoc v 39 'z)) 39))))",
+      "(40 40 . z)", "(40 40 . z)" },
+    { "(let ((m (assoc (pmap) 'k 2))) (await (future (get (assoc m 'j 3) 'k))))", "2", "2" },
+    { "(cons (pmap? (pmap)) (pvec? (pmap)))", "(1 . 0)", "(1 . 0)" },
+    { "(conj (pmap) 1)", "#<error conj: not a persistent vector>", "#<error conj: not a persistent vector>" },
+    { "(assoc (pvec) 1 'x)", "#<error assoc: index out of range>", "#<error assoc: index out of range>" },
+    { "(let ((t (transient (pmap)))) (assoc! t 'a 1) (assoc! t 'b 2) "
+      "(let ((m (persistent! t))) `(,(get m 'b) ,(count m))))", "(2 2)", "(2 2)" },
+    { "(let ((base (assoc (pmap) 1 'one))) (let ((t (assoc! (transient base) 1 'uno))) "
+      "`(,(get base 1) ,(get (persistent! t) 1))))", "(one uno)", "(one uno)" },
+    { "(let loop ((t (transient (pvec))) (i 0)) (if (= i 40) (let ((v (persistent! t))) "
+      "`(,(count v) ,(get v 39))) (loop (conj! t i) (+ i 1))))", "(40 39)", "(40 39)" },
+    { "(let ((t (transient (assoc (assoc (pmap) 1 2) 3 4)))) (dissoc! t 1) (keys (persistent! t)))", "(3)", "(3)" },
+    { "(let ((t (transient (pmap)))) `(,(transient? t) ,(pmap? t) ,(pmap? (persistent! t)) ,(transient? t)))",
+      "(1 0 1 0)", "(1 0 1 0)" },
+    { "(transient (pvec))", "#<transient pvec>", "#<transient pvec>" },
+    { "(let ((t (transient (pvec)))) (persistent! t) (conj! t 1))",
+      "#<error conj!: transient used after persistent!>", "#<error conj!: transient used after persistent!>" },
+    { "(assoc (transient (pmap)) 1 2)", "#<error assoc: a transient (use assoc!)>",
+      "#<error assoc: a transient (use assoc!)>" },
+    { "(let ((x 5)) (nursery (spawn (* x x)) (spawn (+ x 1)) x))", "(25 6)", "(25 6)" },
+    { "(nursery (spawn (error 'boom)) (spawn (sleep-ms 5) 1))", "#<error boom>", "#<error boom>" },
+    { "(spawn 1)", "#<error spawn: not inside a nursery>", "#<error spawn: not inside a nursery>" },
+    { "(let ((t (make-cancel))) (cancel! t) (cancelled? t))", "1", "1" },
+    { "(make-cancel)", "#<cancel>", "#<cancel>" },
+    { "(cond ((< 2 1) 'a) ((= 2 2) 'b) (else 'c))", "b", "b" },
+    { "(case 'y ((x) 1) ((y z) 2) (else 3))", "2", "2" },
+    { "(case \"s\" ((\"s\") 'str) (else 'no))", "str", "str" },
+    { "(let ((t (make-cancel))) (cancel! t) (with-cancel t (cons 1 2)))",
+      "#<error cancelled>", "#<error cancelled>" },
+    { "((lambda self (n) (if (= n 0) 1 (* n (self (- n 1))))) 5)", "120", "120" },
+    { "(let ((x 4)) (await (future (* x x))))", "16", "16" },
+    { "(let loop ((i 0) (acc 0)) (if (= i 40000) acc (loop (+ i 1) (+ acc (await (future i))))))",
+      "799980000", "799980000" },
+    { "(all-of (cons (future 'a) (cons (future \"b\") ())))", "(a b)", "(a b)" },
+    { "(await 'p)", "#<error await: not a promise>", "#<error await: not a promise>" },
+    { "(let ((e (error 'missing \"k\"))) (cons (error-tag e) (cons (error-payload e) (error-tag (error e)))))",
+      "(missing k . missing)", "(missing k . missing)" },
+    { "(cons (error-tag (error \"plain\")) (error-trace (error 'x)))", "(error)", "(error)" },
+    { "(cons :a (cons (keyword? :a) (cons (keyword? ':a) (cons (keyword? 'a) (if (eq? :a ':a) 'same 'apart)))))",
+      "(:a 1 1 0 . same)", "(:a 1 1 0 . same)" },
+    { "(let ((h (hash))) (hash-set! h :k 1) (hash-set! h 'k 2) (cons (hash-get h :k) (await (future :k))))",
+      "(1 . :k)", "(1 . :k)" },
+    { "(define (size k) (match k (:small 1) (:large 3) (_ 2))) (+ (size :large) (size 'large))", "5", "5" },
+    { "(let ((p (make-pool 2)) (x 3))\n"
+      "  (all-of (cons (pool-submit p (lambda () (* x x))) (cons (pool-submit p (lambda () 'b)) ()))))",
+      "(9 b)", "(9 b)" },
+    { "(pool-submit 'p (lambda () 1))", "#<error pool-submit: not a pool>", "#<error pool-submit: not a pool>" },
+    { "(let ((x 5)) (wait-group (go (* x 2)) (go (+ x 1)) x))", "5", "5" },
+    { "(define (f xs) (wait-group (go (length xs)) (go (length xs)) `(0 ,xs)))\n(f '(1 2 3))",
+      "(0 (1 2 3))", "(0 (1 2 3))" },
+    { "(cons (runtime-config 'scheduler) (runtime-config 'speed))",
+      "(threads . #<error runtime-config: unknown key>)", "(threads . #<error runtime-config: unknown key>)" },
+    { "(letrec ((ev? (lambda (n) (if (= n 0) 1 (od? (- n 1))))) (od? (lambda (n) (if (= n 0) 0 (ev? (- n 1)))))) (ev? 10))",
+      "1", "1" },
+    { "(let ((k 3)) (letrec ((f (lambda (n) (if (= n 0) k (f (- n 1)))))) (f 5)))", "3", "3" },
+    { "((do (display 0) (lambda (a b) a)) (do (display 1) 1) (do (display 2) 2))", "0121", "0\n1\n2\n1" },
+    { "'(100.0 1500.0 1e21 -2.5e-7 1e-8)", "(100.0 1500.0 1e+21 -0.00000025 1e-08)",
+      "(100.0 1500.0 1e+21 -0.00000025 1e-08)" },
+    { "(let ((x 64) (y 2.0)) `(,(expt 2 x) ,(min 1 x 0.5) ,(max x 3 99) ,(min x) ,(gcd y 4)))",
+      "(18446744073709552000.0 0.5 99 64 2.0)", "(18446744073709552000.0 0.5 99 64 2.0)" },
+    { "(let loop ((i 0) (acc 1)) (if (= i 10) acc (loop (+ i 1) (* acc 2))))", "1024", "1024" },
+    { "(deftype Point (x int) (y int)) (Point-y (mk-Point 3 4))", "4", "4" },
+    { "(deftype Point x y) (let ((p (mk-Point 3 '(4)))) (set! (Point-x p) \"a\") (write p))",
+      "#<Point x=\"a\" y=(4)>()", "#<Point x=\"a\" y=(4)>()" },
+    { "(deftype Node (val int) (parent Node)) (let ((root (mk-Node 1 '()))) (mk-Node 2 root))",
+      "#<Node val=2 parent=#<weak>>", "#<Node val=2 parent=#<weak>>" },
+    { "(deftype Node (val int) (parent Node)) "
+      "(let ((root (mk-Node 1 '()))) (let ((n (mk-Node 2 root))) (set! (Node-parent n) '()) (cons root n)))",
+      "(#<Node val=1 parent=()> . #<Node val=2 parent=()>)",
+      "(#<Node val=1 parent=()> . #<Node val=2 parent=()>)" },
+    { "(deftype Point x y) (do (define-printer Point (lambda (p port) (display \"<\" port) (write (Point-x p) port) (display \">\" port))) "
+      "(cons (mk-Point \"a\" 1) (mk-Point 2 3)))", "(<\"a\"> . <2>)", "(<\"a\"> . <2>)" },
+    { "(deftype Box v) (define-printer Box 'p)", "#<error define-printer Box: expected a procedure of 2 arguments>",
+      "#<error define-printer Box: expected a procedure of 2 arguments>" },
+    { "(deftype Box v) (cons (Box? (mk-Box 1)) (Box? '(1)))", "(1 . 0)", "(1 . 0)" },
+    { "(deftype Box v) (Box-v 'b)", "#<error Box-v: not a Box>", "#<error Box-v: not a Box>" },
+    { "(deftype Pair l r) (define (sum p) (match p ((Pair (Pair a b) c) (+ a (+ b c))) ((Pair a _) a) (_ 0))) "
+      "(cons (sum (mk-Pair (mk-Pair 1 2) 3)) (cons (sum (mk-Pair 5 'x)) (cons (sum 7) '())))", "(6 5 0)", "(6 5 0)" },
+    { "(deftype Pair l r) (define make Pair) (let ((p (make 1 (Pair 2 3)))) (cons (Pair? p) (Pair-l (Pair-r p))))",
+      "(1 . 2)", "(1 . 2)" },
+    { "(deftype Expr (Num (n int)) (Add (l Expr) (r Expr)) (Zero)) "
+      "(define (ev e) (match e ((Num n) n) ((Add a b) (+ (ev a) (ev b))) ((Zero) 0))) "
+      "(let ((e (Add (Num 3) (Add (Zero) (mk-Num 4))))) (cons (ev e) (cons (Expr-tag e) (cons (Expr? e) (Expr? 3)))))",
+      "(7 Add 1 . 0)", "(7 Add 1 . 0)" },
+    { "(deftype Shape (Circle r) (Rect w h)) (Shape-tag '(1))",
+      "#<error Shape-tag: not a Shape>", "#<error Shape-tag: not a Shape>" },
+    { "(match 3 (0 'zero) (n :when (> n 2) 'big) (_ 'small))", "big", "big" },
+    { "(match 'q (\"q\" 1))", "#<error match: no clause matches>", "#<error match: no clause matches>" },
+    { "(let ((p (open-output-string))) (with-output-to-port p (write \"a\") (newline) (write 1 (current-output-port))) "
+      "(get-output-string p))", "\"a\"\n1", "\"a\"\n1" },
+    { "(let ((p (open-output-string))) (close-port p) (cons (port? p) (write 1 p)))",
+      "(1 . #<error write: not an open output port>)", "(1 . #<error write: not an open output port>)" },
+    { "(with-output-to-port 'p 1)", "#<error with-output-to-port: not an open output port>",
+      "#<error with-output-to-port: not an open output port>" },
+    { "(define (build n) (if (= n 0) '() (cons n (build (- n 1))))) (define p (open-output-string)) "
+      "(do (with-budget (allocs 50) (with-output-to-port p (build 100))) (write 1) p)",
+      "1#<port>", "1#<port>" },
+    { "(let ((o (open-output-file \"/tmp/omni_ports_test.txt\"))) (write '(1 \"a\") o) (newline o) (close-port o) "
+      "(let ((i (open-input-file \"/tmp/omni_ports_test.txt\"))) `(,(read-char i) ,(read-line i) ,(read-line i))))",
+      "(( 1 \"a\") ())", "(( 1 \"a\") ())" },
+    { "(open-input-file \"/nonexistent/omni\")", "#<error open-input-file: cannot open the file>",
+      "#<error open-input-file: cannot open the file>" },
+    { "(let ((o (open-output-file \"/tmp/omni_flush_test.txt\"))) (set-port-buffer! o 4096) (display \"ab\" o) "
+      "(flush-port o) (read-line (open-input-file \"/tmp/omni_flush_test.txt\")))", "ab", "ab" },
+    { "(cons (flush-port 3) (set-port-buffer! (open-output-string) 'x))",
+      "(#<error flush-port: not an open output port> . #<error set-port-buffer!: expected a size in bytes or 'line>)",
+      "(#<error flush-port: not an open output port> . #<error set-port-buffer!: expected a size in bytes or 'line>)" },
+    { "(define (pick a b) (cond ((< a b) 'lt) ((= a b) 'eq) ((null? a) 'nil) ((eq? a 'x) 'x) (else 'gt)))\n"
+      "(define (kind v) (if (string? v) 's (if (vector? v) 'v (if (>= v 2) 'big 'small))))\n"
+      "`(,(pick 1 2) ,(pick 2.0 2) ,(pick 3 -1) ,(kind \"a\") ,(kind (vector 1)) ,(kind 5) ,(kind 1))",
+      "(lt eq gt s v big small)", "(lt eq gt s v big small)" },
+};
+
+TEST(test_backend_parity) {
+    /* The generated #include names the runtime by path, so make it absolute */
+    char* runtime = access("../runtime/libpurple.a", F_OK) == 0 ? realpath("../runtime", NULL) : NULL;
+    bool ok = true;
+    for (size_t i = 0; ok && i < sizeof(g_backend_cases) / sizeof(g_backend_cases[0]); i++) {
+        /* A program one back end cannot build is a gap to fix, not a case */
+        if (!g_backend_cases[i].embedded != !g_backend_cases[i].libpurple) {
+            printf("(%s builds on one back end only) ", g_backend_cases[i].src);
+            ok = false;
+        }
+        for (int backend = 0; ok && backend < 2; backend++) {
+            if (backend == 1 && !runtime) continue;
+            const char* expected = backend ? g_backend_cases[i].libpurple
+                                           : g_backend_cases[i].embedded;
+            char out[128];
+            int status = run_program_on(g_backend_cases[i].src, backend ? runtime : NULL,
+                                        out, sizeof(out));
+            ok = expected ? status == 0 && strcmp(out, expected) == 0 : status == -1;
+            if (!ok)
+                printf("(%s on %s: %s) ", g_backend_cases[i].src,
+                       backend ? "libpurple" : "embedded", status == -1 ? "no build" : out);
+        }
+    }
+    free(runtime);
+    ASSERT(ok);
+}
+
+TEST(test_open_files_are_flushed_at_exit) {
+    char* runtime = access("../runtime/libpurple.a", F_OK) == 0 ? realpath("../runtime", NULL) : NULL;
+    for (int backend = 0; backend < 2; backend++) {
+        if (backend == 1 && !runtime) continue;
+        unlink("/tmp/omni_exit_flush_test.txt");
+        char out[64];
+        int status = run_program_on("(define o (open-output-file \"/tmp/omni_exit_flush_test.txt\")) "
+                                    "(set-port-buffer! o 1024) (display \"kept\" o) 1",
+                                    backend ? runtime : NULL, out, sizeof(out));
+        ASSERT(status == 0);
+        FILE* f = fopen("/tmp/omni_exit_flush_test.txt", "r");
+        ASSERT(f != NULL);
+        char text[16] = {0};
+        size_t n = fread(text, 1, sizeof(text) - 1, f);
+        fclose(f);
+        ASSERT(n == 4 && strcmp(text, "kept") == 0);
+    }
+    free(runtime);
+    unlink("/tmp/omni_exit_flush_test.txt");
+}
+
+TEST(test_runtime_config_reads_the_environment) {
+    const char* src = "(nursery (spawn (sleep-ms 30) (display 1) 1) (spawn (display 2) 2))\n"
+                      "(cons (runtime-config 'scheduler)\n"
+                      "      (cons (runtime-config 'heap-limit) (runtime-config 'deferred-batch)))";
+    /* libpurple's display ends the line; both run the tasks in order */
+    const char* expected[2] = { "12(1 2)\n(inline 1048576 . 8)",
+                                "1\n2\n(1 2)\n\n(inline 1048576 . 8)" };
+    char* runtime = access("../runtime/libpurple.a", F_OK) == 0 ? realpath("../runtime", NULL) : NULL;
+    char out[2][128] = { "", "" };
+    int status[2] = { 0, 0 };
+
+    setenv("PURPLE_SCHEDULER", "inline", 1);
+    setenv("PURPLE_HEAP_LIMIT", "1m", 1);
+    setenv("PURPLE_DEFERRED_BATCH", "8", 1);
+    status[0] = run_program(src, out[0], sizeof(out[0]));
+    if (runtime) status[1] = run_program_on(src, runtime, out[1], sizeof(out[1]));
+    unsetenv("PURPLE_SCHEDULER");
+    unsetenv("PURPLE_HEAP_LIMIT");
+    unsetenv("PURPLE_DEFERRED_BATCH");
+
+    ASSERT(status[0] == 0 && strcmp(out[0], expected[0]) == 0);
+    if (runtime) ASSERT(status[1] == 0 && strcmp(out[1], expected[1]) == 0);
+    free(runtime);
+}
+
+/* ========== Standalone C ========== */
+
+TEST(test_standalone_c_builds_without_libpurple) {
+    char* runtime = access("../runtime/libpurple.a", F_OK) == 0 ? realpath("../runtime", NULL) : NULL;
+    if (!runtime) return;
+    CompilerOptions opts = { .runtime_path = runtime, .standalone = true };
+    Compiler* c = omni_compiler_new_with_options(&opts);
+    char* code = omni_compiler_compile_to_c(c, "(define (sq x) (* x x)) (sq 7)");
+    omni_compiler_free(c);
+    free(runtime);
+    ASSERT(code != NULL);
+    ASSERT(strstr(code, "/include/purple.h\"") == NULL);
+    ASSERT(strstr(code, "/* ========== libpurple: src/memory/handle.c ========== */") != NULL);
+
+    char dir[] = "/tmp/omni_test_standalone_XXXXXX";
+    ASSERT(mkdtemp(dir) != NULL);
+    char path[512], cmd[1200];
+    snprintf(path, sizeof(path), "%s/prog.c", dir);
+    FILE* f = fopen(path, "w");
+    fputs(code, f);
+    fclose(f);
+    free(code);
+
+    /* No -I, -L or -lpurple: the file is the whole program */
+    snprintf(cmd, sizeof(cmd), "cc -w %s/prog.c -o %s/prog -lm && %s/prog", dir, dir, dir);
+    FILE* p = popen(cmd, "r");
+    char out[64];
+    size_t n = p ? fread(out, 1, sizeof(out) - 1, p) : 0;
+    out[n] = '\0';
+    while (n > 0 && out[n - 1] == '\n') out[--n] = '\0';
+    int status = p ? pclose(p) : -1;
+    snprintf(cmd, sizeof(cmd), "rm -rf %s", dir);
+    ASSERT(system(cmd) == 0);
+    ASSERT(status == 0);
+    ASSERT(strcmp(out, "49") == 0);
+}
+
+/* ========== Size Profile ========== */
+
+TEST(test_size_profile_trims_the_runtime) {
+    CompilerOptions opts = { .use_embedded_runtime = true, .opt_level = 2, .size_profile = true };
+    Compiler* c = omni_compiler_new_with_options(&opts);
+    char* code = omni_compiler_compile_to_c(c, "(+ 1 2)");
+    ASSERT(code != NULL);
+    ASSERT(strstr(code, "prim_add") != NULL);
+    ASSERT(strstr(code, "hash-set!") == NULL);
+    ASSERT(strstr(code, "channel_new") == NULL);
+    free(code);
+
+    code = omni_compiler_compile_to_c(c, "(let ((h (hash))) (hash-set! h 1 2) h)");
+    ASSERT(code != NULL);
+    ASSERT(strstr(code, "hash-set!") != NULL);
+    free(code);
+    omni_compiler_free(c);
+}
+
+TEST(test_size_profile_matches_embedded) {
+    /* Trimmed, and printing without printf, each program prints as before */
+    CompilerOptions opts = {
+        .use_embedded_runtime = true, .opt_level = 2, .size_profile = true, .minimal_io = true,
+    };
+    for (size_t i = 0; i < sizeof(g_backend_cases) / sizeof(g_backend_cases[0]); i++) {
+        const char* expected = g_backend_cases[i].embedded;
+        if (!expected) continue;
+        char out[128];
+        int status = run_program_with(&opts, g_backend_cases[i].src, out, sizeof(out));
+        bool ok = status == 0 && strcmp(out, expected) == 0;
+        if (!ok) printf("(%s: %s) ", g_backend_cases[i].src, status == -1 ? "no build" : out);
+        ASSERT(ok);
+    }
+
+    char out[128];
+    ASSERT(run_program_with(&opts, "(cons 0.1 (cons -2.5e-7 (cons 1e21 (cons 100.0 '()))))",
+                            out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "(0.1 -0.00000025 1e+21 100.0)") == 0);
+}
+
+TEST(test_section_sizes) {
+    char path[] = "/tmp/omni_test_size_XXXXXX";
+    int fd = mkstemp(path);
+    ASSERT(fd >= 0);
+    close(fd);
+    CompilerOptions opts = { .use_embedded_runtime = true, .opt_level = 2, .size_profile = true };
+    Compiler* c = omni_compiler_new_with_options(&opts);
+    bool built = omni_compiler_compile_to_binary(c, "(+ 1 2)", path);
+    omni_compiler_free(c);
+    ASSERT(built);
+
+    OmniSectionSize sections[64];
+    int count = omni_binary_sections(path, sections, 64);
+    unlink(path);
+    ASSERT(count > 0);
+    bool text = false;
+    for (int i = 0; i < count && i < 64; i++) {
+        if (strcmp(sections[i].name, ".text") == 0) text = sections[i].size > 0;
+    }
+    ASSERT(text);
+
+    /* Not an ELF file */
+    ASSERT(omni_binary_sections("../Makefile", sections, 64) == -1);
+    ASSERT(omni_binary_sections("/nonexistent", sections, 64) == -1);
+}
+
+/* ========== Memory Modes ========== */
+
+TEST(test_memory_modes_gate_the_runtime) {
+    const char* src =
+        "(define (f xs) (map (lambda (x) (let ((p (cons x xs)))"
+        " (let ((q (cons (+ (car p) 10) (cdr p)))) q))) xs))\n"
+        "(f (cons 2 (cons 3 '())))";
+    static const struct {
+        OmniMemoryMode memory;
+        bool reuses;          /* A cons takes over a dead pair */
+        bool regions;         /* The region section is there */
+        bool channels;        /* The concurrency section is there */
+    } cases[] = {
+        { OMNI_MEMORY_DEFAULT, true, false, false },
+        { OMNI_MEMORY_ASAP, false, false, false },
+        { OMNI_MEMORY_RC, true, false, false },
+        { OMNI_MEMORY_ARENA, false, true, false },
+        { OMNI_MEMORY_ALL, true, true, true },
+    };
+    for (size_t i = 0; i < sizeof(cases) / sizeof(cases[0]); i++) {
+        CompilerOptions opts = { .use_embedded_runtime = true, .memory = cases[i].memory };
+        Compiler* c = omni_compiler_new_with_options(&opts);
+        char* code = omni_compiler_compile_to_c(c, src);
+        ASSERT(code != NULL);
+        ASSERT((strstr(code, "= REUSE_OR_NEW_CELL(o_p, ") != NULL) == cases[i].reuses);
+        ASSERT((strstr(code, "region_new(") != NULL) == cases[i].regions);
+        ASSERT((strstr(code, "channel_new(") != NULL) == cases[i].channels);
+        free(code);
+        omni_compiler_free(c);
+
+        char out[64];
+        ASSERT(run_program_with(&opts, src, out, sizeof(out)) == 0);
+        ASSERT(strcmp(out, "((12 2 3) (13 2 3))") == 0);
+    }
+
+    OmniMemoryMode mode;
+    ASSERT(omni_memory_mode_parse("arena", &mode) && mode == OMNI_MEMORY_ARENA);
+    ASSERT(!omni_memory_mode_parse("default", &mode));
+    ASSERT(!omni_memory_mode_parse("gc", &mode));
+    ASSERT(strcmp(omni_memory_mode_name(OMNI_MEMORY_RC), "rc") == 0);
+}
+
+/* ========== Provenance ========== */
+
+TEST(test_sha256_vectors) {
+    char hex[65];
+    omni_sha256_hex("", 0, hex);
+    ASSERT(strcmp(hex, "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855") == 0);
+    omni_sha256_hex("abc", 3, hex);
+    ASSERT(strcmp(hex, "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad") == 0);
+    /* 56 bytes: the length goes in a second block */
+    const char* two = "abcdbcdecdefdefgefghfghighijhijkijkljklmklmnlmnomnopnopq";
+    omni_sha256_hex(two, strlen(two), hex);
+    ASSERT(strcmp(hex, "248d6a61d20638b8e5c026930c3e6039a33ce45964ff2167f6ecedd419db06c1") == 0);
+}
+
+TEST(test_binaries_record_their_build) {
+    char dir[] = "/tmp/omni_test_provenance_XXXXXX";
+    ASSERT(mkdtemp(dir) != NULL);
+    write_module(dir, "lib/util.omni", "(provide square)\n(define (square x) (* x x))");
+    write_module(dir, "main.omni", "(import \"lib/util.omni\")\n(display (square 7))");
+
+    char main_path[512], util_path[512], bin[512], bin2[512], expected[1024];
+    snprintf(main_path, sizeof(main_path), "%s/main.omni", dir);
+    snprintf(util_path, sizeof(util_path), "%s/lib/util.omni", dir);
+    snprintf(bin, sizeof(bin), "%s/main", dir);
+    snprintf(bin2, sizeof(bin2), "%s/main2", dir);
+    CompilerOptions opts = { .use_embedded_runtime = true, .opt_level = 2, .checked = true };
+    Compiler* c = omni_compiler_new_with_options(&opts);
+    ASSERT(omni_compiler_compile_file_to_binary(c, main_path, bin));
+    ASSERT(omni_compiler_compile_file_to_binary(c, main_path, bin2));
+    omni_compiler_free(c);
+
+    /* The program prints its record, the same for the same build */
+    char cmd[600], out[2048];
+    snprintf(cmd, sizeof(cmd), "%s --purple-info", bin);
+    FILE* p = popen(cmd, "r");
+    size_t n = fread(out, 1, sizeof(out) - 1, p);
+    out[n] = '\0';
+    ASSERT(pclose(p) == 0);
+    char* record = omni_binary_provenance(bin);
+    char* record2 = omni_binary_provenance(bin2);
+    ASSERT(record && record2 && strcmp(record, out) == 0 && strcmp(record, record2) == 0);
+    free(record);
+    free(record2);
+    snprintf(expected, sizeof(expected),
+             "purple-info 1\ncompiler: omnilisp %s\nruntime: embedded sha256:", omni_compiler_version());
+    ASSERT(strncmp(out, expected, strlen(expected)) == 0);
+    ASSERT(strstr(out, "\nflags: -O2 checked\n") != NULL);
+    char* util_at = strstr(out, util_path);
+    char* main_at = strstr(out, main_path);
+    ASSERT(util_at && main_at && util_at < main_at);
+
+    /* Every source, in any order; a changed or missing one is reported */
+    FILE* devnull = fopen("/dev/null", "w");
+    const char* both[] = { main_path, util_path };
+    ASSERT(omni_verify_binary(bin, both, 2, devnull) == 0);
+    ASSERT(omni_verify_binary(bin, both, 1, devnull) == 1);
+    write_module(dir, "lib/util.omni", "(provide square)\n(define (square x) (* x x x))");
+    char report[2048];
+    FILE* f = fmemopen(report, sizeof(report), "w");
+    ASSERT(omni_verify_binary(bin, both, 2, f) == 1);
+    fclose(f);
+    snprintf(expected, sizeof(expected), "differs: %s (sha256:", util_path);
+    ASSERT(strstr(report, expected) != NULL);
+    snprintf(expected, sizeof(expected), "match: %s\n%s: not built from these sources\n", main_path, bin);
+    ASSERT(strstr(report, expected) != NULL);
+    ASSERT(strstr(report, "not a source") == NULL);
+
+    /* A file without a record */
+    ASSERT(omni_verify_binary(main_path, both, 2, devnull) == 2);
+    fclose(devnull);
+
+    const char* files[] = { "lib/util.omni", "main.omni", "main", "main2" };
+    remove_modules(dir, files, 4);
+}
+
+/* ========== C Compiler ========== */
+
+/* Write an executable script dir/name that logs its arguments to dir/log
+ * and runs gcc with them, less any --target= */
+static void write_fake_cc(const char* dir, const char* name) {
+    char path[512];
+    snprintf(path, sizeof(path), "%s/%s", dir, name);
+    FILE* f = fopen(path, "w");
+    fprintf(f, "#!/bin/sh\necho \"%s $*\" >> %s/log\n", name, dir);
+    fprintf(f, "for a; do shift; case $a in --target=*) ;; *) set -- \"$@\" \"$a\";; esac; done\n");
+    fprintf(f, "exec gcc \"$@\"\n");
+    fclose(f);
+    chmod(path, 0755);
+}
+
+TEST(test_cc_is_found_for_the_target) {
+    char dir[] = "/tmp/omni_test_cc_XXXXXX";
+    ASSERT(mkdtemp(dir) != NULL);
+    write_fake_cc(dir, "arm-test-eabi-gcc");
+    write_fake_cc(dir, "clang");
+    char* old_path = strdup(getenv("PATH"));
+    char path[4096];
+    snprintf(path, sizeof(path), "%s:%s", dir, old_path);
+    setenv("PATH", path, 1);
+
+    char* cc = omni_find_cc(NULL);
+    ASSERT(cc && strcmp(cc, "gcc") == 0);
+    free(cc);
+    cc = omni_find_cc("arm-test-eabi");
+    ASSERT(cc && strcmp(cc, "arm-test-eabi-gcc") == 0);
+    free(cc);
+    cc = omni_find_cc("riscv-test-elf");
+    ASSERT(cc && strcmp(cc, "clang") == 0);
+    free(cc);
+
+    /* The target's gcc, and clang told the target; ldflags go last */
+    char map[600], out[64];
+    snprintf(map, sizeof(map), "-Wl,-Map=%s/map", dir);
+    CompilerOptions opts = { .use_embedded_runtime = true, .target = "arm-test-eabi",
+                             .ldflags = map };
+    ASSERT(run_program_with(&opts, "(+ 1 2)", out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "3") == 0);
+    opts = (CompilerOptions){ .use_embedded_runtime = true, .target = "riscv-test-elf" };
+    ASSERT(run_program_with(&opts, "(+ 1 2)", out, sizeof(out)) == 0);
+
+    char log_path[600];
+    snprintf(log_path, sizeof(log_path), "%s/log", dir);
+    char* log = omni_fs_read(NULL, log_path);
+    ASSERT(log != NULL);
+    ASSERT(strstr(log, "arm-test-eabi-gcc -std=c99 -pthread -O") == log);
+    ASSERT(strstr(log, " -lm -Wl,-Map=") != NULL);
+    ASSERT(strstr(log, "\nclang -std=c99 -pthread --target=riscv-test-elf -O") != NULL);
+    ASSERT(strstr(log, "\nclang -pthread --target=riscv-test-elf -O") != NULL);
+    free(log);
+    snprintf(map, sizeof(map), "%s/map", dir);
+    ASSERT(access(map, F_OK) == 0);
+
+    /* Nothing for a target without a toolchain (unless this machine has
+     * clang), or a compiler not there */
+    snprintf(path, sizeof(path), "%s/clang", dir);
+    unlink(path);
+    cc = omni_find_cc("riscv-test-elf");
+    Compiler* c = omni_compiler_new_with_options(&(CompilerOptions){
+        .use_embedded_runtime = true, .target = "riscv-test-elf" });
+    if (!cc) {
+        ASSERT(!omni_compiler_compile_to_binary(c, "(+ 1 2)", "/tmp/omni_test_no_cc"));
+        ASSERT(strcmp(omni_compiler_get_error(c, 0), "No C compiler for riscv-test-elf (tried "
+                      "riscv-test-elf-gcc, riscv-test-elf-cc and clang); pass -cc") == 0);
+    }
+    free(cc);
+    omni_compiler_free(c);
+    c = omni_compiler_new_with_options(&(CompilerOptions){
+        .use_embedded_runtime = true, .cc = "no-such-cc -O1" });
+    ASSERT(!omni_compiler_compile_to_binary(c, "(+ 1 2)", "/tmp/omni_test_no_cc"));
+    ASSERT(strcmp(omni_compiler_get_error(c, 0), "C compiler not found: no-such-cc") == 0);
+    omni_compiler_free(c);
+
+    setenv("PATH", old_path, 1);
+    free(old_path);
+    const char* files[] = { "arm-test-eabi-gcc", "log", "map" };
+    for (size_t i = 0; i < sizeof(files) / sizeof(files[0]); i++) {
+        snprintf(path, sizeof(path), "%s/%s", dir, files[i]);
+        unlink(path);
+    }
+    ASSERT(rmdir(dir) == 0);
+}
+
+/* ========== Freestanding ========== */
+
+/* Hooks a freestanding object is linked with here: the C library's
+ * allocator and putchar. The number of allocations follows the output. */
+static const char* g_freestanding_hooks =
+    "#include <stdio.h>\n"
+    "#include <stdlib.h>\n"
+    "static long allocs;\n"
+    "void* purple_malloc(size_t n) { allocs++; return malloc(n); }\n"
+    "void purple_free(void* p) { free(p); }\n"
+    "void purple_putchar(int c) { putchar(c); }\n"
+    "int purple_main(void);\n"
+    "int main(void) { int rc = purple_main(); printf(\"|%ld\", allocs); return rc; }\n";
+
+/* Build src as a freestanding object, check it needs nothing but the
+ * hooks and what any gcc output may call, then link it with
+ * g_freestanding_hooks, run it and capture stdout and the allocations.
+ * Returns the exit status, or -1 if it didn't build or needs anything else. */
+static int run_freestanding(const char* src, char* out, size_t cap, long* allocs) {
+    char obj[] = "/tmp/omni_test_fs_XXXXXX";
+    int fd = mkstemp(obj);
+    if (fd < 0) return -1;
+    close(fd);
+    CompilerOptions opts = { .use_embedded_runtime = true, .opt_level = 2, .freestanding = true };
+    Compiler* c = omni_compiler_new_with_options(&opts);
+    bool ok = omni_compiler_compile_to_binary(c, src, obj);
+    omni_compiler_free(c);
+
+    char cmd[512];
+    snprintf(cmd, sizeof(cmd), "nm -u %s", obj);
+    FILE* p = ok ? popen(cmd, "r") : NULL;
+    char line[256];
+    while (p && fgets(line, sizeof(line), p)) {
+        static const char* allowed[] = {
+            "purple_malloc", "purple_free", "purple_putchar", "memcpy", "memmove", "memset", "memcmp",
+        };
+        char name[128] = "";
+        sscanf(line, " U %127s", name);
+        bool known = false;
+        for (size_t i = 0; i < sizeof(allowed) / sizeof(allowed[0]); i++) {
+            known = known || strcmp(name, allowed[i]) == 0;
+        }
+        if (!known) {
+            printf("(needs %s) ", name);
+            ok = false;
+        }
+    }
+    if (p) ok = pclose(p) == 0 && ok;
+
+    char hooks[] = "/tmp/omni_test_hooks_XXXXXX.c";
+    char prog[] = "/tmp/omni_test_fsprog_XXXXXX";
+    int hooks_fd = mkstemps(hooks, 2);
+    int prog_fd = mkstemp(prog);
+    if (hooks_fd >= 0) {
+        FILE* f = fdopen(hooks_fd, "w");
+        fputs(g_freestanding_hooks, f);
+        fclose(f);
+    }
+    if (prog_fd >= 0) close(prog_fd);
+    snprintf(cmd, sizeof(cmd), "gcc -o %s %s %s", prog, obj, hooks);
+    ok = ok && hooks_fd >= 0 && prog_fd >= 0 && system(cmd) == 0;
+
+    int status = -1;
+    if (ok) {
+        p = popen(prog, "r");
+        size_t n = p ? fread(out, 1, cap - 1, p) : 0;
+        out[n] = '\0';
+        status = p ? pclose(p) : -1;
+        char* bar = strrchr(out, '|');
+        *allocs = bar ? strtol(bar + 1, NULL, 10) : 0;
+        if (bar) *bar = '\0';
+        for (n = strlen(out); n > 0 && out[n - 1] == '\n'; n--) out[n - 1] = '\0';
+    }
+    unlink(obj);
+    unlink(hooks);
+    unlink(prog);
+    return status;
+}
+
+TEST(test_freestanding_objects_use_the_hooks) {
+    char out[256];
+    long allocs = 0;
+    ASSERT(run_freestanding("(define (fact n) (if (= n 0) 1 (* n (fact (- n 1)))))\n"
+                            "(fact 10)\n"
+                            "(cons \"ab\" (cons 2.5 (cons [1 2] '())))\n"
+                            "(with-budget (allocs 2) (cons 1 (cons 2 (cons 3 '()))))",
+                            out, sizeof(out), &allocs) == 0);
+    ASSERT(strcmp(out, "3628800\n(ab 2.5 [1 2])\n#<error budget-exceeded>") == 0);
+    ASSERT(allocs > 0);
+}
+
+/* Whether src uses threads or files, which freestanding code cannot */
+static bool needs_os(const char* src) {
+    static const char* names[] = { "nursery", "spawn", "cancel", "future", "await", "sleep-ms",
+                                   "wait-group", "pool", "open-input-file", "open-output-file" };
+    for (size_t i = 0; i < sizeof(names) / sizeof(names[0]); i++) {
+        if (strstr(src, names[i])) return true;
+    }
+    return false;
+}
+
+TEST(test_freestanding_matches_embedded) {
+    for (size_t i = 0; i < sizeof(g_backend_cases) / sizeof(g_backend_cases[0]); i++) {
+        const char* expected = g_backend_cases[i].embedded;
+        if (!expected || needs_os(g_backend_cases[i].src)) continue;
+        char out[256];
+        long allocs;
+        int status = run_freestanding(g_backend_cases[i].src, out, sizeof(out), &allocs);
+        bool ok = status == 0 && strcmp(out, expected) == 0;
+        if (!ok) printf("(%s: %s) ", g_backend_cases[i].src, status == -1 ? "no build" : out);
+        ASSERT(ok);
+    }
+}
+
+TEST(test_freestanding_rejects_threads) {
+    CompilerOptions opts = { .use_embedded_runtime = true, .freestanding = true };
+    Compiler* c = omni_compiler_new_with_options(&opts);
+    char* code = omni_compiler_compile_to_c(c, "(nursery (spawn (display 1)))");
+    ASSERT(code == NULL);
+    ASSERT(strcmp(omni_compiler_get_error(c, 0),
+                  "E0004 (nursery (spawn (display 1))): nursery needs threads, "
+                  "which -freestanding code does not have") == 0);
+
+    /* As values too, unless the program binds the name itself */
+    omni_compiler_clear_errors(c);
+    ASSERT(omni_compiler_compile_to_c(c, "(map await '())") == NULL);
+    ASSERT(strstr(omni_compiler_get_error(c, 0), "await needs threads") != NULL);
+    omni_compiler_clear_errors(c);
+    code = omni_compiler_compile_to_c(c, "(define (yield x) x) (yield 1)");
+    ASSERT(code != NULL);
+    ASSERT(strstr(code, "purple_main") != NULL && strstr(code, "pthread") == NULL);
+    free(code);
+    omni_compiler_free(c);
+}
+
+TEST(test_freestanding_rejects_files) {
+    CompilerOptions opts = { .use_embedded_runtime = true, .freestanding = true };
+    Compiler* c = omni_compiler_new_with_options(&opts);
+    ASSERT(omni_compiler_compile_to_c(c, "(read-line (open-input-file \"x\"))") == NULL);
+    ASSERT(strcmp(omni_compiler_get_error(c, 0),
+                  "E0004 (read-line (open-input-file \"x\")): read-line needs files and sockets, "
+                  "which -freestanding code does not have") == 0);
+
+    /* String ports need neither */
+    omni_compiler_clear_errors(c);
+    char* code = omni_compiler_compile_to_c(c, "(let ((p (open-output-string))) (display 1 p) (get-output-string p))");
+    ASSERT(code != NULL);
+    free(code);
+    omni_compiler_free(c);
+}
+
+/* ========== Allocators ========== */
+
+/* Compile hooks, C linked into the program, and run src with it built
+ * with opts. Returns the exit status, or -1 if it didn't build. */
+static int run_linked_with(CompilerOptions opts, const char* hooks, const char* src, char* out, size_t cap) {
+    char c_file[] = "/tmp/omni_test_link_XXXXXX.c";
+    char obj[] = "/tmp/omni_test_link_XXXXXX.o";
+    int c_fd = mkstemps(c_file, 2);
+    int obj_fd = mkstemps(obj, 2);
+    int status = -1;
+    if (c_fd >= 0 && obj_fd >= 0) {
+        FILE* f = fdopen(c_fd, "w");
+        fputs(hooks, f);
+        fclose(f);
+        close(obj_fd);
+        char cmd[256];
+        snprintf(cmd, sizeof(cmd), "gcc -c -o %s %s", obj, c_file);
+        opts.link_with = obj;
+        if (system(cmd) == 0) status = run_program_with(&opts, src, out, cap);
+    }
+    if (c_fd >= 0) unlink(c_file);
+    if (obj_fd >= 0) unlink(obj);
+    return status;
+}
+
+/* The same on the embedded runtime */
+static int run_linked(const char* hooks, const char* src, char* out, size_t cap) {
+    CompilerOptions opts = { .use_embedded_runtime = true, .opt_level = 2 };
+    return run_linked_with(opts, hooks, src, out, cap);
+}
+
+/* The layout purple_allocators() returns */
+#define ALLOCATOR_DECLS \
+    "#include <stdio.h>\n" \
+    "#include <stdlib.h>\n" \
+    "typedef struct { const char* name; void* (*alloc)(size_t); void (*release)(void*);\n" \
+    "                 size_t allocs, frees, live, peak; } PurpleAllocator;\n" \
+    "const PurpleAllocator* purple_allocators(size_t* count);\n" \
+    "int purple_set_allocator(const char* name, void* (*alloc)(size_t), void (*release)(void*));\n"
+
+TEST(test_set_allocator_counts_per_allocator) {
+    /* Installed before main; at exit its counters must match the calls it
+     * saw, including frees of its blocks made after the switch back */
+    const char* hooks = ALLOCATOR_DECLS
+        "static size_t made, released;\n"
+        "static void* counted(size_t n) { made++; return malloc(n); }\n"
+        "static void uncounted(void* p) { released++; free(p); }\n"
+        "__attribute__((constructor)) static void install(void) {\n"
+        "    purple_set_allocator(\"counted\", counted, uncounted);\n"
+        "}\n"
+        "__attribute__((destructor)) static void check(void) {\n"
+        "    size_t n;\n"
+        "    const PurpleAllocator* a = purple_allocators(&n);\n"
+        "    printf(\"|%s\", n == 2 && a[1].allocs == made && a[1].frees == released &&\n"
+        "                   released > 0 && a[0].allocs > 0 ? \"match\" : \"mismatch\");\n"
+        "}\n";
+    char out[256];
+    ASSERT(run_linked(hooks,
+                      "(let ((p (cons 1 2))) (set-allocator! 'default) p)\n"
+                      "(map car (memory-stats))\n"
+                      "(set-allocator! \"nowhere\")",
+                      out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "(1 . 2)\n(default counted)\n#<error set-allocator!: no such allocator>\n|match") == 0);
+}
+
+TEST(test_purple_malloc_overrides_at_link) {
+    const char* hooks = ALLOCATOR_DECLS
+        "static size_t calls;\n"
+        "void* purple_malloc(size_t n) { calls++; return malloc(n); }\n"
+        "void purple_free(void* p) { free(p); }\n"
+        "__attribute__((destructor)) static void check(void) {\n"
+        "    size_t n;\n"
+        "    const PurpleAllocator* a = purple_allocators(&n);\n"
+        "    printf(\"|%s\", calls > 0 && a[0].allocs == calls ? \"hooked\" : \"unhooked\");\n"
+        "}\n";
+    char out[256];
+    ASSERT(run_linked(hooks, "(car (cons \"ab\" 2))", out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "ab\n|hooked") == 0);
+}
+
+TEST(test_crash_handler_reports_the_stack) {
+    /* stderr goes to the captured stdout; the embedded program aborts in
+     * its first allocation from bomb, libpurple's in its first free */
+    const char* hooks = ALLOCATOR_DECLS
+        "#include <unistd.h>\n"
+        "int purple_set_allocator(const char*, void* (*)(size_t), void (*)(void*)) __attribute__((weak));\n"
+        "void set_free_hook(void (*hook)(void*)) __attribute__((weak));\n"
+        "static void* bomb(size_t n) { (void)n; abort(); }\n"
+        "static void bomb_free(void* o) { (void)o; abort(); }\n"
+        "__attribute__((constructor)) static void install(void) {\n"
+        "    dup2(1, 2);\n"
+        "    if (set_free_hook) { set_free_hook(bomb_free); return; }\n"
+        "    purple_set_allocator(\"bomb\", bomb, free);\n"
+        "    purple_set_allocator(\"default\", NULL, NULL);\n"
+        "}\n";
+    char out[2048];
+    CompilerOptions opts = { .use_embedded_runtime = true, .opt_level = 2, .emit_debug_info = true };
+    ASSERT(run_linked_with(opts, hooks,
+                           "(define (boom xs) (set-allocator! 'bomb) (cons xs xs))\n"
+                           "(define (outer n) (boom (cons n 2)))\n"
+                           "(outer 1)",
+                           out, sizeof(out)) > 0);
+    ASSERT(strstr(out, "purple: crashed with abort\nfunction stack, innermost first:\n  boom\n  outer\n"
+                   "last reference count changes, oldest first:\n") == out);
+    ASSERT(strstr(out, " (pair, count 1)\n") != NULL);
+    ASSERT(strstr(out, "heap:\n  default: ") != NULL);
+    ASSERT(strstr(out, "  bomb: 0 allocs, 0 frees, 0 bytes live, 0 at peak") != NULL);
+
+    char* runtime = access("../runtime/libpurple.a", F_OK) == 0 ? realpath("../runtime", NULL) : NULL;
+    if (runtime) {
+        CompilerOptions lib = { .runtime_path = runtime, .opt_level = 2, .emit_debug_info = true };
+        out[0] = '\0';
+        int status = run_linked_with(lib, hooks,
+                                     "(define (boom xs) (length xs))\n"
+                                     "(define (outer n) (boom (cons n (cons 2 '()))))\n"
+                                     "(outer 1)",
+                                     out, sizeof(out));
+        free(runtime);
+        ASSERT(status > 0);
+        ASSERT(strstr(out, "purple: crashed with abort\nfunction stack, innermost first:\n"
+                       "  (no compiled function running)\n") == out);
+        ASSERT(strstr(out, "heap: 5 objects made, 0 released") != NULL);
+    }
+
+    /* Without -g nothing is counted or pushed */
+    Compiler* c = omni_compiler_new();
+    char* code = omni_compiler_compile_to_c(c, "(define (f x) x)\n(f 1)");
+    ASSERT(code && !strstr(code, "purple_enter") && !strstr(code, "purple_install_crash_handler"));
+    free(code);
+    omni_compiler_free(c);
+}
+
+TEST(test_memory_stats) {
+    char out[256];
+    ASSERT(run_program("(define xs (cons 1 (cons 2 '())))\n"
+                       "(let ((row (car (memory-stats))))\n"
+                       "  (if (> (car (cdr row)) 0) (car row) 'none))",
+                       out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "default") == 0);
+
+    long allocs = 0;
+    ASSERT(run_freestanding("(car (car (memory-stats)))", out, sizeof(out), &allocs) == 0);
+    ASSERT(strcmp(out, "default") == 0);
+
+    Compiler* c = omni_compiler_new();
+    ASSERT(omni_compiler_compile_to_c(c, "(memory-stats 1)") == NULL);
+    ASSERT(strcmp(omni_compiler_get_error(c, 0), "E0002 (memory-stats 1): expected (memory-stats)") == 0);
+    omni_compiler_clear_errors(c);
+    ASSERT(omni_compiler_compile_to_c(c, "(set-allocator!)") == NULL);
+    ASSERT(strcmp(omni_compiler_get_error(c, 0), "E0002 (set-allocator!): expected (set-allocator! name)") == 0);
+    omni_compiler_free(c);
+
+    CompilerOptions opts = { .runtime_path = "../runtime" };
+    c = omni_compiler_new_with_options(&opts);
+    ASSERT(omni_compiler_compile_to_c(c, "(memory-stats)") == NULL);
+    ASSERT(strcmp(omni_compiler_get_error(c, 0), "E0004 (memory-stats): allocators belong to the "
+                  "embedded runtime; compile with --embedded") == 0);
+    omni_compiler_free(c);
+}
+
+#define GROW_FOREVER "(define (grow n acc) (grow (+ n 1) (cons n acc)))\n"
+
+TEST(test_catch_oom_stops_at_heap_limit) {
+    char out[256];
+    CompilerOptions opts = { .use_embedded_runtime = true, .opt_level = 2,
+                             .heap_limit = 1 << 20, .oom_policy = OMNI_OOM_ERROR };
+    ASSERT(run_program_with(&opts,
+        GROW_FOREVER
+        "(define e (catch-oom (grow 0 '())))\n"
+        "e\n"
+        "(> (error-data e) 0)\n"
+        "(catch-oom (+ 1 2))\n"
+        "(with-budget (allocs 100) (catch-oom (grow 0 '())))",
+        out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "#<error out-of-memory>\n1\n3\n#<error budget-exceeded>") == 0);
+
+    /* A nursery inside joins its tasks before the error is returned */
+    ASSERT(run_program_with(&opts, GROW_FOREVER "(catch-oom (nursery (spawn 1) (grow 0 '())))",
+                            out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "#<error out-of-memory>") == 0);
+}
+
+TEST(test_heap_limit_aborts_by_default) {
+    char out[256];
+    CompilerOptions opts = { .use_embedded_runtime = true, .opt_level = 2, .heap_limit = 1 << 16 };
+    ASSERT(run_program_with(&opts, "(+ 1 2)", out, sizeof(out)) == 0);
+    ASSERT(strcmp(out, "3") == 0);
+    ASSERT(run_program_with(&opts, GROW_FOREVER "(grow 0 '())", out, sizeof(out)) != 0);
+
+    /* Without a catch-oom around it, the error policy stops the program too */
+    opts.oom_policy = OMNI_OOM_ERROR;
+    ASSERT(run_program_with(&opts, GROW_FOREVER "(grow 0 '())", out, sizeof(out)) != 0);
+}
+
+TEST(test_catch_oom_needs_the_error_policy) {
+    Compiler* c = omni_compiler_new_with_options(&(CompilerOptions){ .use_embedded_runtime = true });
+    ASSERT(omni_compiler_compile_to_c(c, "(catch-oom 1)") == NULL);
+    ASSERT(strcmp(omni_compiler_get_error(c, 0), "E0004 (catch-oom 1): catch-oom needs --oom error") == 0);
+    omni_compiler_free(c);
+
+    c = omni_compiler_new_with_options(&(CompilerOptions){ .use_embedded_runtime = true,
+                                                           .oom_policy = OMNI_OOM_ERROR });
+    ASSERT(omni_compiler_compile_to_c(c, "(catch-oom)") == NULL);
+    ASSERT(strcmp(omni_compiler_get_error(c, 0), "E0002 (catch-oom): expected (catch-oom body...)") == 0);
+    omni_compiler_free(c);
+
+    c = omni_compiler_new_with_options(&(CompilerOptions){ .runtime_path = "../runtime",
+                                                           .oom_policy = OMNI_OOM_ERROR });
+    ASSERT(omni_compiler_compile_to_c(c, "(catch-oom 1)") == NULL);
+    ASSERT(strstr(omni_compiler_get_error(c, 0), "E0004 (catch-oom 1): out-of-memory handling belongs") != NULL);
+    omni_compiler_free(c);
+}
+
+int main(void) {
+    session = omni_session_new();
+    printf("\n\033[33m=== Compiler Driver Tests ===\033[0m\n");
+
+    printf("\n\033[33m--- Multi-unit Compilation ---\033[0m\n");
+    RUN_TEST(test_units_share_one_program);
+    RUN_TEST(test_unit_lines_count_from_each_file);
+    RUN_TEST(test_unit_errors_name_file);
+    RUN_TEST(test_errors_point_at_the_source);
+    RUN_TEST(test_unnamed_unit_error_format);
+    RUN_TEST(test_unbound_symbol_suggests_names);
+    RUN_TEST(test_shadowed_builtins_follow_scope);
+    RUN_TEST(test_shadowing_policy);
+    RUN_TEST(test_uninitialized_reads_are_errors);
+    RUN_TEST(test_wrong_argument_counts_are_errors);
+    RUN_TEST(test_dead_stores_warn);
+    RUN_TEST(test_cond_and_case);
+    RUN_TEST(test_cond_and_case_check_their_clauses);
+    RUN_TEST(test_tests_use_unboxed_booleans);
+    RUN_TEST(test_if_computes_shared_test_calls_once);
+    RUN_TEST(test_internal_defines);
+
+    printf("\n\033[33m--- Scripts ---\033[0m\n");
+    RUN_TEST(test_shebang_and_comments_skipped);
+    RUN_TEST(test_script_mode_suppresses_echo);
+    RUN_TEST(test_script_exits_with_the_last_value);
+    RUN_TEST(test_main_is_the_entry_point);
+
+    printf("\n\033[33m--- Modules ---\033[0m\n");
+    RUN_TEST(test_imports_run_once_before_the_importer);
+    RUN_TEST(test_private_names_stay_in_their_module);
+    RUN_TEST(test_provides_reach_only_direct_importers);
+    RUN_TEST(test_modules_have_their_own_names);
+    RUN_TEST(test_import_errors);
+    RUN_TEST(test_imports_read_from_memory);
+
+    printf("\n\033[33m--- Macros ---\033[0m\n");
+    RUN_TEST(test_macros_expand_before_compiling);
+    RUN_TEST(test_macros_cross_modules);
+    RUN_TEST(test_macro_errors_point_at_the_call);
+    RUN_TEST(test_deftype_across_modules);
+
+    printf("\n\033[33m--- Language Levels ---\033[0m\n");
+    RUN_TEST(test_lang_levels_gate_forms_per_file);
+    RUN_TEST(test_unknown_lang_levels_are_errors);
+    RUN_TEST(test_deprecated_behaviour_warns_per_policy);
+
+    printf("\n\033[33m--- Temporary Files ---\033[0m\n");
+    RUN_TEST(test_temp_files_share_a_session);
+
+    printf("\n\033[33m--- Errors ---\033[0m\n");
+    RUN_TEST(test_error_forms_map_to_prims);
+    RUN_TEST(test_errors_carry_a_tag_and_trace);
+
+    printf("\n\033[33m--- Logical Forms ---\033[0m\n");
+    RUN_TEST(test_and_or_empty_and_single);
+    RUN_TEST(test_and_mixed_ownership);
+    RUN_TEST(test_or_mixed_ownership);
+    RUN_TEST(test_and_or_short_circuit);
+    RUN_TEST(test_when_unless_and_one_armed_if);
+
+    printf("\n\033[33m--- Evaluation Order ---\033[0m\n");
+    RUN_TEST(test_call_args_left_to_right);
+    RUN_TEST(test_operator_before_args);
+    RUN_TEST(test_nested_args_left_to_right);
+    RUN_TEST(test_let_bindings_left_to_right);
+
+    printf("\n\033[33m--- Nesting ---\033[0m\n");
+    RUN_TEST(test_nested_forms_stay_flat);
+    RUN_TEST(test_flat_bindings_keep_their_scope);
+    RUN_TEST(test_local_ints_and_pairs_on_the_stack);
+    RUN_TEST(test_dead_pairs_are_reused);
+    RUN_TEST(test_dead_pairs_are_freed_at_last_use);
+    RUN_TEST(test_check_reports_without_building);
+    RUN_TEST(test_timings_table_lists_every_phase);
+    RUN_TEST(test_long_programs_run_in_chunks);
+    RUN_TEST(test_large_literals_get_builders);
+
+    printf("\n\033[33m--- Timers ---\033[0m\n");
+    RUN_TEST(test_sleep_uses_virtual_time);
+
+    printf("\n\033[33m--- Characters ---\033[0m\n");
+    RUN_TEST(test_char_literals_parse);
+    RUN_TEST(test_write_vs_display);
+    RUN_TEST(test_quoted_chars_written);
+    RUN_TEST(test_quasiquote_unquote_and_splice);
+
+    printf("\n\033[33m--- Numeric Literals ---\033[0m\n");
+    RUN_TEST(test_negative_literal_vs_minus);
+    RUN_TEST(test_radix_literals);
+    RUN_TEST(test_digit_separators);
+    RUN_TEST(test_numeric_literals_compile);
+    RUN_TEST(test_float_literals);
+    RUN_TEST(test_floats_print_round_trip);
+
+    printf("\n\033[33m--- Numeric Comparison ---\033[0m\n");
+    RUN_TEST(test_mixed_numeric_comparison);
+
+    printf("\n\033[33m--- Numeric Library ---\033[0m\n");
+    RUN_TEST(test_numeric_library_folded_and_runtime);
+    RUN_TEST(test_numeric_library_constant_folds);
+    RUN_TEST(test_min_max_are_variadic);
+    RUN_TEST(test_user_definition_blocks_folding);
+
+    printf("\n\033[33m--- List Primitives ---\033[0m\n");
+    RUN_TEST(test_list_primitives_link);
+    RUN_TEST(test_named_functions_as_arguments);
+    RUN_TEST(test_lambda_inside_function_body);
+    RUN_TEST(test_map_wraps_function_argument);
+    RUN_TEST(test_closures_print_and_introspect);
+    RUN_TEST(test_lambdas_capture_enclosing_locals);
+    RUN_TEST(test_set_shares_captured_variables);
+    RUN_TEST(test_malformed_core_forms_are_errors);
+    RUN_TEST(test_truncated_forms_compile_or_fail_cleanly);
+    RUN_TEST(test_set_needs_a_variable);
+    RUN_TEST(test_letrec_functions_call_each_other);
+    RUN_TEST(test_letrec_functions_as_values);
+    RUN_TEST(test_named_let_runs_as_a_loop);
+    RUN_TEST(test_named_let_falls_back_to_a_function);
+    RUN_TEST(test_closure_identity);
+    RUN_TEST(test_top_level_variables_are_globals);
+    RUN_TEST(test_global_calls_follow_redefinition);
+    RUN_TEST(test_call_caches_are_per_thread);
+    RUN_TEST(test_hot_reload_calls_through_pointers);
+    RUN_TEST(test_incremental_objects_build_only_new_units);
+    RUN_TEST(test_modules_record_their_abi);
+    RUN_TEST(test_debug_history_shows_recorded_calls);
+    RUN_TEST(test_debug_history_shows_environment_deltas);
+    RUN_TEST(test_debug_history_shows_local_deltas);
+    RUN_TEST(test_debug_history_needs_recording);
+    RUN_TEST(test_with_budget_stops_runaway_allocation);
+    RUN_TEST(test_with_budget_needs_literal_limits);
+    RUN_TEST(test_nursery_joins_its_tasks);
+    RUN_TEST(test_nursery_first_error_cancels_the_rest);
+    RUN_TEST(test_spawn_needs_a_body);
+    RUN_TEST(test_with_cancel_stops_when_its_token_is_cancelled);
+    RUN_TEST(test_cancel_wakes_a_sleeper);
+    RUN_TEST(test_coop_cancel_checks_on_every_call);
+    RUN_TEST(test_with_cancel_needs_a_token_and_body);
+    RUN_TEST(test_await_memoizes_the_result);
+    RUN_TEST(test_pool_runs_many_tasks_on_few_threads);
+    RUN_TEST(test_future_needs_a_body);
+    RUN_TEST(test_wait_group_joins_goroutines);
+    RUN_TEST(test_go_counts_shared_captures_atomically);
+    RUN_TEST(test_shared_variables_count_atomically);
+    RUN_TEST(test_go_needs_a_body);
+    RUN_TEST(test_lift_persists_compile_time_values);
+    RUN_TEST(test_lift_rejects_run_time_values);
+    RUN_TEST(test_code_combinators_build_programs);
+    RUN_TEST(test_code_combinators_reject_non_code);
+    RUN_TEST(test_for_each_runs_for_effects);
+    RUN_TEST(test_discarded_map_warns);
+    RUN_TEST(test_checked_lists_reject_improper);
+    RUN_TEST(test_improper_literal_warns);
+
+    printf("\n\033[33m--- Constraint Checking ---\033[0m\n");
+    RUN_TEST(test_constraint_check_registers_borrows);
+    RUN_TEST(test_constraint_check_reports_free_while_borrowed);
+    RUN_TEST(test_constraint_check_writes_trace);
+
+    printf("\n\033[33m--- Analysis Reflection ---\033[0m\n");
+    RUN_TEST(test_reflection_reports_verdicts);
+    RUN_TEST(test_reflection_is_resolved_at_compile_time);
+
+    printf("\n\033[33m--- Queries ---\033[0m\n");
+    RUN_TEST(test_query_answers_after_compiling);
+    RUN_TEST(test_query_describes_sum_types);
+    RUN_TEST(test_query_call_graph);
+
+    printf("\n\033[33m--- Independent Sessions ---\033[0m\n");
+    RUN_TEST(test_compilers_run_concurrently);
+    RUN_TEST(test_compile_frees_its_session);
+
+    printf("\n\033[33m--- Back-end Parity ---\033[0m\n");
+    RUN_TEST(test_backend_parity);
+    RUN_TEST(test_open_files_are_flushed_at_exit);
+    RUN_TEST(test_runtime_config_reads_the_environment);
+
+    printf("\n\033[33m--- Standalone C ---\033[0m\n");
+    RUN_TEST(test_standalone_c_builds_without_libpurple);
+
+    printf("\n\033[33m--- Size Profile ---\033[0m\n");
+    RUN_TEST(test_size_profile_trims_the_runtime);
+    RUN_TEST(test_size_profile_matches_embedded);
+    RUN_TEST(test_section_sizes);
+
+    printf("\n\033[33m--- Memory Modes ---\033[0m\n");
+    RUN_TEST(test_memory_modes_gate_the_runtime);
+
+    printf("\n\033[33m--- Provenance ---\033[0m\n");
+    RUN_TEST(test_sha256_vectors);
+    RUN_TEST(test_binaries_record_their_build);
+
+    printf("\n\033[33m--- C Compiler ---\033[0m\n");
+    RUN_TEST(test_cc_is_found_for_the_target);
+
+    printf("\n\033[33m--- Freestanding ---\033[0m\n");
+    RUN_TEST(test_freestanding_objects_use_the_hooks);
+    RUN_TEST(test_freestanding_matches_embedded);
+    RUN_TEST(test_freestanding_rejects_threads);
+    RUN_TEST(test_freestanding_rejects_files);
+
+    printf("\n\033[33m--- Allocators ---\033[0m\n");
+    RUN_TEST(test_set_allocator_counts_per_allocator);
+    RUN_TEST(test_purple_malloc_overrides_at_link);
+    RUN_TEST(test_crash_handler_reports_the_stack);
+    RUN_TEST(test_memory_stats);
+    RUN_TEST(test_catch_oom_stops_at_heap_limit);
+    RUN_TEST(test_heap_limit_aborts_by_default);
+    RUN_TEST(test_catch_oom_needs_the_error_policy);
+
+    printf("\n\033[33m=== Summary ===\033[0m\n");
+    printf("  Total:  %d\n", tests_run);
+    if (tests_passed == tests_run) {
+        printf("  \033[32mPassed: %d\033[0m\n", tests_passed);
+    } else {
+        printf("  \033[32mPassed: %d\033[0m\n", tests_passed);
+        printf("  \033[31mFailed: %d\033[0m\n", tests_run - tests_passed);
+    }
+    printf("  Failed: %d\n", tests_run - tests_passed);
+
+    omni_session_free(session);
+    return (tests_passed == tests_run) ? 0 : 1;
+}
@@ -21,6 +21,9 @@
 static int tests_run = 0;
 static int tests_passed = 0;
 
+/* Where the trees the tests build and parse live */
+static OmniSession* session;
+
 #define TEST(name) static void name(void)
 #define RUN_TEST(name) do { \
     printf("  %s: ", #name); \
@@ -40,12 +43,12 @@ static int tests_passed = 0;
 
 /* Helper to create a simple symbol */
 static OmniValue* mk_sym(const char* name) {
-    return omni_new_sym(name);
+    return omni_new_sym(session->arena, name);
 }
 
 /* Helper to create a cons cell */
 static OmniValue* mk_cons(OmniValue* car, OmniValue* cdr) {
-    return omni_new_cell(car, cdr);
+    return omni_new_cell(session->arena, car, cdr);
 }
 
 /* Helper to create a list */
@@ -227,9 +230,9 @@ TEST(test_analyze_atom_expr) {
 /* ========== Codegen Tests ========== */
 
 TEST(test_codegen_has_concurrency_macros) {
-    OmniValue* expr = omni_new_int(42);
+    OmniValue* expr = omni_new_int(session->arena, 42);
 
-    CodeGenContext* cg = omni_codegen_new_buffer();
+    CodeGenContext* cg = omni_codegen_new_buffer(session);
     cg->analysis = omni_analysis_new();
 
     omni_codegen_program(cg, &expr, 1);
@@ -258,6 +261,7 @@ TEST(test_codegen_has_concurrency_macros) {
 /* ========== Main ========== */
 
 int main(void) {
+    session = omni_session_new();
     printf("\n\033[33m=== Concurrency Ownership Inference Tests ===\033[0m\n");
 
     printf("\n\033[33m--- Thread Locality Names ---\033[0m\n");
@@ -296,5 +300,6 @@ int main(void) {
     }
     printf("  Failed: %d\n", tests_run - tests_passed);
 
+    omni_session_free(session);
     return (tests_passed == tests_run) ? 0 : 1;
 }
@@ -0,0 +1,154 @@
+/*
+ * Deprecation Tests
+ *
+ * Tests for omni_deprecations_find and omni_deprecations_allowed: each
+ * deprecated behaviour is found where a program relies on it and not in
+ * data or near misses, positions are the source's, and allow-deprecated
+ * comment lines accept the codes they name.
+ */
+
+#define _POSIX_C_SOURCE 200809L
+#define _GNU_SOURCE
+
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <assert.h>
+
+#include "../ast/ast.h"
+#include "../parser/parser.h"
+#include "../deprecate/deprecate.h"
+
+/* Test counters */
+static int tests_run = 0;
+static int tests_passed = 0;
+
+/* Where the trees the tests build and parse live */
+static OmniSession* session;
+
+#define TEST(name) static void name(void)
+#define RUN_TEST(name) do { \
+    printf("  %s: ", #name); \
+    name(); \
+    tests_run++; \
+    tests_passed++; \
+    printf("\033[32mPASS\033[0m\n"); \
+} while(0)
+
+#define ASSERT(cond) do { \
+    if (!(cond)) { \
+        printf("\033[31mFAIL\033[0m (line %d: %s)\n", __LINE__, #cond); \
+        tests_run++; \
+        return; \
+    } \
+} while(0)
+
+/* ========== Helpers ========== */
+
+/* The uses in src, allowing what its pragmas allow, rendered into out
+ * as line:col: message, one per line */
+static size_t find_uses(const char* src, char* out, size_t cap) {
+    OmniParser* p = omni_parser_new(session, src);
+    size_t n = 0;
+    OmniValue** forms = omni_parser_parse_all(p, &n);
+
+    OmniDeprecatedUses* uses = omni_deprecations_find(forms, n, omni_deprecations_allowed(src));
+    size_t count = uses->count;
+    out[0] = '\0';
+    size_t len = 0;
+    for (size_t i = 0; i < count && len < cap; i++) {
+        len += (size_t)snprintf(out + len, cap - len, "%d:%d: %s\n", uses->items[i].at->line,
+                                uses->items[i].at->column, uses->items[i].message);
+    }
+
+    omni_deprecations_free(uses);
+    free(forms);
+    omni_parser_free(p);
+    return count;
+}
+
+/* ========== Catalog ========== */
+
+TEST(test_every_deprecation_has_an_entry) {
+    for (int d = OMNI_DEPRECATED_ZERO_IS_FALSE; d < OMNI_DEPRECATED_COUNT; d++) {
+        const OmniDeprecationInfo* info = omni_deprecation_info((OmniDeprecation)d);
+        ASSERT(info != NULL);
+        ASSERT(omni_deprecation_lookup(info->id) == info);
+    }
+    ASSERT(omni_deprecation_lookup("d0002")->code == OMNI_DEPRECATED_DIVIDE_BY_ZERO);
+    ASSERT(omni_deprecation_lookup("D9999") == NULL);
+}
+
+/* ========== Uses ========== */
+
+TEST(test_zero_as_a_test) {
+    char out[1024];
+    ASSERT(find_uses("(if 0 1 2)\n(cond (x 1) (0.0 2))\n(define (f) (and 0 (or 0 0)))", out, sizeof(out)) == 4);
+    ASSERT(strcmp(out,
+        "1:5: D0001 (if 0 1 2) tests 0, which is false now and will be true; use '() for false\n"
+        "2:14: D0001 (cond (x 1) (0.0 2)) tests 0, which is false now and will be true; use '() for false\n"
+        "3:18: D0001 (and 0 (or 0 0)) tests 0, which is false now and will be true; use '() for false\n"
+        "3:24: D0001 (or 0 0) tests 0, which is false now and will be true; use '() for false\n") == 0);
+
+    /* Values that are not tests, and quoted data */
+    ASSERT(find_uses("(if x 0 1) (and x 0) (define y 0) '(if 0 1 2) (when 1 0)", out, sizeof(out)) == 0);
+}
+
+TEST(test_division_by_zero) {
+    char out[512];
+    ASSERT(find_uses("(/ x 0)\n(% (f) 2 0.0)", out, sizeof(out)) == 2);
+    ASSERT(strcmp(out,
+        "1:1: D0002 (/ x 0) divides by 0, which gives 0 or stops the program now and will give an error value\n"
+        "2:1: D0002 (% (f) 2 0.0) divides by 0, which gives 0 or stops the program now and will give an error value\n") == 0);
+
+    /* A zero dividend, and a program with its own / */
+    ASSERT(find_uses("(/ 0 x) (- x 0)", out, sizeof(out)) == 0);
+
+    /* Float division by 0.0, which follows IEEE */
+    ASSERT(find_uses("(/ x 0.0)", out, sizeof(out)) == 0);
+    ASSERT(find_uses("(define (/ a b) a) (/ 1 0)", out, sizeof(out)) == 0);
+}
+
+/* ========== Pragmas ========== */
+
+TEST(test_pragmas_allow_codes) {
+    ASSERT(omni_deprecations_allowed(NULL) == 0);
+    ASSERT(omni_deprecations_allowed("(f)\n;; allow-deprecated D0002\n") ==
+           1u << OMNI_DEPRECATED_DIVIDE_BY_ZERO);
+    ASSERT(omni_deprecations_allowed("  ; allow-deprecated d0001, D0002 D7777\r\n") ==
+           (1u << OMNI_DEPRECATED_ZERO_IS_FALSE | 1u << OMNI_DEPRECATED_DIVIDE_BY_ZERO));
+    /* Only whole comment lines */
+    ASSERT(omni_deprecations_allowed("(f) ; allow-deprecated D0001\n; see allow-deprecated D0002") == 0);
+
+    char out[512];
+    ASSERT(find_uses("; allow-deprecated D0001\n(if 0 (/ 1 0) 2)", out, sizeof(out)) == 1);
+    ASSERT(strncmp(out, "2:7: D0002", 10) == 0);
+}
+
+int main(void) {
+    session = omni_session_new();
+    printf("\n\033[33m=== Deprecation Tests ===\033[0m\n");
+
+    printf("\n\033[33m--- Catalog ---\033[0m\n");
+    RUN_TEST(test_every_deprecation_has_an_entry);
+
+    printf("\n\033[33m--- Uses ---\033[0m\n");
+    RUN_TEST(test_zero_as_a_test);
+    RUN_TEST(test_division_by_zero);
+
+    printf("\n\033[33m--- Pragmas ---\033[0m\n");
+    RUN_TEST(test_pragmas_allow_codes);
+
+    printf("\n\033[33m=== Summary ===\033[0m\n");
+    printf("  Total:  %d\n", tests_run);
+    if (tests_passed == tests_run) {
+        printf("  \033[32mPassed: %d\033[0m\n", tests_passed);
+    } else {
+        printf("  \033[32mPassed: %d\033[0m\n", tests_passed);
+        printf("  \033[31mFailed: %d\033[0m\n", tests_run - tests_passed);
+    }
+    printf("  Failed: %d\n", tests_run - tests_passed);
+
+    omni_session_free(session);
+    return (tests_passed == tests_run) ? 0 : 1;
+}
@@ -0,0 +1,153 @@
+/*
+ * Diagnostics Tests
+ *
+ * Tests for the error catalog and the edit-distance suggestions used for
+ * "did you mean" hints.
+ */
+
+#define _POSIX_C_SOURCE 200809L
+#define _GNU_SOURCE
+
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <assert.h>
+
+#include "../diagnostics/diagnostics.h"
+
+/* Test counters */
+static int tests_run = 0;
+static int tests_passed = 0;
+
+#define TEST(name) static void name(void)
+#define RUN_TEST(name) do { \
+    printf("  %s: ", #name); \
+    name(); \
+    tests_run++; \
+    tests_passed++; \
+    printf("\033[32mPASS\033[0m\n"); \
+} while(0)
+
+#define ASSERT(cond) do { \
+    if (!(cond)) { \
+        printf("\033[31mFAIL\033[0m (line %d: %s)\n", __LINE__, #cond); \
+        tests_run++; \
+        return; \
+    } \
+} while(0)
+
+/* ========== Catalog ========== */
+
+TEST(test_every_code_has_an_entry) {
+    for (int code = OMNI_E_UNBOUND_SYMBOL; code < OMNI_E_COUNT; code++) {
+        const OmniErrorInfo* info = omni_error_info((OmniErrorCode)code);
+        ASSERT(info != NULL);
+        char id[8];
+        snprintf(id, sizeof(id), "E%04d", code);
+        ASSERT(strcmp(info->id, id) == 0);
+        ASSERT(omni_error_lookup(id) == info);
+        ASSERT(info->explanation[strlen(info->explanation) - 1] == '\n');
+    }
+}
+
+TEST(test_lookup_by_id) {
+    ASSERT(omni_error_lookup("e0001") == omni_error_info(OMNI_E_UNBOUND_SYMBOL));
+    ASSERT(strcmp(omni_error_lookup("E0005")->title, "parse error") == 0);
+    ASSERT(omni_error_lookup("E9999") == NULL);
+    ASSERT(omni_error_lookup(NULL) == NULL);
+}
+
+/* ========== Suggestions ========== */
+
+TEST(test_edit_distance) {
+    ASSERT(omni_edit_distance("", "") == 0);
+    ASSERT(omni_edit_distance("abc", "") == 3);
+    ASSERT(omni_edit_distance("length", "length") == 0);
+    ASSERT(omni_edit_distance("lenght", "length") == 1);
+    ASSERT(omni_edit_distance("lamda", "lambda") == 1);
+    ASSERT(omni_edit_distance("kitten", "sitting") == 3);
+}
+
+TEST(test_suggest_nearest_first) {
+    const char* names[] = { "let", "length", "lambda", "list", "let", "letrec" };
+    const char* out[3];
+    ASSERT(omni_suggest("lenght", names, 6, out, 3) == 1);
+    ASSERT(strcmp(out[0], "length") == 0);
+
+    /* Ties keep candidate order; duplicates and the name itself are dropped */
+    ASSERT(omni_suggest("lst", names, 6, out, 3) == 2);
+    ASSERT(strcmp(out[0], "let") == 0);
+    ASSERT(strcmp(out[1], "list") == 0);
+    ASSERT(omni_suggest("let", names, 6, out, 3) == 0);
+}
+
+TEST(test_suggest_limits) {
+    const char* names[] = { "+", "-", "*", "f", "filter", "fold", "map" };
+    const char* out[2];
+    ASSERT(omni_suggest("x", names, 7, out, 2) == 0);
+    ASSERT(omni_suggest("qqqqqq", names, 7, out, 2) == 0);
+    ASSERT(omni_suggest("fld", names, 7, out, 2) == 1);
+    ASSERT(strcmp(out[0], "fold") == 0);
+    ASSERT(omni_suggest("fiter", names, 7, out, 1) == 1);
+    ASSERT(strcmp(out[0], "filter") == 0);
+}
+
+TEST(test_format_suggestions) {
+    char buf[64] = "unbound symbol: x";
+    omni_format_suggestions(buf, sizeof(buf), NULL, 0);
+    ASSERT(strcmp(buf, "unbound symbol: x") == 0);
+
+    const char* one[] = { "length" };
+    strcpy(buf, "E0001 lenght");
+    omni_format_suggestions(buf, sizeof(buf), one, 1);
+    ASSERT(strcmp(buf, "E0001 lenght (did you mean length?)") == 0);
+
+    const char* three[] = { "let", "lambda", "letrec" };
+    strcpy(buf, "lt");
+    omni_format_suggestions(buf, sizeof(buf), three, 3);
+    ASSERT(strcmp(buf, "lt (did you mean let, lambda or letrec?)") == 0);
+
+    char small[16] = "name";
+    omni_format_suggestions(small, sizeof(small), three, 3);
+    ASSERT(strlen(small) == sizeof(small) - 1);
+}
+
+TEST(test_format_snippet) {
+    const char* text = "(define x 1)\n\t(foo x)\n";
+    char buf[128] = "at";
+    omni_format_snippet(buf, sizeof(buf), text, 2, 3);
+    ASSERT(strcmp(buf, "at\n 2 | \t(foo x)\n   | \t ^") == 0);
+
+    char none[16] = "at";
+    omni_format_snippet(none, sizeof(none), text, 9, 1);
+    ASSERT(strcmp(none, "at") == 0);
+}
+
+int main(void) {
+    printf("\n\033[33m=== Diagnostics Tests ===\033[0m\n");
+
+    printf("\n\033[33m--- Catalog ---\033[0m\n");
+    RUN_TEST(test_every_code_has_an_entry);
+    RUN_TEST(test_lookup_by_id);
+
+    printf("\n\033[33m--- Suggestions ---\033[0m\n");
+    RUN_TEST(test_edit_distance);
+    RUN_TEST(test_suggest_nearest_first);
+    RUN_TEST(test_suggest_limits);
+    RUN_TEST(test_format_suggestions);
+
+    printf("\n\033[33m--- Snippets ---\033[0m\n");
+    RUN_TEST(test_format_snippet);
+
+    printf("\n\033[33m=== Summary ===\033[0m\n");
+    printf("  Total:  %d\n", tests_run);
+    if (tests_passed == tests_run) {
+        printf("  \033[32mPassed: %d\033[0m\n", tests_passed);
+    } else {
+        printf("  \033[32mPassed: %d\033[0m\n", tests_passed);
+        printf("  \033[31mFailed: %d\033[0m\n", tests_run - tests_passed);
+    }
+    printf("  Failed: %d\n", tests_run - tests_passed);
+
+    return (tests_passed == tests_run) ? 0 : 1;
+}
@@ -0,0 +1,191 @@
+/*
+ * Structural Diff Tests
+ *
+ * Tests for omni_diff_forms: layout and comments are ignored, unchanged
+ * forms are matched, and changes are reported at the smallest subtree.
+ */
+
+#define _POSIX_C_SOURCE 200809L
+#define _GNU_SOURCE
+
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <assert.h>
+
+#include "../ast/ast.h"
+#include "../parser/parser.h"
+#include "../diff/diff.h"
+
+/* Test counters */
+static int tests_run = 0;
+static int tests_passed = 0;
+
+/* Where the trees the tests build and parse live */
+static OmniSession* session;
+
+#define TEST(name) static void name(void)
+#define RUN_TEST(name) do { \
+    printf("  %s: ", #name); \
+    name(); \
+    tests_run++; \
+    tests_passed++; \
+    printf("\033[32mPASS\033[0m\n"); \
+} while(0)
+
+#define ASSERT(cond) do { \
+    if (!(cond)) { \
+        printf("\033[31mFAIL\033[0m (line %d: %s)\n", __LINE__, #cond); \
+        tests_run++; \
+        return; \
+    } \
+} while(0)
+
+/* ========== Helpers ========== */
+
+/* Diff two sources and render the result into out */
+static size_t diff_sources(const char* a_src, const char* b_src, char* out, size_t cap) {
+    OmniParser* pa = omni_parser_new(session, a_src);
+    OmniParser* pb = omni_parser_new(session, b_src);
+    size_t na = 0, nb = 0;
+    OmniValue** a = omni_parser_parse_all(pa, &na);
+    OmniValue** b = omni_parser_parse_all(pb, &nb);
+
+    OmniDiff* diff = omni_diff_forms(a, na, b, nb);
+    size_t count = diff->count;
+
+    out[0] = '\0';
+    FILE* f = fmemopen(out, cap, "w");
+    omni_diff_print(f, diff);
+    fclose(f);
+
+    omni_diff_free(diff);
+    free(a);
+    free(b);
+    omni_parser_free(pa);
+    omni_parser_free(pb);
+    return count;
+}
+
+/* ========== Equality ========== */
+
+TEST(test_equal_is_structural) {
+    OmniValue* a = omni_list_of(session->arena, 2, omni_new_sym(session->arena, "f"), omni_list_of(session->arena, 1, omni_new_int(session->arena, 1)));
+    OmniValue* b = omni_list_of(session->arena, 2, omni_new_sym(session->arena, "f"), omni_list_of(session->arena, 1, omni_new_int(session->arena, 1)));
+    OmniValue* c = omni_list_of(session->arena, 2, omni_new_sym(session->arena, "f"), omni_list_of(session->arena, 1, omni_new_int(session->arena, 2)));
+    ASSERT(omni_diff_equal(a, b));
+    ASSERT(!omni_diff_equal(a, c));
+    ASSERT(!omni_diff_equal(a, omni_cdr(a)));
+    ASSERT(omni_diff_equal(NULL, omni_nil));
+}
+
+/* ========== Diffing ========== */
+
+TEST(test_layout_and_comments_ignored) {
+    char out[256];
+    ASSERT(diff_sources("(define (f x) (* x 2)) ; double\n(f 1)",
+                        "; header\n(define (f x)\n  (* x\n     2))\n\n(f   1)",
+                        out, sizeof(out)) == 0);
+    ASSERT(out[0] == '\0');
+}
+
+TEST(test_change_reported_at_smallest_subtree) {
+    OmniParser* pa = omni_parser_new(session, "(define (f x) (+ x 2))");
+    OmniParser* pb = omni_parser_new(session, "(define (f x) (+ x 3))");
+    size_t na = 0, nb = 0;
+    OmniValue** a = omni_parser_parse_all(pa, &na);
+    OmniValue** b = omni_parser_parse_all(pb, &nb);
+
+    OmniDiff* diff = omni_diff_forms(a, na, b, nb);
+    ASSERT(diff->count == 1);
+    OmniDiffEntry* e = &diff->entries[0];
+    ASSERT(e->kind == OMNI_DIFF_CHANGED);
+    ASSERT(e->form_a == 1 && e->form_b == 1);
+    ASSERT(e->path_len == 2 && e->path[0] == 3 && e->path[1] == 3);
+    ASSERT(e->old_val->int_val == 2 && e->new_val->int_val == 3);
+
+    omni_diff_free(diff);
+    free(a);
+    free(b);
+    omni_parser_free(pa);
+    omni_parser_free(pb);
+}
+
+TEST(test_inserted_forms_keep_alignment) {
+    char out[256];
+    ASSERT(diff_sources("(a) (b) (c)", "(a) (x 1) (b) (c)", out, sizeof(out)) == 1);
+    ASSERT(strcmp(out, "form 2 added:\n+ (x 1)\n") == 0);
+
+    ASSERT(diff_sources("(a) (b) (c)", "(a) (c)", out, sizeof(out)) == 1);
+    ASSERT(strcmp(out, "form 2 removed:\n- (b)\n") == 0);
+}
+
+TEST(test_elements_added_inside_form) {
+    char out[256];
+    ASSERT(diff_sources("(do (f 1) (g 2))", "(do (f 1) (h 0) (g 2))", out, sizeof(out)) == 1);
+    ASSERT(strcmp(out, "form 1, element 3, in (do (f 1) (h 0) (g 2)):\n+ (h 0)\n") == 0);
+}
+
+TEST(test_different_definitions_are_not_merged) {
+    char out[256];
+    ASSERT(diff_sources("(define (g) 1)", "(define (h y) 1)", out, sizeof(out)) == 2);
+    ASSERT(strcmp(out, "form 1 removed:\n- (define (g) 1)\nform 1 added:\n+ (define (h y) 1)\n") == 0);
+}
+
+TEST(test_moved_form_numbers) {
+    char out[256];
+    ASSERT(diff_sources("(f 1)", "(g) (f 2)", out, sizeof(out)) == 2);
+    ASSERT(strstr(out, "form 1 added:\n+ (g)\n") != NULL);
+    ASSERT(strstr(out, "form 2 (was 1), element 2, in (f 2):\n- 1\n+ 2\n") != NULL);
+}
+
+TEST(test_arrays_compared_elementwise) {
+    OmniParser* pa = omni_parser_new(session, "(f [1 2 3])");
+    OmniParser* pb = omni_parser_new(session, "(f [1 9 3])");
+    size_t na = 0, nb = 0;
+    OmniValue** a = omni_parser_parse_all(pa, &na);
+    OmniValue** b = omni_parser_parse_all(pb, &nb);
+
+    OmniDiff* diff = omni_diff_forms(a, na, b, nb);
+    ASSERT(diff->count == 1);
+    ASSERT(diff->entries[0].path_len == 2);
+    char* s = omni_value_to_string(diff->entries[0].new_val);
+    ASSERT(strcmp(s, "9") == 0);
+    free(s);
+
+    omni_diff_free(diff);
+    free(a);
+    free(b);
+    omni_parser_free(pa);
+    omni_parser_free(pb);
+}
+
+int main(void) {
+    session = omni_session_new();
+    printf("\n\033[33m=== Structural Diff Tests ===\033[0m\n");
+
+    printf("\n\033[33m--- Equality ---\033[0m\n");
+    RUN_TEST(test_equal_is_structural);
+
+    printf("\n\033[33m--- Diffing ---\033[0m\n");
+    RUN_TEST(test_layout_and_comments_ignored);
+    RUN_TEST(test_change_reported_at_smallest_subtree);
+    RUN_TEST(test_inserted_forms_keep_alignment);
+    RUN_TEST(test_elements_added_inside_form);
+    RUN_TEST(test_different_definitions_are_not_merged);
+    RUN_TEST(test_moved_form_numbers);
+    RUN_TEST(test_arrays_compared_elementwise);
+
+    printf("\n\033[33m=== Summary ===\033[0m\n");
+    printf("  Total:  %d\n", tests_run);
+    if (tests_passed == tests_run) {
+        printf("  \033[32mPassed: %d\033[0m\n", tests_passed);
+    } else {
+        printf("  \033[32mPassed: %d\033[0m\n", tests_passed);
+        printf("  \033[31mFailed: %d\033[0m\n", tests_run - tests_passed);
+    }
+    printf("  Failed: %d\n", tests_run - tests_passed);
+
+    omni_session_free(session);
+    return (tests_passed == tests_run) ? 0 : 1;
+}
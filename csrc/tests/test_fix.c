@@ -0,0 +1,147 @@
+/*
+ * Fix Tests
+ *
+ * Tests for omni_fix_source and omni_fix_print_diff: fixes land in place
+ * of the text they replace, comments and layout elsewhere survive, fixes
+ * that overlap are left for a later pass, and renames skip quoted data.
+ */
+
+#define _POSIX_C_SOURCE 200809L
+#define _GNU_SOURCE
+
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <assert.h>
+
+#include "../fix/fix.h"
+
+/* Test counters */
+static int tests_run = 0;
+static int tests_passed = 0;
+
+#define TEST(name) static void name(void)
+#define RUN_TEST(name) do { \
+    printf("  %s: ", #name); \
+    name(); \
+    tests_run++; \
+    tests_passed++; \
+    printf("\033[32mPASS\033[0m\n"); \
+} while(0)
+
+#define ASSERT(cond) do { \
+    if (!(cond)) { \
+        printf("\033[31mFAIL\033[0m (line %d: %s)\n", __LINE__, #cond); \
+        tests_run++; \
+        return; \
+    } \
+} while(0)
+
+/* ========== Helpers ========== */
+
+/* src fixed without renames, compared with want */
+static bool fixes_to(const char* src, const char* want, size_t want_applied) {
+    size_t applied = 0;
+    char* got = omni_fix_source(src, NULL, &applied);
+    bool ok = got && strcmp(got, want) == 0 && applied == want_applied;
+    if (!ok) printf("\n    got: %s\n", got ? got : "(null)");
+    free(got);
+    return ok;
+}
+
+/* ========== Fixes ========== */
+
+TEST(test_fix_keeps_comments_and_layout) {
+    ASSERT(fixes_to("; top\n(define (f x)\n  ; why\n  (if (g) [1  2] [1 2]))  ; end\n",
+                    "; top\n(define (f x)\n  ; why\n  (do (g) [1  2]))  ; end\n", 1));
+}
+
+TEST(test_fix_deletes_ignored_values) {
+    ASSERT(fixes_to("(define (f x)\n  (+ x 1)\n  (display x)\n  x)\n",
+                    "(define (f x)\n  (display x)\n  x)\n", 1));
+    ASSERT(fixes_to("(define (f x) (display x) (car x) x)", "(define (f x) (display x) x)", 1));
+}
+
+TEST(test_fix_removes_unused_bindings) {
+    ASSERT(fixes_to("(let ((a 1)\n      (b 2))\n  b)", "(let ((b 2))\n  b)", 1));
+    ASSERT(fixes_to("(let ((a 1) (b 2)) a)", "(let ((a 1)) a)", 1));
+    /* Not when the init does something */
+    ASSERT(fixes_to("(let ((a (f))) 1)", "(let ((a (f))) 1)", 0));
+}
+
+TEST(test_fix_renests_append_chains) {
+    ASSERT(fixes_to("(append (append (append a b) c) d)", "(append a (append b (append c d)))", 1));
+}
+
+TEST(test_fix_follows_overlapping_fixes) {
+    /* The bindings inside the if are fixed on the pass after the if */
+    ASSERT(fixes_to("(define (f y)\n  (if (g) (let ((a 1)) y) (let ((a 1)) y)))",
+                    "(define (f y)\n  (do (g) (let () y)))", 2));
+}
+
+TEST(test_fix_renames_code_not_data) {
+    OmniRename renames[] = { { "lenght", "length" } };
+    OmniFixOptions opts = { renames, 1 };
+    size_t applied = 0;
+    char* got = omni_fix_source("(lenght '(lenght x)) ; lenght\n(lenght \"lenght\")", &opts, &applied);
+    ASSERT(got != NULL);
+    ASSERT(strcmp(got, "(length '(lenght x)) ; lenght\n(length \"lenght\")") == 0);
+    ASSERT(applied == 2);
+    free(got);
+}
+
+TEST(test_fix_rejects_unparsable_source) {
+    size_t applied = 7;
+    ASSERT(omni_fix_source("(define (f x)", NULL, &applied) == NULL);
+    ASSERT(applied == 0);
+}
+
+/* ========== Diff ========== */
+
+TEST(test_diff_of_changed_lines) {
+    char out[512] = "";
+    FILE* f = fmemopen(out, sizeof(out), "w");
+    omni_fix_print_diff(f, "t.omni", "a\nb\nc\nd\n", "a\nB\nc\nx\ny\n");
+    omni_fix_print_diff(f, "same.omni", "a\n", "a\n");
+    fclose(f);
+    ASSERT(strcmp(out, "--- t.omni\n+++ t.omni\n"
+                       "@@ -2 +2 @@\n-b\n+B\n"
+                       "@@ -4 +4,2 @@\n-d\n+x\n+y\n") == 0);
+}
+
+TEST(test_diff_of_removed_lines) {
+    char out[512] = "";
+    FILE* f = fmemopen(out, sizeof(out), "w");
+    omni_fix_print_diff(f, "t.omni", "a\nb\nc\n", "a\nc\n");
+    fclose(f);
+    ASSERT(strcmp(out, "--- t.omni\n+++ t.omni\n@@ -2 +1,0 @@\n-b\n") == 0);
+}
+
+int main(void) {
+    printf("\n\033[33m=== Fix Tests ===\033[0m\n");
+
+    printf("\n\033[33m--- Fixes ---\033[0m\n");
+    RUN_TEST(test_fix_keeps_comments_and_layout);
+    RUN_TEST(test_fix_deletes_ignored_values);
+    RUN_TEST(test_fix_removes_unused_bindings);
+    RUN_TEST(test_fix_renests_append_chains);
+    RUN_TEST(test_fix_follows_overlapping_fixes);
+    RUN_TEST(test_fix_renames_code_not_data);
+    RUN_TEST(test_fix_rejects_unparsable_source);
+
+    printf("\n\033[33m--- Diff ---\033[0m\n");
+    RUN_TEST(test_diff_of_changed_lines);
+    RUN_TEST(test_diff_of_removed_lines);
+
+    printf("\n\033[33m=== Summary ===\033[0m\n");
+    printf("  Total:  %d\n", tests_run);
+    if (tests_passed == tests_run) {
+        printf("  \033[32mPassed: %d\033[0m\n", tests_passed);
+    } else {
+        printf("  \033[32mPassed: %d\033[0m\n", tests_passed);
+        printf("  \033[31mFailed: %d\033[0m\n", tests_run - tests_passed);
+    }
+    printf("  Failed: %d\n", tests_run - tests_passed);
+
+    return (tests_passed == tests_run) ? 0 : 1;
+}
@@ -21,6 +21,9 @@
 static int tests_run = 0;
 static int tests_passed = 0;
 
+/* Where the trees the tests build and parse live */
+static OmniSession* session;
+
 #define TEST(name) static void name(void)
 #define RUN_TEST(name) do { \
     printf("  %s: ", #name); \
@@ -40,12 +43,12 @@ static int tests_passed = 0;
 
 /* Helper to create a simple symbol */
 static OmniValue* mk_sym(const char* name) {
-    return omni_new_sym(name);
+    return omni_new_sym(session->arena, name);
 }
 
 /* Helper to create a cons cell */
 static OmniValue* mk_cons(OmniValue* car, OmniValue* cdr) {
-    return omni_new_cell(car, cdr);
+    return omni_new_cell(session->arena, car, cdr);
 }
 
 /* Helper to create a list */
@@ -142,6 +145,109 @@ TEST(test_function_with_side_effects) {
     omni_analysis_free(ctx);
 }
 
+TEST(test_primitive_summaries_are_pure) {
+    AnalysisContext* ctx = omni_analysis_new();
+    omni_register_primitive_summaries(ctx);
+
+    FunctionSummary* expt = omni_get_function_summary(ctx, "expt");
+    ASSERT(expt != NULL);
+    ASSERT(expt->param_count == 2);
+    ASSERT(expt->return_ownership == RETURN_FRESH);
+    ASSERT(omni_function_is_pure(ctx, "expt"));
+    ASSERT(omni_get_function_summary(ctx, "sqrt")->param_count == 1);
+    ASSERT(omni_caller_should_free_arg(ctx, "gcd", 1));
+    ASSERT(!omni_function_is_pure(ctx, "no-such-fn"));
+
+    omni_analysis_free(ctx);
+}
+
+TEST(test_for_each_propagates_effects) {
+    AnalysisContext* ctx = omni_analysis_new();
+    omni_register_primitive_summaries(ctx);
+
+    FunctionSummary* for_each = omni_get_function_summary(ctx, "for-each");
+    ASSERT(for_each != NULL);
+    ASSERT(for_each->effect_param == 0);
+    ASSERT(!omni_function_is_pure(ctx, "for-each"));
+
+    /* (define (show xs) (for-each display xs)) */
+    omni_analyze_function_summary(ctx, mk_list3(
+        mk_sym("define"),
+        mk_list2(mk_sym("show"), mk_sym("xs")),
+        mk_list3(mk_sym("for-each"), mk_sym("display"), mk_sym("xs"))
+    ));
+    ASSERT(omni_get_function_summary(ctx, "show")->has_side_effects);
+
+    /* (define (walk xs) (for-each (lambda (x) (+ x 1)) xs)) */
+    OmniValue* lambda = mk_list3(
+        mk_sym("lambda"),
+        mk_cons(mk_sym("x"), omni_nil),
+        mk_list3(mk_sym("+"), mk_sym("x"), omni_new_int(session->arena, 1))
+    );
+    omni_analyze_function_summary(ctx, mk_list3(
+        mk_sym("define"),
+        mk_list2(mk_sym("walk"), mk_sym("xs")),
+        mk_list3(mk_sym("for-each"), lambda, mk_sym("xs"))
+    ));
+    ASSERT(!omni_get_function_summary(ctx, "walk")->has_side_effects);
+
+    omni_analysis_free(ctx);
+}
+
+TEST(test_timer_summaries_have_effects) {
+    AnalysisContext* ctx = omni_analysis_new();
+    omni_register_primitive_summaries(ctx);
+
+    FunctionSummary* sleep = omni_get_function_summary(ctx, "sleep-ms");
+    ASSERT(sleep != NULL && sleep->param_count == 1);
+    ASSERT(sleep->effects == (EFFECT_IO | EFFECT_CONCURRENT));
+    ASSERT(omni_get_function_summary(ctx, "yield")->effects == EFFECT_CONCURRENT);
+    ASSERT(omni_get_function_summary(ctx, "monotonic-millis")->effects == EFFECT_IO);
+    ASSERT(!omni_function_is_pure(ctx, "monotonic-millis"));
+    ASSERT(omni_get_function_summary(ctx, "expt")->effects == EFFECT_NONE);
+
+    /* (define (pause) (yield)) takes on the primitive's effects */
+    omni_analyze_function_summary(ctx, mk_list3(
+        mk_sym("define"),
+        mk_cons(mk_sym("pause"), omni_nil),
+        mk_cons(mk_sym("yield"), omni_nil)
+    ));
+    FunctionSummary* pause = omni_get_function_summary(ctx, "pause");
+    ASSERT(pause->has_side_effects && pause->effects == EFFECT_CONCURRENT);
+
+    /* (define (wait-all xs) (for-each sleep-ms xs)) */
+    omni_analyze_function_summary(ctx, mk_list3(
+        mk_sym("define"),
+        mk_list2(mk_sym("wait-all"), mk_sym("xs")),
+        mk_list3(mk_sym("for-each"), mk_sym("sleep-ms"), mk_sym("xs"))
+    ));
+    ASSERT(omni_get_function_summary(ctx, "wait-all")->has_side_effects);
+
+    omni_analysis_free(ctx);
+}
+
+TEST(test_discarded_map_warns) {
+    AnalysisContext* ctx = omni_analysis_new();
+
+    /* (do (map f xs) (for-each f xs) 1) */
+    OmniValue* prog = mk_list4(
+        mk_sym("do"),
+        mk_list3(mk_sym("map"), mk_sym("f"), mk_sym("xs")),
+        mk_list3(mk_sym("for-each"), mk_sym("f"), mk_sym("xs")),
+        omni_new_int(session->arena, 1)
+    );
+    omni_analyze_dead_code(ctx, &prog, 1, true);
+    ASSERT(omni_analysis_warning_count(ctx) == 1);
+    ASSERT(strstr(omni_analysis_get_warning(ctx, 0), "for-each") != NULL);
+
+    /* A map whose value is the result is fine */
+    OmniValue* used = mk_list3(mk_sym("map"), mk_sym("f"), mk_sym("xs"));
+    omni_analyze_dead_code(ctx, &used, 1, true);
+    ASSERT(omni_analysis_warning_count(ctx) == 1);
+
+    omni_analysis_free(ctx);
+}
+
 TEST(test_param_ownership_query) {
     AnalysisContext* ctx = omni_analysis_new();
 
@@ -216,7 +322,7 @@ TEST(test_lambda_style_define) {
         mk_list3(
             mk_sym("lambda"),
             mk_cons(mk_sym("x"), omni_nil),
-            mk_list3(mk_sym("+"), mk_sym("x"), omni_new_int(1))
+            mk_list3(mk_sym("+"), mk_sym("x"), omni_new_int(session->arena, 1))
         )
     );
 
@@ -232,9 +338,9 @@ TEST(test_lambda_style_define) {
 /* ========== Codegen Tests ========== */
 
 TEST(test_codegen_has_interprocedural_macros) {
-    OmniValue* expr = omni_new_int(42);
+    OmniValue* expr = omni_new_int(session->arena, 42);
 
-    CodeGenContext* cg = omni_codegen_new_buffer();
+    CodeGenContext* cg = omni_codegen_new_buffer(session);
     cg->analysis = omni_analysis_new();
 
     omni_codegen_program(cg, &expr, 1);
@@ -259,6 +365,7 @@ TEST(test_codegen_has_interprocedural_macros) {
 /* ========== Main ========== */
 
 int main(void) {
+    session = omni_session_new();
     printf("\n\033[33m=== Interprocedural Summary Tests ===\033[0m\n");
 
     printf("\n\033[33m--- Ownership Name Tests ---\033[0m\n");
@@ -269,6 +376,10 @@ int main(void) {
     RUN_TEST(test_simple_function_define);
     RUN_TEST(test_function_returns_fresh);
     RUN_TEST(test_function_with_side_effects);
+    RUN_TEST(test_primitive_summaries_are_pure);
+    RUN_TEST(test_for_each_propagates_effects);
+    RUN_TEST(test_timer_summaries_have_effects);
+    RUN_TEST(test_discarded_map_warns);
     RUN_TEST(test_param_ownership_query);
     RUN_TEST(test_caller_should_free_arg);
     RUN_TEST(test_function_consumes_param);
@@ -288,5 +399,6 @@ int main(void) {
     }
     printf("  Failed: %d\n", tests_run - tests_passed);
 
+    omni_session_free(session);
     return (tests_passed == tests_run) ? 0 : 1;
 }
@@ -0,0 +1,202 @@
+/*
+ * Lint Tests
+ *
+ * Tests for omni_lint_forms: each rule fires on the shape it describes
+ * and not on near misses, positions are the source's, and fixes are only
+ * offered when the rewrite keeps what the program does.
+ */
+
+#define _POSIX_C_SOURCE 200809L
+#define _GNU_SOURCE
+
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <assert.h>
+
+#include "../ast/ast.h"
+#include "../parser/parser.h"
+#include "../lint/lint.h"
+
+/* Test counters */
+static int tests_run = 0;
+static int tests_passed = 0;
+
+/* Where the trees the tests build and parse live */
+static OmniSession* session;
+
+#define TEST(name) static void name(void)
+#define RUN_TEST(name) do { \
+    printf("  %s: ", #name); \
+    name(); \
+    tests_run++; \
+    tests_passed++; \
+    printf("\033[32mPASS\033[0m\n"); \
+} while(0)
+
+#define ASSERT(cond) do { \
+    if (!(cond)) { \
+        printf("\033[31mFAIL\033[0m (line %d: %s)\n", __LINE__, #cond); \
+        tests_run++; \
+        return; \
+    } \
+} while(0)
+
+/* ========== Helpers ========== */
+
+/* Lint src and render the findings into out, as from a file t.omni */
+static size_t lint_source(const char* src, char* out, size_t cap) {
+    OmniParser* p = omni_parser_new(session, src);
+    size_t n = 0;
+    OmniValue** forms = omni_parser_parse_all(p, &n);
+
+    OmniLints* lints = omni_lint_forms(session->arena, forms, n);
+    size_t count = lints->count;
+
+    out[0] = '\0';
+    FILE* f = fmemopen(out, cap, "w");
+    omni_lint_print(f, "t.omni", lints);
+    fclose(f);
+
+    omni_lint_free(lints);
+    free(forms);
+    omni_parser_free(p);
+    return count;
+}
+
+/* ========== Catalog ========== */
+
+TEST(test_every_rule_has_an_entry) {
+    for (int r = OMNI_LINT_IGNORED_VALUE; r < OMNI_LINT_COUNT; r++) {
+        const OmniLintInfo* info = omni_lint_info((OmniLintRule)r);
+        ASSERT(info != NULL);
+        ASSERT(omni_lint_lookup(info->id) == info);
+    }
+    ASSERT(omni_lint_lookup("l0003")->rule == OMNI_LINT_CAR_OF_CONS);
+    ASSERT(omni_lint_lookup("L9999") == NULL);
+}
+
+/* ========== Rules ========== */
+
+TEST(test_ignored_pure_value) {
+    char out[512];
+    ASSERT(lint_source("(define (f x)\n  (+ x 1)\n  (display x)\n  x)", out, sizeof(out)) == 1);
+    ASSERT(strcmp(out, "t.omni:2:3: L0001 the value of (+ x 1) is never used\n"
+                       "  fix: delete (+ x 1)\n") == 0);
+
+    /* Calls with effects, last forms and top-level values are fine */
+    ASSERT(lint_source("(define (f x) (display x) (g x) x)\n(+ 1 2)\n(let ((y 1)) y)", out, sizeof(out)) == 0);
+}
+
+TEST(test_if_with_same_branches) {
+    char out[512];
+    ASSERT(lint_source("(define (f x) (if (g) (h x) (h x)))\n(if x 1 1)", out, sizeof(out)) == 2);
+    ASSERT(strcmp(out, "t.omni:1:15: L0002 both branches of this if are (h x)\n"
+                       "  fix: replace (if (g) (h x) (h x)) with (do (g) (h x))\n"
+                       "t.omni:2:1: L0002 both branches of this if are 1\n"
+                       "  fix: replace (if x 1 1) with 1\n") == 0);
+    ASSERT(lint_source("(if x 1 2)", out, sizeof(out)) == 0);
+}
+
+TEST(test_car_of_cons) {
+    OmniParser* p = omni_parser_new(session, "(car (cons a 2)) (cdr (cons (f) b)) (car (cons a (g)))");
+    size_t n = 0;
+    OmniValue** forms = omni_parser_parse_all(p, &n);
+    OmniLints* lints = omni_lint_forms(session->arena, forms, n);
+    ASSERT(lints->count == 3);
+    ASSERT(lints->items[0].rule == OMNI_LINT_CAR_OF_CONS);
+    ASSERT(lints->items[0].fixable && omni_sym_eq_str(lints->items[0].fix, "a"));
+    /* Dropping (f) or (g) would drop their effects */
+    ASSERT(!lints->items[1].fixable);
+    ASSERT(!lints->items[2].fixable);
+    ASSERT(strcmp(lints->items[1].message, "cdr of a cons just made is b") == 0);
+    omni_lint_free(lints);
+    free(forms);
+    omni_parser_free(p);
+
+    /* Not when the program has its own car */
+    char out[256];
+    ASSERT(lint_source("(define (car x) 1) (car (cons 1 2))", out, sizeof(out)) == 0);
+}
+
+TEST(test_self_comparison) {
+    char out[512];
+    ASSERT(lint_source("(= x x) (< (car y) (car y)) (eq? (f) (f)) (= x y)", out, sizeof(out)) == 2);
+    ASSERT(strcmp(out, "t.omni:1:1: L0004 = compares x with itself, so it is always true\n"
+                       "t.omni:1:9: L0004 < compares (car y) with itself, so it is always false\n") == 0);
+}
+
+TEST(test_recursion_without_base_case) {
+    char out[512];
+    ASSERT(lint_source("(define (f n) (display n) (f (+ n 1)))", out, sizeof(out)) == 1);
+    ASSERT(strcmp(out, "t.omni:1:1: L0005 f calls itself on every path, so it never returns\n") == 0);
+
+    ASSERT(lint_source("(define (f n) (if (= n 0) 0 (f (- n 1))))\n"
+                       "(define (g n) (and (> n 0) (g (- n 1))))\n"
+                       "(define (h n) (lambda () (h n)))\n"
+                       "(define (k k) (k 1))", out, sizeof(out)) == 0);
+}
+
+TEST(test_float_equality) {
+    char out[512];
+    ASSERT(lint_source("(define (f x) (if (= x 0.5) 1 2))\n(= 1 2)", out, sizeof(out)) == 1);
+    ASSERT(strcmp(out, "t.omni:1:19: L0006 = compares floats exactly; compare the difference "
+                       "with a tolerance\n") == 0);
+}
+
+TEST(test_unused_binding) {
+    char out[512];
+    ASSERT(lint_source("(let ((a 1) (b (f)) (c 3)) c)\n(let [d 1] 2)", out, sizeof(out)) == 3);
+    ASSERT(strcmp(out, "t.omni:1:7: L0007 a is bound but never used\n"
+                       "  fix: delete (a 1)\n"
+                       "t.omni:1:13: L0007 b is bound but never used\n"
+                       "t.omni:2:7: L0007 d is bound but never used\n") == 0);
+
+    /* A later let* binding is a use; named let variables are loop state */
+    ASSERT(lint_source("(let* ((a 1) (b a)) b)\n(let loop ((i 0)) 1)", out, sizeof(out)) == 0);
+}
+
+TEST(test_append_chain) {
+    char out[512];
+    ASSERT(lint_source("(append (append (append a b) c) d)\n(append a (append b c))", out, sizeof(out)) == 1);
+    ASSERT(strcmp(out, "t.omni:1:1: L0008 append copies the lists of (append (append a b) c) again\n"
+                       "  fix: replace (append (append (append a b) c) d) with "
+                       "(append a (append b (append c d)))\n") == 0);
+}
+
+TEST(test_quoted_data_is_not_code) {
+    char out[256];
+    ASSERT(lint_source("'(if x 1 1) `(car (cons a b)) (defmacro m (x) `(if ,x 1 1))", out, sizeof(out)) == 0);
+}
+
+int main(void) {
+    session = omni_session_new();
+    printf("\n\033[33m=== Lint Tests ===\033[0m\n");
+
+    printf("\n\033[33m--- Catalog ---\033[0m\n");
+    RUN_TEST(test_every_rule_has_an_entry);
+
+    printf("\n\033[33m--- Rules ---\033[0m\n");
+    RUN_TEST(test_ignored_pure_value);
+    RUN_TEST(test_if_with_same_branches);
+    RUN_TEST(test_car_of_cons);
+    RUN_TEST(test_self_comparison);
+    RUN_TEST(test_recursion_without_base_case);
+    RUN_TEST(test_float_equality);
+    RUN_TEST(test_unused_binding);
+    RUN_TEST(test_append_chain);
+    RUN_TEST(test_quoted_data_is_not_code);
+
+    printf("\n\033[33m=== Summary ===\033[0m\n");
+    printf("  Total:  %d\n", tests_run);
+    if (tests_passed == tests_run) {
+        printf("  \033[32mPassed: %d\033[0m\n", tests_passed);
+    } else {
+        printf("  \033[32mPassed: %d\033[0m\n", tests_passed);
+        printf("  \033[31mFailed: %d\033[0m\n", tests_run - tests_passed);
+    }
+    printf("  Failed: %d\n", tests_run - tests_passed);
+
+    omni_session_free(session);
+    return (tests_passed == tests_run) ? 0 : 1;
+}
@@ -0,0 +1,377 @@
+/*
+ * Macro Expansion Tests
+ *
+ * Tests for defmacro, the evaluator macro bodies run in, and the
+ * renaming that keeps expansions hygienic.
+ */
+
+#define _POSIX_C_SOURCE 200809L
+#define _GNU_SOURCE
+
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <assert.h>
+
+#include "../ast/ast.h"
+#include "../parser/parser.h"
+#include "../macro/macro.h"
+
+/* Test counters */
+static int tests_run = 0;
+static int tests_passed = 0;
+
+/* Where the trees the tests build and parse live */
+static OmniSession* session;
+
+#define TEST(name) static void name(void)
+#define RUN_TEST(name) do { \
+    printf("  %s: ", #name); \
+    name(); \
+    tests_run++; \
+    tests_passed++; \
+    printf("\033[32mPASS\033[0m\n"); \
+} while(0)
+
+#define ASSERT(cond) do { \
+    if (!(cond)) { \
+        printf("\033[31mFAIL\033[0m (line %d: %s)\n", __LINE__, #cond); \
+        tests_run++; \
+        return; \
+    } \
+} while(0)
+
+/* ========== Helpers ========== */
+
+/* Define the macros in defs, then expand each form of src and write them
+ * to out, one per line; false with err set if anything fails */
+static bool expand_text(const char* defs, const char* src, char* out, size_t cap, OmniMacroError* err) {
+    OmniMacros* macros = omni_macros_new(session);
+    OmniParser* parser = omni_parser_new(session, defs);
+    size_t count = 0;
+    OmniValue** forms = omni_parser_parse_all(parser, &count);
+    bool ok = true;
+    for (size_t i = 0; i < count && ok; i++) ok = omni_macros_define(macros, forms[i], err);
+    free(forms);
+    omni_parser_free(parser);
+
+    parser = omni_parser_new(session, src);
+    forms = omni_parser_parse_all(parser, &count);
+    size_t len = 0;
+    out[0] = '\0';
+    for (size_t i = 0; i < count && ok; i++) {
+        OmniValue* expanded = omni_macros_expand(macros, forms[i], err);
+        if (!expanded) {
+            ok = false;
+            break;
+        }
+        char* text = omni_value_to_string(expanded);
+        len += (size_t)snprintf(out + len, cap - len, "%s%s", len ? "\n" : "", text);
+        free(text);
+    }
+    free(forms);
+    omni_parser_free(parser);
+    omni_macros_free(macros);
+    return ok;
+}
+
+/* ========== Expansion ========== */
+
+TEST(test_templates_fill_in_arguments) {
+    char out[512];
+    OmniMacroError err;
+    ASSERT(expand_text("(defmacro twice (x) `(+ ,x ,x))"
+                       "(defmacro unless (c . body) `(if ,c 0 (do ,@body)))",
+                       "(twice (f 1)) (unless done (step) (log \"again\")) (g 'twice)",
+                       out, sizeof(out), &err));
+    ASSERT(strcmp(out, "(+ (f 1) (f 1))\n"
+                       "(if done 0 (do (step) (log \"again\")))\n"
+                       "(g (quote twice))") == 0);
+}
+
+TEST(test_expansions_are_expanded_again) {
+    char out[512];
+    OmniMacroError err;
+    ASSERT(expand_text("(defmacro my-list args"
+                       "  (if (null? args) ''() `(cons ,(car args) (my-list ,@(cdr args)))))"
+                       "(defmacro twice (x) `(+ ,x ,x))",
+                       "(my-list 1 (twice 2))", out, sizeof(out), &err));
+    ASSERT(strcmp(out, "(cons 1 (cons (+ 2 2) (quote ())))") == 0);
+}
+
+TEST(test_macro_bodies_compute) {
+    char out[512];
+    OmniMacroError err;
+    ASSERT(expand_text("(defmacro sum-of xs (let* ((n (length xs)) (total (apply + xs))) (if (> n 0) total -1)))"
+                       "(defmacro defs (val . names)"
+                       "  (define (def name) `(define ,name ,val))"
+                       "  `(do ,@(map def names)))"
+                       "(defmacro pick (n . xs)"
+                       "  (cond ((< n 0) (error \"negative index\" n)) (else (nth xs n))))",
+                       "(sum-of 1 2 3) (sum-of) (defs 0 a b) (pick 1 a b c)", out, sizeof(out), &err));
+    ASSERT(strcmp(out, "6\n-1\n(do (define a 0) (define b 0))\nb") == 0);
+
+    ASSERT(!expand_text("(defmacro pick (n . xs)"
+                        "  (cond ((< n 0) (error \"negative index\" n)) (else (nth xs n))))",
+                        "(pick -1 a)", out, sizeof(out), &err));
+    ASSERT(strcmp(err.message, "E0010 expanding (pick -1 a): negative index -1") == 0);
+}
+
+TEST(test_when_and_unless_become_if) {
+    char out[512];
+    OmniMacroError err;
+    ASSERT(expand_text("", "(when (f) (g) 1) (unless (f) 2)", out, sizeof(out), &err));
+    ASSERT(strcmp(out, "(if (f) (do (g) 1))\n(if (f) () (do 2))") == 0);
+
+    /* Macro bodies may use them too */
+    ASSERT(expand_text("(defmacro pos (n) (when (> n 0) n))"
+                       "(defmacro neg (n) (unless (> n 0) n))",
+                       "(pos 2) (pos -2) (neg 2) (neg -2)", out, sizeof(out), &err));
+    ASSERT(strcmp(out, "2\n()\n()\n-2") == 0);
+
+    ASSERT(!expand_text("", "(f (unless))", out, sizeof(out), &err));
+    ASSERT(strcmp(err.message, "E0002 (unless): expected (unless test body...)") == 0);
+}
+
+/* ========== Hygiene ========== */
+
+TEST(test_macro_binders_are_renamed) {
+    char out[512];
+    OmniMacroError err;
+    ASSERT(expand_text("(defmacro my-or (a b) `(let ((tmp ,a)) (if tmp tmp ,b)))"
+                       "(defmacro with-x (v body) `(let [x ,v] ,body))",
+                       "(my-or 0 tmp) (with-x 1 (+ x 1)) (my-or (fn (tmp) tmp) 'tmp)",
+                       out, sizeof(out), &err));
+    /* Names from the arguments keep theirs; quoted data is left alone */
+    ASSERT(strcmp(out, "(let ((tmp%1 0)) (if tmp%1 tmp%1 tmp))\n"
+                       "(let [x%2 1] (+ x 1))\n"
+                       "(let ((tmp%3 (fn (tmp) tmp))) (if tmp%3 tmp%3 (quote tmp)))") == 0);
+}
+
+TEST(test_gensym_names_are_fresh) {
+    char out[512];
+    OmniMacroError err;
+    ASSERT(expand_text("(defmacro names () `(list (quote ,(gensym)) (quote ,(gensym \"n\"))))",
+                       "(names) (names)", out, sizeof(out), &err));
+    ASSERT(strcmp(out, "(list (quote g%1) (quote n%2))\n(list (quote g%3) (quote n%4))") == 0);
+}
+
+TEST(test_expansions_take_the_call_position) {
+    OmniMacros* macros = omni_macros_new(session);
+    OmniMacroError err;
+    OmniParser* parser = omni_parser_new(session, "(defmacro inc (x) `(+ ,x 1))\n\n  (inc y)");
+    size_t count = 0;
+    OmniValue** forms = omni_parser_parse_all(parser, &count);
+    ASSERT(count == 2);
+    ASSERT(omni_is_defmacro(forms[0]) && !omni_is_defmacro(forms[1]));
+    ASSERT(omni_macros_define(macros, forms[0], &err));
+
+    OmniValue* y = omni_car(omni_cdr(forms[1]));
+    OmniValue* expanded = omni_macros_expand(macros, forms[1], &err);
+    ASSERT(expanded && expanded != forms[1]);
+    ASSERT(expanded->line == 3 && expanded->column == 3);
+    ASSERT(omni_car(expanded)->line == 3);
+    ASSERT(omni_car(omni_cdr(expanded)) == y);
+
+    /* Forms without macro calls come back as they are */
+    ASSERT(omni_macros_expand(macros, y, &err) == y);
+
+    free(forms);
+    omni_parser_free(parser);
+    omni_macros_free(macros);
+}
+
+/* ========== User Types ========== */
+
+/* The defines for the deftype in src, as text */
+static bool deftype_text(OmniMacros* macros, const char* src, char* out, size_t cap, OmniMacroError* err) {
+    OmniParser* parser = omni_parser_new(session, src);
+    size_t count = 0;
+    OmniValue** forms = omni_parser_parse_all(parser, &count);
+    OmniValue* defs = count == 1 && omni_is_deftype(forms[0])
+                    ? omni_macros_deftype(macros, forms[0], err) : NULL;
+    if (defs) {
+        char* text = omni_value_to_string(defs);
+        snprintf(out, cap, "%s", text);
+        free(text);
+    }
+    free(forms);
+    omni_parser_free(parser);
+    return defs != NULL;
+}
+
+TEST(test_deftype_defines_functions) {
+    OmniMacros* macros = omni_macros_new(session);
+    OmniMacroError err;
+    char out[1024];
+    ASSERT(deftype_text(macros, "(deftype Node (val int) (prev Node :weak))", out, sizeof(out), &err));
+    ASSERT(strcmp(out, "((define (mk-Node val%1 prev%2) (user%new Node val%1 prev%2)) "
+                       "(define (Node val%1 prev%2) (user%new Node val%1 prev%2)) "
+                       "(define (Node? x%3) (user%is Node x%3)) "
+                       "(define (Node-val x%3) (user%ref Node 0 x%3)) "
+                       "(define (set-Node-val! x%3 v%4) (user%set Node 0 x%3 v%4)) "
+                       "(define (Node-prev x%3) (user%ref Node 1 x%3)) "
+                       "(define (set-Node-prev! x%3 v%4) (user%set Node 1 x%3 v%4)))") == 0);
+
+    /* Fields are assigned with set! through their accessors */
+    OmniParser* parser = omni_parser_new(session, "(set! (Node-val n) 2)");
+    size_t count = 0;
+    OmniValue** forms = omni_parser_parse_all(parser, &count);
+    char* text = omni_value_to_string(omni_macros_expand(macros, forms[0], &err));
+    ASSERT(strcmp(text, "(set-Node-val! n 2)") == 0);
+    free(text);
+    free(forms);
+    omni_parser_free(parser);
+
+    /* A printer is registered for a type defined earlier */
+    parser = omni_parser_new(session, "(define-printer Node (lambda (n port) (display n port))) (define-printer Leaf f)");
+    forms = omni_parser_parse_all(parser, &count);
+    text = omni_value_to_string(omni_macros_expand(macros, forms[0], &err));
+    ASSERT(strcmp(text, "(user%printer Node (lambda (n port) (display n port)))") == 0);
+    free(text);
+    ASSERT(!omni_macros_expand(macros, forms[1], &err));
+    ASSERT(strcmp(err.message, "E0002 (define-printer Leaf f): expected (define-printer Type fn) after (deftype Type ...)") == 0);
+    free(forms);
+    omni_parser_free(parser);
+
+    ASSERT(!deftype_text(macros, "(deftype P x x)", out, sizeof(out), &err));
+    ASSERT(strcmp(err.message, "E0002 (deftype P x x): expected (deftype Name (field type [:weak]) ...)") == 0);
+    ASSERT(!deftype_text(macros, "(deftype P (x int :strong))", out, sizeof(out), &err));
+    ASSERT(!deftype_text(macros, "(deftype (P) x)", out, sizeof(out), &err));
+    /* Marks are keywords, and a keyword is not a type */
+    ASSERT(!deftype_text(macros, "(deftype P (x int weak))", out, sizeof(out), &err));
+    ASSERT(!deftype_text(macros, "(deftype P (x :int))", out, sizeof(out), &err));
+    ASSERT(deftype_text(macros, "(deftype P (x :weak))", out, sizeof(out), &err));
+    ASSERT(!expand_text("", "(f (deftype Q a))", out, sizeof(out), &err));
+    ASSERT(strcmp(err.message, "E0002 deftype is only allowed at top level") == 0);
+    omni_macros_free(macros);
+}
+
+TEST(test_sum_types_define_variants) {
+    OmniMacros* macros = omni_macros_new(session);
+    char out[2048];
+    OmniMacroError err;
+    ASSERT(deftype_text(macros, "(deftype Shape (Circle (r float)) (Dot))", out, sizeof(out), &err));
+    ASSERT(strcmp(out, "((define (Shape? x%1) (user%in Shape x%1)) "
+                       "(define (Shape-tag x%1) (user%tag Shape x%1)) "
+                       "(define (mk-Circle r%2) (user%new Circle r%2)) "
+                       "(define (Circle r%2) (user%new Circle r%2)) "
+                       "(define (Circle? x%3) (user%is Circle x%3)) "
+                       "(define (Circle-r x%3) (user%ref Circle 0 x%3)) "
+                       "(define (set-Circle-r! x%3 v%4) (user%set Circle 0 x%3 v%4)) "
+                       "(define (mk-Dot) (user%new Dot)) "
+                       "(define (Dot) (user%new Dot)) "
+                       "(define (Dot? x%5) (user%is Dot x%5)))") == 0);
+
+    /* Each variant needs a clause, unless one matches anything */
+    OmniParser* parser = omni_parser_new(session, "(match s ((Circle r) r) ((Dot) 0)) "
+                                         "(match s ((Circle r) r) (_ 0)) "
+                                         "(match s ((Circle 1) r) ((Dot) 0)) "
+                                         "(match s ((Circle r) :when r r) ((Dot) 0))");
+    size_t count = 0;
+    OmniValue** forms = omni_parser_parse_all(parser, &count);
+    ASSERT(count == 4);
+    ASSERT(omni_macros_expand(macros, forms[0], &err));
+    ASSERT(omni_macros_expand(macros, forms[1], &err));
+    ASSERT(!omni_macros_expand(macros, forms[2], &err));
+    ASSERT(strcmp(err.message, "E0002 (match s ((Circle 1) r) ((Dot) 0)): no clause matches Circle, "
+                               "a variant of Shape; add one, or a _ clause") == 0);
+    ASSERT(!omni_macros_expand(macros, forms[3], &err));
+    free(forms);
+    omni_parser_free(parser);
+
+    ASSERT(!deftype_text(macros, "(deftype S (A x) y)", out, sizeof(out), &err));
+    ASSERT(strcmp(err.message, "E0002 deftype S: y: a sum type's specs are all variants (Variant field...)") == 0);
+    ASSERT(!deftype_text(macros, "(deftype S (A x) (A y))", out, sizeof(out), &err));
+    ASSERT(strcmp(err.message, "E0002 deftype S: (A y): a variant is repeated") == 0);
+    ASSERT(!deftype_text(macros, "(deftype S (A x x))", out, sizeof(out), &err));
+    omni_macros_free(macros);
+}
+
+TEST(test_match_becomes_cond) {
+    char out[1024];
+    OmniMacroError err;
+    ASSERT(expand_text("", "(match (f) (0 'z) (\"s\" 's) ('() 'e) (x :when (> x 1) x) (_ 'other))",
+                       out, sizeof(out), &err));
+    ASSERT(strcmp(out, "(let ((match%1 (f))) (cond ((eq? match%1 0) (quote z)) ((eq? match%1 \"s\") (quote s)) "
+                       "((null? match%1) (quote e)) ((let* ((x match%1)) (> x 1)) (let* ((x match%1)) x)) "
+                       "(else (quote other))))") == 0);
+
+    /* A guard may sit in the pattern instead */
+    ASSERT(expand_text("", "(match x ((n :when (> n 0)) 'pos))", out, sizeof(out), &err));
+    ASSERT(strcmp(out, "(let ((match%1 x)) (cond ((let* ((n match%1)) (> n 0)) (let* ((n match%1)) (quote pos))) "
+                       "(else (error \"match: no clause matches\"))))") == 0);
+
+    /* Keywords match themselves */
+    ASSERT(expand_text("", "(match k (:a 1) (_ 2))", out, sizeof(out), &err));
+    ASSERT(strcmp(out, "(let ((match%1 k)) (cond ((eq? match%1 :a) 1) (else 2)))") == 0);
+
+    /* Clauses after one that always matches are never reached */
+    ASSERT(expand_text("", "(match x (y 1) (_ 2))", out, sizeof(out), &err));
+    ASSERT(strcmp(out, "(let ((match%1 x)) (cond (else (let* ((y match%1)) 1))))") == 0);
+
+    ASSERT(!expand_text("", "(match 1 ((Q a) 1))", out, sizeof(out), &err));
+    ASSERT(strcmp(err.message, "E0002 (Q a): expected _, a variable, a literal or (Type pattern...)") == 0);
+}
+
+/* ========== Errors ========== */
+
+TEST(test_macro_errors) {
+    char out[512];
+    OmniMacroError err;
+    ASSERT(!expand_text("(defmacro two (a b) `(+ ,a ,b))", "(two 1)", out, sizeof(out), &err));
+    ASSERT(strcmp(err.message, "E0010 expanding (two 1): expects 2 arguments, got 1") == 0);
+
+    ASSERT(!expand_text("(defmacro bad (x) (car x))", "(bad 5)", out, sizeof(out), &err));
+    ASSERT(strcmp(err.message, "E0010 expanding (bad 5): list too short: 5") == 0);
+
+    ASSERT(!expand_text("(defmacro forever (x) `(forever ,x))", "(forever 1)", out, sizeof(out), &err));
+    ASSERT(strstr(err.message, "expansions nest more than 256 deep") != NULL);
+
+    ASSERT(!expand_text("(defmacro spin (x) (define (f n) (f n)) (f x))", "(spin 1)",
+                        out, sizeof(out), &err));
+    ASSERT(strcmp(err.message, "E0010 expanding (spin 1): macro body recurses too deeply") == 0);
+
+    ASSERT(!expand_text("", "(f (defmacro g (x) x))", out, sizeof(out), &err));
+    ASSERT(strcmp(err.message, "E0010 defmacro is only allowed at top level") == 0);
+
+    ASSERT(!expand_text("(defmacro (x) x)", "", out, sizeof(out), &err));
+    ASSERT(strcmp(err.message, "E0002 (defmacro (x) x): expected (defmacro name (params...) body...)") == 0);
+}
+
+int main(void) {
+    session = omni_session_new();
+    printf("\n\033[33m=== Macro Expansion Tests ===\033[0m\n");
+
+    printf("\n\033[33m--- Expansion ---\033[0m\n");
+    RUN_TEST(test_templates_fill_in_arguments);
+    RUN_TEST(test_expansions_are_expanded_again);
+    RUN_TEST(test_macro_bodies_compute);
+    RUN_TEST(test_when_and_unless_become_if);
+
+    printf("\n\033[33m--- Hygiene ---\033[0m\n");
+    RUN_TEST(test_macro_binders_are_renamed);
+    RUN_TEST(test_gensym_names_are_fresh);
+    RUN_TEST(test_expansions_take_the_call_position);
+
+    printf("\n\033[33m--- User Types ---\033[0m\n");
+    RUN_TEST(test_deftype_defines_functions);
+    RUN_TEST(test_sum_types_define_variants);
+    RUN_TEST(test_match_becomes_cond);
+
+    printf("\n\033[33m--- Errors ---\033[0m\n");
+    RUN_TEST(test_macro_errors);
+
+    printf("\n\033[33m=== Summary ===\033[0m\n");
+    printf("  Total:  %d\n", tests_run);
+    if (tests_passed == tests_run) {
+        printf("  \033[32mPassed: %d\033[0m\n", tests_passed);
+    } else {
+        printf("  \033[32mPassed: %d\033[0m\n", tests_passed);
+        printf("  \033[31mFailed: %d\033[0m\n", tests_run - tests_passed);
+    }
+    printf("  Failed: %d\n", tests_run - tests_passed);
+
+    omni_session_free(session);
+    return (tests_passed == tests_run) ? 0 : 1;
+}
@@ -0,0 +1,269 @@
+/*
+ * Module Loader Tests
+ *
+ * Tests for import path resolution, loading each file once, finding
+ * import cycles and reading files from memory.
+ */
+
+#define _POSIX_C_SOURCE 200809L
+#define _GNU_SOURCE
+
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <unistd.h>
+#include <assert.h>
+#include <limits.h>
+
+#include "../ast/ast.h"
+#include "../parser/parser.h"
+#include "../modules/modules.h"
+
+/* Test counters */
+static int tests_run = 0;
+static int tests_passed = 0;
+
+/* Where the trees the tests build and parse live */
+static OmniSession* session;
+
+#define TEST(name) static void name(void)
+#define RUN_TEST(name) do { \
+    printf("  %s: ", #name); \
+    name(); \
+    tests_run++; \
+    tests_passed++; \
+    printf("\033[32mPASS\033[0m\n"); \
+} while(0)
+
+#define ASSERT(cond) do { \
+    if (!(cond)) { \
+        printf("\033[31mFAIL\033[0m (line %d: %s)\n", __LINE__, #cond); \
+        tests_run++; \
+        return; \
+    } \
+} while(0)
+
+/* ========== Helpers ========== */
+
+/* Write text to dir/name */
+static void write_file(const char* dir, const char* name, const char* text) {
+    char path[512];
+    snprintf(path, sizeof(path), "%s/%s", dir, name);
+    FILE* f = fopen(path, "w");
+    fputs(text, f);
+    fclose(f);
+}
+
+static void remove_file(const char* dir, const char* name) {
+    char path[512];
+    snprintf(path, sizeof(path), "%s/%s", dir, name);
+    unlink(path);
+}
+
+/* ========== Paths ========== */
+
+TEST(test_paths_are_relative_to_the_importer) {
+    char* p = omni_module_resolve("src/main.omni", "lib/util.omni");
+    ASSERT(strcmp(p, "src/lib/util.omni") == 0);
+    free(p);
+
+    p = omni_module_resolve("main.omni", "util.omni");
+    ASSERT(strcmp(p, "util.omni") == 0);
+    free(p);
+
+    p = omni_module_resolve(NULL, "util.omni");
+    ASSERT(strcmp(p, "util.omni") == 0);
+    free(p);
+
+    p = omni_module_resolve("src/main.omni", "/opt/util.omni");
+    ASSERT(strcmp(p, "/opt/util.omni") == 0);
+    free(p);
+}
+
+/* ========== Loading ========== */
+
+TEST(test_files_load_once) {
+    char dir[] = "/tmp/omni_test_modules_XXXXXX";
+    ASSERT(mkdtemp(dir) != NULL);
+    write_file(dir, "util.omni", "(define (sq x) (* x x))");
+
+    char path[512], other[512];
+    snprintf(path, sizeof(path), "%s/util.omni", dir);
+    snprintf(other, sizeof(other), "%s/./util.omni", dir);
+
+    OmniModuleLoader* loader = omni_modules_new();
+    size_t first, again;
+    ASSERT(omni_modules_load(loader, path, NULL, &first) == OMNI_MODULE_NEW);
+    ASSERT(strcmp(loader->modules[first].text, "(define (sq x) (* x x))") == 0);
+    omni_modules_done(loader, first);
+
+    /* The same file by another name */
+    ASSERT(omni_modules_load(loader, other, NULL, &again) == OMNI_MODULE_LOADED);
+    ASSERT(again == first);
+
+    snprintf(path, sizeof(path), "%s/missing.omni", dir);
+    ASSERT(omni_modules_load(loader, path, NULL, &again) == OMNI_MODULE_MISSING);
+
+    /* Text that is not in a file is never already loaded */
+    ASSERT(omni_modules_load(loader, "<eval>", "(+ 1 2)", &first) == OMNI_MODULE_NEW);
+    omni_modules_done(loader, first);
+    ASSERT(omni_modules_load(loader, "<eval>", "(+ 1 2)", &again) == OMNI_MODULE_NEW);
+    ASSERT(again != first);
+    omni_modules_done(loader, again);
+
+    omni_modules_free(loader);
+    remove_file(dir, "util.omni");
+    rmdir(dir);
+}
+
+TEST(test_cycles_name_the_chain) {
+    char dir[] = "/tmp/omni_test_modules_XXXXXX";
+    ASSERT(mkdtemp(dir) != NULL);
+    write_file(dir, "a.omni", "(import \"b.omni\")");
+    write_file(dir, "b.omni", "(import \"a.omni\")");
+
+    char a[512], b[512];
+    snprintf(a, sizeof(a), "%s/a.omni", dir);
+    snprintf(b, sizeof(b), "%s/b.omni", dir);
+
+    OmniModuleLoader* loader = omni_modules_new();
+    size_t ia, ib, again;
+    ASSERT(omni_modules_load(loader, a, NULL, &ia) == OMNI_MODULE_NEW);
+    ASSERT(omni_modules_load(loader, b, NULL, &ib) == OMNI_MODULE_NEW);
+    ASSERT(omni_modules_load(loader, a, NULL, &again) == OMNI_MODULE_CYCLE);
+    ASSERT(again == ia);
+
+    char chain[1200], expected[1200];
+    omni_modules_format_cycle(loader, again, chain, sizeof(chain));
+    snprintf(expected, sizeof(expected), "%s -> %s -> %s", a, b, a);
+    ASSERT(strcmp(chain, expected) == 0);
+
+    /* Once loaded, importing again is not a cycle */
+    omni_modules_done(loader, ib);
+    omni_modules_done(loader, ia);
+    ASSERT(omni_modules_load(loader, b, NULL, &again) == OMNI_MODULE_LOADED);
+
+    omni_modules_free(loader);
+    remove_file(dir, "a.omni");
+    remove_file(dir, "b.omni");
+    rmdir(dir);
+}
+
+/* ========== Files in Memory ========== */
+
+TEST(test_files_in_memory) {
+    OmniFS* fs = omni_fs_memory_new(NULL);
+    omni_fs_memory_put(fs, "src/util.omni", "(define (sq x) (* x x))");
+
+    char key[256];
+    ASSERT(omni_fs_canonical(fs, "src/./lib//../util.omni", key, sizeof(key)));
+    ASSERT(strcmp(key, "src/util.omni") == 0);
+    ASSERT(!omni_fs_canonical(fs, "src/other.omni", key, sizeof(key)));
+
+    OmniModuleLoader* loader = omni_modules_new();
+    loader->fs = fs;
+    size_t first, again;
+    char* path = omni_module_resolve("src/main.omni", "util.omni");
+    ASSERT(omni_modules_load(loader, path, NULL, &first) == OMNI_MODULE_NEW);
+    ASSERT(strcmp(loader->modules[first].text, "(define (sq x) (* x x))") == 0);
+    omni_modules_done(loader, first);
+    ASSERT(omni_modules_load(loader, "src/lib/../util.omni", NULL, &again) == OMNI_MODULE_LOADED);
+    ASSERT(again == first);
+    ASSERT(omni_modules_load(loader, "src/other.omni", NULL, &again) == OMNI_MODULE_MISSING);
+    free(path);
+    omni_modules_free(loader);
+
+    /* Replacing and removing */
+    omni_fs_memory_put(fs, "src/util.omni", "(define k 1)");
+    char* text = omni_fs_read(fs, "src/util.omni");
+    ASSERT(strcmp(text, "(define k 1)") == 0);
+    free(text);
+    ASSERT(omni_fs_memory_remove(fs, "src/util.omni"));
+    ASSERT(omni_fs_read(fs, "src/util.omni") == NULL);
+    ASSERT(!omni_fs_memory_remove(fs, "src/util.omni"));
+    omni_fs_memory_free(fs);
+}
+
+TEST(test_memory_files_hide_the_fallback) {
+    char dir[] = "/tmp/omni_test_modules_XXXXXX";
+    ASSERT(mkdtemp(dir) != NULL);
+    write_file(dir, "a.omni", "(define a 1)");
+    write_file(dir, "b.omni", "(define b 2)");
+
+    char a[512], b[512], key[PATH_MAX];
+    snprintf(a, sizeof(a), "%s/a.omni", dir);
+    snprintf(b, sizeof(b), "%s/b.omni", dir);
+
+    OmniFS* fs = omni_fs_memory_new(omni_fs_os());
+    omni_fs_memory_put(fs, a, "(define a 10)");
+    char* text = omni_fs_read(fs, a);
+    ASSERT(strcmp(text, "(define a 10)") == 0);
+    free(text);
+    text = omni_fs_read(fs, b);
+    ASSERT(strcmp(text, "(define b 2)") == 0);
+    free(text);
+    ASSERT(omni_fs_canonical(fs, b, key, sizeof(key)));
+
+    /* Removing the buffer uncovers the file */
+    ASSERT(omni_fs_memory_remove(fs, a));
+    text = omni_fs_read(fs, a);
+    ASSERT(strcmp(text, "(define a 1)") == 0);
+    free(text);
+    omni_fs_memory_free(fs);
+
+    remove_file(dir, "a.omni");
+    remove_file(dir, "b.omni");
+    rmdir(dir);
+}
+
+/* ========== Forms ========== */
+
+TEST(test_module_forms) {
+    OmniParser* parser = omni_parser_new(session, 
+        "(import \"a.omni\") (provide f) (define (f x) x) (define y 1) (define)");
+    size_t count = 0;
+    OmniValue** forms = omni_parser_parse_all(parser, &count);
+    ASSERT(count == 5);
+
+    ASSERT(omni_is_import(forms[0]) && !omni_is_provide(forms[0]));
+    ASSERT(omni_is_provide(forms[1]) && !omni_is_import(forms[1]));
+    ASSERT(omni_defined_name(forms[1]) == NULL);
+    ASSERT(strcmp(omni_defined_name(forms[2]), "f") == 0);
+    ASSERT(strcmp(omni_defined_name(forms[3]), "y") == 0);
+    ASSERT(omni_defined_name(forms[4]) == NULL);
+
+    free(forms);
+    omni_parser_free(parser);
+}
+
+int main(void) {
+    session = omni_session_new();
+    printf("\n\033[33m=== Module Loader Tests ===\033[0m\n");
+
+    printf("\n\033[33m--- Paths ---\033[0m\n");
+    RUN_TEST(test_paths_are_relative_to_the_importer);
+
+    printf("\n\033[33m--- Loading ---\033[0m\n");
+    RUN_TEST(test_files_load_once);
+    RUN_TEST(test_cycles_name_the_chain);
+
+    printf("\n\033[33m--- Files in Memory ---\033[0m\n");
+    RUN_TEST(test_files_in_memory);
+    RUN_TEST(test_memory_files_hide_the_fallback);
+
+    printf("\n\033[33m--- Forms ---\033[0m\n");
+    RUN_TEST(test_module_forms);
+
+    printf("\n\033[33m=== Summary ===\033[0m\n");
+    printf("  Total:  %d\n", tests_run);
+    if (tests_passed == tests_run) {
+        printf("  \033[32mPassed: %d\033[0m\n", tests_passed);
+    } else {
+        printf("  \033[32mPassed: %d\033[0m\n", tests_passed);
+        printf("  \033[31mFailed: %d\033[0m\n", tests_run - tests_passed);
+    }
+    printf("  Failed: %d\n", tests_run - tests_passed);
+
+    omni_session_free(session);
+    return (tests_passed == tests_run) ? 0 : 1;
+}
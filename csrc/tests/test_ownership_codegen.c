@@ -20,6 +20,9 @@
 static int tests_run = 0;
 static int tests_passed = 0;
 
+/* Where the trees the tests build and parse live */
+static OmniSession* session;
+
 #define TEST(name) static void name(void)
 #define RUN_TEST(name) do { \
     printf("  %s: ", #name); \
@@ -39,17 +42,17 @@ static int tests_passed = 0;
 
 /* Helper to create a simple symbol */
 static OmniValue* mk_sym(const char* name) {
-    return omni_new_sym(name);
+    return omni_new_sym(session->arena, name);
 }
 
 /* Helper to create a simple integer */
 static OmniValue* mk_int(long val) {
-    return omni_new_int(val);
+    return omni_new_int(session->arena, val);
 }
 
 /* Helper to create a cons cell */
 static OmniValue* mk_cons(OmniValue* car, OmniValue* cdr) {
-    return omni_new_cell(car, cdr);
+    return omni_new_cell(session->arena, car, cdr);
 }
 
 /* Helper to create a list */
@@ -132,7 +135,7 @@ TEST(test_codegen_emits_free_unique) {
     );
     OmniValue* expr = mk_list3(mk_sym("let"), bindings, mk_sym("x"));
 
-    CodeGenContext* cg = omni_codegen_new_buffer();
+    CodeGenContext* cg = omni_codegen_new_buffer(session);
 
     /* Set up analysis */
     cg->analysis = omni_analysis_new();
@@ -163,7 +166,7 @@ TEST(test_codegen_has_ownership_comments) {
     OmniValue* body = mk_list3(mk_sym("+"), mk_sym("x"), mk_int(1));
     OmniValue* expr = mk_list3(mk_sym("let"), bindings, body);
 
-    CodeGenContext* cg = omni_codegen_new_buffer();
+    CodeGenContext* cg = omni_codegen_new_buffer(session);
     cg->analysis = omni_analysis_new();
     omni_analyze_ownership(cg->analysis, expr);
 
@@ -198,9 +201,91 @@ TEST(test_shape_defaults_to_tree) {
     omni_analysis_free(ctx);
 }
 
+TEST(test_string_binding_is_leaf) {
+    /* (let ((s "abc") (t (string-append s s))) (cons t t))
+     * s and t hold no references: scalar-shaped, never freed recursively
+     */
+    OmniValue* bindings = mk_cons(
+        mk_list2(mk_sym("s"), omni_new_string(session->arena, "abc")),
+        mk_cons(mk_list2(mk_sym("t"), mk_list3(mk_sym("string-append"), mk_sym("s"), mk_sym("s"))),
+                omni_nil)
+    );
+    OmniValue* body = mk_list3(mk_sym("cons"), mk_sym("t"), mk_sym("t"));
+    OmniValue* expr = mk_list3(mk_sym("let"), bindings, body);
+
+    AnalysisContext* ctx = omni_analysis_new();
+    omni_analyze_ownership(ctx, expr);
+
+    OwnerInfo* s = omni_get_owner_info(ctx, "s");
+    OwnerInfo* t = omni_get_owner_info(ctx, "t");
+    ASSERT(s != NULL && t != NULL);
+    ASSERT(s->shape == SHAPE_SCALAR);
+    ASSERT(t->shape == SHAPE_SCALAR);
+
+    /* Shared leaves still go through the reference count */
+    FreeStrategy strategy = omni_get_free_strategy(ctx, "t");
+    ASSERT(t->is_unique || strategy != FREE_STRATEGY_UNIQUE);
+
+    omni_analysis_free(ctx);
+}
+
+TEST(test_vector_slots_are_strong) {
+    /* (let ((x (cons 1 2)) (v [x x])) (vector-length v))
+     * v's slots share x, so neither is freed as a unique tree
+     */
+    OmniValue* items[] = { mk_sym("x"), mk_sym("x") };
+    OmniValue* bindings = mk_cons(
+        mk_list2(mk_sym("x"), mk_list3(mk_sym("cons"), mk_int(1), mk_int(2))),
+        mk_cons(mk_list2(mk_sym("v"), omni_new_array_from(session->arena, items, 2)), omni_nil)
+    );
+    OmniValue* body = mk_list2(mk_sym("vector-length"), mk_sym("v"));
+    OmniValue* expr = mk_list3(mk_sym("let"), bindings, body);
+
+    AnalysisContext* ctx = omni_analysis_new();
+    omni_analyze_ownership(ctx, expr);
+
+    OwnerInfo* x = omni_get_owner_info(ctx, "x");
+    OwnerInfo* v = omni_get_owner_info(ctx, "v");
+    ASSERT(x != NULL && v != NULL);
+    ASSERT(!x->is_unique);
+    ASSERT(omni_get_free_strategy(ctx, "x") != FREE_STRATEGY_UNIQUE);
+    ASSERT(v->shape == SHAPE_DAG);
+
+    omni_analysis_free(ctx);
+}
+
+TEST(test_hash_entries_are_strong) {
+    /* (let ((x (cons 1 2)) (h (hash))) (hash-set! h 'k x) (hash-count h))
+     * h holds a reference to x, so x is not freed as a unique tree
+     */
+    OmniValue* bindings = mk_cons(
+        mk_list2(mk_sym("x"), mk_list3(mk_sym("cons"), mk_int(1), mk_int(2))),
+        mk_cons(mk_list2(mk_sym("h"), mk_cons(mk_sym("hash"), omni_nil)), omni_nil)
+    );
+    OmniValue* set = mk_cons(mk_sym("hash-set!"),
+        mk_cons(mk_sym("h"), mk_cons(mk_list2(mk_sym("quote"), mk_sym("k")),
+                                      mk_cons(mk_sym("x"), omni_nil))));
+    OmniValue* body = mk_cons(mk_sym("begin"),
+        mk_cons(set, mk_cons(mk_list2(mk_sym("hash-count"), mk_sym("h")), omni_nil)));
+    OmniValue* expr = mk_list3(mk_sym("let"), bindings, body);
+
+    AnalysisContext* ctx = omni_analysis_new();
+    omni_analyze_ownership(ctx, expr);
+
+    OwnerInfo* x = omni_get_owner_info(ctx, "x");
+    OwnerInfo* h = omni_get_owner_info(ctx, "h");
+    ASSERT(x != NULL && h != NULL);
+    ASSERT(!x->is_unique);
+    ASSERT(omni_get_free_strategy(ctx, "x") != FREE_STRATEGY_UNIQUE);
+    ASSERT(h->shape == SHAPE_DAG);
+
+    omni_analysis_free(ctx);
+}
+
 /* ========== Main ========== */
 
 int main(void) {
+    session = omni_session_new();
     printf("\n\033[33m=== Ownership-Driven Codegen Tests ===\033[0m\n");
 
     printf("\n\033[33m--- Free Strategy Selection ---\033[0m\n");
@@ -208,6 +293,9 @@ int main(void) {
     RUN_TEST(test_param_borrowed_strategy);
     RUN_TEST(test_free_strategy_names);
     RUN_TEST(test_shape_defaults_to_tree);
+    RUN_TEST(test_string_binding_is_leaf);
+    RUN_TEST(test_vector_slots_are_strong);
+    RUN_TEST(test_hash_entries_are_strong);
 
     printf("\n\033[33m--- Code Generation ---\033[0m\n");
     RUN_TEST(test_codegen_emits_free_unique);
@@ -223,5 +311,6 @@ int main(void) {
     }
     printf("  Failed: %d\n", tests_run - tests_passed);
 
+    omni_session_free(session);
     return (tests_passed == tests_run) ? 0 : 1;
 }
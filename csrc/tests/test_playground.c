@@ -0,0 +1,122 @@
+/*
+ * Playground Tests
+ *
+ * Tests for the JSON the playground gives a browser: diagnostics from
+ * checking, generated C from compiling, and imports held in memory.
+ */
+
+#define _POSIX_C_SOURCE 200809L
+#define _GNU_SOURCE
+
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <stdbool.h>
+#include <assert.h>
+
+#include "../playground/playground.h"
+
+/* Test counters */
+static int tests_run = 0;
+static int tests_passed = 0;
+
+#define TEST(name) static void name(void)
+#define RUN_TEST(name) do { \
+    printf("  %s: ", #name); \
+    name(); \
+    tests_run++; \
+    tests_passed++; \
+    printf("\033[32mPASS\033[0m\n"); \
+} while(0)
+
+#define ASSERT(cond) do { \
+    if (!(cond)) { \
+        printf("\033[31mFAIL\033[0m (line %d: %s)\n", __LINE__, #cond); \
+        tests_run++; \
+        return; \
+    } \
+} while(0)
+
+/* ========== Helpers ========== */
+
+static bool starts_with(const char* s, const char* prefix) {
+    return strncmp(s, prefix, strlen(prefix)) == 0;
+}
+
+static bool ends_with(const char* s, const char* suffix) {
+    size_t n = strlen(s), m = strlen(suffix);
+    return n >= m && strcmp(s + n - m, suffix) == 0;
+}
+
+/* ========== Check ========== */
+
+TEST(test_check_reports_located_errors) {
+    OmniPlayground* p = omni_playground_new();
+    const char* r = omni_playground_check(p, "(define (f x)\n  (+ x y))");
+    ASSERT(strcmp(r, "{\"ok\":false,\"errors\":[\"main.omni:2:8: E0001 unbound symbol: y"
+                     "\\n 2 |   (+ x y))\\n   |        ^\"],\"warnings\":[]}") == 0);
+
+    r = omni_playground_check(p, "(define (f x) (+ x 1))");
+    ASSERT(strcmp(r, "{\"ok\":true,\"errors\":[],\"warnings\":[]}") == 0);
+
+    r = omni_playground_check(p, "(f \"a");
+    ASSERT(starts_with(r, "{\"ok\":false,\"errors\":[\"main.omni:1:1: E0005 parse error: "));
+    omni_playground_free(p);
+}
+
+/* ========== Compile ========== */
+
+TEST(test_compile_gives_escaped_c) {
+    OmniPlayground* p = omni_playground_new();
+    const char* r = omni_playground_compile(p, "(display \"a\\tb\")");
+    ASSERT(starts_with(r, "{\"ok\":true,\"c\":\"/* Generated by OmniLisp Compiler */\\n"));
+    ASSERT(strstr(r, "int main(void) {\\n") != NULL);
+    ASSERT(strstr(r, "mk_string(\\\"a\\\\011b\\\")") != NULL);
+    ASSERT(strchr(r, '\n') == NULL && strchr(r, '\t') == NULL);
+    ASSERT(ends_with(r, "}\\n\",\"errors\":[],\"warnings\":[]}"));
+
+    r = omni_playground_compile(p, "(car)");
+    ASSERT(starts_with(r, "{\"ok\":false,\"c\":null,\"errors\":[\"main.omni:1:1: E0011 "));
+    omni_playground_free(p);
+}
+
+TEST(test_imports_come_from_put_files) {
+    OmniPlayground* p = omni_playground_new();
+    const char* src = "(import \"lib/util.omni\")\n(sq 3)";
+    const char* r = omni_playground_check(p, src);
+    ASSERT(strstr(r, "E0009") != NULL);
+
+    omni_playground_put_file(p, "lib/util.omni", "(define (sq n) (* n n))\n(provide sq)");
+    r = omni_playground_compile(p, src);
+    ASSERT(starts_with(r, "{\"ok\":true,"));
+    ASSERT(strstr(r, "o_sq") != NULL);
+
+    ASSERT(omni_playground_remove_file(p, "lib/util.omni"));
+    ASSERT(!omni_playground_remove_file(p, "lib/util.omni"));
+    r = omni_playground_check(p, src);
+    ASSERT(strstr(r, "E0009") != NULL);
+    omni_playground_free(p);
+}
+
+int main(void) {
+    printf("\n\033[33m=== Playground Tests ===\033[0m\n");
+
+    printf("\n\033[33m--- Check ---\033[0m\n");
+    RUN_TEST(test_check_reports_located_errors);
+
+    printf("\n\033[33m--- Compile ---\033[0m\n");
+    RUN_TEST(test_compile_gives_escaped_c);
+    RUN_TEST(test_imports_come_from_put_files);
+
+    printf("\n\033[33m=== Summary ===\033[0m\n");
+    printf("  Total:  %d\n", tests_run);
+    if (tests_passed == tests_run) {
+        printf("  \033[32mPassed: %d\033[0m\n", tests_passed);
+    } else {
+        printf("  \033[32mPassed: %d\033[0m\n", tests_passed);
+        printf("  \033[31mFailed: %d\033[0m\n", tests_run - tests_passed);
+    }
+    printf("  Failed: %d\n", tests_run - tests_passed);
+
+    return (tests_passed == tests_run) ? 0 : 1;
+}
@@ -21,6 +21,9 @@
 static int tests_run = 0;
 static int tests_passed = 0;
 
+/* Where the trees the tests build and parse live */
+static OmniSession* session;
+
 #define TEST(name) static void name(void)
 #define RUN_TEST(name) do { \
     printf("  %s: ", #name); \
@@ -40,17 +43,17 @@ static int tests_passed = 0;
 
 /* Helper to create a simple symbol */
 static OmniValue* mk_sym(const char* name) {
-    return omni_new_sym(name);
+    return omni_new_sym(session->arena, name);
 }
 
 /* Helper to create a simple integer */
 static OmniValue* mk_int(long val) {
-    return omni_new_int(val);
+    return omni_new_int(session->arena, val);
 }
 
 /* Helper to create a cons cell */
 static OmniValue* mk_cons(OmniValue* car, OmniValue* cdr) {
-    return omni_new_cell(car, cdr);
+    return omni_new_cell(session->arena, car, cdr);
 }
 
 /* Helper to create a list */
@@ -281,7 +284,7 @@ TEST(test_codegen_has_rc_elision_macros) {
     /* Test that generated code includes RC elision infrastructure */
     OmniValue* expr = mk_int(42);
 
-    CodeGenContext* cg = omni_codegen_new_buffer();
+    CodeGenContext* cg = omni_codegen_new_buffer(session);
     cg->analysis = omni_analysis_new();
 
     omni_codegen_program(cg, &expr, 1);
@@ -302,6 +305,7 @@ TEST(test_codegen_has_rc_elision_macros) {
 /* ========== Main ========== */
 
 int main(void) {
+    session = omni_session_new();
     printf("\n\033[33m=== Region-Aware RC Elision Tests ===\033[0m\n");
 
     printf("\n\033[33m--- RC Elision Class Names ---\033[0m\n");
@@ -333,5 +337,6 @@ int main(void) {
     }
     printf("  Failed: %d\n", tests_run - tests_passed);
 
+    omni_session_free(session);
     return (tests_passed == tests_run) ? 0 : 1;
 }
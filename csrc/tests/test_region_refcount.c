@@ -21,6 +21,9 @@
 static int tests_run = 0;
 static int tests_passed = 0;
 
+/* Where the trees the tests build and parse live */
+static OmniSession* session;
+
 #define TEST(name) static void name(void)
 #define RUN_TEST(name) do { \
     printf("  %s: ", #name); \
@@ -161,9 +164,9 @@ TEST(test_get_region_by_id) {
 
 TEST(test_codegen_has_region_refcount_macros) {
     /* Test that generated code includes region refcount infrastructure */
-    OmniValue* expr = omni_new_int(42);
+    OmniValue* expr = omni_new_int(session->arena, 42);
 
-    CodeGenContext* cg = omni_codegen_new_buffer();
+    CodeGenContext* cg = omni_codegen_new_buffer(session);
     cg->analysis = omni_analysis_new();
 
     omni_codegen_program(cg, &expr, 1);
@@ -190,6 +193,7 @@ TEST(test_codegen_has_region_refcount_macros) {
 /* ========== Main ========== */
 
 int main(void) {
+    session = omni_session_new();
     printf("\n\033[33m=== Per-Region External Refcount Tests ===\033[0m\n");
 
     printf("\n\033[33m--- External Refcount Management ---\033[0m\n");
@@ -213,5 +217,6 @@ int main(void) {
     }
     printf("  Failed: %d\n", tests_run - tests_passed);
 
+    omni_session_free(session);
     return (tests_passed == tests_run) ? 0 : 1;
 }
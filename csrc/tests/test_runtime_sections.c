@@ -0,0 +1,437 @@
+/*
+ * Embedded Runtime Section Tests
+ *
+ * Compiles every embedded runtime section standalone (prelude + section
+ * + a tiny driver exercising it) with -Wall -Werror -fsyntax-only, so
+ * runtime regressions such as bad format escapes or missing declarations
+ * are caught without running full programs. Behaviour that only shows at
+ * run time, such as channel rendezvous, is checked by building and running
+ * a small program against the emitted section.
+ */
+
+#define _POSIX_C_SOURCE 200809L
+#define _GNU_SOURCE
+
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <unistd.h>
+#include <assert.h>
+
+#include "../codegen/codegen.h"
+
+/* Test counters */
+static int tests_run = 0;
+static int tests_passed = 0;
+
+/* Where the trees the tests build and parse live */
+static OmniSession* session;
+
+#define TEST(name) static void name(void)
+#define RUN_TEST(name) do { \
+    printf("  %s: ", #name); \
+    name(); \
+    tests_run++; \
+    tests_passed++; \
+    printf("\033[32mPASS\033[0m\n"); \
+} while(0)
+
+#define ASSERT(cond) do { \
+    if (!(cond)) { \
+        printf("\033[31mFAIL\033[0m (line %d: %s)\n", __LINE__, #cond); \
+        tests_run++; \
+        return; \
+    } \
+} while(0)
+
+/* ========== Helpers ========== */
+
+/* Drivers exercising each section's public surface */
+static const char* g_drivers[OMNI_RT_COUNT] = {
+    [OMNI_RT_CORE] =
+        "Obj* c = mk_cell(mk_int(1), NIL);\n"
+        "free_obj(c);\n"
+        "free_unique(mk_float(1.5));\n"
+        "free_tree(mk_sym(\"x\"));\n"
+        "Obj* d = mk_int(2); inc_ref(d); dec_ref(d); free_obj(d);\n",
+    [OMNI_RT_STACK] =
+        "STACK_INT(x, 3);\n"
+        "STACK_CELL(y, x, NIL);\n"
+        "Obj z, *zp = &z;\n"
+        "init_int(zp, 4);\n"
+        "init_cell(zp, y, NIL);\n"
+        "return IS_STACK_OBJ(zp) ? 0 : 1;\n",
+    [OMNI_RT_WEAK] =
+        "struct { Obj* back; } holder, *h = &holder;\n"
+        "Obj* a = mk_int(1);\n"
+        "SET_WEAK(h, back, a);\n"
+        "weak_refs_nullify(a);\n"
+        "free_obj(a);\n"
+        "return GET_WEAK(h, back) == NULL ? 0 : 1;\n",
+    [OMNI_RT_REUSE] =
+        "Obj* a = mk_int(1);\n"
+        "a = REUSE_OR_NEW_INT(a, 2);\n"
+        "a = REUSE_OR_NEW_FLOAT(a, 2.5);\n"
+        "a = REUSE_OR_NEW_CELL(a, NIL, NIL);\n"
+        "free_obj(a);\n",
+    [OMNI_RT_RC_ELISION] =
+        "Obj* a = mk_int(1);\n"
+        "INC_REF_IF_NEEDED(a, 0);\n"
+        "DEC_REF_IF_NEEDED(a, 0);\n"
+        "RC_ELIDED();\n"
+        "free_obj(REGION_LOCAL_REF(a));\n",
+    [OMNI_RT_REGION] =
+        "Region* r = region_new(1);\n"
+        "REGION_INC_EXTERNAL(r);\n"
+        "REGION_DEC_EXTERNAL(r);\n"
+        "int ok = REGION_CAN_BULK_FREE(r);\n"
+        "region_end(r);\n"
+        "return ok ? 0 : 1;\n",
+    [OMNI_RT_TETHER] =
+        "Obj* a = mk_int(1);\n"
+        "BORROW_FOR_LOOP(a);\n"
+        "END_LOOP_BORROW(a);\n"
+        "SCOPED_TETHER_DECL(t, a);\n"
+        "SCOPED_TETHER_END(t);\n"
+        "free_obj(a);\n",
+    [OMNI_RT_OWNERSHIP] =
+        "Obj* a = mk_int(1);\n"
+        "ASSERT_OWNED(a);\n"
+        "Obj* b = CALL_BORROWED(a, PARAM_BORROWED(a));\n"
+        "free_obj(RETURN_FRESH(b));\n",
+    [OMNI_RT_CONCURRENCY] =
+        "Channel* c = channel_new(2);\n"
+        "SEND_OWNERSHIP(c, mk_int(1));\n"
+        "Obj* v;\n"
+        "RECV_OWNERSHIP(c, v);\n"
+        "INC_REF_FOR_THREAD(v, 1);\n"
+        "DEC_REF_FOR_THREAD(v, 0);\n"
+        "free_obj(v);\n"
+        "channel_close(c);\n"
+        "channel_free(c);\n",
+    [OMNI_RT_PRINT] =
+        "Obj* c = mk_cell(mk_int(1), NIL);\n"
+        "omni_print(c);\n"
+        "omni_write(mk_char('a'));\n"
+        "free_obj(c);\n",
+    [OMNI_RT_PRIMITIVES] =
+        "Obj* a = mk_int(6);\n"
+        "Obj* b = mk_int(7);\n"
+        "Obj* p = prim_mul(a, b);\n"
+        "Obj* l = prim_cons(p, NIL);\n"
+        "int t = is_truthy(prim_car(l)) && is_truthy(prim_null(prim_cdr(l)));\n"
+        "return t ? 0 : 1;\n",
+    [OMNI_RT_ERROR] =
+        "Obj* e = prim_error(mk_sym(\"oops\"), mk_int(42));\n"
+        "Obj* m = prim_error_message(e);\n"
+        "Obj* d = prim_error_data(e);\n"
+        "int ok = is_error(e) && prim_is_error(e)->i && d->i == 42;\n"
+        "free_obj(d); free_obj(m); free_obj(e);\n"
+        "free_obj(mk_error(error_message(NIL)));\n"
+        "return ok ? 0 : 1;\n",
+    [OMNI_RT_LISTS] =
+        "Obj* xs = mk_cell(mk_int(1), mk_cell(mk_int(2), NIL));\n"
+        "Obj* ys = list_append(xs, xs);\n"
+        "Obj* rs = list_reverse(ys);\n"
+        "Obj* n = list_length(rs);\n"
+        "Obj* args[2] = { n, n };\n"
+        "Obj* e = call_closure(mk_code(NULL, 1, NULL), args, 2);\n"
+        "free_obj(list_for_each(mk_code(NULL, 1, NULL), NIL));\n"
+        "int ok = n->i == 4 && e->tag == T_ERROR;\n"
+        "free_obj(e); free_obj(n); free_obj(rs); free_obj(ys); free_obj(xs);\n"
+        "return ok ? 0 : 1;\n",
+    [OMNI_RT_STRINGS] =
+        "Obj* s = prim_string_append(mk_string(\"ab\"), mk_string(\"cd\"));\n"
+        "Obj* n = prim_string_length(s);\n"
+        "Obj* c = prim_string_ref(s, n);\n"
+        "Obj* t = prim_substring(s, mk_int(1), mk_int(3));\n"
+        "int ok = n->i == 4 && c->tag == T_ERROR && prim_is_string(t)->i;\n"
+        "free_obj(t); free_obj(c); free_obj(n); free_obj(s);\n"
+        "return ok ? 0 : 1;\n",
+    [OMNI_RT_VECTORS] =
+        "Obj* x = mk_cell(mk_int(1), NIL);\n"
+        "Obj* v = prim_make_vector(mk_int(2), x);\n"
+        "prim_vector_set(v, mk_int(1), mk_int(7));\n"
+        "Obj* r = prim_vector_ref(v, mk_int(1));\n"
+        "Obj* e = prim_vector_ref(v, mk_int(2));\n"
+        "int ok = r->i == 7 && e->tag == T_ERROR && x->rc == 2;\n"
+        "free_obj(e); free_obj(r); free_obj(v);\n"
+        "ok = ok && x->rc == 1;\n"
+        "free_obj(x);\n"
+        "return ok ? 0 : 1;\n",
+    [OMNI_RT_HASHES] =
+        "Obj* h = prim_make_hash();\n"
+        "Obj* k = mk_string(\"k\");\n"
+        "Obj* x = mk_cell(mk_int(1), NIL);\n"
+        "prim_hash_set(h, k, x);\n"
+        "Obj* probe = mk_string(\"k\");\n"
+        "Obj* r = prim_hash_get(h, probe);\n"
+        "int ok = r == x && k->rc == 2 && x->rc == 3;\n"
+        "free_obj(r);\n"
+        "Obj* keys = prim_hash_keys(h);\n"
+        "ok = ok && car(keys) == k && k->rc == 3;\n"
+        "free_obj(keys);\n"
+        "free_obj(h);\n"
+        "ok = ok && k->rc == 1 && x->rc == 1;\n"
+        "free_obj(probe); free_obj(x); free_obj(k);\n"
+        "return ok ? 0 : 1;\n",
+    [OMNI_RT_PERSISTENT] =
+        "Obj* x = mk_cell(mk_int(1), NIL);\n"
+        "Obj* k = mk_string(\"k\");\n"
+        "Obj* m = prim_make_pmap();\n"
+        "Obj* m2 = prim_assoc(m, k, x);\n"
+        "Obj* probe = mk_string(\"k\");\n"
+        "Obj* r = prim_get(m2, probe);\n"
+        "int ok = r == x && is_nil(prim_get(m, probe)) && x->rc == 3;\n"
+        "free_obj(r);\n"
+        "Obj* v = prim_make_pvec();\n"
+        "for (int i = 0; i < 40; i++) { Obj* n = prim_conj(v, x); free_obj(v); v = n; }\n"
+        "Obj* w = prim_freeze(prim_assoc(v, mk_int(33), NIL));\n"
+        "free_obj(w);\n"
+        "Obj* e = prim_conj(m, x);\n"
+        "ok = ok && is_nil(prim_get(w, mk_int(33))) && e->tag == T_ERROR;\n"
+        "free_obj(e); free_obj(w); free_obj(v); free_obj(m2); free_obj(m);\n"
+        "ok = ok && x->rc == 1;\n"
+        "free_obj(probe); free_obj(k); free_obj(x);\n"
+        "return ok ? 0 : 1;\n",
+    [OMNI_RT_USER_TYPES] =
+        "static const char* const names[] = {\"head\", \"back\"};\n"
+        "static const UserType node = { \"Node\", 2, names, 0x2 };\n"
+        "Obj* x = mk_cell(mk_int(1), NIL);\n"
+        "Obj* n = mk_user(&node, (Obj*[]){x, x});\n"
+        "Obj* r = user_ref(&node, 0, n);\n"
+        "Obj* e = user_ref(&node, 0, x);\n"
+        "int ok = r == x && x->rc == 3 && e->tag == T_ERROR && user_is(&node, n)->i;\n"
+        "user_set(&node, 0, n, NIL);\n"
+        "ok = ok && x->rc == 2;\n"
+        "free_obj(r); free_obj(e); free_obj(n);\n"
+        "ok = ok && x->rc == 1;\n"
+        "free_obj(x);\n"
+        "return ok ? 0 : 1;\n",
+    [OMNI_RT_PORTS] =
+        "Obj* p = prim_open_output_string();\n"
+        "Obj* outer;\n"
+        "int ok = omni_output_enter(p, &outer) && !outer;\n"
+        "omni_print(mk_int(42));\n"
+        "omni_write_to(NIL, mk_string(\"a\"));\n"
+        "omni_output_leave(outer);\n"
+        "Obj* s = prim_get_output_string(p);\n"
+        "ok = ok && strcmp(s->s, \"42\\\"a\\\"\") == 0;\n"
+        "prim_close_port(p);\n"
+        "Obj* e = omni_newline_to(p);\n"
+        "ok = ok && e->tag == T_ERROR && !omni_output_enter(p, &outer);\n"
+        "free_obj(e); free_obj(s); free_obj(p);\n"
+        "return ok ? 0 : 1;\n",
+};
+
+/* Emit the given sections, file-scope helpers and a driver into a C file.
+ * Syntax-check it, or build and run it when run is set. */
+static int emit_sections(unsigned mask, const char* helpers, const char* driver, int run) {
+    CodeGenContext* ctx = omni_codegen_new_buffer(session);
+    omni_codegen_runtime_sections(ctx, mask);
+    char* code = omni_codegen_get_output(ctx);
+
+    char path[] = "/tmp/omni_rt_section_XXXXXX.c";
+    int fd = mkstemps(path, 2);
+    if (fd < 0) {
+        free(code);
+        omni_codegen_free(ctx);
+        return -1;
+    }
+    FILE* f = fdopen(fd, "w");
+    fprintf(f, "%s\n%s\nint main(void) {\n%s\nreturn 0;\n}\n",
+            code, helpers ? helpers : "", driver ? driver : "");
+    fclose(f);
+
+    char bin[sizeof(path)];
+    memcpy(bin, path, sizeof(path));
+    bin[strlen(bin) - 2] = '\0';
+
+    char cmd[512];
+    if (run) {
+        snprintf(cmd, sizeof(cmd),
+                 "cc -std=c99 -Wall -Werror -Wno-unused-function -o %s %s -lpthread -lm && %s",
+                 bin, path, bin);
+    } else {
+        snprintf(cmd, sizeof(cmd), "cc -std=c99 -Wall -Werror -fsyntax-only %s", path);
+    }
+    int status = system(cmd);
+
+    unlink(path);
+    if (run) unlink(bin);
+    free(code);
+    omni_codegen_free(ctx);
+    return status;
+}
+
+static int check_sections(unsigned mask, const char* driver) {
+    return emit_sections(mask, NULL, driver, 0);
+}
+
+/* Ping-pong over two unbuffered channels. Before each receive the ponger
+ * checks that the pinger has not completed more sends than it has
+ * received, which a rendezvous rules out. */
+static const char* g_ping_pong_helpers =
+    "#define ROUNDS 200\n"
+    "static Channel* ping;\n"
+    "static Channel* pong;\n"
+    "static int pings_sent;\n"
+    "static int ran_ahead;\n"
+    "static long events[2 * ROUNDS];\n"
+    "static int event_count;\n"
+    "static pthread_mutex_t event_lock = PTHREAD_MUTEX_INITIALIZER;\n"
+    "static void record(long e) {\n"
+    "    pthread_mutex_lock(&event_lock);\n"
+    "    events[event_count++] = e;\n"
+    "    pthread_mutex_unlock(&event_lock);\n"
+    "}\n"
+    "static void* ponger(void* arg) {\n"
+    "    (void)arg;\n"
+    "    for (int i = 0; i < ROUNDS; i++) {\n"
+    "        if (__atomic_load_n(&pings_sent, __ATOMIC_SEQ_CST) > i) ran_ahead = 1;\n"
+    "        Obj* v = channel_recv(ping);\n"
+    "        record(v->i);\n"
+    "        channel_send(pong, v);\n"
+    "    }\n"
+    "    return NULL;\n"
+    "}\n";
+
+static const char* g_ping_pong_driver =
+    "ping = channel_new(0);\n"
+    "pong = channel_new(0);\n"
+    "pthread_t th;\n"
+    "pthread_create(&th, NULL, ponger, NULL);\n"
+    "for (int i = 0; i < ROUNDS; i++) {\n"
+    "    channel_send(ping, mk_int(i));\n"
+    "    __atomic_add_fetch(&pings_sent, 1, __ATOMIC_SEQ_CST);\n"
+    "    Obj* r = channel_recv(pong);\n"
+    "    if (r->i != i) return 1;\n"
+    "    free_obj(r);\n"
+    "    record(-(long)i - 1);\n"
+    "}\n"
+    "pthread_join(th, NULL);\n"
+    "if (ran_ahead || event_count != 2 * ROUNDS) return 2;\n"
+    "for (int i = 0; i < ROUNDS; i++) {\n"
+    "    if (events[2 * i] != i || events[2 * i + 1] != -i - 1) return 3;\n"
+    "}\n"
+    "channel_free(ping);\n"
+    "channel_free(pong);\n";
+
+/* A send still waiting when the channel closes fails and keeps its value */
+static const char* g_close_helpers =
+    "static Channel* ch;\n"
+    "static Obj* val;\n"
+    "static int result = -1;\n"
+    "static void* sender(void* arg) {\n"
+    "    (void)arg;\n"
+    "    result = channel_send(ch, val);\n"
+    "    return NULL;\n"
+    "}\n";
+
+static const char* g_close_driver =
+    "ch = channel_new(0);\n"
+    "val = mk_int(42);\n"
+    "pthread_t th;\n"
+    "pthread_create(&th, NULL, sender, NULL);\n"
+    "struct timespec ts = { 0, 10 * 1000000L };\n"
+    "nanosleep(&ts, NULL);\n"
+    "channel_close(ch);\n"
+    "pthread_join(th, NULL);\n"
+    "if (result != 0 || val->i != 42) return 1;\n"
+    "if (channel_recv(ch) != NIL) return 2;\n"
+    "free_obj(val);\n"
+    "channel_free(ch);\n";
+
+/* ========== Section Structure ========== */
+
+TEST(test_closure_always_has_core) {
+    ASSERT(omni_runtime_section_closure(0) == OMNI_RT_BIT(OMNI_RT_CORE));
+    unsigned m = omni_runtime_section_closure(OMNI_RT_BIT(OMNI_RT_REUSE));
+    ASSERT(m & OMNI_RT_BIT(OMNI_RT_CORE));
+    ASSERT(m & OMNI_RT_BIT(OMNI_RT_REUSE));
+    ASSERT(omni_runtime_section_closure(OMNI_RT_ALL) == OMNI_RT_ALL);
+}
+
+TEST(test_section_names) {
+    for (int i = 0; i < OMNI_RT_COUNT; i++) {
+        const char* name = omni_runtime_section_name((OmniRuntimeSection)i);
+        ASSERT(name != NULL);
+        ASSERT(strcmp(name, "unknown") != 0);
+    }
+    ASSERT(strcmp(omni_runtime_section_name(OMNI_RT_COUNT), "unknown") == 0);
+}
+
+TEST(test_prelude_precedes_sections) {
+    CodeGenContext* ctx = omni_codegen_new_buffer(session);
+    omni_codegen_runtime_sections(ctx, OMNI_RT_BIT(OMNI_RT_CONCURRENCY));
+    char* code = omni_codegen_get_output(ctx);
+
+    char* inc = strstr(code, "#include <pthread.h>");
+    char* tag = strstr(code, "} Tag;");
+    char* chan = strstr(code, "typedef struct Channel");
+    ASSERT(inc && tag && chan);
+    ASSERT(inc < tag && tag < chan);
+    ASSERT(strstr(code, "reuse_as_int") == NULL);
+
+    free(code);
+    omni_codegen_free(ctx);
+}
+
+/* ========== Standalone Compilation ========== */
+
+TEST(test_each_section_compiles_standalone) {
+    for (int i = 0; i < OMNI_RT_COUNT; i++) {
+        int status = check_sections(OMNI_RT_BIT(i), g_drivers[i]);
+        if (status != 0) {
+            printf("(section %s) ", omni_runtime_section_name((OmniRuntimeSection)i));
+        }
+        ASSERT(status == 0);
+    }
+}
+
+TEST(test_all_sections_compile_together) {
+    ASSERT(check_sections(OMNI_RT_ALL, g_drivers[OMNI_RT_PRIMITIVES]) == 0);
+}
+
+/* ========== Channel Semantics ========== */
+
+TEST(test_unbuffered_ping_pong_alternates) {
+    ASSERT(emit_sections(OMNI_RT_BIT(OMNI_RT_CONCURRENCY),
+                         g_ping_pong_helpers, g_ping_pong_driver, 1) == 0);
+}
+
+TEST(test_unbuffered_send_fails_on_close) {
+    ASSERT(emit_sections(OMNI_RT_BIT(OMNI_RT_CONCURRENCY),
+                         g_close_helpers, g_close_driver, 1) == 0);
+}
+
+int main(void) {
+    session = omni_session_new();
+    printf("\n\033[33m=== Embedded Runtime Section Tests ===\033[0m\n");
+
+    printf("\n\033[33m--- Section Structure ---\033[0m\n");
+    RUN_TEST(test_closure_always_has_core);
+    RUN_TEST(test_section_names);
+    RUN_TEST(test_prelude_precedes_sections);
+
+    printf("\n\033[33m--- Standalone Compilation ---\033[0m\n");
+    RUN_TEST(test_each_section_compiles_standalone);
+    RUN_TEST(test_all_sections_compile_together);
+
+    printf("\n\033[33m--- Channel Semantics ---\033[0m\n");
+    RUN_TEST(test_unbuffered_ping_pong_alternates);
+    RUN_TEST(test_unbuffered_send_fails_on_close);
+
+    printf("\n\033[33m=== Summary ===\033[0m\n");
+    printf("  Total:  %d\n", tests_run);
+    if (tests_passed == tests_run) {
+        printf("  \033[32mPassed: %d\033[0m\n", tests_passed);
+    } else {
+        printf("  \033[32mPassed: %d\033[0m\n", tests_passed);
+        printf("  \033[31mFailed: %d\033[0m\n", tests_run - tests_passed);
+    }
+    printf("  Failed: %d\n", tests_run - tests_passed);
+
+    omni_session_free(session);
+    return (tests_passed == tests_run) ? 0 : 1;
+}
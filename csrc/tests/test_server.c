@@ -0,0 +1,340 @@
+/*
+ * Server Tests
+ *
+ * Tests for the --server protocol: frame headers the server must refuse,
+ * describe, interrupting an eval that is running, and a round trip over
+ * TCP as --port serves it. The server runs in a child process, fed
+ * through a pipe or a socket, and the tests read back its frames.
+ */
+
+#define _POSIX_C_SOURCE 200809L
+#define _GNU_SOURCE
+
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <assert.h>
+
+/* The server's static functions are what is under test */
+#include "../cli/server.c"
+#include "../cli/snapshot.c"
+
+/* Test counters */
+static int tests_run = 0;
+static int tests_passed = 0;
+
+#define TEST(name) static void name(void)
+#define RUN_TEST(name) do { \
+    printf("  %s: ", #name); \
+    name(); \
+    tests_run++; \
+    tests_passed++; \
+    printf("\033[32mPASS\033[0m\n"); \
+} while(0)
+
+#define ASSERT(cond) do { \
+    if (!(cond)) { \
+        printf("\033[31mFAIL\033[0m (line %d: %s)\n", __LINE__, #cond); \
+        tests_run++; \
+        return; \
+    } \
+} while(0)
+
+/* ========== Helpers ========== */
+
+static Compiler* new_compiler(void) {
+    CompilerOptions opts = { .use_embedded_runtime = true };
+    return omni_compiler_new_with_options(&opts);
+}
+
+/* Write all of text to fd */
+static void write_all(int fd, const char* text, size_t len) {
+    while (len > 0) {
+        ssize_t n = write(fd, text, len);
+        if (n < 0 && errno == EINTR) continue;
+        if (n <= 0) return;
+        text += n;
+        len -= (size_t)n;
+    }
+}
+
+/* Send json as one frame */
+static void send_frame(int fd, const char* json) {
+    char header[32];
+    int n = snprintf(header, sizeof(header), "%zu\n", strlen(json));
+    write_all(fd, header, (size_t)n);
+    write_all(fd, json, strlen(json));
+}
+
+/* Read fd to EOF into out, as one string */
+static void read_all(int fd, char* out, size_t cap) {
+    size_t len = 0;
+    for (;;) {
+        ssize_t n = read(fd, out + len, cap - 1 - len);
+        if (n < 0 && errno == EINTR) continue;
+        if (n <= 0 || len + (size_t)n >= cap - 1) {
+            if (n > 0) len += (size_t)n;
+            break;
+        }
+        len += (size_t)n;
+    }
+    out[len] = '\0';
+}
+
+/* Read from fd into out until it holds needle, giving up after ten
+ * seconds without input; false if it never does */
+static bool read_until(int fd, char* out, size_t cap, const char* needle) {
+    size_t len = strlen(out);
+    while (!strstr(out, needle) && len < cap - 1) {
+        struct pollfd pfd = { fd, POLLIN, 0 };
+        if (poll(&pfd, 1, 10000) <= 0) return false;
+        ssize_t n = read(fd, out + len, cap - 1 - len);
+        if (n < 0 && errno == EINTR) continue;
+        if (n <= 0) return false;
+        len += (size_t)n;
+        out[len] = '\0';
+    }
+    return strstr(out, needle) != NULL;
+}
+
+/* Serve stdio-style in a child and feed it input, then after, pause_ms
+ * later. The input stays open until the server has sent until, when that
+ * is not NULL, and every frame it sends is read back into out. */
+static bool serve_input(const char* input, size_t len, int pause_ms, const char* after,
+                        const char* until, char* out, size_t cap) {
+    int to_server[2], from_server[2];
+    if (pipe(to_server) < 0 || pipe(from_server) < 0) return false;
+    pid_t pid = fork();
+    if (pid == 0) {
+        close(to_server[1]);
+        close(from_server[0]);
+        Compiler* compiler = new_compiler();
+        signal(SIGPIPE, SIG_IGN);
+        serve(compiler, to_server[0], from_server[1]);
+        omni_compiler_free(compiler);
+        _exit(0);
+    }
+    close(to_server[0]);
+    close(from_server[1]);
+    write_all(to_server[1], input, len);
+    if (pause_ms) usleep((useconds_t)pause_ms * 1000);
+    if (after) write_all(to_server[1], after, strlen(after));
+    out[0] = '\0';
+    bool seen = !until || read_until(from_server[0], out, cap, until);
+    close(to_server[1]);
+    if (seen) {
+        size_t got = strlen(out);
+        read_all(from_server[0], out + got, cap - got);
+    } else {
+        kill(pid, SIGKILL);
+    }
+    close(from_server[0]);
+    int status = 0;
+    waitpid(pid, &status, 0);
+    return seen && WIFEXITED(status) && WEXITSTATUS(status) == 0;
+}
+
+/* The frame for json, as send_frame writes it */
+static void frame_text(char* buf, size_t cap, const char* json) {
+    snprintf(buf, cap, "%zu\n%s", strlen(json), json);
+}
+
+/* ========== Frame Headers ========== */
+
+TEST(test_malformed_header_is_refused) {
+    char out[1024];
+    const char* input = "12x\n{\"op\":\"describe\"}";
+    ASSERT(serve_input(input, strlen(input), 0, NULL, NULL, out, sizeof(out)));
+    char expect[128];
+    frame_text(expect, sizeof(expect), "{\"id\":null,\"status\":\"error\",\"message\":\"malformed frame header\"}");
+    ASSERT(strcmp(out, expect) == 0);
+
+    /* A header that is not a number, and one that never ends */
+    input = " \n{}";
+    ASSERT(serve_input(input, strlen(input), 0, NULL, NULL, out, sizeof(out)));
+    ASSERT(strstr(out, "\"message\":\"malformed frame header\"") != NULL);
+    input = "123456789012345678901234567890123456789";
+    ASSERT(serve_input(input, strlen(input), 0, NULL, NULL, out, sizeof(out)));
+    ASSERT(strstr(out, "\"message\":\"malformed frame header\"") != NULL);
+}
+
+TEST(test_oversized_header_is_refused) {
+    char out[1024];
+    char input[64];
+    snprintf(input, sizeof(input), "%d\n{}", MAX_FRAME_SIZE + 1);
+    ASSERT(serve_input(input, strlen(input), 0, NULL, NULL, out, sizeof(out)));
+    ASSERT(strstr(out, "\"message\":\"malformed frame header\"") != NULL);
+
+    /* Digits enough to overflow a size_t are refused, not wrapped */
+    const char* huge = "99999999999999999999999999\n{}";
+    ASSERT(serve_input(huge, strlen(huge), 0, NULL, NULL, out, sizeof(out)));
+    ASSERT(strstr(out, "\"message\":\"malformed frame header\"") != NULL);
+}
+
+TEST(test_requests_after_a_bad_header_are_not_served) {
+    char out[1024];
+    char input[256];
+    char describe[128];
+    frame_text(describe, sizeof(describe), "{\"op\":\"describe\",\"id\":1}");
+    snprintf(input, sizeof(input), "%s-1\n%s", describe, describe);
+    ASSERT(serve_input(input, strlen(input), 0, NULL, NULL, out, sizeof(out)));
+    const char* first = strstr(out, "\"version\"");
+    ASSERT(first != NULL);
+    ASSERT(strstr(first + 1, "\"version\"") == NULL);
+    ASSERT(strstr(out, "malformed frame header") != NULL);
+}
+
+/* ========== Requests ========== */
+
+TEST(test_describe_reply) {
+    char out[1024];
+    char input[128];
+    frame_text(input, sizeof(input), "{\"op\":\"describe\",\"id\":\"d\"}");
+    ASSERT(serve_input(input, strlen(input), 0, NULL, NULL, out, sizeof(out)));
+
+    char expect[512];
+    snprintf(expect, sizeof(expect),
+             "{\"id\":\"d\",\"status\":\"ok\",\"version\":\"%s\","
+             "\"ops\":[\"eval\",\"interrupt\",\"describe\",\"close\"]}", omni_compiler_version());
+    char framed[600];
+    frame_text(framed, sizeof(framed), expect);
+    ASSERT(strcmp(out, framed) == 0);
+}
+
+TEST(test_interrupt_stops_a_running_eval) {
+    char out[2048];
+    char input[256];
+    frame_text(input, sizeof(input),
+               "{\"op\":\"eval\",\"id\":7,\"code\":\"(sleep-ms 60000)\"}");
+    char interrupt[128];
+    frame_text(interrupt, sizeof(interrupt), "{\"op\":\"interrupt\",\"id\":7}");
+
+    /* Sent while the program sleeps, and sent with the eval itself. The
+     * server's input stays open, as a client's would, until it replies. */
+    const char* stopped = "{\"id\":7,\"status\":\"interrupted\"";
+    ASSERT(serve_input(input, strlen(input), 1500, interrupt, stopped, out, sizeof(out)));
+    ASSERT(strstr(out, "{\"id\":7,\"status\":\"ok\",\"interrupted\":true}") != NULL);
+    ASSERT(strstr(out, "{\"id\":7,\"status\":\"interrupted\",\"value\":null") != NULL);
+
+    char both[512];
+    snprintf(both, sizeof(both), "%s%s", input, interrupt);
+    ASSERT(serve_input(both, strlen(both), 0, NULL, stopped, out, sizeof(out)));
+    ASSERT(strstr(out, "{\"id\":7,\"status\":\"ok\",\"interrupted\":true}") != NULL);
+}
+
+TEST(test_interrupt_of_another_id_does_not_stop_the_eval) {
+    char out[2048];
+    char input[512];
+    char eval[256], interrupt[128];
+    frame_text(eval, sizeof(eval), "{\"op\":\"eval\",\"id\":1,\"code\":\"(+ 1 2)\"}");
+    frame_text(interrupt, sizeof(interrupt), "{\"op\":\"interrupt\",\"id\":2}");
+    snprintf(input, sizeof(input), "%s%s", eval, interrupt);
+    ASSERT(serve_input(input, strlen(input), 0, NULL, NULL, out, sizeof(out)));
+    ASSERT(strstr(out, "{\"id\":2,\"status\":\"ok\",\"interrupted\":false}") != NULL);
+    ASSERT(strstr(out, "{\"id\":1,\"status\":\"ok\",\"value\":\"3\"") != NULL);
+}
+
+/* ========== TCP ========== */
+
+/* A port nothing listens on just now */
+static int free_port(void) {
+    int sock = socket(AF_INET, SOCK_STREAM, 0);
+    struct sockaddr_in addr;
+    memset(&addr, 0, sizeof(addr));
+    addr.sin_family = AF_INET;
+    addr.sin_addr.s_addr = htonl(INADDR_LOOPBACK);
+    socklen_t len = sizeof(addr);
+    int port = -1;
+    if (sock >= 0 && bind(sock, (struct sockaddr*)&addr, sizeof(addr)) == 0 &&
+        getsockname(sock, (struct sockaddr*)&addr, &len) == 0) {
+        port = ntohs(addr.sin_port);
+    }
+    if (sock >= 0) close(sock);
+    return port;
+}
+
+/* A connection to the server on port, retried while it starts */
+static int connect_to(int port) {
+    for (int tries = 0; tries < 100; tries++) {
+        int sock = socket(AF_INET, SOCK_STREAM, 0);
+        struct sockaddr_in addr;
+        memset(&addr, 0, sizeof(addr));
+        addr.sin_family = AF_INET;
+        addr.sin_addr.s_addr = htonl(INADDR_LOOPBACK);
+        addr.sin_port = htons((unsigned short)port);
+        if (connect(sock, (struct sockaddr*)&addr, sizeof(addr)) == 0) return sock;
+        close(sock);
+        usleep(50 * 1000);
+    }
+    return -1;
+}
+
+TEST(test_tcp_round_trip) {
+    int port = free_port();
+    ASSERT(port > 0);
+    pid_t pid = fork();
+    if (pid == 0) {
+        int devnull = open("/dev/null", O_WRONLY);
+        if (devnull >= 0) dup2(devnull, STDERR_FILENO);
+        Compiler* compiler = new_compiler();
+        _exit(omni_server_run_tcp(compiler, port));
+    }
+
+    char out[2048];
+    int sock = connect_to(port);
+    if (sock >= 0) {
+        send_frame(sock, "{\"op\":\"eval\",\"id\":1,\"code\":\"(define x 20)\"}");
+        send_frame(sock, "{\"op\":\"eval\",\"id\":2,\"code\":\"(display 'hi) (+ x 22)\"}");
+        send_frame(sock, "{\"op\":\"close\",\"id\":3}");
+        read_all(sock, out, sizeof(out));
+        close(sock);
+    }
+
+    /* One client at a time: a second one is served after the first */
+    int again = sock >= 0 ? connect_to(port) : -1;
+    char second[512] = "";
+    if (again >= 0) {
+        send_frame(again, "{\"op\":\"describe\",\"id\":4}");
+        send_frame(again, "{\"op\":\"close\"}");
+        read_all(again, second, sizeof(second));
+        close(again);
+    }
+    kill(pid, SIGKILL);
+    waitpid(pid, NULL, 0);
+
+    ASSERT(sock >= 0);
+    ASSERT(strstr(out, "{\"id\":1,\"status\":\"ok\",\"value\":null") != NULL);
+    ASSERT(strstr(out, "{\"id\":2,\"status\":\"ok\",\"value\":\"42\",\"out\":\"hi\",\"exit\":0") != NULL);
+    ASSERT(strstr(out, "\n{\"id\":3,\"status\":\"ok\"}") != NULL);
+    ASSERT(again >= 0);
+    ASSERT(strstr(second, "{\"id\":4,\"status\":\"ok\",\"version\"") != NULL);
+}
+
+int main(void) {
+    printf("\n\033[33m=== Server Tests ===\033[0m\n");
+
+    printf("\n\033[33m--- Frame Headers ---\033[0m\n");
+    RUN_TEST(test_malformed_header_is_refused);
+    RUN_TEST(test_oversized_header_is_refused);
+    RUN_TEST(test_requests_after_a_bad_header_are_not_served);
+
+    printf("\n\033[33m--- Requests ---\033[0m\n");
+    RUN_TEST(test_describe_reply);
+    RUN_TEST(test_interrupt_stops_a_running_eval);
+    RUN_TEST(test_interrupt_of_another_id_does_not_stop_the_eval);
+
+    printf("\n\033[33m--- TCP ---\033[0m\n");
+    RUN_TEST(test_tcp_round_trip);
+
+    printf("\n\033[33m=== Summary ===\033[0m\n");
+    printf("  Total:  %d\n", tests_run);
+    if (tests_passed == tests_run) {
+        printf("  \033[32mPassed: %d\033[0m\n", tests_passed);
+    } else {
+        printf("  \033[32mPassed: %d\033[0m\n", tests_passed);
+        printf("  \033[31mFailed: %d\033[0m\n", tests_run - tests_passed);
+    }
+    printf("  Failed: %d\n", tests_run - tests_passed);
+
+    return (tests_passed == tests_run) ? 0 : 1;
+}
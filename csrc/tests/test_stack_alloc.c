@@ -20,6 +20,9 @@
 static int tests_run = 0;
 static int tests_passed = 0;
 
+/* Where the trees the tests build and parse live */
+static OmniSession* session;
+
 #define TEST(name) static void name(void)
 #define RUN_TEST(name) do { \
     printf("  %s: ", #name); \
@@ -39,17 +42,17 @@ static int tests_passed = 0;
 
 /* Helper to create a simple symbol */
 static OmniValue* mk_sym(const char* name) {
-    return omni_new_sym(name);
+    return omni_new_sym(session->arena, name);
 }
 
 /* Helper to create a simple integer */
 static OmniValue* mk_int(long val) {
-    return omni_new_int(val);
+    return omni_new_int(session->arena, val);
 }
 
 /* Helper to create a cons cell */
 static OmniValue* mk_cons(OmniValue* car, OmniValue* cdr) {
-    return omni_new_cell(car, cdr);
+    return omni_new_cell(session->arena, car, cdr);
 }
 
 /* Helper to create a list */
@@ -225,7 +228,7 @@ TEST(test_codegen_has_stack_macros) {
     /* Test that generated code includes stack allocation macros */
     OmniValue* expr = mk_int(42);
 
-    CodeGenContext* cg = omni_codegen_new_buffer();
+    CodeGenContext* cg = omni_codegen_new_buffer(session);
     cg->analysis = omni_analysis_new();
     omni_analyze_ownership(cg->analysis, expr);
 
@@ -247,6 +250,7 @@ TEST(test_codegen_has_stack_macros) {
 /* ========== Main ========== */
 
 int main(void) {
+    session = omni_session_new();
     printf("\n\033[33m=== Escape-Aware Stack Allocation Tests ===\033[0m\n");
 
     printf("\n\033[33m--- Allocation Strategy Selection ---\033[0m\n");
@@ -270,5 +274,6 @@ int main(void) {
     }
     printf("  Failed: %d\n", tests_run - tests_passed);
 
+    omni_session_free(session);
     return (tests_passed == tests_run) ? 0 : 1;
 }
@@ -0,0 +1,237 @@
+/*
+ * Memory Strategy Matrix
+ *
+ * Compiles one corpus against libpurple under each memory strategy
+ * combination (--strategy) with AddressSanitizer and UBSan, and checks
+ * that every build prints what the default build prints and that the
+ * sanitizers report nothing. Leak checking is off: the strategies differ
+ * in what they leave allocated at exit, not in what a program may touch.
+ *
+ * The matrix is printed either way, one row per program:
+ *
+ *   ok    same output, clean run
+ *   DIFF  output differs from the default build
+ *   SAN   a sanitizer report or a non-zero exit
+ *   BUILD did not compile
+ *
+ * Skipped (passing) when ../runtime/libpurple.a is not built.
+ */
+
+#define _POSIX_C_SOURCE 200809L
+#define _GNU_SOURCE
+
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <unistd.h>
+
+#include "../compiler/compiler.h"
+
+/* Test counters */
+static int tests_run = 0;
+static int tests_passed = 0;
+
+#define TEST(name) static void name(void)
+#define RUN_TEST(name) do { \
+    printf("  %s: ", #name); \
+    name(); \
+    tests_run++; \
+    tests_passed++; \
+    printf("\033[32mPASS\033[0m\n"); \
+} while(0)
+
+#define ASSERT(cond) do { \
+    if (!(cond)) { \
+        printf("\033[31mFAIL\033[0m (line %d: %s)\n", __LINE__, #cond); \
+        tests_run++; \
+        return; \
+    } \
+} while(0)
+
+/* ========== Corpus ========== */
+
+static const struct {
+    const char* name;
+    const char* src;
+} g_corpus[] = {
+    { "arith", "(+ 1 2) (* 6 7) (- 10 3.5) (/ 9 3)" },
+    { "lists", "(cons 1 (cons 2 '())) (reverse '(1 2 3)) (append '(1 2) '(3 4)) '(a (b . c) d)" },
+    { "shared", "(let ((x '(1 2))) (cons x x)) (let ((y (cons 3 '()))) (cons y (cons y '())))" },
+    { "hof", "(define (sq x) (* x x)) (map sq '(1 2 3)) (filter (lambda (x) (> x 1)) '(1 2 3)) "
+             "(fold + 0 '(1 2 3 4))" },
+    { "recursion", "(define (build n) (if (= n 0) '() (cons n (build (- n 1))))) (build 200) "
+                   "(length (build 300)) (define (fact n) (if (= n 0) 1 (* n (fact (- n 1))))) (fact 10)" },
+    { "bindings", "(let ((a 1) (b 2)) (+ a b)) (let ((xs '(1 2 3))) (append xs (reverse xs))) (null? '())" },
+    { "errors", "(error 'boom) (cons (error 'inner) '(1))" },
+    { "floats", "(cons 1.5 2.25) (map (lambda (x) (* x 0.5)) '(1 2 3))" },
+    { "vectors", "(define v (make-vector 3 '(1))) (vector-set! v 1 (cons 2 '())) v (vector-ref v 0) "
+                 "[1 (+ 1 1) \"three\"] (let ((x '(1 2))) (vector x x))" },
+    { "hashes", "(define h (hash)) (hash-set! h 'a (cons 1 '())) (hash-set! h \"b\" [2]) "
+                "(hash-set! h 'a 3) (hash-remove! h \"b\") h (hash-keys h) (hash-get h 'a)" },
+    { "persistent", "(define m (assoc (assoc (pmap) 'a (cons 1 '())) \"b\" [2])) (dissoc m 'a) m (keys m) "
+                    "(define v (conj (conj (pvec) '(1)) \"x\")) (assoc v 0 'y) (get (freeze v) 1)" },
+    { "transients", "(define base (assoc (pmap) 'a (cons 1 '()))) (define t (transient base)) "
+                    "(assoc! t \"b\" [2]) (dissoc! t 'a) (define m (persistent! t)) m base (get t 'a) "
+                    "(persistent! (conj! (conj! (transient (pvec)) '(1)) \"x\"))" },
+    { "types", "(deftype Node (val int) (next Node) (parent Node)) (define a (mk-Node '(1) '() '())) "
+               "(define b (mk-Node 2 a a)) (set-Node-val! a (cons 3 '())) b (Node-val (Node-next b)) "
+               "(match b ((Node v (Node w _ _) _) (cons v w)) (_ 0))" },
+    { "ports", "(define p (open-output-string)) (with-output-to-port p (write '(1 \"a\")) (display 2 p)) "
+               "(get-output-string p) (let ((q (open-output-string))) (write (cons 1 '()) q) (get-output-string q)) "
+               "(close-port p) (display 3 p)" },
+};
+
+#define CORPUS_SIZE (sizeof(g_corpus) / sizeof(g_corpus[0]))
+
+/* asap alone, asap plus each other strategy, then all of them */
+static const unsigned g_combos[] = {
+    OMNI_STRATEGY_ASAP,
+    OMNI_STRATEGY_ASAP | OMNI_STRATEGY_PERCEUS,
+    OMNI_STRATEGY_ASAP | OMNI_STRATEGY_ARENA,
+    OMNI_STRATEGY_ASAP | OMNI_STRATEGY_DEFERRED,
+    OMNI_STRATEGY_ASAP | OMNI_STRATEGY_SYMMETRIC,
+    OMNI_STRATEGY_ASAP | OMNI_STRATEGY_SCC,
+    OMNI_STRATEGY_ALL,
+};
+
+#define COMBO_COUNT (sizeof(g_combos) / sizeof(g_combos[0]))
+
+/* ========== Helpers ========== */
+
+typedef enum { CELL_OK, CELL_DIFF, CELL_SAN, CELL_BUILD } CellResult;
+
+static const char* cell_name(CellResult r) {
+    switch (r) {
+    case CELL_OK:    return "ok";
+    case CELL_DIFF:  return "DIFF";
+    case CELL_SAN:   return "SAN";
+    case CELL_BUILD: return "BUILD";
+    }
+    return "?";
+}
+
+/* Build src with strategies (0 = default release), run it under the
+ * sanitizers and capture stdout. Returns CELL_BUILD, CELL_SAN or CELL_OK. */
+static CellResult run_with(const char* runtime, const char* src, unsigned strategies,
+                           char* out, size_t cap) {
+    CompilerOptions opts = {
+        .runtime_path = runtime,
+        .opt_level = 1,
+        .strategies = strategies,
+        .enable_asan = true,
+        .cflags = "-fsanitize=undefined -fno-sanitize-recover=undefined",
+    };
+    Compiler* c = omni_compiler_new_with_options(&opts);
+    char bin[] = "/tmp/omni_strategy_XXXXXX";
+    int fd = mkstemp(bin);
+    if (fd < 0) {
+        omni_compiler_free(c);
+        return CELL_BUILD;
+    }
+    close(fd);
+    bool ok = omni_compiler_compile_to_binary(c, src, bin);
+    omni_compiler_free(c);
+    if (!ok) {
+        unlink(bin);
+        return CELL_BUILD;
+    }
+
+    char err[sizeof(bin) + 4];
+    snprintf(err, sizeof(err), "%s.err", bin);
+    char cmd[256];
+    snprintf(cmd, sizeof(cmd), "ASAN_OPTIONS=detect_leaks=0 %s 2>%s", bin, err);
+    FILE* p = popen(cmd, "r");
+    size_t n = p ? fread(out, 1, cap - 1, p) : 0;
+    out[n] = '\0';
+    int status = p ? pclose(p) : -1;
+    unlink(bin);
+
+    /* Programs may print errors themselves; only sanitizer reports count */
+    bool report = false;
+    FILE* e = fopen(err, "r");
+    if (e) {
+        char line[512];
+        while (fgets(line, sizeof(line), e)) {
+            if (strstr(line, "AddressSanitizer") || strstr(line, "runtime error:")) report = true;
+        }
+        fclose(e);
+    }
+    unlink(err);
+    return (status != 0 || report) ? CELL_SAN : CELL_OK;
+}
+
+/* ========== Tests ========== */
+
+TEST(test_strategy_names) {
+    ASSERT(omni_strategy_parse("") == OMNI_STRATEGY_ASAP);
+    ASSERT(omni_strategy_parse("perceus,scc") ==
+           (OMNI_STRATEGY_ASAP | OMNI_STRATEGY_PERCEUS | OMNI_STRATEGY_SCC));
+    ASSERT(omni_strategy_parse("asap,arena,deferred,symmetric,perceus,scc") == OMNI_STRATEGY_ALL);
+    ASSERT(omni_strategy_parse("perceus,gc") == 0);
+    ASSERT(omni_strategy_parse("arenas") == 0);
+    ASSERT(strcmp(omni_strategy_name(OMNI_STRATEGY_SYMMETRIC), "symmetric") == 0);
+
+    char buf[64];
+    omni_strategy_format(OMNI_STRATEGY_ASAP | OMNI_STRATEGY_DEFERRED, buf, sizeof(buf));
+    ASSERT(strcmp(buf, "asap+deferred") == 0);
+}
+
+TEST(test_strategy_needs_libpurple) {
+    CompilerOptions opts = { .use_embedded_runtime = true, .strategies = OMNI_STRATEGY_ASAP };
+    Compiler* c = omni_compiler_new_with_options(&opts);
+    char* code = omni_compiler_compile_to_c(c, "(+ 1 2)");
+    ASSERT(code == NULL);
+    ASSERT(strstr(omni_compiler_get_error(c, 0), "--strategy needs the libpurple runtime") != NULL);
+    omni_compiler_free(c);
+}
+
+TEST(test_strategy_matrix) {
+    char* runtime = access("../runtime/libpurple.a", F_OK) == 0 ? realpath("../runtime", NULL) : NULL;
+    if (!runtime) {
+        printf("(no libpurple, skipped) ");
+        return;
+    }
+
+    printf("\n    %-10s", "");
+    for (size_t j = 0; j < COMBO_COUNT; j++) {
+        char name[64];
+        omni_strategy_format(g_combos[j], name, sizeof(name));
+        printf(" %s", j == COMBO_COUNT - 1 ? "all" : strchr(name, '+') ? strchr(name, '+') : name);
+    }
+    printf("\n");
+
+    int failures = 0;
+    for (size_t i = 0; i < CORPUS_SIZE; i++) {
+        char expected[4096];
+        CellResult base = run_with(runtime, g_corpus[i].src, 0, expected, sizeof(expected));
+        printf("    %-10s", g_corpus[i].name);
+        for (size_t j = 0; j < COMBO_COUNT; j++) {
+            char out[4096];
+            CellResult r = run_with(runtime, g_corpus[i].src, g_combos[j], out, sizeof(out));
+            if (r == CELL_OK && (base != CELL_OK || strcmp(out, expected) != 0)) r = CELL_DIFF;
+            if (r != CELL_OK) failures++;
+            char name[64];
+            omni_strategy_format(g_combos[j], name, sizeof(name));
+            int width = (int)strlen(j == COMBO_COUNT - 1 ? "all"
+                                    : strchr(name, '+') ? strchr(name, '+') : name);
+            printf(" %-*s", width, cell_name(r));
+        }
+        printf("\n");
+    }
+    printf("    ");
+    free(runtime);
+    ASSERT(failures == 0);
+}
+
+int main(void) {
+    printf("\n\033[33m=== Memory Strategy Tests ===\033[0m\n");
+    RUN_TEST(test_strategy_names);
+    RUN_TEST(test_strategy_needs_libpurple);
+    RUN_TEST(test_strategy_matrix);
+
+    printf("\n\033[33m=== Summary ===\033[0m\n");
+    printf("  Total:  %d\n", tests_run);
+    printf("  Passed: %d\n", tests_passed);
+    printf("  Failed: %d\n", tests_run - tests_passed);
+    return (tests_passed == tests_run) ? 0 : 1;
+}
@@ -16,6 +16,8 @@
 #include <string.h>
 #include <pthread.h>
 #include <stdbool.h>
+#include <setjmp.h>
+#include <time.h>
 
 #ifdef __cplusplus
 extern "C" {
@@ -66,7 +68,16 @@ typedef enum {
     TAG_CHANNEL,
     TAG_ERROR,
     TAG_ATOM,
-    TAG_THREAD
+    TAG_THREAD,
+    TAG_STRING,
+    TAG_VECTOR,
+    TAG_HASH,
+    TAG_CANCEL,
+    TAG_PORT,
+    TAG_PMAP,
+    TAG_PVEC,
+    TAG_POOL,
+    TAG_KEYWORD
 } ObjTag;
 
 #define TAG_USER_BASE 1000
@@ -394,8 +405,12 @@ Obj* mk_float(double f);
 Obj* mk_char(long c);
 Obj* mk_pair(Obj* a, Obj* b);
 Obj* mk_sym(const char* s);
+Obj* mk_string(const char* s);
+/* The interned keyword :s; never freed, so it need not be released */
+Obj* mk_keyword(const char* s);
 Obj* mk_box(Obj* v);
 Obj* mk_error(const char* msg);
+Obj* mk_error_obj(const char* msg, Obj* data);
 Obj* mk_closure(ClosureFn fn, Obj** captures, BorrowRef** refs, int count, int arity);
 
 /* Stack-allocated primitives (optimization for non-escaping values) */
@@ -412,17 +427,81 @@ void free_tree(Obj* x);
 void free_unique(Obj* x);
 void flush_freelist(void);
 
+/* Counted atomically: compiled programs use these for the variables
+ * their concurrency analysis finds shared between threads. Once any
+ * thread has started, inc_ref and dec_ref are atomic as well. */
+void atomic_inc_ref(Obj* x);
+void atomic_dec_ref(Obj* x);
+
+/* Call hook with each object as dec_ref or free_obj frees it (NULL = none);
+ * compiled programs use it for --constraint-check */
+void set_free_hook(void (*hook)(Obj* x));
+
 /* Check if object is nil */
 int is_nil(Obj* x);
 
 /* Check if object is stack-allocated */
 int is_stack_obj(Obj* x);
 
+/* ========== Memory Strategies ========== */
+
+/* How compiled programs release top-level values; combine with | */
+#define PURPLE_STRATEGY_ASAP      0x01  /* Free through dec_ref as soon as possible */
+#define PURPLE_STRATEGY_PERCEUS   0x02  /* Reuse freed cells for new ones */
+#define PURPLE_STRATEGY_ARENA     0x04  /* Allocate each form's cells in an arena */
+#define PURPLE_STRATEGY_DEFERRED  0x08  /* Queue releases, drain them in batches */
+#define PURPLE_STRATEGY_SYMMETRIC 0x10  /* Release through a symmetric-RC scope */
+#define PURPLE_STRATEGY_SCC       0x20  /* Freeze and release cycles as SCCs */
+
+void set_memory_strategies(unsigned mask);
+unsigned get_memory_strategies(void);
+
+/* Release the value of a top-level form by the strategies in effect */
+void strategy_release(Obj* x);
+
 /* ========== Deferred Reference Counting ========== */
 
 void defer_decrement(Obj* obj);
 void flush_deferred(void);
 
+/* ========== Crash Reports ========== */
+
+/*
+ * Programs built with -g call purple_install_crash_handler first thing in
+ * main. On SIGSEGV, SIGBUS, SIGFPE, SIGILL or SIGABRT it writes to stderr
+ * the crashing thread's compiled functions, innermost first, the last
+ * reference count changes with each object's tag and count before the
+ * change, and how many objects were made and released; then the signal
+ * takes its default action. Every compiled function calls purple_enter
+ * with its name on entry and returns through purple_leave. A frame that a
+ * nonlocal exit can reach saves purple_shadow_depth and restores it when
+ * it is unwound to.
+ */
+void purple_install_crash_handler(void);
+void purple_enter(const char* fn);
+Obj* purple_leave(Obj* result);
+int purple_shadow_depth(void);
+void purple_shadow_restore(int depth);
+
+/* ========== Runtime Configuration ========== */
+
+/*
+ * Knobs a compiled program reads from its environment when main starts,
+ * so that a deployed binary can be tuned without recompiling:
+ *   PURPLE_DEFERRED_BATCH   decrements drained per safe point (32)
+ *   PURPLE_FREELIST_BUDGET  freed objects held before the free list is
+ *                           flushed (0: only when flush_freelist is called)
+ *   PURPLE_HEAP_LIMIT       bytes, with an optional k, m or g suffix; only
+ *                           the embedded runtime enforces it
+ *   PURPLE_LOG_LEVEL        error, warn (the default), info or debug
+ *   PURPLE_SCHEDULER        threads (the default), or inline to run every
+ *                           task, goroutine and future where it is started
+ * A value that does not parse is reported at warn and ignored.
+ */
+void purple_load_config(void);
+/* (runtime-config 'key): the knob's value, or an error for an unknown key */
+Obj* prim_runtime_config(Obj* key);
+
 /* ========== Box Operations ========== */
 
 Obj* box_get(Obj* b);
@@ -432,14 +511,22 @@ void box_set(Obj* b, Obj* v);
 
 Obj* obj_car(Obj* p);
 Obj* obj_cdr(Obj* p);
+Obj* prim_car(Obj* p);
+Obj* prim_cdr(Obj* p);
+Obj* prim_cons(Obj* a, Obj* b);
 Obj* list_length(Obj* xs);
 Obj* list_map(Obj* fn, Obj* xs);
+Obj* list_for_each(Obj* fn, Obj* xs);
 Obj* list_fold(Obj* fn, Obj* init, Obj* xs);
 Obj* list_foldr(Obj* fn, Obj* init, Obj* xs);
 Obj* list_filter(Obj* fn, Obj* xs);
 Obj* list_append(Obj* a, Obj* b);
 Obj* list_reverse(Obj* xs);
 
+/* Checked mode: the list operations above return an error for a dotted
+ * tail (or a non-list argument) instead of stopping there */
+void set_checked_lists(int on);
+
 /* ========== Arithmetic Primitives ========== */
 
 Obj* prim_add(Obj* a, Obj* b);
@@ -448,24 +535,209 @@ Obj* prim_mul(Obj* a, Obj* b);
 Obj* prim_div(Obj* a, Obj* b);
 Obj* prim_mod(Obj* a, Obj* b);
 Obj* prim_abs(Obj* a);
+Obj* prim_min(Obj* a, Obj* b);
+Obj* prim_max(Obj* a, Obj* b);
+Obj* prim_expt(Obj* base, Obj* power);
+Obj* prim_gcd(Obj* a, Obj* b);
+Obj* prim_lcm(Obj* a, Obj* b);
+Obj* prim_sqrt(Obj* a);
 
 /* ========== Comparison Primitives ========== */
 
+/* Exact numeric ordering across ints and floats: -1, 0, 1, or 2 when a
+ * NaN makes the pair unordered */
+int num_compare(Obj* a, Obj* b);
+
 Obj* prim_lt(Obj* a, Obj* b);
 Obj* prim_gt(Obj* a, Obj* b);
 Obj* prim_le(Obj* a, Obj* b);
 Obj* prim_ge(Obj* a, Obj* b);
 Obj* prim_eq(Obj* a, Obj* b);
+Obj* prim_is_eq(Obj* a, Obj* b);
+Obj* prim_hash(Obj* x);
 Obj* prim_not(Obj* a);
 
+/*
+ * What the boolean primitives would box, as C truth values. A compiled
+ * test such as (if (< a b) ...) calls these and allocates nothing; the
+ * boxed primitive is only made when the result is used as a value.
+ */
+int test_lt(Obj* a, Obj* b);
+int test_gt(Obj* a, Obj* b);
+int test_le(Obj* a, Obj* b);
+int test_ge(Obj* a, Obj* b);
+int test_eq(Obj* a, Obj* b);
+int test_is_eq(Obj* a, Obj* b);
+int test_null(Obj* x);
+int test_is_error(Obj* x);
+int test_is_procedure(Obj* x);
+int test_is_string(Obj* x);
+int test_is_keyword(Obj* x);
+int test_is_vector(Obj* x);
+int test_is_hash(Obj* x);
+int test_is_port(Obj* x);
+
 /* ========== Type Predicates ========== */
 
 Obj* prim_null(Obj* x);
 Obj* prim_pair(Obj* x);
+Obj* prim_proper_list(Obj* x);
 Obj* prim_int(Obj* x);
 Obj* prim_float(Obj* x);
 Obj* prim_char(Obj* x);
 Obj* prim_sym(Obj* x);
+Obj* prim_is_keyword(Obj* x);
+
+/* ========== Error Objects ========== */
+
+/* Accessors return borrowed values; NULL if x is not an error */
+int is_error(Obj* x);
+const char* error_message(Obj* e);
+Obj* error_data(Obj* e);
+
+/*
+ * (error msg [data]), (error-message e), (error-data e), (error? x).
+ * (error-tag e) is the error's kind: the symbol it was made with, the
+ * kind of the error it was made from, or error. (error-trace e) lists the
+ * names of the compiled functions running when it was made, innermost
+ * first; only -g builds keep them, so it is () otherwise.
+ */
+Obj* prim_error(Obj* msg, Obj* data);
+Obj* prim_error_message(Obj* e);
+Obj* prim_error_data(Obj* e);
+Obj* prim_error_tag(Obj* e);
+Obj* prim_error_trace(Obj* e);
+Obj* prim_is_error(Obj* x);
+
+/* ========== Strings ========== */
+
+/* Heap strings own a NUL-terminated copy of their text and reference no
+ * other object. Wrong types and out-of-range indices return errors. */
+Obj* prim_is_string(Obj* x);
+Obj* prim_string_length(Obj* s);
+Obj* prim_string_append(Obj* a, Obj* b);
+Obj* prim_string_ref(Obj* s, Obj* i);
+Obj* prim_substring(Obj* s, Obj* start, Obj* end);
+
+/* ========== Vectors ========== */
+
+/* Fixed-length vectors with O(1) indexed access. Each slot holds its own
+ * reference, released when the slot is overwritten or the vector freed.
+ * Arguments are borrowed; vector-ref returns a new reference to the slot. */
+Obj* prim_vector_of(Obj** items, int n);
+Obj* prim_make_vector(Obj* n, Obj* init);
+Obj* prim_is_vector(Obj* x);
+Obj* prim_vector_length(Obj* v);
+Obj* prim_vector_ref(Obj* v, Obj* i);
+Obj* prim_vector_set(Obj* v, Obj* i, Obj* x);
+
+/* ========== Hash Tables ========== */
+
+/* Mutable tables keyed by eq? and hash. The table holds its own reference
+ * to each key and value and releases them when the entry is removed or the
+ * table freed. hash-get returns a new reference, or nil for a missing key;
+ * hash-keys returns a fresh list in insertion order. */
+Obj* prim_make_hash(void);
+Obj* prim_is_hash(Obj* x);
+Obj* prim_hash_count(Obj* h);
+Obj* prim_hash_get(Obj* h, Obj* key);
+Obj* prim_hash_set(Obj* h, Obj* key, Obj* value);
+Obj* prim_hash_remove(Obj* h, Obj* key);
+Obj* prim_hash_keys(Obj* h);
+
+/* ========== Persistent Collections ========== */
+
+/* Immutable maps (keyed by eq? and hash) and vectors. assoc, dissoc and
+ * conj return a new version sharing all but the changed path with the
+ * old one; assoc on a vector sets an index, or appends at its count. get
+ * returns a new reference, or nil when nothing is there; keys returns a
+ * fresh list in the map's order. freeze moves a version's nodes into a
+ * frozen group shared without atomic counts, as spawn, future and
+ * channel-send do before a version crosses threads. */
+Obj* prim_make_pmap(void);
+Obj* prim_make_pvec(void);
+Obj* prim_is_pmap(Obj* x);
+Obj* prim_is_pvec(Obj* x);
+Obj* prim_assoc(Obj* coll, Obj* key, Obj* value);
+Obj* prim_dissoc(Obj* m, Obj* key);
+Obj* prim_conj(Obj* v, Obj* x);
+Obj* prim_get(Obj* coll, Obj* key);
+Obj* prim_count(Obj* coll);
+Obj* prim_keys(Obj* m);
+Obj* prim_freeze(Obj* coll);
+
+/* A transient is a version assoc!, dissoc! and conj! change in place,
+ * where nothing else reaches the nodes, returning it with a new
+ * reference. The persistent forms reject it; persistent! returns a new
+ * version with its contents and ends it, and using it after that is an
+ * error. */
+Obj* prim_transient(Obj* coll);
+Obj* prim_persistent(Obj* t);
+Obj* prim_is_transient(Obj* x);
+Obj* prim_transient_assoc(Obj* t, Obj* key, Obj* value);
+Obj* prim_transient_dissoc(Obj* t, Obj* key);
+Obj* prim_transient_conj(Obj* t, Obj* x);
+
+/* ========== User Types ========== */
+
+/*
+ * A deftype is described by a static UserType the program defines; its
+ * objects have tag TAG_USER_BASE. Bit i of weak marks field i as a
+ * back-edge, neither counted nor released. Arguments are borrowed;
+ * user_ref returns a new reference to a strong field, and user_ref and
+ * user_set return an error for an object of another type. Types match by
+ * descriptor or by name.
+ *
+ * Each variant of a sum type is a type of its own whose descriptor names
+ * the sum; the sum's descriptor has no fields. user_in tests an object is
+ * one of the sum's variants, and user_tag returns the variant's name as
+ * a symbol (an error for anything else).
+ */
+typedef struct UserType {
+    const char* name;
+    int field_count;
+    const char* const* fields;      /* Field names, for printing and errors */
+    uint64_t weak;
+    const char* sum;                /* The sum type a variant belongs to, or NULL */
+    int tag;                        /* The variant's place among the sum's */
+} UserType;
+
+Obj* mk_user(const UserType* t, Obj** fields);
+Obj* user_is(const UserType* t, Obj* x);
+Obj* user_ref(const UserType* t, int i, Obj* x);
+Obj* user_set(const UserType* t, int i, Obj* x, Obj* v);
+Obj* user_in(const UserType* sum, Obj* x);
+Obj* user_tag(const UserType* sum, Obj* x);
+
+/* (define-printer T fn): display and write call fn with the object and a
+ * port for the stream it goes to, in place of the default #<T f1=v1 ...>.
+ * fn is borrowed; an error if it does not take 2 arguments. */
+Obj* user_printer(const UserType* t, Obj* fn);
+
+/* ========== Allocation Budgets ========== */
+
+/*
+ * (with-budget (allocs n) (ms t) expr): while a budget is active, every
+ * heap constructor charges it, and running out longjmps back to jump in
+ * the frame that entered it. Budgets nest per thread; when several run
+ * out at once the outermost one wins. Objects allocated before the jump
+ * are not reclaimed.
+ */
+typedef struct OmniBudget {
+    jmp_buf jump;
+    long allocs_left;               /* < 0: no allocation limit */
+    clock_t deadline;               /* 0: no time limit (processor time) */
+    const char* exceeded;           /* Limit that ran out: "allocs" or "ms" */
+    struct OmniBudget* outer;
+    Obj* output;                    /* The current output port when it began */
+} OmniBudget;
+
+/* Push b; allocs or ms < 0 leaves that limit off. setjmp(b->jump) next. */
+void omni_budget_enter(OmniBudget* b, long allocs, long ms);
+/* Pop b after its expression finished within budget */
+void omni_budget_leave(OmniBudget* b);
+/* The (error 'budget-exceeded limit) value for a budget that ran out */
+Obj* omni_budget_error(OmniBudget* b);
 
 /* ========== Type Introspection ========== */
 
@@ -475,8 +747,51 @@ Obj* ctr_arg(Obj* x, Obj* idx);
 /* ========== I/O Primitives ========== */
 
 Obj* prim_display(Obj* x);
+Obj* prim_write(Obj* x);
 Obj* prim_print(Obj* x);
 Obj* prim_newline(void);
+/* Printing to a port; anything but a port is the current output port.
+ * An error value when the port is closed or cannot be written to. */
+Obj* prim_display_to(Obj* x, Obj* port);
+Obj* prim_write_to(Obj* x, Obj* port);
+Obj* prim_newline_to(Obj* port);
+
+/* ========== Ports ========== */
+
+Obj* prim_is_port(Obj* x);
+/* Standard output, or the port with-output-to-port made current */
+Obj* prim_current_output_port(void);
+Obj* prim_current_input_port(void);
+/* with-output-to-port: make port current, keeping the one it replaces in
+ * *outer for omni_output_leave. 0, changing nothing, unless port is open
+ * for output. */
+int omni_output_enter(Obj* port, Obj** outer);
+void omni_output_leave(Obj* outer);
+/* A port collecting what is written to it; get-output-string reads it */
+Obj* prim_open_output_string(void);
+Obj* prim_get_output_string(Obj* port);
+Obj* prim_open_input_file(Obj* path);
+Obj* prim_open_output_file(Obj* path);
+/* A port reading and writing a TCP connection to host:port */
+Obj* prim_tcp_connect(Obj* host, Obj* port);
+/* The next line without its newline, or the next char; nil at the end */
+Obj* prim_read_line(Obj* port);
+Obj* prim_read_char(Obj* port);
+Obj* prim_close_port(Obj* port);
+Obj* prim_flush_port(Obj* port);
+/* Buffer size bytes of what port writes, or else reads: 0 for none and
+ * the symbol line to write each line as it ends */
+Obj* prim_set_port_buffer(Obj* port, Obj* size);
+/* Write what every open file and connection port has buffered, oldest
+ * first, then standard output; done at exit */
+void omni_flush_ports(void);
+
+/* Shortest round-trippable float text, e.g. 0.1, 1.0, 1e+100 */
+int format_float(char* buf, size_t cap, double f);
+
+/* write-style output: chars as #\name, strings quoted and escaped */
+void write_obj(Obj* x);
+void write_obj_to(FILE* out, Obj* x);
 
 /* ========== Character/String Primitives ========== */
 
@@ -498,6 +813,69 @@ Obj* prim_compose(Obj* f, Obj* g);
 /* ========== Closure Operations ========== */
 
 Obj* call_closure(Obj* clos, Obj** args, int argc);
+Obj* closure_named(Obj* clos, const char* name);
+
+/*
+ * Inline call cache: one per call site through a global. Holds the entry
+ * point and captures resolved for the global's version stamp; a changed
+ * stamp (the global was redefined) resolves again. A cache is not
+ * synchronized, so each thread needs its own (compiled code declares them
+ * static __thread).
+ */
+typedef struct OmniCallCache {
+    unsigned version;
+    ClosureFn fn;
+    Obj** captures;
+} OmniCallCache;
+
+Obj* omni_call_cached(OmniCallCache* ic, Obj* clos, unsigned version, Obj** args, int argc);
+Obj* prim_is_procedure(Obj* x);
+Obj* prim_arity(Obj* x);
+
+/* ========== Module ABI ========== */
+/*
+ * Compiled modules (a program, and the patches --hot loads into it) share
+ * objects and closures with the runtime, so these are fixed per ABI
+ * version: the Obj layout, the tag numbers, the ClosureFn signature with
+ * captures passed as one Obj* array in capture order, and OmniCallCache.
+ * Bump PURPLE_ABI_VERSION whenever one of them changes.
+ *
+ * Every module exports omni_module_abi, the ABI it was compiled against;
+ * a loader passes it to purple_abi_check before running any of its code.
+ */
+#define PURPLE_ABI_VERSION 1
+
+/* One object type a module may create or inspect */
+typedef struct PurpleTypeDescriptor {
+    const char* name;
+    int tag;
+} PurpleTypeDescriptor;
+
+/* Built-in types, as this header numbers them */
+#define PURPLE_ABI_TYPES { \
+    { "int", TAG_INT }, { "float", TAG_FLOAT }, { "char", TAG_CHAR }, \
+    { "pair", TAG_PAIR }, { "sym", TAG_SYM }, { "box", TAG_BOX }, \
+    { "closure", TAG_CLOSURE }, { "channel", TAG_CHANNEL }, { "error", TAG_ERROR }, \
+    { "atom", TAG_ATOM }, { "thread", TAG_THREAD }, { "string", TAG_STRING }, \
+    { "vector", TAG_VECTOR }, { "hash", TAG_HASH }, { "cancel", TAG_CANCEL }, \
+    { "port", TAG_PORT }, { "pmap", TAG_PMAP }, { "pvec", TAG_PVEC }, \
+    { "pool", TAG_POOL }, { "keyword", TAG_KEYWORD }, { "user", TAG_USER_BASE } \
+}
+
+typedef struct PurpleAbi {
+    unsigned version;                   /* PURPLE_ABI_VERSION */
+    unsigned obj_size;                  /* sizeof(Obj) */
+    unsigned call_cache_size;           /* sizeof(OmniCallCache) */
+    const PurpleTypeDescriptor* types;
+    unsigned type_count;
+} PurpleAbi;
+
+/* The ABI this runtime was built with */
+const PurpleAbi* purple_abi(void);
+
+/* 1 if a module built for abi can run on this runtime. Otherwise 0, with
+ * the first difference found written to why (cap bytes). */
+int purple_abi_check(const PurpleAbi* abi, char* why, size_t cap);
 
 /* ========== Truthiness ========== */
 
@@ -524,6 +902,9 @@ Obj* borrow_get(BorrowRef* ref);
 
 /* ========== Concurrency: Channels ========== */
 
+/* Capacity 0 makes an unbuffered channel: a send blocks until a receiver
+ * takes the value. A send that fails because the channel is closed leaves
+ * the value with the caller. */
 Obj* make_channel(int capacity);
 int channel_send(Obj* ch, Obj* val);
 Obj* channel_recv(Obj* ch);
@@ -548,6 +929,115 @@ Obj* spawn_thread(Obj* closure);
 Obj* thread_join(Obj* thread);
 static inline Obj* thread_create(Obj* closure) { return spawn_thread(closure); }
 
+/* ========== Concurrency: Nurseries ========== */
+
+/*
+ * (nursery body...) owns every task (spawn expr) starts during its body,
+ * including tasks spawned by those tasks, and joins them all when the
+ * body ends. Its value is the list of task results in spawn order; the
+ * body's own value is dropped. The first error, returned by the body or a
+ * task, cancels the rest and becomes the value instead.
+ *
+ * Cancelled code stops at its next safe point (an allocation, sleep-ms,
+ * yield or omni_cancel_point): a task then finishes as (error 'cancelled),
+ * and a nested nursery body unwinds to its omni_nursery_leave. Blocking
+ * waits (channel_recv, thread_join, sleep-ms) notice cancellation within
+ * about 10 ms and return (error 'cancelled) or stop. A with-budget that
+ * runs out outside a nursery body joins the body's tasks before it
+ * unwinds.
+ *
+ * (with-cancel tok body...) uses the same frame without collecting tasks:
+ * once (cancel! tok) is called from any thread, the body and every task
+ * of a nursery inside it are cancelled, and the form's value is
+ * (error 'cancelled). Spawns inside it go to the enclosing nursery.
+ */
+typedef struct OmniTask OmniTask;
+
+typedef struct OmniNursery {
+    jmp_buf jump;                   /* Cancellation unwinds the body to here */
+    pthread_mutex_t lock;
+    OmniTask* first;                /* Tasks in spawn order */
+    OmniTask* last;
+    int cancelled;
+    int unwound;                    /* The body was stopped by cancellation */
+    Obj* failure;                   /* First error from the body or a task */
+    OmniBudget* budget;             /* This thread's budget when the body began */
+    OmniBudget* unwinding;          /* An outer budget that ran out in the body */
+    Obj* token;                     /* with-cancel's token, borrowed; else NULL */
+    int collects;                   /* A nursery: spawn adds tasks here */
+    Obj* output;                    /* The current output port when the body began */
+    struct OmniNursery* parent;     /* Nursery the body itself runs in */
+} OmniNursery;
+
+/* Open n on this thread; setjmp(n->jump) next, as for budgets */
+void omni_nursery_enter(OmniNursery* n);
+/* Run fn(captures, NULL, 0) as a task of this thread's innermost nursery.
+ * The captures are shared with the task until the nursery joins it. */
+Obj* omni_spawn(ClosureFn fn, Obj** captures, int count);
+/* Join n's tasks; takes the body's value and returns the nursery's */
+Obj* omni_nursery_leave(OmniNursery* n, Obj* value);
+/* Open n for (with-cancel token ...); 0, and nothing opened, if token is
+ * not a cancel token */
+int omni_cancel_enter(OmniNursery* n, Obj* token);
+/* Close n; takes the body's value and returns the form's */
+Obj* omni_cancel_leave(OmniNursery* n, Obj* value);
+/* A safe point; -coop-cancel puts one at every function entry */
+void omni_cancel_point(void);
+
+/* Cancel tokens start clear; cancel! sets them for good */
+Obj* prim_make_cancel(void);
+Obj* prim_cancel(Obj* tok);
+Obj* prim_is_cancelled(Obj* tok);
+
+/* ========== Concurrency: Futures ========== */
+
+/*
+ * (future expr) runs expr on its own thread and returns a promise (a
+ * thread object). (await p) joins it and may be called any number of
+ * times: the result is kept in the promise, and each await returns a new
+ * reference to it. The captures are shared with the thread until the
+ * promise is freed.
+ */
+Obj* omni_future(ClosureFn fn, Obj** captures, int count);
+Obj* prim_await(Obj* p);
+Obj* prim_promise_done(Obj* p);
+Obj* prim_all_of(Obj* ps);
+
+/*
+ * (make-pool n) starts n worker threads; (pool-submit pool thunk) queues
+ * a procedure of no arguments on them and returns a promise of its value.
+ * Freeing the pool runs what is queued, then joins the workers.
+ */
+Obj* prim_make_pool(Obj* n);
+Obj* prim_pool_submit(Obj* pool, Obj* thunk);
+
+/* ========== Concurrency: Goroutines ========== */
+
+/*
+ * (go expr) runs expr on a detached thread, which releases its captures
+ * when it ends: those with their bit set in shared are counted
+ * atomically. (wait-group body...) opens a wait group around body and
+ * waits, on leaving, for every goroutine started inside it.
+ */
+typedef struct OmniWaitGroup {
+    pthread_mutex_t lock;
+    pthread_cond_t done;
+    int pending;                    /* Goroutines started and not ended */
+    struct OmniWaitGroup* parent;
+} OmniWaitGroup;
+
+Obj* omni_go(ClosureFn fn, Obj** captures, int count, uint64_t shared);
+void omni_wait_group_enter(OmniWaitGroup* w);
+/* Wait for w's goroutines; takes the body's value and returns it */
+Obj* omni_wait_group_leave(OmniWaitGroup* w, Obj* value);
+
+/* ========== Sleeping and Timers ========== */
+
+/* PURPLE_VIRTUAL_TIME makes sleep-ms advance a virtual clock instead */
+Obj* prim_sleep_ms(Obj* ms);
+Obj* prim_yield(void);
+Obj* prim_monotonic_millis(void);
+
 /* ========== Safe Points ========== */
 
 void safe_point(void);
@@ -18,8 +18,8 @@ static void* grow_array(void* arr, int* capacity, size_t elem_size) {
     return new_arr;
 }
 
-/* Helper: add violation to context */
-static void add_violation(ConstraintContext* ctx, const char* message) {
+/* Add violation to context */
+void constraint_add_violation(ConstraintContext* ctx, const char* message) {
     if (!ctx) return;
 
     /* Duplicate the message */
@@ -171,7 +171,7 @@ ConstraintError constraint_free(ConstraintContext* ctx, ConstraintObj* obj) {
                  obj->constraint_count);
 
         if (ctx) {
-            add_violation(ctx, msg);
+            constraint_add_violation(ctx, msg);
 
             if (ctx->assert_on_error) {
                 fprintf(stderr, "%s\n", msg);
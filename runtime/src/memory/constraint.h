@@ -93,6 +93,7 @@ bool constraint_ref_is_valid(ConstraintRef* ref);
 void constraint_ref_free(ConstraintRef* ref);
 
 /* Violation tracking */
+void constraint_add_violation(ConstraintContext* ctx, const char* message);
 bool constraint_has_violations(ConstraintContext* ctx);
 int constraint_get_violation_count(ConstraintContext* ctx);
 const char* constraint_get_violation(ConstraintContext* ctx, int index);
@@ -0,0 +1,264 @@
+/*
+ * Constraint Traces implementation
+ * Parse recorded alloc/borrow/release/free events and replay them
+ */
+
+#include "constraint_trace.h"
+#include <stdarg.h>
+#include <stdlib.h>
+#include <stdio.h>
+#include <string.h>
+
+/* An object while the trace is replayed */
+typedef struct {
+    uintptr_t object;
+    ConstraintObj* obj;
+    ConstraintRef** refs;   /* Open borrows, innermost last */
+    int ref_count;
+    int ref_capacity;
+    int freed_line;         /* 0 while the object is live */
+} TraceObject;
+
+typedef struct {
+    TraceObject* objects;
+    int count;
+    int capacity;
+} TraceHeap;
+
+static bool add_event(ConstraintTrace* trace, TraceEvent ev) {
+    if (trace->event_count >= trace->event_capacity) {
+        int cap = trace->event_capacity ? trace->event_capacity * 2 : 64;
+        TraceEvent* events = realloc(trace->events, cap * sizeof(TraceEvent));
+        if (!events) return false;
+        trace->events = events;
+        trace->event_capacity = cap;
+    }
+    trace->events[trace->event_count++] = ev;
+    return true;
+}
+
+static void set_error(ConstraintTrace* trace, int line, const char* what) {
+    char msg[128];
+    snprintf(msg, sizeof(msg), "trace line %d: %s", line, what);
+    trace->error = strdup(msg);
+}
+
+/* Parse trace text */
+ConstraintTrace* constraint_trace_parse(const char* text) {
+    ConstraintTrace* trace = calloc(1, sizeof(ConstraintTrace));
+    if (!trace) return NULL;
+    trace->text = strdup(text ? text : "");
+    if (!trace->text) {
+        free(trace);
+        return NULL;
+    }
+
+    int line = 0;
+    char* next = trace->text;
+    while (next && *next) {
+        char* p = next;
+        line++;
+        next = strchr(p, '\n');
+        if (next) *next++ = '\0';
+
+        while (*p == ' ' || *p == '\t' || *p == '\r') p++;
+        if (*p == '\0' || *p == '#') continue;
+
+        /* Kind */
+        char* kind = p;
+        while (*p && *p != ' ' && *p != '\t') p++;
+        if (*p) *p++ = '\0';
+
+        TraceEvent ev = { .line = line };
+        if (strcmp(kind, "alloc") == 0) ev.kind = TRACE_ALLOC;
+        else if (strcmp(kind, "borrow") == 0) ev.kind = TRACE_BORROW;
+        else if (strcmp(kind, "release") == 0) ev.kind = TRACE_RELEASE;
+        else if (strcmp(kind, "free") == 0) ev.kind = TRACE_FREE;
+        else {
+            set_error(trace, line, "unknown event (expected alloc, borrow, release or free)");
+            break;
+        }
+
+        /* Address */
+        while (*p == ' ' || *p == '\t') p++;
+        char* end = NULL;
+        ev.object = (uintptr_t)strtoull(p, &end, 16);
+        if (end == p || (*end && *end != ' ' && *end != '\t' && *end != '\r')) {
+            set_error(trace, line, "expected an object address");
+            break;
+        }
+
+        /* Site: the rest of the line */
+        p = end;
+        while (*p == ' ' || *p == '\t') p++;
+        char* tail = p + strlen(p);
+        while (tail > p && (tail[-1] == '\r' || tail[-1] == ' ')) *--tail = '\0';
+        ev.site = (*p && (ev.kind == TRACE_ALLOC || ev.kind == TRACE_BORROW)) ? p : NULL;
+
+        if (!add_event(trace, ev)) {
+            set_error(trace, line, "out of memory");
+            break;
+        }
+    }
+    return trace;
+}
+
+/* Load trace file */
+ConstraintTrace* constraint_trace_load(const char* path) {
+    FILE* f = fopen(path, "rb");
+    if (!f) return NULL;
+
+    size_t len = 0, cap = 4096;
+    char* text = malloc(cap);
+    size_t n;
+    while (text && (n = fread(text + len, 1, cap - len - 1, f)) > 0) {
+        len += n;
+        if (cap - len - 1 == 0) {
+            char* bigger = realloc(text, cap * 2);
+            if (!bigger) {
+                free(text);
+                text = NULL;
+                break;
+            }
+            text = bigger;
+            cap *= 2;
+        }
+    }
+    fclose(f);
+    if (!text) return NULL;
+    text[len] = '\0';
+
+    ConstraintTrace* trace = constraint_trace_parse(text);
+    free(text);
+    return trace;
+}
+
+/* Free trace */
+void constraint_trace_free(ConstraintTrace* trace) {
+    if (!trace) return;
+    free(trace->events);
+    free(trace->text);
+    free(trace->error);
+    free(trace);
+}
+
+/* The latest object at an address, live or not */
+static TraceObject* find_object(TraceHeap* heap, uintptr_t object) {
+    for (int i = heap->count - 1; i >= 0; i--) {
+        if (heap->objects[i].object == object) return &heap->objects[i];
+    }
+    return NULL;
+}
+
+static TraceObject* new_object(TraceHeap* heap, uintptr_t object, const char* site) {
+    if (heap->count >= heap->capacity) {
+        int cap = heap->capacity ? heap->capacity * 2 : 32;
+        TraceObject* objects = realloc(heap->objects, cap * sizeof(TraceObject));
+        if (!objects) return NULL;
+        heap->objects = objects;
+        heap->capacity = cap;
+    }
+    TraceObject* o = &heap->objects[heap->count];
+    memset(o, 0, sizeof(*o));
+    o->object = object;
+    o->obj = constraint_alloc(NULL, NULL, NULL, site);
+    if (!o->obj) return NULL;
+    heap->count++;
+    return o;
+}
+
+static void drop_refs(TraceObject* o) {
+    for (int i = 0; i < o->ref_count; i++) constraint_ref_free(o->refs[i]);
+    o->ref_count = 0;
+}
+
+static const char* site_or_unknown(const char* site) {
+    return site ? site : "an unrecorded site";
+}
+
+static int violation(ConstraintContext* ctx, const char* fmt, ...) {
+    char msg[512];
+    va_list args;
+    va_start(args, fmt);
+    vsnprintf(msg, sizeof(msg), fmt, args);
+    va_end(args);
+    constraint_add_violation(ctx, msg);
+    return 1;
+}
+
+/* Replay trace */
+int constraint_trace_verify(ConstraintContext* ctx, const ConstraintTrace* trace) {
+    if (!ctx || !trace) return 0;
+
+    TraceHeap heap = {0};
+    int found = 0;
+
+    for (int i = 0; i < trace->event_count; i++) {
+        const TraceEvent* ev = &trace->events[i];
+        TraceObject* o = find_object(&heap, ev->object);
+        bool live = o && o->freed_line == 0;
+
+        switch (ev->kind) {
+        case TRACE_ALLOC:
+            /* Binding a live object again only moves its site */
+            if (live) o->obj->owner = ev->site;
+            else new_object(&heap, ev->object, ev->site);
+            break;
+
+        case TRACE_BORROW:
+            if (!live) o = new_object(&heap, ev->object, NULL);
+            if (!o) break;
+            if (o->ref_count >= o->ref_capacity) {
+                int cap = o->ref_capacity ? o->ref_capacity * 2 : 4;
+                ConstraintRef** refs = realloc(o->refs, cap * sizeof(ConstraintRef*));
+                if (!refs) break;
+                o->refs = refs;
+                o->ref_capacity = cap;
+            }
+            o->refs[o->ref_count] = constraint_add(o->obj, ev->site);
+            if (o->refs[o->ref_count]) o->ref_count++;
+            break;
+
+        case TRACE_RELEASE:
+            if (!live || o->ref_count == 0) {
+                found += violation(ctx, "trace line %d: release of %#lx without an open borrow",
+                                   ev->line, (unsigned long)ev->object);
+                break;
+            }
+            constraint_release(o->refs[o->ref_count - 1]);
+            constraint_ref_free(o->refs[--o->ref_count]);
+            break;
+
+        case TRACE_FREE:
+            if (!o) break;  /* Never bound or borrowed, so never checked */
+            if (!live) {
+                found += violation(ctx, "trace line %d: object allocated at %s freed twice (first at line %d)",
+                                   ev->line, site_or_unknown(o->obj->owner), o->freed_line);
+                break;
+            }
+            if (o->ref_count > 0) {
+                found += violation(ctx, "trace line %d: object allocated at %s freed while borrowed at %s",
+                                   ev->line, site_or_unknown(o->obj->owner),
+                                   o->refs[o->ref_count - 1]->source);
+                drop_refs(o);
+                o->obj->constraint_count = 0;
+            }
+            constraint_free(ctx, o->obj);
+            o->freed_line = ev->line;
+            break;
+        }
+    }
+
+    for (int i = 0; i < heap.count; i++) {
+        TraceObject* o = &heap.objects[i];
+        if (o->freed_line == 0 && o->ref_count > 0) {
+            found += violation(ctx, "trace ends with object allocated at %s still borrowed at %s",
+                               site_or_unknown(o->obj->owner), o->refs[o->ref_count - 1]->source);
+        }
+        drop_refs(o);
+        free(o->refs);
+        free(o->obj);
+    }
+    free(heap.objects);
+    return found;
+}
@@ -0,0 +1,58 @@
+/*
+ * Constraint Traces - replay recorded executions through the constraint model
+ *
+ * A program built with `omnilisp --constraint-check` and run with
+ * PURPLE_CONSTRAINT_TRACE=<file> writes one line per event:
+ *
+ *   alloc   <address> <site>     object bound at site
+ *   borrow  <address> <site>     borrow opened at site
+ *   release <address>            innermost borrow closed
+ *   free    <address>            object freed
+ *
+ * Lines that are empty or start with '#' are ignored. Addresses are reused
+ * once an object is freed, so an alloc after a free starts a new object.
+ *
+ * Replaying a trace checks the same rule as the live check (no free while
+ * borrowed) plus the ones it can't see: frees and releases of objects that
+ * are gone, and borrows still open when the trace ends.
+ */
+
+#ifndef CONSTRAINT_TRACE_H
+#define CONSTRAINT_TRACE_H
+
+#include <stdint.h>
+#include "constraint.h"
+
+typedef enum {
+    TRACE_ALLOC,
+    TRACE_BORROW,
+    TRACE_RELEASE,
+    TRACE_FREE
+} TraceEventKind;
+
+typedef struct {
+    TraceEventKind kind;
+    uintptr_t object;
+    const char* site;      /* NULL for release and free */
+    int line;              /* 1-based line in the trace text */
+} TraceEvent;
+
+typedef struct {
+    TraceEvent* events;
+    int event_count;
+    int event_capacity;
+    char* text;            /* Owns the site strings */
+    char* error;           /* Set when parsing stopped at a bad line */
+} ConstraintTrace;
+
+/* Parsing. Both return NULL only when out of memory or the file can't be
+ * read; a malformed line leaves the events before it and sets error. */
+ConstraintTrace* constraint_trace_parse(const char* text);
+ConstraintTrace* constraint_trace_load(const char* path);
+void constraint_trace_free(ConstraintTrace* trace);
+
+/* Replay trace into ctx, adding a violation for each broken rule.
+ * Returns the number of violations added. */
+int constraint_trace_verify(ConstraintContext* ctx, const ConstraintTrace* trace);
+
+#endif /* CONSTRAINT_TRACE_H */
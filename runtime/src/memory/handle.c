@@ -191,8 +191,10 @@ Obj* handle_deref_obj(Handle h) {
 /* ============== BorrowRef Integration ============== */
 
 /*
- * BorrowRef structure - must match runtime.c definition
+ * BorrowRef structure - must match runtime.c definition, which this file
+ * follows in the one C file omnilisp -c --standalone writes
  */
+#ifndef PURPLE_BORROW_REF_DEFINED
 typedef struct BorrowRef {
     void* target;            /* Legacy GenObj system */
     uint16_t remembered_gen; /* Snapshot of generation */
@@ -200,6 +202,7 @@ typedef struct BorrowRef {
     void* ipge_target;       /* IPGE: Direct Obj* */
     Handle handle;           /* NEW: Stable handle */
 } BorrowRef;
+#endif
 
 struct BorrowRef* handle_borrow_create(Obj* obj, const char* source_desc) {
     BorrowRef* ref = malloc(sizeof(BorrowRef));
@@ -8,10 +8,21 @@
 #include <stdlib.h>
 #include <stdio.h>
 #include <limits.h>
+#include <math.h>
 #include <stdint.h>
 #include <string.h>
 #include <pthread.h>
 #include <stdbool.h>
+#include <setjmp.h>
+#include <time.h>
+#include <sched.h>
+#include <unistd.h>
+#include <sys/socket.h>
+#include <netdb.h>
+#include <signal.h>
+
+/* POSIX 2008, which the feature level above leaves undeclared */
+FILE* open_memstream(char** buf, size_t* len);
 
 /* Sound generational references - slot pool never frees to system allocator */
 #include "memory/slot_pool.h"
@@ -110,16 +121,19 @@ typedef struct BorrowRef {
     struct Obj* ipge_target;     /* IPGE: Direct Obj* for generation check */
     Handle handle;               /* Sound handle for slot-pool objects */
 } BorrowRef;
+#define PURPLE_BORROW_REF_DEFINED
 
 void invalidate_weak_refs_for(void* target);
 BorrowRef* borrow_create(Obj* obj, const char* source_desc);
 void borrow_invalidate_obj(Obj* obj);
 Obj* call_closure(Obj* clos, Obj** args, int arg_count);
+Obj* closure_named(Obj* clos, const char* name);
 void closure_release(Closure* c);
 void release_user_obj(Obj* x);
 void free_channel_obj(Obj* ch_obj);
 void free_atom_obj(Obj* atom_obj);
 void free_thread_obj(Obj* thread_obj);
+void free_pool_obj(Obj* pool_obj);
 void scan_user_obj(Obj* obj);
 void clear_marks_user_obj(Obj* obj);
 
@@ -141,19 +155,39 @@ Obj* prim_ge(Obj* a, Obj* b);
 Obj* prim_eq(Obj* a, Obj* b);
 Obj* prim_not(Obj* a);
 Obj* prim_abs(Obj* a);
+Obj* prim_min(Obj* a, Obj* b);
+Obj* prim_max(Obj* a, Obj* b);
+Obj* prim_expt(Obj* base, Obj* power);
+Obj* prim_gcd(Obj* a, Obj* b);
+Obj* prim_lcm(Obj* a, Obj* b);
+Obj* prim_sqrt(Obj* a);
 Obj* prim_null(Obj* x);
 Obj* prim_pair(Obj* x);
 Obj* prim_int(Obj* x);
 Obj* prim_float(Obj* x);
 Obj* prim_char(Obj* x);
 Obj* prim_sym(Obj* x);
+Obj* prim_error(Obj* msg, Obj* data);
+Obj* prim_error_message(Obj* e);
+Obj* prim_error_data(Obj* e);
+Obj* prim_error_tag(Obj* e);
+Obj* prim_error_trace(Obj* e);
+Obj* prim_is_error(Obj* x);
+Obj* mk_sym(const char* s);
+Obj* mk_string(const char* s);
+Obj* mk_error_obj(const char* msg, Obj* data);
 Obj* obj_car(Obj* p);
 Obj* obj_cdr(Obj* p);
 
 /* I/O primitive forward declarations */
 Obj* prim_display(Obj* x);
+Obj* prim_write(Obj* x);
 Obj* prim_print(Obj* x);
 Obj* prim_newline(void);
+Obj* prim_display_to(Obj* x, Obj* port);
+Obj* prim_write_to(Obj* x, Obj* port);
+Obj* prim_newline_to(Obj* port);
+void omni_flush_ports(void);
 
 /* List operation forward declarations */
 Obj* list_append(Obj* a, Obj* b);
@@ -190,7 +224,16 @@ typedef enum {
     TAG_CHANNEL,
     TAG_ERROR,
     TAG_ATOM,
-    TAG_THREAD
+    TAG_THREAD,
+    TAG_STRING,
+    TAG_VECTOR,
+    TAG_HASH,
+    TAG_CANCEL,
+    TAG_PORT,
+    TAG_PMAP,
+    TAG_PVEC,
+    TAG_POOL,
+    TAG_KEYWORD
 } ObjTag;
 
 #define TAG_USER_BASE 1000
@@ -212,6 +255,61 @@ typedef struct Obj {
 } Obj;
 /* Size: 32 bytes (compact) or 40 bytes (robust) */
 #define PURPLE_OBJ_DEFINED 1
+
+/* Slots of a TAG_VECTOR object, behind its ptr */
+typedef struct Vector {
+    long len;
+    Obj* items[];
+} Vector;
+
+/* Entries of a TAG_HASH object, behind its ptr: chained buckets, plus a
+ * list in insertion order that hash-keys follows */
+typedef struct HashNode {
+    Obj* key;
+    Obj* value;
+    unsigned long code;        /* hash_code(key) */
+    struct HashNode* chain;    /* Next in the bucket */
+    struct HashNode* prev;     /* Insertion order */
+    struct HashNode* next;
+} HashNode;
+
+typedef struct HashTable {
+    HashNode** buckets;
+    long bucket_count;         /* A power of two */
+    long count;
+    HashNode* first;
+    HashNode* last;
+} HashTable;
+
+static void hash_table_free(HashTable* t, void (*release)(Obj*));
+
+/* Versions of a TAG_PMAP or TAG_PVEC object, behind its ptr; see
+ * Persistent Collections */
+typedef struct PColl PColl;
+
+static void pcoll_free(PColl* c);
+static void share_persistent(Obj* x);
+
+/* A TAG_PORT object's streams, behind its ptr; see Ports */
+typedef struct Port Port;
+
+static void port_free(Port* p);
+
+/* See purple.h. A deftype's objects have tag TAG_USER_BASE and their
+ * type and fields behind ptr. */
+typedef struct UserType {
+    const char* name;
+    int field_count;
+    const char* const* fields;
+    uint64_t weak;
+    const char* sum;
+    int tag;
+} UserType;
+
+typedef struct UserObj {
+    const UserType* type;
+    Obj* fields[];
+} UserObj;
 #define PURPLE_OBJ_SIZE sizeof(Obj)
 
 /* Now that Obj is defined, include handle system for sound borrowed refs */
@@ -288,6 +386,8 @@ typedef struct FreeNode {
 
 FreeNode* FREE_HEAD = NULL;
 int FREE_COUNT = 0;
+static long g_freelist_budget = 0;  /* PURPLE_FREELIST_BUDGET; 0 = no limit */
+void flush_freelist(void);
 
 /* Stack Allocation Pool */
 #define STACK_POOL_SIZE 256
@@ -386,12 +486,89 @@ int is_pool_obj(Obj* obj) {
     return handle_is_pool_obj(obj) ? 1 : 0;
 }
 
+/* ========== Allocation Budgets ========== */
+/* See purple.h; constructors call budget_charge() before allocating */
+
+typedef struct OmniBudget {
+    jmp_buf jump;
+    long allocs_left;
+    clock_t deadline;
+    const char* exceeded;
+    struct OmniBudget* outer;
+    Obj* output;
+} OmniBudget;
+
+/* with-output-to-port's port on this thread; NULL for standard output.
+ * Frames that unwinding lands in put back the one they began with. */
+static __thread Obj* g_output = NULL;
+
+/* Innermost active budget of this thread */
+static __thread OmniBudget* g_budget = NULL;
+static __thread unsigned g_budget_ticks = 0;
+
+/* Time is read every this many charges */
+#define BUDGET_CLOCK_EVERY 64
+
+void omni_budget_enter(OmniBudget* b, long allocs, long ms) {
+    b->allocs_left = allocs;
+    b->deadline = 0;
+    if (ms >= 0) {
+        b->deadline = clock() + (clock_t)((double)ms * CLOCKS_PER_SEC / 1000.0);
+        if (b->deadline == 0) b->deadline = 1;
+    }
+    b->exceeded = NULL;
+    b->outer = g_budget;
+    b->output = g_output;
+    g_budget = b;
+}
+
+void omni_budget_leave(OmniBudget* b) {
+    g_budget = b->outer;
+}
+
+Obj* omni_budget_error(OmniBudget* b) {
+    g_output = b->output;
+    return mk_error_obj("budget-exceeded", mk_sym(b->exceeded ? b->exceeded : "allocs"));
+}
+
+/* Cancellation and budget unwinding for nurseries; see Nurseries below */
+static void nursery_safe_point(void);
+static void nursery_budget_jump(OmniBudget* hit);
+
+static void budget_charge(void) {
+    nursery_safe_point();
+    if (!g_budget) return;
+    bool timed = ++g_budget_ticks % BUDGET_CLOCK_EVERY == 0;
+    clock_t now = timed ? clock() : 0;
+    OmniBudget* hit = NULL;
+    for (OmniBudget* b = g_budget; b; b = b->outer) {
+        if (b->allocs_left >= 0 && --b->allocs_left < 0) {
+            b->exceeded = "allocs";
+            hit = b;
+        } else if (timed && b->deadline && now >= b->deadline) {
+            b->exceeded = "ms";
+            hit = b;
+        }
+    }
+    if (hit) {
+        nursery_budget_jump(hit);
+        g_budget = hit->outer;
+        longjmp(hit->jump, 1);
+    }
+}
+
+/* Storage for int, float and pair cells; see Memory Strategies */
+static Obj* obj_alloc(void);
+static int obj_initial_mark(Obj* x);
+static void obj_free_storage(Obj* x);
+
 /* Object Constructors */
 Obj* mk_int(long i) {
-    Obj* x = malloc(sizeof(Obj));
+    budget_charge();
+    Obj* x = obj_alloc();
     if (!x) return NULL;
     x->generation = _next_generation();
-    x->mark = 1;
+    x->mark = obj_initial_mark(x);
     x->tag = TAG_INT;
     x->is_pair = 0;
     x->scc_id = -1;  /* Initialize to not in SCC */
@@ -401,10 +578,11 @@ Obj* mk_int(long i) {
 }
 
 Obj* mk_float(double f) {
-    Obj* x = malloc(sizeof(Obj));
+    budget_charge();
+    Obj* x = obj_alloc();
     if (!x) return NULL;
     x->generation = _next_generation();
-    x->mark = 1;
+    x->mark = obj_initial_mark(x);
     x->tag = TAG_FLOAT;
     x->is_pair = 0;
     x->scc_id = -1;  /* Initialize to not in SCC */
@@ -424,6 +602,7 @@ Obj* mk_char(long c) {
         return mk_char_unboxed(c);
     }
     /* Fallback to boxed for invalid codepoints */
+    budget_charge();
     Obj* x = malloc(sizeof(Obj));
     if (!x) return NULL;
     x->generation = _next_generation();
@@ -437,10 +616,11 @@ Obj* mk_char(long c) {
 }
 
 Obj* mk_pair(Obj* a, Obj* b) {
-    Obj* x = malloc(sizeof(Obj));
+    budget_charge();
+    Obj* x = obj_alloc();
     if (!x) return NULL;
     x->generation = _next_generation();
-    x->mark = 1;
+    x->mark = obj_initial_mark(x);
     x->tag = TAG_PAIR;
     x->is_pair = 1;
     x->scc_id = -1;  /* Initialize to not in SCC */
@@ -452,6 +632,7 @@ Obj* mk_pair(Obj* a, Obj* b) {
 }
 
 Obj* mk_sym(const char* s) {
+    budget_charge();
     Obj* x = malloc(sizeof(Obj));
     if (!x) return NULL;
     x->generation = _next_generation();
@@ -475,7 +656,57 @@ Obj* mk_sym(const char* s) {
     return x;
 }
 
+/* Strings share the symbol layout: ptr owns a NUL-terminated copy */
+Obj* mk_string(const char* s) {
+    Obj* x = mk_sym(s ? s : "");
+    if (x) x->tag = TAG_STRING;
+    return x;
+}
+
+/* Keywords are interned: one object per name, made on first use. Like
+ * arena objects (mark -2) they are not counted and never freed, so eq?
+ * on keywords is identity. */
+static Obj** g_keywords = NULL;
+static size_t g_keyword_count = 0, g_keyword_cap = 0;
+static pthread_mutex_t g_keywords_lock = PTHREAD_MUTEX_INITIALIZER;
+
+Obj* mk_keyword(const char* s) {
+    if (!s) return NULL;
+    pthread_mutex_lock(&g_keywords_lock);
+    Obj* x = NULL;
+    for (size_t i = 0; i < g_keyword_count && !x; i++) {
+        if (strcmp((const char*)g_keywords[i]->ptr, s) == 0) x = g_keywords[i];
+    }
+    if (!x && g_keyword_count == g_keyword_cap) {
+        size_t cap = g_keyword_cap ? g_keyword_cap * 2 : 16;
+        Obj** grown = realloc(g_keywords, cap * sizeof(Obj*));
+        if (grown) {
+            g_keywords = grown;
+            g_keyword_cap = cap;
+        }
+    }
+    if (!x && g_keyword_count < g_keyword_cap && (x = calloc(1, sizeof(Obj)))) {
+        /* Not mk_sym: a budget running out must not jump out holding the lock */
+        x->generation = _next_generation();
+        x->mark = -2;
+        x->tag = TAG_KEYWORD;
+        x->scc_id = -1;
+        size_t len = strlen(s);
+        x->ptr = malloc(len + 1);
+        if (x->ptr) {
+            memcpy(x->ptr, s, len + 1);
+            g_keywords[g_keyword_count++] = x;
+        } else {
+            free(x);
+            x = NULL;
+        }
+    }
+    pthread_mutex_unlock(&g_keywords_lock);
+    return x;
+}
+
 Obj* mk_box(Obj* v) {
+    budget_charge();
     Obj* x = malloc(sizeof(Obj));
     if (!x) return NULL;
     x->generation = _next_generation();
@@ -501,7 +732,32 @@ void box_set(Obj* b, Obj* v) {
     b->ptr = v;
 }
 
-Obj* mk_error(const char* msg) {
+/*
+ * Error objects: ptr holds the message (owned copy, may be NULL) and b an
+ * optional payload. The payload is referenced, not copied. The message
+ * is the end of an ErrorInfo, which also references the error's tag and
+ * the function stack when it was made (kept by -g builds); an error
+ * without a message has neither.
+ */
+typedef struct ErrorInfo {
+    Obj* tag;       /* A symbol, or NULL for error */
+    Obj* trace;     /* Function names, innermost first */
+    char msg[];
+} ErrorInfo;
+
+#define ERROR_INFO(x) ((ErrorInfo*)((char*)(x)->ptr - offsetof(ErrorInfo, msg)))
+
+static Obj* error_trace(void);
+
+static void error_info_free(Obj* x, void (*release)(Obj*)) {
+    ErrorInfo* info = ERROR_INFO(x);
+    if (release && info->tag) release(info->tag);
+    if (release && info->trace) release(info->trace);
+    free(info);
+}
+
+Obj* mk_error_obj(const char* msg, Obj* data) {
+    budget_charge();
     Obj* x = malloc(sizeof(Obj));
     if (!x) return NULL;
     x->mark = 1;
@@ -512,19 +768,39 @@ Obj* mk_error(const char* msg) {
     x->generation = _next_generation();
     if (msg) {
         size_t len = strlen(msg);
-        char* copy = malloc(len + 1);
-        if (!copy) {
+        ErrorInfo* info = malloc(sizeof(ErrorInfo) + len + 1);
+        if (!info) {
             free(x);
             return NULL;
         }
-        memcpy(copy, msg, len + 1);
-        x->ptr = copy;
+        memcpy(info->msg, msg, len + 1);
+        info->tag = NULL;
+        info->trace = error_trace();
+        x->ptr = info->msg;
     } else {
         x->ptr = NULL;
     }
+    if (data) inc_ref(data);
+    x->b = data;
     return x;
 }
 
+Obj* mk_error(const char* msg) {
+    return mk_error_obj(msg, NULL);
+}
+
+int is_error(Obj* x) {
+    return x && !IS_IMMEDIATE(x) && x->tag == TAG_ERROR;
+}
+
+const char* error_message(Obj* e) {
+    return is_error(e) ? (const char*)e->ptr : NULL;
+}
+
+Obj* error_data(Obj* e) {
+    return is_error(e) ? e->b : NULL;
+}
+
 Obj* mk_int_stack(long i) {
     if (STACK_PTR < STACK_POOL_SIZE) {
         Obj* x = &STACK_POOL[STACK_PTR++];
@@ -587,9 +863,30 @@ void release_children(Obj* x) {
         if (x->ptr) closure_release((Closure*)x->ptr);
         break;
     case TAG_SYM:
-    case TAG_ERROR:
+    case TAG_STRING:
         if (x->ptr) free(x->ptr);
         break;
+    case TAG_VECTOR:
+        if (x->ptr) {
+            Vector* v = (Vector*)x->ptr;
+            for (long i = 0; i < v->len; i++) dec_ref(v->items[i]);
+            free(v);
+        }
+        break;
+    case TAG_HASH:
+        if (x->ptr) hash_table_free((HashTable*)x->ptr, dec_ref);
+        break;
+    case TAG_PMAP:
+    case TAG_PVEC:
+        if (x->ptr) pcoll_free((PColl*)x->ptr);
+        break;
+    case TAG_PORT:
+        if (x->ptr) port_free((Port*)x->ptr);
+        break;
+    case TAG_ERROR:
+        if (x->ptr) error_info_free(x, dec_ref);
+        if (x->b) dec_ref(x->b);
+        break;
     case TAG_CHANNEL:
         if (x->ptr) free_channel_obj(x);
         break;
@@ -599,6 +896,9 @@ void release_children(Obj* x) {
     case TAG_THREAD:
         if (x->ptr) free_thread_obj(x);
         break;
+    case TAG_POOL:
+        if (x->ptr) free_pool_obj(x);
+        break;
     default:
         if (x->tag >= TAG_USER_BASE) {
             release_user_obj(x);
@@ -607,11 +907,42 @@ void release_children(Obj* x) {
     }
 }
 
+/*
+ * Once purple_install_crash_handler has run, the last RC_RING changes of
+ * a reference count, each with the object's tag and count before it, and
+ * how many objects were made and released, for the crash report.
+ */
+#define RC_RING 32
+typedef struct { const char* op; Obj* obj; int tag; int mark; } RcOp;
+static RcOp g_rc_ring[RC_RING];
+static unsigned long g_rc_ops = 0;
+static int g_rc_logging = 0;
+static unsigned long g_objs_made = 0, g_objs_released = 0;
+
+static inline void rc_log(const char* op, Obj* x) {
+    if (!g_rc_logging) return;
+    RcOp* r = &g_rc_ring[__atomic_fetch_add(&g_rc_ops, 1, __ATOMIC_RELAXED) % RC_RING];
+    r->op = op;
+    r->obj = x;
+    r->tag = x->tag;
+    r->mark = x->mark;
+}
+
+/* Called with each object as it is freed; see set_free_hook */
+static void (*g_free_hook)(Obj*) = NULL;
+
+void set_free_hook(void (*hook)(Obj*)) {
+    g_free_hook = hook;
+}
+
 /* TREE: Direct free (ASAP) */
 void free_tree(Obj* x) {
     if (!x) return;
     if (IS_IMMEDIATE(x)) return;
     if (is_stack_obj(x)) return;
+    if (x->mark == -2) return;  /* Arena-allocated: freed with the arena */
+    rc_log("free_tree", x);
+    if (g_free_hook) g_free_hook(x);
     switch (x->tag) {
     case TAG_PAIR:
         free_tree(x->a);
@@ -624,9 +955,31 @@ void free_tree(Obj* x) {
         if (x->ptr) closure_release((Closure*)x->ptr);
         break;
     case TAG_SYM:
-    case TAG_ERROR:
+    case TAG_STRING:
         if (x->ptr) free(x->ptr);
         break;
+    case TAG_VECTOR:
+        if (x->ptr) {
+            Vector* v = (Vector*)x->ptr;
+            for (long i = 0; i < v->len; i++) free_tree(v->items[i]);
+            free(v);
+        }
+        break;
+    case TAG_HASH:
+        if (x->ptr) hash_table_free((HashTable*)x->ptr, free_tree);
+        break;
+    case TAG_PMAP:
+    case TAG_PVEC:
+        /* Nodes may be shared with other versions: count them down */
+        if (x->ptr) pcoll_free((PColl*)x->ptr);
+        break;
+    case TAG_PORT:
+        if (x->ptr) port_free((Port*)x->ptr);
+        break;
+    case TAG_ERROR:
+        if (x->ptr) error_info_free(x, free_tree);
+        if (x->b) free_tree(x->b);
+        break;
     default:
         if (x->tag >= TAG_USER_BASE) {
             release_user_obj(x);
@@ -635,34 +988,97 @@ void free_tree(Obj* x) {
     }
     borrow_invalidate_obj(x);
     invalidate_weak_refs_for(x);
-    free(x);
+    obj_free_storage(x);
 }
 
-/* DAG: Reference counting */
-void dec_ref(Obj* x) {
-    if (!x) return;
+/*
+ * Set once a second thread has started (see start_thread). From then on
+ * inc_ref and dec_ref change counts atomically, since any object may have
+ * reached another thread; until then they need not pay for it.
+ */
+static int g_threaded = 0;
+
+static inline bool rc_atomic(void) {
+    return __atomic_load_n(&g_threaded, __ATOMIC_ACQUIRE);
+}
+
+/* Drops one reference to x; true if it was the last */
+static bool drop_ref(Obj* x) {
+    if (!x) return false;
     /* Immediate integers don't need RC */
-    if (IS_IMMEDIATE(x)) return;
-    if (is_stack_obj(x)) return;
-    if (x->mark < 0) return;
-    x->mark--;
-    if (x->mark <= 0) {
+    if (IS_IMMEDIATE(x)) return false;
+    if (is_stack_obj(x)) return false;
+    bool atomic = rc_atomic();
+    if ((atomic ? __atomic_load_n(&x->mark, __ATOMIC_ACQUIRE) : x->mark) < 0) return false;
+    rc_log("dec_ref", x);
+    int left = atomic ? __atomic_sub_fetch(&x->mark, 1, __ATOMIC_ACQ_REL) : --x->mark;
+    return left <= 0;
+}
+
+/* The last reference to x is gone. A list's spine is released in a loop,
+ * so a long list does not recurse once per cell. */
+static void release_obj(Obj* x) {
+    while (x) {
+        Obj* next = NULL;
+        if (x->tag == TAG_PAIR) {
+            next = x->b;
+            x->b = NULL;
+        }
+        if (g_free_hook) g_free_hook(x);
         release_children(x);
         borrow_invalidate_obj(x);
         invalidate_weak_refs_for(x);
-        free(x);
+        obj_free_storage(x);
+        x = drop_ref(next) ? next : NULL;
     }
 }
 
+/* DAG: Reference counting */
+void dec_ref(Obj* x) {
+    if (drop_ref(x)) release_obj(x);
+}
+
 void inc_ref(Obj* x) {
     if (!x) return;
     /* Immediate integers don't need RC */
     if (IS_IMMEDIATE(x)) return;
     if (is_stack_obj(x)) return;
+    if (rc_atomic()) {
+        int mark = __atomic_load_n(&x->mark, __ATOMIC_ACQUIRE);
+        if (mark == -2) return;  /* Arena-allocated: not counted */
+        rc_log("inc_ref", x);
+        /* Another thread may count x first; then add to its count */
+        while (mark < 0) {
+            if (__atomic_compare_exchange_n(&x->mark, &mark, 1, false,
+                                            __ATOMIC_ACQ_REL, __ATOMIC_ACQUIRE)) return;
+            if (mark == -2) return;
+        }
+        __atomic_add_fetch(&x->mark, 1, __ATOMIC_ACQ_REL);
+        return;
+    }
+    if (x->mark == -2) return;  /* Arena-allocated: not counted */
+    rc_log("inc_ref", x);
     if (x->mark < 0) { x->mark = 1; return; }
     x->mark++;
 }
 
+/* Reference counting for objects the compiler finds shared between
+ * threads: atomic whether or not a thread has started yet */
+void atomic_inc_ref(Obj* x) {
+    if (!x || IS_IMMEDIATE(x) || is_stack_obj(x)) return;
+    if (__atomic_load_n(&x->mark, __ATOMIC_ACQUIRE) == -2) return;
+    rc_log("atomic_inc_ref", x);
+    share_persistent(x);
+    __atomic_add_fetch(&x->mark, 1, __ATOMIC_ACQ_REL);
+}
+
+void atomic_dec_ref(Obj* x) {
+    if (!x || IS_IMMEDIATE(x) || is_stack_obj(x)) return;
+    if (__atomic_load_n(&x->mark, __ATOMIC_ACQUIRE) < 0) return;
+    rc_log("atomic_dec_ref", x);
+    if (__atomic_sub_fetch(&x->mark, 1, __ATOMIC_ACQ_REL) <= 0) release_obj(x);
+}
+
 /* RC Optimization: Direct free for proven-unique references (Lobster-style) */
 /* When compile-time analysis proves a reference is the only one, skip RC check */
 void free_unique(Obj* x) {
@@ -670,11 +1086,14 @@ void free_unique(Obj* x) {
     /* Immediate integers don't need freeing */
     if (IS_IMMEDIATE(x)) return;
     if (is_stack_obj(x)) return;
+    if (x->mark == -2) return;  /* Arena-allocated: freed with the arena */
     /* Proven unique at compile time - no RC check needed */
+    rc_log("free_unique", x);
+    if (g_free_hook) g_free_hook(x);
     release_children(x);
     borrow_invalidate_obj(x);
     invalidate_weak_refs_for(x);
-    free(x);
+    obj_free_storage(x);
 }
 
 /* RC Optimization: Borrowed reference - no RC ops needed */
@@ -688,7 +1107,9 @@ void free_obj(Obj* x) {
     if (IS_IMMEDIATE(x)) return;
     if (is_stack_obj(x)) return;
     if (x->mark < 0) return;
+    rc_log("free_obj", x);
     x->mark = -1;
+    if (g_free_hook) g_free_hook(x);
 
     /* IPGE: Evolve generation to invalidate borrowed refs */
     x->generation = ipge_evolve(x->generation);
@@ -697,13 +1118,14 @@ void free_obj(Obj* x) {
     if (!n) {
         release_children(x);
         invalidate_weak_refs_for(x);
-        free(x);
+        obj_free_storage(x);
         return;
     }
     n->obj = x;
     n->next = FREE_HEAD;
     FREE_HEAD = n;
     FREE_COUNT++;
+    if (g_freelist_budget > 0 && FREE_COUNT >= g_freelist_budget) flush_freelist();
 }
 
 void flush_freelist(void) {
@@ -714,7 +1136,7 @@ void flush_freelist(void) {
             release_children(n->obj);
             borrow_invalidate_obj(n->obj);
             invalidate_weak_refs_for(n->obj);
-            free(n->obj);
+            obj_free_storage(n->obj);
         }
         free(n);
     }
@@ -1020,10 +1442,30 @@ void release_scc(SCC* scc) {
                 } else if (obj->ptr && obj->tag == TAG_CLOSURE) {
                     /* Closure has its own cleanup, but ptr points to Closure struct */
                     obj->ptr = NULL;
-                } else if (obj->ptr && (obj->tag == TAG_SYM || obj->tag == TAG_ERROR)) {
+                } else if (obj->ptr && obj->tag == TAG_VECTOR) {
+                    /* Drop the slots without releasing them */
+                    free(obj->ptr);
+                    obj->ptr = NULL;
+                } else if (obj->ptr && obj->tag == TAG_HASH) {
+                    hash_table_free((HashTable*)obj->ptr, NULL);
+                    obj->ptr = NULL;
+                } else if (obj->ptr && (obj->tag == TAG_PMAP || obj->tag == TAG_PVEC)) {
+                    /* Other versions may share the nodes: keep them */
+                    free(obj->ptr);
+                    obj->ptr = NULL;
+                } else if (obj->ptr && obj->tag == TAG_USER_BASE) {
+                    /* Drop the fields without releasing them */
+                    free(obj->ptr);
+                    obj->ptr = NULL;
+                } else if (obj->ptr && (obj->tag == TAG_SYM || obj->tag == TAG_STRING)) {
                     /* These have dynamically allocated strings */
                     free(obj->ptr);
                     obj->ptr = NULL;
+                } else if (obj->ptr && obj->tag == TAG_ERROR) {
+                    /* The tag, trace and payload are dropped unreleased */
+                    error_info_free(obj, NULL);
+                    obj->ptr = NULL;
+                    obj->b = NULL;
                 }
                 invalidate_weak_refs_for(obj);
                 borrow_invalidate_obj(obj);
@@ -1073,6 +1515,7 @@ void release_with_scc(Obj* obj) {
 void tarjan_strongconnect(Obj* v, TarjanState* state,
                                   void (*on_scc)(Obj**, int)) {
     if (!v || !state) return;
+    if (state->stack_top >= state->capacity) return;  /* Too deep: leave the rest unscanned */
 
     /* Use scan_tag field to store Tarjan index for this node */
     int v_idx = state->current_index++;
@@ -1087,7 +1530,7 @@ void tarjan_strongconnect(Obj* v, TarjanState* state,
         Obj* children[] = {v->a, v->b};
         for (int i = 0; i < 2; i++) {
             Obj* w = children[i];
-            if (!w) continue;
+            if (!w || IS_IMMEDIATE(w)) continue;
 
             int w_idx = (int)w->scan_tag;
             if (w_idx == 0) {
@@ -1136,6 +1579,7 @@ void on_scc_found(Obj** members, int count) {
 
 /* Detect and freeze SCCs starting from a root object */
 void detect_and_freeze_sccs(Obj* root) {
+    if (!root || IS_IMMEDIATE(root)) return;
     TarjanState* state = tarjan_init(1024);
     if (!state) return;
     tarjan_strongconnect(root, state, on_scc_found);
@@ -1261,6 +1705,89 @@ void set_deferred_batch_size(int size) {
     }
 }
 
+/* ========== Runtime Configuration ========== */
+/*
+ * See purple.h. The knobs are read once, before the program's first
+ * form, and only read after that, so threads need no lock to see them.
+ */
+
+enum { LOG_ERROR, LOG_WARN, LOG_INFO, LOG_DEBUG };
+enum { SCHED_THREADS, SCHED_INLINE };
+
+static const char* g_log_level_names[] = { "error", "warn", "info", "debug" };
+static const char* g_scheduler_names[] = { "threads", "inline" };
+
+static int g_log_level = LOG_WARN;
+static int g_scheduler = SCHED_THREADS;
+static unsigned long long g_heap_limit = 0;  /* Reported, not enforced */
+
+static void config_ignore(const char* var, const char* value) {
+    if (g_log_level >= LOG_WARN) fprintf(stderr, "purple: ignoring %s=%s\n", var, value);
+}
+
+/* Digits with an optional k, m or g suffix; 0 if v is not one */
+static int config_size(const char* v, unsigned long long* out) {
+    if (*v < '0' || *v > '9') return 0;
+    char* end;
+    unsigned long long n = strtoull(v, &end, 10);
+    int shift = *end == 'k' || *end == 'K' ? 10 : *end == 'm' || *end == 'M' ? 20
+              : *end == 'g' || *end == 'G' ? 30 : 0;
+    if (shift) end++;
+    if (*end || n > (ULLONG_MAX >> shift)) return 0;
+    *out = n << shift;
+    return 1;
+}
+
+/* The index of v in names, or -1 */
+static int config_choice(const char* v, const char** names, int count) {
+    for (int i = 0; i < count; i++) {
+        if (strcmp(v, names[i]) == 0) return i;
+    }
+    return -1;
+}
+
+void purple_load_config(void) {
+    const char* v;
+    unsigned long long n;
+    int i;
+    if ((v = getenv("PURPLE_LOG_LEVEL"))) {
+        if ((i = config_choice(v, g_log_level_names, 4)) >= 0) g_log_level = i;
+        else config_ignore("PURPLE_LOG_LEVEL", v);
+    }
+    if ((v = getenv("PURPLE_DEFERRED_BATCH"))) {
+        if (config_size(v, &n) && n > 0 && n <= INT_MAX) set_deferred_batch_size((int)n);
+        else config_ignore("PURPLE_DEFERRED_BATCH", v);
+    }
+    if ((v = getenv("PURPLE_FREELIST_BUDGET"))) {
+        if (config_size(v, &n) && n <= LONG_MAX) g_freelist_budget = (long)n;
+        else config_ignore("PURPLE_FREELIST_BUDGET", v);
+    }
+    if ((v = getenv("PURPLE_HEAP_LIMIT"))) {
+        if (config_size(v, &n)) g_heap_limit = n;
+        else config_ignore("PURPLE_HEAP_LIMIT", v);
+    }
+    if ((v = getenv("PURPLE_SCHEDULER"))) {
+        if ((i = config_choice(v, g_scheduler_names, 2)) >= 0) g_scheduler = i;
+        else config_ignore("PURPLE_SCHEDULER", v);
+    }
+    if (g_log_level >= LOG_INFO) {
+        fprintf(stderr, "purple: deferred-batch=%d freelist-budget=%ld heap-limit=%llu "
+                        "log-level=%s scheduler=%s\n",
+                DEFERRED_CTX.batch_size, g_freelist_budget, g_heap_limit,
+                g_log_level_names[g_log_level], g_scheduler_names[g_scheduler]);
+    }
+}
+
+Obj* prim_runtime_config(Obj* key) {
+    const char* k = obj_tag(key) == TAG_SYM && key->ptr ? (const char*)key->ptr : "";
+    if (strcmp(k, "deferred-batch") == 0) return mk_int(DEFERRED_CTX.batch_size);
+    if (strcmp(k, "freelist-budget") == 0) return mk_int(g_freelist_budget);
+    if (strcmp(k, "heap-limit") == 0) return mk_int((long)g_heap_limit);
+    if (strcmp(k, "log-level") == 0) return mk_sym(g_log_level_names[g_log_level]);
+    if (strcmp(k, "scheduler") == 0) return mk_sym(g_scheduler_names[g_scheduler]);
+    return mk_error_obj("runtime-config: unknown key", key);
+}
+
 /* Symmetric Reference Counting (Hybrid Memory Strategy) */
 /* Key insight: Treat scope as an object that participates in ownership graph */
 /* External refs: From live scopes/roots */
@@ -1455,6 +1982,117 @@ Obj* sym_get_data(SymObj* obj) {
     return obj ? (Obj*)obj->data : NULL;
 }
 
+/* ========== Memory Strategies ========== */
+/* set_memory_strategies() selects how compiled programs release the value
+ * of each top-level form (see strategy_release) and where int, float and
+ * pair cells come from. ASAP alone frees through dec_ref; the other
+ * strategies layer on top so each can be tested against the same program:
+ *   PERCEUS    freed cells go to a per-thread pool that constructors reuse
+ *   ARENA      cells come from a per-form arena, reset once its value is released
+ *   DEFERRED   the release is queued with defer_decrement and drained at exit
+ *   SYMMETRIC  the value is owned by a symmetric-RC scope that is exited
+ *   SCC        cycles are frozen into SCCs and released with release_with_scc */
+
+/* Same values as purple.h */
+#define PURPLE_STRATEGY_ASAP      0x01
+#define PURPLE_STRATEGY_PERCEUS   0x02
+#define PURPLE_STRATEGY_ARENA     0x04
+#define PURPLE_STRATEGY_DEFERRED  0x08
+#define PURPLE_STRATEGY_SYMMETRIC 0x10
+#define PURPLE_STRATEGY_SCC       0x20
+
+#define REUSE_POOL_MAX 1024
+
+static unsigned g_strategies = 0;
+static __thread Obj* g_reuse_pool = NULL;      /* Linked through ->a */
+static __thread int g_reuse_count = 0;
+static __thread Arena* g_form_arena = NULL;    /* Only the thread that set it */
+
+static Obj* obj_alloc(void) {
+    if (g_rc_logging) __atomic_add_fetch(&g_objs_made, 1, __ATOMIC_RELAXED);
+    if (g_form_arena) {
+        Obj* x = arena_alloc(g_form_arena, sizeof(Obj));
+        if (x) return x;
+    }
+    if (g_reuse_pool) {
+        Obj* x = g_reuse_pool;
+        g_reuse_pool = x->a;
+        g_reuse_count--;
+        return x;
+    }
+    return malloc(sizeof(Obj));
+}
+
+/* -2 marks arena cells, which RC never frees */
+static int obj_initial_mark(Obj* x) {
+    ArenaBlock* b = g_form_arena ? g_form_arena->current : NULL;
+    if (b && (char*)x >= b->memory && (char*)x < b->memory + b->used) return -2;
+    return 1;
+}
+
+static void obj_free_storage(Obj* x) {
+    if (g_rc_logging) __atomic_add_fetch(&g_objs_released, 1, __ATOMIC_RELAXED);
+    if ((g_strategies & PURPLE_STRATEGY_PERCEUS) && g_reuse_count < REUSE_POOL_MAX) {
+        x->a = g_reuse_pool;
+        g_reuse_pool = x;
+        g_reuse_count++;
+        return;
+    }
+    free(x);
+}
+
+static void strategies_at_exit(void) {
+    flush_deferred();
+    while (g_reuse_pool) {
+        Obj* x = g_reuse_pool;
+        g_reuse_pool = x->a;
+        free(x);
+    }
+    g_reuse_count = 0;
+}
+
+void set_memory_strategies(unsigned mask) {
+    static int registered = 0;
+    g_strategies = mask;
+    if ((mask & PURPLE_STRATEGY_ARENA) && !g_form_arena) g_form_arena = arena_create();
+    if (!(mask & PURPLE_STRATEGY_ARENA) && g_form_arena) {
+        arena_destroy(g_form_arena);
+        g_form_arena = NULL;
+    }
+    if (!registered) {
+        atexit(strategies_at_exit);
+        registered = 1;
+    }
+}
+
+unsigned get_memory_strategies(void) {
+    return g_strategies;
+}
+
+void strategy_release(Obj* x) {
+    if (x && !IS_IMMEDIATE(x) && !is_stack_obj(x) && x->mark != -2) {
+        if (g_strategies & PURPLE_STRATEGY_SCC) detect_and_freeze_sccs(x);
+        if (g_strategies & PURPLE_STRATEGY_SYMMETRIC) {
+            SymScope* scope = sym_enter_scope();
+            if (scope) {
+                sym_scope_own(scope, sym_obj_new(x));
+                sym_exit_scope();
+            } else {
+                dec_ref(x);
+            }
+        } else if (g_strategies & PURPLE_STRATEGY_SCC) {
+            release_with_scc(x);
+        } else if (g_strategies & PURPLE_STRATEGY_DEFERRED) {
+            defer_decrement(x);
+            safe_point();
+        } else {
+            dec_ref(x);
+        }
+    }
+    /* Nothing from this form is reachable once its value is released */
+    if (g_form_arena) arena_reset(g_form_arena);
+}
+
 
 /* ========== Region References (v0.5.0) ========== */
 /* Vale/Ada/SPARK-style scope hierarchy validation */
@@ -1878,9 +2516,11 @@ struct Closure {
     BorrowRef** capture_refs;
     int capture_count;
     int arity;
+    const char* name;            /* Source name for printing, or NULL */
 };
 
 Obj* mk_closure(ClosureFn fn, Obj** captures, BorrowRef** refs, int count, int arity) {
+    budget_charge();
     Obj* x = malloc(sizeof(Obj));
     if (!x) return NULL;
     x->mark = 1;
@@ -1973,6 +2613,239 @@ Obj* call_closure(Obj* clos, Obj** args, int arg_count) {
     return c->fn ? c->fn(c->captures, args, arg_count) : NULL;
 }
 
+/* Inline call cache; see purple.h */
+typedef struct OmniCallCache {
+    unsigned version;
+    ClosureFn fn;
+    Obj** captures;
+} OmniCallCache;
+
+Obj* omni_call_cached(OmniCallCache* ic, Obj* clos, unsigned version, Obj** args, int arg_count) {
+    if (!ic->fn || ic->version != version) {
+        Closure* c = obj_tag(clos) == TAG_CLOSURE ? (Closure*)clos->ptr : NULL;
+        if (!c || !c->fn || (c->arity >= 0 && arg_count != c->arity) || c->capture_refs) {
+            return call_closure(clos, args, arg_count);
+        }
+        ic->fn = c->fn;
+        ic->captures = c->captures;
+        ic->version = version;
+    }
+    return ic->fn(ic->captures, args, arg_count);
+}
+
+/* Module ABI; see purple.h */
+#define PURPLE_ABI_VERSION 1
+
+typedef struct PurpleTypeDescriptor {
+    const char* name;
+    int tag;
+} PurpleTypeDescriptor;
+
+typedef struct PurpleAbi {
+    unsigned version;
+    unsigned obj_size;
+    unsigned call_cache_size;
+    const PurpleTypeDescriptor* types;
+    unsigned type_count;
+} PurpleAbi;
+
+#define PURPLE_ABI_TYPES { \
+    { "int", TAG_INT }, { "float", TAG_FLOAT }, { "char", TAG_CHAR }, \
+    { "pair", TAG_PAIR }, { "sym", TAG_SYM }, { "box", TAG_BOX }, \
+    { "closure", TAG_CLOSURE }, { "channel", TAG_CHANNEL }, { "error", TAG_ERROR }, \
+    { "atom", TAG_ATOM }, { "thread", TAG_THREAD }, { "string", TAG_STRING }, \
+    { "vector", TAG_VECTOR }, { "hash", TAG_HASH }, { "cancel", TAG_CANCEL }, \
+    { "port", TAG_PORT }, { "pmap", TAG_PMAP }, { "pvec", TAG_PVEC }, \
+    { "pool", TAG_POOL }, { "keyword", TAG_KEYWORD }, { "user", TAG_USER_BASE } \
+}
+
+static const PurpleTypeDescriptor g_abi_types[] = PURPLE_ABI_TYPES;
+
+static const PurpleAbi g_abi = {
+    PURPLE_ABI_VERSION, sizeof(Obj), sizeof(OmniCallCache),
+    g_abi_types, sizeof(g_abi_types) / sizeof(g_abi_types[0])
+};
+
+const PurpleAbi* purple_abi(void) {
+    return &g_abi;
+}
+
+int purple_abi_check(const PurpleAbi* abi, char* why, size_t cap) {
+    char none[1];
+    if (!why || cap == 0) {
+        why = none;
+        cap = sizeof(none);
+    }
+    if (!abi) {
+        snprintf(why, cap, "no ABI record (built before ABI version %d?); rebuild it", PURPLE_ABI_VERSION);
+        return 0;
+    }
+    if (abi->version != g_abi.version) {
+        snprintf(why, cap, "built for ABI version %u, the runtime has version %u; rebuild it",
+                 abi->version, g_abi.version);
+        return 0;
+    }
+    if (abi->obj_size != g_abi.obj_size) {
+        snprintf(why, cap, "expects %u-byte objects, the runtime's are %u bytes "
+                 "(built with a different IPGE_ROBUST_MODE?)", abi->obj_size, g_abi.obj_size);
+        return 0;
+    }
+    if (abi->call_cache_size != g_abi.call_cache_size) {
+        snprintf(why, cap, "expects %u-byte call caches, the runtime's are %u bytes",
+                 abi->call_cache_size, g_abi.call_cache_size);
+        return 0;
+    }
+    for (unsigned i = 0; i < abi->type_count; i++) {
+        const PurpleTypeDescriptor* t = &abi->types[i];
+        const PurpleTypeDescriptor* mine = NULL;
+        for (unsigned j = 0; j < g_abi.type_count && !mine; j++) {
+            if (strcmp(g_abi.types[j].name, t->name) == 0) mine = &g_abi.types[j];
+        }
+        if (!mine) {
+            snprintf(why, cap, "uses type %s, which the runtime does not have", t->name);
+            return 0;
+        }
+        if (mine->tag != t->tag) {
+            snprintf(why, cap, "numbers type %s as tag %d, the runtime as tag %d",
+                     t->name, t->tag, mine->tag);
+            return 0;
+        }
+    }
+    why[0] = '\0';
+    return 1;
+}
+
+/* ========== Crash Reports ========== */
+/*
+ * See purple.h. Compiled functions push their names on a per-thread
+ * shadow stack as they are entered and pop them on return; frames a
+ * nonlocal exit can unwind to put back the depth they saw. The report is
+ * written with write(2) from the crashing thread, then the signal is
+ * raised again with its default action, so the exit status and any core
+ * dump are what they would have been.
+ */
+
+#define SHADOW_DEPTH 256
+
+static __thread const char* g_shadow[SHADOW_DEPTH];
+static __thread int g_shadow_depth = 0;
+
+void purple_enter(const char* fn) {
+    if (g_shadow_depth < SHADOW_DEPTH) g_shadow[g_shadow_depth] = fn;
+    g_shadow_depth++;
+}
+
+Obj* purple_leave(Obj* result) {
+    if (g_shadow_depth > 0) g_shadow_depth--;
+    return result;
+}
+
+int purple_shadow_depth(void) {
+    return g_shadow_depth;
+}
+
+/* The function stack as a list of names, innermost first */
+static Obj* error_trace(void) {
+    Obj* trace = NULL;
+    int depth = g_shadow_depth < SHADOW_DEPTH ? g_shadow_depth : SHADOW_DEPTH;
+    for (int i = 0; i < depth; i++) trace = mk_pair(mk_sym(g_shadow[i]), trace);
+    return trace;
+}
+
+void purple_shadow_restore(int depth) {
+    g_shadow_depth = depth;
+}
+
+static const char* crash_tag_name(int tag) {
+    if (tag >= TAG_USER_BASE) return "user";
+    for (unsigned i = 0; i < g_abi.type_count; i++) {
+        if (g_abi.types[i].tag == tag) return g_abi.types[i].name;
+    }
+    return "freed";
+}
+
+#define CRASH_SAY(...) do { \
+    char line_[160]; \
+    int n_ = snprintf(line_, sizeof(line_), __VA_ARGS__); \
+    if (n_ > 0 && write(2, line_, n_ < (int)sizeof(line_) ? (size_t)n_ : sizeof(line_) - 1) < 0) {} \
+} while (0)
+
+static void crash_report(int sig) {
+    const char* what = sig == SIGSEGV ? "segmentation fault" : sig == SIGBUS ? "bus error" :
+                       sig == SIGFPE ? "arithmetic exception" : sig == SIGILL ? "illegal instruction" :
+                       "abort";
+    CRASH_SAY("purple: crashed with %s\n", what);
+
+    CRASH_SAY("function stack, innermost first:\n");
+    if (g_shadow_depth == 0) CRASH_SAY("  (no compiled function running)\n");
+    for (int i = g_shadow_depth; i-- > 0;) {
+        if (i >= SHADOW_DEPTH) {
+            CRASH_SAY("  ... %d frames too deep to keep\n", g_shadow_depth - SHADOW_DEPTH);
+            i = SHADOW_DEPTH;
+            continue;
+        }
+        CRASH_SAY("  %s\n", g_shadow[i]);
+    }
+
+    unsigned long ops = g_rc_ops;
+    CRASH_SAY("last reference count changes, oldest first:\n");
+    if (ops == 0) CRASH_SAY("  (none)\n");
+    for (unsigned long i = ops > RC_RING ? ops - RC_RING : 0; i < ops; i++) {
+        RcOp* r = &g_rc_ring[i % RC_RING];
+        CRASH_SAY("  %s %p (%s, count %d)\n", r->op, (void*)r->obj, crash_tag_name(r->tag), r->mark);
+    }
+
+    CRASH_SAY("heap: %lu objects made, %lu released, %d on the free list\n",
+              g_objs_made, g_objs_released, FREE_COUNT);
+}
+
+static void crash_handler(int sig) {
+    crash_report(sig);
+    signal(sig, SIG_DFL);
+    raise(sig);
+}
+
+void purple_install_crash_handler(void) {
+    static const int signals[] = { SIGSEGV, SIGBUS, SIGFPE, SIGILL, SIGABRT };
+    struct sigaction sa;
+    memset(&sa, 0, sizeof(sa));
+    sa.sa_handler = crash_handler;
+    sigemptyset(&sa.sa_mask);
+    for (size_t i = 0; i < sizeof(signals) / sizeof(signals[0]); i++) {
+        sigaction(signals[i], &sa, NULL);
+    }
+    g_rc_logging = 1;
+}
+
+/* Attach a source name used when printing; name must outlive the closure */
+Obj* closure_named(Obj* clos, const char* name) {
+    if (obj_tag(clos) == TAG_CLOSURE && clos->ptr) {
+        ((Closure*)clos->ptr)->name = name;
+    }
+    return clos;
+}
+
+static void write_closure(FILE* out, Obj* x) {
+    Closure* c = (Closure*)x->ptr;
+    if (!c) {
+        fputs("#<closure>", out);
+    } else if (c->name) {
+        fprintf(out, "#<closure %s arity %d>", c->name, c->arity);
+    } else {
+        fprintf(out, "#<closure arity %d>", c->arity);
+    }
+}
+
+/* Closures without captures are identified by their code, so every
+ * reference to the same named function is eq? to the others */
+static int closure_same(Obj* a, Obj* b) {
+    Closure* ca = (Closure*)a->ptr;
+    Closure* cb = (Closure*)b->ptr;
+    if (a == b) return 1;
+    if (!ca || !cb) return 0;
+    return ca->fn == cb->fn && ca->capture_count == 0 && cb->capture_count == 0;
+}
+
 
 /* ========== Constraint References (v0.5.0) ========== */
 /* Assertion-based safety for complex patterns */
@@ -2176,10 +3049,9 @@ Obj* div_op(Obj* a, Obj* b) {
         return mk_int_unboxed(IMMEDIATE_VALUE(a) / bv);
     }
     if (!a || !b) return mk_int_unboxed(0);
+    /* IEEE: a float divided by zero is an infinity, or NaN for 0/0 */
     if (num_is_float(a) || num_is_float(b)) {
-        double denom = num_to_double(b);
-        if (denom == 0.0) return mk_float(0.0);
-        return mk_float(num_to_double(a) / denom);
+        return mk_float(num_to_double(a) / num_to_double(b));
     }
     long bv = obj_to_int(b);
     if (bv == 0) return mk_int_unboxed(0);
@@ -2198,122 +3070,1348 @@ Obj* mod_op(Obj* a, Obj* b) {
 }
 
 /* Comparison Operations - with unboxed integer support */
-Obj* eq_op(Obj* a, Obj* b) {
+
+/*
+ * Numeric ordering across the tower. Two ints compare as integers and two
+ * floats as doubles. An int and a float compare by exact value, so a large
+ * int is never rounded to a nearby double: (= 9007199254740993 9007199254740992.0)
+ * is false. Anything involving NaN is unordered, which makes every
+ * comparison false.
+ */
+#define NUM_LT (-1)
+#define NUM_EQ 0
+#define NUM_GT 1
+#define NUM_UNORDERED 2
+
+static int cmp_int_float(long i, double f) {
+    if (f != f) return NUM_UNORDERED;
+    if (f >= 9223372036854775808.0) return NUM_LT;
+    if (f < -9223372036854775808.0) return NUM_GT;
+    long t = (long)f;  /* truncation is exact in this range */
+    if (i < t) return NUM_LT;
+    if (i > t) return NUM_GT;
+    double td = (double)t;
+    if (f > td) return NUM_LT;
+    if (f < td) return NUM_GT;
+    return NUM_EQ;
+}
+
+int num_compare(Obj* a, Obj* b) {
+    int af = num_is_float(a), bf = num_is_float(b);
+    if (af && bf) {
+        double x = a->f, y = b->f;
+        if (x != x || y != y) return NUM_UNORDERED;
+        return x < y ? NUM_LT : (x > y ? NUM_GT : NUM_EQ);
+    }
+    if (af) {
+        int c = cmp_int_float(obj_to_int(b), a->f);
+        return c == NUM_UNORDERED ? c : -c;
+    }
+    if (bf) return cmp_int_float(obj_to_int(a), b->f);
+    long x = obj_to_int(a), y = obj_to_int(b);
+    return x < y ? NUM_LT : (x > y ? NUM_GT : NUM_EQ);
+}
+
+/* The comparisons as C truth values, which compiled tests use unboxed */
+int test_eq(Obj* a, Obj* b) {
     /* Fast path: both immediate */
-    if (IS_IMMEDIATE(a) && IS_IMMEDIATE(b)) {
-        return mk_int_unboxed(a == b ? 1 : 0);
-    }
-    if (!a && !b) return mk_int_unboxed(1);
-    if (!a || !b) return mk_int_unboxed(0);
-    if (num_is_float(a) || num_is_float(b)) {
-        return mk_int_unboxed(num_to_double(a) == num_to_double(b) ? 1 : 0);
-    }
-    return mk_int_unboxed(obj_to_int(a) == obj_to_int(b) ? 1 : 0);
+    if (IS_IMMEDIATE(a) && IS_IMMEDIATE(b)) return a == b;
+    if (!a && !b) return 1;
+    if (!a || !b) return 0;
+    return num_compare(a, b) == NUM_EQ;
 }
 
-Obj* lt_op(Obj* a, Obj* b) {
-    if (IS_IMMEDIATE(a) && IS_IMMEDIATE(b)) {
-        return mk_int_unboxed(IMMEDIATE_VALUE(a) < IMMEDIATE_VALUE(b) ? 1 : 0);
-    }
-    if (!a || !b) return mk_int_unboxed(0);
-    if (num_is_float(a) || num_is_float(b)) {
-        return mk_int_unboxed(num_to_double(a) < num_to_double(b) ? 1 : 0);
+int test_lt(Obj* a, Obj* b) {
+    if (IS_IMMEDIATE(a) && IS_IMMEDIATE(b)) return IMMEDIATE_VALUE(a) < IMMEDIATE_VALUE(b);
+    if (!a || !b) return 0;
+    return num_compare(a, b) == NUM_LT;
+}
+
+int test_gt(Obj* a, Obj* b) {
+    if (IS_IMMEDIATE(a) && IS_IMMEDIATE(b)) return IMMEDIATE_VALUE(a) > IMMEDIATE_VALUE(b);
+    if (!a || !b) return 0;
+    return num_compare(a, b) == NUM_GT;
+}
+
+int test_le(Obj* a, Obj* b) {
+    if (IS_IMMEDIATE(a) && IS_IMMEDIATE(b)) return IMMEDIATE_VALUE(a) <= IMMEDIATE_VALUE(b);
+    if (!a || !b) return 0;
+    int c = num_compare(a, b);
+    return c == NUM_LT || c == NUM_EQ;
+}
+
+int test_ge(Obj* a, Obj* b) {
+    if (IS_IMMEDIATE(a) && IS_IMMEDIATE(b)) return IMMEDIATE_VALUE(a) >= IMMEDIATE_VALUE(b);
+    if (!a || !b) return 0;
+    int c = num_compare(a, b);
+    return c == NUM_GT || c == NUM_EQ;
+}
+
+Obj* eq_op(Obj* a, Obj* b) { return mk_int_unboxed(test_eq(a, b)); }
+Obj* lt_op(Obj* a, Obj* b) { return mk_int_unboxed(test_lt(a, b)); }
+Obj* gt_op(Obj* a, Obj* b) { return mk_int_unboxed(test_gt(a, b)); }
+Obj* le_op(Obj* a, Obj* b) { return mk_int_unboxed(test_le(a, b)); }
+Obj* ge_op(Obj* a, Obj* b) { return mk_int_unboxed(test_ge(a, b)); }
+
+Obj* not_op(Obj* a) {
+    if (!a) return mk_int_unboxed(1);
+    if (IS_IMMEDIATE(a)) {
+        return mk_int_unboxed(IMMEDIATE_VALUE(a) == 0 ? 1 : 0);
+    }
+    return mk_int_unboxed(a->i == 0 ? 1 : 0);
+}
+
+int is_truthy(Obj* x) {
+    if (!x) return 0;
+    /* Fast path: immediate integer */
+    if (IS_IMMEDIATE(x)) {
+        return IMMEDIATE_VALUE(x) != 0;
+    }
+    switch (x->tag) {
+    case TAG_INT:
+        return x->i != 0;
+    case TAG_FLOAT:
+        return x->f != 0.0;
+    case TAG_CHAR:
+        return x->i != 0;
+    default:
+        return 1;
+    }
+}
+
+/* Primitive aliases for compiler */
+Obj* prim_add(Obj* a, Obj* b) { return add(a, b); }
+Obj* prim_sub(Obj* a, Obj* b) { return sub(a, b); }
+Obj* prim_mul(Obj* a, Obj* b) { return mul(a, b); }
+Obj* prim_div(Obj* a, Obj* b) { return div_op(a, b); }
+Obj* prim_mod(Obj* a, Obj* b) { return mod_op(a, b); }
+Obj* prim_lt(Obj* a, Obj* b) { return lt_op(a, b); }
+Obj* prim_gt(Obj* a, Obj* b) { return gt_op(a, b); }
+Obj* prim_le(Obj* a, Obj* b) { return le_op(a, b); }
+Obj* prim_ge(Obj* a, Obj* b) { return ge_op(a, b); }
+Obj* prim_eq(Obj* a, Obj* b) { return eq_op(a, b); }
+
+/* Identity: immediates, ints, chars, symbols and strings by value,
+ * closures by code, everything else by pointer */
+static int is_eq_obj(Obj* a, Obj* b) {
+    if (a == b) return 1;
+    int ta = obj_tag(a);
+    if (!a || !b || ta != obj_tag(b)) return 0;
+    switch (ta) {
+    case TAG_INT:
+    case TAG_CHAR:
+        return obj_to_int(a) == obj_to_int(b);
+    case TAG_SYM:
+    case TAG_STRING:
+        return a->ptr && b->ptr && strcmp((char*)a->ptr, (char*)b->ptr) == 0;
+    case TAG_CLOSURE:
+        return closure_same(a, b);
+    default:
+        return 0;
+    }
+}
+
+int test_is_eq(Obj* a, Obj* b) { return is_eq_obj(a, b); }
+Obj* prim_is_eq(Obj* a, Obj* b) { return mk_int_unboxed(is_eq_obj(a, b)); }
+
+/* Hash consistent with is_eq_obj */
+static unsigned long hash_code(Obj* x) {
+    unsigned long h;
+    switch (obj_tag(x)) {
+    case TAG_INT:
+    case TAG_CHAR:
+        h = (unsigned long)obj_to_int(x);
+        break;
+    case TAG_SYM:
+    case TAG_STRING: {
+        h = 1469598103934665603UL;
+        for (const char* s = x->ptr ? (const char*)x->ptr : ""; *s; s++) {
+            h = (h ^ (unsigned char)*s) * 1099511628211UL;
+        }
+        break;
+    }
+    case TAG_CLOSURE: {
+        Closure* c = (Closure*)x->ptr;
+        h = (c && c->capture_count == 0) ? (unsigned long)(uintptr_t)c->fn
+                                         : (unsigned long)(uintptr_t)x;
+        break;
+    }
+    default:
+        h = (unsigned long)(uintptr_t)x;
+        break;
+    }
+    return h * 0x9E3779B97F4A7C15UL;
+}
+
+Obj* prim_hash(Obj* x) {
+    return mk_int_unboxed((long)(hash_code(x) >> 4));  /* fits an immediate */
+}
+
+int test_is_procedure(Obj* x) { return obj_tag(x) == TAG_CLOSURE; }
+Obj* prim_is_procedure(Obj* x) {
+    return mk_int_unboxed(test_is_procedure(x));
+}
+
+Obj* prim_arity(Obj* x) {
+    if (obj_tag(x) != TAG_CLOSURE || !x->ptr) return mk_error("arity: not a procedure");
+    return mk_int_unboxed(((Closure*)x->ptr)->arity);
+}
+Obj* prim_not(Obj* a) { return not_op(a); }
+Obj* prim_abs(Obj* a) {
+    if (!a) return mk_int_unboxed(0);
+    if (IS_IMMEDIATE(a)) {
+        long v = IMMEDIATE_VALUE(a);
+        return mk_int_unboxed(v < 0 ? -v : v);
+    }
+    if (a->tag == TAG_FLOAT) return mk_float(a->f < 0 ? -a->f : a->f);
+    return mk_int_unboxed(a->i < 0 ? -a->i : a->i);
+}
+
+/*
+ * Numeric library. Results follow the tower: ints in, int out; a float
+ * anywhere makes the result a float. expt and sqrt stay exact when they
+ * can, so (expt 2 10) is 1024 and (sqrt 16) is 4, but (sqrt 2) is a float,
+ * and so is (expt 2 64), which no int holds.
+ */
+Obj* prim_min(Obj* a, Obj* b) {
+    int c = num_compare(a, b);
+    int inexact = num_is_float(a) || num_is_float(b);
+    if (c == NUM_UNORDERED) return mk_float(NAN);
+    Obj* r = c == NUM_GT ? b : a;
+    return inexact ? mk_float(num_to_double(r)) : mk_int_unboxed(obj_to_int(r));
+}
+
+Obj* prim_max(Obj* a, Obj* b) {
+    int c = num_compare(a, b);
+    int inexact = num_is_float(a) || num_is_float(b);
+    if (c == NUM_UNORDERED) return mk_float(NAN);
+    Obj* r = c == NUM_LT ? b : a;
+    return inexact ? mk_float(num_to_double(r)) : mk_int_unboxed(obj_to_int(r));
+}
+
+Obj* prim_expt(Obj* base, Obj* power) {
+    if (num_is_float(base) || num_is_float(power) || obj_to_int(power) < 0) {
+        return mk_float(pow(num_to_double(base), num_to_double(power)));
+    }
+    /* Square-and-multiply, giving up on ints at the first overflow */
+    long b = obj_to_int(base);
+    unsigned long e = (unsigned long)obj_to_int(power);
+    long r = 1;
+    for (;;) {
+        if ((e & 1) && __builtin_mul_overflow(r, b, &r)) break;
+        e >>= 1;
+        if (!e) return mk_int_unboxed(r);
+        if (__builtin_mul_overflow(b, b, &b)) break;
+    }
+    return mk_float(pow(num_to_double(base), num_to_double(power)));
+}
+
+static unsigned long gcd_ulong(unsigned long a, unsigned long b) {
+    while (b) {
+        unsigned long t = a % b;
+        a = b;
+        b = t;
+    }
+    return a;
+}
+
+/* The magnitude of an integer operand, exact for LONG_MIN; false for a
+ * float with a fraction, or one that is not finite */
+static bool int_magnitude(Obj* x, unsigned long* out) {
+    if (num_is_float(x)) {
+        double f = fabs(x->f);
+        if (f != floor(f) || f >= 18446744073709551616.0) return false;
+        *out = (unsigned long)f;
+        return true;
+    }
+    long v = obj_to_int(x);
+    *out = v < 0 ? 0UL - (unsigned long)v : (unsigned long)v;
+    return true;
+}
+
+/* As expt: a float if an operand was one or no int holds the result */
+static Obj* magnitude_result(Obj* a, Obj* b, unsigned long v) {
+    if (num_is_float(a) || num_is_float(b) || v > LONG_MAX) return mk_float((double)v);
+    return mk_int_unboxed((long)v);
+}
+
+Obj* prim_gcd(Obj* a, Obj* b) {
+    unsigned long x, y;
+    if (!int_magnitude(a, &x) || !int_magnitude(b, &y)) return mk_error("gcd: not an integer");
+    return magnitude_result(a, b, gcd_ulong(x, y));
+}
+
+Obj* prim_lcm(Obj* a, Obj* b) {
+    unsigned long x, y, l;
+    if (!int_magnitude(a, &x) || !int_magnitude(b, &y)) return mk_error("lcm: not an integer");
+    if (x == 0 || y == 0) return magnitude_result(a, b, 0);
+    x /= gcd_ulong(x, y);
+    if (__builtin_mul_overflow(x, y, &l)) return mk_float((double)x * (double)y);
+    return magnitude_result(a, b, l);
+}
+
+Obj* prim_sqrt(Obj* a) {
+    if (num_is_float(a)) return mk_float(sqrt(a->f));
+    long n = obj_to_int(a);
+    if (n >= 0) {
+        /* Exact root for perfect squares; correct the double estimate */
+        unsigned long r = (unsigned long)sqrt((double)n);
+        while (r * r > (unsigned long)n) r--;
+        while ((r + 1) * (r + 1) <= (unsigned long)n) r++;
+        if (r * r == (unsigned long)n) return mk_int_unboxed((long)r);
+    }
+    return mk_float(sqrt((double)n));
+}
+
+/* Type predicate wrappers - return Obj* for uniformity */
+/* Use obj_tag() to handle immediate values (tagged pointers) */
+int test_null(Obj* x) { return x == NULL; }
+Obj* prim_null(Obj* x) { return mk_int(test_null(x)); }
+Obj* prim_pair(Obj* x) { return mk_int(x && obj_tag(x) == TAG_PAIR ? 1 : 0); }
+Obj* prim_int(Obj* x) { return mk_int(obj_tag(x) == TAG_INT ? 1 : 0); }
+Obj* prim_float(Obj* x) { return mk_int(x && obj_tag(x) == TAG_FLOAT ? 1 : 0); }
+Obj* prim_char(Obj* x) { return mk_int(obj_tag(x) == TAG_CHAR ? 1 : 0); }
+Obj* prim_sym(Obj* x) { return mk_int(x && obj_tag(x) == TAG_SYM ? 1 : 0); }
+int test_is_keyword(Obj* x) { return x && obj_tag(x) == TAG_KEYWORD; }
+Obj* prim_is_keyword(Obj* x) { return mk_int(test_is_keyword(x)); }
+
+/* Error Primitives */
+Obj* prim_error(Obj* msg, Obj* data) {
+    char buf[32];
+    const char* text = "error";
+    if (msg && (obj_tag(msg) == TAG_SYM || obj_tag(msg) == TAG_STRING) && msg->ptr) {
+        text = (const char*)msg->ptr;
+    } else if (error_message(msg)) {
+        text = error_message(msg);
+    } else if (msg && obj_tag(msg) == TAG_INT) {
+        snprintf(buf, sizeof(buf), "%ld", obj_to_int(msg));
+        text = buf;
+    }
+    Obj* e = mk_error_obj(text, data);
+    /* A symbol names the error's kind; an error passes its kind on */
+    Obj* tag = obj_tag(msg) == TAG_SYM ? msg : error_message(msg) ? ERROR_INFO(msg)->tag : NULL;
+    if (error_message(e) && tag) {
+        inc_ref(tag);
+        ERROR_INFO(e)->tag = tag;
+    }
+    return e;
+}
+
+Obj* prim_error_message(Obj* e) {
+    const char* msg = error_message(e);
+    return msg ? mk_sym(msg) : NULL;
+}
+
+Obj* prim_error_data(Obj* e) {
+    Obj* data = error_data(e);
+    if (data) inc_ref(data);
+    return data;
+}
+
+Obj* prim_error_tag(Obj* e) {
+    if (!is_error(e)) return NULL;
+    Obj* tag = e->ptr ? ERROR_INFO(e)->tag : NULL;
+    if (!tag) return mk_sym("error");
+    inc_ref(tag);
+    return tag;
+}
+
+Obj* prim_error_trace(Obj* e) {
+    Obj* trace = error_message(e) ? ERROR_INFO(e)->trace : NULL;
+    if (trace) inc_ref(trace);
+    return trace;
+}
+
+int test_is_error(Obj* x) { return is_error(x) ? 1 : 0; }
+Obj* prim_is_error(Obj* x) { return mk_int(test_is_error(x)); }
+
+/* String Primitives: arguments borrowed, results owned */
+static int is_string_obj(Obj* x) { return x && obj_tag(x) == TAG_STRING && x->ptr; }
+static int is_index(Obj* x) { return x && obj_tag(x) == TAG_INT; }
+
+int test_is_string(Obj* x) { return is_string_obj(x); }
+Obj* prim_is_string(Obj* x) { return mk_int(is_string_obj(x)); }
+
+Obj* prim_string_length(Obj* s) {
+    if (!is_string_obj(s)) return mk_error("string-length: not a string");
+    return mk_int((long)strlen((const char*)s->ptr));
+}
+
+Obj* prim_string_append(Obj* a, Obj* b) {
+    if (!is_string_obj(a) || !is_string_obj(b)) return mk_error("string-append: not a string");
+    size_t la = strlen((const char*)a->ptr), lb = strlen((const char*)b->ptr);
+    char* buf = malloc(la + lb + 1);
+    if (!buf) return NULL;
+    memcpy(buf, a->ptr, la);
+    memcpy(buf + la, b->ptr, lb + 1);
+    Obj* r = mk_string(buf);
+    free(buf);
+    return r;
+}
+
+Obj* prim_string_ref(Obj* s, Obj* i) {
+    if (!is_string_obj(s)) return mk_error("string-ref: not a string");
+    long k = is_index(i) ? obj_to_int(i) : -1;
+    if (k < 0 || (size_t)k >= strlen((const char*)s->ptr)) return mk_error("string-ref: index out of range");
+    return mk_char((unsigned char)((const char*)s->ptr)[k]);
+}
+
+Obj* prim_substring(Obj* s, Obj* start, Obj* end) {
+    if (!is_string_obj(s)) return mk_error("substring: not a string");
+    long len = (long)strlen((const char*)s->ptr);
+    long from = is_index(start) ? obj_to_int(start) : -1;
+    long to = is_index(end) ? obj_to_int(end) : -1;
+    if (from < 0 || to < from || to > len) return mk_error("substring: index out of range");
+    char* buf = malloc((size_t)(to - from) + 1);
+    if (!buf) return NULL;
+    memcpy(buf, (const char*)s->ptr + from, (size_t)(to - from));
+    buf[to - from] = '\0';
+    Obj* r = mk_string(buf);
+    free(buf);
+    return r;
+}
+
+/* Vector Primitives: arguments borrowed, results owned */
+static int is_vector_obj(Obj* x) { return x && obj_tag(x) == TAG_VECTOR && x->ptr; }
+
+static Obj* mk_vector(long n, Obj* init) {
+    budget_charge();
+    Vector* v = malloc(sizeof(Vector) + (size_t)n * sizeof(Obj*));
+    Obj* x = v ? malloc(sizeof(Obj)) : NULL;
+    if (!x) {
+        free(v);
+        return NULL;
+    }
+    x->generation = _next_generation();
+    x->mark = 1;
+    x->tag = TAG_VECTOR;
+    x->is_pair = 0;
+    x->scc_id = -1;
+    x->scan_tag = 0;
+    v->len = n;
+    for (long i = 0; i < n; i++) {
+        if (init) inc_ref(init);
+        v->items[i] = init;
+    }
+    x->ptr = v;
+    return x;
+}
+
+Obj* prim_vector_of(Obj** items, int n) {
+    Obj* x = mk_vector(n, NULL);
+    if (!x) return NULL;
+    Vector* v = (Vector*)x->ptr;
+    for (int i = 0; i < n; i++) {
+        if (items[i]) inc_ref(items[i]);
+        v->items[i] = items[i];
+    }
+    return x;
+}
+
+Obj* prim_make_vector(Obj* n, Obj* init) {
+    long len = is_index(n) ? obj_to_int(n) : -1;
+    if (len < 0) return mk_error("make-vector: length must be a non-negative integer");
+    return mk_vector(len, init);
+}
+
+int test_is_vector(Obj* x) { return is_vector_obj(x); }
+Obj* prim_is_vector(Obj* x) { return mk_int(is_vector_obj(x)); }
+
+Obj* prim_vector_length(Obj* v) {
+    if (!is_vector_obj(v)) return mk_error("vector-length: not a vector");
+    return mk_int(((Vector*)v->ptr)->len);
+}
+
+Obj* prim_vector_ref(Obj* v, Obj* i) {
+    if (!is_vector_obj(v)) return mk_error("vector-ref: not a vector");
+    Vector* vec = (Vector*)v->ptr;
+    long k = is_index(i) ? obj_to_int(i) : -1;
+    if (k < 0 || k >= vec->len) return mk_error("vector-ref: index out of range");
+    if (vec->items[k]) inc_ref(vec->items[k]);
+    return vec->items[k];
+}
+
+Obj* prim_vector_set(Obj* v, Obj* i, Obj* x) {
+    if (!is_vector_obj(v)) return mk_error("vector-set!: not a vector");
+    Vector* vec = (Vector*)v->ptr;
+    long k = is_index(i) ? obj_to_int(i) : -1;
+    if (k < 0 || k >= vec->len) return mk_error("vector-set!: index out of range");
+    if (x) inc_ref(x);
+    Obj* old = vec->items[k];
+    vec->items[k] = x;
+    dec_ref(old);
+    return NULL;
+}
+
+/* Hash Table Primitives: arguments borrowed, results owned. Keys compare
+ * with eq? and hash with hash. The table holds its own reference to each
+ * key and value, released when the entry goes or the table is freed. */
+static int is_hash_obj(Obj* x) { return x && obj_tag(x) == TAG_HASH && x->ptr; }
+
+/* Free the entries, handing each key and value to release (NULL drops
+ * them without releasing, for tables already being torn down) */
+static void hash_table_free(HashTable* t, void (*release)(Obj*)) {
+    HashNode* n = t->first;
+    while (n) {
+        HashNode* next = n->next;
+        if (release) {
+            release(n->key);
+            release(n->value);
+        }
+        free(n);
+        n = next;
+    }
+    free(t->buckets);
+    free(t);
+}
+
+static HashNode** hash_bucket(HashTable* t, unsigned long code) {
+    return &t->buckets[(code ^ (code >> 32)) & (unsigned long)(t->bucket_count - 1)];
+}
+
+/* The link pointing at key's node, or at the NULL ending its bucket */
+static HashNode** hash_link(HashTable* t, Obj* key, unsigned long code) {
+    HashNode** link = hash_bucket(t, code);
+    while (*link && !((*link)->code == code && is_eq_obj((*link)->key, key))) {
+        link = &(*link)->chain;
+    }
+    return link;
+}
+
+/* Double the buckets, rechaining in insertion order */
+static void hash_grow(HashTable* t) {
+    HashNode** buckets = calloc((size_t)t->bucket_count * 2, sizeof(HashNode*));
+    if (!buckets) return;  /* Keep the longer chains */
+    free(t->buckets);
+    t->buckets = buckets;
+    t->bucket_count *= 2;
+    for (HashNode* n = t->first; n; n = n->next) {
+        HashNode** b = hash_bucket(t, n->code);
+        n->chain = *b;
+        *b = n;
+    }
+}
+
+Obj* prim_make_hash(void) {
+    budget_charge();
+    HashTable* t = calloc(1, sizeof(HashTable));
+    HashNode** buckets = t ? calloc(8, sizeof(HashNode*)) : NULL;
+    Obj* x = buckets ? malloc(sizeof(Obj)) : NULL;
+    if (!x) {
+        free(buckets);
+        free(t);
+        return NULL;
+    }
+    t->buckets = buckets;
+    t->bucket_count = 8;
+    x->generation = _next_generation();
+    x->mark = 1;
+    x->tag = TAG_HASH;
+    x->is_pair = 0;
+    x->scc_id = -1;
+    x->scan_tag = 0;
+    x->ptr = t;
+    return x;
+}
+
+int test_is_hash(Obj* x) { return is_hash_obj(x); }
+Obj* prim_is_hash(Obj* x) { return mk_int(is_hash_obj(x)); }
+
+Obj* prim_hash_count(Obj* h) {
+    if (!is_hash_obj(h)) return mk_error("hash-count: not a hash table");
+    return mk_int(((HashTable*)h->ptr)->count);
+}
+
+/* The value stored under key, or nil */
+Obj* prim_hash_get(Obj* h, Obj* key) {
+    if (!is_hash_obj(h)) return mk_error("hash-get: not a hash table");
+    HashNode* n = *hash_link((HashTable*)h->ptr, key, hash_code(key));
+    if (!n) return NULL;
+    if (n->value) inc_ref(n->value);
+    return n->value;
+}
+
+Obj* prim_hash_set(Obj* h, Obj* key, Obj* value) {
+    if (!is_hash_obj(h)) return mk_error("hash-set!: not a hash table");
+    HashTable* t = (HashTable*)h->ptr;
+    unsigned long code = hash_code(key);
+    HashNode** link = hash_link(t, key, code);
+    if (*link) {
+        /* Keep the key already stored; replace the value */
+        if (value) inc_ref(value);
+        Obj* old = (*link)->value;
+        (*link)->value = value;
+        dec_ref(old);
+        return NULL;
+    }
+    HashNode* n = malloc(sizeof(HashNode));
+    if (!n) return NULL;
+    if (key) inc_ref(key);
+    if (value) inc_ref(value);
+    n->key = key;
+    n->value = value;
+    n->code = code;
+    n->chain = NULL;
+    *link = n;
+    n->prev = t->last;
+    n->next = NULL;
+    if (t->last) t->last->next = n;
+    else t->first = n;
+    t->last = n;
+    if (++t->count > t->bucket_count) hash_grow(t);
+    return NULL;
+}
+
+Obj* prim_hash_remove(Obj* h, Obj* key) {
+    if (!is_hash_obj(h)) return mk_error("hash-remove!: not a hash table");
+    HashTable* t = (HashTable*)h->ptr;
+    HashNode** link = hash_link(t, key, hash_code(key));
+    HashNode* n = *link;
+    if (!n) return NULL;
+    *link = n->chain;
+    if (n->prev) n->prev->next = n->next;
+    else t->first = n->next;
+    if (n->next) n->next->prev = n->prev;
+    else t->last = n->prev;
+    t->count--;
+    dec_ref(n->key);
+    dec_ref(n->value);
+    free(n);
+    return NULL;
+}
+
+/* Fresh list of the keys in insertion order */
+Obj* prim_hash_keys(Obj* h) {
+    if (!is_hash_obj(h)) return mk_error("hash-keys: not a hash table");
+    Obj* keys = NULL;
+    for (HashNode* n = ((HashTable*)h->ptr)->last; n; n = n->prev) {
+        if (n->key) inc_ref(n->key);
+        keys = mk_pair(n->key, keys);
+    }
+    return keys;
+}
+
+/* ========== Persistent Collections ========== */
+/*
+ * pmap and pvec values never change: assoc, dissoc and conj return a new
+ * version that shares everything but the changed path with the old one.
+ * A map is a hash array mapped trie keyed by hash_code, 5 bits a level,
+ * ending in collision nodes once the hash runs out; a vector is a
+ * radix-balanced trie of 32-way nodes with the elements in its leaves.
+ *
+ * Nodes are counted with plain increments while one thread can reach
+ * them. Freezing a version moves every node it reaches into a frozen
+ * group: as with a frozen SCC, one count covers all of the group's nodes,
+ * and they are never counted again, so versions in any thread share them
+ * without atomic traffic. Each version counts, atomically, the group of
+ * the frozen nodes it reaches, and a group counts the one frozen before
+ * it. A version captured by spawn or future, or sent on a channel, is
+ * frozen first.
+ *
+ * A transient is a version that assoc!, dissoc! and conj! change in
+ * place. A node it alone reaches (count 1 down the whole path, and not
+ * frozen) is changed where it is, and the nodes it copies from shared
+ * ones are its own from then on, with room to grow, so a loop building
+ * a collection copies each node at most once. persistent! hands the
+ * nodes to a new version and ends the transient; using it after that is
+ * an error. A transient belongs to the thread that made it.
+ */
+
+#define PTRIE_BITS 5
+#define PTRIE_WIDTH (1 << PTRIE_BITS)
+#define PTRIE_MASK (PTRIE_WIDTH - 1)
+#define PHASH_BITS ((int)(sizeof(unsigned long) * 8))
+
+/* A map slot holds an entry, or a subtrie in node; a vector slot holds an
+ * element in a leaf and a child above the leaves */
+typedef struct PSlot {
+    Obj* key;
+    Obj* value;
+    struct PNode* node;
+} PSlot;
+
+typedef struct PNode {
+    int rc;                    /* Unused once frozen */
+    int frozen;
+    uint32_t bitmap;           /* Map: slots present; 0 in a collision node */
+    int count;
+    int capacity;              /* Slots allocated; more than count in a transient's */
+    PSlot slots[];
+} PNode;
+
+typedef struct PGroup {
+    int rc;                    /* Versions reaching it, and the next group */
+    PNode** nodes;
+    long count;
+    long capacity;
+    struct PGroup* older;
+} PGroup;
+
+struct PColl {
+    long count;
+    int shift;                 /* Vector: bits above the leaf level */
+    int transient;             /* 1 for a transient, -1 once persistent! ends it */
+    PNode* root;
+    PGroup* group;             /* Frozen nodes this version reaches */
+};
+
+/* A node of count slots; for a transient (edit), with room to grow */
+static PNode* pnode_new(int count, int edit) {
+    int capacity = count;
+    if (edit) {
+        for (capacity = 4; capacity < count; capacity *= 2) {}
+    }
+    PNode* n = calloc(1, sizeof(PNode) + (size_t)capacity * sizeof(PSlot));
+    if (!n) {
+        fprintf(stderr, "persistent collection: out of memory\n");
+        omni_flush_ports();
+        abort();
+    }
+    n->rc = 1;
+    n->count = count;
+    n->capacity = capacity;
+    return n;
+}
+
+static void pnode_retain(PNode* n) {
+    if (n && !n->frozen) n->rc++;
+}
+
+static void pnode_release(PNode* n) {
+    if (!n || n->frozen || --n->rc > 0) return;
+    for (int i = 0; i < n->count; i++) {
+        dec_ref(n->slots[i].key);
+        dec_ref(n->slots[i].value);
+        pnode_release(n->slots[i].node);
+    }
+    free(n);
+}
+
+/* Whether a transient may change n in place: nothing else reaches it.
+ * The caller owns the path down to n. */
+static int pnode_owned(const PNode* n, int edit) {
+    return edit && n && !n->frozen && n->rc == 1;
+}
+
+/* Copy count slots, taking a reference to each part */
+static void pslot_copy(PSlot* dst, const PSlot* src, int count) {
+    for (int i = 0; i < count; i++) {
+        dst[i] = src[i];
+        inc_ref(dst[i].key);
+        inc_ref(dst[i].value);
+        pnode_retain(dst[i].node);
+    }
+}
+
+/* n with count slots, to change: n itself when a transient owns it and
+ * it has room, else a fresh copy. n is borrowed; the result is a new
+ * reference. */
+static PNode* pnode_edit(PNode* n, int count, int edit) {
+    if (pnode_owned(n, edit) && count <= n->capacity) {
+        for (int i = n->count; i < count; i++) n->slots[i] = (PSlot){ NULL, NULL, NULL };
+        n->count = count;
+        n->rc++;
+        return n;
+    }
+    PNode* c = pnode_new(count, edit);
+    c->bitmap = n->bitmap;
+    pslot_copy(c->slots, n->slots, n->count < count ? n->count : count);
+    return c;
+}
+
+/* Set slot i of a node being changed: key and value are borrowed, node
+ * is taken */
+static void pslot_put(PNode* n, int i, Obj* key, Obj* value, PNode* node) {
+    PSlot old = n->slots[i];
+    inc_ref(key);
+    inc_ref(value);
+    n->slots[i] = (PSlot){ key, value, node };
+    dec_ref(old.key);
+    dec_ref(old.value);
+    pnode_release(old.node);
+}
+
+/* n with an empty slot i before the ones from i on, as for pnode_edit */
+static PNode* pnode_insert(PNode* n, int i, int edit) {
+    if (pnode_owned(n, edit) && n->count < n->capacity) {
+        memmove(n->slots + i + 1, n->slots + i, (size_t)(n->count - i) * sizeof(PSlot));
+        n->slots[i] = (PSlot){ NULL, NULL, NULL };
+        n->count++;
+        n->rc++;
+        return n;
+    }
+    PNode* c = pnode_new(n->count + 1, edit);
+    c->bitmap = n->bitmap;
+    pslot_copy(c->slots, n->slots, i);
+    pslot_copy(c->slots + i + 1, n->slots + i, n->count - i);
+    return c;
+}
+
+/* n without slot i, and without bit in its bitmap, as for pnode_edit */
+static PNode* pnode_without(PNode* n, int i, uint32_t bit, int edit) {
+    if (pnode_owned(n, edit)) {
+        pslot_put(n, i, NULL, NULL, NULL);
+        memmove(n->slots + i, n->slots + i + 1, (size_t)(n->count - i - 1) * sizeof(PSlot));
+        n->count--;
+        n->bitmap &= ~bit;
+        n->rc++;
+        return n;
+    }
+    PNode* c = pnode_new(n->count - 1, edit);
+    c->bitmap = n->bitmap & ~bit;
+    pslot_copy(c->slots, n->slots, i);
+    pslot_copy(c->slots + i, n->slots + i + 1, n->count - i - 1);
+    return c;
+}
+
+static int pslot_index(uint32_t bitmap, uint32_t bit) {
+    uint32_t x = bitmap & (bit - 1);
+    x = x - (x >> 1 & 0x55555555u);
+    x = (x & 0x33333333u) + (x >> 2 & 0x33333333u);
+    return (int)(((x + (x >> 4)) & 0x0F0F0F0Fu) * 0x01010101u >> 24);
+}
+
+static void pgroup_retain(PGroup* g) {
+    if (g) __atomic_add_fetch(&g->rc, 1, __ATOMIC_ACQ_REL);
+}
+
+static void pgroup_release(PGroup* g) {
+    while (g && __atomic_sub_fetch(&g->rc, 1, __ATOMIC_ACQ_REL) == 0) {
+        for (long i = 0; i < g->count; i++) {
+            PNode* n = g->nodes[i];
+            for (int j = 0; j < n->count; j++) {
+                dec_ref(n->slots[j].key);
+                dec_ref(n->slots[j].value);
+            }
+            free(n);
+        }
+        free(g->nodes);
+        PGroup* older = g->older;
+        free(g);
+        g = older;
+    }
+}
+
+/* n frozen into g: n itself when only this version reaches it, else a
+ * frozen copy. Takes the caller's reference to n. */
+static PNode* pnode_freeze(PNode* n, PGroup* g) {
+    if (!n || n->frozen) return n;
+    if (n->rc > 1) {
+        PNode* c = pnode_edit(n, n->count, 0);
+        n->rc--;
+        n = c;
+    }
+    n->frozen = 1;
+    if (g->count == g->capacity) {
+        g->capacity = g->capacity ? g->capacity * 2 : 16;
+        g->nodes = realloc(g->nodes, (size_t)g->capacity * sizeof(PNode*));
+    }
+    g->nodes[g->count++] = n;
+    for (int i = 0; i < n->count; i++) n->slots[i].node = pnode_freeze(n->slots[i].node, g);
+    return n;
+}
+
+static void pcoll_freeze(PColl* c) {
+    if (!c->root || c->root->frozen) return;
+    PGroup* g = calloc(1, sizeof(PGroup));
+    if (!g) return;
+    g->rc = 1;
+    g->older = c->group;       /* Takes the version's count */
+    c->root = pnode_freeze(c->root, g);
+    c->group = g;
+}
+
+static void pcoll_free(PColl* c) {
+    pnode_release(c->root);
+    pgroup_release(c->group);
+    free(c);
+}
+
+static int is_pmap_obj(Obj* x) { return x && obj_tag(x) == TAG_PMAP && x->ptr; }
+static int is_pvec_obj(Obj* x) { return x && obj_tag(x) == TAG_PVEC && x->ptr; }
+
+/* Takes root, and a count of group */
+static Obj* mk_pcoll(int tag, long count, int shift, PNode* root, PGroup* group) {
+    budget_charge();
+    PColl* c = malloc(sizeof(PColl));
+    Obj* x = c ? malloc(sizeof(Obj)) : NULL;
+    if (!x) {
+        free(c);
+        pnode_release(root);
+        pgroup_release(group);
+        return NULL;
+    }
+    c->count = count;
+    c->shift = shift;
+    c->transient = 0;
+    c->root = root;
+    c->group = group;
+    x->generation = _next_generation();
+    x->mark = 1;
+    x->tag = tag;
+    x->is_pair = 0;
+    x->scc_id = -1;
+    x->scan_tag = 0;
+    x->ptr = c;
+    return x;
+}
+
+/* Another version of c with a new root, reaching c's frozen nodes */
+static Obj* pcoll_derive(Obj* x, long count, int shift, PNode* root) {
+    PColl* c = (PColl*)x->ptr;
+    pgroup_retain(c->group);
+    return mk_pcoll(x->tag, count, shift, root, c->group);
+}
+
+/* Freeze a persistent collection about to be shared with another thread */
+static void share_persistent(Obj* x) {
+    if (is_pmap_obj(x) || is_pvec_obj(x)) pcoll_freeze((PColl*)x->ptr);
+}
+
+/* Calls f on every entry or element of n, in order */
+static void pnode_each(PNode* n, void (*f)(Obj* key, Obj* value, void* arg), void* arg) {
+    for (int i = 0; n && i < n->count; i++) {
+        if (n->slots[i].node) pnode_each(n->slots[i].node, f, arg);
+        else f(n->slots[i].key, n->slots[i].value, arg);
+    }
+}
+
+/* Map tries */
+
+static PNode* pmap_assoc_node(PNode* n, int shift, unsigned long h, Obj* key, Obj* value, int* added,
+                              int edit);
+
+/* A trie holding two entries whose hashes agree below shift */
+static PNode* pmap_pair(int shift, Obj* k1, Obj* v1, unsigned long h2, Obj* k2, Obj* v2, int edit) {
+    if (shift >= PHASH_BITS) {
+        PNode* r = pnode_new(2, edit);
+        pslot_put(r, 0, k1, v1, NULL);
+        pslot_put(r, 1, k2, v2, NULL);
+        return r;
+    }
+    int added;
+    PNode* one = pmap_assoc_node(NULL, shift, hash_code(k1), k1, v1, &added, edit);
+    PNode* r = pmap_assoc_node(one, shift, h2, k2, v2, &added, edit);
+    pnode_release(one);
+    return r;
+}
+
+/* n with key bound to value, as for pnode_edit; *added is set if key is
+ * new. n is changed before the child under it, so a transient changes
+ * a child in place only when it owns n. */
+static PNode* pmap_assoc_node(PNode* n, int shift, unsigned long h, Obj* key, Obj* value, int* added,
+                              int edit) {
+    if (!n) {
+        PNode* r = pnode_new(1, edit);
+        r->bitmap = 1u << (h >> shift & PTRIE_MASK);
+        pslot_put(r, 0, key, value, NULL);
+        *added = 1;
+        return r;
+    }
+    if (!n->bitmap) {
+        /* Every key here has hash h */
+        int count = n->count;
+        for (int i = 0; i < count; i++) {
+            if (is_eq_obj(n->slots[i].key, key)) {
+                PNode* r = pnode_edit(n, count, edit);
+                pslot_put(r, i, r->slots[i].key, value, NULL);
+                return r;
+            }
+        }
+        PNode* r = pnode_edit(n, count + 1, edit);
+        pslot_put(r, count, key, value, NULL);
+        *added = 1;
+        return r;
+    }
+    uint32_t bit = 1u << (h >> shift & PTRIE_MASK);
+    int i = pslot_index(n->bitmap, bit);
+    if (!(n->bitmap & bit)) {
+        PNode* r = pnode_insert(n, i, edit);
+        r->bitmap |= bit;
+        pslot_put(r, i, key, value, NULL);
+        *added = 1;
+        return r;
+    }
+    PNode* r = pnode_edit(n, n->count, edit);
+    const PSlot* s = &r->slots[i];
+    if (s->node) {
+        pslot_put(r, i, NULL, NULL, pmap_assoc_node(s->node, shift + PTRIE_BITS, h, key, value, added, edit));
+    } else if (is_eq_obj(s->key, key)) {
+        pslot_put(r, i, s->key, value, NULL);
+    } else {
+        pslot_put(r, i, NULL, NULL, pmap_pair(shift + PTRIE_BITS, s->key, s->value, h, key, value, edit));
+        *added = 1;
+    }
+    return r;
+}
+
+/* n without key: a new reference to n when key is not there, else n
+ * changed as for pnode_edit, or NULL for an empty one, with *removed
+ * set. n is borrowed. */
+static PNode* pmap_dissoc_node(PNode* n, int shift, unsigned long h, Obj* key, int* removed, int edit) {
+    if (!n->bitmap) {
+        for (int i = 0; i < n->count; i++) {
+            if (is_eq_obj(n->slots[i].key, key)) {
+                *removed = 1;
+                return n->count == 1 ? NULL : pnode_without(n, i, 0, edit);
+            }
+        }
+        pnode_retain(n);
+        return n;
+    }
+    uint32_t bit = 1u << (h >> shift & PTRIE_MASK);
+    int i = pslot_index(n->bitmap, bit);
+    const PSlot* s = &n->slots[i];
+    if (!(n->bitmap & bit) || (!s->node && !is_eq_obj(s->key, key))) {
+        pnode_retain(n);
+        return n;
+    }
+    if (s->node) {
+        /* Whether to remove anything is only known below, so the child is
+         * changed in place only if n is owned too */
+        PNode* child = pmap_dissoc_node(s->node, shift + PTRIE_BITS, h, key, removed, pnode_owned(n, edit));
+        if (!*removed) {
+            pnode_release(child);
+            pnode_retain(n);
+            return n;
+        }
+        if (child) {
+            PNode* r = pnode_edit(n, n->count, edit);
+            pslot_put(r, i, NULL, NULL, child);
+            return r;
+        }
+    }
+    *removed = 1;
+    return n->count == 1 ? NULL : pnode_without(n, i, bit, edit);
+}
+
+static const PSlot* pmap_find(PNode* n, unsigned long h, Obj* key) {
+    for (int shift = 0; n; shift += PTRIE_BITS) {
+        if (!n->bitmap) {
+            for (int i = 0; i < n->count; i++) {
+                if (is_eq_obj(n->slots[i].key, key)) return &n->slots[i];
+            }
+            return NULL;
+        }
+        uint32_t bit = 1u << (h >> shift & PTRIE_MASK);
+        if (!(n->bitmap & bit)) return NULL;
+        const PSlot* s = &n->slots[pslot_index(n->bitmap, bit)];
+        if (!s->node) return is_eq_obj(s->key, key) ? s : NULL;
+        n = s->node;
+    }
+    return NULL;
+}
+
+/* Vector tries */
+
+/* n with element i set to x, as for pnode_edit. n may be NULL or end
+ * before i when i is the next element to add. */
+static PNode* pvec_set_node(PNode* n, int shift, long i, Obj* x, int edit) {
+    int j = (int)(i >> shift & PTRIE_MASK);
+    int have = n ? n->count : 0;
+    PNode* r = n ? pnode_edit(n, j < have ? have : j + 1, edit) : pnode_new(j + 1, edit);
+    if (shift == 0) {
+        pslot_put(r, j, NULL, x, NULL);
+    } else {
+        pslot_put(r, j, NULL, NULL, pvec_set_node(r->slots[j].node, shift - PTRIE_BITS, i, x, edit));
+    }
+    return r;
+}
+
+static Obj* pvec_nth(PColl* c, long i) {
+    PNode* n = c->root;
+    for (int shift = c->shift; shift > 0; shift -= PTRIE_BITS) n = n->slots[i >> shift & PTRIE_MASK].node;
+    return n->slots[i & PTRIE_MASK].value;
+}
+
+/* x with count elements under root, a new reference: x itself, changed,
+ * for a transient, else another version. Takes root. */
+static Obj* pcoll_update(Obj* x, long count, int shift, PNode* root) {
+    PColl* c = (PColl*)x->ptr;
+    if (!c->transient) return pcoll_derive(x, count, shift, root);
+    pnode_release(c->root);
+    c->root = root;
+    c->count = count;
+    c->shift = shift;
+    inc_ref(x);
+    return x;
+}
+
+static Obj* pcoll_conj(Obj* v, Obj* x) {
+    PColl* c = (PColl*)v->ptr;
+    int edit = c->transient;
+    if (c->root && c->count == (long)PTRIE_WIDTH << c->shift) {
+        /* Full: the old root becomes the first child of a new one */
+        PNode* up = pnode_new(1, edit);
+        up->slots[0].node = c->root;
+        pnode_retain(c->root);
+        PNode* r = pvec_set_node(up, c->shift + PTRIE_BITS, c->count, x, edit);
+        pnode_release(up);
+        return pcoll_update(v, c->count + 1, c->shift + PTRIE_BITS, r);
+    }
+    return pcoll_update(v, c->count + 1, c->shift, pvec_set_node(c->root, c->shift, c->count, x, edit));
+}
+
+static Obj* pcoll_assoc(Obj* coll, Obj* key, Obj* value, const char* range_error) {
+    PColl* c = (PColl*)coll->ptr;
+    if (coll->tag == TAG_PMAP) {
+        int added = 0;
+        PNode* r = pmap_assoc_node(c->root, 0, hash_code(key), key, value, &added, c->transient);
+        return pcoll_update(coll, c->count + added, 0, r);
+    }
+    long i = obj_tag(key) == TAG_INT ? obj_to_int(key) : -1;
+    if (i < 0 || i > c->count) return mk_error(range_error);
+    if (i == c->count) return pcoll_conj(coll, value);
+    return pcoll_update(coll, c->count, c->shift, pvec_set_node(c->root, c->shift, i, value, c->transient));
+}
+
+static Obj* pcoll_dissoc(Obj* m, Obj* key) {
+    PColl* c = (PColl*)m->ptr;
+    int removed = 0;
+    PNode* r = c->root ? pmap_dissoc_node(c->root, 0, hash_code(key), key, &removed, c->transient) : NULL;
+    if (!removed) {
+        pnode_release(r);
+        inc_ref(m);
+        return m;
+    }
+    return pcoll_update(m, c->count - 1, 0, r);
+}
+
+/* Whether x is a transient persistent! has not ended */
+static int is_live_transient(Obj* x) {
+    return (is_pmap_obj(x) || is_pvec_obj(x)) && ((PColl*)x->ptr)->transient == 1;
+}
+
+/* Whether x is a transient persistent! has ended */
+static int is_ended_transient(Obj* x) {
+    return (is_pmap_obj(x) || is_pvec_obj(x)) && ((PColl*)x->ptr)->transient < 0;
+}
+
+static int is_transient_obj(Obj* x) {
+    return (is_pmap_obj(x) || is_pvec_obj(x)) && ((PColl*)x->ptr)->transient;
+}
+
+/* Persistent collection primitives: arguments borrowed, results owned */
+
+Obj* prim_make_pmap(void) { return mk_pcoll(TAG_PMAP, 0, 0, NULL, NULL); }
+Obj* prim_make_pvec(void) { return mk_pcoll(TAG_PVEC, 0, 0, NULL, NULL); }
+Obj* prim_is_pmap(Obj* x) { return mk_int(is_pmap_obj(x) && !is_transient_obj(x)); }
+Obj* prim_is_pvec(Obj* x) { return mk_int(is_pvec_obj(x) && !is_transient_obj(x)); }
+
+Obj* prim_conj(Obj* v, Obj* x) {
+    if (is_transient_obj(v)) return mk_error("conj: a transient (use conj!)");
+    if (!is_pvec_obj(v)) return mk_error("conj: not a persistent vector");
+    return pcoll_conj(v, x);
+}
+
+Obj* prim_assoc(Obj* coll, Obj* key, Obj* value) {
+    if (is_transient_obj(coll)) return mk_error("assoc: a transient (use assoc!)");
+    if (!is_pmap_obj(coll) && !is_pvec_obj(coll)) return mk_error("assoc: not a persistent map or vector");
+    return pcoll_assoc(coll, key, value, "assoc: index out of range");
+}
+
+Obj* prim_dissoc(Obj* m, Obj* key) {
+    if (is_transient_obj(m)) return mk_error("dissoc: a transient (use dissoc!)");
+    if (!is_pmap_obj(m)) return mk_error("dissoc: not a persistent map");
+    return pcoll_dissoc(m, key);
+}
+
+/* The value under key, or element key of a vector; nil if there is none */
+Obj* prim_get(Obj* coll, Obj* key) {
+    Obj* v = NULL;
+    if (is_ended_transient(coll)) {
+        return mk_error("get: transient used after persistent!");
+    } else if (is_pmap_obj(coll)) {
+        const PSlot* s = pmap_find(((PColl*)coll->ptr)->root, hash_code(key), key);
+        if (s) v = s->value;
+    } else if (is_pvec_obj(coll)) {
+        PColl* c = (PColl*)coll->ptr;
+        long i = obj_tag(key) == TAG_INT ? obj_to_int(key) : -1;
+        if (i >= 0 && i < c->count) v = pvec_nth(c, i);
+    } else {
+        return mk_error("get: not a persistent map or vector");
     }
-    return mk_int_unboxed(obj_to_int(a) < obj_to_int(b) ? 1 : 0);
+    inc_ref(v);
+    return v;
+}
+
+Obj* prim_count(Obj* coll) {
+    if (is_ended_transient(coll)) return mk_error("count: transient used after persistent!");
+    if (!is_pmap_obj(coll) && !is_pvec_obj(coll)) return mk_error("count: not a persistent map or vector");
+    return mk_int(((PColl*)coll->ptr)->count);
+}
+
+static void collect_key(Obj* key, Obj* value, void* arg) {
+    (void)value;
+    Obj** keys = (Obj**)arg;
+    inc_ref(key);
+    *keys = mk_pair(key, *keys);
 }
 
-Obj* gt_op(Obj* a, Obj* b) {
-    if (IS_IMMEDIATE(a) && IS_IMMEDIATE(b)) {
-        return mk_int_unboxed(IMMEDIATE_VALUE(a) > IMMEDIATE_VALUE(b) ? 1 : 0);
-    }
-    if (!a || !b) return mk_int_unboxed(0);
-    if (num_is_float(a) || num_is_float(b)) {
-        return mk_int_unboxed(num_to_double(a) > num_to_double(b) ? 1 : 0);
+/* Fresh list of the keys, in the map's order */
+Obj* prim_keys(Obj* m) {
+    if (is_ended_transient(m)) return mk_error("keys: transient used after persistent!");
+    if (!is_pmap_obj(m)) return mk_error("keys: not a persistent map");
+    Obj* reversed = NULL;
+    pnode_each(((PColl*)m->ptr)->root, collect_key, &reversed);
+    Obj* keys = NULL;
+    for (Obj* p = reversed; p; p = p->b) {
+        inc_ref(p->a);
+        keys = mk_pair(p->a, keys);
     }
-    return mk_int_unboxed(obj_to_int(a) > obj_to_int(b) ? 1 : 0);
+    dec_ref(reversed);
+    return keys;
 }
 
-Obj* le_op(Obj* a, Obj* b) {
-    if (IS_IMMEDIATE(a) && IS_IMMEDIATE(b)) {
-        return mk_int_unboxed(IMMEDIATE_VALUE(a) <= IMMEDIATE_VALUE(b) ? 1 : 0);
-    }
-    if (!a || !b) return mk_int_unboxed(0);
-    if (num_is_float(a) || num_is_float(b)) {
-        return mk_int_unboxed(num_to_double(a) <= num_to_double(b) ? 1 : 0);
-    }
-    return mk_int_unboxed(obj_to_int(a) <= obj_to_int(b) ? 1 : 0);
+Obj* prim_freeze(Obj* coll) {
+    if (is_transient_obj(coll)) return mk_error("freeze: a transient");
+    if (!is_pmap_obj(coll) && !is_pvec_obj(coll)) return mk_error("freeze: not a persistent map or vector");
+    pcoll_freeze((PColl*)coll->ptr);
+    inc_ref(coll);
+    return coll;
 }
 
-Obj* ge_op(Obj* a, Obj* b) {
-    if (IS_IMMEDIATE(a) && IS_IMMEDIATE(b)) {
-        return mk_int_unboxed(IMMEDIATE_VALUE(a) >= IMMEDIATE_VALUE(b) ? 1 : 0);
-    }
-    if (!a || !b) return mk_int_unboxed(0);
-    if (num_is_float(a) || num_is_float(b)) {
-        return mk_int_unboxed(num_to_double(a) >= num_to_double(b) ? 1 : 0);
+/* Transients */
+
+Obj* prim_transient(Obj* coll) {
+    if (is_transient_obj(coll) || (!is_pmap_obj(coll) && !is_pvec_obj(coll))) {
+        return mk_error("transient: not a persistent map or vector");
     }
-    return mk_int_unboxed(obj_to_int(a) >= obj_to_int(b) ? 1 : 0);
+    PColl* c = (PColl*)coll->ptr;
+    pnode_retain(c->root);
+    Obj* t = pcoll_derive(coll, c->count, c->shift, c->root);
+    if (t) ((PColl*)t->ptr)->transient = 1;
+    return t;
 }
 
-Obj* not_op(Obj* a) {
-    if (!a) return mk_int_unboxed(1);
-    if (IS_IMMEDIATE(a)) {
-        return mk_int_unboxed(IMMEDIATE_VALUE(a) == 0 ? 1 : 0);
-    }
-    return mk_int_unboxed(a->i == 0 ? 1 : 0);
+/* A new version with the transient's nodes, which it can no longer use */
+Obj* prim_persistent(Obj* t) {
+    if (is_ended_transient(t)) return mk_error("persistent!: transient used after persistent!");
+    if (!is_live_transient(t)) return mk_error("persistent!: not a transient");
+    PColl* c = (PColl*)t->ptr;
+    Obj* x = mk_pcoll(t->tag, c->count, c->shift, c->root, c->group);
+    c->root = NULL;
+    c->group = NULL;
+    c->count = 0;
+    c->transient = -1;
+    return x;
 }
 
-int is_truthy(Obj* x) {
-    if (!x) return 0;
-    /* Fast path: immediate integer */
-    if (IS_IMMEDIATE(x)) {
-        return IMMEDIATE_VALUE(x) != 0;
-    }
-    switch (x->tag) {
-    case TAG_INT:
-        return x->i != 0;
-    case TAG_FLOAT:
-        return x->f != 0.0;
-    case TAG_CHAR:
-        return x->i != 0;
-    default:
-        return 1;
+Obj* prim_is_transient(Obj* x) { return mk_int(is_live_transient(x)); }
+
+Obj* prim_transient_assoc(Obj* t, Obj* key, Obj* value) {
+    if (is_ended_transient(t)) return mk_error("assoc!: transient used after persistent!");
+    if (!is_live_transient(t)) return mk_error("assoc!: not a transient");
+    return pcoll_assoc(t, key, value, "assoc!: index out of range");
+}
+
+Obj* prim_transient_dissoc(Obj* t, Obj* key) {
+    if (is_ended_transient(t)) return mk_error("dissoc!: transient used after persistent!");
+    if (!is_live_transient(t) || t->tag != TAG_PMAP) return mk_error("dissoc!: not a transient map");
+    return pcoll_dissoc(t, key);
+}
+
+Obj* prim_transient_conj(Obj* t, Obj* x) {
+    if (is_ended_transient(t)) return mk_error("conj!: transient used after persistent!");
+    if (!is_live_transient(t) || t->tag != TAG_PVEC) return mk_error("conj!: not a transient vector");
+    return pcoll_conj(t, x);
+}
+
+/* Printing and scanning helpers for the generic walkers below */
+
+typedef struct PPrint {
+    FILE* out;
+    void (*print)(FILE* out, Obj* x);
+    int map;
+    int first;
+} PPrint;
+
+static void pprint_entry(Obj* key, Obj* value, void* arg) {
+    PPrint* p = (PPrint*)arg;
+    if (!p->first) fputc(' ', p->out);
+    p->first = 0;
+    if (p->map) {
+        p->print(p->out, key);
+        fputc(' ', p->out);
     }
+    p->print(p->out, value);
 }
 
-/* Primitive aliases for compiler */
-Obj* prim_add(Obj* a, Obj* b) { return add(a, b); }
-Obj* prim_sub(Obj* a, Obj* b) { return sub(a, b); }
-Obj* prim_mul(Obj* a, Obj* b) { return mul(a, b); }
-Obj* prim_div(Obj* a, Obj* b) { return div_op(a, b); }
-Obj* prim_mod(Obj* a, Obj* b) { return mod_op(a, b); }
-Obj* prim_lt(Obj* a, Obj* b) { return lt_op(a, b); }
-Obj* prim_gt(Obj* a, Obj* b) { return gt_op(a, b); }
-Obj* prim_le(Obj* a, Obj* b) { return le_op(a, b); }
-Obj* prim_ge(Obj* a, Obj* b) { return ge_op(a, b); }
-Obj* prim_eq(Obj* a, Obj* b) { return eq_op(a, b); }
-Obj* prim_not(Obj* a) { return not_op(a); }
-Obj* prim_abs(Obj* a) {
-    if (!a) return mk_int_unboxed(0);
-    if (IS_IMMEDIATE(a)) {
-        long v = IMMEDIATE_VALUE(a);
-        return mk_int_unboxed(v < 0 ? -v : v);
+/* #pmap{k v ...} in trie order, or #pvec[x ...]; a transient is opaque */
+static void print_pcoll_to(FILE* out, Obj* x, void (*print)(FILE* out, Obj* x)) {
+    int map = x->tag == TAG_PMAP;
+    if (x->ptr && ((PColl*)x->ptr)->transient) {
+        fputs(map ? "#<transient pmap>" : "#<transient pvec>", out);
+        return;
     }
-    if (a->tag == TAG_FLOAT) return mk_float(a->f < 0 ? -a->f : a->f);
-    return mk_int_unboxed(a->i < 0 ? -a->i : a->i);
+    PPrint p = { out, print, map, 1 };
+    fputs(map ? "#pmap{" : "#pvec[", out);
+    if (x->ptr) pnode_each(((PColl*)x->ptr)->root, pprint_entry, &p);
+    fputc(map ? '}' : ']', out);
 }
 
-/* Type predicate wrappers - return Obj* for uniformity */
-/* Use obj_tag() to handle immediate values (tagged pointers) */
-Obj* prim_null(Obj* x) { return mk_int(x == NULL ? 1 : 0); }
-Obj* prim_pair(Obj* x) { return mk_int(x && obj_tag(x) == TAG_PAIR ? 1 : 0); }
-Obj* prim_int(Obj* x) { return mk_int(obj_tag(x) == TAG_INT ? 1 : 0); }
-Obj* prim_float(Obj* x) { return mk_int(x && obj_tag(x) == TAG_FLOAT ? 1 : 0); }
-Obj* prim_char(Obj* x) { return mk_int(obj_tag(x) == TAG_CHAR ? 1 : 0); }
-Obj* prim_sym(Obj* x) { return mk_int(x && obj_tag(x) == TAG_SYM ? 1 : 0); }
+static void pscan_entry(Obj* key, Obj* value, void* arg) {
+    void (*scan)(Obj*) = *(void (**)(Obj*))arg;
+    scan(key);
+    scan(value);
+}
+
+static void scan_pcoll(Obj* x, void (*scan)(Obj*)) {
+    if (x->ptr) pnode_each(((PColl*)x->ptr)->root, pscan_entry, &scan);
+}
 
 /* I/O Primitives */
-void print_obj(Obj* x);  /* forward declaration */
+void print_obj_to(FILE* out, Obj* x);  /* forward declarations */
+void write_obj_to(FILE* out, Obj* x);
+
+/* Shortest decimal form of f that reads back as the same double, in
+ * plain notation (1500.0, 0.001) unless its magnitude is 1e21 or more or
+ * below 1e-7 (1e+21, 1e-08). Always looks like a float (1.0, not 1);
+ * infinities and NaN use the R7RS spellings. Returns the length written. */
+int format_float(char* buf, size_t cap, double f) {
+    if (f != f) return snprintf(buf, cap, "+nan.0");
+    if (f - f != 0) return snprintf(buf, cap, f > 0 ? "+inf.0" : "-inf.0");
+
+    int len = 0;
+    for (int prec = 1; prec <= 17; prec++) {
+        len = snprintf(buf, cap, "%.*g", prec, f);
+        if (strtod(buf, NULL) == f) break;
+    }
+    char* e = strchr(buf, 'e');
+    double mag = f < 0 ? -f : f;
+    if (e && mag >= 1e-7 && mag < 1e21) {
+        /* Spell out the exponent %g chose: d.ddd times 10^x */
+        int x = 0;
+        for (const char* p = e + 2; *p; p++) x = x * 10 + (*p - '0');
+        if (e[1] == '-') x = -x;
+        char digits[24];
+        int n = 0;
+        for (const char* p = buf; p < e; p++) {
+            if (*p >= '0' && *p <= '9') digits[n++] = *p;
+        }
+        char plain[48];
+        int k = 0;
+        if (f < 0) plain[k++] = '-';
+        if (x < 0) {
+            plain[k++] = '0';
+            plain[k++] = '.';
+            for (int i = -1; i > x; i--) plain[k++] = '0';
+            for (int i = 0; i < n; i++) plain[k++] = digits[i];
+        } else {
+            for (int i = 0; i <= x; i++) plain[k++] = i < n ? digits[i] : '0';
+            if (n > x + 1) plain[k++] = '.';
+            for (int i = x + 1; i < n; i++) plain[k++] = digits[i];
+        }
+        plain[k] = '\0';
+        len = snprintf(buf, cap, "%s", plain);
+    }
+    if (!strpbrk(buf, ".e") && (size_t)len + 2 < cap) {
+        buf[len++] = '.';
+        buf[len++] = '0';
+        buf[len] = '\0';
+    }
+    return len;
+}
 
 /* Check if a list is a string (all chars) */
 int is_string_list(Obj* xs) {
@@ -2324,99 +4422,728 @@ int is_string_list(Obj* xs) {
     return xs == NULL; /* Must be proper list */
 }
 
+/* Ports: a stream to read, a stream to write, or both for a socket.
+ * Owned streams close with the port; the rest, like standard output or
+ * the stream a printer was handed, are only borrowed. A string port
+ * collects what is written to it in text. */
+struct Port {
+    FILE* in;
+    FILE* out;
+    bool owned;
+    bool string;
+    char* text;
+    size_t len;
+    char* buf;              /* From set-port-buffer!, for an owned stream */
+    struct Port* prev;      /* In g_open_ports, when tracked */
+    struct Port* next;
+    bool tracked;
+};
+
+/* Ports with a file or connection open, oldest first: at exit, or before
+ * stopping on an uncaught exception, each one's buffered output is
+ * written in that order */
+static Port* g_open_ports = NULL;
+static Port* g_open_ports_last = NULL;
+static pthread_mutex_t g_open_ports_lock = PTHREAD_MUTEX_INITIALIZER;
+
+void omni_flush_ports(void) {
+    pthread_mutex_lock(&g_open_ports_lock);
+    for (Port* p = g_open_ports; p; p = p->next) {
+        if (p->out) fflush(p->out);
+    }
+    pthread_mutex_unlock(&g_open_ports_lock);
+    fflush(stdout);
+}
+
+static void port_untrack(Port* p) {
+    pthread_mutex_lock(&g_open_ports_lock);
+    if (p->prev) p->prev->next = p->next; else g_open_ports = p->next;
+    if (p->next) p->next->prev = p->prev; else g_open_ports_last = p->prev;
+    p->tracked = false;
+    pthread_mutex_unlock(&g_open_ports_lock);
+}
+
+static Obj* port_track(Obj* x) {
+    static bool registered = false;
+    Port* p = (Port*)x->ptr;
+    pthread_mutex_lock(&g_open_ports_lock);
+    if (!registered) {
+        atexit(omni_flush_ports);
+        registered = true;
+    }
+    p->prev = g_open_ports_last;
+    p->next = NULL;
+    if (g_open_ports_last) g_open_ports_last->next = p; else g_open_ports = p;
+    g_open_ports_last = p;
+    p->tracked = true;
+    pthread_mutex_unlock(&g_open_ports_lock);
+    return x;
+}
+
+static void port_close(Port* p) {
+    if (p->tracked) port_untrack(p);
+    if (p->owned) {
+        if (p->in) fclose(p->in);
+        if (p->out) fclose(p->out);
+    } else if (p->out) {
+        fflush(p->out);
+    }
+    p->in = NULL;
+    p->out = NULL;
+}
+
+static void port_free(Port* p) {
+    port_close(p);
+    free(p->text);
+    free(p->buf);
+    free(p);
+}
+
+static Obj* mk_port(FILE* in, FILE* out, bool owned) {
+    budget_charge();
+    Port* p = calloc(1, sizeof(Port));
+    Obj* x = malloc(sizeof(Obj));
+    if (!p || !x) {
+        free(p);
+        free(x);
+        return NULL;
+    }
+    p->in = in;
+    p->out = out;
+    p->owned = owned;
+    x->generation = _next_generation();
+    x->mark = 1;
+    x->tag = TAG_PORT;
+    x->is_pair = 0;
+    x->scc_id = -1;
+    x->scan_tag = 0;
+    x->ptr = p;
+    return x;
+}
+
+static int is_port(Obj* p) {
+    return obj_tag(p) == TAG_PORT && p->ptr;
+}
+
+/* The stream output to p goes to: anything but a port means the current
+ * output port. NULL once the port is closed or has nothing to write to. */
+static FILE* port_out(Obj* p) {
+    if (!is_port(p)) p = g_output;
+    return p ? ((Port*)p->ptr)->out : stdout;
+}
+
+static Obj* port_not_open(const char* who) {
+    char msg[128];
+    snprintf(msg, sizeof(msg), "%s: not an open output port", who);
+    return mk_error(msg);
+}
+
+/* Printers from define-printer, by type name */
+typedef struct UserPrinter {
+    const char* name;
+    Obj* fn;
+    struct UserPrinter* next;
+} UserPrinter;
+
+static UserPrinter* g_user_printers = NULL;
+static pthread_mutex_t g_user_printers_lock = PTHREAD_MUTEX_INITIALIZER;
+
+static UserPrinter* find_user_printer(const char* name) {
+    UserPrinter* p = g_user_printers;
+    while (p && strcmp(p->name, name) != 0) p = p->next;
+    return p;
+}
+
+Obj* user_printer(const UserType* t, Obj* fn) {
+    if (!fn || obj_tag(fn) != TAG_CLOSURE || !fn->ptr ||
+        (((Closure*)fn->ptr)->arity >= 0 && ((Closure*)fn->ptr)->arity != 2)) {
+        char msg[256];
+        snprintf(msg, sizeof(msg), "define-printer %s: expected a procedure of 2 arguments", t->name);
+        return mk_error(msg);
+    }
+    inc_ref(fn);
+    pthread_mutex_lock(&g_user_printers_lock);
+    UserPrinter* p = find_user_printer(t->name);
+    Obj* old = NULL;
+    if (p) {
+        old = p->fn;
+    } else {
+        p = malloc(sizeof(UserPrinter));
+        p->name = t->name;
+        p->next = g_user_printers;
+        g_user_printers = p;
+    }
+    p->fn = fn;
+    pthread_mutex_unlock(&g_user_printers_lock);
+    dec_ref(old);
+    return NULL;
+}
+
+/* A deftype object, through its type's printer when it has one, else as
+ * #<T f1=v1 f2=v2> with each field as field prints it */
+static void print_user_to(FILE* out, Obj* x, void (*field)(FILE*, Obj*)) {
+    UserObj* u = (UserObj*)x->ptr;
+    pthread_mutex_lock(&g_user_printers_lock);
+    UserPrinter* p = find_user_printer(u->type->name);
+    Obj* fn = p ? p->fn : NULL;
+    if (fn) inc_ref(fn);
+    pthread_mutex_unlock(&g_user_printers_lock);
+    if (fn) {
+        Obj* port = mk_port(NULL, out, false);
+        Obj* args[2] = { x, port };
+        Obj* r = call_closure(fn, args, 2);
+        if (r != x && r != port) dec_ref(r);
+        dec_ref(port);
+        dec_ref(fn);
+        return;
+    }
+    fprintf(out, "#<%s", u->type->name);
+    for (int i = 0; i < u->type->field_count; i++) {
+        fprintf(out, " %s=", u->type->fields[i]);
+        /* A back edge is not followed; a cleared one shows its nil */
+        if ((u->type->weak >> i & 1) && u->fields[i]) fputs("#<weak>", out);
+        else field(out, u->fields[i]);
+    }
+    fputc('>', out);
+}
+
 /* Print a string list as a quoted string */
-void print_string(Obj* xs) {
+static void print_string_to(FILE* out, Obj* xs) {
     while (xs && obj_tag(xs) == TAG_PAIR) {
         if (obj_tag(xs->a) == TAG_CHAR) {
-            printf("%c", (char)obj_to_char_val(xs->a));
+            fprintf(out, "%c", (char)obj_to_char_val(xs->a));
         }
         xs = xs->b;
     }
 }
 
-void print_list(Obj* xs) {
+static void print_list_to(FILE* out, Obj* xs) {
     /* Check if this is a string (list of chars) */
     if (is_string_list(xs)) {
-        print_string(xs);
+        print_string_to(out, xs);
         return;
     }
-    printf("(");
+    fprintf(out, "(");
     int first = 1;
-    while (xs && xs->tag == TAG_PAIR) {
-        if (!first) printf(" ");
+    while (xs && obj_tag(xs) == TAG_PAIR) {
+        if (!first) fprintf(out, " ");
         first = 0;
-        print_obj(xs->a);
+        print_obj_to(out, xs->a);
         xs = xs->b;
     }
     if (xs) {
-        printf(" . ");
-        print_obj(xs);
+        fprintf(out, " . ");
+        print_obj_to(out, xs);
     }
-    printf(")");
+    fprintf(out, ")");
 }
 
-void print_obj(Obj* x) {
+void print_obj_to(FILE* out, Obj* x) {
     if (!x) {
-        printf("()");
+        fprintf(out, "()");
         return;
     }
     /* Handle immediate (tagged pointer) values first */
     if (IS_IMMEDIATE_INT(x)) {
-        printf("%ld", (long)INT_IMM_VALUE(x));
+        fprintf(out, "%ld", (long)INT_IMM_VALUE(x));
         return;
     }
     if (IS_IMMEDIATE_CHAR(x)) {
-        printf("%c", (char)CHAR_IMM_VALUE(x));
+        fprintf(out, "%c", (char)CHAR_IMM_VALUE(x));
         return;
     }
     if (IS_IMMEDIATE_BOOL(x)) {
-        printf("%s", x == PURPLE_TRUE ? "#t" : "#f");
+        fprintf(out, "%s", x == PURPLE_TRUE ? "#t" : "#f");
         return;
     }
     switch (x->tag) {
     case TAG_INT:
-        printf("%ld", x->i);
+        fprintf(out, "%ld", x->i);
         break;
-    case TAG_FLOAT:
-        printf("%g", x->f);
+    case TAG_FLOAT: {
+        char buf[32];
+        format_float(buf, sizeof(buf), x->f);
+        fputs(buf, out);
         break;
+    }
     case TAG_CHAR:
-        printf("%c", (char)x->i);
+        fprintf(out, "%c", (char)x->i);
+        break;
+    case TAG_SYM:
+        fprintf(out, "%s", x->ptr ? (char*)x->ptr : "nil");
+        break;
+    case TAG_KEYWORD:
+        fprintf(out, ":%s", (char*)x->ptr);
+        break;
+    case TAG_STRING:
+        fputs(x->ptr ? (char*)x->ptr : "", out);
+        break;
+    case TAG_PAIR:
+        print_list_to(out, x);
+        break;
+    case TAG_VECTOR: {
+        Vector* v = (Vector*)x->ptr;
+        fprintf(out, "[");
+        for (long i = 0; v && i < v->len; i++) {
+            if (i > 0) fprintf(out, " ");
+            print_obj_to(out, v->items[i]);
+        }
+        fprintf(out, "]");
+        break;
+    }
+    case TAG_HASH: {
+        HashTable* t = (HashTable*)x->ptr;
+        fprintf(out, "#{");
+        for (HashNode* n = t ? t->first : NULL; n; n = n->next) {
+            if (n != t->first) fprintf(out, " ");
+            print_obj_to(out, n->key);
+            fprintf(out, " ");
+            print_obj_to(out, n->value);
+        }
+        fprintf(out, "}");
+        break;
+    }
+    case TAG_PMAP:
+    case TAG_PVEC:
+        print_pcoll_to(out, x, print_obj_to);
+        break;
+    case TAG_CLOSURE:
+        write_closure(out, x);
+        break;
+    case TAG_BOX:
+        fprintf(out, "#<box>");
+        break;
+    case TAG_CHANNEL:
+        fprintf(out, "#<channel>");
+        break;
+    case TAG_CANCEL:
+        fprintf(out, "#<cancel>");
+        break;
+    case TAG_THREAD:
+        fprintf(out, "#<promise>");
+        break;
+    case TAG_POOL:
+        fprintf(out, "#<pool>");
+        break;
+    case TAG_ERROR:
+        fprintf(out, "#<error %s>", error_message(x) ? error_message(x) : "");
+        break;
+    case TAG_PORT:
+        fprintf(out, "#<port>");
+        break;
+    default:
+        if (x->tag == TAG_USER_BASE && x->ptr) {
+            print_user_to(out, x, print_obj_to);
+            break;
+        }
+        fprintf(out, "#<object:%d>", x->tag);
+        break;
+    }
+}
+
+void print_obj(Obj* x) {
+    print_obj_to(stdout, x);
+}
+
+/* Character names used by write, matching the reader's #\name syntax */
+static const char* char_name(long c) {
+    switch (c) {
+    case ' ': return "space";
+    case '\n': return "newline";
+    case '\t': return "tab";
+    case '\r': return "return";
+    case 0: return "nul";
+    case 127: return "delete";
+    case 27: return "escape";
+    default: return NULL;
+    }
+}
+
+static void write_char_lit(FILE* out, long c) {
+    const char* name = char_name(c);
+    if (name) fprintf(out, "#\\%s", name);
+    else if (c < 32) fprintf(out, "#\\x%02lx", c);
+    else fprintf(out, "#\\%c", (char)c);
+}
+
+/* One character inside a double-quoted literal */
+static void write_string_char(FILE* out, long c) {
+    switch (c) {
+    case '"': fputs("\\\"", out); break;
+    case '\\': fputs("\\\\", out); break;
+    case '\n': fputs("\\n", out); break;
+    case '\t': fputs("\\t", out); break;
+    case '\r': fputs("\\r", out); break;
+    default:
+        if (c < 32 || c == 127) fprintf(out, "\\x%02lx;", c);
+        else fputc((char)c, out);
+        break;
+    }
+}
+
+/* Write a string list as a double-quoted literal with escapes */
+static void write_string(FILE* out, Obj* xs) {
+    fputc('"', out);
+    while (xs && obj_tag(xs) == TAG_PAIR) {
+        write_string_char(out, obj_to_char_val(xs->a));
+        xs = xs->b;
+    }
+    fputc('"', out);
+}
+
+/* write-style printing: output reads back as the same datum.
+ * Chars and strings are escaped; other atoms print as display does. */
+void write_obj_to(FILE* out, Obj* x) {
+    if (!x) {
+        fputs("()", out);
+        return;
+    }
+    if (IS_IMMEDIATE_INT(x)) {
+        fprintf(out, "%ld", (long)INT_IMM_VALUE(x));
+        return;
+    }
+    if (IS_IMMEDIATE_BOOL(x)) {
+        fputs(x == PURPLE_TRUE ? "#t" : "#f", out);
+        return;
+    }
+    if (obj_tag(x) == TAG_CHAR) {
+        write_char_lit(out, obj_to_char_val(x));
+        return;
+    }
+    switch (x->tag) {
+    case TAG_INT:
+        fprintf(out, "%ld", x->i);
         break;
+    case TAG_FLOAT: {
+        char buf[32];
+        format_float(buf, sizeof(buf), x->f);
+        fputs(buf, out);
+        break;
+    }
     case TAG_SYM:
-        printf("%s", x->ptr ? (char*)x->ptr : "nil");
+        fputs(x->ptr ? (char*)x->ptr : "nil", out);
+        break;
+    case TAG_KEYWORD:
+        fputc(':', out);
+        fputs((char*)x->ptr, out);
+        break;
+    case TAG_STRING:
+        fputc('"', out);
+        for (const char* c = x->ptr ? (const char*)x->ptr : ""; *c; c++) {
+            write_string_char(out, (unsigned char)*c);
+        }
+        fputc('"', out);
         break;
     case TAG_PAIR:
-        print_list(x);
+        if (is_string_list(x)) {
+            write_string(out, x);
+            break;
+        }
+        fputc('(', out);
+        for (int first = 1; x && obj_tag(x) == TAG_PAIR; x = x->b, first = 0) {
+            if (!first) fputc(' ', out);
+            write_obj_to(out, x->a);
+        }
+        if (x) {
+            fputs(" . ", out);
+            write_obj_to(out, x);
+        }
+        fputc(')', out);
+        break;
+    case TAG_VECTOR: {
+        Vector* v = (Vector*)x->ptr;
+        fputc('[', out);
+        for (long i = 0; v && i < v->len; i++) {
+            if (i > 0) fputc(' ', out);
+            write_obj_to(out, v->items[i]);
+        }
+        fputc(']', out);
+        break;
+    }
+    case TAG_HASH: {
+        HashTable* t = (HashTable*)x->ptr;
+        fputs("#{", out);
+        for (HashNode* n = t ? t->first : NULL; n; n = n->next) {
+            if (n != t->first) fputc(' ', out);
+            write_obj_to(out, n->key);
+            fputc(' ', out);
+            write_obj_to(out, n->value);
+        }
+        fputc('}', out);
+        break;
+    }
+    case TAG_PMAP:
+    case TAG_PVEC:
+        print_pcoll_to(out, x, write_obj_to);
         break;
     case TAG_CLOSURE:
-        printf("#<closure>");
+        write_closure(out, x);
         break;
     case TAG_BOX:
-        printf("#<box>");
+        fputs("#<box>", out);
         break;
     case TAG_CHANNEL:
-        printf("#<channel>");
+        fputs("#<channel>", out);
+        break;
+    case TAG_CANCEL:
+        fputs("#<cancel>", out);
+        break;
+    case TAG_THREAD:
+        fputs("#<promise>", out);
+        break;
+    case TAG_POOL:
+        fputs("#<pool>", out);
+        break;
+    case TAG_ERROR:
+        fprintf(out, "#<error %s>", error_message(x) ? error_message(x) : "");
+        break;
+    case TAG_PORT:
+        fputs("#<port>", out);
         break;
     default:
-        printf("#<object:%d>", x->tag);
+        if (x->tag == TAG_USER_BASE && x->ptr) {
+            print_user_to(out, x, write_obj_to);
+            break;
+        }
+        fprintf(out, "#<object:%d>", x->tag);
         break;
     }
 }
 
-Obj* prim_display(Obj* x) {
-    print_obj(x);
+void write_obj(Obj* x) {
+    write_obj_to(stdout, x);
+}
+
+Obj* prim_display(Obj* x) {
+    return prim_display_to(x, NULL);
+}
+
+Obj* prim_write(Obj* x) {
+    return prim_write_to(x, NULL);
+}
+
+Obj* prim_print(Obj* x) {
+    FILE* out = port_out(NULL);
+    if (!out) return port_not_open("print");
+    print_obj_to(out, x);
+    fputc('\n', out);
+    return NULL;
+}
+
+Obj* prim_newline(void) {
+    return prim_newline_to(NULL);
+}
+
+Obj* prim_display_to(Obj* x, Obj* port) {
+    FILE* out = port_out(port);
+    if (!out) return port_not_open("display");
+    print_obj_to(out, x);
+    return NULL;
+}
+
+Obj* prim_write_to(Obj* x, Obj* port) {
+    FILE* out = port_out(port);
+    if (!out) return port_not_open("write");
+    write_obj_to(out, x);
+    return NULL;
+}
+
+Obj* prim_newline_to(Obj* port) {
+    FILE* out = port_out(port);
+    if (!out) return port_not_open("newline");
+    fputc('\n', out);
+    return NULL;
+}
+
+int test_is_port(Obj* x) { return is_port(x); }
+Obj* prim_is_port(Obj* x) {
+    return mk_int(is_port(x));
+}
+
+Obj* prim_current_output_port(void) {
+    if (g_output) {
+        inc_ref(g_output);
+        return g_output;
+    }
+    return mk_port(NULL, stdout, false);
+}
+
+Obj* prim_current_input_port(void) {
+    return mk_port(stdin, NULL, false);
+}
+
+int omni_output_enter(Obj* port, Obj** outer) {
+    if (!is_port(port) || !((Port*)port->ptr)->out) return 0;
+    *outer = g_output;
+    g_output = port;
+    return 1;
+}
+
+void omni_output_leave(Obj* outer) {
+    g_output = outer;
+}
+
+Obj* prim_open_output_string(void) {
+    Obj* x = mk_port(NULL, NULL, true);
+    if (!x) return NULL;
+    Port* p = (Port*)x->ptr;
+    p->string = true;
+    p->out = open_memstream(&p->text, &p->len);
+    return x;
+}
+
+Obj* prim_get_output_string(Obj* port) {
+    if (!is_port(port) || !((Port*)port->ptr)->string) {
+        return mk_error("get-output-string: not a string port");
+    }
+    Port* p = (Port*)port->ptr;
+    if (p->out) fflush(p->out);
+    return mk_string(p->text ? p->text : "");
+}
+
+static Obj* open_file_port(Obj* path, const char* mode, const char* who) {
+    char msg[512];
+    if (obj_tag(path) != TAG_STRING || !path->ptr) {
+        snprintf(msg, sizeof(msg), "%s: not a string", who);
+        return mk_error(msg);
+    }
+    FILE* f = fopen((const char*)path->ptr, mode);
+    if (!f) {
+        snprintf(msg, sizeof(msg), "%s: cannot open the file", who);
+        return mk_error_obj(msg, path);
+    }
+    if (*mode == 'r') return mk_port(f, NULL, true);
+    /* Files are fully buffered, but a terminal shows each line as it ends */
+    if (isatty(fileno(f))) setvbuf(f, NULL, _IOLBF, BUFSIZ);
+    Obj* x = mk_port(NULL, f, true);
+    return x ? port_track(x) : NULL;
+}
+
+Obj* prim_open_input_file(Obj* path) {
+    return open_file_port(path, "r", "open-input-file");
+}
+
+Obj* prim_open_output_file(Obj* path) {
+    return open_file_port(path, "w", "open-output-file");
+}
+
+Obj* prim_tcp_connect(Obj* host, Obj* port) {
+    if (obj_tag(host) != TAG_STRING || !host->ptr || !is_int(port)) {
+        return mk_error("tcp-connect: expected a host name and a port number");
+    }
+    char service[32];
+    snprintf(service, sizeof(service), "%ld", obj_to_int(port));
+    struct addrinfo hints, *res = NULL, *ai;
+    memset(&hints, 0, sizeof(hints));
+    hints.ai_family = AF_UNSPEC;
+    hints.ai_socktype = SOCK_STREAM;
+    int fd = -1;
+    if (getaddrinfo((const char*)host->ptr, service, &hints, &res) == 0) {
+        for (ai = res; ai; ai = ai->ai_next) {
+            fd = socket(ai->ai_family, ai->ai_socktype, ai->ai_protocol);
+            if (fd < 0) continue;
+            if (connect(fd, ai->ai_addr, ai->ai_addrlen) == 0) break;
+            close(fd);
+            fd = -1;
+        }
+        freeaddrinfo(res);
+    }
+    if (fd < 0) return mk_error_obj("tcp-connect: cannot connect", host);
+    /* Separate streams, so reading never disturbs what is buffered to send */
+    FILE* in = fdopen(fd, "r");
+    FILE* out = in ? fdopen(dup(fd), "w") : NULL;
+    if (!out) {
+        if (in) fclose(in); else close(fd);
+        return mk_error_obj("tcp-connect: cannot connect", host);
+    }
+    Obj* x = mk_port(in, out, true);
+    return x ? port_track(x) : NULL;
+}
+
+/* The stream input from p comes from; what was written goes out first,
+ * so a request reaches a socket before its reply is awaited */
+static FILE* port_in(Obj* p) {
+    if (!is_port(p)) return NULL;
+    Port* port = (Port*)p->ptr;
+    if (port->out) fflush(port->out);
+    return port->in;
+}
+
+Obj* prim_read_line(Obj* port) {
+    FILE* in = port_in(port);
+    if (!in) return mk_error("read-line: not an open input port");
+    size_t len = 0, cap = 64;
+    char* buf = malloc(cap);
+    if (!buf) return NULL;
+    int c;
+    while ((c = fgetc(in)) != EOF && c != '\n') {
+        if (len + 1 >= cap) {
+            char* grown = realloc(buf, cap * 2);
+            if (!grown) {
+                free(buf);
+                return NULL;
+            }
+            buf = grown;
+            cap *= 2;
+        }
+        buf[len++] = (char)c;
+    }
+    if (c == EOF && len == 0) {
+        free(buf);
+        return NULL;
+    }
+    buf[len] = '\0';
+    Obj* line = mk_string(buf);
+    free(buf);
+    return line;
+}
+
+Obj* prim_read_char(Obj* port) {
+    FILE* in = port_in(port);
+    if (!in) return mk_error("read-char: not an open input port");
+    int c = fgetc(in);
+    return c == EOF ? NULL : mk_char(c);
+}
+
+Obj* prim_close_port(Obj* port) {
+    if (!is_port(port)) return mk_error("close-port: not a port");
+    port_close((Port*)port->ptr);
     return NULL;
 }
 
-Obj* prim_print(Obj* x) {
-    print_obj(x);
-    printf("\n");
+Obj* prim_flush_port(Obj* port) {
+    FILE* out = is_port(port) ? ((Port*)port->ptr)->out : NULL;
+    if (!out) return port_not_open("flush-port");
+    fflush(out);
     return NULL;
 }
 
-Obj* prim_newline(void) {
-    printf("\n");
+/* A borrowed stream may outlive the port, so the buffer for one is never
+ * freed */
+Obj* prim_set_port_buffer(Obj* port, Obj* size) {
+    Port* p = is_port(port) ? (Port*)port->ptr : NULL;
+    FILE* f = !p ? NULL : p->out ? p->out : p->in;
+    if (!f) return mk_error("set-port-buffer!: not an open port");
+    int mode;
+    size_t n = BUFSIZ;
+    if (obj_tag(size) == TAG_SYM && size->ptr && strcmp((const char*)size->ptr, "line") == 0) {
+        mode = _IOLBF;
+    } else if (is_int(size) && obj_to_int(size) >= 0) {
+        n = (size_t)obj_to_int(size);
+        mode = n ? _IOFBF : _IONBF;
+    } else {
+        return mk_error("set-port-buffer!: expected a size in bytes or 'line");
+    }
+    char* buf = mode == _IONBF ? NULL : malloc(n);
+    fflush(f);
+    if (setvbuf(f, buf, mode, n) != 0) {
+        free(buf);
+        return mk_error("set-port-buffer!: cannot change the buffer");
+    }
+    if (p->owned) {
+        free(p->buf);
+        p->buf = buf;
+    }
     return NULL;
 }
 
@@ -2428,12 +5155,21 @@ Obj* ctr_tag(Obj* x) {
     case TAG_FLOAT: return mk_sym("float");
     case TAG_CHAR: return mk_sym("char");
     case TAG_SYM: return mk_sym("sym");
+    case TAG_STRING: return mk_sym("string");
+    case TAG_VECTOR: return mk_sym("vector");
+    case TAG_HASH: return mk_sym("hash");
+    case TAG_CANCEL: return mk_sym("cancel");
+    case TAG_PORT: return mk_sym("port");
+    case TAG_PMAP: return mk_sym("pmap");
+    case TAG_PVEC: return mk_sym("pvec");
     case TAG_PAIR: return mk_sym("cell");
     case TAG_BOX: return mk_sym("box");
     case TAG_CLOSURE: return mk_sym("closure");
     case TAG_CHANNEL: return mk_sym("channel");
     case TAG_ATOM: return mk_sym("atom");
     case TAG_THREAD: return mk_sym("thread");
+    case TAG_POOL: return mk_sym("pool");
+    case TAG_KEYWORD: return mk_sym("keyword");
     default:
         if (x->tag >= TAG_USER_BASE) return mk_sym("user");
         return mk_sym("unknown");
@@ -2451,6 +5187,14 @@ Obj* ctr_arg(Obj* x, Obj* idx) {
     case TAG_BOX:
         if (i == 0) return (Obj*)x->ptr;
         return NULL;
+    case TAG_VECTOR: {
+        Vector* v = (Vector*)x->ptr;
+        return v && i >= 0 && i < v->len ? v->items[i] : NULL;
+    }
+    case TAG_USER_BASE: {
+        UserObj* u = (UserObj*)x->ptr;
+        return u && i >= 0 && i < u->type->field_count ? u->fields[i] : NULL;
+    }
     default:
         return NULL;
     }
@@ -2502,7 +5246,7 @@ Obj* prim_apply(Obj* fn, Obj* args) {
     /* Count args */
     int n = 0;
     Obj* p = args;
-    while (p && p->tag == TAG_PAIR) { n++; p = p->b; }
+    while (p && obj_tag(p) == TAG_PAIR) { n++; p = p->b; }
 
     /* Build args array */
     Obj** arr = n > 0 ? malloc(n * sizeof(Obj*)) : NULL;
@@ -2564,20 +5308,55 @@ Obj* obj_cdr(Obj* p) {
     return r;
 }
 
+/* The primitives car, cdr and cons, under the names the compiler calls
+ * and passes as function values; arguments are borrowed */
+Obj* prim_car(Obj* p) { return obj_car(p); }
+Obj* prim_cdr(Obj* p) { return obj_cdr(p); }
+Obj* prim_cons(Obj* a, Obj* b) {
+    inc_ref(a);
+    inc_ref(b);
+    return mk_pair(a, b);
+}
+
+/* Checked mode: list operations reject a dotted tail instead of treating
+ * it as the end of the list. The compiled program turns it on. */
+static int g_checked_lists = 0;
+
+void set_checked_lists(int on) {
+    g_checked_lists = on;
+}
+
+/* An error naming the operation; the offending tail is its data */
+static Obj* improper_list_error(const char* op, Obj* tail, long n) {
+    char msg[128];
+    snprintf(msg, sizeof(msg), "%s: improper list, non-list tail after %ld element%s",
+             op, n, n == 1 ? "" : "s");
+    return mk_error_obj(msg, tail);
+}
+
+#define LIST_IMPROPER(xs) (g_checked_lists && (xs) != NULL)
+
 Obj* list_length(Obj* xs) {
     long n = 0;
-    while (xs && xs->tag == TAG_PAIR) {
+    while (xs && obj_tag(xs) == TAG_PAIR) {
         n++;
         xs = xs->b;
     }
+    if (LIST_IMPROPER(xs)) return improper_list_error("length", xs, n);
     return mk_int(n);
 }
 
+Obj* prim_proper_list(Obj* x) {
+    while (x && obj_tag(x) == TAG_PAIR) x = x->b;
+    return mk_int(x == NULL ? 1 : 0);
+}
+
 Obj* list_map(Obj* fn, Obj* xs) {
     if (!fn) return NULL;
     Obj* head = NULL;
     Obj* tail = NULL;
-    while (xs && xs->tag == TAG_PAIR) {
+    long n = 0;
+    while (xs && obj_tag(xs) == TAG_PAIR) {
         Obj* args[1];
         args[0] = xs->a;
         Obj* val = call_closure(fn, args, 1);
@@ -2589,29 +5368,53 @@ Obj* list_map(Obj* fn, Obj* xs) {
         }
         tail = node;
         xs = xs->b;
+        n++;
+    }
+    if (LIST_IMPROPER(xs)) {
+        if (head) dec_ref(head);
+        return improper_list_error("map", xs, n);
     }
     return head;
 }
 
+Obj* list_for_each(Obj* fn, Obj* xs) {
+    if (!fn) return NULL;
+    long n = 0;
+    while (xs && obj_tag(xs) == TAG_PAIR) {
+        Obj* args[1];
+        args[0] = xs->a;
+        Obj* val = call_closure(fn, args, 1);
+        if (val) dec_ref(val);
+        xs = xs->b;
+        n++;
+    }
+    if (LIST_IMPROPER(xs)) return improper_list_error("for-each", xs, n);
+    return NULL;
+}
+
 Obj* list_fold(Obj* fn, Obj* init, Obj* xs) {
     if (!fn) return init;
     Obj* acc = init;
-    while (xs && xs->tag == TAG_PAIR) {
+    long n = 0;
+    while (xs && obj_tag(xs) == TAG_PAIR) {
         Obj* args[2];
         args[0] = acc;
         args[1] = xs->a;
         acc = call_closure(fn, args, 2);
         xs = xs->b;
+        n++;
     }
+    if (LIST_IMPROPER(xs)) return improper_list_error("fold", xs, n);
     return acc;
 }
 
 Obj* list_append(Obj* a, Obj* b) {
+    if (a && obj_tag(a) != TAG_PAIR && g_checked_lists) return improper_list_error("append", a, 0);
     if (!a || a->tag != TAG_PAIR) return b;
     /* Build a copy of list a, then append b */
     Obj* head = NULL;
     Obj* tail = NULL;
-    while (a && a->tag == TAG_PAIR) {
+    while (a && obj_tag(a) == TAG_PAIR) {
         Obj* node = mk_pair(a->a, NULL);
         if (node->a) inc_ref(node->a);
         if (!head) {
@@ -2622,6 +5425,12 @@ Obj* list_append(Obj* a, Obj* b) {
         tail = node;
         a = a->b;
     }
+    if (LIST_IMPROPER(a)) {
+        long n = 0;
+        for (Obj* p = head; p; p = p->b) n++;
+        dec_ref(head);
+        return improper_list_error("append", a, n);
+    }
     if (tail) {
         tail->b = b;
         if (b) inc_ref(b);
@@ -2636,6 +5445,7 @@ Obj* list_filter(Obj* fn, Obj* xs) {
     if (!fn) return NULL;
     Obj* head = NULL;
     Obj* tail = NULL;
+    long n = 0;
     while (xs && obj_tag(xs) == TAG_PAIR) {
         Obj* args[1];
         args[0] = xs->a;
@@ -2654,17 +5464,28 @@ Obj* list_filter(Obj* fn, Obj* xs) {
             tail = node;
         }
         xs = xs->b;
+        n++;
+    }
+    if (LIST_IMPROPER(xs)) {
+        if (head) dec_ref(head);
+        return improper_list_error("filter", xs, n);
     }
     return head;
 }
 
 Obj* list_reverse(Obj* xs) {
     Obj* result = NULL;
-    while (xs && xs->tag == TAG_PAIR) {
+    long n = 0;
+    while (xs && obj_tag(xs) == TAG_PAIR) {
         Obj* node = mk_pair(xs->a, result);
         if (xs->a) inc_ref(xs->a);
         result = node;
         xs = xs->b;
+        n++;
+    }
+    if (LIST_IMPROPER(xs)) {
+        if (result) dec_ref(result);
+        return improper_list_error("reverse", xs, n);
     }
     return result;
 }
@@ -2678,7 +5499,7 @@ Obj* list_foldr(Obj* fn, Obj* init, Obj* xs) {
     Obj* acc = init;
     if (init) inc_ref(init);
     Obj* p = reversed;
-    while (p && p->tag == TAG_PAIR) {
+    while (p && obj_tag(p) == TAG_PAIR) {
         Obj* args[2];
         args[0] = p->a;
         args[1] = acc;
@@ -2703,6 +5524,23 @@ void scan_obj(Obj* x) {
     case TAG_BOX:
         scan_obj((Obj*)x->ptr);
         break;
+    case TAG_VECTOR: {
+        Vector* v = (Vector*)x->ptr;
+        for (long i = 0; v && i < v->len; i++) scan_obj(v->items[i]);
+        break;
+    }
+    case TAG_HASH: {
+        HashTable* t = (HashTable*)x->ptr;
+        for (HashNode* n = t ? t->first : NULL; n; n = n->next) {
+            scan_obj(n->key);
+            scan_obj(n->value);
+        }
+        break;
+    }
+    case TAG_PMAP:
+    case TAG_PVEC:
+        scan_pcoll(x, scan_obj);
+        break;
     case TAG_CLOSURE: {
         Closure* c = (Closure*)x->ptr;
         if (c && c->captures) {
@@ -2731,6 +5569,23 @@ void clear_marks_obj(Obj* x) {
     case TAG_BOX:
         clear_marks_obj((Obj*)x->ptr);
         break;
+    case TAG_VECTOR: {
+        Vector* v = (Vector*)x->ptr;
+        for (long i = 0; v && i < v->len; i++) clear_marks_obj(v->items[i]);
+        break;
+    }
+    case TAG_HASH: {
+        HashTable* t = (HashTable*)x->ptr;
+        for (HashNode* n = t ? t->first : NULL; n; n = n->next) {
+            clear_marks_obj(n->key);
+            clear_marks_obj(n->value);
+        }
+        break;
+    }
+    case TAG_PMAP:
+    case TAG_PVEC:
+        scan_pcoll(x, clear_marks_obj);
+        break;
     case TAG_CLOSURE: {
         Closure* c = (Closure*)x->ptr;
         if (c && c->captures) {
@@ -2797,23 +5652,9 @@ Obj* reuse_as_pair(Obj* old, Obj* a, Obj* b) {
 #include <pthread.h>
 #include <stdbool.h>
 
-/* === Atomic Reference Counting for Shared Objects === */
-
-/* Atomic increment */
-static inline void atomic_inc_ref(Obj* obj) {
-    if (obj) {
-        __atomic_add_fetch(&obj->mark, 1, __ATOMIC_SEQ_CST);
-    }
-}
-
-/* Atomic decrement with potential free */
-static inline void atomic_dec_ref(Obj* obj) {
-    if (obj) {
-        if (__atomic_sub_fetch(&obj->mark, 1, __ATOMIC_SEQ_CST) == 0) {
-            free_obj(obj);
-        }
-    }
-}
+/* Every thread starts here; see Scheduling below */
+static int start_thread(pthread_t* thread, void* (*entry)(void*), void* arg, const char* form);
+static void run_inline(void* (*entry)(void*), void* arg, const char* form);
 
 /* Try to acquire unique ownership (for in-place updates) */
 static inline bool try_acquire_unique(Obj* obj) {
@@ -2825,6 +5666,16 @@ static inline bool try_acquire_unique(Obj* obj) {
 
 /* === Channel Operations with Ownership Transfer === */
 
+/* Blocking receives give up when cancelled; see Nurseries below */
+static int wait_or_cancel(pthread_cond_t* cond, pthread_mutex_t* lock);
+
+/*
+ * A channel with capacity 0 is unbuffered: channel_send returns only once
+ * a receiver has taken the value, so the two threads rendezvous. A send
+ * that is still waiting when the channel closes withdraws its value and
+ * returns false, leaving it with the sender.
+ */
+
 typedef struct Channel Channel;
 struct Channel {
     Obj** buffer;       /* Ring buffer for values */
@@ -2835,6 +5686,7 @@ struct Channel {
     Obj* slot;          /* Unbuffered handoff slot */
     bool has_slot;
     int waiting_receivers;
+    unsigned long handoffs;  /* Values taken from the slot so far */
     pthread_mutex_t lock;
     pthread_cond_t not_empty;
     pthread_cond_t not_full;
@@ -2861,6 +5713,7 @@ Obj* make_channel(int capacity) {
     ch->slot = NULL;
     ch->has_slot = false;
     ch->waiting_receivers = 0;
+    ch->handoffs = 0;
     ch->closed = false;
 
     pthread_mutex_init(&ch->lock, NULL);
@@ -2897,33 +5750,34 @@ static Channel* channel_payload(Obj* ch_obj) {
 /* After send, caller should NOT use or free the value */
 int channel_send(Obj* ch_obj, Obj* value) {
     Channel* ch = channel_payload(ch_obj);
-    if (!ch || ch->closed) return false;
+    if (!ch) return false;
+    share_persistent(value);
 
     pthread_mutex_lock(&ch->lock);
 
     if (ch->capacity == 0) {
-        while (ch->waiting_receivers == 0 && !ch->closed) {
-            pthread_cond_wait(&ch->not_full, &ch->lock);
-        }
-        if (ch->closed) {
-            pthread_mutex_unlock(&ch->lock);
-            return false;
-        }
-        while (ch->has_slot && !ch->closed) {
+        /* Wait for a receiver and a free slot, then wait for the handoff */
+        while ((ch->has_slot || ch->waiting_receivers == 0) && !ch->closed) {
             pthread_cond_wait(&ch->not_full, &ch->lock);
         }
         if (ch->closed) {
             pthread_mutex_unlock(&ch->lock);
             return false;
         }
+        unsigned long ticket = ch->handoffs;
         ch->slot = value;
         ch->has_slot = true;
-        pthread_cond_signal(&ch->not_empty);
-        while (ch->has_slot && !ch->closed) {
+        pthread_cond_broadcast(&ch->not_empty);
+        while (ch->handoffs == ticket && !ch->closed) {
             pthread_cond_wait(&ch->not_full, &ch->lock);
         }
+        bool taken = ch->handoffs != ticket;
+        if (!taken) {
+            ch->slot = NULL;
+            ch->has_slot = false;
+        }
         pthread_mutex_unlock(&ch->lock);
-        return !ch->closed;
+        return taken;
     }
 
     /* Wait for space */
@@ -2948,7 +5802,8 @@ int channel_send(Obj* ch_obj, Obj* value) {
 }
 
 /* Receive value from channel (RECEIVES OWNERSHIP) */
-/* Caller becomes owner, must free when done */
+/* Caller becomes owner, must free when done. Inside a nursery or
+ * with-cancel, a cancelled wait returns (error 'cancelled) instead. */
 Obj* channel_recv(Obj* ch_obj) {
     Channel* ch = channel_payload(ch_obj);
     if (!ch) return NULL;
@@ -2957,9 +5812,14 @@ Obj* channel_recv(Obj* ch_obj) {
 
     if (ch->capacity == 0) {
         ch->waiting_receivers++;
-        pthread_cond_signal(&ch->not_full);
+        pthread_cond_broadcast(&ch->not_full);
         while (!ch->has_slot && !ch->closed) {
-            pthread_cond_wait(&ch->not_empty, &ch->lock);
+            /* A value handed over during the wait is still taken */
+            if (!wait_or_cancel(&ch->not_empty, &ch->lock) && !ch->has_slot) {
+                ch->waiting_receivers--;
+                pthread_mutex_unlock(&ch->lock);
+                return mk_error("cancelled");
+            }
         }
         ch->waiting_receivers--;
         if (!ch->has_slot) {
@@ -2969,14 +5829,18 @@ Obj* channel_recv(Obj* ch_obj) {
         Obj* value = ch->slot;
         ch->slot = NULL;
         ch->has_slot = false;
-        pthread_cond_signal(&ch->not_full);
+        ch->handoffs++;
+        pthread_cond_broadcast(&ch->not_full);
         pthread_mutex_unlock(&ch->lock);
         return value;
     }
 
     /* Wait for data */
     while (ch->count == 0 && !ch->closed) {
-        pthread_cond_wait(&ch->not_empty, &ch->lock);
+        if (!wait_or_cancel(&ch->not_empty, &ch->lock)) {
+            pthread_mutex_unlock(&ch->lock);
+            return mk_error("cancelled");
+        }
     }
 
     if (ch->count == 0) {
@@ -2990,106 +5854,558 @@ Obj* channel_recv(Obj* ch_obj) {
     ch->read_pos = (ch->read_pos + 1) % ch->capacity;
     ch->count--;
 
-    pthread_cond_signal(&ch->not_full);
-    pthread_mutex_unlock(&ch->lock);
+    pthread_cond_signal(&ch->not_full);
+    pthread_mutex_unlock(&ch->lock);
+
+    return value;  /* Caller owns this */
+}
+
+/* Close a channel */
+void channel_close(Obj* ch_obj) {
+    Channel* ch = channel_payload(ch_obj);
+    if (!ch) return;
+
+    pthread_mutex_lock(&ch->lock);
+    ch->closed = true;
+    pthread_cond_broadcast(&ch->not_empty);
+    pthread_cond_broadcast(&ch->not_full);
+    pthread_mutex_unlock(&ch->lock);
+}
+
+/* Free a channel */
+void free_channel_obj(Obj* ch_obj) {
+    Channel* ch = channel_payload(ch_obj);
+    if (!ch) return;
+
+    /* Free any remaining values (ownership cleanup) */
+    if (ch->capacity == 0) {
+        if (ch->has_slot && ch->slot) {
+            dec_ref(ch->slot);
+        }
+    } else {
+        while (ch->count > 0) {
+            Obj* val = ch->buffer[ch->read_pos];
+            if (val) dec_ref(val);
+            ch->read_pos = (ch->read_pos + 1) % ch->capacity;
+            ch->count--;
+        }
+    }
+
+    free(ch->buffer);
+    pthread_mutex_destroy(&ch->lock);
+    pthread_cond_destroy(&ch->not_empty);
+    pthread_cond_destroy(&ch->not_full);
+    free(ch);
+    if (ch_obj) {
+        ch_obj->ptr = NULL;
+    }
+}
+
+/* === Goroutine Spawning === */
+
+typedef struct GoroutineArg GoroutineArg;
+struct GoroutineArg {
+    Obj* closure;       /* The closure to run */
+    Obj** captured;     /* Captured variables (with inc_ref'd ownership) */
+    int captured_count;
+};
+
+/* Thread entry point */
+static void* goroutine_entry(void* arg) {
+    GoroutineArg* ga = (GoroutineArg*)arg;
+
+    /* Call the closure */
+    if (ga->closure) {
+        call_closure(ga->closure, NULL, 0);
+        dec_ref(ga->closure);
+    }
+
+    /* Release captured variables */
+    for (int i = 0; i < ga->captured_count; i++) {
+        if (ga->captured[i]) {
+            atomic_dec_ref(ga->captured[i]);
+        }
+    }
+
+    free(ga->captured);
+    free(ga);
+    return NULL;
+}
+
+/* Spawn a goroutine */
+void spawn_goroutine(Obj* closure, Obj** captured, int count) {
+    GoroutineArg* arg = malloc(sizeof(GoroutineArg));
+    if (!arg) return;
+
+    /* Transfer ownership of closure to goroutine */
+    arg->closure = closure;
+    inc_ref(closure);
+
+    /* Copy and increment captured variables (they become shared) */
+    arg->captured_count = count;
+    arg->captured = malloc(sizeof(Obj*) * count);
+    for (int i = 0; i < count; i++) {
+        arg->captured[i] = captured[i];
+        if (captured[i]) {
+            atomic_inc_ref(captured[i]);
+        }
+    }
+
+    pthread_t thread;
+    if (start_thread(&thread, goroutine_entry, arg, "spawn_goroutine")) {
+        pthread_detach(thread);  /* Don't wait for completion */
+    }
+}
+
+/* === Goroutines and Wait Groups === */
+/*
+ * See purple.h. A goroutine belongs to the wait group that was innermost
+ * on the thread starting it, if any, and so do the goroutines it starts.
+ */
+
+typedef struct OmniWaitGroup {
+    pthread_mutex_t lock;
+    pthread_cond_t done;
+    int pending;                    /* Goroutines started and not ended */
+    struct OmniWaitGroup* parent;
+} OmniWaitGroup;
+
+static __thread OmniWaitGroup* g_wait_group = NULL;
+
+typedef struct OmniGoroutine {
+    ClosureFn fn;
+    Obj** captures;     /* Released when the goroutine ends */
+    int count;
+    uint64_t shared;    /* Bit i: captures[i] is counted atomically */
+    OmniWaitGroup* group;
+} OmniGoroutine;
+
+static void wait_group_done(OmniWaitGroup* w) {
+    if (!w) return;
+    pthread_mutex_lock(&w->lock);
+    if (--w->pending == 0) pthread_cond_broadcast(&w->done);
+    pthread_mutex_unlock(&w->lock);
+}
+
+static void goroutine_free(OmniGoroutine* g) {
+    for (int i = 0; i < g->count; i++) {
+        if (!g->captures[i]) continue;
+        if (g->shared >> i & 1) atomic_dec_ref(g->captures[i]);
+        else dec_ref(g->captures[i]);
+    }
+    free(g->captures);
+    free(g);
+}
+
+static void* go_entry(void* arg) {
+    OmniGoroutine* g = (OmniGoroutine*)arg;
+    OmniWaitGroup* w = g->group;
+    g_wait_group = w;
+    Obj* result = g->fn(g->captures, NULL, 0);
+    if (result) dec_ref(result);
+    goroutine_free(g);
+    wait_group_done(w);
+    return NULL;
+}
+
+Obj* omni_go(ClosureFn fn, Obj** captures, int count, uint64_t shared) {
+    OmniGoroutine* g = calloc(1, sizeof(OmniGoroutine));
+    if (!g) return mk_error("go: out of memory");
+    g->fn = fn;
+    g->count = count;
+    g->shared = shared;
+    g->group = g_wait_group;
+    if (count > 0) {
+        g->captures = malloc(sizeof(Obj*) * count);
+        for (int i = 0; i < count; i++) {
+            g->captures[i] = captures[i];
+            if (!captures[i]) continue;
+            if (shared >> i & 1) {
+                atomic_inc_ref(captures[i]);
+            } else {
+                share_persistent(captures[i]);
+                inc_ref(captures[i]);
+            }
+        }
+    }
+    if (g->group) {
+        pthread_mutex_lock(&g->group->lock);
+        g->group->pending++;
+        pthread_mutex_unlock(&g->group->lock);
+    }
+
+    if (g_scheduler == SCHED_INLINE) {
+        run_inline(go_entry, g, "go");
+        return NULL;
+    }
+    pthread_t thread;
+    if (!start_thread(&thread, go_entry, g, "go")) {
+        OmniWaitGroup* w = g->group;
+        goroutine_free(g);
+        wait_group_done(w);
+        return mk_error("go: cannot start a thread");
+    }
+    pthread_detach(thread);
+    return NULL;
+}
+
+void omni_wait_group_enter(OmniWaitGroup* w) {
+    pthread_mutex_init(&w->lock, NULL);
+    pthread_cond_init(&w->done, NULL);
+    w->pending = 0;
+    w->parent = g_wait_group;
+    g_wait_group = w;
+}
+
+Obj* omni_wait_group_leave(OmniWaitGroup* w, Obj* value) {
+    g_wait_group = w->parent;
+    pthread_mutex_lock(&w->lock);
+    while (w->pending > 0) pthread_cond_wait(&w->done, &w->lock);
+    pthread_mutex_unlock(&w->lock);
+    pthread_mutex_destroy(&w->lock);
+    pthread_cond_destroy(&w->done);
+    return value;
+}
+
+/* === Nurseries (Structured Concurrency) === */
+/*
+ * See purple.h. A thread is inside at most one innermost frame
+ * (g_nursery): a nursery or with-cancel body it is running, or the
+ * nursery its task was spawned into. Cancellation unwinds to the
+ * innermost frame this thread owns: the body of g_nursery when
+ * g_nursery_bodies > 0, otherwise the entry of its task.
+ */
+
+typedef struct OmniTask OmniTask;
+
+typedef struct OmniNursery {
+    jmp_buf jump;
+    pthread_mutex_t lock;
+    OmniTask* first;
+    OmniTask* last;
+    int cancelled;
+    int unwound;
+    Obj* failure;
+    OmniBudget* budget;
+    OmniBudget* unwinding;
+    Obj* token;
+    int collects;
+    Obj* output;
+    struct OmniNursery* parent;
+} OmniNursery;
+
+struct OmniTask {
+    ClosureFn fn;
+    Obj** captures;     /* atomic_inc_ref'd; released after the join */
+    int count;
+    Obj* result;        /* Owned until omni_nursery_leave collects it */
+    pthread_t thread;
+    bool started;
+    jmp_buf jump;       /* Cancellation unwinds the task to here */
+    OmniNursery* nursery;
+    struct OmniTask* next;
+};
+
+static __thread OmniNursery* g_nursery = NULL;
+static __thread OmniTask* g_task = NULL;
+static __thread int g_nursery_bodies = 0;
+
+/* === Scheduling === */
+/*
+ * Tasks, goroutines and futures each get a thread of their own, unless
+ * PURPLE_SCHEDULER is inline: then each runs to its end where it is
+ * started, with the thread-local state a new thread begins with, so a
+ * program runs on one thread in a repeatable order. Code that waits for
+ * something a later part of the program does, a channel send say, never
+ * wakes under it.
+ */
+
+/* pthread_create, logged at debug; 0 if no thread could be started.
+ * Reference counts are atomic from the first thread on. */
+static int start_thread(pthread_t* thread, void* (*entry)(void*), void* arg, const char* form) {
+    __atomic_store_n(&g_threaded, 1, __ATOMIC_RELEASE);
+    if (pthread_create(thread, NULL, entry, arg) != 0) return 0;
+    if (g_log_level >= LOG_DEBUG) fprintf(stderr, "purple: %s started a thread\n", form);
+    return 1;
+}
+
+static void run_inline(void* (*entry)(void*), void* arg, const char* form) {
+    if (g_log_level >= LOG_DEBUG) fprintf(stderr, "purple: %s runs inline\n", form);
+    OmniNursery* nursery = g_nursery;
+    OmniTask* task = g_task;
+    int bodies = g_nursery_bodies;
+    OmniBudget* budget = g_budget;
+    Obj* output = g_output;
+    OmniWaitGroup* group = g_wait_group;
+    g_nursery = NULL;
+    g_task = NULL;
+    g_nursery_bodies = 0;
+    g_budget = NULL;
+    g_output = NULL;
+    g_wait_group = NULL;
+    entry(arg);
+    g_nursery = nursery;
+    g_task = task;
+    g_nursery_bodies = bodies;
+    g_budget = budget;
+    g_output = output;
+    g_wait_group = group;
+}
+
+/* Record err as n's failure if it is the first; 1 if n now holds it */
+static int nursery_fail(OmniNursery* n, Obj* err) {
+    pthread_mutex_lock(&n->lock);
+    int first = n->failure == NULL;
+    if (first) n->failure = err;
+    pthread_mutex_unlock(&n->lock);
+    __atomic_store_n(&n->cancelled, 1, __ATOMIC_SEQ_CST);
+    return first;
+}
+
+/* Cancel tokens: the flag lives in i and is only ever set */
+static int is_cancel_obj(Obj* x) { return x && obj_tag(x) == TAG_CANCEL; }
+
+Obj* prim_make_cancel(void) {
+    budget_charge();
+    Obj* x = malloc(sizeof(Obj));
+    if (!x) return NULL;
+    x->generation = _next_generation();
+    x->mark = 1;
+    x->tag = TAG_CANCEL;
+    x->is_pair = 0;
+    x->scc_id = -1;
+    x->scan_tag = 0;
+    x->i = 0;
+    return x;
+}
+
+Obj* prim_cancel(Obj* tok) {
+    if (!is_cancel_obj(tok)) return mk_error("cancel!: not a cancel token");
+    __atomic_store_n(&tok->i, 1, __ATOMIC_SEQ_CST);
+    return NULL;
+}
+
+Obj* prim_is_cancelled(Obj* tok) {
+    if (!is_cancel_obj(tok)) return mk_error("cancelled?: not a cancel token");
+    return mk_int(__atomic_load_n(&tok->i, __ATOMIC_SEQ_CST) != 0);
+}
+
+/* Whether this thread's innermost frame or one around it was cancelled */
+static int cancel_requested(void) {
+    for (OmniNursery* n = g_nursery; n; n = n->parent) {
+        if (__atomic_load_n(&n->cancelled, __ATOMIC_SEQ_CST)) return 1;
+        if (n->token && __atomic_load_n(&n->token->i, __ATOMIC_SEQ_CST)) return 1;
+    }
+    return 0;
+}
+
+static void nursery_safe_point(void) {
+    if (!g_nursery || !cancel_requested()) return;
+    if (g_nursery_bodies > 0) {
+        g_budget = g_nursery->budget;
+        g_nursery->unwound = 1;
+        longjmp(g_nursery->jump, 1);
+    }
+    if (!g_task) return;    /* No task to unwind */
+    g_budget = NULL;
+    longjmp(g_task->jump, 1);
+}
 
-    return value;  /* Caller owns this */
+void omni_cancel_point(void) {
+    nursery_safe_point();
 }
 
-/* Close a channel */
-void channel_close(Obj* ch_obj) {
-    Channel* ch = channel_payload(ch_obj);
-    if (!ch) return;
+/* Wait on cond, but give up when this thread is cancelled: 0 then, and
+ * the caller unlocks and returns (error 'cancelled). Inside a frame the
+ * wait is sliced so a cancel! from any thread is seen within
+ * CANCEL_POLL_MS; elsewhere it is a plain pthread_cond_wait. */
+#define CANCEL_POLL_MS 10
 
-    pthread_mutex_lock(&ch->lock);
-    ch->closed = true;
-    pthread_cond_broadcast(&ch->not_empty);
-    pthread_cond_broadcast(&ch->not_full);
-    pthread_mutex_unlock(&ch->lock);
+static int wait_or_cancel(pthread_cond_t* cond, pthread_mutex_t* lock) {
+    if (!g_nursery) {
+        pthread_cond_wait(cond, lock);
+        return 1;
+    }
+    if (cancel_requested()) return 0;
+    struct timespec ts;
+    clock_gettime(CLOCK_REALTIME, &ts);
+    ts.tv_nsec += CANCEL_POLL_MS * 1000000L;
+    if (ts.tv_nsec >= 1000000000L) {
+        ts.tv_sec++;
+        ts.tv_nsec -= 1000000000L;
+    }
+    pthread_cond_timedwait(cond, lock, &ts);
+    return !cancel_requested();
 }
 
-/* Free a channel */
-void free_channel_obj(Obj* ch_obj) {
-    Channel* ch = channel_payload(ch_obj);
-    if (!ch) return;
+/* A budget entered outside the current nursery body ran out: unwind the
+ * body first, so its tasks are joined; omni_nursery_leave resumes the jump */
+static void nursery_budget_jump(OmniBudget* hit) {
+    if (g_nursery_bodies == 0) return;
+    for (OmniBudget* b = g_nursery->budget; b; b = b->outer) {
+        if (b != hit) continue;
+        g_nursery->unwinding = hit;
+        __atomic_store_n(&g_nursery->cancelled, 1, __ATOMIC_SEQ_CST);
+        g_budget = g_nursery->budget;
+        longjmp(g_nursery->jump, 1);
+    }
+}
 
-    /* Free any remaining values (ownership cleanup) */
-    if (ch->capacity == 0) {
-        if (ch->has_slot && ch->slot) {
-            dec_ref(ch->slot);
-        }
+static void* task_entry(void* arg) {
+    OmniTask* t = (OmniTask*)arg;
+    Obj* result;
+    g_task = t;
+    g_nursery = t->nursery;
+    if (setjmp(t->jump)) {
+        g_nursery = NULL;
+        result = mk_error("cancelled");
     } else {
-        while (ch->count > 0) {
-            Obj* val = ch->buffer[ch->read_pos];
-            if (val) dec_ref(val);
-            ch->read_pos = (ch->read_pos + 1) % ch->capacity;
-            ch->count--;
-        }
+        result = t->fn(t->captures, NULL, 0);
+        g_nursery = NULL;
+        if (is_error(result)) nursery_fail(t->nursery, result);
     }
+    g_task = NULL;
+    t->result = result;
+    return NULL;
+}
 
-    free(ch->buffer);
-    pthread_mutex_destroy(&ch->lock);
-    pthread_cond_destroy(&ch->not_empty);
-    pthread_cond_destroy(&ch->not_full);
-    free(ch);
-    if (ch_obj) {
-        ch_obj->ptr = NULL;
-    }
+static void nursery_open(OmniNursery* n, Obj* token, int collects) {
+    pthread_mutex_init(&n->lock, NULL);
+    n->first = NULL;
+    n->last = NULL;
+    n->cancelled = 0;
+    n->unwound = 0;
+    n->failure = NULL;
+    n->budget = g_budget;
+    n->unwinding = NULL;
+    n->token = token;
+    n->collects = collects;
+    n->output = g_output;
+    n->parent = g_nursery;
+    g_nursery = n;
+    g_nursery_bodies++;
 }
 
-/* === Goroutine Spawning === */
+static void nursery_close(OmniNursery* n) {
+    g_nursery = n->parent;
+    g_nursery_bodies--;
+    g_output = n->output;
+}
 
-typedef struct GoroutineArg GoroutineArg;
-struct GoroutineArg {
-    Obj* closure;       /* The closure to run */
-    Obj** captured;     /* Captured variables (with inc_ref'd ownership) */
-    int captured_count;
-};
+/* Carry an outer budget's unwinding on past the frame that paused it */
+static void nursery_resume_unwind(OmniBudget* hit) {
+    nursery_budget_jump(hit);
+    g_budget = hit->outer;
+    longjmp(hit->jump, 1);
+}
 
-/* Thread entry point */
-static void* goroutine_entry(void* arg) {
-    GoroutineArg* ga = (GoroutineArg*)arg;
+void omni_nursery_enter(OmniNursery* n) {
+    nursery_open(n, NULL, 1);
+}
 
-    /* Call the closure */
-    if (ga->closure) {
-        call_closure(ga->closure, NULL, 0);
-        dec_ref(ga->closure);
-    }
+int omni_cancel_enter(OmniNursery* n, Obj* token) {
+    if (!is_cancel_obj(token)) return 0;
+    nursery_open(n, token, 0);
+    return 1;
+}
 
-    /* Release captured variables */
-    for (int i = 0; i < ga->captured_count; i++) {
-        if (ga->captured[i]) {
-            atomic_dec_ref(ga->captured[i]);
+Obj* omni_cancel_leave(OmniNursery* n, Obj* value) {
+    nursery_close(n);
+    pthread_mutex_destroy(&n->lock);
+    if (n->unwinding) nursery_resume_unwind(n->unwinding);
+    if (!n->unwound) return value;
+    if (value) dec_ref(value);
+    return mk_error("cancelled");
+}
+
+Obj* omni_spawn(ClosureFn fn, Obj** captures, int count) {
+    OmniNursery* n = g_nursery;
+    while (n && !n->collects) n = n->parent;
+    if (!n) return mk_error("spawn: not inside a nursery");
+    OmniTask* t = calloc(1, sizeof(OmniTask));
+    if (!t) return mk_error("spawn: out of memory");
+    t->fn = fn;
+    t->count = count;
+    t->nursery = n;
+    if (count > 0) {
+        t->captures = malloc(sizeof(Obj*) * count);
+        for (int i = 0; i < count; i++) {
+            t->captures[i] = captures[i];
+            if (captures[i]) atomic_inc_ref(captures[i]);
         }
     }
 
-    free(ga->captured);
-    free(ga);
+    int runs_inline = g_scheduler == SCHED_INLINE;
+    pthread_mutex_lock(&n->lock);
+    if (n->last) n->last->next = t;
+    else n->first = t;
+    n->last = t;
+    if (!runs_inline) t->started = start_thread(&t->thread, task_entry, t, "spawn");
+    pthread_mutex_unlock(&n->lock);
+
+    if (runs_inline) {
+        run_inline(task_entry, t, "spawn");
+    } else if (!t->started) {
+        t->result = mk_error("spawn: cannot start a thread");
+        nursery_fail(n, t->result);
+    }
     return NULL;
 }
 
-/* Spawn a goroutine */
-void spawn_goroutine(Obj* closure, Obj** captured, int count) {
-    GoroutineArg* arg = malloc(sizeof(GoroutineArg));
-    if (!arg) return;
-
-    /* Transfer ownership of closure to goroutine */
-    arg->closure = closure;
-    inc_ref(closure);
-
-    /* Copy and increment captured variables (they become shared) */
-    arg->captured_count = count;
-    arg->captured = malloc(sizeof(Obj*) * count);
-    for (int i = 0; i < count; i++) {
-        arg->captured[i] = captured[i];
-        if (captured[i]) {
-            atomic_inc_ref(captured[i]);
+Obj* omni_nursery_leave(OmniNursery* n, Obj* value) {
+    nursery_close(n);
+    if (is_error(value)) {
+        if (!nursery_fail(n, value)) dec_ref(value);
+    } else if (value) {
+        dec_ref(value);
+    }
+
+    /* Tasks may spawn more tasks into n until they are joined */
+    int count = 0;
+    pthread_mutex_lock(&n->lock);
+    OmniTask* t = n->first;
+    pthread_mutex_unlock(&n->lock);
+    while (t) {
+        if (t->started) pthread_join(t->thread, NULL);
+        count++;
+        pthread_mutex_lock(&n->lock);
+        t = t->next;
+        pthread_mutex_unlock(&n->lock);
+    }
+
+    bool keep = !n->failure && !n->unwound && !n->unwinding;
+    Obj** results = malloc(sizeof(Obj*) * (count > 0 ? count : 1));
+    int i = 0;
+    for (t = n->first; t; ) {
+        OmniTask* next = t->next;
+        results[i++] = t->result;
+        if (!keep && t->result && t->result != n->failure) dec_ref(t->result);
+        for (int j = 0; j < t->count; j++) {
+            if (t->captures[j]) atomic_dec_ref(t->captures[j]);
         }
+        free(t->captures);
+        free(t);
+        t = next;
     }
+    pthread_mutex_destroy(&n->lock);
 
-    pthread_t thread;
-    pthread_create(&thread, NULL, goroutine_entry, arg);
-    pthread_detach(thread);  /* Don't wait for completion */
+    if (n->unwinding) {
+        free(results);
+        if (n->failure) dec_ref(n->failure);
+        nursery_resume_unwind(n->unwinding);
+    }
+
+    Obj* out = NULL;
+    if (n->failure) {
+        out = n->failure;
+    } else if (n->unwound) {
+        out = mk_error("cancelled");
+    } else {
+        /* Results move into the list, in spawn order */
+        for (i = count; i > 0; i--) out = mk_pair(results[i - 1], out);
+    }
+    free(results);
+    return out;
 }
 
 /* === Atom (Atomic Reference) Operations === */
@@ -3227,6 +6543,12 @@ struct ThreadHandle {
     bool done;
     pthread_mutex_t lock;
     pthread_cond_t cond;
+    /* Set for futures: the lifted body and the locals it shares */
+    ClosureFn fn;
+    Obj** captures;
+    int count;
+    bool ran_inline;    /* PURPLE_SCHEDULER=inline: no thread to join */
+    bool joined;        /* The first join after done; the thread is gone */
 };
 
 typedef struct ThreadArg ThreadArg;
@@ -3236,6 +6558,8 @@ struct ThreadArg {
 };
 
 /* Thread entry point */
+static void thread_finish(ThreadHandle* h, Obj* result);
+
 static void* thread_entry(void* arg) {
     ThreadArg* ta = (ThreadArg*)arg;
 
@@ -3247,39 +6571,30 @@ static void* thread_entry(void* arg) {
     }
 
     /* Store result and signal completion */
-    pthread_mutex_lock(&ta->handle->lock);
-    ta->handle->result = result;
-    ta->handle->done = true;
-    pthread_cond_signal(&ta->handle->cond);
-    pthread_mutex_unlock(&ta->handle->lock);
+    thread_finish(ta->handle, result);
 
     free(ta);
     return NULL;
 }
 
-/* Spawn a thread (returns handle for joining) */
-Obj* spawn_thread(Obj* closure) {
-    ThreadHandle* h = malloc(sizeof(ThreadHandle));
-    if (!h) return NULL;
+static void thread_finish(ThreadHandle* h, Obj* result) {
+    pthread_mutex_lock(&h->lock);
+    h->result = result;
+    h->done = true;
+    pthread_cond_broadcast(&h->cond);
+    pthread_mutex_unlock(&h->lock);
+}
 
-    h->result = NULL;
-    h->done = false;
+static ThreadHandle* new_thread_handle(void) {
+    ThreadHandle* h = calloc(1, sizeof(ThreadHandle));
+    if (!h) return NULL;
     pthread_mutex_init(&h->lock, NULL);
     pthread_cond_init(&h->cond, NULL);
+    return h;
+}
 
-    ThreadArg* arg = malloc(sizeof(ThreadArg));
-    if (!arg) {
-        free(h);
-        return NULL;
-    }
-
-    arg->closure = closure;
-    if (closure) inc_ref(closure);
-    arg->handle = h;
-
-    pthread_create(&h->thread, NULL, thread_entry, arg);
-
-    /* Wrap handle in Obj */
+/* Wrap handle in Obj */
+static Obj* mk_thread_obj(ThreadHandle* h) {
     Obj* obj = malloc(sizeof(Obj));
     if (!obj) return NULL;
     obj->mark = 1;
@@ -3293,6 +6608,30 @@ Obj* spawn_thread(Obj* closure) {
     return obj;
 }
 
+/* Spawn a thread (returns handle for joining) */
+Obj* spawn_thread(Obj* closure) {
+    ThreadHandle* h = new_thread_handle();
+    if (!h) return NULL;
+
+    ThreadArg* arg = malloc(sizeof(ThreadArg));
+    if (!arg) {
+        free(h);
+        return NULL;
+    }
+
+    arg->closure = closure;
+    if (closure) inc_ref(closure);
+    arg->handle = h;
+
+    if (!start_thread(&h->thread, thread_entry, arg, "thread")) {
+        if (closure) dec_ref(closure);
+        free(arg);
+        free(h);
+        return NULL;
+    }
+    return mk_thread_obj(h);
+}
+
 Obj* thread_create(Obj* closure) {
     return spawn_thread(closure);
 }
@@ -3309,7 +6648,15 @@ Obj* thread_join(Obj* thread_obj) {
 
     pthread_mutex_lock(&h->lock);
     while (!h->done) {
-        pthread_cond_wait(&h->cond, &h->lock);
+        if (!wait_or_cancel(&h->cond, &h->lock)) {
+            pthread_mutex_unlock(&h->lock);
+            return mk_error("cancelled");
+        }
+    }
+    /* Finished: reclaim the thread now rather than when the handle is freed */
+    if (!h->ran_inline && !h->joined) {
+        pthread_join(h->thread, NULL);
+        h->joined = true;
     }
     Obj* result = h->result;
     if (result) inc_ref(result);
@@ -3323,14 +6670,316 @@ void free_thread_obj(Obj* thread_obj) {
     ThreadHandle* h = thread_payload(thread_obj);
     if (!h) return;
 
-    pthread_join(h->thread, NULL);
+    if (!h->ran_inline && !h->joined) pthread_join(h->thread, NULL);
     if (h->result) dec_ref(h->result);
+    for (int i = 0; i < h->count; i++) {
+        if (h->captures[i]) atomic_dec_ref(h->captures[i]);
+    }
+    free(h->captures);
     pthread_mutex_destroy(&h->lock);
     pthread_cond_destroy(&h->cond);
     free(h);
     if (thread_obj) thread_obj->ptr = NULL;
 }
 
+/* ========== Futures ========== */
+
+/*
+ * A future is a thread whose handle doubles as a promise: the body runs
+ * once, its result is kept in the handle, and every await hands out a
+ * fresh reference to it. The locals the body uses stay alive until the
+ * promise is freed.
+ */
+static void* future_entry(void* arg) {
+    ThreadHandle* h = (ThreadHandle*)arg;
+    thread_finish(h, h->fn(h->captures, NULL, 0));
+    return NULL;
+}
+
+Obj* omni_future(ClosureFn fn, Obj** captures, int count) {
+    budget_charge();
+    ThreadHandle* h = new_thread_handle();
+    if (!h) return mk_error("future: out of memory");
+    h->fn = fn;
+    h->count = count;
+    if (count > 0) {
+        h->captures = malloc(sizeof(Obj*) * count);
+        for (int i = 0; i < count; i++) {
+            h->captures[i] = captures[i];
+            if (captures[i]) atomic_inc_ref(captures[i]);
+        }
+    }
+    if (g_scheduler == SCHED_INLINE) {
+        h->ran_inline = true;
+        run_inline(future_entry, h, "future");
+    } else if (!start_thread(&h->thread, future_entry, h, "future")) {
+        for (int i = 0; i < count; i++) {
+            if (h->captures[i]) atomic_dec_ref(h->captures[i]);
+        }
+        free(h->captures);
+        pthread_mutex_destroy(&h->lock);
+        pthread_cond_destroy(&h->cond);
+        free(h);
+        return mk_error("future: cannot start a thread");
+    }
+    return mk_thread_obj(h);
+}
+
+Obj* prim_await(Obj* p) {
+    if (!thread_payload(p)) return mk_error("await: not a promise");
+    return thread_join(p);
+}
+
+Obj* prim_promise_done(Obj* p) {
+    ThreadHandle* h = thread_payload(p);
+    if (!h) return mk_error("promise-done?: not a promise");
+    pthread_mutex_lock(&h->lock);
+    int done = h->done;
+    pthread_mutex_unlock(&h->lock);
+    return mk_int(done);
+}
+
+/* Awaits every promise in the list, in order, and lists their results */
+Obj* prim_all_of(Obj* ps) {
+    for (Obj* l = ps; l; l = l->b) {
+        if (obj_tag(l) != TAG_PAIR || !thread_payload(l->a)) {
+            return mk_error("all-of: not a list of promises");
+        }
+    }
+    Obj* results = NULL;
+    Obj* last = NULL;
+    for (Obj* l = ps; l; l = l->b) {
+        Obj* cell = mk_pair(thread_join(l->a), NULL);
+        if (last) last->b = cell;
+        else results = cell;
+        last = cell;
+    }
+    return results;
+}
+
+/* ========== Worker Pools ========== */
+
+/*
+ * (make-pool n) starts n threads that run submitted thunks in queue
+ * order; (pool-submit pool thunk) returns a promise of the thunk's value,
+ * so thousands of small tasks share a few threads. Each job holds a
+ * reference to its promise until it finishes. Freeing the pool lets the
+ * workers drain the queue, then joins them; if a worker drops the last
+ * reference itself, the workers are detached and the last one out frees
+ * the pool.
+ */
+typedef struct PoolJob PoolJob;
+struct PoolJob {
+    Obj* thunk;
+    Obj* promise;
+    PoolJob* next;
+};
+
+typedef struct WorkerPool WorkerPool;
+struct WorkerPool {
+    pthread_t* threads;
+    int count;          /* 0 under PURPLE_SCHEDULER=inline */
+    int running;
+    bool closing;
+    bool orphaned;      /* Freed by the last worker out */
+    pthread_mutex_t lock;
+    pthread_cond_t ready;
+    PoolJob* first;
+    PoolJob* last;
+};
+
+static __thread WorkerPool* g_worker_pool = NULL;
+
+static void pool_destroy(WorkerPool* w) {
+    free(w->threads);
+    pthread_mutex_destroy(&w->lock);
+    pthread_cond_destroy(&w->ready);
+    free(w);
+}
+
+static void* pool_job_entry(void* arg) {
+    PoolJob* job = (PoolJob*)arg;
+    Obj* result = call_closure(job->thunk, NULL, 0);
+    dec_ref(job->thunk);
+    thread_finish(thread_payload(job->promise), result);
+    dec_ref(job->promise);
+    free(job);
+    return NULL;
+}
+
+static void* pool_worker(void* arg) {
+    WorkerPool* w = (WorkerPool*)arg;
+    g_worker_pool = w;
+    for (;;) {
+        pthread_mutex_lock(&w->lock);
+        while (!w->first && !w->closing) pthread_cond_wait(&w->ready, &w->lock);
+        PoolJob* job = w->first;
+        if (!job) {
+            bool last_out = --w->running == 0 && w->orphaned;
+            pthread_mutex_unlock(&w->lock);
+            if (last_out) pool_destroy(w);
+            return NULL;
+        }
+        w->first = job->next;
+        if (!w->first) w->last = NULL;
+        pthread_mutex_unlock(&w->lock);
+        pool_job_entry(job);
+    }
+}
+
+static WorkerPool* pool_payload(Obj* pool_obj) {
+    if (!pool_obj || pool_obj->tag != TAG_POOL) return NULL;
+    return (WorkerPool*)pool_obj->ptr;
+}
+
+void free_pool_obj(Obj* pool_obj) {
+    WorkerPool* w = pool_payload(pool_obj);
+    if (!w) return;
+
+    bool on_worker = g_worker_pool == w;
+    pthread_mutex_lock(&w->lock);
+    w->closing = true;
+    w->orphaned = on_worker;
+    pthread_cond_broadcast(&w->ready);
+    pthread_mutex_unlock(&w->lock);
+    for (int i = 0; i < w->count; i++) {
+        if (on_worker) pthread_detach(w->threads[i]);
+        else pthread_join(w->threads[i], NULL);
+    }
+    if (!on_worker) pool_destroy(w);
+    pool_obj->ptr = NULL;
+}
+
+Obj* prim_make_pool(Obj* n) {
+    if (obj_tag(n) != TAG_INT) return mk_error("make-pool: not an integer");
+    if (n->i < 1 || n->i > 1024) return mk_error("make-pool: size must be between 1 and 1024");
+    budget_charge();
+    WorkerPool* w = calloc(1, sizeof(WorkerPool));
+    Obj* obj = malloc(sizeof(Obj));
+    if (!w || !obj) {
+        free(w);
+        free(obj);
+        return mk_error("make-pool: out of memory");
+    }
+    pthread_mutex_init(&w->lock, NULL);
+    pthread_cond_init(&w->ready, NULL);
+    obj->mark = 1;
+    obj->scc_id = -1;
+    obj->is_pair = 0;
+    obj->scan_tag = 0;
+    obj->tag = TAG_POOL;
+    obj->generation = _next_generation();
+    obj->ptr = w;
+    if (g_scheduler == SCHED_INLINE) return obj;
+
+    w->threads = malloc(sizeof(pthread_t) * n->i);
+    while (w->threads && w->count < n->i &&
+           start_thread(&w->threads[w->count], pool_worker, w, "make-pool")) {
+        pthread_mutex_lock(&w->lock);
+        w->count++;
+        w->running++;
+        pthread_mutex_unlock(&w->lock);
+    }
+    if (w->count < n->i) {
+        free_pool_obj(obj);
+        free(obj);
+        return mk_error("make-pool: cannot start a thread");
+    }
+    return obj;
+}
+
+Obj* prim_pool_submit(Obj* pool, Obj* thunk) {
+    WorkerPool* w = pool_payload(pool);
+    if (!w) return mk_error("pool-submit: not a pool");
+    Closure* c = obj_tag(thunk) == TAG_CLOSURE ? (Closure*)thunk->ptr : NULL;
+    if (!c || c->arity > 0) return mk_error("pool-submit: not a procedure of no arguments");
+    budget_charge();
+    ThreadHandle* h = new_thread_handle();
+    PoolJob* job = malloc(sizeof(PoolJob));
+    Obj* promise = h ? mk_thread_obj(h) : NULL;
+    if (!promise || !job) {
+        free(h);
+        free(job);
+        free(promise);
+        return mk_error("pool-submit: out of memory");
+    }
+    h->ran_inline = true;  /* The pool's threads outlive the job */
+    inc_ref(thunk);
+    inc_ref(promise);      /* The job's reference */
+    job->thunk = thunk;
+    job->promise = promise;
+    job->next = NULL;
+    if (w->count == 0) {
+        run_inline(pool_job_entry, job, "pool-submit");
+        return promise;
+    }
+    pthread_mutex_lock(&w->lock);
+    if (w->last) w->last->next = job;
+    else w->first = job;
+    w->last = job;
+    pthread_cond_signal(&w->ready);
+    pthread_mutex_unlock(&w->lock);
+    return promise;
+}
+
+/* ========== Sleeping and Timers ========== */
+
+/*
+ * With PURPLE_VIRTUAL_TIME set, sleep-ms advances a clock that starts at
+ * 0 instead of blocking, so tests of timed code run instantly and
+ * monotonic-millis reports exact times.
+ */
+static long g_virtual_ms = 0;
+
+static int virtual_time(void) {
+    /* Tasks may ask first from several threads; each computes the same value */
+    static int on = -1;
+    int cached = __atomic_load_n(&on, __ATOMIC_ACQUIRE);
+    if (cached < 0) {
+        const char* v = getenv("PURPLE_VIRTUAL_TIME");
+        cached = v && *v && strcmp(v, "0") != 0;
+        __atomic_store_n(&on, cached, __ATOMIC_RELEASE);
+    }
+    return cached;
+}
+
+Obj* prim_sleep_ms(Obj* ms) {
+    double n;
+    if (obj_tag(ms) == TAG_INT) n = (double)obj_to_int(ms);
+    else if (obj_tag(ms) == TAG_FLOAT) n = ms->f;
+    else return mk_error("sleep-ms: not a number");
+    nursery_safe_point();
+    if (!(n > 0)) return NULL;
+
+    if (virtual_time()) {
+        __atomic_add_fetch(&g_virtual_ms, (long)n, __ATOMIC_SEQ_CST);
+        return NULL;
+    }
+    /* Inside a frame, sleep in slices so a cancel! wakes the sleeper */
+    double slice = g_nursery ? CANCEL_POLL_MS : n;
+    while (n > 0) {
+        double step = n < slice ? n : slice;
+        struct timespec ts = { (time_t)(step / 1000), (long)(fmod(step, 1000) * 1000000) };
+        while (nanosleep(&ts, &ts) != 0) {}
+        n -= step;
+        nursery_safe_point();
+    }
+    return NULL;
+}
+
+Obj* prim_yield(void) {
+    sched_yield();
+    nursery_safe_point();
+    return NULL;
+}
+
+Obj* prim_monotonic_millis(void) {
+    if (virtual_time()) return mk_int_unboxed(__atomic_load_n(&g_virtual_ms, __ATOMIC_SEQ_CST));
+    struct timespec ts;
+    clock_gettime(CLOCK_MONOTONIC, &ts);
+    return mk_int_unboxed((long)ts.tv_sec * 1000 + ts.tv_nsec / 1000000);
+}
+
 /* ========== Destination-Passing Style Runtime ========== */
 /* Pre-allocate destination and pass it down */
 
@@ -3409,16 +7058,117 @@ void clear_marks_List(Obj* x) {
 /* Type-Aware Release Functions */
 /* Automatically skip weak fields (back-edges) to prevent double-free */
 
-void release_user_obj(Obj* obj) { (void)obj; }
+static int is_weak_field(const UserType* t, int i) { return (int)(t->weak >> i & 1); }
+
+void release_user_obj(Obj* obj) {
+    UserObj* u = (UserObj*)obj->ptr;
+    if (!u || obj->tag != TAG_USER_BASE) return;
+    for (int i = 0; i < u->type->field_count; i++) {
+        if (!is_weak_field(u->type, i)) dec_ref(u->fields[i]);
+    }
+    free(u);
+    obj->ptr = NULL;
+}
 
 /* Type Constructors */
 
+/* Types match by descriptor or by name, so objects keep their type
+ * across separately compiled units */
+static int user_type_is(const UserType* t, Obj* x) {
+    if (!x || obj_tag(x) != TAG_USER_BASE || !x->ptr) return 0;
+    const UserType* xt = ((UserObj*)x->ptr)->type;
+    return xt == t || strcmp(xt->name, t->name) == 0;
+}
+
+Obj* mk_user(const UserType* t, Obj** fields) {
+    budget_charge();
+    UserObj* u = malloc(sizeof(UserObj) + (size_t)t->field_count * sizeof(Obj*));
+    Obj* x = u ? malloc(sizeof(Obj)) : NULL;
+    if (!x) {
+        free(u);
+        return NULL;
+    }
+    x->generation = _next_generation();
+    x->mark = 1;
+    x->tag = TAG_USER_BASE;
+    x->is_pair = 0;
+    x->scc_id = -1;
+    x->scan_tag = 0;
+    u->type = t;
+    for (int i = 0; i < t->field_count; i++) {
+        if (fields[i] && !is_weak_field(t, i)) inc_ref(fields[i]);
+        u->fields[i] = fields[i];
+    }
+    x->ptr = u;
+    return x;
+}
+
+Obj* user_is(const UserType* t, Obj* x) { return mk_int(user_type_is(t, x)); }
+
+/* Sum types: an object of one of the variants whose descriptors name sum */
+static int user_sum_is(const UserType* sum, Obj* x) {
+    if (!x || obj_tag(x) != TAG_USER_BASE || !x->ptr) return 0;
+    const UserType* xt = ((UserObj*)x->ptr)->type;
+    return xt->sum && strcmp(xt->sum, sum->name) == 0;
+}
+
+Obj* user_in(const UserType* sum, Obj* x) { return mk_int(user_sum_is(sum, x)); }
+
+Obj* user_tag(const UserType* sum, Obj* x) {
+    if (!user_sum_is(sum, x)) {
+        char msg[256];
+        snprintf(msg, sizeof(msg), "%s-tag: not a %s", sum->name, sum->name);
+        return mk_error(msg);
+    }
+    return mk_sym(((UserObj*)x->ptr)->type->name);
+}
+
 /* Field Accessors */
 /* Getters for weak fields do not increment reference count */
 /* Setters for strong fields manage reference counts automatically */
 
-void scan_user_obj(Obj* obj) { (void)obj; }
-void clear_marks_user_obj(Obj* obj) { (void)obj; }
+Obj* user_ref(const UserType* t, int i, Obj* x) {
+    if (!user_type_is(t, x)) {
+        char msg[256];
+        snprintf(msg, sizeof(msg), "%s-%s: not a %s", t->name, t->fields[i], t->name);
+        return mk_error(msg);
+    }
+    Obj* v = ((UserObj*)x->ptr)->fields[i];
+    if (v && !is_weak_field(t, i)) inc_ref(v);
+    return v;
+}
+
+Obj* user_set(const UserType* t, int i, Obj* x, Obj* v) {
+    if (!user_type_is(t, x)) {
+        char msg[256];
+        snprintf(msg, sizeof(msg), "set-%s-%s!: not a %s", t->name, t->fields[i], t->name);
+        return mk_error(msg);
+    }
+    UserObj* u = (UserObj*)x->ptr;
+    Obj* old = u->fields[i];
+    u->fields[i] = v;
+    if (!is_weak_field(t, i)) {
+        if (v) inc_ref(v);
+        dec_ref(old);
+    }
+    return NULL;
+}
+
+void scan_user_obj(Obj* obj) {
+    UserObj* u = (UserObj*)obj->ptr;
+    if (!u || obj->tag != TAG_USER_BASE) return;
+    for (int i = 0; i < u->type->field_count; i++) {
+        if (!is_weak_field(u->type, i)) scan_obj(u->fields[i]);
+    }
+}
+
+void clear_marks_user_obj(Obj* obj) {
+    UserObj* u = (UserObj*)obj->ptr;
+    if (!u || obj->tag != TAG_USER_BASE) return;
+    for (int i = 0; i < u->type->field_count; i++) {
+        if (!is_weak_field(u->type, i)) clear_marks_obj(u->fields[i]);
+    }
+}
 
 /* ========== Exception Handling Runtime ========== */
 /* ASAP-compatible exception handling with deterministic cleanup */
@@ -3509,11 +7259,12 @@ void exception_throw(Obj* value) {
     if (!g_exception_ctx) {
         /* No handler - print and abort */
         fprintf(stderr, "Uncaught exception: ");
-        if (value && value->tag == TAG_ERROR && value->ptr) {
-            fprintf(stderr, "%s\n", (char*)value->ptr);
+        if (error_message(value)) {
+            fprintf(stderr, "%s\n", error_message(value));
         } else {
             fprintf(stderr, "<unknown>\n");
         }
+        omni_flush_ports();
         abort();
     }
 
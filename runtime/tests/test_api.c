@@ -167,6 +167,18 @@ static void test_api_thread(void) {
     PASS();
 }
 
+static void test_api_module_abi(void) {
+    TEST("module abi");
+    /* What a compiled module records, built from this header */
+    static const PurpleTypeDescriptor types[] = PURPLE_ABI_TYPES;
+    PurpleAbi abi = { PURPLE_ABI_VERSION, sizeof(Obj), sizeof(OmniCallCache),
+                      types, sizeof(types) / sizeof(types[0]) };
+    char why[256];
+    ASSERT(purple_abi_check(&abi, why, sizeof(why)));
+    ASSERT_EQ(purple_abi()->version, PURPLE_ABI_VERSION);
+    PASS();
+}
+
 int main(void) {
     printf("Runtime API Test Suite\n");
     printf("========================\n");
@@ -180,6 +192,7 @@ int main(void) {
     test_api_channel();
     test_api_atom();
     test_api_thread();
+    test_api_module_abi();
 
     if (tests_failed == 0) {
         printf("\nAll %d tests passed.\n", tests_run);
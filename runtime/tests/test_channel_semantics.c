@@ -87,9 +87,157 @@ void test_channel_unbuffered_blocks(void) {
     PASS();
 }
 
+/* Ping-pong over two unbuffered channels. The ponger checks, before each
+ * receive, that the pinger has not completed more sends than it has
+ * received: with a rendezvous the pinger can never run ahead. */
+#define PING_PONG_ROUNDS 200
+
+typedef struct {
+    Obj* ping;
+    Obj* pong;
+    volatile int pings_sent;    /* Sends the pinger has seen complete */
+    int ran_ahead;
+    long log[2 * PING_PONG_ROUNDS];
+    int log_len;
+    pthread_mutex_t lock;
+} PingPongCtx;
+
+static void ping_pong_log(PingPongCtx* ctx, long event) {
+    pthread_mutex_lock(&ctx->lock);
+    ctx->log[ctx->log_len++] = event;
+    pthread_mutex_unlock(&ctx->lock);
+}
+
+static void* ponger_thread(void* arg) {
+    PingPongCtx* ctx = (PingPongCtx*)arg;
+    for (int i = 0; i < PING_PONG_ROUNDS; i++) {
+        if (__atomic_load_n(&ctx->pings_sent, __ATOMIC_SEQ_CST) > i) {
+            ctx->ran_ahead = 1;
+        }
+        Obj* v = channel_recv(ctx->ping);
+        ping_pong_log(ctx, obj_to_int(v));
+        channel_send(ctx->pong, v);
+    }
+    return NULL;
+}
+
+void test_channel_unbuffered_ping_pong(void) {
+    PingPongCtx ctx = {0};
+    ctx.ping = make_channel(0);
+    ctx.pong = make_channel(0);
+    pthread_mutex_init(&ctx.lock, NULL);
+
+    pthread_t th;
+    pthread_create(&th, NULL, ponger_thread, &ctx);
+
+    int replies_ok = 1;
+    for (int i = 0; i < PING_PONG_ROUNDS; i++) {
+        channel_send(ctx.ping, mk_int_unboxed(i));
+        __atomic_add_fetch(&ctx.pings_sent, 1, __ATOMIC_SEQ_CST);
+        Obj* r = channel_recv(ctx.pong);
+        if (obj_to_int(r) != i) replies_ok = 0;
+        ping_pong_log(&ctx, -(long)i - 1);
+    }
+    pthread_join(th, NULL);
+
+    ASSERT_EQ(replies_ok, 1);
+    ASSERT_EQ(ctx.ran_ahead, 0);
+    ASSERT_EQ(ctx.log_len, 2 * PING_PONG_ROUNDS);
+    for (int i = 0; i < PING_PONG_ROUNDS; i++) {
+        ASSERT_EQ(ctx.log[2 * i], i);
+        ASSERT_EQ(ctx.log[2 * i + 1], -i - 1);
+    }
+
+    pthread_mutex_destroy(&ctx.lock);
+    dec_ref(ctx.ping);
+    dec_ref(ctx.pong);
+    PASS();
+}
+
+typedef struct {
+    Obj* ch;
+    int base;
+    int count;
+} BurstCtx;
+
+static void* burst_sender(void* arg) {
+    BurstCtx* ctx = (BurstCtx*)arg;
+    for (int i = 0; i < ctx->count; i++) {
+        channel_send(ctx->ch, mk_int_unboxed(ctx->base + i));
+    }
+    return NULL;
+}
+
+void test_channel_unbuffered_many_senders(void) {
+    enum { SENDERS = 4, PER_SENDER = 250 };
+    Obj* ch = make_channel(0);
+    pthread_t th[SENDERS];
+    BurstCtx ctx[SENDERS];
+    for (int t = 0; t < SENDERS; t++) {
+        ctx[t].ch = ch;
+        ctx[t].base = t * PER_SENDER;
+        ctx[t].count = PER_SENDER;
+        pthread_create(&th[t], NULL, burst_sender, &ctx[t]);
+    }
+
+    long sum = 0;
+    for (int i = 0; i < SENDERS * PER_SENDER; i++) {
+        sum += obj_to_int(channel_recv(ch));
+    }
+    for (int t = 0; t < SENDERS; t++) {
+        pthread_join(th[t], NULL);
+    }
+
+    long n = SENDERS * PER_SENDER;
+    ASSERT_EQ(sum, n * (n - 1) / 2);
+    dec_ref(ch);
+    PASS();
+}
+
+typedef struct {
+    Obj* ch;
+    Obj* val;
+    int result;
+} CloseCtx;
+
+static void* blocked_sender(void* arg) {
+    CloseCtx* ctx = (CloseCtx*)arg;
+    ctx->result = channel_send(ctx->ch, ctx->val);
+    return NULL;
+}
+
+void test_channel_unbuffered_close_returns_value(void) {
+    Obj* ch = make_channel(0);
+    CloseCtx ctx = { ch, mk_int(42), -1 };
+
+    pthread_t th;
+    pthread_create(&th, NULL, blocked_sender, &ctx);
+    sleep_ms(10);
+    channel_close(ch);
+    pthread_join(th, NULL);
+
+    /* Nobody received, so the send fails and the value stays with us */
+    ASSERT_EQ(ctx.result, 0);
+    ASSERT_EQ(obj_to_int(ctx.val), 42);
+    ASSERT_NULL(channel_recv(ch));
+
+    dec_ref(ctx.val);
+    dec_ref(ch);
+    PASS();
+}
+
 void run_channel_semantics_tests(void) {
     TEST_SUITE("Channel Semantics");
 
     TEST("unbuffered send blocks until recv");
     test_channel_unbuffered_blocks();
+
+    TEST("unbuffered ping-pong alternates");
+    test_channel_unbuffered_ping_pong();
+
+    TEST("unbuffered channel with many senders");
+    test_channel_unbuffered_many_senders();
+
+    TEST("close withdraws a pending unbuffered send");
+    test_channel_unbuffered_close_returns_value();
 }
@@ -329,6 +329,127 @@ void test_closure_returned_from_closure(void) {
     dec_ref(ten);
 }
 
+/* ========== Identity and introspection ========== */
+
+void test_closure_eq_by_code(void) {
+    Obj* a = closure_named(mk_closure(return_42, NULL, NULL, 0, 0), "f");
+    Obj* b = closure_named(mk_closure(return_42, NULL, NULL, 0, 0), "f");
+    Obj* c = mk_closure(add_args, NULL, NULL, 0, 2);
+    ASSERT_EQ(obj_to_int(prim_is_eq(a, b)), 1);
+    ASSERT_EQ(obj_to_int(prim_is_eq(a, c)), 0);
+    ASSERT_EQ(obj_to_int(prim_hash(a)), obj_to_int(prim_hash(b)));
+    dec_ref(c);
+    dec_ref(b);
+    dec_ref(a);
+}
+
+void test_closure_eq_with_captures_is_identity(void) {
+    Obj* cap = mk_int(1);
+    Obj* caps[1] = {cap};
+    Obj* a = mk_closure(return_captured, caps, NULL, 1, 0);
+    Obj* b = mk_closure(return_captured, caps, NULL, 1, 0);
+    ASSERT_EQ(obj_to_int(prim_is_eq(a, a)), 1);
+    ASSERT_EQ(obj_to_int(prim_is_eq(a, b)), 0);
+    dec_ref(b);
+    dec_ref(a);
+    dec_ref(cap);
+}
+
+void test_closure_procedure_and_arity(void) {
+    Obj* f = mk_closure(add_args, NULL, NULL, 0, 2);
+    Obj* n = mk_int(3);
+    ASSERT_EQ(obj_to_int(prim_is_procedure(f)), 1);
+    ASSERT_EQ(obj_to_int(prim_is_procedure(n)), 0);
+    ASSERT_EQ(obj_to_int(prim_arity(f)), 2);
+    Obj* e = prim_arity(n);
+    ASSERT_EQ(obj_to_int(prim_is_error(e)), 1);
+    dec_ref(e);
+    dec_ref(n);
+    dec_ref(f);
+}
+
+/* ========== Inline call caches ========== */
+
+void test_call_cached_resolves_once_per_version(void) {
+    Obj* cap = mk_int(100);
+    Obj* caps[1] = {cap};
+    Obj* first = mk_closure(return_captured, caps, NULL, 1, 0);
+    Obj* second = mk_closure(return_42, NULL, NULL, 0, 0);
+    OmniCallCache ic = {0};
+
+    Obj* result = omni_call_cached(&ic, first, 1, NULL, 0);
+    ASSERT_EQ(obj_to_int(result), 100);
+    dec_ref(result);
+    ASSERT(ic.fn == return_captured);
+
+    /* Same version: the cached entry point is used as is */
+    result = omni_call_cached(&ic, second, 1, NULL, 0);
+    ASSERT_EQ(obj_to_int(result), 100);
+    dec_ref(result);
+
+    /* Redefined: resolved again */
+    result = omni_call_cached(&ic, second, 2, NULL, 0);
+    ASSERT_EQ(obj_to_int(result), 42);
+    dec_ref(result);
+
+    dec_ref(first);
+    dec_ref(second);
+    dec_ref(cap);
+}
+
+void test_call_cached_falls_back_when_not_callable(void) {
+    OmniCallCache ic = {0};
+    Obj* not_closure = mk_int(1);
+    ASSERT_NULL(omni_call_cached(&ic, not_closure, 1, NULL, 0));
+    ASSERT(ic.fn == NULL);
+    dec_ref(not_closure);
+
+    Obj* closure = mk_closure(return_first_arg, NULL, NULL, 0, 1);
+    ASSERT_NULL(omni_call_cached(&ic, closure, 1, NULL, 0));
+    ASSERT(ic.fn == NULL);
+    dec_ref(closure);
+}
+
+/* ========== Module ABI ========== */
+
+void test_module_abi_matches_runtime(void) {
+    char why[256];
+    ASSERT(purple_abi_check(purple_abi(), why, sizeof(why)));
+    ASSERT_STR_EQ(why, "");
+
+    PurpleAbi none = *purple_abi();
+    none.type_count = 0;
+    ASSERT(purple_abi_check(&none, why, sizeof(why)));
+}
+
+void test_module_abi_mismatch_explained(void) {
+    char why[256];
+    ASSERT(!purple_abi_check(NULL, why, sizeof(why)));
+    ASSERT(strstr(why, "no ABI record") != NULL);
+
+    PurpleAbi old = *purple_abi();
+    old.version = PURPLE_ABI_VERSION + 1;
+    ASSERT(!purple_abi_check(&old, why, sizeof(why)));
+    ASSERT(strstr(why, "ABI version 2, the runtime has version 1") != NULL);
+
+    PurpleAbi wide = *purple_abi();
+    wide.obj_size += 8;
+    ASSERT(!purple_abi_check(&wide, why, sizeof(why)));
+    ASSERT(strstr(why, "-byte objects") != NULL);
+
+    PurpleTypeDescriptor renumbered[] = { { "pair", TAG_PAIR + 1 } };
+    PurpleAbi tags = *purple_abi();
+    tags.types = renumbered;
+    tags.type_count = 1;
+    ASSERT(!purple_abi_check(&tags, why, sizeof(why)));
+    ASSERT(strstr(why, "type pair as tag") != NULL);
+
+    PurpleTypeDescriptor unknown[] = { { "table", 40 } };
+    tags.types = unknown;
+    ASSERT(!purple_abi_check(&tags, why, sizeof(why)));
+    ASSERT(strstr(why, "type table, which the runtime does not have") != NULL);
+}
+
 /* ========== Stress tests ========== */
 
 void test_closure_many_calls(void) {
@@ -412,6 +533,19 @@ void run_closure_tests(void) {
     RUN_TEST(test_closure_capture_list);
     RUN_TEST(test_closure_returned_from_closure);
 
+    TEST_SECTION("Closure Identity");
+    RUN_TEST(test_closure_eq_by_code);
+    RUN_TEST(test_closure_eq_with_captures_is_identity);
+    RUN_TEST(test_closure_procedure_and_arity);
+
+    TEST_SECTION("Inline Call Caches");
+    RUN_TEST(test_call_cached_resolves_once_per_version);
+    RUN_TEST(test_call_cached_falls_back_when_not_callable);
+
+    TEST_SECTION("Module ABI");
+    RUN_TEST(test_module_abi_matches_runtime);
+    RUN_TEST(test_module_abi_mismatch_explained);
+
     TEST_SECTION("Closure Stress Tests");
     RUN_TEST(test_closure_many_calls);
     RUN_TEST(test_closure_many_captures);
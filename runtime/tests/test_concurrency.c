@@ -1,5 +1,6 @@
 /* test_concurrency.c - Channel, atom, and thread tests */
 #include "test_framework.h"
+#include <time.h>
 #include <unistd.h>
 
 /* ========== Channel Creation Tests ========== */
@@ -574,6 +575,229 @@ void test_thread_stress_many_threads(void) {
     PASS();
 }
 
+/* ========== Nursery Tests ========== */
+
+static Obj* nursery_error(Obj** caps, Obj** args, int nargs) {
+    (void)caps; (void)args; (void)nargs;
+    return mk_error("boom");
+}
+
+/* Yields until cancelled; a task that returns was never cancelled */
+static int g_spins_left;
+static Obj* nursery_spin(Obj** caps, Obj** args, int nargs) {
+    (void)caps; (void)args; (void)nargs;
+    while (__atomic_sub_fetch(&g_spins_left, 1, __ATOMIC_SEQ_CST) > 0) prim_yield();
+    return mk_int(0);
+}
+
+void test_nursery_results_in_spawn_order(void) {
+    Obj* caps[] = { mk_int(30), mk_int(12) };
+    OmniNursery n;
+    Obj* volatile body = NULL;
+    omni_nursery_enter(&n);
+    if (!setjmp(n.jump)) {
+        omni_spawn(add_captures, caps, 2);
+        omni_spawn(conc_return_42, NULL, 0);
+        body = mk_int(7);
+    }
+    Obj* result = omni_nursery_leave(&n, body);
+
+    ASSERT_NULL(obj_cdr(obj_cdr(result)));
+    ASSERT_EQ(obj_to_int(obj_car(result)), 42);
+    ASSERT_EQ(obj_to_int(obj_car(obj_cdr(result))), 42);
+    ASSERT_NULL(g_nursery);
+
+    dec_ref(result);
+    dec_ref(caps[0]);
+    dec_ref(caps[1]);
+    PASS();
+}
+
+void test_nursery_first_error_cancels_siblings(void) {
+    g_spins_left = 1000000;
+    OmniNursery n;
+    omni_nursery_enter(&n);
+    if (!setjmp(n.jump)) {
+        omni_spawn(nursery_spin, NULL, 0);
+        omni_spawn(nursery_error, NULL, 0);
+    }
+    Obj* result = omni_nursery_leave(&n, NULL);
+
+    ASSERT_TRUE(is_error(result));
+    ASSERT_STR_EQ(error_message(result), "boom");
+    ASSERT_TRUE(g_spins_left > 0);
+
+    dec_ref(result);
+    PASS();
+}
+
+void test_nursery_body_error_wins(void) {
+    OmniNursery n;
+    Obj* volatile body = NULL;
+    omni_nursery_enter(&n);
+    if (!setjmp(n.jump)) {
+        omni_spawn(conc_return_42, NULL, 0);
+        body = mk_error("body");
+    }
+    Obj* result = omni_nursery_leave(&n, body);
+
+    ASSERT_TRUE(is_error(result));
+    ASSERT_STR_EQ(error_message(result), "body");
+
+    dec_ref(result);
+    PASS();
+}
+
+void test_spawn_outside_nursery(void) {
+    Obj* result = omni_spawn(conc_return_42, NULL, 0);
+    ASSERT_TRUE(is_error(result));
+    ASSERT_STR_EQ(error_message(result), "spawn: not inside a nursery");
+    dec_ref(result);
+    PASS();
+}
+
+/* ========== Cancellation Tests ========== */
+
+void test_cancel_token_is_set_once(void) {
+    Obj* tok = prim_make_cancel();
+    ASSERT_EQ(tok->tag, TAG_CANCEL);
+    Obj* before = prim_is_cancelled(tok);
+    ASSERT_EQ(obj_to_int(before), 0);
+    prim_cancel(tok);
+    prim_cancel(tok);
+    Obj* after = prim_is_cancelled(tok);
+    ASSERT_EQ(obj_to_int(after), 1);
+
+    Obj* x = mk_int(1);
+    Obj* bad = prim_is_cancelled(x);
+    ASSERT_TRUE(is_error(bad));
+    ASSERT_STR_EQ(error_message(bad), "cancelled?: not a cancel token");
+
+    dec_ref(bad);
+    dec_ref(x);
+    dec_ref(before);
+    dec_ref(after);
+    dec_ref(tok);
+    PASS();
+}
+
+static Obj* g_cancel_later_tok;
+static void* cancel_later(void* arg) {
+    (void)arg;
+    struct timespec ts = { 0, 20000000L };
+    nanosleep(&ts, NULL);
+    prim_cancel(g_cancel_later_tok);
+    return NULL;
+}
+
+void test_with_cancel_interrupts_recv(void) {
+    Obj* ch = make_channel(0);
+    Obj* tok = prim_make_cancel();
+    g_cancel_later_tok = tok;
+    pthread_t canceller;
+    pthread_create(&canceller, NULL, cancel_later, NULL);
+
+    OmniNursery n;
+    Obj* volatile body = NULL;
+    ASSERT_TRUE(omni_cancel_enter(&n, tok));
+    if (!setjmp(n.jump)) body = channel_recv(ch);
+    Obj* result = omni_cancel_leave(&n, body);
+    pthread_join(canceller, NULL);
+
+    ASSERT_TRUE(is_error(result));
+    ASSERT_STR_EQ(error_message(result), "cancelled");
+    ASSERT_NULL(g_nursery);
+
+    dec_ref(result);
+    dec_ref(tok);
+    dec_ref(ch);
+    PASS();
+}
+
+void test_with_cancel_needs_a_token(void) {
+    OmniNursery n;
+    Obj* x = mk_int(1);
+    ASSERT_FALSE(omni_cancel_enter(&n, x));
+    ASSERT_NULL(g_nursery);
+    dec_ref(x);
+    PASS();
+}
+
+/* ========== Future Tests ========== */
+
+void test_await_returns_the_same_result(void) {
+    Obj* caps[] = { mk_int(30), mk_int(12) };
+    Obj* p = omni_future(add_captures, caps, 2);
+    dec_ref(caps[0]);
+    dec_ref(caps[1]);
+
+    Obj* first = prim_await(p);
+    Obj* second = prim_await(p);
+    ASSERT_EQ(obj_to_int(first), 42);
+    ASSERT_TRUE(first == second);
+    Obj* done = prim_promise_done(p);
+    ASSERT_EQ(obj_to_int(done), 1);
+
+    dec_ref(done);
+    dec_ref(first);
+    dec_ref(second);
+    dec_ref(p);
+    PASS();
+}
+
+/* Each await joins its thread, so live promises do not hold threads */
+#define MANY_FUTURES 40000
+
+void test_await_joins_the_thread(void) {
+    Obj** ps = malloc(MANY_FUTURES * sizeof(Obj*));
+    ASSERT_NOT_NULL(ps);
+    long sum = 0;
+    for (int i = 0; i < MANY_FUTURES; i++) {
+        Obj* caps[] = { mk_int(i), mk_int(0) };
+        ps[i] = omni_future(add_captures, caps, 2);
+        dec_ref(caps[0]);
+        dec_ref(caps[1]);
+        Obj* r = prim_await(ps[i]);
+        ASSERT_FALSE(is_error(r));
+        sum += obj_to_int(r);
+        dec_ref(r);
+    }
+    ASSERT_EQ(sum, (long)MANY_FUTURES * (MANY_FUTURES - 1) / 2);
+    for (int i = 0; i < MANY_FUTURES; i++) dec_ref(ps[i]);
+    free(ps);
+    PASS();
+}
+
+void test_all_of_keeps_promise_order(void) {
+    Obj* ps = mk_pair(omni_future(conc_return_42, NULL, 0), NULL);
+    Obj* x = mk_int(1);
+    Obj* caps[] = { x, x };
+    ps = mk_pair(omni_future(add_captures, caps, 2), ps);
+    dec_ref(x);
+
+    Obj* results = prim_all_of(ps);
+    ASSERT_EQ(obj_to_int(obj_car(results)), 2);
+    ASSERT_EQ(obj_to_int(obj_car(obj_cdr(results))), 42);
+    ASSERT_NULL(obj_cdr(obj_cdr(results)));
+
+    dec_ref(results);
+    dec_ref(ps);
+    PASS();
+}
+
+void test_await_needs_a_promise(void) {
+    Obj* x = mk_int(1);
+    Obj* r = prim_await(x);
+    ASSERT_TRUE(is_error(r));
+    dec_ref(r);
+    Obj* ps = mk_pair(x, NULL);
+    r = prim_all_of(ps);
+    ASSERT_TRUE(is_error(r));
+    dec_ref(r);
+    dec_ref(ps);
+    PASS();
+}
+
 /* ========== Run All Concurrency Tests ========== */
 
 void run_concurrency_tests(void) {
@@ -632,6 +856,23 @@ void run_concurrency_tests(void) {
     RUN_TEST(test_thread_join_null);
     RUN_TEST(test_thread_join_multiple_times);
 
+    TEST_SECTION("Nurseries");
+    RUN_TEST(test_nursery_results_in_spawn_order);
+    RUN_TEST(test_nursery_first_error_cancels_siblings);
+    RUN_TEST(test_nursery_body_error_wins);
+    RUN_TEST(test_spawn_outside_nursery);
+
+    TEST_SECTION("Cancellation");
+    RUN_TEST(test_cancel_token_is_set_once);
+    RUN_TEST(test_with_cancel_interrupts_recv);
+    RUN_TEST(test_with_cancel_needs_a_token);
+
+    TEST_SECTION("Futures");
+    RUN_TEST(test_await_returns_the_same_result);
+    RUN_TEST(test_await_joins_the_thread);
+    RUN_TEST(test_all_of_keeps_promise_order);
+    RUN_TEST(test_await_needs_a_promise);
+
     TEST_SECTION("Concurrent Operations");
     RUN_TEST(test_concurrent_channel);
     RUN_TEST(test_concurrent_atom);
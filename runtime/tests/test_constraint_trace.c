@@ -0,0 +1,175 @@
+/*
+ * Constraint Trace Tests
+ *
+ * Parsing recorded alloc/borrow/release/free traces and replaying them
+ * through the constraint model.
+ */
+
+#define _POSIX_C_SOURCE 200809L
+
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <unistd.h>
+
+#include "../src/memory/constraint.c"
+#include "../src/memory/constraint_trace.c"
+
+/* Test counters */
+static int tests_run = 0;
+static int tests_passed = 0;
+
+#define TEST(name) static void name(void)
+#define RUN_TEST(name) do { \
+    printf("  %s: ", #name); \
+    name(); \
+    tests_run++; \
+    tests_passed++; \
+    printf("\033[32mPASS\033[0m\n"); \
+} while(0)
+
+#define ASSERT(cond) do { \
+    if (!(cond)) { \
+        printf("\033[31mFAIL\033[0m (line %d: %s)\n", __LINE__, #cond); \
+        tests_run++; \
+        return; \
+    } \
+} while(0)
+
+/* Replay text, returning the violations found */
+static int verify_text(const char* text, ConstraintContext** out) {
+    ConstraintTrace* trace = constraint_trace_parse(text);
+    ConstraintContext* ctx = constraint_context_new(false);
+    int n = constraint_trace_verify(ctx, trace);
+    constraint_trace_free(trace);
+    *out = ctx;
+    return n;
+}
+
+TEST(test_trace_parse) {
+    ConstraintTrace* trace = constraint_trace_parse(
+        "# comment\n"
+        "alloc 0x10 form 1: let xs\n"
+        "\n"
+        "borrow 0x10 form 1: (map f xs)\r\n"
+        "release 0x10\n"
+        "free 0x10");
+    ASSERT(trace != NULL);
+    ASSERT(trace->error == NULL);
+    ASSERT(trace->event_count == 4);
+    ASSERT(trace->events[0].kind == TRACE_ALLOC);
+    ASSERT(trace->events[0].object == 0x10);
+    ASSERT(strcmp(trace->events[0].site, "form 1: let xs") == 0);
+    ASSERT(trace->events[1].line == 4);
+    ASSERT(strcmp(trace->events[1].site, "form 1: (map f xs)") == 0);
+    ASSERT(trace->events[2].kind == TRACE_RELEASE);
+    ASSERT(trace->events[2].site == NULL);
+    ASSERT(trace->events[3].kind == TRACE_FREE);
+    constraint_trace_free(trace);
+}
+
+TEST(test_trace_parse_errors) {
+    ConstraintTrace* trace = constraint_trace_parse("alloc 0x10 a\nmove 0x10\nfree 0x10\n");
+    ASSERT(trace->event_count == 1);
+    ASSERT(trace->error != NULL);
+    ASSERT(strstr(trace->error, "trace line 2: unknown event") != NULL);
+    constraint_trace_free(trace);
+
+    trace = constraint_trace_parse("free zz\n");
+    ASSERT(trace->event_count == 0);
+    ASSERT(strcmp(trace->error, "trace line 1: expected an object address") == 0);
+    constraint_trace_free(trace);
+}
+
+TEST(test_trace_clean) {
+    ConstraintContext* ctx;
+    ASSERT(verify_text(
+        "alloc 0x10 let xs\n"
+        "borrow 0x10 map\n"
+        "borrow 0x10 fold\n"
+        "release 0x10\n"
+        "release 0x10\n"
+        "free 0x10\n"
+        "free 0x20\n", &ctx) == 0);
+    ASSERT(!constraint_has_violations(ctx));
+    constraint_context_free(ctx);
+}
+
+TEST(test_trace_free_while_borrowed) {
+    ConstraintContext* ctx;
+    ASSERT(verify_text(
+        "alloc 0x10 form 2: let ys\n"
+        "borrow 0x10 form 2: (map f ys)\n"
+        "free 0x10\n"
+        "release 0x10\n", &ctx) == 2);
+    ASSERT(strcmp(constraint_get_violation(ctx, 0),
+                  "trace line 3: object allocated at form 2: let ys "
+                  "freed while borrowed at form 2: (map f ys)") == 0);
+    ASSERT(strcmp(constraint_get_violation(ctx, 1),
+                  "trace line 4: release of 0x10 without an open borrow") == 0);
+    constraint_context_free(ctx);
+}
+
+TEST(test_trace_address_reuse) {
+    ConstraintContext* ctx;
+    /* A freed address bound again is a new object */
+    ASSERT(verify_text(
+        "alloc 0x10 a\n"
+        "free 0x10\n"
+        "alloc 0x10 b\n"
+        "borrow 0x10 c\n"
+        "release 0x10\n"
+        "free 0x10\n"
+        "free 0x10\n", &ctx) == 1);
+    ASSERT(strcmp(constraint_get_violation(ctx, 0),
+                  "trace line 7: object allocated at b freed twice (first at line 6)") == 0);
+    constraint_context_free(ctx);
+}
+
+TEST(test_trace_open_borrow_at_end) {
+    ConstraintContext* ctx;
+    ASSERT(verify_text("borrow 0x10 map\n", &ctx) == 1);
+    ASSERT(strcmp(constraint_get_violation(ctx, 0),
+                  "trace ends with object allocated at an unrecorded site still borrowed at map") == 0);
+    constraint_context_free(ctx);
+}
+
+TEST(test_trace_load) {
+    char path[] = "/tmp/constraint_trace_XXXXXX";
+    int fd = mkstemp(path);
+    ASSERT(fd >= 0);
+    FILE* f = fdopen(fd, "w");
+    for (int i = 0; i < 500; i++) {
+        fprintf(f, "alloc %#x form %d: let x\nborrow %#x form %d: (map f x)\nrelease %#x\nfree %#x\n",
+                0x1000 + i * 16, i, 0x1000 + i * 16, i, 0x1000 + i * 16, 0x1000 + i * 16);
+    }
+    fclose(f);
+
+    ConstraintTrace* trace = constraint_trace_load(path);
+    unlink(path);
+    ASSERT(trace != NULL);
+    ASSERT(trace->error == NULL);
+    ASSERT(trace->event_count == 2000);
+    ConstraintContext* ctx = constraint_context_new(false);
+    ASSERT(constraint_trace_verify(ctx, trace) == 0);
+    constraint_context_free(ctx);
+    constraint_trace_free(trace);
+
+    ASSERT(constraint_trace_load("/nonexistent/trace") == NULL);
+}
+
+int main(void) {
+    printf("\n\033[33m=== Constraint Trace Tests ===\033[0m\n");
+    RUN_TEST(test_trace_parse);
+    RUN_TEST(test_trace_parse_errors);
+    RUN_TEST(test_trace_clean);
+    RUN_TEST(test_trace_free_while_borrowed);
+    RUN_TEST(test_trace_address_reuse);
+    RUN_TEST(test_trace_open_borrow_at_end);
+    RUN_TEST(test_trace_load);
+
+    printf("\n  Total:  %d\n", tests_run);
+    printf("  Passed: %d\n", tests_passed);
+    printf("  Failed: %d\n", tests_run - tests_passed);
+    return (tests_passed == tests_run) ? 0 : 1;
+}
@@ -263,6 +263,80 @@ void test_mk_error_null(void) {
     PASS();
 }
 
+void test_mk_error_obj_payload(void) {
+    Obj* data = mk_int(7);
+    Obj* x = mk_error_obj("bad input", data);
+    ASSERT_NOT_NULL(x);
+    ASSERT(is_error(x));
+    ASSERT_STR_EQ(error_message(x), "bad input");
+    ASSERT(error_data(x) == data);
+    ASSERT_EQ(data->mark, 2);  /* Error holds a reference */
+    dec_ref(x);
+    ASSERT_EQ(data->mark, 1);
+    dec_ref(data);
+    PASS();
+}
+
+void test_error_prims(void) {
+    Obj* msg = mk_sym("oops");
+    Obj* data = mk_int(3);
+    Obj* e = prim_error(msg, data);
+    ASSERT(is_error(e));
+    Obj* m = prim_error_message(e);
+    ASSERT_STR_EQ((char*)m->ptr, "oops");
+    Obj* d = prim_error_data(e);
+    ASSERT_EQ(obj_to_int(d), 3);
+    ASSERT_EQ(obj_to_int(prim_is_error(e)), 1);
+    ASSERT_EQ(obj_to_int(prim_is_error(msg)), 0);
+    ASSERT_NULL(error_message(msg));
+    dec_ref(d);
+    dec_ref(m);
+    dec_ref(e);
+    dec_ref(data);
+    dec_ref(msg);
+    PASS();
+}
+
+void test_error_tag_prims(void) {
+    Obj* kind = mk_sym("not-found");
+    Obj* e = prim_error(kind, NULL);
+    Obj* t = prim_error_tag(e);
+    ASSERT(t == kind);
+    Obj* wrapped = prim_error(e, NULL);
+    Obj* t2 = prim_error_tag(wrapped);
+    ASSERT(t2 == kind);
+    Obj* plain = mk_error_obj("plain", NULL);
+    Obj* t3 = prim_error_tag(plain);
+    ASSERT_STR_EQ((char*)t3->ptr, "error");
+    ASSERT_NULL(prim_error_tag(kind));
+    ASSERT_NULL(prim_error_trace(e));  /* nothing on the shadow stack */
+    dec_ref(t3);
+    dec_ref(plain);
+    dec_ref(t2);
+    dec_ref(wrapped);
+    dec_ref(t);
+    dec_ref(e);
+    dec_ref(kind);
+    PASS();
+}
+
+void test_mk_keyword_interned(void) {
+    Obj* a = mk_keyword("weak");
+    Obj* b = mk_keyword("weak");
+    ASSERT(a == b);
+    ASSERT(a != mk_keyword("when"));
+    ASSERT_EQ(a->tag, TAG_KEYWORD);
+    ASSERT_EQ(test_is_keyword(a), 1);
+    Obj* s = mk_sym("weak");
+    ASSERT_EQ(test_is_keyword(s), 0);
+    dec_ref(a);  /* Never freed */
+    free_tree(b);
+    ASSERT(mk_keyword("weak") == a);
+    ASSERT_STR_EQ((char*)a->ptr, "weak");
+    dec_ref(s);
+    PASS();
+}
+
 /* === mk_int_stack tests === */
 
 void test_mk_int_stack_normal(void) {
@@ -291,8 +365,170 @@ void test_mk_int_stack_fallback(void) {
     PASS();
 }
 
+/* === Allocation budgets === */
+
+void test_budget_allows_allocs_within_limit(void) {
+    OmniBudget b;
+    omni_budget_enter(&b, 2, -1);
+    if (setjmp(b.jump)) {
+        ASSERT(0);  /* Two allocations fit */
+    }
+    Obj* x = mk_int(1);
+    Obj* y = mk_int(2);
+    omni_budget_leave(&b);
+    dec_ref(x);
+    dec_ref(y);
+    PASS();
+}
+
+void test_budget_unwinds_when_exceeded(void) {
+    OmniBudget outer, inner;
+    volatile int made = 0;
+    omni_budget_enter(&outer, 3, -1);
+    if (setjmp(outer.jump)) {
+        Obj* err = omni_budget_error(&outer);
+        ASSERT(is_error(err));
+        ASSERT_STR_EQ(error_message(err), "budget-exceeded");
+        ASSERT_STR_EQ((char*)error_data(err)->ptr, "allocs");
+        ASSERT_EQ(made, 3);  /* Outer frame ran out first */
+        dec_ref(err);
+        PASS();
+        return;
+    }
+    omni_budget_enter(&inner, 100, -1);
+    for (;;) {
+        mk_int(made);
+        made++;
+    }
+}
+
 /* === Run all constructor tests === */
 
+/* === User type tests === */
+
+static const char* const node_fields[] = {"val", "parent"};
+static const UserType node_type = {"Node", 2, node_fields, 0x2};  /* parent is weak */
+
+void test_mk_user_fields(void) {
+    Obj* val = mk_int(7);
+    Obj* parent = mk_int(1);
+    Obj* n = mk_user(&node_type, (Obj*[]){val, parent});
+    ASSERT_NOT_NULL(n);
+    ASSERT_EQ(val->mark, 2);     /* Strong field holds a reference */
+    ASSERT_EQ(parent->mark, 1);  /* Weak field does not */
+    ASSERT_EQ(obj_to_int(user_is(&node_type, n)), 1);
+    ASSERT_EQ(obj_to_int(user_is(&node_type, val)), 0);
+
+    Obj* v = user_ref(&node_type, 0, n);
+    ASSERT(v == val);
+    ASSERT_EQ(val->mark, 3);
+    dec_ref(v);
+    ASSERT(user_ref(&node_type, 1, n) == parent);
+    ASSERT_EQ(parent->mark, 1);
+
+    dec_ref(n);
+    ASSERT_EQ(val->mark, 1);
+    ASSERT_EQ(parent->mark, 1);
+    dec_ref(val);
+    dec_ref(parent);
+    PASS();
+}
+
+void test_user_set_fields(void) {
+    Obj* a = mk_int(1);
+    Obj* b = mk_int(2);
+    Obj* n = mk_user(&node_type, (Obj*[]){a, NULL});
+    ASSERT_NULL(user_set(&node_type, 0, n, b));
+    ASSERT_EQ(a->mark, 1);
+    ASSERT_EQ(b->mark, 2);
+    ASSERT_NULL(user_set(&node_type, 1, n, a));
+    ASSERT_EQ(a->mark, 1);
+    dec_ref(n);
+    ASSERT_EQ(b->mark, 1);
+    dec_ref(a);
+    dec_ref(b);
+    PASS();
+}
+
+void test_user_ref_other_type(void) {
+    static const char* const leaf_fields[] = {"val"};
+    static const UserType leaf_type = {"Leaf", 1, leaf_fields, 0};
+    Obj* x = mk_int(3);
+    Obj* e = user_ref(&node_type, 0, x);
+    ASSERT(is_error(e));
+    ASSERT_STR_EQ(error_message(e), "Node-val: not a Node");
+    dec_ref(e);
+    Obj* leaf = mk_user(&leaf_type, (Obj*[]){x});
+    e = user_set(&node_type, 1, leaf, x);
+    ASSERT(is_error(e));
+    ASSERT_STR_EQ(error_message(e), "set-Node-parent!: not a Node");
+    dec_ref(e);
+    dec_ref(leaf);
+    dec_ref(x);
+    PASS();
+}
+
+/* Render x with print_obj_to into buf */
+static void print_to_buf(Obj* x, char* buf, size_t cap) {
+    FILE* f = tmpfile();
+    print_obj_to(f, x);
+    rewind(f);
+    size_t n = fread(buf, 1, cap - 1, f);
+    buf[n] = '\0';
+    fclose(f);
+}
+
+void test_user_prints_fields(void) {
+    Obj* val = mk_int(7);
+    Obj* n = mk_user(&node_type, (Obj*[]){val, NULL});
+    char buf[64];
+    print_to_buf(n, buf, sizeof(buf));
+    ASSERT_STR_EQ(buf, "#<Node val=7 parent=()>");
+    Obj* child = mk_user(&node_type, (Obj*[]){val, n});
+    print_to_buf(child, buf, sizeof(buf));
+    ASSERT_STR_EQ(buf, "#<Node val=7 parent=#<weak>>");
+    dec_ref(child);
+    dec_ref(n);
+    dec_ref(val);
+    PASS();
+}
+
+static Obj* print_angled(Obj** captures, Obj** args, int nargs) {
+    (void)captures; (void)nargs;
+    Obj* open = mk_sym("<");
+    Obj* close = mk_sym(">");
+    prim_display_to(open, args[1]);
+    prim_display_to(((UserObj*)args[0]->ptr)->fields[0], args[1]);
+    prim_display_to(close, args[1]);
+    dec_ref(open);
+    dec_ref(close);
+    return NULL;
+}
+
+void test_user_printer(void) {
+    static const char* const box_fields[] = {"v"};
+    static const UserType box_type = {"Box", 1, box_fields, 0};
+    Obj* bad = mk_closure(print_angled, NULL, NULL, 0, 1);
+    Obj* e = user_printer(&box_type, bad);
+    ASSERT(is_error(e));
+    ASSERT_STR_EQ(error_message(e), "define-printer Box: expected a procedure of 2 arguments");
+    dec_ref(e);
+    dec_ref(bad);
+
+    Obj* fn = mk_closure(print_angled, NULL, NULL, 0, 2);
+    ASSERT_NULL(user_printer(&box_type, fn));
+    ASSERT_EQ(fn->mark, 2);  /* The registry holds a reference */
+    Obj* v = mk_int(5);
+    Obj* b = mk_user(&box_type, (Obj*[]){v});
+    char buf[64];
+    print_to_buf(b, buf, sizeof(buf));
+    ASSERT_STR_EQ(buf, "<5>");
+    dec_ref(b);
+    dec_ref(v);
+    dec_ref(fn);
+    PASS();
+}
+
 void run_constructor_tests(void) {
     TEST_SUITE("Object Constructors");
 
@@ -336,8 +572,23 @@ void run_constructor_tests(void) {
     RUN_TEST(test_mk_error_normal);
     RUN_TEST(test_mk_error_empty);
     RUN_TEST(test_mk_error_null);
+    RUN_TEST(test_mk_error_obj_payload);
+    RUN_TEST(test_error_prims);
+    RUN_TEST(test_error_tag_prims);
+    RUN_TEST(test_mk_keyword_interned);
 
     /* mk_int_stack */
     RUN_TEST(test_mk_int_stack_normal);
     RUN_TEST(test_mk_int_stack_fallback);
+
+    /* User types */
+    RUN_TEST(test_mk_user_fields);
+    RUN_TEST(test_user_set_fields);
+    RUN_TEST(test_user_ref_other_type);
+    RUN_TEST(test_user_prints_fields);
+    RUN_TEST(test_user_printer);
+
+    /* Allocation budgets */
+    RUN_TEST(test_budget_allows_allocs_within_limit);
+    RUN_TEST(test_budget_unwinds_when_exceeded);
 }
@@ -181,6 +181,37 @@ void test_list_length_runtime_non_list(void) {
     dec_ref(val);
 }
 
+void test_list_length_checked_improper(void) {
+    Obj* list = mk_pair(mk_int(1), mk_pair(mk_int(2), mk_int(3)));
+    set_checked_lists(1);
+    Obj* len = list_length(list);
+    Obj* rev = list_reverse(list);
+    set_checked_lists(0);
+    ASSERT_TRUE(is_error(len));
+    ASSERT_STR_EQ(error_message(len), "length: improper list, non-list tail after 2 elements");
+    ASSERT_EQ(obj_to_int(error_data(len)), 3);
+    ASSERT_TRUE(is_error(rev));
+    dec_ref(len);
+    dec_ref(rev);
+    dec_ref(list);
+}
+
+void test_proper_list_predicate(void) {
+    Obj* proper = mk_pair(mk_int(1), NULL);
+    Obj* dotted = mk_pair(mk_int(1), mk_int(2));
+    Obj* yes = prim_proper_list(proper);
+    Obj* no = prim_proper_list(dotted);
+    Obj* empty = prim_proper_list(NULL);
+    ASSERT_EQ(obj_to_int(yes), 1);
+    ASSERT_EQ(obj_to_int(no), 0);
+    ASSERT_EQ(obj_to_int(empty), 1);
+    dec_ref(yes);
+    dec_ref(no);
+    dec_ref(empty);
+    dec_ref(proper);
+    dec_ref(dotted);
+}
+
 /* ========== list_append tests ========== */
 
 void test_list_append_both_non_empty(void) {
@@ -425,6 +456,34 @@ void test_list_map_non_list(void) {
     dec_ref(val);
 }
 
+/* ========== list_for_each tests ========== */
+
+static long for_each_sum = 0;
+
+static Obj* accumulate_closure_fn(Obj** caps, Obj** args, int nargs) {
+    (void)caps;
+    if (nargs < 1 || !args[0]) return NULL;
+    for_each_sum += obj_to_int(args[0]);
+    return mk_int(for_each_sum);
+}
+
+void test_list_for_each_visits_all(void) {
+    Obj* fn = mk_closure(accumulate_closure_fn, NULL, NULL, 0, 1);
+    Obj* list = mk_pair(mk_int(1), mk_pair(mk_int(2), mk_pair(mk_int(3), NULL)));
+    for_each_sum = 0;
+    Obj* result = list_for_each(fn, list);
+    ASSERT_NULL(result);
+    ASSERT_EQ(for_each_sum, 6);
+    dec_ref(list);
+    dec_ref(fn);
+}
+
+void test_list_for_each_null_fn(void) {
+    Obj* list = mk_pair(mk_int(1), NULL);
+    ASSERT_NULL(list_for_each(NULL, list));
+    dec_ref(list);
+}
+
 /* ========== list_filter tests ========== */
 
 /* Filter predicate closures - return truthy Obj* for keep */
@@ -695,6 +754,16 @@ void test_build_list_1000(void) {
     dec_ref(list);
 }
 
+void test_release_long_list(void) {
+    /* The spine is released in a loop, not one stack frame per cell */
+    Obj* list = NULL;
+    for (int i = 0; i < 1000000; i++) {
+        list = mk_pair(mk_int(i), list);
+    }
+    ASSERT_EQ(count_list_length(list), 1000000);
+    dec_ref(list);
+}
+
 void test_nested_list(void) {
     Obj* inner1 = mk_pair(mk_int(1), mk_pair(mk_int(2), NULL));
     Obj* inner2 = mk_pair(mk_int(3), mk_pair(mk_int(4), NULL));
@@ -748,6 +817,8 @@ void run_list_tests(void) {
     RUN_TEST(test_list_length_runtime_single);
     RUN_TEST(test_list_length_runtime_improper);
     RUN_TEST(test_list_length_runtime_non_list);
+    RUN_TEST(test_list_length_checked_improper);
+    RUN_TEST(test_proper_list_predicate);
 
     TEST_SECTION("List Operations - append");
     RUN_TEST(test_list_append_both_non_empty);
@@ -775,6 +846,10 @@ void run_list_tests(void) {
     RUN_TEST(test_list_map_null_fn);
     RUN_TEST(test_list_map_non_list);
 
+    TEST_SECTION("List Operations - for-each");
+    RUN_TEST(test_list_for_each_visits_all);
+    RUN_TEST(test_list_for_each_null_fn);
+
     TEST_SECTION("List Operations - filter");
     RUN_TEST(test_list_filter_empty);
     RUN_TEST(test_list_filter_keep_all);
@@ -802,6 +877,7 @@ void run_list_tests(void) {
     TEST_SECTION("List Construction");
     RUN_TEST(test_build_list_10);
     RUN_TEST(test_build_list_1000);
+    RUN_TEST(test_release_long_list);
     RUN_TEST(test_nested_list);
     RUN_TEST(test_deeply_nested_list);
 }
@@ -483,6 +483,66 @@ void test_free_tree_immediate(void) {
     PASS();
 }
 
+/* === Memory strategies === */
+
+void test_strategy_release_asap(void) {
+    set_memory_strategies(PURPLE_STRATEGY_ASAP);
+    ASSERT_EQ(get_memory_strategies(), PURPLE_STRATEGY_ASAP);
+    Obj* x = mk_pair(mk_int(1), mk_int(2));
+    strategy_release(x);  /* Frees under ASan if anything is left wrong */
+    set_memory_strategies(0);
+    PASS();
+}
+
+void test_strategy_perceus_reuses_cells(void) {
+    set_memory_strategies(PURPLE_STRATEGY_ASAP | PURPLE_STRATEGY_PERCEUS);
+    Obj* x = mk_int(1);
+    Obj* old = x;
+    strategy_release(x);
+    Obj* y = mk_int(2);
+    ASSERT(y == old);
+    ASSERT_EQ(y->i, 2);
+    ASSERT_EQ(y->mark, 1);
+    dec_ref(y);
+    set_memory_strategies(0);
+    PASS();
+}
+
+void test_strategy_arena_cells(void) {
+    set_memory_strategies(PURPLE_STRATEGY_ASAP | PURPLE_STRATEGY_ARENA);
+    Obj* x = mk_pair(mk_int(1), mk_int(2));
+    ASSERT_EQ(x->mark, -2);
+    inc_ref(x);
+    dec_ref(x);  /* RC leaves arena cells alone */
+    ASSERT_EQ(x->mark, -2);
+    strategy_release(x);
+    set_memory_strategies(0);
+    Obj* y = mk_int(3);
+    ASSERT_EQ(y->mark, 1);
+    dec_ref(y);
+    PASS();
+}
+
+void test_strategy_release_deferred(void) {
+    set_memory_strategies(PURPLE_STRATEGY_ASAP | PURPLE_STRATEGY_DEFERRED);
+    Obj* x = mk_pair(mk_int(1), mk_int(2));
+    strategy_release(x);
+    flush_deferred();
+    set_memory_strategies(0);
+    PASS();
+}
+
+void test_strategy_release_symmetric_scc(void) {
+    set_memory_strategies(PURPLE_STRATEGY_ASAP | PURPLE_STRATEGY_SYMMETRIC | PURPLE_STRATEGY_SCC);
+    Obj* shared = mk_pair(mk_int(1), NULL);
+    inc_ref(shared);
+    Obj* x = mk_pair(shared, shared);
+    strategy_release(x);
+    strategy_release(mk_int_unboxed(5));  /* Immediates are ignored */
+    set_memory_strategies(0);
+    PASS();
+}
+
 /* === Run all memory tests === */
 
 void run_memory_tests(void) {
@@ -556,4 +616,11 @@ void run_memory_tests(void) {
     RUN_TEST(test_release_children_atom);
     RUN_TEST(test_release_children_thread);
     RUN_TEST(test_free_tree_immediate);
+
+    /* Memory strategies */
+    RUN_TEST(test_strategy_release_asap);
+    RUN_TEST(test_strategy_perceus_reuses_cells);
+    RUN_TEST(test_strategy_arena_cells);
+    RUN_TEST(test_strategy_release_deferred);
+    RUN_TEST(test_strategy_release_symmetric_scc);
 }
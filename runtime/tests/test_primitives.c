@@ -163,6 +163,22 @@ void test_prim_div_by_zero(void) {
     PASS();
 }
 
+void test_prim_div_float_by_zero(void) {
+    Obj* one = mk_float(1.0);
+    Obj* zero = mk_float(0.0);
+    Obj* r = prim_div(one, zero);
+    ASSERT(isinf(r->f) && r->f > 0);
+    dec_ref(r);
+    r = prim_div(mk_int(-1), zero);
+    ASSERT(isinf(r->f) && r->f < 0);
+    dec_ref(r);
+    r = prim_div(zero, zero);
+    ASSERT(isnan(r->f));
+    dec_ref(r);
+    dec_ref(one); dec_ref(zero);
+    PASS();
+}
+
 void test_prim_mod_normal(void) {
     Obj* a = mk_int(10);
     Obj* b = mk_int(3);
@@ -438,6 +454,141 @@ void test_prim_sym_false(void) {
     PASS();
 }
 
+/* === String tests === */
+
+void test_string_primitives(void) {
+    Obj* a = mk_string("foo");
+    Obj* b = mk_string("bar");
+    Obj* s = prim_string_append(a, b);
+    ASSERT(obj_to_int(prim_is_string(s)) == 1);
+    ASSERT_STR_EQ((char*)s->ptr, "foobar");
+
+    Obj* n = prim_string_length(s);
+    ASSERT(obj_to_int(n) == 6);
+    Obj* c = prim_string_ref(s, mk_int(3));
+    ASSERT(obj_to_char_val(c) == 'b');
+    Obj* sub = prim_substring(s, mk_int(1), mk_int(4));
+    ASSERT_STR_EQ((char*)sub->ptr, "oob");
+    ASSERT(obj_to_int(prim_is_eq(sub, mk_string("oob"))) == 1);
+
+    dec_ref(sub); dec_ref(c); dec_ref(n); dec_ref(s); dec_ref(b); dec_ref(a);
+    PASS();
+}
+
+void test_string_primitive_errors(void) {
+    Obj* s = mk_string("abc");
+    Obj* e1 = prim_string_ref(s, mk_int(3));
+    Obj* e2 = prim_substring(s, mk_int(2), mk_int(1));
+    Obj* e3 = prim_string_length(mk_sym("abc"));
+    ASSERT_STR_EQ(error_message(e1), "string-ref: index out of range");
+    ASSERT_STR_EQ(error_message(e2), "substring: index out of range");
+    ASSERT_STR_EQ(error_message(e3), "string-length: not a string");
+    dec_ref(e3); dec_ref(e2); dec_ref(e1); dec_ref(s);
+    PASS();
+}
+
+void test_vector_primitives(void) {
+    Obj* pair = mk_pair(mk_int(1), mk_int(2));
+    Obj* v = prim_vector_of((Obj*[]){ mk_int_unboxed(7), pair }, 2);
+    ASSERT(obj_to_int(prim_is_vector(v)) == 1);
+    ASSERT(obj_to_int(prim_vector_length(v)) == 2);
+    ASSERT_EQ(pair->mark, 2);  /* the slot holds its own reference */
+
+    Obj* first = prim_vector_ref(v, mk_int(0));
+    ASSERT(obj_to_int(first) == 7);
+    ASSERT_NULL(prim_vector_set(v, mk_int(1), mk_int_unboxed(9)));
+    ASSERT_EQ(pair->mark, 1);  /* overwriting released it */
+    Obj* second = prim_vector_ref(v, mk_int(1));
+    ASSERT(obj_to_int(second) == 9);
+
+    Obj* filled = prim_make_vector(mk_int(3), pair);
+    ASSERT_EQ(pair->mark, 4);
+    dec_ref(filled);
+    ASSERT_EQ(pair->mark, 1);  /* freeing the vector releases every slot */
+
+    dec_ref(pair); dec_ref(v);
+    PASS();
+}
+
+void test_vector_primitive_errors(void) {
+    Obj* v = prim_make_vector(mk_int(2), NULL);
+    Obj* e1 = prim_vector_ref(v, mk_int(2));
+    Obj* e2 = prim_vector_set(v, mk_int(-1), NULL);
+    Obj* e3 = prim_vector_length(mk_string("ab"));
+    Obj* e4 = prim_make_vector(mk_int(-1), NULL);
+    ASSERT_STR_EQ(error_message(e1), "vector-ref: index out of range");
+    ASSERT_STR_EQ(error_message(e2), "vector-set!: index out of range");
+    ASSERT_STR_EQ(error_message(e3), "vector-length: not a vector");
+    ASSERT_STR_EQ(error_message(e4), "make-vector: length must be a non-negative integer");
+    dec_ref(e4); dec_ref(e3); dec_ref(e2); dec_ref(e1); dec_ref(v);
+    PASS();
+}
+
+void test_hash_primitives(void) {
+    Obj* h = prim_make_hash();
+    Obj* key = mk_string("k");
+    Obj* val = mk_pair(mk_int(1), mk_int(2));
+    ASSERT(obj_to_int(prim_is_hash(h)) == 1);
+    ASSERT_NULL(prim_hash_set(h, key, val));
+    ASSERT_EQ(key->mark, 2);  /* the table holds its own references */
+    ASSERT_EQ(val->mark, 2);
+
+    /* Keys compare with eq?, so an equal string finds the entry */
+    Obj* probe = mk_string("k");
+    Obj* got = prim_hash_get(h, probe);
+    ASSERT(got == val);
+    ASSERT_EQ(val->mark, 3);
+    dec_ref(got);
+    ASSERT_NULL(prim_hash_get(h, mk_int(5)));
+
+    /* Replacing keeps the stored key and releases the old value */
+    ASSERT_NULL(prim_hash_set(h, probe, mk_int_unboxed(9)));
+    ASSERT_EQ(val->mark, 1);
+    ASSERT_EQ(probe->mark, 1);
+    ASSERT(obj_to_int(prim_hash_count(h)) == 1);
+
+    ASSERT_NULL(prim_hash_remove(h, probe));
+    ASSERT_EQ(key->mark, 1);
+    ASSERT(obj_to_int(prim_hash_count(h)) == 0);
+
+    /* Freeing the table releases every key and value */
+    ASSERT_NULL(prim_hash_set(h, key, val));
+    dec_ref(h);
+    ASSERT_EQ(key->mark, 1);
+    ASSERT_EQ(val->mark, 1);
+
+    dec_ref(probe); dec_ref(key); dec_ref(val);
+    PASS();
+}
+
+void test_hash_keys_in_insertion_order(void) {
+    Obj* h = prim_make_hash();
+    for (long i = 0; i < 100; i++) {
+        prim_hash_set(h, mk_int_unboxed(99 - i), mk_int_unboxed(i));
+    }
+    for (long i = 0; i < 100; i += 2) {
+        prim_hash_remove(h, mk_int_unboxed(i));
+    }
+    Obj* keys = prim_hash_keys(h);
+    long expect = 99, n = 0;
+    for (Obj* k = keys; k; k = k->b, expect -= 2, n++) {
+        ASSERT(obj_to_int(k->a) == expect);
+    }
+    ASSERT(n == 50);
+    ASSERT(obj_to_int(prim_hash_get(h, mk_int_unboxed(51))) == 48);
+    dec_ref(keys); dec_ref(h);
+    PASS();
+}
+
+void test_hash_primitive_errors(void) {
+    Obj* e1 = prim_hash_get(mk_int(1), mk_int(2));
+    Obj* e2 = prim_hash_keys(NULL);
+    ASSERT_STR_EQ(error_message(e1), "hash-get: not a hash table");
+    ASSERT_STR_EQ(error_message(e2), "hash-keys: not a hash table");
+    dec_ref(e2); dec_ref(e1);
+    PASS();
+}
+
 /* === Character/Float conversion tests === */
 
 void test_char_to_int(void) {
@@ -606,6 +757,156 @@ void test_is_truthy_pair(void) {
     PASS();
 }
 
+/* === write vs display tests === */
+
+/* Render x with write_obj_to into buf */
+static void write_to_buf(Obj* x, char* buf, size_t cap) {
+    FILE* f = tmpfile();
+    write_obj_to(f, x);
+    rewind(f);
+    size_t n = fread(buf, 1, cap - 1, f);
+    buf[n] = '\0';
+    fclose(f);
+}
+
+void test_write_chars(void) {
+    char buf[64];
+    write_to_buf(mk_char('a'), buf, sizeof(buf));
+    ASSERT_STR_EQ(buf, "#\\a");
+    write_to_buf(mk_char('\n'), buf, sizeof(buf));
+    ASSERT_STR_EQ(buf, "#\\newline");
+    write_to_buf(mk_char(1), buf, sizeof(buf));
+    ASSERT_STR_EQ(buf, "#\\x01");
+    PASS();
+}
+
+void test_write_string_escapes(void) {
+    char buf[64];
+    Obj* s = mk_pair(mk_char('a'), mk_pair(mk_char('"'),
+             mk_pair(mk_char('\n'), mk_pair(mk_char(7), NULL))));
+    write_to_buf(s, buf, sizeof(buf));
+    ASSERT_STR_EQ(buf, "\"a\\\"\\n\\x07;\"");
+    dec_ref(s);
+    PASS();
+}
+
+void test_write_nested_list(void) {
+    char buf[64];
+    Obj* l = mk_pair(mk_sym("x"), mk_pair(mk_char(' '), mk_pair(mk_int(3), NULL)));
+    write_to_buf(l, buf, sizeof(buf));
+    ASSERT_STR_EQ(buf, "(x #\\space 3)");
+    dec_ref(l);
+    PASS();
+}
+
+void test_format_float_round_trip(void) {
+    char buf[32];
+    double samples[] = { 0.1, 1.0 / 3.0, 2.5, -0.0, 1e100, 123456789.125, 5e-324 };
+    for (size_t i = 0; i < sizeof(samples) / sizeof(samples[0]); i++) {
+        format_float(buf, sizeof(buf), samples[i]);
+        ASSERT(strtod(buf, NULL) == samples[i]);
+    }
+    format_float(buf, sizeof(buf), 0.1);
+    ASSERT_STR_EQ(buf, "0.1");
+    format_float(buf, sizeof(buf), 3.0);
+    ASSERT_STR_EQ(buf, "3.0");
+    format_float(buf, sizeof(buf), 1e100);
+    ASSERT_STR_EQ(buf, "1e+100");
+    PASS();
+}
+
+void test_format_float_plain_range(void) {
+    char buf[32];
+    format_float(buf, sizeof(buf), 100.0);
+    ASSERT_STR_EQ(buf, "100.0");
+    format_float(buf, sizeof(buf), 1500.0);
+    ASSERT_STR_EQ(buf, "1500.0");
+    format_float(buf, sizeof(buf), -0.00025);
+    ASSERT_STR_EQ(buf, "-0.00025");
+    format_float(buf, sizeof(buf), 1e20);
+    ASSERT_STR_EQ(buf, "100000000000000000000.0");
+    /* Exponents outside [1e-7, 1e21) */
+    format_float(buf, sizeof(buf), 1e21);
+    ASSERT_STR_EQ(buf, "1e+21");
+    format_float(buf, sizeof(buf), 1.5e-8);
+    ASSERT_STR_EQ(buf, "1.5e-08");
+    PASS();
+}
+
+void test_num_compare_mixed(void) {
+    Obj* one = mk_int(1);
+    Obj* one_f = mk_float(1.0);
+    Obj* two_half = mk_float(2.5);
+    Obj* big = mk_int(9007199254740993L);
+    Obj* big_f = mk_float(9007199254740992.0);
+    Obj* nan = mk_float(0.0 / 0.0);
+
+    ASSERT_EQ(num_compare(one, one_f), 0);
+    ASSERT_EQ(num_compare(one, two_half), -1);
+    ASSERT_EQ(num_compare(two_half, one), 1);
+    ASSERT_EQ(num_compare(big, big_f), 1);
+    ASSERT_EQ(num_compare(nan, one), 2);
+    ASSERT_EQ(num_compare(nan, nan), 2);
+
+    ASSERT(is_truthy(prim_eq(one, one_f)));
+    ASSERT(!is_truthy(prim_eq(big, big_f)));
+    ASSERT(is_truthy(prim_lt(big_f, big)));
+    ASSERT(!is_truthy(prim_lt(nan, one)));
+    ASSERT(!is_truthy(prim_ge(nan, one)));
+    ASSERT(!is_truthy(prim_eq(nan, nan)));
+
+    dec_ref(one); dec_ref(one_f); dec_ref(two_half);
+    dec_ref(big); dec_ref(big_f); dec_ref(nan);
+    PASS();
+}
+
+void test_numeric_library(void) {
+    Obj* two = mk_int(2);
+    Obj* ten = mk_int(10);
+    Obj* sixteen = mk_int(16);
+    Obj* half = mk_float(0.5);
+    Obj* neg = mk_int(-18);
+    Obj* twelve = mk_int(12);
+
+    Obj* r = prim_expt(two, ten);
+    ASSERT_EQ(obj_tag(r), TAG_INT);
+    ASSERT_EQ(obj_to_int(r), 1024);
+    r = prim_expt(two, mk_int(-1));
+    ASSERT_EQ_FLOAT(r->f, 0.5, 1e-12);
+    r = prim_sqrt(sixteen);
+    ASSERT_EQ(obj_tag(r), TAG_INT);
+    ASSERT_EQ(obj_to_int(r), 4);
+    r = prim_sqrt(two);
+    ASSERT_EQ(obj_tag(r), TAG_FLOAT);
+    r = prim_min(two, half);
+    ASSERT_EQ_FLOAT(r->f, 0.5, 1e-12);
+    r = prim_max(two, half);
+    ASSERT_EQ(obj_tag(r), TAG_FLOAT);
+    ASSERT_EQ_FLOAT(r->f, 2.0, 1e-12);
+    ASSERT_EQ(obj_to_int(prim_max(two, ten)), 10);
+    ASSERT_EQ(obj_to_int(prim_gcd(twelve, neg)), 6);
+    ASSERT_EQ(obj_to_int(prim_lcm(twelve, neg)), 36);
+    ASSERT_EQ(obj_to_int(prim_lcm(twelve, mk_int(0))), 0);
+    r = prim_expt(two, mk_int(64));
+    ASSERT_EQ(obj_tag(r), TAG_FLOAT);
+    ASSERT_EQ_FLOAT(r->f, 18446744073709551616.0, 1.0);
+    r = prim_gcd(mk_float(2.0), mk_int(4));
+    ASSERT_EQ(obj_tag(r), TAG_FLOAT);
+    ASSERT_EQ_FLOAT(r->f, 2.0, 1e-12);
+    ASSERT_TRUE(is_error(prim_gcd(mk_float(1.5), mk_int(3))));
+    ASSERT_TRUE(is_error(prim_lcm(mk_int(3), mk_float(NAN))));
+    r = prim_gcd(mk_int(LONG_MIN), mk_int(0));
+    ASSERT_EQ(obj_tag(r), TAG_FLOAT);
+    ASSERT_EQ_FLOAT(r->f, 9223372036854775808.0, 1.0);
+    r = prim_lcm(mk_int(4294967296L), mk_int(4294967297L));
+    ASSERT_EQ(obj_tag(r), TAG_FLOAT);
+    ASSERT_EQ_FLOAT(r->f, 18446744078004518912.0, 4096.0);
+
+    dec_ref(two); dec_ref(ten); dec_ref(sixteen);
+    dec_ref(half); dec_ref(neg); dec_ref(twelve);
+    PASS();
+}
+
 /* === Run all primitive tests === */
 
 void run_primitive_tests(void) {
@@ -629,6 +930,7 @@ void run_primitive_tests(void) {
     RUN_TEST(test_prim_div_immediates);
     RUN_TEST(test_prim_div_floats);
     RUN_TEST(test_prim_div_by_zero);
+    RUN_TEST(test_prim_div_float_by_zero);
     RUN_TEST(test_prim_mod_normal);
     RUN_TEST(test_prim_mod_immediates);
     RUN_TEST(test_prim_mod_negative);
@@ -666,6 +968,15 @@ void run_primitive_tests(void) {
     RUN_TEST(test_prim_sym_true);
     RUN_TEST(test_prim_sym_false);
 
+    /* Strings */
+    RUN_TEST(test_string_primitives);
+    RUN_TEST(test_string_primitive_errors);
+    RUN_TEST(test_vector_primitives);
+    RUN_TEST(test_vector_primitive_errors);
+    RUN_TEST(test_hash_primitives);
+    RUN_TEST(test_hash_keys_in_insertion_order);
+    RUN_TEST(test_hash_primitive_errors);
+
     /* Conversions */
     RUN_TEST(test_char_to_int);
     RUN_TEST(test_char_to_int_wrong_type);
@@ -690,4 +1001,17 @@ void run_primitive_tests(void) {
     RUN_TEST(test_is_truthy_zero);
     RUN_TEST(test_is_truthy_nonzero);
     RUN_TEST(test_is_truthy_pair);
+
+    /* write */
+    RUN_TEST(test_write_chars);
+    RUN_TEST(test_write_string_escapes);
+    RUN_TEST(test_write_nested_list);
+    RUN_TEST(test_format_float_round_trip);
+    RUN_TEST(test_format_float_plain_range);
+
+    /* Numeric tower comparison */
+    RUN_TEST(test_num_compare_mixed);
+
+    /* Numeric library */
+    RUN_TEST(test_numeric_library);
 }
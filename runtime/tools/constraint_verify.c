@@ -0,0 +1,45 @@
+/*
+ * constraint-verify - replay constraint traces and report violations
+ *
+ * Usage: constraint-verify trace...
+ *
+ * Traces come from programs built with `omnilisp --constraint-check` and
+ * run with PURPLE_CONSTRAINT_TRACE set. Exits 1 if any trace has a
+ * violation or can't be read, so it can gate CI.
+ */
+
+#include <stdio.h>
+#include "constraint_trace.h"
+
+int main(int argc, char** argv) {
+    if (argc < 2) {
+        fprintf(stderr, "Usage: %s trace...\n", argv[0]);
+        return 2;
+    }
+
+    int failed = 0;
+    for (int i = 1; i < argc; i++) {
+        ConstraintTrace* trace = constraint_trace_load(argv[i]);
+        if (!trace) {
+            fprintf(stderr, "%s: cannot read trace\n", argv[i]);
+            failed = 1;
+            continue;
+        }
+        if (trace->error) {
+            fprintf(stderr, "%s: %s\n", argv[i], trace->error);
+            failed = 1;
+        }
+
+        ConstraintContext* ctx = constraint_context_new(false);
+        constraint_trace_verify(ctx, trace);
+        for (int v = 0; v < constraint_get_violation_count(ctx); v++) {
+            printf("%s: %s\n", argv[i], constraint_get_violation(ctx, v));
+        }
+        if (constraint_has_violations(ctx)) failed = 1;
+        else if (!trace->error) printf("%s: %d events, no violations\n", argv[i], trace->event_count);
+
+        constraint_context_free(ctx);
+        constraint_trace_free(trace);
+    }
+    return failed;
+}